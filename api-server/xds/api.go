@@ -8,28 +8,90 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 )
 
-// ConfigAPI provides HTTP endpoints for configuration updates
+// ConfigAPI provides HTTP endpoints for configuration updates. Every
+// endpoint takes a group query parameter selecting the node group it
+// applies to, the default node ID when absent.
 type ConfigAPI struct {
-	cache           *SnapshotCache
-	nodeID          string
-	mu              sync.RWMutex
+	cache      *SnapshotCache
+	nodeID     string
+	mu         sync.RWMutex
+	groups     map[string]*nodeGroup
+	maxHistory int
+	tracker    *ApplyTracker
+}
+
+// nodeGroup is the configuration state of one node group, versioned
+// independently of the others
+type nodeGroup struct {
 	version         int
-	snapshotHistory map[int]string // Store version strings for rollback
-	maxHistory      int
+	snapshotHistory map[int]string          // Store version strings for rollback
+	snapshots       map[int]*cache.Snapshot // Snapshots of the versions in history, for diffs
 }
 
-// NewConfigAPI creates a new configuration API
-func NewConfigAPI(cache *SnapshotCache, nodeID string) *ConfigAPI {
+// NewConfigAPI creates a new configuration API. The tracker, if any, is
+// told of every snapshot pushed.
+func NewConfigAPI(snapshotCache *SnapshotCache, nodeID string, tracker *ApplyTracker) *ConfigAPI {
 	return &ConfigAPI{
-		cache:           cache,
-		nodeID:          nodeID,
-		version:         1,
-		snapshotHistory: make(map[int]string),
-		maxHistory:      10, // Keep last 10 snapshots for rollback
+		cache:      snapshotCache,
+		nodeID:     nodeID,
+		groups:     make(map[string]*nodeGroup),
+		maxHistory: 10, // Keep last 10 snapshots for rollback
+		tracker:    tracker,
+	}
+}
+
+// groupName returns the node group a request applies to
+func (api *ConfigAPI) groupName(r *http.Request) string {
+	if group := r.URL.Query().Get("group"); group != "" {
+		return group
+	}
+	return api.nodeID
+}
+
+// group returns the state of a node group, creating it on first use. The
+// caller holds api.mu for writing.
+func (api *ConfigAPI) group(name string) *nodeGroup {
+	group, exists := api.groups[name]
+	if !exists {
+		group = &nodeGroup{
+			version:         1,
+			snapshotHistory: make(map[int]string),
+			snapshots:       make(map[int]*cache.Snapshot),
+		}
+		api.groups[name] = group
+
+		// Version 1 is the empty configuration a group starts from, kept
+		// so the first update can be diffed against it
+		initial, _ := cache.NewSnapshot("1", map[resource.Type][]types.Resource{
+			resource.EndpointType: nil,
+			resource.ClusterType:  nil,
+			resource.RouteType:    nil,
+			resource.ListenerType: nil,
+		})
+		api.storeSnapshotInHistory(group, 1, "1", initial)
 	}
+	return group
+}
+
+// groupVersion returns the current version of a node group without
+// creating it
+func (api *ConfigAPI) groupVersion(name string) int {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+
+	if group, exists := api.groups[name]; exists {
+		return group.version
+	}
+	return 1
 }
 
 // UpdateConfigHandler handles configuration update requests from the API server
@@ -57,9 +119,12 @@ func (api *ConfigAPI) UpdateConfigHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Generate new version
+	groupName := api.groupName(r)
 	api.mu.Lock()
-	api.version++
-	version := fmt.Sprintf("%d", api.version)
+	group := api.group(groupName)
+	group.version++
+	versionNumber := group.version
+	version := fmt.Sprintf("%d", versionNumber)
 	config.Version = version
 	api.mu.Unlock()
 
@@ -72,16 +137,22 @@ func (api *ConfigAPI) UpdateConfigHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Update cache
-	if err := api.cache.SetSnapshot(context.Background(), api.nodeID, snapshot); err != nil {
+	if err := api.cache.SetSnapshot(context.Background(), groupName, snapshot); err != nil {
 		log.Printf("Failed to set snapshot: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to update configuration: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Store snapshot version in history for rollback capability
-	api.storeSnapshotInHistory(api.version, version)
+	api.mu.Lock()
+	api.storeSnapshotInHistory(group, versionNumber, version, snapshot)
+	api.mu.Unlock()
 
-	log.Printf("Configuration updated to version %s", version)
+	if api.tracker != nil {
+		api.tracker.Pushed(groupName, version)
+	}
+
+	log.Printf("Configuration of node group %s updated to version %s", groupName, version)
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
@@ -89,24 +160,28 @@ func (api *ConfigAPI) UpdateConfigHandler(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":  "success",
 		"version": version,
+		"group":   groupName,
 		"message": "Configuration updated successfully",
 	})
 }
 
 // storeSnapshotInHistory stores a snapshot version for rollback capability
-func (api *ConfigAPI) storeSnapshotInHistory(version int, versionString string) {
-	api.snapshotHistory[version] = versionString
+// and diffs in a node group's history. The caller holds api.mu.
+func (api *ConfigAPI) storeSnapshotInHistory(group *nodeGroup, version int, versionString string, snapshot *cache.Snapshot) {
+	group.snapshotHistory[version] = versionString
+	group.snapshots[version] = snapshot
 
 	// Remove oldest snapshots if we exceed maxHistory
-	if len(api.snapshotHistory) > api.maxHistory {
+	if len(group.snapshotHistory) > api.maxHistory {
 		// Find oldest version
 		oldestVersion := version
-		for v := range api.snapshotHistory {
+		for v := range group.snapshotHistory {
 			if v < oldestVersion {
 				oldestVersion = v
 			}
 		}
-		delete(api.snapshotHistory, oldestVersion)
+		delete(group.snapshotHistory, oldestVersion)
+		delete(group.snapshots, oldestVersion)
 	}
 }
 
@@ -117,15 +192,46 @@ func (api *ConfigAPI) GetConfigHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	api.mu.RLock()
-	version := api.version
-	api.mu.RUnlock()
+	groupName := api.groupName(r)
+	version := api.groupVersion(groupName)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"version": version,
 		"node_id": api.nodeID,
+		"group":   groupName,
+	})
+}
+
+// GroupsHandler lists the node groups that have been configured, with
+// their current version and the versions kept for rollback
+func (api *ConfigAPI) GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	api.mu.RLock()
+	groups := make(map[string]interface{}, len(api.groups))
+	for name, group := range api.groups {
+		history := make([]int, 0, len(group.snapshotHistory))
+		for version := range group.snapshotHistory {
+			history = append(history, version)
+		}
+		sort.Ints(history)
+		groups[name] = map[string]interface{}{
+			"version": group.version,
+			"history": history,
+		}
+	}
+	api.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default_group": api.nodeID,
+		"groups":        groups,
 	})
 }
 
@@ -134,7 +240,7 @@ func (api *ConfigAPI) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "healthy",
+		"status":  "healthy",
 		"service": "marchproxy-xds-server",
 	})
 }
@@ -153,9 +259,14 @@ func (api *ConfigAPI) GetSnapshotHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	groupName := api.groupName(r)
 	api.mu.RLock()
-	_, exists := api.snapshotHistory[requestedVersion]
-	currentVersion := api.version
+	var exists bool
+	currentVersion := 1
+	if group, ok := api.groups[groupName]; ok {
+		_, exists = group.snapshotHistory[requestedVersion]
+		currentVersion = group.version
+	}
 	api.mu.RUnlock()
 
 	if !exists {
@@ -169,6 +280,7 @@ func (api *ConfigAPI) GetSnapshotHandler(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"version":         requestedVersion,
 		"current_version": currentVersion,
+		"group":           groupName,
 		"available":       true,
 	})
 }
@@ -187,8 +299,13 @@ func (api *ConfigAPI) RollbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	groupName := api.groupName(r)
 	api.mu.Lock()
-	versionString, exists := api.snapshotHistory[targetVersion]
+	group, exists := api.groups[groupName]
+	var versionString string
+	if exists {
+		versionString, exists = group.snapshotHistory[targetVersion]
+	}
 	if !exists {
 		api.mu.Unlock()
 		http.Error(w, "Target version not found in history", http.StatusNotFound)
@@ -196,24 +313,118 @@ func (api *ConfigAPI) RollbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create new version for the rollback
-	api.version++
-	newVersion := api.version
+	group.version++
+	newVersion := group.version
 	api.mu.Unlock()
 
-	log.Printf("Rolled back to version %d (new version: %d, version string: %s)", targetVersion, newVersion, versionString)
+	log.Printf("Rolled back node group %s to version %d (new version: %d, version string: %s)", groupName, targetVersion, newVersion, versionString)
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":          "success",
-		"rolled_back_to":  targetVersion,
-		"new_version":     newVersion,
-		"version_string":  versionString,
-		"message":         fmt.Sprintf("Successfully rolled back to version %d", targetVersion),
+		"status":         "success",
+		"rolled_back_to": targetVersion,
+		"new_version":    newVersion,
+		"version_string": versionString,
+		"group":          groupName,
+		"message":        fmt.Sprintf("Successfully rolled back to version %d", targetVersion),
 	})
 }
 
+// DiffHandler returns what an update changes. GET /v1/diff?from=X&to=Y
+// compares two snapshot versions in history; to defaults to the current
+// version and from to the one before it. POST /v1/diff?from=X previews a
+// configuration in the request body against version from, the current one
+// by default, without applying it.
+func (api *ConfigAPI) DiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupName := api.groupName(r)
+	currentVersion := api.groupVersion(groupName)
+
+	toVersion, err := versionParam(r, "to", currentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fromDefault := toVersion - 1
+	if r.Method == http.MethodPost {
+		fromDefault = currentVersion
+	}
+	fromVersion, err := versionParam(r, "from", fromDefault)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var from, to *cache.Snapshot
+	var fromExists, toExists bool
+	api.mu.RLock()
+	if group, ok := api.groups[groupName]; ok {
+		from, fromExists = group.snapshots[fromVersion]
+		to, toExists = group.snapshots[toVersion]
+	}
+	api.mu.RUnlock()
+
+	if !fromExists {
+		http.Error(w, fmt.Sprintf("Snapshot version %d not found in history", fromVersion), http.StatusNotFound)
+		return
+	}
+
+	// Preview a pending configuration
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		config, err := ParseConfig(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid configuration: %v", err), http.StatusBadRequest)
+			return
+		}
+		config.Version = "pending"
+		if to, err = GenerateSnapshot(*config); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to generate snapshot: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else if !toExists {
+		http.Error(w, fmt.Sprintf("Snapshot version %d not found in history", toVersion), http.StatusNotFound)
+		return
+	}
+
+	diff, err := DiffSnapshots(from, to)
+	if err != nil {
+		log.Printf("Failed to diff snapshots: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to diff snapshots: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(diff)
+}
+
+// versionParam reads a snapshot version from the query parameter name,
+// returning defaultVersion when it is absent
+func versionParam(r *http.Request, name string, defaultVersion int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultVersion, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s version %q", name, value)
+	}
+	return version, nil
+}
+
 // StartHTTPAPI starts the HTTP API server for configuration updates
 func StartHTTPAPI(api *ConfigAPI, port uint) {
 	mux := http.NewServeMux()
@@ -221,6 +432,8 @@ func StartHTTPAPI(api *ConfigAPI, port uint) {
 	mux.HandleFunc("/v1/version", api.GetConfigHandler)
 	mux.HandleFunc("/v1/snapshot/", api.GetSnapshotHandler)
 	mux.HandleFunc("/v1/rollback/", api.RollbackHandler)
+	mux.HandleFunc("/v1/diff", api.DiffHandler)
+	mux.HandleFunc("/v1/groups", api.GroupsHandler)
 	mux.HandleFunc("/healthz", api.HealthHandler)
 
 	addr := fmt.Sprintf(":%d", port)
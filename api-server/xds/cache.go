@@ -10,32 +10,37 @@ import (
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 )
 
-// SnapshotCache wraps the go-control-plane snapshot cache
+// SnapshotCache wraps the go-control-plane snapshot cache. Snapshots are
+// keyed by node group, as computed by the cache's node hash, so each group
+// is configured and versioned independently.
 type SnapshotCache struct {
 	cache.SnapshotCache
-	mu      sync.RWMutex
-	version int64
-	debug   bool
+	mu       sync.RWMutex
+	version  int64
+	versions map[string]int64 // Snapshots set per node group
+	debug    bool
 }
 
-// NewSnapshotCache creates a new snapshot cache
-func NewSnapshotCache(debug bool) *SnapshotCache {
+// NewSnapshotCache creates a new snapshot cache grouping nodes with hash
+func NewSnapshotCache(debug bool, hash cache.NodeHash) *SnapshotCache {
 	return &SnapshotCache{
-		SnapshotCache: cache.NewSnapshotCache(false, cache.IDHash{}, nil),
+		SnapshotCache: cache.NewSnapshotCache(false, hash, nil),
 		version:       0,
+		versions:      make(map[string]int64),
 		debug:         debug,
 	}
 }
 
-// SetSnapshot sets a new snapshot for the given node
+// SetSnapshot sets a new snapshot for the given node group
 func (c *SnapshotCache) SetSnapshot(ctx context.Context, nodeID string, snapshot *cache.Snapshot) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.version++
+	c.versions[nodeID]++
 
 	if c.debug {
-		fmt.Printf("Setting snapshot v%d for node %s\n", c.version, nodeID)
+		fmt.Printf("Setting snapshot v%d for node group %s\n", c.version, nodeID)
 		fmt.Printf("  Listeners: %d\n", len(snapshot.GetResources(resource.ListenerType)))
 		fmt.Printf("  Routes: %d\n", len(snapshot.GetResources(resource.RouteType)))
 		fmt.Printf("  Clusters: %d\n", len(snapshot.GetResources(resource.ClusterType)))
@@ -58,15 +63,28 @@ func (c *SnapshotCache) GetVersion() int64 {
 	return c.version
 }
 
+// GetGroupVersions returns the number of snapshots set for each node group
+func (c *SnapshotCache) GetGroupVersions() map[string]int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	versions := make(map[string]int64, len(c.versions))
+	for group, version := range c.versions {
+		versions[group] = version
+	}
+	return versions
+}
+
 // ClearSnapshot clears the snapshot for a given node
 func (c *SnapshotCache) ClearSnapshot(nodeID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.debug {
-		fmt.Printf("Clearing snapshot for node %s\n", nodeID)
+		fmt.Printf("Clearing snapshot for node group %s\n", nodeID)
 	}
 
+	delete(c.versions, nodeID)
 	c.SnapshotCache.ClearSnapshot(nodeID)
 }
 
@@ -112,7 +130,8 @@ func (c *SnapshotCache) GetStats() map[string]interface{} {
 	defer c.mu.RUnlock()
 
 	return map[string]interface{}{
-		"version": c.version,
+		"version":     c.version,
+		"node_groups": len(c.versions),
 		// Additional stats can be added here
 	}
 }
@@ -16,6 +16,7 @@ type Callbacks struct {
 	Fetches  uint32
 	Requests uint32
 	Debug    bool
+	Tracker  *ApplyTracker // Follows ACKs and NACKs for webhooks, optional
 }
 
 var _ server.Callbacks = &Callbacks{}
@@ -33,6 +34,9 @@ func (cb *Callbacks) OnStreamClosed(id int64, node *core.Node) {
 	if cb.Debug {
 		fmt.Printf("Stream closed: id=%d node=%s\n", id, node.GetId())
 	}
+	if cb.Tracker != nil {
+		cb.Tracker.OnStreamClosed(id)
+	}
 }
 
 // OnStreamRequest is called when a request is received on a stream
@@ -42,6 +46,9 @@ func (cb *Callbacks) OnStreamRequest(id int64, req *discovery.DiscoveryRequest)
 		fmt.Printf("Stream request: id=%d node=%s type=%s version=%s\n",
 			id, req.GetNode().GetId(), req.GetTypeUrl(), req.GetVersionInfo())
 	}
+	if cb.Tracker != nil {
+		cb.Tracker.OnRequest(id, req)
+	}
 	return nil
 }
 
@@ -51,6 +58,9 @@ func (cb *Callbacks) OnStreamResponse(ctx context.Context, id int64, req *discov
 		fmt.Printf("Stream response: id=%d node=%s type=%s version=%s\n",
 			id, req.GetNode().GetId(), req.GetTypeUrl(), resp.GetVersionInfo())
 	}
+	if cb.Tracker != nil {
+		cb.Tracker.OnResponse(id, req, resp)
+	}
 }
 
 // OnFetchRequest is called when a fetch request is received
@@ -0,0 +1,154 @@
+// Snapshot comparison for the diff endpoint
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// FieldChange is a top-level field of a resource that differs between two
+// snapshots, with its values in each. A field missing from one side is
+// unset there.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// ResourceChange is a resource present in both snapshots that differs
+type ResourceChange struct {
+	Name   string        `json:"name"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// ResourceDiff lists the resources of one type added, removed and changed
+// between two snapshots
+type ResourceDiff struct {
+	Added   []string         `json:"added"`
+	Removed []string         `json:"removed"`
+	Changed []ResourceChange `json:"changed"`
+}
+
+// Empty reports whether the resources are the same in both snapshots
+func (d ResourceDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// SnapshotDiff is what an update from one snapshot to another changes.
+// Secrets are left out so keys never leave the server.
+type SnapshotDiff struct {
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Changed   bool         `json:"changed"`
+	Listeners ResourceDiff `json:"listeners"`
+	Clusters  ResourceDiff `json:"clusters"`
+	Routes    ResourceDiff `json:"routes"`
+}
+
+// DiffSnapshots compares the listeners, clusters and routes of two
+// snapshots
+func DiffSnapshots(from, to *cache.Snapshot) (*SnapshotDiff, error) {
+	diff := &SnapshotDiff{
+		From: from.GetVersion(resource.ListenerType),
+		To:   to.GetVersion(resource.ListenerType),
+	}
+
+	var err error
+	if diff.Listeners, err = diffResources(from, to, resource.ListenerType); err != nil {
+		return nil, err
+	}
+	if diff.Clusters, err = diffResources(from, to, resource.ClusterType); err != nil {
+		return nil, err
+	}
+	if diff.Routes, err = diffResources(from, to, resource.RouteType); err != nil {
+		return nil, err
+	}
+	diff.Changed = !diff.Listeners.Empty() || !diff.Clusters.Empty() || !diff.Routes.Empty()
+	return diff, nil
+}
+
+// diffResources compares the resources of typeURL in two snapshots by name
+func diffResources(from, to *cache.Snapshot, typeURL string) (ResourceDiff, error) {
+	before := from.GetResources(typeURL)
+	after := to.GetResources(typeURL)
+	diff := ResourceDiff{Added: []string{}, Removed: []string{}, Changed: []ResourceChange{}}
+
+	for name, resourceAfter := range after {
+		resourceBefore, exists := before[name]
+		if !exists {
+			diff.Added = append(diff.Added, name)
+			continue
+		}
+		fields, err := diffFields(resourceBefore, resourceAfter)
+		if err != nil {
+			return diff, fmt.Errorf("failed to compare %s: %w", name, err)
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ResourceChange{Name: name, Fields: fields})
+		}
+	}
+	for name := range before {
+		if _, exists := after[name]; !exists {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff, nil
+}
+
+// diffFields returns the top-level fields that differ between two versions
+// of a resource, in their JSON form
+func diffFields(before, after proto.Message) ([]FieldChange, error) {
+	if proto.Equal(before, after) {
+		return nil, nil
+	}
+	beforeFields, err := resourceFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := resourceFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range beforeFields {
+		names[name] = true
+	}
+	for name := range afterFields {
+		names[name] = true
+	}
+
+	var changes []FieldChange
+	for name := range names {
+		if !reflect.DeepEqual(beforeFields[name], afterFields[name]) {
+			changes = append(changes, FieldChange{Field: name, From: beforeFields[name], To: afterFields[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// resourceFields converts a resource to its top-level JSON fields
+func resourceFields(message proto.Message) (map[string]interface{}, error) {
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+var (
+	// baseConfig routes example.com to the api and web services
+	baseConfig = MarchProxyConfig{
+		Services: []ServiceConfig{
+			{Name: "api", Hosts: []string{"api.internal"}, Port: 8080, Protocol: "http", TimeoutSeconds: 5},
+			{Name: "web", Hosts: []string{"web.internal"}, Port: 8080, Protocol: "http"},
+		},
+		Routes: []RouteConfig{
+			{Name: "api", Prefix: "/api", ClusterName: "api", Hosts: []string{"example.com"}},
+			{Name: "web", Prefix: "/", ClusterName: "web", Hosts: []string{"example.com"}},
+		},
+	}
+
+	// updatedConfig changes the api service, replaces web with auth and
+	// leaves the routes as they are
+	updatedConfig = MarchProxyConfig{
+		Services: []ServiceConfig{
+			{Name: "api", Hosts: []string{"api.internal"}, Port: 8080, Protocol: "http", TimeoutSeconds: 10, HealthCheckPath: "/healthz"},
+			{Name: "auth", Hosts: []string{"auth.internal"}, Port: 9000, Protocol: "http"},
+		},
+		Routes: baseConfig.Routes,
+	}
+
+	// routeConfig and updatedRouteConfig serve routes without clusters,
+	// with a longer api timeout in the update
+	routeConfig        = MarchProxyConfig{Routes: baseConfig.Routes}
+	updatedRouteConfig = MarchProxyConfig{Routes: []RouteConfig{
+		{Name: "api", Prefix: "/api", ClusterName: "api", Hosts: []string{"example.com"}, Timeout: 60},
+		{Name: "web", Prefix: "/", ClusterName: "web", Hosts: []string{"example.com"}},
+	}}
+)
+
+func generateSnapshot(t *testing.T, config MarchProxyConfig, version string) *cache.Snapshot {
+	t.Helper()
+	config.Version = version
+	snapshot, err := GenerateSnapshot(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	diff, err := DiffSnapshots(generateSnapshot(t, baseConfig, "1"), generateSnapshot(t, updatedConfig, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.From != "1" || diff.To != "2" || !diff.Changed {
+		t.Errorf("diff from %s to %s changed %v, want from 1 to 2 changed", diff.From, diff.To, diff.Changed)
+	}
+	if !reflect.DeepEqual(diff.Clusters.Added, []string{"auth"}) || !reflect.DeepEqual(diff.Clusters.Removed, []string{"web"}) {
+		t.Errorf("clusters added %v removed %v, want [auth] and [web]", diff.Clusters.Added, diff.Clusters.Removed)
+	}
+	if !diff.Listeners.Empty() || !diff.Routes.Empty() {
+		t.Errorf("listeners %+v and routes %+v changed", diff.Listeners, diff.Routes)
+	}
+
+	if len(diff.Clusters.Changed) != 1 || diff.Clusters.Changed[0].Name != "api" {
+		t.Fatalf("changed clusters %+v, want api", diff.Clusters.Changed)
+	}
+	// Fields are sorted, and a field set on one side only is unset on the other
+	fields := diff.Clusters.Changed[0].Fields
+	if len(fields) != 2 {
+		t.Fatalf("api fields %+v, want connect_timeout and health_checks", fields)
+	}
+	if fields[0].Field != "connect_timeout" || fields[0].From != "5s" || fields[0].To != "10s" {
+		t.Errorf("field %+v, want connect_timeout from 5s to 10s", fields[0])
+	}
+	if fields[1].Field != "health_checks" || fields[1].From != nil || fields[1].To == nil {
+		t.Errorf("field %+v, want health_checks added", fields[1])
+	}
+}
+
+func TestDiffSnapshotsUnchanged(t *testing.T) {
+	diff, err := DiffSnapshots(generateSnapshot(t, baseConfig, "1"), generateSnapshot(t, baseConfig, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Changed {
+		t.Errorf("identical configurations differ: %+v", diff)
+	}
+
+	// Empty lists are encoded as such rather than as null
+	data, err := json.Marshal(diff.Clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"added":[],"removed":[],"changed":[]}`; string(data) != want {
+		t.Errorf("clusters %s, want %s", data, want)
+	}
+}
+
+// request runs handler on a request with a JSON body, when body isn't nil
+func request(handler http.HandlerFunc, method, target string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, bytes.NewReader(data)))
+	return w
+}
+
+func newTestConfigAPI() *ConfigAPI {
+	return NewConfigAPI(NewSnapshotCache(false, NodeGroupHash{By: GroupByNode}), "node-1", nil)
+}
+
+func decodeDiff(t *testing.T, w *httptest.ResponseRecorder) SnapshotDiff {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var diff SnapshotDiff
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	return diff
+}
+
+func TestDiffHandler(t *testing.T) {
+	api := newTestConfigAPI()
+	if w := request(api.UpdateConfigHandler, http.MethodPost, "/v1/config", routeConfig); w.Code != http.StatusOK {
+		t.Fatalf("update status %d: %s", w.Code, w.Body.String())
+	}
+
+	// The first update is diffed against the empty configuration
+	diff := decodeDiff(t, request(api.DiffHandler, http.MethodGet, "/v1/diff", nil))
+	if diff.From != "1" || diff.To != "2" {
+		t.Errorf("diff from %s to %s, want from 1 to 2", diff.From, diff.To)
+	}
+	if !reflect.DeepEqual(diff.Listeners.Added, []string{"marchproxy_listener"}) || !reflect.DeepEqual(diff.Routes.Added, []string{"marchproxy_routes"}) || !diff.Clusters.Empty() {
+		t.Errorf("initial diff %+v, want the listener and routes added", diff)
+	}
+
+	if w := request(api.UpdateConfigHandler, http.MethodPost, "/v1/config", updatedRouteConfig); w.Code != http.StatusOK {
+		t.Fatalf("update status %d: %s", w.Code, w.Body.String())
+	}
+	diff = decodeDiff(t, request(api.DiffHandler, http.MethodGet, "/v1/diff", nil))
+	if diff.From != "2" || diff.To != "3" || !diff.Listeners.Empty() {
+		t.Errorf("diff %+v, want the routes changed from 2 to 3", diff)
+	}
+	if changed := diff.Routes.Changed; len(changed) != 1 || changed[0].Name != "marchproxy_routes" || len(changed[0].Fields) != 1 || changed[0].Fields[0].Field != "virtual_hosts" {
+		t.Errorf("changed routes %+v, want the virtual hosts of marchproxy_routes", changed)
+	}
+
+	diff = decodeDiff(t, request(api.DiffHandler, http.MethodGet, "/v1/diff?from=1&to=3", nil))
+	if diff.From != "1" || diff.To != "3" || !reflect.DeepEqual(diff.Listeners.Added, []string{"marchproxy_listener"}) {
+		t.Errorf("diff %+v, want the listener added from 1 to 3", diff)
+	}
+}
+
+func TestDiffHandlerPreview(t *testing.T) {
+	api := newTestConfigAPI()
+	request(api.UpdateConfigHandler, http.MethodPost, "/v1/config", routeConfig)
+
+	// A pending configuration is compared with the current version
+	diff := decodeDiff(t, request(api.DiffHandler, http.MethodPost, "/v1/diff", baseConfig))
+	if diff.From != "2" || diff.To != "pending" || !reflect.DeepEqual(diff.Clusters.Added, []string{"api", "web"}) || len(diff.Listeners.Added) != 0 {
+		t.Errorf("preview %+v, want api and web added from 2", diff)
+	}
+	diff = decodeDiff(t, request(api.DiffHandler, http.MethodPost, "/v1/diff?from=1", baseConfig))
+	if diff.From != "1" || !reflect.DeepEqual(diff.Listeners.Added, []string{"marchproxy_listener"}) {
+		t.Errorf("preview %+v, want the listener added from 1", diff)
+	}
+
+	// Previewing applies nothing
+	if version := api.groupVersion("node-1"); version != 2 {
+		t.Errorf("version %d after preview, want 2", version)
+	}
+}
+
+func TestDiffHandlerErrors(t *testing.T) {
+	api := newTestConfigAPI()
+	request(api.UpdateConfigHandler, http.MethodPost, "/v1/config", routeConfig)
+
+	for _, c := range []struct {
+		method string
+		target string
+		body   interface{}
+		want   int
+	}{
+		{http.MethodPut, "/v1/diff", nil, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v1/diff?from=latest", nil, http.StatusBadRequest},
+		{http.MethodGet, "/v1/diff?to=2.5", nil, http.StatusBadRequest},
+		{http.MethodGet, "/v1/diff?from=9", nil, http.StatusNotFound},
+		{http.MethodGet, "/v1/diff?from=1&to=9", nil, http.StatusNotFound},
+		// Groups that were never configured have no history
+		{http.MethodGet, "/v1/diff?group=edge", nil, http.StatusNotFound},
+		{http.MethodPost, "/v1/diff", "not a configuration", http.StatusBadRequest},
+		{http.MethodPost, "/v1/diff?from=9", baseConfig, http.StatusNotFound},
+	} {
+		if w := request(api.DiffHandler, c.method, c.target, c.body); w.Code != c.want {
+			t.Errorf("%s %s status %d, want %d", c.method, c.target, w.Code, c.want)
+		}
+	}
+}
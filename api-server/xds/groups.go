@@ -0,0 +1,78 @@
+// Node groups for per-group snapshots
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+// NodeGroupMetadataKey is the node metadata field that assigns a node to a
+// group explicitly, whatever the grouping
+const NodeGroupMetadataKey = "node_group"
+
+// Node groupings, selecting the node attribute that names its group
+const (
+	GroupByNode    = "node"    // Node ID: each node is its own group
+	GroupByCluster = "cluster" // Envoy service cluster
+	GroupByRegion  = "region"  // Locality region
+	GroupByZone    = "zone"    // Locality zone
+	GroupByRole    = "role"    // module_type in the node metadata
+)
+
+// NodeGroupHash maps nodes to node groups, so that each group gets its own
+// snapshot and version. Nodes that don't have the grouping's attribute fall
+// back to their node ID.
+type NodeGroupHash struct {
+	By string
+}
+
+var _ cache.NodeHash = NodeGroupHash{}
+
+// NewNodeGroupHash creates a node hash for the grouping by
+func NewNodeGroupHash(by string) (NodeGroupHash, error) {
+	switch by {
+	case GroupByNode, GroupByCluster, GroupByRegion, GroupByZone, GroupByRole:
+		return NodeGroupHash{By: by}, nil
+	default:
+		return NodeGroupHash{}, fmt.Errorf("unknown node grouping %q", by)
+	}
+}
+
+// ID returns the group of a node
+func (h NodeGroupHash) ID(node *core.Node) string {
+	if node == nil {
+		return ""
+	}
+	if group := metadataString(node, NodeGroupMetadataKey); group != "" {
+		return group
+	}
+
+	var group string
+	switch h.By {
+	case GroupByCluster:
+		group = node.GetCluster()
+	case GroupByRegion:
+		group = node.GetLocality().GetRegion()
+	case GroupByZone:
+		group = node.GetLocality().GetZone()
+	case GroupByRole:
+		group = strings.ToLower(metadataString(node, "module_type"))
+	}
+	if group == "" {
+		return node.GetId()
+	}
+	return group
+}
+
+// metadataString returns a string field of the node metadata
+func metadataString(node *core.Node, key string) string {
+	value, ok := node.GetMetadata().GetFields()[key]
+	if !ok {
+		return ""
+	}
+	return value.GetStringValue()
+}
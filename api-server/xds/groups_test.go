@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// testNode builds a node with the given metadata fields
+func testNode(t *testing.T, id, cluster string, locality *core.Locality, metadata map[string]interface{}) *core.Node {
+	t.Helper()
+	fields, err := structpb.NewStruct(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &core.Node{Id: id, Cluster: cluster, Locality: locality, Metadata: fields}
+}
+
+func TestNodeGroupHash(t *testing.T) {
+	locality := &core.Locality{Region: "us-east-1", Zone: "us-east-1a"}
+	node := testNode(t, "envoy-1", "edge", locality, map[string]interface{}{"module_type": "INGRESS"})
+	bare := testNode(t, "envoy-2", "", nil, nil)
+	pinned := testNode(t, "envoy-3", "edge", locality, map[string]interface{}{NodeGroupMetadataKey: "canary", "module_type": "ingress"})
+
+	for _, c := range []struct {
+		by   string
+		node *core.Node
+		want string
+	}{
+		{GroupByNode, node, "envoy-1"},
+		{GroupByCluster, node, "edge"},
+		{GroupByRegion, node, "us-east-1"},
+		{GroupByZone, node, "us-east-1a"},
+		{GroupByRole, node, "ingress"},
+		// Nodes without the attribute are grouped alone
+		{GroupByCluster, bare, "envoy-2"},
+		{GroupByRegion, bare, "envoy-2"},
+		{GroupByRole, bare, "envoy-2"},
+		// The node_group metadata field overrides any grouping
+		{GroupByNode, pinned, "canary"},
+		{GroupByRole, pinned, "canary"},
+		{GroupByNode, nil, ""},
+	} {
+		hash, err := NewNodeGroupHash(c.by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hash.ID(c.node); got != c.want {
+			t.Errorf("group by %s of %s = %q, want %q", c.by, c.node.GetId(), got, c.want)
+		}
+	}
+
+	if _, err := NewNodeGroupHash("datacenter"); err == nil {
+		t.Error("unknown grouping accepted")
+	}
+}
+
+func TestSnapshotCacheGroups(t *testing.T) {
+	snapshotCache := NewSnapshotCache(false, NodeGroupHash{By: GroupByRole})
+	for _, update := range []struct {
+		group   string
+		version string
+	}{{"ingress", "1"}, {"egress", "1"}, {"ingress", "2"}} {
+		if err := snapshotCache.SetSnapshot(context.Background(), update.group, generateSnapshot(t, routeConfig, update.version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := snapshotCache.GetGroupVersions(), map[string]int64{"ingress": 2, "egress": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("group versions %v, want %v", got, want)
+	}
+	if version := snapshotCache.GetVersion(); version != 3 {
+		t.Errorf("cache version %d, want 3", version)
+	}
+
+	// Clearing one group leaves the others served
+	snapshotCache.ClearSnapshot("egress")
+	if _, err := snapshotCache.GetSnapshot("egress"); err == nil {
+		t.Error("cleared group still has a snapshot")
+	}
+	snapshot, err := snapshotCache.GetConcreteSnapshot("ingress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := snapshot.GetVersion(resource.RouteType); version != "2" {
+		t.Errorf("ingress version %s, want 2", version)
+	}
+	if got, want := snapshotCache.GetGroupVersions(), map[string]int64{"ingress": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("group versions %v, want %v", got, want)
+	}
+}
+
+func TestConfigAPIGroupIsolation(t *testing.T) {
+	hash := NodeGroupHash{By: GroupByRole}
+	api := NewConfigAPI(NewSnapshotCache(false, hash), "node-1", nil)
+	for _, update := range []struct {
+		group  string
+		config MarchProxyConfig
+	}{
+		{"ingress", routeConfig},
+		{"egress", routeConfig},
+		{"ingress", updatedRouteConfig},
+	} {
+		if w := request(api.UpdateConfigHandler, http.MethodPost, "/v1/config?group="+update.group, update.config); w.Code != http.StatusOK {
+			t.Fatalf("update of %s status %d: %s", update.group, w.Code, w.Body.String())
+		}
+	}
+
+	// Each group is versioned on its own, and the default group is untouched
+	for group, want := range map[string]float64{"ingress": 3, "egress": 2, "node-1": 1} {
+		var body map[string]interface{}
+		json.NewDecoder(request(api.GetConfigHandler, http.MethodGet, "/v1/version?group="+group, nil).Body).Decode(&body)
+		if body["version"] != want || body["group"] != group {
+			t.Errorf("version of %s %v, want %v", group, body, want)
+		}
+	}
+
+	// Nodes get the snapshot of their own group
+	for module, want := range map[string]string{"INGRESS": "3", "egress": "2"} {
+		node := testNode(t, "envoy-"+module, "", nil, map[string]interface{}{"module_type": module})
+		snapshot, err := api.cache.GetConcreteSnapshot(hash.ID(node))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := snapshot.GetVersion(resource.ListenerType); version != want {
+			t.Errorf("%s node served version %s, want %s", module, version, want)
+		}
+	}
+
+	var groups struct {
+		DefaultGroup string `json:"default_group"`
+		Groups       map[string]struct {
+			Version int   `json:"version"`
+			History []int `json:"history"`
+		} `json:"groups"`
+	}
+	if err := json.NewDecoder(request(api.GroupsHandler, http.MethodGet, "/v1/groups", nil).Body).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	if groups.DefaultGroup != "node-1" || len(groups.Groups) != 2 {
+		t.Fatalf("groups %+v, want ingress and egress", groups)
+	}
+	if ingress := groups.Groups["ingress"]; ingress.Version != 3 || !reflect.DeepEqual(ingress.History, []int{1, 2, 3}) {
+		t.Errorf("ingress %+v, want version 3 with history 1 to 3", ingress)
+	}
+	if egress := groups.Groups["egress"]; egress.Version != 2 || !reflect.DeepEqual(egress.History, []int{1, 2}) {
+		t.Errorf("egress %+v, want version 2 with history 1 and 2", egress)
+	}
+
+	// Versions are looked up and rolled back within the group only
+	if w := request(api.GetSnapshotHandler, http.MethodGet, "/v1/snapshot/3?group=egress", nil); w.Code != http.StatusNotFound {
+		t.Errorf("version 3 of egress status %d, want 404", w.Code)
+	}
+	if w := request(api.RollbackHandler, http.MethodPost, "/v1/rollback/3?group=egress", nil); w.Code != http.StatusNotFound {
+		t.Errorf("rollback of egress to 3 status %d, want 404", w.Code)
+	}
+	if w := request(api.RollbackHandler, http.MethodPost, "/v1/rollback/2?group=ingress", nil); w.Code != http.StatusOK {
+		t.Errorf("rollback of ingress to 2 status %d, want 200", w.Code)
+	}
+	if ingress, egress := api.groupVersion("ingress"), api.groupVersion("egress"); ingress != 4 || egress != 2 {
+		t.Errorf("versions after rollback ingress %d egress %d, want 4 and 2", ingress, egress)
+	}
+}
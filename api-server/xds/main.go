@@ -34,13 +34,31 @@ var (
 	nodeID      = flag.String("nodeID", "marchproxy-control-plane", "Node ID")
 	debug       = flag.Bool("debug", false, "Enable debug logging")
 	metricsPort = flag.Int("metrics", 19000, "Metrics server port")
+	groupBy     = flag.String("groupBy", GroupByNode, "Node attribute naming a node's group: node, cluster, region, zone or role")
+
+	webhooks      = flag.String("webhooks", "", "Comma-separated URLs notified of config pushes, ACKs and NACKs")
+	webhookEvents = flag.String("webhookEvents", "", "Comma-separated webhook events to send (default: all)")
+	webhookSecret = flag.String("webhookSecret", "", "Secret signing webhook bodies with HMAC-SHA256")
 )
 
 func main() {
 	flag.Parse()
 
-	// Create snapshot cache
-	cache := NewSnapshotCache(*debug)
+	// Create snapshot cache, one snapshot per node group
+	hash, err := NewNodeGroupHash(*groupBy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid node grouping: %v\n", err)
+		os.Exit(1)
+	}
+	cache := NewSnapshotCache(*debug, hash)
+
+	// Create webhook notifications of config application
+	notifier, err := NewWebhookNotifier(ParseList(*webhooks), ParseList(*webhookEvents), *webhookSecret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid webhook configuration: %v\n", err)
+		os.Exit(1)
+	}
+	tracker := NewApplyTracker(hash, notifier)
 
 	// Create xDS server callbacks
 	cb := &Callbacks{
@@ -48,6 +66,7 @@ func main() {
 		Fetches:  0,
 		Requests: 0,
 		Debug:    *debug,
+		Tracker:  tracker,
 	}
 
 	// Create the xDS server
@@ -83,7 +102,7 @@ func main() {
 	fmt.Printf("xDS management server listening on :%d\n", *port)
 
 	// Start metrics server
-	go startMetricsServer(*metricsPort, cache, cb)
+	go startMetricsServer(*metricsPort, cache, cb, notifier)
 
 	// Handle graceful shutdown
 	go func() {
@@ -102,9 +121,9 @@ func main() {
 }
 
 // startMetricsServer starts HTTP server for health checks, metrics, and config API
-func startMetricsServer(port int, cache *SnapshotCache, cb *Callbacks) {
+func startMetricsServer(port int, cache *SnapshotCache, cb *Callbacks, notifier *WebhookNotifier) {
 	// Create config API
-	configAPI := NewConfigAPI(cache, *nodeID)
+	configAPI := NewConfigAPI(cache, *nodeID, cb.Tracker)
 
 	// Setup HTTP server
 	mux := http.NewServeMux()
@@ -114,6 +133,8 @@ func startMetricsServer(port int, cache *SnapshotCache, cb *Callbacks) {
 	mux.HandleFunc("/v1/version", configAPI.GetConfigHandler)
 	mux.HandleFunc("/v1/snapshot/", configAPI.GetSnapshotHandler)
 	mux.HandleFunc("/v1/rollback/", configAPI.RollbackHandler)
+	mux.HandleFunc("/v1/diff", configAPI.DiffHandler)
+	mux.HandleFunc("/v1/groups", configAPI.GroupsHandler)
 
 	// Health and metrics endpoints
 	mux.HandleFunc("/health", configAPI.HealthHandler)
@@ -129,6 +150,16 @@ func startMetricsServer(port int, cache *SnapshotCache, cb *Callbacks) {
 		fmt.Fprintf(w, "# HELP xds_cache_version Current cache version\n")
 		fmt.Fprintf(w, "# TYPE xds_cache_version gauge\n")
 		fmt.Fprintf(w, "xds_cache_version %d\n", cache.GetVersion())
+		fmt.Fprintf(w, "# HELP xds_group_snapshots_total Total number of snapshots set per node group\n")
+		fmt.Fprintf(w, "# TYPE xds_group_snapshots_total counter\n")
+		for group, version := range cache.GetGroupVersions() {
+			fmt.Fprintf(w, "xds_group_snapshots_total{group=%q} %d\n", group, version)
+		}
+		fmt.Fprintf(w, "# HELP xds_webhook_deliveries_total Total number of webhook deliveries by result\n")
+		fmt.Fprintf(w, "# TYPE xds_webhook_deliveries_total counter\n")
+		for result, count := range notifier.GetStats() {
+			fmt.Fprintf(w, "xds_webhook_deliveries_total{result=%q} %d\n", result, count)
+		}
 	})
 
 	addr := fmt.Sprintf(":%d", port)
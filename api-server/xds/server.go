@@ -30,18 +30,22 @@ type NodeInfo struct {
 	ConnectionCount int
 }
 
-// NewServer creates a new xDS control plane server
-func NewServer(debug bool, nodeID string) *Server {
-	cache := NewSnapshotCache(debug)
+// NewServer creates a new xDS control plane server, keeping a snapshot per
+// node group of hash
+func NewServer(debug bool, nodeID string, hash cache.NodeHash) *Server {
+	cache := NewSnapshotCache(debug, hash)
+
+	tracker := NewApplyTracker(hash, nil)
 
 	callbacks := &Callbacks{
 		Signal:   make(chan struct{}),
 		Fetches:  0,
 		Requests: 0,
 		Debug:    debug,
+		Tracker:  tracker,
 	}
 
-	configAPI := NewConfigAPI(cache, nodeID)
+	configAPI := NewConfigAPI(cache, nodeID, tracker)
 
 	return &Server{
 		cache:     cache,
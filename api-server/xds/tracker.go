@@ -0,0 +1,211 @@
+// Tracking of how nodes apply snapshot versions
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+// ApplyTracker follows the ACKs and NACKs of each node group's current
+// snapshot version on the xDS streams and notifies webhooks when the
+// version is pushed, ACKed by every connected node, or NACKed
+type ApplyTracker struct {
+	hash     cache.NodeHash
+	notifier *WebhookNotifier
+	mu       sync.Mutex
+	streams  map[int64]streamNode
+	groups   map[string]*groupApply
+}
+
+// streamNode is the node and group of an xDS stream. Envoy may only send
+// its node on a stream's first request.
+type streamNode struct {
+	node  string
+	group string
+}
+
+// groupApply is the progress of a group's current version across its
+// nodes
+type groupApply struct {
+	version string
+	pending map[string]map[string]bool // Types sent to a node and not yet ACKed
+	acked   map[string]bool
+	nacked  map[string]bool
+	done    bool // ACKed by every node, or its event already sent
+}
+
+// NewApplyTracker creates a tracker grouping nodes with hash. A nil notifier
+// tracks without notifying.
+func NewApplyTracker(hash cache.NodeHash, notifier *WebhookNotifier) *ApplyTracker {
+	return &ApplyTracker{
+		hash:     hash,
+		notifier: notifier,
+		streams:  make(map[int64]streamNode),
+		groups:   make(map[string]*groupApply),
+	}
+}
+
+// Pushed records a new snapshot version set for a group and notifies the
+// nodes it is pushed to
+func (t *ApplyTracker) Pushed(group, version string) {
+	t.mu.Lock()
+	t.groups[group] = &groupApply{
+		version: version,
+		pending: make(map[string]map[string]bool),
+		acked:   make(map[string]bool),
+		nacked:  make(map[string]bool),
+	}
+	nodes := t.nodesLocked(group)
+	t.mu.Unlock()
+
+	t.notifier.Notify(WebhookEvent{Event: EventConfigPushed, Group: group, Version: version, Nodes: nodes})
+}
+
+// OnRequest records an ACK or NACK carried by a discovery request
+func (t *ApplyTracker) OnRequest(streamID int64, req *discovery.DiscoveryRequest) {
+	t.mu.Lock()
+	stream, ok := t.streamLocked(streamID, req.GetNode())
+	if !ok || req.GetResponseNonce() == "" {
+		t.mu.Unlock()
+		return
+	}
+	apply := t.groups[stream.group]
+	if apply == nil {
+		t.mu.Unlock()
+		return
+	}
+
+	// NACK: the node keeps its previous version and reports why
+	if detail := req.GetErrorDetail(); detail != nil {
+		if apply.nacked[stream.node] {
+			t.mu.Unlock()
+			return
+		}
+		apply.nacked[stream.node] = true
+		apply.done = true
+		event := WebhookEvent{
+			Event:   EventConfigNacked,
+			Group:   stream.group,
+			Version: apply.version,
+			Nodes:   []string{stream.node},
+			Errors: []NodeError{{
+				Node:    stream.node,
+				TypeURL: req.GetTypeUrl(),
+				Code:    detail.GetCode(),
+				Message: detail.GetMessage(),
+			}},
+		}
+		t.mu.Unlock()
+		t.notifier.Notify(event)
+		return
+	}
+
+	if req.GetVersionInfo() != apply.version {
+		t.mu.Unlock()
+		return
+	}
+	if pending := apply.pending[stream.node]; pending != nil {
+		delete(pending, req.GetTypeUrl())
+		if len(pending) == 0 {
+			apply.acked[stream.node] = true
+		}
+	}
+	event, complete := t.completeLocked(stream.group)
+	t.mu.Unlock()
+
+	if complete {
+		t.notifier.Notify(event)
+	}
+}
+
+// OnResponse records a resource type of the current version sent to a node
+func (t *ApplyTracker) OnResponse(streamID int64, req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stream, ok := t.streamLocked(streamID, req.GetNode())
+	if !ok {
+		return
+	}
+	apply := t.groups[stream.group]
+	if apply == nil || resp.GetVersionInfo() != apply.version {
+		return
+	}
+	if apply.pending[stream.node] == nil {
+		apply.pending[stream.node] = make(map[string]bool)
+	}
+	apply.pending[stream.node][resp.GetTypeUrl()] = true
+	delete(apply.acked, stream.node)
+}
+
+// OnStreamClosed forgets a stream; the group's remaining nodes may then all
+// have ACKed
+func (t *ApplyTracker) OnStreamClosed(streamID int64) {
+	t.mu.Lock()
+	stream, ok := t.streams[streamID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.streams, streamID)
+	event, complete := t.completeLocked(stream.group)
+	t.mu.Unlock()
+
+	if complete {
+		t.notifier.Notify(event)
+	}
+}
+
+// streamLocked returns the node of a stream, recording it from the first
+// request that carries one
+func (t *ApplyTracker) streamLocked(streamID int64, node *core.Node) (streamNode, bool) {
+	if stream, ok := t.streams[streamID]; ok {
+		return stream, true
+	}
+	if node == nil || node.GetId() == "" {
+		return streamNode{}, false
+	}
+	stream := streamNode{node: node.GetId(), group: t.hash.ID(node)}
+	t.streams[streamID] = stream
+	return stream, true
+}
+
+// nodesLocked returns the nodes with an open stream in a group
+func (t *ApplyTracker) nodesLocked(group string) []string {
+	seen := make(map[string]bool)
+	nodes := []string{}
+	for _, stream := range t.streams {
+		if stream.group == group && !seen[stream.node] {
+			seen[stream.node] = true
+			nodes = append(nodes, stream.node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// completeLocked returns the ACK event of a group once every connected node
+// has ACKed its current version, at most once per version
+func (t *ApplyTracker) completeLocked(group string) (WebhookEvent, bool) {
+	apply := t.groups[group]
+	if apply == nil || apply.done {
+		return WebhookEvent{}, false
+	}
+	nodes := t.nodesLocked(group)
+	if len(nodes) == 0 {
+		return WebhookEvent{}, false
+	}
+	for _, node := range nodes {
+		if !apply.acked[node] {
+			return WebhookEvent{}, false
+		}
+	}
+
+	apply.done = true
+	return WebhookEvent{Event: EventConfigAcked, Group: group, Version: apply.version, Nodes: nodes}, true
+}
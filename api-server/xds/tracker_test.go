@@ -0,0 +1,188 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	status "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// newQueueNotifier returns a notifier without a delivery worker, so the
+// events it is given stay on its queue
+func newQueueNotifier() *WebhookNotifier {
+	return &WebhookNotifier{urls: []string{"http://hooks.example.com"}, queue: make(chan WebhookEvent, webhookQueueSize)}
+}
+
+// queued returns the events notified since the last call
+func queued(n *WebhookNotifier) []WebhookEvent {
+	var events []WebhookEvent
+	for {
+		select {
+		case event := <-n.queue:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// trackedStream is an xDS stream of a node in the ingress group
+type trackedStream struct {
+	tracker *ApplyTracker
+	id      int64
+}
+
+// openStream opens a stream for node, which Envoy names on its first
+// request only
+func openStream(t *testing.T, tracker *ApplyTracker, id int64, node string) trackedStream {
+	t.Helper()
+	tracker.OnRequest(id, &discovery.DiscoveryRequest{
+		Node:    testNode(t, node, "", nil, map[string]interface{}{"module_type": "ingress"}),
+		TypeUrl: resource.ListenerType,
+	})
+	return trackedStream{tracker: tracker, id: id}
+}
+
+// send records a response of version carrying typeURL
+func (s trackedStream) send(typeURL, version string) {
+	s.tracker.OnResponse(s.id, &discovery.DiscoveryRequest{TypeUrl: typeURL}, &discovery.DiscoveryResponse{TypeUrl: typeURL, VersionInfo: version})
+}
+
+// ack acknowledges version of typeURL
+func (s trackedStream) ack(typeURL, version string) {
+	s.tracker.OnRequest(s.id, &discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: version, ResponseNonce: "nonce"})
+}
+
+// nack rejects a response of typeURL, staying on previous
+func (s trackedStream) nack(typeURL, previous, message string) {
+	s.tracker.OnRequest(s.id, &discovery.DiscoveryRequest{
+		TypeUrl:       typeURL,
+		VersionInfo:   previous,
+		ResponseNonce: "nonce",
+		ErrorDetail:   &status.Status{Code: 3, Message: message},
+	})
+}
+
+func TestApplyTrackerAcked(t *testing.T) {
+	notifier := newQueueNotifier()
+	tracker := NewApplyTracker(NodeGroupHash{By: GroupByRole}, notifier)
+	a := openStream(t, tracker, 1, "envoy-a")
+	b := openStream(t, tracker, 2, "envoy-b")
+
+	tracker.Pushed("ingress", "2")
+	events := queued(notifier)
+	if len(events) != 1 || events[0].Event != EventConfigPushed || events[0].Version != "2" || !reflect.DeepEqual(events[0].Nodes, []string{"envoy-a", "envoy-b"}) {
+		t.Fatalf("push events %+v, want config.pushed of 2 to both nodes", events)
+	}
+
+	a.send(resource.ListenerType, "2")
+	a.send(resource.ClusterType, "2")
+	b.send(resource.ListenerType, "2")
+
+	// A node has applied a version once it ACKs every type it was sent
+	a.ack(resource.ListenerType, "2")
+	b.ack(resource.ListenerType, "2")
+	if events := queued(notifier); len(events) != 0 {
+		t.Fatalf("events %+v before envoy-a ACKed its clusters", events)
+	}
+	// ACKs of other versions don't count
+	a.ack(resource.ClusterType, "1")
+	if events := queued(notifier); len(events) != 0 {
+		t.Fatalf("events %+v after a stale ACK", events)
+	}
+
+	a.ack(resource.ClusterType, "2")
+	events = queued(notifier)
+	if len(events) != 1 || events[0].Event != EventConfigAcked || events[0].Group != "ingress" || events[0].Version != "2" || !reflect.DeepEqual(events[0].Nodes, []string{"envoy-a", "envoy-b"}) {
+		t.Fatalf("ack events %+v, want config.acked of 2 by both nodes", events)
+	}
+
+	// The ACK event is sent once per version
+	a.ack(resource.ClusterType, "2")
+	if events := queued(notifier); len(events) != 0 {
+		t.Errorf("events %+v after a repeated ACK", events)
+	}
+}
+
+func TestApplyTrackerNacked(t *testing.T) {
+	notifier := newQueueNotifier()
+	tracker := NewApplyTracker(NodeGroupHash{By: GroupByRole}, notifier)
+	a := openStream(t, tracker, 1, "envoy-a")
+	b := openStream(t, tracker, 2, "envoy-b")
+
+	tracker.Pushed("ingress", "3")
+	queued(notifier)
+	a.send(resource.RouteType, "3")
+	b.send(resource.RouteType, "3")
+
+	a.nack(resource.RouteType, "2", "duplicate virtual host")
+	events := queued(notifier)
+	if len(events) != 1 || events[0].Event != EventConfigNacked || events[0].Version != "3" || !reflect.DeepEqual(events[0].Nodes, []string{"envoy-a"}) {
+		t.Fatalf("nack events %+v, want config.nacked of 3 by envoy-a", events)
+	}
+	want := []NodeError{{Node: "envoy-a", TypeURL: resource.RouteType, Code: 3, Message: "duplicate virtual host"}}
+	if !reflect.DeepEqual(events[0].Errors, want) {
+		t.Errorf("errors %+v, want %+v", events[0].Errors, want)
+	}
+
+	// Envoy repeats its NACK, and a rejected version is never reported ACKed
+	a.nack(resource.RouteType, "2", "duplicate virtual host")
+	b.ack(resource.RouteType, "3")
+	if events := queued(notifier); len(events) != 0 {
+		t.Errorf("events %+v after the first NACK", events)
+	}
+
+	// The next version is tracked afresh
+	tracker.Pushed("ingress", "4")
+	queued(notifier)
+	a.send(resource.RouteType, "4")
+	b.send(resource.RouteType, "4")
+	a.ack(resource.RouteType, "4")
+	b.ack(resource.RouteType, "4")
+	if events := queued(notifier); len(events) != 1 || events[0].Event != EventConfigAcked || events[0].Version != "4" {
+		t.Errorf("events %+v, want config.acked of 4", events)
+	}
+}
+
+func TestApplyTrackerStreamClosed(t *testing.T) {
+	notifier := newQueueNotifier()
+	tracker := NewApplyTracker(NodeGroupHash{By: GroupByRole}, notifier)
+	a := openStream(t, tracker, 1, "envoy-a")
+	b := openStream(t, tracker, 2, "envoy-b")
+	// Nodes of other groups don't hold the version back
+	tracker.OnRequest(3, &discovery.DiscoveryRequest{Node: &core.Node{Id: "envoy-egress"}})
+
+	tracker.Pushed("ingress", "2")
+	if events := queued(notifier); len(events) != 1 || !reflect.DeepEqual(events[0].Nodes, []string{"envoy-a", "envoy-b"}) {
+		t.Fatalf("push events %+v, want the ingress nodes", events)
+	}
+	a.send(resource.ListenerType, "2")
+	b.send(resource.ListenerType, "2")
+	a.ack(resource.ListenerType, "2")
+
+	// Once envoy-b disconnects, every remaining node has ACKed
+	tracker.OnStreamClosed(2)
+	events := queued(notifier)
+	if len(events) != 1 || events[0].Event != EventConfigAcked || !reflect.DeepEqual(events[0].Nodes, []string{"envoy-a"}) {
+		t.Errorf("events %+v, want config.acked by envoy-a", events)
+	}
+
+	// Unknown streams and streams that never named their node are ignored
+	tracker.OnStreamClosed(9)
+	tracker.OnRequest(10, &discovery.DiscoveryRequest{ResponseNonce: "nonce", VersionInfo: "2"})
+	if events := queued(notifier); len(events) != 0 {
+		t.Errorf("events %+v from unknown streams", events)
+	}
+}
+
+func TestApplyTrackerWithoutNotifier(t *testing.T) {
+	tracker := NewApplyTracker(NodeGroupHash{By: GroupByNode}, nil)
+	tracker.OnRequest(1, &discovery.DiscoveryRequest{Node: &core.Node{Id: "envoy-a"}})
+	tracker.Pushed("envoy-a", "2")
+	tracker.OnResponse(1, &discovery.DiscoveryRequest{}, &discovery.DiscoveryResponse{TypeUrl: resource.ListenerType, VersionInfo: "2"})
+	tracker.OnRequest(1, &discovery.DiscoveryRequest{TypeUrl: resource.ListenerType, VersionInfo: "2", ResponseNonce: "nonce"})
+	tracker.OnStreamClosed(1)
+}
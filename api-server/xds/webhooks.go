@@ -0,0 +1,188 @@
+// Webhook notifications of configuration changes
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Webhook events, fired as a snapshot version is applied to a node group
+const (
+	EventConfigPushed = "config.pushed" // Snapshot set for the group
+	EventConfigAcked  = "config.acked"  // ACKed by every connected node of the group
+	EventConfigNacked = "config.nacked" // Rejected by a node
+)
+
+const (
+	webhookQueueSize   = 100
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 3
+
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the body, keyed
+	// with the webhook secret, when one is configured
+	WebhookSignatureHeader = "X-MarchProxy-Signature"
+)
+
+// NodeError is a node's rejection of a resource type
+type NodeError struct {
+	Node    string `json:"node"`
+	TypeURL string `json:"type_url"`
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+}
+
+// WebhookEvent is the JSON body posted to webhooks
+type WebhookEvent struct {
+	Event     string      `json:"event"`
+	Group     string      `json:"group"`
+	Version   string      `json:"version"`
+	Nodes     []string    `json:"nodes"`
+	Errors    []NodeError `json:"errors,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// WebhookNotifier posts events to the configured webhooks from a background
+// queue, so xDS streams are never blocked on delivery
+type WebhookNotifier struct {
+	urls      []string
+	events    map[string]bool
+	secret    string
+	client    *http.Client
+	queue     chan WebhookEvent
+	delivered uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// NewWebhookNotifier creates a notifier posting the events listed to urls,
+// every event when events is empty, and starts its delivery worker
+func NewWebhookNotifier(urls []string, events []string, secret string) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{
+		urls:   urls,
+		events: make(map[string]bool),
+		secret: secret,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+	}
+	for _, event := range events {
+		switch event {
+		case EventConfigPushed, EventConfigAcked, EventConfigNacked:
+			n.events[event] = true
+		default:
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+
+	go n.run()
+	return n, nil
+}
+
+// ParseList splits a comma-separated flag value, dropping empty entries
+func ParseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Notify queues an event for delivery, dropping it when the queue is full
+func (n *WebhookNotifier) Notify(event WebhookEvent) {
+	if n == nil || len(n.urls) == 0 {
+		return
+	}
+	if len(n.events) > 0 && !n.events[event.Event] {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		atomic.AddUint64(&n.dropped, 1)
+		log.Printf("Webhook queue full, dropping %s event for node group %s version %s", event.Event, event.Group, event.Version)
+	}
+}
+
+// run delivers queued events to every webhook
+func (n *WebhookNotifier) run() {
+	for event := range n.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode webhook event: %v", err)
+			continue
+		}
+		for _, url := range n.urls {
+			if err := n.deliver(url, body); err != nil {
+				atomic.AddUint64(&n.failed, 1)
+				log.Printf("Failed to deliver %s event to webhook %s: %v", event.Event, url, err)
+				continue
+			}
+			atomic.AddUint64(&n.delivered, 1)
+		}
+	}
+}
+
+// deliver posts body to url, retrying with backoff on errors and 5xx
+// responses
+func (n *WebhookNotifier) deliver(url string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < webhookMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if n.secret != "" {
+			mac := hmac.New(sha256.New, []byte(n.secret))
+			mac.Write(body)
+			req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		var resp *http.Response
+		resp, err = n.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook returned %d", resp.StatusCode)
+		if resp.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
+
+// GetStats returns the delivery counters
+func (n *WebhookNotifier) GetStats() map[string]uint64 {
+	if n == nil {
+		return map[string]uint64{}
+	}
+	return map[string]uint64{
+		"delivered": atomic.LoadUint64(&n.delivered),
+		"failed":    atomic.LoadUint64(&n.failed),
+		"dropped":   atomic.LoadUint64(&n.dropped),
+	}
+}
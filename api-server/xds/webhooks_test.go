@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests posted to its server, answering
+// each with the next of its statuses and 200 OK once they run out
+type webhookReceiver struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		receiver.mu.Lock()
+		receiver.bodies = append(receiver.bodies, body)
+		receiver.headers = append(receiver.headers, r.Header)
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		receiver.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.server.Close)
+	return receiver
+}
+
+// events returns the events received so far
+func (r *webhookReceiver) events(t *testing.T) []WebhookEvent {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]WebhookEvent, len(r.bodies))
+	for i, body := range r.bodies {
+		if err := json.Unmarshal(body, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return events
+}
+
+// waitStats waits until the notifier has delivered and failed as many
+// deliveries as given
+func waitStats(t *testing.T, n *WebhookNotifier, delivered, failed uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := n.GetStats()
+		if stats["delivered"] == delivered && stats["failed"] == failed {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %v, want %d delivered and %d failed", stats, delivered, failed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookNotifierDelivery(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	other := newWebhookReceiver(t)
+	n, err := NewWebhookNotifier([]string{receiver.server.URL, other.server.URL}, nil, "hook-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Notify(WebhookEvent{Event: EventConfigAcked, Group: "ingress", Version: "2", Nodes: []string{"envoy-a"}})
+	waitStats(t, n, 2, 0)
+
+	events := receiver.events(t)
+	if len(events) != 1 || events[0].Event != EventConfigAcked || events[0].Group != "ingress" || events[0].Version != "2" || !reflect.DeepEqual(events[0].Nodes, []string{"envoy-a"}) {
+		t.Fatalf("received %+v", events)
+	}
+	if events[0].Timestamp.IsZero() {
+		t.Error("event sent without a timestamp")
+	}
+	if len(other.events(t)) != 1 {
+		t.Error("second webhook not notified")
+	}
+
+	// The body is signed with the secret
+	header := receiver.headers[0]
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(receiver.bodies[0])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get(WebhookSignatureHeader) != want {
+		t.Errorf("signature %q, want %q", header.Get(WebhookSignatureHeader), want)
+	}
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("content type %q", header.Get("Content-Type"))
+	}
+}
+
+func TestWebhookNotifierEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	n, err := NewWebhookNotifier([]string{receiver.server.URL}, []string{EventConfigNacked}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the events subscribed to are sent
+	n.Notify(WebhookEvent{Event: EventConfigPushed, Group: "ingress", Version: "3"})
+	n.Notify(WebhookEvent{Event: EventConfigNacked, Group: "ingress", Version: "3"})
+	waitStats(t, n, 1, 0)
+	if events := receiver.events(t); len(events) != 1 || events[0].Event != EventConfigNacked {
+		t.Errorf("received %+v, want config.nacked only", events)
+	}
+	if signature := receiver.headers[0].Get(WebhookSignatureHeader); signature != "" {
+		t.Errorf("unsigned webhook got signature %q", signature)
+	}
+
+	if _, err := NewWebhookNotifier([]string{receiver.server.URL}, []string{"config.applied"}, ""); err == nil {
+		t.Error("unknown event accepted")
+	}
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	// Server errors are retried, client errors are not
+	retried := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	rejected := newWebhookReceiver(t, http.StatusBadRequest)
+	n, err := NewWebhookNotifier([]string{retried.server.URL, rejected.server.URL}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Notify(WebhookEvent{Event: EventConfigPushed, Group: "ingress", Version: "2"})
+	waitStats(t, n, 1, 1)
+	if requests := len(retried.events(t)); requests != 2 {
+		t.Errorf("%d requests to the failing webhook, want 2", requests)
+	}
+	if requests := len(rejected.events(t)); requests != 1 {
+		t.Errorf("%d requests to the rejecting webhook, want 1", requests)
+	}
+}
+
+func TestWebhookNotifierQueueFull(t *testing.T) {
+	// Without a worker draining it, the queue fills up
+	n := &WebhookNotifier{urls: []string{"http://hooks.example.com"}, queue: make(chan WebhookEvent, 1)}
+	n.Notify(WebhookEvent{Event: EventConfigPushed})
+	n.Notify(WebhookEvent{Event: EventConfigPushed})
+	if stats := n.GetStats(); stats["dropped"] != 1 {
+		t.Errorf("stats %v, want 1 dropped", stats)
+	}
+
+	// A nil notifier, or one without webhooks, does nothing
+	var none *WebhookNotifier
+	none.Notify(WebhookEvent{Event: EventConfigPushed})
+	if stats := none.GetStats(); len(stats) != 0 {
+		t.Errorf("nil notifier stats %v", stats)
+	}
+	empty, err := NewWebhookNotifier(nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty.Notify(WebhookEvent{Event: EventConfigPushed})
+	if len(empty.queue) != 0 {
+		t.Error("event queued without webhooks")
+	}
+}
+
+func TestParseList(t *testing.T) {
+	for value, want := range map[string][]string{
+		"":                           nil,
+		" , ":                        nil,
+		"http://a":                   {"http://a"},
+		"http://a, http://b,":        {"http://a", "http://b"},
+		"config.acked,config.nacked": {"config.acked", "config.nacked"},
+	} {
+		if got := ParseList(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseList(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -15,6 +15,10 @@ from ..models.cluster import (
     CreateClusterRequest, UpdateClusterRequest, ClusterResponse,
     AssignUserToClusterRequest
 )
+from ..models.tenant import TenantModel, CreateTenantRequest
+from ..models.usage import UsageRecordModel, USAGE_GROUP_FIELDS
+from ..models.rollout import ConfigRolloutModel
+from ..models.coordination import CoordinationLeaseModel
 from .auth import _check_auth
 
 logger = logging.getLogger(__name__)
@@ -228,6 +232,12 @@ def clusters_api(db, jwt_manager):
                 update_data['log_debug'] = data.log_debug
             if data.max_proxies is not None:
                 update_data['max_proxies'] = data.max_proxies
+            if data.rollout_canary_percent is not None:
+                update_data['rollout_canary_percent'] = data.rollout_canary_percent
+            if data.rollout_observe_seconds is not None:
+                update_data['rollout_observe_seconds'] = data.rollout_observe_seconds
+            if data.rollout_max_error_rate is not None:
+                update_data['rollout_max_error_rate'] = data.rollout_max_error_rate
 
             cluster.update_record(**update_data)
 
@@ -340,9 +350,15 @@ def clusters_api(db, jwt_manager):
                 response.status = 404
                 return {"error": "User not found"}
 
-            # Assign user to cluster
+            try:
+                tenant = TenantModel.check_tenant(db, cluster_id, data.tenant)
+            except ValueError as e:
+                response.status = 400
+                return {"error": str(e)}
+
+            # Assign user to cluster, limited to the tenant when given
             success = UserClusterAssignmentModel.assign_user_to_cluster(
-                db, data.user_id, cluster_id, data.role, auth_result['user']['id']
+                db, data.user_id, cluster_id, data.role, auth_result['user']['id'], tenant
             )
 
             if success:
@@ -355,6 +371,177 @@ def clusters_api(db, jwt_manager):
             response.status = 405
             return {"error": "Method not allowed"}
 
+    @enable_cors()
+    def list_tenants(cluster_id):
+        """List cluster tenants and their quotas"""
+        if request.method == 'GET':
+            # Check authentication
+            auth_result = _check_auth(db, jwt_manager)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            user = auth_result['user']
+            query = (db.tenants.cluster_id == cluster_id) & (db.tenants.is_active == True)
+
+            # Users limited to one tenant only see that tenant
+            if not user['is_admin']:
+                if not UserClusterAssignmentModel.check_user_cluster_access(db, user['id'], cluster_id):
+                    response.status = 403
+                    return {"error": "Access denied to cluster"}
+                tenant = TenantModel.user_tenant(db, user['id'], cluster_id)
+                if tenant:
+                    query &= db.tenants.name == tenant
+
+            tenants = db(query).select(orderby=db.tenants.name)
+            return {"tenants": [tenant.as_dict() for tenant in tenants]}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def create_tenant(cluster_id):
+        """Create a tenant with quotas in a cluster"""
+        if request.method == 'POST':
+            # Check authentication - admin required
+            auth_result = _check_auth(db, jwt_manager, admin_required=True)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            try:
+                data = CreateTenantRequest(cluster_id=cluster_id, **request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            if not db.clusters[cluster_id]:
+                response.status = 404
+                return {"error": "Cluster not found"}
+
+            existing = db(
+                (db.tenants.cluster_id == cluster_id) &
+                (db.tenants.name == data.name) &
+                (db.tenants.is_active == True)
+            ).select().first()
+            if existing:
+                response.status = 409
+                return {"error": "Tenant already exists in cluster"}
+
+            tenant_id = db.tenants.insert(
+                created_by=auth_result['user']['id'],
+                **data.dict()
+            )
+
+            return {"tenant": db.tenants[tenant_id].as_dict(), "message": "Tenant created successfully"}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def update_tenant(cluster_id, tenant_id):
+        """Update a tenant's quotas, or deactivate it"""
+        if request.method in ('PUT', 'DELETE'):
+            # Check authentication - admin required
+            auth_result = _check_auth(db, jwt_manager, admin_required=True)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            tenant = db(
+                (db.tenants.id == tenant_id) &
+                (db.tenants.cluster_id == cluster_id) &
+                (db.tenants.is_active == True)
+            ).select().first()
+            if not tenant:
+                response.status = 404
+                return {"error": "Tenant not found"}
+
+            if request.method == 'DELETE':
+                tenant.update_record(is_active=False, updated_at=datetime.utcnow())
+                return {"message": "Tenant deactivated successfully"}
+
+            data = request.json or {}
+            try:
+                update_data = TenantModel.validate_quotas(data)
+            except ValueError as e:
+                response.status = 400
+                return {"error": str(e)}
+            if 'description' in data:
+                update_data['description'] = data['description']
+
+            tenant.update_record(updated_at=datetime.utcnow(), **update_data)
+            return {"tenant": tenant.as_dict()}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def get_usage(cluster_id):
+        """Aggregate metered usage for chargeback, as JSON or a CSV export"""
+        if request.method == 'GET':
+            # Check authentication
+            auth_result = _check_auth(db, jwt_manager)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            user = auth_result['user']
+            tenant = request.query.get('tenant')
+
+            # Users limited to one tenant only see that tenant's usage
+            if not user['is_admin']:
+                if not UserClusterAssignmentModel.check_user_cluster_access(db, user['id'], cluster_id):
+                    response.status = 403
+                    return {"error": "Access denied to cluster"}
+                user_tenant = TenantModel.user_tenant(db, user['id'], cluster_id)
+                if user_tenant:
+                    if tenant and tenant != user_tenant:
+                        response.status = 403
+                        return {"error": "Access denied to tenant"}
+                    tenant = user_tenant
+
+            # Defaults to the current month so far
+            now = datetime.utcnow()
+            try:
+                start = datetime.fromisoformat(request.query['start']) if request.query.get('start') \
+                    else now.replace(day=1, hour=0, minute=0, second=0, microsecond=0)
+                end = datetime.fromisoformat(request.query['end']) if request.query.get('end') else now
+            except ValueError:
+                response.status = 400
+                return {"error": "start and end must be ISO 8601 dates"}
+            if end <= start:
+                response.status = 400
+                return {"error": "end must be after start"}
+
+            group_by = [f for f in request.query.get('group_by', 'tenant,service').split(',') if f]
+            if not group_by or any(f not in USAGE_GROUP_FIELDS for f in group_by):
+                response.status = 400
+                return {"error": f"group_by must be fields of {', '.join(USAGE_GROUP_FIELDS)}"}
+
+            usage = UsageRecordModel.get_usage(db, cluster_id, start, end, group_by, tenant)
+
+            if request.query.get('format') == 'csv':
+                response.headers['Content-Type'] = 'text/csv'
+                response.headers['Content-Disposition'] = \
+                    f'attachment; filename="usage-cluster{cluster_id}-{start:%Y%m%d}-{end:%Y%m%d}.csv"'
+                return UsageRecordModel.to_csv(usage, group_by, start, end)
+
+            return {
+                "cluster_id": cluster_id,
+                "start": start.isoformat(),
+                "end": end.isoformat(),
+                "group_by": group_by,
+                "usage": usage
+            }
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
     @enable_cors()
     def get_config(cluster_id):
         """Get cluster configuration for proxy (API key authenticated)"""
@@ -377,7 +564,79 @@ def clusters_api(db, jwt_manager):
                 response.status = 404
                 return {"error": "Cluster configuration not found"}
 
-            return config
+            # Canary proxies get a config change before the rest of the cluster
+            proxy_name = request.environ.get('HTTP_X_PROXY_NAME')
+            return ConfigRolloutModel.resolve_config(db, int(cluster_id), proxy_name, config)
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def list_rollouts(cluster_id):
+        """List the cluster's config rollouts with canary progress"""
+        if request.method == 'GET':
+            # Check authentication - admin required
+            auth_result = _check_auth(db, jwt_manager, admin_required=True)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            if not db.clusters[cluster_id]:
+                response.status = 404
+                return {"error": "Cluster not found"}
+
+            # Evaluate a running rollout so its state is current
+            current = ConfigRolloutModel.current(db, cluster_id)
+            if current:
+                ConfigRolloutModel.evaluate(db, current)
+
+            return {"rollouts": ConfigRolloutModel.list_rollouts(db, cluster_id)}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def decide_rollout(cluster_id, rollout_id, action):
+        """Promote or roll back a canary rollout by hand"""
+        if request.method == 'POST':
+            # Check authentication - admin required
+            auth_result = _check_auth(db, jwt_manager, admin_required=True)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            if action not in ('promote', 'rollback'):
+                response.status = 400
+                return {"error": "Action must be promote or rollback"}
+
+            error = ConfigRolloutModel.decide(db, cluster_id, rollout_id, action, auth_result['user']['id'])
+            if error:
+                response.status = 404 if error == 'Rollout not found' else 409
+                return {"error": error}
+
+            return {"message": f"Rollout {rollout_id} {'promoted' if action == 'promote' else 'rolled back'}"}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def list_leases(cluster_id):
+        """List the cluster's coordination leases and their holders"""
+        if request.method == 'GET':
+            # Check authentication - admin required
+            auth_result = _check_auth(db, jwt_manager, admin_required=True)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            if not db.clusters[cluster_id]:
+                response.status = 404
+                return {"error": "Cluster not found"}
+
+            return {"leases": CoordinationLeaseModel.list_leases(db, cluster_id)}
 
         else:
             response.status = 405
@@ -392,5 +651,12 @@ def clusters_api(db, jwt_manager):
         'rotate_api_key': rotate_api_key,
         'update_logging_config': update_logging_config,
         'assign_user': assign_user,
+        'list_tenants': list_tenants,
+        'create_tenant': create_tenant,
+        'update_tenant': update_tenant,
+        'get_usage': get_usage,
+        'list_rollouts': list_rollouts,
+        'decide_rollout': decide_rollout,
+        'list_leases': list_leases,
         'get_config': get_config
     }
\ No newline at end of file
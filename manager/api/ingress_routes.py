@@ -18,9 +18,19 @@ from ..common import (
     auth, db, require_auth, require_admin, require_license_feature,
     create_audit_log, check_permission
 )
+from ..models.mapping import MappingModel
+from ..models.tenant import TenantModel
 
 cors = CORS()
 
+# Actions the ingress can take on requests classified as bad bots
+BOT_ACTIONS = ['allow', 'tarpit', 'block', 'challenge']
+
+
+def valid_request_timeout(value) -> bool:
+    """Check a route's request timeout budget in milliseconds, 0 for none"""
+    return isinstance(value, int) and not isinstance(value, bool) and 0 <= value <= 86400000
+
 
 @action('api/ingress-routes', method=['GET'])
 @action.uses(cors, auth, require_auth)
@@ -40,17 +50,14 @@ def list_ingress_routes():
             orderby=~db.ingress_routes.priority
         )
     else:
-        # Non-admin users see only routes in their assigned clusters
-        user_clusters = db(db.user_cluster_assignments.user_id == user_id).select(
-            db.user_cluster_assignments.cluster_id
-        )
-        cluster_ids = [row.cluster_id for row in user_clusters]
-
-        if not cluster_ids:
+        # Non-admin users see only routes in their assigned clusters, or of
+        # their tenant when the assignment is limited to one
+        visible = TenantModel.visible_query(db, db.ingress_routes, user_id)
+        if visible is None:
             return {"routes": []}
 
         routes = db(
-            (db.ingress_routes.cluster_id.belongs(cluster_ids)) &
+            visible &
             (db.ingress_routes.is_active == True)
         ).select(
             db.ingress_routes.ALL,
@@ -94,14 +101,10 @@ def get_ingress_route(route_id):
             (db.ingress_routes.is_active == True)
         ).select().first()
     else:
-        user_clusters = db(db.user_cluster_assignments.user_id == user_id).select(
-            db.user_cluster_assignments.cluster_id
-        )
-        cluster_ids = [row.cluster_id for row in user_clusters]
-
-        route = db(
+        visible = TenantModel.visible_query(db, db.ingress_routes, user_id)
+        route = visible and db(
             (db.ingress_routes.id == route_id) &
-            (db.ingress_routes.cluster_id.belongs(cluster_ids)) &
+            visible &
             (db.ingress_routes.is_active == True)
         ).select().first()
 
@@ -153,6 +156,17 @@ def create_ingress_route():
     if not cluster:
         abort(400, "Invalid cluster ID")
 
+    # Users limited to a tenant create routes for that tenant only
+    tenant = data.get('tenant')
+    if not is_admin and user_cluster.tenant:
+        if tenant and tenant != user_cluster.tenant:
+            abort(403, "Access denied to tenant")
+        tenant = user_cluster.tenant
+    try:
+        tenant = TenantModel.check_tenant(db, cluster_id, tenant)
+    except ValueError as e:
+        abort(400, str(e))
+
     # Validate backend services exist and belong to the cluster
     backend_service_ids = data['backend_services']
     if not isinstance(backend_service_ids, list) or not backend_service_ids:
@@ -165,6 +179,8 @@ def create_ingress_route():
 
     if len(services) != len(backend_service_ids):
         abort(400, "One or more backend services not found in the specified cluster")
+    if tenant and any(s.tenant and s.tenant != tenant for s in services):
+        abort(400, "Backend services must belong to the route's tenant or be shared")
 
     # Validate routing patterns
     host_pattern = data.get('host_pattern', '')
@@ -184,11 +200,23 @@ def create_ingress_route():
     if conflicts:
         abort(400, "A route with the same host and path patterns already exists")
 
+    if data.get('bot_action', 'challenge') not in BOT_ACTIONS:
+        abort(400, f"bot_action must be one of: {', '.join(BOT_ACTIONS)}")
+
+    if not valid_request_timeout(data.get('request_timeout_ms', 0)):
+        abort(400, "request_timeout_ms must be an integer from 0 to 86400000")
+
+    try:
+        fault_injection = MappingModel.validate_fault_injection(data.get('fault_injection'))
+    except ValueError as e:
+        abort(400, str(e))
+
     # Create the route
     route_data = {
         'name': data['name'],
         'description': data.get('description', ''),
         'cluster_id': cluster_id,
+        'tenant': tenant,
         'host_pattern': host_pattern,
         'path_pattern': path_pattern,
         'priority': data.get('priority', 100),
@@ -205,8 +233,18 @@ def create_ingress_route():
         'health_check_threshold': data.get('health_check_threshold', 3),
         'rate_limit_enabled': data.get('rate_limit_enabled', False),
         'rate_limit_rps': data.get('rate_limit_rps', 1000),
+        'rate_limit_burst': data.get('rate_limit_burst', 0),
+        'rate_limit_client_rps': data.get('rate_limit_client_rps', 0),
+        'rate_limit_client_burst': data.get('rate_limit_client_burst', 0),
         'ddos_protection_enabled': data.get('ddos_protection_enabled', False),
         'ddos_threshold_pps': data.get('ddos_threshold_pps', 10000),
+        'max_body_size': data.get('max_body_size', 0),
+        'request_timeout_ms': data.get('request_timeout_ms', 0),
+        'bot_protection_enabled': data.get('bot_protection_enabled', False),
+        'bot_action': data.get('bot_action', 'challenge'),
+        'tls_fingerprint_allow': data.get('tls_fingerprint_allow', []),
+        'tls_fingerprint_deny': data.get('tls_fingerprint_deny', []),
+        'fault_injection': fault_injection,
         'request_headers': data.get('request_headers'),
         'response_headers': data.get('response_headers'),
         'strip_prefix': data.get('strip_prefix'),
@@ -258,20 +296,26 @@ def update_ingress_route(route_id):
             (db.ingress_routes.is_active == True)
         ).select().first()
     else:
-        user_clusters = db(db.user_cluster_assignments.user_id == user_id).select(
-            db.user_cluster_assignments.cluster_id
-        )
-        cluster_ids = [row.cluster_id for row in user_clusters]
-
-        route = db(
+        visible = TenantModel.visible_query(db, db.ingress_routes, user_id)
+        route = visible and db(
             (db.ingress_routes.id == route_id) &
-            (db.ingress_routes.cluster_id.belongs(cluster_ids)) &
+            visible &
             (db.ingress_routes.is_active == True)
         ).select().first()
 
     if not route:
         abort(404, "Ingress route not found")
 
+    # Only users with the whole cluster may move a route between tenants
+    tenant = route.tenant
+    if 'tenant' in data:
+        if not is_admin and TenantModel.user_tenant(db, user_id, route.cluster_id):
+            abort(403, "Access denied to tenant")
+        try:
+            tenant = TenantModel.check_tenant(db, route.cluster_id, data['tenant'])
+        except ValueError as e:
+            abort(400, str(e))
+
     # Validate backend services if provided
     if 'backend_services' in data:
         backend_service_ids = data['backend_services']
@@ -285,6 +329,8 @@ def update_ingress_route(route_id):
 
         if len(services) != len(backend_service_ids):
             abort(400, "One or more backend services not found in the route's cluster")
+        if tenant and any(s.tenant and s.tenant != tenant for s in services):
+            abort(400, "Backend services must belong to the route's tenant or be shared")
 
     # Check for conflicts if routing patterns are changing
     if 'host_pattern' in data or 'path_pattern' in data:
@@ -305,19 +351,36 @@ def update_ingress_route(route_id):
     # Update the route
     update_data = {}
     updateable_fields = [
-        'name', 'description', 'host_pattern', 'path_pattern', 'priority',
+        'name', 'description', 'tenant', 'host_pattern', 'path_pattern', 'priority',
         'backend_services', 'load_balancer_algorithm', 'service_weights',
         'require_mtls', 'allowed_client_cns', 'tls_server_name',
         'health_check_enabled', 'health_check_path', 'health_check_interval',
         'health_check_timeout', 'health_check_threshold', 'rate_limit_enabled',
-        'rate_limit_rps', 'ddos_protection_enabled', 'ddos_threshold_pps',
-        'request_headers', 'response_headers', 'strip_prefix', 'add_prefix'
+        'rate_limit_rps', 'rate_limit_burst', 'rate_limit_client_rps',
+        'rate_limit_client_burst', 'ddos_protection_enabled', 'ddos_threshold_pps',
+        'max_body_size', 'request_timeout_ms', 'bot_protection_enabled', 'bot_action',
+        'tls_fingerprint_allow', 'tls_fingerprint_deny', 'fault_injection', 'request_headers', 'response_headers', 'strip_prefix', 'add_prefix'
     ]
 
     for field in updateable_fields:
         if field in data:
             update_data[field] = data[field]
 
+    if 'bot_action' in update_data and update_data['bot_action'] not in BOT_ACTIONS:
+        abort(400, f"bot_action must be one of: {', '.join(BOT_ACTIONS)}")
+
+    if 'request_timeout_ms' in update_data and not valid_request_timeout(update_data['request_timeout_ms']):
+        abort(400, "request_timeout_ms must be an integer from 0 to 86400000")
+
+    if 'tenant' in update_data:
+        update_data['tenant'] = tenant
+
+    if 'fault_injection' in update_data:
+        try:
+            update_data['fault_injection'] = MappingModel.validate_fault_injection(update_data['fault_injection'])
+        except ValueError as e:
+            abort(400, str(e))
+
     if update_data:
         db(db.ingress_routes.id == route_id).update(**update_data)
 
@@ -354,14 +417,10 @@ def delete_ingress_route(route_id):
             (db.ingress_routes.is_active == True)
         ).select().first()
     else:
-        user_clusters = db(db.user_cluster_assignments.user_id == user_id).select(
-            db.user_cluster_assignments.cluster_id
-        )
-        cluster_ids = [row.cluster_id for row in user_clusters]
-
-        route = db(
+        visible = TenantModel.visible_query(db, db.ingress_routes, user_id)
+        route = visible and db(
             (db.ingress_routes.id == route_id) &
-            (db.ingress_routes.cluster_id.belongs(cluster_ids)) &
+            visible &
             (db.ingress_routes.is_active == True)
         ).select().first()
 
@@ -411,10 +470,11 @@ def get_cluster_ingress_routes(cluster_id):
     if not cluster:
         abort(404, "Cluster not found")
 
-    routes = db(
-        (db.ingress_routes.cluster_id == cluster_id) &
-        (db.ingress_routes.is_active == True)
-    ).select(orderby=~db.ingress_routes.priority)
+    query = (db.ingress_routes.cluster_id == cluster_id) & (db.ingress_routes.is_active == True)
+    if not is_admin and user_cluster.tenant:
+        query &= db.ingress_routes.tenant == user_cluster.tenant
+
+    routes = db(query).select(orderby=~db.ingress_routes.priority)
 
     route_list = []
     for route in routes:
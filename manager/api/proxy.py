@@ -12,15 +12,21 @@ import logging
 from ..models.proxy import (
     ProxyServerModel, ProxyMetricsModel,
     ProxyRegistrationRequest, ProxyHeartbeatRequest, ProxyConfigRequest,
-    ProxyResponse, ProxyStatsResponse, ProxyMetricsResponse
+    ProxyCertificateRequest, SessionTicketKeysRequest, ModulesRequest, ProxyResponse, ProxyStatsResponse, ProxyMetricsResponse
 )
 from ..models.cluster import ClusterModel
+from ..models.certificate import ClusterCAModel, SessionTicketKeyModel
+from ..models.usage import UsageRecordModel, UsageUploadRequest
+from ..models.rollout import ConfigRolloutModel
+from ..models.coordination import (
+    CoordinationLeaseModel, SharedCounterModel, LeaseRequest, CountersRequest
+)
 from .auth import _check_auth
 
 logger = logging.getLogger(__name__)
 
 
-def proxy_api(db, jwt_manager):
+def proxy_api(db, jwt_manager, license_manager=None):
     """Proxy registration and management API endpoints"""
 
     @enable_cors()
@@ -90,6 +96,8 @@ def proxy_api(db, jwt_manager):
                 status_data['capabilities'] = data.capabilities
             if data.config_version:
                 status_data['config_version'] = data.config_version
+            if data.certificates is not None:
+                status_data['certificates'] = data.certificates
 
             success = ProxyServerModel.update_heartbeat(
                 db, data.proxy_name, data.cluster_api_key, status_data
@@ -105,7 +113,13 @@ def proxy_api(db, jwt_manager):
                 if proxy:
                     ProxyMetricsModel.record_metrics(db, proxy.id, data.metrics)
 
-            return {"message": "Heartbeat recorded successfully"}
+            # Canaries of a config rollout report their progress
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            ConfigRolloutModel.record_heartbeat(
+                db, cluster_info['cluster_id'], data.proxy_name, data.config_version, data.metrics
+            )
+
+            return {"success": True, "message": "Heartbeat recorded successfully"}
 
         else:
             response.status = 405
@@ -135,6 +149,193 @@ def proxy_api(db, jwt_manager):
             response.status = 405
             return {"error": "Method not allowed"}
 
+    @enable_cors()
+    def issue_certificate():
+        """Sign a proxy CSR with the cluster CA for intra-cluster mTLS"""
+        if request.method == 'POST':
+            try:
+                data = ProxyCertificateRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            proxy = db(
+                (db.proxy_servers.name == data.proxy_name) &
+                (db.proxy_servers.cluster_id == cluster_info['cluster_id'])
+            ).select().first()
+            if not proxy:
+                response.status = 404
+                return {"error": "Proxy not registered in this cluster"}
+
+            try:
+                issued = ClusterCAModel.sign_csr(
+                    db, cluster_info['cluster_id'], cluster_info['name'],
+                    proxy.name, data.csr, data.ttl_seconds
+                )
+            except ValueError as e:
+                response.status = 400
+                return {"error": str(e)}
+
+            logger.info(f"Issued mTLS certificate {issued['serial_number']} to proxy {proxy.name}")
+            return {"success": True, **issued}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def session_ticket_keys():
+        """Shared TLS session ticket keys for the cluster's ingress replicas"""
+        if request.method == 'POST':
+            try:
+                data = SessionTicketKeysRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            return {
+                "success": True,
+                "keys": SessionTicketKeyModel.get_keys(db, cluster_info['cluster_id']),
+                "rotation_interval": int(SessionTicketKeyModel.ROTATION_INTERVAL.total_seconds()),
+            }
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def upload_usage():
+        """Store usage records closed by a proxy's meter"""
+        if request.method == 'POST':
+            try:
+                data = UsageUploadRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            recorded = UsageRecordModel.record_usage(
+                db, cluster_info['cluster_id'], data.proxy_name, data.records
+            )
+            return {"success": True, "recorded": recorded}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def entitlements():
+        """Enterprise features the license entitles the proxy's cluster to"""
+        if request.method == 'POST':
+            try:
+                data = ProxyConfigRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            if license_manager is None:
+                return {"success": True, "edition": "Community", "valid": True, "features": []}
+            return {"success": True, **license_manager.get_entitlements()}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def lease():
+        """Acquire, renew or release a coordination lease for a proxy replica"""
+        if request.method == 'POST':
+            try:
+                data = LeaseRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            if data.release:
+                released = CoordinationLeaseModel.release(
+                    db, cluster_info['cluster_id'], data.name, data.proxy_name
+                )
+                return {"success": True, "released": released}
+
+            lease = CoordinationLeaseModel.acquire(
+                db, cluster_info['cluster_id'], data.name, data.proxy_name, data.ttl_seconds
+            )
+            return dict(lease, success=True)
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def counters():
+        """Add to shared counters and return their cluster-wide totals"""
+        if request.method == 'POST':
+            try:
+                data = CountersRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            totals = SharedCounterModel.add(db, cluster_info['cluster_id'], data.increments)
+            return {"success": True, "counters": totals}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
+    @enable_cors()
+    def modules():
+        """List the gRPC endpoints of the cluster's modules a load balancer routes to"""
+        if request.method == 'POST':
+            try:
+                data = ModulesRequest(**request.json)
+            except ValidationError as e:
+                response.status = 400
+                return {"error": "Validation error", "details": str(e)}
+
+            cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+            if not cluster_info:
+                response.status = 401
+                return {"error": "Invalid cluster API key"}
+
+            endpoints = ProxyServerModel.get_module_endpoints(
+                db, cluster_info['cluster_id'], data.module_types
+            )
+            return {"success": True, "modules": endpoints}
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
     @enable_cors()
     def list_proxies():
         """List all proxies (authenticated endpoint)"""
@@ -316,6 +517,41 @@ def proxy_api(db, jwt_manager):
             response.status = 405
             return {"error": "Method not allowed"}
 
+    @enable_cors()
+    def get_certificates():
+        """Get proxy certificates expiring soon"""
+        if request.method == 'GET':
+            # Check authentication
+            auth_result = _check_auth(db, jwt_manager)
+            if 'error' in auth_result:
+                response.status = auth_result['status']
+                return auth_result
+
+            user = auth_result['user']
+            cluster_id = request.query.get('cluster_id')
+
+            if cluster_id:
+                cluster_id = int(cluster_id)
+                # Check access to cluster
+                if not user['is_admin']:
+                    from ..models.cluster import UserClusterAssignmentModel
+                    user_role = UserClusterAssignmentModel.check_user_cluster_access(db, user['id'], cluster_id)
+                    if not user_role:
+                        response.status = 403
+                        return {"error": "Access denied to cluster"}
+
+            days = int(request.query.get('days', 30))
+            certificates = ProxyServerModel.get_expiring_certificates(db, days, cluster_id)
+
+            return {
+                "days": days,
+                "certificates": certificates
+            }
+
+        else:
+            response.status = 405
+            return {"error": "Method not allowed"}
+
     @enable_cors()
     def cleanup_stale():
         """Cleanup stale proxy registrations (admin only)"""
@@ -343,9 +579,17 @@ def proxy_api(db, jwt_manager):
         'register': register,
         'heartbeat': heartbeat,
         'get_config': get_config,
+        'issue_certificate': issue_certificate,
+        'session_ticket_keys': session_ticket_keys,
+        'upload_usage': upload_usage,
+        'lease': lease,
+        'counters': counters,
+        'modules': modules,
+        'entitlements': entitlements,
         'list_proxies': list_proxies,
         'get_proxy': get_proxy,
         'get_stats': get_stats,
         'get_metrics': get_metrics,
+        'get_certificates': get_certificates,
         'cleanup_stale': cleanup_stale
     }
\ No newline at end of file
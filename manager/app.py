@@ -22,7 +22,11 @@ from models.proxy import ProxyServerModel, ProxyMetricsModel
 from models.license import LicenseCacheModel, LicenseManager
 from models.service import ServiceModel, UserServiceAssignmentModel
 from models.mapping import MappingModel
-from models.certificate import CertificateModel
+from models.tenant import TenantModel
+from models.usage import UsageRecordModel
+from models.rollout import ConfigRolloutModel
+from models.coordination import CoordinationLeaseModel, SharedCounterModel
+from models.certificate import CertificateModel, ClusterCAModel, SessionTicketKeyModel
 
 from api.auth import auth_api
 from api.clusters import clusters_api
@@ -50,6 +54,7 @@ UserModel.define_table(db)
 SessionModel.define_table(db)
 APITokenModel.define_table(db)
 ClusterModel.define_table(db)
+TenantModel.define_table(db)
 UserClusterAssignmentModel.define_table(db)
 ProxyServerModel.define_table(db)
 ProxyMetricsModel.define_table(db)
@@ -58,6 +63,12 @@ ServiceModel.define_table(db)
 UserServiceAssignmentModel.define_table(db)
 MappingModel.define_table(db)
 CertificateModel.define_table(db)
+ClusterCAModel.define_table(db)
+SessionTicketKeyModel.define_table(db)
+UsageRecordModel.define_table(db)
+ConfigRolloutModel.define_table(db)
+CoordinationLeaseModel.define_table(db)
+SharedCounterModel.define_table(db)
 
 # Commit database changes
 db.commit()
@@ -73,7 +84,7 @@ license_manager = LicenseManager(db, LICENSE_KEY)
 # Initialize API endpoints
 auth_endpoints = auth_api(db, jwt_manager)
 cluster_endpoints = clusters_api(db, jwt_manager)
-proxy_endpoints = proxy_api(db, jwt_manager)
+proxy_endpoints = proxy_api(db, jwt_manager, license_manager)
 mtls_endpoints = mtls_api(db, jwt_manager)
 
 # Register API routes
@@ -146,6 +157,33 @@ def update_cluster_logging(cluster_id):
 def assign_user_to_cluster(cluster_id):
     return _call_endpoint(lambda: cluster_endpoints['assign_user'](cluster_id))
 
+@application.route('/api/clusters/<int:cluster_id>/tenants', methods=['GET', 'POST'])
+def cluster_tenants(cluster_id):
+    if request.method == 'GET':
+        return _call_endpoint(lambda: cluster_endpoints['list_tenants'](cluster_id))
+    else:
+        return _call_endpoint(lambda: cluster_endpoints['create_tenant'](cluster_id))
+
+@application.route('/api/clusters/<int:cluster_id>/tenants/<int:tenant_id>', methods=['PUT', 'DELETE'])
+def cluster_tenant_detail(cluster_id, tenant_id):
+    return _call_endpoint(lambda: cluster_endpoints['update_tenant'](cluster_id, tenant_id))
+
+@application.route('/api/clusters/<int:cluster_id>/usage', methods=['GET'])
+def cluster_usage(cluster_id):
+    return _call_endpoint(lambda: cluster_endpoints['get_usage'](cluster_id))
+
+@application.route('/api/clusters/<int:cluster_id>/rollouts', methods=['GET'])
+def cluster_rollouts(cluster_id):
+    return _call_endpoint(lambda: cluster_endpoints['list_rollouts'](cluster_id))
+
+@application.route('/api/clusters/<int:cluster_id>/rollouts/<int:rollout_id>/<action>', methods=['POST'])
+def cluster_rollout_decide(cluster_id, rollout_id, action):
+    return _call_endpoint(lambda: cluster_endpoints['decide_rollout'](cluster_id, rollout_id, action))
+
+@application.route('/api/clusters/<int:cluster_id>/leases', methods=['GET'])
+def cluster_leases(cluster_id):
+    return _call_endpoint(lambda: cluster_endpoints['list_leases'](cluster_id))
+
 @application.route('/api/config/<int:cluster_id>', methods=['GET'])
 def get_cluster_config(cluster_id):
     return _call_endpoint(lambda: cluster_endpoints['get_config'](cluster_id))
@@ -163,6 +201,34 @@ def proxy_heartbeat():
 def proxy_get_config():
     return _call_endpoint(proxy_endpoints['get_config'])
 
+@application.route('/api/proxy/certificate', methods=['POST'])
+def proxy_issue_certificate():
+    return _call_endpoint(proxy_endpoints['issue_certificate'])
+
+@application.route('/api/proxy/session-tickets', methods=['POST'])
+def proxy_session_tickets():
+    return _call_endpoint(proxy_endpoints['session_ticket_keys'])
+
+@application.route('/api/proxy/usage', methods=['POST'])
+def proxy_upload_usage():
+    return _call_endpoint(proxy_endpoints['upload_usage'])
+
+@application.route('/api/proxy/entitlements', methods=['POST'])
+def proxy_entitlements():
+    return _call_endpoint(proxy_endpoints['entitlements'])
+
+@application.route('/api/proxy/lease', methods=['POST'])
+def proxy_lease():
+    return _call_endpoint(proxy_endpoints['lease'])
+
+@application.route('/api/proxy/counters', methods=['POST'])
+def proxy_counters():
+    return _call_endpoint(proxy_endpoints['counters'])
+
+@application.route('/api/proxy/modules', methods=['POST'])
+def proxy_modules():
+    return _call_endpoint(proxy_endpoints['modules'])
+
 @application.route('/api/proxies', methods=['GET'])
 def list_proxies():
     return _call_endpoint(proxy_endpoints['list_proxies'])
@@ -179,6 +245,10 @@ def get_proxy_stats():
 def get_proxy_metrics(proxy_id):
     return _call_endpoint(lambda: proxy_endpoints['get_metrics'](proxy_id))
 
+@application.route('/api/proxies/certificates', methods=['GET'])
+def get_proxy_certificates():
+    return _call_endpoint(proxy_endpoints['get_certificates'])
+
 @application.route('/api/proxies/cleanup', methods=['POST'])
 def cleanup_stale_proxies():
     return _call_endpoint(proxy_endpoints['cleanup_stale'])
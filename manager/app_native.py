@@ -26,10 +26,18 @@ from models.auth_native import (
 
 # Import existing models (updated to work with py4web auth)
 from models.cluster import ClusterModel, UserClusterAssignmentModel
-from models.proxy import ProxyServerModel, ProxyMetricsModel
+from models.proxy import ProxyServerModel, ProxyMetricsModel, ProxyConfigRequest, ModulesRequest
 from models.license import LicenseCacheModel, LicenseManager
 from models.service import ServiceModel, UserServiceAssignmentModel
 from models.mapping import MappingModel
+from models.tenant import TenantModel
+from models.usage import UsageRecordModel, UsageUploadRequest
+from models.quarantine import QuarantineModel, QuarantineReportRequest
+from models.drain import DrainModel, DrainRequest
+from models.rollout import ConfigRolloutModel
+from models.coordination import (
+    CoordinationLeaseModel, SharedCounterModel, LeaseRequest, CountersRequest
+)
 from models.certificate import CertificateModel
 from models.rate_limiting import RateLimitModel, RateLimitManager
 from models.syslog_client import ClusterSyslogManager
@@ -60,6 +68,7 @@ extend_auth_user_table(auth)
 
 # Define business logic tables (referencing auth_user)
 ClusterModel.define_table(db)
+TenantModel.define_table(db)
 UserClusterAssignmentModel.define_table(db)
 ProxyServerModel.define_table(db)
 ProxyMetricsModel.define_table(db)
@@ -69,6 +78,12 @@ UserServiceAssignmentModel.define_table(db)
 MappingModel.define_table(db)
 CertificateModel.define_table(db)
 RateLimitModel.define_table(db)
+UsageRecordModel.define_table(db)
+QuarantineModel.define_table(db)
+DrainModel.define_table(db)
+ConfigRolloutModel.define_table(db)
+CoordinationLeaseModel.define_table(db)
+SharedCounterModel.define_table(db)
 
 # Commit database changes
 db.commit()
@@ -365,6 +380,10 @@ def cluster_detail(cluster_id):
                 'is_default': cluster.is_default,
                 'max_proxies': cluster.max_proxies,
                 'active_proxies': active_proxies,
+                'quarantine_connections_per_second': cluster.quarantine_connections_per_second,
+                'quarantine_block': cluster.quarantine_block,
+                'quarantine_log': cluster.quarantine_log,
+                'egress_dns': cluster.egress_dns,
                 'created_at': cluster.created_at,
                 'updated_at': cluster.updated_at
             }
@@ -393,6 +412,22 @@ def cluster_detail(cluster_id):
             update_data['log_debug'] = data['log_debug']
         if 'max_proxies' in data:
             update_data['max_proxies'] = data['max_proxies']
+        if 'quarantine_connections_per_second' in data:
+            rate = data['quarantine_connections_per_second']
+            if not isinstance(rate, (int, float)) or isinstance(rate, bool) or rate < 0:
+                response.status = 400
+                return {'error': 'quarantine_connections_per_second must be a non-negative number'}
+            update_data['quarantine_connections_per_second'] = rate
+        if 'quarantine_block' in data:
+            update_data['quarantine_block'] = bool(data['quarantine_block'])
+        if 'quarantine_log' in data:
+            update_data['quarantine_log'] = bool(data['quarantine_log'])
+        if 'egress_dns' in data:
+            try:
+                update_data['egress_dns'] = MappingModel.validate_dns_policy(data['egress_dns'])
+            except ValueError as e:
+                response.status = 400
+                return {'error': f'egress_dns: {e}'}
 
         cluster.update_record(**update_data)
         return {'message': 'Cluster updated successfully'}
@@ -564,7 +599,133 @@ def cluster_config(cluster_id):
     if not config:
         abort(404)
 
-    return config
+    # Canary proxies get a config change before the rest of the cluster
+    return ConfigRolloutModel.resolve_config(db, cluster_id, request.headers.get('X-Proxy-Name'), config)
+
+
+@action('/api/clusters/<cluster_id:int>/rollouts', methods=['GET'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_rollouts(cluster_id):
+    """List the cluster's config rollouts with canary progress"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if not db.clusters[cluster_id]:
+        abort(404)
+
+    # Evaluate a running rollout so its state is current
+    current = ConfigRolloutModel.current(db, cluster_id)
+    if current:
+        ConfigRolloutModel.evaluate(db, current)
+
+    return {'rollouts': ConfigRolloutModel.list_rollouts(db, cluster_id)}
+
+
+@action('/api/clusters/<cluster_id:int>/leases', methods=['GET'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_leases(cluster_id):
+    """List the cluster's coordination leases and their holders"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if not db.clusters[cluster_id]:
+        abort(404)
+
+    return {'leases': CoordinationLeaseModel.list_leases(db, cluster_id)}
+
+
+@action('/api/clusters/<cluster_id:int>/quarantine', methods=['GET'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_quarantine(cluster_id):
+    """List the cluster's quarantined services, with released ones on ?all=true"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if not db.clusters[cluster_id]:
+        abort(404)
+
+    include_released = request.query.get('all', '').lower() == 'true'
+    return {'quarantines': QuarantineModel.list_quarantines(db, cluster_id, include_released)}
+
+
+@action('/api/clusters/<cluster_id:int>/quarantine/<service_id:int>/release', methods=['POST'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_quarantine_release(cluster_id, service_id):
+    """Release a quarantined service on every proxy of the cluster"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if not QuarantineModel.release(db, cluster_id, service_id, auth.user_id):
+        response.status = 404
+        return {'error': 'Service is not quarantined'}
+
+    return {'message': f'Service {service_id} released from quarantine'}
+
+
+@action('/api/clusters/<cluster_id:int>/drains', methods=['GET', 'POST'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_drains(cluster_id):
+    """List the cluster's drained backends, with lifted ones on ?all=true, or drain one"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if not db.clusters[cluster_id]:
+        abort(404)
+
+    if request.method == 'GET':
+        include_lifted = request.query.get('all', '').lower() == 'true'
+        return {'drains': DrainModel.list_drains(db, cluster_id, include_lifted)}
+
+    try:
+        data = DrainRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    drain_id = DrainModel.drain(db, cluster_id, data.host, data.port, data.reason, auth.user_id)
+    backend = f"{data.host}:{data.port}" if data.port else data.host
+    logger.info(f"Backend {backend} drained in cluster {cluster_id}")
+    return {'message': f'Backend {backend} drained on every proxy of the cluster', 'drain_id': drain_id}
+
+
+@action('/api/clusters/<cluster_id:int>/drains/<drain_id:int>/lift', methods=['POST'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_drain_lift(cluster_id, drain_id):
+    """Return a drained backend to service on every proxy of the cluster"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if not DrainModel.lift(db, cluster_id, drain_id, auth.user_id):
+        response.status = 404
+        return {'error': 'Backend is not drained'}
+
+    return {'message': f'Drain {drain_id} lifted'}
+
+
+@action('/api/clusters/<cluster_id:int>/rollouts/<rollout_id:int>/<decision>', methods=['POST'])
+@action.uses(auth, auth.user, CORS())
+
+def cluster_rollout_decide(cluster_id, rollout_id, decision):
+    """Promote or roll back a canary rollout by hand"""
+    if not check_permission(auth, 'update_clusters'):
+        abort(403)
+
+    if decision not in ('promote', 'rollback'):
+        response.status = 400
+        return {'error': 'Action must be promote or rollback'}
+
+    error = ConfigRolloutModel.decide(db, cluster_id, rollout_id, decision, auth.user_id)
+    if error:
+        response.status = 404 if error == 'Rollout not found' else 409
+        return {'error': error}
+
+    return {'message': f"Rollout {rollout_id} {'promoted' if decision == 'promote' else 'rolled back'}"}
 
 
 # User management using py4web auth
@@ -708,7 +869,159 @@ def proxy_heartbeat():
         except Exception as e:
             logger.warning(f"Failed to record metrics: {e}")
 
-    return {'message': 'Heartbeat received successfully'}
+    # Canaries of a config rollout report their progress
+    ConfigRolloutModel.record_heartbeat(
+        db, ClusterModel.validate_api_key(db, data['cluster_api_key'])['cluster_id'],
+        data['proxy_name'], data.get('config_version'), data.get('metrics')
+    )
+
+    return {'success': True, 'message': 'Heartbeat received successfully'}
+
+
+@action('/api/proxy/usage', methods=['POST'])
+
+def proxy_upload_usage():
+    """Store usage records closed by a proxy's meter"""
+    try:
+        data = UsageUploadRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'error': 'Invalid cluster API key'}
+
+    recorded = UsageRecordModel.record_usage(
+        db, cluster_info['cluster_id'], data.proxy_name, data.records
+    )
+    return {'success': True, 'recorded': recorded}
+
+
+@action('/api/proxy/quarantine', methods=['POST'])
+
+def proxy_report_quarantine():
+    """Quarantine a source service a proxy flagged repeatedly"""
+    try:
+        data = QuarantineReportRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'error': 'Invalid cluster API key'}
+
+    quarantine_id = QuarantineModel.quarantine(
+        db, cluster_info['cluster_id'], data.service_id, data.reason, data.proxy_name
+    )
+    if quarantine_id is None:
+        response.status = 404
+        return {'error': 'Service not found in cluster'}
+
+    logger.warning(f"Service {data.service_id} quarantined by proxy {data.proxy_name}: {data.reason}")
+    return {'success': True, 'quarantine_id': quarantine_id}
+
+
+@action('/api/proxy/entitlements', methods=['POST'])
+
+def proxy_entitlements():
+    """Enterprise features the license entitles the proxy's cluster to"""
+    try:
+        data = ProxyConfigRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'error': 'Invalid cluster API key'}
+
+    return {'success': True, **license_manager.get_entitlements()}
+
+
+@action('/api/proxy/lease', methods=['POST'])
+
+def proxy_lease():
+    """Acquire, renew or release a coordination lease for a proxy replica"""
+    try:
+        data = LeaseRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'error': 'Invalid cluster API key'}
+
+    if data.release:
+        released = CoordinationLeaseModel.release(db, cluster_info['cluster_id'], data.name, data.proxy_name)
+        return {'success': True, 'released': released}
+
+    lease = CoordinationLeaseModel.acquire(
+        db, cluster_info['cluster_id'], data.name, data.proxy_name, data.ttl_seconds
+    )
+    return dict(lease, success=True)
+
+
+@action('/api/proxy/counters', methods=['POST'])
+
+def proxy_counters():
+    """Add to shared counters and return their cluster-wide totals"""
+    try:
+        data = CountersRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'error': 'Invalid cluster API key'}
+
+    totals = SharedCounterModel.add(db, cluster_info['cluster_id'], data.increments)
+    return {'success': True, 'counters': totals}
+
+
+@action('/api/proxy/drains', methods=['POST'])
+
+def proxy_drains():
+    """Backends drained across the proxy's cluster"""
+    try:
+        data = ProxyConfigRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'success': False, 'error': 'Invalid cluster API key'}
+
+    return {'success': True, 'drained_backends': DrainModel.get_cluster_drains(db, cluster_info['cluster_id'])}
+
+
+@action('/api/proxy/modules', methods=['POST'])
+
+def proxy_modules():
+    """List the gRPC endpoints of the cluster's modules a load balancer routes to"""
+    try:
+        data = ModulesRequest(**request.json)
+    except Exception as e:
+        response.status = 400
+        return {'error': 'Validation error', 'details': str(e)}
+
+    cluster_info = ClusterModel.validate_api_key(db, data.cluster_api_key)
+    if not cluster_info:
+        response.status = 401
+        return {'error': 'Invalid cluster API key'}
+
+    modules = ProxyServerModel.get_module_endpoints(db, cluster_info['cluster_id'], data.module_types)
+    return {'success': True, 'modules': modules}
 
 
 @action('/api/proxy/config/<proxy_name>', methods=['GET'])
@@ -1439,7 +1752,21 @@ def mappings():
                 auth_required=data.get('auth_required', True),
                 priority=data.get('priority', 100),
                 description=data.get('description'),
-                comments=data.get('comments')
+                comments=data.get('comments'),
+                fault_injection=data.get('fault_injection'),
+                dns=data.get('dns'),
+                smtp=data.get('smtp'),
+                condition=data.get('condition'),
+                schedule=data.get('schedule'),
+                dlp=data.get('dlp'),
+                tls_inspection=data.get('tls_inspection'),
+                ssh=data.get('ssh'),
+                tls_policy=data.get('tls_policy'),
+                upstream_proxy=data.get('upstream_proxy'),
+                slos=data.get('slos'),
+                source_cidrs=data.get('source_cidrs'),
+                listen_ports=data.get('listen_ports'),
+                hostnames=data.get('hostnames')
             )
 
             return {
@@ -1526,6 +1853,36 @@ def mapping_detail(mapping_id):
                 update_data['priority'] = data['priority']
             if 'comments' in data:
                 update_data['comments'] = data['comments']
+            if 'fault_injection' in data:
+                update_data['fault_injection'] = MappingModel.validate_fault_injection(
+                    data['fault_injection']
+                )
+            if 'dns' in data:
+                update_data['dns'] = MappingModel.validate_dns_policy(data['dns'])
+            if 'smtp' in data:
+                update_data['smtp'] = MappingModel.validate_smtp_policy(data['smtp'])
+            if 'condition' in data:
+                update_data['condition'] = MappingModel.validate_condition(data['condition'])
+            if 'schedule' in data:
+                update_data['schedule'] = MappingModel.validate_schedule(data['schedule'])
+            if 'dlp' in data:
+                update_data['dlp'] = MappingModel.validate_dlp_policy(data['dlp'])
+            if 'tls_inspection' in data:
+                update_data['tls_inspection'] = MappingModel.validate_tls_inspection(data['tls_inspection'])
+            if 'ssh' in data:
+                update_data['ssh'] = MappingModel.validate_ssh_policy(data['ssh'])
+            if 'tls_policy' in data:
+                update_data['tls_policy'] = MappingModel.validate_tls_policy(data['tls_policy'])
+            if 'upstream_proxy' in data:
+                update_data['upstream_proxy'] = MappingModel.validate_upstream_proxy(data['upstream_proxy'])
+            if 'slos' in data:
+                update_data['slos'] = MappingModel.validate_slos(data['slos'])
+            if 'source_cidrs' in data:
+                update_data['source_cidrs'] = MappingModel.validate_source_cidrs(data['source_cidrs'])
+            if 'listen_ports' in data:
+                update_data['listen_ports'] = MappingModel.validate_listen_ports(data['listen_ports'])
+            if 'hostnames' in data:
+                update_data['hostnames'] = MappingModel.validate_hostnames(data['hostnames'])
 
             if update_data:
                 update_data['updated_at'] = datetime.utcnow()
@@ -2164,6 +2521,8 @@ def run_background_tasks():
             cleanup_stale_proxies()
             # Also clean up old metrics
             ProxyMetricsModel.cleanup_old_metrics(db, days=30)
+            UsageRecordModel.cleanup_old_usage(db)
+            SharedCounterModel.cleanup_old_counters(db)
         except Exception as e:
             logger.error(f"Background task failed: {e}")
         time.sleep(300)  # Run every 5 minutes
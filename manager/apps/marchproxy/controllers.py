@@ -340,7 +340,7 @@ def create_service():
         Field('collection', label='Collection/Group'),
         Field('cluster_id', requires=IS_IN_SET(cluster_options), label='Cluster'),
         Field('description'),
-        Field('auth_type', requires=IS_IN_SET(['none', 'base64', 'jwt']), default='none'),
+        Field('auth_type', requires=IS_IN_SET(['none', 'base64', 'hmac', 'jwt']), default='none'),
         Field('tags', label='Tags (comma-separated)')
     ])
     
@@ -351,7 +351,7 @@ def create_service():
             jwt_secret = None
             jwt_expiry = None
             
-            if form.vars.auth_type == 'base64':
+            if form.vars.auth_type in ('base64', 'hmac'):
                 import base64
                 import secrets
                 # Generate a secure Base64 token
@@ -399,11 +399,28 @@ def create_service():
     
     return dict(form=form, clusters=clusters)
 
+# Longest overlap window a rotation may keep the old credentials for
+MAX_ROTATION_OVERLAP = 7 * 24 * 3600
+
 @action('services/<service_id>/rotate-auth', method='POST')
 @require_auth
 def rotate_service_auth(service_id):
-    """Rotate service authentication credentials"""
+    """Rotate service authentication credentials
+    
+    The old credentials keep validating for overlap_seconds (default 3600,
+    0 for an immediate cutover) so clients can pick up the new ones first.
+    """
     try:
+        data = request.json or {}
+        try:
+            overlap = int(data.get('overlap_seconds', 3600))
+        except (TypeError, ValueError):
+            overlap = -1
+        if overlap < 0 or overlap > MAX_ROTATION_OVERLAP:
+            response.status = 400
+            return dict(success=False, error=f"overlap_seconds must be between 0 and {MAX_ROTATION_OVERLAP}")
+        
+
         user_id = auth.get_current_user_id()
         user = db.auth_user[user_id]
         
@@ -423,18 +440,29 @@ def rotate_service_auth(service_id):
             if not assignment:
                 abort(403, "Access denied")
         
-        # Generate new credentials based on auth type
-        update_data = {}
+        # Generate new credentials based on auth type, keeping the current
+        # ones valid through the overlap window
+        valid_until = datetime.utcnow() + timedelta(seconds=overlap) if overlap else None
+        update_data = {
+            'previous_token_base64': None,
+            'previous_jwt_secret': None,
+            'previous_valid_until': valid_until,
+        }
         
-        if service.auth_type == 'base64':
+        if service.auth_type in ('base64', 'hmac'):
             import base64
             import secrets
             token_bytes = secrets.token_bytes(32)
             update_data['token_base64'] = base64.b64encode(token_bytes).decode('ascii')
+            if valid_until:
+                update_data['previous_token_base64'] = service.token_base64
             
         elif service.auth_type == 'jwt':
             import secrets
             update_data['jwt_secret'] = secrets.token_urlsafe(32)
+            update_data['jwt_last_rotation'] = datetime.utcnow()
+            if valid_until:
+                update_data['previous_jwt_secret'] = service.jwt_secret
             # Keep the same expiry time or reset to default
             if not service.jwt_expiry:
                 update_data['jwt_expiry'] = 3600
@@ -444,10 +472,15 @@ def rotate_service_auth(service_id):
         
         create_audit_log('service_auth_rotated', 'service', str(service_id), {
             'service_name': service.name,
-            'auth_type': service.auth_type
+            'auth_type': service.auth_type,
+            'overlap_seconds': overlap
         })
         
-        return dict(success=True, message="Authentication credentials rotated successfully")
+        return dict(
+            success=True,
+            message="Authentication credentials rotated successfully",
+            previous_valid_until=valid_until.isoformat() + 'Z' if valid_until else None
+        )
         
     except Exception as e:
         response.status = 500
@@ -623,10 +656,14 @@ def mappings():
             orderby=db.mappings.priority | db.mappings.name
         )
     else:
-        # Service owners see mappings for their clusters
+        # Service owners see mappings for their clusters, or their tenant's
+        # mappings when assigned to one tenant
         mappings = db(
             (db.user_cluster_assignments.user_id == user_id) &
             (db.user_cluster_assignments.cluster_id == db.mappings.cluster_id) &
+            ((db.user_cluster_assignments.tenant == None) |
+             (db.user_cluster_assignments.tenant == '') |
+             (db.user_cluster_assignments.tenant == db.mappings.tenant)) &
             (db.mappings.is_active == True)
         ).select(db.mappings.ALL, orderby=db.mappings.priority | db.mappings.name)
     
@@ -1075,7 +1112,18 @@ def api_get_config(cluster_id):
             },
             'services': [],
             'mappings': [],
-            'certificates': []
+            'certificates': [],
+            'tenants': [],
+            'quarantine': {
+                'policy': {
+                    'connections_per_second': cluster.quarantine_connections_per_second or 0,
+                    'block': bool(cluster.quarantine_block),
+                    'log': bool(cluster.quarantine_log)
+                },
+                'services': []
+            },
+            'drained_backends': [],
+            'egress_dns': cluster.egress_dns
         }
         
         # Add services
@@ -1085,16 +1133,25 @@ def api_get_config(cluster_id):
                 'name': service.name,
                 'ip_fqdn': service.ip_fqdn,
                 'collection': service.collection,
-                'auth_type': service.auth_type
+                'auth_type': service.auth_type,
+                'tenant': service.tenant
             }
             
             # Add authentication details based on type
-            if service.auth_type == 'base64' and service.token_base64:
+            if service.auth_type in ('base64', 'hmac') and service.token_base64:
                 service_config['auth_token'] = service.token_base64
             elif service.auth_type == 'jwt' and service.jwt_secret:
                 service_config['jwt_secret'] = service.jwt_secret
                 service_config['jwt_expiry'] = service.jwt_expiry
             
+            # Credentials replaced by a rotation, until the overlap ends
+            if service.previous_valid_until and service.previous_valid_until > datetime.utcnow():
+                if service.auth_type in ('base64', 'hmac') and service.previous_token_base64:
+                    service_config['previous_auth_token'] = service.previous_token_base64
+                elif service.auth_type == 'jwt' and service.previous_jwt_secret:
+                    service_config['previous_jwt_secret'] = service.previous_jwt_secret
+                service_config['previous_valid_until'] = service.previous_valid_until.isoformat() + 'Z'
+            
             config['services'].append(service_config)
         
         # Add mappings
@@ -1109,7 +1166,55 @@ def api_get_config(cluster_id):
                 'auth_required': mapping.auth_required,
                 'auth_type': mapping.auth_type,
                 'priority': mapping.priority,
-                'timeout': mapping.timeout
+                'timeout': mapping.timeout,
+                'tenant': mapping.tenant,
+                'condition': mapping.condition,
+                'schedule': mapping.schedule,
+                'dlp': mapping.dlp,
+                'tls_inspection': mapping.tls_inspection,
+                'ssh': mapping.ssh,
+                'tls_policy': mapping.tls_policy,
+                'upstream_proxy': mapping.upstream_proxy,
+                'slos': mapping.slos,
+                'source_cidrs': mapping.source_cidrs,
+                'listen_ports': mapping.listen_ports,
+                'hostnames': mapping.hostnames
+            })
+
+        # Add tenant quotas, enforced by each proxy of the cluster
+        tenants = db(
+            (db.tenants.cluster_id == cluster_id) &
+            (db.tenants.is_active == True)
+        ).select(orderby=db.tenants.name)
+        for tenant in tenants:
+            config['tenants'].append({
+                'id': tenant.name,
+                'max_connections': tenant.max_connections or 0,
+                'requests_per_second': tenant.requests_per_second or 0,
+                'bandwidth_kbps': tenant.bandwidth_kbps or 0
+            })
+        
+        # Add quarantined services, under the policy on every proxy
+        quarantined = db(
+            (db.quarantined_services.cluster_id == cluster_id) &
+            (db.quarantined_services.released_at == None)
+        ).select(orderby=db.quarantined_services.service_id)
+        for entry in quarantined:
+            config['quarantine']['services'].append({
+                'service_id': entry.service_id,
+                'reason': entry.reason or '',
+                'since': entry.quarantined_at.isoformat() + 'Z'
+            })
+        
+        # Add backends drained on every proxy tier for maintenance
+        drains = db(
+            (db.backend_drains.cluster_id == cluster_id) &
+            (db.backend_drains.lifted_at == None)
+        ).select(orderby=db.backend_drains.host | db.backend_drains.port)
+        for entry in drains:
+            config['drained_backends'].append({
+                'host': entry.host,
+                'port': entry.port or 0
             })
         
         # Add certificates
@@ -72,6 +72,36 @@ def define_tables():
         Field('max_proxies', 'integer', default=3),  # Community: 3, Enterprise: from license
         Field('proxy_count', 'integer', default=0),  # Current proxy count
         
+        # Policy for source services quarantined by the proxies
+        Field('quarantine_connections_per_second', 'double', default=1),  # 0 = unchanged
+        Field('quarantine_block', 'boolean', default=False),  # Refuse their connections outright
+        Field('quarantine_log', 'boolean', default=True),     # Log every connection
+        
+        # Destination names the egress proxies may resolve, same fields as a mapping's dns
+        Field('egress_dns', 'json'),
+        
+        # Metadata
+        Field('created_by', 'reference auth_user'),
+        Field('created_at', 'datetime', default=datetime.utcnow),
+        Field('updated_at', 'datetime', default=datetime.utcnow, update=datetime.utcnow),
+        
+        # Validation
+        format='%(name)s'
+    )
+    
+    # Tenants sharing a cluster, with quotas enforced by every proxy instance
+    db.define_table(
+        'tenants',
+        Field('name', 'string', length=100, notnull=True),  # Tenant ID tagged on services, mappings and routes
+        Field('description', 'text'),
+        Field('cluster_id', 'reference clusters', notnull=True),
+        Field('is_active', 'boolean', default=True),
+        
+        # Quotas per proxy instance, 0 = unlimited
+        Field('max_connections', 'integer', default=0),       # Concurrent connections (ingress: requests in flight)
+        Field('requests_per_second', 'double', default=0),    # New connections, datagrams or HTTP requests
+        Field('bandwidth_kbps', 'integer', default=0),        # Shared by all of the tenant's traffic
+        
         # Metadata
         Field('created_by', 'reference auth_user'),
         Field('created_at', 'datetime', default=datetime.utcnow),
@@ -88,11 +118,12 @@ def define_tables():
         Field('ip_fqdn', 'string', length=255, notnull=True),  # IP or FQDN
         Field('collection', 'string', length=255),  # Service grouping/collection
         Field('cluster_id', 'reference clusters', notnull=True),
+        Field('tenant', 'string', length=100),  # Owning tenant, empty = shared by all tenants
         Field('is_active', 'boolean', default=True),
         
         # Authentication configuration (mutually exclusive)
-        Field('auth_type', 'string', length=20, default='none',  # none, base64, jwt
-              requires=IS_IN_SET(['none', 'base64', 'jwt'])),
+        Field('auth_type', 'string', length=20, default='none',  # none, base64, hmac, jwt
+              requires=IS_IN_SET(['none', 'base64', 'hmac', 'jwt'])),
         
         # Base64 token authentication
         Field('token_base64', 'string', length=512),
@@ -103,6 +134,12 @@ def define_tables():
         Field('jwt_last_rotation', 'datetime'),
         Field('jwt_rotation_enabled', 'boolean', default=False),
         
+        # Credentials replaced by the last rotation, still accepted until
+        # previous_valid_until so clients can roll over without a cutover
+        Field('previous_token_base64', 'string', length=512),
+        Field('previous_jwt_secret', 'string', length=512),
+        Field('previous_valid_until', 'datetime'),
+        
         # Service metadata
         Field('description', 'text'),
         Field('service_owner', 'reference auth_user'),
@@ -123,6 +160,7 @@ def define_tables():
         Field('name', 'string', length=255, notnull=True),
         Field('description', 'text'),
         Field('cluster_id', 'reference clusters', notnull=True),
+        Field('tenant', 'string', length=100),  # Owning tenant, counts towards its quotas
         Field('is_active', 'boolean', default=True),
         
         # Source and destination services (JSON arrays of service IDs)
@@ -142,6 +180,20 @@ def define_tables():
         Field('priority', 'integer', default=1000),  # Rule priority (lower = higher priority)
         Field('rate_limit', 'integer'),  # Requests per second limit
         Field('timeout', 'integer', default=30),  # Connection timeout in seconds
+        Field('fault_injection', 'json'),  # Latency, abort and bandwidth faults for resilience testing
+        Field('dns', 'json'),  # Domain allow/deny lists and rewrites for the egress DNS proxy
+        Field('smtp', 'json'),  # Sender/recipient domains, rate and TLS policy for the egress SMTP relay
+        Field('condition', 'text'),  # CEL expression over source, listener and connection
+        Field('schedule', 'json'),  # Validity period and weekly windows, e.g. business hours or a temporary grant
+        Field('dlp', 'json'),  # Sensitive data scanning of outbound payloads: alert, mask or block
+        Field('tls_inspection', 'json'),  # Egress TLS interception with server name exclusions (enterprise)
+        Field('ssh', 'json'),  # SSH auditing: handshake metadata or full session recording
+        Field('tls_policy', 'json'),  # Destination TLS mode: require, passthrough or terminate
+        Field('upstream_proxy', 'json'),  # Upstream HTTP CONNECT or SOCKS5 proxies tried in order, with a fallback
+        Field('slos', 'json'),  # Connect latency, error rate and bandwidth objectives with burn rate alerts
+        Field('source_cidrs', 'json'),  # Client CIDRs matched; the most specific matching mapping wins
+        Field('listen_ports', 'json'),  # Proxy listener ports matched
+        Field('hostnames', 'json'),  # TLS server names matched, exact or *.example.com
         
         # Justification and approval
         Field('justification', 'text'),  # Business justification for the mapping
@@ -181,6 +233,7 @@ def define_tables():
         Field('cluster_id', 'reference clusters', notnull=True),
         Field('role', 'string', length=20, default='viewer',
               requires=IS_IN_SET(['admin', 'manager', 'viewer'])),
+        Field('tenant', 'string', length=100),  # Limits the user to one tenant, empty = whole cluster
         Field('assigned_by', 'reference auth_user'),
         Field('assigned_at', 'datetime', default=datetime.utcnow),
         
@@ -278,10 +331,13 @@ def define_tables():
         Field('name', 'string', length=255, notnull=True),
         Field('description', 'text'),
         Field('cluster_id', 'reference clusters', notnull=True),
+        Field('tenant', 'string', length=100),  # Owning tenant, counts towards its quotas
 
         # Routing rules
         Field('host_pattern', 'string', length=255),  # Host-based routing (*.example.com)
         Field('path_pattern', 'string', length=255),  # Path-based routing (/api/*)
+        Field('condition', 'text'),  # CEL expression over source, request and connection
+        Field('schedule', 'json'),  # Validity period and weekly windows the route is active in
         Field('priority', 'integer', default=100),     # Lower numbers = higher priority
 
         # Backend services
@@ -305,8 +361,26 @@ def define_tables():
         # Rate limiting and DDoS protection
         Field('rate_limit_enabled', 'boolean', default=False),
         Field('rate_limit_rps', 'integer', default=1000),
+        Field('rate_limit_burst', 'integer', default=0),         # 0 = rate_limit_rps
+        Field('rate_limit_client_rps', 'integer', default=0),    # per client IP, 0 = unlimited
+        Field('rate_limit_client_burst', 'integer', default=0),
         Field('ddos_protection_enabled', 'boolean', default=False),
         Field('ddos_threshold_pps', 'integer', default=10000),
+        Field('max_body_size', 'bigint', default=0),  # bytes, 0 = proxy default
+        Field('request_timeout_ms', 'integer', default=0,
+              requires=IS_INT_IN_RANGE(0, 86400000)),  # budget forwarded to backends, 0 = none
+
+        # Bot protection
+        Field('bot_protection_enabled', 'boolean', default=False),
+        Field('bot_action', 'string', length=16, default='challenge',
+              requires=IS_IN_SET(['allow', 'tarpit', 'block', 'challenge'])),
+
+        # TLS client fingerprints (JA3 hashes or JA4 strings)
+        Field('tls_fingerprint_allow', 'list:string'),
+        Field('tls_fingerprint_deny', 'list:string'),
+
+        # Latency, abort and bandwidth faults for resilience testing
+        Field('fault_injection', 'json'),
 
         # Headers and transformations
         Field('request_headers', 'json'),   # Headers to add/modify on request
@@ -406,6 +480,35 @@ def define_tables():
         migrate=True
     )
     
+    # Source services quarantined after repeated WAF or anomaly flags
+    db.define_table(
+        'quarantined_services',
+        Field('cluster_id', 'reference clusters', notnull=True),
+        Field('service_id', 'reference services', notnull=True),
+        Field('reason', 'text'),
+        Field('reported_by', 'string', length=100),  # Proxy that quarantined the service
+        Field('quarantined_at', 'datetime', default=datetime.utcnow),
+        Field('released_at', 'datetime'),  # Set by an operator, empty while quarantined
+        Field('released_by', 'reference auth_user'),
+        
+        format='Service %(service_id)s quarantine'
+    )
+    
+    # Backends drained on every proxy tier of the cluster for maintenance
+    db.define_table(
+        'backend_drains',
+        Field('cluster_id', 'reference clusters', notnull=True),
+        Field('host', 'string', length=255, notnull=True),
+        Field('port', 'integer', default=0),  # 0 drains every port of the host
+        Field('reason', 'text'),
+        Field('drained_by', 'reference auth_user'),
+        Field('drained_at', 'datetime', default=datetime.utcnow),
+        Field('lifted_at', 'datetime'),  # Set by an operator, empty while drained
+        Field('lifted_by', 'reference auth_user'),
+        
+        format='%(host)s drain'
+    )
+    
     # Configuration cache for performance
     db.define_table(
         'config_cache',
@@ -1004,4 +1004,260 @@ class TLSProxyConfigManager:
             'buffer_size_kb': config.buffer_size_kb,
             'certificates': certificates,
             'enterprise_available': True,
-        }
\ No newline at end of file
+        }
+
+class ClusterCAModel:
+    """Embedded per-cluster CA that issues short-lived mTLS certificates to proxies"""
+
+    # Bounds for the lifetime a proxy may request for an issued certificate
+    MIN_TTL_SECONDS = 3600
+    MAX_TTL_SECONDS = 7 * 24 * 3600
+    DEFAULT_TTL_SECONDS = 24 * 3600
+
+    # Tolerated clock skew between the manager and proxies
+    BACKDATE = timedelta(minutes=5)
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define cluster CA table"""
+        return db.define_table(
+            'cluster_cas',
+            Field('cluster_id', type='reference clusters', unique=True, required=True),
+            Field('ca_cert_data', type='text', required=True),
+            Field('ca_key_data', type='text', required=True),
+            Field('ca_subject', type='string', length=255),
+            Field('ca_serial_number', type='string', length=100),
+            Field('ca_fingerprint_sha256', type='string', length=64),
+            Field('ca_expires_at', type='datetime'),
+            Field('certificates_issued', type='integer', default=0),
+            Field('last_issued_at', type='datetime'),
+            Field('created_at', type='datetime', default=datetime.utcnow),
+            Field('updated_at', type='datetime', update=datetime.utcnow),
+        )
+
+    @staticmethod
+    def generate_ca(cluster_name: str, lifetime_years: int = 10) -> Dict[str, Any]:
+        """Generate a self-signed ECDSA P-384 CA for a cluster"""
+        from cryptography.hazmat.primitives.asymmetric import ec
+        from cryptography.x509.oid import NameOID
+
+        key = ec.generate_private_key(ec.SECP384R1())
+        subject = x509.Name([
+            x509.NameAttribute(NameOID.ORGANIZATION_NAME, "MarchProxy"),
+            x509.NameAttribute(NameOID.ORGANIZATIONAL_UNIT_NAME, "Cluster mTLS CA"),
+            x509.NameAttribute(NameOID.COMMON_NAME, f"MarchProxy Cluster CA ({cluster_name})"),
+        ])
+        now = datetime.utcnow()
+
+        cert = x509.CertificateBuilder().subject_name(
+            subject
+        ).issuer_name(
+            subject
+        ).public_key(
+            key.public_key()
+        ).serial_number(
+            x509.random_serial_number()
+        ).not_valid_before(
+            now - ClusterCAModel.BACKDATE
+        ).not_valid_after(
+            now + timedelta(days=365 * lifetime_years)
+        ).add_extension(
+            x509.BasicConstraints(ca=True, path_length=0),
+            critical=True,
+        ).add_extension(
+            x509.KeyUsage(
+                digital_signature=True,
+                key_cert_sign=True,
+                crl_sign=True,
+                content_commitment=False,
+                data_encipherment=False,
+                key_agreement=False,
+                key_encipherment=False,
+                encipher_only=False,
+                decipher_only=False,
+            ),
+            critical=True,
+        ).add_extension(
+            x509.SubjectKeyIdentifier.from_public_key(key.public_key()),
+            critical=False,
+        ).sign(key, hashes.SHA384())
+
+        return {
+            'ca_cert': cert.public_bytes(serialization.Encoding.PEM).decode(),
+            'ca_key': key.private_bytes(
+                encoding=serialization.Encoding.PEM,
+                format=serialization.PrivateFormat.PKCS8,
+                encryption_algorithm=serialization.NoEncryption()
+            ).decode(),
+            'ca_subject': cert.subject.rfc4514_string(),
+            'ca_serial': str(cert.serial_number),
+            'ca_fingerprint': cert.fingerprint(hashes.SHA256()).hex(),
+            'ca_expires_at': cert.not_valid_after,
+        }
+
+    @staticmethod
+    def get_or_create(db: DAL, cluster_id: int, cluster_name: str):
+        """Return the cluster's CA, generating it on first use"""
+        ca = db(db.cluster_cas.cluster_id == cluster_id).select().first()
+        if ca:
+            return ca
+
+        ca_data = ClusterCAModel.generate_ca(cluster_name)
+        ca_id = db.cluster_cas.insert(
+            cluster_id=cluster_id,
+            ca_cert_data=ca_data['ca_cert'],
+            ca_key_data=ca_data['ca_key'],
+            ca_subject=ca_data['ca_subject'],
+            ca_serial_number=ca_data['ca_serial'],
+            ca_fingerprint_sha256=ca_data['ca_fingerprint'],
+            ca_expires_at=ca_data['ca_expires_at'],
+        )
+        db.commit()
+        logger.info(f"Generated mTLS CA for cluster {cluster_name}")
+        return db.cluster_cas[ca_id]
+
+    @staticmethod
+    def sign_csr(db: DAL, cluster_id: int, cluster_name: str, common_name: str,
+                 csr_pem: str, ttl_seconds: int = None) -> Dict[str, Any]:
+        """Sign a proxy CSR with the cluster CA.
+
+        The subject is always set to the proxy name so a proxy cannot request
+        another identity; SANs are copied from the CSR.
+        """
+        from cryptography.x509.oid import NameOID, ExtendedKeyUsageOID
+
+        try:
+            csr = x509.load_pem_x509_csr(csr_pem.encode())
+        except ValueError as e:
+            raise ValueError(f"Invalid CSR: {e}")
+        if not csr.is_signature_valid:
+            raise ValueError("CSR signature is invalid")
+
+        ttl = ttl_seconds or ClusterCAModel.DEFAULT_TTL_SECONDS
+        ttl = max(ClusterCAModel.MIN_TTL_SECONDS, min(ttl, ClusterCAModel.MAX_TTL_SECONDS))
+
+        ca = ClusterCAModel.get_or_create(db, cluster_id, cluster_name)
+        ca_cert = x509.load_pem_x509_certificate(ca.ca_cert_data.encode())
+        ca_key = serialization.load_pem_private_key(ca.ca_key_data.encode(), password=None)
+
+        now = datetime.utcnow()
+        not_after = min(now + timedelta(seconds=ttl), ca_cert.not_valid_after)
+
+        builder = x509.CertificateBuilder().subject_name(
+            x509.Name([
+                x509.NameAttribute(NameOID.ORGANIZATION_NAME, "MarchProxy"),
+                x509.NameAttribute(NameOID.ORGANIZATIONAL_UNIT_NAME, cluster_name),
+                x509.NameAttribute(NameOID.COMMON_NAME, common_name),
+            ])
+        ).issuer_name(
+            ca_cert.subject
+        ).public_key(
+            csr.public_key()
+        ).serial_number(
+            x509.random_serial_number()
+        ).not_valid_before(
+            now - ClusterCAModel.BACKDATE
+        ).not_valid_after(
+            not_after
+        ).add_extension(
+            x509.BasicConstraints(ca=False, path_length=None),
+            critical=True,
+        ).add_extension(
+            x509.KeyUsage(
+                digital_signature=True,
+                key_encipherment=True,
+                content_commitment=False,
+                data_encipherment=False,
+                key_agreement=False,
+                key_cert_sign=False,
+                crl_sign=False,
+                encipher_only=False,
+                decipher_only=False,
+            ),
+            critical=True,
+        ).add_extension(
+            x509.ExtendedKeyUsage([
+                ExtendedKeyUsageOID.SERVER_AUTH,
+                ExtendedKeyUsageOID.CLIENT_AUTH,
+            ]),
+            critical=False,
+        ).add_extension(
+            x509.AuthorityKeyIdentifier.from_issuer_public_key(ca_key.public_key()),
+            critical=False,
+        )
+
+        try:
+            san = csr.extensions.get_extension_for_class(x509.SubjectAlternativeName)
+            builder = builder.add_extension(san.value, critical=False)
+        except x509.ExtensionNotFound:
+            builder = builder.add_extension(
+                x509.SubjectAlternativeName([x509.DNSName(common_name)]),
+                critical=False,
+            )
+
+        cert = builder.sign(ca_key, hashes.SHA384())
+
+        db(db.cluster_cas.id == ca.id).update(
+            certificates_issued=(ca.certificates_issued or 0) + 1,
+            last_issued_at=now,
+        )
+
+        return {
+            'certificate': cert.public_bytes(serialization.Encoding.PEM).decode(),
+            'ca_certificate': ca.ca_cert_data,
+            'serial_number': str(cert.serial_number),
+            'expires_at': not_after.isoformat(),
+        }
+
+
+class SessionTicketKeyModel:
+    """TLS session ticket keys shared by the ingress replicas of a cluster"""
+
+    ROTATION_INTERVAL = timedelta(hours=1)
+    KEYS_KEPT = 3
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define session ticket key table"""
+        return db.define_table(
+            'session_ticket_keys',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('key_data', type='string', required=True, length=64),  # base64 of 32 bytes
+            Field('created_at', type='datetime', default=datetime.utcnow),
+        )
+
+    @staticmethod
+    def get_keys(db: DAL, cluster_id: int) -> List[Dict[str, Any]]:
+        """Return the cluster's keys newest first, rotating when the newest is due.
+
+        The newest key encrypts tickets; older ones are kept so tickets issued
+        before a rotation still resume on every replica.
+        """
+        import secrets
+
+        query = db.session_ticket_keys.cluster_id == cluster_id
+        keys = db(query).select(orderby=~db.session_ticket_keys.created_at)
+
+        now = datetime.utcnow()
+        if not keys or keys.first().created_at <= now - SessionTicketKeyModel.ROTATION_INTERVAL:
+            db.session_ticket_keys.insert(
+                cluster_id=cluster_id,
+                key_data=base64.b64encode(secrets.token_bytes(32)).decode(),
+                created_at=now,
+            )
+            keys = db(query).select(orderby=~db.session_ticket_keys.created_at)
+
+            expired = [key.id for key in keys[SessionTicketKeyModel.KEYS_KEPT:]]
+            if expired:
+                db(db.session_ticket_keys.id.belongs(expired)).delete()
+            db.commit()
+            keys = keys[:SessionTicketKeyModel.KEYS_KEPT]
+
+        return [
+            {
+                'id': key.id,
+                'key': key.key_data,
+                'created_at': key.created_at.isoformat(),
+            }
+            for key in keys
+        ]
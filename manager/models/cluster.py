@@ -31,6 +31,13 @@ class ClusterModel:
             Field('is_active', type='boolean', default=True),
             Field('is_default', type='boolean', default=False),
             Field('max_proxies', type='integer', default=3),
+            Field('rollout_canary_percent', type='integer', default=0),  # Proxies getting config changes first, 0 = no staged rollout
+            Field('rollout_observe_seconds', type='integer', default=300),
+            Field('rollout_max_error_rate', type='double', default=0.05),
+            Field('quarantine_connections_per_second', type='double', default=1),  # Per quarantined service, 0 = unchanged
+            Field('quarantine_block', type='boolean', default=False),  # Refuse quarantined services outright
+            Field('quarantine_log', type='boolean', default=True),  # Log every connection of quarantined services
+            Field('egress_dns', type='json'),  # Destination names the egress proxies may resolve, same fields as a mapping's dns
             Field('created_by', type='reference auth_user', required=True),
             Field('created_at', type='datetime', default=datetime.utcnow),
             Field('updated_at', type='datetime', update=datetime.utcnow),
@@ -186,6 +193,18 @@ class ClusterModel:
         # Get certificates available to this cluster
         certificates = db(db.certificates.is_active == True).select()
 
+        # Get tenant quotas enforced by the cluster's proxies
+        from .tenant import TenantModel
+        tenants = TenantModel.get_cluster_quotas(db, cluster_id)
+
+        # Get quarantined services and the policy applied to them
+        from .quarantine import QuarantineModel
+        quarantine = QuarantineModel.get_cluster_quarantine(db, cluster)
+
+        # Get backends drained on every proxy tier for maintenance
+        from .drain import DrainModel
+        drained_backends = DrainModel.get_cluster_drains(db, cluster_id)
+
         return {
             'cluster': {
                 'id': cluster.id,
@@ -197,7 +216,11 @@ class ClusterModel:
             },
             'services': [dict(service) for service in services],
             'mappings': [dict(mapping) for mapping in mappings],
-            'certificates': [dict(cert) for cert in certificates]
+            'certificates': [dict(cert) for cert in certificates],
+            'tenants': tenants,
+            'quarantine': quarantine,
+            'drained_backends': drained_backends,
+            'egress_dns': cluster.egress_dns
         }
 
     @staticmethod
@@ -231,6 +254,7 @@ class UserClusterAssignmentModel:
             Field('user_id', type='reference auth_user', required=True),
             Field('cluster_id', type='reference clusters', required=True),
             Field('role', type='string', default='service_owner', length=50),
+            Field('tenant', type='string', length=100),  # Limits the user to one tenant, empty = whole cluster
             Field('assigned_by', type='reference auth_user', required=True),
             Field('assigned_at', type='datetime', default=datetime.utcnow),
             Field('is_active', type='boolean', default=True),
@@ -238,8 +262,9 @@ class UserClusterAssignmentModel:
 
     @staticmethod
     def assign_user_to_cluster(db: DAL, user_id: int, cluster_id: int,
-                              role: str = 'service_owner', assigned_by: int = None) -> bool:
-        """Assign user to cluster with role"""
+                              role: str = 'service_owner', assigned_by: int = None,
+                              tenant: str = None) -> bool:
+        """Assign user to cluster with role, limited to one tenant when given"""
         # Check if assignment already exists
         existing = db(
             (db.user_cluster_assignments.user_id == user_id) &
@@ -248,13 +273,14 @@ class UserClusterAssignmentModel:
         ).select().first()
 
         if existing:
-            existing.update_record(role=role, assigned_by=assigned_by)
+            existing.update_record(role=role, assigned_by=assigned_by, tenant=tenant)
             return True
 
         db.user_cluster_assignments.insert(
             user_id=user_id,
             cluster_id=cluster_id,
             role=role,
+            tenant=tenant,
             assigned_by=assigned_by
         )
         return True
@@ -278,6 +304,7 @@ class UserClusterAssignmentModel:
                 'cluster_name': assignment.clusters.name,
                 'cluster_description': assignment.clusters.description,
                 'role': assignment.user_cluster_assignments.role,
+                'tenant': assignment.user_cluster_assignments.tenant,
                 'assigned_at': assignment.user_cluster_assignments.assigned_at
             }
             for assignment in assignments
@@ -328,6 +355,13 @@ class UpdateClusterRequest(BaseModel):
     log_netflow: Optional[bool] = None
     log_debug: Optional[bool] = None
     max_proxies: Optional[int] = None
+    rollout_canary_percent: Optional[int] = None
+    rollout_observe_seconds: Optional[int] = None
+    rollout_max_error_rate: Optional[float] = None
+    quarantine_connections_per_second: Optional[float] = None
+    quarantine_block: Optional[bool] = None
+    quarantine_log: Optional[bool] = None
+    egress_dns: Optional[Dict[str, Any]] = None
 
     @validator('max_proxies')
     def validate_max_proxies(cls, v):
@@ -335,6 +369,35 @@ class UpdateClusterRequest(BaseModel):
             raise ValueError('Max proxies must be between 1 and 1000')
         return v
 
+    @validator('rollout_canary_percent')
+    def validate_rollout_canary_percent(cls, v):
+        if v is not None and (v < 0 or v > 100):
+            raise ValueError('Rollout canary percent must be between 0 and 100')
+        return v
+
+    @validator('rollout_observe_seconds')
+    def validate_rollout_observe_seconds(cls, v):
+        if v is not None and v < 30:
+            raise ValueError('Rollout observe seconds must be at least 30')
+        return v
+
+    @validator('rollout_max_error_rate')
+    def validate_rollout_max_error_rate(cls, v):
+        if v is not None and (v <= 0 or v > 1):
+            raise ValueError('Rollout max error rate must be between 0 and 1')
+        return v
+
+    @validator('quarantine_connections_per_second')
+    def validate_quarantine_connections_per_second(cls, v):
+        if v is not None and v < 0:
+            raise ValueError('Quarantine connections per second must not be negative')
+        return v
+
+    @validator('egress_dns')
+    def validate_egress_dns(cls, v):
+        from .mapping import MappingModel
+        return MappingModel.validate_dns_policy(v)
+
 
 class ClusterResponse(BaseModel):
     id: int
@@ -355,9 +418,15 @@ class ClusterResponse(BaseModel):
 class AssignUserToClusterRequest(BaseModel):
     user_id: int
     role: str = 'service_owner'
+    tenant: Optional[str] = None
 
     @validator('role')
     def validate_role(cls, v):
         if v not in ['admin', 'service_owner']:
             raise ValueError('Role must be either "admin" or "service_owner"')
-        return v
\ No newline at end of file
+        return v
+
+    @validator('tenant')
+    def validate_tenant(cls, v):
+        from .tenant import TenantModel
+        return TenantModel.validate_tenant(v)
@@ -0,0 +1,240 @@
+"""
+Coordination models for MarchProxy Manager
+
+Replicas of a proxy role coordinate through the manager: leases elect one
+replica to run singleton tasks such as BGP announcements or autoscaling,
+and shared counters let replicas enforce cluster-wide limits such as rate
+limits. Leases expire unless their holder renews them, so a failed leader
+is replaced within one lease TTL. Every change of holder starts a new term,
+which holders can use to fence off work started under an older term.
+
+Copyright (C) 2025 MarchProxy Contributors
+Licensed under GNU Affero General Public License v3.0
+"""
+
+import logging
+import re
+from datetime import datetime, timedelta
+from typing import Optional, Dict, Any, List
+from pydal import DAL, Field
+from pydantic import BaseModel, validator
+
+logger = logging.getLogger(__name__)
+
+# Lease and counter names, such as nlb/bgp or nlb/ratelimit/http
+NAME_PATTERN = re.compile(r'^[a-z0-9][a-z0-9_./-]{0,127}$')
+
+MIN_LEASE_TTL = 5
+MAX_LEASE_TTL = 300
+
+# Counters nobody touched for this long are deleted
+COUNTER_RETENTION = timedelta(days=1)
+
+
+class CoordinationLeaseModel:
+    """Leases electing one replica per role for singleton tasks"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define coordination leases table"""
+        table = db.define_table(
+            'coordination_leases',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('name', type='string', length=128, required=True),
+            Field('holder', type='string', length=100),
+            Field('term', type='bigint', default=0),
+            Field('acquired_at', type='datetime'),
+            Field('renewed_at', type='datetime'),
+            Field('expires_at', type='datetime'),
+        )
+        _create_name_index(db, 'coordination_leases')
+        return table
+
+    @staticmethod
+    def acquire(db: DAL, cluster_id: int, name: str, holder: str, ttl_seconds: int) -> Dict[str, Any]:
+        """Acquire or renew a lease for holder. Returns the lease, held by
+        holder when it was free, expired or already theirs."""
+        now = datetime.utcnow()
+        expires_at = now + timedelta(seconds=ttl_seconds)
+
+        for _ in range(3):
+            lease = db(
+                (db.coordination_leases.cluster_id == cluster_id) &
+                (db.coordination_leases.name == name)
+            ).select().first()
+
+            if lease is None:
+                # Replicas racing for a new lease all get here; the unique
+                # index lets one insert win and sends the others round again
+                if _insert_once(db, db.coordination_leases,
+                                cluster_id=cluster_id, name=name, holder=holder, term=1,
+                                acquired_at=now, renewed_at=now, expires_at=expires_at):
+                    return CoordinationLeaseModel._result(name, holder, holder, 1, expires_at)
+                continue
+
+            if lease.holder == holder and lease.expires_at > now:
+                lease.update_record(renewed_at=now, expires_at=expires_at)
+                return CoordinationLeaseModel._result(name, holder, holder, lease.term, expires_at)
+
+            if lease.holder and lease.expires_at > now:
+                return CoordinationLeaseModel._result(name, holder, lease.holder, lease.term, lease.expires_at)
+
+            # Free or expired: take it over unless another replica got there
+            # first, which shows as a changed term
+            taken = db(
+                (db.coordination_leases.id == lease.id) &
+                (db.coordination_leases.term == lease.term)
+            ).update(holder=holder, term=lease.term + 1, acquired_at=now,
+                     renewed_at=now, expires_at=expires_at)
+            db.commit()
+            if taken:
+                return CoordinationLeaseModel._result(name, holder, holder, lease.term + 1, expires_at)
+
+        lease = db(
+            (db.coordination_leases.cluster_id == cluster_id) &
+            (db.coordination_leases.name == name)
+        ).select().first()
+        return CoordinationLeaseModel._result(name, holder, lease.holder, lease.term, lease.expires_at)
+
+    @staticmethod
+    def release(db: DAL, cluster_id: int, name: str, holder: str) -> bool:
+        """Release a lease held by holder so another replica can take over at once"""
+        return db(
+            (db.coordination_leases.cluster_id == cluster_id) &
+            (db.coordination_leases.name == name) &
+            (db.coordination_leases.holder == holder)
+        ).update(holder=None, expires_at=datetime.utcnow()) > 0
+
+    @staticmethod
+    def _result(name: str, requester: str, holder: Optional[str], term: int,
+                expires_at: datetime) -> Dict[str, Any]:
+        """Lease as returned to a proxy"""
+        return {
+            'name': name,
+            'holder': holder or '',
+            'held': holder == requester,
+            'term': term,
+            'expires_at': expires_at.isoformat() + 'Z',
+        }
+
+    @staticmethod
+    def list_leases(db: DAL, cluster_id: int) -> List[Dict[str, Any]]:
+        """Leases of the cluster and who holds them"""
+        now = datetime.utcnow()
+        leases = db(db.coordination_leases.cluster_id == cluster_id).select(
+            orderby=db.coordination_leases.name
+        )
+        return [
+            {
+                'name': lease.name,
+                'holder': lease.holder if lease.expires_at and lease.expires_at > now else None,
+                'term': lease.term,
+                'acquired_at': lease.acquired_at.isoformat() if lease.acquired_at else None,
+                'expires_at': lease.expires_at.isoformat() if lease.expires_at else None,
+            }
+            for lease in leases
+        ]
+
+
+class SharedCounterModel:
+    """Counters replicas add to, for limits enforced across a cluster"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define shared counters table"""
+        table = db.define_table(
+            'shared_counters',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('name', type='string', length=128, required=True),
+            Field('value', type='bigint', default=0),
+            Field('updated_at', type='datetime', default=datetime.utcnow),
+        )
+        _create_name_index(db, 'shared_counters')
+        return table
+
+    @staticmethod
+    def add(db: DAL, cluster_id: int, increments: Dict[str, int]) -> Dict[str, int]:
+        """Add increments to the cluster's counters, returning their totals"""
+        now = datetime.utcnow()
+        totals = {}
+        for name, increment in increments.items():
+            query = (db.shared_counters.cluster_id == cluster_id) & (db.shared_counters.name == name)
+            if increment:
+                updated = db(query).update(value=db.shared_counters.value + increment, updated_at=now)
+                if not updated and not _insert_once(db, db.shared_counters, cluster_id=cluster_id,
+                                                    name=name, value=increment, updated_at=now):
+                    # Another replica created the counter first
+                    db(query).update(value=db.shared_counters.value + increment, updated_at=now)
+                db.commit()
+            counter = db(query).select(db.shared_counters.value).first()
+            totals[name] = counter.value if counter else 0
+        return totals
+
+    @staticmethod
+    def cleanup_old_counters(db: DAL) -> int:
+        """Delete counters nobody added to within the retention"""
+        return db(db.shared_counters.updated_at < datetime.utcnow() - COUNTER_RETENTION).delete()
+
+
+def _create_name_index(db: DAL, table: str):
+    """Make names unique per cluster, so replicas racing to create the same
+    lease or counter cannot both insert it"""
+    try:
+        db.executesql(
+            f'CREATE UNIQUE INDEX IF NOT EXISTS idx_{table}_name ON {table}(cluster_id, name)'
+        )
+    except Exception as e:
+        logger.warning(f"Failed to create unique index on {table}: {e}")
+
+
+def _insert_once(db: DAL, table, **fields) -> bool:
+    """Insert a row, returning False when the unique index shows another
+    replica inserted it first"""
+    try:
+        table.insert(**fields)
+        db.commit()
+        return True
+    except db._adapter.driver.IntegrityError:
+        db.rollback()
+        return False
+
+
+def _validate_name(v):
+    if not NAME_PATTERN.match(v):
+        raise ValueError('Names are lowercase letters, digits and _ . / - up to 128 characters')
+    return v
+
+
+# Pydantic models for request/response validation
+class LeaseRequest(BaseModel):
+    proxy_name: str
+    cluster_api_key: str
+    name: str
+    ttl_seconds: int = 15
+    release: bool = False
+
+    @validator('name')
+    def validate_name(cls, v):
+        return _validate_name(v)
+
+    @validator('ttl_seconds')
+    def validate_ttl_seconds(cls, v):
+        if v < MIN_LEASE_TTL or v > MAX_LEASE_TTL:
+            raise ValueError(f'ttl_seconds must be between {MIN_LEASE_TTL} and {MAX_LEASE_TTL}')
+        return v
+
+
+class CountersRequest(BaseModel):
+    proxy_name: str
+    cluster_api_key: str
+    increments: Dict[str, int]
+
+    @validator('increments')
+    def validate_increments(cls, v):
+        if len(v) > 100:
+            raise ValueError('At most 100 counters per request')
+        for name, increment in v.items():
+            _validate_name(name)
+            if increment < 0:
+                raise ValueError('Increments must not be negative')
+        return v
@@ -0,0 +1,131 @@
+"""
+Backend drain models for MarchProxy Manager
+
+Operators drain a backend host before maintenance. The manager distributes
+the drain to every proxy of the cluster: ingress proxies stop routing
+requests to it, NLBs stop routing connections to its modules and DBLBs stop
+connecting to it, while the work already on it finishes.
+
+Copyright (C) 2025 MarchProxy Contributors
+Licensed under GNU Affero General Public License v3.0
+"""
+
+from datetime import datetime
+from typing import Optional, Dict, Any, List
+from pydal import DAL, Field
+from pydantic import BaseModel, validator
+
+
+class DrainModel:
+    """Backends drained across every proxy tier of a cluster"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define backend drains table"""
+        return db.define_table(
+            'backend_drains',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('host', type='string', length=255, required=True),
+            Field('port', type='integer', default=0),  # 0 drains every port of the host
+            Field('reason', type='text'),
+            Field('drained_by', type='reference auth_user'),
+            Field('drained_at', type='datetime', default=datetime.utcnow),
+            Field('lifted_at', type='datetime'),  # None while drained
+            Field('lifted_by', type='reference auth_user'),
+        )
+
+    @staticmethod
+    def drain(db: DAL, cluster_id: int, host: str, port: int, reason: str,
+              drained_by: int) -> int:
+        """Drain a backend of the cluster, returning the drain ID.
+
+        A backend that is already drained keeps its first drain.
+        """
+        active = DrainModel._active(db, cluster_id, host, port)
+        if active:
+            return active.id
+
+        return db.backend_drains.insert(
+            cluster_id=cluster_id,
+            host=host,
+            port=port,
+            reason=reason,
+            drained_by=drained_by,
+        )
+
+    @staticmethod
+    def lift(db: DAL, cluster_id: int, drain_id: int, lifted_by: int) -> bool:
+        """Return a drained backend to service, False if it isn't drained"""
+        drain = db.backend_drains[drain_id]
+        if not drain or drain.cluster_id != cluster_id or drain.lifted_at:
+            return False
+
+        drain.update_record(lifted_at=datetime.utcnow(), lifted_by=lifted_by)
+        return True
+
+    @staticmethod
+    def list_drains(db: DAL, cluster_id: int,
+                    include_lifted: bool = False) -> List[Dict[str, Any]]:
+        """Drains of the cluster, newest first"""
+        query = db.backend_drains.cluster_id == cluster_id
+        if not include_lifted:
+            query &= db.backend_drains.lifted_at == None
+
+        rows = db(query).select(orderby=~db.backend_drains.drained_at)
+        return [
+            {
+                'id': row.id,
+                'host': row.host,
+                'port': row.port or 0,
+                'reason': row.reason,
+                'drained_by': row.drained_by,
+                'drained_at': row.drained_at,
+                'lifted_at': row.lifted_at,
+                'lifted_by': row.lifted_by,
+            }
+            for row in rows
+        ]
+
+    @staticmethod
+    def get_cluster_drains(db: DAL, cluster_id: int) -> List[Dict[str, Any]]:
+        """Drained backends for the cluster's proxies"""
+        rows = db(
+            (db.backend_drains.cluster_id == cluster_id) &
+            (db.backend_drains.lifted_at == None)
+        ).select(orderby=db.backend_drains.host | db.backend_drains.port)
+
+        return [{'host': row.host, 'port': row.port or 0} for row in rows]
+
+    @staticmethod
+    def _active(db: DAL, cluster_id: int, host: str, port: int):
+        """Drain of a backend that hasn't been lifted"""
+        return db(
+            (db.backend_drains.cluster_id == cluster_id) &
+            (db.backend_drains.host == host) &
+            (db.backend_drains.port == port) &
+            (db.backend_drains.lifted_at == None)
+        ).select().first()
+
+
+# Pydantic models for request/response validation
+class DrainRequest(BaseModel):
+    host: str
+    port: int = 0
+    reason: Optional[str] = None
+
+    @validator('host')
+    def validate_host(cls, v):
+        v = v.strip().strip('[]').lower()
+        if not v or len(v) > 255:
+            raise ValueError('Host is required and at most 255 characters')
+        return v
+
+    @validator('port')
+    def validate_port(cls, v):
+        if v < 0 or v > 65535:
+            raise ValueError('Port must be between 0 and 65535, 0 for every port')
+        return v
+
+    @validator('reason')
+    def validate_reason(cls, v):
+        return v[:1000] if v else v
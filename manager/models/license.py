@@ -460,6 +460,26 @@ class LicenseManager:
             'error': license_data.get('error')
         }
 
+    def get_entitlements(self) -> Dict[str, Any]:
+        """Enterprise features the license entitles proxies to, from the cache"""
+        status = self.get_license_status_sync()
+
+        entitled = []
+        if status.get('valid') and status.get('is_enterprise'):
+            features = status.get('features') or {}
+            entitled = sorted(name for name, enabled in features.items() if enabled)
+
+        expires_at = status.get('expires_at')
+        if isinstance(expires_at, datetime):
+            expires_at = expires_at.isoformat()
+
+        return {
+            'edition': status.get('edition', 'Community'),
+            'valid': status.get('valid', False),
+            'features': entitled,
+            'expires_at': expires_at
+        }
+
     async def check_proxy_registration(self, cluster_id: int) -> bool:
         """Check if new proxy can be registered"""
         if not self.license_key:
@@ -5,12 +5,64 @@ Copyright (C) 2025 MarchProxy Contributors
 Licensed under GNU Affero General Public License v3.0
 """
 
+import ipaddress
 import re
 from datetime import datetime
 from typing import Optional, Dict, Any, List, Union
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
 from pydal import DAL, Field
 from pydantic import BaseModel, validator
 
+# Fault injection spec fields, matching the proxies' fault.Spec
+FAULT_INJECTION_FIELDS = [
+    'delay_ms', 'delay_percent', 'abort_percent', 'abort_status', 'abort_errno', 'bandwidth_kbps'
+]
+
+# Errors aborted egress connections can simulate
+FAULT_ERRNOS = ['ECONNRESET', 'ECONNREFUSED', 'ETIMEDOUT']
+
+# DNS policy fields, matching the egress proxy's dnsproxy.Policy
+DNS_POLICY_FIELDS = ['allow_domains', 'deny_domains', 'rewrites']
+
+# SMTP policy fields, matching the egress proxy's smtprelay.Policy
+SMTP_POLICY_FIELDS = [
+    'allowed_recipient_domains', 'allowed_sender_domains', 'messages_per_minute',
+    'max_recipients', 'max_message_size', 'require_tls'
+]
+
+# Longest CEL condition the proxies compile
+MAX_CONDITION_LENGTH = 4096
+
+# Schedule fields and weekdays, matching the proxies' schedule.Schedule
+SCHEDULE_FIELDS = ['valid_from', 'valid_until', 'timezone', 'windows']
+SCHEDULE_DAYS = ['mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun']
+
+# DLP policy fields, actions and built-in detectors, matching the egress
+# proxy's dlp.Policy
+DLP_POLICY_FIELDS = ['action', 'detectors', 'custom', 'max_scan_bytes']
+DLP_ACTIONS = ['alert', 'mask', 'block']
+DLP_DETECTORS = ['api_key', 'aws_access_key', 'credit_card', 'github_token', 'private_key', 'ssn']
+
+# TLS inspection fields, matching the egress proxy's tlsinspect.Policy
+TLS_INSPECTION_FIELDS = ['enabled', 'exclude']
+
+# TLS policy fields and modes, matching the egress proxy's tlsmode.Policy
+TLS_POLICY_FIELDS = ['mode', 'server_name', 'root_cas', 'min_version', 'certificate', 'private_key']
+TLS_POLICY_MODES = ['require', 'passthrough', 'terminate']
+TLS_POLICY_VERSIONS = ['1.2', '1.3']
+
+# Upstream proxy route fields and fallbacks, matching the egress proxy's upstreamproxy.Route
+UPSTREAM_PROXY_FIELDS = ['proxies', 'fallback']
+UPSTREAM_PROXY_FALLBACKS = ['fail', 'direct']
+
+# SLO fields and metrics, matching the egress proxy's slo.Objective
+SLO_FIELDS = ['name', 'metric', 'target', 'threshold', 'window']
+SLO_METRICS = ['connect_latency', 'error_rate', 'bandwidth']
+
+# SSH auditing fields and recording modes, matching the egress proxy's sshaudit.Policy
+SSH_POLICY_FIELDS = ['record', 'allow_users', 'allow_forward', 'authorized_keys']
+SSH_RECORD_MODES = ['metadata', 'full']
+
 
 class MappingModel:
     """Mapping model for source-destination service routing"""
@@ -35,6 +87,21 @@ class MappingModel:
             Field('updated_at', type='datetime', update=datetime.utcnow),
             Field('comments', type='text'),
             Field('metadata', type='json'),
+            Field('fault_injection', type='json'),  # Faults for resilience testing
+            Field('dns', type='json'),  # Domains the sources may resolve through the egress DNS proxy
+            Field('smtp', type='json'),  # Mail policy of the egress SMTP relay
+            Field('condition', type='text'),  # CEL expression the connection must satisfy
+            Field('schedule', type='json'),  # Validity period and weekly windows
+            Field('dlp', type='json'),  # Sensitive data scanning of outbound payloads
+            Field('tls_inspection', type='json'),  # TLS interception by the egress proxy, enterprise only
+            Field('ssh', type='json'),  # SSH audit metadata or full session recording
+            Field('tls_policy', type='json'),  # Destination TLS mode: require, passthrough or terminate
+            Field('upstream_proxy', type='json'),  # Upstream HTTP CONNECT or SOCKS5 proxies of the egress proxy
+            Field('slos', type='json'),  # Service level objectives with burn rate alerting
+            Field('source_cidrs', type='json'),  # Client addresses or CIDRs the mapping matches
+            Field('listen_ports', type='json'),  # Proxy listener ports the mapping matches
+            Field('hostnames', type='json'),  # TLS server names the mapping matches, exact or *.example.com
+            Field('tenant', type='string', length=100),  # Owning tenant, counts towards its quotas
         )
 
     @staticmethod
@@ -42,7 +109,21 @@ class MappingModel:
                       dest_services: List[Union[int, str]], ports: List[Union[int, str]],
                       cluster_id: int, created_by: int, protocols: List[str] = None,
                       auth_required: bool = True, priority: int = 100,
-                      description: str = None, comments: str = None) -> int:
+                      description: str = None, comments: str = None,
+                      fault_injection: Dict[str, Any] = None,
+                      dns: Dict[str, Any] = None,
+                      smtp: Dict[str, Any] = None,
+                      condition: str = None,
+                      schedule: Dict[str, Any] = None,
+                      dlp: Dict[str, Any] = None,
+                      tls_inspection: Dict[str, Any] = None,
+                      ssh: Dict[str, Any] = None,
+                      tls_policy: Dict[str, Any] = None,
+                      upstream_proxy: Dict[str, Any] = None,
+                      slos: List[Dict[str, Any]] = None,
+                      source_cidrs: List[str] = None,
+                      listen_ports: List[int] = None,
+                      hostnames: List[str] = None) -> int:
         """Create new mapping configuration"""
 
         # Validate and normalize source services
@@ -75,11 +156,498 @@ class MappingModel:
             auth_required=auth_required,
             priority=priority,
             created_by=created_by,
-            comments=comments
+            comments=comments,
+            fault_injection=MappingModel.validate_fault_injection(fault_injection),
+            dns=MappingModel.validate_dns_policy(dns),
+            smtp=MappingModel.validate_smtp_policy(smtp),
+            condition=MappingModel.validate_condition(condition),
+            schedule=MappingModel.validate_schedule(schedule),
+            dlp=MappingModel.validate_dlp_policy(dlp),
+            tls_inspection=MappingModel.validate_tls_inspection(tls_inspection),
+            ssh=MappingModel.validate_ssh_policy(ssh),
+            tls_policy=MappingModel.validate_tls_policy(tls_policy),
+            upstream_proxy=MappingModel.validate_upstream_proxy(upstream_proxy),
+            slos=MappingModel.validate_slos(slos),
+            source_cidrs=MappingModel.validate_source_cidrs(source_cidrs),
+            listen_ports=MappingModel.validate_listen_ports(listen_ports),
+            hostnames=MappingModel.validate_hostnames(hostnames)
         )
 
         return mapping_id
 
+    @staticmethod
+    def validate_fault_injection(spec: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate a fault injection spec for a mapping or ingress route.
+
+        Faults are only applied by proxies started with fault injection
+        enabled, so a spec is inert on production proxies.
+        """
+        if not spec:
+            return None
+        if not isinstance(spec, dict):
+            raise ValueError("fault_injection must be an object")
+
+        unknown = set(spec) - set(FAULT_INJECTION_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown fault_injection fields: {', '.join(sorted(unknown))}")
+
+        for field in ('delay_ms', 'bandwidth_kbps'):
+            value = spec.get(field, 0)
+            if not isinstance(value, int) or value < 0:
+                raise ValueError(f"{field} must be a non-negative integer")
+        for field in ('delay_percent', 'abort_percent'):
+            value = spec.get(field, 0)
+            if not isinstance(value, (int, float)) or not 0 <= value <= 100:
+                raise ValueError(f"{field} must be between 0 and 100")
+
+        status = spec.get('abort_status', 0)
+        if not isinstance(status, int) or (status and not 400 <= status <= 599):
+            raise ValueError("abort_status must be between 400 and 599")
+        errno = spec.get('abort_errno', '')
+        if errno and errno not in FAULT_ERRNOS:
+            raise ValueError(f"abort_errno must be one of: {', '.join(FAULT_ERRNOS)}")
+
+        return spec
+
+    @staticmethod
+    def validate_dns_policy(policy: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the DNS policy of a mapping.
+
+        "example.com" matches the domain and its subdomains, "*.example.com"
+        only the subdomains. Rewrites answer split-horizon names with fixed
+        addresses.
+        """
+        if not policy:
+            return None
+        if not isinstance(policy, dict):
+            raise ValueError("dns must be an object")
+
+        unknown = set(policy) - set(DNS_POLICY_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown dns fields: {', '.join(sorted(unknown))}")
+
+        def check_pattern(pattern):
+            name = pattern[2:] if isinstance(pattern, str) and pattern.startswith('*.') else pattern
+            if not isinstance(name, str) or not name or '*' in name or ' ' in name:
+                raise ValueError(f"Invalid domain pattern: {pattern}")
+
+        for field in ('allow_domains', 'deny_domains'):
+            domains = policy.get(field, [])
+            if not isinstance(domains, list):
+                raise ValueError(f"{field} must be a list")
+            for domain in domains:
+                check_pattern(domain)
+
+        rewrites = policy.get('rewrites', [])
+        if not isinstance(rewrites, list):
+            raise ValueError("rewrites must be a list")
+        for rewrite in rewrites:
+            if not isinstance(rewrite, dict):
+                raise ValueError("Each rewrite must be an object")
+            check_pattern(rewrite.get('domain'))
+            addresses = rewrite.get('addresses')
+            if not isinstance(addresses, list) or not addresses:
+                raise ValueError(f"Rewrite for {rewrite.get('domain')} needs addresses")
+            for address in addresses:
+                try:
+                    ipaddress.ip_address(address)
+                except ValueError:
+                    raise ValueError(f"Invalid rewrite address: {address}")
+            ttl = rewrite.get('ttl', 0)
+            if not isinstance(ttl, int) or ttl < 0:
+                raise ValueError("Rewrite ttl must be a non-negative integer")
+
+        return policy
+
+    @staticmethod
+    def validate_smtp_policy(policy: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the SMTP policy of a mapping with the smtp protocol.
+
+        Domain lists use the same patterns as DNS policies and are empty to
+        allow any domain. Rate and size limits of 0 are unlimited.
+        """
+        if not policy:
+            return None
+        if not isinstance(policy, dict):
+            raise ValueError("smtp must be an object")
+
+        unknown = set(policy) - set(SMTP_POLICY_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown smtp fields: {', '.join(sorted(unknown))}")
+
+        for field in ('allowed_recipient_domains', 'allowed_sender_domains'):
+            domains = policy.get(field, [])
+            if not isinstance(domains, list):
+                raise ValueError(f"{field} must be a list")
+            for domain in domains:
+                name = domain[2:] if isinstance(domain, str) and domain.startswith('*.') else domain
+                if not isinstance(name, str) or not name or any(c in name for c in '*@ '):
+                    raise ValueError(f"Invalid domain pattern: {domain}")
+
+        for field in ('messages_per_minute', 'max_recipients', 'max_message_size'):
+            value = policy.get(field, 0)
+            if not isinstance(value, int) or isinstance(value, bool) or value < 0:
+                raise ValueError(f"{field} must be a non-negative integer")
+        if not isinstance(policy.get('require_tls', False), bool):
+            raise ValueError("require_tls must be a boolean")
+
+        return policy
+
+    @staticmethod
+    def validate_condition(condition: Optional[str]) -> Optional[str]:
+        """Validate the CEL condition of a mapping or ingress route.
+
+        Expressions are compiled by the proxies, which log and skip ones that
+        don't compile; only the type and the proxies' length limit are
+        checked here.
+        """
+        if not condition:
+            return None
+        if not isinstance(condition, str):
+            raise ValueError("condition must be a string")
+        if len(condition) > MAX_CONDITION_LENGTH:
+            raise ValueError(f"condition must be at most {MAX_CONDITION_LENGTH} characters")
+        return condition
+
+    @staticmethod
+    def validate_schedule(schedule: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the schedule of a mapping or ingress route.
+
+        Mirrors the proxies' schedule.Validate: valid_from and valid_until
+        are RFC 3339 times, timezone an IANA zone and windows HH:MM periods
+        on named weekdays, where an end before the start wraps past midnight.
+        """
+        if not schedule:
+            return None
+        if not isinstance(schedule, dict):
+            raise ValueError("schedule must be an object")
+
+        unknown = set(schedule) - set(SCHEDULE_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown schedule fields: {', '.join(sorted(unknown))}")
+
+        bounds = {}
+        for field in ('valid_from', 'valid_until'):
+            value = schedule.get(field)
+            if value is None:
+                continue
+            try:
+                bounds[field] = datetime.fromisoformat(str(value).replace('Z', '+00:00'))
+            except ValueError:
+                raise ValueError(f"{field} must be an RFC 3339 time")
+            if bounds[field].tzinfo is None:
+                raise ValueError(f"{field} must include a UTC offset")
+        if len(bounds) == 2 and bounds['valid_until'] <= bounds['valid_from']:
+            raise ValueError("valid_until must be after valid_from")
+
+        timezone = schedule.get('timezone')
+        if timezone:
+            try:
+                ZoneInfo(timezone)
+            except (ZoneInfoNotFoundError, ValueError):
+                raise ValueError(f"Unknown timezone: {timezone}")
+
+        windows = schedule.get('windows', [])
+        if not isinstance(windows, list):
+            raise ValueError("windows must be a list")
+        for i, window in enumerate(windows, 1):
+            if not isinstance(window, dict):
+                raise ValueError(f"window {i} must be an object")
+            days = window.get('days', [])
+            if not isinstance(days, list) or any(
+                    not isinstance(day, str) or day.lower() not in SCHEDULE_DAYS for day in days):
+                raise ValueError(f"window {i}: days must be a list of {', '.join(SCHEDULE_DAYS)}")
+            start = MappingModel._parse_clock(window.get('start'))
+            end = MappingModel._parse_clock(window.get('end'))
+            if start is None or end is None:
+                raise ValueError(f"window {i}: start and end must be HH:MM")
+            if start == end or start == 24 * 60:
+                raise ValueError(f"window {i} is empty")
+
+        return schedule
+
+    @staticmethod
+    def validate_dlp_policy(policy: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the DLP policy of a mapping.
+
+        Custom patterns are RE2 expressions compiled by the egress proxies;
+        here they only have to compile as Python regular expressions.
+        """
+        if not policy:
+            return None
+        if not isinstance(policy, dict):
+            raise ValueError("dlp must be an object")
+
+        unknown = set(policy) - set(DLP_POLICY_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown dlp fields: {', '.join(sorted(unknown))}")
+
+        if policy.get('action') not in DLP_ACTIONS:
+            raise ValueError(f"dlp action must be one of {', '.join(DLP_ACTIONS)}")
+
+        detectors = policy.get('detectors', [])
+        if not isinstance(detectors, list) or any(d not in DLP_DETECTORS for d in detectors):
+            raise ValueError(f"dlp detectors must be a list of {', '.join(DLP_DETECTORS)}")
+
+        custom = policy.get('custom', [])
+        if not isinstance(custom, list):
+            raise ValueError("dlp custom must be a list")
+        for pattern in custom:
+            if not isinstance(pattern, dict) or not pattern.get('name') or not isinstance(pattern.get('regex'), str):
+                raise ValueError("dlp custom patterns need a name and a regex")
+            try:
+                re.compile(pattern['regex'])
+            except re.error as e:
+                raise ValueError(f"Invalid dlp pattern {pattern['name']}: {e}")
+
+        max_scan = policy.get('max_scan_bytes', 0)
+        if not isinstance(max_scan, int) or isinstance(max_scan, bool) or max_scan < 0:
+            raise ValueError("max_scan_bytes must be a non-negative integer")
+
+        return policy
+
+    @staticmethod
+    def validate_tls_inspection(policy: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the TLS inspection policy of a mapping.
+
+        Exclusions use the domain patterns of the DNS policy: "example.com"
+        matches the domain and its subdomains, "*.example.com" only the
+        subdomains.
+        """
+        if not policy:
+            return None
+        if not isinstance(policy, dict):
+            raise ValueError("tls_inspection must be an object")
+
+        unknown = set(policy) - set(TLS_INSPECTION_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown tls_inspection fields: {', '.join(sorted(unknown))}")
+
+        if not isinstance(policy.get('enabled', False), bool):
+            raise ValueError("tls_inspection enabled must be a boolean")
+
+        exclude = policy.get('exclude', [])
+        if not isinstance(exclude, list):
+            raise ValueError("tls_inspection exclude must be a list")
+        for pattern in exclude:
+            name = pattern[2:] if isinstance(pattern, str) and pattern.startswith('*.') else pattern
+            if not isinstance(name, str) or not name or '*' in name or ' ' in name:
+                raise ValueError(f"Invalid tls_inspection exclusion {pattern!r}")
+
+        return policy
+
+    @staticmethod
+    def validate_tls_policy(policy: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the destination TLS mode of a mapping.
+
+        require blocks plaintext and verifies the destination certificate,
+        passthrough relays TLS untouched, and terminate ends the client's
+        TLS and re-originates it. The egress proxy parses the PEM fields.
+        """
+        if not policy:
+            return None
+        if not isinstance(policy, dict):
+            raise ValueError("tls_policy must be an object")
+
+        unknown = set(policy) - set(TLS_POLICY_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown tls_policy fields: {', '.join(sorted(unknown))}")
+
+        if policy.get('mode') not in TLS_POLICY_MODES:
+            raise ValueError(f"tls_policy mode must be one of: {', '.join(TLS_POLICY_MODES)}")
+
+        min_version = policy.get('min_version')
+        if min_version is not None and min_version not in TLS_POLICY_VERSIONS:
+            raise ValueError(f"tls_policy min_version must be one of: {', '.join(TLS_POLICY_VERSIONS)}")
+
+        for field in ('server_name', 'root_cas', 'certificate', 'private_key'):
+            if not isinstance(policy.get(field, ''), str):
+                raise ValueError(f"tls_policy {field} must be a string")
+
+        if bool(policy.get('certificate')) != bool(policy.get('private_key')):
+            raise ValueError("tls_policy certificate and private_key must be set together")
+        if policy.get('certificate') and policy['mode'] != 'terminate':
+            raise ValueError("tls_policy certificate requires mode terminate")
+
+        return policy
+
+    @staticmethod
+    def validate_upstream_proxy(route: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the upstream proxy route of a mapping.
+
+        proxies names upstreams from the egress proxy's upstream_proxies,
+        tried in order; fallback decides what happens when none connects.
+        """
+        if not route:
+            return None
+        if not isinstance(route, dict):
+            raise ValueError("upstream_proxy must be an object")
+
+        unknown = set(route) - set(UPSTREAM_PROXY_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown upstream_proxy fields: {', '.join(sorted(unknown))}")
+
+        proxies = route.get('proxies')
+        if not isinstance(proxies, list) or not proxies:
+            raise ValueError("upstream_proxy proxies must be a non-empty list")
+        for name in proxies:
+            if not isinstance(name, str) or not name:
+                raise ValueError(f"Invalid upstream_proxy proxy name {name!r}")
+
+        fallback = route.get('fallback')
+        if fallback is not None and fallback not in UPSTREAM_PROXY_FALLBACKS:
+            raise ValueError(f"upstream_proxy fallback must be one of: {', '.join(UPSTREAM_PROXY_FALLBACKS)}")
+
+        return route
+
+    @staticmethod
+    def validate_slos(slos: Optional[List[Dict[str, Any]]]) -> Optional[List[Dict[str, Any]]]:
+        """Validate the service level objectives of a mapping.
+
+        connect_latency and bandwidth objectives need a threshold, in
+        milliseconds and Mbit/s. target is the fraction of good events and
+        window the compliance window in days.
+        """
+        if not slos:
+            return None
+        if not isinstance(slos, list):
+            raise ValueError("slos must be a list")
+
+        names = set()
+        for objective in slos:
+            if not isinstance(objective, dict):
+                raise ValueError("Each SLO must be an object")
+            unknown = set(objective) - set(SLO_FIELDS)
+            if unknown:
+                raise ValueError(f"Unknown SLO fields: {', '.join(sorted(unknown))}")
+
+            metric = objective.get('metric')
+            if metric not in SLO_METRICS:
+                raise ValueError(f"SLO metric must be one of: {', '.join(SLO_METRICS)}")
+
+            target = objective.get('target')
+            if isinstance(target, bool) or not isinstance(target, (int, float)) or not 0 < target < 1:
+                raise ValueError("SLO target must be a number between 0 and 1, exclusive")
+
+            threshold = objective.get('threshold', 0)
+            if isinstance(threshold, bool) or not isinstance(threshold, (int, float)) or threshold < 0:
+                raise ValueError("SLO threshold must be a positive number")
+            if metric != 'error_rate' and not threshold:
+                raise ValueError(f"{metric} SLO requires a threshold")
+
+            window = objective.get('window', 0)
+            if isinstance(window, bool) or not isinstance(window, int) or not 0 <= window <= 90:
+                raise ValueError("SLO window must be at most 90 days")
+
+            name = objective.get('name') or metric
+            if name in names:
+                raise ValueError(f"Duplicate SLO {name}")
+            names.add(name)
+
+        return slos
+
+    @staticmethod
+    def validate_source_cidrs(cidrs: Optional[List[str]]) -> Optional[List[str]]:
+        """Validate the client addresses or CIDRs a mapping matches.
+
+        When several mappings match a connection, the egress proxy selects
+        the most specific, so a /24 wins over a /8.
+        """
+        if not cidrs:
+            return None
+        if not isinstance(cidrs, list):
+            raise ValueError("source_cidrs must be a list")
+        for cidr in cidrs:
+            try:
+                ipaddress.ip_network(cidr, strict=False)
+            except (TypeError, ValueError):
+                raise ValueError(f"Invalid source CIDR {cidr!r}")
+        return cidrs
+
+    @staticmethod
+    def validate_listen_ports(ports: Optional[List[int]]) -> Optional[List[int]]:
+        """Validate the proxy listener ports a mapping matches"""
+        if not ports:
+            return None
+        if not isinstance(ports, list):
+            raise ValueError("listen_ports must be a list")
+        for port in ports:
+            if isinstance(port, bool) or not isinstance(port, int) or not 1 <= port <= 65535:
+                raise ValueError(f"Invalid listen port {port!r}")
+        return ports
+
+    @staticmethod
+    def validate_hostnames(hostnames: Optional[List[str]]) -> Optional[List[str]]:
+        """Validate the TLS server names a mapping matches.
+
+        A name matches exactly and *.example.com matches any subdomain. An
+        exact name wins over a wildcard, and a longer wildcard over a
+        shorter one.
+        """
+        if not hostnames:
+            return None
+        if not isinstance(hostnames, list):
+            raise ValueError("hostnames must be a list")
+        for hostname in hostnames:
+            name = hostname[2:] if isinstance(hostname, str) and hostname.startswith('*.') else hostname
+            if not isinstance(name, str) or not name or re.search(r'[*\s/:]', name):
+                raise ValueError(f"Invalid hostname pattern {hostname!r}")
+        return hostnames
+
+    @staticmethod
+    def validate_ssh_policy(policy: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        """Validate the SSH auditing policy of a mapping.
+
+        Forwarding targets are host[:port], where the host is a domain
+        pattern, IP address or CIDR and the port is a number or "*", 22
+        when omitted. The egress proxy parses the authorized keys.
+        """
+        if not policy:
+            return None
+        if not isinstance(policy, dict):
+            raise ValueError("ssh must be an object")
+
+        unknown = set(policy) - set(SSH_POLICY_FIELDS)
+        if unknown:
+            raise ValueError(f"Unknown ssh fields: {', '.join(sorted(unknown))}")
+
+        record = policy.get('record', 'metadata')
+        if record not in SSH_RECORD_MODES:
+            raise ValueError(f"ssh record must be one of: {', '.join(SSH_RECORD_MODES)}")
+
+        for field in ('allow_users', 'allow_forward', 'authorized_keys'):
+            values = policy.get(field, [])
+            if not isinstance(values, list) or not all(isinstance(v, str) and v.strip() for v in values):
+                raise ValueError(f"ssh {field} must be a list of non-empty strings")
+
+        for target in policy.get('allow_forward', []):
+            host, port = target, '22'
+            if target.startswith('['):
+                host, _, rest = target[1:].partition(']')
+                if rest:
+                    port = rest[1:] if rest.startswith(':') else ''
+            elif target.count(':') == 1:
+                host, port = target.split(':')
+            if not host or ' ' in host or not (port == '*' or (port.isdigit() and 0 < int(port) < 65536)):
+                raise ValueError(f"Invalid ssh forwarding target {target!r}")
+
+        if record != 'full':
+            for field in ('allow_users', 'allow_forward', 'authorized_keys'):
+                if policy.get(field):
+                    raise ValueError(f"ssh {field} requires record mode full")
+
+        return policy
+
+    @staticmethod
+    def _parse_clock(value: Any) -> Optional[int]:
+        """Parse HH:MM into minutes after midnight, allowing 24:00"""
+        if not isinstance(value, str) or not re.fullmatch(r'\d\d:\d\d', value):
+            return None
+        hours, minutes = int(value[:2]), int(value[3:])
+        if minutes > 59 or hours > 24 or (hours == 24 and minutes):
+            return None
+        return hours * 60 + minutes
+
     @staticmethod
     def _normalize_service_list(db: DAL, services: List[Union[int, str]], cluster_id: int) -> List[Dict[str, Any]]:
         """Normalize service list to include IDs and metadata"""
@@ -415,6 +983,20 @@ class CreateMappingRequest(BaseModel):
     auth_required: bool = True
     priority: int = 100
     comments: Optional[str] = None
+    fault_injection: Optional[Dict[str, Any]] = None
+    dns: Optional[Dict[str, Any]] = None
+    smtp: Optional[Dict[str, Any]] = None
+    condition: Optional[str] = None
+    schedule: Optional[Dict[str, Any]] = None
+    dlp: Optional[Dict[str, Any]] = None
+    tls_inspection: Optional[Dict[str, Any]] = None
+    ssh: Optional[Dict[str, Any]] = None
+    tls_policy: Optional[Dict[str, Any]] = None
+    upstream_proxy: Optional[Dict[str, Any]] = None
+    slos: Optional[List[Dict[str, Any]]] = None
+    source_cidrs: Optional[List[str]] = None
+    listen_ports: Optional[List[int]] = None
+    hostnames: Optional[List[str]] = None
 
     @validator('name')
     def validate_name(cls, v):
@@ -426,7 +1008,7 @@ class CreateMappingRequest(BaseModel):
 
     @validator('protocols')
     def validate_protocols(cls, v):
-        valid_protocols = ['tcp', 'udp', 'icmp', 'http', 'https']
+        valid_protocols = ['tcp', 'udp', 'icmp', 'http', 'https', 'smtp']
         for protocol in v:
             if protocol not in valid_protocols:
                 raise ValueError(f'Invalid protocol: {protocol}. Must be one of: {valid_protocols}')
@@ -488,6 +1070,20 @@ class UpdateMappingRequest(BaseModel):
     auth_required: Optional[bool] = None
     priority: Optional[int] = None
     comments: Optional[str] = None
+    fault_injection: Optional[Dict[str, Any]] = None
+    dns: Optional[Dict[str, Any]] = None
+    smtp: Optional[Dict[str, Any]] = None
+    condition: Optional[str] = None
+    schedule: Optional[Dict[str, Any]] = None
+    dlp: Optional[Dict[str, Any]] = None
+    tls_inspection: Optional[Dict[str, Any]] = None
+    ssh: Optional[Dict[str, Any]] = None
+    tls_policy: Optional[Dict[str, Any]] = None
+    upstream_proxy: Optional[Dict[str, Any]] = None
+    slos: Optional[List[Dict[str, Any]]] = None
+    source_cidrs: Optional[List[str]] = None
+    listen_ports: Optional[List[int]] = None
+    hostnames: Optional[List[str]] = None
 
 
 class MappingResponse(BaseModel):
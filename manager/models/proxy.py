@@ -25,6 +25,7 @@ class ProxyServerModel:
             Field('hostname', type='string', required=True, length=255),
             Field('ip_address', type='string', required=True, length=45),
             Field('port', type='integer', default=8080),
+            Field('proxy_type', type='string', default='egress', length=20),
             Field('cluster_id', type='reference clusters', required=True),
             Field('status', type='string', default='pending', length=20),
             Field('version', type='string', length=50),
@@ -136,6 +137,11 @@ class ProxyServerModel:
                 update_data['capabilities'] = status_data['capabilities']
             if 'config_version' in status_data:
                 update_data['config_version'] = status_data['config_version']
+            if 'certificates' in status_data:
+                metadata = dict(proxy.metadata or {})
+                metadata['certificates'] = status_data['certificates']
+                metadata['certificates_reported_at'] = datetime.utcnow().isoformat()
+                update_data['metadata'] = metadata
 
         proxy.update_record(**update_data)
         return True
@@ -198,6 +204,42 @@ class ProxyServerModel:
             (db.proxy_servers.status == 'active')
         ).update(status='inactive')
 
+    @staticmethod
+    def get_expiring_certificates(db: DAL, days: int = 30,
+                                  cluster_id: int = None) -> List[Dict[str, Any]]:
+        """Get certificates reported by proxies that expire within days"""
+        query = db.proxy_servers.id > 0
+        if cluster_id:
+            query &= db.proxy_servers.cluster_id == cluster_id
+
+        now = datetime.utcnow()
+        cutoff = now + timedelta(days=days)
+        expiring = []
+        for proxy in db(query).select():
+            for cert in (proxy.metadata or {}).get('certificates') or []:
+                try:
+                    not_after = datetime.fromisoformat(
+                        cert['not_after'].replace('Z', '+00:00')
+                    ).replace(tzinfo=None)
+                except (KeyError, TypeError, ValueError):
+                    continue
+                if not_after > cutoff:
+                    continue
+                expiring.append({
+                    'proxy_id': proxy.id,
+                    'proxy_name': proxy.name,
+                    'cluster_id': proxy.cluster_id,
+                    'source': cert.get('source'),
+                    'role': cert.get('role'),
+                    'path': cert.get('path'),
+                    'subject': cert.get('subject'),
+                    'serial': cert.get('serial'),
+                    'not_after': not_after,
+                    'days_to_expiry': round((not_after - now).total_seconds() / 86400, 1)
+                })
+
+        return sorted(expiring, key=lambda cert: cert['not_after'])
+
     @staticmethod
     def get_cluster_proxies(db: DAL, cluster_id: int) -> List[Dict[str, Any]]:
         """Get all proxies for a cluster"""
@@ -218,6 +260,27 @@ class ProxyServerModel:
             for proxy in proxies
         ]
 
+    @staticmethod
+    def get_module_endpoints(db: DAL, cluster_id: int, module_types: List[str]) -> List[Dict[str, Any]]:
+        """Get the gRPC endpoints of a cluster's active modules of the given types"""
+        modules = db(
+            (db.proxy_servers.cluster_id == cluster_id) &
+            (db.proxy_servers.status == 'active') &
+            (db.proxy_servers.proxy_type.belongs(module_types))
+        ).select(orderby=db.proxy_servers.name)
+        endpoints = []
+        for module in modules:
+            capabilities = module.capabilities or {}
+            endpoints.append({
+                'name': module.name,
+                'type': module.proxy_type,
+                'address': module.ip_address,
+                'grpc_port': int(capabilities.get('grpc_port') or module.port),
+                'zone': capabilities.get('zone', ''),
+                'region': capabilities.get('region', ''),
+            })
+        return endpoints
+
     @staticmethod
     def get_proxy_stats(db: DAL, cluster_id: int = None) -> Dict[str, Any]:
         """Get proxy statistics"""
@@ -264,6 +327,11 @@ class ProxyMetricsModel:
     @staticmethod
     def record_metrics(db: DAL, proxy_id: int, metrics: Dict[str, Any]) -> int:
         """Record proxy metrics"""
+        metadata = dict(metrics.get('metadata') or {})
+        # Bytes per mapping, destination service and tenant by direction,
+        # totals since the proxy started, for quota enforcement
+        if metrics.get('traffic'):
+            metadata['traffic'] = metrics['traffic']
         return db.proxy_metrics.insert(
             proxy_id=proxy_id,
             cpu_usage=metrics.get('cpu_usage'),
@@ -276,7 +344,7 @@ class ProxyMetricsModel:
             latency_avg=metrics.get('latency_avg'),
             latency_p95=metrics.get('latency_p95'),
             errors_per_second=metrics.get('errors_per_second'),
-            metadata=metrics.get('metadata', {})
+            metadata=metadata
         )
 
     @staticmethod
@@ -297,6 +365,10 @@ class ProxyMetricsModel:
         return db(db.proxy_metrics.timestamp < cutoff_time).delete()
 
 
+# Proxy module types that register with the manager
+MODULE_TYPES = ['egress', 'ingress', 'nlb', 'alb', 'dblb', 'rtmp']
+
+
 # Pydantic models for request/response validation
 class ProxyRegistrationRequest(BaseModel):
     name: str
@@ -310,8 +382,8 @@ class ProxyRegistrationRequest(BaseModel):
 
     @validator('proxy_type')
     def validate_proxy_type(cls, v):
-        if v not in ['egress', 'ingress']:
-            raise ValueError('proxy_type must be either "egress" or "ingress"')
+        if v not in MODULE_TYPES:
+            raise ValueError(f'proxy_type must be one of: {", ".join(MODULE_TYPES)}')
         return v.lower()
 
     @validator('name')
@@ -343,6 +415,7 @@ class ProxyHeartbeatRequest(BaseModel):
     capabilities: Optional[Dict[str, Any]] = None
     config_version: Optional[str] = None
     metrics: Optional[Dict[str, Any]] = None
+    certificates: Optional[List[Dict[str, Any]]] = None
 
 
 class ProxyConfigRequest(BaseModel):
@@ -350,6 +423,36 @@ class ProxyConfigRequest(BaseModel):
     cluster_api_key: str
 
 
+class ModulesRequest(BaseModel):
+    proxy_name: str
+    cluster_api_key: str
+    module_types: List[str]
+
+    @validator('module_types')
+    def validate_module_types(cls, v):
+        unknown = [t for t in v if t not in MODULE_TYPES]
+        if unknown:
+            raise ValueError(f'Unknown module types: {", ".join(unknown)}')
+        return v
+
+
+class SessionTicketKeysRequest(BaseModel):
+    cluster_api_key: str
+
+
+class ProxyCertificateRequest(BaseModel):
+    proxy_name: str
+    cluster_api_key: str
+    csr: str
+    ttl_seconds: Optional[int] = None
+
+    @validator('csr')
+    def validate_csr(cls, v):
+        if 'BEGIN CERTIFICATE REQUEST' not in v:
+            raise ValueError('csr must be a PEM encoded certificate signing request')
+        return v
+
+
 class ProxyResponse(BaseModel):
     id: int
     name: str
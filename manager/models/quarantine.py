@@ -0,0 +1,147 @@
+"""
+Service quarantine models for MarchProxy Manager
+
+Proxies quarantine source services that their WAF or anomaly detection
+flags repeatedly and report them here. The manager distributes the
+quarantine to every proxy of the cluster, which applies the cluster's
+quarantine policy to the service until an operator releases it.
+
+Copyright (C) 2025 MarchProxy Contributors
+Licensed under GNU Affero General Public License v3.0
+"""
+
+from datetime import datetime
+from typing import Optional, Dict, Any, List
+from pydal import DAL, Field
+from pydantic import BaseModel, validator
+
+
+class QuarantineModel:
+    """Source services under their cluster's quarantine policy"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define quarantined services table"""
+        return db.define_table(
+            'quarantined_services',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('service_id', type='reference services', required=True),
+            Field('reason', type='text'),
+            Field('reported_by', type='string', length=100),  # Proxy that quarantined the service
+            Field('quarantined_at', type='datetime', default=datetime.utcnow),
+            Field('released_at', type='datetime'),  # Set by an operator, None while quarantined
+            Field('released_by', type='reference auth_user'),
+        )
+
+    @staticmethod
+    def quarantine(db: DAL, cluster_id: int, service_id: int, reason: str,
+                   reported_by: str) -> Optional[int]:
+        """Quarantine a service of the cluster, returning the quarantine ID.
+
+        A service that is already quarantined keeps its first quarantine.
+        Returns None if the service isn't one of the cluster's.
+        """
+        service = db.services[service_id]
+        if not service or service.cluster_id != cluster_id:
+            return None
+
+        active = QuarantineModel._active(db, cluster_id, service_id)
+        if active:
+            return active.id
+
+        return db.quarantined_services.insert(
+            cluster_id=cluster_id,
+            service_id=service_id,
+            reason=reason,
+            reported_by=reported_by,
+        )
+
+    @staticmethod
+    def release(db: DAL, cluster_id: int, service_id: int, released_by: int) -> bool:
+        """Release a quarantined service, False if it isn't quarantined"""
+        active = QuarantineModel._active(db, cluster_id, service_id)
+        if not active:
+            return False
+
+        active.update_record(released_at=datetime.utcnow(), released_by=released_by)
+        return True
+
+    @staticmethod
+    def list_quarantines(db: DAL, cluster_id: int,
+                         include_released: bool = False) -> List[Dict[str, Any]]:
+        """Quarantines of the cluster, newest first"""
+        query = db.quarantined_services.cluster_id == cluster_id
+        if not include_released:
+            query &= db.quarantined_services.released_at == None
+
+        rows = db(query).select(
+            db.quarantined_services.ALL, db.services.name,
+            left=db.services.on(db.services.id == db.quarantined_services.service_id),
+            orderby=~db.quarantined_services.quarantined_at
+        )
+        return [
+            {
+                'id': row.quarantined_services.id,
+                'service_id': row.quarantined_services.service_id,
+                'service': row.services.name,
+                'reason': row.quarantined_services.reason,
+                'reported_by': row.quarantined_services.reported_by,
+                'quarantined_at': row.quarantined_services.quarantined_at,
+                'released_at': row.quarantined_services.released_at,
+                'released_by': row.quarantined_services.released_by,
+            }
+            for row in rows
+        ]
+
+    @staticmethod
+    def get_cluster_quarantine(db: DAL, cluster) -> Dict[str, Any]:
+        """Quarantine policy and quarantined services for the cluster's proxies"""
+        rows = db(
+            (db.quarantined_services.cluster_id == cluster.id) &
+            (db.quarantined_services.released_at == None)
+        ).select(orderby=db.quarantined_services.service_id)
+
+        return {
+            'policy': {
+                'connections_per_second': cluster.quarantine_connections_per_second or 0,
+                'block': bool(cluster.quarantine_block),
+                'log': bool(cluster.quarantine_log),
+            },
+            'services': [
+                {
+                    'service_id': row.service_id,
+                    'reason': row.reason or '',
+                    'since': row.quarantined_at.isoformat() + 'Z',
+                }
+                for row in rows
+            ],
+        }
+
+    @staticmethod
+    def _active(db: DAL, cluster_id: int, service_id: int):
+        """Unreleased quarantine of a service"""
+        return db(
+            (db.quarantined_services.cluster_id == cluster_id) &
+            (db.quarantined_services.service_id == service_id) &
+            (db.quarantined_services.released_at == None)
+        ).select().first()
+
+
+# Pydantic models for request/response validation
+class QuarantineReportRequest(BaseModel):
+    proxy_name: str
+    cluster_api_key: str
+    service_id: int
+    reason: str
+
+    @validator('service_id')
+    def validate_service_id(cls, v):
+        if v <= 0:
+            raise ValueError('Service ID must be positive')
+        return v
+
+    @validator('reason')
+    def validate_reason(cls, v):
+        if not v:
+            raise ValueError('Reason is required')
+        return v[:1000]
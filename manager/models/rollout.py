@@ -0,0 +1,285 @@
+"""
+Staged config rollout models for MarchProxy Manager
+
+A changed cluster config is first served to a canary subset of the cluster's
+proxies while the others keep the stable config. Canaries report the config
+version they run and their closed and failed connection counts with every
+heartbeat. Once every canary ran the new version for the observation window
+within the error budget the version is promoted to all proxies; a canary
+going silent, failing to apply the version or exceeding the error budget
+rolls it back.
+
+Copyright (C) 2025 MarchProxy Contributors
+Licensed under GNU Affero General Public License v3.0
+"""
+
+import hashlib
+import json
+import logging
+import math
+from datetime import datetime, timedelta
+from typing import Optional, Dict, Any, List
+from pydal import DAL, Field
+
+logger = logging.getLogger(__name__)
+
+ROLLOUT_STATES = ['canary', 'promoted', 'rolled_back', 'superseded']
+
+# Closed connections a canary needs before its error rate is judged
+MIN_ERROR_SAMPLE = 20
+
+# A canary without a heartbeat for this long fails the rollout
+CANARY_HEARTBEAT_TIMEOUT = timedelta(minutes=2)
+
+
+class ConfigRolloutModel:
+    """Config versions rolled out to canary proxies before the whole cluster"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define config rollouts table"""
+        return db.define_table(
+            'config_rollouts',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('version', type='string', length=64, required=True),
+            Field('config', type='json'),
+            Field('stable_version', type='string', length=64),
+            Field('stable_config', type='json'),
+            Field('canary_proxies', type='list:string'),
+            Field('canary_stats', type='json'),  # Per canary: applied_at and connection counters
+            Field('state', type='string', length=20, default='canary'),
+            Field('reason', type='string', length=255),
+            Field('observe_seconds', type='integer', default=300),
+            Field('max_error_rate', type='double', default=0.05),
+            Field('started_at', type='datetime', default=datetime.utcnow),
+            Field('decided_at', type='datetime'),
+            Field('decided_by', type='reference auth_user'),
+        )
+
+    @staticmethod
+    def config_version(config: Dict[str, Any]) -> str:
+        """Version of a config: a hash of its canonical JSON"""
+        canonical = json.dumps(config, sort_keys=True, default=str)
+        return hashlib.sha256(canonical.encode('utf-8')).hexdigest()[:16]
+
+    @staticmethod
+    def current(db: DAL, cluster_id: int):
+        """Latest rollout of the cluster, None before the first config"""
+        return db(db.config_rollouts.cluster_id == cluster_id).select(
+            orderby=~db.config_rollouts.id, limitby=(0, 1)
+        ).first()
+
+    @staticmethod
+    def resolve_config(db: DAL, cluster_id: int, proxy_name: Optional[str],
+                       live_config: Dict[str, Any]) -> Dict[str, Any]:
+        """Config to serve proxy_name, starting a rollout when the live config changed"""
+        # Round trip through JSON so stored snapshots match what proxies receive
+        live_config = json.loads(json.dumps(live_config, default=str))
+        live_version = ConfigRolloutModel.config_version(live_config)
+
+        cluster = db.clusters[cluster_id]
+        if not cluster or not cluster.rollout_canary_percent:
+            return dict(live_config, version=live_version)
+
+        rollout = ConfigRolloutModel.current(db, cluster_id)
+        if rollout is None:
+            # The first config is the stable baseline
+            rollout_id = db.config_rollouts.insert(
+                cluster_id=cluster_id, version=live_version, config=live_config,
+                state='promoted', reason='initial config', decided_at=datetime.utcnow()
+            )
+            rollout = db.config_rollouts[rollout_id]
+        elif rollout.version != live_version:
+            rollout = ConfigRolloutModel._start(db, cluster, rollout, live_version, live_config)
+        else:
+            rollout = ConfigRolloutModel.evaluate(db, rollout)
+
+        return ConfigRolloutModel._serve(rollout, proxy_name)
+
+    @staticmethod
+    def _start(db: DAL, cluster, previous, version: str, config: Dict[str, Any]):
+        """Start rolling out version to a canary subset of the cluster's proxies"""
+        now = datetime.utcnow()
+        if previous.state == 'promoted':
+            stable_version, stable_config = previous.version, previous.config
+        else:
+            # An unpromoted version never becomes stable
+            stable_version, stable_config = previous.stable_version, previous.stable_config
+        if previous.state == 'canary':
+            previous.update_record(state='superseded', reason=f'superseded by {version}', decided_at=now)
+
+        proxies = db(
+            (db.proxy_servers.cluster_id == cluster.id) &
+            (db.proxy_servers.status == 'active') &
+            (db.proxy_servers.last_seen > now - CANARY_HEARTBEAT_TIMEOUT)
+        ).select(db.proxy_servers.name, orderby=db.proxy_servers.name)
+        names = [proxy.name for proxy in proxies]
+        count = math.ceil(len(names) * cluster.rollout_canary_percent / 100)
+        canaries = names[:max(1, count)] if names else []
+
+        fields = dict(
+            cluster_id=cluster.id, version=version, config=config,
+            stable_version=stable_version, stable_config=stable_config,
+            canary_proxies=canaries, canary_stats={},
+            observe_seconds=cluster.rollout_observe_seconds or 300,
+            max_error_rate=cluster.rollout_max_error_rate or 0.05,
+            started_at=now,
+        )
+        if version == stable_version:
+            fields.update(state='promoted', reason='matches the stable config', decided_at=now)
+        elif not canaries or len(canaries) >= len(names):
+            # Nothing to compare against, the version goes out directly
+            fields.update(state='promoted', reason='no proxies to hold back', decided_at=now)
+        else:
+            fields.update(state='canary')
+            logger.info(f"Rolling out config {version} to canaries {', '.join(canaries)}")
+        return db.config_rollouts[db.config_rollouts.insert(**fields)]
+
+    @staticmethod
+    def _serve(rollout, proxy_name: Optional[str]) -> Dict[str, Any]:
+        """Config of rollout for proxy_name, with the rollout state attached"""
+        canary = rollout.state == 'canary' and proxy_name in (rollout.canary_proxies or [])
+        if rollout.state == 'promoted' or canary:
+            config, version = rollout.config, rollout.version
+        else:
+            config, version = rollout.stable_config, rollout.stable_version
+
+        served = dict(config or {}, version=version or '')
+        served['rollout'] = {
+            'id': rollout.id,
+            'state': rollout.state,
+            'role': 'canary' if canary else 'stable',
+            'version': rollout.version,
+            'stable_version': rollout.stable_version or '',
+        }
+        return served
+
+    @staticmethod
+    def record_heartbeat(db: DAL, cluster_id: int, proxy_name: str,
+                         config_version: Optional[str], metrics: Optional[Dict[str, Any]]) -> None:
+        """Track a canary's progress on the current rollout from its heartbeat"""
+        rollout = ConfigRolloutModel.current(db, cluster_id)
+        if not rollout or rollout.state != 'canary' or proxy_name not in (rollout.canary_proxies or []):
+            return
+
+        if config_version == rollout.version:
+            metrics = metrics or {}
+            total = int(metrics.get('connections_closed') or 0)
+            failed = int(metrics.get('connections_failed') or 0)
+
+            stats = dict(rollout.canary_stats or {})
+            entry = stats.get(proxy_name)
+            if entry is None or total < entry['total']:
+                # First heartbeat on the version, or the proxy restarted and
+                # its counters with it: count from here
+                entry = {
+                    'applied_at': (entry or {}).get('applied_at') or datetime.utcnow().isoformat(),
+                    'base_total': total, 'base_failed': failed,
+                }
+            entry.update(total=total, failed=failed)
+            stats[proxy_name] = entry
+            rollout.update_record(canary_stats=stats)
+
+        ConfigRolloutModel.evaluate(db, rollout)
+
+    @staticmethod
+    def evaluate(db: DAL, rollout):
+        """Promote or roll back a canary rollout once its outcome is known"""
+        if rollout.state != 'canary':
+            return rollout
+
+        now = datetime.utcnow()
+        stats = rollout.canary_stats or {}
+        observe = timedelta(seconds=rollout.observe_seconds or 300)
+
+        proxies = {
+            proxy.name: proxy for proxy in db(
+                (db.proxy_servers.cluster_id == rollout.cluster_id) &
+                (db.proxy_servers.name.belongs(rollout.canary_proxies or []))
+            ).select()
+        }
+
+        applied = []
+        for name in rollout.canary_proxies or []:
+            proxy = proxies.get(name)
+            if not proxy or not proxy.last_seen or now - proxy.last_seen > CANARY_HEARTBEAT_TIMEOUT:
+                return ConfigRolloutModel._decide(rollout, 'rolled_back', f'canary {name} stopped sending heartbeats')
+
+            entry = stats.get(name)
+            if entry is None:
+                if now - rollout.started_at > observe:
+                    return ConfigRolloutModel._decide(rollout, 'rolled_back', f'canary {name} did not apply the version')
+                continue
+
+            closed = entry['total'] - entry['base_total']
+            failed = entry['failed'] - entry['base_failed']
+            if closed >= MIN_ERROR_SAMPLE and failed / closed > rollout.max_error_rate:
+                return ConfigRolloutModel._decide(
+                    rollout, 'rolled_back',
+                    f'canary {name} error rate {failed / closed:.1%} above {rollout.max_error_rate:.1%}'
+                )
+            applied.append(datetime.fromisoformat(entry['applied_at']))
+
+        if len(applied) == len(rollout.canary_proxies or []) and now - max(applied) >= observe:
+            return ConfigRolloutModel._decide(
+                rollout, 'promoted', f'canaries healthy for {int(observe.total_seconds())}s'
+            )
+        return rollout
+
+    @staticmethod
+    def _decide(rollout, state: str, reason: str, user_id: int = None):
+        """Record the outcome of a rollout"""
+        rollout.update_record(state=state, reason=reason, decided_at=datetime.utcnow(), decided_by=user_id)
+        logger.info(f"Config rollout {rollout.id} ({rollout.version}) {state.replace('_', ' ')}: {reason}")
+        return rollout
+
+    @staticmethod
+    def decide(db: DAL, cluster_id: int, rollout_id: int, action: str, user_id: int) -> Optional[str]:
+        """Promote or roll back a canary rollout by hand, returning an error if it can't be"""
+        rollout = db.config_rollouts[rollout_id]
+        if not rollout or rollout.cluster_id != cluster_id:
+            return 'Rollout not found'
+        if rollout.state != 'canary':
+            return f'Rollout is already {rollout.state}'
+
+        state = 'promoted' if action == 'promote' else 'rolled_back'
+        ConfigRolloutModel._decide(rollout, state, f'{action} requested by user {user_id}', user_id)
+        return None
+
+    @staticmethod
+    def list_rollouts(db: DAL, cluster_id: int, limit: int = 20) -> List[Dict[str, Any]]:
+        """Latest rollouts of the cluster with per-canary progress"""
+        rollouts = db(db.config_rollouts.cluster_id == cluster_id).select(
+            orderby=~db.config_rollouts.id, limitby=(0, limit)
+        )
+
+        result = []
+        for rollout in rollouts:
+            canaries = []
+            for name in rollout.canary_proxies or []:
+                entry = (rollout.canary_stats or {}).get(name)
+                canary = {'proxy_name': name, 'applied': entry is not None}
+                if entry:
+                    closed = entry['total'] - entry['base_total']
+                    failed = entry['failed'] - entry['base_failed']
+                    canary.update(
+                        applied_at=entry['applied_at'],
+                        connections_closed=closed,
+                        connections_failed=failed,
+                        error_rate=failed / closed if closed else 0.0,
+                    )
+                canaries.append(canary)
+
+            result.append({
+                'id': rollout.id,
+                'version': rollout.version,
+                'stable_version': rollout.stable_version,
+                'state': rollout.state,
+                'reason': rollout.reason,
+                'observe_seconds': rollout.observe_seconds,
+                'max_error_rate': rollout.max_error_rate,
+                'started_at': rollout.started_at.isoformat() if rollout.started_at else None,
+                'decided_at': rollout.decided_at.isoformat() if rollout.decided_at else None,
+                'canaries': canaries,
+            })
+        return result
@@ -28,6 +28,7 @@ class ServiceModel:
             Field('protocol', type='string', default='tcp', length=10),
             Field('collection', type='string', length=100),
             Field('cluster_id', type='reference clusters', required=True),
+            Field('tenant', type='string', length=100),  # Owning tenant, empty = shared by all tenants
             Field('auth_type', type='string', default='none', length=20),
             Field('token_base64', type='string', length=255),
             Field('jwt_secret', type='string', length=255),
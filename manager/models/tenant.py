@@ -0,0 +1,150 @@
+"""
+Tenant models for MarchProxy Manager
+
+Tenants share a cluster's proxies. Services, mappings and ingress routes are
+tagged with a tenant ID, proxies enforce each tenant's quotas, and users
+assigned to a cluster for one tenant only see that tenant's resources.
+
+Copyright (C) 2025 MarchProxy Contributors
+Licensed under GNU Affero General Public License v3.0
+"""
+
+import re
+from datetime import datetime
+from typing import Optional, Dict, Any, List
+from pydal import DAL, Field
+from pydantic import BaseModel, validator
+
+# Quota fields, matching the proxies' tenant.Quota
+TENANT_QUOTA_FIELDS = ['max_connections', 'requests_per_second', 'bandwidth_kbps']
+
+TENANT_ID_PATTERN = re.compile(r'^[a-z0-9][a-z0-9_-]{0,99}$')
+
+
+class TenantModel:
+    """Tenant model for isolation and quotas on shared clusters"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define tenant table in database"""
+        return db.define_table(
+            'tenants',
+            Field('name', type='string', required=True, length=100),
+            Field('description', type='text'),
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('max_connections', type='integer', default=0),
+            Field('requests_per_second', type='double', default=0),
+            Field('bandwidth_kbps', type='integer', default=0),
+            Field('is_active', type='boolean', default=True),
+            Field('created_by', type='reference auth_user'),
+            Field('created_at', type='datetime', default=datetime.utcnow),
+            Field('updated_at', type='datetime', update=datetime.utcnow),
+        )
+
+    @staticmethod
+    def validate_tenant(tenant: Optional[str]) -> Optional[str]:
+        """Validate a tenant ID tag, None for resources shared by all tenants"""
+        if not tenant:
+            return None
+        if not isinstance(tenant, str) or not TENANT_ID_PATTERN.match(tenant):
+            raise ValueError("tenant must be lowercase letters, digits, hyphens and underscores")
+        return tenant
+
+    @staticmethod
+    def validate_quotas(data: Dict[str, Any]) -> Dict[str, Any]:
+        """Validate the quota fields present in data, 0 meaning unlimited"""
+        quotas = {}
+        for field in TENANT_QUOTA_FIELDS:
+            if field not in data:
+                continue
+            value = data[field] or 0
+            if field == 'requests_per_second':
+                valid = isinstance(value, (int, float)) and value >= 0
+            else:
+                valid = isinstance(value, int) and value >= 0
+            if not valid:
+                raise ValueError(f"{field} must be a non-negative number")
+            quotas[field] = value
+        return quotas
+
+    @staticmethod
+    def check_tenant(db: DAL, cluster_id: int, tenant: Optional[str]) -> Optional[str]:
+        """Validate a tenant tag and check the tenant exists in the cluster"""
+        tenant = TenantModel.validate_tenant(tenant)
+        if tenant and db(
+            (db.tenants.cluster_id == cluster_id) &
+            (db.tenants.name == tenant) &
+            (db.tenants.is_active == True)
+        ).isempty():
+            raise ValueError(f"Unknown tenant {tenant} in cluster {cluster_id}")
+        return tenant
+
+    @staticmethod
+    def get_cluster_quotas(db: DAL, cluster_id: int) -> List[Dict[str, Any]]:
+        """Get the tenant quotas sent to a cluster's proxies"""
+        tenants = db(
+            (db.tenants.cluster_id == cluster_id) &
+            (db.tenants.is_active == True)
+        ).select(orderby=db.tenants.name)
+
+        return [
+            {
+                'id': tenant.name,
+                'max_connections': tenant.max_connections or 0,
+                'requests_per_second': tenant.requests_per_second or 0,
+                'bandwidth_kbps': tenant.bandwidth_kbps or 0,
+            }
+            for tenant in tenants
+        ]
+
+    @staticmethod
+    def user_tenant(db: DAL, user_id: int, cluster_id: int) -> Optional[str]:
+        """Get the tenant a user is limited to in a cluster, None for the whole cluster"""
+        assignment = db(
+            (db.user_cluster_assignments.user_id == user_id) &
+            (db.user_cluster_assignments.cluster_id == cluster_id)
+        ).select().first()
+        return assignment.tenant if assignment else None
+
+    @staticmethod
+    def visible_query(db: DAL, table, user_id: int):
+        """Build the query for rows of table a non-admin user may see.
+
+        Users see every row of the clusters they are assigned to, or only
+        their tenant's rows when the assignment names a tenant. Returns None
+        when the user has no cluster assignments.
+        """
+        assignments = db(db.user_cluster_assignments.user_id == user_id).select(
+            db.user_cluster_assignments.cluster_id,
+            db.user_cluster_assignments.tenant
+        )
+
+        query = None
+        for assignment in assignments:
+            scope = table.cluster_id == assignment.cluster_id
+            if assignment.tenant:
+                scope &= table.tenant == assignment.tenant
+            query = scope if query is None else query | scope
+        return query
+
+
+# Pydantic models for request/response validation
+class CreateTenantRequest(BaseModel):
+    name: str
+    cluster_id: int
+    description: Optional[str] = None
+    max_connections: int = 0
+    requests_per_second: float = 0
+    bandwidth_kbps: int = 0
+
+    @validator('name')
+    def validate_name(cls, v):
+        if not v:
+            raise ValueError('Tenant name is required')
+        return TenantModel.validate_tenant(v)
+
+    @validator('max_connections', 'requests_per_second', 'bandwidth_kbps')
+    def validate_quota(cls, v):
+        if v < 0:
+            raise ValueError('Quotas must be non-negative, 0 is unlimited')
+        return v
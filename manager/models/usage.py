@@ -0,0 +1,149 @@
+"""
+Usage metering models for MarchProxy Manager
+
+Proxies upload closed usage periods per tenant and service: bytes,
+connections, requests and transcode minutes. The manager keeps the records
+and aggregates them for chargeback and billing exports.
+
+Copyright (C) 2025 MarchProxy Contributors
+Licensed under GNU Affero General Public License v3.0
+"""
+
+import csv
+import io
+from datetime import datetime, timedelta, timezone
+from typing import Optional, Dict, Any, List
+from pydal import DAL, Field
+from pydantic import BaseModel, validator
+
+USAGE_METRICS = ['bytes', 'connections', 'requests', 'transcode_minutes']
+
+# Record fields usage can be grouped by
+USAGE_GROUP_FIELDS = ['tenant', 'service', 'module', 'proxy_name']
+
+
+class UsageRecordModel:
+    """Usage records uploaded by proxies for chargeback"""
+
+    @staticmethod
+    def define_table(db: DAL):
+        """Define usage records table"""
+        return db.define_table(
+            'usage_records',
+            Field('cluster_id', type='reference clusters', required=True),
+            Field('proxy_name', type='string', length=100),
+            Field('module', type='string', length=20),
+            Field('tenant', type='string', length=100),
+            Field('service', type='string', length=255),
+            Field('period_start', type='datetime', required=True),
+            Field('period_end', type='datetime', required=True),
+            Field('bytes', type='bigint', default=0),
+            Field('connections', type='bigint', default=0),
+            Field('requests', type='bigint', default=0),
+            Field('transcode_minutes', type='double', default=0),
+            Field('received_at', type='datetime', default=datetime.utcnow),
+        )
+
+    @staticmethod
+    def record_usage(db: DAL, cluster_id: int, proxy_name: str,
+                     records: List['UsageRecordRequest']) -> int:
+        """Store uploaded usage records, returning how many were stored"""
+        for record in records:
+            db.usage_records.insert(
+                cluster_id=cluster_id,
+                proxy_name=record.proxy or proxy_name,
+                module=record.module,
+                tenant=record.tenant,
+                service=record.service,
+                period_start=record.period_start,
+                period_end=record.period_end,
+                bytes=record.bytes,
+                connections=record.connections,
+                requests=record.requests,
+                transcode_minutes=record.transcode_minutes,
+            )
+        return len(records)
+
+    @staticmethod
+    def get_usage(db: DAL, cluster_id: int, start: datetime, end: datetime,
+                  group_by: List[str], tenant: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Sum usage of periods starting in [start, end), grouped by group_by"""
+        query = (
+            (db.usage_records.cluster_id == cluster_id) &
+            (db.usage_records.period_start >= start) &
+            (db.usage_records.period_start < end)
+        )
+        if tenant:
+            query &= db.usage_records.tenant == tenant
+
+        groups = [db.usage_records[field] for field in group_by]
+        sums = {metric: db.usage_records[metric].sum() for metric in USAGE_METRICS}
+        rows = db(query).select(*groups, *sums.values(), groupby=groups, orderby=groups)
+
+        usage = []
+        for row in rows:
+            entry = {field: row.usage_records[field] for field in group_by}
+            for metric, total in sums.items():
+                entry[metric] = row[total] or 0
+            usage.append(entry)
+        return usage
+
+    @staticmethod
+    def to_csv(usage: List[Dict[str, Any]], group_by: List[str],
+               start: datetime, end: datetime) -> str:
+        """Format aggregated usage as a CSV billing export"""
+        out = io.StringIO()
+        writer = csv.writer(out)
+        writer.writerow(['period_start', 'period_end'] + group_by + USAGE_METRICS)
+        for entry in usage:
+            writer.writerow(
+                [start.isoformat(), end.isoformat()] +
+                [entry[field] for field in group_by] +
+                [entry[metric] for metric in USAGE_METRICS]
+            )
+        return out.getvalue()
+
+    @staticmethod
+    def cleanup_old_usage(db: DAL, days: int = 400) -> int:
+        """Clean up usage records older than the billing retention"""
+        cutoff_time = datetime.utcnow() - timedelta(days=days)
+        return db(db.usage_records.period_end < cutoff_time).delete()
+
+
+# Pydantic models for request/response validation
+class UsageRecordRequest(BaseModel):
+    period_start: datetime
+    period_end: datetime
+    module: str
+    proxy: Optional[str] = None
+    tenant: str = ''
+    service: str = ''
+    bytes: int = 0
+    connections: int = 0
+    requests: int = 0
+    transcode_minutes: float = 0
+
+    @validator('period_start', 'period_end')
+    def validate_utc(cls, v):
+        # Stored as naive UTC like every other manager timestamp
+        if v.tzinfo is not None:
+            v = v.astimezone(timezone.utc).replace(tzinfo=None)
+        return v
+
+    @validator('period_end')
+    def validate_period(cls, v, values):
+        if 'period_start' in values and v < values['period_start']:
+            raise ValueError('period_end must not be before period_start')
+        return v
+
+    @validator('bytes', 'connections', 'requests', 'transcode_minutes')
+    def validate_usage(cls, v):
+        if v < 0:
+            raise ValueError('Usage must be non-negative')
+        return v
+
+
+class UsageUploadRequest(BaseModel):
+    proxy_name: str
+    cluster_api_key: str
+    records: List[UsageRecordRequest]
@@ -2,77 +2,100 @@ package config
 
 import (
 	"fmt"
-	"os"
-	"strconv"
 	"time"
+
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/layers"
+
+	"github.com/spf13/pflag"
 )
 
-// Config holds the ALB configuration
+// Config holds the ALB configuration. Keys match the environment variables
+// the ALB has always read, so MODULE_ID sets module_id.
 type Config struct {
 	// Module identification
-	ModuleID   string
-	ModuleType string
-	Version    string
+	ModuleID   string `mapstructure:"module_id"`
+	ModuleType string `mapstructure:"-"`
+	Version    string `mapstructure:"version"`
 
 	// Envoy configuration
-	EnvoyBinary      string
-	EnvoyConfigPath  string
-	EnvoyAdminPort   int
-	EnvoyListenPort  int
-	EnvoyLogLevel    string
+	EnvoyBinary     string `mapstructure:"envoy_binary"`
+	EnvoyConfigPath string `mapstructure:"envoy_config_path"`
+	EnvoyAdminPort  int    `mapstructure:"envoy_admin_port"`
+	EnvoyListenPort int    `mapstructure:"envoy_listen_port"`
+	EnvoyLogLevel   string `mapstructure:"envoy_log_level"`
 
 	// xDS configuration
-	XDSServerAddr    string
-	XDSNodeID        string
-	XDSCluster       string
-	XDSConnectTimeout time.Duration
+	XDSServerAddr     string        `mapstructure:"xds_server"`
+	XDSNodeID         string        `mapstructure:"xds_node_id"`
+	XDSCluster        string        `mapstructure:"xds_cluster"`
+	XDSConnectTimeout time.Duration `mapstructure:"xds_connect_timeout"`
+
+	// Drift between Envoy's config and the xDS snapshot
+	DriftCheckInterval time.Duration `mapstructure:"drift_check_interval"` // 0 disables drift checks
+	DriftResyncAfter   time.Duration `mapstructure:"drift_resync_after"`   // Drift lasting this long forces a resync, 0 never
 
 	// gRPC server configuration
-	GRPCPort         int
-	GRPCMaxConnAge   time.Duration
+	GRPCPort       int           `mapstructure:"grpc_port"`
+	GRPCMaxConnAge time.Duration `mapstructure:"grpc_max_conn_age"`
 
 	// Monitoring
-	MetricsPort      int
-	HealthCheckPort  int
+	MetricsPort     int `mapstructure:"metrics_port"`
+	HealthCheckPort int `mapstructure:"health_port"`
+
+	// Metrics server authentication, TLS and binding
+	Admin adminserver.Config `mapstructure:"admin"`
 
 	// Lifecycle
-	ShutdownTimeout  time.Duration
-	ReloadGracePeriod time.Duration
+	ShutdownTimeout   time.Duration `mapstructure:"shutdown_timeout"`
+	ReloadGracePeriod time.Duration `mapstructure:"reload_grace_period"`
 
 	// License
-	LicenseKey       string
-	ClusterAPIKey    string
+	LicenseKey    string `mapstructure:"license_key"`
+	ClusterAPIKey string `mapstructure:"cluster_api_key"`
 }
 
-// LoadConfig loads configuration from environment variables
-func LoadConfig() (*Config, error) {
-	cfg := &Config{
-		ModuleID:         getEnv("MODULE_ID", "alb-1"),
-		ModuleType:       "ALB",
-		Version:          getEnv("VERSION", "v1.0.0"),
+// Load loads configuration from defaults, the config file at configPath
+// if any, environment variables and the --set flags
+func Load(configPath string, flags *pflag.FlagSet) (*Config, error) {
+	l := layers.New("")
+	v := l.Viper()
+
+	v.SetDefault("module_id", "alb-1")
+	v.SetDefault("version", "v1.0.0")
 
-		EnvoyBinary:      getEnv("ENVOY_BINARY", "/usr/local/bin/envoy"),
-		EnvoyConfigPath:  getEnv("ENVOY_CONFIG_PATH", "/etc/envoy/envoy.yaml"),
-		EnvoyAdminPort:   getEnvAsInt("ENVOY_ADMIN_PORT", 9901),
-		EnvoyListenPort:  getEnvAsInt("ENVOY_LISTEN_PORT", 10000),
-		EnvoyLogLevel:    getEnv("ENVOY_LOG_LEVEL", "info"),
+	v.SetDefault("envoy_binary", "/usr/local/bin/envoy")
+	v.SetDefault("envoy_config_path", "/etc/envoy/envoy.yaml")
+	v.SetDefault("envoy_admin_port", 9901)
+	v.SetDefault("envoy_listen_port", 10000)
+	v.SetDefault("envoy_log_level", "info")
 
-		XDSServerAddr:    getEnv("XDS_SERVER", "api-server:18000"),
-		XDSNodeID:        getEnv("XDS_NODE_ID", "alb-node"),
-		XDSCluster:       getEnv("XDS_CLUSTER", "marchproxy-cluster"),
-		XDSConnectTimeout: getEnvAsDuration("XDS_CONNECT_TIMEOUT", 5*time.Second),
+	v.SetDefault("xds_server", "api-server:18000")
+	v.SetDefault("xds_node_id", "alb-node")
+	v.SetDefault("xds_cluster", "marchproxy-cluster")
+	v.SetDefault("xds_connect_timeout", 5*time.Second)
+	v.SetDefault("drift_check_interval", 30*time.Second)
+	v.SetDefault("drift_resync_after", 5*time.Minute)
 
-		GRPCPort:         getEnvAsInt("GRPC_PORT", 50051),
-		GRPCMaxConnAge:   getEnvAsDuration("GRPC_MAX_CONN_AGE", 30*time.Minute),
+	v.SetDefault("grpc_port", 50051)
+	v.SetDefault("grpc_max_conn_age", 30*time.Minute)
 
-		MetricsPort:      getEnvAsInt("METRICS_PORT", 9090),
-		HealthCheckPort:  getEnvAsInt("HEALTH_PORT", 8080),
+	v.SetDefault("metrics_port", 9090)
+	v.SetDefault("health_port", 8080)
 
-		ShutdownTimeout:  getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
-		ReloadGracePeriod: getEnvAsDuration("RELOAD_GRACE_PERIOD", 5*time.Second),
+	v.SetDefault("shutdown_timeout", 30*time.Second)
+	v.SetDefault("reload_grace_period", 5*time.Second)
 
-		LicenseKey:       getEnv("LICENSE_KEY", ""),
-		ClusterAPIKey:    getEnv("CLUSTER_API_KEY", ""),
+	if err := l.ReadFile(configPath); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := l.ApplySet(flags); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{ModuleType: "ALB"}
+	if err := l.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	if err := cfg.Validate(); err != nil {
@@ -104,37 +127,17 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("GRPC_PORT must be between 1 and 65535")
 	}
 
-	if c.EnvoyAdminPort < 1 || c.EnvoyAdminPort > 65535 {
-		return fmt.Errorf("ENVOY_ADMIN_PORT must be between 1 and 65535")
+	if c.DriftCheckInterval < 0 || c.DriftResyncAfter < 0 {
+		return fmt.Errorf("DRIFT_CHECK_INTERVAL and DRIFT_RESYNC_AFTER must not be negative")
 	}
 
-	return nil
-}
-
-// getEnv gets an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	if c.EnvoyAdminPort < 1 || c.EnvoyAdminPort > 65535 {
+		return fmt.Errorf("ENVOY_ADMIN_PORT must be between 1 and 65535")
 	}
-	return defaultValue
-}
 
-// getEnvAsInt gets an environment variable as integer or returns a default value
-func getEnvAsInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intVal, err := strconv.Atoi(value); err == nil {
-			return intVal
-		}
+	if err := c.Admin.Validate(); err != nil {
+		return err
 	}
-	return defaultValue
-}
 
-// getEnvAsDuration gets an environment variable as duration or returns a default value
-func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
-	if value := os.Getenv(key); value != "" {
-		if duration, err := time.ParseDuration(value); err == nil {
-			return duration
-		}
-	}
-	return defaultValue
+	return nil
 }
@@ -0,0 +1,397 @@
+package envoy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Resource types compared against the xDS snapshot
+const (
+	ResourceListeners = "listeners"
+	ResourceClusters  = "clusters"
+	ResourceRoutes    = "routes"
+)
+
+// Client statuses Envoy reports for dynamic resources
+const (
+	clientStatusNacked = "NACKED"
+)
+
+// RejectedResource is a resource Envoy refused to apply
+type RejectedResource struct {
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	Version string    `json:"version"` // Version of the rejected update
+	Details string    `json:"details"` // Envoy's reason
+	At      time.Time `json:"at"`
+}
+
+// AppliedConfig is what Envoy's config_dump says it runs
+type AppliedConfig struct {
+	Versions map[string]string // Last accepted xDS version per resource type, absent when none was sent
+	Rejected []RejectedResource
+}
+
+// Drift compares the config Envoy runs with the snapshot the xDS server
+// holds for it
+type Drift struct {
+	Expected   string             `json:"expected_version"`
+	Applied    map[string]string  `json:"applied_versions"`
+	Rejected   []RejectedResource `json:"rejected"`
+	Since      time.Time          `json:"since"` // When the drift was first seen, zero in sync
+	CheckedAt  time.Time          `json:"checked_at"`
+	Error      string             `json:"error,omitempty"` // Last failed check
+	Resyncs    int                `json:"resyncs"`
+	LastResync time.Time          `json:"last_resync"`
+}
+
+// InSync reports whether every resource type runs the expected version and
+// none was rejected
+func (d Drift) InSync() bool {
+	return len(d.Stale()) == 0 && len(d.Rejected) == 0
+}
+
+// Stale returns the resource types running another version than expected
+func (d Drift) Stale() []string {
+	var stale []string
+	for _, resourceType := range []string{ResourceListeners, ResourceClusters, ResourceRoutes} {
+		if version, ok := d.Applied[resourceType]; ok && version != d.Expected {
+			stale = append(stale, resourceType)
+		}
+	}
+	return stale
+}
+
+// dynamicResource is a dynamic listener, cluster or route configuration in
+// the config dump
+type dynamicResource struct {
+	Name         string `json:"name"`
+	VersionInfo  string `json:"version_info"`
+	ClientStatus string `json:"client_status"`
+	ActiveState  *struct {
+		VersionInfo string `json:"version_info"`
+	} `json:"active_state"`
+	Cluster *struct {
+		Name string `json:"name"`
+	} `json:"cluster"`
+	RouteConfig *struct {
+		Name string `json:"name"`
+	} `json:"route_config"`
+	ErrorState *struct {
+		Details           string    `json:"details"`
+		LastUpdateAttempt time.Time `json:"last_update_attempt"`
+		VersionInfo       string    `json:"version_info"`
+	} `json:"error_state"`
+}
+
+// name returns the resource name wherever its type keeps it
+func (r dynamicResource) name() string {
+	switch {
+	case r.Cluster != nil:
+		return r.Cluster.Name
+	case r.RouteConfig != nil:
+		return r.RouteConfig.Name
+	}
+	return r.Name
+}
+
+// version returns the version the resource was last accepted at
+func (r dynamicResource) version() string {
+	if r.ActiveState != nil {
+		return r.ActiveState.VersionInfo
+	}
+	return r.VersionInfo
+}
+
+// configDumpSection is one of the typed configs in the config dump
+type configDumpSection struct {
+	Type                   string            `json:"@type"`
+	VersionInfo            string            `json:"version_info"`
+	DynamicListeners       []dynamicResource `json:"dynamic_listeners"`
+	DynamicActiveClusters  []dynamicResource `json:"dynamic_active_clusters"`
+	DynamicWarmingClusters []dynamicResource `json:"dynamic_warming_clusters"`
+	DynamicRouteConfigs    []dynamicResource `json:"dynamic_route_configs"`
+}
+
+// ConfigDump fetches Envoy's config_dump from the admin API and reads the
+// versions and rejected updates of its dynamic resources
+func (m *Manager) ConfigDump(ctx context.Context) (*AppliedConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/config_dump", m.adminPort), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config dump: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("admin API returned %d: %s", resp.StatusCode, body)
+	}
+	return parseConfigDump(resp.Body)
+}
+
+// parseConfigDump reads the dynamic resources of a config dump
+func parseConfigDump(r io.Reader) (*AppliedConfig, error) {
+	var dump struct {
+		Configs []configDumpSection `json:"configs"`
+	}
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, fmt.Errorf("failed to decode config dump: %w", err)
+	}
+
+	applied := &AppliedConfig{Versions: make(map[string]string)}
+	for _, section := range dump.Configs {
+		var resourceType string
+		var resources []dynamicResource
+		switch {
+		case strings.HasSuffix(section.Type, ".ListenersConfigDump"):
+			resourceType = ResourceListeners
+			resources = section.DynamicListeners
+		case strings.HasSuffix(section.Type, ".ClustersConfigDump"):
+			resourceType = ResourceClusters
+			resources = append(section.DynamicActiveClusters, section.DynamicWarmingClusters...)
+		case strings.HasSuffix(section.Type, ".RoutesConfigDump"):
+			resourceType = ResourceRoutes
+			resources = section.DynamicRouteConfigs
+		default:
+			continue
+		}
+
+		// Listeners and clusters carry the last accepted version of their
+		// xDS stream; routes only per route configuration
+		version := section.VersionInfo
+		for _, resource := range resources {
+			if version == "" {
+				version = resource.version()
+			}
+			if resource.ErrorState == nil && resource.ClientStatus != clientStatusNacked {
+				continue
+			}
+			rejected := RejectedResource{Type: resourceType, Name: resource.name()}
+			if resource.ErrorState != nil {
+				rejected.Version = resource.ErrorState.VersionInfo
+				rejected.Details = resource.ErrorState.Details
+				rejected.At = resource.ErrorState.LastUpdateAttempt
+			}
+			applied.Rejected = append(applied.Rejected, rejected)
+		}
+		if version != "" {
+			applied.Versions[resourceType] = version
+		}
+	}
+	return applied, nil
+}
+
+// driftMetrics report the reconciler's checks
+type driftMetrics struct {
+	drift    prometheus.Gauge
+	seconds  prometheus.Gauge
+	rejected *prometheus.GaugeVec
+	checks   *prometheus.CounterVec
+	resyncs  *prometheus.CounterVec
+}
+
+func newDriftMetrics(registerer prometheus.Registerer) driftMetrics {
+	m := driftMetrics{
+		drift: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "marchproxy",
+			Subsystem: "alb",
+			Name:      "config_drift",
+			Help:      "Whether Envoy's config differs from the xDS snapshot",
+		}),
+		seconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "marchproxy",
+			Subsystem: "alb",
+			Name:      "config_drift_seconds",
+			Help:      "How long Envoy's config has differed from the xDS snapshot, 0 in sync",
+		}),
+		rejected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "marchproxy",
+			Subsystem: "alb",
+			Name:      "config_rejected_resources",
+			Help:      "Resources whose last xDS update Envoy rejected (NACK)",
+		}, []string{"type"}),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "marchproxy",
+			Subsystem: "alb",
+			Name:      "config_drift_checks_total",
+			Help:      "Total number of drift checks by result",
+		}, []string{"result"}),
+		resyncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "marchproxy",
+			Subsystem: "alb",
+			Name:      "config_resyncs_total",
+			Help:      "Total number of forced resyncs with the xDS server by trigger",
+		}, []string{"trigger", "result"}),
+	}
+	if registerer != nil {
+		registerer.MustRegister(m.drift, m.seconds, m.rejected, m.checks, m.resyncs)
+	}
+	return m
+}
+
+// Reconciler periodically compares Envoy's config_dump with the snapshot
+// version the xDS server holds, reporting drift and rejected updates, and
+// forces a resync once drift outlasts resyncAfter
+type Reconciler struct {
+	manager     *Manager
+	xdsClient   *XDSClient
+	resyncAfter time.Duration // 0 never resyncs on its own
+	logger      *logrus.Logger
+	metrics     driftMetrics
+
+	mu    sync.RWMutex
+	drift Drift
+}
+
+// NewReconciler creates a reconciler registering its metrics with
+// registerer
+func NewReconciler(manager *Manager, xdsClient *XDSClient, resyncAfter time.Duration, registerer prometheus.Registerer, logger *logrus.Logger) *Reconciler {
+	if logger == nil {
+		logger = logrus.New()
+	}
+
+	return &Reconciler{
+		manager:     manager,
+		xdsClient:   xdsClient,
+		resyncAfter: resyncAfter,
+		logger:      logger,
+		metrics:     newDriftMetrics(registerer),
+	}
+}
+
+// Run checks for drift every interval until ctx is done
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if drift := r.Check(ctx); r.resyncDue(drift) {
+				if err := r.Resync(ctx, "drift"); err != nil {
+					r.logger.WithError(err).Warn("Forced resync after config drift failed")
+				}
+			}
+		}
+	}
+}
+
+// resyncDue reports whether drift has lasted resyncAfter, since it was
+// first seen or since the last resync failed to fix it
+func (r *Reconciler) resyncDue(drift Drift) bool {
+	if r.resyncAfter <= 0 || drift.Since.IsZero() {
+		return false
+	}
+	since := drift.Since
+	if drift.LastResync.After(since) {
+		since = drift.LastResync
+	}
+	return time.Since(since) >= r.resyncAfter
+}
+
+// Check compares Envoy's config with the xDS snapshot once and returns the
+// result. Failed checks keep the last comparison and record the error.
+func (r *Reconciler) Check(ctx context.Context) Drift {
+	expected, err := r.xdsClient.GetSnapshotVersion()
+	var applied *AppliedConfig
+	if err == nil {
+		applied, err = r.manager.ConfigDump(ctx)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.drift.CheckedAt = now
+	if err != nil {
+		r.drift.Error = err.Error()
+		r.metrics.checks.WithLabelValues("error").Inc()
+		r.logger.WithError(err).Debug("Config drift check failed")
+		return r.drift
+	}
+
+	wasInSync := r.drift.Since.IsZero()
+	r.drift.Error = ""
+	r.drift.Expected = expected
+	r.drift.Applied = applied.Versions
+	r.drift.Rejected = applied.Rejected
+
+	rejected := map[string]int{ResourceListeners: 0, ResourceClusters: 0, ResourceRoutes: 0}
+	for _, resource := range applied.Rejected {
+		rejected[resource.Type]++
+	}
+	for resourceType, count := range rejected {
+		r.metrics.rejected.WithLabelValues(resourceType).Set(float64(count))
+	}
+
+	if r.drift.InSync() {
+		if !wasInSync {
+			r.logger.WithField("version", expected).Info("Envoy config back in sync with the xDS snapshot")
+		}
+		r.drift.Since = time.Time{}
+		r.metrics.drift.Set(0)
+		r.metrics.seconds.Set(0)
+		r.metrics.checks.WithLabelValues("in_sync").Inc()
+		return r.drift
+	}
+
+	if wasInSync {
+		r.drift.Since = now
+		r.logger.WithFields(logrus.Fields{
+			"expected": expected,
+			"applied":  applied.Versions,
+			"stale":    r.drift.Stale(),
+			"rejected": len(applied.Rejected),
+		}).Warn("Envoy config drifted from the xDS snapshot")
+		for _, resource := range applied.Rejected {
+			r.logger.WithFields(logrus.Fields{
+				"type":    resource.Type,
+				"name":    resource.Name,
+				"version": resource.Version,
+			}).Warnf("Envoy rejected xDS update: %s", resource.Details)
+		}
+	}
+	r.metrics.drift.Set(1)
+	r.metrics.seconds.Set(now.Sub(r.drift.Since).Seconds())
+	r.metrics.checks.WithLabelValues("drift").Inc()
+	return r.drift
+}
+
+// Resync forces Envoy to reload its config from the xDS server, then checks
+// for drift again. trigger labels the resync in metrics, e.g. drift or
+// grpc.
+func (r *Reconciler) Resync(ctx context.Context, trigger string) error {
+	r.logger.WithField("trigger", trigger).Info("Forcing resync with the xDS server")
+	if err := r.manager.Reload(); err != nil {
+		r.metrics.resyncs.WithLabelValues(trigger, "failed").Inc()
+		return fmt.Errorf("resync failed: %w", err)
+	}
+	r.metrics.resyncs.WithLabelValues(trigger, "succeeded").Inc()
+
+	r.mu.Lock()
+	r.drift.Resyncs++
+	r.drift.LastResync = time.Now()
+	r.mu.Unlock()
+	r.Check(ctx)
+	return nil
+}
+
+// Status returns the last drift check
+func (r *Reconciler) Status() Drift {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.drift
+}
@@ -0,0 +1,298 @@
+package envoy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// configDump is a config_dump with listeners and clusters at version 7 and
+// a route configuration NACKed at version 8
+const configDump = `{
+  "configs": [
+    {"@type": "type.googleapis.com/envoy.admin.v3.BootstrapConfigDump", "bootstrap": {}},
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump",
+      "version_info": "7",
+      "dynamic_listeners": [
+        {"name": "marchproxy_listener", "active_state": {"version_info": "7"}, "client_status": "ACKED"}
+      ]
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+      "version_info": "7",
+      "dynamic_active_clusters": [
+        {"version_info": "7", "cluster": {"name": "api"}}
+      ],
+      "dynamic_warming_clusters": [
+        {"version_info": "7", "cluster": {"name": "auth"}}
+      ]
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.RoutesConfigDump",
+      "dynamic_route_configs": [
+        {
+          "version_info": "6",
+          "route_config": {"name": "marchproxy_routes"},
+          "client_status": "NACKED",
+          "error_state": {
+            "details": "duplicate virtual host",
+            "last_update_attempt": "2026-03-01T12:00:00Z",
+            "version_info": "8"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+func TestParseConfigDump(t *testing.T) {
+	applied, err := parseConfigDump(strings.NewReader(configDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Routes carry their version per route configuration
+	want := map[string]string{ResourceListeners: "7", ResourceClusters: "7", ResourceRoutes: "6"}
+	if !reflect.DeepEqual(applied.Versions, want) {
+		t.Errorf("versions %v, want %v", applied.Versions, want)
+	}
+
+	wantRejected := []RejectedResource{{
+		Type:    ResourceRoutes,
+		Name:    "marchproxy_routes",
+		Version: "8",
+		Details: "duplicate virtual host",
+		At:      time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	}}
+	if !reflect.DeepEqual(applied.Rejected, wantRejected) {
+		t.Errorf("rejected %+v, want %+v", applied.Rejected, wantRejected)
+	}
+}
+
+func TestParseConfigDumpRejected(t *testing.T) {
+	// A NACKed cluster without error details, and a warming cluster that
+	// failed its update
+	dump := `{"configs": [{
+		"@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+		"dynamic_active_clusters": [
+			{"version_info": "3", "cluster": {"name": "api"}, "client_status": "NACKED"}
+		],
+		"dynamic_warming_clusters": [
+			{"version_info": "3", "cluster": {"name": "auth"}, "error_state": {"details": "no endpoints", "version_info": "4"}}
+		]
+	}]}`
+	applied, err := parseConfigDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a section version the first resource's is used, and types
+	// Envoy wasn't sent are absent
+	if want := map[string]string{ResourceClusters: "3"}; !reflect.DeepEqual(applied.Versions, want) {
+		t.Errorf("versions %v, want %v", applied.Versions, want)
+	}
+	want := []RejectedResource{
+		{Type: ResourceClusters, Name: "api"},
+		{Type: ResourceClusters, Name: "auth", Version: "4", Details: "no endpoints"},
+	}
+	if !reflect.DeepEqual(applied.Rejected, want) {
+		t.Errorf("rejected %+v, want %+v", applied.Rejected, want)
+	}
+
+	if _, err := parseConfigDump(strings.NewReader("<html>")); err == nil {
+		t.Error("invalid config dump parsed")
+	}
+}
+
+func TestDriftInSync(t *testing.T) {
+	rejected := []RejectedResource{{Type: ResourceRoutes, Name: "marchproxy_routes"}}
+	for _, c := range []struct {
+		name   string
+		drift  Drift
+		stale  []string
+		inSync bool
+	}{
+		{"in sync", Drift{Expected: "7", Applied: map[string]string{ResourceListeners: "7", ResourceClusters: "7", ResourceRoutes: "7"}}, nil, true},
+		// Types Envoy wasn't sent are not stale
+		{"partial", Drift{Expected: "7", Applied: map[string]string{ResourceClusters: "7"}}, nil, true},
+		{"nothing applied", Drift{Expected: "7"}, nil, true},
+		{"stale", Drift{Expected: "8", Applied: map[string]string{ResourceListeners: "8", ResourceClusters: "7", ResourceRoutes: "7"}}, []string{ResourceClusters, ResourceRoutes}, false},
+		{"rejected", Drift{Expected: "7", Applied: map[string]string{ResourceRoutes: "7"}, Rejected: rejected}, nil, false},
+	} {
+		if stale := c.drift.Stale(); !reflect.DeepEqual(stale, c.stale) {
+			t.Errorf("%s: stale %v, want %v", c.name, stale, c.stale)
+		}
+		if inSync := c.drift.InSync(); inSync != c.inSync {
+			t.Errorf("%s: in sync %v, want %v", c.name, inSync, c.inSync)
+		}
+	}
+}
+
+// fakeEnvoy serves the xDS server's version endpoint and Envoy's admin
+// config dump, answering 503 for either while it is set to fail
+type fakeEnvoy struct {
+	mu      sync.Mutex
+	version int
+	dump    string
+	fail    bool
+}
+
+func (f *fakeEnvoy) set(version int, dump string, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version, f.dump, f.fail = version, dump, fail
+}
+
+func (f *fakeEnvoy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/version":
+		fmt.Fprintf(w, `{"version": %d, "node_id": "alb-1"}`, f.version)
+	case "/config_dump":
+		fmt.Fprint(w, f.dump)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestReconciler returns a reconciler checking a fake xDS server and
+// Envoy, with a manager whose Envoy isn't running
+func newTestReconciler(t *testing.T, resyncAfter time.Duration) (*Reconciler, *fakeEnvoy) {
+	t.Helper()
+	fake := &fakeEnvoy{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	address, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(address.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	manager := NewManager("envoy", "", port, "info", logger)
+	return NewReconciler(manager, NewXDSClient(address.Host, logger), resyncAfter, prometheus.NewRegistry(), logger), fake
+}
+
+// metricValue returns the value of a gauge or counter
+func metricValue(t *testing.T, metric prometheus.Metric) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Gauge != nil {
+		return m.Gauge.GetValue()
+	}
+	return m.Counter.GetValue()
+}
+
+func TestReconcilerCheck(t *testing.T) {
+	r, fake := newTestReconciler(t, 0)
+	ctx := context.Background()
+
+	// Envoy runs version 7 of everything but the NACKed routes
+	fake.set(7, configDump, false)
+	drift := r.Check(ctx)
+	if drift.InSync() || drift.Expected != "7" || drift.Since.IsZero() || !reflect.DeepEqual(drift.Stale(), []string{ResourceRoutes}) {
+		t.Fatalf("drift %+v, want routes stale and rejected", drift)
+	}
+	since := drift.Since
+	if metricValue(t, r.metrics.drift) != 1 || metricValue(t, r.metrics.rejected.WithLabelValues(ResourceRoutes)) != 1 || metricValue(t, r.metrics.rejected.WithLabelValues(ResourceClusters)) != 0 {
+		t.Error("drift and rejected routes not reported")
+	}
+
+	// Drift is dated from when it was first seen
+	if drift = r.Check(ctx); !drift.Since.Equal(since) {
+		t.Errorf("drift since %v, want %v", drift.Since, since)
+	}
+
+	// A failed check keeps the last comparison
+	fake.set(8, configDump, true)
+	drift = r.Check(ctx)
+	if drift.Error == "" || drift.Expected != "7" || !drift.Since.Equal(since) {
+		t.Errorf("drift %+v after a failed check, want the error and the last comparison", drift)
+	}
+
+	fake.set(7, `{"configs": [{"@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump", "version_info": "7"}]}`, false)
+	drift = r.Check(ctx)
+	if !drift.InSync() || !drift.Since.IsZero() || drift.Error != "" || len(drift.Rejected) != 0 {
+		t.Errorf("drift %+v, want in sync", drift)
+	}
+	if metricValue(t, r.metrics.drift) != 0 || metricValue(t, r.metrics.seconds) != 0 || metricValue(t, r.metrics.rejected.WithLabelValues(ResourceRoutes)) != 0 {
+		t.Error("drift still reported in sync")
+	}
+	if status := r.Status(); !reflect.DeepEqual(status, drift) {
+		t.Errorf("status %+v, want the last check %+v", status, drift)
+	}
+
+	for result, want := range map[string]float64{"drift": 2, "error": 1, "in_sync": 1} {
+		if got := metricValue(t, r.metrics.checks.WithLabelValues(result)); got != want {
+			t.Errorf("%s checks %v, want %v", result, got, want)
+		}
+	}
+}
+
+func TestReconcilerResync(t *testing.T) {
+	r, fake := newTestReconciler(t, time.Minute)
+	fake.set(7, configDump, false)
+
+	// Envoy isn't running, so the reload fails and nothing is recorded as
+	// resynced
+	if err := r.Resync(context.Background(), "drift"); err == nil {
+		t.Fatal("resync without Envoy succeeded")
+	}
+	if status := r.Status(); status.Resyncs != 0 || !status.LastResync.IsZero() {
+		t.Errorf("status %+v after a failed resync", status)
+	}
+	if got := metricValue(t, r.metrics.resyncs.WithLabelValues("drift", "failed")); got != 1 {
+		t.Errorf("failed resyncs %v, want 1", got)
+	}
+}
+
+func TestResyncDue(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name        string
+		resyncAfter time.Duration
+		drift       Drift
+		want        bool
+	}{
+		{"in sync", time.Minute, Drift{}, false},
+		{"disabled", 0, Drift{Since: now.Add(-time.Hour)}, false},
+		{"recent drift", time.Minute, Drift{Since: now.Add(-30 * time.Second)}, false},
+		{"lasting drift", time.Minute, Drift{Since: now.Add(-2 * time.Minute)}, true},
+		// A resync that didn't fix the drift restarts the wait
+		{"recent resync", time.Minute, Drift{Since: now.Add(-time.Hour), LastResync: now.Add(-30 * time.Second)}, false},
+		{"old resync", time.Minute, Drift{Since: now.Add(-time.Hour), LastResync: now.Add(-2 * time.Minute)}, true},
+		// Resyncs before the drift began don't count
+		{"resync before drift", time.Minute, Drift{Since: now.Add(-2 * time.Minute), LastResync: now.Add(-time.Hour)}, true},
+	} {
+		r := &Reconciler{resyncAfter: c.resyncAfter}
+		if got := r.resyncDue(c.drift); got != c.want {
+			t.Errorf("%s: resync due %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -115,6 +115,29 @@ func (x *XDSClient) GetClusters() ([]ClusterConfig, error) {
 	return clusters, nil
 }
 
+// GetSnapshotVersion returns the version of the snapshot the xDS server
+// serves
+func (x *XDSClient) GetSnapshotVersion() (string, error) {
+	resp, err := x.httpClient.Get(fmt.Sprintf("http://%s/v1/version", x.serverAddr))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch snapshot version: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("xDS server returned %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Version json.Number `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode snapshot version: %w", err)
+	}
+	return result.Version.String(), nil
+}
+
 // UpdateRouteRateLimit updates rate limiting for a specific route
 func (x *XDSClient) UpdateRouteRateLimit(routeName string, rateLimit *RateLimitConfig) error {
 	x.logger.WithFields(logrus.Fields{
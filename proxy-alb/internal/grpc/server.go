@@ -24,6 +24,7 @@ type Server struct {
 	envoyManager    *envoy.Manager
 	xdsClient       *envoy.XDSClient
 	metricsCollector *metrics.Collector
+	reconciler      *envoy.Reconciler // nil without drift checks
 	logger          *logrus.Logger
 
 	grpcServer      *grpc.Server
@@ -36,6 +37,7 @@ func NewServer(
 	envoyMgr *envoy.Manager,
 	xdsClient *envoy.XDSClient,
 	metricsCollector *metrics.Collector,
+	reconciler *envoy.Reconciler,
 	logger *logrus.Logger,
 ) *Server {
 	if logger == nil {
@@ -47,6 +49,7 @@ func NewServer(
 		envoyManager:     envoyMgr,
 		xdsClient:        xdsClient,
 		metricsCollector: metricsCollector,
+		reconciler:       reconciler,
 		logger:           logger,
 		startTime:        time.Now(),
 	}
@@ -122,6 +125,27 @@ func (s *Server) GetStatus(ctx context.Context, req *pb.StatusRequest) (*pb.Stat
 		},
 	}
 
+	// Report drift from the xDS snapshot, which leaves Envoy serving but
+	// on an outdated or partial config
+	if s.reconciler != nil {
+		drift := s.reconciler.Status()
+		resp.Metadata["xds_expected_version"] = drift.Expected
+		for resourceType, version := range drift.Applied {
+			resp.Metadata["xds_applied_version_"+resourceType] = version
+		}
+		resp.Metadata["config_drift"] = fmt.Sprintf("%t", !drift.InSync())
+		resp.Metadata["config_rejected"] = fmt.Sprintf("%d", len(drift.Rejected))
+		if !drift.Since.IsZero() {
+			resp.Metadata["config_drift_since"] = drift.Since.Format(time.RFC3339)
+		}
+		if drift.Error != "" {
+			resp.Metadata["config_drift_error"] = drift.Error
+		}
+		if !drift.InSync() && health == pb.HealthStatus_HEALTHY {
+			resp.Health = pb.HealthStatus_DEGRADED
+		}
+	}
+
 	return resp, nil
 }
 
@@ -267,8 +291,14 @@ func (s *Server) SetTrafficWeight(ctx context.Context, req *pb.TrafficWeightRequ
 func (s *Server) Reload(ctx context.Context, req *pb.ReloadRequest) (*pb.ReloadResponse, error) {
 	s.logger.WithField("force", req.Force).Info("Reload called")
 
+	// A forced reload resyncs with the xDS server and checks for drift again
+	reload := s.envoyManager.Reload
+	if req.Force && s.reconciler != nil {
+		reload = func() error { return s.reconciler.Resync(ctx, "grpc") }
+	}
+
 	// Trigger Envoy reload
-	if err := s.envoyManager.Reload(); err != nil {
+	if err := reload(); err != nil {
 		return &pb.ReloadResponse{
 			Success:         false,
 			Message:         fmt.Sprintf("Reload failed: %v", err),
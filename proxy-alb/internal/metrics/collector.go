@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,6 +23,10 @@ type Collector struct {
 	cachedMetrics  *Metrics
 	lastCollection time.Time
 	cacheTimeout   time.Duration
+
+	// Envoy's full stats on a Prometheus registry, see prometheus.go
+	registry *prometheus.Registry
+	scrape   scrapeMetrics
 }
 
 // Metrics contains performance and traffic metrics
@@ -58,14 +63,17 @@ func NewCollector(adminAddr string, logger *logrus.Logger) *Collector {
 		logger = logrus.New()
 	}
 
-	return &Collector{
+	c := &Collector{
 		adminAddr: adminAddr,
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
 		logger:       logger,
 		cacheTimeout: 5 * time.Second,
+		scrape:       newScrapeMetrics(),
 	}
+	c.registry = c.newRegistry()
+	return c
 }
 
 // GetMetrics retrieves current metrics from Envoy
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Namespace prefixes the ALB's metrics, Envoy's included
+const Namespace = "marchproxy_alb"
+
+// envoyLabels renames Envoy's tag labels to the names used across
+// marchproxy; other labels only lose their envoy_ prefix
+var envoyLabels = map[string]string{
+	"envoy_cluster_name":             "cluster",
+	"envoy_listener_address":         "listener",
+	"envoy_http_conn_manager_prefix": "http_conn_manager",
+	"envoy_tcp_prefix":               "tcp_proxy",
+	"envoy_virtual_host":             "virtual_host",
+	"envoy_virtual_cluster":          "virtual_cluster",
+}
+
+// scrapeMetrics describe the collector's scrapes of Envoy
+type scrapeMetrics struct {
+	up       prometheus.Gauge
+	duration prometheus.Histogram
+	errors   prometheus.Counter
+	families prometheus.Gauge
+}
+
+func newScrapeMetrics() scrapeMetrics {
+	return scrapeMetrics{
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "envoy_up",
+			Help:      "Whether the last scrape of Envoy's stats succeeded",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "envoy_scrape_duration_seconds",
+			Help:      "Time taken to scrape and convert Envoy's stats",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "envoy_scrape_errors_total",
+			Help:      "Total number of failed scrapes of Envoy's stats",
+		}),
+		families: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "envoy_metric_families",
+			Help:      "Metric families in the last scrape of Envoy's stats",
+		}),
+	}
+}
+
+// Registry returns the registry exposing Envoy's stats, scraped from
+// /stats/prometheus on every collection and renamed into the marchproxy
+// namespace, together with the ALB process's own metrics
+func (c *Collector) Registry() *prometheus.Registry {
+	return c.registry
+}
+
+// newRegistry registers the collector and the Go and process collectors
+func (c *Collector) newRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		c,
+	)
+	return registry
+}
+
+// collect sends the scrape metrics
+func (m scrapeMetrics) collect(ch chan<- prometheus.Metric) {
+	ch <- m.up
+	ch <- m.duration
+	ch <- m.errors
+	ch <- m.families
+}
+
+// Describe sends nothing: Envoy's stats are only known once scraped, so the
+// collector is unchecked
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect scrapes Envoy's stats and sends them renamed, followed by the
+// scrape metrics so they describe this scrape rather than the previous one
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	defer c.scrape.collect(ch)
+
+	start := time.Now()
+	families, err := c.scrapeEnvoy()
+	c.scrape.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.scrape.up.Set(0)
+		c.scrape.errors.Inc()
+		c.logger.WithError(err).Warn("Failed to scrape Envoy stats")
+		return
+	}
+	c.scrape.up.Set(1)
+	c.scrape.families.Set(float64(len(families)))
+
+	for _, family := range families {
+		name := envoyMetricName(family.GetName())
+		help := family.GetHelp()
+		if help == "" {
+			help = "Envoy stat " + family.GetName()
+		}
+		for _, m := range family.GetMetric() {
+			metric, err := convertMetric(name, help, family.GetType(), m)
+			if err != nil {
+				c.logger.WithError(err).WithField("metric", family.GetName()).Debug("Skipping Envoy stat")
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
+
+// scrapeEnvoy fetches and parses Envoy's stats in the Prometheus text format
+func (c *Collector) scrapeEnvoy() (map[string]*dto.MetricFamily, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("http://%s/stats/prometheus", c.adminAddr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("admin API returned %d: %s", resp.StatusCode, body)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stats: %w", err)
+	}
+	return families, nil
+}
+
+// envoyMetricName moves an Envoy metric into the ALB's namespace, e.g.
+// envoy_cluster_upstream_rq_total becomes
+// marchproxy_alb_cluster_upstream_rq_total
+func envoyMetricName(name string) string {
+	return Namespace + "_" + strings.TrimPrefix(name, "envoy_")
+}
+
+// envoyLabelName renames one of Envoy's labels
+func envoyLabelName(name string) string {
+	if renamed, ok := envoyLabels[name]; ok {
+		return renamed
+	}
+	return strings.TrimPrefix(name, "envoy_")
+}
+
+// convertMetric turns a parsed Envoy metric into a constant metric under
+// name, with its labels renamed
+func convertMetric(name, help string, metricType dto.MetricType, m *dto.Metric) (prometheus.Metric, error) {
+	labels := make(prometheus.Labels, len(m.GetLabel()))
+	for _, pair := range m.GetLabel() {
+		labels[envoyLabelName(pair.GetName())] = pair.GetValue()
+	}
+	desc := prometheus.NewDesc(name, help, nil, labels)
+
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		histogram := m.GetHistogram()
+		buckets := make(map[float64]uint64, len(histogram.GetBucket()))
+		for _, bucket := range histogram.GetBucket() {
+			buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, histogram.GetSampleCount(), histogram.GetSampleSum(), buckets)
+	case dto.MetricType_SUMMARY:
+		summary := m.GetSummary()
+		quantiles := make(map[float64]float64, len(summary.GetQuantile()))
+		for _, quantile := range summary.GetQuantile() {
+			quantiles[quantile.GetQuantile()] = quantile.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, summary.GetSampleCount(), summary.GetSampleSum(), quantiles)
+	default:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue())
+	}
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// envoyStats is a /stats/prometheus page with one stat of each type
+const envoyStats = `# TYPE envoy_cluster_upstream_rq_total counter
+envoy_cluster_upstream_rq_total{envoy_cluster_name="api"} 42
+envoy_cluster_upstream_rq_total{envoy_cluster_name="auth"} 7
+# TYPE envoy_server_live gauge
+envoy_server_live{} 1
+# TYPE envoy_http_downstream_rq_time histogram
+envoy_http_downstream_rq_time_bucket{envoy_http_conn_manager_prefix="ingress_http",le="0.5"} 3
+envoy_http_downstream_rq_time_bucket{envoy_http_conn_manager_prefix="ingress_http",le="1"} 5
+envoy_http_downstream_rq_time_bucket{envoy_http_conn_manager_prefix="ingress_http",le="+Inf"} 6
+envoy_http_downstream_rq_time_sum{envoy_http_conn_manager_prefix="ingress_http"} 12.5
+envoy_http_downstream_rq_time_count{envoy_http_conn_manager_prefix="ingress_http"} 6
+envoy_cluster_membership_healthy{envoy_cluster_name="api",envoy_custom_tag="blue"} 2
+`
+
+// fakeAdmin serves Envoy's stats page, or fails with status when it is set
+type fakeAdmin struct {
+	mu     sync.Mutex
+	status int
+}
+
+func (f *fakeAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/stats/prometheus" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.status != 0 {
+		http.Error(w, "unavailable", f.status)
+		return
+	}
+	w.Write([]byte(envoyStats))
+}
+
+func newTestCollector(t *testing.T) (*Collector, *fakeAdmin) {
+	t.Helper()
+	admin := &fakeAdmin{}
+	server := httptest.NewServer(admin)
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	return NewCollector(strings.TrimPrefix(server.URL, "http://"), logger), admin
+}
+
+// gather collects the registry's families by name
+func gather(t *testing.T, c *Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := c.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+func labelMap(m *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range m.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestCollectorEnvoyStats(t *testing.T) {
+	c, _ := newTestCollector(t)
+	families := gather(t, c)
+
+	requests := families["marchproxy_alb_cluster_upstream_rq_total"]
+	if requests.GetType() != dto.MetricType_COUNTER || len(requests.GetMetric()) != 2 {
+		t.Fatalf("requests %v, want 2 counters", requests)
+	}
+	for _, m := range requests.GetMetric() {
+		want := map[string]float64{"api": 42, "auth": 7}[labelMap(m)["cluster"]]
+		if m.GetCounter().GetValue() != want {
+			t.Errorf("requests %v = %v, want %v", labelMap(m), m.GetCounter().GetValue(), want)
+		}
+	}
+	// Envoy's stats have no help text, so one is made up
+	if help := requests.GetHelp(); help != "Envoy stat envoy_cluster_upstream_rq_total" {
+		t.Errorf("help %q", help)
+	}
+
+	if live := families["marchproxy_alb_server_live"]; live.GetType() != dto.MetricType_GAUGE || live.GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Errorf("server live %v, want gauge 1", live)
+	}
+
+	rqTime := families["marchproxy_alb_http_downstream_rq_time"]
+	if rqTime.GetType() != dto.MetricType_HISTOGRAM {
+		t.Fatalf("request time %v, want a histogram", rqTime)
+	}
+	histogram := rqTime.GetMetric()[0].GetHistogram()
+	if histogram.GetSampleCount() != 6 || histogram.GetSampleSum() != 12.5 {
+		t.Errorf("request time count %d sum %v, want 6 and 12.5", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	buckets := histogram.GetBucket()
+	if len(buckets) != 3 || buckets[0].GetUpperBound() != 0.5 || buckets[0].GetCumulativeCount() != 3 || buckets[1].GetUpperBound() != 1 || buckets[1].GetCumulativeCount() != 5 || !math.IsInf(buckets[2].GetUpperBound(), 1) || buckets[2].GetCumulativeCount() != 6 {
+		t.Errorf("request time buckets %v, want le=0.5 3, le=1 5 and le=+Inf 6", buckets)
+	}
+	if labels := labelMap(rqTime.GetMetric()[0]); labels["http_conn_manager"] != "ingress_http" || len(labels) != 1 {
+		t.Errorf("request time labels %v", labels)
+	}
+
+	// Stats without a type are passed on untyped, other labels just lose
+	// their envoy_ prefix
+	healthy := families["marchproxy_alb_cluster_membership_healthy"]
+	if healthy.GetType() != dto.MetricType_UNTYPED || healthy.GetMetric()[0].GetUntyped().GetValue() != 2 {
+		t.Errorf("healthy members %v, want untyped 2", healthy)
+	}
+	if labels := labelMap(healthy.GetMetric()[0]); labels["cluster"] != "api" || labels["custom_tag"] != "blue" || len(labels) != 2 {
+		t.Errorf("healthy members labels %v", labels)
+	}
+
+	if up := families["marchproxy_alb_envoy_up"].GetMetric()[0].GetGauge().GetValue(); up != 1 {
+		t.Errorf("envoy up %v, want 1", up)
+	}
+	if count := families["marchproxy_alb_envoy_metric_families"].GetMetric()[0].GetGauge().GetValue(); count != 4 {
+		t.Errorf("metric families %v, want 4", count)
+	}
+	if scrapes := families["marchproxy_alb_envoy_scrape_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount(); scrapes != 1 {
+		t.Errorf("%d scrapes timed, want 1", scrapes)
+	}
+}
+
+func TestCollectorScrapeErrors(t *testing.T) {
+	c, admin := newTestCollector(t)
+	gather(t, c)
+
+	admin.mu.Lock()
+	admin.status = http.StatusServiceUnavailable
+	admin.mu.Unlock()
+	families := gather(t, c)
+
+	// A failed scrape reports Envoy down and drops its stats, in the same
+	// collection
+	if _, ok := families["marchproxy_alb_cluster_upstream_rq_total"]; ok {
+		t.Error("Envoy stats exposed after a failed scrape")
+	}
+	if up := families["marchproxy_alb_envoy_up"].GetMetric()[0].GetGauge().GetValue(); up != 0 {
+		t.Errorf("envoy up %v, want 0", up)
+	}
+	if errors := families["marchproxy_alb_envoy_scrape_errors_total"].GetMetric()[0].GetCounter().GetValue(); errors != 1 {
+		t.Errorf("scrape errors %v, want 1", errors)
+	}
+}
+
+func TestRegistryProcessMetrics(t *testing.T) {
+	c, _ := newTestCollector(t)
+	families := gather(t, c)
+
+	// The ALB's own Go and process metrics are exposed alongside Envoy's
+	for _, name := range []string{"go_goroutines", "process_cpu_seconds_total", "marchproxy_alb_envoy_up", "marchproxy_alb_envoy_scrape_errors_total"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("%s not registered", name)
+		}
+	}
+}
+
+func TestEnvoyNames(t *testing.T) {
+	for name, want := range map[string]string{
+		"envoy_cluster_upstream_rq_total": "marchproxy_alb_cluster_upstream_rq_total",
+		"server_live":                     "marchproxy_alb_server_live",
+	} {
+		if got := envoyMetricName(name); got != want {
+			t.Errorf("envoyMetricName(%s) = %s, want %s", name, got, want)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"envoy_cluster_name":             "cluster",
+		"envoy_listener_address":         "listener",
+		"envoy_http_conn_manager_prefix": "http_conn_manager",
+		"envoy_tcp_prefix":               "tcp_proxy",
+		"envoy_virtual_host":             "virtual_host",
+		"envoy_virtual_cluster":          "virtual_cluster",
+		"envoy_response_code":            "response_code",
+		"le":                             "le",
+	} {
+		if got := envoyLabelName(name); got != want {
+			t.Errorf("envoyLabelName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
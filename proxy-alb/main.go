@@ -6,15 +6,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 
 	"github.com/PenguinTech/MarchProxy/proxy-alb/internal/config"
 	"github.com/PenguinTech/MarchProxy/proxy-alb/internal/envoy"
 	"github.com/PenguinTech/MarchProxy/proxy-alb/internal/grpc"
 	"github.com/PenguinTech/MarchProxy/proxy-alb/internal/metrics"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/layers"
 )
 
 var (
@@ -24,6 +29,18 @@ var (
 )
 
 func main() {
+	configPath := pflag.String("config", os.Getenv("CONFIG_FILE"), "config file (default: environment only)")
+	layers.AddFlags(pflag.CommandLine)
+	output := pflag.StringP("output", "o", "yaml", "output format of config print-effective: yaml or json")
+	pflag.Parse()
+
+	if validate, _ := pflag.CommandLine.GetBool("validate-config"); validate {
+		os.Exit(checkConfig(*configPath))
+	}
+	if pflag.NArg() > 0 {
+		os.Exit(configCommand(*configPath, pflag.Args(), *output))
+	}
+
 	// Setup logger
 	logger := setupLogger()
 
@@ -34,7 +51,7 @@ func main() {
 	}).Info("Starting MarchProxy ALB")
 
 	// Load configuration
-	cfg, err := config.LoadConfig()
+	cfg, err := config.Load(*configPath, pflag.CommandLine)
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to load configuration")
 	}
@@ -65,11 +82,18 @@ func main() {
 		logger,
 	)
 
+	// Compare Envoy's config with the xDS snapshot and resync on drift
+	var reconciler *envoy.Reconciler
+	if cfg.DriftCheckInterval > 0 {
+		reconciler = envoy.NewReconciler(envoyManager, xdsClient, cfg.DriftResyncAfter, metricsCollector.Registry(), logger)
+	}
+
 	grpcServer := grpc.NewServer(
 		cfg,
 		envoyManager,
 		xdsClient,
 		metricsCollector,
+		reconciler,
 		logger,
 	)
 
@@ -85,11 +109,19 @@ func main() {
 		logger.WithError(err).Fatal("Failed to start gRPC server")
 	}
 
+	if reconciler != nil {
+		go reconciler.Run(ctx, cfg.DriftCheckInterval)
+		logger.WithFields(logrus.Fields{
+			"interval":     cfg.DriftCheckInterval,
+			"resync_after": cfg.DriftResyncAfter,
+		}).Info("Config drift checks started")
+	}
+
 	// Start health check endpoint
 	go startHealthCheckServer(cfg.HealthCheckPort, envoyManager, logger)
 
 	// Start metrics endpoint
-	go startMetricsServer(cfg.MetricsPort, metricsCollector, logger)
+	go startMetricsServer(cfg.MetricsPort, cfg.Admin, metricsCollector, logger)
 
 	logger.Info("ALB started successfully")
 
@@ -97,6 +129,35 @@ func main() {
 	waitForShutdown(ctx, cancel, cfg, envoyManager, grpcServer, logger)
 }
 
+// configCommand runs config print-effective, which prints the merged
+// configuration with secrets masked, and returns the exit status
+func configCommand(configPath string, args []string, format string) int {
+	if len(args) != 2 || args[0] != "config" || args[1] != "print-effective" {
+		fmt.Fprintf(os.Stderr, "unknown command %q, want config print-effective\n", strings.Join(args, " "))
+		return 2
+	}
+	cfg, err := config.Load(configPath, pflag.CommandLine)
+	if err == nil {
+		err = layers.PrintEffective(os.Stdout, cfg, format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// checkConfig loads the configuration for --validate-config and returns the
+// exit code
+func checkConfig(configPath string) int {
+	if _, err := config.Load(configPath, pflag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
 // setupLogger configures the logger
 func setupLogger() *logrus.Logger {
 	logger := logrus.New()
@@ -122,9 +183,12 @@ func setupLogger() *logrus.Logger {
 	return logger
 }
 
-// startHealthCheckServer starts HTTP health check endpoint
+// startHealthCheckServer starts HTTP health check endpoint. It stays plain
+// HTTP without authentication, for probes.
 func startHealthCheckServer(port int, envoyMgr *envoy.Manager, logger *logrus.Logger) {
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		if envoyMgr.IsRunning() {
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "OK")
@@ -134,7 +198,7 @@ func startHealthCheckServer(port int, envoyMgr *envoy.Manager, logger *logrus.Lo
 		}
 	})
 
-	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
 		if envoyMgr.IsRunning() && envoyMgr.Uptime() > 5*time.Second {
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "Ready")
@@ -147,55 +211,32 @@ func startHealthCheckServer(port int, envoyMgr *envoy.Manager, logger *logrus.Lo
 	addr := fmt.Sprintf(":%d", port)
 	logger.WithField("address", addr).Info("Starting health check server")
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := http.ListenAndServe(addr, mux); err != nil {
 		logger.WithError(err).Error("Health check server error")
 	}
 }
 
-// startMetricsServer starts Prometheus metrics endpoint
-func startMetricsServer(port int, collector *metrics.Collector, logger *logrus.Logger) {
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		m, err := collector.GetMetrics()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// startMetricsServer starts Prometheus metrics endpoint, serving Envoy's
+// stats and the ALB's own metrics from the collector's registry
+func startMetricsServer(port int, admin adminserver.Config, collector *metrics.Collector, logger *logrus.Logger) {
+	mux := http.NewServeMux()
 
-		// Write Prometheus format metrics
-		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-		fmt.Fprintf(w, "# HELP alb_total_connections Total number of connections\n")
-		fmt.Fprintf(w, "# TYPE alb_total_connections counter\n")
-		fmt.Fprintf(w, "alb_total_connections %d\n", m.TotalConnections)
-
-		fmt.Fprintf(w, "# HELP alb_active_connections Active connections\n")
-		fmt.Fprintf(w, "# TYPE alb_active_connections gauge\n")
-		fmt.Fprintf(w, "alb_active_connections %d\n", m.ActiveConnections)
-
-		fmt.Fprintf(w, "# HELP alb_total_requests Total number of requests\n")
-		fmt.Fprintf(w, "# TYPE alb_total_requests counter\n")
-		fmt.Fprintf(w, "alb_total_requests %d\n", m.TotalRequests)
-
-		fmt.Fprintf(w, "# HELP alb_requests_per_second Requests per second\n")
-		fmt.Fprintf(w, "# TYPE alb_requests_per_second gauge\n")
-		fmt.Fprintf(w, "alb_requests_per_second %d\n", m.RequestsPerSecond)
-
-		fmt.Fprintf(w, "# HELP alb_latency_ms Request latency in milliseconds\n")
-		fmt.Fprintf(w, "# TYPE alb_latency_ms summary\n")
-		fmt.Fprintf(w, "alb_latency_ms{quantile=\"0.5\"} %.2f\n", m.Latency.P50Ms)
-		fmt.Fprintf(w, "alb_latency_ms{quantile=\"0.9\"} %.2f\n", m.Latency.P90Ms)
-		fmt.Fprintf(w, "alb_latency_ms{quantile=\"0.95\"} %.2f\n", m.Latency.P95Ms)
-		fmt.Fprintf(w, "alb_latency_ms{quantile=\"0.99\"} %.2f\n", m.Latency.P99Ms)
-
-		// Status codes
-		for code, count := range m.StatusCodes {
-			fmt.Fprintf(w, "alb_responses_total{status=\"%s\"} %d\n", code, count)
-		}
-	})
+	mux.Handle("/metrics", promhttp.HandlerFor(collector.Registry(), promhttp.HandlerOpts{
+		ErrorLog:      logger,
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
 
-	addr := fmt.Sprintf(":%d", port)
+	addr := admin.Address(fmt.Sprintf(":%d", port))
 	logger.WithField("address", addr).Info("Starting metrics server")
+	if warning := adminserver.Warning(admin, addr); warning != "" {
+		logger.Warn(warning)
+	}
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	listener, err := adminserver.Listen(admin, fmt.Sprintf(":%d", port))
+	if err == nil {
+		err = http.Serve(listener, adminserver.Guard(admin, mux))
+	}
+	if err != nil {
 		logger.WithError(err).Error("Metrics server error")
 	}
 }
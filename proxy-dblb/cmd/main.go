@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -14,10 +15,17 @@ import (
 	"marchproxy-dblb/internal/handlers"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/dashgen"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/readiness"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -44,18 +52,114 @@ func main() {
 - gRPC-based module communication`,
 		Version: fmt.Sprintf("%s (built: %s, commit: %s)", version, buildTime, gitCommit),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runDBLB(configPath, logger)
+			if validate, _ := cmd.Flags().GetBool("validate-config"); validate {
+				os.Exit(checkConfig(configPath, cmd.Flags()))
+			}
+			return runDBLB(configPath, cmd.Flags(), logger)
 		},
 	}
 
 	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file path")
+	layers.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newConfigCmd(&configPath))
+	rootCmd.AddCommand(newMetricsCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		logger.WithError(err).Fatal("Failed to start DBLB")
 	}
 }
 
-func runDBLB(configPath string, logger *logrus.Logger) error {
+// newConfigCmd creates the config command. config print-effective prints
+// the configuration this binary would run with, given the same flags and
+// environment, with secrets masked.
+func newConfigCmd(configPath *string) *cobra.Command {
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print-effective",
+		Short: "Print the merged configuration with secrets masked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := config.Load(*configPath, cmd.Flags())
+			if err == nil {
+				err = layers.PrintEffective(os.Stdout, cfg, format)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", "yaml", "output format: yaml or json")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(printCmd)
+	return configCmd
+}
+
+// newMetricsCmd creates the metrics command. metrics export-dashboards
+// generates a Grafana dashboard and Prometheus rules from the metrics this
+// binary registers, adding those only a running DBLB exposes when --from
+// points at its metrics endpoint.
+func newMetricsCmd() *cobra.Command {
+	var outputDir, from string
+	exportCmd := &cobra.Command{
+		Use:   "export-dashboards",
+		Short: "Generate a Grafana dashboard and Prometheus rules from the registered metrics",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := exportDashboards(outputDir, from); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", ".", "directory to write the dashboard and rules to")
+	exportCmd.Flags().StringVar(&from, "from", "", "metrics endpoint of a running DBLB to read as well")
+
+	metricsCmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Inspect the registered metrics",
+	}
+	metricsCmd.AddCommand(exportCmd)
+	return metricsCmd
+}
+
+// exportDashboards writes the dashboard and rules generated from the
+// registered metrics, merged with those scraped from a running DBLB
+func exportDashboards(outputDir, from string) error {
+	metrics, err := dashgen.FromDefaultRegistry()
+	if err != nil {
+		return err
+	}
+	if from != "" {
+		scraped, err := dashgen.Scrape(from)
+		if err != nil {
+			return err
+		}
+		metrics = dashgen.Merge(scraped, metrics)
+	}
+	files, err := dashgen.Write(outputDir, "dblb", metrics)
+	for _, file := range files {
+		fmt.Printf("Wrote %s\n", file)
+	}
+	return err
+}
+
+// checkConfig loads the configuration for --validate-config and returns
+// the exit status, printing every problem found
+func checkConfig(configPath string, flags *pflag.FlagSet) int {
+	if _, err := config.Load(configPath, flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+func runDBLB(configPath string, flags *pflag.FlagSet, logger *logrus.Logger) error {
 	logger.WithFields(logrus.Fields{
 		"version":    version,
 		"build_time": buildTime,
@@ -63,14 +167,24 @@ func runDBLB(configPath string, logger *logrus.Logger) error {
 	}).Info("Starting MarchProxy Database Load Balancer")
 
 	// Load configuration
-	cfg, err := config.Load(configPath)
+	cfg, err := config.Load(configPath, flags)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	// /readyz stays unavailable until the config is loaded and every
+	// listener is bound
+	ready := readiness.New(readiness.StepConfig, readiness.StepListeners)
+	ready.Done(readiness.StepConfig)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Gate enterprise features on the cluster's entitlements
+	license := cfg.NewLicenseGate(logger)
+	license.Refresh(ctx)
+	go license.Run(ctx)
+
 	// Initialize security checker
 	securityChecker := security.NewChecker(logger)
 	logger.Info("Security checker initialized")
@@ -79,6 +193,16 @@ func runDBLB(configPath string, logger *logrus.Logger) error {
 	connectionPool := pool.NewPool(cfg.MaxConnectionsPerRoute, logger)
 	logger.Info("Connection pool initialized")
 
+	// Backends drained for maintenance take no new connections while their
+	// open ones finish, drained by the manager or the admin API
+	drains := drain.NewSet("dblb")
+	prometheus.MustRegister(drains.Collector(nil))
+	if fetch := cfg.NewDrainFetcher(); fetch != nil {
+		go drains.Poll(ctx, cfg.DrainPollInterval, fetch, func(err error) {
+			logger.WithError(err).Warn("Failed to fetch backend drains")
+		})
+	}
+
 	// Initialize database handlers
 	handlerManager := handlers.NewManager(connectionPool, securityChecker, cfg, logger)
 
@@ -103,6 +227,23 @@ func runDBLB(configPath string, logger *logrus.Logger) error {
 		logger.WithError(err).Warn("Failed to register MSSQL handler")
 	}
 
+	// Kafka routes get a handler each, proxying the route's cluster
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if route.Protocol != "kafka" {
+			continue
+		}
+		kafkaHandler, err := handlers.NewKafkaHandler(cfg, route, logger)
+		if err != nil {
+			logger.WithError(err).Warnf("Failed to create Kafka handler for route %s", route.Name)
+			continue
+		}
+		kafkaHandler.SetDrains(drains)
+		if err := handlerManager.AddHandler("kafka:"+route.Name, kafkaHandler); err != nil {
+			logger.WithError(err).Warnf("Failed to register Kafka handler for route %s", route.Name)
+		}
+	}
+
 	logger.Info("Database handlers registered")
 
 	// Start all handlers
@@ -113,6 +254,13 @@ func runDBLB(configPath string, logger *logrus.Logger) error {
 	// Initialize gRPC server with ModuleService
 	moduleService := grpc.NewModuleService(handlerManager, logger)
 	grpcServer := grpc.NewServer(cfg.GRPCAddr, cfg.GRPCPort, moduleService, logger)
+	grpcServer.SetBindInterface(cfg.BindInterface)
+	if cfg.GRPCSocket != "" {
+		grpcServer.SetSocket(cfg.GRPCSocket, cfg.SocketFileMode())
+	}
+	if err := grpcServer.Listen(); err != nil {
+		return fmt.Errorf("failed to start gRPC server: %w", err)
+	}
 
 	// Start gRPC server in goroutine
 	go func() {
@@ -122,10 +270,15 @@ func runDBLB(configPath string, logger *logrus.Logger) error {
 	}()
 
 	logger.WithFields(logrus.Fields{
-		"address": cfg.GRPCAddr,
-		"port":    cfg.GRPCPort,
+		"address":   cfg.GRPCAddr,
+		"port":      cfg.GRPCPort,
+		"socket":    cfg.GRPCSocket,
+		"interface": cfg.BindInterface,
 	}).Info("gRPC ModuleService server started")
 
+	// The handlers and the gRPC server are listening
+	ready.Done(readiness.StepListeners)
+
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -138,25 +291,40 @@ func runDBLB(configPath string, logger *logrus.Logger) error {
 		w.Write([]byte("OK"))
 	})
 
+	// Readiness for rollouts, once the handlers are listening
+	metricsMux.Handle("/readyz", ready)
+
 	metricsMux.Handle("/metrics", promhttp.Handler())
 
+	// Backends drained for maintenance and the connections still open
+	metricsMux.HandleFunc("/admin/backends/drain", drains.Handler(nil))
+
 	metricsMux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		stats := handlerManager.GetStats()
 		poolStats := connectionPool.GetStats()
+		licenseStatus, _ := json.Marshal(license.Status())
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"version":"%s","handlers":%v,"pool":%v}`, version, stats, poolStats)
+		fmt.Fprintf(w, `{"version":"%s","handlers":%v,"pool":%v,"license":%s}`, version, stats, poolStats, licenseStatus)
 	})
 
 	metricsServer := &http.Server{
-		Addr:    cfg.MetricsAddr,
-		Handler: metricsMux,
+		Handler: adminserver.Guard(cfg.Admin, metricsMux),
 	}
 
+	metricsAddr := cfg.Admin.Address(cfg.MetricsAddr)
+	if warning := adminserver.Warning(cfg.Admin, metricsAddr); warning != "" {
+		logger.Warn(warning)
+	}
 	go func() {
-		logger.WithField("addr", cfg.MetricsAddr).Info("Starting metrics/health server")
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithField("addr", metricsAddr).Info("Starting metrics/health server")
+		listener, err := adminserver.Listen(cfg.Admin, cfg.MetricsAddr)
+		if err != nil {
+			logger.WithError(err).Error("Metrics server error")
+			return
+		}
+		if err := metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 			logger.WithError(err).Error("Metrics server error")
 		}
 	}()
@@ -1,11 +1,22 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"time"
 
-	"github.com/spf13/viper"
+	"marchproxy-dblb/internal/bufpool"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/licensing"
+	"marchproxy-shared/netutil"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
 // Config holds the DBLB configuration
@@ -15,11 +26,26 @@ type Config struct {
 	GRPCPort    int    `mapstructure:"grpc_port"`
 	MetricsAddr string `mapstructure:"metrics_addr"`
 
+	// Metrics server authentication, TLS and binding
+	Admin adminserver.Config `mapstructure:"admin"`
+
+	// Unix sockets in place of TCP listeners, for sidecars
+	SocketDir  string `mapstructure:"socket_dir"`  // Protocol handlers listen on <socket_dir>/<protocol>.sock
+	GRPCSocket string `mapstructure:"grpc_socket"` // gRPC server socket path
+	SocketMode string `mapstructure:"socket_mode"` // Octal permissions, 0660 when empty
+
+	// Listener binding (applies to database routes and the gRPC server)
+	BindAddress   string `mapstructure:"bind_address"`   // IP to bind route listeners to, empty = all
+	BindInterface string `mapstructure:"bind_interface"` // Interface or VRF device (Linux only)
+
 	// Manager connection
 	ManagerURL      string `mapstructure:"manager_url"`
 	ClusterAPIKey   string `mapstructure:"cluster_api_key"`
 	RegistrationURL string `mapstructure:"registration_url"`
 
+	// Backend drains from the manager are fetched this often, 0 ignores them
+	DrainPollInterval time.Duration `mapstructure:"drain_poll_interval"`
+
 	// Database routing
 	Routes []RouteConfig `mapstructure:"routes"`
 
@@ -27,6 +53,7 @@ type Config struct {
 	MaxConnectionsPerRoute int           `mapstructure:"max_connections_per_route"`
 	ConnectionIdleTimeout  time.Duration `mapstructure:"connection_idle_timeout"`
 	ConnectionMaxLifetime  time.Duration `mapstructure:"connection_max_lifetime"`
+	BufferSize             int           `mapstructure:"buffer_size"` // Relay buffer bytes per direction
 
 	// Rate limiting
 	EnableRateLimiting    bool    `mapstructure:"enable_rate_limiting"`
@@ -47,12 +74,17 @@ type Config struct {
 	LicenseKey    string `mapstructure:"license_key"`
 	LicenseServer string `mapstructure:"license_server"`
 	ReleaseMode   bool   `mapstructure:"release_mode"`
+
+	// Enterprise feature entitlements fetched from the manager in release mode
+	LicenseRefreshInterval time.Duration `mapstructure:"license_refresh_interval"`
+	LicenseGracePeriod     time.Duration `mapstructure:"license_grace_period"` // cached entitlements outlive an unreachable manager this long
+	LicenseCacheFile       string        `mapstructure:"license_cache_file"`   // keep entitlements here across restarts
 }
 
 // RouteConfig defines a database route configuration
 type RouteConfig struct {
 	Name            string  `mapstructure:"name"`
-	Protocol        string  `mapstructure:"protocol"` // mysql, postgresql, mongodb, redis, mssql
+	Protocol        string  `mapstructure:"protocol"` // mysql, postgresql, mongodb, redis, mssql, kafka
 	ListenPort      int     `mapstructure:"listen_port"`
 	BackendHost     string  `mapstructure:"backend_host"`
 	BackendPort     int     `mapstructure:"backend_port"`
@@ -64,55 +96,82 @@ type RouteConfig struct {
 	Password        string  `mapstructure:"password"`
 	EnableSSL       bool    `mapstructure:"enable_ssl"`
 	HealthCheckSQL  string  `mapstructure:"health_check_sql"`
+	BindAddress     string  `mapstructure:"bind_address"`   // Overrides the global bind_address
+	BindInterface   string  `mapstructure:"bind_interface"` // Overrides the global bind_interface
+
+	Kafka KafkaConfig `mapstructure:"kafka"` // kafka routes only
+}
+
+// KafkaConfig configures a kafka route. Clients bootstrap through the
+// route's listen_port and reach each broker through a listener of its own,
+// which Metadata and FindCoordinator responses advertise instead of the
+// broker's address.
+type KafkaConfig struct {
+	AdvertisedHost  string     `mapstructure:"advertised_host"`   // Host clients reach the DBLB at, the bind address or host name when empty
+	BrokerPortStart int        `mapstructure:"broker_port_start"` // First broker listener port, listen_port+1 when 0
+	MaxBrokers      int        `mapstructure:"max_brokers"`       // Broker listeners to allow for, 16 when 0
+	ACLs            []KafkaACL `mapstructure:"acls"`              // Produce and fetch are allowed for any topic when empty
 }
 
-// Load loads configuration from file and environment variables
-func Load(configPath string) (*Config, error) {
+// KafkaACL allows clients to produce to or consume from topics
+type KafkaACL struct {
+	Sources    []string `mapstructure:"sources"`    // Client CIDRs or addresses, any client when empty
+	Topics     []string `mapstructure:"topics"`     // Topic names, "prefix*" or "*"
+	Operations []string `mapstructure:"operations"` // produce, consume
+}
+
+// Load loads configuration from defaults, the config file at configPath,
+// MARCHPROXY_DBLB_* environment variables and the --set flags, each
+// overriding the one before
+func Load(configPath string, flags *pflag.FlagSet) (*Config, error) {
+	l := layers.New("MARCHPROXY_DBLB")
+	v := l.Viper()
+
 	// Set defaults
-	viper.SetDefault("grpc_addr", "0.0.0.0")
-	viper.SetDefault("grpc_port", 50052)
-	viper.SetDefault("metrics_addr", ":7002")
-	viper.SetDefault("manager_url", "http://api-server:8000")
+	v.SetDefault("grpc_addr", "0.0.0.0")
+	v.SetDefault("grpc_port", 50052)
+	v.SetDefault("metrics_addr", ":7002")
+	v.SetDefault("bind_address", "")
+	v.SetDefault("bind_interface", "")
+	v.SetDefault("manager_url", "http://api-server:8000")
+	v.SetDefault("drain_poll_interval", 10*time.Second)
 
 	// Connection pooling defaults
-	viper.SetDefault("max_connections_per_route", 100)
-	viper.SetDefault("connection_idle_timeout", 5*time.Minute)
-	viper.SetDefault("connection_max_lifetime", 30*time.Minute)
+	v.SetDefault("max_connections_per_route", 100)
+	v.SetDefault("connection_idle_timeout", 5*time.Minute)
+	v.SetDefault("connection_max_lifetime", 30*time.Minute)
+	v.SetDefault("buffer_size", 32*1024)
 
 	// Rate limiting defaults
-	viper.SetDefault("enable_rate_limiting", true)
-	viper.SetDefault("default_connection_rate", 100.0) // 100 connections per second
-	viper.SetDefault("default_query_rate", 1000.0)     // 1000 queries per second
+	v.SetDefault("enable_rate_limiting", true)
+	v.SetDefault("default_connection_rate", 100.0) // 100 connections per second
+	v.SetDefault("default_query_rate", 1000.0)     // 1000 queries per second
 
 	// Security defaults
-	viper.SetDefault("enable_sql_injection_detection", true)
-	viper.SetDefault("block_suspicious_queries", true)
+	v.SetDefault("enable_sql_injection_detection", true)
+	v.SetDefault("block_suspicious_queries", true)
 
 	// Observability defaults
-	viper.SetDefault("enable_tracing", false)
-	viper.SetDefault("trace_sample_rate", 0.1)
-	viper.SetDefault("metrics_namespace", "marchproxy_dblb")
+	v.SetDefault("enable_tracing", false)
+	v.SetDefault("trace_sample_rate", 0.1)
+	v.SetDefault("metrics_namespace", "marchproxy_dblb")
 
 	// Licensing defaults
-	viper.SetDefault("license_server", "https://license.penguintech.io")
-	viper.SetDefault("release_mode", false)
-
-	// Load config file if provided
-	if configPath != "" {
-		viper.SetConfigFile(configPath)
-		if err := viper.ReadInConfig(); err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
-		}
-	}
+	v.SetDefault("license_server", "https://license.penguintech.io")
+	v.SetDefault("release_mode", false)
+	v.SetDefault("license_refresh_interval", licensing.DefaultRefresh)
+	v.SetDefault("license_grace_period", licensing.DefaultGrace)
 
-	// Environment variables take precedence
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("MARCHPROXY_DBLB")
+	if err := l.ReadFile(configPath); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := l.ApplySet(flags); err != nil {
+		return nil, err
+	}
 
-	// Unmarshal config
 	var cfg Config
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	if err := l.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	// Override from environment if set
@@ -134,6 +193,22 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid grpc_port: must be 1-65535")
 	}
 
+	if err := netutil.ValidateBindAddress(c.BindAddress); err != nil {
+		return err
+	}
+
+	if err := netutil.ValidateInterface(c.BindInterface); err != nil {
+		return err
+	}
+
+	if _, err := netutil.ParseSocketMode(c.SocketMode); err != nil {
+		return fmt.Errorf("invalid socket_mode: %w", err)
+	}
+
+	if c.DrainPollInterval < 0 {
+		return fmt.Errorf("drain_poll_interval must be >= 0")
+	}
+
 	if c.MaxConnectionsPerRoute <= 0 {
 		return fmt.Errorf("max_connections_per_route must be > 0")
 	}
@@ -146,6 +221,10 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("connection_max_lifetime must be > 0")
 	}
 
+	if err := bufpool.ValidateSize("buffer_size", c.BufferSize); err != nil {
+		return err
+	}
+
 	if c.EnableRateLimiting {
 		if c.DefaultConnectionRate <= 0 {
 			return fmt.Errorf("default_connection_rate must be > 0")
@@ -156,12 +235,17 @@ func (c *Config) Validate() error {
 	}
 
 	// Validate routes
-	for i, route := range c.Routes {
+	for i := range c.Routes {
+		route := &c.Routes[i]
 		if err := route.Validate(); err != nil {
 			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
 		}
 	}
 
+	if err := c.Admin.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -177,16 +261,25 @@ func (r *RouteConfig) Validate() error {
 		"mongodb":    true,
 		"redis":      true,
 		"mssql":      true,
+		"kafka":      true,
 	}
 
 	if !validProtocols[r.Protocol] {
-		return fmt.Errorf("invalid protocol: %s (must be one of: mysql, postgresql, mongodb, redis, mssql)", r.Protocol)
+		return fmt.Errorf("invalid protocol: %s (must be one of: mysql, postgresql, mongodb, redis, mssql, kafka)", r.Protocol)
 	}
 
 	if r.ListenPort <= 0 || r.ListenPort > 65535 {
 		return fmt.Errorf("invalid listen_port: must be 1-65535")
 	}
 
+	if err := netutil.ValidateBindAddress(r.BindAddress); err != nil {
+		return err
+	}
+
+	if err := netutil.ValidateInterface(r.BindInterface); err != nil {
+		return err
+	}
+
 	if r.BackendHost == "" {
 		return fmt.Errorf("backend_host is required")
 	}
@@ -207,16 +300,115 @@ func (r *RouteConfig) Validate() error {
 		r.QueryRate = 1000.0 // default
 	}
 
+	if r.Protocol == "kafka" {
+		if err := r.Kafka.validate(r.ListenPort); err != nil {
+			return fmt.Errorf("kafka: %w", err)
+		}
+	}
+
 	return nil
 }
 
-// IsEnterpriseFeatureEnabled checks if an enterprise feature is enabled
-func (c *Config) IsEnterpriseFeatureEnabled(feature string) bool {
-	// In release mode, check license
-	if c.ReleaseMode {
-		// TODO: Validate with license server
-		return c.LicenseKey != ""
+// validate checks a kafka route's settings and fills in the defaults
+func (k *KafkaConfig) validate(listenPort int) error {
+	if k.BrokerPortStart == 0 {
+		k.BrokerPortStart = listenPort + 1
+	}
+	if k.MaxBrokers <= 0 {
+		k.MaxBrokers = 16
+	}
+	if k.BrokerPortStart <= 0 || k.BrokerPortStart+k.MaxBrokers-1 > 65535 {
+		return fmt.Errorf("broker ports %d-%d must be within 1-65535", k.BrokerPortStart, k.BrokerPortStart+k.MaxBrokers-1)
+	}
+	if listenPort >= k.BrokerPortStart && listenPort < k.BrokerPortStart+k.MaxBrokers {
+		return fmt.Errorf("broker ports %d-%d overlap listen_port", k.BrokerPortStart, k.BrokerPortStart+k.MaxBrokers-1)
+	}
+
+	for i, acl := range k.ACLs {
+		if len(acl.Topics) == 0 {
+			return fmt.Errorf("acl %d: topics are required", i)
+		}
+		if len(acl.Operations) == 0 {
+			return fmt.Errorf("acl %d: operations are required", i)
+		}
+		for _, op := range acl.Operations {
+			if op != "produce" && op != "consume" {
+				return fmt.Errorf("acl %d: invalid operation %q (must be produce or consume)", i, op)
+			}
+		}
+		for _, source := range acl.Sources {
+			if _, err := netip.ParsePrefix(source); err != nil {
+				if _, err := netip.ParseAddr(source); err != nil {
+					return fmt.Errorf("acl %d: invalid source %q", i, source)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ListenAddress returns the listen address for a port on the global bind address
+func (c *Config) ListenAddress(port int) string {
+	return netutil.JoinHostPort(c.BindAddress, port)
+}
+
+// ProtocolListenAddress returns the listen address of a protocol handler,
+// unix:<socket_dir>/<protocol>.sock when socket_dir is set
+func (c *Config) ProtocolListenAddress(protocol string, port int) string {
+	if c.SocketDir != "" {
+		return netutil.UnixPrefix + filepath.Join(c.SocketDir, protocol+".sock")
+	}
+	return c.ListenAddress(port)
+}
+
+// SocketFileMode returns the permissions of unix sockets
+func (c *Config) SocketFileMode() os.FileMode {
+	mode, err := netutil.ParseSocketMode(c.SocketMode)
+	if err != nil {
+		return netutil.DefaultSocketMode
+	}
+	return mode
+}
+
+// RouteListenAddress returns the listen address for a route, honouring per-route overrides
+func (c *Config) RouteListenAddress(r *RouteConfig) string {
+	if r.BindAddress != "" {
+		return netutil.JoinHostPort(r.BindAddress, r.ListenPort)
+	}
+	return c.ListenAddress(r.ListenPort)
+}
+
+// RouteBindInterface returns the interface a route's listener binds to
+func (c *Config) RouteBindInterface(r *RouteConfig) string {
+	if r.BindInterface != "" {
+		return r.BindInterface
+	}
+	return c.BindInterface
+}
+
+// NewDrainFetcher returns a function fetching the backends the manager
+// drains across the cluster. It returns nil without a cluster API key or
+// when drain polling is disabled.
+func (c *Config) NewDrainFetcher() func(ctx context.Context) ([]drain.Backend, error) {
+	if c.ClusterAPIKey == "" || c.DrainPollInterval <= 0 {
+		return nil
+	}
+	proxyName, _ := os.Hostname()
+	return drain.ManagerFetcher(c.ManagerURL, c.ClusterAPIKey, proxyName)
+}
+
+// NewLicenseGate creates the gate for enterprise features. In release mode
+// it follows the entitlements the manager reports for the cluster; in
+// development mode all features are available.
+func (c *Config) NewLicenseGate(logger logrus.FieldLogger) *licensing.Gate {
+	if !c.ReleaseMode {
+		return licensing.Unrestricted()
 	}
-	// In development mode, all features available
-	return true
+	proxyName, _ := os.Hostname()
+	return licensing.New(licensing.ManagerFetcher(c.ManagerURL, c.ClusterAPIKey, proxyName), licensing.Options{
+		Refresh:   c.LicenseRefreshInterval,
+		Grace:     c.LicenseGracePeriod,
+		CacheFile: c.LicenseCacheFile,
+		Logger:    logger,
+	})
 }
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"marchproxy-shared/layers"
+
+	"github.com/spf13/pflag"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dblb.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "grpc_port: 50060\nmetrics_addr: :9000\nconnection_idle_timeout: 1m\n")
+	t.Setenv("MARCHPROXY_DBLB_GRPC_PORT", "50070")
+	t.Setenv("MARCHPROXY_DBLB_METRICS_ADDR", ":9100")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	layers.AddFlags(flags)
+	flags.Set("set", "metrics_addr=:9200")
+
+	cfg, err := Load(path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxConnectionsPerRoute != 100 {
+		t.Errorf("max_connections_per_route %d, want the default", cfg.MaxConnectionsPerRoute)
+	}
+	if cfg.ConnectionIdleTimeout != time.Minute {
+		t.Errorf("connection_idle_timeout %s, want the file's", cfg.ConnectionIdleTimeout)
+	}
+	if cfg.GRPCPort != 50070 {
+		t.Errorf("grpc_port %d, want the environment's", cfg.GRPCPort)
+	}
+	if cfg.MetricsAddr != ":9200" {
+		t.Errorf("metrics_addr %q, want --set's", cfg.MetricsAddr)
+	}
+}
+
+func TestLoadProblems(t *testing.T) {
+	path := writeConfig(t, `
+routes:
+  - name: orders
+    protocol: postgresql
+    listen_port: 15432
+    backend_host: db
+    backend_port: 5432
+    kafka:
+      max_broker: 4
+`)
+	t.Setenv("MARCHPROXY_DBLB_BUFFER_SIZE", "32k")
+
+	_, err := Load(path, nil)
+	var problems layers.Problems
+	if !errors.As(err, &problems) {
+		t.Fatalf("error %v, want Problems", err)
+	}
+	want := layers.Problems{
+		{Key: "buffer_size", Source: "MARCHPROXY_DBLB_BUFFER_SIZE", Reason: `want an integer, got "32k"`},
+		{Key: "routes[0].kafka.max_broker", Source: path, Reason: `unknown setting, did you mean "routes[0].kafka.max_brokers"?`},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems:\n%v", problems)
+	}
+	for i := range want {
+		if problems[i] != want[i] {
+			t.Errorf("problem %d: %+v, want %+v", i, problems[i], want[i])
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	if _, err := Load("../../config.example.yaml", nil); err != nil {
+		t.Errorf("config.example.yaml: %v", err)
+	}
+}
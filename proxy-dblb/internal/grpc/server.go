@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
+	"marchproxy-shared/netutil"
+
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -30,6 +33,9 @@ type ModuleService interface {
 type Server struct {
 	address      string
 	port         int
+	bindIface    string
+	socketPath   string
+	socketMode   os.FileMode
 	grpcServer   *grpc.Server
 	healthServer *health.Server
 	service      ModuleService
@@ -49,6 +55,48 @@ func NewServer(address string, port int, service ModuleService, logger *logrus.L
 	}
 }
 
+// SetBindInterface binds the server socket to a network interface or VRF
+// device. Must be called before Start.
+func (s *Server) SetBindInterface(iface string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bindIface = iface
+}
+
+// SetSocket serves on the unix socket at path with file permissions mode
+// instead of TCP. Must be called before Start.
+func (s *Server) SetSocket(path string, mode os.FileMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.socketPath = path
+	s.socketMode = mode
+}
+
+// Listen opens the server socket ahead of Start, so that it is open once
+// Listen returns. Start opens it when Listen wasn't called.
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listen()
+}
+
+// listen opens the server socket unless it is open. Must hold mu.
+func (s *Server) listen() error {
+	if s.listener != nil {
+		return nil
+	}
+	addr := netutil.JoinHostPort(s.address, s.port)
+	if s.socketPath != "" {
+		addr = netutil.UnixPrefix + s.socketPath
+	}
+	listener, err := netutil.ListenStream(addr, s.bindIface, s.socketMode)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s.listener = listener
+	return nil
+}
+
 // Start starts the gRPC server
 func (s *Server) Start() error {
 	s.mu.Lock()
@@ -57,14 +105,12 @@ func (s *Server) Start() error {
 		return fmt.Errorf("server already running")
 	}
 
-	addr := fmt.Sprintf("%s:%d", s.address, s.port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
+	if err := s.listen(); err != nil {
 		s.mu.Unlock()
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return err
 	}
-
-	s.listener = listener
+	addr := s.listener.Addr().String()
+	listener := s.listener
 
 	// Configure keepalive parameters
 	kaParams := keepalive.ServerParameters{
@@ -154,6 +200,7 @@ func (s *Server) Stop() error {
 
 	if s.listener != nil {
 		s.listener.Close()
+		s.listener = nil
 	}
 
 	s.running = false
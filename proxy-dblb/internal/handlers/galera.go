@@ -11,10 +11,13 @@ import (
 	"sync"
 	"time"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
 	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/licensing"
+	"marchproxy-shared/netutil"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
@@ -142,6 +145,9 @@ type GaleraHandler struct {
 
 	// Backend configuration
 	backends []*GaleraBackend
+
+	// Enterprise entitlements, Galera balancing needs FeatureGalera
+	license *licensing.Gate
 }
 
 // GaleraConfig contains Galera-specific configuration
@@ -155,6 +161,7 @@ type GaleraConfig struct {
 	ConnectionTimeout    time.Duration
 	QueryTimeout         time.Duration
 	Backends             []*GaleraBackend
+	License              *licensing.Gate // The handler only starts when the license includes Galera
 }
 
 // NewGaleraHandler creates a new Galera cluster handler
@@ -193,6 +200,7 @@ func NewGaleraHandler(protocol string, port int, galeraConfig *GaleraConfig,
 		nodeWeightEnabled:    galeraConfig.NodeWeightEnabled,
 		stopHealthCheck:      make(chan bool),
 		backends:             galeraConfig.Backends,
+		license:              galeraConfig.License,
 	}
 
 	return handler
@@ -207,6 +215,10 @@ func (h *GaleraHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("handler already running")
 	}
 
+	if !h.license.Require(licensing.FeatureGalera, "Galera cluster load balancing") {
+		return fmt.Errorf("galera handler requires an enterprise license")
+	}
+
 	// Initialize connection pools
 	if err := h.initPools(); err != nil {
 		return fmt.Errorf("failed to initialize pools: %w", err)
@@ -217,11 +229,12 @@ func (h *GaleraHandler) Start(ctx context.Context) error {
 	h.startHealthChecks(h.ctx)
 
 	// Start listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.port))
+	addr := h.config.ListenAddress(h.port)
+	listener, err := netutil.Listen("tcp", addr, h.config.BindInterface)
 	if err != nil {
 		h.stopHealthChecks()
 		h.closePools()
-		return fmt.Errorf("failed to listen on port %d: %w", h.port, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -618,6 +631,7 @@ func (h *GaleraHandler) acceptConnections() {
 			// Apply rate limiting
 			if !h.connLimiter.Allow() {
 				h.logger.Warn("Connection rate limit exceeded")
+				metrics.ConnectionRejected(h.protocol)
 				conn.Close()
 				continue
 			}
@@ -639,10 +653,21 @@ func (h *GaleraHandler) handleConnection(clientConn net.Conn) {
 	metrics.IncConnection("galera")
 	defer metrics.DecConnection("galera")
 
+	session := metrics.StartSession(h.protocol, "")
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Perform MySQL handshake
 	username, database, err := h.performHandshake(clientConn)
 	if err != nil {
 		h.logger.WithError(err).Error("Handshake failed")
+		session.Fail("handshake")
 		return
 	}
 
@@ -657,14 +682,17 @@ func (h *GaleraHandler) handleConnection(clientConn net.Conn) {
 	if backend == nil {
 		h.logger.Error("No healthy Galera node available")
 		h.sendError(clientConn, "No healthy Galera node available")
+		session.Fail("no_backend")
 		return
 	}
+	session.SetBackend(fmt.Sprintf("%s:%d", backend.Host, backend.Port))
 
 	// Get backend connection
 	backendConn, err := h.getBackendConnection(backend)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to connect to Galera backend")
 		h.sendError(clientConn, "Backend connection failed")
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer backendConn.Close()
@@ -817,34 +845,9 @@ func (h *GaleraHandler) performHandshake(conn net.Conn) (string, string, error)
 		return "", "", fmt.Errorf("failed to read handshake response: %w", err)
 	}
 
-	if n < 36 {
-		return "", "", fmt.Errorf("invalid handshake packet: too short")
-	}
-
-	// Parse username and database from handshake response
-	username := ""
-	database := ""
-
-	// Skip packet header (4 bytes) + capability flags (4 bytes) + max packet (4 bytes) + charset (1 byte) + filler (23 bytes)
-	pos := 36
-	for pos < n && buf[pos] != 0 {
-		username += string(buf[pos])
-		pos++
-	}
-	pos++ // Skip null terminator
-
-	// Skip auth response length and data
-	if pos < n {
-		authLen := int(buf[pos])
-		pos += 1 + authLen
-	}
-
-	// Parse database name if present
-	if pos < n {
-		for pos < n && buf[pos] != 0 {
-			database += string(buf[pos])
-			pos++
-		}
+	username, database, err := parseMySQLHandshakeResponse(buf[:n])
+	if err != nil {
+		return "", "", err
 	}
 
 	// Send OK packet
@@ -914,7 +917,8 @@ func (h *GaleraHandler) proxyTraffic(ctx context.Context, client net.Conn,
 	// Client to backend
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, 32*1024)
+		buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+		defer release()
 		for {
 			select {
 			case <-ctx.Done():
@@ -939,6 +943,7 @@ func (h *GaleraHandler) proxyTraffic(ctx context.Context, client net.Conn,
 					if !h.queryLimiter.Allow() {
 						h.logger.Warn("Query rate limit exceeded")
 						h.sendError(client, "Query rate limit exceeded")
+						metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 						return
 					}
 
@@ -952,6 +957,7 @@ func (h *GaleraHandler) proxyTraffic(ctx context.Context, client net.Conn,
 							}).Warn("Suspicious query blocked")
 							metrics.IncSQLInjection("galera")
 							h.sendError(client, "Query blocked by security policy")
+							metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 							return
 						}
 					}
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"marchproxy-dblb/internal/config"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/licensing"
 
 	"github.com/sirupsen/logrus"
 )
@@ -323,3 +326,33 @@ func TestGaleraHandlerLifecycle(t *testing.T) {
 		t.Error("Handler should not be running")
 	}
 }
+
+// TestGaleraHandlerRequiresLicense verifies the handler refuses to start
+// without the Galera entitlement
+func TestGaleraHandlerRequiresLicense(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	cfg := &config.Config{
+		MaxConnectionsPerRoute: 100,
+		DefaultConnectionRate:  100.0,
+		DefaultQueryRate:       1000.0,
+	}
+
+	secChecker := security.NewChecker(logger)
+
+	// A gate that never reached the manager enables nothing
+	license := licensing.New(func(ctx context.Context) (licensing.Entitlements, error) {
+		return licensing.Entitlements{}, errors.New("manager unreachable")
+	}, licensing.Options{Logger: logger})
+	license.Refresh(context.Background())
+
+	handler := NewGaleraHandler("galera", 33061, &GaleraConfig{License: license}, secChecker, cfg, logger)
+	if err := handler.Start(context.Background()); err == nil {
+		handler.Stop()
+		t.Fatal("Expected Start to fail without the galera entitlement")
+	}
+	if handler.GetStats()["running"].(bool) {
+		t.Error("Handler should not be running")
+	}
+}
@@ -0,0 +1,539 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-dblb/internal/config"
+	"marchproxy-dblb/internal/metrics"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/netutil"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// KafkaHandler proxies a Kafka cluster. Clients bootstrap through the
+// route's listen port; the broker addresses in Metadata and FindCoordinator
+// responses are replaced with listeners of the handler, one per broker, so
+// clients never connect to a broker directly. Produce and Fetch requests are
+// checked against the route's topic ACLs. Brokers drained for maintenance
+// take no new connections.
+type KafkaHandler struct {
+	cfg         *config.Config
+	route       *config.RouteConfig
+	logger      *logrus.Logger
+	acls        []kafkaACL
+	advertised  string
+	connLimiter *rate.Limiter
+	drains      *drain.Set // nil when nothing is drained
+
+	mu        sync.RWMutex
+	brokers   map[int32]*kafkaBroker
+	listeners []net.Listener
+	running   bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	activeConns int64
+	totalConns  int64
+	requests    uint64
+	denied      uint64
+	rewrites    uint64
+}
+
+// kafkaBroker is a broker the handler listens for
+type kafkaBroker struct {
+	nodeID  int32
+	address string // The broker's own address
+	port    int    // The handler's listener for it
+}
+
+// kafkaACL is a parsed config.KafkaACL
+type kafkaACL struct {
+	sources []netip.Prefix
+	topics  []string
+	produce bool
+	consume bool
+}
+
+// kafkaPending is a request whose response the handler rewrites
+type kafkaPending struct {
+	apiKey     int16
+	apiVersion int16
+}
+
+// NewKafkaHandler creates the handler for a kafka route
+func NewKafkaHandler(cfg *config.Config, route *config.RouteConfig, logger *logrus.Logger) (*KafkaHandler, error) {
+	acls, err := parseKafkaACLs(route.Kafka.ACLs)
+	if err != nil {
+		return nil, err
+	}
+
+	advertised := route.Kafka.AdvertisedHost
+	if advertised == "" {
+		advertised = route.BindAddress
+	}
+	if advertised == "" {
+		advertised = cfg.BindAddress
+	}
+	if advertised == "" {
+		if advertised, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("failed to determine the advertised host: %w", err)
+		}
+	}
+
+	return &KafkaHandler{
+		cfg:         cfg,
+		route:       route,
+		logger:      logger,
+		acls:        acls,
+		advertised:  advertised,
+		connLimiter: rate.NewLimiter(rate.Limit(route.ConnectionRate), int(route.ConnectionRate)),
+		brokers:     make(map[int32]*kafkaBroker),
+	}, nil
+}
+
+// parseKafkaACLs parses the sources of a route's ACLs, a bare address
+// matching that address only
+func parseKafkaACLs(configured []config.KafkaACL) ([]kafkaACL, error) {
+	acls := make([]kafkaACL, 0, len(configured))
+	for i, c := range configured {
+		acl := kafkaACL{topics: c.Topics}
+		for _, source := range c.Sources {
+			prefix, err := netip.ParsePrefix(source)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(source)
+				if addrErr != nil {
+					return nil, fmt.Errorf("kafka acl %d: invalid source %q", i, source)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			acl.sources = append(acl.sources, prefix.Masked())
+		}
+		for _, op := range c.Operations {
+			switch op {
+			case "produce":
+				acl.produce = true
+			case "consume":
+				acl.consume = true
+			}
+		}
+		acls = append(acls, acl)
+	}
+	return acls, nil
+}
+
+// SetDrains sets the backends drained for maintenance. It must be called
+// before Start.
+func (h *KafkaHandler) SetDrains(drains *drain.Set) {
+	h.drains = drains
+}
+
+// Start listens for bootstrap connections on the route's listen port
+func (h *KafkaHandler) Start(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running {
+		return fmt.Errorf("handler already running")
+	}
+
+	addr := h.cfg.RouteListenAddress(h.route)
+	listener, err := netutil.Listen("tcp", addr, h.cfg.RouteBindInterface(h.route))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	h.ctx, h.cancel = context.WithCancel(ctx)
+	h.listeners = append(h.listeners, listener)
+	h.running = true
+
+	bootstrap := netutil.JoinHostPort(h.route.BackendHost, h.route.BackendPort)
+	go h.acceptConnections(listener, func() string { return bootstrap })
+
+	h.logger.WithFields(logrus.Fields{
+		"route":     h.route.Name,
+		"port":      h.route.ListenPort,
+		"bootstrap": bootstrap,
+		"acls":      len(h.acls),
+	}).Info("Kafka handler started")
+
+	return nil
+}
+
+// Stop closes the bootstrap and broker listeners
+func (h *KafkaHandler) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return nil
+	}
+
+	h.logger.WithField("route", h.route.Name).Info("Stopping Kafka handler")
+
+	h.cancel()
+	for _, listener := range h.listeners {
+		listener.Close()
+	}
+	h.listeners = nil
+	h.brokers = make(map[int32]*kafkaBroker)
+	metrics.SetKafkaBrokers(h.route.Name, 0)
+
+	h.running = false
+	return nil
+}
+
+// GetStats returns handler statistics
+func (h *KafkaHandler) GetStats() map[string]interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	brokers := make(map[string]interface{}, len(h.brokers))
+	for _, b := range h.brokers {
+		brokers[fmt.Sprintf("%d", b.nodeID)] = map[string]interface{}{
+			"address": b.address,
+			"port":    b.port,
+		}
+	}
+
+	return map[string]interface{}{
+		"protocol":     "kafka",
+		"route":        h.route.Name,
+		"port":         h.route.ListenPort,
+		"brokers":      brokers,
+		"active_conns": atomic.LoadInt64(&h.activeConns),
+		"total_conns":  atomic.LoadInt64(&h.totalConns),
+		"requests":     atomic.LoadUint64(&h.requests),
+		"denied":       atomic.LoadUint64(&h.denied),
+		"rewrites":     atomic.LoadUint64(&h.rewrites),
+		"running":      h.running,
+	}
+}
+
+// acceptConnections relays the connections of a listener to the address
+// upstream returns at the time
+func (h *KafkaHandler) acceptConnections(listener net.Listener, upstream func() string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if h.ctx.Err() != nil {
+				return
+			}
+			h.logger.WithError(err).Error("Failed to accept connection")
+			continue
+		}
+
+		if !h.connLimiter.Allow() || atomic.LoadInt64(&h.activeConns) >= int64(h.route.MaxConnections) {
+			h.logger.WithField("route", h.route.Name).Warn("Connection limit exceeded")
+			metrics.ConnectionRejected(h.route.Name)
+			conn.Close()
+			continue
+		}
+
+		go h.handleConnection(conn, upstream())
+	}
+}
+
+// handleConnection relays one client connection frame by frame
+func (h *KafkaHandler) handleConnection(clientConn net.Conn, backendAddr string) {
+	defer clientConn.Close()
+
+	atomic.AddInt64(&h.activeConns, 1)
+	defer atomic.AddInt64(&h.activeConns, -1)
+	atomic.AddInt64(&h.totalConns, 1)
+
+	session := metrics.StartSession(h.route.Name, backendAddr)
+	defer session.End()
+	defer func() {
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+
+	// A drained broker keeps its open connections but takes no new ones,
+	// clients moving to the other brokers
+	backendHost, port, _ := net.SplitHostPort(backendAddr)
+	backendPort, _ := strconv.Atoi(port)
+	if h.drains.Drained(backendHost, backendPort) {
+		h.logger.WithField("backend", backendAddr).Warn("Kafka broker drained, connection refused")
+		session.Fail("backend_drained")
+		return
+	}
+	defer h.drains.Track(backendHost, backendPort)()
+
+	backendConn, err := net.DialTimeout("tcp", backendAddr, 10*time.Second)
+	if err != nil {
+		h.logger.WithError(err).WithField("backend", backendAddr).Error("Failed to connect to Kafka broker")
+		session.Fail("backend_unavailable")
+		return
+	}
+	defer backendConn.Close()
+
+	var source netip.Addr
+	if addr, ok := clientConn.RemoteAddr().(*net.TCPAddr); ok {
+		source = addr.AddrPort().Addr().Unmap()
+	}
+
+	client := session.WatchClient(clientConn)
+	backend := session.WatchBackend(backendConn)
+
+	var pendingMu sync.Mutex
+	pending := make(map[int32]kafkaPending)
+	errChan := make(chan error, 2)
+
+	// Client to broker
+	go func() {
+		reader := bufio.NewReaderSize(client, h.cfg.BufferSize)
+		for {
+			frame, err := readKafkaFrame(reader)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			header, err := parseKafkaRequestHeader(frame)
+			if err != nil {
+				session.Close(metrics.CloseError)
+				errChan <- err
+				return
+			}
+			if operation, reason := h.checkRequest(source, frame, header); reason != "" {
+				atomic.AddUint64(&h.denied, 1)
+				metrics.IncKafkaDenied(h.route.Name, operation)
+				h.logger.WithFields(logrus.Fields{
+					"route":     h.route.Name,
+					"client":    source.String(),
+					"client_id": header.ClientID,
+					"api_key":   header.APIKey,
+					"version":   header.APIVersion,
+				}).Warn("Kafka request denied: " + reason)
+				session.Close(metrics.ClosePolicyDenied)
+				errChan <- fmt.Errorf("kafka request denied: %s", reason)
+				return
+			}
+
+			atomic.AddUint64(&h.requests, 1)
+			metrics.IncKafkaRequest(h.route.Name, kafkaAPIName(header.APIKey))
+			switch header.APIKey {
+			case kafkaMetadata, kafkaFindCoordinator, kafkaApiVersions:
+				pendingMu.Lock()
+				pending[header.CorrelationID] = kafkaPending{header.APIKey, header.APIVersion}
+				pendingMu.Unlock()
+			}
+			if err := writeKafkaFrame(backend, frame); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	// Broker to client
+	go func() {
+		reader := bufio.NewReaderSize(backend, h.cfg.BufferSize)
+		for {
+			frame, err := readKafkaFrame(reader)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if len(frame) >= 4 {
+				correlationID := int32(binary.BigEndian.Uint32(frame))
+				pendingMu.Lock()
+				request, ok := pending[correlationID]
+				delete(pending, correlationID)
+				pendingMu.Unlock()
+				if ok {
+					if frame, err = h.rewriteResponse(frame, request); err != nil {
+						h.logger.WithError(err).WithField("route", h.route.Name).Error("Failed to rewrite Kafka response")
+						session.Close(metrics.CloseError)
+						errChan <- err
+						return
+					}
+				}
+			}
+			if err := writeKafkaFrame(client, frame); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	<-errChan
+}
+
+// checkRequest returns the operation and reason a request is refused for,
+// no reason when it is allowed
+func (h *KafkaHandler) checkRequest(source netip.Addr, frame []byte, header kafkaRequestHeader) (string, string) {
+	if name, ok := kafkaAdminAPIs[header.APIKey]; ok && h.cfg.BlockSuspiciousQueries {
+		return "admin", name + " is blocked"
+	}
+	// Version 0 SASL handshakes are followed by unframed tokens
+	if header.APIKey == 17 && header.APIVersion == 0 {
+		return "version", "SaslHandshake v0 is not supported"
+	}
+	if len(h.acls) == 0 {
+		return "", ""
+	}
+
+	var operation string
+	switch header.APIKey {
+	case kafkaProduce:
+		operation = "produce"
+	case kafkaFetch:
+		operation = "consume"
+	default:
+		return "", ""
+	}
+	if header.APIVersion > kafkaMaxTopicVersion {
+		return "version", fmt.Sprintf("%s v%d names topics by ID", operation, header.APIVersion)
+	}
+	topics, err := requestTopics(frame, header)
+	if err != nil {
+		return operation, err.Error()
+	}
+	for _, topic := range topics {
+		if !kafkaAllowed(h.acls, source, operation, topic) {
+			return operation, fmt.Sprintf("%s to topic %q is not allowed", operation, topic)
+		}
+	}
+	return "", ""
+}
+
+// kafkaAllowed reports whether an ACL lets source perform operation on topic
+func kafkaAllowed(acls []kafkaACL, source netip.Addr, operation, topic string) bool {
+	for _, acl := range acls {
+		if (operation == "produce" && !acl.produce) || (operation == "consume" && !acl.consume) {
+			continue
+		}
+		if len(acl.sources) > 0 && !kafkaSourceMatches(acl.sources, source) {
+			continue
+		}
+		for _, pattern := range acl.topics {
+			if kafkaTopicMatches(pattern, topic) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func kafkaSourceMatches(sources []netip.Prefix, source netip.Addr) bool {
+	for _, prefix := range sources {
+		if prefix.Contains(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// kafkaTopicMatches matches a topic name, "prefix*" or "*"
+func kafkaTopicMatches(pattern, topic string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(topic, prefix)
+	}
+	return pattern == topic
+}
+
+// kafkaAPIName labels an API key for metrics
+func kafkaAPIName(apiKey int16) string {
+	if name, ok := kafkaAPINames[apiKey]; ok {
+		return name
+	}
+	if _, ok := kafkaAdminAPIs[apiKey]; ok {
+		return "admin"
+	}
+	return "other"
+}
+
+// rewriteResponse points the broker addresses of a response at the
+// handler's listeners. ApiVersions responses are capped to the Produce and
+// Fetch versions the ACLs can inspect.
+func (h *KafkaHandler) rewriteResponse(frame []byte, request kafkaPending) ([]byte, error) {
+	var err error
+	switch request.apiKey {
+	case kafkaMetadata:
+		frame, err = rewriteMetadataResponse(frame, request.apiVersion, h.brokerAddress)
+	case kafkaFindCoordinator:
+		frame, err = rewriteFindCoordinatorResponse(frame, request.apiVersion, h.brokerAddress)
+	case kafkaApiVersions:
+		if len(h.acls) > 0 {
+			err = capApiVersionsResponse(frame, request.apiVersion, map[int16]int16{
+				kafkaProduce: kafkaMaxTopicVersion,
+				kafkaFetch:   kafkaMaxTopicVersion,
+			})
+		}
+		return frame, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&h.rewrites, 1)
+	metrics.IncKafkaRewrite(h.route.Name, kafkaAPIName(request.apiKey))
+	return frame, nil
+}
+
+// brokerAddress returns the address the handler advertises for a broker,
+// listening for it on the next broker port the first time it is seen
+func (h *KafkaHandler) brokerAddress(nodeID int32, host string, port int32) (string, int32, error) {
+	address := netutil.JoinHostPort(host, int(port))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if b, ok := h.brokers[nodeID]; ok {
+		if b.address != address {
+			h.logger.WithFields(logrus.Fields{
+				"route":   h.route.Name,
+				"node_id": nodeID,
+				"address": address,
+			}).Info("Kafka broker moved")
+			b.address = address
+		}
+		return h.advertised, int32(b.port), nil
+	}
+
+	if !h.running {
+		return "", 0, fmt.Errorf("handler stopped")
+	}
+	if len(h.brokers) >= h.route.Kafka.MaxBrokers {
+		return "", 0, fmt.Errorf("broker %d exceeds max_brokers %d", nodeID, h.route.Kafka.MaxBrokers)
+	}
+
+	b := &kafkaBroker{nodeID: nodeID, address: address, port: h.route.Kafka.BrokerPortStart + len(h.brokers)}
+	brokerRoute := *h.route
+	brokerRoute.ListenPort = b.port
+	listen := h.cfg.RouteListenAddress(&brokerRoute)
+	listener, err := netutil.Listen("tcp", listen, h.cfg.RouteBindInterface(h.route))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to listen for broker %d on %s: %w", nodeID, listen, err)
+	}
+	h.brokers[nodeID] = b
+	h.listeners = append(h.listeners, listener)
+	metrics.SetKafkaBrokers(h.route.Name, len(h.brokers))
+
+	go h.acceptConnections(listener, func() string {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return b.address
+	})
+
+	h.logger.WithFields(logrus.Fields{
+		"route":   h.route.Name,
+		"node_id": nodeID,
+		"broker":  address,
+		"port":    b.port,
+	}).Info("Kafka broker listener started")
+
+	return h.advertised, int32(b.port), nil
+}
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Kafka API keys the handler inspects
+const (
+	kafkaProduce         int16 = 0
+	kafkaFetch           int16 = 1
+	kafkaMetadata        int16 = 3
+	kafkaFindCoordinator int16 = 10
+	kafkaApiVersions     int16 = 18
+)
+
+const (
+	// kafkaMaxFrameSize bounds a request or response, the broker default
+	// for socket.request.max.bytes
+	kafkaMaxFrameSize = 100 << 20
+
+	// kafkaMaxTopicVersion is the highest Produce and Fetch version naming
+	// topics; later versions use topic IDs the ACLs cannot match
+	kafkaMaxTopicVersion = 12
+)
+
+// kafkaFlexibleVersions is the first version of each inspected API using
+// compact encodings and tagged fields (KIP-482)
+var kafkaFlexibleVersions = map[int16]int16{
+	kafkaProduce:         9,
+	kafkaFetch:           12,
+	kafkaMetadata:        9,
+	kafkaFindCoordinator: 3,
+	kafkaApiVersions:     3,
+}
+
+// kafkaAdminAPIs change cluster state and are blocked with
+// block_suspicious_queries
+var kafkaAdminAPIs = map[int16]string{
+	19: "CreateTopics",
+	20: "DeleteTopics",
+	21: "DeleteRecords",
+	30: "CreateAcls",
+	31: "DeleteAcls",
+	33: "AlterConfigs",
+	34: "AlterReplicaLogDirs",
+	37: "CreatePartitions",
+	42: "DeleteGroups",
+	43: "ElectLeaders",
+	44: "IncrementalAlterConfigs",
+	45: "AlterPartitionReassignments",
+	49: "AlterClientQuotas",
+	51: "AlterUserScramCredentials",
+	64: "UnregisterBroker",
+}
+
+// kafkaAPINames labels request metrics; other keys are counted as "other"
+var kafkaAPINames = map[int16]string{
+	kafkaProduce:         "produce",
+	kafkaFetch:           "fetch",
+	2:                    "list_offsets",
+	kafkaMetadata:        "metadata",
+	8:                    "offset_commit",
+	9:                    "offset_fetch",
+	kafkaFindCoordinator: "find_coordinator",
+	11:                   "join_group",
+	12:                   "heartbeat",
+	14:                   "sync_group",
+	17:                   "sasl_handshake",
+	kafkaApiVersions:     "api_versions",
+	36:                   "sasl_authenticate",
+}
+
+var errKafkaShort = errors.New("truncated kafka message")
+
+// isFlexible reports whether a version of an API uses flexible encoding
+func isFlexible(apiKey, version int16) bool {
+	first, ok := kafkaFlexibleVersions[apiKey]
+	return ok && version >= first
+}
+
+// readKafkaFrame reads one size-prefixed request or response
+func readKafkaFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > kafkaMaxFrameSize {
+		return nil, fmt.Errorf("kafka frame of %d bytes exceeds the limit", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeKafkaFrame writes a frame with its size prefix
+func writeKafkaFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+	_, err := w.Write(buf)
+	return err
+}
+
+// kafkaReader decodes the primitive types of the Kafka protocol. The first
+// error sticks and later reads return zero values.
+type kafkaReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.off+n > len(r.buf) {
+		r.err = errKafkaShort
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.off:])
+	if n <= 0 {
+		r.err = errKafkaShort
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+// length reads an array, string or bytes length, -1 for null. Compact
+// lengths are stored plus one.
+func (r *kafkaReader) length(compact bool, wide bool) int {
+	var n int
+	switch {
+	case compact:
+		n = int(r.uvarint()) - 1
+	case wide:
+		n = int(r.int32())
+	default:
+		n = int(r.int16())
+	}
+	if n < -1 || n > len(r.buf) {
+		r.err = errKafkaShort
+		return 0
+	}
+	return n
+}
+
+// string reads a (nullable) string, empty for null
+func (r *kafkaReader) string(compact bool) string {
+	n := r.length(compact, false)
+	if n <= 0 {
+		return ""
+	}
+	return string(r.take(n))
+}
+
+// array reads an array length, 0 for null
+func (r *kafkaReader) array(compact bool) int {
+	n := r.length(compact, true)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// skipBytes skips a (nullable) bytes field
+func (r *kafkaReader) skipBytes(compact bool) {
+	if n := r.length(compact, true); n > 0 {
+		r.take(n)
+	}
+}
+
+// skipTaggedFields skips the tagged fields of a flexible structure
+func (r *kafkaReader) skipTaggedFields() {
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		r.uvarint() // tag
+		r.take(int(r.uvarint()))
+	}
+}
+
+// appendKafkaString encodes a string the way the reader decodes it
+func appendKafkaString(b []byte, s string, compact bool) []byte {
+	if compact {
+		b = binary.AppendUvarint(b, uint64(len(s))+1)
+	} else {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	}
+	return append(b, s...)
+}
+
+// appendKafkaArrayLen encodes an array length
+func appendKafkaArrayLen(b []byte, n int, compact bool) []byte {
+	if compact {
+		return binary.AppendUvarint(b, uint64(n)+1)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n))
+}
+
+// kafkaRequestHeader is the part of a request the handler needs
+type kafkaRequestHeader struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+	bodyOffset    int
+}
+
+// parseKafkaRequestHeader decodes a request header. The client ID is never
+// compact; tagged fields follow it in flexible versions.
+func parseKafkaRequestHeader(frame []byte) (kafkaRequestHeader, error) {
+	r := &kafkaReader{buf: frame}
+	h := kafkaRequestHeader{
+		APIKey:        r.int16(),
+		APIVersion:    r.int16(),
+		CorrelationID: r.int32(),
+	}
+	h.ClientID = r.string(false)
+	// ApiVersions requests keep the old header for clients probing newer
+	// brokers, so their tagged fields are only known for inspected APIs
+	if isFlexible(h.APIKey, h.APIVersion) {
+		r.skipTaggedFields()
+	}
+	h.bodyOffset = r.off
+	return h, r.err
+}
+
+// requestTopics returns the topics a Produce or Fetch request names
+func requestTopics(frame []byte, h kafkaRequestHeader) ([]string, error) {
+	flexible := isFlexible(h.APIKey, h.APIVersion)
+	r := &kafkaReader{buf: frame, off: h.bodyOffset}
+	var topics []string
+
+	switch h.APIKey {
+	case kafkaProduce:
+		if h.APIVersion >= 3 {
+			r.string(flexible) // transactional_id
+		}
+		r.int16() // acks
+		r.int32() // timeout_ms
+		for n := r.array(flexible); n > 0 && r.err == nil; n-- {
+			topics = append(topics, r.string(flexible))
+			for p := r.array(flexible); p > 0 && r.err == nil; p-- {
+				r.int32() // partition index
+				r.skipBytes(flexible)
+				if flexible {
+					r.skipTaggedFields()
+				}
+			}
+			if flexible {
+				r.skipTaggedFields()
+			}
+		}
+
+	case kafkaFetch:
+		r.int32() // replica_id
+		r.int32() // max_wait_ms
+		r.int32() // min_bytes
+		if h.APIVersion >= 3 {
+			r.int32() // max_bytes
+		}
+		if h.APIVersion >= 4 {
+			r.int8() // isolation_level
+		}
+		if h.APIVersion >= 7 {
+			r.int32() // session_id
+			r.int32() // session_epoch
+		}
+		partitionSize := 4 + 8 + 4 // partition, fetch_offset, partition_max_bytes
+		if h.APIVersion >= 5 {
+			partitionSize += 8 // log_start_offset
+		}
+		if h.APIVersion >= 9 {
+			partitionSize += 4 // current_leader_epoch
+		}
+		if h.APIVersion >= 12 {
+			partitionSize += 4 // last_fetched_epoch
+		}
+		for n := r.array(flexible); n > 0 && r.err == nil; n-- {
+			topics = append(topics, r.string(flexible))
+			for p := r.array(flexible); p > 0 && r.err == nil; p-- {
+				r.take(partitionSize)
+				if flexible {
+					r.skipTaggedFields()
+				}
+			}
+			if flexible {
+				r.skipTaggedFields()
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("api key %d names no topics", h.APIKey)
+	}
+	return topics, r.err
+}
+
+// kafkaAddressRewrite maps a broker's advertised address to the proxy's
+type kafkaAddressRewrite func(nodeID int32, host string, port int32) (string, int32, error)
+
+// responseBody returns a reader positioned after the response header
+func responseBody(frame []byte, apiKey, version int16) *kafkaReader {
+	r := &kafkaReader{buf: frame}
+	r.int32() // correlation_id
+	// ApiVersions responses always use header version 0
+	if apiKey != kafkaApiVersions && isFlexible(apiKey, version) {
+		r.skipTaggedFields()
+	}
+	return r
+}
+
+// rewriteMetadataResponse replaces the broker addresses of a Metadata
+// response. The brokers array is re-encoded and the rest copied unchanged.
+func rewriteMetadataResponse(frame []byte, version int16, rewrite kafkaAddressRewrite) ([]byte, error) {
+	flexible := isFlexible(kafkaMetadata, version)
+	r := responseBody(frame, kafkaMetadata, version)
+	if version >= 3 {
+		r.int32() // throttle_time_ms
+	}
+	start := r.off
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	out := append([]byte{}, frame[:start]...)
+	count := r.array(flexible)
+	out = appendKafkaArrayLen(out, count, flexible)
+	for i := 0; i < count && r.err == nil; i++ {
+		nodeID := r.int32()
+		host := r.string(flexible)
+		port := r.int32()
+		if r.err != nil {
+			break
+		}
+		newHost, newPort, err := rewrite(nodeID, host, port)
+		if err != nil {
+			return nil, err
+		}
+		out = binary.BigEndian.AppendUint32(out, uint32(nodeID))
+		out = appendKafkaString(out, newHost, flexible)
+		out = binary.BigEndian.AppendUint32(out, uint32(newPort))
+
+		// rack and tagged fields are copied as they are
+		rest := r.off
+		if version >= 1 {
+			if n := r.length(flexible, false); n > 0 {
+				r.take(n)
+			}
+		}
+		if flexible {
+			r.skipTaggedFields()
+		}
+		out = append(out, frame[rest:r.off]...)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append(out, frame[r.off:]...), nil
+}
+
+// rewriteFindCoordinatorResponse replaces the coordinator addresses of a
+// FindCoordinator response, one coordinator before version 4 and a list of
+// them from version 4
+func rewriteFindCoordinatorResponse(frame []byte, version int16, rewrite kafkaAddressRewrite) ([]byte, error) {
+	flexible := isFlexible(kafkaFindCoordinator, version)
+	r := responseBody(frame, kafkaFindCoordinator, version)
+	if version >= 1 {
+		r.int32() // throttle_time_ms
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := append([]byte{}, frame[:r.off]...)
+
+	// node_id, host and port of one coordinator
+	coordinator := func() error {
+		nodeID := r.int32()
+		host := r.string(flexible)
+		port := r.int32()
+		if r.err != nil {
+			return r.err
+		}
+		// Failed lookups carry node -1 and no address
+		newHost, newPort := host, port
+		if nodeID >= 0 {
+			var err error
+			if newHost, newPort, err = rewrite(nodeID, host, port); err != nil {
+				return err
+			}
+		}
+		out = binary.BigEndian.AppendUint32(out, uint32(nodeID))
+		out = appendKafkaString(out, newHost, flexible)
+		out = binary.BigEndian.AppendUint32(out, uint32(newPort))
+		return nil
+	}
+
+	if version < 4 {
+		fields := r.off
+		r.int16() // error_code
+		if version >= 1 {
+			if n := r.length(flexible, false); n > 0 {
+				r.take(n) // error_message
+			}
+		}
+		out = append(out, frame[fields:r.off]...)
+		if err := coordinator(); err != nil {
+			return nil, err
+		}
+		return append(out, frame[r.off:]...), nil
+	}
+
+	count := r.array(true)
+	out = appendKafkaArrayLen(out, count, true)
+	for i := 0; i < count && r.err == nil; i++ {
+		key := r.off
+		r.string(true) // key
+		out = append(out, frame[key:r.off]...)
+		if err := coordinator(); err != nil {
+			return nil, err
+		}
+		rest := r.off
+		r.int16() // error_code
+		if n := r.length(true, false); n > 0 {
+			r.take(n) // error_message
+		}
+		r.skipTaggedFields()
+		out = append(out, frame[rest:r.off]...)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append(out, frame[r.off:]...), nil
+}
+
+// capApiVersionsResponse lowers the highest version of APIs in place, so
+// clients keep to versions the handler can inspect
+func capApiVersionsResponse(frame []byte, version int16, caps map[int16]int16) error {
+	flexible := isFlexible(kafkaApiVersions, version)
+	r := responseBody(frame, kafkaApiVersions, version)
+	r.int16() // error_code
+	for n := r.array(flexible); n > 0 && r.err == nil; n-- {
+		apiKey := r.int16()
+		r.int16() // min_version
+		maxOffset := r.off
+		maxVersion := r.int16()
+		if flexible {
+			r.skipTaggedFields()
+		}
+		if limit, ok := caps[apiKey]; ok && r.err == nil && maxVersion > limit {
+			binary.BigEndian.PutUint16(frame[maxOffset:], uint16(limit))
+		}
+	}
+	return r.err
+}
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"marchproxy-dblb/internal/config"
+	"marchproxy-shared/drain"
+
+	"github.com/sirupsen/logrus"
+)
+
+// kafkaBuilder encodes test messages
+type kafkaBuilder struct {
+	b        []byte
+	flexible bool
+}
+
+func (k *kafkaBuilder) int8(v int8) *kafkaBuilder { k.b = append(k.b, byte(v)); return k }
+func (k *kafkaBuilder) int16(v int16) *kafkaBuilder {
+	k.b = binary.BigEndian.AppendUint16(k.b, uint16(v))
+	return k
+}
+func (k *kafkaBuilder) int32(v int32) *kafkaBuilder {
+	k.b = binary.BigEndian.AppendUint32(k.b, uint32(v))
+	return k
+}
+func (k *kafkaBuilder) int64(v int64) *kafkaBuilder {
+	k.b = binary.BigEndian.AppendUint64(k.b, uint64(v))
+	return k
+}
+func (k *kafkaBuilder) str(s string) *kafkaBuilder {
+	k.b = appendKafkaString(k.b, s, k.flexible)
+	return k
+}
+func (k *kafkaBuilder) array(n int) *kafkaBuilder {
+	k.b = appendKafkaArrayLen(k.b, n, k.flexible)
+	return k
+}
+
+func (k *kafkaBuilder) null() *kafkaBuilder {
+	if k.flexible {
+		k.b = append(k.b, 0)
+		return k
+	}
+	return k.int16(-1)
+}
+
+func (k *kafkaBuilder) tags() *kafkaBuilder {
+	if k.flexible {
+		k.b = append(k.b, 0)
+	}
+	return k
+}
+
+// requestHeader starts a request, the client ID never being compact
+func requestHeader(apiKey, version int16, flexible bool) *kafkaBuilder {
+	k := &kafkaBuilder{}
+	k.int16(apiKey).int16(version).int32(7).str("client-1")
+	k.flexible = flexible
+	return k.tags()
+}
+
+func testRewrite(nodeID int32, host string, port int32) (string, int32, error) {
+	return "proxy.local", 19092 + nodeID, nil
+}
+
+// metadataBrokers decodes the broker list of a Metadata response
+func metadataBrokers(t *testing.T, frame []byte, version int16) []string {
+	t.Helper()
+	flexible := isFlexible(kafkaMetadata, version)
+	r := responseBody(frame, kafkaMetadata, version)
+	if version >= 3 {
+		r.int32()
+	}
+	var brokers []string
+	for n := r.array(flexible); n > 0; n-- {
+		nodeID := r.int32()
+		host := r.string(flexible)
+		port := r.int32()
+		rack := r.string(flexible)
+		if flexible {
+			r.skipTaggedFields()
+		}
+		brokers = append(brokers, fmt.Sprintf("%d %s:%d %s", nodeID, host, port, rack))
+	}
+	if r.err != nil {
+		t.Fatalf("failed to decode rewritten response: %v", r.err)
+	}
+	return brokers
+}
+
+func TestRewriteMetadataResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int16
+	}{
+		{"v1", 1},
+		{"v5 with throttle", 5},
+		{"v9 flexible", 9},
+		{"v12 flexible", 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flexible := isFlexible(kafkaMetadata, tt.version)
+			k := &kafkaBuilder{}
+			k.int32(42)
+			k.flexible = flexible
+			k.tags()
+			if tt.version >= 3 {
+				k.int32(0)
+			}
+			k.array(2)
+			k.int32(1).str("broker-1.internal").int32(9092).str("rack-a").tags()
+			k.int32(2).str("broker-2.internal").int32(9092).null().tags()
+			header := len(k.b)
+			trailer := []byte{0xde, 0xad, 0xbe, 0xef}
+			k.b = append(k.b, trailer...)
+
+			out, err := rewriteMetadataResponse(k.b, tt.version, testRewrite)
+			if err != nil {
+				t.Fatalf("rewrite failed: %v", err)
+			}
+			if got := binary.BigEndian.Uint32(out); got != 42 {
+				t.Errorf("correlation ID = %d, want 42", got)
+			}
+			want := []string{"1 proxy.local:19093 rack-a", "2 proxy.local:19094 "}
+			if got := metadataBrokers(t, out, tt.version); !reflect.DeepEqual(got, want) {
+				t.Errorf("brokers = %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(out[len(out)-len(trailer):], trailer) {
+				t.Error("bytes after the brokers were not copied")
+			}
+			if len(out) == header {
+				t.Error("rewritten response is truncated")
+			}
+		})
+	}
+}
+
+func TestRewriteFindCoordinatorResponse(t *testing.T) {
+	// v0: error_code, node_id, host, port
+	k := &kafkaBuilder{}
+	k.int32(9).int16(0).int32(3).str("broker-3.internal").int32(9092)
+	out, err := rewriteFindCoordinatorResponse(k.b, 0, testRewrite)
+	if err != nil {
+		t.Fatalf("v0 rewrite failed: %v", err)
+	}
+	r := &kafkaReader{buf: out, off: 6}
+	if nodeID, host, port := r.int32(), r.string(false), r.int32(); nodeID != 3 || host != "proxy.local" || port != 19095 {
+		t.Errorf("v0 coordinator = %d %s:%d", nodeID, host, port)
+	}
+
+	// v2: throttle and error message before the coordinator
+	k = &kafkaBuilder{}
+	k.int32(9).int32(0).int16(15).str("not available").int32(-1).str("").int32(-1)
+	out, err = rewriteFindCoordinatorResponse(k.b, 2, testRewrite)
+	if err != nil {
+		t.Fatalf("v2 rewrite failed: %v", err)
+	}
+	if !reflect.DeepEqual(out, k.b) {
+		t.Error("v2 response without a coordinator should be unchanged")
+	}
+
+	// v4: a flexible list of coordinators
+	k = &kafkaBuilder{flexible: true}
+	k.int32(9).tags().int32(0).array(2)
+	k.str("group-a").int32(1).str("broker-1.internal").int32(9092).int16(0).null().tags()
+	k.str("group-b").int32(2).str("broker-2.internal").int32(9092).int16(0).null().tags()
+	k.tags()
+	out, err = rewriteFindCoordinatorResponse(k.b, 4, testRewrite)
+	if err != nil {
+		t.Fatalf("v4 rewrite failed: %v", err)
+	}
+	r = responseBody(out, kafkaFindCoordinator, 4)
+	r.int32()
+	if n := r.array(true); n != 2 {
+		t.Fatalf("v4 coordinators = %d, want 2", n)
+	}
+	for _, want := range []struct {
+		key  string
+		port int32
+	}{{"group-a", 19093}, {"group-b", 19094}} {
+		key, _, host, port := r.string(true), r.int32(), r.string(true), r.int32()
+		r.int16()
+		r.string(true)
+		r.skipTaggedFields()
+		if key != want.key || host != "proxy.local" || port != want.port {
+			t.Errorf("v4 coordinator = %s %s:%d, want %s proxy.local:%d", key, host, port, want.key, want.port)
+		}
+	}
+	if r.err != nil || r.off != len(out)-1 {
+		t.Errorf("v4 response decoded to %d of %d bytes: %v", r.off, len(out), r.err)
+	}
+}
+
+func TestCapApiVersionsResponse(t *testing.T) {
+	for _, version := range []int16{2, 3} {
+		k := &kafkaBuilder{flexible: isFlexible(kafkaApiVersions, version)}
+		k.int32(1).int16(0).array(3)
+		k.int16(kafkaProduce).int16(0).int16(11).tags()
+		k.int16(kafkaFetch).int16(0).int16(16).tags()
+		k.int16(kafkaMetadata).int16(0).int16(12).tags()
+
+		if err := capApiVersionsResponse(k.b, version, map[int16]int16{kafkaProduce: 12, kafkaFetch: 12}); err != nil {
+			t.Fatalf("v%d: cap failed: %v", version, err)
+		}
+		r := responseBody(k.b, kafkaApiVersions, version)
+		r.int16()
+		got := map[int16]int16{}
+		for n := r.array(k.flexible); n > 0; n-- {
+			key := r.int16()
+			r.int16()
+			got[key] = r.int16()
+			if k.flexible {
+				r.skipTaggedFields()
+			}
+		}
+		want := map[int16]int16{kafkaProduce: 11, kafkaFetch: 12, kafkaMetadata: 12}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("v%d: max versions = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestRequestTopics(t *testing.T) {
+	produce := func(version int16) []byte {
+		flexible := isFlexible(kafkaProduce, version)
+		k := requestHeader(kafkaProduce, version, flexible)
+		if version >= 3 {
+			k.null()
+		}
+		k.int16(1).int32(30000).array(2)
+		for _, topic := range []string{"orders", "payments"} {
+			k.str(topic).array(1).int32(0)
+			if flexible {
+				k.b = append(k.b, 4, 1, 2, 3)
+			} else {
+				k.int32(3).b = append(k.b, 1, 2, 3)
+			}
+			k.tags().tags()
+		}
+		return k.tags().b
+	}
+	fetch := func(version int16) []byte {
+		flexible := isFlexible(kafkaFetch, version)
+		k := requestHeader(kafkaFetch, version, flexible)
+		k.int32(-1).int32(500).int32(1)
+		if version >= 3 {
+			k.int32(1 << 20)
+		}
+		if version >= 4 {
+			k.int8(0)
+		}
+		if version >= 7 {
+			k.int32(0).int32(-1)
+		}
+		k.array(2)
+		for _, topic := range []string{"orders", "payments"} {
+			k.str(topic).array(2)
+			for p := int32(0); p < 2; p++ {
+				k.int32(p)
+				if version >= 9 {
+					k.int32(-1)
+				}
+				k.int64(100)
+				if version >= 12 {
+					k.int32(-1)
+				}
+				if version >= 5 {
+					k.int64(0)
+				}
+				k.int32(1 << 20).tags()
+			}
+			k.tags()
+		}
+		return k.tags().b
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"produce v2", produce(2)},
+		{"produce v8", produce(8)},
+		{"produce v9 flexible", produce(9)},
+		{"fetch v4", fetch(4)},
+		{"fetch v11", fetch(11)},
+		{"fetch v12 flexible", fetch(12)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := parseKafkaRequestHeader(tt.frame)
+			if err != nil {
+				t.Fatalf("header: %v", err)
+			}
+			if header.ClientID != "client-1" || header.CorrelationID != 7 {
+				t.Errorf("header = %+v", header)
+			}
+			topics, err := requestTopics(tt.frame, header)
+			if err != nil {
+				t.Fatalf("topics: %v", err)
+			}
+			if want := []string{"orders", "payments"}; !reflect.DeepEqual(topics, want) {
+				t.Errorf("topics = %v, want %v", topics, want)
+			}
+		})
+	}
+
+	if _, err := requestTopics(produce(3)[:30], kafkaRequestHeader{APIKey: kafkaProduce, APIVersion: 3, bodyOffset: 18}); err == nil {
+		t.Error("truncated produce request should fail")
+	}
+}
+
+func TestKafkaCheckRequest(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	route := &config.RouteConfig{
+		Name:           "events",
+		Protocol:       "kafka",
+		ListenPort:     9092,
+		BackendHost:    "kafka.internal",
+		BackendPort:    9092,
+		ConnectionRate: 100,
+		Kafka: config.KafkaConfig{
+			AdvertisedHost: "dblb.local",
+			ACLs: []config.KafkaACL{
+				{Sources: []string{"10.0.0.0/8"}, Topics: []string{"orders"}, Operations: []string{"produce"}},
+				{Topics: []string{"orders", "metrics.*"}, Operations: []string{"consume"}},
+			},
+		},
+	}
+	h, err := NewKafkaHandler(&config.Config{BlockSuspiciousQueries: true}, route, logger)
+	if err != nil {
+		t.Fatalf("NewKafkaHandler: %v", err)
+	}
+
+	produce := func(topic string) []byte {
+		k := requestHeader(kafkaProduce, 3, false)
+		k.null().int16(1).int32(30000).array(1).str(topic).array(0)
+		return k.b
+	}
+	fetch := func(version int16, topic string) []byte {
+		k := requestHeader(kafkaFetch, version, false)
+		k.int32(-1).int32(500).int32(1).int32(1 << 20).int8(0).array(1).str(topic).array(0)
+		return k.b
+	}
+
+	inside := netip.MustParseAddr("10.1.2.3")
+	outside := netip.MustParseAddr("192.168.1.5")
+	tests := []struct {
+		name      string
+		source    netip.Addr
+		frame     []byte
+		operation string
+	}{
+		{"produce from allowed network", inside, produce("orders"), ""},
+		{"produce from other network", outside, produce("orders"), "produce"},
+		{"produce to other topic", inside, produce("payments"), "produce"},
+		{"consume exact topic", outside, fetch(4, "orders"), ""},
+		{"consume prefixed topic", outside, fetch(4, "metrics.cpu"), ""},
+		{"consume other topic", outside, fetch(4, "payments"), "consume"},
+		{"fetch by topic ID", outside, requestHeader(kafkaFetch, 13, true).b, "version"},
+		{"create topics", inside, requestHeader(19, 4, false).b, "admin"},
+		{"metadata", outside, requestHeader(kafkaMetadata, 4, false).b, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := parseKafkaRequestHeader(tt.frame)
+			if err != nil {
+				t.Fatalf("header: %v", err)
+			}
+			operation, reason := h.checkRequest(tt.source, tt.frame, header)
+			if operation != tt.operation || (reason == "") != (tt.operation == "") {
+				t.Errorf("checkRequest = %q %q, want operation %q", operation, reason, tt.operation)
+			}
+		})
+	}
+}
+
+func TestKafkaTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders-dlq", false},
+		{"orders*", "orders-dlq", true},
+		{"*", "anything", true},
+		{"metrics.*", "metrics", false},
+	}
+	for _, tt := range tests {
+		if got := kafkaTopicMatches(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("kafkaTopicMatches(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestKafkaDrainedBroker(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	route := &config.RouteConfig{Name: "events", Protocol: "kafka", ConnectionRate: 100, Kafka: config.KafkaConfig{AdvertisedHost: "dblb.local"}}
+	h, err := NewKafkaHandler(&config.Config{BufferSize: 4096}, route, logger)
+	if err != nil {
+		t.Fatalf("NewKafkaHandler: %v", err)
+	}
+	h.ctx = context.Background()
+	drains := drain.NewSet("dblb")
+	drains.Add(drain.Backend{Host: "127.0.0.1"})
+	h.SetDrains(drains)
+
+	// The client is closed without the drained broker being dialed
+	client, server := net.Pipe()
+	defer client.Close()
+	h.handleConnection(server, broker.Addr().String())
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read = %v, want the connection closed", err)
+	}
+	broker.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if conn, err := broker.Accept(); err == nil {
+		conn.Close()
+		t.Error("drained broker was dialed")
+	}
+}
@@ -3,13 +3,15 @@ package handlers
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
+	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
@@ -64,6 +66,20 @@ func (m *Manager) RegisterHandler(protocol string, port int) error {
 	return nil
 }
 
+// AddHandler registers a handler built for a route under the route's name
+func (m *Manager) AddHandler(name string, handler Handler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.handlers[name]; exists {
+		return fmt.Errorf("handler %s already registered", name)
+	}
+	m.handlers[name] = handler
+
+	m.logger.WithField("handler", name).Info("Handler registered")
+	return nil
+}
+
 // StartAll starts all registered handlers
 func (m *Manager) StartAll(ctx context.Context) error {
 	m.mu.RLock()
@@ -158,9 +174,10 @@ func (h *TCPHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("handler already running")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.port))
+	addr := h.config.ProtocolListenAddress(h.protocol, h.port)
+	listener, err := netutil.ListenStream(addr, h.config.BindInterface, h.config.SocketFileMode())
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.port, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -171,7 +188,7 @@ func (h *TCPHandler) Start(ctx context.Context) error {
 
 	h.logger.WithFields(logrus.Fields{
 		"protocol": h.protocol,
-		"port":     h.port,
+		"address":  addr,
 	}).Info("TCP handler started")
 
 	return nil
@@ -233,6 +250,7 @@ func (h *TCPHandler) acceptConnections() {
 			// Apply rate limiting
 			if !h.connLimiter.Allow() {
 				h.logger.Warn("Connection rate limit exceeded")
+				metrics.ConnectionRejected(h.protocol)
 				conn.Close()
 				continue
 			}
@@ -251,26 +269,39 @@ func (h *TCPHandler) handleConnection(clientConn net.Conn) {
 
 	h.incrementTotalConns()
 
+	session := metrics.StartSession(h.protocol, "")
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+
 	// Get backend connection from pool
 	backendConn, err := h.pool.Get(h.protocol)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to get backend connection")
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer h.pool.Put(h.protocol, backendConn)
+	session.SetBackend(backendConn.RemoteAddr().String())
 
 	// Bidirectional proxy
 	errChan := make(chan error, 2)
+	client := session.WatchClient(clientConn)
+	backend := session.WatchBackend(backendConn)
 
 	// Client to backend
 	go func() {
-		_, err := io.Copy(backendConn, clientConn)
+		_, err := bufpool.Default.Copy(backend, client, h.config.BufferSize)
 		errChan <- err
 	}()
 
 	// Backend to client
 	go func() {
-		_, err := io.Copy(clientConn, backendConn)
+		_, err := bufpool.Default.Copy(client, backend, h.config.BufferSize)
 		errChan <- err
 	}()
 
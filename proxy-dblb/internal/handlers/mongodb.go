@@ -12,10 +12,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
 	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	"github.com/sirupsen/logrus"
 )
@@ -72,9 +74,10 @@ func (h *MongoDBHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("MongoDB handler already running")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.port))
+	addr := h.config.ListenAddress(h.port)
+	listener, err := netutil.Listen("tcp", addr, h.config.BindInterface)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.port, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -163,11 +166,23 @@ func (h *MongoDBHandler) handleConnection(clientConn net.Conn) {
 		metrics.DecConnection(h.protocol)
 	}()
 
+	backendAddr := fmt.Sprintf("%s:%d", h.backendHost, h.backendPort)
+	session := metrics.StartSession(h.protocol, backendAddr)
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Perform MongoDB handshake
 	username, database, err := h.performHandshake(clientConn)
 	if err != nil {
 		h.logger.WithError(err).Error("MongoDB handshake failed")
 		metrics.IncAuthFailure(h.protocol, "unknown")
+		session.Fail("handshake")
 		return
 	}
 
@@ -177,18 +192,18 @@ func (h *MongoDBHandler) handleConnection(clientConn net.Conn) {
 	}).Debug("MongoDB handshake completed")
 
 	// Connect to backend
-	backendAddr := fmt.Sprintf("%s:%d", h.backendHost, h.backendPort)
 	backendConn, err := net.DialTimeout("tcp", backendAddr, 10*time.Second)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to connect to MongoDB backend")
 		h.sendError(clientConn, "Backend connection failed")
 		metrics.IncBackendError(h.protocol)
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer backendConn.Close()
 
 	// Proxy traffic with MongoDB-aware monitoring
-	h.proxyTraffic(h.ctx, clientConn, backendConn, username, database)
+	h.proxyTraffic(h.ctx, clientConn, session.WatchBackend(backendConn), username, database)
 }
 
 // performHandshake performs MongoDB wire protocol handshake
@@ -365,7 +380,8 @@ func (h *MongoDBHandler) proxyClientToBackend(
 	username string,
 	database string,
 ) {
-	buf := make([]byte, 32*1024)
+	buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+	defer release()
 
 	for {
 		select {
@@ -394,6 +410,7 @@ func (h *MongoDBHandler) proxyClientToBackend(
 
 				metrics.IncSQLInjection(h.protocol)
 				h.sendError(client, "Operation blocked by security policy")
+				metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 				return
 			}
 
@@ -408,6 +425,7 @@ func (h *MongoDBHandler) proxyClientToBackend(
 
 					metrics.IncSQLInjection(h.protocol)
 					h.sendError(client, "Command blocked: "+reason)
+					metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 					return
 				}
 			}
@@ -434,7 +452,8 @@ func (h *MongoDBHandler) proxyBackendToClient(
 	backend net.Conn,
 	client net.Conn,
 ) {
-	buf := make([]byte, 32*1024)
+	buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+	defer release()
 
 	for {
 		select {
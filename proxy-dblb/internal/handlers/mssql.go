@@ -10,10 +10,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
 	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
@@ -74,9 +76,10 @@ func (h *MSSQLHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("handler already running")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.route.ListenPort))
+	addr := h.config.RouteListenAddress(h.route)
+	listener, err := netutil.Listen("tcp", addr, h.config.RouteBindInterface(h.route))
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.route.ListenPort, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -154,6 +157,7 @@ func (h *MSSQLHandler) acceptConnections() {
 			if h.config.EnableRateLimiting && !h.connLimiter.Allow() {
 				h.logger.Warn("MSSQL connection rate limit exceeded")
 				h.sendError(conn, "Connection rate limit exceeded")
+				metrics.ConnectionRejected(h.route.Name)
 				conn.Close()
 				continue
 			}
@@ -176,11 +180,22 @@ func (h *MSSQLHandler) handleConnection(clientConn net.Conn) {
 		metrics.DecConnection(h.protocol)
 	}()
 
+	session := metrics.StartSession(h.route.Name, fmt.Sprintf("%s:%d", h.route.BackendHost, h.route.BackendPort))
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Perform TDS handshake and extract credentials
 	username, database, err := h.performHandshake(clientConn)
 	if err != nil {
 		h.logger.WithError(err).Error("TDS handshake failed")
 		metrics.IncAuthFailure(h.protocol, "unknown")
+		session.Fail("handshake")
 		return
 	}
 
@@ -196,12 +211,13 @@ func (h *MSSQLHandler) handleConnection(clientConn net.Conn) {
 		h.logger.WithError(err).Error("Failed to get backend connection")
 		metrics.IncBackendError(h.protocol)
 		h.sendError(clientConn, "Backend connection failed")
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer h.pool.Put(h.protocol, backendConn)
 
 	// Proxy traffic with security inspection
-	h.proxyTrafficWithInspection(h.ctx, clientConn, backendConn, username, database)
+	h.proxyTrafficWithInspection(h.ctx, clientConn, session.WatchBackend(backendConn), username, database)
 }
 
 // performHandshake performs TDS protocol handshake
@@ -352,7 +368,8 @@ func (h *MSSQLHandler) proxyTrafficWithInspection(ctx context.Context, clientCon
 	// Client to backend (with inspection)
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, 32*1024) // 32KB buffer for TDS packets
+		buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+		defer release()
 
 		for {
 			select {
@@ -371,6 +388,7 @@ func (h *MSSQLHandler) proxyTrafficWithInspection(ctx context.Context, clientCon
 				if h.config.EnableRateLimiting && !h.queryLimiter.Allow() {
 					h.logger.Warn("MSSQL query rate limit exceeded")
 					h.sendError(clientConn, "Query rate limit exceeded")
+					metrics.SetCloseReason(clientConn, metrics.ClosePolicyDenied)
 					atomic.AddInt64(&h.blockedQueries, 1)
 					return
 				}
@@ -390,6 +408,7 @@ func (h *MSSQLHandler) proxyTrafficWithInspection(ctx context.Context, clientCon
 							metrics.IncSQLInjection(h.protocol)
 							atomic.AddInt64(&h.blockedQueries, 1)
 							h.sendError(clientConn, "Query blocked by security policy")
+							metrics.SetCloseReason(clientConn, metrics.ClosePolicyDenied)
 							return
 						}
 
@@ -415,7 +434,8 @@ func (h *MSSQLHandler) proxyTrafficWithInspection(ctx context.Context, clientCon
 	// Backend to client (passthrough)
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, 32*1024)
+		buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+		defer release()
 
 		for {
 			select {
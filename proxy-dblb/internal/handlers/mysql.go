@@ -9,9 +9,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
+	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
@@ -87,9 +90,10 @@ func (h *MySQLHandler) Start(ctx context.Context) error {
 	}
 
 	// Start listening
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.route.ListenPort))
+	addr := h.config.RouteListenAddress(h.route)
+	listener, err := netutil.Listen("tcp", addr, h.config.RouteBindInterface(h.route))
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.route.ListenPort, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -249,6 +253,7 @@ func (h *MySQLHandler) acceptConnections() {
 			// Apply connection rate limiting
 			if h.config.EnableRateLimiting && !h.connLimiter.Allow() {
 				h.logger.Warn("MySQL connection rate limit exceeded")
+				metrics.ConnectionRejected(h.route.Name)
 				conn.Close()
 				continue
 			}
@@ -269,10 +274,21 @@ func (h *MySQLHandler) handleConnection(clientConn net.Conn) {
 	defer atomic.AddInt64(&h.activeConns, -1)
 	atomic.AddInt64(&h.totalConns, 1)
 
+	session := metrics.StartSession(h.route.Name, fmt.Sprintf("%s:%d", h.route.BackendHost, h.route.BackendPort))
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Perform MySQL handshake
 	username, database, err := h.performHandshake(clientConn)
 	if err != nil {
 		h.logger.WithError(err).Error("MySQL handshake failed")
+		session.Fail("handshake")
 		return
 	}
 
@@ -287,6 +303,7 @@ func (h *MySQLHandler) handleConnection(clientConn net.Conn) {
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to get MySQL backend connection")
 		h.sendError(clientConn, "Backend connection failed")
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer backendConn.Close()
@@ -310,12 +327,11 @@ func (h *MySQLHandler) performHandshake(conn net.Conn) (string, string, error) {
 		return "", "", fmt.Errorf("failed to read handshake response: %w", err)
 	}
 
-	if n < 36 {
-		return "", "", fmt.Errorf("invalid handshake packet: too short")
-	}
-
 	// Parse username and database from handshake response
-	username, database := h.parseHandshakeResponse(buf[:n])
+	username, database, err := parseMySQLHandshakeResponse(buf[:n])
+	if err != nil {
+		return "", "", err
+	}
 
 	// Send OK packet
 	okPacket := []byte{
@@ -353,41 +369,6 @@ func (h *MySQLHandler) buildHandshakePacket() []byte {
 	return greeting
 }
 
-// parseHandshakeResponse parses username and database from client handshake response
-func (h *MySQLHandler) parseHandshakeResponse(buf []byte) (string, string) {
-	// Skip capability flags, max packet size, charset, reserved bytes (32 bytes total)
-	pos := 32
-
-	if pos >= len(buf) {
-		return "", ""
-	}
-
-	// Extract username (null-terminated string)
-	username := ""
-	for pos < len(buf) && buf[pos] != 0 {
-		username += string(buf[pos])
-		pos++
-	}
-	pos++ // skip null terminator
-
-	// Skip auth response length and auth response data
-	if pos < len(buf) {
-		authLen := int(buf[pos])
-		pos += 1 + authLen
-	}
-
-	// Extract database name (null-terminated string)
-	database := ""
-	if pos < len(buf) {
-		for pos < len(buf) && buf[pos] != 0 {
-			database += string(buf[pos])
-			pos++
-		}
-	}
-
-	return username, database
-}
-
 // sendError sends a MySQL error packet to the client
 func (h *MySQLHandler) sendError(conn net.Conn, message string) {
 	// MySQL error packet format
@@ -457,7 +438,8 @@ func (h *MySQLHandler) proxyTraffic(client net.Conn, backend *sql.Conn, username
 
 // proxyClientToBackend forwards queries from client to backend with security checks
 func (h *MySQLHandler) proxyClientToBackend(client net.Conn, backend *sql.Conn, username, database string) {
-	buf := make([]byte, 32*1024)
+	buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+	defer release()
 
 	for {
 		select {
@@ -485,6 +467,7 @@ func (h *MySQLHandler) proxyClientToBackend(client net.Conn, backend *sql.Conn,
 				if h.config.EnableRateLimiting && !h.queryLimiter.Allow() {
 					h.logger.Warn("MySQL query rate limit exceeded")
 					h.sendError(client, "Query rate limit exceeded")
+					metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 					return
 				}
 
@@ -503,6 +486,7 @@ func (h *MySQLHandler) proxyClientToBackend(client net.Conn, backend *sql.Conn,
 
 						if h.config.BlockSuspiciousQueries {
 							h.sendError(client, "Query blocked by security policy: "+reason)
+							metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 							return
 						}
 					}
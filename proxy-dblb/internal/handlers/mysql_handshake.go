@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MySQL client capability flags that change the HandshakeResponse41 layout
+const (
+	mysqlClientConnectWithDB        = 0x00000008
+	mysqlClientProtocol41           = 0x00000200
+	mysqlClientSecureConnection     = 0x00008000
+	mysqlClientPluginAuthLenencData = 0x00200000
+)
+
+// mysqlHandshakeFixedLen is the capability flags, max packet size, character
+// set and reserved bytes before the username
+const mysqlHandshakeFixedLen = 32
+
+var errShortHandshake = errors.New("invalid handshake packet: too short")
+
+// parseMySQLHandshakeResponse extracts the username and database from a
+// client HandshakeResponse41 packet, including its 4 byte header. The packet
+// comes from an unauthenticated client, so every length in it is checked
+// against the bytes actually received.
+func parseMySQLHandshakeResponse(packet []byte) (string, string, error) {
+	if len(packet) < 4 {
+		return "", "", errShortHandshake
+	}
+
+	// Only the payload length from the header counts, a client may have
+	// pipelined more data behind it
+	length := int(packet[0]) | int(packet[1])<<8 | int(packet[2])<<16
+	body := packet[4:]
+	if length < len(body) {
+		body = body[:length]
+	}
+	if len(body) < mysqlHandshakeFixedLen+1 {
+		return "", "", errShortHandshake
+	}
+
+	capabilities := binary.LittleEndian.Uint32(body[0:4])
+	if capabilities&mysqlClientProtocol41 == 0 {
+		return "", "", errors.New("unsupported handshake: client does not speak protocol 4.1")
+	}
+
+	pos := mysqlHandshakeFixedLen
+	username, pos, err := readNullTerminated(body, pos)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid username: %w", err)
+	}
+
+	// Skip the auth response, whose framing depends on the capabilities
+	switch {
+	case capabilities&mysqlClientPluginAuthLenencData != 0:
+		authLen, size, err := readLengthEncodedInt(body[pos:])
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth response: %w", err)
+		}
+		pos += size
+		if authLen > uint64(len(body)-pos) {
+			return "", "", fmt.Errorf("invalid auth response: length %d exceeds packet", authLen)
+		}
+		pos += int(authLen)
+	case capabilities&mysqlClientSecureConnection != 0:
+		if pos >= len(body) {
+			return "", "", errShortHandshake
+		}
+		authLen := int(body[pos])
+		pos++
+		if authLen > len(body)-pos {
+			return "", "", fmt.Errorf("invalid auth response: length %d exceeds packet", authLen)
+		}
+		pos += authLen
+	default:
+		if _, pos, err = readNullTerminated(body, pos); err != nil {
+			return "", "", fmt.Errorf("invalid auth response: %w", err)
+		}
+	}
+
+	database := ""
+	if capabilities&mysqlClientConnectWithDB != 0 && pos < len(body) {
+		if database, _, err = readNullTerminated(body, pos); err != nil {
+			return "", "", fmt.Errorf("invalid database: %w", err)
+		}
+	}
+
+	return username, database, nil
+}
+
+// readNullTerminated reads a NUL terminated string at pos and returns it
+// with the position after the terminator
+func readNullTerminated(data []byte, pos int) (string, int, error) {
+	if pos >= len(data) {
+		return "", pos, errShortHandshake
+	}
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return "", pos, errors.New("missing NUL terminator")
+	}
+	return string(data[pos : pos+end]), pos + end + 1, nil
+}
+
+// readLengthEncodedInt decodes a MySQL length-encoded integer and returns
+// it with the number of bytes it took
+func readLengthEncodedInt(data []byte) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errShortHandshake
+	}
+
+	var size int
+	switch data[0] {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	case 0xfb, 0xff:
+		return 0, 0, fmt.Errorf("invalid length-encoded integer prefix 0x%02x", data[0])
+	default:
+		return uint64(data[0]), 1, nil
+	}
+
+	if len(data) < 1+size {
+		return 0, 0, errShortHandshake
+	}
+	var value uint64
+	for i := size; i >= 1; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, 1 + size, nil
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// buildHandshakeResponse builds a HandshakeResponse41 packet with a header
+func buildHandshakeResponse(capabilities uint32, username string, auth []byte, database string) []byte {
+	body := make([]byte, mysqlHandshakeFixedLen)
+	binary.LittleEndian.PutUint32(body[0:4], capabilities)
+	binary.LittleEndian.PutUint32(body[4:8], 16*1024*1024)
+	body[8] = 0x21
+	body = append(body, username...)
+	body = append(body, 0)
+
+	switch {
+	case capabilities&mysqlClientPluginAuthLenencData != 0, capabilities&mysqlClientSecureConnection != 0:
+		body = append(body, byte(len(auth)))
+		body = append(body, auth...)
+	default:
+		body = append(body, auth...)
+		body = append(body, 0)
+	}
+	if capabilities&mysqlClientConnectWithDB != 0 {
+		body = append(body, database...)
+		body = append(body, 0)
+	}
+	body = append(body, "mysql_native_password\x00"...)
+
+	header := []byte{byte(len(body)), byte(len(body) >> 8), byte(len(body) >> 16), 1}
+	return append(header, body...)
+}
+
+func TestParseMySQLHandshakeResponse(t *testing.T) {
+	auth := []byte{0x01, 0x02, 0x00, 0x04, 0x05}
+	tests := []struct {
+		name         string
+		packet       []byte
+		wantUser     string
+		wantDatabase string
+		wantErr      bool
+	}{
+		{
+			name:         "secure connection with database",
+			packet:       buildHandshakeResponse(mysqlClientProtocol41|mysqlClientSecureConnection|mysqlClientConnectWithDB, "app", auth, "orders"),
+			wantUser:     "app",
+			wantDatabase: "orders",
+		},
+		{
+			name:         "lenenc auth data",
+			packet:       buildHandshakeResponse(mysqlClientProtocol41|mysqlClientPluginAuthLenencData|mysqlClientConnectWithDB, "app", auth, "orders"),
+			wantUser:     "app",
+			wantDatabase: "orders",
+		},
+		{
+			// The plugin name must not be taken for a database
+			name:     "without database",
+			packet:   buildHandshakeResponse(mysqlClientProtocol41|mysqlClientSecureConnection, "app", auth, ""),
+			wantUser: "app",
+		},
+		{
+			name:         "NUL terminated auth data",
+			packet:       buildHandshakeResponse(mysqlClientProtocol41|mysqlClientConnectWithDB, "app", []byte("secret"), "orders"),
+			wantUser:     "app",
+			wantDatabase: "orders",
+		},
+		{
+			name:    "protocol 3.20",
+			packet:  buildHandshakeResponse(mysqlClientSecureConnection, "app", auth, ""),
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			packet:  buildHandshakeResponse(mysqlClientProtocol41|mysqlClientSecureConnection, "app", auth, "")[:20],
+			wantErr: true,
+		},
+		{
+			name:    "unterminated username",
+			packet:  buildHandshakeResponse(mysqlClientProtocol41|mysqlClientSecureConnection, "app", auth, "")[:39],
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, database, err := parseMySQLHandshakeResponse(tt.packet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if user != tt.wantUser || database != tt.wantDatabase {
+				t.Errorf("Expected %q/%q, got %q/%q", tt.wantUser, tt.wantDatabase, user, database)
+			}
+		})
+	}
+
+	// An auth length past the end of the packet is rejected
+	packet := buildHandshakeResponse(mysqlClientProtocol41|mysqlClientSecureConnection|mysqlClientConnectWithDB, "app", auth, "orders")
+	packet[4+mysqlHandshakeFixedLen+4] = 0xff
+	if _, _, err := parseMySQLHandshakeResponse(packet); err == nil {
+		t.Error("Expected an oversized auth length to be rejected")
+	}
+}
+
+func FuzzParseMySQLHandshakeResponse(f *testing.F) {
+	auth := []byte{0x01, 0x02, 0x03}
+	f.Add(buildHandshakeResponse(mysqlClientProtocol41|mysqlClientSecureConnection|mysqlClientConnectWithDB, "app", auth, "orders"))
+	f.Add(buildHandshakeResponse(mysqlClientProtocol41|mysqlClientPluginAuthLenencData, "root", auth, ""))
+	f.Add(buildHandshakeResponse(mysqlClientProtocol41|mysqlClientConnectWithDB, "u", []byte("pw"), "db"))
+	f.Add([]byte{0xff, 0xff, 0xff, 0x00})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		user, database, err := parseMySQLHandshakeResponse(packet)
+		if err != nil {
+			return
+		}
+		if strings.IndexByte(user, 0) >= 0 || strings.IndexByte(database, 0) >= 0 {
+			t.Fatalf("NUL byte in parsed names %q/%q", user, database)
+		}
+		if len(user)+len(database) > len(packet) {
+			t.Fatalf("Parsed %d bytes of names from a %d byte packet", len(user)+len(database), len(packet))
+		}
+	})
+}
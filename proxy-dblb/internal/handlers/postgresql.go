@@ -11,10 +11,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
 	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	"github.com/sirupsen/logrus"
 )
@@ -73,8 +75,8 @@ func (h *PostgreSQLHandler) Start(ctx context.Context) error {
 	}
 
 	// Create listener
-	addr := fmt.Sprintf(":%d", h.route.ListenPort)
-	listener, err := net.Listen("tcp", addr)
+	addr := h.config.RouteListenAddress(h.route)
+	listener, err := netutil.Listen("tcp", addr, h.config.RouteBindInterface(h.route))
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
@@ -170,12 +172,23 @@ func (h *PostgreSQLHandler) handleConnection(clientConn net.Conn) {
 		metrics.DecConnection("postgresql")
 	}()
 
+	session := metrics.StartSession(h.route.Name, fmt.Sprintf("%s:%d", h.route.BackendHost, h.route.BackendPort))
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Perform PostgreSQL handshake
 	username, database, err := h.performHandshake(clientConn)
 	if err != nil {
 		h.logger.WithError(err).Error("PostgreSQL handshake failed")
 		atomic.AddInt64(&h.authFailures, 1)
 		metrics.IncAuthFailure("postgresql", "unknown")
+		session.Fail("handshake")
 		return
 	}
 
@@ -193,12 +206,13 @@ func (h *PostgreSQLHandler) handleConnection(clientConn net.Conn) {
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to get backend connection")
 		h.sendError(clientConn, "Backend connection unavailable")
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer h.pool.Put("postgresql", backendConn)
 
 	// Proxy traffic between client and backend
-	h.proxyTraffic(clientConn, backendConn, username, database)
+	h.proxyTraffic(clientConn, session.WatchBackend(backendConn), username, database)
 }
 
 // performHandshake handles the PostgreSQL startup handshake
@@ -240,6 +254,7 @@ func (h *PostgreSQLHandler) performHandshake(conn net.Conn) (string, string, err
 	if h.route.EnableAuth {
 		if username != h.route.Username {
 			h.sendError(conn, "Authentication failed: invalid username")
+			metrics.SetCloseReason(conn, metrics.CloseAuthFailure)
 			return "", "", fmt.Errorf("authentication failed: invalid username")
 		}
 	}
@@ -335,7 +350,8 @@ func (h *PostgreSQLHandler) proxyTraffic(client, backend net.Conn, username, dat
 		defer wg.Done()
 		defer cancel()
 
-		buf := make([]byte, 32*1024)
+		buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+		defer release()
 		for {
 			select {
 			case <-ctx.Done():
@@ -369,6 +385,7 @@ func (h *PostgreSQLHandler) proxyTraffic(client, backend net.Conn, username, dat
 
 							if h.config.BlockSuspiciousQueries {
 								h.sendError(client, "Query blocked: "+reason)
+								metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 								return
 							}
 						}
@@ -400,7 +417,8 @@ func (h *PostgreSQLHandler) proxyTraffic(client, backend net.Conn, username, dat
 		defer wg.Done()
 		defer cancel()
 
-		buf := make([]byte, 32*1024)
+		buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+		defer release()
 		for {
 			select {
 			case <-ctx.Done():
@@ -10,9 +10,12 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
+	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
@@ -72,9 +75,10 @@ func (h *RedisHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("redis handler already running")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.port))
+	addr := h.config.ListenAddress(h.port)
+	listener, err := netutil.Listen("tcp", addr, h.config.BindInterface)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.port, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -152,6 +156,7 @@ func (h *RedisHandler) acceptConnections() {
 			if !h.connLimiter.Allow() {
 				h.logger.Warn("Redis connection rate limit exceeded")
 				h.sendError(conn, "Connection rate limit exceeded")
+				metrics.ConnectionRejected(h.protocol)
 				conn.Close()
 				continue
 			}
@@ -169,6 +174,16 @@ func (h *RedisHandler) handleConnection(clientConn net.Conn) {
 	defer atomic.AddInt64(&h.activeConns, -1)
 	atomic.AddInt64(&h.totalConns, 1)
 
+	session := metrics.StartSession(h.protocol, "")
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Track current user and database (Redis numbered databases)
 	username := "default"
 	database := "0"
@@ -178,12 +193,14 @@ func (h *RedisHandler) handleConnection(clientConn net.Conn) {
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to get Redis backend connection")
 		h.sendError(clientConn, "Backend connection unavailable")
+		session.Fail("backend_unavailable")
 		return
 	}
 	defer h.releaseBackendConnection(backendConn)
+	session.SetBackend(backendConn.RemoteAddr().String())
 
 	// Proxy Redis traffic with protocol awareness
-	h.proxyRedisTraffic(h.ctx, clientConn, backendConn, &username, &database)
+	h.proxyRedisTraffic(h.ctx, clientConn, session.WatchBackend(backendConn), &username, &database)
 }
 
 // proxyRedisTraffic proxies Redis protocol traffic with command inspection
@@ -244,6 +261,7 @@ func (h *RedisHandler) proxyClientToBackend(ctx context.Context, client net.Conn
 			if !h.queryLimiter.Allow() {
 				h.logger.Warn("Redis query rate limit exceeded")
 				h.sendError(client, "Query rate limit exceeded")
+				metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 				return
 			}
 
@@ -256,6 +274,7 @@ func (h *RedisHandler) proxyClientToBackend(ctx context.Context, client net.Conn
 				}).Warn("Blocked Redis command")
 				atomic.AddInt64(&h.blockedQueries, 1)
 				h.sendError(client, "Command blocked by security policy")
+				metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 				return
 			}
 
@@ -271,6 +290,7 @@ func (h *RedisHandler) proxyClientToBackend(ctx context.Context, client net.Conn
 					}).Warn("Blocked suspicious Redis command")
 					atomic.AddInt64(&h.blockedQueries, 1)
 					h.sendError(client, "Command blocked: "+reason)
+					metrics.SetCloseReason(client, metrics.ClosePolicyDenied)
 					return
 				}
 			}
@@ -298,7 +318,8 @@ func (h *RedisHandler) proxyClientToBackend(ctx context.Context, client net.Conn
 
 // proxyBackendToClient handles backend to client passthrough
 func (h *RedisHandler) proxyBackendToClient(ctx context.Context, client net.Conn, backend net.Conn) {
-	buf := make([]byte, 32*1024)
+	buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+	defer release()
 	for {
 		select {
 		case <-ctx.Done():
@@ -17,6 +17,7 @@ import (
 	"marchproxy-dblb/internal/config"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 )
 
 const (
@@ -163,9 +164,10 @@ func (h *RedisClusterHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("handler already running")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.routeConfig.ListenPort))
+	addr := h.cfg.RouteListenAddress(h.routeConfig)
+	listener, err := netutil.Listen("tcp", addr, h.cfg.RouteBindInterface(h.routeConfig))
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.routeConfig.ListenPort, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -12,9 +12,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"marchproxy-dblb/internal/bufpool"
 	"marchproxy-dblb/internal/config"
+	"marchproxy-dblb/internal/metrics"
 	"marchproxy-dblb/internal/pool"
 	"marchproxy-dblb/internal/security"
+	"marchproxy-shared/netutil"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -90,9 +93,10 @@ func (h *SQLiteHandler) Start(ctx context.Context) error {
 		return fmt.Errorf("handler already running")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", h.port))
+	addr := h.config.ListenAddress(h.port)
+	listener, err := netutil.Listen("tcp", addr, h.config.BindInterface)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", h.port, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	h.listener = listener
@@ -370,12 +374,24 @@ func (h *SQLiteHandler) handleConnection(clientConn net.Conn) {
 	defer atomic.AddInt64(&h.activeConns, -1)
 	atomic.AddInt64(&h.totalConns, 1)
 
+	session := metrics.StartSession(h.protocol, "")
+	defer session.End()
+	defer func() {
+		// Sessions cut short by a handler shutdown were drained
+		if h.ctx.Err() != nil {
+			session.Close(metrics.CloseDrain)
+		}
+	}()
+	clientConn = session.WatchClient(clientConn)
+
 	// Perform handshake to get username and database
 	username, database, err := h.performHandshake(clientConn)
 	if err != nil {
 		h.logger.WithError(err).Error("Handshake failed")
+		session.Fail("handshake")
 		return
 	}
+	session.SetBackend(database)
 
 	// Get database
 	sqliteDB, err := h.getDatabase(database)
@@ -385,6 +401,7 @@ func (h *SQLiteHandler) handleConnection(clientConn net.Conn) {
 			"error":    err,
 		}).Error("Database not found")
 		h.sendError(clientConn, "Database not found")
+		session.Fail("backend_unavailable")
 		return
 	}
 
@@ -411,7 +428,8 @@ func (h *SQLiteHandler) getDatabase(name string) (*SQLiteDatabase, error) {
 
 // proxyTraffic handles query traffic for SQLite
 func (h *SQLiteHandler) proxyTraffic(client net.Conn, sqliteDB *SQLiteDatabase, username, database string) {
-	buf := make([]byte, 32*1024)
+	buf, release := bufpool.Default.Acquire(h.config.BufferSize)
+	defer release()
 	for {
 		select {
 		case <-h.ctx.Done():
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"strconv"
+
+	"marchproxy-dblb/internal/bufpool"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bufferPoolCollector exports relay buffer pool statistics per size class
+type bufferPoolCollector struct {
+	manager *bufpool.Manager
+	gets    *prometheus.Desc
+	allocs  *prometheus.Desc
+	inUse   *prometheus.Desc
+}
+
+func init() {
+	prometheus.MustRegister(newBufferPoolCollector(bufpool.Default))
+}
+
+// newBufferPoolCollector creates a collector for a buffer manager
+func newBufferPoolCollector(manager *bufpool.Manager) *bufferPoolCollector {
+	return &bufferPoolCollector{
+		manager: manager,
+		gets: prometheus.NewDesc("marchproxy_dblb_buffer_pool_gets_total",
+			"Buffers taken from the relay pool", []string{"size"}, nil),
+		allocs: prometheus.NewDesc("marchproxy_dblb_buffer_pool_allocs_total",
+			"Buffers newly allocated because the pool was empty", []string{"size"}, nil),
+		inUse: prometheus.NewDesc("marchproxy_dblb_buffer_pool_in_use",
+			"Buffers currently checked out of the pool", []string{"size"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *bufferPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.gets
+	ch <- c.allocs
+	ch <- c.inUse
+}
+
+// Collect implements prometheus.Collector
+func (c *bufferPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stat := range c.manager.Stats() {
+		size := strconv.Itoa(stat.Size)
+		ch <- prometheus.MustNewConstMetric(c.gets, prometheus.CounterValue, float64(stat.Gets), size)
+		ch <- prometheus.MustNewConstMetric(c.allocs, prometheus.CounterValue, float64(stat.Allocs), size)
+		ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stat.InUse), size)
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Connection close reasons shared by every MarchProxy module, so backend
+// failures can be told apart from client churn
+const (
+	CloseClientEOF    = "client_eof"    // The client closed its side first
+	CloseBackendEOF   = "backend_eof"   // The backend closed its side first
+	CloseAuthFailure  = "auth_failure"  // The client failed to authenticate
+	ClosePolicyDenied = "policy_denied" // A query or command was blocked
+	CloseIdleTimeout  = "idle_timeout"  // A read timed out
+	CloseDrain        = "drain"         // Closed while the handler shut down
+	CloseError        = "error"         // Handshake, backend or relay error
+)
+
+var connectionsClosed = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "marchproxy_connections_closed_total",
+		Help: "Closed connections per module, route and close reason",
+	},
+	[]string{"module", "route", "reason"},
+)
+
+// Close sets the reason the session closed, overriding what its watched
+// connections saw. The first reason wins.
+func (s *Session) Close(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed == "" {
+		s.closed = reason
+	}
+}
+
+// WatchClient wraps the client connection so the session sees how its
+// reads end
+func (s *Session) WatchClient(conn net.Conn) net.Conn {
+	return &watchedConn{Conn: conn, session: s, eof: CloseClientEOF}
+}
+
+// WatchBackend wraps a backend connection so the session sees how its
+// reads end. Pooled connections must be returned unwrapped.
+func (s *Session) WatchBackend(conn net.Conn) net.Conn {
+	return &watchedConn{Conn: conn, session: s, eof: CloseBackendEOF}
+}
+
+// observe records how the first connection read to end did so. Reads on a
+// connection the relay already closed are the result of another end.
+func (s *Session) observe(eof string, err error) {
+	var reason string
+	var netErr net.Error
+	switch {
+	case errors.Is(err, net.ErrClosed):
+		return
+	case errors.Is(err, io.EOF):
+		reason = eof
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = CloseIdleTimeout
+	default:
+		reason = CloseError
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.observed == "" {
+		s.observed = reason
+	}
+}
+
+// closeReason returns why the session closed: the handler's reason, else
+// the first connection read to end, else an error if the session failed
+func (s *Session) closeReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closed != "":
+		return s.closed
+	case s.observed != "":
+		return s.observed
+	case s.reason != "":
+		return CloseError
+	default:
+		return CloseClientEOF
+	}
+}
+
+// watchedConn reports the end of its reads to a session
+type watchedConn struct {
+	net.Conn
+	session *Session
+	eof     string
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.session.observe(c.eof, err)
+	}
+	return n, err
+}
+
+// SetCloseReason sets the close reason of the session watching conn, if any
+func SetCloseReason(conn net.Conn, reason string) {
+	if watched, ok := conn.(*watchedConn); ok {
+		watched.session.Close(reason)
+	}
+}
+
+// ConnectionRejected counts a connection closed on route before a session
+// started, such as by a connection rate limit
+func ConnectionRejected(route string) {
+	connectionsClosed.WithLabelValues(redModule, route, ClosePolicyDenied).Inc()
+}
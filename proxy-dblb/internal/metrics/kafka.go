@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Kafka route metrics
+	kafkaRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "marchproxy_dblb",
+			Subsystem: "kafka",
+			Name:      "requests_total",
+			Help:      "Kafka requests relayed per route and API",
+		},
+		[]string{"route", "api"},
+	)
+
+	kafkaDenied = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "marchproxy_dblb",
+			Subsystem: "kafka",
+			Name:      "denied_total",
+			Help:      "Kafka requests refused per route and operation (produce, consume, admin, version)",
+		},
+		[]string{"route", "operation"},
+	)
+
+	kafkaRewrites = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "marchproxy_dblb",
+			Subsystem: "kafka",
+			Name:      "rewritten_responses_total",
+			Help:      "Kafka responses whose broker addresses were rewritten, per route and API",
+		},
+		[]string{"route", "api"},
+	)
+
+	kafkaBrokers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "marchproxy_dblb",
+			Subsystem: "kafka",
+			Name:      "brokers",
+			Help:      "Brokers with a proxy listener per route",
+		},
+		[]string{"route"},
+	)
+)
+
+// IncKafkaRequest counts a relayed Kafka request
+func IncKafkaRequest(route, api string) {
+	kafkaRequests.WithLabelValues(route, api).Inc()
+}
+
+// IncKafkaDenied counts a refused Kafka request
+func IncKafkaDenied(route, operation string) {
+	kafkaDenied.WithLabelValues(route, operation).Inc()
+}
+
+// IncKafkaRewrite counts a response with rewritten broker addresses
+func IncKafkaRewrite(route, api string) {
+	kafkaRewrites.WithLabelValues(route, api).Inc()
+}
+
+// SetKafkaBrokers sets the number of brokers a route listens for
+func SetKafkaBrokers(route string, brokers int) {
+	kafkaBrokers.WithLabelValues(route).Set(float64(brokers))
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RED metrics shared by every MarchProxy module. The DBLB reports each
+// client session, from accept to close, with the same names and labels the
+// other modules use for their unit of work.
+const (
+	redModule        = "dblb"
+	redDefaultTenant = "default"
+)
+
+// redDurationBuckets are the latency bounds used by every module in seconds
+var redDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	redRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_requests_total",
+			Help: "Requests handled per module, route, backend and tenant",
+		},
+		[]string{"module", "route", "backend", "tenant"},
+	)
+
+	redErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_request_errors_total",
+			Help: "Failed requests per module, route, backend, tenant and reason",
+		},
+		[]string{"module", "route", "backend", "tenant", "reason"},
+	)
+
+	redDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "marchproxy_request_duration_seconds",
+			Help:    "Request latency per module, route, backend and tenant",
+			Buckets: redDurationBuckets,
+		},
+		[]string{"module", "route", "backend", "tenant"},
+	)
+)
+
+// Session records one client session in the RED metrics and the reason it
+// closed. Its connection's relay goroutines may report concurrently.
+type Session struct {
+	route   string
+	backend string
+	reason  string
+	start   time.Time
+
+	mu       sync.Mutex
+	closed   string // Close reason set by the handler
+	observed string // Close reason seen on the first connection read to end
+}
+
+// StartSession begins timing a session on route towards backend
+func StartSession(route, backend string) *Session {
+	return &Session{route: route, backend: backend, start: time.Now()}
+}
+
+// SetBackend updates the backend once it has been selected
+func (s *Session) SetBackend(backend string) {
+	s.backend = backend
+}
+
+// Fail marks the session as failed. The first reason wins.
+func (s *Session) Fail(reason string) {
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// End records the session's outcome, duration and close reason
+func (s *Session) End() {
+	backend := s.backend
+	if backend == "" {
+		backend = "none"
+	}
+
+	redRequests.WithLabelValues(redModule, s.route, backend, redDefaultTenant).Inc()
+	if s.reason != "" {
+		redErrors.WithLabelValues(redModule, s.route, backend, redDefaultTenant, s.reason).Inc()
+	}
+	redDuration.WithLabelValues(redModule, s.route, backend, redDefaultTenant).Observe(time.Since(s.start).Seconds())
+	connectionsClosed.WithLabelValues(redModule, s.route, s.closeReason()).Inc()
+}
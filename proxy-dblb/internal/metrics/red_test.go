@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherSeries returns the series of the named family on route from the
+// default registry the RED metrics use
+func gatherSeries(t *testing.T, name, route string) []*dto.Metric {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var series []*dto.Metric
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if labelMap(metric)["route"] == route {
+				series = append(series, metric)
+			}
+		}
+	}
+	return series
+}
+
+func labelMap(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range metric.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestSessionSeries(t *testing.T) {
+	route := "red-test-session"
+
+	session := StartSession(route, "")
+	session.SetBackend("db-1")
+	session.start = time.Now().Add(-2 * time.Second)
+	session.End()
+
+	// The first failure wins, and a session that never picked a backend is
+	// reported against backend "none"
+	failed := StartSession(route, "")
+	failed.Fail("auth_failed")
+	failed.Fail("backend_unavailable")
+	failed.End()
+
+	requests := gatherSeries(t, "marchproxy_requests_total", route)
+	if len(requests) != 2 {
+		t.Fatalf("%d request series, want 2", len(requests))
+	}
+	for _, metric := range requests {
+		labels := labelMap(metric)
+		if len(labels) != 4 || labels["module"] != "dblb" || labels["tenant"] != redDefaultTenant || metric.GetCounter().GetValue() != 1 {
+			t.Errorf("request series %v = %v", labels, metric.GetCounter().GetValue())
+		}
+	}
+
+	errors := gatherSeries(t, "marchproxy_request_errors_total", route)
+	if len(errors) != 1 {
+		t.Fatalf("%d error series, want 1", len(errors))
+	}
+	if labels := labelMap(errors[0]); len(labels) != 5 || labels["backend"] != "none" || labels["reason"] != "auth_failed" {
+		t.Errorf("error labels %v", labels)
+	}
+
+	for _, metric := range gatherSeries(t, "marchproxy_request_duration_seconds", route) {
+		if labelMap(metric)["backend"] != "db-1" {
+			continue
+		}
+		buckets := metric.GetHistogram().GetBucket()
+		if len(buckets) != len(redDurationBuckets) {
+			t.Fatalf("%d buckets, want %d", len(buckets), len(redDurationBuckets))
+		}
+		for i, bucket := range buckets {
+			var want uint64
+			if redDurationBuckets[i] >= 2.5 {
+				want = 1
+			}
+			if bucket.GetUpperBound() != redDurationBuckets[i] || bucket.GetCumulativeCount() != want {
+				t.Errorf("bucket le=%g count %d, want le=%g count %d", bucket.GetUpperBound(), bucket.GetCumulativeCount(), redDurationBuckets[i], want)
+			}
+			// Database sessions carry no trace context
+			if bucket.GetExemplar() != nil {
+				t.Errorf("bucket le=%g has exemplar %v", bucket.GetUpperBound(), bucket.GetExemplar())
+			}
+		}
+		return
+	}
+	t.Error("no duration series for backend db-1")
+}
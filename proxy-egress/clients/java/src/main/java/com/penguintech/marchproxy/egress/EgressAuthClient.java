@@ -0,0 +1,210 @@
+package com.penguintech.marchproxy.egress;
+
+import java.io.ByteArrayOutputStream;
+import java.io.EOFException;
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.OutputStream;
+import java.net.InetSocketAddress;
+import java.net.Socket;
+import java.net.SocketException;
+import java.nio.charset.StandardCharsets;
+import java.security.GeneralSecurityException;
+import java.time.Duration;
+import java.time.Instant;
+import java.util.Arrays;
+import javax.crypto.Mac;
+import javax.crypto.spec.SecretKeySpec;
+
+/**
+ * Connects sockets through a mapping of the MarchProxy egress proxy that
+ * requires authentication, answering its handshake as specified in
+ * proto/marchproxy/egress_auth.proto.
+ *
+ * <pre>{@code
+ * EgressAuthClient client = new EgressAuthClient(12, System.getenv("MARCHPROXY_TOKEN"));
+ * try (Socket socket = client.connect("egress.internal", 8081)) {
+ *     // socket carries the destination's bytes
+ * }
+ * }</pre>
+ */
+public final class EgressAuthClient {
+    /** Bounds the handshake lines read from the proxy */
+    private static final int MAX_HANDSHAKE_LINE = 4096;
+
+    private final int serviceId;
+    private final String token;
+    private boolean challenge;
+    private Duration timeout = Duration.ofSeconds(10);
+
+    /** The proxy refused the credentials */
+    public static final class AuthRejectedException extends IOException {
+        private final String reason;
+
+        AuthRejectedException(String reason) {
+            super(reason == null
+                    ? "egress proxy rejected the credentials"
+                    : "egress proxy rejected the credentials: " + reason);
+            this.reason = reason;
+        }
+
+        /** The AUTH_FAIL reason of version 2 proxies, null when the proxy just closed the connection */
+        public String getReason() {
+            return reason;
+        }
+    }
+
+    /**
+     * @param serviceId source service presented to the proxy
+     * @param token     service token or JWT
+     */
+    public EgressAuthClient(int serviceId, String token) {
+        if (serviceId <= 0) {
+            throw new IllegalArgumentException("a positive service ID is required");
+        }
+        this.serviceId = serviceId;
+        this.token = token;
+    }
+
+    /**
+     * Answer a nonce with an HMAC proof instead of sending the token. Only
+     * static service tokens can be proven, not JWTs.
+     */
+    public EgressAuthClient withChallenge(boolean challenge) {
+        this.challenge = challenge;
+        return this;
+    }
+
+    /** Bounds connecting and the handshake, 10 seconds by default */
+    public EgressAuthClient withTimeout(Duration timeout) {
+        this.timeout = timeout;
+        return this;
+    }
+
+    /** Connects to the mapping listening at host and port and authenticates */
+    public Socket connect(String host, int port) throws IOException {
+        Socket socket = new Socket();
+        try {
+            int millis = (int) timeout.toMillis();
+            socket.connect(new InetSocketAddress(host, port), millis);
+            socket.setSoTimeout(millis);
+            authenticate(socket);
+            socket.setSoTimeout(0);
+            return socket;
+        } catch (IOException | RuntimeException e) {
+            socket.close();
+            throw e;
+        }
+    }
+
+    /** Answers the handshake of the proxy on a connected socket */
+    public void authenticate(Socket socket) throws IOException {
+        InputStream in = socket.getInputStream();
+        OutputStream out = socket.getOutputStream();
+
+        String line = readLine(in);
+        if (!line.equals(EgressAuthProtocol.BANNER)) {
+            throw new IOException("unexpected handshake from egress proxy: " + line);
+        }
+        String latest = Integer.toString(EgressAuthProtocol.LATEST_VERSION);
+        boolean versioned = false;
+        while (!line.equals(EgressAuthProtocol.PROMPT)) {
+            line = readLine(in);
+            if (line.startsWith(EgressAuthProtocol.VERSIONS + " ")) {
+                versioned = Arrays.asList(line.substring(EgressAuthProtocol.VERSIONS.length() + 1).split(" ")).contains(latest);
+            }
+        }
+
+        if (versioned) {
+            send(out, EgressAuthProtocol.VERSION_REQUEST + " " + latest);
+            line = readReply(in);
+            if (!line.equals(EgressAuthProtocol.VERSION_ACCEPTED + " " + latest)) {
+                throw unexpected(line);
+            }
+        }
+
+        String answer = token;
+        if (challenge) {
+            send(out, EgressAuthProtocol.CHALLENGE_REQUEST);
+            line = readReply(in);
+            String prefix = EgressAuthProtocol.CHALLENGE + " ";
+            if (!line.startsWith(prefix) || line.length() == prefix.length()) {
+                throw unexpected(line);
+            }
+            String nonce = line.substring(prefix.length());
+            long timestamp = Instant.now().getEpochSecond();
+            answer = nonce + ":" + timestamp + ":" + challengeProof(serviceId, token, nonce, timestamp);
+        }
+
+        send(out, serviceId + ":" + answer);
+        line = readReply(in);
+        if (!line.equals(EgressAuthProtocol.OK)) {
+            throw unexpected(line);
+        }
+    }
+
+    /** Hex HMAC-SHA256 of "SERVICE_ID:NONCE:TIMESTAMP" keyed with the token */
+    public static String challengeProof(int serviceId, String token, String nonce, long timestamp) {
+        try {
+            Mac mac = Mac.getInstance("HmacSHA256");
+            mac.init(new SecretKeySpec(token.getBytes(StandardCharsets.UTF_8), "HmacSHA256"));
+            byte[] sum = mac.doFinal((serviceId + ":" + nonce + ":" + timestamp).getBytes(StandardCharsets.UTF_8));
+            StringBuilder hex = new StringBuilder(sum.length * 2);
+            for (byte b : sum) {
+                hex.append(String.format("%02x", b));
+            }
+            return hex.toString();
+        } catch (GeneralSecurityException e) {
+            throw new IllegalStateException("HmacSHA256 unavailable", e);
+        }
+    }
+
+    private static void send(OutputStream out, String line) throws IOException {
+        out.write((line + "\n").getBytes(StandardCharsets.UTF_8));
+        out.flush();
+    }
+
+    /**
+     * Reads a reply to the client's line; the proxy closing the connection
+     * instead means it refused the credentials
+     */
+    private static String readReply(InputStream in) throws IOException {
+        try {
+            return readLine(in);
+        } catch (EOFException e) {
+            throw new AuthRejectedException(null);
+        } catch (SocketException e) {
+            throw new AuthRejectedException(null); // Connection reset
+        }
+    }
+
+    /**
+     * Reads one handshake line without its line ending. Reads a byte at a
+     * time so none of the destination's bytes are consumed.
+     */
+    private static String readLine(InputStream in) throws IOException {
+        ByteArrayOutputStream line = new ByteArrayOutputStream();
+        while (true) {
+            int b = in.read();
+            if (b < 0) {
+                throw new EOFException("egress proxy closed the connection during the handshake");
+            }
+            if (b == '\n') {
+                String s = line.toString(StandardCharsets.UTF_8.name());
+                return s.endsWith("\r") ? s.substring(0, s.length() - 1) : s;
+            }
+            line.write(b);
+            if (line.size() > MAX_HANDSHAKE_LINE) {
+                throw new IOException("handshake line longer than " + MAX_HANDSHAKE_LINE + " bytes");
+            }
+        }
+    }
+
+    private static IOException unexpected(String line) {
+        String prefix = EgressAuthProtocol.FAIL + " ";
+        if (line.startsWith(prefix)) {
+            return new AuthRejectedException(line.substring(prefix.length()));
+        }
+        return new IOException("unexpected reply from egress proxy: " + line);
+    }
+}
@@ -0,0 +1,5 @@
+"""MarchProxy egress proxy client helpers"""
+
+from .client import AuthRejected, ProtocolError, authenticate, challenge_proof, connect
+
+__all__ = ["AuthRejected", "ProtocolError", "authenticate", "challenge_proof", "connect"]
@@ -0,0 +1,148 @@
+"""
+Egress proxy authentication for Python applications
+
+Connects a socket through a mapping of the MarchProxy egress proxy that
+requires authentication, answering its handshake as specified in
+proto/marchproxy/egress_auth.proto. The returned socket carries the
+destination's bytes, so it can be wrapped in TLS or handed to any library
+that accepts a connected socket.
+"""
+
+import hashlib
+import hmac
+import socket
+import time
+from typing import Optional
+
+from . import protocol
+
+# Bounds the handshake lines read from the proxy
+MAX_HANDSHAKE_LINE = 4096
+
+
+class AuthRejected(Exception):
+    """The proxy refused the credentials. reason is the AUTH_FAIL reason of
+    version 2 proxies, None when the proxy just closed the connection."""
+
+    def __init__(self, reason: Optional[str] = None):
+        self.reason = reason
+        super().__init__(
+            f"egress proxy rejected the credentials: {reason}"
+            if reason
+            else "egress proxy rejected the credentials"
+        )
+
+
+class ProtocolError(Exception):
+    """The proxy sent something the handshake doesn't allow"""
+
+
+def challenge_proof(service_id: int, token: str, nonce: str, timestamp: int) -> str:
+    """Hex HMAC-SHA256 of "SERVICE_ID:NONCE:TIMESTAMP" keyed with the token"""
+    message = f"{service_id}:{nonce}:{timestamp}".encode()
+    return hmac.new(token.encode(), message, hashlib.sha256).hexdigest()
+
+
+def connect(
+    address: tuple,
+    service_id: int,
+    token: str,
+    challenge: bool = False,
+    timeout: float = 10.0,
+) -> socket.socket:
+    """
+    Connect to the egress proxy listener of a mapping and authenticate
+
+    Args:
+        address: (host, port) of the mapping's listener
+        service_id: Source service presented to the proxy
+        token: Service token or JWT
+        challenge: Answer a nonce with an HMAC proof instead of sending the
+            token. Only static service tokens can be proven, not JWTs.
+        timeout: Seconds for connecting and the handshake
+
+    Returns:
+        The connected socket, without a timeout
+
+    Raises:
+        AuthRejected: The proxy refused the credentials
+        ProtocolError: The proxy sent an unexpected line
+        OSError: The connection failed
+    """
+    sock = socket.create_connection(address, timeout=timeout)
+    try:
+        authenticate(sock, service_id, token, challenge)
+    except BaseException:
+        sock.close()
+        raise
+    sock.settimeout(None)
+    return sock
+
+
+def authenticate(sock: socket.socket, service_id: int, token: str, challenge: bool = False) -> None:
+    """Answer the handshake of the proxy on a connected socket"""
+    line = _read_line(sock)
+    if line != protocol.BANNER:
+        raise ProtocolError(f"unexpected handshake from egress proxy: {line!r}")
+
+    versioned = False
+    while line != protocol.PROMPT:
+        line = _read_line(sock)
+        keyword, _, versions = line.partition(" ")
+        if keyword == protocol.VERSIONS:
+            versioned = str(protocol.LATEST_VERSION) in versions.split()
+
+    if versioned:
+        _send(sock, f"{protocol.VERSION_REQUEST} {protocol.LATEST_VERSION}")
+        line = _read_reply(sock)
+        if line != f"{protocol.VERSION_ACCEPTED} {protocol.LATEST_VERSION}":
+            raise _unexpected(line)
+
+    answer = token
+    if challenge:
+        _send(sock, protocol.CHALLENGE_REQUEST)
+        keyword, _, nonce = _read_reply(sock).partition(" ")
+        if keyword != protocol.CHALLENGE or not nonce:
+            raise _unexpected(f"{keyword} {nonce}")
+        timestamp = int(time.time())
+        answer = f"{nonce}:{timestamp}:{challenge_proof(service_id, token, nonce, timestamp)}"
+
+    _send(sock, f"{service_id}:{answer}")
+    line = _read_reply(sock)
+    if line != protocol.OK:
+        raise _unexpected(line)
+
+
+def _send(sock: socket.socket, line: str) -> None:
+    sock.sendall(line.encode() + b"\n")
+
+
+def _read_reply(sock: socket.socket) -> str:
+    """Read a reply to the client's line; the proxy closing the connection
+    instead means it refused the credentials"""
+    try:
+        return _read_line(sock)
+    except (ConnectionResetError, EOFError):
+        raise AuthRejected() from None
+
+
+def _read_line(sock: socket.socket) -> str:
+    """Read one handshake line without its line ending. Reads a byte at a
+    time so none of the destination's bytes are consumed."""
+    line = bytearray()
+    while True:
+        byte = sock.recv(1)
+        if not byte:
+            raise EOFError("egress proxy closed the connection during the handshake")
+        if byte == b"\n":
+            return line.decode(errors="replace").rstrip("\r")
+        line += byte
+        if len(line) > MAX_HANDSHAKE_LINE:
+            raise ProtocolError(f"handshake line longer than {MAX_HANDSHAKE_LINE} bytes")
+
+
+def _unexpected(line: str) -> Exception:
+    keyword, _, reason = line.partition(" ")
+    if keyword == protocol.FAIL:
+        return AuthRejected(reason)
+    return ProtocolError(f"unexpected reply from egress proxy: {line!r}")
@@ -0,0 +1,93 @@
+"""Tests for the egress proxy client helpers against a fake proxy"""
+
+import socket
+import threading
+import unittest
+
+from marchproxy_egress import AuthRejected, challenge_proof, connect
+
+BANNER_V1 = b"MARCHPROXY_AUTH\nPlease provide authentication in format:\nSERVICE_ID:TOKEN\n"
+BANNER_V2 = b"MARCHPROXY_AUTH\nPlease provide authentication in format:\nAUTH_VERSIONS 1 2\nSERVICE_ID:TOKEN\n"
+
+
+class FakeProxy:
+    """Answers one handshake per connection like the egress proxy, accepting
+    service 7 with token "secret" or a challenge proof of it, and greeting
+    with "hello" after AUTH_OK"""
+
+    def __init__(self, banner):
+        self.banner = banner
+        self.listener = socket.create_server(("127.0.0.1", 0))
+        self.address = self.listener.getsockname()
+        threading.Thread(target=self._serve, daemon=True).start()
+
+    def close(self):
+        self.listener.close()
+
+    def _serve(self):
+        while True:
+            try:
+                conn, _ = self.listener.accept()
+            except OSError:
+                return
+            threading.Thread(target=self._handle, args=(conn,), daemon=True).start()
+
+    def _handle(self, conn):
+        with conn, conn.makefile("rb") as reader:
+            conn.sendall(self.banner)
+            line = reader.readline().decode().strip()
+            version = 1
+            if line.startswith("VERSION "):
+                version = int(line.split()[1])
+                conn.sendall(f"AUTH_VERSION {version}\n".encode())
+                line = reader.readline().decode().strip()
+            if line == "CHALLENGE":
+                conn.sendall(b"AUTH_CHALLENGE abc123\n")
+                line = reader.readline().decode().strip()
+                service_id, _, answer = line.partition(":")
+                nonce, timestamp, proof = answer.split(":")
+                accepted = proof == challenge_proof(7, "secret", nonce, int(timestamp))
+            else:
+                accepted = line == "7:secret"
+            if not accepted:
+                if version >= 2:
+                    conn.sendall(b"AUTH_FAIL denied\n")
+                return
+            conn.sendall(b"AUTH_OK\nhello\n")
+
+
+class ConnectTest(unittest.TestCase):
+    def expect_greeting(self, sock):
+        with sock:
+            self.assertEqual(sock.recv(6), b"hello\n")
+
+    def test_versions(self):
+        for banner in (BANNER_V1, BANNER_V2):
+            proxy = FakeProxy(banner)
+            self.addCleanup(proxy.close)
+            self.expect_greeting(connect(proxy.address, 7, "secret"))
+            self.expect_greeting(connect(proxy.address, 7, "secret", challenge=True))
+
+    def test_rejected(self):
+        proxy = FakeProxy(BANNER_V1)
+        self.addCleanup(proxy.close)
+        with self.assertRaises(AuthRejected) as caught:
+            connect(proxy.address, 7, "wrong")
+        self.assertIsNone(caught.exception.reason)
+
+        proxy = FakeProxy(BANNER_V2)
+        self.addCleanup(proxy.close)
+        with self.assertRaises(AuthRejected) as caught:
+            connect(proxy.address, 7, "wrong")
+        self.assertEqual(caught.exception.reason, "denied")
+
+    def test_challenge_proof(self):
+        # Matches egressclient.ChallengeProof of the Go client
+        self.assertEqual(
+            challenge_proof(7, "secret", "abc123", 1700000000),
+            "6cc8bf3c9ef9e5ad8488f35e21d00358c61203aff4e74bf1b94ab9945605f1d6",
+        )
+
+
+if __name__ == "__main__":
+    unittest.main()
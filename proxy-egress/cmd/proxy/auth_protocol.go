@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TCP handshake versions, as specified in proto/marchproxy/egress_auth.proto.
+// The banner lists the versions the proxy speaks on an AUTH_VERSIONS line
+// before the SERVICE_ID:TOKEN prompt. A client that sends "VERSION <n>" in
+// place of its credentials line gets "AUTH_VERSION <n>" and then answers
+// as before; clients that don't send one speak version 1.
+//
+// Version 2 replies "AUTH_FAIL <reason>" before closing a connection it
+// refuses, where version 1 just closes it.
+const (
+	authVersion1      = 1
+	authVersion2      = 2
+	authVersionLatest = authVersion2
+
+	authVersions        = "AUTH_VERSIONS"
+	authVersionRequest  = "VERSION"
+	authVersionAccepted = "AUTH_VERSION"
+)
+
+// Reasons of an AUTH_FAIL reply. They tell a client what to fix without
+// telling it which of the service ID or token was wrong.
+const (
+	authFailMalformed          = "malformed"
+	authFailDenied             = "denied"
+	authFailUnsupportedVersion = "unsupported_version"
+	authFailUnavailable        = "unavailable"
+)
+
+// authBanner is the greeting of a mapping that requires authentication
+func authBanner() string {
+	versions := make([]string, 0, authVersionLatest)
+	for v := authVersion1; v <= authVersionLatest; v++ {
+		versions = append(versions, strconv.Itoa(v))
+	}
+	return "MARCHPROXY_AUTH\nPlease provide authentication in format:\n" +
+		authVersions + " " + strings.Join(versions, " ") + "\nSERVICE_ID:TOKEN\n"
+}
+
+// parseVersionRequest returns the version a "VERSION <n>" line asks for.
+// ok is false for any other line. An unsupported or unparsable version
+// returns an error.
+func parseVersionRequest(line string) (version int, ok bool, err error) {
+	arg, found := strings.CutPrefix(strings.TrimSpace(line), authVersionRequest+" ")
+	if !found {
+		return 0, false, nil
+	}
+	version, err = strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || version < authVersion1 || version > authVersionLatest {
+		return 0, true, fmt.Errorf("unsupported auth protocol version %q", arg)
+	}
+	return version, true, nil
+}
+
+// writeAuthFailure tells a version 2 client why its handshake was refused.
+// Version 1 clients only see the connection close.
+func writeAuthFailure(conn net.Conn, version int, reason string) {
+	if version < authVersion2 {
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("%s %s\n", udpAuthFail, reason)))
+}
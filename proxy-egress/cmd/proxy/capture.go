@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"marchproxy-egress/internal/capture"
+	"marchproxy-egress/internal/config"
+)
+
+// newCaptureManager creates the on-demand capture manager, nil when the
+// capture API is disabled
+func newCaptureManager(cfg *config.Config) *capture.Manager {
+	if !cfg.CaptureEnabled {
+		return nil
+	}
+	return capture.NewManager(capture.Limits{
+		MaxDuration: time.Duration(cfg.CaptureMaxDuration) * time.Second,
+		MaxBytes:    int64(cfg.CaptureMaxBytes) * 1024 * 1024,
+	})
+}
+
+// captureHandler serves /admin/capture:
+//
+//	GET    /admin/capture           list captures
+//	POST   /admin/capture           start a capture
+//	GET    /admin/capture/{id}      capture status
+//	POST   /admin/capture/{id}/stop stop a running capture
+//	GET    /admin/capture/{id}/pcap download the pcap captured so far
+//	DELETE /admin/capture/{id}      stop and discard a capture
+func captureHandler(captures *capture.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if captures == nil {
+			http.Error(w, "packet capture is disabled, set capture_enabled", http.StatusNotFound)
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/capture"), "/")
+		if path == "" {
+			switch r.Method {
+			case http.MethodGet:
+				writeCaptureJSON(w, http.StatusOK, captures.List())
+			case http.MethodPost:
+				startCapture(w, r, captures)
+			default:
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+
+		id, action, _ := strings.Cut(path, "/")
+		session, ok := captures.Get(id)
+		if !ok {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			writeCaptureJSON(w, http.StatusOK, session.Status())
+		case action == "" && r.Method == http.MethodDelete:
+			captures.Delete(id)
+			w.WriteHeader(http.StatusNoContent)
+		case action == "stop" && r.Method == http.MethodPost:
+			captures.Stop(id)
+			writeCaptureJSON(w, http.StatusOK, session.Status())
+		case action == "pcap" && r.Method == http.MethodGet:
+			data := session.Pcap()
+			w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"capture-%s.pcap\"", id))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		case action == "" || action == "stop" || action == "pcap":
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
+
+// startCapture starts a capture from a JSON request body
+func startCapture(w http.ResponseWriter, r *http.Request, captures *capture.Manager) {
+	var req capture.Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid capture request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	session, err := captures.Start(req)
+	if errors.Is(err, capture.ErrBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := session.Status()
+	fmt.Printf("Packet capture %s started on %q with filter %q for %ds\n",
+		status.ID, status.Interface, status.Filter, req.Duration)
+	writeCaptureJSON(w, http.StatusCreated, status)
+}
+
+func writeCaptureJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
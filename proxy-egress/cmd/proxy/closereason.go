@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/counters"
+	"marchproxy-egress/internal/dlp"
+	"marchproxy-egress/internal/sshaudit"
+)
+
+// Connection close reasons shared by every MarchProxy module, so backend
+// failures can be told apart from client churn with one set of dashboards
+const (
+	closeClientEOF    = "client_eof"    // The client closed its side first
+	closeBackendEOF   = "backend_eof"   // The backend closed its side first
+	closeAuthFailure  = "auth_failure"  // The client failed to authenticate
+	closePolicyDenied = "policy_denied" // No mapping allowed the client
+	closeIdleTimeout  = "idle_timeout"  // No data moved for the idle timeout
+	closeDrain        = "drain"         // Closed by the proxy while shutting down
+	closeError        = "error"         // Handshake, dial or relay error
+)
+
+// errIdleTimeout ends a relay that moved no data for the idle timeout
+var errIdleTimeout = errors.New("connection idle timeout")
+
+// closeKey identifies one close counter
+type closeKey struct {
+	route  string
+	reason string
+}
+
+// closeMetrics counts closed connections per route and close reason
+type closeMetrics struct {
+	counts counters.Labeled[closeKey]
+}
+
+// record counts one closed connection
+func (m *closeMetrics) record(route, reason string) {
+	if m == nil {
+		return
+	}
+	if route == "" {
+		route = "none"
+	}
+	m.counts.Inc(closeKey{route: route, reason: reason})
+}
+
+// totals returns the closed connections over every route and how many of
+// them ended in an error
+func (m *closeMetrics) totals() (closed, failed uint64) {
+	if m == nil {
+		return 0, 0
+	}
+
+	for key, count := range m.counts.Snapshot() {
+		closed += count
+		if key.reason == closeError {
+			failed += count
+		}
+	}
+	return closed, failed
+}
+
+// writePrometheus writes the close counts in Prometheus text format
+func (m *closeMetrics) writePrometheus(w io.Writer) {
+	counts := m.counts.Snapshot()
+	keys := make([]closeKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	fmt.Fprintf(w, "# HELP marchproxy_connections_closed_total Closed connections per module, route and close reason\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_connections_closed_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, `marchproxy_connections_closed_total{module="%s",route="%s",reason="%s"} %d`+"\n",
+			redModule, key.route, key.reason, counts[key])
+	}
+}
+
+// relayResult is how one direction of a relay ended
+type relayResult struct {
+	fromClient bool // The client -> backend direction
+	err        error
+}
+
+// closeReason classifies a relay by the direction that finished first
+func (r relayResult) closeReason() string {
+	switch {
+	case errors.Is(r.err, errIdleTimeout):
+		return closeIdleTimeout
+	case errors.Is(r.err, dlp.ErrBlocked), errors.Is(r.err, sshaudit.ErrNotSSH):
+		return closePolicyDenied
+	case r.err != nil && r.err != io.EOF:
+		return closeError
+	case r.fromClient:
+		return closeClientEOF
+	default:
+		return closeBackendEOF
+	}
+}
+
+// idleTracker ends a relay once neither direction has moved data for the
+// timeout. Long-lived streams that only send one way stay open as long as
+// that direction is active.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the last read that returned data
+}
+
+// newIdleTracker returns a tracker for one relay, nil when timeout is 0
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTracker{timeout: timeout}
+	t.last.Store(time.Now().UnixNano())
+	return t
+}
+
+// reader wraps one side of the relay so its reads count as activity
+func (t *idleTracker) reader(conn net.Conn) io.Reader {
+	if t == nil {
+		return conn
+	}
+	return &idleReader{conn: conn, tracker: t}
+}
+
+// idle returns true if no data moved in either direction for the timeout
+func (t *idleTracker) idle() bool {
+	return time.Since(time.Unix(0, t.last.Load())) >= t.timeout
+}
+
+// idleReader reads from one side of a relay with the tracker's timeout
+type idleReader struct {
+	conn    net.Conn
+	tracker *idleTracker
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	for {
+		r.conn.SetReadDeadline(time.Now().Add(r.tracker.timeout))
+		n, err := r.conn.Read(b)
+		if n > 0 {
+			r.tracker.last.Store(time.Now().UnixNano())
+		}
+
+		// A quiet side keeps waiting while the other one is active
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+			if r.tracker.idle() {
+				return 0, errIdleTimeout
+			}
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/dlp"
+	"marchproxy-egress/internal/sshaudit"
+)
+
+func TestRelayCloseReason(t *testing.T) {
+	tests := []struct {
+		result relayResult
+		want   string
+	}{
+		{relayResult{fromClient: true}, closeClientEOF},
+		{relayResult{fromClient: true, err: io.EOF}, closeClientEOF},
+		{relayResult{fromClient: false}, closeBackendEOF},
+		{relayResult{fromClient: false, err: errIdleTimeout}, closeIdleTimeout},
+		{relayResult{fromClient: true, err: dlp.ErrBlocked}, closePolicyDenied},
+		{relayResult{fromClient: true, err: sshaudit.ErrNotSSH}, closePolicyDenied},
+		{relayResult{fromClient: true, err: errors.New("connection reset by peer")}, closeError},
+	}
+	for _, tt := range tests {
+		if got := tt.result.closeReason(); got != tt.want {
+			t.Errorf("closeReason(%+v) = %s, want %s", tt.result, got, tt.want)
+		}
+	}
+}
+
+func TestIdleTracker(t *testing.T) {
+	if newIdleTracker(0) != nil {
+		t.Fatal("Expected no tracker without a timeout")
+	}
+
+	idle := newIdleTracker(100 * time.Millisecond)
+	quiet, quietPeer := net.Pipe()
+	busy, busyPeer := net.Pipe()
+	defer quietPeer.Close()
+	defer busyPeer.Close()
+
+	// The quiet side outlives the timeout while the busy side sends
+	go func() {
+		for i := 0; i < 6; i++ {
+			busyPeer.Write([]byte("x"))
+			time.Sleep(40 * time.Millisecond)
+		}
+	}()
+	go io.Copy(io.Discard, idle.reader(busy))
+
+	start := time.Now()
+	_, err := idle.reader(quiet).Read(make([]byte, 1))
+	if !errors.Is(err, errIdleTimeout) {
+		t.Fatalf("Expected an idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Idle timeout after %v while the other side was active", elapsed)
+	}
+}
+
+func TestUDPSessionCloses(t *testing.T) {
+	var closes closeMetrics
+	table := newUDPSessionTable(time.Minute, &closes)
+	table.create("10.0.0.1:1000", 1, 1, "dns")
+	table.create("10.0.0.2:1000", 2, 1, "dns")
+	table.create("10.0.0.3:1000", 1, 2, "ntp")
+
+	table.sessions["10.0.0.1:1000"].LastSeen = time.Now().Add(-2 * time.Minute)
+	if removed := table.expire(); removed != 1 {
+		t.Fatalf("Expected 1 expired session, got %d", removed)
+	}
+	if removed := table.closeAll(closeDrain); removed != 2 {
+		t.Fatalf("Expected 2 drained sessions, got %d", removed)
+	}
+
+	var buf bytes.Buffer
+	closes.writePrometheus(&buf)
+	for _, want := range []string{
+		`marchproxy_connections_closed_total{module="egress",route="dns",reason="drain"} 1`,
+		`marchproxy_connections_closed_total{module="egress",route="dns",reason="idle_timeout"} 1`,
+		`marchproxy_connections_closed_total{module="egress",route="ntp",reason="drain"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, buf.String())
+		}
+	}
+}
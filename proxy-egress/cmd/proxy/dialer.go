@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/connpool"
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/slo"
+	"marchproxy-egress/internal/upstreamproxy"
+	"marchproxy-shared/netutil"
+)
+
+// dialLatencyBuckets are the histogram upper bounds for connect latency in seconds
+var dialLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// dialHistogram tracks connect latency and failures for one mapping
+type dialHistogram struct {
+	buckets  []uint64
+	count    uint64
+	sum      float64
+	failures uint64
+}
+
+// dialMetrics holds per-mapping dial latency histograms
+type dialMetrics struct {
+	mappings map[string]*dialHistogram
+	mu       sync.Mutex
+}
+
+// observe records a dial attempt for a mapping
+func (m *dialMetrics) observe(mapping string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mappings == nil {
+		m.mappings = make(map[string]*dialHistogram)
+	}
+	h, exists := m.mappings[mapping]
+	if !exists {
+		h = &dialHistogram{buckets: make([]uint64, len(dialLatencyBuckets))}
+		m.mappings[mapping] = h
+	}
+
+	if err != nil {
+		h.failures++
+		return
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range dialLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// writePrometheus writes the histograms in Prometheus text format
+func (m *dialMetrics) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.mappings))
+	for name := range m.mappings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP marchproxy_dial_duration_seconds Outbound connect latency per mapping\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_dial_duration_seconds histogram\n")
+	for _, name := range names {
+		h := m.mappings[name]
+		for i, bound := range dialLatencyBuckets {
+			fmt.Fprintf(w, `marchproxy_dial_duration_seconds_bucket{mapping="%s",le="%g"} %d`+"\n", name, bound, h.buckets[i])
+		}
+		fmt.Fprintf(w, `marchproxy_dial_duration_seconds_bucket{mapping="%s",le="+Inf"} %d`+"\n", name, h.count)
+		fmt.Fprintf(w, `marchproxy_dial_duration_seconds_sum{mapping="%s"} %g`+"\n", name, h.sum)
+		fmt.Fprintf(w, `marchproxy_dial_duration_seconds_count{mapping="%s"} %d`+"\n", name, h.count)
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_dial_failures_total Outbound connect failures per mapping\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_dial_failures_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, `marchproxy_dial_failures_total{mapping="%s"} %d`+"\n", name, m.mappings[name].failures)
+	}
+}
+
+// mappingDialer is a cached dialer and the options it was built from
+type mappingDialer struct {
+	opts   netutil.DialOptions
+	dialer *netutil.Dialer
+}
+
+// outboundDialers builds and caches outbound dialers per mapping so source
+// address round-robin state survives across connections
+type outboundDialers struct {
+	config    *config.Config
+	metrics   *ProxyMetrics
+	fallback  *netutil.Dialer
+	upstreams *upstreamproxy.Set // Upstream proxies mappings are chained through
+	pool      *connpool.Pool     // Warm destination connections of the TCP proxy
+	resolver  *dnsproxy.Resolver // Destination host names, under the egress DNS policy
+	mappings  map[int]*mappingDialer
+	mu        sync.Mutex
+}
+
+// newOutboundDialers creates the dialer cache from the global outbound settings
+func newOutboundDialers(cfg *config.Config, metrics *ProxyMetrics) (*outboundDialers, error) {
+	timeout := time.Duration(cfg.ResolverTimeout) * time.Second
+	var resolverUpstreams []*dnsproxy.Upstream
+	for _, address := range cfg.ResolverUpstreams {
+		upstream, err := dnsproxy.ParseUpstream(address, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver upstream: %w", err)
+		}
+		resolverUpstreams = append(resolverUpstreams, upstream)
+	}
+	resolver := dnsproxy.NewResolver(dnsproxy.ResolverOptions{
+		Upstreams: resolverUpstreams,
+		Cache:     dnsproxy.NewCache(cfg.ResolverCacheSize, time.Duration(cfg.ResolverCacheMaxTTL)*time.Second),
+	})
+	metrics.Resolver = resolver
+
+	opts := cfg.GetDialOptions()
+	opts.Resolver = resolver
+	fallback, err := netutil.NewDialer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound dial configuration: %w", err)
+	}
+
+	var roots *x509.CertPool
+	if cfg.UpstreamProxyTLSCA != "" {
+		pem, err := os.ReadFile(cfg.UpstreamProxyTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream proxy CA: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in upstream proxy CA %s", cfg.UpstreamProxyTLSCA)
+		}
+	}
+	upstreams, err := upstreamproxy.NewSet(cfg.UpstreamProxies, upstreamproxy.Options{
+		Timeout:  time.Duration(cfg.UpstreamProxyTimeout) * time.Second,
+		Cooldown: time.Duration(cfg.UpstreamProxyCooldown) * time.Second,
+		RootCAs:  roots,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxies: %w", err)
+	}
+	metrics.UpstreamProxies = upstreams
+
+	pool := connpool.New(connpool.Options{
+		IdleTimeout: time.Duration(cfg.UpstreamPoolIdleTimeout) * time.Second,
+		DialTimeout: time.Duration(cfg.ConnectionTimeout) * time.Second,
+		HealthCheck: cfg.UpstreamPoolHealthCheck,
+	})
+	metrics.UpstreamPool = pool
+
+	return &outboundDialers{
+		config:    cfg,
+		metrics:   metrics,
+		fallback:  fallback,
+		upstreams: upstreams,
+		pool:      pool,
+		resolver:  resolver,
+		mappings:  make(map[int]*mappingDialer),
+	}, nil
+}
+
+// close closes the pooled destination connections
+func (o *outboundDialers) close() {
+	o.pool.Close()
+}
+
+// updateConfiguration applies the egress DNS policy of a new cluster config
+func (o *outboundDialers) updateConfiguration(clusterConfig *manager.ClusterConfig) {
+	policy := clusterConfig.EgressDNS
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			fmt.Printf("Warning: Ignoring the egress DNS policy: %v\n", err)
+			policy = nil
+		}
+	}
+	o.resolver.SetPolicy(policy)
+}
+
+// forMapping returns the dialer for a mapping, applying its overrides
+func (o *outboundDialers) forMapping(mapping *manager.Mapping) *netutil.Dialer {
+	opts := mappingDialOptions(o.config.GetDialOptions(), mapping)
+	opts.Resolver = o.resolver
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if cached, exists := o.mappings[mapping.ID]; exists && reflect.DeepEqual(cached.opts, opts) {
+		return cached.dialer
+	}
+
+	dialer, err := netutil.NewDialer(opts)
+	if err != nil {
+		fmt.Printf("Invalid dial options for mapping %s, using defaults: %v\n", mapping.Name, err)
+		dialer = o.fallback
+	}
+	o.mappings[mapping.ID] = &mappingDialer{opts: opts, dialer: dialer}
+	return dialer
+}
+
+// dial connects to a destination for a mapping and records the dial latency.
+// Host names are looked up by the resolver. TCP connections of mappings
+// with an upstream proxy route are tunneled through the upstreams, which
+// are reached with the mapping's dialer and resolve the destination
+// themselves once the egress DNS policy allows its name.
+func (o *outboundDialers) dial(ctx context.Context, network string, mapping *manager.Mapping, address string) (net.Conn, error) {
+	start := time.Now()
+	dialer := o.forMapping(mapping)
+	var conn net.Conn
+	var err error
+	if mapping.UpstreamProxy != nil && network == "tcp" {
+		if host, _, splitErr := net.SplitHostPort(address); splitErr == nil {
+			err = o.resolver.Check(host)
+		}
+		if err == nil {
+			conn, err = o.upstreams.Dial(ctx, mapping.Name, mapping.UpstreamProxy, address, dialer.DialContext)
+		}
+		if err != nil {
+			fmt.Printf("Upstream proxies of mapping %s failed to reach %s: %v\n", mapping.Name, address, err)
+		}
+	} else {
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	elapsed := time.Since(start)
+	o.metrics.Dials.observe(mapping.Name, elapsed, err)
+	slo.Default.ObserveDial(mapping.Name, elapsed, err)
+	return conn, err
+}
+
+// dialTLS connects to a destination for a mapping and performs a TLS handshake
+func (o *outboundDialers) dialTLS(ctx context.Context, mapping *manager.Mapping, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := o.dial(ctx, "tcp", mapping, address)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := tlsConfig.Clone()
+	if clientConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			clientConfig.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(conn, clientConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialPooled connects to a destination for a mapping, taking a warm
+// connection from the pool when the mapping keeps them. With a TLS config
+// the connection completes the handshake before it is pooled.
+func (o *outboundDialers) dialPooled(ctx context.Context, mapping *manager.Mapping, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if tlsConfig != nil {
+			return o.dialTLS(ctx, mapping, address, tlsConfig)
+		}
+		return o.dial(ctx, "tcp", mapping, address)
+	}
+
+	maxIdle := o.config.UpstreamPoolMaxIdle
+	if mapping.PoolMaxIdle != nil {
+		maxIdle = *mapping.PoolMaxIdle
+	}
+	if maxIdle <= 0 {
+		return dial(ctx)
+	}
+	key := connpool.Key{Mapping: mapping.Name, Destination: address, TLS: tlsConfig != nil}
+	return o.pool.Get(ctx, key, maxIdle, dial)
+}
+
+// mappingDialOptions applies a mapping's dial overrides to the global options
+func mappingDialOptions(opts netutil.DialOptions, mapping *manager.Mapping) netutil.DialOptions {
+	if len(mapping.SourceAddresses) > 0 {
+		opts.SourceAddrs = mapping.SourceAddresses
+	}
+	if mapping.SourceInterface != "" {
+		opts.Interface = mapping.SourceInterface
+	}
+	if mapping.IPFamily != "" {
+		opts.Family = mapping.IPFamily
+	}
+	if mapping.DialTimeout > 0 {
+		opts.Timeout = time.Duration(mapping.DialTimeout) * time.Second
+	}
+	if mapping.DialRetries != nil {
+		opts.Retries = *mapping.DialRetries
+	}
+	if mapping.MPTCP != nil {
+		opts.MPTCP = *mapping.MPTCP
+	}
+	return opts
+}
+
+// tuneTCPConn applies a mapping's socket options to a proxied TCP connection
+func tuneTCPConn(cfg *config.Config, conn net.Conn, mapping *manager.Mapping) {
+	opts := mappingTCPOptions(cfg.GetTCPOptions(), mapping)
+	if err := opts.Validate(); err != nil {
+		fmt.Printf("Invalid TCP options for mapping %s, using defaults: %v\n", mapping.Name, err)
+		opts = cfg.GetTCPOptions()
+	}
+
+	if err := netutil.ApplyTCPOptions(conn, opts); err != nil {
+		fmt.Printf("Failed to apply TCP options for mapping %s on %s: %v\n", mapping.Name, conn.RemoteAddr(), err)
+	}
+}
+
+// mappingTCPOptions applies a mapping's socket overrides to the global options
+func mappingTCPOptions(opts netutil.TCPOptions, mapping *manager.Mapping) netutil.TCPOptions {
+	if mapping.TCPNoDelay != nil {
+		opts.NoDelay = mapping.TCPNoDelay
+	}
+	if mapping.TCPKeepAlive != 0 {
+		opts.KeepAlive = time.Duration(mapping.TCPKeepAlive) * time.Second
+	}
+	if mapping.TCPKeepAliveInterval != 0 {
+		opts.KeepAliveInterval = time.Duration(mapping.TCPKeepAliveInterval) * time.Second
+	}
+	if mapping.TCPKeepAliveCount != 0 {
+		opts.KeepAliveCount = mapping.TCPKeepAliveCount
+	}
+	if mapping.TCPSendBuffer != 0 {
+		opts.SendBuffer = mapping.TCPSendBuffer
+	}
+	if mapping.TCPRecvBuffer != 0 {
+		opts.RecvBuffer = mapping.TCPRecvBuffer
+	}
+	if mapping.TCPUserTimeout != 0 {
+		opts.UserTimeout = time.Duration(mapping.TCPUserTimeout) * time.Millisecond
+	}
+	return opts
+}
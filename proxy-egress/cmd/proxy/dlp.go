@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"marchproxy-egress/internal/dlp"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/waf"
+)
+
+// dlpScanners compiles the DLP policies of mappings
+var dlpScanners = dlp.NewCache()
+
+// dlpReporter returns the callback logging and counting the findings in a
+// client's outbound payloads on mapping, and sending them to the security
+// log sinks. Matched data is never logged.
+func dlpReporter(metrics *dlp.Metrics, security *securityLog, mapping *manager.Mapping, client net.Addr) func([]dlp.Finding) {
+	action := mapping.DLP.Action
+	return func(findings []dlp.Finding) {
+		metrics.Record(mapping.Name, action, findings)
+		detectors := findingDetectors(findings)
+		fmt.Printf("DLP %s on mapping %s for %s: %s\n", action, mapping.Name, client, detectors)
+		security.log(&waf.SecurityLogEntry{
+			ClientIP: getIPFromAddr(client),
+			Action:   "dlp_" + action,
+			Metadata: map[string]interface{}{"allowed": action != "block", "mapping": mapping.Name, "detectors": detectors},
+		})
+	}
+}
+
+// findingDetectors lists the detectors of findings once each
+func findingDetectors(findings []dlp.Finding) string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, f := range findings {
+		if !seen[f.Detector] {
+			seen[f.Detector] = true
+			names = append(names, f.Detector)
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-shared/netutil"
+)
+
+// dnsProxy is the DNS listener clients resolve egress destinations through
+type dnsProxy struct {
+	server       *dnsproxy.Server
+	allowUnknown bool
+	queryLog     io.Closer // nil when logging to stdout or not at all
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+// startDNSProxy listens for DNS queries on dns_port over UDP and TCP. It
+// returns nil when the DNS proxy is disabled.
+func startDNSProxy(ctx context.Context, cfg *config.Config, clusterConfig *manager.ClusterConfig) (*dnsProxy, error) {
+	if !cfg.DNSEnabled {
+		return nil, nil
+	}
+
+	timeout := time.Duration(cfg.DNSUpstreamTimeout) * time.Second
+	var upstreams []*dnsproxy.Upstream
+	for _, address := range cfg.DNSUpstreams {
+		upstream, err := dnsproxy.ParseUpstream(address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	p := &dnsProxy{allowUnknown: cfg.DNSAllowUnknown, done: make(chan struct{})}
+	var queryLog io.Writer
+	switch cfg.DNSQueryLog {
+	case "":
+	case "stdout":
+		queryLog = os.Stdout
+	default:
+		file, err := os.OpenFile(cfg.DNSQueryLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open DNS query log: %w", err)
+		}
+		queryLog, p.queryLog = file, file
+	}
+
+	p.server = dnsproxy.NewServer(dnsproxy.Options{
+		Upstreams:     upstreams,
+		Cache:         dnsproxy.NewCache(cfg.DNSCacheSize, time.Duration(cfg.DNSCacheMaxTTL)*time.Second),
+		BlockResponse: cfg.DNSBlockResponse,
+		QueryLog:      queryLog,
+	})
+	p.updateConfiguration(clusterConfig)
+
+	addr := netutil.JoinHostPort(cfg.BindAddress, cfg.DNSPort)
+	packetConn, err := netutil.ListenPacket("udp", addr, cfg.BindInterface)
+	if err != nil {
+		p.closeLog()
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	}
+	listener, err := netutil.Listen("tcp", addr, cfg.BindInterface)
+	if err != nil {
+		packetConn.Close()
+		p.closeLog()
+		return nil, fmt.Errorf("failed to listen on TCP %s: %w", addr, err)
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	udpDone := make(chan struct{})
+	go func() {
+		defer close(udpDone)
+		p.server.ServeUDP(ctx, packetConn)
+	}()
+	go func() {
+		defer close(p.done)
+		p.server.ServeTCP(ctx, listener)
+		<-udpDone
+	}()
+
+	fmt.Printf("DNS proxy listening on %s (upstreams: %v, cache: %d)\n", addr, cfg.DNSUpstreams, cfg.DNSCacheSize)
+	return p, nil
+}
+
+// updateConfiguration applies the DNS policies of a new cluster config
+func (p *dnsProxy) updateConfiguration(clusterConfig *manager.ClusterConfig) {
+	if p == nil {
+		return
+	}
+	p.server.SetRules(dnsRules(clusterConfig, p.allowUnknown))
+}
+
+// Stop closes the DNS listeners and the query log
+func (p *dnsProxy) Stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	p.closeLog()
+}
+
+func (p *dnsProxy) closeLog() {
+	if p.queryLog != nil {
+		p.queryLog.Close()
+	}
+}
+
+// WritePrometheus writes the DNS query metrics, nothing when disabled
+func (p *dnsProxy) WritePrometheus(w io.Writer) {
+	if p == nil {
+		return
+	}
+	p.server.WritePrometheus(w)
+}
+
+// dnsRules builds the DNS rules of a cluster config. Every service that is
+// the source of a mapping may query, identified by the addresses and
+// networks in its ip_fqdn. Once any of its mappings has a DNS policy, the
+// service resolves only what one of those policies allows.
+func dnsRules(clusterConfig *manager.ClusterConfig, allowUnknown bool) *dnsproxy.Rules {
+	rules := &dnsproxy.Rules{AllowUnknown: allowUnknown}
+	if clusterConfig == nil {
+		return rules
+	}
+
+	policies := make(map[int][]*dnsproxy.Policy)
+	sources := make(map[int]bool)
+	for i := range clusterConfig.Mappings {
+		mapping := &clusterConfig.Mappings[i]
+		if mapping.DNS != nil {
+			if err := mapping.DNS.Validate(); err != nil {
+				fmt.Printf("Warning: Ignoring DNS policy of mapping %s: %v\n", mapping.Name, err)
+				continue
+			}
+		}
+		for _, serviceID := range mapping.SourceServices {
+			sources[serviceID] = true
+			if mapping.DNS != nil {
+				policies[serviceID] = append(policies[serviceID], mapping.DNS)
+			}
+		}
+	}
+
+	for _, service := range clusterConfig.Services {
+		if !sources[service.ID] {
+			continue
+		}
+		networks := dnsproxy.ParseNetworks(service.IPFQDN)
+		if len(networks) == 0 {
+			continue
+		}
+		rules.Sources = append(rules.Sources, dnsproxy.Source{
+			Service:  service.Name,
+			Networks: networks,
+			Policies: policies[service.ID],
+		})
+	}
+	return rules
+}
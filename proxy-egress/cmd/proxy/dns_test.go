@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/manager"
+)
+
+func TestDNSRules(t *testing.T) {
+	clusterConfig := &manager.ClusterConfig{
+		Services: []manager.Service{
+			{ID: 1, Name: "web", IPFQDN: "10.0.0.0/24"},
+			{ID: 2, Name: "batch", IPFQDN: "10.0.1.5"},
+			{ID: 3, Name: "api", IPFQDN: "api.internal"}, // No address to match clients by
+			{ID: 4, Name: "idle", IPFQDN: "10.0.2.5"},    // Source of no mapping
+		},
+		Mappings: []manager.Mapping{
+			{ID: 10, Name: "web-out", SourceServices: []int{1}, DNS: &dnsproxy.Policy{AllowDomains: []string{"example.com"}}},
+			{ID: 11, Name: "web-db", SourceServices: []int{1, 3}, DNS: &dnsproxy.Policy{AllowDomains: []string{"db.internal"}}},
+			{ID: 12, Name: "batch-out", SourceServices: []int{2}},
+			{ID: 13, Name: "broken", SourceServices: []int{4}, DNS: &dnsproxy.Policy{AllowDomains: []string{"*"}}},
+		},
+	}
+	rules := dnsRules(clusterConfig, false)
+
+	tests := []struct {
+		client  string
+		name    string
+		service string
+		allowed bool
+	}{
+		{"10.0.0.9", "www.example.com.", "web", true},
+		{"10.0.0.9", "db.internal.", "web", true},
+		{"10.0.0.9", "example.org.", "web", false},
+		{"10.0.1.5", "example.org.", "batch", true},
+		{"10.0.2.5", "example.org.", dnsproxy.UnknownService, false},
+	}
+	for _, tt := range tests {
+		d := rules.Decide(net.ParseIP(tt.client), tt.name)
+		if d.Service != tt.service || d.Allowed != tt.allowed {
+			t.Errorf("%s asking %s: got %+v, expected %s allowed=%t", tt.client, tt.name, d, tt.service, tt.allowed)
+		}
+	}
+	if len(rules.Sources) != 2 {
+		t.Errorf("Expected web and batch as sources, got %+v", rules.Sources)
+	}
+}
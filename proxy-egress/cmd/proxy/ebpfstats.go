@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"marchproxy-shared/ebpfstats"
+)
+
+// writeEBPFScopes writes the eBPF counters of each mapping or service, as
+// named by scope, in Prometheus text format
+func writeEBPFScopes(w io.Writer, scope string, counters map[uint32]ebpfstats.Counters) {
+	ids := make([]uint32, 0, len(counters))
+	for id := range counters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	series := []struct {
+		name, help string
+		value      func(ebpfstats.Counters) uint64
+	}{
+		{"packets", "Packets matched in eBPF", func(c ebpfstats.Counters) uint64 { return c.Packets }},
+		{"bytes", "Bytes matched in eBPF", func(c ebpfstats.Counters) uint64 { return c.Bytes }},
+		{"dropped_packets", "Packets dropped in eBPF", func(c ebpfstats.Counters) uint64 { return c.Dropped }},
+		{"userspace_packets", "Packets passed to userspace by eBPF", func(c ebpfstats.Counters) uint64 { return c.Userspace }},
+	}
+	for _, s := range series {
+		name := fmt.Sprintf("marchproxy_ebpf_%s_%s_total", scope, s.name)
+		fmt.Fprintf(w, "# HELP %s %s per %s\n", name, s.help, scope)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		for _, id := range ids {
+			fmt.Fprintf(w, `%s{%s="%d"} %d`+"\n", name, scope, id, s.value(counters[id]))
+		}
+	}
+}
+
+// writeEBPFFlowCache writes the flow cache counters in Prometheus text format
+func writeEBPFFlowCache(w io.Writer, cache ebpfstats.FlowCache) {
+	fmt.Fprintf(w, "# HELP marchproxy_ebpf_flow_cache_hits_total Packets whose policy decision came from the flow cache\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_ebpf_flow_cache_hits_total counter\n")
+	fmt.Fprintf(w, "marchproxy_ebpf_flow_cache_hits_total %d\n", cache.Hits)
+	fmt.Fprintf(w, "# HELP marchproxy_ebpf_flow_cache_misses_total Packets whose policy was decided by scanning the rules\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_ebpf_flow_cache_misses_total counter\n")
+	fmt.Fprintf(w, "marchproxy_ebpf_flow_cache_misses_total %d\n", cache.Misses)
+	fmt.Fprintf(w, "# HELP marchproxy_ebpf_flow_cache_hit_ratio Share of policy decisions answered from the flow cache\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_ebpf_flow_cache_hit_ratio gauge\n")
+	fmt.Fprintf(w, "marchproxy_ebpf_flow_cache_hit_ratio %g\n", cache.HitRatio())
+}
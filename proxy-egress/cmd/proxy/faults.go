@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"marchproxy-shared/fault"
+)
+
+// abortConnection ends a client connection the way the simulated errno
+// would look to the client. The connection is closed by the caller.
+func abortConnection(conn net.Conn, errno string, timeout time.Duration) {
+	switch errno {
+	case "ETIMEDOUT":
+		// Swallow everything without answering until the client gives up
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		io.Copy(io.Discard, conn)
+	case "ECONNRESET":
+		// Reset once the client has started talking
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		conn.Read(make([]byte, 1))
+	}
+
+	// Close with a RST instead of a FIN
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// datagramDelay is how long a datagram of size bytes takes at kbps
+func datagramDelay(size, kbps int) time.Duration {
+	if kbps <= 0 {
+		return 0
+	}
+	return time.Duration(size) * 8 * time.Millisecond / time.Duration(kbps)
+}
+
+// faultOverride is the body of PUT /admin/faults
+type faultOverride struct {
+	Mapping string `json:"mapping"`
+	TTL     int    `json:"ttl"` // seconds
+	fault.Spec
+}
+
+// faultsHandler serves /admin/faults:
+//
+//	GET    /admin/faults                 list active overrides
+//	PUT    /admin/faults                 override a mapping's faults for ttl seconds
+//	DELETE /admin/faults?mapping=<name>  clear one override, or all without mapping
+func faultsHandler(faults *fault.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !faults.Enabled() {
+			http.Error(w, "fault injection is disabled, set fault_injection_enabled", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(faults.Overrides())
+		case http.MethodPut:
+			var req faultOverride
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid fault override: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := faults.Set(req.Mapping, req.Spec, time.Duration(req.TTL)*time.Second); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Printf("Fault override for mapping %s set for %ds: %+v\n", req.Mapping, req.TTL, req.Spec)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(faults.Overrides())
+		case http.MethodDelete:
+			if mapping := r.URL.Query().Get("mapping"); mapping != "" {
+				if !faults.Clear(mapping) {
+					http.Error(w, "no override for mapping", http.StatusNotFound)
+					return
+				}
+			} else {
+				faults.ClearAll()
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
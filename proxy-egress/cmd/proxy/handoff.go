@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+)
+
+// maxHandoffSize bounds a handoff fetched from another instance
+const maxHandoffSize = 64 * 1024 * 1024
+
+// udpHandoff is the UDP session state one instance hands to its
+// replacement during planned maintenance. Clients keep their authenticated
+// sessions once their traffic reaches the replacement, as long as it
+// listens on the same addresses.
+type udpHandoff struct {
+	ExportedAt time.Time               `json:"exported_at"`
+	Listeners  map[string][]udpSession `json:"listeners"` // Sessions per UDP listen address
+}
+
+// newUDPHandoff creates an empty handoff
+func newUDPHandoff() *udpHandoff {
+	return &udpHandoff{
+		ExportedAt: time.Now().UTC(),
+		Listeners:  make(map[string][]udpSession),
+	}
+}
+
+// add exports the sessions of a UDP proxy into the handoff
+func (h *udpHandoff) add(p *UDPProxy) {
+	if sessions := p.sessions.export(); len(sessions) > 0 {
+		h.Listeners[p.listenAddress()] = sessions
+	}
+}
+
+// restore restores the sessions handed over for a UDP proxy's listen address
+func (h *udpHandoff) restore(p *UDPProxy, services []manager.Service) int {
+	if h == nil {
+		return 0
+	}
+	return p.sessions.restore(h.Listeners[p.listenAddress()], services)
+}
+
+// count returns the number of sessions in the handoff
+func (h *udpHandoff) count() int {
+	total := 0
+	for _, sessions := range h.Listeners {
+		total += len(sessions)
+	}
+	return total
+}
+
+// writeFile writes the handoff to path, readable only by the proxy's user
+// since the sessions are authenticated
+func (h *udpHandoff) writeFile(path string) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handoff: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".handoff-*")
+	if err != nil {
+		return fmt.Errorf("failed to create handoff file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write handoff file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write handoff file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadUDPHandoff reads a handoff from a file or from the /admin/handoff URL
+// of the instance being replaced. A missing file is no handoff.
+func loadUDPHandoff(source string) (*udpHandoff, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch handoff: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch handoff: status %d", resp.StatusCode)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxHandoffSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read handoff: %w", err)
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(source)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read handoff file: %w", err)
+		}
+	}
+
+	handoff := newUDPHandoff()
+	if err := json.Unmarshal(data, handoff); err != nil {
+		return nil, fmt.Errorf("failed to parse handoff: %w", err)
+	}
+	return handoff, nil
+}
+
+// restoreUDPHandoff loads the handoff from handoff_source, or handoff_file
+// without a source. It returns nil when there is nothing to restore.
+func restoreUDPHandoff(cfg *config.Config) *udpHandoff {
+	source := cfg.HandoffSource
+	if source == "" {
+		source = cfg.HandoffFile
+	}
+	if source == "" {
+		return nil
+	}
+
+	handoff, err := loadUDPHandoff(source)
+	if err != nil {
+		fmt.Printf("Warning: Failed to load UDP session handoff: %v\n", err)
+		return nil
+	}
+	if handoff != nil {
+		fmt.Printf("Loaded %d UDP sessions handed over at %s from %s\n",
+			handoff.count(), handoff.ExportedAt.Format(time.RFC3339), source)
+	}
+	return handoff
+}
+
+// handoffHandler serves GET /admin/handoff, the live UDP sessions for a
+// warm standby to restore before traffic moves to it
+func handoffHandler(snapshot func() *udpHandoff) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(snapshot())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+)
+
+func TestUDPSessionHandoff(t *testing.T) {
+	cfg := &config.Config{}
+	services := []manager.Service{{ID: 1}, {ID: 2}}
+
+	old := &UDPProxy{config: cfg, listenAddr: "0.0.0.0:9081", sessions: newUDPSessionTable(time.Minute, nil)}
+	old.sessions.create("10.0.0.1:5000", 1, 10, "dns")
+	old.sessions.create("10.0.0.2:5000", 2, 10, "dns")
+	old.sessions.create("10.0.0.3:5000", 1, 10, "dns")
+	old.sessions.sessions["10.0.0.3:5000"].LastSeen = time.Now().Add(-2 * time.Minute)
+
+	handoff := newUDPHandoff()
+	handoff.add(old)
+	if handoff.count() != 2 {
+		t.Fatalf("Expected the idle session to be left out, got %d sessions", handoff.count())
+	}
+
+	path := filepath.Join(t.TempDir(), "handoff.json")
+	if err := handoff.writeFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadUDPHandoff(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Service 2 was removed while the instances were swapped
+	replacement := &UDPProxy{config: cfg, listenAddr: "0.0.0.0:9081", sessions: newUDPSessionTable(time.Minute, nil)}
+	if restored := loaded.restore(replacement, services[:1]); restored != 1 {
+		t.Fatalf("Expected 1 session restored, got %d", restored)
+	}
+	session := replacement.sessions.lookup("10.0.0.1:5000", old.sessions.sessions["10.0.0.1:5000"].ID)
+	if session == nil || session.MappingID != 10 {
+		t.Errorf("Expected the session to keep its ID and mapping, got %+v", session)
+	}
+	if replacement.sessions.lookup("10.0.0.2:5000", old.sessions.sessions["10.0.0.2:5000"].ID) != nil {
+		t.Error("Expected the session of the removed service to be dropped")
+	}
+
+	// Sessions only move to the same listen address
+	other := &UDPProxy{config: cfg, listenAddr: "0.0.0.0:9500", sessions: newUDPSessionTable(time.Minute, nil)}
+	if restored := loaded.restore(other, services); restored != 0 {
+		t.Errorf("Expected no sessions for another listener, got %d", restored)
+	}
+}
+
+func TestLoadUDPHandoff(t *testing.T) {
+	if handoff, err := loadUDPHandoff(filepath.Join(t.TempDir(), "missing.json")); handoff != nil || err != nil {
+		t.Errorf("Expected a missing file to be no handoff, got %v, %v", handoff, err)
+	}
+
+	live := &UDPProxy{config: &config.Config{}, listenAddr: "0.0.0.0:9081", sessions: newUDPSessionTable(time.Minute, nil)}
+	live.sessions.create("10.0.0.1:5000", 1, 10, "dns")
+	server := httptest.NewServer(handoffHandler(func() *udpHandoff {
+		snapshot := newUDPHandoff()
+		snapshot.add(live)
+		return snapshot
+	}))
+	defer server.Close()
+
+	handoff, err := loadUDPHandoff(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handoff.Listeners["0.0.0.0:9081"]) != 1 {
+		t.Errorf("Expected the live session from the standby endpoint, got %+v", handoff.Listeners)
+	}
+
+	resp, err := http.Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to be rejected, got %d", resp.StatusCode)
+	}
+}
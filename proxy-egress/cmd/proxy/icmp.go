@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/geoip"
+	"marchproxy-egress/internal/manager"
+)
+
+// Results of an echo request from a client, for metrics
+const (
+	icmpRelayed       = "relayed"
+	icmpNoMapping     = "no_mapping"
+	icmpGeoBlocked    = "geo_blocked"
+	icmpAuthRequired  = "auth_required"
+	icmpRateLimited   = "rate_limited"
+	icmpTenantQuota   = "tenant_quota"
+	icmpNoDestination = "no_destination"
+	icmpFlowLimit     = "flow_limit"
+	icmpFailed        = "failed"
+)
+
+var icmpResults = []string{icmpAuthRequired, icmpFailed, icmpFlowLimit, icmpGeoBlocked, icmpNoDestination, icmpNoMapping, icmpRateLimited, icmpRelayed, icmpTenantQuota}
+
+// icmpPending caps the echo requests of a flow awaiting a reply, for RTTs
+const icmpPending = 256
+
+// icmpOpener opens a socket for echo requests to host, returning it with
+// the destination address to write to. raw is set for sockets that see
+// every ICMP message of the host rather than replies to their own echoes.
+type icmpOpener func(ctx context.Context, host string) (conn net.PacketConn, dest net.Addr, raw bool, err error)
+
+// icmpFlowKey identifies the echoes of one client ping through one mapping
+type icmpFlowKey struct {
+	client  string
+	id      int
+	mapping int
+}
+
+// icmpFlow relays the echoes of one client ping to the mapping's
+// destination over its own socket, and the replies back with the client's
+// identifier
+type icmpFlow struct {
+	key        icmpFlowKey
+	route      string // Mapping name, for metrics
+	client     net.Addr
+	conn       net.PacketConn
+	dest       net.Addr
+	raw        bool
+	id         int // Identifier of the echoes sent, the kernel's own on unprivileged sockets
+	lastActive atomic.Int64
+
+	mu   sync.Mutex
+	sent map[int]time.Time // sequence -> when the echo was sent
+}
+
+// icmpRelay answers echo requests clients send to the proxy's address when
+// their mapping serves the icmp protocol: it pings the mapping's
+// destination service and relays each reply, so clients can check the
+// destinations they may reach without raw access to the network. Each
+// mapping's echoes are rate limited.
+type icmpRelay struct {
+	conn    net.PacketConn // Echo requests from clients
+	open    icmpOpener
+	metrics *ProxyMetrics
+	geo     *geoip.Reader
+	skew    time.Duration
+	idle    time.Duration
+	max     int     // Open flows, 0 for no limit
+	rate    float64 // Echo requests per second per mapping, 0 for no limit
+	nextID  atomic.Uint32
+
+	mu            sync.Mutex
+	clusterConfig *manager.ClusterConfig
+	flows         map[icmpFlowKey]*icmpFlow
+	buckets       map[int]*icmpBucket
+	stats         map[string]*icmpCounts
+	closed        bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// icmpBucket is the token bucket of one mapping's echo requests
+type icmpBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// icmpCounts are the echoes of one mapping
+type icmpCounts struct {
+	requests map[string]uint64 // result -> echo requests
+	replies  uint64
+	rttSum   float64 // seconds
+	rttCount uint64
+	active   int64
+}
+
+// startICMPRelay listens for echo requests on bind_address. It needs
+// CAP_NET_RAW and returns nil when the relay is disabled.
+func startICMPRelay(ctx context.Context, cfg *config.Config, clusterConfig *manager.ClusterConfig, metrics *ProxyMetrics, dialers *outboundDialers, geo *geoip.Reader) (*icmpRelay, error) {
+	if !cfg.ICMPEnabled {
+		return nil, nil
+	}
+
+	address := cfg.BindAddress
+	if address == "" {
+		address = "0.0.0.0"
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for ICMP on %s (CAP_NET_RAW is required): %w", address, err)
+	}
+
+	r := newICMPRelay(conn, dialers.openICMP, metrics, geo, cfg)
+	r.updateConfiguration(clusterConfig)
+	r.serve(ctx)
+
+	fmt.Printf("ICMP echo relay on %s (%d echo requests per second per mapping)\n", address, cfg.ICMPRateLimit)
+	return r, nil
+}
+
+// newICMPRelay creates a relay answering the echo requests read from conn
+func newICMPRelay(conn net.PacketConn, open icmpOpener, metrics *ProxyMetrics, geo *geoip.Reader, cfg *config.Config) *icmpRelay {
+	return &icmpRelay{
+		conn:    conn,
+		open:    open,
+		metrics: metrics,
+		geo:     geo,
+		skew:    cfg.GetScheduleClockSkew(),
+		idle:    time.Duration(cfg.ICMPTimeout) * time.Second,
+		max:     cfg.ICMPMaxFlows,
+		rate:    float64(cfg.ICMPRateLimit),
+		flows:   make(map[icmpFlowKey]*icmpFlow),
+		buckets: make(map[int]*icmpBucket),
+		stats:   make(map[string]*icmpCounts),
+	}
+}
+
+// serve reads echo requests until ctx ends or Stop is called
+func (r *icmpRelay) serve(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		<-ctx.Done()
+		r.conn.Close()
+	}()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := r.conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+			if err != nil || msg.Type != ipv4.ICMPTypeEcho {
+				continue // Replies to the relay's own sockets and other ICMP traffic
+			}
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok {
+				continue
+			}
+			r.handleEcho(ctx, echo, from)
+		}
+	}()
+}
+
+// updateConfiguration applies the mappings of a new cluster config
+func (r *icmpRelay) updateConfiguration(clusterConfig *manager.ClusterConfig) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clusterConfig = clusterConfig
+}
+
+// handleEcho relays one echo request of a client
+func (r *icmpRelay) handleEcho(ctx context.Context, echo *icmp.Echo, client net.Addr) {
+	country := clientCountry(r.geo, client)
+	facts := connectionFacts{Protocol: "icmp", Country: country, SourceIP: getIPFromAddr(client)}
+
+	r.mu.Lock()
+	clusterConfig := r.clusterConfig
+	r.mu.Unlock()
+	mapping := matchMapping(clusterConfig, nil, facts, r.skew)
+	r.metrics.Matches.record(mapping, facts)
+	if mapping == nil {
+		r.count("", icmpNoMapping)
+		return
+	}
+
+	// Echoes can't carry a token, so authenticated mappings refuse them
+	switch {
+	case geoip.Match(country, mapping.BlockedCountries):
+		r.count(mapping.Name, icmpGeoBlocked)
+		return
+	case bindingRequiresAuth(nil, mapping):
+		r.count(mapping.Name, icmpAuthRequired)
+		return
+	case !r.allow(mapping.ID):
+		r.count(mapping.Name, icmpRateLimited)
+		return
+	case !r.metrics.Tenants.Request(mappingTenant(clusterConfig, mapping)):
+		r.count(mapping.Name, icmpTenantQuota)
+		return
+	}
+
+	service := destinationService(clusterConfig, mapping)
+	if service == nil || icmpTarget(service.IPFQDN) == "" {
+		r.count(mapping.Name, icmpNoDestination)
+		return
+	}
+
+	key := icmpFlowKey{client: client.String(), id: echo.ID, mapping: mapping.ID}
+	flow, err := r.flow(ctx, key, mapping.Name, client, icmpTarget(service.IPFQDN))
+	if err != nil {
+		if errors.Is(err, errUDPFlowLimit) {
+			r.count(mapping.Name, icmpFlowLimit)
+		} else {
+			fmt.Printf("ICMP echo from %s to %s failed: %v\n", client, service.Name, err)
+			r.count(mapping.Name, icmpFailed)
+		}
+		return
+	}
+
+	request, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: flow.id, Seq: echo.Seq, Data: echo.Data},
+	}).Marshal(nil)
+	if err == nil {
+		flow.mu.Lock()
+		if len(flow.sent) >= icmpPending {
+			clear(flow.sent)
+		}
+		flow.sent[echo.Seq] = time.Now()
+		flow.mu.Unlock()
+		_, err = flow.conn.WriteTo(request, flow.dest)
+	}
+	if err != nil {
+		r.count(mapping.Name, icmpFailed)
+		return
+	}
+	flow.lastActive.Store(time.Now().UnixNano())
+	r.count(mapping.Name, icmpRelayed)
+}
+
+// allow takes an echo request from the mapping's bucket, which holds a
+// second's worth
+func (r *icmpRelay) allow(mappingID int) bool {
+	if r.rate <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	b, ok := r.buckets[mappingID]
+	if !ok {
+		b = &icmpBucket{tokens: r.rate, last: now}
+		r.buckets[mappingID] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*r.rate, r.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// flow returns the flow of key, opening a socket to host when there is none
+func (r *icmpRelay) flow(ctx context.Context, key icmpFlowKey, route string, client net.Addr, host string) (*icmpFlow, error) {
+	r.mu.Lock()
+	flow, err := r.flows[key], r.admit()
+	r.mu.Unlock()
+	if flow != nil {
+		return flow, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, dest, raw, err := r.open(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing := r.flows[key]; existing != nil {
+		// Another echo of the ping opened it meanwhile
+		conn.Close()
+		return existing, nil
+	}
+	if err := r.admit(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	flow = &icmpFlow{
+		key:    key,
+		route:  route,
+		client: client,
+		conn:   conn,
+		dest:   dest,
+		raw:    raw,
+		id:     int(r.nextID.Add(1) & 0xffff),
+		sent:   make(map[int]time.Time),
+	}
+	flow.lastActive.Store(time.Now().UnixNano())
+	r.flows[key] = flow
+	r.counts(route).active++
+
+	r.wg.Add(1)
+	go r.relay(flow)
+	return flow, nil
+}
+
+// admit checks a new flow may open. Callers hold r.mu.
+func (r *icmpRelay) admit() error {
+	if r.closed {
+		return errUDPFlowClosed
+	}
+	if r.max > 0 && len(r.flows) >= r.max {
+		return errUDPFlowLimit
+	}
+	return nil
+}
+
+// relay passes the destination's echo replies to the client until the flow
+// idles out or its socket fails
+func (r *icmpRelay) relay(flow *icmpFlow) {
+	defer r.wg.Done()
+	defer r.end(flow)
+
+	buf := make([]byte, 65535)
+	for {
+		flow.conn.SetReadDeadline(time.Now().Add(r.idle))
+		n, from, err := flow.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, flow.lastActive.Load())) < r.idle {
+				continue // Client echoes kept the flow active
+			}
+			return
+		}
+		if getIPFromAddr(from) != getIPFromAddr(flow.dest) {
+			continue
+		}
+		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || (flow.raw && echo.ID != flow.id) {
+			continue // Raw sockets also see the echoes of other flows
+		}
+
+		flow.mu.Lock()
+		sent, ok := flow.sent[echo.Seq]
+		delete(flow.sent, echo.Seq)
+		flow.mu.Unlock()
+
+		reply, err := (&icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: flow.key.id, Seq: echo.Seq, Data: echo.Data},
+		}).Marshal(nil)
+		if err != nil {
+			continue
+		}
+		if _, err := r.conn.WriteTo(reply, flow.client); err != nil {
+			return
+		}
+		flow.lastActive.Store(time.Now().UnixNano())
+
+		r.mu.Lock()
+		counts := r.counts(flow.route)
+		counts.replies++
+		if ok {
+			counts.rttSum += time.Since(sent).Seconds()
+			counts.rttCount++
+		}
+		r.mu.Unlock()
+	}
+}
+
+// end removes a flow and closes its socket
+func (r *icmpRelay) end(flow *icmpFlow) {
+	r.mu.Lock()
+	if r.flows[flow.key] == flow {
+		delete(r.flows, flow.key)
+		r.counts(flow.route).active--
+	}
+	r.mu.Unlock()
+	flow.conn.Close()
+}
+
+// counts returns the counts of a mapping. Callers hold r.mu.
+func (r *icmpRelay) counts(route string) *icmpCounts {
+	counts := r.stats[route]
+	if counts == nil {
+		counts = &icmpCounts{requests: make(map[string]uint64)}
+		r.stats[route] = counts
+	}
+	return counts
+}
+
+// count records the result of an echo request
+func (r *icmpRelay) count(route, result string) {
+	r.mu.Lock()
+	r.counts(route).requests[result]++
+	r.mu.Unlock()
+}
+
+// Stop closes the listener and every flow, and waits for the relays
+func (r *icmpRelay) Stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.closed = true
+	flows := make([]*icmpFlow, 0, len(r.flows))
+	for _, flow := range r.flows {
+		flows = append(flows, flow)
+	}
+	r.mu.Unlock()
+
+	r.cancel()
+	for _, flow := range flows {
+		flow.conn.Close()
+	}
+	r.wg.Wait()
+}
+
+// WritePrometheus writes the echo requests, replies and round trips per
+// mapping, nothing when disabled
+func (r *icmpRelay) WritePrometheus(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := make([]string, 0, len(r.stats))
+	for route := range r.stats {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintf(w, "# HELP marchproxy_icmp_echo_requests_total ICMP echo requests from clients per mapping and result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_icmp_echo_requests_total counter\n")
+	for _, route := range routes {
+		for _, result := range icmpResults {
+			if n, ok := r.stats[route].requests[result]; ok {
+				fmt.Fprintf(w, "marchproxy_icmp_echo_requests_total{mapping=%q,result=%q} %d\n", route, result, n)
+			}
+		}
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_icmp_echo_replies_total ICMP echo replies relayed to clients per mapping\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_icmp_echo_replies_total counter\n")
+	for _, route := range routes {
+		if route != "" {
+			fmt.Fprintf(w, "marchproxy_icmp_echo_replies_total{mapping=%q} %d\n", route, r.stats[route].replies)
+		}
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_icmp_rtt_seconds Round trip from the proxy to the destination per mapping\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_icmp_rtt_seconds summary\n")
+	for _, route := range routes {
+		if route != "" {
+			fmt.Fprintf(w, "marchproxy_icmp_rtt_seconds_sum{mapping=%q} %g\n", route, r.stats[route].rttSum)
+			fmt.Fprintf(w, "marchproxy_icmp_rtt_seconds_count{mapping=%q} %d\n", route, r.stats[route].rttCount)
+		}
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_icmp_flows_active Pings being relayed per mapping\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_icmp_flows_active gauge\n")
+	for _, route := range routes {
+		if route != "" {
+			fmt.Fprintf(w, "marchproxy_icmp_flows_active{mapping=%q} %d\n", route, r.stats[route].active)
+		}
+	}
+}
+
+// icmpTarget returns the first host name or address of a service's
+// ip_fqdn, skipping CIDRs
+func icmpTarget(ipFQDN string) string {
+	for _, entry := range strings.Split(ipFQDN, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(entry); err == nil {
+			continue
+		}
+		return entry
+	}
+	return ""
+}
+
+// openICMP resolves host under the egress DNS policy and opens a socket for
+// echo requests to it: an unprivileged datagram socket when
+// net.ipv4.ping_group_range allows, a raw one otherwise
+func (o *outboundDialers) openICMP(ctx context.Context, host string) (net.PacketConn, net.Addr, bool, error) {
+	addrs, err := o.resolver.LookupNetIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, false, fmt.Errorf("no IPv4 address for %s", host)
+	}
+	ip := net.IP(addrs[0].Unmap().AsSlice())
+
+	if conn, err := icmp.ListenPacket("udp4", "0.0.0.0"); err == nil {
+		return conn, &net.UDPAddr{IP: ip}, false, nil
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return conn, &net.IPAddr{IP: ip}, true, nil
+}
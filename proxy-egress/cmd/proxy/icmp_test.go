@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+)
+
+// icmpResponder answers echo requests carried in UDP datagrams, the way an
+// unprivileged ICMP socket delivers them
+func icmpResponder(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := icmp.ParseMessage(1, buf[:n])
+			if err != nil || msg.Type != ipv4.ICMPTypeEcho {
+				continue
+			}
+			msg.Type = ipv4.ICMPTypeEchoReply
+			reply, _ := msg.Marshal(nil)
+			conn.WriteTo(reply, from)
+		}
+	}()
+	return conn
+}
+
+func TestICMPRelayEcho(t *testing.T) {
+	dest := icmpResponder(t)
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var mu sync.Mutex
+	var opened []string
+	open := func(ctx context.Context, host string) (net.PacketConn, net.Addr, bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opened = append(opened, host)
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		return conn, dest.LocalAddr(), false, err
+	}
+	r := newICMPRelay(listener, open, NewProxyMetrics(), nil, &config.Config{ICMPRateLimit: 2, ICMPTimeout: 30, ICMPMaxFlows: 10})
+	r.updateConfiguration(&manager.ClusterConfig{
+		Services: []manager.Service{{ID: 2, Name: "db", IPFQDN: "10.0.0.0/8, db.internal"}},
+		Mappings: []manager.Mapping{{ID: 1, Name: "ping-db", Protocols: []string{"icmp"}, DestServices: []int{2}}},
+	})
+	r.serve(context.Background())
+	defer r.Stop()
+
+	// Three echoes of one ping, the third over the mapping's rate limit
+	for seq := 1; seq <= 3; seq++ {
+		request, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 4242, Seq: seq, Data: []byte("ping")}}).Marshal(nil)
+		if _, err := client.WriteTo(request, listener.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 1500)
+	for seq := 1; seq <= 2; seq++ {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Reply %d: %v", seq, err)
+		}
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if msg.Type != ipv4.ICMPTypeEchoReply || !ok || echo.ID != 4242 || echo.Seq != seq || string(echo.Data) != "ping" {
+			t.Errorf("Reply %d = %v %+v, want the echo back with the client's identifier", seq, msg.Type, msg.Body)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadFrom(buf); err == nil {
+		t.Error("The rate limited echo was relayed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(opened) != 1 || opened[0] != "db.internal" {
+		t.Errorf("Opened sockets to %v, want one to db.internal", opened)
+	}
+
+	var metrics strings.Builder
+	r.WritePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_icmp_echo_requests_total{mapping="ping-db",result="relayed"} 2`,
+		`marchproxy_icmp_echo_requests_total{mapping="ping-db",result="rate_limited"} 1`,
+		`marchproxy_icmp_echo_replies_total{mapping="ping-db"} 2`,
+		`marchproxy_icmp_rtt_seconds_count{mapping="ping-db"} 2`,
+		`marchproxy_icmp_flows_active{mapping="ping-db"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+}
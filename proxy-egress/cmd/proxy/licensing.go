@@ -0,0 +1,23 @@
+package main
+
+import (
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-shared/licensing"
+)
+
+// newLicenseGate creates the gate for enterprise features, fed by the
+// manager or, in standalone mode, limited to community features
+func newLicenseGate(cfg *config.Config, client *manager.Client) *licensing.Gate {
+	fetch := licensing.ManagerFetcher(cfg.ManagerURL, cfg.ClusterAPIKey, cfg.ProxyName)
+	if client.Standalone() {
+		fetch = licensing.Community()
+	}
+	return licensing.New(fetch, licensing.Options{
+		Refresh:   time.Duration(cfg.LicenseRefreshInterval) * time.Second,
+		Grace:     time.Duration(cfg.LicenseGracePeriod) * time.Second,
+		CacheFile: cfg.LicenseCacheFile,
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/bufpool"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/ebpf"
+	"marchproxy-egress/internal/geoip"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/mirror"
+	mtls "marchproxy-egress/internal/tls"
+	"marchproxy-shared/fault"
+	"marchproxy-shared/netutil"
+)
+
+// supervisedListener is a manager-defined listener and the proxies serving it
+type supervisedListener struct {
+	spec   manager.Listener
+	tcp    *TCPProxy
+	udp    *UDPProxy
+	cancel context.CancelFunc
+}
+
+// ListenerSupervisor starts, reconfigures and stops the additional listeners
+// defined in the cluster configuration. The default listener on listen_port is
+// not managed here and always serves every mapping.
+type ListenerSupervisor struct {
+	config        *config.Config
+	managerClient *manager.Client
+	authenticator *auth.Authenticator
+	metrics       *ProxyMetrics
+	ebpfManager   *ebpf.Manager
+	mtlsManager   *mtls.MTLSManager
+	dialers       *outboundDialers
+	buffers       *bufpool.Manager
+	geo           *geoip.Reader
+	mirror        *mirror.Mirror
+	faults        *fault.Injector
+	handoff       *udpHandoff // UDP sessions handed over at startup, nil without a handoff
+	ctx           context.Context
+	listeners     map[int]*supervisedListener
+	mu            sync.Mutex
+}
+
+// NewListenerSupervisor creates a supervisor sharing the default proxy's dependencies
+func NewListenerSupervisor(ctx context.Context, cfg *config.Config, managerClient *manager.Client,
+	authenticator *auth.Authenticator, metrics *ProxyMetrics, ebpfManager *ebpf.Manager,
+	mtlsManager *mtls.MTLSManager, dialers *outboundDialers, buffers *bufpool.Manager, geo *geoip.Reader,
+	flowMirror *mirror.Mirror, faults *fault.Injector) *ListenerSupervisor {
+	return &ListenerSupervisor{
+		config:        cfg,
+		managerClient: managerClient,
+		authenticator: authenticator,
+		metrics:       metrics,
+		ebpfManager:   ebpfManager,
+		mtlsManager:   mtlsManager,
+		dialers:       dialers,
+		buffers:       buffers,
+		geo:           geo,
+		mirror:        flowMirror,
+		faults:        faults,
+		ctx:           ctx,
+		listeners:     make(map[int]*supervisedListener),
+	}
+}
+
+// Apply reconciles running listeners with the cluster configuration
+func (s *ListenerSupervisor) Apply(clusterConfig *manager.ClusterConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	desired := make(map[int]manager.Listener, len(clusterConfig.Listeners))
+	ports := make(map[int]string, len(clusterConfig.Listeners))
+	for _, spec := range clusterConfig.Listeners {
+		if err := s.validate(spec, ports); err != nil {
+			fmt.Printf("Skipping listener %s: %v\n", spec.Name, err)
+			continue
+		}
+		desired[spec.ID] = spec
+		ports[spec.Port] = spec.Name
+	}
+
+	// Stop listeners that were removed or whose binding changed
+	for id, running := range s.listeners {
+		spec, keep := desired[id]
+		if keep && reflect.DeepEqual(spec, running.spec) {
+			continue
+		}
+		fmt.Printf("Stopping listener %s on port %d\n", running.spec.Name, running.spec.Port)
+		s.stop(running)
+		delete(s.listeners, id)
+	}
+
+	// Start new listeners and push configuration to existing ones
+	for id, spec := range desired {
+		if running, exists := s.listeners[id]; exists {
+			if running.tcp != nil {
+				running.tcp.updateConfiguration(clusterConfig)
+			}
+			if running.udp != nil {
+				running.udp.updateConfiguration(clusterConfig)
+			}
+			continue
+		}
+		// A listener that failed to bind isn't recorded, so the next
+		// configuration update tries again
+		running, err := s.start(spec, clusterConfig)
+		if err != nil {
+			fmt.Printf("Listener %s failed: %v\n", spec.Name, err)
+			continue
+		}
+		s.listeners[id] = running
+	}
+}
+
+// StopAll stops every supervised listener
+func (s *ListenerSupervisor) StopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, running := range s.listeners {
+		s.stop(running)
+		delete(s.listeners, id)
+	}
+}
+
+// exportUDPSessions adds the sessions of every supervised UDP proxy to a handoff
+func (s *ListenerSupervisor) exportUDPSessions(handoff *udpHandoff) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, running := range s.listeners {
+		if running.udp != nil {
+			handoff.add(running.udp)
+		}
+	}
+}
+
+// validate checks a listener definition can be served by this proxy. ports
+// maps the ports of the listeners already accepted to their names.
+func (s *ListenerSupervisor) validate(spec manager.Listener, ports map[int]string) error {
+	if spec.Port <= 0 || spec.Port > 65535 {
+		return fmt.Errorf("invalid port %d", spec.Port)
+	}
+	if spec.Port == s.config.ListenPort || spec.Port == s.config.AdminPort || spec.Port == s.config.ListenPort+1000 {
+		return fmt.Errorf("port %d conflicts with a built-in listener", spec.Port)
+	}
+	if name, taken := ports[spec.Port]; taken {
+		return fmt.Errorf("port %d is already used by listener %s", spec.Port, name)
+	}
+	if spec.EnableTLS && s.mtlsManager == nil {
+		return fmt.Errorf("TLS requested but mTLS is not configured")
+	}
+	if err := netutil.ValidateBindAddress(spec.BindAddress); err != nil {
+		return err
+	}
+	if !listenerServes(spec, "tcp") && !listenerServes(spec, "udp") {
+		return fmt.Errorf("no supported protocols in %v", spec.Protocols)
+	}
+	return nil
+}
+
+// start launches the TCP and/or UDP proxies for a listener. When a socket
+// fails to bind, whatever was bound is closed again and an error returned.
+func (s *ListenerSupervisor) start(spec manager.Listener, clusterConfig *manager.ClusterConfig) (*supervisedListener, error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	binding := spec
+	running := &supervisedListener{spec: spec, cancel: cancel}
+	addr := netutil.JoinHostPort(s.bindAddress(spec), spec.Port)
+
+	if listenerServes(spec, "tcp") {
+		running.tcp = &TCPProxy{
+			config:        s.config,
+			clusterConfig: clusterConfig,
+			managerClient: s.managerClient,
+			authenticator: s.authenticator,
+			metrics:       s.metrics,
+			ebpfManager:   s.ebpfManager,
+			mtlsManager:   s.mtlsManager,
+			dialers:       s.dialers,
+			buffers:       s.buffers,
+			geo:           s.geo,
+			mirror:        s.mirror,
+			faults:        s.faults,
+			listenAddr:    addr,
+			binding:       &binding,
+		}
+		// Bind before returning so the sockets are open once Apply is done
+		if err := running.tcp.Listen(); err != nil {
+			cancel()
+			return nil, fmt.Errorf("TCP: %w", err)
+		}
+	}
+
+	if listenerServes(spec, "udp") {
+		running.udp = &UDPProxy{
+			config:        s.config,
+			clusterConfig: clusterConfig,
+			managerClient: s.managerClient,
+			authenticator: s.authenticator,
+			metrics:       s.metrics,
+			ebpfManager:   s.ebpfManager,
+			mtlsManager:   s.mtlsManager,
+			dialers:       s.dialers,
+			buffers:       s.buffers,
+			geo:           s.geo,
+			mirror:        s.mirror,
+			faults:        s.faults,
+			sessions:      newUDPSessionTable(time.Duration(s.config.UDPSessionTimeout)*time.Second, &s.metrics.Closes),
+			flows:         newUDPFlowTable(time.Duration(s.config.UDPFlowIdleTimeout)*time.Second, s.config.UDPMaxFlows, s.config.UDPBufferSize, &s.metrics.UDPFlows, &s.metrics.Closes),
+			listenAddr:    addr,
+			binding:       &binding,
+		}
+		if restored := s.handoff.restore(running.udp, clusterConfig.Services); restored > 0 {
+			fmt.Printf("Listener %s restored %d handed over UDP sessions\n", spec.Name, restored)
+		}
+		if err := running.udp.Listen(); err != nil {
+			running.udp.Stop()
+			running.udp = nil
+			s.stop(running)
+			return nil, fmt.Errorf("UDP: %w", err)
+		}
+	}
+
+	// Serve once every socket is bound
+	if running.tcp != nil {
+		go func() {
+			if err := running.tcp.Start(ctx); err != nil {
+				fmt.Printf("Listener %s TCP proxy failed: %v\n", spec.Name, err)
+			}
+		}()
+	}
+	if running.udp != nil {
+		go func() {
+			if err := running.udp.Start(ctx); err != nil {
+				fmt.Printf("Listener %s UDP proxy failed: %v\n", spec.Name, err)
+			}
+		}()
+	}
+
+	fmt.Printf("Started listener %s on %s (protocols: %v, mappings: %v, tls: %t)\n",
+		spec.Name, addr, spec.Protocols, spec.Mappings, spec.EnableTLS)
+	return running, nil
+}
+
+// bindAddress returns the listener's bind address, defaulting to the proxy's
+func (s *ListenerSupervisor) bindAddress(spec manager.Listener) string {
+	if spec.BindAddress != "" {
+		return spec.BindAddress
+	}
+	return s.config.BindAddress
+}
+
+// stop closes a listener's sockets before returning, so its port can be
+// bound again at once; established TCP connections drain in the background
+func (s *ListenerSupervisor) stop(running *supervisedListener) {
+	running.cancel()
+	if running.udp != nil {
+		running.udp.Stop()
+	}
+	if running.tcp != nil {
+		running.tcp.CloseListeners()
+		go running.tcp.Stop()
+	}
+}
+
+// listenerServes returns true if the listener accepts the given protocol
+func listenerServes(spec manager.Listener, protocol string) bool {
+	if len(spec.Protocols) == 0 {
+		return protocol == "tcp"
+	}
+	for _, p := range spec.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// bindingAllows returns true if a mapping may be served by a listener binding
+func bindingAllows(binding *manager.Listener, mappingID int) bool {
+	if binding == nil || len(binding.Mappings) == 0 {
+		return true
+	}
+	for _, id := range binding.Mappings {
+		if id == mappingID {
+			return true
+		}
+	}
+	return false
+}
+
+// bindingRequiresAuth returns true if connections for a mapping must authenticate
+func bindingRequiresAuth(binding *manager.Listener, mapping *manager.Mapping) bool {
+	if mapping.AuthRequired {
+		return true
+	}
+	return binding != nil && binding.RequireAuth
+}
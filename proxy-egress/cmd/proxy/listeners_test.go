@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/bufpool"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+)
+
+// newTestSupervisor returns a supervisor binding listeners on loopback
+func newTestSupervisor(t *testing.T) *ListenerSupervisor {
+	cfg := &config.Config{
+		BindAddress:        "127.0.0.1",
+		ListenPort:         1,
+		AdminPort:          2,
+		UDPSessionTimeout:  60,
+		UDPFlowIdleTimeout: 60,
+		UDPMaxFlows:        10,
+		UDPBufferSize:      2048,
+	}
+	s := NewListenerSupervisor(context.Background(), cfg, nil, auth.NewAuthenticator(nil), NewProxyMetrics(),
+		nil, nil, nil, bufpool.NewManager(), nil, nil, nil)
+	t.Cleanup(s.StopAll)
+	return s
+}
+
+// freePort returns a loopback port nothing listens on, for TCP and UDP
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if conn, err := net.ListenPacket("udp", listener.Addr().String()); err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatal("No free port")
+	return 0
+}
+
+// listening reports whether a TCP listener accepts connections on port
+func listening(port int) bool {
+	conn, err := net.Dial("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String())
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestListenerRestartOnSamePort(t *testing.T) {
+	s := newTestSupervisor(t)
+	port := freePort(t)
+
+	s.Apply(&manager.ClusterConfig{Listeners: []manager.Listener{{ID: 1, Name: "api", Port: port}}})
+	if s.listeners[1] == nil || !listening(port) {
+		t.Fatal("Expected listener api to be serving")
+	}
+
+	// Changing the binding restarts the listener on the same port, which
+	// only works when the old socket is closed by then
+	for i := 0; i < 20; i++ {
+		mappings := []int{i}
+		s.Apply(&manager.ClusterConfig{Listeners: []manager.Listener{{ID: 1, Name: "api", Port: port, Mappings: mappings}}})
+		running := s.listeners[1]
+		if running == nil || len(running.spec.Mappings) != 1 || running.spec.Mappings[0] != i {
+			t.Fatalf("Restart %d: expected the listener to be rebound, got %+v", i, running)
+		}
+	}
+	if !listening(port) {
+		t.Fatal("Expected the restarted listener to be serving")
+	}
+
+	// Moving the port to another listener in one update works as well
+	s.Apply(&manager.ClusterConfig{Listeners: []manager.Listener{{ID: 2, Name: "api-v2", Port: port}}})
+	if s.listeners[1] != nil || s.listeners[2] == nil {
+		t.Fatalf("Expected only listener api-v2, got %v", s.listeners)
+	}
+}
+
+func TestListenerBindFailureNotRecorded(t *testing.T) {
+	s := newTestSupervisor(t)
+	port := freePort(t)
+
+	busy, err := net.ListenPacket("udp", (&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := manager.Listener{ID: 1, Name: "dns", Port: port, Protocols: []string{"tcp", "udp"}}
+	s.Apply(&manager.ClusterConfig{Listeners: []manager.Listener{spec}})
+	if s.listeners[1] != nil {
+		t.Fatal("Expected a listener that failed to bind not to be recorded")
+	}
+	if listening(port) {
+		t.Fatal("Expected the TCP socket to be closed when UDP failed to bind")
+	}
+
+	// The next update retries it
+	busy.Close()
+	s.Apply(&manager.ClusterConfig{Listeners: []manager.Listener{spec}})
+	if s.listeners[1] == nil || s.listeners[1].udp == nil || !listening(port) {
+		t.Fatal("Expected the listener to start once the port is free")
+	}
+}
+
+func TestListenerDuplicatePorts(t *testing.T) {
+	s := newTestSupervisor(t)
+	port := freePort(t)
+
+	s.Apply(&manager.ClusterConfig{Listeners: []manager.Listener{
+		{ID: 1, Name: "first", Port: port},
+		{ID: 2, Name: "second", Port: port, Protocols: []string{"udp"}},
+	}})
+	if s.listeners[1] == nil || s.listeners[2] != nil {
+		t.Fatalf("Expected only the first listener on port %d, got %v", port, s.listeners)
+	}
+
+	err := s.validate(manager.Listener{Name: "third", Port: port}, map[int]string{port: "first"})
+	if err == nil {
+		t.Fatal("Expected a port used by another listener to be rejected")
+	}
+	for _, builtin := range []int{1, 2, 1001} {
+		if err := s.validate(manager.Listener{Name: "builtin", Port: builtin}, nil); err == nil {
+			t.Errorf("Expected built-in port %d to be rejected", builtin)
+		}
+	}
+}
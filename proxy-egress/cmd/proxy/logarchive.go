@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/logarchive"
+)
+
+// newLogArchiver creates the archiver of the rotated audit, DNS query and
+// TLS inspection logs and of log_archive_paths, nil without a bucket or
+// logs to archive
+func newLogArchiver(cfg *config.Config) (*logarchive.Archiver, error) {
+	if cfg.LogArchiveBucket == "" {
+		return nil, nil
+	}
+
+	var logs []logarchive.Log
+	for _, log := range []logarchive.Log{
+		{Name: "audit", Path: cfg.AuditLogPath},
+		{Name: "dns_queries", Path: cfg.DNSQueryLog},
+		{Name: "tls_inspection", Path: cfg.TLSInspectionAuditLog},
+	} {
+		if log.Path != "" && log.Path != "stdout" {
+			logs = append(logs, log)
+		}
+	}
+	for _, path := range cfg.LogArchivePaths {
+		base := filepath.Base(path)
+		logs = append(logs, logarchive.Log{Name: strings.TrimSuffix(base, filepath.Ext(base)), Path: path})
+	}
+	if len(logs) == 0 {
+		fmt.Printf("Warning: log_archive_bucket is set but no logs are written to files\n")
+		return nil, nil
+	}
+
+	store, err := logarchive.NewS3(logarchive.S3Options{
+		Endpoint:     cfg.GetLogArchiveEndpoint(),
+		Region:       cfg.LogArchiveRegion,
+		Bucket:       cfg.LogArchiveBucket,
+		AccessKey:    cfg.LogArchiveAccessKey,
+		SecretKey:    cfg.LogArchiveSecretKey,
+		SessionToken: cfg.LogArchiveSessionToken,
+		PathStyle:    cfg.LogArchivePathStyle,
+		SSE:          cfg.LogArchiveSSE,
+		KMSKeyID:     cfg.LogArchiveKMSKeyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Log archival to bucket %s enabled for %d logs\n", cfg.LogArchiveBucket, len(logs))
+	return logarchive.New(logarchive.Options{
+		Store:     store,
+		Prefix:    cfg.LogArchivePrefix,
+		Host:      cfg.ProxyName,
+		Logs:      logs,
+		Retention: time.Duration(cfg.LogArchiveRetentionDays) * 24 * time.Hour,
+	}), nil
+}
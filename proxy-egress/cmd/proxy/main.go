@@ -6,8 +6,9 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
@@ -16,13 +17,43 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/bufpool"
+	"marchproxy-egress/internal/capture"
+	"marchproxy-egress/internal/certs"
 	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/connpool"
+	"marchproxy-egress/internal/counters"
+	"marchproxy-egress/internal/dlp"
+	"marchproxy-egress/internal/dnsproxy"
 	"marchproxy-egress/internal/ebpf"
+	"marchproxy-egress/internal/fingerprint"
+	"marchproxy-egress/internal/geoip"
+	"marchproxy-egress/internal/logarchive"
 	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/mirror"
+	"marchproxy-egress/internal/quarantine"
+	"marchproxy-egress/internal/selfmon"
+	"marchproxy-egress/internal/slo"
+	"marchproxy-egress/internal/sshaudit"
+	"marchproxy-egress/internal/tenant"
+	"marchproxy-egress/internal/tlsinspect"
+	"marchproxy-egress/internal/tlsmode"
+	"marchproxy-egress/internal/traffic"
+	"marchproxy-egress/internal/upstreamproxy"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/dashgen"
+	"marchproxy-shared/fault"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/licensing"
+	"marchproxy-shared/metering"
+	"marchproxy-shared/netutil"
+	"marchproxy-shared/readiness"
+	"marchproxy-shared/snmp"
 	mtls "marchproxy-egress/internal/tls"
 	"github.com/spf13/cobra"
 )
@@ -51,37 +82,150 @@ Features:
 	}
 
 	// Add command line flags
-	rootCmd.Flags().StringP("config", "c", "", "Configuration file path")
-	rootCmd.Flags().StringP("manager-url", "m", "", "Manager server URL")
-	rootCmd.Flags().StringP("cluster-api-key", "k", "", "Cluster API key")
-	rootCmd.Flags().StringP("listen-port", "p", "8080", "Proxy listen port")
-	rootCmd.Flags().StringP("admin-port", "a", "8081", "Admin/metrics port")
-	rootCmd.Flags().StringP("log-level", "l", "INFO", "Log level (DEBUG, INFO, WARN, ERROR)")
-	rootCmd.Flags().BoolP("enable-ebpf", "e", true, "Enable eBPF acceleration")
-	rootCmd.Flags().BoolP("enable-metrics", "", true, "Enable Prometheus metrics")
+	rootCmd.PersistentFlags().StringP("config", "c", "", "Configuration file path")
+	rootCmd.PersistentFlags().StringP("manager-url", "m", "", "Manager server URL")
+	rootCmd.PersistentFlags().StringP("cluster-api-key", "k", "", "Cluster API key")
+	rootCmd.PersistentFlags().StringP("standalone-config", "", "", "Run without a manager from a local cluster config file")
+	rootCmd.PersistentFlags().StringP("listen-port", "p", "8080", "Proxy listen port")
+	rootCmd.PersistentFlags().StringP("admin-port", "a", "8081", "Admin/metrics port")
+	rootCmd.PersistentFlags().StringP("bind-address", "", "", "IP address to bind proxy listeners to (default all)")
+	rootCmd.PersistentFlags().StringP("bind-interface", "", "", "Interface or VRF device to bind proxy listeners to (Linux only)")
+	rootCmd.PersistentFlags().StringP("log-level", "l", "INFO", "Log level (DEBUG, INFO, WARN, ERROR)")
+	rootCmd.PersistentFlags().BoolP("enable-ebpf", "e", true, "Enable eBPF acceleration")
+	rootCmd.PersistentFlags().BoolP("enable-metrics", "", true, "Enable Prometheus metrics")
+	layers.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newConfigCmd())
+	rootCmd.AddCommand(newMetricsCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newConfigCmd creates the config command. config print-effective prints
+// the configuration this binary would run with, given the same flags and
+// environment, with secrets masked.
+func newConfigCmd() *cobra.Command {
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print-effective",
+		Short: "Print the merged configuration with secrets masked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := config.Load(cmd)
+			if err == nil {
+				err = layers.PrintEffective(os.Stdout, cfg, format)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", "yaml", "output format: yaml or json")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(printCmd)
+	return configCmd
+}
+
+// newMetricsCmd creates the metrics command. metrics export-dashboards
+// generates a Grafana dashboard and Prometheus rules from the metrics a
+// running proxy exposes on its admin port, most of which only exist once
+// the features behind them are configured.
+func newMetricsCmd() *cobra.Command {
+	var outputDir, from string
+	exportCmd := &cobra.Command{
+		Use:   "export-dashboards",
+		Short: "Generate a Grafana dashboard and Prometheus rules from the exposed metrics",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if from == "" {
+				adminPort, _ := cmd.Flags().GetString("admin-port")
+				from = "http://127.0.0.1:" + adminPort + "/metrics"
+			}
+			metrics, err := dashgen.Scrape(from)
+			if err == nil {
+				var files []string
+				files, err = dashgen.Write(outputDir, redModule, metrics)
+				for _, file := range files {
+					fmt.Printf("Wrote %s\n", file)
+				}
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", ".", "directory to write the dashboard and rules to")
+	exportCmd.Flags().StringVar(&from, "from", "", "metrics endpoint to read (default the admin port on this host)")
+
+	metricsCmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Inspect the exposed metrics",
+	}
+	metricsCmd.AddCommand(exportCmd)
+	return metricsCmd
+}
+
 func runProxy(cmd *cobra.Command, args []string) {
 	// Load configuration
 	cfg, err := config.Load(cmd)
+	if validate, _ := cmd.Flags().GetBool("validate-config"); validate {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	fmt.Printf("Starting MarchProxy Egress %s\n", version)
-	fmt.Printf("Manager URL: %s\n", cfg.ManagerURL)
+	if cfg.StandaloneConfig != "" {
+		fmt.Printf("Standalone config: %s\n", cfg.StandaloneConfig)
+	} else {
+		fmt.Printf("Manager URL: %s\n", cfg.ManagerURL)
+	}
 	fmt.Printf("Listen Port: %d\n", cfg.ListenPort)
 	fmt.Printf("Admin Port: %d\n", cfg.AdminPort)
+	if cfg.BindAddress != "" || cfg.BindInterface != "" {
+		fmt.Printf("Bind: address=%q interface=%q\n", cfg.BindAddress, cfg.BindInterface)
+	}
 	fmt.Printf("Log Level: %s\n", cfg.LogLevel)
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Take over the listeners of the egress this binary replaces, if one is
+	// running, before opening any
+	var handover *netutil.Handover
+	if cfg.UpgradeSocket != "" {
+		handover, err = netutil.StartHandover(cfg.UpgradeSocket, time.Duration(cfg.UpgradeTimeout)*time.Second, func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		})
+		if err != nil {
+			log.Fatalf("Failed to start listener handover: %v", err)
+		}
+		defer handover.Close()
+		fmt.Printf("Listener handover enabled on %s, inherited %d sockets\n", cfg.UpgradeSocket, handover.Inherited())
+	}
+
+	// /readyz stays unavailable until the proxy is registered, has its
+	// config and listeners, and has loaded eBPF when enabled
+	readySteps := []string{readiness.StepRegistration, readiness.StepConfig, readiness.StepListeners}
+	if cfg.EnableEBPF {
+		readySteps = append(readySteps, readiness.StepEBPF)
+	}
+	ready := readiness.New(readySteps...)
+
 	// Initialize manager client for configuration and registration
 	managerClient := manager.NewClient(cfg)
 
@@ -102,12 +246,20 @@ func runProxy(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	// Gate enterprise features on the cluster's entitlements
+	license := newLicenseGate(cfg, managerClient)
+	if err := license.Refresh(ctx); err == nil {
+		fmt.Printf("License entitlements: %v\n", license.Status().Features)
+	}
+	go license.Run(ctx)
+
 	// Register proxy with manager
 	fmt.Printf("Registering with manager...\n")
 	if err := managerClient.Register(cfg); err != nil {
 		fmt.Printf("Failed to register with manager: %v\n", err)
 		os.Exit(1)
 	}
+	ready.Done(readiness.StepRegistration)
 
 	// Get initial configuration
 	initialConfig, err := managerClient.GetConfig()
@@ -115,6 +267,7 @@ func runProxy(cmd *cobra.Command, args []string) {
 		fmt.Printf("Failed to get initial configuration: %v\n", err)
 		os.Exit(1)
 	}
+	ready.Done(readiness.StepConfig)
 
 	fmt.Printf("Loaded configuration - Services: %d, Mappings: %d\n",
 		len(initialConfig.Services), len(initialConfig.Mappings))
@@ -124,7 +277,7 @@ func runProxy(cmd *cobra.Command, args []string) {
 	if cfg.IsMTLSEnabled() {
 		fmt.Printf("mTLS enabled - initializing certificate management\n")
 		var err error
-		mtlsManager, err = mtls.NewMTLSManager(cfg)
+		mtlsManager, err = mtls.NewMTLSManagerWithSigner(cfg, managerClient)
 		if err != nil {
 			fmt.Printf("Failed to initialize mTLS manager: %v\n", err)
 			os.Exit(1)
@@ -148,7 +301,84 @@ func runProxy(cmd *cobra.Command, args []string) {
 
 	// Initialize authenticator and metrics
 	authenticator := auth.NewAuthenticator(initialConfig.Services)
-	metrics := &ProxyMetrics{}
+	metrics := NewProxyMetrics()
+	metrics.License = license
+	metrics.AuthAttempts = auth.NewAttemptLimiter(auth.AttemptLimits{
+		Rate:        cfg.AuthRateLimit,
+		Burst:       cfg.AuthBurst,
+		MaxFailures: cfg.AuthMaxFailures,
+		Lockout:     time.Duration(cfg.AuthLockout) * time.Second,
+		MaxLockout:  time.Duration(cfg.AuthMaxLockout) * time.Second,
+	})
+	metrics.Fingerprints = fingerprint.NewTracker(cfg.TLSFingerprintMaxTracked)
+	metrics.Tenants.Update(initialConfig.Tenants)
+	updateSLOs(initialConfig)
+	if len(initialConfig.Tenants) > 0 {
+		fmt.Printf("Tenant quotas loaded for %d tenants\n", len(initialConfig.Tenants))
+	}
+	metrics.SecurityLog, err = newSecurityLog(cfg)
+	if err != nil {
+		fmt.Printf("Failed to configure security log sinks: %v\n", err)
+		os.Exit(1)
+	}
+	metrics.Quarantine = quarantine.NewTracker(cfg.QuarantineThreshold, cfg.GetQuarantineWindow(), quarantineReporter(managerClient, metrics.SecurityLog))
+	metrics.Quarantine.Update(initialConfig.Quarantine)
+	metrics.TLSInspection, err = newTLSInspector(cfg, license)
+	if err != nil {
+		fmt.Printf("Failed to configure TLS inspection: %v\n", err)
+		os.Exit(1)
+	}
+	metrics.SSH, err = newSSHAuditing(cfg, metrics.SecurityLog)
+	if err != nil {
+		fmt.Printf("Failed to configure SSH auditing: %v\n", err)
+		os.Exit(1)
+	}
+	
+	// Pooled buffers for the TCP and UDP relay loops
+	buffers := bufpool.NewManager()
+	
+	// Outbound dialers (Happy Eyeballs, source address pinning, retries)
+	dialers, err := newOutboundDialers(cfg, metrics)
+	if err != nil {
+		fmt.Printf("Failed to configure outbound dialing: %v\n", err)
+		os.Exit(1)
+	}
+	dialers.updateConfiguration(initialConfig)
+
+	// Client country lookups for mapping match criteria
+	var geo *geoip.Reader
+	if cfg.GeoIPDatabase != "" {
+		geo, err = geoip.Open(cfg.GeoIPDatabase)
+		if err != nil {
+			fmt.Printf("Failed to load GeoIP database: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("GeoIP database loaded: %s (built %s)\n", geo.Metadata.DatabaseType,
+			time.Unix(int64(geo.Metadata.BuildEpoch), 0).UTC().Format("2006-01-02"))
+	}
+
+	// Flow mirroring to an IDS or capture target
+	flowMirror, err := newFlowMirror(cfg)
+	if err != nil {
+		fmt.Printf("Failed to configure flow mirroring: %v\n", err)
+		os.Exit(1)
+	}
+	if flowMirror != nil {
+		fmt.Printf("Flow mirroring enabled: %s (sample rate %g)\n", cfg.MirrorMode, cfg.MirrorSampleRate)
+	}
+
+	// On-demand packet captures from the admin API
+	captures := newCaptureManager(cfg)
+
+	// Fault injection for resilience testing
+	faults := fault.NewInjector(cfg.FaultInjectionEnabled)
+	if faults.Enabled() {
+		fmt.Printf("Warning: fault injection enabled, mapping faults and admin overrides will be applied\n")
+	}
+
+	if cfg.EnableMPTCP && !netutil.MPTCPSupported() {
+		fmt.Printf("Warning: MPTCP enabled but not available in this kernel, connections will use plain TCP\n")
+	}
 
 	// Initialize eBPF manager
 	ebpfManager := ebpf.NewManager(cfg.EnableEBPF)
@@ -156,8 +386,11 @@ func runProxy(cmd *cobra.Command, args []string) {
 		fmt.Printf("eBPF acceleration enabled\n")
 		if err := ebpfManager.LoadProgram(""); err != nil {
 			fmt.Printf("Warning: Failed to load eBPF program: %v\n", err)
-			fmt.Printf("Continuing with userspace-only mode\n")
+			fmt.Printf("Continuing in %s mode, /readyz stays unavailable while eBPF is enabled\n", ebpfManager.GetMode())
+			ready.Fail(readiness.StepEBPF, err)
 		} else {
+			fmt.Printf("eBPF acceleration mode: %s\n", ebpfManager.GetMode())
+			ready.Done(readiness.StepEBPF)
 			// Sync initial configuration
 			ebpfManager.UpdateServices(initialConfig.Services)
 			ebpfManager.UpdateMappings(initialConfig.Mappings)
@@ -174,6 +407,11 @@ func runProxy(cmd *cobra.Command, args []string) {
 		metrics:       metrics,
 		ebpfManager:   ebpfManager,
 		mtlsManager:   mtlsManager,
+		dialers:       dialers,
+		buffers:       buffers,
+		geo:           geo,
+		mirror:        flowMirror,
+		faults:        faults,
 	}
 	
 	// Initialize UDP proxy server
@@ -186,27 +424,180 @@ func runProxy(cmd *cobra.Command, args []string) {
 		metrics:       metrics,
 		ebpfManager:   ebpfManager,
 		mtlsManager:   mtlsManager,
+		dialers:       dialers,
+		buffers:       buffers,
+		geo:           geo,
+		mirror:        flowMirror,
+		faults:        faults,
+		sessions:      newUDPSessionTable(time.Duration(cfg.UDPSessionTimeout)*time.Second, &metrics.Closes),
+		flows:         newUDPFlowTable(time.Duration(cfg.UDPFlowIdleTimeout)*time.Second, cfg.UDPMaxFlows, cfg.UDPBufferSize, &metrics.UDPFlows, &metrics.Closes),
+	}
+
+	// Authenticated UDP sessions handed over by the instance this one replaces
+	handoff := restoreUDPHandoff(cfg)
+	if restored := handoff.restore(udpProxyServer, initialConfig.Services); restored > 0 {
+		fmt.Printf("Restored %d handed over UDP sessions\n", restored)
+	}
+
+	// Additional manager-defined listeners (port -> mapping group)
+	listenerSupervisor := NewListenerSupervisor(ctx, cfg, managerClient, authenticator,
+		metrics, ebpfManager, mtlsManager, dialers, buffers, geo, flowMirror, faults)
+	listenerSupervisor.handoff = handoff
+	listenerSupervisor.Apply(initialConfig)
+	listenerSupervisor.handoff = nil
+
+	// DNS proxy enforcing the domain lists of each service's mappings
+	dnsServer, err := startDNSProxy(ctx, cfg, initialConfig)
+	if err != nil {
+		fmt.Printf("Failed to start DNS proxy: %v\n", err)
+		os.Exit(1)
+	}
+
+	// SMTP relay enforcing the mail policies of each service's mappings
+	smtpServer, err := startSMTPRelay(ctx, cfg, initialConfig, authenticator, dialers)
+	if err != nil {
+		fmt.Printf("Failed to start SMTP relay: %v\n", err)
+		os.Exit(1)
+	}
+
+	// SOCKS5 listener authorizing each request against the client's mappings
+	socksServer, err := startSOCKSListener(ctx, cfg, initialConfig, authenticator, dialers)
+	if err != nil {
+		fmt.Printf("Failed to start SOCKS5 listener: %v\n", err)
+		os.Exit(1)
+	}
+
+	// ICMP echo relay pinging the destinations of icmp mappings
+	icmpServer, err := startICMPRelay(ctx, cfg, initialConfig, metrics, dialers, geo)
+	if err != nil {
+		fmt.Printf("Failed to start ICMP echo relay: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Multiplexed listener relaying streams of authenticated transports
+	muxServer, err := startMuxListener(ctx, cfg, tcpProxyServer)
+	if err != nil {
+		fmt.Printf("Failed to start multiplexed listener: %v\n", err)
+		os.Exit(1)
 	}
 
+	// Live UDP sessions of every listener, for the replacing instance
+	snapshotUDPSessions := func() *udpHandoff {
+		snapshot := newUDPHandoff()
+		snapshot.add(udpProxyServer)
+		listenerSupervisor.exportUDPSessions(snapshot)
+		return snapshot
+	}
+	
+	// Applied config version and diff for /admin/config
+	configHistory := &manager.ConfigHistory{}
+	configHistory.Record(initialConfig)
+	for _, err := range invalidMappings(initialConfig) {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	metrics.Rollout.applied(initialConfig.Version, &metrics.Closes)
+
 	// Start configuration refresh loop
 	go managerClient.StartConfigRefresh(ctx, cfg, func(config *manager.ClusterConfig) {
-		fmt.Printf("Configuration updated - Version: %s\n", config.Version)
+		diff := configHistory.Record(config)
+		fmt.Printf("Configuration updated - Version: %s (%s)\n", config.Version, diff.Summary())
+		for _, err := range invalidMappings(config) {
+			fmt.Printf("Warning: %v\n", err)
+		}
+		metrics.Tenants.Update(config.Tenants)
+		metrics.Quarantine.Update(config.Quarantine)
+		updateSLOs(config)
+		dialers.updateConfiguration(config)
 		tcpProxyServer.updateConfiguration(config)
 		udpProxyServer.updateConfiguration(config)
+		listenerSupervisor.Apply(config)
+		dnsServer.updateConfiguration(config)
+		smtpServer.updateConfiguration(config)
+		socksServer.updateConfiguration(config)
+		icmpServer.updateConfiguration(config)
 		
 		// Update eBPF maps
 		if ebpfManager.IsEnabled() {
 			ebpfManager.UpdateServices(config.Services)
 			ebpfManager.UpdateMappings(config.Mappings)
 		}
+
+		// Canaries are judged on the connections since the version was applied
+		metrics.Rollout.applied(config.Version, &metrics.Closes)
 	})
 
 	// Start heartbeat loop
 	go managerClient.StartHeartbeat(ctx, cfg, func() manager.SystemStats {
-		return manager.GetSystemStats()
+		stats := manager.GetSystemStats()
+		stats.ConfigVersion = metrics.Rollout.appliedVersion()
+		stats.ConnectionsClosed, stats.ConnectionsFailed = metrics.Closes.totals()
+		stats.Traffic = trafficEntries(metrics, ebpfManager, configHistory.Current())
+		if ebpfManager.IsEnabled() {
+			if snapshot, err := ebpfManager.Snapshot(); err == nil {
+				stats.EBPF = snapshot
+			}
+		}
+		return stats
 		// TODO: Add actual connection counts and bytes transferred from proxy server
 	})
 
+	// Watch our own goroutines, heap and file descriptors
+	selfMonitor := newSelfMonitor(cfg, metrics)
+	if selfMonitor != nil {
+		go selfMonitor.Run(ctx)
+	}
+
+	// Meter usage per tenant and service for chargeback
+	metrics.Meter = newMeter(cfg, managerClient)
+	if metrics.Meter != nil {
+		fmt.Printf("Usage metering enabled - interval: %ds\n", cfg.MeteringInterval)
+		go metrics.Meter.Run(ctx, time.Duration(cfg.MeteringInterval)*time.Second)
+	}
+
+	// Archive rotated logs to object storage
+	metrics.LogArchive, err = newLogArchiver(cfg)
+	if err != nil {
+		fmt.Printf("Failed to configure log archival: %v\n", err)
+		os.Exit(1)
+	}
+	if metrics.LogArchive != nil {
+		go metrics.LogArchive.Run(ctx, time.Duration(cfg.LogArchiveInterval)*time.Second)
+	}
+
+	// Open every listener before serving, so an egress being replaced can
+	// stop accepting once they are all open
+	if err := tcpProxyServer.Listen(); err != nil {
+		fmt.Printf("TCP proxy server failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := udpProxyServer.Listen(); err != nil {
+		fmt.Printf("UDP proxy server failed: %v\n", err)
+		os.Exit(1)
+	}
+	var adminListener net.Listener
+	var snmpConn net.PacketConn
+	if cfg.EnableMetrics {
+		adminListener, err = adminserver.ListenWith(cfg.Admin, fmt.Sprintf(":%d", cfg.AdminPort), func(network, address string) (net.Listener, error) {
+			return netutil.Listen(network, address, "")
+		})
+		if err != nil {
+			fmt.Printf("Failed to start admin server: %v\n", err)
+			os.Exit(1)
+		}
+		if warning := adminserver.Warning(cfg.Admin, cfg.Admin.Address(fmt.Sprintf(":%d", cfg.AdminPort))); warning != "" {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		if cfg.SNMPListen != "" {
+			snmpConn, err = netutil.ListenPacket("udp", cfg.SNMPListen, "")
+			if err != nil {
+				fmt.Printf("Failed to start SNMP agent: %v\n", err)
+				os.Exit(1)
+			}
+			metrics.SNMP = newSNMPAgent(cfg.SNMPCommunity, ready, metrics)
+		}
+	}
+	ready.Done(readiness.StepListeners)
+
 	// Start TCP proxy server in goroutine
 	go func() {
 		if err := tcpProxyServer.Start(ctx); err != nil {
@@ -224,35 +615,97 @@ func runProxy(cmd *cobra.Command, args []string) {
 	}()
 
 	// Start admin server for health checks and metrics
-	if cfg.EnableMetrics {
+	if adminListener != nil {
 		go func() {
-			if err := startAdminServer(cfg.AdminPort, metrics, ebpfManager, mtlsManager); err != nil {
+			if err := startAdminServer(adminListener, ready, cfg, metrics, ebpfManager, mtlsManager, buffers, configHistory, managerClient, authenticator, geo, flowMirror, captures, faults, selfMonitor, snapshotUDPSessions, dnsServer, smtpServer, socksServer, icmpServer, muxServer); err != nil {
 				fmt.Printf("Failed to start admin server: %v\n", err)
 			}
 		}()
 	}
+	if snmpConn != nil {
+		fmt.Printf("SNMP agent listening on %s\n", snmpConn.LocalAddr())
+		go func() {
+			if err := metrics.SNMP.Serve(snmpConn); err != nil {
+				fmt.Printf("SNMP agent failed: %v\n", err)
+			}
+		}()
+	}
+
+	var upgraded <-chan struct{}
+	if handover != nil {
+		if err := handover.Ready(); err != nil {
+			fmt.Printf("Warning: listener handover incomplete: %v\n", err)
+		}
+		upgraded = handover.Done()
+	}
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal. SIGUSR2 starts a hitless upgrade.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if handover != nil {
+		signal.Notify(sigChan, syscall.SIGUSR2)
+	}
 
-	select {
-	case sig := <-sigChan:
-		fmt.Printf("Received signal %s, shutting down\n", sig)
-	case <-ctx.Done():
-		fmt.Printf("Context cancelled, shutting down\n")
+	for running := true; running; {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGUSR2 {
+				fmt.Printf("Upgrading, starting the new binary\n")
+				go func() {
+					if err := handover.Upgrade(); err != nil {
+						fmt.Printf("Upgrade failed, still serving: %v\n", err)
+					}
+				}()
+				continue
+			}
+			fmt.Printf("Received signal %s, shutting down\n", sig)
+		case <-upgraded:
+			fmt.Printf("New process took over the listeners, draining\n")
+		case <-ctx.Done():
+			fmt.Printf("Context cancelled, shutting down\n")
+		}
+		running = false
 	}
 
 	// Graceful shutdown
 	fmt.Printf("Starting graceful shutdown...\n")
 
+	// Hand the UDP sessions to the replacing instance before they are closed
+	if cfg.HandoffFile != "" {
+		snapshot := snapshotUDPSessions()
+		if err := snapshot.writeFile(cfg.HandoffFile); err != nil {
+			fmt.Printf("Warning: Failed to write UDP session handoff: %v\n", err)
+		} else {
+			fmt.Printf("Handed over %d UDP sessions in %s\n", snapshot.count(), cfg.HandoffFile)
+		}
+	}
+
 	// Shutdown proxy servers
+	listenerSupervisor.StopAll()
 	if tcpProxyServer != nil {
 		tcpProxyServer.Stop()
 	}
+	muxServer.Stop()
 	if udpProxyServer != nil {
 		udpProxyServer.Stop()
 	}
+	dnsServer.Stop()
+	smtpServer.Stop()
+	socksServer.Stop()
+	icmpServer.Stop()
+	dialers.close()
+
+	// Export usage of the last partial period
+	if metrics.Meter != nil {
+		metrics.Meter.Flush()
+	}
+
+	// Write out frames still queued for the mirror target
+	flowMirror.Close()
+	captures.StopAll()
+
+	// Deliver security events still queued for the SIEM collectors
+	metrics.SecurityLog.close()
 
 	// Cleanup eBPF resources
 	if ebpfManager != nil && ebpfManager.IsEnabled() {
@@ -264,15 +717,52 @@ func runProxy(cmd *cobra.Command, args []string) {
 	fmt.Printf("MarchProxy shutdown complete\n")
 }
 
-// ProxyMetrics holds metrics for the proxy servers
+// ProxyMetrics holds metrics for the proxy servers. Per-connection counters
+// are updated with sync/atomic; per-packet and per-byte counters are sharded
+// so the relay paths never contend on a single cache line.
 type ProxyMetrics struct {
 	TCPConnections    int64
-	UDPPackets        int64
-	BytesTransferred  int64
+	UDPPackets        *counters.ShardedCounter
+	BytesTransferred  *counters.ShardedCounter
+	Traffic           traffic.Counter // Relayed bytes per mapping, service and tenant by direction
 	AuthSuccesses     int64
 	AuthFailures      int64
 	ActiveConnections int64
-	mu                sync.RWMutex
+	Dials             dialMetrics
+	MPTCP             mptcpTracker
+	RED               redMetrics
+	Fingerprints      *fingerprint.Tracker  // TLS client handshakes by JA3/JA4
+	Countries         *geoip.Traffic        // Connections and bytes by client country
+	Closes            closeMetrics          // Closed connections by close reason
+	UDPFlows          udpFlowStats          // Open UDP flows per mapping
+	Matches           matchMetrics          // Mapping selected per connection, and connections none matched
+	Tenants           *tenant.Limiter       // Per-tenant quotas and usage
+	Quarantine        *quarantine.Tracker   // Source services under the quarantine policy
+	DLP               dlp.Metrics           // Sensitive data found in outbound payloads
+	TLSInspection     *tlsinspect.Inspector // TLS interception of opted-in mappings, nil without a CA
+	TLSMode           *tlsmode.Enforcer     // Destination TLS modes of mappings
+	UpstreamProxies   *upstreamproxy.Set    // Dials through upstream proxies and their health
+	UpstreamPool      *connpool.Pool        // Warm destination connections per mapping
+	Resolver          *dnsproxy.Resolver    // Destination host name lookups per result
+	SSH               *sshAuditing          // SSH audit events and session recording
+	SecurityLog       *securityLog          // Security events forwarded to SIEM collectors
+	LogArchive        *logarchive.Archiver  // Rotated logs uploaded to object storage, nil when disabled
+	AuthAttempts      *auth.AttemptLimiter  // Authentication attempts and lockouts per client IP
+	Meter             *metering.Meter       // Billable usage per tenant and service, nil when disabled
+	License           *licensing.Gate       // Enterprise features enabled by the license
+	Rollout           rolloutTracker        // Applied config version and its outcomes, for canary rollouts
+	SNMP              *snmp.Agent           // MARCHPROXY-MIB for SNMP monitoring, nil when disabled
+}
+
+// NewProxyMetrics creates zeroed proxy metrics
+func NewProxyMetrics() *ProxyMetrics {
+	return &ProxyMetrics{
+		UDPPackets:       counters.NewShardedCounter(),
+		BytesTransferred: counters.NewShardedCounter(),
+		Countries:        geoip.NewTraffic(),
+		Tenants:          tenant.NewLimiter(),
+		TLSMode:          tlsmode.New(tlsmode.Options{}),
+	}
 }
 
 // TCPProxy implements a basic TCP proxy server
@@ -284,37 +774,126 @@ type TCPProxy struct {
 	metrics       *ProxyMetrics
 	ebpfManager   *ebpf.Manager
 	mtlsManager   *mtls.MTLSManager
-	listener      net.Listener
+	dialers       *outboundDialers
+	buffers       *bufpool.Manager
+	geo           *geoip.Reader // Client country lookups, nil without a database
+	mirror        *mirror.Mirror // Flow mirroring, nil when disabled
+	faults        *fault.Injector
+	listenAddr    string           // Overrides the configured listen address when set
+	binding       *manager.Listener // Mapping group for supervised listeners, nil = all mappings
+	listeners     []net.Listener
+	conns         map[net.Conn]struct{} // Client connections being handled
 	wg            sync.WaitGroup
 	stopping      bool
+	drained       bool // Remaining connections were closed at the drain timeout
 	mu            sync.RWMutex
 }
 
-// Start starts the TCP proxy server
-func (p *TCPProxy) Start(ctx context.Context) error {
-	var listener net.Listener
-	var err error
-
+// Listen opens the proxy's sockets ahead of Start, so they are bound once
+// Listen returns. Start opens them when Listen wasn't called.
+func (p *TCPProxy) Listen() error {
+	listenAddr := p.listenAddress()
+	
+	listeners, err := p.openListeners(listenAddr)
+	if err != nil {
+		return err
+	}
+	
 	// Create listener with or without TLS based on mTLS configuration
-	if p.config.IsMTLSEnabled() && p.mtlsManager != nil {
-		// Create TLS listener
-		tlsConfig := p.mtlsManager.GetTLSConfig()
-		listener, err = tls.Listen("tcp", p.config.GetListenAddress(), tlsConfig)
-		if err != nil {
-			return fmt.Errorf("failed to create TLS listener on %s: %w", p.config.GetListenAddress(), err)
+	if p.tlsEnabled() {
+		if p.mtlsManager == nil {
+			closeListeners(listeners)
+			return fmt.Errorf("TLS requested on %s but mTLS is not configured", listenAddr)
+		}
+		// Fingerprint client handshakes on a copy so each listener hooks
+		// the ClientHello once
+		tlsConfig := p.mtlsManager.GetTLSConfig().Clone()
+		fingerprint.Capture(tlsConfig, p.metrics.Fingerprints)
+		for i := range listeners {
+			listeners[i] = tls.NewListener(fingerprint.Listener(listeners[i]), tlsConfig)
 		}
-		fmt.Printf("TCP proxy listening on %s with mTLS enabled\n", p.config.GetListenAddress())
+		fmt.Printf("TCP proxy listening on %s with mTLS enabled (%d acceptors)\n", listenAddr, len(listeners))
 	} else {
-		// Create regular TCP listener
-		listener, err = net.Listen("tcp", p.config.GetListenAddress())
+		fmt.Printf("TCP proxy listening on %s (%d acceptors)\n", listenAddr, len(listeners))
+	}
+
+	p.mu.Lock()
+	p.listeners = listeners
+	p.mu.Unlock()
+	return nil
+}
+
+// Start starts the TCP proxy server
+func (p *TCPProxy) Start(ctx context.Context) error {
+	p.mu.RLock()
+	listeners := p.listeners
+	p.mu.RUnlock()
+	if listeners == nil {
+		if err := p.Listen(); err != nil {
+			return err
+		}
+		p.mu.RLock()
+		listeners = p.listeners
+		p.mu.RUnlock()
+	}
+	
+	// One accept loop per socket; with SO_REUSEPORT the kernel spreads
+	// incoming connections across them
+	var acceptors sync.WaitGroup
+	for _, listener := range listeners {
+		acceptors.Add(1)
+		go func(listener net.Listener) {
+			defer acceptors.Done()
+			p.acceptLoop(listener)
+		}(listener)
+	}
+	acceptors.Wait()
+	
+	return nil
+}
+
+// openListeners opens the TCP sockets for this proxy, one per acceptor when
+// SO_REUSEPORT is enabled, falling back to a single socket if it is unavailable
+func (p *TCPProxy) openListeners(listenAddr string) ([]net.Listener, error) {
+	// Unix sockets get one accept loop, without MPTCP or SO_REUSEPORT
+	if strings.HasPrefix(listenAddr, netutil.UnixPrefix) {
+		listener, err := netutil.ListenStream(listenAddr, "", p.config.GetListenSocketMode())
 		if err != nil {
-			return fmt.Errorf("failed to listen on %s: %w", p.config.GetListenAddress(), err)
+			return nil, fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
 		}
-		fmt.Printf("TCP proxy listening on %s\n", p.config.GetListenAddress())
+		return []net.Listener{listener}, nil
 	}
 
-	p.listener = listener
+	acceptors := p.config.GetAcceptors()
+	if p.config.EnableMPTCP {
+		count := 1
+		if p.config.ReusePort {
+			count = acceptors
+		}
+		listeners, err := netutil.ListenMPTCP("tcp", listenAddr, p.bindInterface(), count)
+		if err == nil {
+			return listeners, nil
+		}
+		fmt.Printf("Warning: MPTCP listener unavailable on %s, using plain TCP: %v\n", listenAddr, err)
+	}
+	
+	if p.config.ReusePort && acceptors > 1 {
+		listeners, err := netutil.ListenReusePort("tcp", listenAddr, p.bindInterface(), acceptors)
+		if err == nil {
+			return listeners, nil
+		}
+		fmt.Printf("Warning: SO_REUSEPORT unavailable on %s, using a single acceptor: %v\n", listenAddr, err)
+	}
 	
+	listener, err := netutil.Listen("tcp", listenAddr, p.bindInterface())
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+	return []net.Listener{listener}, nil
+}
+
+// acceptLoop accepts connections from one listener until the proxy stops
+func (p *TCPProxy) acceptLoop(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -323,7 +902,7 @@ func (p *TCPProxy) Start(ctx context.Context) error {
 			p.mu.RUnlock()
 			
 			if stopping {
-				break
+				return
 			}
 			
 			fmt.Printf("Accept error: %v\n", err)
@@ -333,21 +912,108 @@ func (p *TCPProxy) Start(ctx context.Context) error {
 		p.wg.Add(1)
 		go p.handleConnection(conn)
 	}
+}
+
+// CloseListeners stops accepting connections and closes the proxy's
+// sockets. Established connections are left to Stop.
+func (p *TCPProxy) CloseListeners() {
+	p.mu.Lock()
+	p.stopping = true
+	listeners := p.listeners
+	p.mu.Unlock()
 	
-	return nil
+	closeListeners(listeners)
 }
 
-// Stop stops the TCP proxy server
+// Stop stops the TCP proxy server. Established connections get the drain
+// timeout to finish before they are closed.
 func (p *TCPProxy) Stop() {
+	p.CloseListeners()
+	
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	
+	drainTimeout := time.Duration(p.config.DrainTimeout) * time.Second
+	if drainTimeout <= 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		p.mu.Lock()
+		p.drained = true
+		conns := make([]net.Conn, 0, len(p.conns))
+		for conn := range p.conns {
+			conns = append(conns, conn)
+		}
+		p.mu.Unlock()
+		
+		fmt.Printf("Drain timeout reached, closing %d connections on %s\n", len(conns), p.listenAddress())
+		for _, conn := range conns {
+			conn.Close()
+		}
+		<-done
+	}
+}
+
+// trackConn registers a client connection so a drain can close it and
+// returns a function that removes it again
+func (p *TCPProxy) trackConn(conn net.Conn) func() {
 	p.mu.Lock()
-	p.stopping = true
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
 	p.mu.Unlock()
 	
-	if p.listener != nil {
-		p.listener.Close()
+	return func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
 	}
+}
+
+// wasDrained returns true if remaining connections were closed at the drain timeout
+func (p *TCPProxy) wasDrained() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	
-	p.wg.Wait()
+	return p.drained
+}
+
+// closeListeners closes every listener in the slice
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// listenAddress returns the address this proxy instance listens on
+func (p *TCPProxy) listenAddress() string {
+	if p.listenAddr != "" {
+		return p.listenAddr
+	}
+	return p.config.GetListenAddress()
+}
+
+// bindInterface returns the interface this proxy instance binds its socket to
+func (p *TCPProxy) bindInterface() string {
+	if p.binding != nil && p.binding.BindInterface != "" {
+		return p.binding.BindInterface
+	}
+	return p.config.BindInterface
+}
+
+// tlsEnabled returns true if inbound connections on this listener use TLS
+func (p *TCPProxy) tlsEnabled() bool {
+	if p.binding != nil {
+		return p.binding.EnableTLS
+	}
+	return p.config.IsMTLSEnabled() && p.mtlsManager != nil
 }
 
 // handleConnection handles a single TCP connection
@@ -356,25 +1022,45 @@ func (p *TCPProxy) handleConnection(clientConn net.Conn) {
 	defer clientConn.Close()
 	
 	// Update metrics
-	p.metrics.mu.Lock()
-	p.metrics.TCPConnections++
-	p.metrics.ActiveConnections++
-	p.metrics.mu.Unlock()
+	atomic.AddInt64(&p.metrics.TCPConnections, 1)
+	atomic.AddInt64(&p.metrics.ActiveConnections, 1)
 	
 	defer func() {
-		p.metrics.mu.Lock()
-		p.metrics.ActiveConnections--
-		p.metrics.mu.Unlock()
+		atomic.AddInt64(&p.metrics.ActiveConnections, -1)
+	}()
+	
+	// RED metrics and the close reason for this connection, recorded once
+	// it closes. Connections handed to eBPF have no close reason.
+	start := time.Now()
+	var route, backend, reason string
+	var mapping *manager.Mapping
+	closed := closeError
+	defer p.trackConn(clientConn)()
+	defer func() {
+		p.metrics.RED.observe(route, backend, p.tenant(mapping), reason, time.Since(start))
+		if closed != "" && p.wasDrained() {
+			closed = closeDrain
+		}
+		if closed != "" {
+			p.metrics.Closes.record(route, closed)
+		}
+		if closed != "" && mapping != nil {
+			slo.Default.ObserveConnection(mapping.Name, closed == closeError)
+		}
+		if closed == closePolicyDenied || closed == closeAuthFailure {
+			p.metrics.SecurityLog.refused(clientConn.RemoteAddr(), mapping, route, reason, closed)
+		}
 	}()
 	
 	fmt.Printf("New connection from %s\n", clientConn.RemoteAddr())
 
 	// Log mTLS connection details if enabled
-	if p.config.IsMTLSEnabled() {
+	if p.tlsEnabled() {
 		if tlsConn, ok := clientConn.(*tls.Conn); ok {
 			// Perform TLS handshake to get certificate info
 			if err := tlsConn.Handshake(); err != nil {
 				fmt.Printf("TLS handshake failed for %s: %v\n", clientConn.RemoteAddr(), err)
+				reason = "tls_handshake"
 				return
 			}
 
@@ -383,6 +1069,9 @@ func (p *TCPProxy) handleConnection(clientConn net.Conn) {
 				clientConn.RemoteAddr(),
 				fmt.Sprintf("1.%d", connectionState.Version&0xff),
 				tls.CipherSuiteName(connectionState.CipherSuite))
+			if fp := fingerprint.ForConn(clientConn); fp != nil {
+				fmt.Printf("TLS fingerprint for %s: ja3=%s ja4=%s\n", clientConn.RemoteAddr(), fp.JA3, fp.JA4)
+			}
 
 			if len(connectionState.PeerCertificates) > 0 {
 				clientCert := connectionState.PeerCertificates[0]
@@ -392,8 +1081,10 @@ func (p *TCPProxy) handleConnection(clientConn net.Conn) {
 		}
 	}
 
-	// Check if eBPF should handle this connection
-	if p.ebpfManager != nil && p.ebpfManager.IsEnabled() {
+	// Check if eBPF should handle this connection. It never sees unix
+	// socket connections or multiplexed streams.
+	stream, _ := clientConn.(*muxStream)
+	if p.ebpfManager != nil && p.ebpfManager.IsEnabled() && clientConn.LocalAddr().Network() != "unix" && stream == nil {
 		// Parse connection details for eBPF check
 		srcIP := ipStringToUint32(getIPFromAddr(clientConn.RemoteAddr()))
 		dstIP := ipStringToUint32(getIPFromAddr(clientConn.LocalAddr()))
@@ -404,191 +1095,409 @@ func (p *TCPProxy) handleConnection(clientConn net.Conn) {
 		if !p.ebpfManager.ShouldFallbackToUserspace(srcIP, dstIP, srcPort, dstPort, 6) { // TCP = 6
 			// eBPF should handle this - close connection as eBPF will forward
 			fmt.Printf("eBPF handling connection from %s\n", clientConn.RemoteAddr())
+			closed = ""
 			return
 		}
 		fmt.Printf("eBPF fallback: handling in userspace %s\n", clientConn.RemoteAddr())
 	}
 	
+	// Client country for geo match criteria and per-country traffic
+	country := clientCountry(p.geo, clientConn.RemoteAddr())
+	if p.geo != nil {
+		p.metrics.Countries.Connection(country)
+	}
+
 	// Find a matching mapping for this connection
-	mapping := p.findMatchingMapping()
+	mapping = p.findMatchingMapping(tcpConnectionFacts(clientConn, country))
 	if mapping == nil {
-		fmt.Printf("No mapping found for connection from %s\n", clientConn.RemoteAddr())
+		fmt.Printf("No mapping found for connection from %s (country %s)\n", clientConn.RemoteAddr(), country)
+		reason = "no_mapping"
+		closed = closePolicyDenied
 		return
 	}
-	
-	// Check if authentication is required for this mapping
-	if mapping.AuthRequired {
-		if err := p.handleAuthentication(clientConn, mapping); err != nil {
+	route = mapping.Name
+
+	if geoip.Match(country, mapping.BlockedCountries) {
+		fmt.Printf("Connection from %s dropped: country %s blocked for mapping %s\n", clientConn.RemoteAddr(), country, mapping.Name)
+		reason = "geo_blocked"
+		closed = closePolicyDenied
+		return
+	}
+
+	// TLS fingerprint allow and deny lists for the mapping
+	if !fingerprint.Allowed(fingerprint.ForConn(clientConn), mapping.TLSFingerprintAllow, mapping.TLSFingerprintDeny) {
+		fmt.Printf("TLS fingerprint of %s not allowed for mapping %s\n", clientConn.RemoteAddr(), mapping.Name)
+		reason = "fingerprint_denied"
+		closed = closePolicyDenied
+		return
+	}
+
+	// Connection and request quotas of the mapping's tenant
+	tenantID := p.tenant(mapping)
+	release, quota := p.metrics.Tenants.Open(tenantID)
+	if quota != "" {
+		fmt.Printf("Connection from %s rejected: tenant %s over its %s quota\n", clientConn.RemoteAddr(), tenantID, quota)
+		reason = "tenant_quota"
+		closed = closePolicyDenied
+		return
+	}
+	defer release()
+	tuneTCPConn(p.config, clientConn, mapping)
+	defer p.metrics.MPTCP.track(clientConn)()
+	
+	// Check if authentication is required for this mapping or listener.
+	// Multiplexed streams carry the service their transport authenticated.
+	if bindingRequiresAuth(p.binding, mapping) {
+		var serviceID int
+		var err error
+		if stream != nil {
+			serviceID, err = stream.authorize(mapping)
+		} else {
+			serviceID, err = p.handleAuthentication(clientConn, mapping)
+		}
+		if err != nil {
 			fmt.Printf("Authentication failed for %s: %v\n", clientConn.RemoteAddr(), err)
+			reason = "auth_failed"
+			closed = closeAuthFailure
+			return
+		}
+
+		// Stricter policy for services flagged repeatedly
+		if refused := checkQuarantine(p.metrics.Quarantine, serviceID, clientConn.RemoteAddr().String()); refused != "" {
+			reason = refused
+			closed = closePolicyDenied
 			return
 		}
 	}
 	
+	// Injected faults for resilience testing
+	faults := p.faults.Decide(mapping.Name, mapping.FaultInjection)
+	time.Sleep(faults.Delay)
+	if faults.Abort {
+		fmt.Printf("Injected %s fault for %s on mapping %s\n", faults.AbortErrno, clientConn.RemoteAddr(), mapping.Name)
+		abortConnection(clientConn, faults.AbortErrno, time.Duration(p.config.ConnectionTimeout)*time.Second)
+		reason = "fault_abort"
+		return
+	}
+
+	// Sensitive data scanning of what the client sends
+	scanner, err := dlpScanners.Scanner(mapping.DLP)
+	if err != nil {
+		fmt.Printf("Connection from %s refused: invalid DLP policy on mapping %s: %v\n", clientConn.RemoteAddr(), mapping.Name, err)
+		reason = "dlp_invalid"
+		closed = closePolicyDenied
+		return
+	}
+	report := func([]dlp.Finding) {}
+	if scanner != nil {
+		report = dlpReporter(&p.metrics.DLP, p.metrics.SecurityLog, mapping, clientConn.RemoteAddr())
+	}
+
 	// Find destination service
 	destService := p.findDestinationService(mapping)
 	if destService == nil {
 		fmt.Printf("No destination service found for mapping %s\n", mapping.Name)
+		reason = "no_destination"
 		return
 	}
+	backend = destService.Name
 	
 	// Connect to destination - use mapping ports or default to 80
 	destPort := p.getDestinationPort(mapping)
-	destAddr := fmt.Sprintf("%s:%d", destService.IPFQDN, destPort)
-
-	var destConn net.Conn
-	// Use mTLS for outbound connections if configured
-	if p.config.IsMTLSEnabled() && p.mtlsManager != nil {
-		// Create mTLS client for outbound connection
-		httpClient, err := p.mtlsManager.CreateHTTPClient()
-		if err != nil {
-			fmt.Printf("Failed to create mTLS client for %s: %v\n", destAddr, err)
+	destAddr := net.JoinHostPort(destService.IPFQDN, strconv.Itoa(destPort))
+
+	// SSH auditing: full recording terminates SSH at the bastion, metadata
+	// mode observes the handshake on the relay below
+	var sshObserver *sshaudit.Observer
+	if mapping.SSH != nil {
+		if err := mapping.SSH.Validate(); err != nil {
+			fmt.Printf("Connection from %s refused: invalid SSH policy on mapping %s: %v\n", clientConn.RemoteAddr(), mapping.Name, err)
+			reason = "ssh_invalid"
+			closed = closePolicyDenied
+			return
+		}
+		if mapping.SSH.Mode() == sshaudit.RecordFull {
+			var sent, received int64
+			sent, received, reason, closed = p.serveSSH(clientConn, mapping, destAddr)
+			n := sent + received
+			p.metrics.BytesTransferred.Add(n)
+			p.metrics.Traffic.Egress(trafficKey(mapping, backend, tenantID), sent)
+			p.metrics.Traffic.Ingress(trafficKey(mapping, backend, tenantID), received)
+			p.metrics.Tenants.Count(tenantID, n)
+			p.metrics.Meter.Add(tenantID, backend, metering.Usage{Connections: 1, Bytes: uint64(n)})
 			return
 		}
+		sshObserver = sshaudit.NewObserver()
+	}
 
-		// For TCP proxy, we need to establish a direct TLS connection
-		if httpClient.Transport != nil {
-			if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
-				destConn, err = tls.Dial("tcp", destAddr, transport.TLSClientConfig)
-				if err != nil {
-					fmt.Printf("Failed to establish mTLS connection to %s: %v\n", destAddr, err)
-					return
-				}
-				fmt.Printf("mTLS connection established to destination %s\n", destAddr)
-			} else {
-				// Fallback to regular connection
-				destConn, err = net.Dial("tcp", destAddr)
-				if err != nil {
-					fmt.Printf("Failed to connect to destination %s: %v\n", destAddr, err)
-					return
-				}
-			}
-		} else {
-			// Fallback to regular connection
-			destConn, err = net.Dial("tcp", destAddr)
-			if err != nil {
-				fmt.Printf("Failed to connect to destination %s: %v\n", destAddr, err)
-				return
+	destConn, err := p.dialDestination(mapping, destAddr)
+	if err != nil {
+		fmt.Printf("Failed to connect to destination %s: %v\n", destAddr, err)
+		reason = "dial_failed"
+		return
+	}
+	defer destConn.Close()
+	tuneTCPConn(p.config, destConn, mapping)
+
+	// Billable usage of the connection, metered once it closes
+	var relayed atomic.Int64
+	defer func() {
+		p.metrics.Meter.Add(tenantID, backend, metering.Usage{Connections: 1, Bytes: uint64(relayed.Load())})
+		slo.Default.ObserveTransfer(mapping.Name, relayed.Load(), time.Since(start))
+	}()
+	defer p.metrics.MPTCP.track(destConn)()
+	
+	// Enforce the mapping's TLS mode, or terminate and re-encrypt the TLS
+	// of inspected mappings so DLP, mirroring and the domain policy see
+	// the plaintext
+	if mapping.TLSPolicy != nil {
+		clientConn, destConn, reason = p.applyTLSMode(clientConn, destConn, mapping, destAddr)
+		if reason != "" {
+			if tlsModeRefusal(reason) {
+				closed = closePolicyDenied
 			}
+			return
 		}
 	} else {
-		// Regular TCP connection
-		destConn, err = net.Dial("tcp", destAddr)
-		if err != nil {
-			fmt.Printf("Failed to connect to destination %s: %v\n", destAddr, err)
+		clientConn, destConn, reason = p.inspectTLS(clientConn, destConn, mapping)
+		if reason != "" {
+			if reason != "tls_inspection_failed" {
+				closed = closePolicyDenied
+			}
 			return
 		}
 	}
-	defer destConn.Close()
-	
+
 	fmt.Printf("Proxying connection from %s to %s (%s)\n", 
 		clientConn.RemoteAddr(), destAddr, destService.Name)
 	
-	// Start bidirectional forwarding
-	errChan := make(chan error, 2)
+	// Start bidirectional forwarding with pooled relay buffers
+	bufferSize := p.config.RelayBufferSize
+	if mapping.BufferSize > 0 {
+		bufferSize = mapping.BufferSize
+	}
+	results := make(chan relayResult, 2)
+
+	// Copy the flow to the mirror target when selected
+	flow := p.mirror.TCPFlow(mapping.Mirror, clientConn.RemoteAddr(), destConn.RemoteAddr())
+	defer flow.Close()
+	
+	// Both directions count towards the idle timeout
+	idle := newIdleTracker(time.Duration(p.config.IdleTimeout) * time.Second)
 	
 	// Forward client -> server
+	usage := trafficKey(mapping, backend, tenantID)
 	go func() {
-		_, err := io.Copy(destConn, clientConn)
-		errChan <- err
+		n, err := p.buffers.Copy(fault.Writer(scanner.Writer(p.metrics.Tenants.Writer(tenantID, destConn), report), faults.BandwidthKbps), flow.Reader(sshObserver.Reader(idle.reader(clientConn), true), true), bufferSize)
+		p.metrics.BytesTransferred.Add(n)
+		p.metrics.Traffic.Egress(usage, n)
+		p.metrics.Tenants.Count(tenantID, n)
+		relayed.Add(n)
+		if p.geo != nil {
+			p.metrics.Countries.Bytes(country, n)
+		}
+		results <- relayResult{fromClient: true, err: err}
 	}()
 	
 	// Forward server -> client
 	go func() {
-		_, err := io.Copy(clientConn, destConn)
-		errChan <- err
+		n, err := p.buffers.Copy(fault.Writer(p.metrics.Tenants.Writer(tenantID, clientConn), faults.BandwidthKbps), flow.Reader(sshObserver.Reader(idle.reader(destConn), false), false), bufferSize)
+		p.metrics.BytesTransferred.Add(n)
+		p.metrics.Traffic.Ingress(usage, n)
+		p.metrics.Tenants.Count(tenantID, n)
+		relayed.Add(n)
+		if p.geo != nil {
+			p.metrics.Countries.Bytes(country, n)
+		}
+		results <- relayResult{fromClient: false, err: err}
 	}()
 	
 	// Wait for either direction to close
-	err = <-errChan
-	if err != nil && err != io.EOF {
-		fmt.Printf("Proxy error: %v\n", err)
+	result := <-results
+	closed = result.closeReason()
+	if closed == closeError {
+		fmt.Printf("Proxy error: %v\n", result.err)
+		reason = "relay_error"
+	}
+	if errors.Is(result.err, dlp.ErrBlocked) {
+		reason = "dlp_blocked"
+	}
+	if errors.Is(result.err, sshaudit.ErrNotSSH) {
+		reason = "ssh_protocol"
+	}
+	if sshObserver != nil {
+		p.metrics.SSH.recordSession(mapping, clientConn.RemoteAddr(), destAddr, sshObserver.Session(), closed)
 	}
 	
-	fmt.Printf("Connection from %s to %s closed\n", clientConn.RemoteAddr(), destAddr)
+	fmt.Printf("Connection from %s to %s closed (%s)\n", clientConn.RemoteAddr(), destAddr, closed)
 }
 
-// handleAuthentication performs authentication for a connection
-func (p *TCPProxy) handleAuthentication(conn net.Conn, mapping *manager.Mapping) error {
-	// Send authentication challenge
-	authMsg := "MARCHPROXY_AUTH\nPlease provide authentication in format:\nSERVICE_ID:TOKEN\n"
-	if _, err := conn.Write([]byte(authMsg)); err != nil {
-		return fmt.Errorf("failed to send auth challenge: %w", err)
+// dialDestination connects to a mapping destination, using mTLS when configured
+func (p *TCPProxy) dialDestination(mapping *manager.Mapping, destAddr string) (net.Conn, error) {
+	ctx := context.Background()
+	
+	if p.config.IsMTLSEnabled() && p.mtlsManager != nil {
+		// Create mTLS client for outbound connection
+		httpClient, err := p.mtlsManager.CreateHTTPClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mTLS client: %w", err)
+		}
+		
+		// For TCP proxy, we need to establish a direct TLS connection
+		if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+			destConn, err := p.dialers.dialPooled(ctx, mapping, destAddr, transport.TLSClientConfig)
+			if err != nil {
+				return nil, fmt.Errorf("failed to establish mTLS connection: %w", err)
+			}
+			fmt.Printf("mTLS connection established to destination %s\n", destAddr)
+			return destConn, nil
+		}
 	}
 	
-	// Read authentication response
-	reader := bufio.NewReader(conn)
-	responseLine, err := reader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read auth response: %w", err)
+	// Regular TCP connection
+	return p.dialers.dialPooled(ctx, mapping, destAddr, nil)
+}
+
+// handleAuthentication performs authentication for a connection, returning
+// the authenticated service's ID
+func (p *TCPProxy) handleAuthentication(conn net.Conn, mapping *manager.Mapping) (int, error) {
+	return p.authenticateConn(conn, func(serviceID int, token string) error {
+		return authorizeMappingService(p.authenticator, mapping, serviceID, token)
+	})
+}
+
+// authenticateConn runs the authentication handshake on a connection,
+// checking the credentials with authorize
+func (p *TCPProxy) authenticateConn(conn net.Conn, authorize func(serviceID int, token string) error) (int, error) {
+	// Refuse clients over their attempt rate or locked out before reading
+	// any credentials
+	clientIP := getIPFromAddr(conn.RemoteAddr())
+	if refused, retryAfter := p.metrics.AuthAttempts.Allow(clientIP); refused != "" {
+		atomic.AddInt64(&p.metrics.AuthFailures, 1)
+		return 0, fmt.Errorf("authentication attempt refused (%s), retry after %s", refused, retryAfter.Round(time.Second))
 	}
-	response := strings.TrimSpace(responseLine)
 	
-	// Parse service ID and token
-	parts := strings.SplitN(response, ":", 2)
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid auth format, expected SERVICE_ID:TOKEN")
+	// Send authentication challenge
+	if _, err := conn.Write([]byte(authBanner())); err != nil {
+		return 0, fmt.Errorf("failed to send auth challenge: %w", err)
 	}
 	
-	var serviceID int
-	if _, err := fmt.Sscanf(parts[0], "%d", &serviceID); err != nil {
-		return fmt.Errorf("invalid service ID: %w", err)
+	// Read authentication response, bounding how long an unauthenticated
+	// client can hold the handshake open
+	if timeout := time.Duration(p.config.ConnectionTimeout) * time.Second; timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(conn)
+	responseLine, err := readCredentialsLine(reader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read auth response: %w", err)
 	}
 	
-	token := parts[1]
+	// Versioned clients pick a protocol version before anything else
+	version := authVersion1
+	if requested, ok, err := parseVersionRequest(responseLine); ok {
+		if err != nil {
+			writeAuthFailure(conn, authVersionLatest, authFailUnsupportedVersion)
+			p.authFailed(clientIP)
+			return 0, err
+		}
+		version = requested
+		if _, err := conn.Write([]byte(fmt.Sprintf("%s %d\n", authVersionAccepted, version))); err != nil {
+			return 0, fmt.Errorf("failed to send auth version: %w", err)
+		}
+		if responseLine, err = readCredentialsLine(reader); err != nil {
+			return 0, fmt.Errorf("failed to read auth response: %w", err)
+		}
+	}
 	
-	// Verify service ID is allowed for this mapping
-	allowed := false
-	for _, allowedServiceID := range mapping.SourceServices {
-		if allowedServiceID == serviceID {
-			allowed = true
-			break
+	// Challenge/response clients ask for a nonce before answering
+	if isChallengeRequest(responseLine) {
+		nonce, err := p.authenticator.IssueChallenge()
+		if err != nil {
+			writeAuthFailure(conn, version, authFailUnavailable)
+			return 0, err
+		}
+		if _, err := conn.Write([]byte(fmt.Sprintf("%s %s\n", authChallengeNext, nonce))); err != nil {
+			return 0, fmt.Errorf("failed to send auth nonce: %w", err)
+		}
+		if responseLine, err = readCredentialsLine(reader); err != nil {
+			return 0, fmt.Errorf("failed to read challenge response: %w", err)
 		}
 	}
+	response := strings.TrimSpace(responseLine)
 	
-	if !allowed {
-		return fmt.Errorf("service %d not allowed for mapping %s", serviceID, mapping.Name)
+	// Parse service ID and token
+	serviceID, token, err := parseServiceCredentials(response)
+	if err != nil {
+		writeAuthFailure(conn, version, authFailMalformed)
+		p.authFailed(clientIP)
+		return 0, err
 	}
 	
-	// Authenticate the service
-	if err := p.authenticator.AuthenticateService(serviceID, token); err != nil {
-		p.metrics.mu.Lock()
-		p.metrics.AuthFailures++
-		p.metrics.mu.Unlock()
-		return fmt.Errorf("authentication failed: %w", err)
+	// Verify service ID is allowed for this mapping and authenticate it
+	if err := authorize(serviceID, token); err != nil {
+		atomic.AddInt64(&p.metrics.AuthFailures, 1)
+		writeAuthFailure(conn, version, authFailDenied)
+		p.authFailed(clientIP)
+		return 0, err
 	}
 	
-	p.metrics.mu.Lock()
-	p.metrics.AuthSuccesses++
-	p.metrics.mu.Unlock()
+	atomic.AddInt64(&p.metrics.AuthSuccesses, 1)
+	p.metrics.AuthAttempts.Success(clientIP)
 	
 	// Send success response
 	if _, err := conn.Write([]byte("AUTH_OK\n")); err != nil {
-		return fmt.Errorf("failed to send auth success: %w", err)
+		return 0, fmt.Errorf("failed to send auth success: %w", err)
 	}
 	
 	fmt.Printf("Authentication successful for service %d from %s\n", serviceID, conn.RemoteAddr())
-	return nil
+	return serviceID, nil
 }
 
-// findMatchingMapping finds the first mapping that matches this connection
-func (p *TCPProxy) findMatchingMapping() *manager.Mapping {
+// authFailed records a failed authentication from clientIP, logging when it
+// locks the client out
+func (p *TCPProxy) authFailed(clientIP string) {
+	if lockout := p.metrics.AuthAttempts.Failure(clientIP); lockout > 0 {
+		fmt.Printf("Client %s locked out of authentication for %s after repeated failures\n", clientIP, lockout)
+	}
+}
+
+// tenant returns the tenant of a mapping, nil before a mapping matched
+func (p *TCPProxy) tenant(mapping *manager.Mapping) string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	if p.clusterConfig == nil {
-		return nil
-	}
+	return mappingTenant(p.clusterConfig, mapping)
+}
+
+// findMatchingMapping finds the most specific mapping that matches a
+// connection
+func (p *TCPProxy) findMatchingMapping(facts connectionFacts) *manager.Mapping {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	
-	// For now, return the first mapping with TCP protocol support
-	for _, mapping := range p.clusterConfig.Mappings {
-		for _, protocol := range mapping.Protocols {
-			if protocol == "tcp" {
-				return &mapping
-			}
-		}
+	mapping := matchMapping(p.clusterConfig, p.binding, facts, p.config.GetScheduleClockSkew())
+	p.metrics.Matches.record(mapping, facts)
+	return mapping
+}
+
+// tcpConnectionFacts describes a client connection from country for
+// mapping conditions
+func tcpConnectionFacts(clientConn net.Conn, country string) connectionFacts {
+	facts := connectionFacts{
+		Protocol:     "tcp",
+		Country:      country,
+		SourceIP:     getIPFromAddr(clientConn.RemoteAddr()),
+		SourcePort:   getPortFromAddr(clientConn.RemoteAddr()),
+		ListenerPort: getPortFromAddr(clientConn.LocalAddr()),
+		Fingerprint:  fingerprint.ForConn(clientConn),
 	}
-	
-	return nil
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		facts.TLS = true
+		facts.SNI = tlsConn.ConnectionState().ServerName
+	}
+	return facts
 }
 
 // findDestinationService finds a destination service for the mapping
@@ -596,45 +1505,12 @@ func (p *TCPProxy) findDestinationService(mapping *manager.Mapping) *manager.Ser
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	if p.clusterConfig == nil {
-		return nil
-	}
-	
-	// Find first available destination service
-	for _, serviceID := range mapping.DestServices {
-		for _, service := range p.clusterConfig.Services {
-			if service.ID == serviceID {
-				return &service
-			}
-		}
-	}
-	
-	return nil
+	return destinationService(p.clusterConfig, mapping)
 }
 
 // getDestinationPort returns the destination port from mapping or defaults to 80
 func (p *TCPProxy) getDestinationPort(mapping *manager.Mapping) int {
-	// Parse mapping ports - can be single port, range, or list
-	ports := mapping.Ports
-	if ports == "" {
-		return 80 // Default to HTTP port
-	}
-	
-	// For now, just parse single port or take first port from list
-	var port int
-	if _, err := fmt.Sscanf(ports, "%d", &port); err == nil {
-		return port
-	}
-	
-	// If parsing fails, check for comma-separated list
-	if parts := strings.Split(ports, ","); len(parts) > 0 {
-		if _, err := fmt.Sscanf(strings.TrimSpace(parts[0]), "%d", &port); err == nil {
-			return port
-		}
-	}
-	
-	// Default to port 80 if all parsing fails
-	return 80
+	return destinationPort(mapping, 80) // Default to HTTP port
 }
 
 // updateConfiguration updates the proxy's cluster configuration
@@ -658,27 +1534,55 @@ type UDPProxy struct {
 	metrics       *ProxyMetrics
 	ebpfManager   *ebpf.Manager
 	mtlsManager   *mtls.MTLSManager
+	dialers       *outboundDialers
+	buffers       *bufpool.Manager
+	geo           *geoip.Reader // Client country lookups, nil without a database
+	mirror        *mirror.Mirror // Flow mirroring, nil when disabled
+	faults        *fault.Injector
+	sessions      *udpSessionTable
+	flows         *udpFlowTable     // Destination sockets per client and mapping
+	listenAddr    string           // Overrides the derived UDP listen address when set
+	binding       *manager.Listener // Mapping group for supervised listeners, nil = all mappings
 	conn          *net.UDPConn
 	stopping      bool
 	mu            sync.RWMutex
 }
 
-// Start starts the UDP proxy server
-func (p *UDPProxy) Start(ctx context.Context) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", p.config.ListenPort+1000))
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
-	}
-	
-	conn, err := net.ListenUDP("udp", udpAddr)
+// Listen opens the proxy's socket ahead of Start, so it is bound once Listen
+// returns. Start opens it when Listen wasn't called.
+func (p *UDPProxy) Listen() error {
+	udpAddr := p.listenAddress()
+	packetConn, err := netutil.ListenPacket("udp", udpAddr, p.bindInterface())
 	if err != nil {
 		return fmt.Errorf("failed to listen on UDP %s: %w", udpAddr, err)
 	}
 	
-	p.conn = conn
+	p.mu.Lock()
+	p.conn = packetConn.(*net.UDPConn)
+	p.mu.Unlock()
 	fmt.Printf("UDP proxy listening on %s\n", udpAddr)
+	return nil
+}
+
+// Start starts the UDP proxy server
+func (p *UDPProxy) Start(ctx context.Context) error {
+	p.mu.RLock()
+	conn := p.conn
+	p.mu.RUnlock()
+	if conn == nil {
+		if err := p.Listen(); err != nil {
+			return err
+		}
+		p.mu.RLock()
+		conn = p.conn
+		p.mu.RUnlock()
+	}
 	
-	buffer := make([]byte, 4096)
+	go p.expireSessions(ctx)
+	
+	// Each datagram gets its own pooled buffer, returned once the packet
+	// goroutine has finished with it
+	pool := p.buffers.Pool(p.config.UDPBufferSize)
 	for {
 		p.mu.RLock()
 		stopping := p.stopping
@@ -688,8 +1592,10 @@ func (p *UDPProxy) Start(ctx context.Context) error {
 			break
 		}
 		
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
+		buffer := pool.Get()
+		n, clientAddr, err := conn.ReadFromUDP(*buffer)
 		if err != nil {
+			pool.Put(buffer)
 			if stopping {
 				break
 			}
@@ -698,114 +1604,333 @@ func (p *UDPProxy) Start(ctx context.Context) error {
 		}
 		
 		// Handle UDP packet in goroutine for concurrency
-		go p.handleUDPPacket(buffer[:n], clientAddr)
+		go func() {
+			defer pool.Put(buffer)
+			p.handleUDPPacket((*buffer)[:n], clientAddr)
+		}()
 	}
 	
 	return nil
 }
 
-// Stop stops the UDP proxy server
+// Stop stops the UDP proxy server and ends its sessions
 func (p *UDPProxy) Stop() {
 	p.mu.Lock()
 	p.stopping = true
+	conn := p.conn
 	p.mu.Unlock()
 	
-	if p.conn != nil {
-		p.conn.Close()
+	if conn != nil {
+		conn.Close()
+	}
+	p.flows.closeAll(closeDrain)
+	p.sessions.closeAll(closeDrain)
+}
+
+// listenAddress returns the address this proxy instance listens on
+func (p *UDPProxy) listenAddress() string {
+	if p.listenAddr != "" {
+		return p.listenAddr
 	}
+	return p.config.GetUDPListenAddress()
+}
+
+// bindInterface returns the interface this proxy instance binds its socket to
+func (p *UDPProxy) bindInterface() string {
+	if p.binding != nil && p.binding.BindInterface != "" {
+		return p.binding.BindInterface
+	}
+	return p.config.BindInterface
 }
 
 // handleUDPPacket handles a single UDP packet
 func (p *UDPProxy) handleUDPPacket(data []byte, clientAddr *net.UDPAddr) {
 	// Update metrics
-	p.metrics.mu.Lock()
-	p.metrics.UDPPackets++
-	p.metrics.BytesTransferred += int64(len(data))
-	p.metrics.mu.Unlock()
+	p.metrics.UDPPackets.Inc()
+	p.metrics.BytesTransferred.Add(int64(len(data)))
+	
+	// RED metrics for this datagram exchange
+	start := time.Now()
+	var route, backend, reason string
+	var mapping *manager.Mapping
+	defer func() {
+		p.metrics.RED.observe(route, backend, p.tenant(mapping), reason, time.Since(start))
+	}()
 	
 	fmt.Printf("UDP packet from %s, size: %d bytes\n", clientAddr, len(data))
 	
+	// Client country for geo match criteria and per-country traffic
+	country := clientCountry(p.geo, clientAddr)
+	if p.geo != nil {
+		p.metrics.Countries.Bytes(country, int64(len(data)))
+	}
+
 	// Find a matching mapping for UDP traffic
-	mapping := p.findMatchingUDPMapping()
+	facts := connectionFacts{
+		Protocol:   "udp",
+		Country:    country,
+		SourceIP:   clientAddr.IP.String(),
+		SourcePort: clientAddr.Port,
+	}
+	if local, ok := p.conn.LocalAddr().(*net.UDPAddr); ok {
+		facts.ListenerPort = local.Port
+	}
+	mapping = p.findMatchingUDPMapping(facts)
 	if mapping == nil {
-		fmt.Printf("No UDP mapping found for packet from %s\n", clientAddr)
+		fmt.Printf("No UDP mapping found for packet from %s (country %s)\n", clientAddr, country)
+		reason = "no_mapping"
+		return
+	}
+	route = mapping.Name
+
+	if geoip.Match(country, mapping.BlockedCountries) {
+		fmt.Printf("UDP packet from %s dropped: country %s blocked for mapping %s\n", clientAddr, country, mapping.Name)
+		reason = "geo_blocked"
 		return
 	}
 	
+	// Authenticated mappings only forward datagrams from established sessions
+	if bindingRequiresAuth(p.binding, mapping) {
+		if isUDPAuthDatagram(data) {
+			p.handleUDPAuthentication(data, clientAddr, mapping)
+			return
+		}
+		
+		var session *udpSession
+		id, payload, ok := splitUDPSessionID(data)
+		if ok {
+			session = p.sessions.lookup(clientAddr.String(), id)
+		}
+		if session == nil || session.MappingID != mapping.ID {
+			fmt.Printf("UDP packet from %s dropped: no authenticated session for mapping %s\n", clientAddr, mapping.Name)
+			p.conn.WriteToUDP([]byte(udpAuthRequired), clientAddr)
+			reason = "auth_failed"
+			return
+		}
+		data = payload
+
+		// Stricter policy for services flagged repeatedly
+		if refused := checkQuarantine(p.metrics.Quarantine, session.ServiceID, clientAddr.String()); refused != "" {
+			reason = refused
+			return
+		}
+	}
+	
+	// Request rate and bandwidth quotas of the mapping's tenant
+	tenantID := p.tenant(mapping)
+	if !p.metrics.Tenants.Request(tenantID) {
+		fmt.Printf("UDP packet from %s dropped: tenant %s over its requests quota\n", clientAddr, tenantID)
+		reason = "tenant_quota"
+		return
+	}
+	p.metrics.Tenants.Count(tenantID, int64(len(data)))
+	p.metrics.Tenants.Wait(tenantID, len(data))
+	
+	// Injected faults for resilience testing; aborted datagrams are dropped
+	faults := p.faults.Decide(mapping.Name, mapping.FaultInjection)
+	time.Sleep(faults.Delay + datagramDelay(len(data), faults.BandwidthKbps))
+	if faults.Abort {
+		fmt.Printf("UDP packet from %s dropped by injected fault on mapping %s\n", clientAddr, mapping.Name)
+		reason = "fault_abort"
+		return
+	}
+
+	// Sensitive data scanning of the datagram
+	if data, reason = p.scanDatagram(data, mapping, clientAddr); reason != "" {
+		return
+	}
+
 	// Find destination service
 	destService := p.findDestinationService(mapping)
 	if destService == nil {
 		fmt.Printf("No destination service found for UDP mapping %s\n", mapping.Name)
+		reason = "no_destination"
 		return
 	}
+	backend = destService.Name
 	
-	// For UDP, we don't have persistent connections, so we forward each packet individually
+	// The client's datagrams through this mapping share one destination
+	// socket, so every reply the destination sends is relayed back
 	destPort := p.getDestinationPort(mapping)
-	destAddr := fmt.Sprintf("%s:%d", destService.IPFQDN, destPort)
-	destUDPAddr, err := net.ResolveUDPAddr("udp", destAddr)
-	if err != nil {
-		fmt.Printf("Failed to resolve destination UDP address %s: %v\n", destAddr, err)
+	destAddr := net.JoinHostPort(destService.IPFQDN, strconv.Itoa(destPort))
+	key := trafficKey(mapping, backend, tenantID)
+	flow, created, err := p.flows.open(udpFlowKey{client: clientAddr.String(), mapping: mapping.ID}, mapping.Name, func() (net.Conn, *mirror.Flow, error) {
+		destConn, err := p.dialers.dial(context.Background(), "udp", mapping, destAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return destConn, p.mirror.UDPFlow(mapping.Mirror, clientAddr, destConn.RemoteAddr()), nil
+	})
+	switch {
+	case errors.Is(err, errUDPFlowLimit):
+		fmt.Printf("UDP packet from %s dropped: UDP flow limit reached\n", clientAddr)
+		reason = "flow_limit"
 		return
-	}
-	
-	// Create a connection to destination
-	destConn, err := net.DialUDP("udp", nil, destUDPAddr)
-	if err != nil {
+	case errors.Is(err, errUDPFlowClosed):
+		reason = "draining"
+		return
+	case err != nil:
 		fmt.Printf("Failed to connect to UDP destination %s: %v\n", destAddr, err)
+		reason = "dial_failed"
 		return
 	}
-	defer destConn.Close()
-	
+	if created {
+		p.flows.relay(flow, func(response []byte) error {
+			return p.relayUDPResponse(response, clientAddr, country, key)
+		})
+	}
+
 	// Forward the packet
-	_, err = destConn.Write(data)
-	if err != nil {
+	if err := flow.write(data); err != nil {
 		fmt.Printf("Failed to forward UDP packet to %s: %v\n", destAddr, err)
+		reason = "relay_error"
+		return
+	}
+	p.metrics.Traffic.Egress(key, int64(len(data)))
+	p.metrics.Meter.Add(tenantID, backend, metering.Usage{Requests: 1, Bytes: uint64(len(data))})
+
+	fmt.Printf("UDP packet forwarded: %s -> %s\n", clientAddr, destAddr)
+}
+
+// relayUDPResponse sends a datagram of a flow's destination back to its
+// client
+func (p *UDPProxy) relayUDPResponse(response []byte, clientAddr *net.UDPAddr, country string, key traffic.Key) error {
+	p.metrics.Tenants.Count(key.Tenant, int64(len(response)))
+	p.metrics.Tenants.Wait(key.Tenant, len(response))
+
+	if _, err := p.conn.WriteToUDP(response, clientAddr); err != nil {
+		fmt.Printf("Failed to send UDP response to %s: %v\n", clientAddr, err)
+		return err
+	}
+
+	// Update response metrics
+	p.metrics.BytesTransferred.Add(int64(len(response)))
+	p.metrics.Traffic.Ingress(key, int64(len(response)))
+	p.metrics.Meter.Add(key.Tenant, key.Service, metering.Usage{Bytes: uint64(len(response))})
+	if p.geo != nil {
+		p.metrics.Countries.Bytes(country, int64(len(response)))
+	}
+	return nil
+}
+
+// scanDatagram applies the mapping's DLP policy to a datagram, returning
+// the datagram to forward, masked if needed, or the reason it is dropped
+func (p *UDPProxy) scanDatagram(data []byte, mapping *manager.Mapping, clientAddr *net.UDPAddr) ([]byte, string) {
+	scanner, err := dlpScanners.Scanner(mapping.DLP)
+	if err != nil {
+		fmt.Printf("UDP packet from %s dropped: invalid DLP policy on mapping %s: %v\n", clientAddr, mapping.Name, err)
+		return nil, "dlp_invalid"
+	}
+	if scanner == nil {
+		return data, ""
+	}
+	findings := scanner.Scan(data)
+	if len(findings) == 0 {
+		return data, ""
+	}
+
+	dlpReporter(&p.metrics.DLP, p.metrics.SecurityLog, mapping, clientAddr)(findings)
+	switch scanner.Action() {
+	case dlp.ActionBlock:
+		return nil, "dlp_blocked"
+	case dlp.ActionMask:
+		masked := append([]byte(nil), data...)
+		dlp.Mask(masked, findings)
+		return masked, ""
+	}
+	return data, ""
+}
+
+// handleUDPAuthentication processes a session handshake datagram
+func (p *UDPProxy) handleUDPAuthentication(data []byte, clientAddr *net.UDPAddr, mapping *manager.Mapping) {
+	clientIP := clientAddr.IP.String()
+	if refused, retryAfter := p.metrics.AuthAttempts.Allow(clientIP); refused != "" {
+		atomic.AddInt64(&p.metrics.AuthFailures, 1)
+		
+		fmt.Printf("UDP authentication attempt from %s refused (%s), retry after %s\n", clientAddr, refused, retryAfter.Round(time.Second))
+		p.conn.WriteToUDP([]byte(udpAuthFail+" "+refused+"\n"), clientAddr)
 		return
 	}
 	
-	// Read response
-	responseBuffer := make([]byte, 4096)
-	destConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, err := destConn.Read(responseBuffer)
+	if isChallengeRequest(strings.TrimPrefix(string(data), udpAuthPrefix)) {
+		nonce, err := p.authenticator.IssueChallenge()
+		if err != nil {
+			fmt.Printf("Failed to issue UDP auth challenge to %s: %v\n", clientAddr, err)
+			p.conn.WriteToUDP([]byte(udpAuthFail+" internal error\n"), clientAddr)
+			return
+		}
+		p.conn.WriteToUDP([]byte(fmt.Sprintf("%s %s\n", authChallengeNext, nonce)), clientAddr)
+		return
+	}
+	
+	serviceID, token, err := parseUDPAuthDatagram(data)
+	if err == nil {
+		err = authorizeMappingService(p.authenticator, mapping, serviceID, token)
+	}
+	
 	if err != nil {
-		fmt.Printf("Failed to read UDP response from %s: %v\n", destAddr, err)
+		atomic.AddInt64(&p.metrics.AuthFailures, 1)
+		if lockout := p.metrics.AuthAttempts.Failure(clientIP); lockout > 0 {
+			fmt.Printf("Client %s locked out of authentication for %s after repeated failures\n", clientIP, lockout)
+		}
+		
+		fmt.Printf("UDP authentication failed for %s: %v\n", clientAddr, err)
+		p.conn.WriteToUDP([]byte(udpAuthFail+" authentication failed\n"), clientAddr)
 		return
 	}
 	
-	// Send response back to client
-	_, err = p.conn.WriteToUDP(responseBuffer[:n], clientAddr)
+	session, err := p.sessions.create(clientAddr.String(), serviceID, mapping.ID, mapping.Name)
 	if err != nil {
-		fmt.Printf("Failed to send UDP response to %s: %v\n", clientAddr, err)
+		fmt.Printf("Failed to create UDP session for %s: %v\n", clientAddr, err)
+		p.conn.WriteToUDP([]byte(udpAuthFail+" internal error\n"), clientAddr)
 		return
 	}
 	
-	// Update response metrics
-	p.metrics.mu.Lock()
-	p.metrics.BytesTransferred += int64(n)
-	p.metrics.mu.Unlock()
+	atomic.AddInt64(&p.metrics.AuthSuccesses, 1)
+	p.metrics.AuthAttempts.Success(clientIP)
 	
-	fmt.Printf("UDP packet forwarded: %s -> %s -> %s\n", clientAddr, destAddr, clientAddr)
+	if _, err := p.conn.WriteToUDP([]byte(fmt.Sprintf("%s %s\n", udpAuthOK, session.ID)), clientAddr); err != nil {
+		fmt.Printf("Failed to send UDP auth success to %s: %v\n", clientAddr, err)
+		return
+	}
+	
+	fmt.Printf("UDP session %s established for service %d from %s\n", session.ID, serviceID, clientAddr)
 }
 
-// findMatchingUDPMapping finds the first mapping that supports UDP
-func (p *UDPProxy) findMatchingUDPMapping() *manager.Mapping {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	
-	if p.clusterConfig == nil {
-		return nil
-	}
+// expireSessions periodically removes idle UDP sessions
+func (p *UDPProxy) expireSessions(ctx context.Context) {
+	ticker := time.NewTicker(p.sessions.ttl / 2)
+	defer ticker.Stop()
 	
-	// For now, return the first mapping with UDP protocol support
-	for _, mapping := range p.clusterConfig.Mappings {
-		for _, protocol := range mapping.Protocols {
-			if protocol == "udp" {
-				return &mapping
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := p.sessions.expire(); removed > 0 {
+				fmt.Printf("Expired %d idle UDP sessions\n", removed)
 			}
 		}
 	}
+}
+
+// tenant returns the tenant of a mapping, nil before a mapping matched
+func (p *UDPProxy) tenant(mapping *manager.Mapping) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	
-	return nil
+	return mappingTenant(p.clusterConfig, mapping)
+}
+
+// findMatchingUDPMapping finds the most specific mapping that supports UDP
+// for a client datagram
+func (p *UDPProxy) findMatchingUDPMapping(facts connectionFacts) *manager.Mapping {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	mapping := matchMapping(p.clusterConfig, p.binding, facts, p.config.GetScheduleClockSkew())
+	p.metrics.Matches.record(mapping, facts)
+	return mapping
 }
 
 // findDestinationService finds a destination service for the mapping (shared with TCP)
@@ -813,45 +1938,12 @@ func (p *UDPProxy) findDestinationService(mapping *manager.Mapping) *manager.Ser
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	if p.clusterConfig == nil {
-		return nil
-	}
-	
-	// Find first available destination service
-	for _, serviceID := range mapping.DestServices {
-		for _, service := range p.clusterConfig.Services {
-			if service.ID == serviceID {
-				return &service
-			}
-		}
-	}
-	
-	return nil
+	return destinationService(p.clusterConfig, mapping)
 }
 
 // getDestinationPort returns the destination port from mapping or defaults to 53 for UDP
 func (p *UDPProxy) getDestinationPort(mapping *manager.Mapping) int {
-	// Parse mapping ports - can be single port, range, or list
-	ports := mapping.Ports
-	if ports == "" {
-		return 53 // Default to DNS port for UDP
-	}
-	
-	// For now, just parse single port or take first port from list
-	var port int
-	if _, err := fmt.Sscanf(ports, "%d", &port); err == nil {
-		return port
-	}
-	
-	// If parsing fails, check for comma-separated list
-	if parts := strings.Split(ports, ","); len(parts) > 0 {
-		if _, err := fmt.Sscanf(strings.TrimSpace(parts[0]), "%d", &port); err == nil {
-			return port
-		}
-	}
-	
-	// Default to port 53 if all parsing fails
-	return 53
+	return destinationPort(mapping, 53) // Default to DNS port for UDP
 }
 
 // updateConfiguration updates the proxy's cluster configuration
@@ -861,10 +1953,14 @@ func (p *UDPProxy) updateConfiguration(config *manager.ClusterConfig) {
 	
 	p.clusterConfig = config
 	p.authenticator.UpdateServices(config.Services)
+	
+	if removed := p.sessions.retainServices(config.Services); removed > 0 {
+		fmt.Printf("Revoked %d UDP sessions for removed services\n", removed)
+	}
 }
 
 // startAdminServer starts the admin/metrics HTTP server
-func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mtlsMgr *mtls.MTLSManager) error {
+func startAdminServer(listener net.Listener, ready *readiness.Tracker, cfg *config.Config, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mtlsMgr *mtls.MTLSManager, buffers *bufpool.Manager, configHistory *manager.ConfigHistory, managerClient *manager.Client, authenticator *auth.Authenticator, geo *geoip.Reader, flowMirror *mirror.Mirror, captures *capture.Manager, faults *fault.Injector, selfMonitor *selfmon.Monitor, snapshotUDPSessions func() *udpHandoff, dnsServer *dnsProxy, smtpServer *smtpRelay, socksServer *socksListener, icmpServer *icmpRelay, muxServer *muxListener) error {
 	mux := http.NewServeMux()
 	
 	// Health check endpoint
@@ -882,17 +1978,19 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 
 		fmt.Fprintf(w, `{"status":"healthy","version":"%s","mtls":"%s"}`, version, mtlsStatus)
 	})
+
+	// Readiness for rollouts, once startup has finished
+	mux.Handle("/readyz", ready)
 	
 	// Comprehensive metrics endpoint
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics.mu.RLock()
-		tcpConnections := metrics.TCPConnections
-		udpPackets := metrics.UDPPackets
-		bytesTransferred := metrics.BytesTransferred
-		authSuccesses := metrics.AuthSuccesses
-		authFailures := metrics.AuthFailures
-		activeConnections := metrics.ActiveConnections
-		metrics.mu.RUnlock()
+		tcpConnections := atomic.LoadInt64(&metrics.TCPConnections)
+		udpPackets := metrics.UDPPackets.Load()
+		bytesTransferred := metrics.BytesTransferred.Load()
+		authSuccesses := atomic.LoadInt64(&metrics.AuthSuccesses)
+		authFailures := atomic.LoadInt64(&metrics.AuthFailures)
+		activeConnections := atomic.LoadInt64(&metrics.ActiveConnections)
+		mptcpConnections, mptcpSubflows := metrics.MPTCP.stats()
 		
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
@@ -926,6 +2024,127 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 		fmt.Fprintf(w, "# TYPE marchproxy_active_connections gauge\n")
 		fmt.Fprintf(w, "marchproxy_active_connections %d\n", activeConnections)
 		
+		// Multipath TCP connections and subflows
+		fmt.Fprintf(w, "# HELP marchproxy_mptcp_connections Current number of connections using Multipath TCP\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_mptcp_connections gauge\n")
+		fmt.Fprintf(w, "marchproxy_mptcp_connections %d\n", mptcpConnections)
+		
+		fmt.Fprintf(w, "# HELP marchproxy_mptcp_subflows Current number of subflows across Multipath TCP connections\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_mptcp_subflows gauge\n")
+		fmt.Fprintf(w, "marchproxy_mptcp_subflows %d\n", mptcpSubflows)
+		
+		// Outbound dial latency per mapping
+		metrics.Dials.writePrometheus(w)
+		
+		// Request rate, errors and duration per route, backend and tenant
+		metrics.RED.writePrometheus(w)
+
+		// Closed connections and UDP sessions per route and close reason
+		metrics.Closes.writePrometheus(w)
+
+		// UDP flows per mapping
+		metrics.UDPFlows.writePrometheus(w)
+
+		// Mapping selections and connections no mapping matched
+		metrics.Matches.writePrometheus(w)
+
+		// TLS client handshakes per fingerprint
+		metrics.Fingerprints.WritePrometheus(w)
+
+		// Connections and bytes per client country
+		metrics.Countries.WritePrometheus(w)
+
+		// Flows and frames sent to the mirror target
+		flowMirror.WritePrometheus(w)
+
+		// Faults injected per mapping
+		faults.WritePrometheus(w)
+
+		// DNS queries per source service and result
+		dnsServer.WritePrometheus(w)
+		smtpServer.WritePrometheus(w)
+
+		// SOCKS5 requests per source service and result
+		socksServer.WritePrometheus(w)
+
+		// ICMP echoes, replies and round trips per mapping
+		icmpServer.WritePrometheus(w)
+
+		// Multiplexed transports and stream requests per result
+		muxServer.WritePrometheus(w)
+
+		// Goroutines, heap and file descriptors from the self-monitor
+		selfMonitor.WritePrometheus(w)
+
+		// Connections, bytes and quota rejections per tenant
+		metrics.Tenants.WritePrometheus(w, redModule)
+
+		// Quarantined services and their refused connections
+		metrics.Quarantine.WritePrometheus(w)
+
+		// Sensitive data found per mapping, detector and action
+		metrics.DLP.WritePrometheus(w)
+
+		// TLS inspection decisions per mapping and minted certificates
+		metrics.TLSInspection.WritePrometheus(w)
+
+		// TLS mode outcomes and handshake failure reasons per mapping
+		metrics.TLSMode.WritePrometheus(w)
+
+		// Dials through upstream proxies per result and fallbacks per mapping
+		metrics.UpstreamProxies.WritePrometheus(w)
+
+		// Warm destination connections, pool hits and evictions
+		metrics.UpstreamPool.WritePrometheus(w)
+
+		// Destination host name lookups, upstream errors and cached answers
+		metrics.Resolver.WritePrometheus(w)
+
+		// Security event delivery per SIEM sink
+		metrics.SecurityLog.writePrometheus(w)
+
+		// Rotated log uploads to object storage
+		metrics.LogArchive.WritePrometheus(w)
+
+		// SNMP requests answered and refused
+		metrics.SNMP.WritePrometheus(w)
+
+		// Usage record exports per sink
+		metrics.Meter.WritePrometheus(w)
+
+		// Enterprise features enabled by the license
+		metrics.License.WritePrometheus(w)
+
+		// Authentication attempts refused and clients locked out
+		metrics.AuthAttempts.WritePrometheus(w)
+
+		// Authentications with credentials replaced by a rotation
+		authenticator.WritePrometheus(w)
+		
+		// Days to expiry of every loaded certificate
+		certs.Default.WritePrometheus(w, redModule)
+
+		// Compliance, error budgets and burn rates of mapping SLOs
+		slo.Default.WritePrometheus(w)
+		
+		// Relay buffer pool activity per size class
+		bufferStats := buffers.Stats()
+		fmt.Fprintf(w, "# HELP marchproxy_buffer_pool_gets_total Buffers taken from the relay pool\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_buffer_pool_gets_total counter\n")
+		for _, stat := range bufferStats {
+			fmt.Fprintf(w, `marchproxy_buffer_pool_gets_total{size="%d"} %d`+"\n", stat.Size, stat.Gets)
+		}
+		fmt.Fprintf(w, "# HELP marchproxy_buffer_pool_allocs_total Buffers newly allocated because the pool was empty\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_buffer_pool_allocs_total counter\n")
+		for _, stat := range bufferStats {
+			fmt.Fprintf(w, `marchproxy_buffer_pool_allocs_total{size="%d"} %d`+"\n", stat.Size, stat.Allocs)
+		}
+		fmt.Fprintf(w, "# HELP marchproxy_buffer_pool_in_use Buffers currently checked out of the pool\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_buffer_pool_in_use gauge\n")
+		for _, stat := range bufferStats {
+			fmt.Fprintf(w, `marchproxy_buffer_pool_in_use{size="%d"} %d`+"\n", stat.Size, stat.InUse)
+		}
+		
 		// Version information
 		fmt.Fprintf(w, "# HELP marchproxy_version_info Version information\n")
 		fmt.Fprintf(w, "# TYPE marchproxy_version_info gauge\n")
@@ -962,6 +2181,16 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 				fmt.Fprintf(w, "# TYPE marchproxy_mtls_verify_client_cert gauge\n")
 				fmt.Fprintf(w, "marchproxy_mtls_verify_client_cert %d\n", verifyClientCert)
 			}
+			
+			// Client certificate revocation checks
+			if revocation := mtlsMgr.GetRevocationChecker(); revocation != nil {
+				revocation.WritePrometheus(w)
+			}
+
+			// Certificates issued by the cluster CA
+			if issuer := mtlsMgr.GetIssuer(); issuer != nil {
+				issuer.WritePrometheus(w)
+			}
 		}
 
 		// eBPF metrics
@@ -972,6 +2201,11 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 			fmt.Fprintf(w, "# TYPE marchproxy_ebpf_enabled gauge\n")
 			fmt.Fprintf(w, "marchproxy_ebpf_enabled %d\n", map[bool]int{true: 1, false: 0}[ebpfStats.ProgramLoaded])
 			
+			fmt.Fprintf(w, "# HELP marchproxy_ebpf_mode_info Selected eBPF acceleration mode and program variant\n")
+			fmt.Fprintf(w, "# TYPE marchproxy_ebpf_mode_info gauge\n")
+			fmt.Fprintf(w, `marchproxy_ebpf_mode_info{mode="%s",variant="%s",kernel="%s"} 1`+"\n",
+				ebpfStats.Mode, ebpfStats.ProgramVariant, ebpfStats.KernelVersion)
+			
 			fmt.Fprintf(w, "# HELP marchproxy_ebpf_total_packets Total packets processed by eBPF\n")
 			fmt.Fprintf(w, "# TYPE marchproxy_ebpf_total_packets counter\n")
 			fmt.Fprintf(w, "marchproxy_ebpf_total_packets %d\n", ebpfProxyStats.TotalPackets)
@@ -991,23 +2225,44 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 			fmt.Fprintf(w, "# HELP marchproxy_ebpf_map_sync_errors eBPF map synchronization errors\n")
 			fmt.Fprintf(w, "# TYPE marchproxy_ebpf_map_sync_errors counter\n")
 			fmt.Fprintf(w, "marchproxy_ebpf_map_sync_errors %d\n", ebpfStats.MapSyncErrors)
+
+			fmt.Fprintf(w, "# HELP marchproxy_ebpf_stats_read_errors Failed reads of the eBPF statistics maps\n")
+			fmt.Fprintf(w, "# TYPE marchproxy_ebpf_stats_read_errors counter\n")
+			fmt.Fprintf(w, "marchproxy_ebpf_stats_read_errors %d\n", ebpfStats.StatsReadErrors)
+
+			fmt.Fprintf(w, "# HELP marchproxy_ebpf_flow_cache_invalidations_total Flow cache invalidations on config change\n")
+			fmt.Fprintf(w, "# TYPE marchproxy_ebpf_flow_cache_invalidations_total counter\n")
+			fmt.Fprintf(w, "marchproxy_ebpf_flow_cache_invalidations_total %d\n", ebpfStats.FlowCacheInvalidations)
+
+			// Per-mapping and per-service breakdowns
+			if snapshot, err := ebpfMgr.Snapshot(); err == nil {
+				writeEBPFFlowCache(w, snapshot.FlowCache)
+				writeEBPFScopes(w, "mapping", snapshot.Mappings)
+				writeEBPFScopes(w, "service", snapshot.Services)
+			}
 		}
+
+		// Relayed bytes by direction per mapping, service and tenant
+		traffic.WritePrometheus(w, trafficEntries(metrics, ebpfMgr, configHistory.Current()))
 	})
 	
 	// Stats endpoint for easy debugging
 	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		metrics.mu.RLock()
-		tcpConnections := metrics.TCPConnections
-		udpPackets := metrics.UDPPackets
-		bytesTransferred := metrics.BytesTransferred
-		authSuccesses := metrics.AuthSuccesses
-		authFailures := metrics.AuthFailures
-		activeConnections := metrics.ActiveConnections
-		metrics.mu.RUnlock()
+		tcpConnections := atomic.LoadInt64(&metrics.TCPConnections)
+		udpPackets := metrics.UDPPackets.Load()
+		bytesTransferred := metrics.BytesTransferred.Load()
+		authSuccesses := atomic.LoadInt64(&metrics.AuthSuccesses)
+		authFailures := atomic.LoadInt64(&metrics.AuthFailures)
+		activeConnections := atomic.LoadInt64(&metrics.ActiveConnections)
+		mptcpConnections, mptcpSubflows := metrics.MPTCP.stats()
 		
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		
+		licenseSection, _ := json.Marshal(metrics.License.Status())
+		authAttemptsSection, _ := json.Marshal(metrics.AuthAttempts.Stats())
+		rolloutSection, _ := json.Marshal(metrics.Rollout.status(managerClient.Rollout(), &metrics.Closes))
+
 		ebpfSection := ""
 		if ebpfMgr != nil && ebpfMgr.IsEnabled() {
 			ebpfProxyStats, ebpfStats := ebpfMgr.GetStats()
@@ -1015,13 +2270,21 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 	"ebpf": {
 		"enabled": %t,
 		"program_loaded": %t,
+		"mode": %q,
+		"program_variant": %q,
+		"kernel_version": %q,
+		"xdp_mode": %q,
+		"btf_available": %t,
+		"fallback_reason": %q,
 		"total_packets": %d,
 		"dropped_packets": %d,
 		"forwarded_packets": %d,
 		"userspace_fallback": %d,
 		"map_sync_errors": %d,
 		"attached_interfaces": %d
-	}`, ebpfMgr.IsEnabled(), ebpfStats.ProgramLoaded, ebpfProxyStats.TotalPackets,
+	}`, ebpfMgr.IsEnabled(), ebpfStats.ProgramLoaded, ebpfStats.Mode,
+				ebpfStats.ProgramVariant, ebpfStats.KernelVersion, ebpfStats.XDPMode,
+				ebpfStats.BTFAvailable, ebpfStats.FallbackReason, ebpfProxyStats.TotalPackets,
 				ebpfProxyStats.DroppedPackets, ebpfProxyStats.ForwardedPackets,
 				ebpfProxyStats.FallbackToUserspace, ebpfStats.MapSyncErrors,
 				len(ebpfStats.AttachedInterfaces))
@@ -1034,19 +2297,60 @@ func startAdminServer(port int, metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, mt
 	"bytes_transferred": %d,
 	"auth_successes": %d,
 	"auth_failures": %d,
-	"active_connections": %d%s
+	"auth_attempts": %s,
+	"active_connections": %d,
+	"mptcp_connections": %d,
+	"mptcp_subflows": %d,
+	"license": %s,
+	"rollout": %s%s
 }`, version, tcpConnections, udpPackets, bytesTransferred,
-			authSuccesses, authFailures, activeConnections, ebpfSection)
+			authSuccesses, authFailures, authAttemptsSection, activeConnections,
+			mptcpConnections, mptcpSubflows, licenseSection, rolloutSection, ebpfSection)
 	})
 	
+	// Applied configuration version and what the last refresh changed
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		configVersion, appliedAt, diff := configHistory.Snapshot()
+		
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":    configVersion,
+			"applied_at": appliedAt.UTC().Format(time.RFC3339),
+			"diff":       diff,
+			"schedules":  manager.ScheduleStates(configHistory.Current(), time.Now(), cfg.GetScheduleClockSkew()),
+		})
+	})
+	
+	// Dry-run policy evaluation for a hypothetical connection
+	mux.HandleFunc("/admin/policy/evaluate", policyEvaluateHandler(cfg, configHistory, authenticator, geo))
+
+	// On-demand packet captures and pcap downloads
+	mux.HandleFunc("/admin/capture", captureHandler(captures))
+	mux.HandleFunc("/admin/capture/", captureHandler(captures))
+
+	// Fault injection overrides for resilience testing
+	mux.HandleFunc("/admin/faults", faultsHandler(faults))
+
+	// Quota and usage per tenant
+	mux.HandleFunc("/admin/tenants", tenantsHandler(metrics.Tenants))
+
+	// Quarantined services, flags from external detectors and releases
+	mux.HandleFunc("/admin/quarantine", quarantineHandler(metrics.Quarantine))
+
+	// Live UDP sessions for a warm standby to take over
+	mux.HandleFunc("/admin/handoff", handoffHandler(snapshotUDPSessions))
+
+	// Goroutine stacks for tracking down leaks
+	mux.HandleFunc("/debug/goroutines", goroutinesHandler)
+	
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Handler: adminserver.Guard(cfg.Admin, mux),
 	}
 	
-	fmt.Printf("Admin server listening on :%d\n", port)
-	fmt.Printf("Endpoints: /healthz, /metrics, /stats\n")
-	return server.ListenAndServe()
+	fmt.Printf("Admin server listening on %s\n", listener.Addr())
+	fmt.Printf("Endpoints: /healthz, /readyz, /metrics, /stats, /admin/config, /admin/policy/evaluate, /admin/capture, /admin/faults, /admin/tenants, /admin/quarantine, /admin/handoff, /debug/goroutines\n")
+	return server.Serve(listener)
 }
 
 // Helper functions for network address parsing
@@ -1058,6 +2362,8 @@ func getIPFromAddr(addr net.Addr) string {
 		return v.IP.String()
 	case *net.UDPAddr:
 		return v.IP.String()
+	case *net.IPAddr:
+		return v.IP.String()
 	default:
 		// Parse from string representation
 		addrStr := addr.String()
@@ -1068,6 +2374,34 @@ func getIPFromAddr(addr net.Addr) string {
 	}
 }
 
+// clientCountry looks up the country of a client address, geoip.Unknown
+// without a GeoIP database
+func clientCountry(geo *geoip.Reader, addr net.Addr) string {
+	return geo.Country(net.ParseIP(getIPFromAddr(addr)))
+}
+
+// newFlowMirror opens the configured mirror target, nil when mirroring is off
+func newFlowMirror(cfg *config.Config) (*mirror.Mirror, error) {
+	var sink mirror.Sink
+	var err error
+	switch cfg.MirrorMode {
+	case "":
+		return nil, nil
+	case "file":
+		sink, err = mirror.NewFileRing(cfg.MirrorDir, int64(cfg.MirrorFileSize)*1024*1024, cfg.MirrorFileCount)
+	case "gre":
+		sink, err = mirror.NewGRETunnel(cfg.MirrorTarget)
+	case "erspan":
+		sink, err = mirror.NewERSPANTunnel(cfg.MirrorTarget, cfg.MirrorERSPANSession)
+	default:
+		return nil, fmt.Errorf("unknown mirror mode %q", cfg.MirrorMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mirror.New(sink, cfg.MirrorSampleRate), nil
+}
+
 // getPortFromAddr extracts port number from net.Addr
 func getPortFromAddr(addr net.Addr) int {
 	switch v := addr.(type) {
@@ -1087,15 +2421,8 @@ func getPortFromAddr(addr net.Addr) int {
 	}
 }
 
-// ipStringToUint32 converts IP address string to uint32
+// ipStringToUint32 packs an IPv4 address string in host byte order for
+// eBPF connection keys
 func ipStringToUint32(ipStr string) uint32 {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return 0
-	}
-	ip = ip.To4()
-	if ip == nil {
-		return 0
-	}
-	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	return ebpf.IPToUint32(net.ParseIP(ipStr))
 }
\ No newline at end of file
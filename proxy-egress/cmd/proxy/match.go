@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"marchproxy-egress/internal/counters"
+	"marchproxy-egress/internal/manager"
+)
+
+// matchSpecificity ranks how narrowly a mapping's match criteria describe a
+// connection. When several mappings match, the most specific wins, compared
+// field by field in order.
+type matchSpecificity struct {
+	hostname   int // Exact SNI 2, wildcard 1, none 0
+	hostSuffix int // Length of a matched wildcard's suffix
+	prefixLen  int // Bits of the matched source CIDR, -1 for none
+	port       bool
+	countries  bool
+	condition  bool
+	protocols  int // Fewer protocols served is more specific
+}
+
+// moreSpecific returns true if a outranks b
+func (a matchSpecificity) moreSpecific(b matchSpecificity) bool {
+	switch {
+	case a.hostname != b.hostname:
+		return a.hostname > b.hostname
+	case a.hostSuffix != b.hostSuffix:
+		return a.hostSuffix > b.hostSuffix
+	case a.prefixLen != b.prefixLen:
+		return a.prefixLen > b.prefixLen
+	case a.port != b.port:
+		return a.port
+	case a.countries != b.countries:
+		return a.countries
+	case a.condition != b.condition:
+		return a.condition
+	}
+	return a.protocols < b.protocols
+}
+
+// matchCriteria checks the mapping's source CIDRs, listen ports and
+// hostnames against the connection, returning how specifically they
+// matched. Each empty list matches any connection.
+func matchCriteria(mapping *manager.Mapping, facts connectionFacts) (matchSpecificity, bool) {
+	specificity := matchSpecificity{prefixLen: -1, protocols: len(mapping.Protocols)}
+
+	if len(mapping.ListenPorts) > 0 {
+		found := false
+		for _, port := range mapping.ListenPorts {
+			if port == facts.ListenerPort {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return specificity, false
+		}
+		specificity.port = true
+	}
+
+	if len(mapping.SourceCIDRs) > 0 {
+		ip := net.ParseIP(facts.SourceIP)
+		if ip == nil {
+			return specificity, false
+		}
+		for _, cidr := range mapping.SourceCIDRs {
+			network, err := parseSourceCIDR(cidr)
+			if err != nil || !network.Contains(ip) {
+				continue
+			}
+			if ones, _ := network.Mask.Size(); ones > specificity.prefixLen {
+				specificity.prefixLen = ones
+			}
+		}
+		if specificity.prefixLen < 0 {
+			return specificity, false
+		}
+	}
+
+	// Hostnames only match TLS connections whose SNI the proxy has seen
+	if len(mapping.Hostnames) > 0 {
+		if !facts.TLS || facts.SNI == "" {
+			return specificity, false
+		}
+		sni := strings.TrimSuffix(strings.ToLower(facts.SNI), ".")
+		for _, hostname := range mapping.Hostnames {
+			hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+			if suffix, ok := strings.CutPrefix(hostname, "*."); ok {
+				if strings.HasSuffix(sni, "."+suffix) && specificity.hostname < 2 && len(suffix) > specificity.hostSuffix {
+					specificity.hostname, specificity.hostSuffix = 1, len(suffix)
+				}
+			} else if sni == hostname {
+				specificity.hostname, specificity.hostSuffix = 2, 0
+			}
+		}
+		if specificity.hostname == 0 {
+			return specificity, false
+		}
+	}
+
+	specificity.countries = len(mapping.SourceCountries) > 0
+	specificity.condition = mapping.Condition != ""
+	return specificity, true
+}
+
+// parseSourceCIDR parses a source CIDR or a single address
+func parseSourceCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source CIDR %q", cidr)
+	}
+	return network, nil
+}
+
+// validateMatchCriteria checks a mapping's source CIDRs, listen ports and
+// hostname patterns
+func validateMatchCriteria(mapping *manager.Mapping) error {
+	for _, cidr := range mapping.SourceCIDRs {
+		if _, err := parseSourceCIDR(cidr); err != nil {
+			return err
+		}
+	}
+	for _, port := range mapping.ListenPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid listen port %d", port)
+		}
+	}
+	for _, hostname := range mapping.Hostnames {
+		name := strings.TrimPrefix(hostname, "*.")
+		if name == "" || strings.ContainsAny(name, "* /:") {
+			return fmt.Errorf("invalid hostname pattern %q", hostname)
+		}
+	}
+	return nil
+}
+
+// unmatchedKey identifies one counter of connections no mapping matched
+type unmatchedKey struct {
+	protocol string
+	port     int
+}
+
+// matchMetrics counts the mapping selected for each connection and the
+// connections no mapping matched, per protocol and listener port
+type matchMetrics struct {
+	matched   counters.Labeled[string]
+	unmatched counters.Labeled[unmatchedKey]
+}
+
+// record counts one mapping selection, mapping nil when none matched
+func (m *matchMetrics) record(mapping *manager.Mapping, facts connectionFacts) {
+	if mapping == nil {
+		m.unmatched.Inc(unmatchedKey{protocol: facts.Protocol, port: facts.ListenerPort})
+		return
+	}
+	m.matched.Inc(mapping.Name)
+}
+
+// writePrometheus writes the mapping selection counters
+func (m *matchMetrics) writePrometheus(w io.Writer) {
+	fmt.Fprintf(w, "# HELP marchproxy_mapping_matches_total Connections and UDP packets each mapping was selected for\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mapping_matches_total counter\n")
+	matched := m.matched.Snapshot()
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "marchproxy_mapping_matches_total{mapping=%q} %d\n", name, matched[name])
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_mapping_unmatched_total Connections and UDP packets no mapping matched\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mapping_unmatched_total counter\n")
+	unmatched := m.unmatched.Snapshot()
+	keys := make([]unmatchedKey, 0, len(unmatched))
+	for key := range unmatched {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].port < keys[j].port
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_mapping_unmatched_total{protocol=%q,listener_port=\"%d\"} %d\n", key.protocol, key.port, unmatched[key])
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-shared/metering"
+)
+
+// newMeter creates the usage meter with its sinks, nil when metering is
+// disabled or has nowhere to send records
+func newMeter(cfg *config.Config, client *manager.Client) *metering.Meter {
+	if cfg.MeteringInterval <= 0 {
+		return nil
+	}
+
+	var sinks []metering.Sink
+	if cfg.MeteringUpload && !client.Standalone() {
+		sinks = append(sinks, managerUsageSink{client: client})
+	}
+	if cfg.MeteringCSVDir != "" {
+		sink, err := metering.NewCSVSink(cfg.MeteringCSVDir)
+		if err != nil {
+			fmt.Printf("Warning: usage CSV export disabled: %v\n", err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return metering.New(redModule, cfg.ProxyName, sinks...)
+}
+
+// managerUsageSink uploads usage records to the manager
+type managerUsageSink struct {
+	client *manager.Client
+}
+
+// Name implements metering.Sink
+func (s managerUsageSink) Name() string {
+	return "manager"
+}
+
+// Write implements metering.Sink
+func (s managerUsageSink) Write(records []metering.Record) error {
+	return s.client.UploadUsage(records)
+}
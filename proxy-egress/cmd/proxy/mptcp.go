@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"marchproxy-shared/netutil"
+)
+
+// mptcpTracker tracks live Multipath TCP connections so their subflow
+// counts can be reported in connection stats
+type mptcpTracker struct {
+	conns map[net.Conn]struct{}
+	mu    sync.Mutex
+}
+
+// track registers conn if it negotiated MPTCP and returns a function that
+// removes it again. Plain TCP connections are ignored.
+func (t *mptcpTracker) track(conn net.Conn) func() {
+	if _, ok := netutil.MPTCPSubflows(conn); !ok {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+	}
+}
+
+// stats returns the number of live MPTCP connections and their total subflows
+func (t *mptcpTracker) stats() (connections, subflows int) {
+	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		if count, ok := netutil.MPTCPSubflows(conn); ok {
+			connections++
+			subflows += count
+		}
+	}
+	return connections, subflows
+}
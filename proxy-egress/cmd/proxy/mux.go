@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/muxconn"
+	"marchproxy-shared/netutil"
+)
+
+// Results of a multiplexed stream request
+const (
+	muxStreamOpened      = "opened"
+	muxStreamNoMapping   = "no_mapping"
+	muxStreamDenied      = "denied"
+	muxStreamInvalid     = "invalid"
+	muxStreamUnavailable = "unavailable"
+)
+
+// muxListener accepts multiplexed transport connections. A client
+// authenticates a transport with the MARCHPROXY_AUTH handshake once, then
+// speaks HTTP/2 over it with prior knowledge and opens a CONNECT stream for
+// each of its connections. The stream's authority is the proxy address the
+// client would have dialed; each stream is matched to a mapping and relayed
+// like a connection accepted there, without authenticating again.
+type muxListener struct {
+	proxy    *TCPProxy
+	server   *http2.Server
+	listener net.Listener
+	cancel   context.CancelFunc
+
+	transports  map[net.Conn]struct{}
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+	authFailed  atomic.Int64
+	streams     map[string]int64 // Stream requests per result
+	streamsLock sync.Mutex
+}
+
+// startMuxListener listens for multiplexed clients on mux_port, relaying
+// their streams through the main TCP proxy. It returns nil when the
+// listener is disabled.
+func startMuxListener(ctx context.Context, cfg *config.Config, proxy *TCPProxy) (*muxListener, error) {
+	if !cfg.MuxEnabled {
+		return nil, nil
+	}
+
+	addr := netutil.JoinHostPort(cfg.BindAddress, cfg.MuxPort)
+	listener, err := netutil.Listen("tcp", addr, cfg.BindInterface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	// Transports use TLS when the proxy's own listener does
+	if proxy.tlsEnabled() {
+		listener = tls.NewListener(listener, proxy.mtlsManager.GetTLSConfig().Clone())
+	}
+
+	m := &muxListener{
+		proxy: proxy,
+		server: &http2.Server{
+			MaxConcurrentStreams: uint32(cfg.MuxMaxStreams),
+			IdleTimeout:          time.Duration(cfg.MuxIdleTimeout) * time.Second,
+		},
+		listener:   listener,
+		transports: make(map[net.Conn]struct{}),
+		streams:    make(map[string]int64),
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.wg.Add(1)
+	go m.acceptLoop(ctx)
+
+	fmt.Printf("Multiplexed listener on %s (up to %d streams per transport)\n", addr, cfg.MuxMaxStreams)
+	return m, nil
+}
+
+// acceptLoop accepts transport connections until the listener closes
+func (m *muxListener) acceptLoop(ctx context.Context) {
+	defer m.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("Multiplexed accept error: %v\n", err)
+			continue
+		}
+
+		m.mu.Lock()
+		m.transports[conn] = struct{}{}
+		m.mu.Unlock()
+		m.wg.Add(1)
+		go m.serveTransport(ctx, conn)
+	}
+}
+
+// serveTransport authenticates a transport connection and serves its
+// streams
+func (m *muxListener) serveTransport(ctx context.Context, conn net.Conn) {
+	defer m.wg.Done()
+	defer func() {
+		m.mu.Lock()
+		delete(m.transports, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+
+	// The service is authenticated once; each stream is checked against
+	// the mapping it reaches
+	serviceID, err := m.proxy.authenticateConn(conn, func(serviceID int, token string) error {
+		if err := m.proxy.authenticator.AuthenticateService(serviceID, token); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		m.authFailed.Add(1)
+		fmt.Printf("Multiplexed transport from %s failed authentication: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	fmt.Printf("Multiplexed transport from %s authenticated as service %d\n", conn.RemoteAddr(), serviceID)
+
+	m.server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.serveStream(w, r, conn, serviceID)
+		}),
+	})
+}
+
+// serveStream relays one CONNECT stream of a transport. The reply has to
+// precede the relay, so the mapping is looked up first to refuse streams
+// that would be dropped; the relay then matches and authorizes it again.
+func (m *muxListener) serveStream(w http.ResponseWriter, r *http.Request, transport net.Conn, serviceID int) {
+	if r.Method != http.MethodConnect {
+		m.count(muxStreamInvalid)
+		http.Error(w, "only CONNECT streams are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	_, portPart, err := net.SplitHostPort(r.Host)
+	port, _ := strconv.Atoi(portPart)
+	if err != nil || port < 1 || port > 65535 {
+		m.count(muxStreamInvalid)
+		http.Error(w, "stream authority must be host:port", http.StatusBadRequest)
+		return
+	}
+
+	stream := newMuxStream(w, r, transport, port, serviceID)
+	p := m.proxy
+	p.mu.RLock()
+	mapping := matchMapping(p.clusterConfig, p.binding, tcpConnectionFacts(stream, clientCountry(p.geo, stream.RemoteAddr())), p.config.GetScheduleClockSkew())
+	p.mu.RUnlock()
+	if mapping == nil {
+		stream.Close()
+		m.count(muxStreamNoMapping)
+		http.Error(w, "no mapping", http.StatusForbidden)
+		return
+	}
+	if bindingRequiresAuth(p.binding, mapping) && !serviceAllowed(mapping, serviceID) {
+		stream.Close()
+		m.count(muxStreamDenied)
+		http.Error(w, "service not allowed", http.StatusForbidden)
+		return
+	}
+	if !p.admit() {
+		stream.Close()
+		m.count(muxStreamUnavailable)
+		http.Error(w, "proxy is stopping", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+	m.count(muxStreamOpened)
+	p.handleConnection(stream)
+}
+
+// count records a stream request result
+func (m *muxListener) count(result string) {
+	m.streamsLock.Lock()
+	m.streams[result]++
+	m.streamsLock.Unlock()
+}
+
+// Stop closes the listener and the transports, then waits for their
+// streams. The TCP proxy drains the streams before this is called.
+func (m *muxListener) Stop() {
+	if m == nil {
+		return
+	}
+	m.cancel()
+	m.listener.Close()
+	m.mu.Lock()
+	for conn := range m.transports {
+		conn.Close()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// WritePrometheus writes the multiplexed listener metrics, nothing when
+// disabled
+func (m *muxListener) WritePrometheus(w io.Writer) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	transports := len(m.transports)
+	m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP marchproxy_mux_transports Open multiplexed transport connections\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mux_transports gauge\n")
+	fmt.Fprintf(w, "marchproxy_mux_transports %d\n", transports)
+	fmt.Fprintf(w, "# HELP marchproxy_mux_auth_failures_total Multiplexed transport connections that failed authentication\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mux_auth_failures_total counter\n")
+	fmt.Fprintf(w, "marchproxy_mux_auth_failures_total %d\n", m.authFailed.Load())
+
+	m.streamsLock.Lock()
+	defer m.streamsLock.Unlock()
+	fmt.Fprintf(w, "# HELP marchproxy_mux_streams_total Multiplexed stream requests by result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mux_streams_total counter\n")
+	for _, result := range []string{muxStreamOpened, muxStreamNoMapping, muxStreamDenied, muxStreamInvalid, muxStreamUnavailable} {
+		fmt.Fprintf(w, "marchproxy_mux_streams_total{result=%q} %d\n", result, m.streams[result])
+	}
+}
+
+// muxStream is a CONNECT stream relayed as a client connection, carrying
+// the service its transport authenticated
+type muxStream struct {
+	*muxconn.Conn
+	serviceID int
+}
+
+// newMuxStream wraps a CONNECT request of a transport. Its local address
+// is the proxy port the stream's authority named.
+func newMuxStream(w http.ResponseWriter, r *http.Request, transport net.Conn, port int, serviceID int) *muxStream {
+	local := &net.TCPAddr{Port: port}
+	if addr, ok := transport.LocalAddr().(*net.TCPAddr); ok {
+		local.IP = addr.IP
+	}
+	controller := http.NewResponseController(w)
+	return &muxStream{
+		Conn: muxconn.New(muxconn.Stream{
+			Reader:           r.Body,
+			Writer:           w,
+			Flush:            controller.Flush,
+			SetWriteDeadline: controller.SetWriteDeadline,
+			LocalAddr:        local,
+			RemoteAddr:       transport.RemoteAddr(),
+		}),
+		serviceID: serviceID,
+	}
+}
+
+// authorize checks the stream's service may use the mapping, returning the
+// service ID
+func (s *muxStream) authorize(mapping *manager.Mapping) (int, error) {
+	if !serviceAllowed(mapping, s.serviceID) {
+		return 0, fmt.Errorf("service %d not allowed for mapping %s", s.serviceID, mapping.Name)
+	}
+	return s.serviceID, nil
+}
+
+// admit registers a connection handed to the proxy from outside its accept
+// loops, false once the proxy is stopping
+func (p *TCPProxy) admit() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return false
+	}
+	p.wg.Add(1)
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/bufpool"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/pkg/egressclient"
+)
+
+// TestMuxListener relays streams of one authenticated transport through
+// the TCP proxy to an echo destination
+func TestMuxListener(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	clusterConfig := &manager.ClusterConfig{
+		Services: []manager.Service{
+			{ID: 7, Name: "api", AuthType: "base64", AuthToken: "secret"},
+			{ID: 8, Name: "batch", AuthType: "base64", AuthToken: "other"},
+			{ID: 9, Name: "echo", IPFQDN: "127.0.0.1"},
+		},
+		Mappings: []manager.Mapping{{
+			ID:             1,
+			Name:           "echo",
+			SourceServices: []int{7},
+			DestServices:   []int{9},
+			Protocols:      []string{"tcp"},
+			Ports:          strconv.Itoa(echo.Addr().(*net.TCPAddr).Port),
+			AuthRequired:   true,
+		}},
+	}
+	cfg := &config.Config{
+		BindAddress:       "127.0.0.1",
+		ConnectionTimeout: 5,
+		RelayBufferSize:   32 * 1024,
+		MuxEnabled:        true,
+		MuxMaxStreams:     100,
+		MuxIdleTimeout:    60,
+	}
+	metrics := NewProxyMetrics()
+	dialers, err := newOutboundDialers(cfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &TCPProxy{
+		config:        cfg,
+		clusterConfig: clusterConfig,
+		authenticator: auth.NewAuthenticator(clusterConfig.Services),
+		metrics:       metrics,
+		dialers:       dialers,
+		buffers:       bufpool.NewManager(),
+	}
+	mux, err := startMuxListener(context.Background(), cfg, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		proxy.Stop()
+		mux.Stop()
+	}()
+	addr := mux.listener.Addr().String()
+
+	dialer, _ := egressclient.New(egressclient.Config{ServiceID: 7, Token: egressclient.StaticToken("secret"), MuxAddress: addr})
+	defer dialer.Close()
+	for i := 0; i < 3; i++ {
+		conn, err := dialer.Dial("tcp", "egress.internal:8080")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		message := fmt.Sprintf("stream %d\n", i)
+		io.WriteString(conn, message)
+		reply := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != message {
+			t.Fatalf("Echo = %q, %v", reply, err)
+		}
+		conn.Close()
+	}
+
+	// Services authenticate, but only reach the mappings they are a
+	// source of
+	dialer, _ = egressclient.New(egressclient.Config{ServiceID: 8, Token: egressclient.StaticToken("other"), MuxAddress: addr})
+	defer dialer.Close()
+	if _, err := dialer.Dial("tcp", "egress.internal:8080"); !errors.Is(err, egressclient.ErrStreamRefused) {
+		t.Errorf("Dial = %v, want ErrStreamRefused", err)
+	}
+	dialer, _ = egressclient.New(egressclient.Config{ServiceID: 7, Token: egressclient.StaticToken("wrong"), MuxAddress: addr})
+	defer dialer.Close()
+	if _, err := dialer.Dial("tcp", "egress.internal:8080"); !errors.Is(err, egressclient.ErrAuthRejected) {
+		t.Errorf("Dial = %v, want ErrAuthRejected", err)
+	}
+
+	var metricsText strings.Builder
+	mux.WritePrometheus(&metricsText)
+	for _, want := range []string{
+		`marchproxy_mux_streams_total{result="opened"} 3`,
+		`marchproxy_mux_streams_total{result="denied"} 1`,
+		"marchproxy_mux_auth_failures_total 1",
+	} {
+		if !strings.Contains(metricsText.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metricsText.String())
+		}
+	}
+}
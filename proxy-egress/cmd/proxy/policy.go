@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/fingerprint"
+	"marchproxy-egress/internal/geoip"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/slo"
+	"marchproxy-shared/cel"
+)
+
+// policyQuery describes a hypothetical connection to evaluate without
+// generating traffic
+type policyQuery struct {
+	Protocol  string `json:"protocol"`          // tcp or udp, defaults to tcp
+	SourceIP  string `json:"src_ip"`            // Client address, looked up in the GeoIP database
+	Country   string `json:"country,omitempty"` // Client country, overrides the src_ip lookup
+	Port      int    `json:"port"`              // Proxy port the connection arrives on, 0 = default listener
+	ServiceID int    `json:"service_id"`        // Source service presented during authentication
+	Token     string `json:"token,omitempty"`   // Optional credential; when set it is verified
+	JA3       string `json:"ja3,omitempty"`     // Client TLS fingerprint, checked against the mapping's lists
+	JA4       string `json:"ja4,omitempty"`
+	SNI       string `json:"sni,omitempty"`      // TLS server name, for mapping conditions
+	SrcPort   int    `json:"src_port,omitempty"` // Client port, for mapping conditions
+	At        string `json:"at,omitempty"`       // RFC 3339 time for mapping schedules, now when empty
+}
+
+// policyDecision is the result of evaluating a policyQuery
+type policyDecision struct {
+	Allowed            bool                 `json:"allowed"`
+	Reason             string               `json:"reason"`
+	Protocol           string               `json:"protocol"`
+	Listener           *manager.ResourceRef `json:"listener,omitempty"`
+	Mapping            *manager.ResourceRef `json:"mapping,omitempty"`
+	Country            string               `json:"country,omitempty"`
+	AuthRequired       bool                 `json:"auth_required"`
+	CredentialsChecked bool                 `json:"credentials_checked"`
+	DestinationService *manager.ResourceRef `json:"destination_service,omitempty"`
+	Destination        string               `json:"destination,omitempty"`
+}
+
+// connectionFacts describes a connection for mapping selection
+type connectionFacts struct {
+	Protocol     string // tcp or udp
+	Country      string
+	SourceIP     string
+	SourcePort   int
+	ListenerPort int
+	TLS          bool
+	SNI          string
+	Fingerprint  *fingerprint.Fingerprint
+	Time         time.Time // When the connection arrived, now when zero
+}
+
+// conditions compiles mapping conditions against the variables of
+// connectionFacts.activation
+var conditions = cel.NewCache("source", "listener", "connection")
+
+// activation returns the variables mapping conditions see
+func (f connectionFacts) activation() cel.Activation {
+	var ja3, ja4 string
+	if f.Fingerprint != nil {
+		ja3, ja4 = f.Fingerprint.JA3, f.Fingerprint.JA4
+	}
+	return cel.Activation{
+		"source": map[string]interface{}{
+			"ip":      f.SourceIP,
+			"port":    f.SourcePort,
+			"country": f.Country,
+		},
+		"listener": map[string]interface{}{
+			"port": f.ListenerPort,
+		},
+		"connection": map[string]interface{}{
+			"protocol": f.Protocol,
+			"tls":      f.TLS,
+			"sni":      f.SNI,
+			"ja3":      ja3,
+			"ja4":      ja4,
+		},
+	}
+}
+
+// matchMapping returns the most specific mapping serving the connection's
+// protocol that the listener binding allows for it, the same selection the
+// TCP and UDP proxies make. Mappings outside their schedule, give or take
+// skew, don't match, and neither does a condition that fails to compile or
+// evaluate. Equally specific mappings are tie-broken by the lower priority
+// value, then by their order in the cluster config.
+func matchMapping(clusterConfig *manager.ClusterConfig, binding *manager.Listener, facts connectionFacts, skew time.Duration) *manager.Mapping {
+	if clusterConfig == nil {
+		return nil
+	}
+	now := facts.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var vars cel.Activation
+	var best *manager.Mapping
+	var bestSpecificity matchSpecificity
+	for i := range clusterConfig.Mappings {
+		mapping := &clusterConfig.Mappings[i]
+		if !bindingAllows(binding, mapping.ID) {
+			continue
+		}
+		if len(mapping.SourceCountries) > 0 && !geoip.Match(facts.Country, mapping.SourceCountries) {
+			continue
+		}
+		if !servesProtocol(*mapping, facts.Protocol) {
+			continue
+		}
+		specificity, ok := matchCriteria(mapping, facts)
+		if !ok {
+			continue
+		}
+		if best != nil && !specificity.moreSpecific(bestSpecificity) &&
+			(bestSpecificity.moreSpecific(specificity) || mapping.Priority >= best.Priority) {
+			continue
+		}
+		if !mapping.Schedule.Active(now, skew) {
+			continue
+		}
+		if mapping.Condition != "" {
+			if vars == nil {
+				vars = facts.activation()
+			}
+			if ok, err := conditions.Eval(mapping.Condition, vars); err != nil || !ok {
+				continue
+			}
+		}
+		best, bestSpecificity = mapping, specificity
+	}
+	if best == nil {
+		return nil
+	}
+	selected := *best
+	return &selected
+}
+
+// servesProtocol returns true if mapping lists protocol
+func servesProtocol(mapping manager.Mapping, protocol string) bool {
+	for _, p := range mapping.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidMappings returns an error for each mapping whose condition
+// doesn't compile or whose schedule, DLP, TLS inspection, TLS, SSH or
+// upstream proxy policy, SLOs or match criteria are invalid
+func invalidMappings(clusterConfig *manager.ClusterConfig) []error {
+	if clusterConfig == nil {
+		return nil
+	}
+	var errs []error
+	for _, mapping := range clusterConfig.Mappings {
+		if err := mapping.Schedule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid schedule, the mapping matches nothing: %w", mapping.Name, err))
+		}
+		if err := mapping.DLP.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid DLP policy, its connections are refused: %w", mapping.Name, err))
+		}
+		if err := mapping.TLSInspection.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid TLS inspection policy, its connections are refused: %w", mapping.Name, err))
+		}
+		if err := mapping.TLSPolicy.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid TLS policy, its connections are refused: %w", mapping.Name, err))
+		}
+		if err := mapping.SSH.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid SSH policy, its connections are refused: %w", mapping.Name, err))
+		}
+		if err := mapping.UpstreamProxy.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid upstream proxy route, its connections fail: %w", mapping.Name, err))
+		}
+		if err := slo.ValidateAll(mapping.SLOs); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid SLOs, they are not tracked: %w", mapping.Name, err))
+		}
+		if err := validateMatchCriteria(&mapping); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid match criteria, invalid entries match nothing: %w", mapping.Name, err))
+		}
+		if mapping.Condition == "" {
+			continue
+		}
+		if _, err := conditions.Program(mapping.Condition); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %s: invalid condition, the mapping matches nothing: %w", mapping.Name, err))
+		}
+	}
+	return errs
+}
+
+// destinationService returns the first configured destination service of a mapping
+func destinationService(clusterConfig *manager.ClusterConfig, mapping *manager.Mapping) *manager.Service {
+	if clusterConfig == nil {
+		return nil
+	}
+
+	for _, serviceID := range mapping.DestServices {
+		for _, service := range clusterConfig.Services {
+			if service.ID == serviceID && sameTenant(mapping, &service) {
+				return &service
+			}
+		}
+	}
+	return nil
+}
+
+// destinationPort parses the first port from a mapping's port spec (single
+// port or comma-separated list), falling back to defaultPort
+func destinationPort(mapping *manager.Mapping, defaultPort int) int {
+	ports := mapping.Ports
+	if ports == "" {
+		return defaultPort
+	}
+
+	var port int
+	if _, err := fmt.Sscanf(ports, "%d", &port); err == nil {
+		return port
+	}
+
+	if parts := strings.Split(ports, ","); len(parts) > 0 {
+		if _, err := fmt.Sscanf(strings.TrimSpace(parts[0]), "%d", &port); err == nil {
+			return port
+		}
+	}
+	return defaultPort
+}
+
+// evaluatePolicy walks the decisions the proxy would make for query against
+// the applied cluster config: listener, mapping, authorization and destination
+func evaluatePolicy(cfg *config.Config, clusterConfig *manager.ClusterConfig, authenticator *auth.Authenticator, geo *geoip.Reader, query policyQuery) policyDecision {
+	protocol := strings.ToLower(query.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	decision := policyDecision{Protocol: protocol}
+
+	if protocol != "tcp" && protocol != "udp" {
+		decision.Reason = fmt.Sprintf("unsupported protocol %q", query.Protocol)
+		return decision
+	}
+	if clusterConfig == nil {
+		decision.Reason = "no cluster configuration applied"
+		return decision
+	}
+
+	// Default listeners serve every mapping; other ports belong to manager-defined listeners
+	defaultPort := cfg.ListenPort
+	if protocol == "udp" {
+		defaultPort = cfg.ListenPort + 1000
+	}
+	var binding *manager.Listener
+	if query.Port != 0 && query.Port != defaultPort {
+		for i := range clusterConfig.Listeners {
+			spec := &clusterConfig.Listeners[i]
+			if spec.Port == query.Port && listenerServes(*spec, protocol) {
+				binding = spec
+				break
+			}
+		}
+		if binding == nil {
+			decision.Reason = fmt.Sprintf("no %s listener on port %d", protocol, query.Port)
+			return decision
+		}
+		decision.Listener = &manager.ResourceRef{ID: binding.ID, Name: binding.Name}
+	}
+
+	decision.Country = query.Country
+	if decision.Country == "" {
+		decision.Country = geo.Country(net.ParseIP(query.SourceIP))
+	}
+
+	var fp *fingerprint.Fingerprint
+	if query.JA3 != "" || query.JA4 != "" {
+		fp = &fingerprint.Fingerprint{JA3: query.JA3, JA4: query.JA4}
+	}
+	var at time.Time
+	if query.At != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, query.At); err != nil {
+			decision.Reason = fmt.Sprintf("invalid time %q, expected RFC 3339", query.At)
+			return decision
+		}
+	}
+	listenerPort := query.Port
+	if listenerPort == 0 {
+		listenerPort = defaultPort
+	}
+	mapping := matchMapping(clusterConfig, binding, connectionFacts{
+		Protocol:     protocol,
+		Country:      decision.Country,
+		SourceIP:     query.SourceIP,
+		SourcePort:   query.SrcPort,
+		ListenerPort: listenerPort,
+		TLS:          fp != nil || query.SNI != "",
+		SNI:          query.SNI,
+		Fingerprint:  fp,
+		Time:         at,
+	}, cfg.GetScheduleClockSkew())
+	if mapping == nil {
+		decision.Reason = fmt.Sprintf("no %s mapping matches", protocol)
+		return decision
+	}
+	decision.Mapping = &manager.ResourceRef{ID: mapping.ID, Name: mapping.Name}
+
+	if geoip.Match(decision.Country, mapping.BlockedCountries) {
+		decision.Reason = fmt.Sprintf("country %s blocked for mapping %s", decision.Country, mapping.Name)
+		return decision
+	}
+
+	if !fingerprint.Allowed(fp, mapping.TLSFingerprintAllow, mapping.TLSFingerprintDeny) {
+		decision.Reason = fmt.Sprintf("tls fingerprint not allowed for mapping %s", mapping.Name)
+		return decision
+	}
+
+	decision.AuthRequired = bindingRequiresAuth(binding, mapping)
+	if decision.AuthRequired {
+		if query.ServiceID == 0 {
+			decision.Reason = "authentication required but no service_id given"
+			return decision
+		}
+		if query.Token != "" {
+			decision.CredentialsChecked = true
+			if err := authorizeMappingService(authenticator, mapping, query.ServiceID, query.Token); err != nil {
+				decision.Reason = err.Error()
+				return decision
+			}
+		} else if !serviceAllowed(mapping, query.ServiceID) {
+			decision.Reason = fmt.Sprintf("service %d not allowed for mapping %s", query.ServiceID, mapping.Name)
+			return decision
+		}
+	}
+
+	destService := destinationService(clusterConfig, mapping)
+	if destService == nil {
+		decision.Reason = fmt.Sprintf("no destination service found for mapping %s", mapping.Name)
+		return decision
+	}
+	defaultDestPort := 80
+	if protocol == "udp" {
+		defaultDestPort = 53
+	}
+	decision.DestinationService = &manager.ResourceRef{ID: destService.ID, Name: destService.Name}
+	decision.Destination = net.JoinHostPort(destService.IPFQDN, strconv.Itoa(destinationPort(mapping, defaultDestPort)))
+
+	decision.Allowed = true
+	decision.Reason = fmt.Sprintf("matched mapping %s", mapping.Name)
+	if decision.AuthRequired && !decision.CredentialsChecked {
+		decision.Reason += " (service allowed, credentials not verified)"
+	}
+	return decision
+}
+
+// serviceAllowed returns true if serviceID is a permitted source for mapping
+func serviceAllowed(mapping *manager.Mapping, serviceID int) bool {
+	for _, allowedServiceID := range mapping.SourceServices {
+		if allowedServiceID == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// policyEvaluateHandler serves dry-run policy evaluation on the admin server
+func policyEvaluateHandler(cfg *config.Config, configHistory *manager.ConfigHistory, authenticator *auth.Authenticator, geo *geoip.Reader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query policyQuery
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&query); err != nil {
+			http.Error(w, fmt.Sprintf("invalid query: %v", err), http.StatusBadRequest)
+			return
+		}
+		if query.SourceIP != "" && net.ParseIP(query.SourceIP) == nil {
+			http.Error(w, fmt.Sprintf("invalid src_ip %q", query.SourceIP), http.StatusBadRequest)
+			return
+		}
+
+		decision := evaluatePolicy(cfg, configHistory.Current(), authenticator, geo, query)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(decision)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-shared/schedule"
+)
+
+// TestMatchMappingCondition tests that mapping conditions select on
+// connection facts and that broken conditions match nothing
+func TestMatchMappingCondition(t *testing.T) {
+	clusterConfig := &manager.ClusterConfig{
+		Mappings: []manager.Mapping{
+			{ID: 1, Name: "broken", Protocols: []string{"tcp"}, Condition: `source.ip in`},
+			{ID: 2, Name: "internal", Protocols: []string{"tcp"}, Condition: `source.ip in cidr("10.0.0.0/8") && listener.port == 8080`},
+			{ID: 3, Name: "tls", Protocols: []string{"tcp", "udp"}, Condition: `connection.tls && connection.sni.endsWith(".example.com")`},
+			{ID: 4, Name: "any-udp", Protocols: []string{"udp"}},
+		},
+	}
+
+	tests := []struct {
+		facts connectionFacts
+		want  string
+	}{
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", ListenerPort: 8080}, "internal"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", ListenerPort: 9090}, ""},
+		{connectionFacts{Protocol: "tcp", SourceIP: "192.0.2.1", TLS: true, SNI: "api.example.com"}, "tls"},
+		{connectionFacts{Protocol: "udp", SourceIP: "192.0.2.1"}, "any-udp"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if mapping := matchMapping(clusterConfig, nil, tt.facts, 0); mapping != nil {
+			got = mapping.Name
+		}
+		if got != tt.want {
+			t.Errorf("matchMapping(%+v) = %q, want %q", tt.facts, got, tt.want)
+		}
+	}
+
+	if errs := invalidMappings(clusterConfig); len(errs) != 1 {
+		t.Errorf("Expected 1 invalid condition, got %v", errs)
+	}
+}
+
+// TestMatchMappingSchedule tests that mappings only match within their
+// schedule
+func TestMatchMappingSchedule(t *testing.T) {
+	expiry := time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)
+	clusterConfig := &manager.ClusterConfig{
+		Mappings: []manager.Mapping{
+			{ID: 1, Name: "grant", Protocols: []string{"tcp"}, Schedule: &schedule.Schedule{ValidUntil: &expiry}},
+			{ID: 2, Name: "default", Protocols: []string{"tcp"}},
+		},
+	}
+
+	for at, want := range map[time.Time]string{
+		expiry.Add(-time.Hour):       "grant",
+		expiry.Add(10 * time.Second): "grant", // Within the skew
+		expiry.Add(time.Minute):      "default",
+	} {
+		facts := connectionFacts{Protocol: "tcp", Time: at}
+		if mapping := matchMapping(clusterConfig, nil, facts, 30*time.Second); mapping == nil || mapping.Name != want {
+			t.Errorf("matchMapping at %v = %v, want %s", at, mapping, want)
+		}
+	}
+}
+
+// TestMatchMappingSpecificity tests that the most specific matching mapping
+// wins, and that ties go to the lower priority value, then config order
+func TestMatchMappingSpecificity(t *testing.T) {
+	clusterConfig := &manager.ClusterConfig{
+		Mappings: []manager.Mapping{
+			{ID: 1, Name: "default", Protocols: []string{"tcp", "udp"}},
+			{ID: 2, Name: "internal", Protocols: []string{"tcp"}, SourceCIDRs: []string{"10.0.0.0/8"}},
+			{ID: 3, Name: "subnet", Protocols: []string{"tcp"}, SourceCIDRs: []string{"10.1.0.0/16"}},
+			{ID: 4, Name: "subnet-urgent", Protocols: []string{"tcp"}, SourceCIDRs: []string{"10.1.0.0/16"}, ListenPorts: []int{9443}},
+			{ID: 5, Name: "wildcard", Protocols: []string{"tcp"}, Hostnames: []string{"*.example.com"}},
+			{ID: 6, Name: "api", Protocols: []string{"tcp"}, Hostnames: []string{"API.example.com"}},
+			{ID: 7, Name: "host", Protocols: []string{"tcp"}, SourceCIDRs: []string{"192.0.2.7"}, Priority: 50},
+			{ID: 8, Name: "host-first", Protocols: []string{"tcp"}, SourceCIDRs: []string{"192.0.2.0/24", "192.0.2.7/32"}, Priority: 10},
+			{ID: 9, Name: "dns", Protocols: []string{"udp"}, ListenPorts: []int{53}},
+		},
+	}
+
+	tests := []struct {
+		facts connectionFacts
+		want  string
+	}{
+		{connectionFacts{Protocol: "udp", SourceIP: "10.1.2.3"}, "default"},
+		{connectionFacts{Protocol: "udp", SourceIP: "10.1.2.3", ListenerPort: 53}, "dns"},
+		{connectionFacts{Protocol: "udp", SourceIP: "10.1.2.3", ListenerPort: 5353}, "default"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.2.0.1"}, "internal"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", ListenerPort: 8080}, "subnet"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", ListenerPort: 9443}, "subnet-urgent"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", TLS: true, SNI: "www.example.com"}, "wildcard"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", TLS: true, SNI: "api.example.com."}, "api"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "10.1.2.3", SNI: "api.example.com"}, "subnet"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "192.0.2.7"}, "host-first"},
+		{connectionFacts{Protocol: "tcp", SourceIP: "2001:db8::1"}, "default"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if mapping := matchMapping(clusterConfig, nil, tt.facts, 0); mapping != nil {
+			got = mapping.Name
+		}
+		if got != tt.want {
+			t.Errorf("matchMapping(%+v) = %q, want %q", tt.facts, got, tt.want)
+		}
+	}
+
+	clusterConfig.Mappings[0].SourceCIDRs = []string{"10.0.0.0/33"}
+	clusterConfig.Mappings[1].Hostnames = []string{"api.*.com"}
+	if errs := invalidMappings(clusterConfig); len(errs) != 2 {
+		t.Errorf("Expected 2 invalid mappings, got %v", errs)
+	}
+}
+
+// TestMatchMetrics tests the selections and misses counted per mapping and
+// per protocol and listener port
+func TestMatchMetrics(t *testing.T) {
+	var m matchMetrics
+	api := &manager.Mapping{Name: "api"}
+	m.record(api, connectionFacts{Protocol: "tcp", ListenerPort: 443})
+	m.record(api, connectionFacts{Protocol: "tcp", ListenerPort: 8443})
+	m.record(nil, connectionFacts{Protocol: "udp", ListenerPort: 53})
+	m.record(nil, connectionFacts{Protocol: "tcp", ListenerPort: 443})
+
+	var buf strings.Builder
+	m.writePrometheus(&buf)
+	for _, want := range []string{
+		`marchproxy_mapping_matches_total{mapping="api"} 2`,
+		`marchproxy_mapping_unmatched_total{protocol="tcp",listener_port="443"} 1`,
+		`marchproxy_mapping_unmatched_total{protocol="udp",listener_port="53"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+// policyClusterConfig is the cluster config the dry-run evaluation tests
+// query against
+func policyClusterConfig() *manager.ClusterConfig {
+	return &manager.ClusterConfig{
+		Services: []manager.Service{
+			{ID: 1, Name: "web", AuthType: "base64", AuthToken: "web-token"},
+			{ID: 2, Name: "db", IPFQDN: "10.0.0.5"},
+			{ID: 3, Name: "dns", IPFQDN: "10.0.0.53"},
+		},
+		Mappings: []manager.Mapping{
+			{ID: 1, Name: "db", Protocols: []string{"tcp"}, SourceServices: []int{1}, DestServices: []int{2}, Ports: "5432,5433", AuthRequired: true, Priority: 10},
+			{ID: 2, Name: "dns", Protocols: []string{"udp"}, DestServices: []int{3}},
+			{ID: 3, Name: "partner", Protocols: []string{"tcp"}, SourceCIDRs: []string{"198.51.100.0/24"}, DestServices: []int{2}, Ports: "443",
+				BlockedCountries: []string{"RU"}, TLSFingerprintDeny: []string{"e7d705a3286e19ea42f587b344ee6865"}},
+			{ID: 4, Name: "bound", Protocols: []string{"tcp"}, SourceServices: []int{1}, DestServices: []int{99}, Priority: 100},
+		},
+		Listeners: []manager.Listener{
+			{ID: 9, Name: "internal", Port: 9443, Mappings: []int{4}, RequireAuth: true},
+		},
+	}
+}
+
+// TestEvaluatePolicy tests each decision the dry run reports, in the order
+// the proxy makes them
+func TestEvaluatePolicy(t *testing.T) {
+	cfg := &config.Config{ListenPort: 8080}
+	clusterConfig := policyClusterConfig()
+	authenticator := auth.NewAuthenticator(clusterConfig.Services)
+
+	tests := []struct {
+		query   policyQuery
+		allowed bool
+		reason  string
+	}{
+		{policyQuery{Protocol: "sctp"}, false, `unsupported protocol "sctp"`},
+		{policyQuery{Port: 9999}, false, "no tcp listener on port 9999"},
+		// Listeners without protocols serve TCP only
+		{policyQuery{Protocol: "udp", Port: 9443}, false, "no udp listener on port 9443"},
+		{policyQuery{At: "tomorrow"}, false, `invalid time "tomorrow", expected RFC 3339`},
+		{policyQuery{ServiceID: 1}, true, "matched mapping db (service allowed, credentials not verified)"},
+		{policyQuery{ServiceID: 1, Token: "web-token"}, true, "matched mapping db"},
+		{policyQuery{ServiceID: 1, Token: "guess"}, false, "authentication failed: invalid Base64 token for service web"},
+		{policyQuery{}, false, "authentication required but no service_id given"},
+		{policyQuery{ServiceID: 3}, false, "service 3 not allowed for mapping db"},
+		{policyQuery{ServiceID: 3, Token: "web-token"}, false, "service 3 not allowed for mapping db"},
+		{policyQuery{Protocol: "UDP"}, true, "matched mapping dns"},
+		{policyQuery{Protocol: "udp", Port: 9080}, true, "matched mapping dns"},
+		{policyQuery{SourceIP: "198.51.100.7", Country: "ru"}, false, "country ru blocked for mapping partner"},
+		{policyQuery{SourceIP: "198.51.100.7", Country: "DE", JA3: "E7D705A3286E19EA42F587B344EE6865"}, false, "tls fingerprint not allowed for mapping partner"},
+		{policyQuery{SourceIP: "198.51.100.7", Country: "DE"}, true, "matched mapping partner"},
+		{policyQuery{Port: 9443, ServiceID: 1}, false, "no destination service found for mapping bound"},
+	}
+	for _, tt := range tests {
+		decision := evaluatePolicy(cfg, clusterConfig, authenticator, nil, tt.query)
+		if decision.Allowed != tt.allowed || decision.Reason != tt.reason {
+			t.Errorf("evaluatePolicy(%+v) = %t %q, want %t %q", tt.query, decision.Allowed, decision.Reason, tt.allowed, tt.reason)
+		}
+	}
+
+	decision := evaluatePolicy(cfg, clusterConfig, authenticator, nil, policyQuery{ServiceID: 1, Token: "web-token"})
+	if decision.Protocol != "tcp" || decision.Listener != nil || decision.Mapping.ID != 1 || !decision.AuthRequired || !decision.CredentialsChecked ||
+		decision.DestinationService.Name != "db" || decision.Destination != "10.0.0.5:5432" {
+		t.Errorf("db decision %+v", decision)
+	}
+
+	// Without a GeoIP database the client's country is unknown, and UDP
+	// destinations default to port 53
+	decision = evaluatePolicy(cfg, clusterConfig, authenticator, nil, policyQuery{Protocol: "udp", SourceIP: "192.0.2.1"})
+	if decision.Country != "unknown" || decision.AuthRequired || decision.Destination != "10.0.0.53:53" {
+		t.Errorf("dns decision %+v", decision)
+	}
+
+	// A manager-defined listener only serves its own mappings and can
+	// require authentication for all of them
+	decision = evaluatePolicy(cfg, clusterConfig, authenticator, nil, policyQuery{Port: 9443, ServiceID: 1})
+	if decision.Listener == nil || decision.Listener.Name != "internal" || decision.Mapping.Name != "bound" || !decision.AuthRequired {
+		t.Errorf("listener decision %+v", decision)
+	}
+
+	if decision := evaluatePolicy(cfg, nil, authenticator, nil, policyQuery{}); decision.Allowed || decision.Reason != "no cluster configuration applied" {
+		t.Errorf("decision without a config %+v", decision)
+	}
+}
+
+// TestPolicyEvaluateHandler tests the admin endpoint around evaluatePolicy
+func TestPolicyEvaluateHandler(t *testing.T) {
+	cfg := &config.Config{ListenPort: 8080}
+	var history manager.ConfigHistory
+	clusterConfig := policyClusterConfig()
+	handler := policyEvaluateHandler(cfg, &history, auth.NewAuthenticator(clusterConfig.Services), nil)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/admin/policy/evaluate", strings.NewReader(body)))
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) policyDecision {
+		t.Helper()
+		var decision policyDecision
+		if err := json.NewDecoder(rec.Body).Decode(&decision); err != nil {
+			t.Fatal(err)
+		}
+		return decision
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/admin/policy/evaluate", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET: %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	for _, body := range []string{`{"port": "8080"}`, `{"src_ip": "10.0.0.300"}`, strings.Repeat(" ", 64*1024) + "{}"} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("body %.40q: %d", body, rec.Code)
+		}
+	}
+
+	// Queries before the first config is applied are answered, not refused
+	rec = post(`{"service_id": 1}`)
+	if decision := decode(rec); rec.Code != http.StatusOK || decision.Allowed || decision.Reason != "no cluster configuration applied" {
+		t.Errorf("before the first config: %d %+v", rec.Code, decision)
+	}
+
+	history.Record(clusterConfig)
+	rec = post(`{"protocol": "tcp", "src_ip": "10.1.2.3", "service_id": 1, "token": "web-token"}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("query: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	decision := decode(rec)
+	if !decision.Allowed || decision.Mapping.Name != "db" || !decision.CredentialsChecked || decision.Destination != "10.0.0.5:5432" {
+		t.Errorf("decision %+v", decision)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/quarantine"
+	"marchproxy-egress/internal/waf"
+)
+
+// quarantineReporter returns the callback telling the manager and the
+// security log sinks about services this proxy quarantined, which only
+// log in standalone mode
+func quarantineReporter(client *manager.Client, security *securityLog) func(serviceID int, reason string) {
+	return func(serviceID int, reason string) {
+		fmt.Printf("Service %d quarantined: %s\n", serviceID, reason)
+		security.log(&waf.SecurityLogEntry{
+			Action:   "quarantined",
+			Metadata: map[string]interface{}{"allowed": false, "service_id": serviceID, "reason": reason},
+		})
+		if client.Standalone() {
+			return
+		}
+		if err := client.ReportQuarantine(serviceID, reason); err != nil {
+			fmt.Printf("Failed to report quarantine of service %d: %v\n", serviceID, err)
+		}
+	}
+}
+
+// quarantineFlag is the body of POST /admin/quarantine
+type quarantineFlag struct {
+	ServiceID int    `json:"service_id"`
+	Reason    string `json:"reason"`
+}
+
+// quarantineHandler serves /admin/quarantine:
+//
+//	GET    /admin/quarantine                 quarantine policy and quarantined services
+//	POST   /admin/quarantine                 flag a service, as external detectors do
+//	DELETE /admin/quarantine?service_id=<id> release a service on this proxy
+func quarantineHandler(tracker *quarantine.Tracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(quarantine.Config{Policy: tracker.Policy(), Services: tracker.List()})
+		case http.MethodPost:
+			var req quarantineFlag
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid quarantine flag: %v", err), http.StatusBadRequest)
+				return
+			}
+			if req.ServiceID <= 0 || req.Reason == "" {
+				http.Error(w, "service_id and reason are required", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]bool{"quarantined": tracker.Flag(req.ServiceID, req.Reason)})
+		case http.MethodDelete:
+			serviceID, err := strconv.Atoi(r.URL.Query().Get("service_id"))
+			if err != nil {
+				http.Error(w, "service_id is required", http.StatusBadRequest)
+				return
+			}
+			if !tracker.Release(serviceID) {
+				http.Error(w, "service is not quarantined", http.StatusNotFound)
+				return
+			}
+			fmt.Printf("Service %d released from quarantine on this proxy\n", serviceID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// checkQuarantine admits a connection or datagram of an authenticated
+// service, returning the reason it is refused, empty when admitted
+func checkQuarantine(tracker *quarantine.Tracker, serviceID int, client string) string {
+	entry, refused := tracker.Check(serviceID)
+	if entry == nil {
+		return ""
+	}
+	if refused != "" {
+		fmt.Printf("Connection of service %d from %s refused (%s)\n", serviceID, client, refused)
+	} else if tracker.Policy().Log {
+		fmt.Printf("Connection of quarantined service %d from %s admitted (quarantined %s: %s)\n",
+			serviceID, client, entry.Since.UTC().Format(time.RFC3339), entry.Reason)
+	}
+	return refused
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/counters"
+	"marchproxy-egress/internal/manager"
+)
+
+// RED metrics shared by every MarchProxy module. The egress proxy reports
+// each TCP connection and UDP datagram exchange with the same names and
+// labels the other modules use for their unit of work. L4 flows carry no
+// trace context, so these histograms have no exemplars.
+const (
+	redModule        = "egress"
+	redDefaultTenant = "default"
+)
+
+// redDurationBuckets are the latency bounds used by every module in seconds
+var redDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// redKey identifies one series by the shared labels
+type redKey struct {
+	route   string
+	backend string
+	tenant  string
+}
+
+// redSeries is the request count, error counts and latency histogram for
+// one key. Every field is updated atomically, so observations of a series
+// never wait on each other or on a scrape.
+type redSeries struct {
+	requests atomic.Uint64
+	errors   counters.Labeled[string]
+	buckets  []atomic.Uint64
+	sum      atomic.Uint64 // float64 bits of the latency total in seconds
+}
+
+// redMetrics holds request rate, errors and duration per route, backend and tenant
+type redMetrics struct {
+	series sync.Map // redKey -> *redSeries
+}
+
+// observe records one request. An empty reason marks success.
+func (m *redMetrics) observe(route, backend, tenant, reason string, duration time.Duration) {
+	if route == "" {
+		route = "none"
+	}
+	if backend == "" {
+		backend = "none"
+	}
+	if tenant == "" {
+		tenant = redDefaultTenant
+	}
+
+	key := redKey{route: route, backend: backend, tenant: tenant}
+	value, exists := m.series.Load(key)
+	if !exists {
+		value, _ = m.series.LoadOrStore(key, &redSeries{buckets: make([]atomic.Uint64, len(redDurationBuckets))})
+	}
+	s := value.(*redSeries)
+
+	// The request is counted before its bucket, so a scrape never sees a
+	// bucket above the +Inf count
+	s.requests.Add(1)
+	if reason != "" {
+		s.errors.Inc(reason)
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range redDurationBuckets {
+		if seconds <= bound {
+			s.buckets[i].Add(1)
+		}
+	}
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+seconds)) {
+			break
+		}
+	}
+}
+
+// writePrometheus writes the RED series in Prometheus text format
+func (m *redMetrics) writePrometheus(w io.Writer) {
+	series := make(map[redKey]*redSeries)
+	m.series.Range(func(key, value any) bool {
+		series[key.(redKey)] = value.(*redSeries)
+		return true
+	})
+
+	keys := make([]redKey, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].backend != keys[j].backend {
+			return keys[i].backend < keys[j].backend
+		}
+		return keys[i].tenant < keys[j].tenant
+	})
+
+	labels := func(key redKey) string {
+		return fmt.Sprintf(`module="%s",route="%s",backend="%s",tenant="%s"`, redModule, key.route, key.backend, key.tenant)
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_requests_total Requests handled per module, route, backend and tenant\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_requests_total{%s} %d\n", labels(key), series[key].requests.Load())
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_request_errors_total Failed requests per module, route, backend, tenant and reason\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_request_errors_total counter\n")
+	for _, key := range keys {
+		errors := series[key].errors.Snapshot()
+		reasons := make([]string, 0, len(errors))
+		for reason := range errors {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, `marchproxy_request_errors_total{%s,reason="%s"} %d`+"\n", labels(key), reason, errors[reason])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_request_duration_seconds Request latency per module, route, backend and tenant\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		s := series[key]
+		buckets := make([]uint64, len(s.buckets))
+		for i := range s.buckets {
+			buckets[i] = s.buckets[i].Load()
+		}
+		requests := s.requests.Load()
+		for i, bound := range redDurationBuckets {
+			fmt.Fprintf(w, `marchproxy_request_duration_seconds_bucket{%s,le="%g"} %d`+"\n", labels(key), bound, buckets[i])
+		}
+		fmt.Fprintf(w, `marchproxy_request_duration_seconds_bucket{%s,le="+Inf"} %d`+"\n", labels(key), requests)
+		fmt.Fprintf(w, "marchproxy_request_duration_seconds_sum{%s} %g\n", labels(key), math.Float64frombits(s.sum.Load()))
+		fmt.Fprintf(w, "marchproxy_request_duration_seconds_count{%s} %d\n", labels(key), requests)
+	}
+}
+
+// clusterTenant returns the tenant label for a cluster configuration
+func clusterTenant(clusterConfig *manager.ClusterConfig) string {
+	if clusterConfig == nil || clusterConfig.Cluster.Name == "" {
+		return redDefaultTenant
+	}
+	return clusterConfig.Cluster.Name
+}
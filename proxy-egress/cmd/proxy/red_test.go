@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+)
+
+func TestREDExposition(t *testing.T) {
+	var m redMetrics
+	m.observe("tcp:443", "api.example.com:443", "acme", "", 20*time.Millisecond)
+	m.observe("tcp:443", "api.example.com:443", "acme", closeBackendEOF, 3*time.Second)
+	m.observe("tcp:443", "api.example.com:443", "acme", closeBackendEOF, 400*time.Second)
+	m.observe("", "", "", closePolicyDenied, time.Millisecond)
+
+	var buf bytes.Buffer
+	m.writePrometheus(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	acme := `module="egress",route="tcp:443",backend="api.example.com:443",tenant="acme"`
+	// Missing labels are filled in so every series has the same label set
+	denied := `module="egress",route="none",backend="none",tenant="default"`
+	for _, want := range []string{
+		"# TYPE marchproxy_requests_total counter",
+		"marchproxy_requests_total{" + denied + "} 1",
+		"marchproxy_requests_total{" + acme + "} 3",
+		"# TYPE marchproxy_request_errors_total counter",
+		"marchproxy_request_errors_total{" + denied + `,reason="policy_denied"} 1`,
+		"marchproxy_request_errors_total{" + acme + `,reason="backend_eof"} 2`,
+		"# TYPE marchproxy_request_duration_seconds histogram",
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="0.01"} 0`,
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="0.025"} 1`,
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="2.5"} 1`,
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="5"} 2`,
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="300"} 2`,
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="+Inf"} 3`,
+		"marchproxy_request_duration_seconds_sum{" + acme + "} 403.02",
+		"marchproxy_request_duration_seconds_count{" + acme + "} 3",
+	} {
+		if !containsLine(lines, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+
+	// Every bound is exposed once per series, plus +Inf
+	buckets := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "marchproxy_request_duration_seconds_bucket{"+acme) {
+			buckets++
+		}
+	}
+	if buckets != len(redDurationBuckets)+1 {
+		t.Errorf("%d buckets, want %d", buckets, len(redDurationBuckets)+1)
+	}
+
+	// L4 flows carry no trace context, so no exemplars are written
+	if strings.Contains(buf.String(), "trace_id") || strings.Contains(buf.String(), " # {") {
+		t.Error("exposition contains an exemplar")
+	}
+}
+
+func TestREDConcurrentObserve(t *testing.T) {
+	var m redMetrics
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				m.observe("tcp:443", "api.example.com:443", "acme", closeError, 250*time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var buf bytes.Buffer
+	m.writePrometheus(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	acme := `module="egress",route="tcp:443",backend="api.example.com:443",tenant="acme"`
+	for _, want := range []string{
+		"marchproxy_requests_total{" + acme + "} 4000",
+		"marchproxy_request_errors_total{" + acme + `,reason="error"} 4000`,
+		"marchproxy_request_duration_seconds_bucket{" + acme + `,le="0.25"} 4000`,
+		"marchproxy_request_duration_seconds_sum{" + acme + "} 1000",
+	} {
+		if !containsLine(lines, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestREDExpositionEmpty(t *testing.T) {
+	var m redMetrics
+	var buf bytes.Buffer
+	m.writePrometheus(&buf)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.HasPrefix(line, "# ") {
+			t.Errorf("series written without observations: %s", line)
+		}
+	}
+}
+
+func TestClusterTenant(t *testing.T) {
+	if got := clusterTenant(nil); got != redDefaultTenant {
+		t.Errorf("clusterTenant(nil) = %s", got)
+	}
+	if got := clusterTenant(&manager.ClusterConfig{Cluster: manager.ClusterInfo{Name: "acme"}}); got != "acme" {
+		t.Errorf("clusterTenant = %s, want acme", got)
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
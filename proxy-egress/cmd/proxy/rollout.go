@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+)
+
+// rolloutTracker follows the applied config version and counts connection
+// outcomes since it was applied, so canaries of a config rollout can be
+// watched on /stats
+type rolloutTracker struct {
+	mu         sync.Mutex
+	version    string
+	appliedAt  time.Time
+	baseClosed uint64
+	baseFailed uint64
+}
+
+// rolloutStatus is the "rollout" section of /stats
+type rolloutStatus struct {
+	ConfigVersion     string  `json:"config_version"`
+	AppliedAt         string  `json:"applied_at,omitempty"`
+	Role              string  `json:"role"`
+	State             string  `json:"state,omitempty"`
+	RolloutID         int     `json:"rollout_id,omitempty"`
+	RolloutVersion    string  `json:"rollout_version,omitempty"`
+	StableVersion     string  `json:"stable_version,omitempty"`
+	ConnectionsClosed uint64  `json:"connections_closed"`
+	ConnectionsFailed uint64  `json:"connections_failed"`
+	ErrorRate         float64 `json:"error_rate"`
+}
+
+// applied records that version was applied, restarting the counts when it
+// differs from the previous one
+func (t *rolloutTracker) applied(version string, closes *closeMetrics) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if version == t.version && !t.appliedAt.IsZero() {
+		return
+	}
+	t.version = version
+	t.appliedAt = time.Now()
+	t.baseClosed, t.baseFailed = closes.totals()
+}
+
+// appliedVersion returns the applied config version
+func (t *rolloutTracker) appliedVersion() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version
+}
+
+// status returns the applied version, its rollout state and the connection
+// outcomes since it was applied. A nil rollout means the cluster doesn't
+// stage config rollouts.
+func (t *rolloutTracker) status(rollout *manager.Rollout, closes *closeMetrics) rolloutStatus {
+	closed, failed := closes.totals()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := rolloutStatus{
+		ConfigVersion:     t.version,
+		Role:              "stable",
+		ConnectionsClosed: closed - t.baseClosed,
+		ConnectionsFailed: failed - t.baseFailed,
+	}
+	if !t.appliedAt.IsZero() {
+		status.AppliedAt = t.appliedAt.UTC().Format(time.RFC3339)
+	}
+	if status.ConnectionsClosed > 0 {
+		status.ErrorRate = float64(status.ConnectionsFailed) / float64(status.ConnectionsClosed)
+	}
+	if rollout != nil {
+		status.Role = rollout.Role
+		status.State = rollout.State
+		status.RolloutID = rollout.ID
+		status.RolloutVersion = rollout.Version
+		status.StableVersion = rollout.StableVersion
+	}
+	return status
+}
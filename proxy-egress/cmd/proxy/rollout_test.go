@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"marchproxy-egress/internal/manager"
+)
+
+func TestRolloutTracker(t *testing.T) {
+	var closes closeMetrics
+	var tracker rolloutTracker
+
+	closes.record("web", closeError)
+	closes.record("web", closeClientEOF)
+	tracker.applied("v1", &closes)
+
+	// Only connections closed since the version was applied count
+	closes.record("web", closeClientEOF)
+	closes.record("web", closeClientEOF)
+	closes.record("web", closeClientEOF)
+	closes.record("db", closeError)
+
+	status := tracker.status(nil, &closes)
+	if status.ConfigVersion != "v1" || status.Role != "stable" || status.State != "" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if status.ConnectionsClosed != 4 || status.ConnectionsFailed != 1 || status.ErrorRate != 0.25 {
+		t.Errorf("Expected 1 of 4 connections failed, got %+v", status)
+	}
+
+	// Refetching the same version keeps counting
+	tracker.applied("v1", &closes)
+	if status := tracker.status(nil, &closes); status.ConnectionsClosed != 4 {
+		t.Errorf("Expected the counts kept for the same version, got %+v", status)
+	}
+
+	tracker.applied("v2", &closes)
+	rollout := &manager.Rollout{ID: 3, State: "canary", Role: "canary", Version: "v2", StableVersion: "v1"}
+	status = tracker.status(rollout, &closes)
+	if status.ConfigVersion != "v2" || status.Role != "canary" || status.RolloutID != 3 || status.StableVersion != "v1" {
+		t.Errorf("Unexpected canary status %+v", status)
+	}
+	if status.ConnectionsClosed != 0 || status.ErrorRate != 0 {
+		t.Errorf("Expected the counts restarted for a new version, got %+v", status)
+	}
+
+	if closed, failed := closes.totals(); closed != 6 || failed != 2 {
+		t.Errorf("Expected 6 closed and 2 failed in total, got %d and %d", closed, failed)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/waf"
+)
+
+// securityLog forwards the proxy's security events, such as refused
+// connections, DLP findings, quarantines and SSH sessions, to the SIEM
+// collectors of security_log_sinks
+type securityLog struct {
+	logger *waf.SecurityLogger
+	sinks  []*waf.SyslogWriter
+}
+
+// newSecurityLog starts the configured sinks, which connect in the
+// background
+func newSecurityLog(cfg *config.Config) (*securityLog, error) {
+	s := &securityLog{logger: waf.NewSecurityLogger()}
+	if len(cfg.SecurityLogSinks) == 0 {
+		return s, nil
+	}
+
+	var roots *x509.CertPool
+	if cfg.SecurityLogTLSCA != "" {
+		pem, err := os.ReadFile(cfg.SecurityLogTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read security log CA: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in security log CA %s", cfg.SecurityLogTLSCA)
+		}
+	}
+
+	for _, raw := range cfg.SecurityLogSinks {
+		opts, err := waf.ParseSyslogURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		opts.Version = version
+		opts.TLSConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		sink, err := waf.NewSyslogWriter(opts)
+		if err != nil {
+			return nil, err
+		}
+		s.logger.AddWriter(sink)
+		s.sinks = append(s.sinks, sink)
+		fmt.Printf("Security events forwarded to %s (%s over %s)\n", opts.Address, opts.Format, opts.Network)
+	}
+	return s, nil
+}
+
+// log sends an entry to the sinks
+func (s *securityLog) log(entry *waf.SecurityLogEntry) {
+	if s == nil || len(s.sinks) == 0 {
+		return
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	s.logger.Log(entry)
+}
+
+// refused logs a connection refused by policy or authentication, with
+// its reason as the action
+func (s *securityLog) refused(client net.Addr, mapping *manager.Mapping, route, reason, closed string) {
+	metadata := map[string]interface{}{"allowed": false, "close_reason": closed, "route": route}
+	if mapping != nil {
+		metadata["mapping"] = mapping.Name
+	}
+	s.log(&waf.SecurityLogEntry{ClientIP: getIPFromAddr(client), Action: reason, Metadata: metadata})
+}
+
+// close delivers what is still queued and stops the sinks
+func (s *securityLog) close() {
+	if s == nil {
+		return
+	}
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+}
+
+// writePrometheus writes the delivery of each sink
+func (s *securityLog) writePrometheus(w io.Writer) {
+	if s == nil {
+		return
+	}
+	waf.WriteSinkMetrics(w, s.sinks)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/selfmon"
+)
+
+// newSelfMonitor creates the resource self-monitor, nil when disabled
+func newSelfMonitor(cfg *config.Config, metrics *ProxyMetrics) *selfmon.Monitor {
+	if cfg.SelfMonitorInterval <= 0 {
+		return nil
+	}
+	return selfmon.New(time.Duration(cfg.SelfMonitorInterval)*time.Second, selfmon.Thresholds{
+		Goroutines: cfg.SelfMonitorGoroutines,
+		HeapBytes:  uint64(cfg.SelfMonitorHeapMB) * 1024 * 1024,
+		FDPercent:  cfg.SelfMonitorFDPercent,
+	}, func() int64 {
+		return atomic.LoadInt64(&metrics.ActiveConnections)
+	})
+}
+
+// goroutinesHandler serves /debug/goroutines, a dump of all goroutine
+// stacks for finding leaks. By default identical stacks are grouped with
+// a count, ?debug=2 prints every goroutine with its state and wait time.
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	debug := 1
+	switch r.URL.Query().Get("debug") {
+	case "", "1":
+	case "2":
+		debug = 2
+	default:
+		http.Error(w, "debug must be 1 or 2", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, debug)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/slo"
+)
+
+// updateSLOs tracks the objectives of the mappings, keeping the events of
+// objectives that didn't change
+func updateSLOs(clusterConfig *manager.ClusterConfig) {
+	objectives := make(map[string][]slo.Objective)
+	for _, mapping := range clusterConfig.Mappings {
+		if len(mapping.SLOs) > 0 {
+			objectives[mapping.Name] = mapping.SLOs
+		}
+	}
+	slo.Default.Update(objectives)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/smtprelay"
+	"marchproxy-shared/netutil"
+)
+
+// smtpRelay is the SMTP listener application mail leaves the cluster through
+type smtpRelay struct {
+	server  *smtprelay.Server
+	dialers *outboundDialers
+	log     io.Closer // nil when logging to stdout or not at all
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// startSMTPRelay listens for SMTP on smtp_port, with STARTTLS when the
+// proxy's TLS certificate loads, and for SMTPS on smtps_port when set. It
+// returns nil when the relay is disabled.
+func startSMTPRelay(ctx context.Context, cfg *config.Config, clusterConfig *manager.ClusterConfig, authenticator *auth.Authenticator, dialers *outboundDialers) (*smtpRelay, error) {
+	if !cfg.SMTPEnabled {
+		return nil, nil
+	}
+
+	var tlsConfig *tls.Config
+	if cert, err := tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath); err == nil {
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	} else if cfg.SMTPSPort != 0 {
+		return nil, fmt.Errorf("failed to load the SMTPS certificate: %w", err)
+	} else {
+		fmt.Printf("Warning: SMTP relay without STARTTLS, failed to load the TLS certificate: %v\n", err)
+	}
+
+	p := &smtpRelay{dialers: dialers, done: make(chan struct{})}
+	var envelopeLog io.Writer
+	switch cfg.SMTPLog {
+	case "":
+	case "stdout":
+		envelopeLog = os.Stdout
+	default:
+		file, err := os.OpenFile(cfg.SMTPLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SMTP log: %w", err)
+		}
+		envelopeLog, p.log = file, file
+	}
+
+	hostname := cfg.SMTPHostname
+	if hostname == "" {
+		hostname = cfg.Hostname
+	}
+	p.server = smtprelay.NewServer(smtprelay.Options{
+		Hostname:       hostname,
+		TLSConfig:      tlsConfig,
+		MaxMessageSize: cfg.SMTPMaxMessageSize,
+		Timeout:        time.Duration(cfg.SMTPTimeout) * time.Second,
+		RequireAuth:    cfg.SMTPRequireAuth,
+		Log:            envelopeLog,
+		Authenticate:   authenticator.AuthenticateService,
+	})
+	p.updateConfiguration(clusterConfig)
+
+	addrs := []string{netutil.JoinHostPort(cfg.BindAddress, cfg.SMTPPort)}
+	if cfg.SMTPSPort != 0 {
+		addrs = append(addrs, netutil.JoinHostPort(cfg.BindAddress, cfg.SMTPSPort))
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := netutil.Listen("tcp", addr, cfg.BindInterface)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			p.closeLog()
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	served := make(chan struct{}, len(listeners))
+	for i, listener := range listeners {
+		implicitTLS := i == 1
+		go func() {
+			p.server.Serve(ctx, listener, implicitTLS)
+			served <- struct{}{}
+		}()
+	}
+	go func() {
+		defer close(p.done)
+		for range listeners {
+			<-served
+		}
+	}()
+
+	fmt.Printf("SMTP relay listening on %v (STARTTLS: %t)\n", addrs, tlsConfig != nil)
+	return p, nil
+}
+
+// updateConfiguration applies the SMTP routes of a new cluster config
+func (p *smtpRelay) updateConfiguration(clusterConfig *manager.ClusterConfig) {
+	if p == nil {
+		return
+	}
+	p.server.SetTable(smtpTable(clusterConfig, p.dialers))
+}
+
+// Stop closes the SMTP listeners, waits for open sessions and closes the log
+func (p *smtpRelay) Stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	p.closeLog()
+}
+
+func (p *smtpRelay) closeLog() {
+	if p.log != nil {
+		p.log.Close()
+	}
+}
+
+// WritePrometheus writes the SMTP message metrics, nothing when disabled
+func (p *smtpRelay) WritePrometheus(w io.Writer) {
+	if p == nil {
+		return
+	}
+	p.server.WritePrometheus(w)
+}
+
+// smtpTable builds the SMTP sources of a cluster config. A service relays
+// mail through the first mapping with the smtp protocol it is a source of,
+// to that mapping's destination service on its port (25 by default). The
+// service is known by SMTP AUTH or by the addresses in its ip_fqdn.
+func smtpTable(clusterConfig *manager.ClusterConfig, dialers *outboundDialers) *smtprelay.Table {
+	table := &smtprelay.Table{}
+	if clusterConfig == nil {
+		return table
+	}
+
+	routes := make(map[int]*smtprelay.Route)
+	for i := range clusterConfig.Mappings {
+		mapping := &clusterConfig.Mappings[i]
+		if !hasProtocol(mapping, "smtp") {
+			continue
+		}
+		var policy smtprelay.Policy
+		if mapping.SMTP != nil {
+			if err := mapping.SMTP.Validate(); err != nil {
+				fmt.Printf("Warning: Ignoring SMTP mapping %s: %v\n", mapping.Name, err)
+				continue
+			}
+			policy = *mapping.SMTP
+		}
+		destService := destinationService(clusterConfig, mapping)
+		if destService == nil {
+			fmt.Printf("Warning: Ignoring SMTP mapping %s without a destination service\n", mapping.Name)
+			continue
+		}
+
+		route := &smtprelay.Route{
+			Mapping: mapping.Name,
+			Policy:  policy,
+			Relay:   net.JoinHostPort(destService.IPFQDN, strconv.Itoa(destinationPort(mapping, 25))),
+		}
+		if dialers != nil {
+			route.Dial = func(ctx context.Context, address string) (net.Conn, error) {
+				return dialers.dial(ctx, "tcp", mapping, address)
+			}
+		}
+		for _, serviceID := range mapping.SourceServices {
+			if _, ok := routes[serviceID]; !ok {
+				routes[serviceID] = route
+			}
+		}
+	}
+
+	for _, service := range clusterConfig.Services {
+		route, ok := routes[service.ID]
+		if !ok {
+			continue
+		}
+		table.Sources = append(table.Sources, smtprelay.Source{
+			ServiceID: service.ID,
+			Service:   service.Name,
+			Networks:  dnsproxy.ParseNetworks(service.IPFQDN),
+			Route:     route,
+		})
+	}
+	return table
+}
+
+// hasProtocol reports whether a mapping serves protocol
+func hasProtocol(mapping *manager.Mapping, protocol string) bool {
+	for _, p := range mapping.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
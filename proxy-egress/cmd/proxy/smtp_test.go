@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/smtprelay"
+)
+
+func TestSMTPTable(t *testing.T) {
+	clusterConfig := &manager.ClusterConfig{
+		Services: []manager.Service{
+			{ID: 1, Name: "web", IPFQDN: "10.0.0.0/24"},
+			{ID: 2, Name: "batch", IPFQDN: "10.0.1.5"},
+			{ID: 3, Name: "mail", IPFQDN: "smtp.example.net"},
+			{ID: 4, Name: "idle", IPFQDN: "10.0.2.5"},
+		},
+		Mappings: []manager.Mapping{
+			{ID: 10, Name: "web-http", Protocols: []string{"tcp"}, SourceServices: []int{1, 4}, DestServices: []int{3}},
+			{ID: 11, Name: "web-mail", Protocols: []string{"smtp"}, SourceServices: []int{1}, DestServices: []int{3}, Ports: "587",
+				SMTP: &smtprelay.Policy{AllowedRecipientDomains: []string{"example.com"}, RequireTLS: true}},
+			{ID: 12, Name: "batch-mail", Protocols: []string{"smtp"}, SourceServices: []int{1, 2}, DestServices: []int{3}},
+			{ID: 13, Name: "broken", Protocols: []string{"smtp"}, SourceServices: []int{4}, DestServices: []int{3},
+				SMTP: &smtprelay.Policy{AllowedSenderDomains: []string{"*"}}},
+		},
+	}
+	table := smtpTable(clusterConfig, nil)
+
+	if len(table.Sources) != 2 {
+		t.Fatalf("Expected web and batch as sources, got %+v", table.Sources)
+	}
+	web, batch := table.Sources[0], table.Sources[1]
+	if web.Service != "web" || web.Route.Mapping != "web-mail" || web.Route.Relay != "smtp.example.net:587" || !web.Route.Policy.RequireTLS {
+		t.Errorf("Expected web to relay through its first SMTP mapping, got %+v", web.Route)
+	}
+	if batch.Service != "batch" || batch.Route.Mapping != "batch-mail" || batch.Route.Relay != "smtp.example.net:25" || len(batch.Networks) != 1 {
+		t.Errorf("Expected batch to relay on port 25, got %+v %+v", batch, batch.Route)
+	}
+}
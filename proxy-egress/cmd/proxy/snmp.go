@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/certs"
+	"marchproxy-shared/readiness"
+	"marchproxy-shared/snmp"
+)
+
+// newSNMPAgent creates the agent serving MARCHPROXY-MIB from the proxy's
+// metrics, readiness and certificate inventory
+func newSNMPAgent(community string, ready *readiness.Tracker, metrics *ProxyMetrics) *snmp.Agent {
+	started := time.Now()
+	return snmp.NewAgent(community, func() []snmp.Var {
+		now := time.Now()
+		status := snmp.Status{
+			Version:           version,
+			Module:            "egress",
+			Uptime:            now.Sub(started),
+			ActiveConnections: uint64(max(atomic.LoadInt64(&metrics.ActiveConnections), 0)),
+			Connections:       uint64(atomic.LoadInt64(&metrics.TCPConnections)),
+			BytesTransferred:  uint64(metrics.BytesTransferred.Load()),
+			AuthFailures:      uint64(atomic.LoadInt64(&metrics.AuthFailures)),
+		}
+		status.Health, status.HealthReason = snmpHealth(ready.Status())
+		for _, entry := range certs.Default.Unique() {
+			status.Certificates = append(status.Certificates, snmp.Certificate{
+				Source:   entry.Source,
+				Role:     string(entry.Role),
+				Subject:  entry.Subject,
+				NotAfter: entry.NotAfter,
+			})
+		}
+		return status.Vars(now)
+	})
+}
+
+// snmpHealth maps the readiness on /readyz to mpHealthState and
+// mpHealthReason
+func snmpHealth(status readiness.Status) (int, string) {
+	switch {
+	case status.Ready:
+		return snmp.HealthReady, ""
+	case len(status.Pending) > 0:
+		return snmp.HealthStarting, "pending: " + strings.Join(status.Pending, ", ")
+	}
+	return snmp.HealthUnready, status.Unready
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/socksproxy"
+	"marchproxy-shared/netutil"
+)
+
+// socksListener is the SOCKS5 listener for applications that can't speak
+// the MARCHPROXY_AUTH handshake
+type socksListener struct {
+	server  *socksproxy.Server
+	dialers *outboundDialers
+	skew    time.Duration
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// startSOCKSListener listens for SOCKS5 clients on socks_port. It returns
+// nil when the listener is disabled.
+func startSOCKSListener(ctx context.Context, cfg *config.Config, clusterConfig *manager.ClusterConfig, authenticator *auth.Authenticator, dialers *outboundDialers) (*socksListener, error) {
+	if !cfg.SOCKSEnabled {
+		return nil, nil
+	}
+
+	p := &socksListener{dialers: dialers, skew: cfg.GetScheduleClockSkew(), done: make(chan struct{})}
+	p.server = socksproxy.NewServer(socksproxy.Options{
+		Timeout:        time.Duration(cfg.SOCKSTimeout) * time.Second,
+		UDPIdleTimeout: time.Duration(cfg.SOCKSUDPIdleTimeout) * time.Second,
+		RequireAuth:    cfg.SOCKSRequireAuth,
+		Authenticate:   authenticator.AuthenticateService,
+	})
+	p.updateConfiguration(clusterConfig)
+
+	addr := netutil.JoinHostPort(cfg.BindAddress, cfg.SOCKSPort)
+	listener, err := netutil.Listen("tcp", addr, cfg.BindInterface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(p.done)
+		p.server.Serve(ctx, listener)
+	}()
+
+	fmt.Printf("SOCKS5 listener on %s (authentication required: %t)\n", addr, cfg.SOCKSRequireAuth)
+	return p, nil
+}
+
+// updateConfiguration applies the mappings of a new cluster config
+func (p *socksListener) updateConfiguration(clusterConfig *manager.ClusterConfig) {
+	if p == nil {
+		return
+	}
+	p.server.SetTable(socksTable(clusterConfig, p.dialers, p.skew))
+}
+
+// Stop closes the SOCKS listener and waits for open connections
+func (p *socksListener) Stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
+
+// WritePrometheus writes the SOCKS request metrics, nothing when disabled
+func (p *socksListener) WritePrometheus(w io.Writer) {
+	if p == nil {
+		return
+	}
+	p.server.WritePrometheus(w)
+}
+
+// socksTable builds the SOCKS sources of a cluster config. Each source
+// service of a TCP or UDP mapping may reach the mapping's destination
+// services, by the names and addresses in their ip_fqdn, on the mapping's
+// ports, while the mapping is within its schedule. Clients are known by
+// username, or by the addresses in their own ip_fqdn.
+func socksTable(clusterConfig *manager.ClusterConfig, dialers *outboundDialers, skew time.Duration) *socksproxy.Table {
+	table := &socksproxy.Table{}
+	if clusterConfig == nil {
+		return table
+	}
+
+	routes := make(map[int][]*socksproxy.Route)
+	for i := range clusterConfig.Mappings {
+		mapping := &clusterConfig.Mappings[i]
+		var networks []string
+		for _, protocol := range []string{"tcp", "udp"} {
+			if hasProtocol(mapping, protocol) {
+				networks = append(networks, protocol)
+			}
+		}
+		if len(networks) == 0 {
+			continue
+		}
+		ports, err := socksproxy.ParsePorts(mapping.Ports)
+		if err != nil {
+			fmt.Printf("Warning: Ignoring mapping %s for SOCKS clients: %v\n", mapping.Name, err)
+			continue
+		}
+
+		route := &socksproxy.Route{
+			Mapping:      mapping.Name,
+			Networks:     networks,
+			Ports:        ports,
+			AuthRequired: mapping.AuthRequired,
+		}
+		for _, serviceID := range mapping.DestServices {
+			for j := range clusterConfig.Services {
+				service := &clusterConfig.Services[j]
+				if service.ID != serviceID || !sameTenant(mapping, service) {
+					continue
+				}
+				route.Prefixes = append(route.Prefixes, dnsproxy.ParseNetworks(service.IPFQDN)...)
+				route.Hosts = append(route.Hosts, hostNames(service.IPFQDN)...)
+			}
+		}
+		if mapping.Schedule != nil {
+			route.Active = func(now time.Time) bool {
+				return mapping.Schedule.Active(now, skew)
+			}
+		}
+		if dialers != nil {
+			route.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialers.dial(ctx, network, mapping, address)
+			}
+		}
+		for _, serviceID := range mapping.SourceServices {
+			routes[serviceID] = append(routes[serviceID], route)
+		}
+	}
+
+	for _, service := range clusterConfig.Services {
+		if len(routes[service.ID]) == 0 {
+			continue
+		}
+		table.Sources = append(table.Sources, socksproxy.Source{
+			ServiceID: service.ID,
+			Service:   service.Name,
+			Networks:  dnsproxy.ParseNetworks(service.IPFQDN),
+			Routes:    routes[service.ID],
+		})
+	}
+	return table
+}
+
+// hostNames returns the lower-cased host names of a service's ip_fqdn,
+// skipping addresses and CIDRs
+func hostNames(ipFQDN string) []string {
+	var names []string
+	for _, entry := range strings.Split(ipFQDN, ",") {
+		entry = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+		if entry == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(entry); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(entry); err == nil {
+			continue
+		}
+		names = append(names, entry)
+	}
+	return names
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"marchproxy-egress/internal/manager"
+)
+
+func TestSOCKSTable(t *testing.T) {
+	clusterConfig := &manager.ClusterConfig{
+		Services: []manager.Service{
+			{ID: 1, Name: "web", IPFQDN: "10.0.0.0/24"},
+			{ID: 2, Name: "api", IPFQDN: "API.example.com., 192.0.2.10"},
+			{ID: 3, Name: "db", IPFQDN: "198.51.100.0/28", Tenant: "other"},
+		},
+		Mappings: []manager.Mapping{
+			{ID: 10, Name: "web-api", Protocols: []string{"tcp", "udp"}, SourceServices: []int{1}, DestServices: []int{2, 3}, Ports: "443,8000-8100", Tenant: "acme", AuthRequired: true},
+			{ID: 11, Name: "web-mail", Protocols: []string{"smtp"}, SourceServices: []int{1}, DestServices: []int{2}},
+			{ID: 12, Name: "broken", Protocols: []string{"tcp"}, SourceServices: []int{2}, DestServices: []int{1}, Ports: "http"},
+		},
+	}
+	table := socksTable(clusterConfig, nil, 0)
+
+	if len(table.Sources) != 1 || table.Sources[0].Service != "web" || len(table.Sources[0].Routes) != 1 {
+		t.Fatalf("Expected web with one route, got %+v", table.Sources)
+	}
+	route := table.Sources[0].Routes[0]
+	if len(route.Networks) != 2 || len(route.Ports) != 2 || !route.AuthRequired {
+		t.Errorf("Route = %+v", route)
+	}
+	if len(route.Hosts) != 1 || route.Hosts[0] != "api.example.com" || len(route.Prefixes) != 1 {
+		t.Errorf("Expected api's name and address, not the other tenant's db, got %v %v", route.Hosts, route.Prefixes)
+	}
+}
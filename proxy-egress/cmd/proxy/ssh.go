@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/sshaudit"
+	"marchproxy-egress/internal/waf"
+	"marchproxy-egress/internal/zerotrust"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sshAuditing audits the connections of mappings with an SSH policy
+type sshAuditing struct {
+	bastion  *sshaudit.Bastion      // Full recording, nil without ssh_host_key
+	audit    *zerotrust.AuditLogger // nil without audit_log_path
+	security *securityLog           // SIEM sinks of the audit events
+}
+
+// newSSHAuditing loads the bastion keys and opens the audit log when they
+// are configured
+func newSSHAuditing(cfg *config.Config, security *securityLog) (*sshAuditing, error) {
+	s := &sshAuditing{security: security}
+	if cfg.SSHHostKey != "" {
+		bastion, err := sshaudit.LoadBastion(cfg.SSHHostKey, cfg.SSHUpstreamKey, cfg.SSHKnownHosts, cfg.SSHRecordingDir)
+		if err != nil {
+			return nil, err
+		}
+		s.bastion = bastion
+		fmt.Printf("SSH session recording enabled, recordings in %s\n", cfg.SSHRecordingDir)
+	}
+	if cfg.AuditLogPath != "" {
+		audit, err := zerotrust.NewAuditLogger(cfg.AuditLogPath, logrus.New())
+		if err != nil {
+			return nil, err
+		}
+		s.audit = audit
+	}
+	return s, nil
+}
+
+// record logs an audit event of an SSH connection
+func (s *sshAuditing) record(mapping *manager.Mapping, client net.Addr, dest string, event sshaudit.Event) {
+	fmt.Printf("SSH %s on mapping %s from %s to %s (user %q, allowed %t) %s\n",
+		event.Action, mapping.Name, client, dest, event.User, event.Allowed, event.Reason)
+
+	metadata := map[string]interface{}{"allowed": event.Allowed, "mapping": mapping.Name, "destination": dest}
+	if event.User != "" {
+		metadata["user"] = event.User
+	}
+	if event.Reason != "" {
+		metadata["reason"] = event.Reason
+	}
+	for key, value := range event.Metadata {
+		metadata[key] = value
+	}
+	s.security.log(&waf.SecurityLogEntry{ClientIP: getIPFromAddr(client), Action: "ssh_" + event.Action, Metadata: metadata})
+
+	if s.audit == nil {
+		return
+	}
+	err := s.audit.LogEvent(&zerotrust.AuditEvent{
+		Timestamp:  time.Now(),
+		EventType:  "ssh",
+		User:       event.User,
+		Action:     event.Action,
+		Resource:   dest,
+		SourceIP:   getIPFromAddr(client),
+		Allowed:    event.Allowed,
+		Reason:     event.Reason,
+		PolicyName: mapping.Name,
+		Metadata:   event.Metadata,
+	})
+	if err != nil {
+		fmt.Printf("Failed to write SSH audit event: %v\n", err)
+	}
+}
+
+// recordSession logs the handshake metadata of a relayed SSH connection
+func (s *sshAuditing) recordSession(mapping *manager.Mapping, client net.Addr, dest string, session sshaudit.Session, closed string) {
+	event := sshaudit.Event{Action: "session", Allowed: closed != closePolicyDenied, Metadata: session.Metadata()}
+	if !event.Allowed {
+		event.Reason = "not SSH"
+	}
+	s.record(mapping, client, dest, event)
+}
+
+// serveSSH terminates and records an SSH connection of a mapping in full
+// recording mode, returning the bytes the client sent and received and how
+// it closed
+func (p *TCPProxy) serveSSH(clientConn net.Conn, mapping *manager.Mapping, destAddr string) (sent, received int64, reason, closed string) {
+	auditing := p.metrics.SSH
+	if auditing.bastion == nil {
+		fmt.Printf("Connection from %s refused: mapping %s records SSH sessions but ssh_host_key is not set\n", clientConn.RemoteAddr(), mapping.Name)
+		return 0, 0, "ssh_recording_unavailable", closePolicyDenied
+	}
+
+	counted := &countedConn{Conn: clientConn}
+	var loggedIn atomic.Bool
+	err := auditing.bastion.Serve(sshaudit.Request{
+		Client: counted,
+		Dial:   func() (net.Conn, error) { return p.dialDestination(mapping, destAddr) },
+		Addr:   destAddr,
+		Policy: mapping.SSH,
+		Audit: func(event sshaudit.Event) {
+			if event.Action == sshaudit.ActionStart {
+				loggedIn.Store(true)
+			}
+			auditing.record(mapping, clientConn.RemoteAddr(), destAddr, event)
+		},
+	})
+	sent, received = counted.read.Load(), counted.written.Load()
+	switch {
+	case err != nil && !loggedIn.Load():
+		fmt.Printf("SSH login from %s on mapping %s failed: %v\n", clientConn.RemoteAddr(), mapping.Name, err)
+		return sent, received, "ssh_login_failed", closeAuthFailure
+	case err != nil:
+		fmt.Printf("SSH session from %s on mapping %s failed: %v\n", clientConn.RemoteAddr(), mapping.Name, err)
+		return sent, received, "relay_error", closeError
+	}
+	return sent, received, "", closeClientEOF
+}
+
+// countedConn counts the bytes read from and written to a connection
+type countedConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
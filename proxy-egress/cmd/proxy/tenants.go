@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/tenant"
+)
+
+// mappingTenant returns the tenant a mapping belongs to, the cluster's
+// tenant when the manager did not tag it
+func mappingTenant(clusterConfig *manager.ClusterConfig, mapping *manager.Mapping) string {
+	if mapping != nil && mapping.Tenant != "" {
+		return mapping.Tenant
+	}
+	return clusterTenant(clusterConfig)
+}
+
+// sameTenant returns true if a mapping may reach a service. Untagged
+// mappings and services are shared by every tenant.
+func sameTenant(mapping *manager.Mapping, service *manager.Service) bool {
+	return mapping.Tenant == "" || service.Tenant == "" || mapping.Tenant == service.Tenant
+}
+
+// tenantsHandler serves GET /admin/tenants with the quota and usage of
+// every tenant, or of one tenant with ?tenant=<id>
+func tenantsHandler(tenants *tenant.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		usage := tenants.Usage()
+		if id := r.URL.Query().Get("tenant"); id != "" {
+			filtered := usage[:0]
+			for _, u := range usage {
+				if u.Tenant == id {
+					filtered = append(filtered, u)
+				}
+			}
+			usage = filtered
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(usage)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/tlsinspect"
+	"marchproxy-shared/licensing"
+)
+
+// newTLSInspector loads the TLS inspection CA and opens the audit log. It
+// returns nil when no CA is configured; mappings with TLS inspection
+// enabled are then relayed without it.
+func newTLSInspector(cfg *config.Config, license *licensing.Gate) (*tlsinspect.Inspector, error) {
+	if cfg.TLSInspectionCACert == "" {
+		return nil, nil
+	}
+	license.Require(licensing.FeatureTLSInspection, "TLS inspection")
+
+	authority, err := tlsinspect.LoadAuthority(cfg.TLSInspectionCACert, cfg.TLSInspectionCAKey, cfg.GetTLSInspectionCertTTL())
+	if err != nil {
+		return nil, err
+	}
+
+	var audit io.Writer
+	switch cfg.TLSInspectionAuditLog {
+	case "":
+	case "stdout":
+		audit = os.Stdout
+	default:
+		file, err := os.OpenFile(cfg.TLSInspectionAuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open TLS inspection audit log: %w", err)
+		}
+		audit = file
+	}
+
+	fmt.Printf("TLS inspection CA loaded: %s (expires %s)\n", authority.CA().Subject.CommonName, authority.CA().NotAfter.Format("2006-01-02"))
+	return tlsinspect.New(tlsinspect.Options{
+		Authority: authority,
+		Exclude:   cfg.TLSInspectionExclude,
+		AuditLog:  audit,
+	})
+}
+
+// inspectTLS intercepts a connection of a mapping with TLS inspection
+// enabled, returning the connections to relay, or a reason when the
+// connection is refused. Connections are relayed as they are without a CA
+// or the license entitlement, and when the proxy's own listener already
+// terminated TLS.
+func (p *TCPProxy) inspectTLS(clientConn, destConn net.Conn, mapping *manager.Mapping) (net.Conn, net.Conn, string) {
+	inspector := p.metrics.TLSInspection
+	if mapping.TLSInspection == nil || !mapping.TLSInspection.Enabled || inspector == nil || !p.metrics.License.Enabled(licensing.FeatureTLSInspection) {
+		return clientConn, destConn, ""
+	}
+	if _, ok := clientConn.(*tls.Conn); ok {
+		return clientConn, destConn, ""
+	}
+	if err := mapping.TLSInspection.Validate(); err != nil {
+		fmt.Printf("Connection from %s refused: invalid TLS inspection policy on mapping %s: %v\n", clientConn.RemoteAddr(), mapping.Name, err)
+		return clientConn, destConn, "tls_inspection_invalid"
+	}
+
+	req := tlsinspect.Request{Mapping: mapping.Name, Policy: mapping.TLSInspection, Client: clientConn, Upstream: destConn}
+	if mapping.DNS != nil {
+		req.Allow = mapping.DNS.Allows
+	}
+	session, err := inspector.Intercept(req)
+	switch {
+	case errors.Is(err, tlsinspect.ErrDenied):
+		fmt.Printf("Connection from %s refused: server name denied on mapping %s\n", clientConn.RemoteAddr(), mapping.Name)
+		return clientConn, destConn, "tls_server_name_denied"
+	case errors.Is(err, tlsinspect.ErrUntrusted):
+		fmt.Printf("Connection from %s refused: %v\n", clientConn.RemoteAddr(), err)
+		return clientConn, destConn, "tls_upstream_untrusted"
+	case err != nil:
+		fmt.Printf("TLS inspection failed for %s on mapping %s: %v\n", clientConn.RemoteAddr(), mapping.Name, err)
+		return clientConn, destConn, "tls_inspection_failed"
+	}
+	if session.Intercepted {
+		fmt.Printf("TLS inspection of %s for %s on mapping %s\n", session.ServerName, clientConn.RemoteAddr(), mapping.Name)
+	}
+	return session.Client, session.Upstream, ""
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/tlsmode"
+)
+
+// applyTLSMode enforces the TLS mode of a mapping, returning the
+// connections to relay, or a reason when the connection is refused. TLS
+// inspection is skipped for mappings with a TLS mode.
+func (p *TCPProxy) applyTLSMode(clientConn, destConn net.Conn, mapping *manager.Mapping, destAddr string) (net.Conn, net.Conn, string) {
+	session, err := p.metrics.TLSMode.Apply(tlsmode.Request{
+		Mapping:     mapping.Name,
+		Policy:      mapping.TLSPolicy,
+		Client:      clientConn,
+		Upstream:    destConn,
+		Destination: destAddr,
+		Redial:      func() (net.Conn, error) { return p.dialDestination(mapping, destAddr) },
+	})
+	if err != nil {
+		fmt.Printf("Connection from %s to %s refused by TLS mode %s on mapping %s: %v\n",
+			clientConn.RemoteAddr(), destAddr, mapping.TLSPolicy.Mode, mapping.Name, err)
+		return clientConn, destConn, "tls_" + tlsmode.Reason(err)
+	}
+
+	switch {
+	case session.Terminated:
+		fmt.Printf("TLS terminated for %s and re-originated to %s (%s, %s) on mapping %s\n",
+			clientConn.RemoteAddr(), destAddr, session.ServerName, tls.VersionName(session.Version), mapping.Name)
+	case mapping.TLSPolicy.Mode == tlsmode.ModeRequire:
+		fmt.Printf("TLS to %s (%s) verified for %s on mapping %s\n",
+			destAddr, session.ServerName, clientConn.RemoteAddr(), mapping.Name)
+	}
+	return session.Client, session.Upstream, ""
+}
+
+// tlsModeRefusal reports whether a TLS mode reason is a policy refusal
+// rather than a failed handshake
+func tlsModeRefusal(reason string) bool {
+	switch reason {
+	case "tls_" + tlsmode.ReasonPlaintext,
+		"tls_" + tlsmode.ReasonNoCertificate,
+		"tls_" + tlsmode.ReasonUnknownAuthority,
+		"tls_" + tlsmode.ReasonHostnameMismatch,
+		"tls_" + tlsmode.ReasonExpired,
+		"tls_" + tlsmode.ReasonInvalidCert,
+		"tls_" + tlsmode.ReasonProtocolVersion:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+
+	"marchproxy-egress/internal/ebpf"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/traffic"
+)
+
+// trafficKey returns the traffic key of a mapping's connections to a
+// destination service
+func trafficKey(mapping *manager.Mapping, service, tenantID string) traffic.Key {
+	return traffic.Key{Mapping: mapping.Name, Service: service, Tenant: tenantID}
+}
+
+// trafficEntries returns the bytes relayed in userspace and, with eBPF
+// loaded, forwarded by the eBPF program. The program counts per mapping ID;
+// its counters are named after the mapping in clusterConfig, or the ID once
+// the mapping is gone.
+func trafficEntries(metrics *ProxyMetrics, ebpfMgr *ebpf.Manager, clusterConfig *manager.ClusterConfig) []traffic.Entry {
+	entries := metrics.Traffic.Entries()
+	if ebpfMgr == nil || !ebpfMgr.IsEnabled() {
+		return entries
+	}
+	snapshot, err := ebpfMgr.Snapshot()
+	if err != nil {
+		return entries
+	}
+
+	mappings := make(map[int]*manager.Mapping)
+	if clusterConfig != nil {
+		for i := range clusterConfig.Mappings {
+			mappings[clusterConfig.Mappings[i].ID] = &clusterConfig.Mappings[i]
+		}
+	}
+	for id, counters := range snapshot.Mappings {
+		if counters.BytesOut == 0 && counters.BytesIn == 0 {
+			continue
+		}
+		entry := traffic.Entry{
+			Mapping:      strconv.FormatUint(uint64(id), 10),
+			Path:         traffic.PathEBPF,
+			EgressBytes:  counters.BytesOut,
+			IngressBytes: counters.BytesIn,
+		}
+		if mapping := mappings[int(id)]; mapping != nil {
+			entry.Mapping = mapping.Name
+			entry.Tenant = mappingTenant(clusterConfig, mapping)
+			if service := destinationService(clusterConfig, mapping); service != nil {
+				entry.Service = service.Name
+			}
+		}
+		entries = append(entries, entry)
+	}
+	traffic.Sort(entries)
+	return entries
+}
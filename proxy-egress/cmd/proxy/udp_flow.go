@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/mirror"
+)
+
+var (
+	errUDPFlowLimit  = errors.New("UDP flow limit reached")
+	errUDPFlowClosed = errors.New("UDP proxy is shutting down")
+)
+
+// udpFlowKey identifies the flow of one client address through one mapping
+type udpFlowKey struct {
+	client  string
+	mapping int
+}
+
+// udpFlow relays the datagrams of one client through one mapping over a
+// socket connected to the destination, so every reply the destination
+// sends reaches the client, not only the first
+type udpFlow struct {
+	key        udpFlowKey
+	route      string // Mapping name, for metrics
+	upstream   net.Conn
+	mirror     *mirror.Flow // Flow mirroring, nil when not selected
+	lastActive atomic.Int64 // unix nanoseconds of the last datagram either way
+}
+
+// write sends a client datagram to the destination
+func (f *udpFlow) write(data []byte) error {
+	f.mirror.ClientData(data)
+	if _, err := f.upstream.Write(data); err != nil {
+		return err
+	}
+	f.lastActive.Store(time.Now().UnixNano())
+	return nil
+}
+
+// udpFlowTable tracks the UDP flows of a listener. A flow lasts until no
+// datagram moves either way for the idle timeout. Once max flows are open,
+// datagrams from new clients are dropped.
+type udpFlowTable struct {
+	idle   time.Duration
+	max    int           // 0 for no limit
+	buffer int           // Bytes read per reply, longer replies are truncated
+	stats  *udpFlowStats // Flows per mapping over every listener, may be nil
+	closes *closeMetrics // Flows ended per close reason, may be nil
+	flows  map[udpFlowKey]*udpFlow
+	closed bool
+	mu     sync.Mutex
+	wg     sync.WaitGroup // Reply readers
+}
+
+// newUDPFlowTable creates a flow table with the given idle timeout, flow
+// limit and reply buffer size
+func newUDPFlowTable(idle time.Duration, max, buffer int, stats *udpFlowStats, closes *closeMetrics) *udpFlowTable {
+	return &udpFlowTable{
+		idle:   idle,
+		max:    max,
+		buffer: buffer,
+		stats:  stats,
+		closes: closes,
+		flows:  make(map[udpFlowKey]*udpFlow),
+	}
+}
+
+// open returns the flow of key, calling dial for its destination socket and
+// mirrored flow when there is none. The caller of the open that created the
+// flow gets created set and starts its replies with relay.
+func (t *udpFlowTable) open(key udpFlowKey, route string, dial func() (net.Conn, *mirror.Flow, error)) (flow *udpFlow, created bool, err error) {
+	if flow, err := t.lookup(key, route); flow != nil || err != nil {
+		return flow, false, err
+	}
+
+	upstream, mirrored, err := dial()
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if existing := t.flows[key]; existing != nil {
+		// Another datagram of the client opened it meanwhile
+		upstream.Close()
+		return existing, false, nil
+	}
+	if err := t.admit(route); err != nil {
+		upstream.Close()
+		return nil, false, err
+	}
+
+	flow = &udpFlow{key: key, route: route, upstream: upstream, mirror: mirrored}
+	flow.lastActive.Store(time.Now().UnixNano())
+	t.flows[key] = flow
+	t.stats.record(route, 1, 0)
+	return flow, true, nil
+}
+
+// lookup returns the open flow of key, or an error when a new one would be
+// refused
+func (t *udpFlowTable) lookup(key udpFlowKey, route string) (*udpFlow, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if flow := t.flows[key]; flow != nil {
+		return flow, nil
+	}
+	return nil, t.admit(route)
+}
+
+// admit checks a new flow may open. Callers hold t.mu.
+func (t *udpFlowTable) admit(route string) error {
+	if t.closed {
+		return errUDPFlowClosed
+	}
+	if t.max > 0 && len(t.flows) >= t.max {
+		t.stats.record(route, 0, 1)
+		return errUDPFlowLimit
+	}
+	return nil
+}
+
+// relay passes the destination's replies to reply until the flow idles
+// out, its socket fails or reply returns an error, then ends the flow
+func (t *udpFlowTable) relay(flow *udpFlow, reply func([]byte) error) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		buf := make([]byte, t.buffer)
+		for {
+			flow.upstream.SetReadDeadline(time.Now().Add(t.idle))
+			n, err := flow.upstream.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					if time.Since(time.Unix(0, flow.lastActive.Load())) < t.idle {
+						continue // Client datagrams kept the flow active
+					}
+					t.end(flow, closeIdleTimeout)
+					return
+				}
+				t.end(flow, closeError)
+				return
+			}
+
+			flow.mirror.ServerData(buf[:n])
+			if err := reply(buf[:n]); err != nil {
+				t.end(flow, closeError)
+				return
+			}
+			flow.lastActive.Store(time.Now().UnixNano())
+		}
+	}()
+}
+
+// end removes a flow and closes its socket, counting it once with reason
+func (t *udpFlowTable) end(flow *udpFlow, reason string) {
+	t.mu.Lock()
+	if t.flows[flow.key] != flow {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.flows, flow.key)
+	t.mu.Unlock()
+
+	flow.upstream.Close()
+	t.stats.record(flow.route, -1, 0)
+	t.closes.record(flow.route, reason)
+}
+
+// closeAll ends every flow with reason, refuses new ones and waits for the
+// reply readers
+func (t *udpFlowTable) closeAll(reason string) int {
+	t.mu.Lock()
+	t.closed = true
+	flows := make([]*udpFlow, 0, len(t.flows))
+	for _, flow := range t.flows {
+		flows = append(flows, flow)
+	}
+	t.mu.Unlock()
+
+	for _, flow := range flows {
+		t.end(flow, reason)
+	}
+	t.wg.Wait()
+	return len(flows)
+}
+
+// udpFlowStats counts UDP flows per mapping over every UDP listener
+type udpFlowStats struct {
+	mappings sync.Map // mapping name -> *udpFlowCounts
+}
+
+// udpFlowCounts are the flows of one mapping
+type udpFlowCounts struct {
+	active   atomic.Int64
+	created  atomic.Uint64
+	rejected atomic.Uint64 // Datagrams dropped over the flow limit
+}
+
+// record adds delta open flows, counting the opened ones, and rejected
+// datagrams of a mapping
+func (s *udpFlowStats) record(route string, delta int64, rejected uint64) {
+	if s == nil {
+		return
+	}
+
+	value, exists := s.mappings.Load(route)
+	if !exists {
+		value, _ = s.mappings.LoadOrStore(route, &udpFlowCounts{})
+	}
+	counts := value.(*udpFlowCounts)
+	counts.active.Add(delta)
+	if delta > 0 {
+		counts.created.Add(uint64(delta))
+	}
+	if rejected > 0 {
+		counts.rejected.Add(rejected)
+	}
+}
+
+// writePrometheus writes the open, opened and rejected flows per mapping
+func (s *udpFlowStats) writePrometheus(w io.Writer) {
+	mappings := make(map[string]*udpFlowCounts)
+	s.mappings.Range(func(route, counts any) bool {
+		mappings[route.(string)] = counts.(*udpFlowCounts)
+		return true
+	})
+
+	routes := make([]string, 0, len(mappings))
+	for route := range mappings {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintf(w, "# HELP marchproxy_udp_flows_active Open UDP flows per mapping, one per client address\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_udp_flows_active gauge\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "marchproxy_udp_flows_active{mapping=%q} %d\n", route, mappings[route].active.Load())
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_udp_flows_total UDP flows opened per mapping\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_udp_flows_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "marchproxy_udp_flows_total{mapping=%q} %d\n", route, mappings[route].created.Load())
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_udp_flows_rejected_total Datagrams dropped per mapping because the UDP flow limit was reached\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_udp_flows_rejected_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "marchproxy_udp_flows_rejected_total{mapping=%q} %d\n", route, mappings[route].rejected.Load())
+	}
+}
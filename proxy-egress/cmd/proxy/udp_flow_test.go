@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/mirror"
+)
+
+// udpEcho answers every datagram with two replies
+func udpEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte("1:"), buf[:n]...), from)
+			conn.WriteToUDP(append([]byte("2:"), buf[:n]...), from)
+		}
+	}()
+	return conn
+}
+
+func dialUDP(addr net.Addr) func() (net.Conn, *mirror.Flow, error) {
+	return func() (net.Conn, *mirror.Flow, error) {
+		conn, err := net.Dial("udp", addr.String())
+		return conn, nil, err
+	}
+}
+
+func TestUDPFlowRelaysEveryReply(t *testing.T) {
+	dest := udpEcho(t)
+	var stats udpFlowStats
+	var closes closeMetrics
+	flows := newUDPFlowTable(100*time.Millisecond, 10, 1500, &stats, &closes)
+	defer flows.closeAll(closeDrain)
+
+	replies := make(chan string, 8)
+	key := udpFlowKey{client: "10.0.0.1:5353", mapping: 1}
+	for _, query := range []string{"a", "b"} {
+		flow, created, err := flows.open(key, "dns", dialUDP(dest.LocalAddr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created {
+			flows.relay(flow, func(reply []byte) error {
+				replies <- string(reply)
+				return nil
+			})
+		}
+		if err := flow.write([]byte(query)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both queries went over one socket and both replies to each came back
+	var got []string
+	for len(got) < 4 {
+		select {
+		case reply := <-replies:
+			got = append(got, reply)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Replies = %v, want 4", got)
+		}
+	}
+
+	// The flow ends once idle
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		flows.mu.Lock()
+		open := len(flows.flows)
+		flows.mu.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Flow never idled out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var metrics strings.Builder
+	stats.writePrometheus(&metrics)
+	closes.writePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_udp_flows_active{mapping="dns"} 0`,
+		`marchproxy_udp_flows_total{mapping="dns"} 1`,
+		`reason="idle_timeout"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestUDPFlowLimit(t *testing.T) {
+	dest := udpEcho(t)
+	var stats udpFlowStats
+	flows := newUDPFlowTable(time.Minute, 1, 1500, &stats, nil)
+
+	if _, _, err := flows.open(udpFlowKey{client: "10.0.0.1:1000", mapping: 1}, "syslog", dialUDP(dest.LocalAddr())); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := flows.open(udpFlowKey{client: "10.0.0.2:1000", mapping: 1}, "syslog", dialUDP(dest.LocalAddr())); !errors.Is(err, errUDPFlowLimit) {
+		t.Fatalf("Expected the flow limit, got %v", err)
+	}
+
+	if closed := flows.closeAll(closeDrain); closed != 1 {
+		t.Errorf("closeAll ended %d flows, want 1", closed)
+	}
+	if _, _, err := flows.open(udpFlowKey{client: "10.0.0.2:1000", mapping: 1}, "syslog", dialUDP(dest.LocalAddr())); !errors.Is(err, errUDPFlowClosed) {
+		t.Errorf("Expected no flows after closeAll, got %v", err)
+	}
+
+	var metrics strings.Builder
+	stats.writePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `marchproxy_udp_flows_rejected_total{mapping="syslog"} 1`) {
+		t.Errorf("Metrics missing the rejected datagram:\n%s", metrics.String())
+	}
+}
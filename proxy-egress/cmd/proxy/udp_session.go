@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/manager"
+)
+
+// UDP session handshake messages. A client sends a single datagram
+// "MARCHPROXY_AUTH SERVICE_ID:TOKEN" and receives "AUTH_OK <session-id>" or
+// "AUTH_FAIL <reason>". Every datagram of the session then starts with the
+// session ID, which is stripped before the datagram is forwarded, so only
+// the client holding the ID can use the session, not whoever sends from
+// its address. Sessions idle out after the session timeout.
+//
+// Services using challenge/response first send "MARCHPROXY_AUTH CHALLENGE"
+// and receive "AUTH_CHALLENGE <nonce>", then answer with
+// "MARCHPROXY_AUTH SERVICE_ID:NONCE:TIMESTAMP:PROOF". TCP clients send
+// CHALLENGE in place of their credentials line the same way.
+const (
+	udpAuthPrefix     = "MARCHPROXY_AUTH "
+	udpAuthOK         = "AUTH_OK"
+	udpAuthFail       = "AUTH_FAIL"
+	authChallenge     = "CHALLENGE"
+	authChallengeNext = "AUTH_CHALLENGE"
+	udpAuthRequired   = "MARCHPROXY_AUTH_REQUIRED\n"
+	udpSessionIDBytes = 16
+	udpSessionIDLen   = 2 * udpSessionIDBytes // Hex characters the ID takes in a datagram
+)
+
+// udpSession represents an authenticated UDP client
+type udpSession struct {
+	ID        string    `json:"id"`
+	ServiceID int       `json:"service_id"`
+	MappingID int       `json:"mapping_id"`
+	Route     string    `json:"route"` // Mapping name, for close reason metrics
+	Client    string    `json:"client"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// udpSessionTable tracks authenticated UDP sessions keyed by client address
+type udpSessionTable struct {
+	sessions map[string]*udpSession
+	ttl      time.Duration
+	closes   *closeMetrics // Sessions ended per close reason, may be nil
+	mu       sync.Mutex
+}
+
+// newUDPSessionTable creates a session table with the given idle timeout
+func newUDPSessionTable(ttl time.Duration, closes *closeMetrics) *udpSessionTable {
+	return &udpSessionTable{
+		sessions: make(map[string]*udpSession),
+		ttl:      ttl,
+		closes:   closes,
+	}
+}
+
+// create registers a new session for a client address, replacing any existing one
+func (t *udpSessionTable) create(client string, serviceID, mappingID int, route string) (*udpSession, error) {
+	id := make([]byte, udpSessionIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
+	now := time.Now()
+	session := &udpSession{
+		ID:        hex.EncodeToString(id),
+		ServiceID: serviceID,
+		MappingID: mappingID,
+		Route:     route,
+		Client:    client,
+		Created:   now,
+		LastSeen:  now,
+	}
+
+	t.mu.Lock()
+	t.sessions[client] = session
+	t.mu.Unlock()
+
+	return session, nil
+}
+
+// lookup returns the live session for a client address if id is its
+// session ID, and refreshes its idle timer
+func (t *udpSessionTable) lookup(client, id string) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, exists := t.sessions[client]
+	if !exists || subtle.ConstantTimeCompare([]byte(session.ID), []byte(id)) != 1 {
+		return nil
+	}
+
+	if time.Since(session.LastSeen) > t.ttl {
+		delete(t.sessions, client)
+		t.closes.record(session.Route, closeIdleTimeout)
+		return nil
+	}
+
+	session.LastSeen = time.Now()
+	return session
+}
+
+// expire removes sessions idle for longer than the table TTL
+func (t *udpSessionTable) expire() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for client, session := range t.sessions {
+		if time.Since(session.LastSeen) > t.ttl {
+			delete(t.sessions, client)
+			t.closes.record(session.Route, closeIdleTimeout)
+			removed++
+		}
+	}
+	return removed
+}
+
+// retainServices drops sessions whose service is no longer configured
+func (t *udpSessionTable) retainServices(services []manager.Service) int {
+	valid := make(map[int]bool, len(services))
+	for _, service := range services {
+		valid[service.ID] = true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for client, session := range t.sessions {
+		if !valid[session.ServiceID] {
+			delete(t.sessions, client)
+			t.closes.record(session.Route, closePolicyDenied)
+			removed++
+		}
+	}
+	return removed
+}
+
+// closeAll drops every session, counting them with the given close reason
+func (t *udpSessionTable) closeAll(reason string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := len(t.sessions)
+	for client, session := range t.sessions {
+		delete(t.sessions, client)
+		t.closes.record(session.Route, reason)
+	}
+	return removed
+}
+
+// export returns a copy of the live sessions
+func (t *udpSessionTable) export() []udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]udpSession, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		if time.Since(session.LastSeen) <= t.ttl {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions
+}
+
+// restore adds sessions handed over by another instance. Sessions that
+// idled out or whose service is no longer configured are skipped, and an
+// existing session for the same client wins.
+func (t *udpSessionTable) restore(sessions []udpSession, services []manager.Service) int {
+	valid := make(map[int]bool, len(services))
+	for _, service := range services {
+		valid[service.ID] = true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	restored := 0
+	for _, session := range sessions {
+		if !valid[session.ServiceID] || time.Since(session.LastSeen) > t.ttl {
+			continue
+		}
+		if _, exists := t.sessions[session.Client]; exists {
+			continue
+		}
+		session := session
+		t.sessions[session.Client] = &session
+		restored++
+	}
+	return restored
+}
+
+// isUDPAuthDatagram reports whether a datagram is a session handshake
+func isUDPAuthDatagram(data []byte) bool {
+	return strings.HasPrefix(string(data), udpAuthPrefix)
+}
+
+// splitUDPSessionID splits a session datagram into the session ID it starts
+// with and the payload to forward
+func splitUDPSessionID(data []byte) (string, []byte, bool) {
+	if len(data) < udpSessionIDLen {
+		return "", nil, false
+	}
+	return string(data[:udpSessionIDLen]), data[udpSessionIDLen:], true
+}
+
+// isChallengeRequest reports whether a credentials line or handshake
+// payload asks for a challenge nonce
+func isChallengeRequest(credentials string) bool {
+	return strings.TrimSpace(credentials) == authChallenge
+}
+
+// parseUDPAuthDatagram extracts the service ID and token from a handshake datagram
+func parseUDPAuthDatagram(data []byte) (int, string, error) {
+	payload := strings.TrimSpace(strings.TrimPrefix(string(data), udpAuthPrefix))
+	return parseServiceCredentials(payload)
+}
+
+// maxCredentialsLength bounds the SERVICE_ID:TOKEN line a client may send
+// before it is authenticated. It leaves room for large JWTs.
+const maxCredentialsLength = 16 * 1024
+
+// parseServiceCredentials parses the SERVICE_ID:TOKEN credential format
+func parseServiceCredentials(credentials string) (int, string, error) {
+	if len(credentials) > maxCredentialsLength {
+		return 0, "", fmt.Errorf("credentials longer than %d bytes", maxCredentialsLength)
+	}
+	idPart, token, found := strings.Cut(credentials, ":")
+	if !found {
+		return 0, "", fmt.Errorf("invalid auth format, expected SERVICE_ID:TOKEN")
+	}
+
+	// Only plain decimal IDs, Sscanf would accept "12abc" or "-1"
+	if idPart == "" || len(idPart) > 9 || strings.Trim(idPart, "0123456789") != "" {
+		return 0, "", fmt.Errorf("invalid service ID %q", idPart)
+	}
+	serviceID, err := strconv.Atoi(idPart)
+	if err != nil || serviceID <= 0 {
+		return 0, "", fmt.Errorf("invalid service ID %q", idPart)
+	}
+	if token == "" {
+		return 0, "", fmt.Errorf("missing token")
+	}
+
+	return serviceID, token, nil
+}
+
+// readCredentialsLine reads the client's SERVICE_ID:TOKEN line. Unlike
+// ReadString it stops at maxCredentialsLength, so an unauthenticated client
+// cannot make the proxy buffer an endless line.
+func readCredentialsLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxCredentialsLength+2 { // Allow for CRLF
+			return "", fmt.Errorf("auth response longer than %d bytes", maxCredentialsLength)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+// authorizeMappingService checks the service may use the mapping and validates its token
+func authorizeMappingService(authenticator *auth.Authenticator, mapping *manager.Mapping, serviceID int, token string) error {
+	if !serviceAllowed(mapping, serviceID) {
+		return fmt.Errorf("service %d not allowed for mapping %s", serviceID, mapping.Name)
+	}
+
+	if err := authenticator.AuthenticateService(serviceID, token); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/auth"
+	"marchproxy-egress/internal/bufpool"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/manager"
+)
+
+func TestParseServiceCredentials(t *testing.T) {
+	tests := []struct {
+		input   string
+		id      int
+		token   string
+		wantErr bool
+	}{
+		{input: "12:secret", id: 12, token: "secret"},
+		{input: "7:a:b:c", id: 7, token: "a:b:c"},
+		{input: "12abc:secret", wantErr: true},
+		{input: "-1:secret", wantErr: true},
+		{input: "+1:secret", wantErr: true},
+		{input: "0:secret", wantErr: true},
+		{input: " 1:secret", wantErr: true},
+		{input: "99999999999999999999:secret", wantErr: true},
+		{input: "1:", wantErr: true},
+		{input: "secret", wantErr: true},
+		{input: "1:" + strings.Repeat("x", maxCredentialsLength), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		id, token, err := parseServiceCredentials(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseServiceCredentials(%.20q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if id != tt.id || token != tt.token {
+			t.Errorf("parseServiceCredentials(%.20q) = %d, %q, want %d, %q", tt.input, id, token, tt.id, tt.token)
+		}
+	}
+}
+
+func TestReadCredentialsLine(t *testing.T) {
+	// Lines longer than the bufio buffer are still read whole
+	token := strings.Repeat("t", 10000)
+	line, err := readCredentialsLine(bufio.NewReader(strings.NewReader("1:" + token + "\nDATA")))
+	if err != nil || line != "1:"+token+"\n" {
+		t.Fatalf("Expected the full line, got %d bytes, %v", len(line), err)
+	}
+
+	endless := strings.NewReader(strings.Repeat("x", 10*maxCredentialsLength))
+	if _, err := readCredentialsLine(bufio.NewReader(endless)); err == nil {
+		t.Error("Expected an overlong line to be rejected")
+	}
+	if endless.Len() == 0 {
+		t.Error("Expected reading to stop at the limit")
+	}
+}
+
+func FuzzParseServiceCredentials(f *testing.F) {
+	for _, seed := range []string{"1:token", "42:eyJhbGciOiJIUzI1NiJ9.e30.sig", "1:", ":x", "1a:x", "-5:x", "007:x", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		id, token, err := parseServiceCredentials(input)
+		if err != nil {
+			return
+		}
+		if id <= 0 || token == "" {
+			t.Fatalf("Accepted %q as service %d with token %q", input, id, token)
+		}
+		if !strings.HasSuffix(input, ":"+token) || strings.Contains(input[:len(input)-len(token)-1], ":") {
+			t.Fatalf("Token %q does not follow the first colon in %q", token, input)
+		}
+	})
+}
+
+func FuzzParseUDPAuthDatagram(f *testing.F) {
+	f.Add([]byte(udpAuthPrefix + "1:token\n"))
+	f.Add([]byte(udpAuthPrefix))
+	f.Add([]byte("MARCHPROXY_AUTH"))
+	f.Add([]byte{0xff, 0x00, ':'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if !isUDPAuthDatagram(data) {
+			return
+		}
+		id, token, err := parseUDPAuthDatagram(data)
+		if err == nil && (id <= 0 || token == "") {
+			t.Fatalf("Accepted %q as service %d with token %q", data, id, token)
+		}
+	})
+}
+
+func FuzzReadCredentialsLine(f *testing.F) {
+	f.Add("1:token\n")
+	f.Add("1:token\r\nextra")
+	f.Add("no newline")
+	f.Add(strings.Repeat("y", 5000) + "\n")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		line, err := readCredentialsLine(bufio.NewReader(strings.NewReader(input)))
+		if err != nil {
+			return
+		}
+		if len(line) > maxCredentialsLength+2 || !strings.HasSuffix(line, "\n") || !strings.HasPrefix(input, line) {
+			t.Fatalf("Read %.40q from %.40q", line, input)
+		}
+	})
+}
+
+func TestParseVersionRequest(t *testing.T) {
+	tests := []struct {
+		input   string
+		version int
+		ok      bool
+		wantErr bool
+	}{
+		{input: "VERSION 2\r\n", version: 2, ok: true},
+		{input: "VERSION 1\n", version: 1, ok: true},
+		{input: "VERSION 3\n", ok: true, wantErr: true},
+		{input: "VERSION two\n", ok: true, wantErr: true},
+		{input: "12:secret\n"},
+		{input: "CHALLENGE\n"},
+	}
+
+	for _, tt := range tests {
+		version, ok, err := parseVersionRequest(tt.input)
+		if version != tt.version || ok != tt.ok || (err != nil) != tt.wantErr {
+			t.Errorf("parseVersionRequest(%q) = %d, %t, %v", tt.input, version, ok, err)
+		}
+	}
+
+	// Version 1 clients scan the banner for the prompt, which stays last
+	banner := authBanner()
+	if !strings.HasPrefix(banner, "MARCHPROXY_AUTH\n") || !strings.HasSuffix(banner, "\nSERVICE_ID:TOKEN\n") || !strings.Contains(banner, "\nAUTH_VERSIONS 1 2\n") {
+		t.Errorf("authBanner() = %q", banner)
+	}
+}
+
+func TestUDPSessionLookupRequiresID(t *testing.T) {
+	sessions := newUDPSessionTable(time.Minute, nil)
+	session, err := sessions.create("10.0.0.1:5000", 7, 1, "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.ID) != udpSessionIDLen {
+		t.Fatalf("Session ID %q is not %d characters", session.ID, udpSessionIDLen)
+	}
+
+	if sessions.lookup("10.0.0.1:5000", session.ID) != session {
+		t.Error("Expected the session for its address and ID")
+	}
+	other := strings.Repeat("0", udpSessionIDLen)
+	for _, tt := range []struct{ client, id string }{
+		{"10.0.0.1:5000", other},
+		{"10.0.0.1:5000", ""},
+		{"10.0.0.1:5000", session.ID[:udpSessionIDLen-1]},
+		{"10.0.0.2:5000", session.ID},
+	} {
+		if sessions.lookup(tt.client, tt.id) != nil {
+			t.Errorf("lookup(%s, %q) found the session", tt.client, tt.id)
+		}
+	}
+
+	// A wrong ID doesn't keep an idle session alive
+	session.LastSeen = time.Now().Add(-2 * time.Minute)
+	sessions.lookup("10.0.0.1:5000", other)
+	if sessions.lookup("10.0.0.1:5000", session.ID) != nil {
+		t.Error("Expected the idle session to have expired")
+	}
+}
+
+func TestSplitUDPSessionID(t *testing.T) {
+	id := strings.Repeat("ab", udpSessionIDBytes)
+	got, payload, ok := splitUDPSessionID([]byte(id + "query"))
+	if !ok || got != id || string(payload) != "query" {
+		t.Errorf("splitUDPSessionID = %q, %q, %t", got, payload, ok)
+	}
+	if got, payload, ok := splitUDPSessionID([]byte(id)); !ok || got != id || len(payload) != 0 {
+		t.Errorf("Expected an empty payload after the ID, got %q, %q, %t", got, payload, ok)
+	}
+	if _, _, ok := splitUDPSessionID([]byte("short")); ok {
+		t.Error("Expected a datagram shorter than the ID to be rejected")
+	}
+}
+
+// TestUDPSessionDatagrams authenticates a UDP client and checks only
+// datagrams carrying its session ID reach the destination
+func TestUDPSessionDatagrams(t *testing.T) {
+	dest := udpEcho(t)
+	clusterConfig := &manager.ClusterConfig{
+		Services: []manager.Service{
+			{ID: 7, Name: "api", AuthType: "base64", AuthToken: "secret"},
+			{ID: 9, Name: "echo", IPFQDN: "127.0.0.1"},
+		},
+		Mappings: []manager.Mapping{{
+			ID:             1,
+			Name:           "echo",
+			SourceServices: []int{7},
+			DestServices:   []int{9},
+			Protocols:      []string{"udp"},
+			Ports:          strconv.Itoa(dest.LocalAddr().(*net.UDPAddr).Port),
+			AuthRequired:   true,
+		}},
+	}
+	cfg := &config.Config{BindAddress: "127.0.0.1", ConnectionTimeout: 5, UDPBufferSize: 1500}
+	metrics := NewProxyMetrics()
+	dialers, err := newOutboundDialers(cfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &UDPProxy{
+		config:        cfg,
+		clusterConfig: clusterConfig,
+		authenticator: auth.NewAuthenticator(clusterConfig.Services),
+		metrics:       metrics,
+		dialers:       dialers,
+		buffers:       bufpool.NewManager(),
+		sessions:      newUDPSessionTable(time.Minute, &metrics.Closes),
+		flows:         newUDPFlowTable(time.Minute, 10, 1500, &metrics.UDPFlows, &metrics.Closes),
+		listenAddr:    "127.0.0.1:0",
+	}
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Start(ctx)
+	defer proxy.Stop()
+
+	dial := func() *net.UDPConn {
+		conn, err := net.DialUDP("udp", nil, proxy.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	exchange := func(conn *net.UDPConn, datagram string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("No answer to %q: %v", datagram, err)
+		}
+		return string(buf[:n])
+	}
+
+	client := dial()
+	reply := exchange(client, udpAuthPrefix+"7:secret")
+	id, found := strings.CutPrefix(strings.TrimSpace(reply), udpAuthOK+" ")
+	if !found || len(id) != udpSessionIDLen {
+		t.Fatalf("Expected AUTH_OK with a session ID, got %q", reply)
+	}
+
+	// Datagrams without the session ID, or with another, are refused
+	for _, datagram := range []string{"hello", strings.Repeat("0", udpSessionIDLen) + "hello"} {
+		if reply := exchange(client, datagram); reply != udpAuthRequired {
+			t.Errorf("Datagram %q: expected auth required, got %q", datagram, reply)
+		}
+	}
+
+	// The session ID is stripped before the datagram is forwarded
+	if reply := exchange(client, id+"hello"); reply != "1:hello" {
+		t.Errorf("Expected the echo of the payload, got %q", reply)
+	}
+
+	// Another address with the ID doesn't get the session
+	if reply := exchange(dial(), id+"hello"); reply != udpAuthRequired {
+		t.Errorf("Expected auth required from another address, got %q", reply)
+	}
+}
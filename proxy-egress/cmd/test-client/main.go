@@ -1,88 +1,185 @@
-// Simple test client for MarchProxy authentication
+// Simple test client for MarchProxy authentication, plus a load generator
+// and echo test servers for performance testing
 package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"marchproxy-egress/internal/loadgen"
+	"marchproxy-egress/pkg/egressclient"
 )
 
 func main() {
+	if len(os.Args) >= 2 {
+		switch os.Args[1] {
+		case "loadgen":
+			runLoadgen(os.Args[2:])
+			return
+		case "echo":
+			runEcho(os.Args[2:])
+			return
+		}
+	}
+
 	if len(os.Args) < 4 {
 		fmt.Printf("Usage: %s <proxy_host:port> <service_id> <token>\n", os.Args[0])
+		fmt.Printf("       %s loadgen [flags]   generate load and report latencies\n", os.Args[0])
+		fmt.Printf("       %s echo [flags]      run echo test servers\n", os.Args[0])
 		fmt.Printf("Example: %s localhost:8080 1 mytoken123\n", os.Args[0])
 		os.Exit(1)
 	}
-	
-	proxyAddr := os.Args[1]
-	serviceID := os.Args[2]
-	token := os.Args[3]
-	
-	// Connect to proxy
-	conn, err := net.Dial("tcp", proxyAddr)
+	runAuthTest(os.Args[1], os.Args[2], os.Args[3])
+}
+
+// runAuthTest authenticates to the proxy and sends one echo message
+func runAuthTest(proxyAddr, serviceID, token string) {
+	id, err := strconv.Atoi(serviceID)
+	if err != nil {
+		fmt.Printf("Invalid service ID %q\n", serviceID)
+		os.Exit(1)
+	}
+	dialer, err := egressclient.New(egressclient.Config{ServiceID: id, Token: egressclient.StaticToken(token)})
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	conn, err := dialer.Dial("tcp", proxyAddr)
 	if err != nil {
-		fmt.Printf("Failed to connect to proxy: %v\n", err)
+		fmt.Printf("Authentication failed: %v\n", err)
 		os.Exit(1)
 	}
 	defer conn.Close()
-	
-	fmt.Printf("Connected to proxy at %s\n", proxyAddr)
-	
-	// Read authentication challenge
-	reader := bufio.NewReader(conn)
-	for {
-		line, err := reader.ReadString('\n')
+	fmt.Printf("Authentication successful! Now connected to backend service through %s.\n", proxyAddr)
+
+	// Simple echo test
+	testMessage := "Hello from test client!\n"
+	if _, err := conn.Write([]byte(testMessage)); err != nil {
+		fmt.Printf("Failed to send test message: %v\n", err)
+		os.Exit(1)
+	}
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		fmt.Printf("Failed to read response: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Backend response: %s", response)
+}
+
+// runLoadgen runs the load generator and prints its report
+func runLoadgen(args []string) {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := flags.String("target", "", "host:port for tcp and udp, URL for http")
+	protocol := flags.String("protocol", "tcp", "tcp, udp or http")
+	connections := flags.Int("c", 10, "concurrent connections")
+	rps := flags.Float64("rps", 0, "total target requests per second, 0 for as fast as possible")
+	duration := flags.Duration("d", 30*time.Second, "test duration")
+	sizes := flags.String("sizes", "64", "comma separated payload sizes in bytes, picked at random per request")
+	timeout := flags.Duration("timeout", 5*time.Second, "per request timeout")
+	serviceID := flags.String("service-id", "", "service ID for egress proxy authentication")
+	token := flags.String("token", "", "token for egress proxy authentication")
+	jsonOut := flags.Bool("json", false, "print a JSON summary instead of the text report")
+	maxErrorRate := flags.Float64("max-error-rate", -1, "exit non-zero when more than this percentage of requests fail")
+	flags.Parse(args)
+
+	var payloadSizes []int
+	for _, s := range strings.Split(*sizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
 		if err != nil {
-			fmt.Printf("Failed to read from proxy: %v\n", err)
-			os.Exit(1)
-		}
-		
-		fmt.Printf("Proxy: %s", line)
-		
-		if strings.Contains(line, "SERVICE_ID:TOKEN") {
-			break
+			fmt.Fprintf(os.Stderr, "Invalid payload size %q\n", s)
+			os.Exit(2)
 		}
+		payloadSizes = append(payloadSizes, size)
 	}
-	
-	// Send authentication
-	authResponse := fmt.Sprintf("%s:%s\n", serviceID, token)
-	fmt.Printf("Sending auth: %s", authResponse)
-	
-	if _, err := conn.Write([]byte(authResponse)); err != nil {
-		fmt.Printf("Failed to send auth: %v\n", err)
-		os.Exit(1)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if !*jsonOut {
+		fmt.Printf("Generating %s load against %s for %v...\n", *protocol, *target, *duration)
 	}
-	
-	// Read authentication result
-	result, err := reader.ReadString('\n')
+	result, err := loadgen.Run(ctx, loadgen.Config{
+		Target:       *target,
+		Protocol:     *protocol,
+		Connections:  *connections,
+		RPS:          *rps,
+		Duration:     *duration,
+		PayloadSizes: payloadSizes,
+		Timeout:      *timeout,
+		ServiceID:    *serviceID,
+		Token:        *token,
+	})
 	if err != nil {
-		fmt.Printf("Failed to read auth result: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Load generation failed: %v\n", err)
+		os.Exit(2)
+	}
+
+	if *jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result.Summary())
+	} else {
+		result.WriteText(os.Stdout)
+	}
+
+	total := result.Requests + result.ErrorCount()
+	if *maxErrorRate >= 0 && total > 0 && float64(result.ErrorCount())*100/float64(total) > *maxErrorRate {
+		fmt.Fprintf(os.Stderr, "Error rate above %.2f%%\n", *maxErrorRate)
 		os.Exit(1)
 	}
-	
-	fmt.Printf("Auth result: %s", result)
-	
-	if strings.Contains(result, "AUTH_OK") {
-		fmt.Printf("Authentication successful! Now connected to backend service.\n")
-		
-		// Simple echo test
-		testMessage := "Hello from test client!\n"
-		if _, err := conn.Write([]byte(testMessage)); err != nil {
-			fmt.Printf("Failed to send test message: %v\n", err)
-			os.Exit(1)
+}
+
+// runEcho runs echo servers until interrupted
+func runEcho(args []string) {
+	flags := flag.NewFlagSet("echo", flag.ExitOnError)
+	tcpAddr := flags.String("tcp", ":9000", "TCP echo listen address, empty to disable")
+	udpAddr := flags.String("udp", ":9000", "UDP echo listen address, empty to disable")
+	httpAddr := flags.String("http", ":9080", "HTTP echo listen address, empty to disable")
+	delay := flags.Duration("delay", 0, "added latency for every response")
+	flags.Parse(args)
+
+	var servers []*loadgen.EchoServer
+	for _, listen := range []struct{ protocol, addr string }{
+		{"tcp", *tcpAddr}, {"udp", *udpAddr}, {"http", *httpAddr},
+	} {
+		if listen.addr == "" {
+			continue
 		}
-		
-		response, err := reader.ReadString('\n')
+		server, err := loadgen.ListenEcho(listen.protocol, listen.addr, *delay)
 		if err != nil {
-			fmt.Printf("Failed to read response: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Failed to start %s echo server: %v\n", listen.protocol, err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("Backend response: %s", response)
-	} else {
-		fmt.Printf("Authentication failed\n")
+		fmt.Printf("%s echo server listening on %s\n", strings.ToUpper(listen.protocol), server.Addr())
+		go func(protocol string) {
+			if err := server.Serve(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s echo server failed: %v\n", protocol, err)
+			}
+		}(listen.protocol)
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		fmt.Fprintf(os.Stderr, "No echo servers enabled\n")
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	for _, server := range servers {
+		server.Close()
+	}
+}
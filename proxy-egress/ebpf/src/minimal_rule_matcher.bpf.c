@@ -60,7 +60,7 @@ struct udphdr {
 struct service_rule {
     __u32 service_id;
     __be32 ip_addr;
-    __u16 port;
+    __be16 port;
     __u8 protocol;
     __u8 action;        // 0=drop, 1=allow, 2=userspace
 };
@@ -2,6 +2,15 @@
 // MarchProxy eBPF Rule Matcher
 // Simple packet filtering and service rule matching
 
+#ifdef MARCHPROXY_CORE
+// CO-RE build: kernel types come from BTF (build/vmlinux.h) and field
+// offsets are relocated by libbpf at load time
+#include "vmlinux.h"
+
+#define ETH_P_IP     0x0800
+#define TC_ACT_OK    0
+#define TC_ACT_SHOT  2
+#else
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
@@ -9,6 +18,8 @@
 #include <linux/udp.h>
 #include <linux/icmp.h>
 #include <linux/in.h>
+#include <linux/pkt_cls.h>
+#endif
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_endian.h>
 
@@ -16,12 +27,14 @@
 struct service_rule {
     __u32 service_id;
     __be32 ip_addr;    // Network byte order
-    __u16 port;
+    __be16 port;       // Network byte order
     __u8 protocol;     // IPPROTO_TCP, IPPROTO_UDP, IPPROTO_ICMP
     __u8 action;       // 0=drop, 1=allow, 2=userspace
+    __u32 mapping_id;  // Mapping the rule belongs to, 0 for none
 };
 
-// Statistics structure
+// Statistics structure - must match Global in internal/ebpfstats. Each CPU
+// has its own copy, summed by userspace, so counters need no atomics.
 struct ebpf_stats {
     __u64 total_packets;
     __u64 tcp_packets;
@@ -29,6 +42,20 @@ struct ebpf_stats {
     __u64 dropped_packets;
     __u64 allowed_packets;
     __u64 userspace_packets;
+    __u64 total_bytes;
+    __u64 icmp_packets;
+};
+
+// Per-service and per-mapping counters - must match Counters in
+// internal/ebpfstats
+struct scope_stats {
+    __u64 packets;
+    __u64 bytes;
+    __u64 allowed;
+    __u64 dropped;
+    __u64 userspace;
+    __u64 bytes_out;   // Allowed bytes to the destination
+    __u64 bytes_in;    // Bytes of replies to allowed flows
 };
 
 // BPF maps for service rules and statistics
@@ -47,17 +74,199 @@ struct {
 } service_lookup SEC(".maps");
 
 struct {
-    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
     __uint(max_entries, 1);
     __type(key, __u32);
     __type(value, struct ebpf_stats);
 } statistics SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+    __uint(max_entries, 1024);
+    __type(key, __u32);                 // Service ID
+    __type(value, struct scope_stats);
+} service_stats SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+    __uint(max_entries, 512);
+    __type(key, __u32);                 // Mapping ID
+    __type(value, struct scope_stats);
+} mapping_stats SEC(".maps");
+
+// Flow cache: the policy decision for a flow is made once, on its first
+// packet, and reused for the rest of the flow instead of scanning the rules
+// for every packet
+struct flow_key {
+    __be32 src_ip;
+    __be32 dst_ip;
+    __be16 src_port;
+    __be16 dst_port;   // ICMP type/code for ICMP
+    __u8 protocol;
+    __u8 pad[3];
+};
+
+struct flow_decision {
+    __u32 generation;  // Policy generation the decision was made under
+    __u32 service_id;
+    __u32 mapping_id;
+    __u8 matched;      // 0 when no rule matched
+    __u8 action;
+    __u8 reply;        // The flow is the reply of a rule's flow, from its destination
+    __u8 pad;
+};
+
+// Flow cache counters - must match FlowCache in internal/ebpfstats
+struct flow_cache_stats {
+    __u64 hits;
+    __u64 misses;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct flow_key);
+    __type(value, struct flow_decision);
+} flow_cache SEC(".maps");
+
+// Current policy generation, bumped by userspace whenever the rules change
+// so every cached decision is stale at once without walking the cache
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, __u32);
+} policy_generation SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct flow_cache_stats);
+} flow_cache_stats SEC(".maps");
+
 // Action definitions
 #define ACTION_DROP       0
 #define ACTION_ALLOW      1
 #define ACTION_USERSPACE  2
 
+// Look up the counters of a service or mapping, creating the entry on its
+// first packet
+static __always_inline struct scope_stats *scope_entry(void *map, __u32 id) {
+    struct scope_stats *scope = bpf_map_lookup_elem(map, &id);
+    if (!scope) {
+        struct scope_stats zero = {};
+        bpf_map_update_elem(map, &id, &zero, BPF_NOEXIST);
+        scope = bpf_map_lookup_elem(map, &id);
+    }
+    return scope;
+}
+
+// Count a packet matching a rule against a service or mapping
+static __always_inline void count_scope(void *map, __u32 id, __u64 bytes, __u8 action) {
+    struct scope_stats *scope = scope_entry(map, id);
+    if (!scope)
+        return;
+
+    scope->packets++;
+    scope->bytes += bytes;
+    switch (action) {
+        case ACTION_DROP:
+            scope->dropped++;
+            break;
+        case ACTION_ALLOW:
+            scope->allowed++;
+            scope->bytes_out += bytes;
+            break;
+        case ACTION_USERSPACE:
+            scope->userspace++;
+            break;
+    }
+}
+
+// Count a reply to an allowed flow against a service or mapping. Replies
+// to flows handed to userspace are counted by the proxy.
+static __always_inline void count_reply_scope(void *map, __u32 id, __u64 bytes, __u8 action) {
+    if (action != ACTION_ALLOW)
+        return;
+    struct scope_stats *scope = scope_entry(map, id);
+    if (scope)
+        scope->bytes_in += bytes;
+}
+
+// Count a packet matching a rule, or a reply, against its service and
+// mapping
+static __always_inline void count_rule(struct flow_decision *decision, __u64 bytes) {
+    if (decision->reply) {
+        count_reply_scope(&service_stats, decision->service_id, bytes, decision->action);
+        if (decision->mapping_id)
+            count_reply_scope(&mapping_stats, decision->mapping_id, bytes, decision->action);
+        return;
+    }
+    count_scope(&service_stats, decision->service_id, bytes, decision->action);
+    if (decision->mapping_id)
+        count_scope(&mapping_stats, decision->mapping_id, bytes, decision->action);
+}
+
+// Decide the policy for a packet's flow, from the flow cache when it holds
+// a decision made under the current policy generation, otherwise by
+// scanning the rules and caching the result. Flows matching no rule are
+// cached too, as they are the most expensive to scan.
+static __always_inline void decide_flow(struct flow_key *key, struct flow_decision *decision) {
+    __u32 zero = 0;
+    __u32 generation = 0;
+    __u32 *current = bpf_map_lookup_elem(&policy_generation, &zero);
+    if (current)
+        generation = *current;
+
+    struct flow_cache_stats *cache_stats = bpf_map_lookup_elem(&flow_cache_stats, &zero);
+    struct flow_decision *cached = bpf_map_lookup_elem(&flow_cache, key);
+    if (cached && cached->generation == generation) {
+        *decision = *cached;
+        if (cache_stats)
+            cache_stats->hits++;
+        return;
+    }
+    if (cache_stats)
+        cache_stats->misses++;
+
+    __builtin_memset(decision, 0, sizeof(*decision));
+    decision->generation = generation;
+
+    // Simplified linear search - could be optimized with better data structures
+    struct service_rule *rule;
+    __u32 rule_id;
+
+    for (rule_id = 1; rule_id <= 1000; rule_id++) {
+        rule = bpf_map_lookup_elem(&service_rules, &rule_id);
+        if (!rule)
+            continue;
+
+        if (rule->protocol != key->protocol)
+            continue;
+
+        if (rule->ip_addr == key->dst_ip && rule->port == key->dst_port) {
+            decision->matched = 1;
+            decision->reply = 0;
+            decision->action = rule->action;
+            decision->service_id = rule->service_id;
+            decision->mapping_id = rule->mapping_id;
+            break;
+        }
+
+        // Replies from a rule's destination are only counted, unless the
+        // flow also matches a rule of its own further on
+        if (!decision->reply && rule->ip_addr == key->src_ip && rule->port == key->src_port) {
+            decision->reply = 1;
+            decision->action = rule->action;
+            decision->service_id = rule->service_id;
+            decision->mapping_id = rule->mapping_id;
+        }
+    }
+
+    bpf_map_update_elem(&flow_cache, key, decision, BPF_ANY);
+}
+
 // Helper function to update statistics
 static inline void update_stats(__u64 *counter) {
     __u32 key = 0;
@@ -76,8 +285,10 @@ int rule_matcher_xdp(struct xdp_md *ctx) {
     // Update total packet counter
     __u32 stats_key = 0;
     struct ebpf_stats *stats = bpf_map_lookup_elem(&statistics, &stats_key);
+    __u64 bytes = data_end - data;
     if (stats) {
-        __sync_fetch_and_add(&stats->total_packets, 1);
+        stats->total_packets++;
+        stats->total_bytes += bytes;
     }
 
     // Parse Ethernet header
@@ -94,19 +305,22 @@ int rule_matcher_xdp(struct xdp_md *ctx) {
     if ((void *)(ip + 1) > data_end)
         return XDP_DROP;
 
-    __u8 protocol = ip->protocol;
-    __be32 dst_ip = ip->daddr;
-    __u16 dst_port = 0;
+    struct flow_key key = {
+        .src_ip = ip->saddr,
+        .dst_ip = ip->daddr,
+        .protocol = ip->protocol,
+    };
 
     // Extract destination port based on protocol
-    switch (protocol) {
+    switch (key.protocol) {
         case IPPROTO_TCP: {
             struct tcphdr *tcp = (void *)(ip + 1);
             if ((void *)(tcp + 1) > data_end)
                 return XDP_DROP;
-            dst_port = tcp->dest;
+            key.src_port = tcp->source;
+            key.dst_port = tcp->dest;
             if (stats) {
-                __sync_fetch_and_add(&stats->tcp_packets, 1);
+                stats->tcp_packets++;
             }
             break;
         }
@@ -114,9 +328,10 @@ int rule_matcher_xdp(struct xdp_md *ctx) {
             struct udphdr *udp = (void *)(ip + 1);
             if ((void *)(udp + 1) > data_end)
                 return XDP_DROP;
-            dst_port = udp->dest;
+            key.src_port = udp->source;
+            key.dst_port = udp->dest;
             if (stats) {
-                __sync_fetch_and_add(&stats->udp_packets, 1);
+                stats->udp_packets++;
             }
             break;
         }
@@ -125,7 +340,10 @@ int rule_matcher_xdp(struct xdp_md *ctx) {
             struct icmphdr *icmp = (void *)(ip + 1);
             if ((void *)(icmp + 1) > data_end)
                 return XDP_DROP;
-            dst_port = bpf_htons((icmp->type << 8) | icmp->code);
+            key.dst_port = bpf_htons((icmp->type << 8) | icmp->code);
+            if (stats) {
+                stats->icmp_packets++;
+            }
             break;
         }
         default:
@@ -133,45 +351,40 @@ int rule_matcher_xdp(struct xdp_md *ctx) {
             return XDP_PASS;
     }
 
-    // Look for matching service rules
-    // This is a simplified linear search - could be optimized with better data structures
-    struct service_rule *rule;
-    __u32 rule_id;
+    // Look up the flow's policy decision
+    struct flow_decision decision;
+    decide_flow(&key, &decision);
 
-    // Iterate through possible rule IDs (simplified approach)
-    for (rule_id = 1; rule_id <= 1000; rule_id++) {
-        rule = bpf_map_lookup_elem(&service_rules, &rule_id);
-        if (!rule)
-            continue;
+    // Replies pass untouched, counted against their rule's scopes
+    if (decision.reply) {
+        count_rule(&decision, bytes);
+        return XDP_PASS;
+    }
 
-        // Check if rule matches this packet
-        if (rule->protocol == protocol &&
-            rule->ip_addr == dst_ip &&
-            rule->port == dst_port) {
-
-            // Found a matching rule, apply action
-            switch (rule->action) {
-                case ACTION_DROP:
-                    if (stats) {
-                        __sync_fetch_and_add(&stats->dropped_packets, 1);
-                    }
-                    return XDP_DROP;
-
-                case ACTION_ALLOW:
-                    if (stats) {
-                        __sync_fetch_and_add(&stats->allowed_packets, 1);
-                    }
-                    return XDP_PASS;
-
-                case ACTION_USERSPACE:
-                    if (stats) {
-                        __sync_fetch_and_add(&stats->userspace_packets, 1);
-                    }
-                    return XDP_PASS;  // Let userspace handle it
-
-                default:
-                    return XDP_PASS;
-            }
+    if (decision.matched) {
+        // Found a matching rule, apply action
+        count_rule(&decision, bytes);
+        switch (decision.action) {
+            case ACTION_DROP:
+                if (stats) {
+                    stats->dropped_packets++;
+                }
+                return XDP_DROP;
+
+            case ACTION_ALLOW:
+                if (stats) {
+                    stats->allowed_packets++;
+                }
+                return XDP_PASS;
+
+            case ACTION_USERSPACE:
+                if (stats) {
+                    stats->userspace_packets++;
+                }
+                return XDP_PASS;  // Let userspace handle it
+
+            default:
+                return XDP_PASS;
         }
     }
 
@@ -188,8 +401,10 @@ int rule_matcher_tc_ingress(struct __sk_buff *skb) {
     // Update total packet counter
     __u32 stats_key = 0;
     struct ebpf_stats *stats = bpf_map_lookup_elem(&statistics, &stats_key);
+    __u64 bytes = data_end - data;
     if (stats) {
-        __sync_fetch_and_add(&stats->total_packets, 1);
+        stats->total_packets++;
+        stats->total_bytes += bytes;
     }
 
     // Parse Ethernet header
@@ -206,19 +421,22 @@ int rule_matcher_tc_ingress(struct __sk_buff *skb) {
     if ((void *)(ip + 1) > data_end)
         return TC_ACT_SHOT;
 
-    __u8 protocol = ip->protocol;
-    __be32 dst_ip = ip->daddr;
-    __u16 dst_port = 0;
+    struct flow_key key = {
+        .src_ip = ip->saddr,
+        .dst_ip = ip->daddr,
+        .protocol = ip->protocol,
+    };
 
     // Extract destination port based on protocol
-    switch (protocol) {
+    switch (key.protocol) {
         case IPPROTO_TCP: {
             struct tcphdr *tcp = (void *)(ip + 1);
             if ((void *)(tcp + 1) > data_end)
                 return TC_ACT_SHOT;
-            dst_port = tcp->dest;
+            key.src_port = tcp->source;
+            key.dst_port = tcp->dest;
             if (stats) {
-                __sync_fetch_and_add(&stats->tcp_packets, 1);
+                stats->tcp_packets++;
             }
             break;
         }
@@ -226,9 +444,10 @@ int rule_matcher_tc_ingress(struct __sk_buff *skb) {
             struct udphdr *udp = (void *)(ip + 1);
             if ((void *)(udp + 1) > data_end)
                 return TC_ACT_SHOT;
-            dst_port = udp->dest;
+            key.src_port = udp->source;
+            key.dst_port = udp->dest;
             if (stats) {
-                __sync_fetch_and_add(&stats->udp_packets, 1);
+                stats->udp_packets++;
             }
             break;
         }
@@ -236,48 +455,48 @@ int rule_matcher_tc_ingress(struct __sk_buff *skb) {
             struct icmphdr *icmp = (void *)(ip + 1);
             if ((void *)(icmp + 1) > data_end)
                 return TC_ACT_SHOT;
-            dst_port = bpf_htons((icmp->type << 8) | icmp->code);
+            key.dst_port = bpf_htons((icmp->type << 8) | icmp->code);
+            if (stats) {
+                stats->icmp_packets++;
+            }
             break;
         }
         default:
             return TC_ACT_OK;
     }
 
-    // Look for matching service rules (same logic as XDP)
-    struct service_rule *rule;
-    __u32 rule_id;
+    // Look up the flow's policy decision (same logic as XDP)
+    struct flow_decision decision;
+    decide_flow(&key, &decision);
 
-    for (rule_id = 1; rule_id <= 1000; rule_id++) {
-        rule = bpf_map_lookup_elem(&service_rules, &rule_id);
-        if (!rule)
-            continue;
+    if (decision.reply) {
+        count_rule(&decision, bytes);
+        return TC_ACT_OK;
+    }
 
-        if (rule->protocol == protocol &&
-            rule->ip_addr == dst_ip &&
-            rule->port == dst_port) {
-
-            switch (rule->action) {
-                case ACTION_DROP:
-                    if (stats) {
-                        __sync_fetch_and_add(&stats->dropped_packets, 1);
-                    }
-                    return TC_ACT_SHOT;
-
-                case ACTION_ALLOW:
-                    if (stats) {
-                        __sync_fetch_and_add(&stats->allowed_packets, 1);
-                    }
-                    return TC_ACT_OK;
-
-                case ACTION_USERSPACE:
-                    if (stats) {
-                        __sync_fetch_and_add(&stats->userspace_packets, 1);
-                    }
-                    return TC_ACT_OK;
-
-                default:
-                    return TC_ACT_OK;
-            }
+    if (decision.matched) {
+        count_rule(&decision, bytes);
+        switch (decision.action) {
+            case ACTION_DROP:
+                if (stats) {
+                    stats->dropped_packets++;
+                }
+                return TC_ACT_SHOT;
+
+            case ACTION_ALLOW:
+                if (stats) {
+                    stats->allowed_packets++;
+                }
+                return TC_ACT_OK;
+
+            case ACTION_USERSPACE:
+                if (stats) {
+                    stats->userspace_packets++;
+                }
+                return TC_ACT_OK;
+
+            default:
+                return TC_ACT_OK;
         }
     }
 
@@ -77,7 +77,7 @@ struct icmphdr {
 struct service_rule {
     __u32 service_id;
     __be32 ip_addr;    // Network byte order
-    __u16 port;
+    __be16 port;       // Network byte order
     __u8 protocol;     // IPPROTO_TCP, IPPROTO_UDP, IPPROTO_ICMP
     __u8 action;       // 0=drop, 1=allow, 2=userspace
 };
@@ -10,7 +10,7 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/manager"
 )
 
 // #cgo CFLAGS: -I/usr/include/bpf -I.
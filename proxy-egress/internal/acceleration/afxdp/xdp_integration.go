@@ -8,9 +8,9 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/acceleration/xdp"
-	"github.com/penguintech/marchproxy/internal/manager"
-	"github.com/penguintech/marchproxy/internal/proxy"
+	"marchproxy-egress/internal/acceleration/xdp"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-egress/internal/proxy"
 )
 
 // XDPAFXDPBridge manages the integration between XDP and AF_XDP
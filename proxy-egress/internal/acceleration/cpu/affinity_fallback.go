@@ -8,7 +8,7 @@ import (
 	"runtime"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/manager"
 )
 
 // AffinityManager handles CPU affinity and core isolation (fallback implementation)
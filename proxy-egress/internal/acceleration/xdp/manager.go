@@ -10,7 +10,7 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/manager"
 )
 
 // #cgo CFLAGS: -I/usr/include/bpf -I.
@@ -88,7 +88,9 @@ type XDPConfig struct {
 	BatchTimeout    time.Duration
 }
 
-// ServiceRule represents a service filtering rule for XDP
+// ServiceRule represents a service filtering rule for XDP. Addresses and
+// ports are in host byte order, as xdp_filter.c converts packet fields
+// before comparing them.
 type ServiceRule struct {
 	ServiceID   uint32
 	IPAddr      uint32
@@ -430,6 +432,10 @@ func (xm *XDPManager) GetInterfaceStats(interfaceName string) (*XDPInterface, er
 }
 
 // Helper functions
+
+// ipToUint32 packs an IPv4 address in host byte order. xdp_filter.c looks
+// rules up after bpf_ntohl, so keys and rule addresses are numbers rather
+// than packet bytes and need no swapping on any architecture.
 func ipToUint32(ip net.IP) uint32 {
 	if ip == nil {
 		return 0
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Reasons an authentication attempt is refused before its token is checked
+const (
+	RefusedRateLimited = "rate_limited"
+	RefusedLockedOut   = "locked_out"
+)
+
+// maxTrackedClients is how many client IPs are tracked before idle ones
+// are forgotten
+const maxTrackedClients = 65536
+
+// AttemptLimits bound the authentication attempts of each client IP. Zero
+// values disable the limit.
+type AttemptLimits struct {
+	Rate        float64       // Attempts per second refilled into each IP's bucket
+	Burst       int           // Attempts an IP can make at once, at least 1 when Rate is set
+	MaxFailures int           // Consecutive failures that lock an IP out
+	Lockout     time.Duration // First lockout, doubled for each lockout after it
+	MaxLockout  time.Duration // Longest lockout, 24h when unset
+}
+
+// AttemptStats are the attempts refused since start
+type AttemptStats struct {
+	Refused   map[string]uint64 `json:"refused"`    // By reason
+	Lockouts  uint64            `json:"lockouts"`   // Times an IP was locked out
+	LockedOut int               `json:"locked_out"` // IPs locked out now
+	Tracked   int               `json:"tracked"`    // IPs with recent attempts
+}
+
+// attempts is the recent history of one client IP
+type attempts struct {
+	tokens      float64
+	filled      time.Time
+	failures    int // Consecutive, since the last success or lockout
+	lockouts    int // Since the last success, each doubling the next
+	lockedUntil time.Time
+	seen        time.Time
+}
+
+// AttemptLimiter rate limits authentication attempts per client IP and
+// locks IPs out for exponentially longer after repeated failures, so
+// tokens cannot be guessed by hammering the handshake
+type AttemptLimiter struct {
+	limits   AttemptLimits
+	clients  map[string]*attempts
+	refused  map[string]uint64
+	lockouts uint64
+	mu       sync.Mutex
+
+	now func() time.Time
+}
+
+// NewAttemptLimiter creates a limiter enforcing limits
+func NewAttemptLimiter(limits AttemptLimits) *AttemptLimiter {
+	if limits.Rate > 0 && limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	if limits.MaxLockout <= 0 {
+		limits.MaxLockout = 24 * time.Hour
+	}
+	return &AttemptLimiter{
+		limits:  limits,
+		clients: make(map[string]*attempts),
+		refused: make(map[string]uint64),
+		now:     time.Now,
+	}
+}
+
+// Allow takes an attempt for ip. It returns why the attempt is refused and
+// how long until ip may try again, or "" when it may go ahead.
+func (l *AttemptLimiter) Allow(ip string) (refused string, retryAfter time.Duration) {
+	if l == nil {
+		return "", 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	a := l.client(ip, now)
+	if now.Before(a.lockedUntil) {
+		l.refused[RefusedLockedOut]++
+		return RefusedLockedOut, a.lockedUntil.Sub(now)
+	}
+
+	if l.limits.Rate > 0 {
+		a.tokens += now.Sub(a.filled).Seconds() * l.limits.Rate
+		if burst := float64(l.limits.Burst); a.tokens > burst {
+			a.tokens = burst
+		}
+		a.filled = now
+		if a.tokens < 1 {
+			l.refused[RefusedRateLimited]++
+			return RefusedRateLimited, time.Duration((1 - a.tokens) / l.limits.Rate * float64(time.Second))
+		}
+		a.tokens--
+	}
+	return "", 0
+}
+
+// Failure records a failed attempt from ip. It returns how long ip is
+// locked out for when this failure locked it out, otherwise 0.
+func (l *AttemptLimiter) Failure(ip string) time.Duration {
+	if l == nil || l.limits.MaxFailures <= 0 || l.limits.Lockout <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	a := l.client(ip, now)
+	a.failures++
+	if a.failures < l.limits.MaxFailures {
+		return 0
+	}
+
+	lockout := l.limits.Lockout
+	for i := 0; i < a.lockouts && lockout < l.limits.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > l.limits.MaxLockout {
+		lockout = l.limits.MaxLockout
+	}
+	a.failures = 0
+	a.lockouts++
+	a.lockedUntil = now.Add(lockout)
+	l.lockouts++
+	return lockout
+}
+
+// Success forgets the failures and lockouts of ip
+func (l *AttemptLimiter) Success(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if a, ok := l.clients[ip]; ok {
+		a.failures = 0
+		a.lockouts = 0
+	}
+}
+
+// Stats returns the refused attempts and the IPs locked out now
+func (l *AttemptLimiter) Stats() AttemptStats {
+	stats := AttemptStats{Refused: map[string]uint64{RefusedRateLimited: 0, RefusedLockedOut: 0}}
+	if l == nil {
+		return stats
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for reason, count := range l.refused {
+		stats.Refused[reason] = count
+	}
+	stats.Lockouts = l.lockouts
+	stats.Tracked = len(l.clients)
+	for _, a := range l.clients {
+		if now.Before(a.lockedUntil) {
+			stats.LockedOut++
+		}
+	}
+	return stats
+}
+
+// WritePrometheus writes the refused attempts and lockouts
+func (l *AttemptLimiter) WritePrometheus(w io.Writer) {
+	stats := l.Stats()
+
+	fmt.Fprintf(w, "# HELP marchproxy_auth_attempts_refused_total Authentication attempts refused before the token was checked, by reason\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_auth_attempts_refused_total counter\n")
+	for _, reason := range []string{RefusedRateLimited, RefusedLockedOut} {
+		fmt.Fprintf(w, `marchproxy_auth_attempts_refused_total{reason="%s"} %d`+"\n", reason, stats.Refused[reason])
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_auth_lockouts_total Times a client IP was locked out after repeated authentication failures\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_auth_lockouts_total counter\n")
+	fmt.Fprintf(w, "marchproxy_auth_lockouts_total %d\n", stats.Lockouts)
+	fmt.Fprintf(w, "# HELP marchproxy_auth_locked_out_clients Client IPs locked out of authentication now\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_auth_locked_out_clients gauge\n")
+	fmt.Fprintf(w, "marchproxy_auth_locked_out_clients %d\n", stats.LockedOut)
+}
+
+// client returns the history of ip, creating it with a full bucket on
+// first use. l.mu must be held.
+func (l *AttemptLimiter) client(ip string, now time.Time) *attempts {
+	a, ok := l.clients[ip]
+	if !ok {
+		if len(l.clients) >= maxTrackedClients {
+			l.forgetIdle(now)
+		}
+		a = &attempts{tokens: float64(l.limits.Burst), filled: now}
+		l.clients[ip] = a
+	}
+	a.seen = now
+	return a
+}
+
+// forgetIdle drops IPs that are not locked out and whose bucket has
+// refilled, as forgetting them changes nothing. IPs with lockouts are kept
+// for the longest lockout so returning attackers still back off further.
+// l.mu must be held.
+func (l *AttemptLimiter) forgetIdle(now time.Time) {
+	idle := time.Minute
+	if l.limits.Rate > 0 {
+		if refill := time.Duration(float64(l.limits.Burst) / l.limits.Rate * float64(time.Second)); refill > idle {
+			idle = refill
+		}
+	}
+	for ip, a := range l.clients {
+		quiet := now.Sub(a.seen)
+		if now.Before(a.lockedUntil) || quiet < idle {
+			continue
+		}
+		if a.lockouts > 0 && quiet < l.limits.MaxLockout {
+			continue
+		}
+		delete(l.clients, ip)
+	}
+}
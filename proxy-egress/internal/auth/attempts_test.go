@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for the attempt limiter
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+func newLimiter(limits AttemptLimits) (*AttemptLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := NewAttemptLimiter(limits)
+	l.now = clock.now
+	return l, clock
+}
+
+// TestAttemptLimiterRate tests the per-IP token bucket
+func TestAttemptLimiterRate(t *testing.T) {
+	l, clock := newLimiter(AttemptLimits{Rate: 1, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if refused, _ := l.Allow("10.0.0.1"); refused != "" {
+			t.Fatalf("attempt %d refused: %s", i, refused)
+		}
+	}
+	refused, retryAfter := l.Allow("10.0.0.1")
+	if refused != RefusedRateLimited || retryAfter != time.Second {
+		t.Errorf("fourth attempt = %q, retry after %s; want %q after 1s", refused, retryAfter, RefusedRateLimited)
+	}
+	if refused, _ := l.Allow("10.0.0.2"); refused != "" {
+		t.Errorf("other IP refused: %s", refused)
+	}
+
+	clock.advance(time.Second)
+	if refused, _ := l.Allow("10.0.0.1"); refused != "" {
+		t.Errorf("attempt after refill refused: %s", refused)
+	}
+}
+
+// TestAttemptLimiterLockout tests that lockouts double up to the maximum
+// and that a success resets them
+func TestAttemptLimiterLockout(t *testing.T) {
+	l, clock := newLimiter(AttemptLimits{MaxFailures: 3, Lockout: 10 * time.Second, MaxLockout: 30 * time.Second})
+
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		var lockout time.Duration
+		for i := 0; i < 3; i++ {
+			if refused, _ := l.Allow("10.0.0.1"); refused != "" {
+				t.Fatalf("attempt refused before lockout: %s", refused)
+			}
+			lockout = l.Failure("10.0.0.1")
+		}
+		if lockout != want {
+			t.Errorf("lockout = %s, want %s", lockout, want)
+		}
+		refused, retryAfter := l.Allow("10.0.0.1")
+		if refused != RefusedLockedOut || retryAfter != want {
+			t.Errorf("attempt while locked out = %q, retry after %s", refused, retryAfter)
+		}
+		clock.advance(want)
+	}
+
+	l.Success("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		l.Failure("10.0.0.1")
+	}
+	if _, retryAfter := l.Allow("10.0.0.1"); retryAfter != 10*time.Second {
+		t.Errorf("lockout after success = %s, want 10s", retryAfter)
+	}
+
+	stats := l.Stats()
+	if stats.Lockouts != 5 || stats.LockedOut != 1 || stats.Refused[RefusedLockedOut] != 5 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+// TestAttemptLimiterDisabled tests that zero limits and a nil limiter
+// allow everything
+func TestAttemptLimiterDisabled(t *testing.T) {
+	for _, l := range []*AttemptLimiter{nil, NewAttemptLimiter(AttemptLimits{})} {
+		for i := 0; i < 100; i++ {
+			if refused, _ := l.Allow("10.0.0.1"); refused != "" {
+				t.Fatalf("attempt %d refused: %s", i, refused)
+			}
+			if lockout := l.Failure("10.0.0.1"); lockout != 0 {
+				t.Fatalf("failure %d locked out for %s", i, lockout)
+			}
+		}
+	}
+}
+
+// TestAttemptLimiterForgetIdle tests that idle IPs are forgotten when the
+// table is full but locked out ones are kept
+func TestAttemptLimiterForgetIdle(t *testing.T) {
+	l, clock := newLimiter(AttemptLimits{Rate: 1, Burst: 1, MaxFailures: 1, Lockout: time.Hour})
+	l.Failure("10.0.0.1")
+	for i := 1; i < maxTrackedClients; i++ {
+		l.clients[fmt.Sprintf("idle-%d", i)] = &attempts{seen: clock.t}
+	}
+
+	clock.advance(2 * time.Minute)
+	l.Allow("10.0.0.2")
+	if _, ok := l.clients["10.0.0.1"]; !ok {
+		t.Error("locked out IP was forgotten")
+	}
+	if tracked := l.Stats().Tracked; tracked != 2 {
+		t.Errorf("tracked = %d, want 2", tracked)
+	}
+}
+
+// TestAttemptLimiterPrometheus tests the exported metrics
+func TestAttemptLimiterPrometheus(t *testing.T) {
+	l, _ := newLimiter(AttemptLimits{MaxFailures: 1, Lockout: time.Minute})
+	l.Failure("10.0.0.1")
+	l.Allow("10.0.0.1")
+
+	var out bytes.Buffer
+	l.WritePrometheus(&out)
+	for _, want := range []string{
+		`marchproxy_auth_attempts_refused_total{reason="locked_out"} 1`,
+		`marchproxy_auth_attempts_refused_total{reason="rate_limited"} 0`,
+		"marchproxy_auth_lockouts_total 1",
+		"marchproxy_auth_locked_out_clients 1",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+}
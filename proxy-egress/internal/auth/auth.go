@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/manager"
 )
 
 // AuthType represents the type of authentication
@@ -15,6 +15,7 @@ type AuthType string
 const (
 	AuthTypeBase64 AuthType = "base64"
 	AuthTypeJWT    AuthType = "jwt"
+	AuthTypeHMAC   AuthType = "hmac" // Challenge/response keyed with the service token
 	AuthTypeNone   AuthType = "none"
 )
 
@@ -28,7 +29,11 @@ type BasicJWTClaims struct {
 
 // Authenticator handles authentication for proxy connections
 type Authenticator struct {
-	services map[int]*manager.Service
+	services   map[int]*manager.Service
+	challenges *challenges
+	rotation   *rotationUses
+
+	now func() time.Time
 }
 
 // NewAuthenticator creates a new authenticator with service configuration
@@ -39,7 +44,10 @@ func NewAuthenticator(services []manager.Service) *Authenticator {
 	}
 	
 	return &Authenticator{
-		services: serviceMap,
+		services:   serviceMap,
+		challenges: newChallenges(),
+		rotation:   newRotationUses(),
+		now:        time.Now,
 	}
 }
 
@@ -52,9 +60,11 @@ func (a *Authenticator) AuthenticateService(serviceID int, token string) error {
 	
 	switch AuthType(service.AuthType) {
 	case AuthTypeBase64:
-		return a.validateBase64Token(service, token)
+		return a.withPrevious(service, token, a.validateBase64Token)
 	case AuthTypeJWT:
-		return a.validateJWTToken(service, token)
+		return a.withPrevious(service, token, a.validateJWTToken)
+	case AuthTypeHMAC:
+		return a.validateChallengeResponse(service, token)
 	case AuthTypeNone:
 		return nil // No authentication required
 	default:
@@ -68,13 +78,9 @@ func (a *Authenticator) validateBase64Token(service *manager.Service, token stri
 		return fmt.Errorf("no Base64 token configured for service %s", service.Name)
 	}
 	
-	// Simple constant-time comparison
+	// Compare fixed-size HMACs in constant time, so neither the position of
+	// the first wrong byte nor the length of the token leaks through timing
 	expectedToken := service.AuthToken
-	if len(token) != len(expectedToken) {
-		return fmt.Errorf("invalid token length for service %s", service.Name)
-	}
-	
-	// Use HMAC for constant-time comparison
 	h1 := hmac.New(sha256.New, []byte("comparison"))
 	h1.Write([]byte(token))
 	mac1 := h1.Sum(nil)
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+)
+
+// Challenge/response authentication never sends the service token. The
+// proxy issues a single-use nonce, and the client answers with
+// NONCE:TIMESTAMP:PROOF in place of the token, where PROOF is the hex
+// HMAC-SHA256 of "SERVICE_ID:NONCE:TIMESTAMP" keyed with the token and
+// TIMESTAMP is in Unix seconds. A captured answer cannot be replayed, as
+// its nonce is used up.
+const (
+	ChallengeTTL   = 60 * time.Second // How long an issued nonce can be answered
+	MaxClockSkew   = 30 * time.Second // How far a proof's timestamp may be from the proxy's clock
+	challengeBytes = 16
+
+	// maxPendingChallenges bounds the nonces issued but not yet answered
+	maxPendingChallenges = 65536
+)
+
+// challenges are the nonces issued and not yet answered
+type challenges struct {
+	pending map[string]time.Time // Nonce to expiry
+	mu      sync.Mutex
+}
+
+func newChallenges() *challenges {
+	return &challenges{pending: make(map[string]time.Time)}
+}
+
+// IssueChallenge returns a new nonce for a client to answer within
+// ChallengeTTL
+func (a *Authenticator) IssueChallenge() (string, error) {
+	c := a.challenges
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := a.now()
+	if len(c.pending) >= maxPendingChallenges {
+		for nonce, expires := range c.pending {
+			if !now.Before(expires) {
+				delete(c.pending, nonce)
+			}
+		}
+		if len(c.pending) >= maxPendingChallenges {
+			return "", fmt.Errorf("too many unanswered challenges")
+		}
+	}
+
+	b := make([]byte, challengeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(b)
+	c.pending[nonce] = now.Add(ChallengeTTL)
+	return nonce, nil
+}
+
+// consume uses up nonce, reporting whether it was issued and unexpired
+func (c *challenges) consume(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.pending[nonce]
+	if !ok {
+		return false
+	}
+	delete(c.pending, nonce)
+	return now.Before(expires)
+}
+
+// ChallengeProof computes the answer to nonce for a service, for clients
+// and tests
+func ChallengeProof(serviceID int, token, nonce string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%d:%s:%d", serviceID, nonce, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateChallengeResponse validates a NONCE:TIMESTAMP:PROOF answer
+func (a *Authenticator) validateChallengeResponse(service *manager.Service, response string) error {
+	if service.AuthToken == "" {
+		return fmt.Errorf("no token configured for service %s", service.Name)
+	}
+
+	parts := strings.Split(response, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid challenge response for service %s, expected NONCE:TIMESTAMP:PROOF", service.Name)
+	}
+	nonce, proof := parts[0], parts[2]
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid challenge response timestamp for service %s", service.Name)
+	}
+
+	// Use the nonce up before checking anything else, so a wrong guess
+	// cannot be retried against it
+	now := a.now()
+	if !a.challenges.consume(nonce, now) {
+		return fmt.Errorf("unknown or expired nonce for service %s", service.Name)
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("challenge response timestamp for service %s is %s off", service.Name, skew.Round(time.Second))
+	}
+
+	// The token replaced by a rotation is accepted too until its overlap
+	// window ends
+	proof = strings.ToLower(proof)
+	if hmac.Equal([]byte(proof), []byte(ChallengeProof(service.ID, service.AuthToken, nonce, timestamp))) {
+		return nil
+	}
+	if previous := a.previousCredentials(service, now); previous != nil && previous.AuthToken != "" {
+		if hmac.Equal([]byte(proof), []byte(ChallengeProof(service.ID, previous.AuthToken, nonce, timestamp))) {
+			a.rotation.usedPrevious(service.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid challenge response for service %s", service.Name)
+}
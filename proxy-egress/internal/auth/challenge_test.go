@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+)
+
+// TestChallengeResponse tests HMAC challenge/response authentication and
+// that answers cannot be replayed
+func TestChallengeResponse(t *testing.T) {
+	a := NewAuthenticator([]manager.Service{
+		{ID: 7, Name: "billing", AuthType: "hmac", AuthToken: "c2VjcmV0LXRva2Vu"},
+	})
+	clock := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return clock }
+
+	answer := func(nonce string, timestamp int64, token string) string {
+		return fmt.Sprintf("%s:%d:%s", nonce, timestamp, ChallengeProof(7, token, nonce, timestamp))
+	}
+
+	nonce, err := a.IssueChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := answer(nonce, clock.Unix(), "c2VjcmV0LXRva2Vu")
+	if err := a.AuthenticateService(7, response); err != nil {
+		t.Fatalf("valid answer rejected: %v", err)
+	}
+	if err := a.AuthenticateService(7, response); err == nil {
+		t.Error("replayed answer accepted")
+	}
+	if err := a.AuthenticateService(7, "c2VjcmV0LXRva2Vu"); err == nil {
+		t.Error("static token accepted for an hmac service")
+	}
+
+	tests := []struct {
+		name     string
+		response func(nonce string) string
+	}{
+		{"wrong token", func(nonce string) string { return answer(nonce, clock.Unix(), "d3Jvbmc=") }},
+		{"unissued nonce", func(string) string {
+			return answer("00112233445566778899aabbccddeeff", clock.Unix(), "c2VjcmV0LXRva2Vu")
+		}},
+		{"stale timestamp", func(nonce string) string { return answer(nonce, clock.Unix()-60, "c2VjcmV0LXRva2Vu") }},
+		{"future timestamp", func(nonce string) string { return answer(nonce, clock.Unix()+60, "c2VjcmV0LXRva2Vu") }},
+		{"malformed", func(nonce string) string { return nonce + ":proof" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce, err := a.IssueChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.AuthenticateService(7, tt.response(nonce)); err == nil {
+				t.Error("answer accepted")
+			}
+		})
+	}
+
+	// A wrong answer uses the nonce up
+	nonce, _ = a.IssueChallenge()
+	a.AuthenticateService(7, answer(nonce, clock.Unix(), "d3Jvbmc="))
+	if err := a.AuthenticateService(7, answer(nonce, clock.Unix(), "c2VjcmV0LXRva2Vu")); err == nil {
+		t.Error("nonce reused after a wrong answer")
+	}
+
+	// Nonces expire
+	nonce, _ = a.IssueChallenge()
+	clock = clock.Add(ChallengeTTL)
+	if err := a.AuthenticateService(7, answer(nonce, clock.Unix(), "c2VjcmV0LXRva2Vu")); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired nonce gave %v", err)
+	}
+}
+
+// TestIssueChallengeBound tests that unanswered nonces are bounded and
+// expired ones make room
+func TestIssueChallengeBound(t *testing.T) {
+	a := NewAuthenticator(nil)
+	clock := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return clock }
+
+	for i := 0; i < maxPendingChallenges; i++ {
+		a.challenges.pending[fmt.Sprint(i)] = clock.Add(ChallengeTTL)
+	}
+	if _, err := a.IssueChallenge(); err == nil {
+		t.Error("challenge issued past the bound")
+	}
+
+	clock = clock.Add(ChallengeTTL)
+	if _, err := a.IssueChallenge(); err != nil {
+		t.Errorf("challenge refused after the others expired: %v", err)
+	}
+	if pending := len(a.challenges.pending); pending != 1 {
+		t.Errorf("%d challenges pending, want 1", pending)
+	}
+}
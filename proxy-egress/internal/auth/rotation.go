@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+)
+
+// rotationUses counts authentications with credentials replaced by a
+// rotation, per service, so operators can tell when every client has
+// rolled over
+type rotationUses struct {
+	counts map[string]uint64
+	mu     sync.Mutex
+}
+
+func newRotationUses() *rotationUses {
+	return &rotationUses{counts: make(map[string]uint64)}
+}
+
+func (r *rotationUses) usedPrevious(service string) {
+	r.mu.Lock()
+	r.counts[service]++
+	r.mu.Unlock()
+}
+
+// previousCredentials returns service with the credentials replaced by its
+// last rotation, or nil once the overlap window has ended
+func (a *Authenticator) previousCredentials(service *manager.Service, now time.Time) *manager.Service {
+	if service.PreviousAuthToken == "" && service.PreviousJWTSecret == "" {
+		return nil
+	}
+	if !now.Before(service.PreviousValidUntil) {
+		return nil
+	}
+	previous := *service
+	previous.AuthToken = service.PreviousAuthToken
+	previous.JWTSecret = service.PreviousJWTSecret
+	return &previous
+}
+
+// withPrevious validates token against the service's credentials, then
+// against the ones replaced by its last rotation during the overlap window
+func (a *Authenticator) withPrevious(service *manager.Service, token string, validate func(*manager.Service, string) error) error {
+	err := validate(service, token)
+	if err == nil {
+		return nil
+	}
+	previous := a.previousCredentials(service, a.now())
+	if previous == nil {
+		return err
+	}
+	if validate(previous, token) != nil {
+		return err
+	}
+	a.rotation.usedPrevious(service.Name)
+	return nil
+}
+
+// PreviousCredentialUses returns how many authentications used credentials
+// replaced by a rotation, by service name
+func (a *Authenticator) PreviousCredentialUses() map[string]uint64 {
+	a.rotation.mu.Lock()
+	defer a.rotation.mu.Unlock()
+
+	uses := make(map[string]uint64, len(a.rotation.counts))
+	for service, count := range a.rotation.counts {
+		uses[service] = count
+	}
+	return uses
+}
+
+// WritePrometheus writes the authentications with rotated out credentials
+func (a *Authenticator) WritePrometheus(w io.Writer) {
+	uses := a.PreviousCredentialUses()
+	services := make([]string, 0, len(uses))
+	for service := range uses {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	fmt.Fprintf(w, "# HELP marchproxy_auth_previous_credentials_total Authentications with credentials replaced by a rotation, during its overlap window\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_auth_previous_credentials_total counter\n")
+	for _, service := range services {
+		fmt.Fprintf(w, "marchproxy_auth_previous_credentials_total{service=%q} %d\n", service, uses[service])
+	}
+}
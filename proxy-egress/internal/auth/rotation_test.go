@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-egress/internal/manager"
+)
+
+// TestRotationOverlap tests that rotated out credentials validate until the
+// overlap window ends
+func TestRotationOverlap(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	a := NewAuthenticator([]manager.Service{
+		{
+			ID: 1, Name: "web", AuthType: "base64",
+			AuthToken: "bmV3LXRva2Vu", PreviousAuthToken: "b2xkLXRva2Vu",
+			PreviousValidUntil: clock.Add(time.Hour),
+		},
+		{
+			ID: 2, Name: "batch", AuthType: "jwt",
+			JWTSecret: "new-secret", PreviousJWTSecret: "old-secret",
+			PreviousValidUntil: clock.Add(time.Hour),
+		},
+		{
+			ID: 3, Name: "billing", AuthType: "hmac",
+			AuthToken: "bmV3LXRva2Vu", PreviousAuthToken: "b2xkLXRva2Vu",
+			PreviousValidUntil: clock.Add(time.Hour),
+		},
+	})
+	a.now = func() time.Time { return clock }
+
+	oldJWT, err := GenerateJWTToken(2, "batch", "old-secret", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newJWT, err := GenerateJWTToken(2, "batch", "new-secret", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacAnswer := func(token string) string {
+		nonce, err := a.IssueChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s:%d:%s", nonce, clock.Unix(), ChallengeProof(3, token, nonce, clock.Unix()))
+	}
+
+	for _, tc := range []struct {
+		serviceID int
+		token     func() string
+	}{
+		{1, func() string { return "bmV3LXRva2Vu" }},
+		{1, func() string { return "b2xkLXRva2Vu" }},
+		{2, func() string { return newJWT }},
+		{2, func() string { return oldJWT }},
+		{3, func() string { return hmacAnswer("bmV3LXRva2Vu") }},
+		{3, func() string { return hmacAnswer("b2xkLXRva2Vu") }},
+	} {
+		if err := a.AuthenticateService(tc.serviceID, tc.token()); err != nil {
+			t.Errorf("service %d rejected during overlap: %v", tc.serviceID, err)
+		}
+	}
+	if err := a.AuthenticateService(1, "d3Jvbmc="); err == nil {
+		t.Error("unknown token accepted during overlap")
+	}
+
+	uses := a.PreviousCredentialUses()
+	if uses["web"] != 1 || uses["batch"] != 1 || uses["billing"] != 1 {
+		t.Errorf("previous credential uses = %v", uses)
+	}
+	var out bytes.Buffer
+	a.WritePrometheus(&out)
+	if !strings.Contains(out.String(), `marchproxy_auth_previous_credentials_total{service="web"} 1`) {
+		t.Errorf("metrics missing web:\n%s", out.String())
+	}
+
+	clock = clock.Add(time.Hour)
+	for _, tc := range []struct {
+		serviceID int
+		token     string
+	}{
+		{1, "b2xkLXRva2Vu"},
+		{2, oldJWT},
+		{3, hmacAnswer("b2xkLXRva2Vu")},
+	} {
+		if err := a.AuthenticateService(tc.serviceID, tc.token); err == nil {
+			t.Errorf("service %d accepted rotated out credentials after the overlap", tc.serviceID)
+		}
+	}
+	if err := a.AuthenticateService(1, "bmV3LXRva2Vu"); err != nil {
+		t.Errorf("new token rejected after the overlap: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package bufpool provides sync.Pool-backed byte buffers for the proxy copy
+// loops so relaying traffic does not allocate per connection or per packet.
+package bufpool
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffer size limits. Requested sizes are rounded up to a power of two
+// within these bounds so mappings with similar sizes share a pool.
+const (
+	MinBufferSize     = 4 * 1024
+	MaxBufferSize     = 4 * 1024 * 1024
+	DefaultBufferSize = 32 * 1024 // Used when a caller passes a size <= 0
+)
+
+// Stats describes the activity of a single size class
+type Stats struct {
+	Size   int    `json:"size"`
+	Gets   uint64 `json:"gets"`
+	Puts   uint64 `json:"puts"`
+	Allocs uint64 `json:"allocs"`
+	InUse  int64  `json:"in_use"`
+}
+
+// Pool hands out buffers of one fixed size
+type Pool struct {
+	size   int
+	pool   sync.Pool
+	gets   uint64
+	puts   uint64
+	allocs uint64
+	inUse  int64
+}
+
+// newPool creates a pool of buffers of the given size
+func newPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() interface{} {
+		atomic.AddUint64(&p.allocs, 1)
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer from the pool. Callers must return it with Put.
+func (p *Pool) Get() *[]byte {
+	atomic.AddUint64(&p.gets, 1)
+	atomic.AddInt64(&p.inUse, 1)
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool
+func (p *Pool) Put(buf *[]byte) {
+	if buf == nil || cap(*buf) != p.size {
+		return
+	}
+	*buf = (*buf)[:p.size]
+	atomic.AddUint64(&p.puts, 1)
+	atomic.AddInt64(&p.inUse, -1)
+	p.pool.Put(buf)
+}
+
+// Size returns the buffer size served by the pool
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Stats returns a snapshot of the pool counters
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Size:   p.size,
+		Gets:   atomic.LoadUint64(&p.gets),
+		Puts:   atomic.LoadUint64(&p.puts),
+		Allocs: atomic.LoadUint64(&p.allocs),
+		InUse:  atomic.LoadInt64(&p.inUse),
+	}
+}
+
+// Manager owns one pool per buffer size class
+type Manager struct {
+	pools map[int]*Pool
+	mu    sync.RWMutex
+}
+
+// NewManager creates an empty buffer manager
+func NewManager() *Manager {
+	return &Manager{pools: make(map[int]*Pool)}
+}
+
+// Pool returns the pool serving buffers of at least size bytes
+func (m *Manager) Pool(size int) *Pool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	size = SizeClass(size)
+
+	m.mu.RLock()
+	p, exists := m.pools[size]
+	m.mu.RUnlock()
+	if exists {
+		return p
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, exists = m.pools[size]; !exists {
+		p = newPool(size)
+		m.pools[size] = p
+	}
+	return p
+}
+
+// Acquire returns a pooled buffer of at least size bytes and a function that
+// returns it to the pool
+func (m *Manager) Acquire(size int) ([]byte, func()) {
+	p := m.Pool(size)
+	buf := p.Get()
+	return *buf, func() { p.Put(buf) }
+}
+
+// Copy copies from src to dst using a pooled buffer of the given size. When
+// either side supports zero-copy (ReaderFrom/WriterTo, e.g. TCP splice) the
+// buffer is not used.
+func (m *Manager) Copy(dst io.Writer, src io.Reader, size int) (int64, error) {
+	p := m.Pool(size)
+	buf := p.Get()
+	defer p.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// Stats returns per size class statistics ordered by size
+func (m *Manager) Stats() []Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := make([]Stats, 0, len(m.pools))
+	for _, p := range m.pools {
+		stats = append(stats, p.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Size < stats[j].Size })
+	return stats
+}
+
+// SizeClass rounds size up to the next power of two within the allowed bounds
+func SizeClass(size int) int {
+	if size <= MinBufferSize {
+		return MinBufferSize
+	}
+	if size >= MaxBufferSize {
+		return MaxBufferSize
+	}
+	class := MinBufferSize
+	for class < size {
+		class <<= 1
+	}
+	return class
+}
+
+// ValidateSize checks a configured buffer size is within bounds
+func ValidateSize(name string, size int) error {
+	if size < MinBufferSize || size > MaxBufferSize {
+		return fmt.Errorf("%s must be between %d and %d bytes", name, MinBufferSize, MaxBufferSize)
+	}
+	return nil
+}
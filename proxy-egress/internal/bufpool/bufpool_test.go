@@ -0,0 +1,108 @@
+package bufpool
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestSizeClass tests buffer size rounding
+func TestSizeClass(t *testing.T) {
+	tests := []struct {
+		size     int
+		expected int
+	}{
+		{0, MinBufferSize},
+		{1000, MinBufferSize},
+		{4096, 4096},
+		{5000, 8192},
+		{32 * 1024, 32 * 1024},
+		{100 * 1024, 128 * 1024},
+		{64 * 1024 * 1024, MaxBufferSize},
+	}
+
+	for _, tt := range tests {
+		if got := SizeClass(tt.size); got != tt.expected {
+			t.Errorf("SizeClass(%d) = %d, want %d", tt.size, got, tt.expected)
+		}
+	}
+}
+
+// TestPoolReuse tests buffers are recycled and counted
+func TestPoolReuse(t *testing.T) {
+	m := NewManager()
+	p := m.Pool(32 * 1024)
+
+	buf := p.Get()
+	if len(*buf) != 32*1024 {
+		t.Fatalf("buffer length = %d, want %d", len(*buf), 32*1024)
+	}
+	p.Put(buf)
+
+	stats := p.Stats()
+	if stats.Gets != 1 || stats.Puts != 1 || stats.InUse != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if m.Pool(20*1024) != p {
+		t.Error("expected sizes in the same class to share a pool")
+	}
+}
+
+// TestManagerCopy tests copying through a pooled buffer
+func TestManagerCopy(t *testing.T) {
+	m := NewManager()
+	payload := strings.Repeat("marchproxy", 10000)
+
+	var dst bytes.Buffer
+	// Wrap the reader so io.CopyBuffer cannot use WriterTo and must use the buffer
+	n, err := m.Copy(&dst, struct{ *strings.Reader }{strings.NewReader(payload)}, 8192)
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if n != int64(len(payload)) || dst.String() != payload {
+		t.Errorf("copied %d bytes, want %d", n, len(payload))
+	}
+
+	stats := m.Stats()
+	if len(stats) != 1 || stats[0].InUse != 0 {
+		t.Errorf("unexpected stats after copy: %+v", stats)
+	}
+}
+
+// BenchmarkCopyAlloc measures copying with a freshly allocated buffer per call
+func BenchmarkCopyAlloc(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := make([]byte, 32*1024)
+		copyBuffer(payload, buf)
+	}
+}
+
+// BenchmarkCopyPooled measures copying with a pooled buffer
+func BenchmarkCopyPooled(b *testing.B) {
+	m := NewManager()
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := m.Pool(32 * 1024)
+		buf := p.Get()
+		copyBuffer(payload, *buf)
+		p.Put(buf)
+	}
+}
+
+// copyBuffer copies payload to io.Discard through buf
+func copyBuffer(payload, buf []byte) {
+	r := bytes.NewReader(payload)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			io.Discard.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
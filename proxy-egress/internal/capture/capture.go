@@ -0,0 +1,348 @@
+// Package capture runs bounded packet captures on demand, so client problems
+// can be debugged from the admin API without shell access to the host.
+//
+// Captures read packets from a Linux AF_PACKET socket, keep those matching a
+// filter expression and hold them in memory as a pcap file until it is
+// downloaded. Each capture stops after its duration or once it reaches its
+// byte limit, whichever comes first.
+package capture
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"marchproxy-egress/internal/mirror"
+)
+
+// linkTypeLinuxSLL is the pcap link type of Linux cooked captures, which
+// record packets from any interface type with the same 16 byte header
+const linkTypeLinuxSLL = 113
+
+// keepFinished is how many stopped captures stay available for download
+const keepFinished = 3
+
+// Capture states
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// ErrBusy is returned when a capture is already running
+var ErrBusy = errors.New("a capture is already running")
+
+// Request describes a capture to start
+type Request struct {
+	Filter    string `json:"filter"`
+	Interface string `json:"interface"` // Empty captures every interface
+	Duration  int    `json:"duration"`  // seconds
+	MaxBytes  int64  `json:"max_bytes"` // pcap size limit
+}
+
+// Limits bound the captures an operator can start
+type Limits struct {
+	MaxDuration time.Duration
+	MaxBytes    int64
+}
+
+// Status describes a capture
+type Status struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	Filter     string     `json:"filter"`
+	Interface  string     `json:"interface"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndsAt     time.Time  `json:"ends_at"`
+	StoppedAt  *time.Time `json:"stopped_at,omitempty"`
+	StopReason string     `json:"stop_reason,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Packets    int64      `json:"packets"`
+	Bytes      int64      `json:"bytes"`
+	MaxBytes   int64      `json:"max_bytes"`
+}
+
+// source delivers packets from the network layer up, with the fields of
+// the Linux cooked header describing how each was received. Reads return
+// no data after a short timeout so a stopped capture notices promptly.
+type source interface {
+	read(buf []byte) (int, linkInfo, error)
+	close() error
+}
+
+type linkInfo struct {
+	pktType  uint16
+	haType   uint16
+	addr     []byte
+	protocol uint16 // EtherType
+}
+
+// openSource opens a packet source, replaced in tests
+var openSource = openPacketSource
+
+// Session is one capture
+type Session struct {
+	id        string
+	filter    *Filter
+	iface     string
+	startedAt time.Time
+	endsAt    time.Time
+	maxBytes  int64
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	pcap       *mirror.PcapWriter
+	packets    int64
+	state      string
+	stoppedAt  time.Time
+	stopReason string
+	err        error
+}
+
+// Status returns the capture's current state and counters
+func (s *Session) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := Status{
+		ID:         s.id,
+		State:      s.state,
+		Filter:     s.filter.String(),
+		Interface:  s.iface,
+		StartedAt:  s.startedAt,
+		EndsAt:     s.endsAt,
+		StopReason: s.stopReason,
+		Packets:    s.packets,
+		Bytes:      int64(s.buf.Len()),
+		MaxBytes:   s.maxBytes,
+	}
+	if !s.stoppedAt.IsZero() {
+		stoppedAt := s.stoppedAt
+		status.StoppedAt = &stoppedAt
+	}
+	if s.err != nil {
+		status.Error = s.err.Error()
+	}
+	return status
+}
+
+// Pcap returns a copy of the pcap captured so far
+func (s *Session) Pcap() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.buf.Bytes())
+}
+
+// run reads packets until the capture is cancelled, times out or is full
+func (s *Session) run(ctx context.Context, src source) {
+	defer close(s.done)
+	defer src.close()
+
+	reason := "duration"
+	var err error
+	buf := make([]byte, 65536)
+	for {
+		n, info, readErr := src.read(buf)
+		if ctx.Err() != nil {
+			if ctx.Err() == context.Canceled {
+				reason = "stopped"
+			}
+			break
+		}
+		if readErr != nil {
+			reason, err = "error", readErr
+			break
+		}
+		if n == 0 || !s.filter.Match(buf[:n]) {
+			continue
+		}
+		if !s.write(time.Now(), info, buf[:n]) {
+			reason = "max_bytes"
+			break
+		}
+	}
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stoppedAt = time.Now()
+	s.stopReason = reason
+	s.state = StateDone
+	if err != nil {
+		s.state, s.err = StateFailed, err
+	}
+}
+
+// write adds a packet with its cooked header. It returns false once the
+// packet would not fit within the byte limit.
+func (s *Session) write(ts time.Time, info linkInfo, packet []byte) bool {
+	record := make([]byte, 16, 16+len(packet))
+	binary.BigEndian.PutUint16(record[0:], info.pktType)
+	binary.BigEndian.PutUint16(record[2:], info.haType)
+	binary.BigEndian.PutUint16(record[4:], uint16(len(info.addr)))
+	copy(record[6:14], info.addr)
+	binary.BigEndian.PutUint16(record[14:], info.protocol)
+	record = append(record, packet...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(s.buf.Len()+16+len(record)) > s.maxBytes {
+		return false
+	}
+	s.pcap.WritePacket(ts, record)
+	s.packets++
+	return true
+}
+
+// Manager runs one capture at a time and keeps the last few for download
+type Manager struct {
+	limits Limits
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager creates a manager enforcing limits on every capture
+func NewManager(limits Limits) *Manager {
+	return &Manager{limits: limits, sessions: make(map[string]*Session)}
+}
+
+// Start validates a request and starts capturing
+func (m *Manager) Start(req Request) (*Session, error) {
+	filter, err := CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Duration(req.Duration) * time.Second
+	if duration <= 0 || duration > m.limits.MaxDuration {
+		return nil, fmt.Errorf("duration must be between 1 and %d seconds", int(m.limits.MaxDuration.Seconds()))
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = m.limits.MaxBytes
+	}
+	if maxBytes < 1024 || maxBytes > m.limits.MaxBytes {
+		return nil, fmt.Errorf("max_bytes must be between 1024 and %d", m.limits.MaxBytes)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		if s.Status().State == StateRunning {
+			return nil, ErrBusy
+		}
+	}
+
+	src, err := openSource(req.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	s := &Session{
+		id:        newID(),
+		filter:    filter,
+		iface:     req.Interface,
+		startedAt: now,
+		endsAt:    now.Add(duration),
+		maxBytes:  maxBytes,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		state:     StateRunning,
+	}
+	s.pcap, _ = mirror.NewPcapWriterLinkType(&s.buf, linkTypeLinuxSLL)
+	m.sessions[s.id] = s
+	m.prune()
+
+	go s.run(ctx, src)
+	return s, nil
+}
+
+// prune drops the oldest stopped captures beyond keepFinished. The caller
+// holds m.mu.
+func (m *Manager) prune() {
+	var finished []*Session
+	for _, s := range m.sessions {
+		if s.Status().State != StateRunning {
+			finished = append(finished, s)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].startedAt.After(finished[j].startedAt) })
+	for _, s := range finished[min(len(finished), keepFinished):] {
+		delete(m.sessions, s.id)
+	}
+}
+
+// Get returns a capture by ID
+func (m *Manager) Get(id string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// List returns every capture, newest first
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Status, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s.Status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list
+}
+
+// Stop ends a running capture and waits for it; the pcap stays available
+func (m *Manager) Stop(id string) bool {
+	s, ok := m.Get(id)
+	if !ok {
+		return false
+	}
+	s.cancel()
+	<-s.done
+	return true
+}
+
+// Delete stops a capture if needed and discards it
+func (m *Manager) Delete(id string) bool {
+	if !m.Stop(id) {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return true
+}
+
+// StopAll ends every running capture
+func (m *Manager) StopAll() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.cancel()
+		<-s.done
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
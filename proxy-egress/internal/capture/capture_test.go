@@ -0,0 +1,157 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource replays packets, then reports no data until closed
+type fakeSource struct {
+	mu      sync.Mutex
+	packets [][]byte
+	closed  bool
+}
+
+func (f *fakeSource) read(buf []byte) (int, linkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.packets) == 0 {
+		time.Sleep(time.Millisecond)
+		return 0, linkInfo{}, nil
+	}
+	n := copy(buf, f.packets[0])
+	f.packets = f.packets[1:]
+	return n, linkInfo{haType: 1, addr: []byte{2, 0, 0, 0, 0, 1}, protocol: 0x0800}, nil
+}
+
+func (f *fakeSource) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func useFakeSource(t *testing.T, packets ...[]byte) *fakeSource {
+	src := &fakeSource{packets: packets}
+	openSource = func(string) (source, error) { return src, nil }
+	t.Cleanup(func() { openSource = openPacketSource })
+	return src
+}
+
+// pcapRecords splits a pcap file into its packet records
+func pcapRecords(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	if len(data) < 24 || binary.LittleEndian.Uint32(data[20:]) != linkTypeLinuxSLL {
+		t.Fatalf("Invalid pcap header")
+	}
+	var records [][]byte
+	for data = data[24:]; len(data) >= 16; {
+		n := int(binary.LittleEndian.Uint32(data[8:]))
+		records = append(records, data[16:16+n])
+		data = data[16+n:]
+	}
+	return records
+}
+
+func waitDone(t *testing.T, s *Session) Status {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Capture did not stop")
+	}
+	return s.Status()
+}
+
+func TestCaptureFilterAndDuration(t *testing.T) {
+	web := ipv4Packet("192.0.2.10", "198.51.100.20", protoTCP, 40000, 443)
+	dns := ipv4Packet("192.0.2.10", "198.51.100.53", protoUDP, 50000, 53)
+	src := useFakeSource(t, web, dns, web)
+
+	m := NewManager(Limits{MaxDuration: time.Minute, MaxBytes: 1 << 20})
+	s, err := m.Start(Request{Filter: "tcp port 443", Duration: 1})
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if _, err := m.Start(Request{Duration: 1}); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected a second capture to be refused, got %v", err)
+	}
+
+	status := waitDone(t, s)
+	if status.State != StateDone || status.StopReason != "duration" || status.Packets != 2 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if !src.closed {
+		t.Error("Expected the source to be closed")
+	}
+
+	records := pcapRecords(t, s.Pcap())
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	cooked := records[0]
+	if binary.BigEndian.Uint16(cooked[2:]) != 1 || binary.BigEndian.Uint16(cooked[4:]) != 6 || binary.BigEndian.Uint16(cooked[14:]) != 0x0800 {
+		t.Errorf("Unexpected cooked header % x", cooked[:16])
+	}
+	if string(cooked[16:]) != string(web) {
+		t.Error("Expected the packet to follow the cooked header")
+	}
+}
+
+func TestCaptureMaxBytesAndStop(t *testing.T) {
+	packet := ipv4Packet("192.0.2.10", "198.51.100.20", protoTCP, 40000, 443)
+	var packets [][]byte
+	for i := 0; i < 100; i++ {
+		packets = append(packets, packet)
+	}
+	useFakeSource(t, packets...)
+
+	m := NewManager(Limits{MaxDuration: time.Minute, MaxBytes: 1 << 20})
+	s, err := m.Start(Request{Duration: 60, MaxBytes: 1024})
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	status := waitDone(t, s)
+	// Each record is 16 + 16 + 28 bytes after the 24 byte file header
+	if status.StopReason != "max_bytes" || status.Packets != (1024-24)/60 || status.Bytes > 1024 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	useFakeSource(t)
+	s, err = m.Start(Request{Duration: 60})
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if !m.Stop(s.Status().ID) {
+		t.Fatal("Stop did not find the capture")
+	}
+	if status := s.Status(); status.State != StateDone || status.StopReason != "stopped" {
+		t.Errorf("Unexpected status after stop %+v", status)
+	}
+	if len(m.List()) != 2 {
+		t.Errorf("Expected both captures listed, got %d", len(m.List()))
+	}
+	if !m.Delete(s.Status().ID) || len(m.List()) != 1 {
+		t.Error("Expected the capture to be deleted")
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	useFakeSource(t)
+	m := NewManager(Limits{MaxDuration: time.Minute, MaxBytes: 1 << 20})
+
+	for _, req := range []Request{
+		{Duration: 0},
+		{Duration: 61},
+		{Duration: 10, MaxBytes: 2 << 20},
+		{Duration: 10, MaxBytes: 100},
+		{Duration: 10, Filter: "bogus"},
+	} {
+		if _, err := m.Start(req); err == nil {
+			t.Errorf("Expected %+v to be refused", req)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Packet is the part of an IP packet a filter looks at
+type Packet struct {
+	IPv6     bool
+	Src, Dst netip.Addr
+	Protocol uint8
+	SrcPort  uint16
+	DstPort  uint16
+	HasPorts bool
+}
+
+// IP protocol numbers used by filters
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// ParsePacket decodes the IP and transport headers of a packet that starts
+// at the network layer. It returns false for anything other than IPv4 or
+// IPv6.
+func ParsePacket(b []byte) (Packet, bool) {
+	var p Packet
+	if len(b) < 1 {
+		return p, false
+	}
+
+	var payload []byte
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return p, false
+		}
+		p.Src = netip.AddrFrom4([4]byte(b[12:16]))
+		p.Dst = netip.AddrFrom4([4]byte(b[16:20]))
+		p.Protocol = b[9]
+		// Only the first fragment carries transport ports
+		if binary.BigEndian.Uint16(b[6:])&0x1fff == 0 {
+			payload = b[ihl:]
+		}
+	case 6:
+		if len(b) < 40 {
+			return p, false
+		}
+		p.IPv6 = true
+		p.Src = netip.AddrFrom16([16]byte(b[8:24]))
+		p.Dst = netip.AddrFrom16([16]byte(b[24:40]))
+		next, rest := b[6], b[40:]
+		// Skip hop-by-hop, routing, fragment and destination options headers
+	headers:
+		for {
+			switch next {
+			case 0, 43, 60:
+				if len(rest) < 8 {
+					return p, true
+				}
+				n := (int(rest[1]) + 1) * 8
+				if len(rest) < n {
+					return p, true
+				}
+				next, rest = rest[0], rest[n:]
+				continue
+			case 44:
+				if len(rest) < 8 {
+					return p, true
+				}
+				if binary.BigEndian.Uint16(rest[2:])&0xfff8 != 0 {
+					// Not the first fragment
+					p.Protocol = rest[0]
+					return p, true
+				}
+				next, rest = rest[0], rest[8:]
+				continue
+			}
+			break headers
+		}
+		p.Protocol = next
+		payload = rest
+	default:
+		return p, false
+	}
+
+	if (p.Protocol == protoTCP || p.Protocol == protoUDP) && len(payload) >= 4 {
+		p.SrcPort = binary.BigEndian.Uint16(payload[0:])
+		p.DstPort = binary.BigEndian.Uint16(payload[2:])
+		p.HasPorts = true
+	}
+	return p, true
+}
+
+// Filter selects packets. The zero value and an empty expression match
+// every packet, including non-IP traffic.
+type Filter struct {
+	expr  string
+	match func(*Packet) bool
+}
+
+// String returns the expression the filter was compiled from
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match reports whether a packet starting at the network layer passes the
+// filter
+func (f *Filter) Match(b []byte) bool {
+	if f == nil || f.match == nil {
+		return true
+	}
+	p, ok := ParsePacket(b)
+	return ok && f.match(&p)
+}
+
+// CompileFilter parses a filter expression in a subset of tcpdump syntax:
+//
+//	[src|dst] host ADDR     [src|dst] net CIDR
+//	[src|dst] port N        [src|dst] portrange N-M
+//	tcp  udp  icmp  ip  ip6
+//
+// combined with and (&&), or (||), not (!) and parentheses. Primitives
+// written next to each other are joined with and.
+func CompileFilter(expr string) (*Filter, error) {
+	tokens := tokenize(expr)
+	if len(tokens) == 0 {
+		return &Filter{}, nil
+	}
+	p := &filterParser{tokens: tokens}
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return &Filter{expr: strings.Join(tokens, " "), match: match}, nil
+}
+
+func tokenize(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (func(*Packet) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pkt *Packet) bool { return l(pkt) || right(pkt) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (func(*Packet) bool, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	// Adjacent primitives are joined with and, as in "tcp port 443"
+	for {
+		switch p.peek() {
+		case "and", "&&":
+			p.pos++
+		case "", "or", "||", ")":
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pkt *Packet) bool { return l(pkt) && right(pkt) }
+	}
+}
+
+func (p *filterParser) parseNot() (func(*Packet) bool, error) {
+	if p.peek() == "not" || p.peek() == "!" {
+		p.pos++
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *Packet) bool { return !inner(pkt) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (func(*Packet) bool, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(token) {
+	case "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing, err := p.next(); err != nil || closing != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return inner, nil
+	case "tcp":
+		return func(pkt *Packet) bool { return pkt.Protocol == protoTCP }, nil
+	case "udp":
+		return func(pkt *Packet) bool { return pkt.Protocol == protoUDP }, nil
+	case "icmp":
+		return func(pkt *Packet) bool { return pkt.Protocol == protoICMP || pkt.Protocol == protoICMPv6 }, nil
+	case "ip":
+		return func(pkt *Packet) bool { return !pkt.IPv6 }, nil
+	case "ip6":
+		return func(pkt *Packet) bool { return pkt.IPv6 }, nil
+	case "src", "dst":
+		return p.parseQualifier(strings.ToLower(token))
+	case "host", "net", "port", "portrange":
+		p.pos--
+		return p.parseQualifier("")
+	}
+	return nil, fmt.Errorf("unknown filter primitive %q", token)
+}
+
+// parseQualifier parses host, net, port or portrange after an optional
+// direction
+func (p *filterParser) parseQualifier(dir string) (func(*Packet) bool, error) {
+	kind, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrMatch func(netip.Addr) bool
+	var portMatch func(uint16) bool
+	switch strings.ToLower(kind) {
+	case "host":
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q in filter", value)
+		}
+		addr = addr.Unmap()
+		addrMatch = func(a netip.Addr) bool { return a == addr }
+	case "net":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q in filter", value)
+		}
+		prefix = prefix.Masked()
+		addrMatch = prefix.Contains
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in filter", value)
+		}
+		portMatch = func(p uint16) bool { return p == uint16(port) }
+	case "portrange":
+		lo, hi, ok := strings.Cut(value, "-")
+		low, err1 := strconv.ParseUint(lo, 10, 16)
+		high, err2 := strconv.ParseUint(hi, 10, 16)
+		if !ok || err1 != nil || err2 != nil || low > high {
+			return nil, fmt.Errorf("invalid portrange %q in filter", value)
+		}
+		portMatch = func(p uint16) bool { return uint64(p) >= low && uint64(p) <= high }
+	default:
+		return nil, fmt.Errorf("expected host, net, port or portrange after %s", dir)
+	}
+
+	if addrMatch != nil {
+		return func(pkt *Packet) bool {
+			return (dir != "dst" && addrMatch(pkt.Src)) || (dir != "src" && addrMatch(pkt.Dst))
+		}, nil
+	}
+	return func(pkt *Packet) bool {
+		return pkt.HasPorts && ((dir != "dst" && portMatch(pkt.SrcPort)) || (dir != "src" && portMatch(pkt.DstPort)))
+	}, nil
+}
@@ -0,0 +1,105 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipv4Packet builds a minimal IPv4 packet with a transport header
+func ipv4Packet(src, dst string, proto byte, srcPort, dstPort uint16) []byte {
+	b := make([]byte, 28)
+	b[0] = 0x45
+	b[9] = proto
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(b[12:], s[:])
+	copy(b[16:], d[:])
+	binary.BigEndian.PutUint16(b[20:], srcPort)
+	binary.BigEndian.PutUint16(b[22:], dstPort)
+	return b
+}
+
+// ipv6Packet builds a minimal IPv6 packet, optionally behind a
+// destination options header
+func ipv6Packet(src, dst string, proto byte, srcPort, dstPort uint16, options bool) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x60
+	b[6] = proto
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(b[8:], s[:])
+	copy(b[24:], d[:])
+	if options {
+		b[6] = 60
+		b = append(b, proto, 0, 0, 0, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(srcPort)<<16|uint32(dstPort))
+}
+
+func TestParsePacket(t *testing.T) {
+	p, ok := ParsePacket(ipv6Packet("2001:db8::1", "2001:db8::2", protoTCP, 40000, 443, true))
+	if !ok || !p.IPv6 || p.Protocol != protoTCP || !p.HasPorts || p.SrcPort != 40000 || p.DstPort != 443 {
+		t.Errorf("Unexpected IPv6 parse result %+v", p)
+	}
+
+	fragment := ipv4Packet("192.0.2.1", "192.0.2.2", protoUDP, 53, 53)
+	binary.BigEndian.PutUint16(fragment[6:], 100) // Fragment offset
+	if p, ok := ParsePacket(fragment); !ok || p.HasPorts {
+		t.Errorf("Expected a later fragment to have no ports, got %+v", p)
+	}
+
+	if _, ok := ParsePacket([]byte{0x00, 0x01}); ok {
+		t.Error("Expected a non-IP packet to be rejected")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	web := ipv4Packet("192.0.2.10", "198.51.100.20", protoTCP, 40000, 443)
+	dns := ipv4Packet("192.0.2.10", "198.51.100.53", protoUDP, 50000, 53)
+	web6 := ipv6Packet("2001:db8::1", "2001:db8::2", protoTCP, 40000, 443, false)
+
+	tests := []struct {
+		expr    string
+		matches []bool // web, dns, web6
+	}{
+		{"", []bool{true, true, true}},
+		{"tcp", []bool{true, false, true}},
+		{"udp port 53", []bool{false, true, false}},
+		{"host 192.0.2.10", []bool{true, true, false}},
+		{"src host 198.51.100.20", []bool{false, false, false}},
+		{"dst net 198.51.100.0/24 and not port 53", []bool{true, false, false}},
+		{"ip6 or (udp && dst port 53)", []bool{false, true, true}},
+		{"portrange 400-500", []bool{true, false, true}},
+		{"!tcp", []bool{false, true, false}},
+		{"src port 40000 and ip", []bool{true, false, false}},
+	}
+
+	for _, tt := range tests {
+		filter, err := CompileFilter(tt.expr)
+		if err != nil {
+			t.Errorf("CompileFilter(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		for i, packet := range [][]byte{web, dns, web6} {
+			if got := filter.Match(packet); got != tt.matches[i] {
+				t.Errorf("Filter %q on packet %d = %v, want %v", tt.expr, i, got, tt.matches[i])
+			}
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"host",
+		"host example.com",
+		"port 70000",
+		"portrange 500-400",
+		"(tcp",
+		"tcp and",
+		"src tcp",
+		"ether host 00:11:22:33:44:55",
+	} {
+		if _, err := CompileFilter(expr); err == nil {
+			t.Errorf("Expected CompileFilter(%q) to fail", expr)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetSource reads cooked packets from an AF_PACKET socket
+type packetSource struct {
+	fd int
+}
+
+// openPacketSource opens a capture socket on one interface, or on all of
+// them when iface is empty. It needs CAP_NET_RAW.
+func openPacketSource(iface string) (source, error) {
+	protocol := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture socket: %w", err)
+	}
+
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("unknown interface %s: %w", iface, err)
+		}
+		if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: protocol, Ifindex: ifi.Index}); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to bind capture socket to %s: %w", iface, err)
+		}
+	}
+
+	timeout := unix.NsecToTimeval(int64(250 * 1e6))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set capture socket timeout: %w", err)
+	}
+	return &packetSource{fd: fd}, nil
+}
+
+func (p *packetSource) read(buf []byte) (int, linkInfo, error) {
+	n, from, err := unix.Recvfrom(p.fd, buf, 0)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+		return 0, linkInfo{}, nil
+	}
+	if err != nil {
+		return 0, linkInfo{}, err
+	}
+
+	var info linkInfo
+	if ll, ok := from.(*unix.SockaddrLinklayer); ok {
+		info = linkInfo{
+			pktType:  uint16(ll.Pkttype),
+			haType:   ll.Hatype,
+			addr:     ll.Addr[:min(int(ll.Halen), len(ll.Addr))],
+			protocol: htons(ll.Protocol),
+		}
+	}
+	return min(n, len(buf)), info, nil
+}
+
+func (p *packetSource) close() error {
+	return unix.Close(p.fd)
+}
+
+// htons converts between host and network byte order, as sockaddr_ll
+// fields are kept in network order
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], v)
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package capture
+
+import "fmt"
+
+// openPacketSource is only supported on Linux
+func openPacketSource(iface string) (source, error) {
+	return nil, fmt.Errorf("packet capture is only supported on Linux")
+}
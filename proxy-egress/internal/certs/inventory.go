@@ -0,0 +1,222 @@
+// Package certs keeps an inventory of every certificate the proxy has
+// loaded, so expiry can be monitored in one place whatever component
+// loaded the certificate.
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is what a certificate is used for
+type Role string
+
+const (
+	RoleServer Role = "server" // Presented to clients
+	RoleClient Role = "client" // Presented to upstream servers
+	RoleCA     Role = "ca"     // Trusted to verify peers
+)
+
+// Entry describes one loaded certificate
+type Entry struct {
+	Source      string    `json:"source"` // Component that loaded it, e.g. mtls or quic
+	Role        Role      `json:"role"`
+	Path        string    `json:"path,omitempty"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"fingerprint"` // SHA-256 of the DER encoding
+}
+
+// DaysToExpiry returns the days left until the certificate expires,
+// negative once it has expired
+func (e Entry) DaysToExpiry(now time.Time) float64 {
+	return e.NotAfter.Sub(now).Hours() / 24
+}
+
+// Key identifies the entry in alerts and metrics
+func (e Entry) Key() string {
+	return e.Source + "/" + string(e.Role) + "/" + e.Subject + "/" + e.Serial
+}
+
+// Inventory holds the certificates loaded by the proxy. A certificate
+// loaded again from the same source, role and path replaces the earlier
+// entries, so rotation does not leave stale certificates behind.
+type Inventory struct {
+	entries map[string][]Entry // keyed by source, role and path
+	mutex   sync.RWMutex
+}
+
+// Default is the inventory the proxy's components register their
+// certificates with
+var Default = NewInventory()
+
+// NewInventory creates an empty inventory
+func NewInventory() *Inventory {
+	return &Inventory{entries: make(map[string][]Entry)}
+}
+
+// Add records certificates loaded by source for role, replacing what was
+// recorded for the same source, role and path
+func (i *Inventory) Add(source string, role Role, path string, certificates ...*x509.Certificate) {
+	entries := make([]Entry, 0, len(certificates))
+	for _, cert := range certificates {
+		fingerprint := sha256.Sum256(cert.Raw)
+		entries = append(entries, Entry{
+			Source:      source,
+			Role:        role,
+			Path:        path,
+			Subject:     cert.Subject.String(),
+			Issuer:      cert.Issuer.String(),
+			Serial:      cert.SerialNumber.String(),
+			DNSNames:    cert.DNSNames,
+			NotBefore:   cert.NotBefore,
+			NotAfter:    cert.NotAfter,
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+		})
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.entries[source+"\x00"+string(role)+"\x00"+path] = entries
+}
+
+// AddKeyPair records the leaf of a loaded key pair
+func (i *Inventory) AddKeyPair(source string, role Role, path string, pair *tls.Certificate) error {
+	if pair == nil || len(pair.Certificate) == 0 {
+		return fmt.Errorf("no certificate in key pair from %s", path)
+	}
+
+	leaf := pair.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse certificate from %s: %w", path, err)
+		}
+	}
+
+	i.Add(source, role, path, leaf)
+	return nil
+}
+
+// AddPEM records every certificate in PEM data, such as a CA bundle
+func (i *Inventory) AddPEM(source string, role Role, path string, data []byte) error {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate from %s: %w", path, err)
+		}
+		certificates = append(certificates, cert)
+	}
+
+	if len(certificates) == 0 {
+		return fmt.Errorf("no certificate found in %s", path)
+	}
+
+	i.Add(source, role, path, certificates...)
+	return nil
+}
+
+// AddPEMFile reads a PEM file and records every certificate in it
+func (i *Inventory) AddPEMFile(source string, role Role, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return i.AddPEM(source, role, path, data)
+}
+
+// Entries returns every recorded certificate, soonest expiry first
+func (i *Inventory) Entries() []Entry {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var result []Entry
+	for _, entries := range i.entries {
+		result = append(result, entries...)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if !result[a].NotAfter.Equal(result[b].NotAfter) {
+			return result[a].NotAfter.Before(result[b].NotAfter)
+		}
+		return result[a].Key() < result[b].Key()
+	})
+	return result
+}
+
+// Expiring returns the certificates that expire within window of now,
+// including those already expired
+func (i *Inventory) Expiring(now time.Time, window time.Duration) []Entry {
+	var result []Entry
+	for _, entry := range i.Entries() {
+		if entry.NotAfter.Sub(now) < window {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// Unique returns every recorded certificate once, even when it was loaded
+// from several paths, soonest expiry first
+func (i *Inventory) Unique() []Entry {
+	seen := make(map[string]bool)
+	var result []Entry
+	for _, entry := range i.Entries() {
+		if !seen[entry.Key()] {
+			seen[entry.Key()] = true
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// WritePrometheus writes days to expiry and the expiry time of every
+// certificate in Prometheus text format
+func (i *Inventory) WritePrometheus(w io.Writer, module string) {
+	entries := i.Unique()
+	now := time.Now()
+
+	labels := func(e Entry) string {
+		return fmt.Sprintf(`module="%s",source="%s",role="%s",subject="%s",serial="%s"`,
+			module, escapeLabel(e.Source), e.Role, escapeLabel(e.Subject), e.Serial)
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_certificate_days_to_expiry Days until a loaded certificate expires\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_certificate_days_to_expiry gauge\n")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "marchproxy_certificate_days_to_expiry{%s} %.3f\n", labels(entry), entry.DaysToExpiry(now))
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_certificate_not_after_timestamp_seconds Expiry time of a loaded certificate\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_certificate_not_after_timestamp_seconds gauge\n")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "marchproxy_certificate_not_after_timestamp_seconds{%s} %d\n", labels(entry), entry.NotAfter.Unix())
+	}
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,107 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertPEM(t *testing.T, cn string, serial int64, notAfter time.Time) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestInventoryExpiring(t *testing.T) {
+	now := time.Now()
+	inventory := NewInventory()
+
+	bundle := append(testCertPEM(t, "ca-one", 1, now.Add(400*24*time.Hour)), testCertPEM(t, "ca-two", 2, now.Add(5*24*time.Hour))...)
+	if err := inventory.AddPEM("mtls", RoleCA, "/etc/ca.pem", bundle); err != nil {
+		t.Fatalf("AddPEM failed: %v", err)
+	}
+	if err := inventory.AddPEM("tls", RoleServer, "/etc/server.pem", testCertPEM(t, "server", 3, now.Add(-time.Hour))); err != nil {
+		t.Fatalf("AddPEM failed: %v", err)
+	}
+
+	entries := inventory.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 certificates, got %d", len(entries))
+	}
+	if entries[0].Subject != "CN=server" || entries[0].DaysToExpiry(now) >= 0 {
+		t.Errorf("Expected the expired server certificate first, got %s (%.1f days)", entries[0].Subject, entries[0].DaysToExpiry(now))
+	}
+
+	expiring := inventory.Expiring(now, 30*24*time.Hour)
+	if len(expiring) != 2 {
+		t.Fatalf("Expected 2 certificates expiring within 30 days, got %d", len(expiring))
+	}
+	if expiring[1].Subject != "CN=ca-two" || expiring[1].Role != RoleCA {
+		t.Errorf("Expected ca-two to be expiring, got %s", expiring[1].Subject)
+	}
+}
+
+func TestInventoryReplacesReloadedCertificates(t *testing.T) {
+	now := time.Now()
+	inventory := NewInventory()
+
+	if err := inventory.AddPEM("tls", RoleServer, "/etc/server.pem", testCertPEM(t, "server", 1, now.Add(24*time.Hour))); err != nil {
+		t.Fatalf("AddPEM failed: %v", err)
+	}
+	if err := inventory.AddPEM("tls", RoleServer, "/etc/server.pem", testCertPEM(t, "server", 2, now.Add(90*24*time.Hour))); err != nil {
+		t.Fatalf("AddPEM failed: %v", err)
+	}
+
+	entries := inventory.Entries()
+	if len(entries) != 1 || entries[0].Serial != "2" {
+		t.Fatalf("Expected only the rotated certificate, got %+v", entries)
+	}
+}
+
+func TestInventoryWritePrometheus(t *testing.T) {
+	inventory := NewInventory()
+	if err := inventory.AddPEM("quic", RoleServer, "/etc/quic.pem", testCertPEM(t, "quic", 7, time.Now().Add(10*24*time.Hour+12*time.Hour))); err != nil {
+		t.Fatalf("AddPEM failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	inventory.WritePrometheus(&out, "egress")
+
+	for _, want := range []string{
+		"# TYPE marchproxy_certificate_days_to_expiry gauge",
+		`marchproxy_certificate_days_to_expiry{module="egress",source="quic",role="server",subject="CN=quic",serial="7"} 10.`,
+		`marchproxy_certificate_not_after_timestamp_seconds{module="egress",source="quic",role="server",subject="CN=quic",serial="7"}`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in output:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestAddPEMRejectsEmptyData(t *testing.T) {
+	if err := NewInventory().AddPEM("mtls", RoleCA, "/etc/empty.pem", []byte("not a certificate")); err == nil {
+		t.Error("Expected an error for data without certificates")
+	}
+}
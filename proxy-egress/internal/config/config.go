@@ -3,9 +3,21 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"marchproxy-egress/internal/bufpool"
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/tlsinspect"
+	"marchproxy-egress/internal/upstreamproxy"
+	"marchproxy-egress/internal/waf"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/netutil"
+	"marchproxy-shared/schedule"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -16,12 +28,26 @@ type Config struct {
 	// Manager connection
 	ManagerURL     string `mapstructure:"manager_url"`
 	ClusterAPIKey  string `mapstructure:"cluster_api_key"`
+
+	// Local cluster config file (YAML or JSON) used instead of the manager,
+	// for tests and demos
+	StandaloneConfig string `mapstructure:"standalone_config"`
 	
 	// Proxy server settings
 	ProxyName      string `mapstructure:"proxy_name"`
 	Hostname       string `mapstructure:"hostname"`
 	ListenPort     int    `mapstructure:"listen_port"`
 	AdminPort      int    `mapstructure:"admin_port"`
+	BindAddress    string `mapstructure:"bind_address"`   // IP to bind proxy listeners to, empty = all
+	BindInterface  string `mapstructure:"bind_interface"` // Interface or VRF device (Linux SO_BINDTODEVICE)
+
+	// Serve the TCP proxy on a unix socket instead of listen_port, for
+	// sidecars. UDP stays on its port.
+	ListenSocket     string `mapstructure:"listen_socket"`
+	ListenSocketMode string `mapstructure:"listen_socket_mode"` // Octal permissions, 0660 when empty
+
+	// Admin server authentication, TLS and binding
+	Admin adminserver.Config `mapstructure:"admin"`
 	
 	// Logging configuration
 	LogLevel       string `mapstructure:"log_level"`
@@ -31,6 +57,10 @@ type Config struct {
 	EnableEBPF     bool `mapstructure:"enable_ebpf"`
 	EnableMetrics  bool `mapstructure:"enable_metrics"`
 	WorkerThreads  int  `mapstructure:"worker_threads"`
+	ReusePort      bool `mapstructure:"reuse_port"` // One SO_REUSEPORT socket per acceptor, off by default
+	Acceptors      int  `mapstructure:"acceptors"`  // Accept loops per TCP listener, 0 = one per CPU
+	RelayBufferSize int `mapstructure:"relay_buffer_size"` // bytes per TCP relay direction
+	UDPBufferSize   int `mapstructure:"udp_buffer_size"`   // bytes per UDP datagram
 	
 	// Network acceleration (optional)
 	EnableDPDK     bool   `mapstructure:"enable_dpdk"`
@@ -53,18 +83,228 @@ type Config struct {
 	MTLSRequireClientCert bool  `mapstructure:"mtls_require_client_cert"`
 	MTLSVerifyClientCert  bool  `mapstructure:"mtls_verify_client_cert"`
 	
+	// Client certificate revocation checking
+	MTLSOCSPEnabled        bool     `mapstructure:"mtls_ocsp_enabled"`         // Ask the client certificate's OCSP responder
+	MTLSOCSPStapling       bool     `mapstructure:"mtls_ocsp_stapling"`        // Staple OCSP responses to the server certificate
+	MTLSOCSPTimeout        int      `mapstructure:"mtls_ocsp_timeout"`         // seconds, for OCSP and CRL fetches
+	MTLSCRLEnabled         bool     `mapstructure:"mtls_crl_enabled"`          // Check CRLs from distribution points and sources
+	MTLSCRLSources         []string `mapstructure:"mtls_crl_sources"`          // Additional CRL URLs or file paths
+	MTLSCRLRefreshInterval int      `mapstructure:"mtls_crl_refresh_interval"` // seconds
+	MTLSRevocationFailOpen bool     `mapstructure:"mtls_revocation_fail_open"` // Accept certificates whose status is unknown
+
+	// Certificates issued by the manager's cluster CA instead of files on disk
+	MTLSAutoIssue        bool     `mapstructure:"mtls_auto_issue"`
+	MTLSIssueTTL         int      `mapstructure:"mtls_issue_ttl"`          // seconds, requested certificate lifetime
+	MTLSIssueRenewBefore int      `mapstructure:"mtls_issue_renew_before"` // seconds before expiry, 0 = a third of the lifetime
+	MTLSIssueDNSNames    []string `mapstructure:"mtls_issue_dns_names"`    // Extra SANs, the hostname is always included
+
+	// JA3/JA4 fingerprints of TLS clients, tracked for metrics up to this many
+	TLSFingerprintMaxTracked int `mapstructure:"tls_fingerprint_max_tracked"`
+
+	// MaxMind DB (mmdb) file for client country lookups
+	GeoIPDatabase string `mapstructure:"geoip_database"`
+
+	// Flow mirroring to an IDS or capture target, for mappings with mirror
+	// set and a sample of all other flows
+	MirrorMode          string  `mapstructure:"mirror_mode"`           // "" (off), file, gre, erspan
+	MirrorTarget        string  `mapstructure:"mirror_target"`         // Collector IP for gre and erspan
+	MirrorERSPANSession int     `mapstructure:"mirror_erspan_session"` // 1-1023
+	MirrorDir           string  `mapstructure:"mirror_dir"`            // pcap ring directory for file
+	MirrorFileSize      int     `mapstructure:"mirror_file_size"`      // MB per pcap file
+	MirrorFileCount     int     `mapstructure:"mirror_file_count"`     // pcap files kept
+	MirrorSampleRate    float64 `mapstructure:"mirror_sample_rate"`    // 0-1, fraction of other flows mirrored
+
+	// On-demand packet capture through /admin/capture
+	CaptureEnabled     bool `mapstructure:"capture_enabled"`
+	CaptureMaxDuration int  `mapstructure:"capture_max_duration"` // seconds
+	CaptureMaxBytes    int  `mapstructure:"capture_max_bytes"`    // MB per capture
+
+	// Apply mapping fault specs and accept /admin/faults overrides
+	FaultInjectionEnabled bool `mapstructure:"fault_injection_enabled"`
+
+	// Periodic self-monitoring of goroutines, heap and file descriptors
+	SelfMonitorInterval   int     `mapstructure:"self_monitor_interval"`   // seconds, 0 disables
+	SelfMonitorGoroutines int     `mapstructure:"self_monitor_goroutines"` // warn above, 0 disables
+	SelfMonitorHeapMB     int     `mapstructure:"self_monitor_heap_mb"`    // warn above, 0 disables
+	SelfMonitorFDPercent  float64 `mapstructure:"self_monitor_fd_percent"` // warn above this share of the FD limit, 0 disables
+
+	// Usage metering per tenant and service for chargeback
+	MeteringInterval int    `mapstructure:"metering_interval"` // seconds per usage record, 0 disables
+	MeteringUpload   bool   `mapstructure:"metering_upload"`   // upload records to the manager
+	MeteringCSVDir   string `mapstructure:"metering_csv_dir"`  // also append records to daily CSV files here
+	
+	// DNS proxy enforcing the domain lists of each client service's mappings
+	DNSEnabled         bool     `mapstructure:"dns_enabled"`
+	DNSPort            int      `mapstructure:"dns_port"`             // UDP and TCP, on bind_address
+	DNSUpstreams       []string `mapstructure:"dns_upstreams"`        // host[:port], tcp://, tls:// (DoT) or https:// (DoH), tried in order
+	DNSUpstreamTimeout int      `mapstructure:"dns_upstream_timeout"` // seconds
+	DNSCacheSize       int      `mapstructure:"dns_cache_size"`       // answers, 0 disables the cache
+	DNSCacheMaxTTL     int      `mapstructure:"dns_cache_max_ttl"`    // seconds an answer is cached at most
+	DNSBlockResponse   string   `mapstructure:"dns_block_response"`   // nxdomain or refused
+	DNSAllowUnknown    bool     `mapstructure:"dns_allow_unknown"`    // resolve any domain for clients of no known service
+	DNSQueryLog        string   `mapstructure:"dns_query_log"`        // JSON lines file, "stdout", or empty to disable
+	
+	// SMTP relay enforcing the mail policies of each client service's mappings
+	SMTPEnabled        bool   `mapstructure:"smtp_enabled"`
+	SMTPPort           int    `mapstructure:"smtp_port"`             // STARTTLS when tls_cert_path and tls_key_path load
+	SMTPSPort          int    `mapstructure:"smtps_port"`            // implicit TLS, 0 disables
+	SMTPHostname       string `mapstructure:"smtp_hostname"`         // announced to clients and relays, hostname when empty
+	SMTPRequireAuth    bool   `mapstructure:"smtp_require_auth"`     // identify clients only by SMTP AUTH with service ID and token
+	SMTPMaxMessageSize int    `mapstructure:"smtp_max_message_size"` // bytes
+	SMTPTimeout        int    `mapstructure:"smtp_timeout"`          // seconds per command and per relay delivery
+	SMTPLog            string `mapstructure:"smtp_log"`              // JSON lines envelope log file, "stdout", or empty to disable
+
+	// SOCKS5 listener for applications that can't speak the MARCHPROXY_AUTH
+	// handshake, authorized against each client service's mappings
+	SOCKSEnabled        bool `mapstructure:"socks_enabled"`
+	SOCKSPort           int  `mapstructure:"socks_port"`
+	SOCKSRequireAuth    bool `mapstructure:"socks_require_auth"`     // identify clients only by username (service ID or name) and password (token)
+	SOCKSTimeout        int  `mapstructure:"socks_timeout"`          // seconds for the handshake and the outbound dial
+	SOCKSUDPIdleTimeout int  `mapstructure:"socks_udp_idle_timeout"` // seconds without datagrams before a UDP association ends
+
+	// Multiplexed listener: clients authenticate a transport connection once
+	// and open HTTP/2 CONNECT streams over it for their connections
+	MuxEnabled     bool `mapstructure:"mux_enabled"`
+	MuxPort        int  `mapstructure:"mux_port"`
+	MuxMaxStreams  int  `mapstructure:"mux_max_streams"`  // concurrent streams per transport connection
+	MuxIdleTimeout int  `mapstructure:"mux_idle_timeout"` // seconds without open streams before a transport connection is closed
+
+	// ICMP echo relay: clients ping the proxy and the mapping serving icmp
+	// pings its destination service. Needs CAP_NET_RAW.
+	ICMPEnabled   bool `mapstructure:"icmp_enabled"`
+	ICMPRateLimit int  `mapstructure:"icmp_rate_limit"` // echo requests per second per mapping, 0 for no limit
+	ICMPTimeout   int  `mapstructure:"icmp_timeout"`    // seconds without echoes before a ping's destination socket closes
+	ICMPMaxFlows  int  `mapstructure:"icmp_max_flows"`  // pings relayed at once
+	
 	// License configuration
 	LicenseKey     string `mapstructure:"license_key"`
+
+	// Enterprise feature entitlements fetched from the manager
+	LicenseRefreshInterval int    `mapstructure:"license_refresh_interval"` // seconds
+	LicenseGracePeriod     int    `mapstructure:"license_grace_period"`     // seconds cached entitlements outlive an unreachable manager
+	LicenseCacheFile       string `mapstructure:"license_cache_file"`       // keep entitlements here across restarts
 	
 	// Timeouts and intervals
 	ConfigUpdateInterval int `mapstructure:"config_update_interval"` // seconds
 	HeartbeatInterval    int `mapstructure:"heartbeat_interval"`     // seconds
 	ConnectionTimeout    int `mapstructure:"connection_timeout"`     // seconds
+	UDPSessionTimeout    int `mapstructure:"udp_session_timeout"`    // seconds
+	UDPFlowIdleTimeout   int `mapstructure:"udp_flow_idle_timeout"`  // seconds without datagrams before a client's destination socket is closed
+	UDPMaxFlows          int `mapstructure:"udp_max_flows"`          // open destination sockets per UDP listener, 0 = no limit
+	IdleTimeout          int `mapstructure:"idle_timeout"`           // seconds without TCP relay traffic, 0 = no limit
+	DrainTimeout         int `mapstructure:"drain_timeout"`          // seconds to let connections finish on shutdown, 0 = wait indefinitely
+
+	// UDP session handoff to a replacement instance during planned maintenance
+	HandoffFile   string `mapstructure:"handoff_file"`   // write sessions here on shutdown and restore them from here at startup
+	HandoffSource string `mapstructure:"handoff_source"` // restore from this file or /admin/handoff URL of the instance being replaced instead
+
+	// Listener handover to a new binary for hitless upgrades
+	UpgradeSocket  string `mapstructure:"upgrade_socket"`  // Unix socket listeners are handed over on, empty disables
+	UpgradeTimeout int    `mapstructure:"upgrade_timeout"` // seconds for the new binary to take over
+	
+	// Outbound dialing
+	DialTimeout             int      `mapstructure:"dial_timeout"`              // seconds
+	DialRetries             int      `mapstructure:"dial_retries"`
+	DialRetryBackoff        int      `mapstructure:"dial_retry_backoff"`        // milliseconds
+	HappyEyeballsDelay      int      `mapstructure:"happy_eyeballs_delay"`      // milliseconds, negative disables
+	OutboundIPFamily        string   `mapstructure:"outbound_ip_family"`        // any, ipv4, ipv6
+	OutboundSourceAddresses []string `mapstructure:"outbound_source_addresses"` // Source IPs, round-robin
+	OutboundInterface       string   `mapstructure:"outbound_interface"`        // Interface or VRF device (Linux only)
+	EnableMPTCP             bool     `mapstructure:"enable_mptcp"`              // Multipath TCP listeners and dialers (Linux 5.15+)
+
+	// Resolver for destination host names, enforcing the cluster's egress
+	// DNS policy; the system resolver answers when no upstreams are set
+	ResolverUpstreams   []string `mapstructure:"resolver_upstreams"`     // host[:port], tcp://, tls:// (DoT) or https:// (DoH), tried in order
+	ResolverTimeout     int      `mapstructure:"resolver_timeout"`       // seconds per upstream exchange
+	ResolverCacheSize   int      `mapstructure:"resolver_cache_size"`    // answers, 0 disables the cache
+	ResolverCacheMaxTTL int      `mapstructure:"resolver_cache_max_ttl"` // seconds an answer is cached at most
+
+	// Upstream proxies mappings can be chained through, as http://,
+	// https:// or socks5:// URLs with optional credentials and a name=
+	UpstreamProxies       []string `mapstructure:"upstream_proxies"`
+	UpstreamProxyTimeout  int      `mapstructure:"upstream_proxy_timeout"`  // seconds for the CONNECT or SOCKS5 handshake
+	UpstreamProxyCooldown int      `mapstructure:"upstream_proxy_cooldown"` // seconds an unreachable upstream is tried last
+	UpstreamProxyTLSCA    string   `mapstructure:"upstream_proxy_tls_ca"`   // CA of https:// upstreams, system roots when empty
+
+	// Warm destination connections dialed ahead of demand, per mapping and
+	// destination; mappings override the size with pool_max_idle
+	UpstreamPoolMaxIdle     int  `mapstructure:"upstream_pool_max_idle"`     // 0 disables pooling
+	UpstreamPoolIdleTimeout int  `mapstructure:"upstream_pool_idle_timeout"` // seconds before an idle connection is closed
+	UpstreamPoolHealthCheck bool `mapstructure:"upstream_pool_health_check"` // Evict idle connections the destination closes
+	
+	// TCP socket tuning, applied to client and destination connections
+	TCPNoDelay           bool `mapstructure:"tcp_nodelay"`
+	TCPKeepAlive         int  `mapstructure:"tcp_keepalive"`          // seconds idle before probing, negative disables
+	TCPKeepAliveInterval int  `mapstructure:"tcp_keepalive_interval"` // seconds between probes, 0 = kernel default
+	TCPKeepAliveCount    int  `mapstructure:"tcp_keepalive_count"`    // probes before drop, 0 = kernel default
+	TCPSendBuffer        int  `mapstructure:"tcp_send_buffer"`        // bytes, 0 = kernel default
+	TCPRecvBuffer        int  `mapstructure:"tcp_recv_buffer"`        // bytes, 0 = kernel default
+	TCPUserTimeout       int  `mapstructure:"tcp_user_timeout"`       // milliseconds, 0 = kernel default (Linux only)
 	
 	// Rate limiting
 	RateLimitEnabled bool `mapstructure:"rate_limit_enabled"`
 	RateLimitRPS     int  `mapstructure:"rate_limit_rps"`
 
+	// Authentication attempts per client IP
+	AuthRateLimit   float64 `mapstructure:"auth_rate_limit"`   // attempts per second, 0 = unlimited
+	AuthBurst       int     `mapstructure:"auth_burst"`        // attempts at once
+	AuthMaxFailures int     `mapstructure:"auth_max_failures"` // consecutive failures before a lockout, 0 = never
+	AuthLockout     int     `mapstructure:"auth_lockout"`      // seconds, doubled for each repeated lockout
+	AuthMaxLockout  int     `mapstructure:"auth_max_lockout"`  // seconds
+
+	// Clock skew tolerated at the edges of mapping schedules, in seconds
+	ScheduleClockSkew int `mapstructure:"schedule_clock_skew"`
+
+	// Quarantine of source services flagged repeatedly by the WAF or anomaly
+	// detection: flags within the window that quarantine a service, 0 = off
+	QuarantineThreshold int `mapstructure:"quarantine_threshold"`
+	QuarantineWindow    int `mapstructure:"quarantine_window"` // Seconds
+
+	// TLS interception for mappings with tls_inspection enabled, an
+	// enterprise feature; clients must trust the CA
+	TLSInspectionCACert   string   `mapstructure:"tls_inspection_ca_cert"`
+	TLSInspectionCAKey    string   `mapstructure:"tls_inspection_ca_key"`
+	TLSInspectionCertTTL  int      `mapstructure:"tls_inspection_cert_ttl"`  // seconds per minted certificate
+	TLSInspectionExclude  []string `mapstructure:"tls_inspection_exclude"`   // Server names never intercepted on any mapping
+	TLSInspectionAuditLog string   `mapstructure:"tls_inspection_audit_log"` // JSON lines file, "stdout", or empty to disable
+
+	// SSH awareness for mappings with an ssh policy; full recording
+	// terminates SSH with the host key
+	SSHHostKey      string `mapstructure:"ssh_host_key"`
+	SSHUpstreamKey  string `mapstructure:"ssh_upstream_key"`  // Logs clients with authorized keys in at the destination
+	SSHKnownHosts   string `mapstructure:"ssh_known_hosts"`   // Destination host keys, required with ssh_host_key
+	SSHRecordingDir string `mapstructure:"ssh_recording_dir"` // asciicast files, one directory per day
+
+	// Hash-chained audit log in the format of the L3/L4 proxy's zero-trust
+	// audit logger, empty disables it
+	AuditLogPath string `mapstructure:"audit_log_path"`
+
+	// Remote SIEM sinks of security events, as udp://, tcp:// or tls://
+	// URLs with an optional format=cef
+	SecurityLogSinks []string `mapstructure:"security_log_sinks"`
+	SecurityLogTLSCA string   `mapstructure:"security_log_tls_ca"` // CA of tls:// collectors, system roots when empty
+
+	// Archival of rotated audit, DNS query and TLS inspection logs to
+	// S3-compatible object storage, enabled by the bucket
+	LogArchiveBucket        string   `mapstructure:"log_archive_bucket"`
+	LogArchiveEndpoint      string   `mapstructure:"log_archive_endpoint"` // AWS S3 of the region when empty
+	LogArchiveRegion        string   `mapstructure:"log_archive_region"`
+	LogArchivePrefix        string   `mapstructure:"log_archive_prefix"`
+	LogArchiveAccessKey     string   `mapstructure:"log_archive_access_key"`
+	LogArchiveSecretKey     string   `mapstructure:"log_archive_secret_key"`
+	LogArchiveSessionToken  string   `mapstructure:"log_archive_session_token"`
+	LogArchivePathStyle     bool     `mapstructure:"log_archive_path_style"`     // For MinIO and most other stores
+	LogArchiveSSE           string   `mapstructure:"log_archive_sse"`            // AES256, aws:kms, or empty for the bucket default
+	LogArchiveKMSKeyID      string   `mapstructure:"log_archive_kms_key_id"`     // With aws:kms
+	LogArchiveInterval      int      `mapstructure:"log_archive_interval"`       // Seconds between sweeps
+	LogArchiveRetentionDays int      `mapstructure:"log_archive_retention_days"` // 0 keeps archived logs
+	LogArchivePaths         []string `mapstructure:"log_archive_paths"`          // Other logs whose rotated files are archived
+
+	// Read-only SNMPv2c agent serving MARCHPROXY-MIB, for monitoring
+	// without Prometheus; the listen address (UDP) enables it
+	SNMPListen    string `mapstructure:"snmp_listen"`
+	SNMPCommunity string `mapstructure:"snmp_community"`
+
 	// KillKrill integration
 	KillKrillEnabled         bool   `mapstructure:"killkrill_enabled"`
 	KillKrillLogEndpoint     string `mapstructure:"killkrill_log_endpoint"`
@@ -79,36 +319,33 @@ type Config struct {
 	KillKrillTLSInsecure     bool   `mapstructure:"killkrill_tls_insecure"`
 }
 
-// Load creates a new configuration from command line flags, environment variables, and config file
+// Load creates a new configuration from defaults, the config file,
+// MARCHPROXY_* environment variables and command line flags, each
+// overriding the one before
 func Load(cmd *cobra.Command) (*Config, error) {
-	v := viper.New()
+	l := layers.New("MARCHPROXY")
 	
 	// Set defaults
-	setDefaults(v)
+	setDefaults(l.Viper())
 	
 	// Bind command line flags
-	if err := bindFlags(v, cmd); err != nil {
+	if err := bindFlags(l, cmd); err != nil {
 		return nil, fmt.Errorf("failed to bind flags: %w", err)
 	}
-	
-	// Set up environment variable handling
-	v.SetEnvPrefix("MARCHPROXY")
-	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	v.AutomaticEnv()
+	if err := l.ApplySet(cmd.Flags()); err != nil {
+		return nil, err
+	}
 	
 	// Load config file if specified
 	configFile, _ := cmd.Flags().GetString("config")
-	if configFile != "" {
-		v.SetConfigFile(configFile)
-		if err := v.ReadInConfig(); err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
-		}
+	if err := l.ReadFile(configFile); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 	
 	// Unmarshal into config struct
 	var config Config
-	if err := v.Unmarshal(&config); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	if err := l.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 	
 	// Validate and set derived values
@@ -123,12 +360,15 @@ func setDefaults(v *viper.Viper) {
 	// Manager connection
 	v.SetDefault("manager_url", os.Getenv("MANAGER_URL"))
 	v.SetDefault("cluster_api_key", os.Getenv("CLUSTER_API_KEY"))
+	v.SetDefault("standalone_config", os.Getenv("STANDALONE_CONFIG"))
 	
 	// Proxy settings
 	v.SetDefault("proxy_name", getHostname())
 	v.SetDefault("hostname", getHostname())
 	v.SetDefault("listen_port", 8080)
 	v.SetDefault("admin_port", 8081)
+	v.SetDefault("bind_address", os.Getenv("BIND_ADDRESS"))
+	v.SetDefault("bind_interface", os.Getenv("BIND_INTERFACE"))
 	
 	// Logging
 	v.SetDefault("log_level", "INFO")
@@ -138,6 +378,10 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("enable_ebpf", true)
 	v.SetDefault("enable_metrics", true)
 	v.SetDefault("worker_threads", 0) // 0 = auto-detect based on CPU cores
+	v.SetDefault("reuse_port", false) // opt-in: a second instance would silently share the port
+	v.SetDefault("acceptors", 0)      // 0 = one per CPU core
+	v.SetDefault("relay_buffer_size", 32*1024)
+	v.SetDefault("udp_buffer_size", 4096)
 	
 	// Network acceleration (disabled by default)
 	v.SetDefault("enable_dpdk", false)
@@ -159,18 +403,156 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("mtls_client_key_path", os.Getenv("MTLS_CLIENT_KEY_PATH"))
 	v.SetDefault("mtls_require_client_cert", getBoolEnv("MTLS_REQUIRE_CLIENT_CERT", true))
 	v.SetDefault("mtls_verify_client_cert", getBoolEnv("MTLS_VERIFY_CLIENT_CERT", true))
+	v.SetDefault("mtls_ocsp_enabled", getBoolEnv("MTLS_OCSP_ENABLED", false))
+	v.SetDefault("mtls_ocsp_stapling", getBoolEnv("MTLS_OCSP_STAPLING", false))
+	v.SetDefault("mtls_ocsp_timeout", getIntEnv("MTLS_OCSP_TIMEOUT", 5))
+	v.SetDefault("mtls_crl_enabled", getBoolEnv("MTLS_CRL_ENABLED", false))
+	v.SetDefault("mtls_crl_sources", []string{})
+	v.SetDefault("mtls_crl_refresh_interval", getIntEnv("MTLS_CRL_REFRESH_INTERVAL", 3600))
+	v.SetDefault("mtls_revocation_fail_open", getBoolEnv("MTLS_REVOCATION_FAIL_OPEN", false))
+	v.SetDefault("mtls_auto_issue", getBoolEnv("MTLS_AUTO_ISSUE", false))
+	v.SetDefault("mtls_issue_ttl", getIntEnv("MTLS_ISSUE_TTL", 86400))
+	v.SetDefault("mtls_issue_renew_before", getIntEnv("MTLS_ISSUE_RENEW_BEFORE", 0))
+	v.SetDefault("mtls_issue_dns_names", []string{})
+	v.SetDefault("tls_fingerprint_max_tracked", getIntEnv("TLS_FINGERPRINT_MAX_TRACKED", 1000))
+	v.SetDefault("geoip_database", os.Getenv("GEOIP_DATABASE"))
+	v.SetDefault("mirror_mode", os.Getenv("MIRROR_MODE"))
+	v.SetDefault("mirror_target", os.Getenv("MIRROR_TARGET"))
+	v.SetDefault("mirror_erspan_session", getIntEnv("MIRROR_ERSPAN_SESSION", 1))
+	v.SetDefault("mirror_dir", getEnvOrDefault("MIRROR_DIR", "/var/lib/marchproxy/mirror"))
+	v.SetDefault("mirror_file_size", getIntEnv("MIRROR_FILE_SIZE", 100))
+	v.SetDefault("mirror_file_count", getIntEnv("MIRROR_FILE_COUNT", 10))
+	v.SetDefault("mirror_sample_rate", getFloatEnv("MIRROR_SAMPLE_RATE", 0))
+	v.SetDefault("capture_enabled", getBoolEnv("CAPTURE_ENABLED", false))
+	v.SetDefault("capture_max_duration", getIntEnv("CAPTURE_MAX_DURATION", 300))
+	v.SetDefault("capture_max_bytes", getIntEnv("CAPTURE_MAX_BYTES", 64))
+	v.SetDefault("fault_injection_enabled", getBoolEnv("FAULT_INJECTION_ENABLED", false))
+	v.SetDefault("self_monitor_interval", getIntEnv("SELF_MONITOR_INTERVAL", 30))
+	v.SetDefault("self_monitor_goroutines", getIntEnv("SELF_MONITOR_GOROUTINES", 0))
+	v.SetDefault("self_monitor_heap_mb", getIntEnv("SELF_MONITOR_HEAP_MB", 0))
+	v.SetDefault("self_monitor_fd_percent", getFloatEnv("SELF_MONITOR_FD_PERCENT", 80))
+	v.SetDefault("metering_interval", getIntEnv("METERING_INTERVAL", 300))
+	v.SetDefault("metering_upload", getBoolEnv("METERING_UPLOAD", true))
+	v.SetDefault("metering_csv_dir", os.Getenv("METERING_CSV_DIR"))
+	v.SetDefault("dns_enabled", getBoolEnv("DNS_ENABLED", false))
+	v.SetDefault("dns_port", getIntEnv("DNS_PORT", 53))
+	v.SetDefault("dns_upstreams", getListEnv("DNS_UPSTREAMS"))
+	v.SetDefault("dns_upstream_timeout", getIntEnv("DNS_UPSTREAM_TIMEOUT", 5))
+	v.SetDefault("dns_cache_size", getIntEnv("DNS_CACHE_SIZE", 10000))
+	v.SetDefault("dns_cache_max_ttl", getIntEnv("DNS_CACHE_MAX_TTL", 300))
+	v.SetDefault("dns_block_response", getEnvOrDefault("DNS_BLOCK_RESPONSE", "nxdomain"))
+	v.SetDefault("dns_allow_unknown", getBoolEnv("DNS_ALLOW_UNKNOWN", false))
+	v.SetDefault("dns_query_log", os.Getenv("DNS_QUERY_LOG"))
+	v.SetDefault("smtp_enabled", getBoolEnv("SMTP_ENABLED", false))
+	v.SetDefault("smtp_port", getIntEnv("SMTP_PORT", 2525))
+	v.SetDefault("smtps_port", getIntEnv("SMTPS_PORT", 0))
+	v.SetDefault("smtp_hostname", os.Getenv("SMTP_HOSTNAME"))
+	v.SetDefault("smtp_require_auth", getBoolEnv("SMTP_REQUIRE_AUTH", false))
+	v.SetDefault("smtp_max_message_size", getIntEnv("SMTP_MAX_MESSAGE_SIZE", 10485760))
+	v.SetDefault("smtp_timeout", getIntEnv("SMTP_TIMEOUT", 300))
+	v.SetDefault("smtp_log", os.Getenv("SMTP_LOG"))
+	v.SetDefault("socks_enabled", getBoolEnv("SOCKS_ENABLED", false))
+	v.SetDefault("socks_port", getIntEnv("SOCKS_PORT", 1080))
+	v.SetDefault("socks_require_auth", getBoolEnv("SOCKS_REQUIRE_AUTH", true))
+	v.SetDefault("socks_timeout", getIntEnv("SOCKS_TIMEOUT", 10))
+	v.SetDefault("socks_udp_idle_timeout", getIntEnv("SOCKS_UDP_IDLE_TIMEOUT", 60))
+	v.SetDefault("mux_enabled", getBoolEnv("MUX_ENABLED", false))
+	v.SetDefault("mux_port", getIntEnv("MUX_PORT", 8082))
+	v.SetDefault("mux_max_streams", getIntEnv("MUX_MAX_STREAMS", 1000))
+	v.SetDefault("mux_idle_timeout", getIntEnv("MUX_IDLE_TIMEOUT", 300))
+	v.SetDefault("icmp_enabled", getBoolEnv("ICMP_ENABLED", false))
+	v.SetDefault("icmp_rate_limit", getIntEnv("ICMP_RATE_LIMIT", 10))
+	v.SetDefault("icmp_timeout", getIntEnv("ICMP_TIMEOUT", 30))
+	v.SetDefault("icmp_max_flows", getIntEnv("ICMP_MAX_FLOWS", 1024))
 	
 	// License
 	v.SetDefault("license_key", os.Getenv("LICENSE_KEY"))
+	v.SetDefault("license_refresh_interval", getIntEnv("LICENSE_REFRESH_INTERVAL", 300))
+	v.SetDefault("license_grace_period", getIntEnv("LICENSE_GRACE_PERIOD", 259200))
+	v.SetDefault("license_cache_file", os.Getenv("LICENSE_CACHE_FILE"))
 	
 	// Intervals and timeouts
 	v.SetDefault("config_update_interval", 60) // 60 seconds
 	v.SetDefault("heartbeat_interval", 30)     // 30 seconds
 	v.SetDefault("connection_timeout", 30)     // 30 seconds
+	v.SetDefault("udp_session_timeout", 300)   // 5 minutes
+	v.SetDefault("udp_flow_idle_timeout", getIntEnv("UDP_FLOW_IDLE_TIMEOUT", 30))
+	v.SetDefault("udp_max_flows", getIntEnv("UDP_MAX_FLOWS", 10000))
+	v.SetDefault("idle_timeout", getIntEnv("IDLE_TIMEOUT", 0))
+	v.SetDefault("drain_timeout", getIntEnv("DRAIN_TIMEOUT", 30))
+	v.SetDefault("handoff_file", os.Getenv("HANDOFF_FILE"))
+	v.SetDefault("handoff_source", os.Getenv("HANDOFF_SOURCE"))
+	v.SetDefault("upgrade_socket", os.Getenv("UPGRADE_SOCKET"))
+	v.SetDefault("upgrade_timeout", getIntEnv("UPGRADE_TIMEOUT", 60))
+	
+	// Outbound dialing
+	v.SetDefault("dial_timeout", 10)          // 10 seconds
+	v.SetDefault("dial_retries", 0)
+	v.SetDefault("dial_retry_backoff", 100)   // 100 milliseconds
+	v.SetDefault("happy_eyeballs_delay", 300) // RFC 8305 recommended delay
+	v.SetDefault("outbound_ip_family", netutil.FamilyAny)
+	v.SetDefault("outbound_source_addresses", []string{})
+	v.SetDefault("outbound_interface", os.Getenv("OUTBOUND_INTERFACE"))
+	v.SetDefault("enable_mptcp", getBoolEnv("ENABLE_MPTCP", false))
+	v.SetDefault("resolver_upstreams", getListEnv("RESOLVER_UPSTREAMS"))
+	v.SetDefault("resolver_timeout", getIntEnv("RESOLVER_TIMEOUT", 5))
+	v.SetDefault("resolver_cache_size", getIntEnv("RESOLVER_CACHE_SIZE", 10000))
+	v.SetDefault("resolver_cache_max_ttl", getIntEnv("RESOLVER_CACHE_MAX_TTL", 300))
+	v.SetDefault("upstream_proxies", getListEnv("UPSTREAM_PROXIES"))
+	v.SetDefault("upstream_proxy_timeout", getIntEnv("UPSTREAM_PROXY_TIMEOUT", 10))
+	v.SetDefault("upstream_proxy_cooldown", getIntEnv("UPSTREAM_PROXY_COOLDOWN", 30))
+	v.SetDefault("upstream_proxy_tls_ca", os.Getenv("UPSTREAM_PROXY_TLS_CA"))
+	v.SetDefault("upstream_pool_max_idle", getIntEnv("UPSTREAM_POOL_MAX_IDLE", 0))
+	v.SetDefault("upstream_pool_idle_timeout", getIntEnv("UPSTREAM_POOL_IDLE_TIMEOUT", 30))
+	v.SetDefault("upstream_pool_health_check", getBoolEnv("UPSTREAM_POOL_HEALTH_CHECK", true))
+	
+	// TCP socket tuning
+	v.SetDefault("tcp_nodelay", true)
+	v.SetDefault("tcp_keepalive", 15) // matches the Go runtime default
+	v.SetDefault("tcp_keepalive_interval", 0)
+	v.SetDefault("tcp_keepalive_count", 0)
+	v.SetDefault("tcp_send_buffer", 0)
+	v.SetDefault("tcp_recv_buffer", 0)
+	v.SetDefault("tcp_user_timeout", 0)
 	
 	// Rate limiting
 	v.SetDefault("rate_limit_enabled", false)
 	v.SetDefault("rate_limit_rps", 1000)
+	v.SetDefault("auth_rate_limit", 1.0)
+	v.SetDefault("auth_burst", 10)
+	v.SetDefault("auth_max_failures", 5)
+	v.SetDefault("auth_lockout", 30)
+	v.SetDefault("auth_max_lockout", 3600)
+	v.SetDefault("schedule_clock_skew", 30)
+	v.SetDefault("quarantine_threshold", 5)
+	v.SetDefault("quarantine_window", 300)
+	v.SetDefault("tls_inspection_ca_cert", os.Getenv("TLS_INSPECTION_CA_CERT"))
+	v.SetDefault("tls_inspection_ca_key", os.Getenv("TLS_INSPECTION_CA_KEY"))
+	v.SetDefault("tls_inspection_cert_ttl", getIntEnv("TLS_INSPECTION_CERT_TTL", 86400))
+	v.SetDefault("tls_inspection_exclude", []string{})
+	v.SetDefault("tls_inspection_audit_log", os.Getenv("TLS_INSPECTION_AUDIT_LOG"))
+	v.SetDefault("ssh_host_key", os.Getenv("SSH_HOST_KEY"))
+	v.SetDefault("ssh_upstream_key", os.Getenv("SSH_UPSTREAM_KEY"))
+	v.SetDefault("ssh_known_hosts", os.Getenv("SSH_KNOWN_HOSTS"))
+	v.SetDefault("ssh_recording_dir", getEnvOrDefault("SSH_RECORDING_DIR", "/var/lib/marchproxy/ssh-recordings"))
+	v.SetDefault("audit_log_path", os.Getenv("AUDIT_LOG_PATH"))
+	v.SetDefault("security_log_sinks", getListEnv("SECURITY_LOG_SINKS"))
+	v.SetDefault("security_log_tls_ca", os.Getenv("SECURITY_LOG_TLS_CA"))
+	v.SetDefault("log_archive_bucket", os.Getenv("LOG_ARCHIVE_BUCKET"))
+	v.SetDefault("log_archive_endpoint", os.Getenv("LOG_ARCHIVE_ENDPOINT"))
+	v.SetDefault("log_archive_region", getEnvOrDefault("LOG_ARCHIVE_REGION", getEnvOrDefault("AWS_REGION", "us-east-1")))
+	v.SetDefault("log_archive_prefix", getEnvOrDefault("LOG_ARCHIVE_PREFIX", "marchproxy"))
+	v.SetDefault("log_archive_access_key", os.Getenv("AWS_ACCESS_KEY_ID"))
+	v.SetDefault("log_archive_secret_key", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	v.SetDefault("log_archive_session_token", os.Getenv("AWS_SESSION_TOKEN"))
+	v.SetDefault("log_archive_path_style", getBoolEnv("LOG_ARCHIVE_PATH_STYLE", false))
+	v.SetDefault("log_archive_sse", getEnvOrDefault("LOG_ARCHIVE_SSE", "AES256"))
+	v.SetDefault("log_archive_kms_key_id", os.Getenv("LOG_ARCHIVE_KMS_KEY_ID"))
+	v.SetDefault("log_archive_interval", getIntEnv("LOG_ARCHIVE_INTERVAL", 300))
+	v.SetDefault("log_archive_retention_days", getIntEnv("LOG_ARCHIVE_RETENTION_DAYS", 0))
+	v.SetDefault("log_archive_paths", getListEnv("LOG_ARCHIVE_PATHS"))
+	v.SetDefault("snmp_listen", os.Getenv("SNMP_LISTEN"))
+	v.SetDefault("snmp_community", os.Getenv("SNMP_COMMUNITY"))
 
 	// KillKrill integration
 	v.SetDefault("killkrill_enabled", getBoolEnv("KILLKRILL_ENABLED", false))
@@ -186,20 +568,23 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("killkrill_tls_insecure", getBoolEnv("KILLKRILL_TLS_INSECURE", false))
 }
 
-func bindFlags(v *viper.Viper, cmd *cobra.Command) error {
+func bindFlags(l *layers.Layers, cmd *cobra.Command) error {
 	// Bind specific flags that override config file and env vars
 	flagBindings := map[string]string{
 		"manager-url":      "manager_url",
 		"cluster-api-key":  "cluster_api_key",
+		"standalone-config": "standalone_config",
 		"listen-port":      "listen_port",
 		"admin-port":       "admin_port",
+		"bind-address":     "bind_address",
+		"bind-interface":   "bind_interface",
 		"log-level":        "log_level",
 		"enable-ebpf":      "enable_ebpf",
 		"enable-metrics":   "enable_metrics",
 	}
 	
 	for flag, configKey := range flagBindings {
-		if err := v.BindPFlag(configKey, cmd.Flags().Lookup(flag)); err != nil {
+		if err := l.BindFlag(configKey, cmd.Flags().Lookup(flag)); err != nil {
 			return err
 		}
 	}
@@ -208,13 +593,15 @@ func bindFlags(v *viper.Viper, cmd *cobra.Command) error {
 }
 
 func validateConfig(config *Config) error {
-	// Required settings
-	if config.ManagerURL == "" {
-		return fmt.Errorf("manager_url is required")
-	}
-	
-	if config.ClusterAPIKey == "" {
-		return fmt.Errorf("cluster_api_key is required")
+	// Required settings; a standalone config replaces the manager
+	if config.StandaloneConfig == "" {
+		if config.ManagerURL == "" {
+			return fmt.Errorf("manager_url is required")
+		}
+
+		if config.ClusterAPIKey == "" {
+			return fmt.Errorf("cluster_api_key is required")
+		}
 	}
 	
 	if config.ProxyName == "" {
@@ -237,6 +624,21 @@ func validateConfig(config *Config) error {
 	if config.ListenPort == config.AdminPort {
 		return fmt.Errorf("listen_port and admin_port cannot be the same")
 	}
+	if err := config.Admin.Validate(); err != nil {
+		return err
+	}
+	if _, err := netutil.ParseSocketMode(config.ListenSocketMode); err != nil {
+		return fmt.Errorf("invalid listen_socket_mode: %w", err)
+	}
+	
+	// Listener binding validation
+	if err := netutil.ValidateBindAddress(config.BindAddress); err != nil {
+		return err
+	}
+	
+	if err := netutil.ValidateInterface(config.BindInterface); err != nil {
+		return err
+	}
 	
 	// Log level validation
 	validLogLevels := []string{"DEBUG", "INFO", "WARN", "ERROR"}
@@ -267,6 +669,18 @@ func validateConfig(config *Config) error {
 		// If still 0, will be set based on runtime.NumCPU() in the proxy server
 	}
 	
+	if config.Acceptors < 0 {
+		return fmt.Errorf("acceptors cannot be negative")
+	}
+	
+	if err := bufpool.ValidateSize("relay_buffer_size", config.RelayBufferSize); err != nil {
+		return err
+	}
+	
+	if err := bufpool.ValidateSize("udp_buffer_size", config.UDPBufferSize); err != nil {
+		return err
+	}
+	
 	// Interval validation
 	if config.ConfigUpdateInterval < 10 {
 		return fmt.Errorf("config_update_interval must be at least 10 seconds")
@@ -280,21 +694,294 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("connection_timeout must be at least 1 second")
 	}
 	
+	if config.UDPSessionTimeout < 10 {
+		return fmt.Errorf("udp_session_timeout must be at least 10 seconds")
+	}
+	
+	if config.UDPFlowIdleTimeout < 1 {
+		return fmt.Errorf("udp_flow_idle_timeout must be at least 1 second")
+	}
+	
+	if config.UDPMaxFlows < 0 {
+		return fmt.Errorf("udp_max_flows cannot be negative")
+	}
+	
+	if config.IdleTimeout < 0 || config.DrainTimeout < 0 {
+		return fmt.Errorf("idle_timeout and drain_timeout cannot be negative")
+	}
+	
+	if config.UpgradeSocket != "" && config.UpgradeTimeout < 1 {
+		return fmt.Errorf("upgrade_timeout must be at least 1 second")
+	}
+	
+	// Outbound dialing validation
+	if config.DialTimeout < 1 {
+		return fmt.Errorf("dial_timeout must be at least 1 second")
+	}
+	
+	if config.DialRetryBackoff < 0 {
+		return fmt.Errorf("dial_retry_backoff cannot be negative")
+	}
+	
+	if _, err := netutil.NewDialer(config.GetDialOptions()); err != nil {
+		return fmt.Errorf("invalid outbound dial configuration: %w", err)
+	}
+	
+	if err := netutil.ValidateInterface(config.OutboundInterface); err != nil {
+		return err
+	}
+	
+	for _, address := range config.ResolverUpstreams {
+		if _, err := dnsproxy.ParseUpstream(address, 0); err != nil {
+			return fmt.Errorf("resolver_upstreams: %w", err)
+		}
+	}
+	if config.ResolverTimeout < 1 {
+		return fmt.Errorf("resolver_timeout must be at least 1 second")
+	}
+	if config.ResolverCacheSize < 0 || config.ResolverCacheMaxTTL < 0 {
+		return fmt.Errorf("resolver_cache_size and resolver_cache_max_ttl must not be negative")
+	}
+	
+	if _, err := upstreamproxy.NewSet(config.UpstreamProxies, upstreamproxy.Options{}); err != nil {
+		return fmt.Errorf("upstream_proxies: %w", err)
+	}
+	
+	if config.UpstreamProxyTimeout < 1 || config.UpstreamProxyCooldown < 1 {
+		return fmt.Errorf("upstream_proxy_timeout and upstream_proxy_cooldown must be at least 1 second")
+	}
+	
+	if config.UpstreamPoolMaxIdle < 0 {
+		return fmt.Errorf("upstream_pool_max_idle must not be negative")
+	}
+	if config.UpstreamPoolIdleTimeout < 1 {
+		return fmt.Errorf("upstream_pool_idle_timeout must be at least 1 second")
+	}
+	
+	// TCP socket tuning validation
+	if err := config.GetTCPOptions().Validate(); err != nil {
+		return fmt.Errorf("invalid TCP socket configuration: %w", err)
+	}
+	
 	// Rate limiting validation
 	if config.RateLimitEnabled && config.RateLimitRPS <= 0 {
 		return fmt.Errorf("rate_limit_rps must be positive when rate limiting is enabled")
 	}
+	if config.AuthRateLimit < 0 || config.AuthBurst < 0 || config.AuthMaxFailures < 0 {
+		return fmt.Errorf("auth_rate_limit, auth_burst and auth_max_failures cannot be negative")
+	}
+	if config.AuthRateLimit > 0 && config.AuthBurst < 1 {
+		return fmt.Errorf("auth_burst must be at least 1 when auth_rate_limit is set")
+	}
+	if config.AuthMaxFailures > 0 && (config.AuthLockout <= 0 || config.AuthMaxLockout < config.AuthLockout) {
+		return fmt.Errorf("auth_lockout must be positive and no more than auth_max_lockout when auth_max_failures is set")
+	}
+	if config.ScheduleClockSkew < 0 || time.Duration(config.ScheduleClockSkew)*time.Second > schedule.MaxClockSkew {
+		return fmt.Errorf("schedule_clock_skew must be between 0 and %d seconds", int(schedule.MaxClockSkew.Seconds()))
+	}
+	if config.QuarantineThreshold < 0 || (config.QuarantineThreshold > 0 && config.QuarantineWindow <= 0) {
+		return fmt.Errorf("quarantine_threshold must not be negative and quarantine_window must be positive when it is set")
+	}
+	if (config.TLSInspectionCACert == "") != (config.TLSInspectionCAKey == "") {
+		return fmt.Errorf("tls_inspection_ca_cert and tls_inspection_ca_key must be set together")
+	}
+	if config.TLSInspectionCACert != "" && config.TLSInspectionCertTTL <= 0 {
+		return fmt.Errorf("tls_inspection_cert_ttl must be positive")
+	}
+	if err := (&tlsinspect.Policy{Exclude: config.TLSInspectionExclude}).Validate(); err != nil {
+		return fmt.Errorf("tls_inspection_exclude: %w", err)
+	}
+	if config.SSHHostKey != "" && (config.SSHKnownHosts == "" || config.SSHRecordingDir == "") {
+		return fmt.Errorf("ssh_host_key requires ssh_known_hosts and ssh_recording_dir")
+	}
+	for _, sink := range config.SecurityLogSinks {
+		if _, err := waf.ParseSyslogURL(sink); err != nil {
+			return fmt.Errorf("security_log_sinks: %w", err)
+		}
+	}
+	if config.LogArchiveBucket != "" {
+		if config.LogArchiveInterval <= 0 || config.LogArchiveRetentionDays < 0 {
+			return fmt.Errorf("log_archive_interval must be positive and log_archive_retention_days not negative")
+		}
+		if config.LogArchiveAccessKey == "" || config.LogArchiveSecretKey == "" {
+			return fmt.Errorf("log_archive_bucket requires log_archive_access_key and log_archive_secret_key")
+		}
+	}
+	if config.SNMPListen != "" {
+		if _, _, err := net.SplitHostPort(config.SNMPListen); err != nil {
+			return fmt.Errorf("invalid snmp_listen: %w", err)
+		}
+		if config.SNMPCommunity == "" {
+			return fmt.Errorf("snmp_listen requires snmp_community")
+		}
+	}
+
+	// Mirroring validation
+	switch config.MirrorMode {
+	case "":
+	case "file":
+		if config.MirrorDir == "" {
+			return fmt.Errorf("mirror_dir is required when mirror_mode is file")
+		}
+		if config.MirrorFileSize < 1 || config.MirrorFileCount < 1 {
+			return fmt.Errorf("mirror_file_size and mirror_file_count must be at least 1")
+		}
+	case "gre", "erspan":
+		if net.ParseIP(config.MirrorTarget) == nil {
+			return fmt.Errorf("mirror_target must be an IP address when mirror_mode is %s", config.MirrorMode)
+		}
+		if config.MirrorMode == "erspan" && (config.MirrorERSPANSession < 1 || config.MirrorERSPANSession > 1023) {
+			return fmt.Errorf("mirror_erspan_session must be between 1 and 1023")
+		}
+	default:
+		return fmt.Errorf("mirror_mode must be file, gre or erspan")
+	}
+	if config.MirrorSampleRate < 0 || config.MirrorSampleRate > 1 {
+		return fmt.Errorf("mirror_sample_rate must be between 0 and 1")
+	}
+
+	// Packet capture validation
+	if config.CaptureEnabled && (config.CaptureMaxDuration < 1 || config.CaptureMaxBytes < 1) {
+		return fmt.Errorf("capture_max_duration and capture_max_bytes must be at least 1")
+	}
+
+	// Self-monitoring validation
+	if config.SelfMonitorInterval < 0 || config.SelfMonitorGoroutines < 0 || config.SelfMonitorHeapMB < 0 {
+		return fmt.Errorf("self_monitor_interval, self_monitor_goroutines and self_monitor_heap_mb cannot be negative")
+	}
+	if config.SelfMonitorFDPercent < 0 || config.SelfMonitorFDPercent > 100 {
+		return fmt.Errorf("self_monitor_fd_percent must be between 0 and 100")
+	}
+
+	// Metering validation
+	if config.MeteringInterval < 0 {
+		return fmt.Errorf("metering_interval cannot be negative")
+	}
+
+	// DNS proxy validation
+	if config.DNSEnabled {
+		if config.DNSPort <= 0 || config.DNSPort > 65535 {
+			return fmt.Errorf("invalid dns_port: %d", config.DNSPort)
+		}
+		if config.DNSPort == config.ListenPort || config.DNSPort == config.AdminPort || config.DNSPort == config.ListenPort+1000 {
+			return fmt.Errorf("dns_port %d conflicts with a built-in listener", config.DNSPort)
+		}
+		if len(config.DNSUpstreams) == 0 {
+			return fmt.Errorf("dns_upstreams is required when the DNS proxy is enabled")
+		}
+		if config.DNSUpstreamTimeout < 1 {
+			return fmt.Errorf("dns_upstream_timeout must be at least 1 second")
+		}
+		if config.DNSCacheSize < 0 || config.DNSCacheMaxTTL < 0 {
+			return fmt.Errorf("dns_cache_size and dns_cache_max_ttl cannot be negative")
+		}
+		if config.DNSBlockResponse != "nxdomain" && config.DNSBlockResponse != "refused" {
+			return fmt.Errorf("dns_block_response must be nxdomain or refused")
+		}
+	}
+
+	// SMTP relay validation
+	if config.SMTPEnabled {
+		if config.SMTPPort <= 0 || config.SMTPPort > 65535 {
+			return fmt.Errorf("invalid smtp_port: %d", config.SMTPPort)
+		}
+		if config.SMTPSPort < 0 || config.SMTPSPort > 65535 || config.SMTPSPort == config.SMTPPort {
+			return fmt.Errorf("invalid smtps_port: %d", config.SMTPSPort)
+		}
+		for _, port := range []int{config.SMTPPort, config.SMTPSPort} {
+			if port == config.ListenPort || port == config.AdminPort || port == config.ListenPort+1000 || (config.DNSEnabled && port == config.DNSPort) {
+				return fmt.Errorf("SMTP port %d conflicts with another listener", port)
+			}
+		}
+		if config.SMTPSPort != 0 && (config.TLSCertPath == "" || config.TLSKeyPath == "") {
+			return fmt.Errorf("smtps_port requires tls_cert_path and tls_key_path")
+		}
+		if config.SMTPMaxMessageSize < 1024 {
+			return fmt.Errorf("smtp_max_message_size must be at least 1024 bytes")
+		}
+		if config.SMTPTimeout < 1 {
+			return fmt.Errorf("smtp_timeout must be at least 1 second")
+		}
+	}
+
+	// SOCKS5 listener validation
+	if config.SOCKSEnabled {
+		if config.SOCKSPort <= 0 || config.SOCKSPort > 65535 {
+			return fmt.Errorf("invalid socks_port: %d", config.SOCKSPort)
+		}
+		if config.SOCKSPort == config.ListenPort || config.SOCKSPort == config.AdminPort || config.SOCKSPort == config.ListenPort+1000 ||
+			(config.DNSEnabled && config.SOCKSPort == config.DNSPort) ||
+			(config.SMTPEnabled && (config.SOCKSPort == config.SMTPPort || config.SOCKSPort == config.SMTPSPort)) {
+			return fmt.Errorf("socks_port %d conflicts with another listener", config.SOCKSPort)
+		}
+		if config.SOCKSTimeout < 1 || config.SOCKSUDPIdleTimeout < 1 {
+			return fmt.Errorf("socks_timeout and socks_udp_idle_timeout must be at least 1 second")
+		}
+	}
+
+	// Multiplexed listener validation
+	if config.MuxEnabled {
+		if config.MuxPort <= 0 || config.MuxPort > 65535 {
+			return fmt.Errorf("invalid mux_port: %d", config.MuxPort)
+		}
+		if config.MuxPort == config.ListenPort || config.MuxPort == config.AdminPort || config.MuxPort == config.ListenPort+1000 ||
+			(config.DNSEnabled && config.MuxPort == config.DNSPort) ||
+			(config.SMTPEnabled && (config.MuxPort == config.SMTPPort || config.MuxPort == config.SMTPSPort)) ||
+			(config.SOCKSEnabled && config.MuxPort == config.SOCKSPort) {
+			return fmt.Errorf("mux_port %d conflicts with another listener", config.MuxPort)
+		}
+		if config.MuxMaxStreams < 1 {
+			return fmt.Errorf("mux_max_streams must be at least 1")
+		}
+		if config.MuxIdleTimeout < 1 {
+			return fmt.Errorf("mux_idle_timeout must be at least 1 second")
+		}
+	}
+
+	// ICMP echo relay validation
+	if config.ICMPEnabled {
+		if config.ICMPRateLimit < 0 {
+			return fmt.Errorf("icmp_rate_limit cannot be negative")
+		}
+		if config.ICMPTimeout < 1 {
+			return fmt.Errorf("icmp_timeout must be at least 1 second")
+		}
+		if config.ICMPMaxFlows < 1 {
+			return fmt.Errorf("icmp_max_flows must be at least 1")
+		}
+	}
+
+	// License validation
+	if config.LicenseRefreshInterval <= 0 || config.LicenseGracePeriod <= 0 {
+		return fmt.Errorf("license_refresh_interval and license_grace_period must be positive")
+	}
 
 	// mTLS validation
 	if config.EnableMTLS {
-		if config.MTLSServerCertPath == "" {
-			return fmt.Errorf("mtls_server_cert_path is required when mTLS is enabled")
+		if config.MTLSAutoIssue {
+			// Certificates come from the manager, nothing to load from disk
+			if config.MTLSIssueTTL < 3600 {
+				return fmt.Errorf("mtls_issue_ttl must be at least 3600 seconds")
+			}
+			if config.MTLSIssueRenewBefore < 0 || config.MTLSIssueRenewBefore >= config.MTLSIssueTTL {
+				return fmt.Errorf("mtls_issue_renew_before must be between 0 and mtls_issue_ttl")
+			}
+		} else {
+			if config.MTLSServerCertPath == "" {
+				return fmt.Errorf("mtls_server_cert_path is required when mTLS is enabled")
+			}
+			if config.MTLSServerKeyPath == "" {
+				return fmt.Errorf("mtls_server_key_path is required when mTLS is enabled")
+			}
+			if config.MTLSRequireClientCert && config.MTLSClientCAPath == "" {
+				return fmt.Errorf("mtls_client_ca_path is required when client certificate validation is enabled")
+			}
 		}
-		if config.MTLSServerKeyPath == "" {
-			return fmt.Errorf("mtls_server_key_path is required when mTLS is enabled")
+		if (config.MTLSOCSPEnabled || config.MTLSOCSPStapling || config.MTLSCRLEnabled) && config.MTLSOCSPTimeout <= 0 {
+			return fmt.Errorf("mtls_ocsp_timeout must be positive when revocation checking is enabled")
 		}
-		if config.MTLSRequireClientCert && config.MTLSClientCAPath == "" {
-			return fmt.Errorf("mtls_client_ca_path is required when client certificate validation is enabled")
+		if config.MTLSCRLEnabled && config.MTLSCRLRefreshInterval <= 0 {
+			return fmt.Errorf("mtls_crl_refresh_interval must be positive when CRL checking is enabled")
 		}
 	}
 
@@ -338,6 +1025,30 @@ func getIntEnv(key string, defaultValue int) int {
 	return intValue
 }
 
+func getFloatEnv(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return floatValue
+}
+
+// getListEnv returns a comma-separated environment variable as a list
+func getListEnv(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -346,9 +1057,87 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return value
 }
 
-// GetListenAddress returns the full listen address for the proxy
+// GetListenAddress returns the full listen address for the proxy,
+// unix:/path when it serves on listen_socket
 func (c *Config) GetListenAddress() string {
-	return fmt.Sprintf(":%d", c.ListenPort)
+	if c.ListenSocket != "" {
+		return netutil.UnixPrefix + c.ListenSocket
+	}
+	return netutil.JoinHostPort(c.BindAddress, c.ListenPort)
+}
+
+// GetListenSocketMode returns the permissions of listen_socket
+func (c *Config) GetListenSocketMode() os.FileMode {
+	mode, err := netutil.ParseSocketMode(c.ListenSocketMode)
+	if err != nil {
+		return netutil.DefaultSocketMode
+	}
+	return mode
+}
+
+// GetScheduleClockSkew returns the clock skew tolerated by mapping schedules
+func (c *Config) GetScheduleClockSkew() time.Duration {
+	return time.Duration(c.ScheduleClockSkew) * time.Second
+}
+
+// GetQuarantineWindow returns the window quarantine flags are counted in
+func (c *Config) GetQuarantineWindow() time.Duration {
+	return time.Duration(c.QuarantineWindow) * time.Second
+}
+
+// GetLogArchiveEndpoint returns the object storage endpoint, AWS S3 of the
+// region by default
+func (c *Config) GetLogArchiveEndpoint() string {
+	if c.LogArchiveEndpoint != "" {
+		return c.LogArchiveEndpoint
+	}
+	return fmt.Sprintf("https://s3.%s.amazonaws.com", c.LogArchiveRegion)
+}
+
+// GetTLSInspectionCertTTL returns the lifetime of minted certificates
+func (c *Config) GetTLSInspectionCertTTL() time.Duration {
+	return time.Duration(c.TLSInspectionCertTTL) * time.Second
+}
+
+// GetUDPListenAddress returns the listen address for the UDP proxy
+func (c *Config) GetUDPListenAddress() string {
+	return netutil.JoinHostPort(c.BindAddress, c.ListenPort+1000)
+}
+
+// GetAcceptors returns the number of accept loops per TCP listener
+func (c *Config) GetAcceptors() int {
+	if c.Acceptors > 0 {
+		return c.Acceptors
+	}
+	return netutil.DefaultAcceptors()
+}
+
+// GetDialOptions returns the default options for outbound connections
+func (c *Config) GetDialOptions() netutil.DialOptions {
+	return netutil.DialOptions{
+		Timeout:       time.Duration(c.DialTimeout) * time.Second,
+		FallbackDelay: time.Duration(c.HappyEyeballsDelay) * time.Millisecond,
+		Retries:       c.DialRetries,
+		RetryBackoff:  time.Duration(c.DialRetryBackoff) * time.Millisecond,
+		Family:        c.OutboundIPFamily,
+		SourceAddrs:   c.OutboundSourceAddresses,
+		Interface:     c.OutboundInterface,
+		MPTCP:         c.EnableMPTCP,
+	}
+}
+
+// GetTCPOptions returns the default socket options for proxied TCP connections
+func (c *Config) GetTCPOptions() netutil.TCPOptions {
+	noDelay := c.TCPNoDelay
+	return netutil.TCPOptions{
+		NoDelay:           &noDelay,
+		KeepAlive:         time.Duration(c.TCPKeepAlive) * time.Second,
+		KeepAliveInterval: time.Duration(c.TCPKeepAliveInterval) * time.Second,
+		KeepAliveCount:    c.TCPKeepAliveCount,
+		SendBuffer:        c.TCPSendBuffer,
+		RecvBuffer:        c.TCPRecvBuffer,
+		UserTimeout:       time.Duration(c.TCPUserTimeout) * time.Millisecond,
+	}
 }
 
 // GetAdminAddress returns the full admin/metrics address
@@ -389,6 +1178,10 @@ func (c *Config) GetCapabilities() []string {
 		capabilities = append(capabilities, "mtls")
 	}
 
+	if c.EnableMPTCP {
+		capabilities = append(capabilities, "mptcp")
+	}
+
 	return capabilities
 }
 
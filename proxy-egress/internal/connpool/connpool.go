@@ -0,0 +1,362 @@
+// Package connpool keeps warm connections to egress destinations, so a new
+// client connection doesn't wait for a dial and TLS handshake.
+//
+// A relayed TCP connection carries one client's byte stream with no request
+// boundaries, so it can't be handed to another client once used. The pool
+// instead keeps up to a number of idle connections per destination dialed
+// ahead of demand: each Get takes one and dials its replacement in the
+// background. Idle connections are closed after the idle timeout and, with
+// health checks, as soon as the destination closes them. Bytes the
+// destination sends first, such as a greeting, are kept and read before the
+// rest of the connection.
+package connpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxGreeting bounds the bytes kept from an idle connection. A destination
+// sending more than that isn't waiting for its client.
+const maxGreeting = 4096
+
+// Eviction reasons of idle connections
+const (
+	EvictIdleTimeout = "idle_timeout" // Idle for the idle timeout
+	EvictClosed      = "closed"       // Closed or failed at the destination
+	EvictOverflow    = "overflow"     // Sent more than a greeting while idle
+)
+
+var errOverflow = errors.New("destination sent too much data to an idle connection")
+
+// Key identifies interchangeable connections
+type Key struct {
+	Mapping     string // Mapping the connections are dialed for, with its dial options
+	Destination string // Destination host:port
+	TLS         bool   // The connections completed a TLS handshake
+}
+
+// DialFunc dials a connection for a key
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Options configures a Pool
+type Options struct {
+	IdleTimeout time.Duration // Idle connections are closed after this
+	DialTimeout time.Duration // Bounds background dials, including handshakes
+	HealthCheck bool          // Watch idle connections, evicting those the destination closes
+}
+
+// Pool keeps idle connections per Key
+type Pool struct {
+	opts   Options
+	ctx    context.Context // Cancelled by Close, ends background dials
+	cancel context.CancelFunc
+
+	idle      map[Key][]*idleConn
+	filling   map[Key]int // Background dials in flight
+	requests  map[string]*requestCounts
+	evictions map[string]map[string]uint64 // Per mapping and reason
+	closed    bool
+	mu        sync.Mutex
+	wg        sync.WaitGroup // Background dials and watchers
+}
+
+// requestCounts are the Gets of a mapping served from the pool or dialed
+type requestCounts struct {
+	hits, misses uint64
+}
+
+// idleConn is a pooled connection
+type idleConn struct {
+	conn     net.Conn
+	timer    *time.Timer   // Evicts the connection at the idle timeout
+	watching chan struct{} // Closed when the watcher returns, nil without health checks
+	taken    atomic.Bool   // Set by Get before it stops the watcher
+	greeting []byte        // Read by the watcher
+	err      error         // Why the watcher stopped
+}
+
+// New creates an empty pool
+func New(opts Options) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		opts:      opts,
+		ctx:       ctx,
+		cancel:    cancel,
+		idle:      make(map[Key][]*idleConn),
+		filling:   make(map[Key]int),
+		requests:  make(map[string]*requestCounts),
+		evictions: make(map[string]map[string]uint64),
+	}
+}
+
+// Get returns an idle connection for key, or dials one with ctx when there
+// is none. It then dials a replacement in the background while fewer than
+// maxIdle connections are idle or being dialed.
+func (p *Pool) Get(ctx context.Context, key Key, maxIdle int, dial DialFunc) (net.Conn, error) {
+	conn := p.take(key)
+	p.mu.Lock()
+	counts := p.requests[key.Mapping]
+	if counts == nil {
+		counts = &requestCounts{}
+		p.requests[key.Mapping] = counts
+	}
+	if conn != nil {
+		counts.hits++
+	} else {
+		counts.misses++
+	}
+	if !p.closed && len(p.idle[key])+p.filling[key] < maxIdle {
+		p.filling[key]++
+		p.wg.Add(1)
+		go p.fill(key, maxIdle, dial)
+	}
+	p.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+	return dial(ctx)
+}
+
+// take removes the most recently pooled connection of key that is still
+// open, nil when there is none
+func (p *Pool) take(key Key) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		c := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.mu.Unlock()
+
+		c.timer.Stop()
+		if c.watching == nil {
+			return c.conn
+		}
+
+		// Stop the watcher and check the destination didn't close the
+		// connection meanwhile
+		c.taken.Store(true)
+		c.conn.SetReadDeadline(time.Now())
+		<-c.watching
+		if c.err != nil && !errors.Is(c.err, os.ErrDeadlineExceeded) {
+			p.evicted(key, c, reasonOf(c.err))
+			continue
+		}
+		c.conn.SetReadDeadline(time.Time{})
+		if len(c.greeting) > 0 {
+			return &greetingConn{Conn: c.conn, greeting: c.greeting}
+		}
+		return c.conn
+	}
+}
+
+// fill dials a connection for key and pools it
+func (p *Pool) fill(key Key, maxIdle int, dial DialFunc) {
+	defer p.wg.Done()
+	ctx := p.ctx
+	if p.opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.DialTimeout)
+		defer cancel()
+	}
+	conn, err := dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filling[key]--
+	if err != nil {
+		return
+	}
+	if p.closed || len(p.idle[key]) >= maxIdle {
+		conn.Close()
+		return
+	}
+
+	c := &idleConn{conn: conn}
+	c.timer = time.AfterFunc(p.opts.IdleTimeout, func() { p.evict(key, c, EvictIdleTimeout) })
+	if p.opts.HealthCheck {
+		c.watching = make(chan struct{})
+		p.wg.Add(1)
+		go p.watch(key, c)
+	}
+	p.idle[key] = append(p.idle[key], c)
+}
+
+// watch reads an idle connection until Get takes it, keeping what the
+// destination sends and evicting the connection when it is closed
+func (p *Pool) watch(key Key, c *idleConn) {
+	defer p.wg.Done()
+	defer close(c.watching)
+
+	buf := make([]byte, maxGreeting)
+	n := 0
+	for {
+		read, err := c.conn.Read(buf[n:])
+		n += read
+		if err == nil && n == len(buf) {
+			err = errOverflow
+		}
+		if err != nil {
+			c.greeting = buf[:n]
+			c.err = err
+			if !c.taken.Load() {
+				p.evict(key, c, reasonOf(err))
+			}
+			return
+		}
+	}
+}
+
+// evict closes a connection still in the pool
+func (p *Pool) evict(key Key, c *idleConn, reason string) {
+	p.mu.Lock()
+	conns := p.idle[key]
+	for i, pooled := range conns {
+		if pooled == c {
+			p.idle[key] = append(conns[:i:i], conns[i+1:]...)
+			p.mu.Unlock()
+			p.evicted(key, c, reason)
+			return
+		}
+	}
+	p.mu.Unlock()
+}
+
+// evicted closes a connection removed from the pool and counts it
+func (p *Pool) evicted(key Key, c *idleConn, reason string) {
+	c.timer.Stop()
+	c.conn.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reasons := p.evictions[key.Mapping]
+	if reasons == nil {
+		reasons = make(map[string]uint64)
+		p.evictions[key.Mapping] = reasons
+	}
+	reasons[reason]++
+}
+
+// reasonOf returns the eviction reason of a watcher error
+func reasonOf(err error) string {
+	if errors.Is(err, errOverflow) {
+		return EvictOverflow
+	}
+	return EvictClosed
+}
+
+// Close closes the idle connections and stops background dials
+func (p *Pool) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.cancel()
+	p.mu.Lock()
+	p.closed = true
+	var conns []*idleConn
+	for key, idle := range p.idle {
+		conns = append(conns, idle...)
+		p.idle[key] = nil
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.timer.Stop()
+		c.conn.Close()
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// WritePrometheus writes the pool sizes, requests and evictions
+func (p *Pool) WritePrometheus(w io.Writer) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]Key, 0, len(p.idle))
+	for key := range p.idle {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Mapping != keys[j].Mapping {
+			return keys[i].Mapping < keys[j].Mapping
+		}
+		if keys[i].Destination != keys[j].Destination {
+			return keys[i].Destination < keys[j].Destination
+		}
+		return !keys[i].TLS && keys[j].TLS
+	})
+	fmt.Fprintf(w, "# HELP marchproxy_upstream_pool_idle Idle destination connections in the pool\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_upstream_pool_idle gauge\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_upstream_pool_idle{mapping=%q,destination=%q,tls=\"%t\"} %d\n", key.Mapping, key.Destination, key.TLS, len(p.idle[key]))
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_upstream_pool_dialing Destination connections being dialed for the pool\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_upstream_pool_dialing gauge\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_upstream_pool_dialing{mapping=%q,destination=%q,tls=\"%t\"} %d\n", key.Mapping, key.Destination, key.TLS, p.filling[key])
+	}
+
+	mappings := make([]string, 0, len(p.requests))
+	for mapping := range p.requests {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+	fmt.Fprintf(w, "# HELP marchproxy_upstream_pool_requests_total Destination connections per mapping taken from the pool (hit) or dialed (miss)\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_upstream_pool_requests_total counter\n")
+	for _, mapping := range mappings {
+		counts := p.requests[mapping]
+		fmt.Fprintf(w, "marchproxy_upstream_pool_requests_total{mapping=%q,result=\"hit\"} %d\n", mapping, counts.hits)
+		fmt.Fprintf(w, "marchproxy_upstream_pool_requests_total{mapping=%q,result=\"miss\"} %d\n", mapping, counts.misses)
+	}
+
+	mappings = mappings[:0]
+	for mapping := range p.evictions {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+	fmt.Fprintf(w, "# HELP marchproxy_upstream_pool_evictions_total Idle destination connections closed per mapping and reason\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_upstream_pool_evictions_total counter\n")
+	for _, mapping := range mappings {
+		for _, reason := range []string{EvictIdleTimeout, EvictClosed, EvictOverflow} {
+			fmt.Fprintf(w, "marchproxy_upstream_pool_evictions_total{mapping=%q,reason=%q} %d\n", mapping, reason, p.evictions[mapping][reason])
+		}
+	}
+}
+
+// greetingConn reads what the destination sent while the connection was
+// idle before the rest of the connection
+type greetingConn struct {
+	net.Conn
+	greeting []byte
+}
+
+func (c *greetingConn) Read(b []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(b, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the pooled connection, for socket options
+func (c *greetingConn) NetConn() net.Conn {
+	return c.Conn
+}
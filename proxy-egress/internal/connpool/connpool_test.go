@@ -0,0 +1,160 @@
+package connpool
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// destination accepts connections, greeting them when greeting is set, and
+// returns the accepted connections
+func destination(t *testing.T, greeting string) (net.Listener, chan net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if greeting != "" {
+				io.WriteString(conn, greeting)
+			}
+			accepted <- conn
+		}
+	}()
+	return listener, accepted
+}
+
+// counting returns a dial function for the listener and its dial count
+func counting(listener net.Listener) (DialFunc, *atomic.Int32) {
+	var dials atomic.Int32
+	return func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", listener.Addr().String())
+	}, &dials
+}
+
+// waitIdle waits until the pool holds n idle connections for key
+func waitIdle(t *testing.T, p *Pool, key Key, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		idle := len(p.idle[key])
+		p.mu.Unlock()
+		if idle == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Pool never held %d idle connections", n)
+}
+
+func TestGetReusesWarmConnections(t *testing.T) {
+	listener, _ := destination(t, "220 ready\r\n")
+	dial, dials := counting(listener)
+	p := New(Options{IdleTimeout: time.Minute, HealthCheck: true})
+	defer p.Close()
+	key := Key{Mapping: "smtp", Destination: listener.Addr().String()}
+
+	conn, err := p.Get(context.Background(), key, 2, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitIdle(t, p, key, 1)
+
+	// The warm connection is taken with the greeting it received while
+	// idle, and replaced
+	conn, err = p.Get(context.Background(), key, 2, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	greeting := make([]byte, len("220 ready\r\n"))
+	if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != "220 ready\r\n" {
+		t.Fatalf("Greeting = %q, %v", greeting, err)
+	}
+	waitIdle(t, p, key, 1)
+	if got := dials.Load(); got != 3 {
+		t.Errorf("Dials = %d, want 3", got)
+	}
+
+	var metrics strings.Builder
+	p.WritePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_upstream_pool_requests_total{mapping="smtp",result="hit"} 1`,
+		`marchproxy_upstream_pool_requests_total{mapping="smtp",result="miss"} 1`,
+		`marchproxy_upstream_pool_idle{mapping="smtp",destination="` + key.Destination + `",tls="false"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestEvictions(t *testing.T) {
+	listener, accepted := destination(t, "")
+	dial, _ := counting(listener)
+	p := New(Options{IdleTimeout: 100 * time.Millisecond, HealthCheck: true})
+	defer p.Close()
+	key := Key{Mapping: "db", Destination: listener.Addr().String()}
+
+	conn, _ := p.Get(context.Background(), key, 1, dial)
+	conn.Close()
+	<-accepted
+	waitIdle(t, p, key, 1)
+
+	// The destination closes the idle connection
+	(<-accepted).Close()
+	waitIdle(t, p, key, 0)
+
+	// A connection not taken within the idle timeout is closed
+	conn, _ = p.Get(context.Background(), key, 1, dial)
+	conn.Close()
+	waitIdle(t, p, key, 1)
+	waitIdle(t, p, key, 0)
+
+	var metrics strings.Builder
+	p.WritePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_upstream_pool_evictions_total{mapping="db",reason="closed"} 1`,
+		`marchproxy_upstream_pool_evictions_total{mapping="db",reason="idle_timeout"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestCloseStopsFilling(t *testing.T) {
+	listener, _ := destination(t, "")
+	dial, _ := counting(listener)
+	p := New(Options{IdleTimeout: time.Minute})
+	key := Key{Mapping: "api", Destination: listener.Addr().String()}
+
+	conn, _ := p.Get(context.Background(), key, 4, dial)
+	conn.Close()
+	waitIdle(t, p, key, 1)
+	p.Close()
+
+	// Closed pools dial every connection
+	conn, err := p.Get(context.Background(), key, 4, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitIdle(t, p, key, 0)
+}
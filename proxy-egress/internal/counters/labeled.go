@@ -0,0 +1,37 @@
+package counters
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Labeled is a set of lock-free counters keyed by label values. Counting
+// a key seen before takes no lock; only the first count of a key allocates
+// its counter. The zero value is ready to use.
+type Labeled[K comparable] struct {
+	counters sync.Map // K -> *atomic.Uint64
+}
+
+// Add adds delta to the counter of key
+func (l *Labeled[K]) Add(key K, delta uint64) {
+	counter, ok := l.counters.Load(key)
+	if !ok {
+		counter, _ = l.counters.LoadOrStore(key, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(delta)
+}
+
+// Inc increments the counter of key by one
+func (l *Labeled[K]) Inc(key K) {
+	l.Add(key, 1)
+}
+
+// Snapshot returns the value of every counter, for scrape-time reads
+func (l *Labeled[K]) Snapshot() map[K]uint64 {
+	values := make(map[K]uint64)
+	l.counters.Range(func(key, counter any) bool {
+		values[key.(K)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return values
+}
@@ -0,0 +1,40 @@
+package counters
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestLabeled tests concurrent increments of shared and separate keys
+func TestLabeled(t *testing.T) {
+	var counters Labeled[string]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counters.Inc("shared")
+			}
+		}()
+	}
+	wg.Wait()
+
+	counters.Add("other", 5)
+	want := map[string]uint64{"shared": 8000, "other": 5}
+	if got := counters.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot() = %v, want %v", got, want)
+	}
+}
+
+// BenchmarkLabeled measures one labeled counter under contention
+func BenchmarkLabeled(b *testing.B) {
+	var counters Labeled[string]
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			counters.Inc("route")
+		}
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +22,14 @@ type AdminDashboard struct {
 	metricsClient  *metrics.PrometheusMetrics
 	serviceManager *manager.Manager
 	websockets     map[string]*WebSocketConnection
+	nextSocketID   uint64
+	sessions       *sessionStore
+	logins         *loginLimiter
+	audit          *auditLog
+	alerts         *AlertEngine
+	editor         *configEditor
+	dummyHash      string
+	stopCh         chan struct{}
 	mutex          sync.RWMutex
 	running        bool
 }
@@ -31,6 +38,13 @@ type DashboardConfig struct {
 	Port            int
 	Enabled         bool
 	BasicAuth       BasicAuthConfig
+	Users           []DashboardUser // Role-based accounts; when set they replace BasicAuth
+	SessionTTL      time.Duration   // Idle time before a login session expires
+	LoginAttempts   int             // Failed logins allowed per client address within LoginWindow
+	LoginWindow     time.Duration   // How long failed logins count against a client address
+	AuditLogSize    int             // Number of dashboard actions kept in the audit trail
+	Alerting        AlertingConfig
+	ConfigEditor    ConfigEditorConfig
 	TLSEnabled      bool
 	CertFile        string
 	KeyFile         string
@@ -192,7 +206,7 @@ const (
 	AlertStatusSuppressed AlertStatus = "suppressed"
 )
 
-func NewAdminDashboard(config DashboardConfig, healthChecker *health.HealthChecker, metricsClient *metrics.PrometheusMetrics, serviceManager *manager.Manager) *AdminDashboard {
+func NewAdminDashboard(config DashboardConfig, healthChecker *health.HealthChecker, metricsClient *metrics.PrometheusMetrics, serviceManager *manager.Manager) (*AdminDashboard, error) {
 	if config.Port == 0 {
 		config.Port = 8080
 	}
@@ -202,6 +216,27 @@ func NewAdminDashboard(config DashboardConfig, healthChecker *health.HealthCheck
 	if config.MaxConnections == 0 {
 		config.MaxConnections = 100
 	}
+	if config.SessionTTL == 0 {
+		config.SessionTTL = 8 * time.Hour
+	}
+	if config.AuditLogSize == 0 {
+		config.AuditLogSize = 1000
+	}
+	if config.LoginAttempts == 0 {
+		config.LoginAttempts = 5
+	}
+	if config.LoginWindow == 0 {
+		config.LoginWindow = 15 * time.Minute
+	}
+
+	if err := validateUsers(config.Users); err != nil {
+		return nil, err
+	}
+
+	alerts, err := NewAlertEngine(config.Alerting)
+	if err != nil {
+		return nil, err
+	}
 
 	ad := &AdminDashboard{
 		config:         config,
@@ -209,12 +244,25 @@ func NewAdminDashboard(config DashboardConfig, healthChecker *health.HealthCheck
 		metricsClient:  metricsClient,
 		serviceManager: serviceManager,
 		websockets:     make(map[string]*WebSocketConnection),
+		sessions:       newSessionStore(config.SessionTTL),
+		logins:         newLoginLimiter(config.LoginAttempts, config.LoginWindow),
+		audit:          newAuditLog(config.AuditLogSize),
+		alerts:         alerts,
+		editor:         newConfigEditor(config.ConfigEditor),
+	}
+
+	if len(config.Users) > 0 {
+		dummyHash, err := HashPassword("")
+		if err != nil {
+			return nil, err
+		}
+		ad.dummyHash = dummyHash
 	}
 
 	ad.initializeTemplates()
 	ad.setupRoutes()
 
-	return ad
+	return ad, nil
 }
 
 func (ad *AdminDashboard) initializeTemplates() {
@@ -235,14 +283,25 @@ func (ad *AdminDashboard) setupRoutes() {
 	mux.HandleFunc("/api/metrics", ad.handleMetrics)
 	mux.HandleFunc("/api/health", ad.handleHealth)
 	mux.HandleFunc("/api/config", ad.handleConfiguration)
+	mux.HandleFunc("/api/config/drafts", ad.handleDrafts)
+	mux.HandleFunc("/api/config/drafts/", ad.handleDrafts)
+	mux.HandleFunc("/api/config/freeze", ad.handleConfigFreeze)
 	mux.HandleFunc("/api/events", ad.handleEvents)
 	mux.HandleFunc("/api/alerts", ad.handleAlerts)
+	mux.HandleFunc("/api/alerts/history", ad.handleAlertHistory)
+	mux.HandleFunc("/api/alerts/silences", ad.handleSilences)
+
+	// Session routes
+	mux.HandleFunc("/login", ad.handleLogin)
+	mux.HandleFunc("/logout", ad.handleLogout)
+	mux.HandleFunc("/api/session", ad.handleSession)
+	mux.HandleFunc("/api/audit", ad.requireRole(RoleAdmin, ActionViewAudit, ad.handleAudit))
 
 	// Management routes
-	mux.HandleFunc("/api/services/toggle", ad.handleServiceToggle)
-	mux.HandleFunc("/api/services/restart", ad.handleServiceRestart)
-	mux.HandleFunc("/api/config/reload", ad.handleConfigReload)
-	mux.HandleFunc("/api/cache/clear", ad.handleCacheClear)
+	mux.HandleFunc("/api/services/toggle", ad.requireRole(RoleOperator, ActionToggleService, ad.handleServiceToggle))
+	mux.HandleFunc("/api/services/restart", ad.requireRole(RoleOperator, ActionRestartService, ad.handleServiceRestart))
+	mux.HandleFunc("/api/config/reload", ad.requireRole(RoleAdmin, ActionReloadConfig, ad.handleConfigReload))
+	mux.HandleFunc("/api/cache/clear", ad.requireRole(RoleOperator, ActionClearCache, ad.handleCacheClear))
 
 	// WebSocket route
 	mux.HandleFunc("/ws", ad.handleWebSocket)
@@ -252,8 +311,14 @@ func (ad *AdminDashboard) setupRoutes() {
 	if ad.config.CORS.Enabled {
 		handler = ad.corsMiddleware(handler)
 	}
-	if ad.config.BasicAuth.Enabled {
-		handler = ad.basicAuthMiddleware(handler)
+	switch {
+	case len(ad.config.Users) > 0:
+		handler = ad.sessionMiddleware(handler)
+	case ad.config.BasicAuth.Enabled:
+		handler = ad.basicAuthMiddleware(withSession(ad.config.BasicAuth.Username, RoleAdmin, handler))
+	default:
+		// Without any credentials callers may only look
+		handler = withSession("anonymous", RoleViewer, handler)
 	}
 	if ad.config.RateLimiting.Enabled {
 		handler = ad.rateLimitMiddleware(handler)
@@ -280,8 +345,12 @@ func (ad *AdminDashboard) Start() error {
 	}
 
 	ad.running = true
+	ad.stopCh = make(chan struct{})
 
-	go ad.broadcastLoop()
+	go ad.broadcastLoop(ad.stopCh)
+	if ad.config.Alerting.Enabled {
+		go ad.alerts.Run(ad.stopCh, ad.getMetricsData, ad.getSystemHealth)
+	}
 
 	if ad.config.TLSEnabled {
 		return ad.server.ListenAndServeTLS(ad.config.CertFile, ad.config.KeyFile)
@@ -299,6 +368,14 @@ func (ad *AdminDashboard) Stop() error {
 	}
 
 	ad.running = false
+	close(ad.stopCh)
+
+	for id, wsConn := range ad.websockets {
+		if wsConn.conn != nil {
+			wsConn.conn.Close()
+		}
+		delete(ad.websockets, id)
+	}
 
 	if ad.server != nil {
 		return ad.server.Close()
@@ -368,6 +445,59 @@ func (ad *AdminDashboard) handleAlerts(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(alerts)
 }
 
+func (ad *AdminDashboard) handleAlertHistory(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"resolved":      ad.alerts.History(),
+		"notifications": ad.alerts.NotificationStats(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (ad *AdminDashboard) handleSilences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ad.alerts.Silences())
+	case "POST":
+		ad.requireRole(RoleOperator, ActionCreateSilence, ad.createSilence)(w, r)
+	case "DELETE":
+		ad.requireRole(RoleOperator, ActionRemoveSilence, ad.removeSilence)(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ad *AdminDashboard) createSilence(w http.ResponseWriter, r *http.Request) {
+	var silence Silence
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&silence); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid silence: %v", err), http.StatusBadRequest)
+		return
+	}
+	if sess, ok := sessionFromRequest(r); ok {
+		silence.CreatedBy = sess.username
+	}
+
+	created, err := ad.alerts.AddSilence(silence)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (ad *AdminDashboard) removeSilence(w http.ResponseWriter, r *http.Request) {
+	if !ad.alerts.RemoveSilence(r.URL.Query().Get("id")) {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (ad *AdminDashboard) handleServiceToggle(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -441,13 +571,6 @@ func (ad *AdminDashboard) handleCacheClear(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(response)
 }
 
-func (ad *AdminDashboard) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// WebSocket implementation would go here
-	// For this example, we'll return a simple response
-	w.WriteHeader(http.StatusNotImplemented)
-	w.Write([]byte("WebSocket not implemented in this example"))
-}
-
 func (ad *AdminDashboard) getDashboardData() *DashboardData {
 	return &DashboardData{
 		Timestamp:     time.Now(),
@@ -556,20 +679,7 @@ func (ad *AdminDashboard) getRecentEvents() []SystemEvent {
 }
 
 func (ad *AdminDashboard) getActiveAlerts() []Alert {
-	alerts := []Alert{
-		{
-			ID:          "alert-001",
-			Timestamp:   time.Now().Add(-15 * time.Minute),
-			Type:        AlertPerformance,
-			Severity:    AlertSeverityMedium,
-			Title:       "High Response Time",
-			Description: "Average response time exceeded threshold",
-			Source:      "metrics-collector",
-			Status:      AlertStatusActive,
-		},
-	}
-	
-	return alerts
+	return ad.alerts.Alerts()
 }
 
 func (ad *AdminDashboard) toggleService(serviceName, action string) bool {
@@ -592,29 +702,41 @@ func (ad *AdminDashboard) clearCache() bool {
 	return true
 }
 
-func (ad *AdminDashboard) broadcastLoop() {
+func (ad *AdminDashboard) broadcastLoop(stopCh chan struct{}) {
 	ticker := time.NewTicker(ad.config.UpdateInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			if ad.running {
-				ad.broadcastUpdates()
-			}
+			ad.broadcastUpdates()
+		case <-stopCh:
+			return
 		}
 	}
 }
 
 func (ad *AdminDashboard) broadcastUpdates() {
-	data := ad.getDashboardData()
-	jsonData, _ := json.Marshal(data)
-
 	ad.mutex.RLock()
-	for _, conn := range ad.websockets {
-		conn.conn.WriteMessage(1, jsonData)
+	connections := make(map[string]*WebSocketConnection, len(ad.websockets))
+	for id, wsConn := range ad.websockets {
+		// Connections still completing the handshake have no conn yet
+		if wsConn.conn != nil {
+			connections[id] = wsConn
+		}
 	}
 	ad.mutex.RUnlock()
+
+	if len(connections) == 0 {
+		return
+	}
+
+	payloads := ad.topicPayloads()
+	for id, wsConn := range connections {
+		if err := ad.pushTo(wsConn, payloads); err != nil {
+			ad.removeWebSocket(id)
+		}
+	}
 }
 
 func (ad *AdminDashboard) corsMiddleware(next http.Handler) http.Handler {
@@ -706,23 +828,24 @@ const dashboardHTML = `
         <div class="header">
             <h1>MarchProxy Admin Dashboard</h1>
             <p>Real-time monitoring and management interface</p>
+            <p id="alert-summary">{{len .Alerts}} active alerts, {{len .RecentEvents}} recent events</p>
         </div>
         
         <div class="stats">
             <div class="stat-card">
-                <div class="stat-value">{{.Metrics.TotalRequests}}</div>
+                <div class="stat-value" id="total-requests">{{.Metrics.TotalRequests}}</div>
                 <div class="stat-label">Total Requests</div>
             </div>
             <div class="stat-card">
-                <div class="stat-value">{{printf "%.1f" .Metrics.RequestsPerSecond}}</div>
+                <div class="stat-value" id="requests-per-second">{{printf "%.1f" .Metrics.RequestsPerSecond}}</div>
                 <div class="stat-label">Requests/Second</div>
             </div>
             <div class="stat-card">
-                <div class="stat-value">{{.Metrics.AverageResponseTime}}</div>
+                <div class="stat-value" id="average-response-time">{{.Metrics.AverageResponseTime}}</div>
                 <div class="stat-label">Avg Response Time</div>
             </div>
             <div class="stat-card">
-                <div class="stat-value">{{printf "%.2f%%" .Metrics.ErrorRate}}</div>
+                <div class="stat-value" id="error-rate">{{printf "%.2f%%" .Metrics.ErrorRate}}</div>
                 <div class="stat-label">Error Rate</div>
             </div>
         </div>
@@ -764,10 +887,46 @@ const dashboardHTML = `
     </div>
     
     <script>
-        // Auto-refresh every 5 seconds
-        setInterval(function() {
-            location.reload();
-        }, 5000);
+        // Live updates over /ws, falling back to a full reload if the socket is unavailable
+        var alertCount = {{len .Alerts}}, eventCount = {{len .RecentEvents}};
+
+        function render(msg) {
+            if (msg.topic === "metrics") {
+                var m = msg.data;
+                document.getElementById("total-requests").textContent = m.total_requests;
+                document.getElementById("requests-per-second").textContent = m.requests_per_second.toFixed(1);
+                document.getElementById("average-response-time").textContent = (m.average_response_time / 1e6).toFixed(0) + "ms";
+                document.getElementById("error-rate").textContent = m.error_rate.toFixed(2) + "%";
+                return;
+            }
+            if (msg.topic === "alerts") {
+                alertCount = (msg.data || []).length;
+            } else if (msg.topic === "events") {
+                eventCount = (msg.data || []).length;
+            }
+            document.getElementById("alert-summary").textContent = alertCount + " active alerts, " + eventCount + " recent events";
+        }
+
+        function connect() {
+            var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+            var ws = new WebSocket(scheme + location.host + "/ws?topics=metrics,events,alerts");
+            var opened = false;
+            ws.onopen = function() { opened = true; };
+            ws.onmessage = function(e) { render(JSON.parse(e.data)); };
+            ws.onclose = function() {
+                if (opened) {
+                    setTimeout(connect, 5000);
+                } else {
+                    setTimeout(function() { location.reload(); }, 5000);
+                }
+            };
+        }
+
+        if (window.WebSocket) {
+            connect();
+        } else {
+            setInterval(function() { location.reload(); }, 5000);
+        }
     </script>
 </body>
 </html>
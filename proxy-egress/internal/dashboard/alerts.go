@@ -0,0 +1,557 @@
+package dashboard
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MarchProxy/proxy/internal/certs"
+	"github.com/MarchProxy/proxy/internal/health"
+	"github.com/MarchProxy/proxy/internal/slo"
+)
+
+// RuleKind selects what an AlertRule evaluates
+type RuleKind string
+
+const (
+	RuleMetricThreshold RuleKind = "metric_threshold"
+	RuleHealthState     RuleKind = "health_state"
+	RuleCertExpiry      RuleKind = "cert_expiry"
+	RuleSLOBurnRate     RuleKind = "slo_burn_rate"
+)
+
+// AlertRule defines when an alert fires
+type AlertRule struct {
+	Name        string
+	Kind        RuleKind
+	Severity    AlertSeverity
+	Description string
+
+	// Metric threshold rules compare a dashboard metric against Threshold
+	Metric    string        // e.g. error_rate, requests_per_second, average_response_time_ms
+	Operator  string        // >, >=, <, <=
+	Threshold float64       // Value the metric is compared against
+	For       time.Duration // How long the condition must hold before firing
+
+	// Health state rules fire for services in one of States
+	Service string                // Service key, empty matches every service
+	States  []health.HealthStatus // Defaults to unhealthy
+
+	// Cert expiry rules fire when CertFile expires within ExpiryWindow. An
+	// empty CertFile checks every certificate the proxy has loaded.
+	CertFile     string
+	ExpiryWindow time.Duration
+
+	// SLO burn rate rules fire for mapping objectives spending their error
+	// budget too fast. An empty Mapping matches every mapping and an empty
+	// BurnWindow both the fast and slow burn alerts.
+	Mapping    string
+	BurnWindow string // fast or slow
+}
+
+// AlertingConfig configures the alert engine and its notification channels
+type AlertingConfig struct {
+	Enabled            bool
+	Rules              []AlertRule
+	EvaluationInterval time.Duration
+	RepeatInterval     time.Duration // Re-notify while an alert stays active, 0 disables
+	HistorySize        int           // Resolved alerts kept for the dashboard
+	Webhook            WebhookConfig
+	Slack              SlackConfig
+	Email              EmailConfig
+}
+
+// Silence suppresses notifications for matching alerts until EndsAt
+type Silence struct {
+	ID        string    `json:"id"`
+	RuleName  string    `json:"rule_name"`
+	Subject   string    `json:"subject,omitempty"` // Empty matches every subject of the rule
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedBy string    `json:"created_by"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// matches reports whether the silence applies to an alert at now
+func (s *Silence) matches(ruleName, subject string, now time.Time) bool {
+	if now.Before(s.StartsAt) || !now.Before(s.EndsAt) {
+		return false
+	}
+	return s.RuleName == ruleName && (s.Subject == "" || s.Subject == subject)
+}
+
+// ruleResult is one firing subject produced by evaluating a rule
+type ruleResult struct {
+	subject     string
+	description string
+	data        map[string]interface{}
+}
+
+// alertState tracks one rule/subject pair across evaluations
+type alertState struct {
+	alert        Alert
+	rule         *AlertRule
+	subject      string
+	notifiedAt   time.Time
+	pendingSince time.Time
+	firing       bool
+}
+
+// AlertEngine evaluates alert rules, tracks active alerts and sends
+// deduplicated notifications
+type AlertEngine struct {
+	config      AlertingConfig
+	notifiers   []Notifier
+	states      map[string]*alertState
+	history     []Alert
+	silences    map[string]*Silence
+	notifyStats map[string]*NotificationStats
+	nextID      uint64
+	mutex       sync.RWMutex
+}
+
+// NewAlertEngine validates the rules and creates an engine
+func NewAlertEngine(config AlertingConfig) (*AlertEngine, error) {
+	if config.EvaluationInterval == 0 {
+		config.EvaluationInterval = 30 * time.Second
+	}
+	if config.HistorySize == 0 {
+		config.HistorySize = 100
+	}
+
+	seen := make(map[string]bool)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if err := validateRule(rule); err != nil {
+			return nil, err
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %s", rule.Name)
+		}
+		seen[rule.Name] = true
+	}
+
+	return &AlertEngine{
+		config:      config,
+		notifiers:   newNotifiers(config),
+		states:      make(map[string]*alertState),
+		silences:    make(map[string]*Silence),
+		notifyStats: make(map[string]*NotificationStats),
+	}, nil
+}
+
+func validateRule(rule *AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("alert rule without name")
+	}
+	if rule.Severity == "" {
+		rule.Severity = AlertSeverityMedium
+	}
+
+	switch rule.Kind {
+	case RuleMetricThreshold:
+		if _, ok := metricValue(DashboardMetrics{}, rule.Metric); !ok {
+			return fmt.Errorf("alert rule %s: unknown metric %q", rule.Name, rule.Metric)
+		}
+		if _, ok := compareThreshold(0, rule.Operator, 0); !ok {
+			return fmt.Errorf("alert rule %s: invalid operator %q", rule.Name, rule.Operator)
+		}
+	case RuleHealthState:
+		if len(rule.States) == 0 {
+			rule.States = []health.HealthStatus{health.StatusUnhealthy}
+		}
+	case RuleCertExpiry:
+		if rule.ExpiryWindow <= 0 {
+			return fmt.Errorf("alert rule %s: a positive expiry window is required", rule.Name)
+		}
+	case RuleSLOBurnRate:
+		switch rule.BurnWindow {
+		case "", slo.BurnFast, slo.BurnSlow:
+		default:
+			return fmt.Errorf("alert rule %s: invalid burn window %q", rule.Name, rule.BurnWindow)
+		}
+	default:
+		return fmt.Errorf("alert rule %s: unknown kind %q", rule.Name, rule.Kind)
+	}
+	return nil
+}
+
+// metricValue returns the named dashboard metric
+func metricValue(m DashboardMetrics, name string) (float64, bool) {
+	switch name {
+	case "total_requests":
+		return float64(m.TotalRequests), true
+	case "requests_per_second":
+		return m.RequestsPerSecond, true
+	case "average_response_time_ms":
+		return float64(m.AverageResponseTime) / float64(time.Millisecond), true
+	case "error_rate":
+		return m.ErrorRate, true
+	case "active_connections":
+		return float64(m.ActiveConnections), true
+	case "memory_usage":
+		return float64(m.MemoryUsage), true
+	case "cpu_usage":
+		return m.CPUUsage, true
+	case "cache_hit_rate":
+		return m.CacheHitRate, true
+	case "circuit_breaker_trips":
+		return float64(m.CircuitBreakerTrips), true
+	case "rate_limit_blocks":
+		return float64(m.RateLimitBlocks), true
+	case "security_blocks":
+		return float64(m.SecurityBlocks), true
+	}
+	return 0, false
+}
+
+// compareThreshold applies operator, reporting false for unknown operators
+func compareThreshold(value float64, operator string, threshold float64) (result bool, ok bool) {
+	switch operator {
+	case ">":
+		return value > threshold, true
+	case ">=":
+		return value >= threshold, true
+	case "<":
+		return value < threshold, true
+	case "<=":
+		return value <= threshold, true
+	}
+	return false, false
+}
+
+// evaluateRule returns the subjects for which rule currently holds
+func evaluateRule(rule *AlertRule, metrics DashboardMetrics, systemHealth *health.SystemHealth, now time.Time) []ruleResult {
+	switch rule.Kind {
+	case RuleMetricThreshold:
+		value, _ := metricValue(metrics, rule.Metric)
+		if holds, _ := compareThreshold(value, rule.Operator, rule.Threshold); holds {
+			return []ruleResult{{
+				subject:     rule.Metric,
+				description: fmt.Sprintf("%s is %.2f (%s %.2f)", rule.Metric, value, rule.Operator, rule.Threshold),
+				data:        map[string]interface{}{"value": value, "threshold": rule.Threshold},
+			}}
+		}
+
+	case RuleHealthState:
+		if systemHealth == nil {
+			return nil
+		}
+		var results []ruleResult
+		for key, service := range systemHealth.Services {
+			if rule.Service != "" && rule.Service != key {
+				continue
+			}
+			for _, state := range rule.States {
+				if service.Status == state {
+					results = append(results, ruleResult{
+						subject:     key,
+						description: fmt.Sprintf("service %s is %s", key, service.Status),
+						data: map[string]interface{}{
+							"status":               service.Status,
+							"consecutive_failures": service.ConsecutiveFailures,
+							"error":                service.ErrorMessage,
+						},
+					})
+					break
+				}
+			}
+		}
+		return results
+
+	case RuleCertExpiry:
+		if rule.CertFile == "" {
+			var results []ruleResult
+			for _, entry := range certs.Default.Expiring(now, rule.ExpiryWindow) {
+				results = append(results, ruleResult{
+					subject: entry.Key(),
+					description: fmt.Sprintf("%s %s certificate %s expires %s (in %.1f days)",
+						entry.Source, entry.Role, entry.Subject, entry.NotAfter.Format(time.RFC3339), entry.DaysToExpiry(now)),
+					data: map[string]interface{}{
+						"not_after":   entry.NotAfter,
+						"serial":      entry.Serial,
+						"path":        entry.Path,
+						"fingerprint": entry.Fingerprint,
+					},
+				})
+			}
+			return results
+		}
+
+		notAfter, err := certificateExpiry(rule.CertFile)
+		if err != nil {
+			return []ruleResult{{
+				subject:     rule.CertFile,
+				description: fmt.Sprintf("cannot read certificate %s: %v", rule.CertFile, err),
+			}}
+		}
+		if remaining := notAfter.Sub(now); remaining < rule.ExpiryWindow {
+			return []ruleResult{{
+				subject:     rule.CertFile,
+				description: fmt.Sprintf("certificate %s expires %s (in %s)", rule.CertFile, notAfter.Format(time.RFC3339), remaining.Truncate(time.Minute)),
+				data:        map[string]interface{}{"not_after": notAfter},
+			}}
+		}
+
+	case RuleSLOBurnRate:
+		var results []ruleResult
+		for _, burn := range slo.Default.Burning(now) {
+			if (rule.Mapping != "" && rule.Mapping != burn.Mapping) || (rule.BurnWindow != "" && rule.BurnWindow != burn.Window) {
+				continue
+			}
+			results = append(results, ruleResult{
+				subject: burn.Mapping + "/" + burn.Objective + "/" + burn.Window,
+				description: fmt.Sprintf("mapping %s SLO %s is burning its error budget %.1fx too fast (%s burn, %.1fx short window)",
+					burn.Mapping, burn.Objective, burn.LongRate, burn.Window, burn.ShortRate),
+				data: map[string]interface{}{
+					"mapping":         burn.Mapping,
+					"objective":       burn.Objective,
+					"window":          burn.Window,
+					"burn_rate":       burn.LongRate,
+					"short_burn_rate": burn.ShortRate,
+					"threshold":       burn.Factor,
+				},
+			})
+		}
+		return results
+	}
+	return nil
+}
+
+// certificateExpiry returns NotAfter of the first certificate in a PEM file
+func certificateExpiry(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, fmt.Errorf("no certificate found")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cert.NotAfter, nil
+	}
+}
+
+// alertType maps a rule kind to the dashboard alert type
+func alertType(kind RuleKind) AlertType {
+	switch kind {
+	case RuleHealthState:
+		return AlertHealthCheck
+	case RuleCertExpiry:
+		return AlertSecurity
+	}
+	return AlertPerformance
+}
+
+// Evaluate runs every rule, opening, resolving and notifying alerts
+func (e *AlertEngine) Evaluate(now time.Time, metrics DashboardMetrics, systemHealth *health.SystemHealth) {
+	var pending []Alert
+
+	e.mutex.Lock()
+	seen := make(map[string]bool)
+	for i := range e.config.Rules {
+		rule := &e.config.Rules[i]
+		for _, result := range evaluateRule(rule, metrics, systemHealth, now) {
+			key := rule.Name + "/" + result.subject
+			seen[key] = true
+
+			state, exists := e.states[key]
+			if !exists {
+				state = &alertState{rule: rule, subject: result.subject, pendingSince: now}
+				e.states[key] = state
+			}
+			if !state.firing && now.Sub(state.pendingSince) < rule.For {
+				continue
+			}
+
+			if !state.firing {
+				e.nextID++
+				state.firing = true
+				state.alert = Alert{
+					ID:        fmt.Sprintf("alert-%d", e.nextID),
+					Timestamp: now,
+					Type:      alertType(rule.Kind),
+					Severity:  rule.Severity,
+					Title:     rule.Name,
+					Source:    result.subject,
+				}
+			}
+			state.alert.Description = result.description
+			if rule.Description != "" {
+				state.alert.Description = rule.Description + ": " + result.description
+			}
+			state.alert.Data = result.data
+
+			state.alert.Status = AlertStatusActive
+			if e.silencedLocked(rule.Name, result.subject, now) {
+				state.alert.Status = AlertStatusSuppressed
+				continue
+			}
+
+			// Notify once when the alert opens, then only every RepeatInterval
+			if state.notifiedAt.IsZero() ||
+				(e.config.RepeatInterval > 0 && now.Sub(state.notifiedAt) >= e.config.RepeatInterval) {
+				state.notifiedAt = now
+				pending = append(pending, state.alert)
+			}
+		}
+	}
+
+	for key, state := range e.states {
+		if seen[key] {
+			continue
+		}
+		delete(e.states, key)
+		if !state.firing {
+			continue
+		}
+
+		resolved := state.alert
+		resolved.Status = AlertStatusResolved
+		resolved.Timestamp = now
+		e.history = append(e.history, resolved)
+		if len(e.history) > e.config.HistorySize {
+			e.history = e.history[len(e.history)-e.config.HistorySize:]
+		}
+
+		// Only announce resolution of alerts that were announced
+		if !state.notifiedAt.IsZero() {
+			pending = append(pending, resolved)
+		}
+	}
+	e.mutex.Unlock()
+
+	if len(pending) > 0 {
+		go e.notify(pending)
+	}
+}
+
+// Alerts returns active and silenced alerts, most severe and newest first
+func (e *AlertEngine) Alerts() []Alert {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	alerts := make([]Alert, 0, len(e.states))
+	for _, state := range e.states {
+		if state.firing {
+			alerts = append(alerts, state.alert)
+		}
+	}
+
+	rank := map[AlertSeverity]int{AlertSeverityCritical: 4, AlertSeverityHigh: 3, AlertSeverityMedium: 2, AlertSeverityLow: 1}
+	sort.Slice(alerts, func(i, j int) bool {
+		if rank[alerts[i].Severity] != rank[alerts[j].Severity] {
+			return rank[alerts[i].Severity] > rank[alerts[j].Severity]
+		}
+		return alerts[i].Timestamp.After(alerts[j].Timestamp)
+	})
+	return alerts
+}
+
+// History returns recently resolved alerts, newest first
+func (e *AlertEngine) History() []Alert {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	history := make([]Alert, len(e.history))
+	for i, alert := range e.history {
+		history[len(e.history)-1-i] = alert
+	}
+	return history
+}
+
+// AddSilence registers a silence and applies it to matching active alerts
+func (e *AlertEngine) AddSilence(silence Silence) (Silence, error) {
+	if silence.RuleName == "" {
+		return Silence{}, fmt.Errorf("rule_name is required")
+	}
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = time.Now()
+	}
+	if !silence.EndsAt.After(silence.StartsAt) {
+		return Silence{}, fmt.Errorf("ends_at must be after starts_at")
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.nextID++
+	silence.ID = fmt.Sprintf("silence-%d", e.nextID)
+	e.silences[silence.ID] = &silence
+
+	now := time.Now()
+	for _, state := range e.states {
+		if state.firing && silence.matches(state.rule.Name, state.subject, now) {
+			state.alert.Status = AlertStatusSuppressed
+		}
+	}
+	return silence, nil
+}
+
+// RemoveSilence expires a silence, returning false if it does not exist
+func (e *AlertEngine) RemoveSilence(id string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, exists := e.silences[id]; !exists {
+		return false
+	}
+	delete(e.silences, id)
+	return true
+}
+
+// Silences returns the silences that have not ended
+func (e *AlertEngine) Silences() []Silence {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	silences := make([]Silence, 0, len(e.silences))
+	for id, silence := range e.silences {
+		if !now.Before(silence.EndsAt) {
+			delete(e.silences, id)
+			continue
+		}
+		silences = append(silences, *silence)
+	}
+	sort.Slice(silences, func(i, j int) bool { return silences[i].EndsAt.Before(silences[j].EndsAt) })
+	return silences
+}
+
+func (e *AlertEngine) silencedLocked(ruleName, subject string, now time.Time) bool {
+	for _, silence := range e.silences {
+		if silence.matches(ruleName, subject, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run evaluates rules every EvaluationInterval until stopCh is closed
+func (e *AlertEngine) Run(stopCh chan struct{}, metrics func() DashboardMetrics, systemHealth func() *health.SystemHealth) {
+	ticker := time.NewTicker(e.config.EvaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.Evaluate(time.Now(), metrics(), systemHealth())
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package dashboard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarchProxy/proxy/internal/health"
+)
+
+// errorRateRule fires when the error rate goes over 5%
+var errorRateRule = AlertRule{
+	Name:      "high-error-rate",
+	Kind:      RuleMetricThreshold,
+	Severity:  AlertSeverityHigh,
+	Metric:    "error_rate",
+	Operator:  ">",
+	Threshold: 5,
+}
+
+func TestNewAlertEngineValidation(t *testing.T) {
+	for want, rules := range map[string][]AlertRule{
+		"without name":             {{Kind: RuleHealthState}},
+		"duplicate alert rule":     {{Name: "a", Kind: RuleHealthState}, {Name: "a", Kind: RuleHealthState}},
+		`unknown metric "latency"`: {{Name: "a", Kind: RuleMetricThreshold, Metric: "latency", Operator: ">"}},
+		`invalid operator "=="`:    {{Name: "a", Kind: RuleMetricThreshold, Metric: "error_rate", Operator: "=="}},
+		"positive expiry window":   {{Name: "a", Kind: RuleCertExpiry}},
+		`invalid burn window "x"`:  {{Name: "a", Kind: RuleSLOBurnRate, BurnWindow: "x"}},
+		`unknown kind "uptime"`:    {{Name: "a", Kind: "uptime"}},
+	} {
+		if _, err := NewAlertEngine(AlertingConfig{Rules: rules}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%+v: error %v, want %q", rules, err, want)
+		}
+	}
+
+	e, err := NewAlertEngine(AlertingConfig{Rules: []AlertRule{{Name: "down", Kind: RuleHealthState}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := e.config.Rules[0]
+	if rule.Severity != AlertSeverityMedium || len(rule.States) != 1 || rule.States[0] != health.StatusUnhealthy {
+		t.Errorf("defaults not applied: %+v", rule)
+	}
+	if e.config.EvaluationInterval != 30*time.Second || e.config.HistorySize != 100 {
+		t.Errorf("engine defaults %v, %d", e.config.EvaluationInterval, e.config.HistorySize)
+	}
+}
+
+func TestEvaluateMetricThreshold(t *testing.T) {
+	for _, c := range []struct {
+		operator string
+		value    float64
+		want     bool
+	}{
+		{">", 5.5, true},
+		{">", 5, false},
+		{">=", 5, true},
+		{"<", 4.9, true},
+		{"<", 5, false},
+		{"<=", 5, true},
+	} {
+		rule := AlertRule{Name: "rate", Kind: RuleMetricThreshold, Metric: "error_rate", Operator: c.operator, Threshold: 5}
+		results := evaluateRule(&rule, DashboardMetrics{ErrorRate: c.value}, nil, time.Now())
+		if got := len(results) == 1; got != c.want {
+			t.Errorf("%v %s 5 fired %t, want %t", c.value, c.operator, got, c.want)
+		}
+	}
+
+	// Durations are compared in milliseconds
+	rule := AlertRule{Name: "slow", Kind: RuleMetricThreshold, Metric: "average_response_time_ms", Operator: ">", Threshold: 250}
+	results := evaluateRule(&rule, DashboardMetrics{AverageResponseTime: 300 * time.Millisecond}, nil, time.Now())
+	if len(results) != 1 || results[0].subject != "average_response_time_ms" || results[0].data["value"] != 300.0 {
+		t.Errorf("response time results %+v", results)
+	}
+}
+
+func TestEvaluateHealthState(t *testing.T) {
+	systemHealth := &health.SystemHealth{Services: map[string]health.ServiceHealthSummary{
+		"api":     {Status: health.StatusUnhealthy, ConsecutiveFailures: 3, ErrorMessage: "connection refused"},
+		"billing": {Status: health.StatusDegraded},
+		"search":  {Status: health.StatusHealthy},
+	}}
+
+	for _, c := range []struct {
+		rule AlertRule
+		want []string
+	}{
+		{AlertRule{States: []health.HealthStatus{health.StatusUnhealthy}}, []string{"api"}},
+		{AlertRule{States: []health.HealthStatus{health.StatusUnhealthy, health.StatusDegraded}}, []string{"api", "billing"}},
+		{AlertRule{Service: "billing", States: []health.HealthStatus{health.StatusUnhealthy}}, nil},
+		{AlertRule{Service: "billing", States: []health.HealthStatus{health.StatusDegraded}}, []string{"billing"}},
+	} {
+		c.rule.Kind = RuleHealthState
+		var subjects []string
+		for _, result := range evaluateRule(&c.rule, DashboardMetrics{}, systemHealth, time.Now()) {
+			subjects = append(subjects, result.subject)
+		}
+		sort.Strings(subjects)
+		if strings.Join(subjects, ",") != strings.Join(c.want, ",") {
+			t.Errorf("service %q states %v fired for %v, want %v", c.rule.Service, c.rule.States, subjects, c.want)
+		}
+	}
+
+	rule := AlertRule{Kind: RuleHealthState, States: []health.HealthStatus{health.StatusUnhealthy}}
+	results := evaluateRule(&rule, DashboardMetrics{}, systemHealth, time.Now())
+	if len(results) != 1 || results[0].data["consecutive_failures"] != 3 || results[0].data["error"] != "connection refused" {
+		t.Errorf("unhealthy results %+v", results)
+	}
+	if results := evaluateRule(&rule, DashboardMetrics{}, nil, time.Now()); results != nil {
+		t.Errorf("fired without health data: %+v", results)
+	}
+}
+
+func TestEvaluateCertExpiry(t *testing.T) {
+	now := time.Now()
+	path := writeTestCertificate(t, now.Add(24*time.Hour))
+
+	for window, want := range map[time.Duration]bool{
+		48 * time.Hour: true,
+		time.Hour:      false,
+	} {
+		rule := AlertRule{Name: "cert", Kind: RuleCertExpiry, CertFile: path, ExpiryWindow: window}
+		results := evaluateRule(&rule, DashboardMetrics{}, nil, now)
+		if got := len(results) == 1; got != want {
+			t.Errorf("window %s fired %t, want %t", window, got, want)
+		}
+		if want && (results[0].subject != path || !strings.Contains(results[0].description, "expires")) {
+			t.Errorf("window %s result %+v", window, results[0])
+		}
+	}
+
+	// An unreadable certificate is reported rather than ignored
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	rule := AlertRule{Name: "cert", Kind: RuleCertExpiry, CertFile: missing, ExpiryWindow: time.Hour}
+	results := evaluateRule(&rule, DashboardMetrics{}, nil, now)
+	if len(results) != 1 || !strings.Contains(results[0].description, "cannot read certificate") {
+		t.Errorf("missing certificate results %+v", results)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate expiring at
+// notAfter, preceded by its key, and returns its path
+func writeTestCertificate(t *testing.T, notAfter time.Time) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.example.com"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	path := filepath.Join(t.TempDir(), "proxy.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAlertLifecycle(t *testing.T) {
+	receiver := newWebhookReceiver(t, 0)
+	rule := errorRateRule
+	rule.For = time.Minute
+	e, err := NewAlertEngine(AlertingConfig{
+		Rules:          []AlertRule{rule},
+		RepeatInterval: time.Hour,
+		Webhook:        WebhookConfig{URL: receiver.server.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	failing := DashboardMetrics{ErrorRate: 12}
+
+	// The condition must hold for the rule's For duration before firing
+	e.Evaluate(start, failing, nil)
+	if alerts := e.Alerts(); len(alerts) != 0 {
+		t.Fatalf("pending alert reported: %+v", alerts)
+	}
+	e.Evaluate(start.Add(time.Minute), failing, nil)
+	alerts := e.Alerts()
+	if len(alerts) != 1 || alerts[0].Status != AlertStatusActive || alerts[0].Title != rule.Name || alerts[0].Severity != AlertSeverityHigh {
+		t.Fatalf("alerts after For elapsed: %+v", alerts)
+	}
+	waitNotified(t, e, "webhook", 1)
+
+	// Notifications are deduplicated until the repeat interval passes
+	e.Evaluate(start.Add(2*time.Minute), failing, nil)
+	e.Evaluate(start.Add(61*time.Minute), failing, nil)
+	waitNotified(t, e, "webhook", 2)
+	if id := e.Alerts()[0].ID; id != alerts[0].ID {
+		t.Errorf("alert ID changed from %s to %s while firing", alerts[0].ID, id)
+	}
+
+	// Clearing the condition resolves the alert once
+	e.Evaluate(start.Add(62*time.Minute), DashboardMetrics{}, nil)
+	waitNotified(t, e, "webhook", 3)
+	if alerts := e.Alerts(); len(alerts) != 0 {
+		t.Errorf("alerts after resolution: %+v", alerts)
+	}
+	history := e.History()
+	if len(history) != 1 || history[0].Status != AlertStatusResolved || history[0].ID != alerts[0].ID {
+		t.Errorf("history %+v", history)
+	}
+
+	var statuses []AlertStatus
+	for _, alert := range receiver.alerts() {
+		statuses = append(statuses, alert.Status)
+	}
+	if len(statuses) != 3 || statuses[0] != AlertStatusActive || statuses[1] != AlertStatusActive || statuses[2] != AlertStatusResolved {
+		t.Errorf("webhook received %v", statuses)
+	}
+}
+
+func TestAlertPendingNeverNotifies(t *testing.T) {
+	receiver := newWebhookReceiver(t, 0)
+	rule := errorRateRule
+	rule.For = time.Minute
+	e, err := NewAlertEngine(AlertingConfig{Rules: []AlertRule{rule}, Webhook: WebhookConfig{URL: receiver.server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A condition that clears before For elapses leaves no trace
+	start := time.Now()
+	e.Evaluate(start, DashboardMetrics{ErrorRate: 12}, nil)
+	e.Evaluate(start.Add(30*time.Second), DashboardMetrics{}, nil)
+	e.Evaluate(start.Add(time.Minute), DashboardMetrics{ErrorRate: 12}, nil)
+	if len(e.Alerts()) != 0 || len(e.History()) != 0 || len(e.NotificationStats()) != 0 {
+		t.Errorf("alerts %+v, history %+v, notifications %+v", e.Alerts(), e.History(), e.NotificationStats())
+	}
+}
+
+func TestAlertHistorySize(t *testing.T) {
+	e, err := NewAlertEngine(AlertingConfig{Rules: []AlertRule{errorRateRule}, HistorySize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		e.Evaluate(at, DashboardMetrics{ErrorRate: 12}, nil)
+		e.Evaluate(at.Add(time.Second), DashboardMetrics{}, nil)
+	}
+
+	history := e.History()
+	if len(history) != 2 || !history[0].Timestamp.After(history[1].Timestamp) {
+		t.Fatalf("history %+v", history)
+	}
+	if history[0].ID != "alert-3" || history[1].ID != "alert-2" {
+		t.Errorf("kept %s and %s, want the newest", history[0].ID, history[1].ID)
+	}
+}
+
+func TestAlertsOrder(t *testing.T) {
+	e, err := NewAlertEngine(AlertingConfig{Rules: []AlertRule{
+		{Name: "cpu", Kind: RuleMetricThreshold, Severity: AlertSeverityLow, Metric: "cpu_usage", Operator: ">", Threshold: 50},
+		{Name: "memory", Kind: RuleMetricThreshold, Severity: AlertSeverityLow, Metric: "memory_usage", Operator: ">", Threshold: 50},
+		errorRateRule,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	e.Evaluate(start, DashboardMetrics{CPUUsage: 90}, nil)
+	e.Evaluate(start.Add(time.Minute), DashboardMetrics{CPUUsage: 90, MemoryUsage: 90, ErrorRate: 12}, nil)
+
+	// Most severe first, then newest
+	var titles []string
+	for _, alert := range e.Alerts() {
+		titles = append(titles, alert.Title)
+	}
+	if strings.Join(titles, ",") != "high-error-rate,memory,cpu" {
+		t.Errorf("alerts ordered %v", titles)
+	}
+}
+
+func TestSilences(t *testing.T) {
+	receiver := newWebhookReceiver(t, 0)
+	healthRule := AlertRule{Name: "service-down", Kind: RuleHealthState}
+	e, err := NewAlertEngine(AlertingConfig{
+		Rules:   []AlertRule{errorRateRule, healthRule},
+		Webhook: WebhookConfig{URL: receiver.server.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, invalid := range []Silence{
+		{EndsAt: now.Add(time.Hour)},
+		{RuleName: errorRateRule.Name, StartsAt: now, EndsAt: now},
+	} {
+		if _, err := e.AddSilence(invalid); err == nil {
+			t.Errorf("silence %+v accepted", invalid)
+		}
+	}
+
+	// A silence for one subject leaves the rule's other subjects alone
+	silence, err := e.AddSilence(Silence{RuleName: healthRule.Name, Subject: "api", StartsAt: now, EndsAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &health.SystemHealth{Services: map[string]health.ServiceHealthSummary{
+		"api":     {Status: health.StatusUnhealthy},
+		"billing": {Status: health.StatusUnhealthy},
+	}}
+	e.Evaluate(now, DashboardMetrics{}, down)
+	waitNotified(t, e, "webhook", 1)
+
+	statuses := make(map[string]AlertStatus)
+	for _, alert := range e.Alerts() {
+		statuses[alert.Source] = alert.Status
+	}
+	if statuses["api"] != AlertStatusSuppressed || statuses["billing"] != AlertStatusActive {
+		t.Errorf("alert statuses %v", statuses)
+	}
+	if received := receiver.alerts(); len(received) != 1 || received[0].Source != "billing" {
+		t.Errorf("webhook received %+v", received)
+	}
+
+	// Adding a silence suppresses a firing alert straight away
+	if _, err := e.AddSilence(Silence{RuleName: healthRule.Name, EndsAt: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, alert := range e.Alerts() {
+		if alert.Status != AlertStatusSuppressed {
+			t.Errorf("%s is %s after silencing the rule", alert.Source, alert.Status)
+		}
+	}
+	if silences := e.Silences(); len(silences) != 2 || silences[0].EndsAt.After(silences[1].EndsAt) {
+		t.Errorf("silences %+v", silences)
+	}
+
+	// Removing the silence lets the suppressed alert notify
+	if !e.RemoveSilence(silence.ID) || e.RemoveSilence(silence.ID) {
+		t.Error("RemoveSilence did not remove the silence exactly once")
+	}
+	e.Evaluate(now.Add(2*time.Minute), DashboardMetrics{}, down)
+	waitNotified(t, e, "webhook", 2)
+	if received := receiver.alerts(); len(received) != 2 || received[1].Source != "api" || received[1].Status != AlertStatusActive {
+		t.Errorf("webhook received %+v", received)
+	}
+}
+
+func TestSilenceMatches(t *testing.T) {
+	now := time.Now()
+	silence := Silence{RuleName: "service-down", Subject: "api", StartsAt: now, EndsAt: now.Add(time.Hour)}
+	for _, c := range []struct {
+		rule, subject string
+		at            time.Time
+		want          bool
+	}{
+		{"service-down", "api", now, true},
+		{"service-down", "billing", now, false},
+		{"high-error-rate", "api", now, false},
+		{"service-down", "api", now.Add(-time.Second), false},
+		{"service-down", "api", now.Add(time.Hour), false},
+	} {
+		if got := silence.matches(c.rule, c.subject, c.at); got != c.want {
+			t.Errorf("matches(%s, %s, %s) = %t, want %t", c.rule, c.subject, c.at.Sub(now), got, c.want)
+		}
+	}
+
+	silence.Subject = ""
+	if !silence.matches("service-down", "billing", now) {
+		t.Error("silence without a subject did not match every subject")
+	}
+}
+
+// waitNotified waits until channel has attempted n notifications
+func waitNotified(t *testing.T, e *AlertEngine, channel string, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := e.NotificationStats()[channel]
+		if stats.Sent+stats.Failed == n {
+			return
+		}
+		if stats.Sent+stats.Failed > n || time.Now().After(deadline) {
+			t.Fatalf("%s notifications %+v, want %d", channel, stats, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,714 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigEditorConfig connects the dashboard config editor to the manager API
+type ConfigEditorConfig struct {
+	Enabled    bool
+	ManagerURL string
+	ClusterID  int
+	APIKey     string        // Cluster API key used to read the applied config
+	APIToken   string        // Manager user token used to write mappings
+	Timeout    time.Duration // Per-request timeout for manager calls
+	// OnFreezeChange is called when the config refresh freeze is toggled so
+	// the proxy's refresh loop can stop pulling new configs
+	OnFreezeChange func(frozen bool)
+}
+
+// Draft lifecycle states
+const (
+	DraftOpen      = "draft"
+	DraftValidated = "validated"
+	DraftApplying  = "applying"
+	DraftApplied   = "applied"
+	DraftFailed    = "failed"
+	DraftDiscarded = "discarded"
+)
+
+// Draft change operations
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// MappingSpec is the editable part of a mapping, using the manager's field names
+type MappingSpec struct {
+	ID             int      `json:"id,omitempty"`
+	Name           string   `json:"name"`
+	SourceServices []int    `json:"source_services"`
+	DestServices   []int    `json:"dest_services"`
+	Protocols      []string `json:"protocols"`
+	Ports          string   `json:"ports"`
+	AuthRequired   bool     `json:"auth_required"`
+	Priority       int      `json:"priority"`
+}
+
+// DraftChange is one pending edit to a mapping
+type DraftChange struct {
+	Op        string       `json:"op"`
+	MappingID int          `json:"mapping_id,omitempty"` // Required for update and delete
+	Mapping   *MappingSpec `json:"mapping,omitempty"`    // Required for create and update
+}
+
+// ValidationIssue describes why a draft cannot be applied
+type ValidationIssue struct {
+	Change  int    `json:"change"` // Index into Changes, -1 for the whole draft
+	Message string `json:"message"`
+}
+
+// ChangePreview shows the effect of one change
+type ChangePreview struct {
+	Op     string       `json:"op"`
+	Name   string       `json:"name"`
+	Fields []string     `json:"fields,omitempty"`
+	Before *MappingSpec `json:"before,omitempty"`
+	After  *MappingSpec `json:"after,omitempty"`
+}
+
+// ConfigDraft is a set of changes moving through draft, validate, preview and apply
+type ConfigDraft struct {
+	ID             string            `json:"id"`
+	CreatedBy      string            `json:"created_by"`
+	CreatedAt      time.Time         `json:"created_at"`
+	Comment        string            `json:"comment,omitempty"`
+	Changes        []DraftChange     `json:"changes"`
+	Status         string            `json:"status"`
+	BaseVersion    string            `json:"base_version,omitempty"`
+	ValidatedAt    time.Time         `json:"validated_at,omitempty"`
+	Issues         []ValidationIssue `json:"issues,omitempty"`
+	Preview        []ChangePreview   `json:"preview,omitempty"`
+	ConfirmToken   string            `json:"confirm_token,omitempty"`
+	AppliedBy      string            `json:"applied_by,omitempty"`
+	AppliedAt      time.Time         `json:"applied_at,omitempty"`
+	AppliedChanges int               `json:"applied_changes,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// configSnapshot is the subset of the manager's cluster config the editor checks against
+type configSnapshot struct {
+	Version  string `json:"version"`
+	Services []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"services"`
+	Mappings []MappingSpec `json:"mappings"`
+}
+
+// configEditor stores drafts and talks to the manager
+type configEditor struct {
+	config ConfigEditorConfig
+	client *http.Client
+	drafts map[string]*ConfigDraft
+	frozen atomic.Bool
+	mutex  sync.Mutex
+}
+
+func newConfigEditor(config ConfigEditorConfig) *configEditor {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &configEditor{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		drafts: make(map[string]*ConfigDraft),
+	}
+}
+
+// managerRequest calls the manager API, decoding the JSON response into out
+func (ce *configEditor) managerRequest(ctx context.Context, method, endpoint string, useToken bool, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(ce.config.ManagerURL, "/")+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if useToken {
+		req.Header.Set("Authorization", "Bearer "+ce.config.APIToken)
+	} else {
+		req.Header.Set("X-API-Key", ce.config.APIKey)
+	}
+
+	resp, err := ce.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errManager, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errManager, err)
+	}
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%w: status %d: %s", errManager, resp.StatusCode, apiErr.Error)
+		}
+		return fmt.Errorf("%w: status %d", errManager, resp.StatusCode)
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%w: %v", errManager, err)
+		}
+	}
+	return nil
+}
+
+// fetchSnapshot reads the config currently applied to the cluster
+func (ce *configEditor) fetchSnapshot(ctx context.Context) (*configSnapshot, error) {
+	var snapshot configSnapshot
+	if err := ce.managerRequest(ctx, "GET", fmt.Sprintf("/api/config/%d", ce.config.ClusterID), false, nil, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// createDraft stores a new draft after checking its shape
+func (ce *configEditor) createDraft(createdBy, comment string, changes []DraftChange) (*ConfigDraft, error) {
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("draft has no changes")
+	}
+	for i, change := range changes {
+		switch change.Op {
+		case ChangeCreate:
+			if change.Mapping == nil {
+				return nil, fmt.Errorf("change %d: create requires mapping", i)
+			}
+		case ChangeUpdate:
+			if change.Mapping == nil || change.MappingID == 0 {
+				return nil, fmt.Errorf("change %d: update requires mapping_id and mapping", i)
+			}
+		case ChangeDelete:
+			if change.MappingID == 0 {
+				return nil, fmt.Errorf("change %d: delete requires mapping_id", i)
+			}
+		default:
+			return nil, fmt.Errorf("change %d: unknown op %q", i, change.Op)
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	draft := &ConfigDraft{
+		ID:        "draft-" + hex.EncodeToString(id),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+		Comment:   comment,
+		Changes:   changes,
+		Status:    DraftOpen,
+	}
+
+	ce.mutex.Lock()
+	ce.drafts[draft.ID] = draft
+	ce.mutex.Unlock()
+
+	return draft, nil
+}
+
+// get returns a copy of a draft
+func (ce *configEditor) get(id string) (ConfigDraft, bool) {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+
+	draft, exists := ce.drafts[id]
+	if !exists {
+		return ConfigDraft{}, false
+	}
+	return *draft, true
+}
+
+// list returns every draft, newest first
+func (ce *configEditor) list() []ConfigDraft {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+
+	drafts := make([]ConfigDraft, 0, len(ce.drafts))
+	for _, draft := range ce.drafts {
+		drafts = append(drafts, *draft)
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i].CreatedAt.After(drafts[j].CreatedAt) })
+	return drafts
+}
+
+// validate checks a draft against the manager's current config and, when it
+// passes, stores the preview and a confirmation token for apply
+func (ce *configEditor) validate(ctx context.Context, id string) (ConfigDraft, error) {
+	draft, exists := ce.get(id)
+	if !exists {
+		return ConfigDraft{}, errDraftNotFound
+	}
+	if draft.Status != DraftOpen && draft.Status != DraftValidated {
+		return draft, fmt.Errorf("draft is %s", draft.Status)
+	}
+
+	snapshot, err := ce.fetchSnapshot(ctx)
+	if err != nil {
+		return draft, err
+	}
+
+	issues := validateChanges(snapshot, draft.Changes)
+	preview := previewChanges(snapshot, draft.Changes)
+
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+
+	stored, exists := ce.drafts[id]
+	if !exists {
+		return ConfigDraft{}, errDraftNotFound
+	}
+	stored.BaseVersion = snapshot.Version
+	stored.ValidatedAt = time.Now()
+	stored.Issues = issues
+	stored.Preview = preview
+	stored.ConfirmToken = ""
+	stored.Status = DraftOpen
+	if len(issues) == 0 {
+		token := make([]byte, 8)
+		if _, err := rand.Read(token); err != nil {
+			return *stored, err
+		}
+		stored.ConfirmToken = hex.EncodeToString(token)
+		stored.Status = DraftValidated
+	}
+	return *stored, nil
+}
+
+// apply pushes a validated draft to the manager. confirmToken must match the
+// token returned by the last validation so the caller has seen the preview.
+func (ce *configEditor) apply(ctx context.Context, id, confirmToken, appliedBy string) (ConfigDraft, error) {
+	ce.mutex.Lock()
+	stored, exists := ce.drafts[id]
+	if !exists {
+		ce.mutex.Unlock()
+		return ConfigDraft{}, errDraftNotFound
+	}
+	if stored.Status != DraftValidated {
+		ce.mutex.Unlock()
+		return *stored, fmt.Errorf("draft must be validated before it is applied")
+	}
+	if confirmToken == "" || confirmToken != stored.ConfirmToken {
+		ce.mutex.Unlock()
+		return *stored, fmt.Errorf("confirmation token does not match the last validation")
+	}
+	// Consume the token so a draft cannot be applied twice
+	stored.ConfirmToken = ""
+	stored.Status = DraftApplying
+	draft := *stored
+	ce.mutex.Unlock()
+
+	snapshot, err := ce.fetchSnapshot(ctx)
+	if err == nil && snapshot.Version != draft.BaseVersion {
+		err = fmt.Errorf("cluster config changed from %s to %s since validation, validate again", draft.BaseVersion, snapshot.Version)
+	}
+	if err != nil {
+		ce.mutex.Lock()
+		stored.Status = DraftOpen
+		ce.mutex.Unlock()
+		return draft, err
+	}
+
+	applied := 0
+	for _, change := range draft.Changes {
+		if err = ce.applyChange(ctx, change); err != nil {
+			break
+		}
+		applied++
+	}
+
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+
+	stored.AppliedBy = appliedBy
+	stored.AppliedAt = time.Now()
+	stored.AppliedChanges = applied
+	stored.Status = DraftApplied
+	if err != nil {
+		stored.Status = DraftFailed
+		stored.Error = fmt.Sprintf("change %d: %v", applied, err)
+	}
+	return *stored, err
+}
+
+func (ce *configEditor) applyChange(ctx context.Context, change DraftChange) error {
+	switch change.Op {
+	case ChangeCreate:
+		body := mappingRequest(change.Mapping, ce.config.ClusterID)
+		return ce.managerRequest(ctx, "POST", "/api/mappings", true, body, nil)
+	case ChangeUpdate:
+		body := mappingRequest(change.Mapping, ce.config.ClusterID)
+		return ce.managerRequest(ctx, "PUT", fmt.Sprintf("/api/mappings/%d", change.MappingID), true, body, nil)
+	case ChangeDelete:
+		return ce.managerRequest(ctx, "DELETE", fmt.Sprintf("/api/mappings/%d", change.MappingID), true, nil, nil)
+	}
+	return fmt.Errorf("unknown op %q", change.Op)
+}
+
+// mappingRequest adds the cluster ID the manager's mapping API requires
+func mappingRequest(spec *MappingSpec, clusterID int) map[string]interface{} {
+	return map[string]interface{}{
+		"name":            spec.Name,
+		"cluster_id":      clusterID,
+		"source_services": spec.SourceServices,
+		"dest_services":   spec.DestServices,
+		"protocols":       spec.Protocols,
+		"ports":           spec.Ports,
+		"auth_required":   spec.AuthRequired,
+		"priority":        spec.Priority,
+	}
+}
+
+// discard marks a draft as abandoned
+func (ce *configEditor) discard(id string) error {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+
+	draft, exists := ce.drafts[id]
+	if !exists {
+		return errDraftNotFound
+	}
+	if draft.Status == DraftApplied {
+		return fmt.Errorf("draft already applied")
+	}
+	draft.Status = DraftDiscarded
+	draft.ConfirmToken = ""
+	return nil
+}
+
+// setFrozen toggles the config refresh freeze, reporting whether it changed
+func (ce *configEditor) setFrozen(frozen bool) bool {
+	if ce.frozen.Swap(frozen) == frozen {
+		return false
+	}
+	if ce.config.OnFreezeChange != nil {
+		ce.config.OnFreezeChange(frozen)
+	}
+	return true
+}
+
+var (
+	errDraftNotFound = errors.New("draft not found")
+	errManager       = errors.New("manager API error")
+)
+
+// validateChanges checks each change against the snapshot and the mappings
+// the draft would produce
+func validateChanges(snapshot *configSnapshot, changes []DraftChange) []ValidationIssue {
+	var issues []ValidationIssue
+
+	services := make(map[int]bool, len(snapshot.Services))
+	for _, service := range snapshot.Services {
+		services[service.ID] = true
+	}
+	mappings := make(map[int]bool, len(snapshot.Mappings))
+	for _, mapping := range snapshot.Mappings {
+		mappings[mapping.ID] = true
+	}
+
+	touched := make(map[int]bool)
+	for i, change := range changes {
+		if change.Op != ChangeCreate {
+			if !mappings[change.MappingID] {
+				issues = append(issues, ValidationIssue{Change: i, Message: fmt.Sprintf("mapping %d does not exist", change.MappingID)})
+			}
+			if touched[change.MappingID] {
+				issues = append(issues, ValidationIssue{Change: i, Message: fmt.Sprintf("mapping %d is changed more than once", change.MappingID)})
+			}
+			touched[change.MappingID] = true
+		}
+		if change.Mapping == nil {
+			continue
+		}
+
+		spec := change.Mapping
+		if strings.TrimSpace(spec.Name) == "" {
+			issues = append(issues, ValidationIssue{Change: i, Message: "name is required"})
+		}
+		if len(spec.SourceServices) == 0 || len(spec.DestServices) == 0 {
+			issues = append(issues, ValidationIssue{Change: i, Message: "source_services and dest_services are required"})
+		}
+		for _, id := range append(append([]int{}, spec.SourceServices...), spec.DestServices...) {
+			if !services[id] {
+				issues = append(issues, ValidationIssue{Change: i, Message: fmt.Sprintf("service %d does not exist", id)})
+			}
+		}
+		for _, protocol := range spec.Protocols {
+			if protocol != "tcp" && protocol != "udp" {
+				issues = append(issues, ValidationIssue{Change: i, Message: fmt.Sprintf("unsupported protocol %q", protocol)})
+			}
+		}
+		if err := validatePortSpec(spec.Ports); err != nil {
+			issues = append(issues, ValidationIssue{Change: i, Message: err.Error()})
+		}
+	}
+
+	// Names must stay unique across the resulting mapping set
+	names := make(map[string]int)
+	for _, mapping := range resultingMappings(snapshot, changes) {
+		names[mapping.Name]++
+	}
+	for name, count := range names {
+		if count > 1 && name != "" {
+			issues = append(issues, ValidationIssue{Change: -1, Message: fmt.Sprintf("mapping name %q would be used %d times", name, count)})
+		}
+	}
+
+	return issues
+}
+
+// validatePortSpec accepts a port, a range (a-b) or a comma-separated list of either
+func validatePortSpec(spec string) error {
+	if strings.TrimSpace(spec) == "" {
+		return fmt.Errorf("ports is required")
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil || low < 1 || low > 65535 {
+			return fmt.Errorf("invalid port %q", part)
+		}
+		if len(bounds) == 2 {
+			high, err := strconv.Atoi(bounds[1])
+			if err != nil || high < low || high > 65535 {
+				return fmt.Errorf("invalid port range %q", part)
+			}
+		}
+	}
+	return nil
+}
+
+// resultingMappings applies changes to the snapshot's mappings
+func resultingMappings(snapshot *configSnapshot, changes []DraftChange) []MappingSpec {
+	result := make(map[int]MappingSpec, len(snapshot.Mappings))
+	for _, mapping := range snapshot.Mappings {
+		result[mapping.ID] = mapping
+	}
+
+	var created []MappingSpec
+	for _, change := range changes {
+		switch change.Op {
+		case ChangeCreate:
+			created = append(created, *change.Mapping)
+		case ChangeUpdate:
+			spec := *change.Mapping
+			spec.ID = change.MappingID
+			result[change.MappingID] = spec
+		case ChangeDelete:
+			delete(result, change.MappingID)
+		}
+	}
+
+	mappings := make([]MappingSpec, 0, len(result)+len(created))
+	for _, mapping := range result {
+		mappings = append(mappings, mapping)
+	}
+	return append(mappings, created...)
+}
+
+// previewChanges shows before and after for every change
+func previewChanges(snapshot *configSnapshot, changes []DraftChange) []ChangePreview {
+	existing := make(map[int]MappingSpec, len(snapshot.Mappings))
+	for _, mapping := range snapshot.Mappings {
+		existing[mapping.ID] = mapping
+	}
+
+	previews := make([]ChangePreview, 0, len(changes))
+	for _, change := range changes {
+		preview := ChangePreview{Op: change.Op}
+
+		if before, ok := existing[change.MappingID]; ok && change.Op != ChangeCreate {
+			b := before
+			preview.Before = &b
+			preview.Name = before.Name
+		}
+		if change.Mapping != nil && change.Op != ChangeDelete {
+			after := *change.Mapping
+			after.ID = change.MappingID
+			preview.After = &after
+			preview.Name = after.Name
+		}
+		if preview.Before != nil && preview.After != nil {
+			preview.Fields = changedMappingFields(*preview.Before, *preview.After)
+		}
+
+		previews = append(previews, preview)
+	}
+	return previews
+}
+
+// changedMappingFields returns the JSON names of fields that differ
+func changedMappingFields(before, after MappingSpec) []string {
+	b := reflect.ValueOf(before)
+	a := reflect.ValueOf(after)
+	t := b.Type()
+
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		if !reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			fields = append(fields, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	return fields
+}
+
+// IsConfigRefreshFrozen reports whether an operator froze config refresh
+func (ad *AdminDashboard) IsConfigRefreshFrozen() bool {
+	return ad.editor.frozen.Load()
+}
+
+// handleDrafts serves /api/config/drafts and /api/config/drafts/{id}[/validate|/apply]
+func (ad *AdminDashboard) handleDrafts(w http.ResponseWriter, r *http.Request) {
+	if !ad.config.ConfigEditor.Enabled {
+		http.Error(w, "Config editing is disabled", http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/config/drafts"), "/"), "/")
+	switch {
+	case parts[0] == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, ad.editor.list())
+	case parts[0] == "" && r.Method == "POST":
+		ad.requireRole(RoleOperator, ActionDraftConfig, ad.createDraft)(w, r)
+	case len(parts) == 1 && r.Method == "GET":
+		draft, exists := ad.editor.get(parts[0])
+		if !exists {
+			http.Error(w, errDraftNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, draft)
+	case len(parts) == 1 && r.Method == "DELETE":
+		ad.requireRole(RoleOperator, ActionDiscardDraft, func(w http.ResponseWriter, r *http.Request) {
+			if err := ad.editor.discard(parts[0]); err != nil {
+				http.Error(w, err.Error(), draftErrorStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})(w, r)
+	case len(parts) == 2 && parts[1] == "validate" && r.Method == "POST":
+		ad.requireRole(RoleOperator, ActionValidateDraft, func(w http.ResponseWriter, r *http.Request) {
+			draft, err := ad.editor.validate(r.Context(), parts[0])
+			if err != nil {
+				http.Error(w, err.Error(), draftErrorStatus(err))
+				return
+			}
+			writeJSON(w, http.StatusOK, draft)
+		})(w, r)
+	case len(parts) == 2 && parts[1] == "apply" && r.Method == "POST":
+		ad.requireRole(RoleAdmin, ActionApplyDraft, func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Confirm string `json:"confirm"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			var appliedBy string
+			if sess, ok := sessionFromRequest(r); ok {
+				appliedBy = sess.username
+			}
+			draft, err := ad.editor.apply(r.Context(), parts[0], req.Confirm, appliedBy)
+			if err != nil {
+				writeJSON(w, draftErrorStatus(err), map[string]interface{}{"error": err.Error(), "draft": draft})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"draft":          draft,
+				"refresh_frozen": ad.IsConfigRefreshFrozen(),
+			})
+		})(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (ad *AdminDashboard) createDraft(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Comment string        `json:"comment"`
+		Changes []DraftChange `json:"changes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256*1024)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid draft: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var createdBy string
+	if sess, ok := sessionFromRequest(r); ok {
+		createdBy = sess.username
+	}
+	draft, err := ad.editor.createDraft(createdBy, req.Comment, req.Changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, draft)
+}
+
+// handleConfigFreeze reports or toggles the emergency config refresh freeze
+func (ad *AdminDashboard) handleConfigFreeze(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]bool{"frozen": ad.IsConfigRefreshFrozen()})
+	case "POST":
+		ad.requireRole(RoleAdmin, ActionFreezeConfig, func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Frozen bool `json:"frozen"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+			changed := ad.editor.setFrozen(req.Frozen)
+			writeJSON(w, http.StatusOK, map[string]bool{"frozen": req.Frozen, "changed": changed})
+		})(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func draftErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errDraftNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errManager):
+		return http.StatusBadGateway
+	}
+	return http.StatusConflict
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
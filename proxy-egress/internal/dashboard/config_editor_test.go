@@ -0,0 +1,441 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeManager serves the manager API endpoints the config editor uses
+type fakeManager struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	snapshot configSnapshot
+	calls    []string          // Mapping writes as "METHOD path"
+	bodies   []json.RawMessage // Mapping write bodies
+	fail     string            // A mapping write answered with an error
+}
+
+func newFakeManager(t *testing.T) *fakeManager {
+	t.Helper()
+	m := &fakeManager{}
+	m.snapshot.Version = "v1"
+	m.snapshot.Services = []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}{{ID: 1, Name: "web"}, {ID: 2, Name: "db"}, {ID: 3, Name: "cache"}}
+	m.snapshot.Mappings = []MappingSpec{
+		{ID: 10, Name: "web-to-db", SourceServices: []int{1}, DestServices: []int{2}, Protocols: []string{"tcp"}, Ports: "5432", Priority: 100},
+		{ID: 11, Name: "web-to-cache", SourceServices: []int{1}, DestServices: []int{3}, Protocols: []string{"tcp"}, Ports: "6379", Priority: 100},
+	}
+
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		if r.URL.Path == "/api/config/7" && r.Method == http.MethodGet {
+			if r.Header.Get("X-API-Key") != "cluster-key" {
+				http.Error(w, `{"error": "invalid api key"}`, http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(m.snapshot)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/api/mappings") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer user-token" {
+			http.Error(w, `{"error": "invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+
+		call := r.Method + " " + r.URL.Path
+		m.calls = append(m.calls, call)
+		body, _ := io.ReadAll(r.Body)
+		m.bodies = append(m.bodies, body)
+		if call == m.fail {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error": "port conflict"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *fakeManager) writes() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.calls...)
+}
+
+func (m *fakeManager) setVersion(version string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot.Version = version
+}
+
+func (m *fakeManager) editorConfig() ConfigEditorConfig {
+	return ConfigEditorConfig{
+		Enabled:    true,
+		ManagerURL: m.server.URL + "/",
+		ClusterID:  7,
+		APIKey:     "cluster-key",
+		APIToken:   "user-token",
+	}
+}
+
+// testChanges update one mapping, delete another and create a third
+var testChanges = []DraftChange{
+	{Op: ChangeUpdate, MappingID: 10, Mapping: &MappingSpec{Name: "web-to-db", SourceServices: []int{1}, DestServices: []int{2}, Protocols: []string{"tcp"}, Ports: "5432-5433", Priority: 50}},
+	{Op: ChangeDelete, MappingID: 11},
+	{Op: ChangeCreate, Mapping: &MappingSpec{Name: "web-to-cache-v2", SourceServices: []int{1}, DestServices: []int{3}, Protocols: []string{"tcp", "udp"}, Ports: "6379,6380"}},
+}
+
+// serveJSON sends a JSON body with the session cookie, if any
+func serveJSON(ad *AdminDashboard, method, target string, cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	ad.server.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateDraftShape(t *testing.T) {
+	ce := newConfigEditor(ConfigEditorConfig{})
+	spec := &MappingSpec{Name: "m"}
+	for want, changes := range map[string][]DraftChange{
+		"no changes":                  nil,
+		"create requires mapping":     {{Op: ChangeCreate}},
+		"update requires mapping_id":  {{Op: ChangeUpdate, Mapping: spec}},
+		"delete requires mapping_id":  {{Op: ChangeDelete}},
+		`change 1: unknown op "move"`: {{Op: ChangeDelete, MappingID: 1}, {Op: "move", MappingID: 1}},
+	} {
+		if _, err := ce.createDraft("operator", "", changes); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%+v: error %v, want %q", changes, err, want)
+		}
+	}
+	if drafts := ce.list(); len(drafts) != 0 {
+		t.Errorf("invalid drafts stored: %+v", drafts)
+	}
+
+	draft, err := ce.createDraft("operator", "widen db ports", testChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(draft.ID, "draft-") || draft.Status != DraftOpen || draft.CreatedBy != "operator" || draft.ConfirmToken != "" {
+		t.Errorf("draft %+v", draft)
+	}
+	if stored, ok := ce.get(draft.ID); !ok || stored.Comment != "widen db ports" {
+		t.Errorf("stored draft %+v, %t", stored, ok)
+	}
+}
+
+func TestValidatePortSpec(t *testing.T) {
+	for spec, valid := range map[string]bool{
+		"443":              true,
+		"8000-8080":        true,
+		"80, 443, 8000-":   false,
+		"80,443,8000-9000": true,
+		"":                 false,
+		"0":                false,
+		"65536":            false,
+		"http":             false,
+		"9000-8000":        false,
+		"8000-70000":       false,
+	} {
+		if err := validatePortSpec(spec); (err == nil) != valid {
+			t.Errorf("validatePortSpec(%q) = %v, want valid %t", spec, err, valid)
+		}
+	}
+}
+
+func TestValidateChanges(t *testing.T) {
+	snapshot := &newFakeManager(t).snapshot
+	if issues := validateChanges(snapshot, testChanges); len(issues) != 0 {
+		t.Errorf("valid changes reported %+v", issues)
+	}
+
+	issues := validateChanges(snapshot, []DraftChange{
+		{Op: ChangeDelete, MappingID: 99},
+		{Op: ChangeDelete, MappingID: 10},
+		{Op: ChangeUpdate, MappingID: 10, Mapping: &MappingSpec{Name: "web-to-db", SourceServices: []int{1}, DestServices: []int{2}, Protocols: []string{"tcp"}, Ports: "5432"}},
+		{Op: ChangeCreate, Mapping: &MappingSpec{SourceServices: []int{1}, DestServices: []int{42}, Protocols: []string{"sctp"}, Ports: "0"}},
+		{Op: ChangeCreate, Mapping: &MappingSpec{Name: "web-to-cache", SourceServices: []int{1}}},
+	})
+	want := []ValidationIssue{
+		{0, "mapping 99 does not exist"},
+		{2, "mapping 10 is changed more than once"},
+		{3, "name is required"},
+		{3, "service 42 does not exist"},
+		{3, `unsupported protocol "sctp"`},
+		{3, `invalid port "0"`},
+		{4, "source_services and dest_services are required"},
+		{4, "ports is required"},
+		{-1, `mapping name "web-to-cache" would be used 2 times`},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("issues %+v, want %+v", issues, want)
+	}
+	for i := range want {
+		if issues[i] != want[i] {
+			t.Errorf("issue %d: %+v, want %+v", i, issues[i], want[i])
+		}
+	}
+}
+
+func TestPreviewChanges(t *testing.T) {
+	previews := previewChanges(&newFakeManager(t).snapshot, testChanges)
+	if len(previews) != 3 {
+		t.Fatalf("%d previews, want 3", len(previews))
+	}
+
+	update := previews[0]
+	if update.Op != ChangeUpdate || update.Name != "web-to-db" || update.Before.Ports != "5432" || update.After.Ports != "5432-5433" || update.After.ID != 10 {
+		t.Errorf("update preview %+v", update)
+	}
+	if strings.Join(update.Fields, ",") != "ports,priority" {
+		t.Errorf("changed fields %v, want ports and priority", update.Fields)
+	}
+
+	if remove := previews[1]; remove.Name != "web-to-cache" || remove.Before == nil || remove.After != nil {
+		t.Errorf("delete preview %+v", remove)
+	}
+	if create := previews[2]; create.Name != "web-to-cache-v2" || create.Before != nil || create.After == nil {
+		t.Errorf("create preview %+v", create)
+	}
+}
+
+func TestDraftWorkflow(t *testing.T) {
+	manager := newFakeManager(t)
+	ad := newTestDashboard(t, DashboardConfig{ConfigEditor: manager.editorConfig()})
+	viewer, operator, admin := login(t, ad, "viewer"), login(t, ad, "operator"), login(t, ad, "admin")
+
+	changes, err := json.Marshal(testChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"comment": "widen db ports", "changes": ` + string(changes) + `}`
+	if rec := serveJSON(ad, http.MethodPost, "/api/config/drafts", viewer, body); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer drafting: %d", rec.Code)
+	}
+	rec := serveJSON(ad, http.MethodPost, "/api/config/drafts", operator, body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("operator drafting: %d %s", rec.Code, rec.Body)
+	}
+	var draft ConfigDraft
+	json.NewDecoder(rec.Body).Decode(&draft)
+	if draft.CreatedBy != "operator" || len(draft.Changes) != 3 {
+		t.Errorf("draft %+v", draft)
+	}
+	path := "/api/config/drafts/" + draft.ID
+
+	// Apply is refused until the draft has been validated
+	if rec := serveJSON(ad, http.MethodPost, path+"/apply", admin, `{"confirm": "x"}`); rec.Code != http.StatusConflict {
+		t.Errorf("applying an unvalidated draft: %d", rec.Code)
+	}
+
+	rec = serveJSON(ad, http.MethodPost, path+"/validate", operator, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("validating: %d %s", rec.Code, rec.Body)
+	}
+	json.NewDecoder(rec.Body).Decode(&draft)
+	if draft.Status != DraftValidated || draft.BaseVersion != "v1" || draft.ConfirmToken == "" || len(draft.Preview) != 3 {
+		t.Fatalf("validated draft %+v", draft)
+	}
+
+	// Only admins apply, and only with the token from the last validation
+	confirm := `{"confirm": "` + draft.ConfirmToken + `"}`
+	if rec := serveJSON(ad, http.MethodPost, path+"/apply", operator, confirm); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "config.apply requires admin role") {
+		t.Errorf("operator applying: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serveJSON(ad, http.MethodPost, path+"/apply", admin, `{"confirm": "stale"}`); rec.Code != http.StatusConflict {
+		t.Errorf("applying with a wrong token: %d", rec.Code)
+	}
+	if writes := manager.writes(); len(writes) != 0 {
+		t.Fatalf("refused applies wrote %v", writes)
+	}
+
+	rec = serveJSON(ad, http.MethodPost, path+"/apply", admin, confirm)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("admin applying: %d %s", rec.Code, rec.Body)
+	}
+	var applied struct {
+		Draft         ConfigDraft `json:"draft"`
+		RefreshFrozen bool        `json:"refresh_frozen"`
+	}
+	json.NewDecoder(rec.Body).Decode(&applied)
+	if applied.Draft.Status != DraftApplied || applied.Draft.AppliedBy != "admin" || applied.Draft.AppliedChanges != 3 || applied.Draft.ConfirmToken != "" {
+		t.Errorf("applied draft %+v", applied.Draft)
+	}
+	want := []string{"PUT /api/mappings/10", "DELETE /api/mappings/11", "POST /api/mappings"}
+	if writes := manager.writes(); strings.Join(writes, ",") != strings.Join(want, ",") {
+		t.Errorf("manager writes %v, want %v", writes, want)
+	}
+	var created map[string]interface{}
+	json.Unmarshal(manager.bodies[2], &created)
+	if created["name"] != "web-to-cache-v2" || created["cluster_id"] != 7.0 || created["ports"] != "6379,6380" {
+		t.Errorf("create body %v", created)
+	}
+
+	// The token is consumed, and an applied draft cannot be discarded
+	if rec := serveJSON(ad, http.MethodPost, path+"/apply", admin, confirm); rec.Code != http.StatusConflict {
+		t.Errorf("applying twice: %d", rec.Code)
+	}
+	if rec := serveJSON(ad, http.MethodDelete, path, operator, ""); rec.Code != http.StatusConflict {
+		t.Errorf("discarding an applied draft: %d", rec.Code)
+	}
+	if len(manager.writes()) != 3 {
+		t.Errorf("manager writes %v after the second apply", manager.writes())
+	}
+}
+
+func TestValidateReportsIssues(t *testing.T) {
+	manager := newFakeManager(t)
+	ce := newConfigEditor(manager.editorConfig())
+	draft, err := ce.createDraft("operator", "", []DraftChange{{Op: ChangeDelete, MappingID: 99}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validated, err := ce.validate(context.Background(), draft.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated.Status != DraftOpen || validated.ConfirmToken != "" || len(validated.Issues) != 1 {
+		t.Errorf("draft with issues %+v", validated)
+	}
+	if _, err := ce.apply(context.Background(), draft.ID, "", "admin"); err == nil {
+		t.Error("draft with issues applied")
+	}
+
+	if _, err := ce.validate(context.Background(), "draft-missing"); err != errDraftNotFound {
+		t.Errorf("validating a missing draft: %v", err)
+	}
+	if err := ce.discard(draft.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ce.validate(context.Background(), draft.ID); err == nil || !strings.Contains(err.Error(), "draft is discarded") {
+		t.Errorf("validating a discarded draft: %v", err)
+	}
+}
+
+func TestApplyRejectsChangedCluster(t *testing.T) {
+	manager := newFakeManager(t)
+	ce := newConfigEditor(manager.editorConfig())
+	draft, err := ce.createDraft("operator", "", testChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validated, err := ce.validate(context.Background(), draft.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else changed the cluster between validate and apply
+	manager.setVersion("v2")
+	result, err := ce.apply(context.Background(), draft.ID, validated.ConfirmToken, "admin")
+	if err == nil || !strings.Contains(err.Error(), "changed from v1 to v2") || draftErrorStatus(err) != http.StatusConflict {
+		t.Errorf("apply error %v", err)
+	}
+	if stored, _ := ce.get(draft.ID); stored.Status != DraftOpen || stored.ConfirmToken != "" || result.AppliedChanges != 0 {
+		t.Errorf("draft after a refused apply %+v", stored)
+	}
+	if writes := manager.writes(); len(writes) != 0 {
+		t.Errorf("manager writes %v", writes)
+	}
+
+	// Validating again picks up the new version
+	validated, err = ce.validate(context.Background(), draft.ID)
+	if err != nil || validated.BaseVersion != "v2" {
+		t.Fatalf("revalidated %+v, %v", validated, err)
+	}
+	if _, err := ce.apply(context.Background(), draft.ID, validated.ConfirmToken, "admin"); err != nil {
+		t.Errorf("apply after revalidating: %v", err)
+	}
+}
+
+func TestApplyStopsAtFailedChange(t *testing.T) {
+	manager := newFakeManager(t)
+	manager.fail = "DELETE /api/mappings/11"
+	ce := newConfigEditor(manager.editorConfig())
+	draft, err := ce.createDraft("operator", "", testChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validated, err := ce.validate(context.Background(), draft.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ce.apply(context.Background(), draft.ID, validated.ConfirmToken, "admin")
+	if err == nil || draftErrorStatus(err) != http.StatusBadGateway {
+		t.Fatalf("apply error %v", err)
+	}
+	if result.Status != DraftFailed || result.AppliedChanges != 1 || !strings.Contains(result.Error, "change 1:") || !strings.Contains(result.Error, "port conflict") {
+		t.Errorf("failed draft %+v", result)
+	}
+	if writes := manager.writes(); len(writes) != 2 {
+		t.Errorf("manager writes %v, want the update and the failed delete", writes)
+	}
+}
+
+func TestManagerAuthFailure(t *testing.T) {
+	manager := newFakeManager(t)
+	config := manager.editorConfig()
+	config.APIKey = "wrong"
+	ce := newConfigEditor(config)
+	draft, err := ce.createDraft("operator", "", testChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ce.validate(context.Background(), draft.ID)
+	if err == nil || !strings.Contains(err.Error(), "status 401: invalid api key") || draftErrorStatus(err) != http.StatusBadGateway {
+		t.Errorf("validate error %v", err)
+	}
+}
+
+func TestDraftsDisabled(t *testing.T) {
+	ad := newTestDashboard(t, DashboardConfig{})
+	if rec := serve(ad, http.MethodGet, "/api/config/drafts", login(t, ad, "admin")); rec.Code != http.StatusNotFound {
+		t.Errorf("drafts with the editor disabled: %d", rec.Code)
+	}
+}
+
+func TestConfigFreeze(t *testing.T) {
+	var changes []bool
+	config := ConfigEditorConfig{OnFreezeChange: func(frozen bool) { changes = append(changes, frozen) }}
+	ad := newTestDashboard(t, DashboardConfig{ConfigEditor: config})
+	operator, admin := login(t, ad, "operator"), login(t, ad, "admin")
+
+	if rec := serveJSON(ad, http.MethodPost, "/api/config/freeze", operator, `{"frozen": true}`); rec.Code != http.StatusForbidden {
+		t.Errorf("operator freezing: %d", rec.Code)
+	}
+	for _, frozen := range []bool{true, true, false} {
+		body := `{"frozen": false}`
+		if frozen {
+			body = `{"frozen": true}`
+		}
+		if rec := serveJSON(ad, http.MethodPost, "/api/config/freeze", admin, body); rec.Code != http.StatusOK {
+			t.Errorf("admin setting frozen %t: %d", frozen, rec.Code)
+		}
+	}
+
+	// Repeating a state does not call the hook again
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("freeze changes %v", changes)
+	}
+	if ad.IsConfigRefreshFrozen() {
+		t.Error("refresh still frozen")
+	}
+}
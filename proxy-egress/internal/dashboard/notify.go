@@ -0,0 +1,217 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier delivers alert notifications to an external channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// WebhookConfig posts alerts as JSON to URL
+type WebhookConfig struct {
+	URL     string
+	Headers map[string]string
+}
+
+// SlackConfig posts alerts to a Slack incoming webhook
+type SlackConfig struct {
+	WebhookURL string
+	Channel    string
+}
+
+// EmailConfig sends alerts through an SMTP relay
+type EmailConfig struct {
+	SMTPHost string
+	SMTPPort int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// NotificationStats counts delivery attempts per channel
+type NotificationStats struct {
+	Sent      uint64 `json:"sent"`
+	Failed    uint64 `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+const notifyTimeout = 10 * time.Second
+
+// headerReplacer keeps alert text from breaking out of an email header
+var headerReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// newNotifiers builds a notifier for every configured channel
+func newNotifiers(config AlertingConfig) []Notifier {
+	client := &http.Client{Timeout: notifyTimeout}
+
+	var notifiers []Notifier
+	if config.Webhook.URL != "" {
+		notifiers = append(notifiers, &webhookNotifier{config: config.Webhook, client: client})
+	}
+	if config.Slack.WebhookURL != "" {
+		notifiers = append(notifiers, &slackNotifier{config: config.Slack, client: client})
+	}
+	if config.Email.SMTPHost != "" && len(config.Email.To) > 0 {
+		notifiers = append(notifiers, &emailNotifier{config: config.Email})
+	}
+	return notifiers
+}
+
+// notify delivers alerts on every channel, recording the outcome
+func (e *AlertEngine) notify(alerts []Alert) {
+	for _, notifier := range e.notifiers {
+		for _, alert := range alerts {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			err := notifier.Notify(ctx, alert)
+			cancel()
+			e.recordNotification(notifier.Name(), err)
+		}
+	}
+}
+
+func (e *AlertEngine) recordNotification(channel string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stats, exists := e.notifyStats[channel]
+	if !exists {
+		stats = &NotificationStats{}
+		e.notifyStats[channel] = stats
+	}
+
+	if err != nil {
+		stats.Failed++
+		stats.LastError = err.Error()
+		return
+	}
+	stats.Sent++
+}
+
+// NotificationStats returns delivery counts per channel
+func (e *AlertEngine) NotificationStats() map[string]NotificationStats {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	result := make(map[string]NotificationStats, len(e.notifyStats))
+	for channel, stats := range e.notifyStats {
+		result[channel] = *stats
+	}
+	return result
+}
+
+// alertSummary is the one-line text used by chat and email channels
+func alertSummary(alert Alert) string {
+	return fmt.Sprintf("[%s] %s %s: %s", strings.ToUpper(string(alert.Status)), alert.Severity, alert.Title, alert.Description)
+}
+
+// postJSON sends body to url and treats non-2xx responses as errors
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type webhookNotifier struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+func (n *webhookNotifier) Name() string { return "webhook" }
+
+func (n *webhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, n.client, n.config.URL, n.config.Headers, alert)
+}
+
+type slackNotifier struct {
+	config SlackConfig
+	client *http.Client
+}
+
+func (n *slackNotifier) Name() string { return "slack" }
+
+func (n *slackNotifier) Notify(ctx context.Context, alert Alert) error {
+	message := map[string]string{"text": alertSummary(alert)}
+	if n.config.Channel != "" {
+		message["channel"] = n.config.Channel
+	}
+	return postJSON(ctx, n.client, n.config.WebhookURL, nil, message)
+}
+
+type emailNotifier struct {
+	config EmailConfig
+}
+
+func (n *emailNotifier) Name() string { return "email" }
+
+func (n *emailNotifier) Notify(ctx context.Context, alert Alert) error {
+	port := n.config.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(n.config.SMTPHost, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if n.config.Username != "" {
+		auth = smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.SMTPHost)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.config.To, ", "))
+	fmt.Fprintf(&body, "Subject: MarchProxy alert: %s\r\n", headerReplacer.Replace(alertSummary(alert)))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "Alert:       %s\r\n", alert.Title)
+	fmt.Fprintf(&body, "Status:      %s\r\n", alert.Status)
+	fmt.Fprintf(&body, "Severity:    %s\r\n", alert.Severity)
+	fmt.Fprintf(&body, "Source:      %s\r\n", alert.Source)
+	fmt.Fprintf(&body, "Time:        %s\r\n", alert.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(&body, "Description: %s\r\n", alert.Description)
+
+	// net/smtp has no context support, so bound the send with a goroutine
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, n.config.From, n.config.To, []byte(body.String()))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,191 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the alerts and requests posted to its server
+type webhookReceiver struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	received []Alert
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+// newWebhookReceiver starts a receiver answering with status, or 200 OK
+// when status is 0
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	t.Helper()
+	receiver := &webhookReceiver{}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var alert Alert
+		json.Unmarshal(body, &alert)
+
+		receiver.mutex.Lock()
+		receiver.received = append(receiver.received, alert)
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		receiver.mutex.Unlock()
+
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(receiver.server.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) alerts() []Alert {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Alert(nil), r.received...)
+}
+
+var testAlert = Alert{
+	ID:          "alert-1",
+	Timestamp:   time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	Type:        AlertPerformance,
+	Severity:    AlertSeverityHigh,
+	Title:       "high-error-rate",
+	Description: "error_rate is 12.00 (> 5.00)",
+	Source:      "error_rate",
+	Status:      AlertStatusActive,
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	receiver := newWebhookReceiver(t, 0)
+	notifiers := newNotifiers(AlertingConfig{Webhook: WebhookConfig{
+		URL:     receiver.server.URL,
+		Headers: map[string]string{"Authorization": "Bearer hook-token"},
+	}})
+	if len(notifiers) != 1 || notifiers[0].Name() != "webhook" {
+		t.Fatalf("notifiers %v", notifiers)
+	}
+
+	if err := notifiers[0].Notify(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	received := receiver.alerts()
+	if len(received) != 1 || received[0].ID != testAlert.ID || received[0].Status != AlertStatusActive || !received[0].Timestamp.Equal(testAlert.Timestamp) {
+		t.Fatalf("received %+v", received)
+	}
+	request := receiver.requests[0]
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" || request.Header.Get("Authorization") != "Bearer hook-token" {
+		t.Errorf("request %s with headers %v", request.Method, request.Header)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	receiver := newWebhookReceiver(t, 0)
+	notifiers := newNotifiers(AlertingConfig{Slack: SlackConfig{WebhookURL: receiver.server.URL, Channel: "#oncall"}})
+	if len(notifiers) != 1 || notifiers[0].Name() != "slack" {
+		t.Fatalf("notifiers %v", notifiers)
+	}
+
+	if err := notifiers[0].Notify(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	var message map[string]string
+	if err := json.Unmarshal(receiver.bodies[0], &message); err != nil {
+		t.Fatal(err)
+	}
+	want := "[ACTIVE] high high-error-rate: error_rate is 12.00 (> 5.00)"
+	if len(message) != 2 || message["text"] != want || message["channel"] != "#oncall" {
+		t.Errorf("slack message %v", message)
+	}
+}
+
+func TestNotifierErrors(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	notifier := newNotifiers(AlertingConfig{Webhook: WebhookConfig{URL: receiver.server.URL}})[0]
+	if err := notifier.Notify(context.Background(), testAlert); err == nil || !strings.Contains(err.Error(), "unexpected status 503") {
+		t.Errorf("error %v, want unexpected status 503", err)
+	}
+
+	// A receiver that does not answer in time fails the delivery
+	blocked := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer slow.Close()
+	defer close(blocked)
+	notifier = newNotifiers(AlertingConfig{Webhook: WebhookConfig{URL: slow.URL}})[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := notifier.Notify(ctx, testAlert); err == nil {
+		t.Error("notification to an unresponsive receiver succeeded")
+	}
+}
+
+func TestNotificationStats(t *testing.T) {
+	ok := newWebhookReceiver(t, 0)
+	failing := newWebhookReceiver(t, http.StatusInternalServerError)
+	e, err := NewAlertEngine(AlertingConfig{
+		Webhook: WebhookConfig{URL: ok.server.URL},
+		Slack:   SlackConfig{WebhookURL: failing.server.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := testAlert
+	resolved.Status = AlertStatusResolved
+	e.notify([]Alert{testAlert, resolved})
+
+	stats := e.NotificationStats()
+	if stats["webhook"].Sent != 2 || stats["webhook"].Failed != 0 || stats["webhook"].LastError != "" {
+		t.Errorf("webhook stats %+v", stats["webhook"])
+	}
+	if stats["slack"].Sent != 0 || stats["slack"].Failed != 2 || !strings.Contains(stats["slack"].LastError, "500") {
+		t.Errorf("slack stats %+v", stats["slack"])
+	}
+	if received := ok.alerts(); len(received) != 2 || received[1].Status != AlertStatusResolved {
+		t.Errorf("webhook received %+v", received)
+	}
+}
+
+func TestNewNotifiers(t *testing.T) {
+	for _, c := range []struct {
+		config AlertingConfig
+		want   string
+	}{
+		{AlertingConfig{}, ""},
+		// Email needs both a relay and recipients
+		{AlertingConfig{Email: EmailConfig{SMTPHost: "smtp.example.com"}}, ""},
+		{AlertingConfig{Email: EmailConfig{SMTPHost: "smtp.example.com", To: []string{"ops@example.com"}}}, "email"},
+		{AlertingConfig{
+			Webhook: WebhookConfig{URL: "http://hooks.example.com"},
+			Slack:   SlackConfig{WebhookURL: "http://slack.example.com"},
+			Email:   EmailConfig{SMTPHost: "smtp.example.com", To: []string{"ops@example.com"}},
+		}, "webhook,slack,email"},
+	} {
+		var names []string
+		for _, notifier := range newNotifiers(c.config) {
+			names = append(names, notifier.Name())
+		}
+		if got := strings.Join(names, ","); got != c.want {
+			t.Errorf("notifiers %s, want %s", got, c.want)
+		}
+	}
+}
+
+func TestEmailSubjectStaysOneLine(t *testing.T) {
+	alert := testAlert
+	alert.Description = "injected\r\nBcc: attacker@example.com"
+	if subject := headerReplacer.Replace(alertSummary(alert)); strings.ContainsAny(subject, "\r\n") {
+		t.Errorf("subject %q spans lines", subject)
+	}
+}
@@ -0,0 +1,579 @@
+package dashboard
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role grants a set of dashboard actions. Each role includes the
+// permissions of the roles below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Allows reports whether r has at least the permissions of required
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] > 0 && roleRank[r] >= roleRank[required]
+}
+
+// Dashboard actions recorded in the audit trail
+const (
+	ActionLogin          = "login"
+	ActionLogout         = "logout"
+	ActionToggleService  = "service.toggle"
+	ActionRestartService = "service.restart"
+	ActionReloadConfig   = "config.reload"
+	ActionClearCache     = "cache.clear"
+	ActionViewAudit      = "audit.view"
+	ActionCreateSilence  = "alert.silence"
+	ActionRemoveSilence  = "alert.unsilence"
+	ActionDraftConfig    = "config.draft"
+	ActionDiscardDraft   = "config.discard"
+	ActionValidateDraft  = "config.validate"
+	ActionApplyDraft     = "config.apply"
+	ActionFreezeConfig   = "config.freeze"
+)
+
+// DashboardUser is a dashboard account. PasswordHash is produced by
+// HashPassword.
+type DashboardUser struct {
+	Username     string
+	PasswordHash string
+	Role         Role
+}
+
+// AuditEntry records one dashboard action
+type AuditEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Username   string    `json:"username"`
+	Role       Role      `json:"role,omitempty"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Allowed    bool      `json:"allowed"`
+	Status     int       `json:"status,omitempty"`
+}
+
+const (
+	sessionCookieName     = "marchproxy_session"
+	passwordHashAlgorithm = "pbkdf2-sha256"
+	passwordHashIter      = 210000
+)
+
+type contextKey int
+
+const sessionContextKey contextKey = 0
+
+// session is an authenticated dashboard login
+type session struct {
+	username string
+	role     Role
+	expires  time.Time
+}
+
+// sessionStore holds active sessions keyed by token
+type sessionStore struct {
+	sessions map[string]*session
+	ttl      time.Duration
+	mutex    sync.Mutex
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*session),
+		ttl:      ttl,
+	}
+}
+
+// create starts a session and returns its token
+func (s *sessionStore) create(username string, role Role) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for t, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = &session{username: username, role: role, expires: now.Add(s.ttl)}
+	return token, nil
+}
+
+// lookup returns the session for token and extends its expiry
+func (s *sessionStore) lookup(token string) (*session, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, exists := s.sessions[token]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+	sess.expires = time.Now().Add(s.ttl)
+	return &session{username: sess.username, role: sess.role, expires: sess.expires}, true
+}
+
+func (s *sessionStore) remove(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, token)
+}
+
+// loginLimiter refuses logins from a client address once it has failed
+// too often within a window, so passwords cannot be guessed at speed
+type loginLimiter struct {
+	attempts int
+	window   time.Duration
+	failures map[string]*loginFailures
+	mutex    sync.Mutex
+}
+
+// loginFailures counts the failed logins of one address since start
+type loginFailures struct {
+	count int
+	start time.Time
+}
+
+func newLoginLimiter(attempts int, window time.Duration) *loginLimiter {
+	return &loginLimiter{
+		attempts: attempts,
+		window:   window,
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+// retryAfter returns how long host must wait before its next login, or 0
+// when it may try now
+func (l *loginLimiter) retryAfter(host string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	f, exists := l.failures[host]
+	if !exists || f.count < l.attempts {
+		return 0
+	}
+	if wait := f.start.Add(l.window).Sub(now); wait > 0 {
+		return wait
+	}
+	delete(l.failures, host)
+	return 0
+}
+
+// fail records a failed login from host
+func (l *loginLimiter) fail(host string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for h, f := range l.failures {
+		if now.Sub(f.start) >= l.window {
+			delete(l.failures, h)
+		}
+	}
+	f, exists := l.failures[host]
+	if !exists {
+		f = &loginFailures{start: now}
+		l.failures[host] = f
+	}
+	f.count++
+}
+
+// reset forgets the failures of host after it logged in
+func (l *loginLimiter) reset(host string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, host)
+}
+
+// auditLog keeps the most recent dashboard actions in a ring buffer
+type auditLog struct {
+	entries []AuditEntry
+	next    int
+	full    bool
+	mutex   sync.Mutex
+}
+
+func newAuditLog(size int) *auditLog {
+	return &auditLog{entries: make([]AuditEntry, size)}
+}
+
+func (l *auditLog) record(entry AuditEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// snapshot returns the entries newest first
+func (l *auditLog) snapshot() []AuditEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+
+	result := make([]AuditEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		result = append(result, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return result
+}
+
+// HashPassword returns a salted PBKDF2 hash suitable for DashboardUser.PasswordHash
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIter, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashAlgorithm, passwordHashIter,
+		hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// verifyPassword checks password against a hash from HashPassword
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashAlgorithm {
+		return false
+	}
+
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// validateUsers checks the configured accounts
+func validateUsers(users []DashboardUser) error {
+	seen := make(map[string]bool)
+	for _, user := range users {
+		if user.Username == "" {
+			return fmt.Errorf("dashboard user without username")
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("duplicate dashboard user %s", user.Username)
+		}
+		seen[user.Username] = true
+
+		if roleRank[user.Role] == 0 {
+			return fmt.Errorf("dashboard user %s has invalid role %q", user.Username, user.Role)
+		}
+		if !strings.HasPrefix(user.PasswordHash, passwordHashAlgorithm+"$") {
+			return fmt.Errorf("dashboard user %s password must be a %s hash", user.Username, passwordHashAlgorithm)
+		}
+	}
+	return nil
+}
+
+// authenticateUser returns the account matching the credentials
+func (ad *AdminDashboard) authenticateUser(username, password string) (*DashboardUser, bool) {
+	for i := range ad.config.Users {
+		user := &ad.config.Users[i]
+		if user.Username == username {
+			if verifyPassword(user.PasswordHash, password) {
+				return user, true
+			}
+			return nil, false
+		}
+	}
+
+	// Spend the same time on unknown users so usernames cannot be probed
+	verifyPassword(ad.dummyHash, password)
+	return nil, false
+}
+
+// sessionFromRequest returns the caller's session, if any
+func sessionFromRequest(r *http.Request) (*session, bool) {
+	sess, ok := r.Context().Value(sessionContextKey).(*session)
+	return sess, ok
+}
+
+// sessionMiddleware requires a valid session for everything except the login page
+func (ad *AdminDashboard) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookieName)
+		if err == nil {
+			if sess, ok := ad.sessions.lookup(cookie.Value); ok {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, sess)))
+				return
+			}
+		}
+
+		if r.URL.Path == "/" && r.Method == http.MethodGet {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// requireRole wraps a handler that performs action, rejecting callers
+// below role and recording the outcome in the audit trail
+func (ad *AdminDashboard) requireRole(role Role, action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := AuditEntry{
+			Timestamp:  time.Now(),
+			Action:     action,
+			Target:     r.FormValue("service"),
+			RemoteAddr: remoteHost(r),
+		}
+
+		sess, ok := sessionFromRequest(r)
+		if ok {
+			entry.Username = sess.username
+			entry.Role = sess.role
+		}
+
+		if !ok || !sess.role.Allows(role) {
+			entry.Status = http.StatusForbidden
+			ad.audit.record(entry)
+			http.Error(w, fmt.Sprintf("Forbidden: %s requires %s role", action, role), http.StatusForbidden)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		entry.Allowed = true
+		entry.Status = recorder.status
+		ad.audit.record(entry)
+	}
+}
+
+// withSession treats every request as the given user. It keeps the legacy
+// single BasicAuth credential, or an unauthenticated dashboard, working
+// with role checks.
+func withSession(username string, role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := &session{username: username, role: role}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, sess)))
+	})
+}
+
+func (ad *AdminDashboard) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(loginHTML))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	host := remoteHost(r)
+	entry := AuditEntry{
+		Timestamp:  time.Now(),
+		Username:   username,
+		Action:     ActionLogin,
+		RemoteAddr: host,
+	}
+
+	if wait := ad.logins.retryAfter(host, time.Now()); wait > 0 {
+		entry.Status = http.StatusTooManyRequests
+		ad.audit.record(entry)
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user, ok := ad.authenticateUser(username, password)
+	if !ok {
+		ad.logins.fail(host, time.Now())
+		entry.Status = http.StatusUnauthorized
+		ad.audit.record(entry)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	ad.logins.reset(host)
+
+	token, err := ad.sessions.create(user.Username, user.Role)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   ad.config.TLSEnabled,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(ad.config.SessionTTL.Seconds()),
+	})
+
+	entry.Role = user.Role
+	entry.Allowed = true
+	entry.Status = http.StatusOK
+	ad.audit.record(entry)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"username": user.Username,
+			"role":     user.Role,
+		})
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (ad *AdminDashboard) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		ad.sessions.remove(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+
+	entry := AuditEntry{
+		Timestamp:  time.Now(),
+		Action:     ActionLogout,
+		RemoteAddr: remoteHost(r),
+		Allowed:    true,
+		Status:     http.StatusOK,
+	}
+	if sess, ok := sessionFromRequest(r); ok {
+		entry.Username = sess.username
+		entry.Role = sess.role
+	}
+	ad.audit.record(entry)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ad *AdminDashboard) handleSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := sessionFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username": sess.username,
+		"role":     sess.role,
+		"expires":  sess.expires,
+	})
+}
+
+func (ad *AdminDashboard) handleAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ad.audit.snapshot())
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// remoteHost returns the client IP without the port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+const loginHTML = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>MarchProxy Admin Dashboard - Login</title>
+    <meta charset="utf-8">
+    <style>
+        body { font-family: Arial, sans-serif; background: #f5f5f5; }
+        form { max-width: 320px; margin: 100px auto; background: white; padding: 20px; border-radius: 5px; box-shadow: 0 2px 4px rgba(0,0,0,0.1); }
+        input { width: 100%; padding: 8px; margin: 6px 0 12px; box-sizing: border-box; }
+        button { padding: 8px 16px; border: none; border-radius: 3px; background: #3498db; color: white; cursor: pointer; }
+    </style>
+</head>
+<body>
+    <form method="POST" action="/login">
+        <h2>MarchProxy Admin</h2>
+        <label>Username</label>
+        <input name="username" autocomplete="username" required>
+        <label>Password</label>
+        <input name="password" type="password" autocomplete="current-password" required>
+        <button type="submit">Sign in</button>
+    </form>
+</body>
+</html>
+`
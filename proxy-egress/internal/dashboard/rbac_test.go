@@ -0,0 +1,374 @@
+package dashboard
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPassword is the password of every account on the test dashboard
+const testPassword = "correct horse battery staple"
+
+// newTestDashboard returns a dashboard with a viewer, an operator and an
+// admin account
+func newTestDashboard(t *testing.T, config DashboardConfig) *AdminDashboard {
+	t.Helper()
+	hash, err := HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Users = []DashboardUser{
+		{Username: "viewer", PasswordHash: hash, Role: RoleViewer},
+		{Username: "operator", PasswordHash: hash, Role: RoleOperator},
+		{Username: "admin", PasswordHash: hash, Role: RoleAdmin},
+	}
+	ad, err := NewAdminDashboard(config, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ad
+}
+
+// postLogin submits the login form from remoteAddr
+func postLogin(ad *AdminDashboard, username, password, remoteAddr string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	ad.server.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// login returns the session cookie of username
+func login(t *testing.T, ad *AdminDashboard, username string) *http.Cookie {
+	t.Helper()
+	rec := postLogin(ad, username, testPassword, "192.0.2.1:1234")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login as %s: %d %s", username, rec.Code, rec.Body)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	t.Fatalf("login as %s set no session cookie", username)
+	return nil
+}
+
+// serve sends a request with the session cookie, if any
+func serve(ad *AdminDashboard, method, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	ad.server.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPassword(hash, "s3cret") {
+		t.Error("password rejected")
+	}
+	if verifyPassword(hash, "s3cret ") || verifyPassword(hash, "") {
+		t.Error("wrong password accepted")
+	}
+	if other, _ := HashPassword("s3cret"); other == hash {
+		t.Error("hashes of one password share a salt")
+	}
+
+	// The iteration count is read from the hash
+	salt := []byte("0123456789abcdef")
+	key, err := pbkdf2.Key(sha256.New, "s3cret", salt, 1000, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fewer := fmt.Sprintf("pbkdf2-sha256$1000$%x$%x", salt, key)
+	if !verifyPassword(fewer, "s3cret") {
+		t.Error("hash with 1000 iterations rejected")
+	}
+
+	parts := strings.Split(hash, "$")
+	tampered := mustDecodeHex(t, parts[3])
+	tampered[0] ^= 1
+	for name, malformed := range map[string]string{
+		"empty":          "",
+		"other scheme":   "bcrypt$1000$" + parts[2] + "$" + parts[3],
+		"missing key":    strings.Join(parts[:3], "$"),
+		"extra field":    hash + "$00",
+		"zero rounds":    "pbkdf2-sha256$0$" + parts[2] + "$" + parts[3],
+		"invalid rounds": "pbkdf2-sha256$many$" + parts[2] + "$" + parts[3],
+		"invalid salt":   "pbkdf2-sha256$1000$zz$" + parts[3],
+		"empty key":      "pbkdf2-sha256$1000$" + parts[2] + "$",
+		"tampered key":   "pbkdf2-sha256$" + parts[1] + "$" + parts[2] + "$" + hex.EncodeToString(tampered),
+	} {
+		if verifyPassword(malformed, "s3cret") {
+			t.Errorf("%s hash accepted", name)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSessionExpiry(t *testing.T) {
+	store := newSessionStore(time.Hour)
+	token, err := store.create("operator", RoleOperator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, ok := store.lookup(token)
+	if !ok || sess.username != "operator" || sess.role != RoleOperator {
+		t.Fatalf("session %+v, %t", sess, ok)
+	}
+
+	// Each use extends the session by the TTL
+	store.sessions[token].expires = time.Now().Add(time.Minute)
+	if sess, _ := store.lookup(token); time.Until(sess.expires) < 59*time.Minute {
+		t.Errorf("session expires in %s after use, want about an hour", time.Until(sess.expires))
+	}
+
+	store.sessions[token].expires = time.Now().Add(-time.Second)
+	if _, ok := store.lookup(token); ok {
+		t.Error("expired session accepted")
+	}
+	if _, exists := store.sessions[token]; exists {
+		t.Error("expired session kept")
+	}
+
+	// Creating a session drops the expired ones
+	stale, _ := store.create("viewer", RoleViewer)
+	store.sessions[stale].expires = time.Now().Add(-time.Second)
+	fresh, _ := store.create("admin", RoleAdmin)
+	if _, exists := store.sessions[stale]; exists || len(store.sessions) != 1 {
+		t.Errorf("%d sessions after expiry", len(store.sessions))
+	}
+
+	store.remove(fresh)
+	if _, ok := store.lookup(fresh); ok {
+		t.Error("removed session accepted")
+	}
+	if _, ok := store.lookup("unknown"); ok {
+		t.Error("unknown token accepted")
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	for _, c := range []struct {
+		role, required Role
+		want           bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleOperator, true},
+		{Role("root"), RoleViewer, false},
+		{Role(""), Role(""), false},
+	} {
+		if got := c.role.Allows(c.required); got != c.want {
+			t.Errorf("%q.Allows(%q) = %t, want %t", c.role, c.required, got, c.want)
+		}
+	}
+}
+
+func TestRoleDenialAudit(t *testing.T) {
+	ad := newTestDashboard(t, DashboardConfig{})
+
+	if rec := serve(ad, http.MethodPost, "/api/cache/clear", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a session: %d", rec.Code)
+	}
+	if rec := serve(ad, http.MethodGet, "/", nil); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("dashboard without a session: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	viewer := login(t, ad, "viewer")
+	rec := serve(ad, http.MethodPost, "/api/cache/clear?service=billing", viewer)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "cache.clear requires operator role") {
+		t.Errorf("viewer clearing the cache: %d %s", rec.Code, rec.Body)
+	}
+	operator := login(t, ad, "operator")
+	if rec := serve(ad, http.MethodPost, "/api/cache/clear", operator); rec.Code != http.StatusOK {
+		t.Errorf("operator clearing the cache: %d", rec.Code)
+	}
+	if rec := serve(ad, http.MethodGet, "/api/audit", operator); rec.Code != http.StatusForbidden {
+		t.Errorf("operator reading the audit trail: %d", rec.Code)
+	}
+
+	rec = serve(ad, http.MethodGet, "/api/audit", login(t, ad, "admin"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("admin reading the audit trail: %d", rec.Code)
+	}
+	var entries []AuditEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first; the admin's own read is recorded once it completes
+	want := []AuditEntry{
+		{Username: "operator", Role: RoleOperator, Action: ActionViewAudit, Allowed: false, Status: http.StatusForbidden},
+		{Username: "operator", Role: RoleOperator, Action: ActionClearCache, Allowed: true, Status: http.StatusOK},
+		{Username: "operator", Role: RoleOperator, Action: ActionLogin, Allowed: true, Status: http.StatusOK},
+		{Username: "viewer", Role: RoleViewer, Action: ActionClearCache, Target: "billing", Allowed: false, Status: http.StatusForbidden},
+		{Username: "viewer", Role: RoleViewer, Action: ActionLogin, Allowed: true, Status: http.StatusOK},
+	}
+	entries = entries[1:] // The admin's login
+	if len(entries) != len(want) {
+		t.Fatalf("audit trail %+v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Timestamp.IsZero() || entry.RemoteAddr == "" {
+			t.Errorf("entry %d without time or address: %+v", i, entry)
+		}
+		entry.Timestamp, entry.RemoteAddr = time.Time{}, ""
+		if entry != want[i] {
+			t.Errorf("entry %d: %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestUnauthenticatedDashboard(t *testing.T) {
+	// Without accounts or basic auth callers are anonymous viewers
+	ad, err := NewAdminDashboard(DashboardConfig{ConfigEditor: ConfigEditorConfig{Enabled: true}}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(ad, http.MethodGet, "/api/session", nil)
+	var sess map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil {
+		t.Fatal(err)
+	}
+	if sess["username"] != "anonymous" || sess["role"] != string(RoleViewer) {
+		t.Errorf("session %v, want the anonymous viewer", sess)
+	}
+
+	for _, target := range []string{"/api/config/reload", "/api/config/freeze", "/api/config/drafts", "/api/config/drafts/1/apply", "/api/cache/clear"} {
+		if rec := serve(ad, http.MethodPost, target, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("anonymous POST %s: %d, want %d", target, rec.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	ad := newTestDashboard(t, DashboardConfig{LoginAttempts: 3, LoginWindow: time.Minute})
+
+	for n := 0; n < 3; n++ {
+		if rec := postLogin(ad, "admin", "guess", "192.0.2.7:1000"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d: %d", n, rec.Code)
+		}
+	}
+	// Further attempts are refused, even with the right password
+	rec := postLogin(ad, "admin", testPassword, "192.0.2.7:1001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login over the limit: %d", rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Retry-After %q, want 60", retry)
+	}
+	if entry := ad.audit.snapshot()[0]; entry.Action != ActionLogin || entry.Status != http.StatusTooManyRequests || entry.Allowed {
+		t.Errorf("audit entry %+v", entry)
+	}
+
+	// Other addresses are unaffected, and logging in clears the count
+	if rec := postLogin(ad, "admin", "guess", "198.51.100.1:1000"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("another address: %d", rec.Code)
+	}
+	if rec := postLogin(ad, "admin", testPassword, "198.51.100.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("another address logging in: %d", rec.Code)
+	}
+	if _, counted := ad.logins.failures["198.51.100.1"]; counted {
+		t.Error("failures kept after logging in")
+	}
+}
+
+func TestLoginLimiterWindow(t *testing.T) {
+	l := newLoginLimiter(2, time.Minute)
+	start := time.Now()
+
+	l.fail("192.0.2.7", start)
+	if wait := l.retryAfter("192.0.2.7", start); wait != 0 {
+		t.Errorf("blocked after one failure for %s", wait)
+	}
+	l.fail("192.0.2.7", start.Add(10*time.Second))
+	if wait := l.retryAfter("192.0.2.7", start.Add(20*time.Second)); wait != 40*time.Second {
+		t.Errorf("blocked for %s, want the rest of the window", wait)
+	}
+
+	// The window counts from the first failure
+	if wait := l.retryAfter("192.0.2.7", start.Add(time.Minute)); wait != 0 {
+		t.Errorf("blocked for %s after the window", wait)
+	}
+	if len(l.failures) != 0 {
+		t.Error("failures kept after the window")
+	}
+
+	// Old failures of other addresses are dropped as new ones arrive
+	l.fail("192.0.2.8", start)
+	l.fail("192.0.2.9", start.Add(2*time.Minute))
+	if _, exists := l.failures["192.0.2.8"]; exists || len(l.failures) != 1 {
+		t.Errorf("failures %v", l.failures)
+	}
+
+	l.reset("192.0.2.9")
+	if len(l.failures) != 0 {
+		t.Error("failures kept after reset")
+	}
+}
+
+func TestAuditLogRing(t *testing.T) {
+	log := newAuditLog(3)
+	if got := log.snapshot(); len(got) != 0 {
+		t.Errorf("empty log %v", got)
+	}
+	for n := 1; n <= 5; n++ {
+		log.record(AuditEntry{Target: fmt.Sprint(n)})
+	}
+	var targets []string
+	for _, entry := range log.snapshot() {
+		targets = append(targets, entry.Target)
+	}
+	if strings.Join(targets, ",") != "5,4,3" {
+		t.Errorf("entries %v, want the newest three first", targets)
+	}
+}
+
+func TestValidateUsers(t *testing.T) {
+	hash := "pbkdf2-sha256$1000$00$00"
+	for name, c := range map[string]struct {
+		users []DashboardUser
+		want  string
+	}{
+		"no username":    {[]DashboardUser{{PasswordHash: hash, Role: RoleAdmin}}, "without username"},
+		"duplicate":      {[]DashboardUser{{"a", hash, RoleAdmin}, {"a", hash, RoleViewer}}, "duplicate dashboard user a"},
+		"unknown role":   {[]DashboardUser{{"a", hash, Role("root")}}, `invalid role "root"`},
+		"plain password": {[]DashboardUser{{"a", "hunter2", RoleAdmin}}, "must be a pbkdf2-sha256 hash"},
+	} {
+		if err := validateUsers(c.users); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: error %v, want %q", name, err, c.want)
+		}
+	}
+	if err := validateUsers([]DashboardUser{{"a", hash, RoleAdmin}, {"b", hash, RoleViewer}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,403 @@
+package dashboard
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket message types, numbered after the RFC 6455 opcodes
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Dashboard push topics
+const (
+	TopicMetrics = "metrics"
+	TopicEvents  = "events"
+	TopicAlerts  = "alerts"
+)
+
+// websocketGUID is appended to the client key to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxClientMessageSize bounds subscription messages sent by the browser
+const maxClientMessageSize = 64 * 1024
+
+var validTopics = map[string]bool{
+	TopicMetrics: true,
+	TopicEvents:  true,
+	TopicAlerts:  true,
+}
+
+// subscriptionMessage is sent by clients to change their topic set
+type subscriptionMessage struct {
+	Action string   `json:"action"` // subscribe or unsubscribe
+	Topics []string `json:"topics"`
+}
+
+// pushMessage is the envelope for every server push
+type pushMessage struct {
+	Topic     string      `json:"topic"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// serverConn is a server side WebSocket connection over a hijacked HTTP
+// connection. Writes are serialized so pushes and control replies can
+// come from different goroutines.
+type serverConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeMu      sync.Mutex
+	writeTimeout time.Duration
+}
+
+// WriteMessage sends a single unfragmented frame
+func (c *serverConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | byte(messageType)}
+	switch {
+	case len(data) < 126:
+		header = append(header, byte(len(data)))
+	case len(data) < 65536:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+	}
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadMessage returns the next data message. Fragmented messages are
+// reassembled and control frames are answered as they arrive.
+func (c *serverConn) ReadMessage() (int, []byte, error) {
+	var messageType int
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			c.WriteMessage(CloseMessage, payload)
+			return CloseMessage, payload, io.EOF
+		case 0:
+			if messageType == 0 {
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+		default:
+			if messageType != 0 {
+				return 0, nil, fmt.Errorf("new message before previous one finished")
+			}
+			messageType = opcode
+		}
+
+		if len(message)+len(payload) > maxClientMessageSize {
+			return 0, nil, fmt.Errorf("message exceeds %d bytes", maxClientMessageSize)
+		}
+		message = append(message, payload...)
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame. Clients must mask every frame.
+func (c *serverConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = int(header[0] & 0x0F)
+	if header[1]&0x80 == 0 {
+		err = fmt.Errorf("client frame is not masked")
+		return
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxClientMessageSize {
+		err = fmt.Errorf("frame exceeds %d bytes", maxClientMessageSize)
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Close closes the underlying connection
+func (c *serverConn) Close() error {
+	return c.conn.Close()
+}
+
+// upgradeWebSocket validates the handshake and hijacks the HTTP connection.
+// Handshake failures are answered here: once the connection is hijacked the
+// ResponseWriter can no longer be used, so the caller only cleans up.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*serverConn, error) {
+	if err := checkHandshake(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := fmt.Errorf("connection does not support hijacking")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// The server read/write timeouts no longer apply once hijacked
+	conn.SetDeadline(time.Time{})
+
+	h := sha1.New()
+	h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &serverConn{conn: conn, reader: rw.Reader, writeTimeout: 10 * time.Second}, nil
+}
+
+// checkHandshake validates the client's upgrade request
+func checkHandshake(r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("websocket upgrade requires GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return fmt.Errorf("missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return fmt.Errorf("unsupported websocket version")
+	}
+	if r.Header.Get("Sec-WebSocket-Key") == "" {
+		return fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+	return nil
+}
+
+// headerContains reports whether a comma-separated header contains token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseTopics returns the valid topics in a comma-separated list, or every
+// topic when the list is empty
+func parseTopics(list string) map[string]bool {
+	topics := make(map[string]bool)
+	for _, topic := range strings.Split(list, ",") {
+		topic = strings.TrimSpace(topic)
+		if validTopics[topic] {
+			topics[topic] = true
+		}
+	}
+	if len(topics) == 0 {
+		for topic := range validTopics {
+			topics[topic] = true
+		}
+	}
+	return topics
+}
+
+func (ad *AdminDashboard) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && ad.config.CORS.Enabled && !ad.isOriginAllowed(origin) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	ad.mutex.Lock()
+	if len(ad.websockets) >= ad.config.MaxConnections {
+		ad.mutex.Unlock()
+		http.Error(w, "Too many dashboard connections", http.StatusServiceUnavailable)
+		return
+	}
+	// Reserve the slot before the handshake so concurrent upgrades cannot exceed the limit
+	ad.nextSocketID++
+	id := fmt.Sprintf("ws-%d", ad.nextSocketID)
+	wsConn := &WebSocketConnection{
+		lastPing: time.Now(),
+		topics:   parseTopics(r.URL.Query().Get("topics")),
+	}
+	ad.websockets[id] = wsConn
+	ad.mutex.Unlock()
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		ad.removeWebSocket(id)
+		return
+	}
+
+	ad.mutex.Lock()
+	wsConn.conn = conn
+	ad.mutex.Unlock()
+
+	// Send the current state straight away instead of waiting for the next tick
+	ad.pushTo(wsConn, ad.topicPayloads())
+
+	go ad.readWebSocket(id, wsConn)
+}
+
+// readWebSocket applies subscription changes until the client disconnects
+func (ad *AdminDashboard) readWebSocket(id string, wsConn *WebSocketConnection) {
+	defer ad.removeWebSocket(id)
+
+	for {
+		messageType, data, err := wsConn.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		ad.mutex.Lock()
+		wsConn.lastPing = time.Now()
+		ad.mutex.Unlock()
+
+		if messageType != TextMessage {
+			continue
+		}
+
+		var msg subscriptionMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		ad.mutex.Lock()
+		for _, topic := range msg.Topics {
+			if !validTopics[topic] {
+				continue
+			}
+			switch msg.Action {
+			case "subscribe":
+				wsConn.topics[topic] = true
+			case "unsubscribe":
+				delete(wsConn.topics, topic)
+			}
+		}
+		ad.mutex.Unlock()
+	}
+}
+
+// removeWebSocket forgets a connection and closes it
+func (ad *AdminDashboard) removeWebSocket(id string) {
+	ad.mutex.Lock()
+	wsConn, exists := ad.websockets[id]
+	delete(ad.websockets, id)
+	ad.mutex.Unlock()
+
+	if exists && wsConn.conn != nil {
+		wsConn.conn.Close()
+	}
+}
+
+// topicPayloads encodes the current push for every topic
+func (ad *AdminDashboard) topicPayloads() map[string][]byte {
+	now := time.Now()
+	data := map[string]interface{}{
+		TopicMetrics: ad.getMetricsData(),
+		TopicEvents:  ad.getRecentEvents(),
+		TopicAlerts:  ad.getActiveAlerts(),
+	}
+
+	payloads := make(map[string][]byte, len(data))
+	for topic, value := range data {
+		encoded, err := json.Marshal(pushMessage{Topic: topic, Timestamp: now, Data: value})
+		if err != nil {
+			continue
+		}
+		payloads[topic] = encoded
+	}
+	return payloads
+}
+
+// pushTo sends the payloads for the topics wsConn subscribes to
+func (ad *AdminDashboard) pushTo(wsConn *WebSocketConnection, payloads map[string][]byte) error {
+	ad.mutex.RLock()
+	var topics []string
+	for topic := range wsConn.topics {
+		topics = append(topics, topic)
+	}
+	ad.mutex.RUnlock()
+
+	for _, topic := range topics {
+		if payload, ok := payloads[topic]; ok {
+			if err := wsConn.conn.WriteMessage(TextMessage, payload); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package dashboard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMask is the masking key of every client frame in these tests
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// clientFrame encodes a frame the way a browser sends it
+func clientFrame(fin bool, opcode int, payload []byte, masked bool) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) < 65536:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame = append(frame, testMask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^testMask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame decodes one unmasked frame written by the server
+func readServerFrame(t *testing.T, r *bufio.Reader) (fin bool, opcode int, payload []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0]&0x80 != 0, int(header[0] & 0x0F), payload
+}
+
+// pipeConn returns a server connection and the client end of its pipe
+func pipeConn(t *testing.T) (*serverConn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return &serverConn{conn: server, reader: bufio.NewReader(server)}, client
+}
+
+// readResult is the outcome of one ReadMessage call
+type readResult struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// sendFrames writes frames from the client and reads the next message on
+// the server side. The pipe is unbuffered, so the caller must consume any
+// control replies before receiving from the returned channel.
+func sendFrames(c *serverConn, client net.Conn, frames ...[]byte) <-chan readResult {
+	go client.Write(bytes.Join(frames, nil))
+	result := make(chan readResult, 1)
+	go func() {
+		messageType, data, err := c.ReadMessage()
+		result <- readResult{messageType, data, err}
+	}()
+	return result
+}
+
+func TestReadMessageMasking(t *testing.T) {
+	c, client := pipeConn(t)
+	got := <-sendFrames(c, client, clientFrame(true, TextMessage, []byte(`{"action":"subscribe"}`), true))
+	if got.err != nil || got.messageType != TextMessage || string(got.data) != `{"action":"subscribe"}` {
+		t.Errorf("read type %d %q, error %v", got.messageType, got.data, got.err)
+	}
+
+	// Extended lengths are unmasked across the whole payload
+	long := bytes.Repeat([]byte("0123456789"), 1000)
+	got = <-sendFrames(c, client, clientFrame(true, BinaryMessage, long, true))
+	if got.err != nil || got.messageType != BinaryMessage || !bytes.Equal(got.data, long) {
+		t.Errorf("read type %d with %d bytes, error %v", got.messageType, len(got.data), got.err)
+	}
+
+	c, client = pipeConn(t)
+	got = <-sendFrames(c, client, clientFrame(true, TextMessage, []byte("hello"), false))
+	if got.err == nil || !strings.Contains(got.err.Error(), "not masked") {
+		t.Errorf("unmasked frame: error %v", got.err)
+	}
+}
+
+func TestReadMessageFragmentation(t *testing.T) {
+	c, client := pipeConn(t)
+	got := <-sendFrames(c, client,
+		clientFrame(false, TextMessage, []byte("frag"), true),
+		clientFrame(false, 0, []byte("men"), true),
+		clientFrame(true, 0, []byte("ted"), true),
+	)
+	if got.err != nil || got.messageType != TextMessage || string(got.data) != "fragmented" {
+		t.Errorf("read type %d %q, error %v", got.messageType, got.data, got.err)
+	}
+
+	// Control frames may arrive between fragments
+	replies := bufio.NewReader(client)
+	result := sendFrames(c, client,
+		clientFrame(false, BinaryMessage, []byte("ab"), true),
+		clientFrame(true, PingMessage, []byte("keepalive"), true),
+		clientFrame(true, 0, []byte("cd"), true),
+	)
+	if _, opcode, payload := readServerFrame(t, replies); opcode != PongMessage || string(payload) != "keepalive" {
+		t.Errorf("replied to ping with opcode %d %q", opcode, payload)
+	}
+	got = <-result
+	if got.err != nil || got.messageType != BinaryMessage || string(got.data) != "abcd" {
+		t.Errorf("read type %d %q, error %v", got.messageType, got.data, got.err)
+	}
+
+	for name, frames := range map[string][][]byte{
+		"unexpected continuation": {
+			clientFrame(true, 0, []byte("orphan"), true),
+		},
+		"before previous one finished": {
+			clientFrame(false, TextMessage, []byte("first"), true),
+			clientFrame(true, TextMessage, []byte("second"), true),
+		},
+	} {
+		c, client := pipeConn(t)
+		if got := <-sendFrames(c, client, frames...); got.err == nil || !strings.Contains(got.err.Error(), name) {
+			t.Errorf("%s: error %v", name, got.err)
+		}
+	}
+}
+
+func TestReadMessageOversize(t *testing.T) {
+	// A single frame is refused from its header, before the payload is read
+	c, client := pipeConn(t)
+	header := clientFrame(true, BinaryMessage, make([]byte, maxClientMessageSize+1), true)[:10]
+	got := <-sendFrames(c, client, header)
+	if got.err == nil || !strings.Contains(got.err.Error(), "frame exceeds") {
+		t.Errorf("oversize frame: error %v", got.err)
+	}
+
+	// Fragments are limited by their combined size
+	c, client = pipeConn(t)
+	half := make([]byte, maxClientMessageSize/2+1)
+	got = <-sendFrames(c, client,
+		clientFrame(false, BinaryMessage, half, true),
+		clientFrame(true, 0, half, true),
+	)
+	if got.err == nil || !strings.Contains(got.err.Error(), "message exceeds") {
+		t.Errorf("oversize message: error %v", got.err)
+	}
+
+	c, client = pipeConn(t)
+	exact := make([]byte, maxClientMessageSize)
+	if got := <-sendFrames(c, client, clientFrame(true, BinaryMessage, exact, true)); got.err != nil || len(got.data) != maxClientMessageSize {
+		t.Errorf("message at the limit: %d bytes, error %v", len(got.data), got.err)
+	}
+}
+
+func TestReadMessageControlFrames(t *testing.T) {
+	c, client := pipeConn(t)
+	replies := bufio.NewReader(client)
+
+	// Pings are answered and pongs are ignored while waiting for data
+	result := sendFrames(c, client,
+		clientFrame(true, PingMessage, []byte("p1"), true),
+		clientFrame(true, PongMessage, []byte("unsolicited"), true),
+		clientFrame(true, PingMessage, nil, true),
+		clientFrame(true, TextMessage, []byte("data"), true),
+	)
+	for _, want := range []string{"p1", ""} {
+		fin, opcode, payload := readServerFrame(t, replies)
+		if !fin || opcode != PongMessage || string(payload) != want {
+			t.Errorf("reply fin %t opcode %d %q, want pong %q", fin, opcode, payload, want)
+		}
+	}
+	if got := <-result; got.err != nil || string(got.data) != "data" {
+		t.Errorf("read %q, error %v", got.data, got.err)
+	}
+
+	// A close frame is echoed and ends the connection
+	closePayload := []byte{0x03, 0xe8}
+	result = sendFrames(c, client, clientFrame(true, CloseMessage, closePayload, true))
+	if _, opcode, payload := readServerFrame(t, replies); opcode != CloseMessage || !bytes.Equal(payload, closePayload) {
+		t.Errorf("replied to close with opcode %d %x", opcode, payload)
+	}
+	if got := <-result; got.err != io.EOF || got.messageType != CloseMessage {
+		t.Errorf("close read type %d, error %v", got.messageType, got.err)
+	}
+}
+
+func TestWriteMessageLengths(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		c, client := pipeConn(t)
+		payload := bytes.Repeat([]byte{'x'}, size)
+		go c.WriteMessage(BinaryMessage, payload)
+		fin, opcode, got := readServerFrame(t, bufio.NewReader(client))
+		if !fin || opcode != BinaryMessage || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: fin %t opcode %d, read %d bytes", size, fin, opcode, len(got))
+		}
+	}
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	// Without accounts every request runs as the anonymous viewer
+	ad, err := NewAdminDashboard(DashboardConfig{}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(ad.server.Handler)
+	defer server.Close()
+
+	// A bad handshake is answered before hijacking and frees the slot
+	resp, err := http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "missing websocket upgrade headers") {
+		t.Errorf("plain GET: %d %q", resp.StatusCode, body)
+	}
+	if n := socketCount(ad); n != 0 {
+		t.Errorf("%d sockets tracked after a failed upgrade", n)
+	}
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// The key and accept value are the example from RFC 6455 section 1.3
+	request := "GET /ws?topics=metrics HTTP/1.1\r\n" +
+		"Host: dashboard\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("upgrade: %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	// Only the subscribed topic is pushed on connect
+	_, opcode, payload := readServerFrame(t, reader)
+	var push pushMessage
+	if err := json.Unmarshal(payload, &push); err != nil || opcode != TextMessage || push.Topic != TopicMetrics {
+		t.Errorf("first push opcode %d topic %q, error %v", opcode, push.Topic, err)
+	}
+	if n := socketCount(ad); n != 1 {
+		t.Errorf("%d sockets tracked, want 1", n)
+	}
+
+	// Closing the socket forgets the connection
+	conn.Write(clientFrame(true, CloseMessage, nil, true))
+	if _, opcode, _ := readServerFrame(t, reader); opcode != CloseMessage {
+		t.Errorf("replied to close with opcode %d", opcode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for socketCount(ad) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("socket still tracked after close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleWebSocketLimit(t *testing.T) {
+	ad := newTestDashboard(t, DashboardConfig{MaxConnections: 1})
+	ad.websockets["ws-held"] = &WebSocketConnection{}
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	rec := httptest.NewRecorder()
+	ad.handleWebSocket(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("over the limit: %d", rec.Code)
+	}
+	if n := socketCount(ad); n != 1 {
+		t.Errorf("%d sockets tracked, want 1", n)
+	}
+}
+
+func socketCount(ad *AdminDashboard) int {
+	ad.mutex.RLock()
+	defer ad.mutex.RUnlock()
+	return len(ad.websockets)
+}
@@ -0,0 +1,345 @@
+// Package dlp scans outbound payloads for sensitive data such as card
+// numbers, social security numbers and credentials. It extends the
+// patterns of the WAF's response DataMasker to egress traffic: a mapping's
+// policy picks the detectors and custom patterns to apply, and whether a
+// finding only raises an alert, is masked in place, or blocks the flow.
+//
+// Only plaintext is visible to the scanner; TLS flows pass unscanned unless
+// their mapping enables TLS inspection.
+package dlp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Actions taken on a finding
+const (
+	ActionAlert = "alert" // Log and count the finding, forward the payload unchanged
+	ActionMask  = "mask"  // Overwrite the finding, keeping the payload length
+	ActionBlock = "block" // Drop the payload and end the flow
+)
+
+// ErrBlocked ends a flow whose payload matched a policy with the block action
+var ErrBlocked = errors.New("payload blocked by DLP policy")
+
+// maxMatch bounds how far back a finding may start in the previous write,
+// so findings split across writes are still detected
+const maxMatch = 256
+
+// Policy is a mapping's DLP configuration
+type Policy struct {
+	Action       string    `json:"action"`                   // alert, mask or block
+	Detectors    []string  `json:"detectors,omitempty"`      // Built-in detectors, every one when empty
+	Custom       []Pattern `json:"custom,omitempty"`         // Additional regular expressions
+	MaxScanBytes int64     `json:"max_scan_bytes,omitempty"` // Scanned bytes per flow, 0 = the whole flow
+}
+
+// Pattern is a named custom detector in RE2 syntax
+type Pattern struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+// Finding is one match of a detector
+type Finding struct {
+	Detector string
+	Offset   int // In the scanned payload
+	Length   int
+}
+
+// detector matches one kind of sensitive data
+type detector struct {
+	name  string
+	re    *regexp.Regexp
+	valid func([]byte) bool // Rejects false positives, nil accepts every match
+}
+
+// builtins are the built-in detectors by name
+var builtins = map[string]detector{
+	"credit_card":    {re: regexp.MustCompile(`\b\d{4}[ -]?\d{4}[ -]?\d{4}[ -]?\d{1,7}\b`), valid: luhn},
+	"ssn":            {re: regexp.MustCompile(`\b(?:00[1-9]|0[1-9]\d|[1-578]\d\d|6[0-57-9]\d|66[0-57-9])-(?:0[1-9]|[1-9]\d)-(?:000[1-9]|00[1-9]\d|0[1-9]\d\d|[1-9]\d\d\d)\b`)},
+	"aws_access_key": {re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	"github_token":   {re: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,255}\b`)},
+	"private_key":    {re: regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )?PRIVATE KEY-----`)},
+	"api_key":        {re: regexp.MustCompile(`(?i)\b(?:api[_-]?key|secret|access[_-]?token)["']?\s*[:=]\s*["']?[A-Za-z0-9_\-]{16,128}`)},
+}
+
+// Detectors returns the names of the built-in detectors
+func Detectors() []string {
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the action, detector names and custom patterns
+func (p *Policy) Validate() error {
+	_, err := Compile(p)
+	return err
+}
+
+// Scanner applies a compiled policy
+type Scanner struct {
+	action    string
+	maxScan   int64
+	detectors []detector
+}
+
+// Compile compiles a policy. It returns nil for a nil policy, which scans
+// nothing.
+func Compile(p *Policy) (*Scanner, error) {
+	if p == nil {
+		return nil, nil
+	}
+	switch p.Action {
+	case ActionAlert, ActionMask, ActionBlock:
+	default:
+		return nil, fmt.Errorf("action must be %s, %s or %s", ActionAlert, ActionMask, ActionBlock)
+	}
+	if p.MaxScanBytes < 0 {
+		return nil, fmt.Errorf("max_scan_bytes cannot be negative")
+	}
+
+	s := &Scanner{action: p.Action, maxScan: p.MaxScanBytes}
+	names := p.Detectors
+	if len(names) == 0 {
+		names = Detectors()
+	}
+	for _, name := range names {
+		d, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+		d.name = name
+		s.detectors = append(s.detectors, d)
+	}
+	for _, pattern := range p.Custom {
+		if pattern.Name == "" {
+			return nil, fmt.Errorf("custom pattern without a name")
+		}
+		re, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("custom pattern %s: %w", pattern.Name, err)
+		}
+		s.detectors = append(s.detectors, detector{name: pattern.Name, re: re})
+	}
+	return s, nil
+}
+
+// Action returns the action the scanner takes on findings
+func (s *Scanner) Action() string {
+	return s.action
+}
+
+// Scan returns the findings in payload, ordered by offset
+func (s *Scanner) Scan(payload []byte) []Finding {
+	var findings []Finding
+	for _, d := range s.detectors {
+		for _, loc := range d.re.FindAllIndex(payload, -1) {
+			if d.valid != nil && !d.valid(payload[loc[0]:loc[1]]) {
+				continue
+			}
+			findings = append(findings, Finding{Detector: d.name, Offset: loc[0], Length: loc[1] - loc[0]})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Offset < findings[j].Offset })
+	return findings
+}
+
+// Mask overwrites the findings in payload, keeping its length so framing
+// such as an HTTP Content-Length stays valid
+func Mask(payload []byte, findings []Finding) {
+	for _, f := range findings {
+		mask(payload[f.Offset : f.Offset+f.Length])
+	}
+}
+
+// mask replaces letters and digits with X, keeping separators
+func mask(b []byte) {
+	for i, c := range b {
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			b[i] = 'X'
+		}
+	}
+}
+
+// luhn checks the card number checksum of the digits in b
+func luhn(b []byte) bool {
+	sum, digits := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		n := int(c - '0')
+		if digits%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
+
+// Writer scans what is written to w, one direction of a flow. report is
+// called with the findings of each write before the action is applied;
+// with the block action the write fails with ErrBlocked. Findings split
+// across writes are detected, but only their part in the current write is
+// masked. It returns w unchanged for a nil scanner.
+func (s *Scanner) Writer(w io.Writer, report func([]Finding)) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &scanWriter{w: w, scanner: s, report: report}
+}
+
+type scanWriter struct {
+	w       io.Writer
+	scanner *Scanner
+	report  func([]Finding)
+	tail    []byte // End of the previous write, for findings split across writes
+	scanned int64
+	masked  []byte
+}
+
+func (sw *scanWriter) Write(b []byte) (int, error) {
+	if sw.scanner.maxScan > 0 && sw.scanned >= sw.scanner.maxScan {
+		return sw.w.Write(b)
+	}
+	sw.scanned += int64(len(b))
+
+	prev := len(sw.tail)
+	window := append(sw.tail, b...)
+	var findings []Finding
+	for _, f := range sw.scanner.Scan(window) {
+		// Findings within the tail were reported with the previous write
+		if f.Offset+f.Length > prev {
+			findings = append(findings, f)
+		}
+	}
+	sw.tail = append(sw.tail[:0], window[max(len(window)-maxMatch, 0):]...)
+
+	if len(findings) == 0 {
+		return sw.w.Write(b)
+	}
+	if sw.report != nil {
+		sw.report(findings)
+	}
+
+	switch sw.scanner.action {
+	case ActionBlock:
+		return 0, ErrBlocked
+	case ActionMask:
+		sw.masked = append(sw.masked[:0], b...)
+		for _, f := range findings {
+			mask(sw.masked[max(f.Offset-prev, 0) : f.Offset+f.Length-prev])
+		}
+		return sw.w.Write(sw.masked)
+	default:
+		return sw.w.Write(b)
+	}
+}
+
+// Cache compiles the policies of mappings once
+type Cache struct {
+	scanners map[string]cached
+	mu       sync.Mutex
+}
+
+type cached struct {
+	scanner *Scanner
+	err     error
+}
+
+// maxCached bounds the cache; it is reset once full
+const maxCached = 1024
+
+// NewCache creates an empty scanner cache
+func NewCache() *Cache {
+	return &Cache{scanners: make(map[string]cached)}
+}
+
+// Scanner returns the compiled policy, nil for a nil policy
+func (c *Cache) Scanner(p *Policy) (*Scanner, error) {
+	if p == nil {
+		return nil, nil
+	}
+	key, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.scanners[string(key)]; ok {
+		return entry.scanner, entry.err
+	}
+	if len(c.scanners) >= maxCached {
+		c.scanners = make(map[string]cached)
+	}
+	scanner, err := Compile(p)
+	c.scanners[string(key)] = cached{scanner: scanner, err: err}
+	return scanner, err
+}
+
+// metricKey identifies one findings counter
+type metricKey struct {
+	mapping  string
+	detector string
+	action   string
+}
+
+// Metrics counts findings per mapping, detector and action
+type Metrics struct {
+	counts map[metricKey]uint64
+	mu     sync.Mutex
+}
+
+// Record counts the findings of one payload of a mapping
+func (m *Metrics) Record(mapping, action string, findings []Finding) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counts == nil {
+		m.counts = make(map[metricKey]uint64)
+	}
+	for _, f := range findings {
+		m.counts[metricKey{mapping: mapping, detector: f.Detector, action: action}]++
+	}
+}
+
+// WritePrometheus writes the findings in Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricKey, 0, len(m.counts))
+	for key := range m.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mapping != keys[j].mapping {
+			return keys[i].mapping < keys[j].mapping
+		}
+		return keys[i].detector < keys[j].detector
+	})
+
+	fmt.Fprintf(w, "# HELP marchproxy_dlp_findings_total Sensitive data found in outbound payloads per mapping, detector and action\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_dlp_findings_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_dlp_findings_total{mapping=%q,detector=%q,action=%q} %d\n",
+			key.mapping, key.detector, key.action, m.counts[key])
+	}
+}
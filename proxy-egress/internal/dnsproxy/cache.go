@@ -0,0 +1,185 @@
+package dnsproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Cache bounds
+const (
+	DefaultCacheSize   = 10000
+	DefaultCacheMaxTTL = 5 * time.Minute
+	negativeCacheTTL   = 30 * time.Second // For answers without an SOA
+)
+
+// cacheKey identifies a cached answer
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// cacheEntry is an upstream answer and when it was stored
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache holds upstream answers until their TTL runs out. When full, the
+// entry closest to expiry is evicted.
+type Cache struct {
+	maxEntries int
+	maxTTL     time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	now     func() time.Time
+}
+
+// NewCache creates a cache of up to maxEntries answers, each kept at most
+// maxTTL. A cache of size 0 stores nothing.
+func NewCache(maxEntries int, maxTTL time.Duration) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    make(map[cacheKey]*cacheEntry),
+		now:        time.Now,
+	}
+}
+
+func keyOf(q dnsmessage.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+// Get returns a cached answer for q with TTLs reduced by the time it was
+// cached, or false
+func (c *Cache) Get(q dnsmessage.Question) (dnsmessage.Message, bool) {
+	if c == nil || c.maxEntries <= 0 {
+		return dnsmessage.Message{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := keyOf(q)
+	entry, ok := c.entries[key]
+	if !ok {
+		return dnsmessage.Message{}, false
+	}
+	now := c.now()
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return dnsmessage.Message{}, false
+	}
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	msg := entry.msg
+	msg.Answers = agedResources(entry.msg.Answers, elapsed)
+	msg.Authorities = agedResources(entry.msg.Authorities, elapsed)
+	msg.Additionals = agedResources(entry.msg.Additionals, elapsed)
+	return msg, true
+}
+
+// Put caches an upstream answer to q. Only successful answers and
+// NXDOMAIN are cached, truncated answers never.
+func (c *Cache) Put(q dnsmessage.Question, msg dnsmessage.Message) {
+	if c == nil || c.maxEntries <= 0 || msg.Truncated {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	ttl := answerTTL(msg)
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	key := keyOf(q)
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// evict removes expired entries, or the one closest to expiry when none
+// have. The caller holds c.mu.
+func (c *Cache) evict(now time.Time) {
+	var oldest cacheKey
+	var oldestExpiry time.Time
+	removed := false
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			removed = true
+			continue
+		}
+		if oldestExpiry.IsZero() || entry.expires.Before(oldestExpiry) {
+			oldest = key
+			oldestExpiry = entry.expires
+		}
+	}
+	if !removed && !oldestExpiry.IsZero() {
+		delete(c.entries, oldest)
+	}
+}
+
+// Len returns the number of cached answers
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// answerTTL is how long an answer may be cached: the lowest answer TTL, or
+// for negative answers the SOA minimum (RFC 2308)
+func answerTTL(msg dnsmessage.Message) time.Duration {
+	if len(msg.Answers) == 0 {
+		for _, rr := range msg.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				ttl := min(rr.Header.TTL, soa.MinTTL)
+				return time.Duration(ttl) * time.Second
+			}
+		}
+		return negativeCacheTTL
+	}
+
+	ttl := msg.Answers[0].Header.TTL
+	for _, rr := range msg.Answers[1:] {
+		ttl = min(ttl, rr.Header.TTL)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// agedResources copies resources with their TTLs reduced by elapsed
+// seconds. The OPT pseudo-record has no TTL and is left as is.
+func agedResources(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(resources) == 0 {
+		return nil
+	}
+	aged := make([]dnsmessage.Resource, len(resources))
+	copy(aged, resources)
+	for i := range aged {
+		if aged[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if aged[i].Header.TTL > elapsed {
+			aged[i].Header.TTL -= elapsed
+		} else {
+			aged[i].Header.TTL = 0
+		}
+	}
+	return aged
+}
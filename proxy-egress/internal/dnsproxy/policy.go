@@ -0,0 +1,213 @@
+// Package dnsproxy answers DNS queries from egress clients, enforcing the
+// domain allow and deny lists of their mappings before forwarding to the
+// upstream resolvers.
+//
+// Clients are identified by the service their address belongs to. A query
+// resolves when any mapping the service is a source of allows the domain.
+// Rewrites answer split-horizon names with fixed addresses instead of
+// asking upstream. Upstream answers are cached for their TTL, and every
+// query is counted and optionally logged per service.
+//
+// The Resolver applies the same policies, caching and upstreams to the
+// destination names the proxy connects to itself.
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Policy is the DNS part of a mapping
+type Policy struct {
+	// Domains the mapping's sources may resolve. "example.com" matches the
+	// domain and its subdomains, "*.example.com" only the subdomains.
+	// Empty allows every domain not denied.
+	AllowDomains []string `json:"allow_domains,omitempty"`
+
+	// Domains never resolved, checked before the allow list
+	DenyDomains []string `json:"deny_domains,omitempty"`
+
+	// Fixed answers for split-horizon names
+	Rewrites []Rewrite `json:"rewrites,omitempty"`
+}
+
+// Rewrite answers queries for a domain with fixed addresses
+type Rewrite struct {
+	Domain    string   `json:"domain"`        // Same patterns as the domain lists
+	Addresses []string `json:"addresses"`     // A and AAAA answers
+	TTL       uint32   `json:"ttl,omitempty"` // seconds, default 60
+}
+
+// DefaultRewriteTTL is the TTL of rewritten answers without one
+const DefaultRewriteTTL = 60
+
+// Validate checks the domain patterns and rewrite addresses
+func (p *Policy) Validate() error {
+	for _, domain := range append(append([]string{}, p.AllowDomains...), p.DenyDomains...) {
+		if err := validatePattern(domain); err != nil {
+			return err
+		}
+	}
+	for _, rewrite := range p.Rewrites {
+		if err := validatePattern(rewrite.Domain); err != nil {
+			return err
+		}
+		if len(rewrite.Addresses) == 0 {
+			return fmt.Errorf("rewrite for %s has no addresses", rewrite.Domain)
+		}
+		for _, address := range rewrite.Addresses {
+			if _, err := netip.ParseAddr(address); err != nil {
+				return fmt.Errorf("rewrite for %s: invalid address %q", rewrite.Domain, address)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePattern checks a domain pattern
+func validatePattern(pattern string) error {
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.Contains(name, "*") || strings.Contains(name, " ") {
+		return fmt.Errorf("invalid domain pattern %q", pattern)
+	}
+	return nil
+}
+
+// MatchDomain reports whether a query name matches a domain pattern. Names
+// are compared case-insensitively, without the trailing dot.
+func MatchDomain(name, pattern string) bool {
+	name = canonical(name)
+	pattern = canonical(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(name, "."+suffix)
+	}
+	return name == pattern || strings.HasSuffix(name, "."+pattern)
+}
+
+// matchAny reports whether name matches any of the patterns
+func matchAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if MatchDomain(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical lower-cases a name and strips its trailing dot
+func canonical(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Allows reports whether the policy lets name resolve
+func (p *Policy) Allows(name string) bool {
+	if matchAny(name, p.DenyDomains) {
+		return false
+	}
+	return len(p.AllowDomains) == 0 || matchAny(name, p.AllowDomains)
+}
+
+// rewrite returns the rewrite for name, nil when there is none
+func (p *Policy) rewrite(name string) *Rewrite {
+	for i := range p.Rewrites {
+		if MatchDomain(name, p.Rewrites[i].Domain) {
+			return &p.Rewrites[i]
+		}
+	}
+	return nil
+}
+
+// Source is a service whose clients query the proxy, with the DNS
+// policies of the mappings it is a source of
+type Source struct {
+	Service  string
+	Networks []netip.Prefix // Client addresses of the service
+	Policies []*Policy
+}
+
+// ParseNetworks turns a service's ip_fqdn into client networks. Addresses
+// and CIDRs are used, comma separated; host names are skipped since
+// clients are matched by address.
+func ParseNetworks(ipFQDN string) []netip.Prefix {
+	var networks []netip.Prefix
+	for _, entry := range strings.Split(ipFQDN, ",") {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			networks = append(networks, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return networks
+}
+
+// Rules decide which queries each client may make
+type Rules struct {
+	Sources []Source
+
+	// Whether clients outside every source may resolve any domain
+	AllowUnknown bool
+}
+
+// Decision is what to do with one query
+type Decision struct {
+	Service string // Source service, "unknown" for other clients
+	Allowed bool
+	Rewrite *Rewrite // Fixed answer, nil to ask upstream
+}
+
+// UnknownService is the service reported for clients outside every source
+const UnknownService = "unknown"
+
+// Decide applies the rules to a query for name from client. The most
+// specific network containing the client picks the source.
+func (r *Rules) Decide(client net.IP, name string) Decision {
+	source := r.match(client)
+	if source == nil {
+		return Decision{Service: UnknownService, Allowed: r != nil && r.AllowUnknown}
+	}
+
+	decision := Decision{Service: source.Service}
+	if len(source.Policies) == 0 {
+		decision.Allowed = true
+		return decision
+	}
+	for _, policy := range source.Policies {
+		if !policy.Allows(name) {
+			continue
+		}
+		decision.Allowed = true
+		if rewrite := policy.rewrite(name); rewrite != nil {
+			decision.Rewrite = rewrite
+			break
+		}
+	}
+	return decision
+}
+
+// match returns the source with the longest network containing client
+func (r *Rules) match(client net.IP) *Source {
+	if r == nil {
+		return nil
+	}
+	addr, ok := netip.AddrFromSlice(client)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	var best *Source
+	bestBits := -1
+	for i := range r.Sources {
+		for _, network := range r.Sources[i].Networks {
+			if network.Contains(addr) && network.Bits() > bestBits {
+				best = &r.Sources[i]
+				bestBits = network.Bits()
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,119 @@
+package dnsproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		match   bool
+	}{
+		{"example.com.", "example.com", true},
+		{"API.Example.com.", "example.com", true},
+		{"notexample.com.", "example.com", false},
+		{"example.com.", "*.example.com", false},
+		{"a.b.example.com.", "*.example.com", true},
+		{"example.org.", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := MatchDomain(tt.name, tt.pattern); got != tt.match {
+			t.Errorf("MatchDomain(%q, %q) = %t, expected %t", tt.name, tt.pattern, got, tt.match)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	valid := Policy{
+		AllowDomains: []string{"example.com", "*.internal"},
+		Rewrites:     []Rewrite{{Domain: "db.internal", Addresses: []string{"10.0.0.5", "fd00::5"}}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid policy: %v", err)
+	}
+
+	invalid := []Policy{
+		{AllowDomains: []string{"*"}},
+		{DenyDomains: []string{"a.*.com"}},
+		{Rewrites: []Rewrite{{Domain: "db.internal"}}},
+		{Rewrites: []Rewrite{{Domain: "db.internal", Addresses: []string{"db"}}}},
+	}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", policy)
+		}
+	}
+}
+
+func TestRulesDecide(t *testing.T) {
+	rules := &Rules{
+		Sources: []Source{
+			{
+				Service:  "web",
+				Networks: ParseNetworks("10.0.0.0/24"),
+				Policies: []*Policy{
+					{AllowDomains: []string{"api.example.com"}},
+					{
+						AllowDomains: []string{"internal"},
+						DenyDomains:  []string{"secret.internal"},
+						Rewrites:     []Rewrite{{Domain: "db.internal", Addresses: []string{"10.1.0.5"}}},
+					},
+				},
+			},
+			// A more specific network picks its own service
+			{Service: "batch", Networks: ParseNetworks("10.0.0.7, batch.example.com")},
+		},
+	}
+
+	tests := []struct {
+		client  string
+		name    string
+		service string
+		allowed bool
+		rewrite bool
+	}{
+		{"10.0.0.1", "api.example.com.", "web", true, false},
+		{"10.0.0.1", "www.example.com.", "web", false, false},
+		{"10.0.0.1", "db.internal.", "web", true, true},
+		{"10.0.0.1", "secret.internal.", "web", false, false},
+		{"::ffff:10.0.0.1", "api.example.com.", "web", true, false},
+		{"10.0.0.7", "anything.example.org.", "batch", true, false},
+		{"192.168.1.1", "api.example.com.", UnknownService, false, false},
+	}
+	for _, tt := range tests {
+		d := rules.Decide(net.ParseIP(tt.client), tt.name)
+		if d.Service != tt.service || d.Allowed != tt.allowed || (d.Rewrite != nil) != tt.rewrite {
+			t.Errorf("%s asking %s: got %+v", tt.client, tt.name, d)
+		}
+	}
+
+	rules.AllowUnknown = true
+	if d := rules.Decide(net.ParseIP("192.168.1.1"), "example.org."); !d.Allowed {
+		t.Error("Expected unknown clients to be allowed")
+	}
+
+	var none *Rules
+	if d := none.Decide(net.ParseIP("10.0.0.1"), "example.org."); d.Allowed {
+		t.Error("Expected every query to be blocked without rules")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks := ParseNetworks("10.0.0.5, 10.1.0.0/16,db.example.com,fd00::/64")
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.5/32"),
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("fd00::/64"),
+	}
+	if len(networks) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, networks)
+	}
+	for i := range expected {
+		if networks[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], networks[i])
+		}
+	}
+}
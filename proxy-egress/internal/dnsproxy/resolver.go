@@ -0,0 +1,265 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrBlocked is returned for names the egress DNS policy doesn't let the
+// proxy resolve
+var ErrBlocked = errors.New("blocked by the egress DNS policy")
+
+// ResolverOptions configure a resolver
+type ResolverOptions struct {
+	Upstreams []*Upstream // Tried in order until one answers, the system resolver when empty
+	Cache     *Cache      // nil disables caching
+}
+
+// Resolver looks up the destinations the proxy connects to itself, the
+// host names in service ip_fqdn values. The cluster's egress DNS policy
+// decides which names may resolve, and rewrites pin names to fixed
+// addresses. Without upstreams names go to the system resolver, which
+// keeps its own cache.
+type Resolver struct {
+	opts   ResolverOptions
+	policy atomic.Pointer[Policy]
+	system func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+	mu             sync.Mutex
+	counts         map[string]int64 // result -> lookups
+	upstreamErrors map[string]int64
+}
+
+// NewResolver creates a resolver that resolves every name until a policy
+// is set
+func NewResolver(opts ResolverOptions) *Resolver {
+	return &Resolver{
+		opts:           opts,
+		system:         net.DefaultResolver.LookupNetIP,
+		counts:         make(map[string]int64),
+		upstreamErrors: make(map[string]int64),
+	}
+}
+
+// SetPolicy replaces the egress DNS policy, nil allows every name
+func (r *Resolver) SetPolicy(policy *Policy) {
+	r.policy.Store(policy)
+}
+
+// Check returns ErrBlocked when the policy doesn't let host resolve.
+// Addresses are never blocked.
+func (r *Resolver) Check(host string) error {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	if policy := r.policy.Load(); policy != nil && !policy.Allows(host) {
+		r.count(ResultBlocked)
+		return fmt.Errorf("%s: %w", host, ErrBlocked)
+	}
+	return nil
+}
+
+// LookupNetIP returns the addresses of host on network ("ip", "ip4" or
+// "ip6"), IPv6 first, the way net.Resolver does. Answers from upstreams
+// are cached for their TTL.
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	if err := r.Check(host); err != nil {
+		return nil, err
+	}
+
+	if policy := r.policy.Load(); policy != nil {
+		if rewrite := policy.rewrite(host); rewrite != nil {
+			r.count(ResultRewritten)
+			return rewriteAddrs(network, host, rewrite)
+		}
+	}
+
+	if len(r.opts.Upstreams) == 0 {
+		addrs, err := r.system(ctx, network, host)
+		if err != nil {
+			r.count(ResultError)
+			return nil, err
+		}
+		r.count(ResultResolved)
+		return addrs, nil
+	}
+
+	var types []dnsmessage.Type
+	if network != "ip4" {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	if network != "ip6" {
+		types = append(types, dnsmessage.TypeA)
+	}
+
+	// Both families are asked at once
+	answers := make([]lookupAnswer, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers[i] = r.lookup(ctx, host, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var err error
+	cached := true
+	for _, answer := range answers {
+		addrs = append(addrs, answer.addrs...)
+		if answer.err != nil && err == nil {
+			err = answer.err
+		}
+		cached = cached && answer.cached
+	}
+
+	switch {
+	case len(addrs) > 0:
+		if cached {
+			r.count(ResultCached)
+		} else {
+			r.count(ResultResolved)
+		}
+		return addrs, nil
+	case err != nil:
+		r.count(ResultError)
+		return nil, err
+	default:
+		r.count(ResultError)
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+}
+
+// lookupAnswer is the result of one record type lookup
+type lookupAnswer struct {
+	addrs  []netip.Addr
+	cached bool
+	err    error
+}
+
+// lookup asks the cache, then the upstreams in turn, for the qtype records
+// of host
+func (r *Resolver) lookup(ctx context.Context, host string, qtype dnsmessage.Type) lookupAnswer {
+	name, err := dnsmessage.NewName(canonical(host) + ".")
+	if err != nil {
+		return lookupAnswer{err: &net.DNSError{Err: "invalid host name", Name: host}}
+	}
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+
+	if msg, ok := r.opts.Cache.Get(question); ok {
+		return lookupAnswer{addrs: answerAddrs(msg, qtype), cached: true}
+	}
+
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	for _, upstream := range r.opts.Upstreams {
+		var msg dnsmessage.Message
+		if msg, err = upstream.Exchange(ctx, query); err != nil {
+			r.mu.Lock()
+			r.upstreamErrors[upstream.Address]++
+			r.mu.Unlock()
+			continue
+		}
+		if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+			err = &net.DNSError{Err: "server failure: " + rcodeName(msg.RCode), Name: host, Server: upstream.Address, IsTemporary: true}
+			continue
+		}
+		r.opts.Cache.Put(question, msg)
+		return lookupAnswer{addrs: answerAddrs(msg, qtype)}
+	}
+	return lookupAnswer{err: err}
+}
+
+// answerAddrs returns the addresses of the qtype records of an answer,
+// following any CNAMEs the upstream resolved along the way
+func answerAddrs(msg dnsmessage.Message, qtype dnsmessage.Type) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				addrs = append(addrs, netip.AddrFrom4(body.A))
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+			}
+		}
+	}
+	return addrs
+}
+
+// rewriteAddrs returns the rewrite's addresses of network's family
+func rewriteAddrs(network, host string, rewrite *Rewrite) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, address := range rewrite.Addresses {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			continue
+		}
+		if (network == "ip4" && !addr.Is4()) || (network == "ip6" && !addr.Is6()) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// count records a lookup result
+func (r *Resolver) count(result string) {
+	r.mu.Lock()
+	r.counts[result]++
+	r.mu.Unlock()
+}
+
+// WritePrometheus writes lookup counts, upstream errors and the cache size
+// in Prometheus text format
+func (r *Resolver) WritePrometheus(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP marchproxy_resolver_lookups_total Destination host name lookups per result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_resolver_lookups_total counter\n")
+	for _, result := range []string{ResultBlocked, ResultCached, ResultError, ResultResolved, ResultRewritten} {
+		if n, ok := r.counts[result]; ok {
+			fmt.Fprintf(w, "marchproxy_resolver_lookups_total{result=%q} %d\n", result, n)
+		}
+	}
+
+	upstreams := make([]string, 0, len(r.upstreamErrors))
+	for upstream := range r.upstreamErrors {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	fmt.Fprintf(w, "# HELP marchproxy_resolver_upstream_errors_total Failed exchanges per destination resolver upstream\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_resolver_upstream_errors_total counter\n")
+	for _, upstream := range upstreams {
+		fmt.Fprintf(w, "marchproxy_resolver_upstream_errors_total{upstream=%q} %d\n", upstream, r.upstreamErrors[upstream])
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_resolver_cache_entries Answers in the destination resolver cache\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_resolver_cache_entries gauge\n")
+	fmt.Fprintf(w, "marchproxy_resolver_cache_entries %d\n", r.opts.Cache.Len())
+}
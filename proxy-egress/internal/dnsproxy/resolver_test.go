@@ -0,0 +1,91 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolverCachesUpstreamAnswers(t *testing.T) {
+	address, queries := fakeUpstream(t)
+	upstream, err := ParseUpstream(address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(ResolverOptions{Upstreams: []*Upstream{upstream}, Cache: NewCache(10, time.Minute)})
+
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupNetIP(context.Background(), "ip", "API.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") {
+			t.Errorf("Addresses = %v, want [192.0.2.1]", addrs)
+		}
+	}
+	// One A and one AAAA query, the second lookup came from the cache
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Upstream queries = %d, want 2", n)
+	}
+
+	var metrics strings.Builder
+	r.WritePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_resolver_lookups_total{result="cached"} 1`,
+		`marchproxy_resolver_lookups_total{result="resolved"} 1`,
+		`marchproxy_resolver_cache_entries 2`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestResolverPolicy(t *testing.T) {
+	r := NewResolver(ResolverOptions{})
+	r.system = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("198.51.100.7")}, nil
+	}
+	r.SetPolicy(&Policy{
+		AllowDomains: []string{"example.com"},
+		DenyDomains:  []string{"internal.example.com"},
+		Rewrites:     []Rewrite{{Domain: "db.example.com", Addresses: []string{"10.0.0.5", "fd00::5"}}},
+	})
+
+	if _, err := r.LookupNetIP(context.Background(), "ip", "vault.internal.example.com"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Denied name: got %v, want ErrBlocked", err)
+	}
+	if _, err := r.LookupNetIP(context.Background(), "ip", "example.org"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Name outside the allow list: got %v, want ErrBlocked", err)
+	}
+	if addrs, err := r.LookupNetIP(context.Background(), "ip", "10.1.2.3"); err != nil || len(addrs) != 1 {
+		t.Errorf("Addresses are never blocked: got %v, %v", addrs, err)
+	}
+	if addrs, err := r.LookupNetIP(context.Background(), "ip", "www.example.com"); err != nil || addrs[0] != netip.MustParseAddr("198.51.100.7") {
+		t.Errorf("Allowed name: got %v, %v", addrs, err)
+	}
+	if addrs, err := r.LookupNetIP(context.Background(), "ip4", "db.example.com"); err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("10.0.0.5") {
+		t.Errorf("Rewritten name: got %v, %v, want [10.0.0.5]", addrs, err)
+	}
+
+	// Without a policy every name resolves
+	r.SetPolicy(nil)
+	if _, err := r.LookupNetIP(context.Background(), "ip", "example.org"); err != nil {
+		t.Errorf("No policy: got %v", err)
+	}
+
+	var metrics strings.Builder
+	r.WritePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_resolver_lookups_total{result="blocked"} 2`,
+		`marchproxy_resolver_lookups_total{result="resolved"} 2`,
+		`marchproxy_resolver_lookups_total{result="rewritten"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Query results, counted per service
+const (
+	ResultResolved  = "resolved"
+	ResultCached    = "cached"
+	ResultRewritten = "rewritten"
+	ResultBlocked   = "blocked"
+	ResultError     = "error"
+)
+
+const (
+	// ednsUDPSize is the UDP payload size advertised to clients (DNS flag day 2020)
+	ednsUDPSize = 1232
+	// plainUDPSize is the UDP payload limit for clients without EDNS
+	plainUDPSize = 512
+	// maxInflight bounds UDP queries handled at once
+	maxInflight = 1024
+	// tcpIdleTimeout closes TCP clients that send nothing
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// Options configure a server
+type Options struct {
+	Upstreams     []*Upstream // Tried in order until one answers
+	Cache         *Cache      // nil disables caching
+	BlockResponse string      // nxdomain (default) or refused
+	QueryLog      io.Writer   // JSON line per query, nil disables the log
+}
+
+// Server answers DNS queries over UDP and TCP
+type Server struct {
+	opts  Options
+	rules atomic.Pointer[Rules]
+
+	mu             sync.Mutex
+	counts         map[string]map[string]int64 // service -> result -> queries
+	upstreamErrors map[string]int64
+	logMu          sync.Mutex
+}
+
+// NewServer creates a server. It blocks every query until rules are set.
+func NewServer(opts Options) *Server {
+	return &Server{
+		opts:           opts,
+		counts:         make(map[string]map[string]int64),
+		upstreamErrors: make(map[string]int64),
+	}
+}
+
+// SetRules replaces the rules for the following queries
+func (s *Server) SetRules(rules *Rules) {
+	s.rules.Store(rules)
+}
+
+// ServeUDP answers queries on conn until ctx is done
+func (s *Server) ServeUDP(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	inflight := make(chan struct{}, maxInflight)
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		client := addrIP(addr)
+
+		select {
+		case inflight <- struct{}{}:
+		default:
+			// Overloaded, the client retries
+			continue
+		}
+		go func() {
+			defer func() { <-inflight }()
+			if answer := s.handle(ctx, client, buf[:n], true); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}()
+	}
+}
+
+// ServeTCP answers queries on connections accepted from listener until ctx
+// is done
+func (s *Server) ServeTCP(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// serveConn answers length-prefixed queries on one TCP connection
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	client := addrIP(conn.RemoteAddr())
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readStreamMessage(conn)
+		if err != nil {
+			return
+		}
+		answer := s.handle(ctx, client, query, false)
+		if answer == nil {
+			return
+		}
+		if err := writeStreamMessage(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// addrIP returns the IP of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// handle answers one packed query. It returns nil for input that isn't a
+// DNS query.
+func (s *Server) handle(ctx context.Context, client net.IP, packed []byte, udp bool) []byte {
+	start := time.Now()
+	var query dnsmessage.Message
+	if err := query.Unpack(packed); err != nil || query.Response {
+		return s.malformed(packed)
+	}
+	udpSize := plainUDPSize
+	edns := clientEDNS(query)
+	if edns > 0 {
+		udpSize = max(plainUDPSize, min(edns, ednsUDPSize))
+	}
+
+	if query.OpCode != 0 {
+		return s.pack(query, reply(query, dnsmessage.RCodeNotImplemented), edns, udp, udpSize)
+	}
+	if len(query.Questions) != 1 {
+		return s.pack(query, reply(query, dnsmessage.RCodeFormatError), edns, udp, udpSize)
+	}
+
+	question := query.Questions[0]
+	name := question.Name.String()
+	decision := s.rules.Load().Decide(client, name)
+
+	var answer dnsmessage.Message
+	var result string
+	switch {
+	case !decision.Allowed:
+		rcode := dnsmessage.RCodeNameError
+		if s.opts.BlockResponse == "refused" {
+			rcode = dnsmessage.RCodeRefused
+		}
+		answer, result = reply(query, rcode), ResultBlocked
+	case decision.Rewrite != nil:
+		answer, result = rewriteAnswer(query, decision.Rewrite), ResultRewritten
+	default:
+		if cached, ok := s.opts.Cache.Get(question); ok {
+			answer, result = cached, ResultCached
+		} else if resolved, err := s.resolve(ctx, query); err == nil {
+			s.opts.Cache.Put(question, resolved)
+			answer, result = resolved, ResultResolved
+		} else {
+			answer, result = reply(query, dnsmessage.RCodeServerFailure), ResultError
+		}
+	}
+
+	s.count(decision.Service, result)
+	s.logQuery(start, client, decision.Service, question, result, answer.RCode)
+	return s.pack(query, answer, edns, udp, udpSize)
+}
+
+// malformed answers a query that could not be parsed with FORMERR, when at
+// least its header is intact
+func (s *Server) malformed(packed []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packed)
+	if err != nil || header.Response {
+		return nil
+	}
+	header.Response = true
+	header.RCode = dnsmessage.RCodeFormatError
+	answer, err := (&dnsmessage.Message{Header: header}).Pack()
+	if err != nil {
+		return nil
+	}
+	return answer
+}
+
+// resolve asks the upstreams in turn
+func (s *Server) resolve(ctx context.Context, query dnsmessage.Message) (dnsmessage.Message, error) {
+	upstreamQuery := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true, CheckingDisabled: query.CheckingDisabled},
+		Questions: query.Questions,
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false); err == nil {
+		upstreamQuery.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+
+	err := errors.New("no DNS upstreams configured")
+	for _, upstream := range s.opts.Upstreams {
+		var answer dnsmessage.Message
+		if answer, err = upstream.Exchange(ctx, upstreamQuery); err == nil {
+			return answer, nil
+		}
+		s.mu.Lock()
+		s.upstreamErrors[upstream.Address]++
+		s.mu.Unlock()
+	}
+	return dnsmessage.Message{}, err
+}
+
+// reply is an empty answer to query with rcode
+func reply(query dnsmessage.Message, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{RCode: rcode},
+		Questions: query.Questions,
+	}
+}
+
+// rewriteAnswer answers a query with the rewrite's addresses of the asked
+// family. Other types get an empty answer, the name exists but has no such
+// records.
+func rewriteAnswer(query dnsmessage.Message, rewrite *Rewrite) dnsmessage.Message {
+	answer := reply(query, dnsmessage.RCodeSuccess)
+	answer.Authoritative = true
+	question := query.Questions[0]
+	ttl := rewrite.TTL
+	if ttl == 0 {
+		ttl = DefaultRewriteTTL
+	}
+
+	for _, address := range rewrite.Addresses {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			continue
+		}
+		header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		switch {
+		case question.Type == dnsmessage.TypeA && addr.Is4():
+			header.Type = dnsmessage.TypeA
+			answer.Answers = append(answer.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+			header.Type = dnsmessage.TypeAAAA
+			answer.Answers = append(answer.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return answer
+}
+
+// clientEDNS returns the UDP payload size the client advertised, 0
+// without EDNS
+func clientEDNS(query dnsmessage.Message) int {
+	for _, rr := range query.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return int(rr.Header.Class)
+		}
+	}
+	return 0
+}
+
+// pack finishes an answer for the client: its ID, flags and question, our
+// own OPT record when it used EDNS, and truncation to its UDP size
+func (s *Server) pack(query, answer dnsmessage.Message, edns int, udp bool, udpSize int) []byte {
+	answer.ID = query.ID
+	answer.Response = true
+	answer.OpCode = query.OpCode
+	answer.RecursionDesired = query.RecursionDesired
+	answer.RecursionAvailable = true
+	answer.Truncated = false
+	answer.Questions = query.Questions
+
+	var opt []dnsmessage.Resource
+	if edns > 0 {
+		var header dnsmessage.ResourceHeader
+		if err := header.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false); err == nil {
+			opt = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.OPTResource{}}}
+		}
+	}
+	additionals := make([]dnsmessage.Resource, 0, len(answer.Additionals)+len(opt))
+	for _, rr := range answer.Additionals {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	answer.Additionals = append(additionals, opt...)
+
+	packed, err := answer.Pack()
+	if err != nil {
+		return nil
+	}
+	if udp && len(packed) > udpSize {
+		// Too large for a datagram, the client retries over TCP
+		answer.Truncated = true
+		answer.Answers, answer.Authorities, answer.Additionals = nil, nil, opt
+		if packed, err = answer.Pack(); err != nil {
+			return nil
+		}
+	}
+	return packed
+}
+
+// count records a query result for a service
+func (s *Server) count(service, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results, ok := s.counts[service]
+	if !ok {
+		results = make(map[string]int64)
+		s.counts[service] = results
+	}
+	results[result]++
+}
+
+// queryLogEntry is one line of the query log
+type queryLogEntry struct {
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Client     string    `json:"client"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Result     string    `json:"result"`
+	RCode      string    `json:"rcode"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// logQuery writes a query to the query log
+func (s *Server) logQuery(start time.Time, client net.IP, service string, question dnsmessage.Question, result string, rcode dnsmessage.RCode) {
+	if s.opts.QueryLog == nil {
+		return
+	}
+	line, err := json.Marshal(queryLogEntry{
+		Time:       start.UTC(),
+		Service:    service,
+		Client:     client.String(),
+		Name:       canonical(question.Name.String()),
+		Type:       typeName(question.Type),
+		Result:     result,
+		RCode:      rcodeName(rcode),
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	})
+	if err != nil {
+		return
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.opts.QueryLog.Write(append(line, '\n'))
+}
+
+// typeName returns a record type without the dnsmessage prefix
+func typeName(t dnsmessage.Type) string {
+	name := t.String()
+	if len(name) > 4 && name[:4] == "Type" {
+		return name[4:]
+	}
+	return name
+}
+
+// rcodeName returns an rcode without the dnsmessage prefix
+func rcodeName(rcode dnsmessage.RCode) string {
+	name := rcode.String()
+	if len(name) > 5 && name[:5] == "RCode" {
+		return name[5:]
+	}
+	return name
+}
+
+// Counts returns queries by service and result
+func (s *Server) Counts() map[string]map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]map[string]int64, len(s.counts))
+	for service, results := range s.counts {
+		copied := make(map[string]int64, len(results))
+		for result, n := range results {
+			copied[result] = n
+		}
+		counts[service] = copied
+	}
+	return counts
+}
+
+// WritePrometheus writes query counts, upstream errors and the cache size
+// in Prometheus text format
+func (s *Server) WritePrometheus(w io.Writer) {
+	if s == nil {
+		return
+	}
+	counts := s.Counts()
+	services := make([]string, 0, len(counts))
+	for service := range counts {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	fmt.Fprintf(w, "# HELP marchproxy_dns_queries_total DNS queries per source service and result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_dns_queries_total counter\n")
+	for _, service := range services {
+		for _, result := range []string{ResultBlocked, ResultCached, ResultError, ResultResolved, ResultRewritten} {
+			if n, ok := counts[service][result]; ok {
+				fmt.Fprintf(w, "marchproxy_dns_queries_total{service=%q,result=%q} %d\n", service, result, n)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	upstreams := make([]string, 0, len(s.upstreamErrors))
+	for upstream := range s.upstreamErrors {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	fmt.Fprintf(w, "# HELP marchproxy_dns_upstream_errors_total Failed exchanges per DNS upstream\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_dns_upstream_errors_total counter\n")
+	for _, upstream := range upstreams {
+		fmt.Fprintf(w, "marchproxy_dns_upstream_errors_total{upstream=%q} %d\n", upstream, s.upstreamErrors[upstream])
+	}
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP marchproxy_dns_cache_entries Answers in the DNS cache\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_dns_cache_entries gauge\n")
+	fmt.Fprintf(w, "marchproxy_dns_cache_entries %d\n", s.opts.Cache.Len())
+}
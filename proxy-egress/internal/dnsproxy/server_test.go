@@ -0,0 +1,227 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream answers A queries with 192.0.2.1 and counts them
+func fakeUpstream(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			answer := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 120},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}},
+			}
+			packed, _ := answer.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+// ask packs a query, handles it and unpacks the answer
+func ask(t *testing.T, s *Server, client, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack query: %v", err)
+	}
+	raw := s.handle(context.Background(), net.ParseIP(client), packed, true)
+	var answer dnsmessage.Message
+	if err := answer.Unpack(raw); err != nil {
+		t.Fatalf("Failed to unpack answer: %v", err)
+	}
+	if answer.ID != 42 || !answer.Response {
+		t.Errorf("Expected a response to query 42, got %+v", answer.Header)
+	}
+	return answer
+}
+
+func TestServerHandle(t *testing.T) {
+	addr, queries := fakeUpstream(t)
+	upstream, err := ParseUpstream(addr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to parse upstream: %v", err)
+	}
+
+	var log bytes.Buffer
+	s := NewServer(Options{
+		Upstreams: []*Upstream{upstream},
+		Cache:     NewCache(100, time.Minute),
+		QueryLog:  &log,
+	})
+	s.SetRules(&Rules{Sources: []Source{{
+		Service:  "web",
+		Networks: ParseNetworks("10.0.0.0/24"),
+		Policies: []*Policy{{
+			AllowDomains: []string{"example.com", "internal"},
+			Rewrites:     []Rewrite{{Domain: "db.internal", Addresses: []string{"10.1.0.5", "fd00::5"}, TTL: 30}},
+		}},
+	}}})
+
+	// Resolved upstream, then answered from the cache
+	for i := 0; i < 2; i++ {
+		answer := ask(t, s, "10.0.0.1", "api.example.com.", dnsmessage.TypeA)
+		if answer.RCode != dnsmessage.RCodeSuccess || len(answer.Answers) != 1 {
+			t.Fatalf("Expected one answer, got %+v", answer)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected the second query to be cached, upstream saw %d", n)
+	}
+
+	// Denied by the allow list
+	if answer := ask(t, s, "10.0.0.1", "example.org.", dnsmessage.TypeA); answer.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected NXDOMAIN, got %v", answer.RCode)
+	}
+
+	// Unknown client
+	if answer := ask(t, s, "192.168.0.1", "api.example.com.", dnsmessage.TypeA); answer.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected NXDOMAIN for an unknown client, got %v", answer.RCode)
+	}
+
+	// Rewritten per address family
+	answer := ask(t, s, "10.0.0.1", "db.internal.", dnsmessage.TypeAAAA)
+	if len(answer.Answers) != 1 || answer.Answers[0].Header.TTL != 30 {
+		t.Fatalf("Expected one rewritten AAAA answer, got %+v", answer.Answers)
+	}
+	if aaaa, ok := answer.Answers[0].Body.(*dnsmessage.AAAAResource); !ok || net.IP(aaaa.AAAA[:]).String() != "fd00::5" {
+		t.Errorf("Expected fd00::5, got %v", answer.Answers[0].Body)
+	}
+	if answer := ask(t, s, "10.0.0.1", "db.internal.", dnsmessage.TypeMX); answer.RCode != dnsmessage.RCodeSuccess || len(answer.Answers) != 0 {
+		t.Errorf("Expected an empty answer for MX, got %+v", answer)
+	}
+
+	counts := s.Counts()
+	if counts["web"][ResultResolved] != 1 || counts["web"][ResultCached] != 1 || counts["web"][ResultBlocked] != 1 ||
+		counts["web"][ResultRewritten] != 2 || counts[UnknownService][ResultBlocked] != 1 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 6 || !strings.Contains(lines[0], `"service":"web"`) || !strings.Contains(lines[0], `"name":"api.example.com"`) {
+		t.Errorf("Unexpected query log:\n%s", log.String())
+	}
+
+	var metrics bytes.Buffer
+	s.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `marchproxy_dns_queries_total{service="web",result="cached"} 1`) ||
+		!strings.Contains(metrics.String(), "marchproxy_dns_cache_entries 1") {
+		t.Errorf("Unexpected metrics:\n%s", metrics.String())
+	}
+}
+
+func TestServerUpstreamFailure(t *testing.T) {
+	// Nothing listens on the upstream port
+	upstream, _ := ParseUpstream("127.0.0.1:1", 200*time.Millisecond)
+	s := NewServer(Options{Upstreams: []*Upstream{upstream}})
+	s.SetRules(&Rules{AllowUnknown: true})
+
+	if answer := ask(t, s, "10.0.0.1", "example.com.", dnsmessage.TypeA); answer.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %v", answer.RCode)
+	}
+	if counts := s.Counts(); counts[UnknownService][ResultError] != 1 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	question := func(name string) dnsmessage.Question {
+		return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	}
+	answer := func(name string, ttl uint32) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{},
+		}}}
+	}
+
+	c.Put(question("a.example."), answer("a.example.", 300)) // capped at a minute
+	c.Put(question("b.example."), answer("b.example.", 10))
+
+	now = now.Add(5 * time.Second)
+	msg, ok := c.Get(question("B.example."))
+	if !ok || msg.Answers[0].Header.TTL != 5 {
+		t.Fatalf("Expected b with 5s left, got %v %+v", ok, msg.Answers)
+	}
+
+	// Full, the entry closest to expiry makes room
+	c.Put(question("c.example."), answer("c.example.", 30))
+	if _, ok := c.Get(question("b.example.")); ok {
+		t.Error("Expected b to be evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get(question("a.example.")); ok {
+		t.Error("Expected a to expire after the maximum TTL")
+	}
+
+	// Failures are not cached
+	c.Put(question("d.example."), dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}})
+	if _, ok := c.Get(question("d.example.")); ok {
+		t.Error("Expected SERVFAIL not to be cached")
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+	}{
+		{"1.1.1.1", "udp", "1.1.1.1:53"},
+		{"tcp://[2606:4700::1111]:5353", "tcp", "[2606:4700::1111]:5353"},
+		{"tls://dns.example.net", "tls", "dns.example.net:853"},
+		{"https://dns.example.net/dns-query", "https", "https://dns.example.net/dns-query"},
+	}
+	for _, tt := range tests {
+		u, err := ParseUpstream(tt.address, time.Second)
+		if err != nil {
+			t.Errorf("ParseUpstream(%q): %v", tt.address, err)
+			continue
+		}
+		if u.network != tt.network || u.addr != tt.addr {
+			t.Errorf("ParseUpstream(%q) = %s %s, expected %s %s", tt.address, u.network, u.addr, tt.network, tt.addr)
+		}
+	}
+}
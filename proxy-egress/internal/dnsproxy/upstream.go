@@ -0,0 +1,214 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxMessageSize is the largest DNS message over TCP, DoT and DoH
+const maxMessageSize = 65535
+
+// Upstream resolves queries the proxy doesn't answer itself
+type Upstream struct {
+	Address string // As configured
+	network string // udp, tcp, tls or https
+	addr    string // host:port, or the URL for https
+	client  *http.Client
+	tls     *tls.Config
+	timeout time.Duration
+}
+
+// ParseUpstream parses an upstream resolver:
+//
+//	1.1.1.1 or 1.1.1.1:53              plain DNS over UDP, retried over TCP when truncated
+//	tcp://1.1.1.1:53                   plain DNS over TCP
+//	tls://dns.example.net:853          DNS over TLS, verified against the host name
+//	https://dns.example.net/dns-query  DNS over HTTPS (RFC 8484)
+func ParseUpstream(address string, timeout time.Duration) (*Upstream, error) {
+	u := &Upstream{Address: address, timeout: timeout}
+	switch {
+	case strings.HasPrefix(address, "https://"):
+		u.network = "https"
+		u.addr = address
+		u.client = &http.Client{Timeout: timeout}
+		return u, nil
+	case strings.HasPrefix(address, "tls://"):
+		u.network = "tls"
+		u.addr = withDefaultPort(strings.TrimPrefix(address, "tls://"), "853")
+		host, _, err := net.SplitHostPort(u.addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS upstream %q: %w", address, err)
+		}
+		u.tls = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	case strings.HasPrefix(address, "tcp://"):
+		u.network = "tcp"
+		u.addr = withDefaultPort(strings.TrimPrefix(address, "tcp://"), "53")
+	default:
+		u.network = "udp"
+		u.addr = withDefaultPort(strings.TrimPrefix(address, "udp://"), "53")
+	}
+	if _, _, err := net.SplitHostPort(u.addr); err != nil {
+		return nil, fmt.Errorf("invalid DNS upstream %q: %w", address, err)
+	}
+	return u, nil
+}
+
+// withDefaultPort adds port to an address without one
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// Exchange sends a query upstream and returns the answer
+func (u *Upstream) Exchange(ctx context.Context, query dnsmessage.Message) (dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	query.ID = uint16(rand.Uint32())
+	packed, err := query.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("failed to pack query: %w", err)
+	}
+
+	var raw []byte
+	switch u.network {
+	case "https":
+		raw, err = u.exchangeHTTPS(ctx, packed)
+	case "udp":
+		raw, err = u.exchangeUDP(ctx, packed)
+	default:
+		raw, err = u.exchangeStream(ctx, packed, u.network)
+	}
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(raw); err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("invalid answer from %s: %w", u.Address, err)
+	}
+	if answer.Truncated && u.network == "udp" {
+		if raw, err = u.exchangeStream(ctx, packed, "tcp"); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		if err := answer.Unpack(raw); err != nil {
+			return dnsmessage.Message{}, fmt.Errorf("invalid answer from %s: %w", u.Address, err)
+		}
+	}
+	// DoH queries carry ID 0 (RFC 8484), other transports echo ours
+	if u.network != "https" && answer.ID != query.ID {
+		return dnsmessage.Message{}, fmt.Errorf("answer from %s has the wrong ID", u.Address)
+	}
+	return answer, nil
+}
+
+// exchangeUDP sends a query in one datagram
+func (u *Upstream) exchangeUDP(ctx context.Context, packed []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams for other queries
+		if n >= 2 && bytes.Equal(buf[:2], packed[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends a length-prefixed query over TCP or TLS
+func (u *Upstream) exchangeStream(ctx context.Context, packed []byte, network string) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if network == "tls" {
+		dialer := &tls.Dialer{Config: u.tls}
+		conn, err = dialer.DialContext(ctx, "tcp", u.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", u.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := writeStreamMessage(conn, packed); err != nil {
+		return nil, err
+	}
+	return readStreamMessage(conn)
+}
+
+// exchangeHTTPS posts a query to a DoH resolver
+func (u *Upstream) exchangeHTTPS(ctx context.Context, packed []byte) ([]byte, error) {
+	// RFC 8484 recommends ID 0 so answers are cacheable by HTTP caches
+	packed[0], packed[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.addr, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s returned status %d", u.Address, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+// writeStreamMessage writes a message with its two-byte length prefix
+func writeStreamMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readStreamMessage reads a length-prefixed message
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,304 @@
+package ebpf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Program variants shipped by the eBPF build (see ebpf/Makefile)
+const (
+	VariantCORE   = "core"   // CO-RE object relocated against kernel BTF
+	VariantLegacy = "legacy" // Object compiled against local kernel headers
+	VariantNone   = "none"   // No usable program for this kernel
+)
+
+// Acceleration modes reported in /stats
+const (
+	ModeXDPOffload = "xdp-offload"
+	ModeXDPNative  = "xdp-native"
+	ModeXDPGeneric = "xdp-generic"
+	ModeUserspace  = "userspace"
+)
+
+// XDP attach modes supported by a network driver
+const (
+	XDPModeOffload = "offload"
+	XDPModeNative  = "native"
+	XDPModeGeneric = "generic"
+	XDPModeNone    = "none"
+)
+
+// KernelVersion represents a parsed kernel release
+type KernelVersion struct {
+	Major   int
+	Minor   int
+	Patch   int
+	Release string
+}
+
+// AtLeast returns true if the kernel version is greater than or equal to major.minor
+func (v KernelVersion) AtLeast(major, minor int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	return v.Minor >= minor
+}
+
+// String returns the kernel release string
+func (v KernelVersion) String() string {
+	if v.Release != "" {
+		return v.Release
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// KernelFeatures describes the eBPF capabilities of the running kernel
+type KernelFeatures struct {
+	Kernel       KernelVersion
+	BTFAvailable bool
+	Interface    string
+	Driver       string
+	XDPMode      string
+	Helpers      map[string]bool
+}
+
+// helperMinVersion lists the first kernel release shipping each helper the programs rely on
+var helperMinVersion = map[string][2]int{
+	"bpf_map_lookup_elem":   {3, 19},
+	"bpf_redirect":          {4, 4},
+	"bpf_xdp_adjust_head":   {4, 10},
+	"bpf_redirect_map":      {4, 14},
+	"bpf_xdp_adjust_tail":   {4, 18},
+	"bpf_fib_lookup":        {4, 18},
+	"bpf_sk_lookup_tcp":     {4, 20},
+	"bpf_spin_lock":         {5, 1},
+	"bpf_ktime_get_boot_ns": {5, 8},
+	"bpf_ringbuf_output":    {5, 8},
+	"bpf_redirect_neigh":    {5, 10},
+	"bpf_loop":              {5, 17},
+}
+
+// nativeXDPDrivers lists drivers known to implement XDP in the driver (native mode)
+var nativeXDPDrivers = map[string]bool{
+	"bnxt_en":    true,
+	"ena":        true,
+	"i40e":       true,
+	"ice":        true,
+	"igb":        true,
+	"igc":        true,
+	"ixgbe":      true,
+	"ixgbevf":    true,
+	"mlx4_core":  true,
+	"mlx5_core":  true,
+	"qede":       true,
+	"sfc":        true,
+	"stmmac":     true,
+	"thunderx":   true,
+	"tun":        true,
+	"veth":       true,
+	"virtio_net": true,
+}
+
+// offloadXDPDrivers lists drivers that can run XDP programs on the NIC itself
+var offloadXDPDrivers = map[string]bool{
+	"nfp": true,
+}
+
+// Minimum kernel releases for each program variant
+var (
+	minXDPKernel  = [2]int{4, 18}
+	minCOREKernel = [2]int{5, 2}
+)
+
+// DetectKernelFeatures probes the running kernel for eBPF support. If iface is
+// empty the interface carrying the default route is used.
+func DetectKernelFeatures(iface string) *KernelFeatures {
+	features := &KernelFeatures{
+		XDPMode: XDPModeNone,
+		Helpers: make(map[string]bool),
+	}
+
+	if runtime.GOOS != "linux" {
+		return features
+	}
+
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		features.Kernel = ParseKernelVersion(strings.TrimSpace(string(release)))
+	}
+
+	if _, err := os.Stat("/sys/kernel/btf/vmlinux"); err == nil {
+		features.BTFAvailable = true
+	}
+
+	for helper, minVersion := range helperMinVersion {
+		features.Helpers[helper] = features.Kernel.AtLeast(minVersion[0], minVersion[1])
+	}
+
+	if iface == "" {
+		iface = defaultRouteInterface()
+	}
+	features.Interface = iface
+
+	if iface != "" && features.Kernel.AtLeast(minXDPKernel[0], minXDPKernel[1]) {
+		features.Driver = interfaceDriver(iface)
+		switch {
+		case offloadXDPDrivers[features.Driver]:
+			features.XDPMode = XDPModeOffload
+		case nativeXDPDrivers[features.Driver]:
+			features.XDPMode = XDPModeNative
+		default:
+			features.XDPMode = XDPModeGeneric
+		}
+	}
+
+	return features
+}
+
+// ParseKernelVersion parses a kernel release such as "5.15.0-91-generic"
+func ParseKernelVersion(release string) KernelVersion {
+	version := KernelVersion{Release: release}
+
+	base := release
+	if idx := strings.IndexAny(base, "-+~ "); idx >= 0 {
+		base = base[:idx]
+	}
+
+	parts := strings.Split(base, ".")
+	fields := []*int{&version.Major, &version.Minor, &version.Patch}
+	for i := 0; i < len(parts) && i < len(fields); i++ {
+		if n, err := strconv.Atoi(parts[i]); err == nil {
+			*fields[i] = n
+		}
+	}
+
+	return version
+}
+
+// SelectVariant picks the best program variant for these features
+func (f *KernelFeatures) SelectVariant() string {
+	if !f.Kernel.AtLeast(minXDPKernel[0], minXDPKernel[1]) || f.XDPMode == XDPModeNone {
+		return VariantNone
+	}
+	if f.BTFAvailable && f.Kernel.AtLeast(minCOREKernel[0], minCOREKernel[1]) {
+		return VariantCORE
+	}
+	return VariantLegacy
+}
+
+// AccelerationMode returns the mode a loaded program of this variant runs in
+func (f *KernelFeatures) AccelerationMode() string {
+	if f.SelectVariant() == VariantNone {
+		return ModeUserspace
+	}
+	switch f.XDPMode {
+	case XDPModeOffload:
+		return ModeXDPOffload
+	case XDPModeNative:
+		return ModeXDPNative
+	default:
+		return ModeXDPGeneric
+	}
+}
+
+// MissingHelpers returns the helpers not available on this kernel
+func (f *KernelFeatures) MissingHelpers() []string {
+	var missing []string
+	for helper, available := range f.Helpers {
+		if !available {
+			missing = append(missing, helper)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// programSearchPaths returns candidate object paths for a variant, best match first
+func programSearchPaths(variant string) []string {
+	legacy := []string{
+		"ebpf/build/complete_filter.o",
+		"ebpf/build/rule_matcher.o",
+		"/opt/marchproxy/ebpf/complete_filter.o",
+		"./complete_filter.o",
+		"./rule_matcher.o",
+	}
+
+	switch variant {
+	case VariantCORE:
+		core := []string{
+			"ebpf/build/core/rule_matcher.o",
+			"/opt/marchproxy/ebpf/core/rule_matcher.o",
+			"./core/rule_matcher.o",
+		}
+		// CO-RE kernels can still run the legacy objects
+		return append(core, legacy...)
+	case VariantLegacy:
+		return legacy
+	default:
+		return nil
+	}
+}
+
+// FindEBPFProgramVariant searches for the compiled program matching a variant
+func FindEBPFProgramVariant(variant string) (string, string, error) {
+	searchPaths := programSearchPaths(variant)
+	if len(searchPaths) == 0 {
+		return "", VariantNone, fmt.Errorf("no eBPF program variant supported by this kernel")
+	}
+
+	for _, path := range searchPaths {
+		if absPath, err := filepath.Abs(path); err == nil {
+			if _, err := os.Stat(absPath); err == nil {
+				if strings.Contains(path, "core/") {
+					return absPath, VariantCORE, nil
+				}
+				return absPath, VariantLegacy, nil
+			}
+		}
+	}
+
+	return "", VariantNone, fmt.Errorf("eBPF program file not found in search paths: %v", searchPaths)
+}
+
+// defaultRouteInterface returns the interface carrying the IPv4 default route
+func defaultRouteInterface() string {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Iface Destination Gateway ... ; default route has destination 00000000
+		if len(fields) > 2 && fields[1] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// interfaceDriver returns the kernel driver name bound to an interface
+func interfaceDriver(iface string) string {
+	link, err := os.Readlink(filepath.Join("/sys/class/net", iface, "device", "driver"))
+	if err != nil {
+		// Virtual devices (veth, tun) have no device link; infer from uevent
+		uevent, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "uevent"))
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(uevent), "\n") {
+			if strings.HasPrefix(line, "DEVTYPE=") {
+				return strings.TrimPrefix(line, "DEVTYPE=")
+			}
+		}
+		return ""
+	}
+	return filepath.Base(link)
+}
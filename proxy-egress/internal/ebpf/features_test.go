@@ -0,0 +1,83 @@
+package ebpf
+
+import (
+	"testing"
+)
+
+// TestParseKernelVersion tests kernel release parsing
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		release string
+		major   int
+		minor   int
+		patch   int
+	}{
+		{"5.15.0-91-generic", 5, 15, 0},
+		{"6.1.55+", 6, 1, 55},
+		{"4.19.0", 4, 19, 0},
+		{"5.10", 5, 10, 0},
+		{"garbage", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.release, func(t *testing.T) {
+			v := ParseKernelVersion(tt.release)
+			if v.Major != tt.major || v.Minor != tt.minor || v.Patch != tt.patch {
+				t.Errorf("ParseKernelVersion(%q) = %d.%d.%d, want %d.%d.%d",
+					tt.release, v.Major, v.Minor, v.Patch, tt.major, tt.minor, tt.patch)
+			}
+		})
+	}
+}
+
+// TestSelectVariant tests program variant and mode selection
+func TestSelectVariant(t *testing.T) {
+	tests := []struct {
+		name     string
+		features KernelFeatures
+		variant  string
+		mode     string
+	}{
+		{
+			name:     "CO-RE capable kernel with native driver",
+			features: KernelFeatures{Kernel: ParseKernelVersion("5.15.0"), BTFAvailable: true, XDPMode: XDPModeNative},
+			variant:  VariantCORE,
+			mode:     ModeXDPNative,
+		},
+		{
+			name:     "BTF missing falls back to legacy objects",
+			features: KernelFeatures{Kernel: ParseKernelVersion("5.4.0"), BTFAvailable: false, XDPMode: XDPModeGeneric},
+			variant:  VariantLegacy,
+			mode:     ModeXDPGeneric,
+		},
+		{
+			name:     "BTF on pre-5.2 kernel uses legacy objects",
+			features: KernelFeatures{Kernel: ParseKernelVersion("4.19.0"), BTFAvailable: true, XDPMode: XDPModeNative},
+			variant:  VariantLegacy,
+			mode:     ModeXDPNative,
+		},
+		{
+			name:     "Old kernel runs in userspace",
+			features: KernelFeatures{Kernel: ParseKernelVersion("4.14.0"), XDPMode: XDPModeGeneric},
+			variant:  VariantNone,
+			mode:     ModeUserspace,
+		},
+		{
+			name:     "No interface runs in userspace",
+			features: KernelFeatures{Kernel: ParseKernelVersion("6.1.0"), BTFAvailable: true, XDPMode: XDPModeNone},
+			variant:  VariantNone,
+			mode:     ModeUserspace,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.features.SelectVariant(); got != tt.variant {
+				t.Errorf("SelectVariant() = %s, want %s", got, tt.variant)
+			}
+			if got := tt.features.AccelerationMode(); got != tt.mode {
+				t.Errorf("AccelerationMode() = %s, want %s", got, tt.mode)
+			}
+		})
+	}
+}
@@ -3,12 +3,16 @@ package ebpf
 import (
 	"fmt"
 	"os"
+	"syscall"
 	"unsafe"
+
+	"marchproxy-shared/ebpfstats"
 )
 
 /*
 #cgo LDFLAGS: -lbpf -lelf -lz
 #include <stdlib.h>
+#include <errno.h>
 #include <bpf/libbpf.h>
 #include <bpf/bpf.h>
 #include <linux/bpf.h>
@@ -19,9 +23,10 @@ import (
 struct service_rule {
     __u32 service_id;
     __be32 ip_addr;  // Network byte order
-    __u16 port;
+    __be16 port;
     __u8 protocol;
     __u8 action;     // 0=drop, 1=allow, 2=userspace
+    __u32 mapping_id;
 };
 
 // Helper function to load eBPF program from file
@@ -85,6 +90,30 @@ int lookup_map_element(int map_fd, void *key, void *value) {
 int delete_map_element(int map_fd, void *key) {
     return bpf_map_delete_elem(map_fd, key);
 }
+
+// Get the key following key, or the first key when key is NULL
+int next_map_key(int map_fd, void *key, void *next_key) {
+    return bpf_map_get_next_key(map_fd, key, next_key);
+}
+
+// Describe a map for the statistics reader, returning its fd or -1 when
+// the program has no such map
+int describe_map(struct bpf_object *obj, const char *map_name, __u32 *value_size, int *per_cpu) {
+    struct bpf_map *map;
+    enum bpf_map_type type;
+
+    map = bpf_object__find_map_by_name(obj, map_name);
+    if (!map) {
+        return -1;
+    }
+
+    type = bpf_map__type(map);
+    *value_size = bpf_map__value_size(map);
+    *per_cpu = type == BPF_MAP_TYPE_PERCPU_ARRAY ||
+               type == BPF_MAP_TYPE_PERCPU_HASH ||
+               type == BPF_MAP_TYPE_LRU_PERCPU_HASH;
+    return bpf_map__fd(map);
+}
 */
 import "C"
 
@@ -140,7 +169,7 @@ func (l *BPFLoader) LoadProgram() error {
 	}
 
 	// Get map file descriptors
-	cStatsMapName := C.CString("stats_map")
+	cStatsMapName := C.CString(ebpfstats.GlobalMapName)
 	defer C.free(unsafe.Pointer(cStatsMapName))
 	
 	l.statsFD = C.get_map_fd(l.obj, cStatsMapName)
@@ -187,9 +216,10 @@ func (l *BPFLoader) UpdateServiceRule(ruleID uint32, rule *ServiceRule) error {
 	var cRule C.struct_service_rule
 	cRule.service_id = C.__u32(rule.ServiceID)
 	cRule.ip_addr = C.__be32(rule.IPAddr)
-	cRule.port = C.__u16(rule.Port)
+	cRule.port = C.__be16(rule.Port)
 	cRule.protocol = C.__u8(rule.Protocol)
 	cRule.action = C.__u8(rule.Action)
+	cRule.mapping_id = C.__u32(rule.MappingID)
 
 	cRuleID := C.__u32(ruleID)
 	
@@ -216,41 +246,122 @@ func (l *BPFLoader) DeleteServiceRule(ruleID uint32) error {
 	return nil
 }
 
-// GetStatistics retrieves statistics from the eBPF stats map
-func (l *BPFLoader) GetStatistics() (*EBPFStatistics, error) {
-	if l.obj == nil || l.statsFD < 0 {
+// StatsReader returns a reader of the program's statistics maps. The
+// per-service and per-mapping breakdowns are read when the program has them.
+func (l *BPFLoader) StatsReader() (*ebpfstats.Reader, error) {
+	if l.obj == nil {
 		return nil, fmt.Errorf("eBPF program not loaded")
 	}
 
-	stats := &EBPFStatistics{}
+	global := l.statsMap(ebpfstats.GlobalMapName)
+	if global == nil {
+		return nil, fmt.Errorf("program has no %s map", ebpfstats.GlobalMapName)
+	}
+
+	var services, mappings ebpfstats.Map
+	if m := l.statsMap(ebpfstats.ServiceMapName); m != nil {
+		services = m
+	}
+	if m := l.statsMap(ebpfstats.MappingMapName); m != nil {
+		mappings = m
+	}
+	reader, err := ebpfstats.NewReader(global, services, mappings)
+	if err != nil {
+		return nil, err
+	}
+	if m := l.statsMap(ebpfstats.FlowCacheMapName); m != nil {
+		reader.SetFlowCacheMap(m)
+	}
+	return reader, nil
+}
+
+// InvalidateFlowCache bumps the policy generation so the program treats
+// every cached flow decision as stale and decides each flow again on its
+// next packet. It returns the new generation.
+func (l *BPFLoader) InvalidateFlowCache() (uint32, error) {
+	if l.obj == nil {
+		return 0, fmt.Errorf("eBPF program not loaded")
+	}
 
-	// Read each statistic from the map
-	for i := 0; i < 8; i++ {
-		key := C.__u32(i)
-		var value C.__u64
-		
-		ret := C.lookup_map_element(l.statsFD, unsafe.Pointer(&key), unsafe.Pointer(&value))
-		if ret != 0 {
-			continue // Skip missing entries
+	m := l.statsMap(PolicyGenerationMapName)
+	if m == nil {
+		return 0, fmt.Errorf("program has no %s map", PolicyGenerationMapName)
+	}
+
+	var key, generation C.__u32
+	if ret := C.lookup_map_element(m.fd, unsafe.Pointer(&key), unsafe.Pointer(&generation)); ret != 0 {
+		return 0, fmt.Errorf("failed to read policy generation: %d", ret)
+	}
+	generation++
+	if ret := C.update_map_element(m.fd, unsafe.Pointer(&key), unsafe.Pointer(&generation)); ret != 0 {
+		return 0, fmt.Errorf("failed to update policy generation: %d", ret)
+	}
+	return uint32(generation), nil
+}
+
+// statsMap returns a statistics map of the program, or nil when it has none
+func (l *BPFLoader) statsMap(name string) *bpfMap {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var valueSize C.__u32
+	var perCPU C.int
+	fd := C.describe_map(l.obj, cName, &valueSize, &perCPU)
+	if fd < 0 {
+		return nil
+	}
+	return &bpfMap{fd: fd, valueSize: int(valueSize), perCPU: perCPU != 0}
+}
+
+// bpfMap is a map with __u32 keys read through libbpf
+type bpfMap struct {
+	fd        C.int
+	valueSize int
+	perCPU    bool
+}
+
+var _ ebpfstats.Map = (*bpfMap)(nil)
+
+// Lookup copies the value of key into value
+func (m *bpfMap) Lookup(key uint32, value []byte) (bool, error) {
+	cKey := C.__u32(key)
+	ret, errno := C.lookup_map_element(m.fd, unsafe.Pointer(&cKey), unsafe.Pointer(&value[0]))
+	if ret != 0 {
+		if ret == -C.ENOENT || errno == syscall.ENOENT {
+			return false, nil
 		}
+		return false, fmt.Errorf("failed to look up key %d: %d", key, ret)
+	}
+	return true, nil
+}
+
+// NextKey returns the key after key, or the first key when key is nil
+func (m *bpfMap) NextKey(key *uint32) (uint32, bool, error) {
+	var cKey, cNext C.__u32
+	var keyPtr unsafe.Pointer
+	if key != nil {
+		cKey = C.__u32(*key)
+		keyPtr = unsafe.Pointer(&cKey)
+	}
 
-		switch i {
-		case 0: // STAT_TOTAL_PACKETS
-			stats.TotalPackets = uint64(value)
-		case 1: // STAT_TCP_PACKETS
-			stats.TCPPackets = uint64(value)
-		case 2: // STAT_UDP_PACKETS
-			stats.UDPPackets = uint64(value)
-		case 3: // STAT_DROPPED_PACKETS
-			stats.DroppedPackets = uint64(value)
-		case 4: // STAT_ALLOWED_PACKETS
-			stats.AllowedPackets = uint64(value)
-		case 5: // STAT_USERSPACE_PACKETS
-			stats.UserspacePackets = uint64(value)
+	ret, errno := C.next_map_key(m.fd, keyPtr, unsafe.Pointer(&cNext))
+	if ret != 0 {
+		if ret == -C.ENOENT || errno == syscall.ENOENT {
+			return 0, false, nil
 		}
+		return 0, false, fmt.Errorf("failed to iterate map: %d", ret)
 	}
+	return uint32(cNext), true, nil
+}
 
-	return stats, nil
+// ValueSize returns the size of one CPU's value
+func (m *bpfMap) ValueSize() int {
+	return m.valueSize
+}
+
+// PerCPU reports whether the map keeps a value per CPU
+func (m *bpfMap) PerCPU() bool {
+	return m.perCPU
 }
 
 // IsLoaded returns true if the eBPF program is loaded
@@ -266,18 +377,9 @@ func (l *BPFLoader) GetProgramFD() int {
 // ServiceRule represents a service rule for eBPF map
 type ServiceRule struct {
 	ServiceID uint32
-	IPAddr    uint32 // Network byte order
-	Port      uint16
+	IPAddr    uint32 // Network byte order, see IPToBE32
+	Port      uint16 // Network byte order, see PortToBE16
 	Protocol  uint8
-	Action    uint8 // 0=drop, 1=allow, 2=userspace
+	Action    uint8  // 0=drop, 1=allow, 2=userspace
+	MappingID uint32 // Mapping counted in mapping_stats, 0 for none
 }
-
-// EBPFStatistics represents statistics from eBPF program
-type EBPFStatistics struct {
-	TotalPackets     uint64
-	TCPPackets       uint64
-	UDPPackets       uint64
-	DroppedPackets   uint64
-	AllowedPackets   uint64
-	UserspacePackets uint64
-}
\ No newline at end of file
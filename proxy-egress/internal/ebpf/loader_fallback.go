@@ -4,12 +4,15 @@ package ebpf
 
 import (
 	"fmt"
+
+	"marchproxy-shared/ebpfstats"
 )
 
 // BPFLoader manages eBPF program loading (fallback implementation without CGO)
 type BPFLoader struct {
 	programPath string
 	loaded      bool
+	generation  uint32
 }
 
 // NewBPFLoader creates a new eBPF program loader (fallback)
@@ -53,21 +56,20 @@ func (l *BPFLoader) DeleteServiceRule(ruleID uint32) error {
 	return nil
 }
 
-// GetStatistics retrieves statistics (fallback - mock data)
-func (l *BPFLoader) GetStatistics() (*EBPFStatistics, error) {
+// StatsReader returns a reader of the program's statistics maps (fallback -
+// maps can't be read without CGO)
+func (l *BPFLoader) StatsReader() (*ebpfstats.Reader, error) {
+	return nil, fmt.Errorf("eBPF statistics unavailable (CGO not available)")
+}
+
+// InvalidateFlowCache bumps the policy generation (fallback - no-op)
+func (l *BPFLoader) InvalidateFlowCache() (uint32, error) {
 	if !l.loaded {
-		return nil, fmt.Errorf("eBPF program not loaded")
+		return 0, fmt.Errorf("eBPF program not loaded")
 	}
-
-	// Return mock statistics
-	return &EBPFStatistics{
-		TotalPackets:     1000,
-		TCPPackets:       800,
-		UDPPackets:       150,
-		DroppedPackets:   50,
-		AllowedPackets:   700,
-		UserspacePackets: 250,
-	}, nil
+	l.generation++
+	fmt.Printf("eBPF: Mock invalidating flow cache, generation %d (CGO not available)\n", l.generation)
+	return l.generation, nil
 }
 
 // IsLoaded returns true if the eBPF program is loaded (fallback)
@@ -87,14 +89,5 @@ type ServiceRule struct {
 	Port      uint16
 	Protocol  uint8
 	Action    uint8
+	MappingID uint32
 }
-
-// EBPFStatistics represents statistics from eBPF program (fallback)
-type EBPFStatistics struct {
-	TotalPackets     uint64
-	TCPPackets       uint64
-	UDPPackets       uint64
-	DroppedPackets   uint64
-	AllowedPackets   uint64
-	UserspacePackets uint64
-}
\ No newline at end of file
@@ -3,12 +3,13 @@ package ebpf
 import (
 	"fmt"
 	"net"
-	"os"
-	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/manager"
+	"marchproxy-shared/ebpfstats"
 )
 
 // Manager handles eBPF program lifecycle and map management
@@ -19,13 +20,19 @@ type Manager struct {
 	stats         *EBPFStats
 	loader        *BPFLoader
 	programPath   string
+	features      *KernelFeatures
+	reader        *ebpfstats.Reader
+	readErrors    atomic.Uint64
+	services      []manager.Service
 	mu            sync.RWMutex
 }
 
 // NewManager creates a new eBPF manager
 func NewManager(enabled bool) *Manager {
-	// Try to find eBPF program
-	programPath, _ := FindEBPFProgram()
+	// Detect kernel capabilities and pick the best program variant
+	features := DetectKernelFeatures("")
+	variant := features.SelectVariant()
+	programPath, foundVariant, findErr := FindEBPFProgramVariant(variant)
 	
 	manager := &Manager{
 		enabled:     enabled,
@@ -42,20 +49,50 @@ func NewManager(enabled bool) *Manager {
 			LastUpdate:        time.Now(),
 			MapSyncErrors:      0,
 			ProgramErrors:      0,
+			Mode:               ModeUserspace,
+			ProgramVariant:     foundVariant,
+			KernelVersion:      features.Kernel.String(),
+			XDPMode:            features.XDPMode,
+			BTFAvailable:       features.BTFAvailable,
 		},
+		features: features,
+	}
+
+	if enabled {
+		fmt.Printf("eBPF: Kernel %s, BTF: %t, interface: %s (driver %s, XDP %s), variant: %s\n",
+			features.Kernel, features.BTFAvailable, features.Interface,
+			features.Driver, features.XDPMode, variant)
+		if missing := features.MissingHelpers(); len(missing) > 0 {
+			fmt.Printf("eBPF: Helpers unavailable on this kernel: %v\n", missing)
+		}
 	}
 
 	// Initialize loader if program found
 	if programPath != "" {
 		manager.loader = NewBPFLoader(programPath)
-		fmt.Printf("eBPF: Found program at %s\n", programPath)
+		fmt.Printf("eBPF: Found %s program at %s\n", foundVariant, programPath)
 	} else if enabled {
-		fmt.Printf("eBPF: Program file not found, using fallback mode\n")
+		manager.stats.FallbackReason = findErr.Error()
+		fmt.Printf("eBPF: %v, using userspace mode\n", findErr)
 	}
 
 	return manager
 }
 
+// GetFeatures returns the kernel features detected at startup
+func (m *Manager) GetFeatures() *KernelFeatures {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.features
+}
+
+// GetMode returns the acceleration mode currently in effect
+func (m *Manager) GetMode() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.stats.Mode
+}
+
 // IsEnabled returns whether eBPF is enabled
 func (m *Manager) IsEnabled() bool {
 	m.mu.RLock()
@@ -86,22 +123,44 @@ func (m *Manager) LoadProgram(programPath string) error {
 	}
 
 	if m.loader == nil {
-		return fmt.Errorf("no eBPF program loader available")
+		return m.fallback(fmt.Errorf("no eBPF program loader available"))
+	}
+
+	if m.features.SelectVariant() == VariantNone {
+		return m.fallback(fmt.Errorf("kernel %s does not support XDP programs", m.features.Kernel))
 	}
 
 	// Load the actual eBPF program
 	if err := m.loader.LoadProgram(); err != nil {
-		return fmt.Errorf("failed to load eBPF program: %w", err)
+		m.stats.ProgramErrors++
+		return m.fallback(fmt.Errorf("failed to load eBPF program: %w", err))
 	}
 
+	reader, err := m.loader.StatsReader()
+	if err != nil {
+		fmt.Printf("eBPF: Statistics unavailable: %v\n", err)
+	}
+	m.reader = reader
+
 	m.programLoaded = true
 	m.stats.ProgramLoaded = true
+	m.stats.Mode = m.features.AccelerationMode()
+	m.stats.FallbackReason = ""
 	m.stats.LastUpdate = time.Now()
 	
-	fmt.Printf("eBPF: Program loaded successfully from %s\n", m.programPath)
+	fmt.Printf("eBPF: Program loaded successfully from %s (mode: %s)\n", m.programPath, m.stats.Mode)
 	return nil
 }
 
+// fallback records why acceleration is unavailable and returns the error.
+// Must be called with m.mu held.
+func (m *Manager) fallback(err error) error {
+	m.stats.Mode = ModeUserspace
+	m.stats.FallbackReason = err.Error()
+	m.stats.LastUpdate = time.Now()
+	return err
+}
+
 // UnloadProgram unloads the eBPF program
 func (m *Manager) UnloadProgram() error {
 	m.mu.Lock()
@@ -118,8 +177,10 @@ func (m *Manager) UnloadProgram() error {
 	
 	fmt.Printf("eBPF: Unloading program\n")
 	
+	m.reader = nil
 	m.programLoaded = false
 	m.stats.ProgramLoaded = false
+	m.stats.Mode = ModeUserspace
 	m.stats.AttachedInterfaces = []string{}
 	m.stats.LastUpdate = time.Now()
 	
@@ -141,11 +202,11 @@ func (m *Manager) UpdateServices(services []manager.Service) error {
 	// Clear existing services from local cache
 	m.maps.Services = make(map[uint32]*EBPFService)
 
-	// Convert and store services in both local cache and eBPF maps
-	for i, service := range services {
+	// Convert and store services in the local cache
+	for _, service := range services {
 		ebpfService := &EBPFService{
 			ID:           uint32(service.ID),
-			IPAddr:       IPToUint32(resolveServiceIP(service.IPFQDN)),
+			IPAddr:       IPToBE32(resolveServiceIP(service.IPFQDN)),
 			Port:         80, // Default port - would be parsed from service config
 			AuthRequired: 0,
 			AuthType:     AuthTypeNone,
@@ -159,28 +220,18 @@ func (m *Manager) UpdateServices(services []manager.Service) error {
 		} else if service.AuthType == "jwt" {
 			ebpfService.AuthRequired = 1
 			ebpfService.AuthType = AuthTypeJWT
+		} else if service.AuthType == "hmac" {
+			ebpfService.AuthRequired = 1
+			ebpfService.AuthType = AuthTypeHMAC
 		}
 
 		// Store in local cache
 		m.maps.Services[ebpfService.ID] = ebpfService
-
-		// Update eBPF map if loader is available
-		if m.loader != nil && m.loader.IsLoaded() {
-			rule := &ServiceRule{
-				ServiceID: ebpfService.ID,
-				IPAddr:    ebpfService.IPAddr,
-				Port:      ebpfService.Port,
-				Protocol:  0, // 0 = any protocol
-				Action:    2, // 2 = send to userspace for authentication
-			}
-
-			if err := m.loader.UpdateServiceRule(uint32(i), rule); err != nil {
-				fmt.Printf("eBPF: Warning - failed to update service rule %d: %v\n", service.ID, err)
-				m.stats.MapSyncErrors++
-			}
-		}
 	}
 
+	m.services = services
+	m.syncServiceRules()
+
 	m.stats.LastUpdate = time.Now()
 	fmt.Printf("eBPF: Services updated successfully\n")
 	return nil
@@ -202,6 +253,12 @@ func (m *Manager) UpdateMappings(mappings []manager.Mapping) error {
 
 	// Convert and store mappings
 	for _, mapping := range mappings {
+		// Conditions, match criteria, schedules, DLP scanning, TLS
+		// inspection, TLS modes, SSH auditing and upstream proxies are only
+		// applied, and SLOs only measured, in userspace
+		if mapping.Condition != "" || len(mapping.SourceCIDRs) > 0 || len(mapping.ListenPorts) > 0 || len(mapping.Hostnames) > 0 || mapping.Schedule != nil || mapping.DLP != nil || mapping.TLSInspection != nil || mapping.TLSPolicy != nil || mapping.SSH != nil || mapping.UpstreamProxy != nil || len(mapping.SLOs) > 0 {
+			continue
+		}
 		ebpfMapping := &EBPFMapping{
 			ID:           uint32(mapping.ID),
 			Protocols:    0,
@@ -243,27 +300,120 @@ func (m *Manager) UpdateMappings(mappings []manager.Mapping) error {
 		m.maps.Mappings[ebpfMapping.ID] = ebpfMapping
 	}
 
+	// Rules carry the mapping they are counted against
+	m.syncServiceRules()
+
 	m.stats.LastUpdate = time.Now()
 	fmt.Printf("eBPF: Mappings updated successfully\n")
 	return nil
 }
 
+// syncServiceRules writes the service rules to the eBPF rules map, each
+// counted against the mapping that has its service as a destination. Must
+// be called with m.mu held.
+func (m *Manager) syncServiceRules() {
+	if m.loader == nil || !m.loader.IsLoaded() {
+		return
+	}
+
+	for i, service := range m.services {
+		ebpfService := m.maps.Services[uint32(service.ID)]
+		if ebpfService == nil {
+			continue
+		}
+		rule := &ServiceRule{
+			ServiceID: ebpfService.ID,
+			IPAddr:    ebpfService.IPAddr,
+			Port:      PortToBE16(ebpfService.Port),
+			Protocol:  0, // 0 = any protocol
+			Action:    2, // 2 = send to userspace for authentication
+			MappingID: m.mappingForService(ebpfService.ID),
+		}
+
+		if err := m.loader.UpdateServiceRule(uint32(i), rule); err != nil {
+			fmt.Printf("eBPF: Warning - failed to update service rule %d: %v\n", service.ID, err)
+			m.stats.MapSyncErrors++
+		}
+	}
+
+	// Decisions cached under the old rules no longer hold
+	m.invalidateFlowCache()
+}
+
+// invalidateFlowCache makes the program decide every flow again on its next
+// packet. Must be called with m.mu held.
+func (m *Manager) invalidateFlowCache() {
+	generation, err := m.loader.InvalidateFlowCache()
+	if err != nil {
+		fmt.Printf("eBPF: Warning - failed to invalidate flow cache: %v\n", err)
+		m.stats.MapSyncErrors++
+		return
+	}
+	m.stats.FlowCacheInvalidations++
+	m.stats.PolicyGeneration = generation
+}
+
+// mappingForService returns the lowest ID of the mappings with the service
+// as a destination, or 0 when none has. Must be called with m.mu held.
+func (m *Manager) mappingForService(serviceID uint32) uint32 {
+	ids := make([]uint32, 0, len(m.maps.Mappings))
+	for id := range m.maps.Mappings {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		mapping := m.maps.Mappings[id]
+		for _, dest := range mapping.DestServices[:mapping.DestCount] {
+			if dest == serviceID {
+				return id
+			}
+		}
+	}
+	return 0
+}
+
+// Snapshot returns the counters of the loaded program, summed across CPUs
+// and broken down per service and mapping. It is shared by /metrics and
+// the heartbeat; callers must not modify it.
+func (m *Manager) Snapshot() (*ebpfstats.Snapshot, error) {
+	m.mu.RLock()
+	reader := m.reader
+	m.mu.RUnlock()
+
+	if reader == nil {
+		return nil, fmt.Errorf("eBPF statistics unavailable")
+	}
+	snapshot, err := reader.Snapshot()
+	if err != nil {
+		m.readErrors.Add(1)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
 // GetStats returns current eBPF statistics
 func (m *Manager) GetStats() (*ProxyStats, *EBPFStats) {
+	var proxyStats ProxyStats
+	if snapshot, err := m.Snapshot(); err == nil {
+		proxyStats = ProxyStats{
+			TotalPackets:        snapshot.Global.TotalPackets,
+			TotalBytes:          snapshot.Global.TotalBytes,
+			TCPPackets:          snapshot.Global.TCPPackets,
+			UDPPackets:          snapshot.Global.UDPPackets,
+			ICMPPackets:         snapshot.Global.ICMPPackets,
+			DroppedPackets:      snapshot.Global.DroppedPackets,
+			ForwardedPackets:    snapshot.Global.AllowedPackets,
+			FallbackToUserspace: snapshot.Global.UserspacePackets,
+		}
+	}
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// Mock some statistics - in production this would read from eBPF maps
-	if m.programLoaded {
-		m.maps.Stats.TotalPackets += 1000
-		m.maps.Stats.ForwardedPackets += 800
-		m.maps.Stats.DroppedPackets += 50
-		m.maps.Stats.FallbackToUserspace += 150
-	}
-
-	// Create copies to avoid race conditions
-	proxyStats := *m.maps.Stats
+	// Create a copy to avoid race conditions
 	ebpfStats := *m.stats
+	ebpfStats.StatsReadErrors = m.readErrors.Load()
 
 	return &proxyStats, &ebpfStats
 }
@@ -361,9 +511,11 @@ func (m *Manager) Cleanup() error {
 	m.stats.AttachedInterfaces = []string{}
 
 	// Unload program
+	m.reader = nil
 	if m.programLoaded {
 		m.programLoaded = false
 		m.stats.ProgramLoaded = false
+		m.stats.Mode = ModeUserspace
 	}
 
 	fmt.Printf("eBPF: Cleanup complete\n")
@@ -395,24 +547,8 @@ func resolveServiceIP(ipfqdn string) net.IP {
 	return net.IPv4(127, 0, 0, 1)
 }
 
-// FindEBPFProgram searches for the compiled eBPF program file
+// FindEBPFProgram searches for the compiled (legacy) eBPF program file
 func FindEBPFProgram() (string, error) {
-	// Search in common locations
-	searchPaths := []string{
-		"ebpf/build/complete_filter.o",
-		"ebpf/build/rule_matcher.o",
-		"/opt/marchproxy/ebpf/complete_filter.o",
-		"./complete_filter.o",
-		"./rule_matcher.o",
-	}
-
-	for _, path := range searchPaths {
-		if absPath, err := filepath.Abs(path); err == nil {
-			if _, err := os.Stat(absPath); err == nil {
-				return absPath, nil
-			}
-		}
-	}
-
-	return "", fmt.Errorf("eBPF program file not found in search paths: %v", searchPaths)
+	path, _, err := FindEBPFProgramVariant(VariantLegacy)
+	return path, err
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package ebpf
 
 import (
+	"encoding/binary"
 	"net"
 	"time"
 )
@@ -24,8 +25,8 @@ type EBPFMaps struct {
 // EBPFService represents a service in eBPF map format
 type EBPFService struct {
 	ID           uint32
-	IPAddr       uint32 // Network byte order
-	Port         uint16
+	IPAddr       uint32 // Network byte order, see IPToBE32
+	Port         uint16 // Host byte order
 	AuthRequired uint8  // 0 = no auth, 1 = auth required
 	AuthType     uint8  // 0 = none, 1 = base64, 2 = jwt
 	Flags        uint32
@@ -45,7 +46,8 @@ type EBPFMapping struct {
 	DestCount      uint8      // Number of dest services
 }
 
-// ConnectionKey represents a connection tracking key
+// ConnectionKey represents a connection tracking key. Addresses and ports
+// are in host byte order.
 type ConnectionKey struct {
 	SrcIP    uint32
 	DstIP    uint32
@@ -83,6 +85,20 @@ type EBPFStats struct {
 	LastUpdate       time.Time
 	MapSyncErrors    uint64
 	ProgramErrors    uint64
+	StatsReadErrors  uint64 // Failed reads of the statistics maps
+
+	// Flow cache invalidations on config change, and the policy generation
+	// cached flow decisions are checked against
+	FlowCacheInvalidations uint64
+	PolicyGeneration       uint32
+
+	// Kernel feature detection results
+	Mode           string // xdp-native, xdp-generic, xdp-offload or userspace
+	ProgramVariant string // core, legacy or none
+	KernelVersion  string
+	XDPMode        string
+	BTFAvailable   bool
+	FallbackReason string
 }
 
 // Constants for eBPF programs
@@ -101,15 +117,26 @@ const (
 	AuthTypeNone   = 0
 	AuthTypeBase64 = 1
 	AuthTypeJWT    = 2
+	AuthTypeHMAC   = 3
 
 	// Map size limits
 	MaxServices    = 1024
 	MaxMappings    = 512
 	MaxPorts       = 16
 	MaxConnections = 65536
+	MaxFlows       = 65536 // Entries of the flow_cache LRU map
 )
 
+// PolicyGenerationMapName is the map holding the policy generation that
+// cached flow decisions are checked against
+const PolicyGenerationMapName = "policy_generation"
+
 // Helper functions for network operations
+
+// IPToUint32 packs an IPv4 address in host byte order, so 10.0.0.1 is
+// 0x0a000001 on every architecture. Use it for values compared as numbers,
+// such as keys the BPF program builds after bpf_ntohl. It returns 0 for
+// IPv6 and nil addresses.
 func IPToUint32(ip net.IP) uint32 {
 	if ip == nil {
 		return 0
@@ -121,10 +148,35 @@ func IPToUint32(ip net.IP) uint32 {
 	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
 }
 
+// Uint32ToIP unpacks an address packed by IPToUint32
 func Uint32ToIP(ip uint32) net.IP {
 	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
 }
 
+// IPToBE32 packs an IPv4 address in network byte order: the value's bytes
+// in memory are the address bytes in order, whatever the architecture. Use
+// it for __be32 map fields compared with addresses read straight from
+// packets, such as ip->daddr. It returns 0 for IPv6 and nil addresses.
+func IPToBE32(ip net.IP) uint32 {
+	ip = ip.To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.NativeEndian.Uint32(ip)
+}
+
+// BE32ToIP unpacks an address packed by IPToBE32
+func BE32ToIP(ip uint32) net.IP {
+	b := binary.NativeEndian.AppendUint32(nil, ip)
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
+
+// PortToBE16 converts a port to network byte order for __be16 map fields
+// compared with ports read straight from packets, such as tcp->dest
+func PortToBE16(port uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, port))
+}
+
 // ProtocolToMask converts protocol name to bitmask
 func ProtocolToMask(protocol string) uint8 {
 	switch protocol {
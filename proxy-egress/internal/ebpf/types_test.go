@@ -0,0 +1,46 @@
+package ebpf
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+)
+
+// These tests check the bytes the kernel sees, so they are meaningful on
+// both byte orders. CI runs them on arm64 and on big-endian s390x.
+
+// TestIPToBE32 tests that packed addresses are in packet byte order
+func TestIPToBE32(t *testing.T) {
+	packed := IPToBE32(net.ParseIP("10.1.2.3"))
+	if got := *(*[4]byte)(unsafe.Pointer(&packed)); got != [4]byte{10, 1, 2, 3} {
+		t.Errorf("IPToBE32(10.1.2.3) is % x in memory, want 0a 01 02 03", got)
+	}
+	if ip := BE32ToIP(packed); !ip.Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("BE32ToIP round trip gave %s", ip)
+	}
+
+	for _, ip := range []net.IP{nil, net.ParseIP("2001:db8::1")} {
+		if got := IPToBE32(ip); got != 0 {
+			t.Errorf("IPToBE32(%v) = %#x, want 0", ip, got)
+		}
+	}
+}
+
+// TestPortToBE16 tests that packed ports are in packet byte order
+func TestPortToBE16(t *testing.T) {
+	packed := PortToBE16(443)
+	if got := *(*[2]byte)(unsafe.Pointer(&packed)); got != [2]byte{0x01, 0xbb} {
+		t.Errorf("PortToBE16(443) is % x in memory, want 01 bb", got)
+	}
+}
+
+// TestIPToUint32 tests that host order packing is the same number on
+// every architecture
+func TestIPToUint32(t *testing.T) {
+	if got := IPToUint32(net.ParseIP("10.1.2.3")); got != 0x0a010203 {
+		t.Errorf("IPToUint32(10.1.2.3) = %#x, want 0x0a010203", got)
+	}
+	if ip := Uint32ToIP(0x0a010203); !ip.Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("Uint32ToIP(0x0a010203) = %s", ip)
+	}
+}
@@ -0,0 +1,508 @@
+// Package geoip looks up client addresses in MaxMind DB (mmdb) files, such
+// as the GeoLite2 and GeoIP2 country, city and ASN databases, and counts
+// traffic per country.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metadataMarker precedes the metadata section at the end of the file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSeparator is the run of zero bytes between the search tree and data
+const dataSeparator = 16
+
+// Unknown is the country reported for addresses not in the database
+const Unknown = "unknown"
+
+// Metadata describes a database
+type Metadata struct {
+	DatabaseType string
+	BuildEpoch   uint64
+	IPVersion    uint
+	NodeCount    uint
+	RecordSize   uint
+}
+
+// Reader looks up addresses in an mmdb file held in memory. It is safe for
+// concurrent use.
+type Reader struct {
+	Metadata Metadata
+
+	tree      []byte
+	data      []byte
+	ipv4Start uint
+}
+
+// Open reads the database at path
+func Open(path string) (*Reader, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	reader, err := FromBytes(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database %s: %w", path, err)
+	}
+	return reader, nil
+}
+
+// FromBytes creates a reader for a database already in memory
+func FromBytes(buffer []byte) (*Reader, error) {
+	start := bytes.LastIndex(buffer, metadataMarker)
+	if start < 0 {
+		return nil, errors.New("metadata section not found")
+	}
+	metaDecoder := decoder{buffer: buffer[start+len(metadataMarker):]}
+	value, _, err := metaDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	r := &Reader{}
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	r.Metadata.BuildEpoch = toUint(meta["build_epoch"])
+	r.Metadata.IPVersion = uint(toUint(meta["ip_version"]))
+	r.Metadata.NodeCount = uint(toUint(meta["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(meta["record_size"]))
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.Metadata.IPVersion)
+	}
+
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	if treeSize+dataSeparator > uint(start) {
+		return nil, errors.New("search tree exceeds file size")
+	}
+	r.tree = buffer[:treeSize]
+	r.data = buffer[treeSize+dataSeparator : start]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node uint, bit uint) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the record for ip, or nil when the database has none
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	var bits []byte
+	node := uint(0)
+	if v4 := ip.To4(); v4 != nil {
+		bits = v4
+		if r.Metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if v6 := ip.To16(); v6 != nil {
+		if r.Metadata.IPVersion == 4 {
+			return nil, nil
+		}
+		bits = v6
+	} else {
+		return nil, fmt.Errorf("invalid IP address %v", ip)
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(bits)*8 && node < nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node <= nodeCount {
+		return nil, nil
+	}
+
+	offset := node - nodeCount - dataSeparator
+	d := decoder{buffer: r.data}
+	value, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode record for %v: %w", ip, err)
+	}
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("record for %v is not a map", ip)
+	}
+	return record, nil
+}
+
+// Country returns the ISO 3166-1 country code of ip, falling back to the
+// country its network is registered in, or Unknown
+func (r *Reader) Country(ip net.IP) string {
+	record, err := r.Lookup(ip)
+	if err != nil || record == nil {
+		return Unknown
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if code, ok := path(record, key, "iso_code").(string); ok && code != "" {
+			return code
+		}
+	}
+	return Unknown
+}
+
+// GetCountry returns the country code of ip, for the WAF's geo blocking
+func (r *Reader) GetCountry(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid IP address %q", ip)
+	}
+	return r.Country(parsed), nil
+}
+
+// GetCity returns the English city name of ip, empty when not known
+func (r *Reader) GetCity(ip string) (string, error) {
+	record, err := r.lookupString(ip)
+	if err != nil {
+		return "", err
+	}
+	city, _ := path(record, "city", "names", "en").(string)
+	return city, nil
+}
+
+// GetASN returns the autonomous system number of ip from an ASN database,
+// empty when not known
+func (r *Reader) GetASN(ip string) (string, error) {
+	record, err := r.lookupString(ip)
+	if err != nil {
+		return "", err
+	}
+	if asn := toUint(path(record, "autonomous_system_number")); asn != 0 {
+		return "AS" + strconv.FormatUint(asn, 10), nil
+	}
+	return "", nil
+}
+
+func (r *Reader) lookupString(ip string) (map[string]interface{}, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	return r.Lookup(parsed)
+}
+
+// path walks nested maps by key
+func path(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// Data section types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth bounds nesting so a corrupt file cannot recurse without end
+const maxDepth = 32
+
+var errTruncated = errors.New("data section truncated")
+
+// decoder decodes values from an mmdb data section
+type decoder struct {
+	buffer []byte
+}
+
+// decode returns the value at offset and the offset that follows it
+func (d *decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == typePointer {
+		// The value behind a pointer is decoded in place, but decoding
+		// resumes after the pointer itself
+		value, _, err := d.decode(size, depth+1)
+		return value, offset, err
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	end := offset + size
+	if end > uint(len(d.buffer)) {
+		return nil, 0, errTruncated
+	}
+	raw := d.buffer[offset:end]
+
+	switch kind {
+	case typeString:
+		return string(raw), end, nil
+	case typeBytes:
+		return append([]byte(nil), raw...), end, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), end, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), end, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var n uint64
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, end, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var n uint32
+		for _, b := range raw {
+			n = n<<8 | uint32(b)
+		}
+		if size == 4 {
+			return int64(int32(n)), end, nil
+		}
+		return int64(n), end, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(raw), end, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+	}
+}
+
+// control decodes a control byte, returning the type, the size (or pointer
+// target) and the offset of the payload
+func (d *decoder) control(offset uint) (int, uint, uint, error) {
+	next := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(d.buffer)) {
+			return nil, errTruncated
+		}
+		b := d.buffer[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	b, err := next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	kind := int(ctrl >> 5)
+
+	if kind == typePointer {
+		length := uint(ctrl>>3) & 0x3
+		b, err := next(length + 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		var target uint
+		switch length {
+		case 0:
+			target = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 1:
+			target = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			target = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		return kind, target, offset, nil
+	}
+
+	if kind == typeExtended {
+		b, err := next(1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		kind = 7 + int(b[0])
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + uint(b[0])
+		case 30:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+	return kind, size, offset, nil
+}
+
+// Traffic counts connections and bytes per client country
+type Traffic struct {
+	mu      sync.Mutex
+	conns   map[string]uint64
+	relayed map[string]uint64
+}
+
+// NewTraffic creates an empty traffic counter
+func NewTraffic() *Traffic {
+	return &Traffic{conns: make(map[string]uint64), relayed: make(map[string]uint64)}
+}
+
+// Connection counts a connection from country
+func (t *Traffic) Connection(country string) {
+	t.mu.Lock()
+	t.conns[country]++
+	t.mu.Unlock()
+}
+
+// Bytes counts n bytes relayed for a client in country
+func (t *Traffic) Bytes(country string, n int64) {
+	if n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.relayed[country] += uint64(n)
+	t.mu.Unlock()
+}
+
+// WritePrometheus writes the per-country counters in Prometheus text format
+func (t *Traffic) WritePrometheus(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	writeCounter(w, "marchproxy_geoip_connections_total", "Connections per client country", t.conns)
+	writeCounter(w, "marchproxy_geoip_bytes_total", "Bytes relayed per client country", t.relayed)
+}
+
+func writeCounter(w io.Writer, name, help string, counts map[string]uint64) {
+	countries := make([]string, 0, len(counts))
+	for country := range counts {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, country := range countries {
+		fmt.Fprintf(w, "%s{country=%q} %d\n", name, country, counts[country])
+	}
+}
+
+// Match reports whether country is in codes, compared case-insensitively
+func Match(country string, codes []string) bool {
+	for _, code := range codes {
+		if strings.EqualFold(code, country) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// pointer is encoded as an mmdb pointer to a data section offset
+type pointer uint
+
+// encode writes a value in the mmdb data format
+func encode(v interface{}) []byte {
+	var out bytes.Buffer
+	switch v := v.(type) {
+	case pointer:
+		out.Write([]byte{typePointer<<5 | byte(v>>8)&0x7, byte(v)})
+	case string:
+		out.WriteByte(typeString<<5 | byte(len(v)))
+		out.WriteString(v)
+	case uint16:
+		out.WriteByte(typeUint16<<5 | 2)
+		binary.Write(&out, binary.BigEndian, v)
+	case uint32:
+		out.WriteByte(typeUint32<<5 | 4)
+		binary.Write(&out, binary.BigEndian, v)
+	case map[string]interface{}:
+		out.WriteByte(typeMap<<5 | byte(len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out.Write(encode(key))
+			out.Write(encode(v[key]))
+		}
+	default:
+		panic("unsupported test value")
+	}
+	return out.Bytes()
+}
+
+type testNetwork struct {
+	cidr   string
+	record int // Index into the records
+}
+
+// buildDatabase writes an IPv6 database with the given record size where
+// each network maps to one of the encoded records
+func buildDatabase(t *testing.T, recordSize int, records [][]byte, networks []testNetwork) []byte {
+	t.Helper()
+
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatalf("Invalid network %s: %v", network.cidr, err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if v4 := ipNet.IP.To4(); v4 != nil {
+			ip = append(make(net.IP, 12), v4...)
+			ones += 96
+		}
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - network.record
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(records))
+	for i, record := range records {
+		offsets[i] = data.Len()
+		data.Write(record)
+	}
+
+	nodeCount := len(nodes)
+	resolve := func(value int) uint32 {
+		switch {
+		case value == empty:
+			return uint32(nodeCount)
+		case value < empty:
+			return uint32(nodeCount + dataSeparator + offsets[-2-value])
+		default:
+			return uint32(value)
+		}
+	}
+
+	var out bytes.Buffer
+	for _, node := range nodes {
+		left, right := resolve(node[0]), resolve(node[1])
+		switch recordSize {
+		case 24:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>20)&0xf0 | byte(right>>24)&0x0f, byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			binary.Write(&out, binary.BigEndian, left)
+			binary.Write(&out, binary.BigEndian, right)
+		}
+	}
+	out.Write(make([]byte, dataSeparator))
+	out.Write(data.Bytes())
+	out.Write(metadataMarker)
+	out.Write(encode(map[string]interface{}{
+		"database_type": "Test-Country",
+		"ip_version":    uint16(6),
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+	}))
+	return out.Bytes()
+}
+
+func testDatabase(t *testing.T, recordSize int) *Reader {
+	t.Helper()
+
+	germany := encode(map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "DE"},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Berlin"}},
+	})
+	// Share the country map of the first record through a pointer, as real
+	// databases do
+	countryOffset := bytes.Index(germany, encode(map[string]interface{}{"iso_code": "DE"}))
+	registered := encode(map[string]interface{}{"registered_country": pointer(countryOffset)})
+	asn := encode(map[string]interface{}{"autonomous_system_number": uint32(64500)})
+	japan := encode(map[string]interface{}{"country": map[string]interface{}{"iso_code": "JP"}})
+
+	db := buildDatabase(t, recordSize, [][]byte{germany, registered, asn, japan}, []testNetwork{
+		{cidr: "192.0.2.0/24", record: 0},
+		{cidr: "198.51.100.0/25", record: 1},
+		{cidr: "203.0.113.0/24", record: 2},
+		{cidr: "2001:db8::/32", record: 3},
+	})
+	reader, err := FromBytes(db)
+	if err != nil {
+		t.Fatalf("Failed to read database: %v", err)
+	}
+	return reader
+}
+
+func TestCountry(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		reader := testDatabase(t, recordSize)
+		if reader.Metadata.DatabaseType != "Test-Country" || reader.Metadata.RecordSize != uint(recordSize) {
+			t.Errorf("Unexpected metadata %+v", reader.Metadata)
+		}
+
+		tests := map[string]string{
+			"192.0.2.10":       "DE",
+			"198.51.100.1":     "DE", // Registered country through a pointer
+			"198.51.100.200":   Unknown,
+			"203.0.113.5":      Unknown,
+			"2001:db8::1":      "JP",
+			"2001:db9::1":      Unknown,
+			"::ffff:192.0.2.1": "DE",
+		}
+		for ip, want := range tests {
+			if got := reader.Country(net.ParseIP(ip)); got != want {
+				t.Errorf("Record size %d: expected %s for %s, got %s", recordSize, want, ip, got)
+			}
+		}
+	}
+}
+
+func TestWAFLookups(t *testing.T) {
+	reader := testDatabase(t, 24)
+
+	if city, err := reader.GetCity("192.0.2.1"); err != nil || city != "Berlin" {
+		t.Errorf("Expected Berlin, got %q (%v)", city, err)
+	}
+	if asn, err := reader.GetASN("203.0.113.1"); err != nil || asn != "AS64500" {
+		t.Errorf("Expected AS64500, got %q (%v)", asn, err)
+	}
+	if _, err := reader.GetCountry("not-an-ip"); err == nil {
+		t.Error("Expected an invalid address to fail")
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Error("Expected a file without metadata to fail")
+	}
+	if country := (*Reader)(nil).Country(net.ParseIP("192.0.2.1")); country != Unknown {
+		t.Errorf("Expected a nil reader to report %s, got %s", Unknown, country)
+	}
+}
+
+func TestTrafficWritePrometheus(t *testing.T) {
+	traffic := NewTraffic()
+	traffic.Connection("DE")
+	traffic.Connection("DE")
+	traffic.Connection(Unknown)
+	traffic.Bytes("DE", 1500)
+
+	var out strings.Builder
+	traffic.WritePrometheus(&out)
+	for _, want := range []string{
+		`marchproxy_geoip_connections_total{country="DE"} 2`,
+		`marchproxy_geoip_connections_total{country="unknown"} 1`,
+		`marchproxy_geoip_bytes_total{country="DE"} 1500`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+}
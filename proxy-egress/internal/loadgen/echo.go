@@ -0,0 +1,230 @@
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxEchoSize caps the response size an HTTP client can ask for
+const maxEchoSize = 64 * 1024 * 1024
+
+// EchoServer is a test upstream that sends back whatever it receives. TCP
+// connections and UDP datagrams are echoed verbatim. HTTP requests get
+// their body back, or the response asked for with these query parameters:
+//
+//	size=<bytes>   respond with this many bytes instead of the request body
+//	delay=<ms>     wait before responding
+//	status=<code>  respond with this status code
+type EchoServer struct {
+	protocol string
+	delay    time.Duration
+
+	listener   net.Listener   // tcp and http
+	packetConn net.PacketConn // udp
+	httpServer *http.Server
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// ListenEcho opens an echo server for protocol (tcp, udp or http) on addr.
+// Every response is held back by delay. Call Serve to start answering.
+func ListenEcho(protocol, addr string, delay time.Duration) (*EchoServer, error) {
+	s := &EchoServer{protocol: protocol, delay: delay, conns: make(map[net.Conn]struct{})}
+
+	var err error
+	switch protocol {
+	case "tcp":
+		s.listener, err = net.Listen("tcp", addr)
+	case "http":
+		s.listener, err = net.Listen("tcp", addr)
+		s.httpServer = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	case "udp":
+		s.packetConn, err = net.ListenPacket("udp", addr)
+	default:
+		return nil, fmt.Errorf("protocol must be tcp, udp or http")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *EchoServer) Addr() net.Addr {
+	if s.packetConn != nil {
+		return s.packetConn.LocalAddr()
+	}
+	return s.listener.Addr()
+}
+
+// Serve answers until the server is closed
+func (s *EchoServer) Serve() error {
+	switch s.protocol {
+	case "http":
+		err := s.httpServer.Serve(s.listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case "udp":
+		return s.serveUDP()
+	default:
+		return s.serveTCP()
+	}
+}
+
+// Close stops the server and closes its connections
+func (s *EchoServer) Close() error {
+	if s.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return s.httpServer.Shutdown(ctx)
+	}
+	if s.packetConn != nil {
+		return s.packetConn.Close()
+	}
+
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *EchoServer) serveTCP() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.echo(conn)
+		}()
+	}
+}
+
+func (s *EchoServer) echo(conn net.Conn) {
+	if s.delay <= 0 {
+		io.Copy(conn, conn)
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			time.Sleep(s.delay)
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *EchoServer) serveUDP() error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		time.Sleep(s.delay)
+		s.packetConn.WriteTo(buf[:n], addr)
+	}
+}
+
+// ServeHTTP implements the HTTP echo
+func (s *EchoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := http.StatusOK
+	if v := query.Get("status"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 200 || code > 599 {
+			http.Error(w, "invalid status", http.StatusBadRequest)
+			return
+		}
+		status = code
+	}
+	delay := s.delay
+	if v := query.Get("delay"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			http.Error(w, "invalid delay", http.StatusBadRequest)
+			return
+		}
+		delay += time.Duration(ms) * time.Millisecond
+	}
+	size := -1
+	if v := query.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxEchoSize {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	// Read the whole body first so the echo measures a full round trip
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoSize))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if size < 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.WriteHeader(status)
+	chunk := make([]byte, min(size, 32*1024))
+	for size > 0 {
+		n, err := w.Write(chunk[:min(size, len(chunk))])
+		if err != nil {
+			return
+		}
+		size -= n
+	}
+}
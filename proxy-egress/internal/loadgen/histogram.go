@@ -0,0 +1,184 @@
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// subBuckets is the number of buckets per power of two of microseconds,
+// which bounds the relative error of recorded latencies to under 1.6%
+const subBuckets = 64
+
+// Histogram records latencies in log-linear buckets with microsecond
+// resolution. It is not safe for concurrent use; workers keep their own and
+// merge them.
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram creates an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+func bucketOf(us uint64) int {
+	if us < 2*subBuckets {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 7 // us>>shift is in [64, 128)
+	return (shift+1)*subBuckets + int(us>>shift) - subBuckets
+}
+
+// bucketBounds returns the microsecond range [lo, hi) of a bucket
+func bucketBounds(b int) (uint64, uint64) {
+	if b < 2*subBuckets {
+		return uint64(b), uint64(b) + 1
+	}
+	shift := b/subBuckets - 1
+	sub := uint64(b%subBuckets + subBuckets)
+	return sub << shift, (sub + 1) << shift
+}
+
+// Record adds one latency
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	b := bucketOf(uint64(d / time.Microsecond))
+	if b >= len(h.counts) {
+		grown := make([]int64, b+1)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	h.counts[b]++
+
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Merge adds the latencies recorded in o
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		grown := make([]int64, len(o.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for b, n := range o.counts {
+		h.counts[b] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// Count returns the number of recorded latencies
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Min returns the lowest recorded latency
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+// Max returns the highest recorded latency
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Mean returns the average recorded latency
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Percentile returns the latency at or below which p percent of the
+// recorded latencies fall
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for b, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			_, hi := bucketBounds(b)
+			d := time.Duration(hi-1) * time.Microsecond
+			return min(max(d, h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// WriteText writes the latency distribution as a bar chart with one row per
+// power of two, skipping empty rows at either end
+func (h *Histogram) WriteText(w io.Writer) {
+	if h.count == 0 {
+		fmt.Fprintf(w, "  (no samples)\n")
+		return
+	}
+
+	// Fold the fine buckets into power of two rows
+	var rows []int64
+	for b, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		lo, _ := bucketBounds(b)
+		row := bits.Len64(lo)
+		for len(rows) <= row {
+			rows = append(rows, 0)
+		}
+		rows[row] += n
+	}
+
+	first := 0
+	for rows[first] == 0 {
+		first++
+	}
+	var peak int64
+	for _, n := range rows {
+		peak = max(peak, n)
+	}
+
+	const width = 40
+	for row := first; row < len(rows); row++ {
+		var lo time.Duration
+		if row > 0 {
+			lo = time.Duration(uint64(1)<<(row-1)) * time.Microsecond
+		}
+		hi := time.Duration(uint64(1)<<row) * time.Microsecond
+		bar := strings.Repeat("#", int(rows[row]*width/peak))
+		fmt.Fprintf(w, "  %10v - %-10v %10d %6.2f%% %s\n",
+			lo, hi, rows[row], float64(rows[row])*100/float64(h.count), bar)
+	}
+}
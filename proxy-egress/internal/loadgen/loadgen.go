@@ -0,0 +1,490 @@
+// Package loadgen generates reproducible TCP, UDP and HTTP load against the
+// proxies and provides the echo servers to run it against, so performance
+// regressions can be measured in CI and in the field.
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes a load run
+type Config struct {
+	Target       string        // host:port for tcp and udp, URL for http
+	Protocol     string        // tcp, udp or http
+	Connections  int           // Concurrent connections
+	RPS          float64       // Total target request rate, 0 for as fast as possible
+	Duration     time.Duration // Length of the run
+	PayloadSizes []int         // Request sizes in bytes, picked at random per request
+	Timeout      time.Duration // Per request timeout
+
+	// Egress proxy authentication for tcp targets, skipped without a token
+	ServiceID string
+	Token     string
+}
+
+// Validate checks the config and fills in defaults
+func (c *Config) Validate() error {
+	switch c.Protocol {
+	case "":
+		c.Protocol = "tcp"
+	case "tcp", "udp", "http":
+	default:
+		return fmt.Errorf("protocol must be tcp, udp or http")
+	}
+	if c.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if c.Protocol == "http" && !strings.HasPrefix(c.Target, "http://") && !strings.HasPrefix(c.Target, "https://") {
+		return fmt.Errorf("http targets must be URLs")
+	}
+	if c.Connections <= 0 {
+		c.Connections = 1
+	}
+	if c.RPS < 0 {
+		return fmt.Errorf("rps cannot be negative")
+	}
+	if c.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if len(c.PayloadSizes) == 0 {
+		c.PayloadSizes = []int{64}
+	}
+	for _, size := range c.PayloadSizes {
+		if size <= 0 {
+			return fmt.Errorf("payload sizes must be positive")
+		}
+		if c.Protocol == "udp" && size > 65507 {
+			return fmt.Errorf("udp payloads cannot exceed 65507 bytes")
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	return nil
+}
+
+// Result is the outcome of a load run
+type Result struct {
+	Config        Config
+	Elapsed       time.Duration
+	Requests      int64
+	Errors        map[string]int64 // By kind
+	BytesSent     int64
+	BytesReceived int64
+	Latency       *Histogram
+}
+
+// ErrorCount returns the number of failed requests
+func (r *Result) ErrorCount() int64 {
+	var n int64
+	for _, count := range r.Errors {
+		n += count
+	}
+	return n
+}
+
+// Throughput returns the successful requests per second
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Summary is the machine readable form of a result
+type Summary struct {
+	Protocol      string             `json:"protocol"`
+	Target        string             `json:"target"`
+	Connections   int                `json:"connections"`
+	TargetRPS     float64            `json:"target_rps"`
+	ElapsedSec    float64            `json:"elapsed_seconds"`
+	Requests      int64              `json:"requests"`
+	Errors        map[string]int64   `json:"errors"`
+	RPS           float64            `json:"rps"`
+	BytesSent     int64              `json:"bytes_sent"`
+	BytesReceived int64              `json:"bytes_received"`
+	LatencyMs     map[string]float64 `json:"latency_ms"`
+}
+
+// Summary returns the result with latencies in milliseconds
+func (r *Result) Summary() Summary {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return Summary{
+		Protocol:      r.Config.Protocol,
+		Target:        r.Config.Target,
+		Connections:   r.Config.Connections,
+		TargetRPS:     r.Config.RPS,
+		ElapsedSec:    r.Elapsed.Seconds(),
+		Requests:      r.Requests,
+		Errors:        r.Errors,
+		RPS:           r.Throughput(),
+		BytesSent:     r.BytesSent,
+		BytesReceived: r.BytesReceived,
+		LatencyMs: map[string]float64{
+			"min":  ms(r.Latency.Min()),
+			"mean": ms(r.Latency.Mean()),
+			"p50":  ms(r.Latency.Percentile(50)),
+			"p90":  ms(r.Latency.Percentile(90)),
+			"p99":  ms(r.Latency.Percentile(99)),
+			"p999": ms(r.Latency.Percentile(99.9)),
+			"max":  ms(r.Latency.Max()),
+		},
+	}
+}
+
+// WriteText writes a human readable report with the latency histogram
+func (r *Result) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Target:      %s (%s)\n", r.Config.Target, r.Config.Protocol)
+	if r.Config.RPS > 0 {
+		fmt.Fprintf(w, "Load:        %d connections at %.0f req/s for %v\n", r.Config.Connections, r.Config.RPS, r.Config.Duration)
+	} else {
+		fmt.Fprintf(w, "Load:        %d connections, unthrottled, for %v\n", r.Config.Connections, r.Config.Duration)
+	}
+	fmt.Fprintf(w, "Requests:    %d ok, %d failed in %.2fs (%.1f req/s)\n",
+		r.Requests, r.ErrorCount(), r.Elapsed.Seconds(), r.Throughput())
+	fmt.Fprintf(w, "Transferred: %d bytes sent, %d bytes received\n", r.BytesSent, r.BytesReceived)
+
+	if len(r.Errors) > 0 {
+		kinds := make([]string, 0, len(r.Errors))
+		for kind := range r.Errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		fmt.Fprintf(w, "Errors:\n")
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "  %-12s %d\n", kind, r.Errors[kind])
+		}
+	}
+
+	h := r.Latency
+	fmt.Fprintf(w, "Latency:     min %v, mean %v, max %v\n", h.Min(), h.Mean(), h.Max())
+	fmt.Fprintf(w, "             p50 %v, p90 %v, p99 %v, p99.9 %v\n",
+		h.Percentile(50), h.Percentile(90), h.Percentile(99), h.Percentile(99.9))
+	fmt.Fprintf(w, "Histogram:\n")
+	h.WriteText(w)
+}
+
+// requestError classifies a failed request for the error counts
+type requestError struct {
+	kind string
+	err  error
+}
+
+func (e *requestError) Error() string { return e.kind + ": " + e.err.Error() }
+
+func fail(kind string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, os.ErrDeadlineExceeded) {
+		kind = "timeout"
+	}
+	return &requestError{kind: kind, err: err}
+}
+
+// client sends one request and waits for the full response
+type client interface {
+	do(payload []byte) (received int, err error)
+	close()
+}
+
+// worker is one connection's share of the load
+type worker struct {
+	cfg      *Config
+	newConn  func() (client, error)
+	interval time.Duration // Between intended sends, 0 when unthrottled
+
+	latency       *Histogram
+	requests      int64
+	errors        map[string]int64
+	bytesSent     int64
+	bytesReceived int64
+}
+
+// run sends requests until the deadline. Throttled latencies are measured
+// from when each request was due rather than when it was sent, so a stalled
+// target is not hidden by the requests that were never sent meanwhile.
+func (wk *worker) run(ctx context.Context, start, deadline time.Time, offset time.Duration, rnd *rand.Rand) {
+	var c client
+	defer func() {
+		if c != nil {
+			c.close()
+		}
+	}()
+
+	payloads := make(map[int][]byte)
+	due := start.Add(offset)
+	for {
+		if wk.interval > 0 {
+			if !due.Before(deadline) {
+				return
+			}
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		} else {
+			due = time.Now()
+			if !due.Before(deadline) || ctx.Err() != nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		size := wk.cfg.PayloadSizes[rnd.Intn(len(wk.cfg.PayloadSizes))]
+		payload, ok := payloads[size]
+		if !ok {
+			payload = make([]byte, size)
+			rnd.Read(payload)
+			payloads[size] = payload
+		}
+
+		var err error
+		if c == nil {
+			c, err = wk.newConn()
+		}
+		if err == nil {
+			var received int
+			received, err = c.do(payload)
+			wk.bytesReceived += int64(received)
+			if err == nil {
+				wk.bytesSent += int64(size)
+				wk.requests++
+				wk.latency.Record(time.Since(due))
+			}
+		}
+		if err != nil {
+			kind := "error"
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				kind = reqErr.kind
+			}
+			wk.errors[kind]++
+
+			// Start over on a fresh connection
+			if c != nil {
+				c.close()
+				c = nil
+			}
+			if wk.interval == 0 {
+				// Do not spin on a target that refuses connections
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		due = due.Add(wk.interval)
+	}
+}
+
+// Run generates load as described by cfg until its duration elapses or ctx
+// is cancelled
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var newConn func() (client, error)
+	switch cfg.Protocol {
+	case "tcp":
+		newConn = func() (client, error) { return dialTCP(&cfg) }
+	case "udp":
+		newConn = func() (client, error) { return dialUDP(&cfg) }
+	case "http":
+		transport := &http.Transport{
+			MaxIdleConnsPerHost: cfg.Connections,
+			MaxConnsPerHost:     cfg.Connections,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		defer transport.CloseIdleConnections()
+		httpClient := &http.Client{Transport: transport, Timeout: cfg.Timeout}
+		newConn = func() (client, error) { return &httpLoadClient{client: httpClient, url: cfg.Target}, nil }
+	}
+
+	var interval time.Duration
+	if cfg.RPS > 0 {
+		interval = time.Duration(float64(cfg.Connections) / cfg.RPS * float64(time.Second))
+	}
+
+	workers := make([]*worker, cfg.Connections)
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wk := &worker{
+			cfg:      &cfg,
+			newConn:  newConn,
+			interval: interval,
+			latency:  NewHistogram(),
+			errors:   make(map[string]int64),
+		}
+		workers[i] = wk
+
+		// Stagger throttled workers so the requests are evenly spread
+		offset := interval * time.Duration(i) / time.Duration(cfg.Connections)
+		rnd := rand.New(rand.NewSource(int64(i) + 1))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wk.run(ctx, start, deadline, offset, rnd)
+		}()
+	}
+	wg.Wait()
+
+	result := &Result{
+		Config:  cfg,
+		Elapsed: time.Since(start),
+		Errors:  make(map[string]int64),
+		Latency: NewHistogram(),
+	}
+	for _, wk := range workers {
+		result.Requests += wk.requests
+		result.BytesSent += wk.bytesSent
+		result.BytesReceived += wk.bytesReceived
+		result.Latency.Merge(wk.latency)
+		for kind, n := range wk.errors {
+			result.Errors[kind] += n
+		}
+	}
+	return result, nil
+}
+
+// tcpLoadClient sends payloads over a stream connection and reads the echo
+type tcpLoadClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	buf     []byte
+}
+
+func dialTCP(cfg *Config) (client, error) {
+	conn, err := net.DialTimeout("tcp", cfg.Target, cfg.Timeout)
+	if err != nil {
+		return nil, fail("dial", err)
+	}
+	c := &tcpLoadClient{conn: conn, reader: bufio.NewReader(conn), timeout: cfg.Timeout}
+	if cfg.Token != "" {
+		if err := c.authenticate(cfg.ServiceID, cfg.Token); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// authenticate answers the egress proxy's SERVICE_ID:TOKEN challenge
+func (c *tcpLoadClient) authenticate(serviceID, token string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return fail("auth", err)
+		}
+		if strings.Contains(line, "SERVICE_ID:TOKEN") {
+			break
+		}
+	}
+	if _, err := fmt.Fprintf(c.conn, "%s:%s\n", serviceID, token); err != nil {
+		return fail("auth", err)
+	}
+	result, err := c.reader.ReadString('\n')
+	if err != nil {
+		return fail("auth", err)
+	}
+	if !strings.Contains(result, "AUTH_OK") {
+		return fail("auth", fmt.Errorf("rejected: %s", strings.TrimSpace(result)))
+	}
+	return nil
+}
+
+func (c *tcpLoadClient) do(payload []byte) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(payload); err != nil {
+		return 0, fail("write", err)
+	}
+	if cap(c.buf) < len(payload) {
+		c.buf = make([]byte, len(payload))
+	}
+	n, err := io.ReadFull(c.reader, c.buf[:len(payload)])
+	if err != nil {
+		return n, fail("read", err)
+	}
+	return n, nil
+}
+
+func (c *tcpLoadClient) close() {
+	c.conn.Close()
+}
+
+// udpLoadClient sends datagrams and waits for the echo
+type udpLoadClient struct {
+	conn    net.Conn
+	timeout time.Duration
+	buf     []byte
+}
+
+func dialUDP(cfg *Config) (client, error) {
+	conn, err := net.DialTimeout("udp", cfg.Target, cfg.Timeout)
+	if err != nil {
+		return nil, fail("dial", err)
+	}
+	return &udpLoadClient{conn: conn, timeout: cfg.Timeout, buf: make([]byte, 65535)}, nil
+}
+
+func (c *udpLoadClient) do(payload []byte) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(payload); err != nil {
+		return 0, fail("write", err)
+	}
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		return 0, fail("read", err)
+	}
+	if n != len(payload) {
+		return n, fail("short_read", fmt.Errorf("echoed %d of %d bytes", n, len(payload)))
+	}
+	return n, nil
+}
+
+func (c *udpLoadClient) close() {
+	c.conn.Close()
+}
+
+// httpLoadClient posts payloads over the shared keep-alive transport
+type httpLoadClient struct {
+	client *http.Client
+	url    string
+}
+
+func (c *httpLoadClient) do(payload []byte) (int, error) {
+	resp, err := c.client.Post(c.url, "application/octet-stream", bytes.NewReader(payload))
+	if err != nil {
+		return 0, fail("request", err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return int(n), fail("read", err)
+	}
+	if resp.StatusCode >= 400 {
+		return int(n), fail(fmt.Sprintf("status_%dxx", resp.StatusCode/100), fmt.Errorf("%s", resp.Status))
+	}
+	return int(n), nil
+}
+
+func (c *httpLoadClient) close() {}
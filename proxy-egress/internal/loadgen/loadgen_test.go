@@ -0,0 +1,226 @@
+package loadgen
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	if h.Count() != 1000 || h.Min() != time.Millisecond || h.Max() != time.Second {
+		t.Fatalf("Unexpected count %d, min %v, max %v", h.Count(), h.Min(), h.Max())
+	}
+	if mean := h.Mean(); mean != 500500*time.Microsecond {
+		t.Errorf("Expected mean 500.5ms, got %v", mean)
+	}
+
+	// Percentiles are accurate to the bucket width
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{{50, 500 * time.Millisecond}, {90, 900 * time.Millisecond}, {99, 990 * time.Millisecond}, {100, time.Second}} {
+		got := h.Percentile(tc.p)
+		if diff := got - tc.want; diff < 0 || diff > tc.want/50 {
+			t.Errorf("p%v = %v, expected about %v", tc.p, got, tc.want)
+		}
+	}
+
+	other := NewHistogram()
+	other.Record(5 * time.Second)
+	h.Merge(other)
+	if h.Count() != 1001 || h.Max() != 5*time.Second || h.Percentile(100) != 5*time.Second {
+		t.Errorf("Merge lost samples: count %d, max %v", h.Count(), h.Max())
+	}
+
+	var out strings.Builder
+	h.WriteText(&out)
+	if !strings.Contains(out.String(), "#") {
+		t.Errorf("Expected a bar chart, got %q", out.String())
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	// Buckets are contiguous and every value falls in its own bucket
+	prevHi := uint64(0)
+	for b := 0; b < 20*subBuckets; b++ {
+		lo, hi := bucketBounds(b)
+		if lo != prevHi || hi <= lo {
+			t.Fatalf("Bucket %d is [%d, %d), previous ended at %d", b, lo, hi, prevHi)
+		}
+		if bucketOf(lo) != b || bucketOf(hi-1) != b {
+			t.Fatalf("Bucket %d bounds map to %d and %d", b, bucketOf(lo), bucketOf(hi-1))
+		}
+		prevHi = hi
+	}
+}
+
+func startEcho(t *testing.T, protocol string, delay time.Duration) *EchoServer {
+	t.Helper()
+	s, err := ListenEcho(protocol, "127.0.0.1:0", delay)
+	if err != nil {
+		t.Fatalf("ListenEcho(%s) failed: %v", protocol, err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRunAgainstEcho(t *testing.T) {
+	for _, protocol := range []string{"tcp", "udp", "http"} {
+		t.Run(protocol, func(t *testing.T) {
+			s := startEcho(t, protocol, 0)
+			target := s.Addr().String()
+			if protocol == "http" {
+				target = "http://" + target + "/echo"
+			}
+
+			result, err := Run(context.Background(), Config{
+				Target:       target,
+				Protocol:     protocol,
+				Connections:  4,
+				Duration:     200 * time.Millisecond,
+				PayloadSizes: []int{16, 1024},
+			})
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if result.Requests == 0 || result.ErrorCount() != 0 {
+				t.Fatalf("Expected requests without errors, got %d ok and %v", result.Requests, result.Errors)
+			}
+			if result.BytesReceived != result.BytesSent || result.Latency.Count() != result.Requests {
+				t.Errorf("Sent %d bytes, received %d, recorded %d of %d latencies",
+					result.BytesSent, result.BytesReceived, result.Latency.Count(), result.Requests)
+			}
+		})
+	}
+}
+
+func TestRunThrottled(t *testing.T) {
+	s := startEcho(t, "tcp", 0)
+	result, err := Run(context.Background(), Config{
+		Target:      s.Addr().String(),
+		Connections: 5,
+		RPS:         200,
+		Duration:    500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// 200 req/s for half a second, give or take scheduling
+	if result.Requests < 80 || result.Requests > 101 {
+		t.Errorf("Expected about 100 requests, got %d", result.Requests)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	// Nothing listens on a closed listener's port
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	result, err := Run(context.Background(), Config{Target: addr, Duration: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Requests != 0 || result.Errors["dial"] == 0 {
+		t.Errorf("Expected dial errors, got %d ok and %v", result.Requests, result.Errors)
+	}
+
+	s := startEcho(t, "http", 0)
+	result, _ = Run(context.Background(), Config{
+		Target:   "http://" + s.Addr().String() + "/?status=503",
+		Protocol: "http",
+		Duration: 100 * time.Millisecond,
+	})
+	if result.Requests != 0 || result.Errors["status_5xx"] == 0 {
+		t.Errorf("Expected 5xx errors, got %d ok and %v", result.Requests, result.Errors)
+	}
+
+	for _, cfg := range []Config{
+		{Target: addr, Protocol: "sctp", Duration: time.Second},
+		{Target: addr, Protocol: "http", Duration: time.Second},
+		{Target: addr},
+		{Target: addr, Duration: time.Second, PayloadSizes: []int{0}},
+	} {
+		if _, err := Run(context.Background(), cfg); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestRunAuthenticated(t *testing.T) {
+	// A stand-in for the egress proxy's authentication handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "MARCHPROXY\nSend SERVICE_ID:TOKEN\n")
+				reader := bufio.NewReader(conn)
+				line, _ := reader.ReadString('\n')
+				if strings.TrimSpace(line) != "7:secret" {
+					io.WriteString(conn, "AUTH_FAILED\n")
+					return
+				}
+				io.WriteString(conn, "AUTH_OK\n")
+				io.Copy(conn, reader)
+			}()
+		}
+	}()
+
+	cfg := Config{Target: l.Addr().String(), Duration: 100 * time.Millisecond, ServiceID: "7", Token: "secret"}
+	result, err := Run(context.Background(), cfg)
+	if err != nil || result.Requests == 0 || result.ErrorCount() != 0 {
+		t.Fatalf("Expected authenticated requests, got %+v, %v", result, err)
+	}
+
+	cfg.Token = "wrong"
+	result, _ = Run(context.Background(), cfg)
+	if result.Requests != 0 || result.Errors["auth"] == 0 {
+		t.Errorf("Expected auth errors, got %d ok and %v", result.Requests, result.Errors)
+	}
+}
+
+func TestEchoHTTP(t *testing.T) {
+	s := startEcho(t, "http", 0)
+	base := "http://" + s.Addr().String()
+
+	start := time.Now()
+	resp, err := http.Get(base + "/?size=100000&delay=50&status=201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 201 || len(body) != 100000 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Got status %d with %d bytes after %v", resp.StatusCode, len(body), time.Since(start))
+	}
+
+	resp, err = http.Get(base + "/?size=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid size to be rejected, got %d", resp.StatusCode)
+	}
+}
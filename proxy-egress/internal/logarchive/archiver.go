@@ -0,0 +1,301 @@
+// Package logarchive uploads rotated log files to S3-compatible object
+// storage for long-term compliance retention, without an agent on the
+// proxy host. Every interval the rotated siblings of each log, such as
+// audit.jsonl.20260102-150405 or queries.log.1.gz, are gzip compressed,
+// uploaded with server-side encryption, and removed locally. Objects older
+// than the retention are expired from the bucket.
+package logarchive
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is the object storage logs are archived to
+type Store interface {
+	Put(ctx context.Context, key string, body io.ReadSeeker, size int64, payloadHash string) error
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Log is a live log file whose rotated files are archived
+type Log struct {
+	Name string // Part of the object keys, such as "audit"
+	Path string // The file written to; rotated files are its siblings
+}
+
+// Options configures an archiver
+type Options struct {
+	Store     Store
+	Prefix    string // Key prefix, such as "marchproxy"
+	Host      string // This proxy, part of the object keys
+	Logs      []Log
+	Settle    time.Duration // Rotated files modified more recently are left for later, default 1m
+	Retention time.Duration // Age of expired objects, 0 keeps them
+}
+
+// Archiver archives rotated logs
+type Archiver struct {
+	opts Options
+	now  func() time.Time
+
+	mu            sync.Mutex
+	stats         map[string]*logStats
+	lastExpiry    time.Time
+	expired       uint64
+	expiryFailure uint64
+}
+
+// logStats is the archival of one log
+type logStats struct {
+	uploaded    uint64
+	failed      uint64
+	bytes       uint64 // Compressed
+	lastSuccess time.Time
+}
+
+// New creates an archiver
+func New(opts Options) *Archiver {
+	if opts.Settle <= 0 {
+		opts.Settle = time.Minute
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	stats := make(map[string]*logStats)
+	for _, log := range opts.Logs {
+		stats[log.Name] = &logStats{}
+	}
+	return &Archiver{opts: opts, now: time.Now, stats: stats}
+}
+
+// Run archives every interval until ctx is done
+func (a *Archiver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.Sweep(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep archives the rotated files of every log, and expires old objects
+// at most once an hour
+func (a *Archiver) Sweep(ctx context.Context) {
+	for _, log := range a.opts.Logs {
+		files, err := a.rotated(log)
+		if err != nil {
+			fmt.Printf("Log archive: failed to list rotated %s logs: %v\n", log.Name, err)
+			continue
+		}
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := a.archive(ctx, log, file); err != nil {
+				fmt.Printf("Log archive: failed to archive %s: %v\n", file, err)
+			}
+		}
+	}
+
+	if a.opts.Retention > 0 && a.now().Sub(a.lastExpiry) >= time.Hour {
+		a.expire(ctx)
+	}
+}
+
+// rotated returns the rotated files of a log that settled: the files next
+// to it named after it, such as audit.jsonl.1 or audit.jsonl-20260102
+func (a *Archiver) rotated(log Log) ([]string, error) {
+	dir, base := filepath.Split(log.Path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || name == base || !(strings.HasPrefix(name, base+".") || strings.HasPrefix(name, base+"-")) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || a.now().Sub(info.ModTime()) < a.opts.Settle {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// key returns the object key of a rotated file:
+// <prefix>/<log>/<host>/<yyyy>/<mm>/<dd>/<modified>-<file>.gz, unique as
+// numbered rotations reuse file names
+func (a *Archiver) key(log Log, file string, modified time.Time) string {
+	modified = modified.UTC()
+	name := filepath.Base(file)
+	if !strings.HasSuffix(name, ".gz") {
+		name += ".gz"
+	}
+	return path.Join(a.opts.Prefix, log.Name, a.opts.Host, modified.Format("2006/01/02"), modified.Format("20060102T150405Z")+"-"+name)
+}
+
+// archive compresses and uploads a rotated file, then removes it
+func (a *Archiver) archive(ctx context.Context, log Log, file string) error {
+	source, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Compress to a temporary file, hashing it for the signature
+	compressed, err := os.CreateTemp(filepath.Dir(file), ".archive-*.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(compressed.Name())
+	defer compressed.Close()
+
+	hash := sha256.New()
+	out := io.MultiWriter(compressed, hash)
+	if strings.HasSuffix(file, ".gz") {
+		_, err = io.Copy(out, source)
+	} else {
+		zw := gzip.NewWriter(out)
+		zw.Name = filepath.Base(file)
+		zw.ModTime = info.ModTime()
+		if _, err = io.Copy(zw, source); err == nil {
+			err = zw.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	size, err := compressed.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := compressed.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	key := a.key(log, file, info.ModTime())
+	err = a.opts.Store.Put(ctx, key, compressed, size, hex.EncodeToString(hash.Sum(nil)))
+	a.record(log.Name, size, err)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Log archive: %s uploaded as %s (%d bytes)\n", file, key, size)
+	return os.Remove(file)
+}
+
+// record counts an upload
+func (a *Archiver) record(log string, size int64, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := a.stats[log]
+	if err != nil {
+		stats.failed++
+		return
+	}
+	stats.uploaded++
+	stats.bytes += uint64(size)
+	stats.lastSuccess = a.now()
+}
+
+// expire deletes this proxy's objects older than the retention
+func (a *Archiver) expire(ctx context.Context) {
+	cutoff := a.now().Add(-a.opts.Retention)
+	var expired, failed uint64
+	for _, log := range a.opts.Logs {
+		prefix := path.Join(a.opts.Prefix, log.Name, a.opts.Host) + "/"
+		objects, err := a.opts.Store.List(ctx, prefix)
+		if err != nil {
+			fmt.Printf("Log archive: failed to list archived %s logs: %v\n", log.Name, err)
+			failed++
+			continue
+		}
+		for _, object := range objects {
+			if !object.LastModified.Before(cutoff) {
+				continue
+			}
+			if err := a.opts.Store.Delete(ctx, object.Key); err != nil {
+				fmt.Printf("Log archive: failed to expire %s: %v\n", object.Key, err)
+				failed++
+				continue
+			}
+			expired++
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expired += expired
+	a.expiryFailure += failed
+	if failed == 0 {
+		a.lastExpiry = a.now()
+	}
+}
+
+// WritePrometheus writes the archival of every log in Prometheus text
+// format; a nil archiver writes nothing
+func (a *Archiver) WritePrometheus(w io.Writer) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names := make([]string, 0, len(a.stats))
+	for name := range a.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP marchproxy_log_archive_uploads_total Rotated log files uploaded to object storage by log and result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_log_archive_uploads_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "marchproxy_log_archive_uploads_total{log=%q,result=\"success\"} %d\n", name, a.stats[name].uploaded)
+		fmt.Fprintf(w, "marchproxy_log_archive_uploads_total{log=%q,result=\"failure\"} %d\n", name, a.stats[name].failed)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_log_archive_bytes_total Compressed bytes uploaded by log\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_log_archive_bytes_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "marchproxy_log_archive_bytes_total{log=%q} %d\n", name, a.stats[name].bytes)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_log_archive_last_success_timestamp_seconds Last successful upload by log\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_log_archive_last_success_timestamp_seconds gauge\n")
+	for _, name := range names {
+		var last int64
+		if !a.stats[name].lastSuccess.IsZero() {
+			last = a.stats[name].lastSuccess.Unix()
+		}
+		fmt.Fprintf(w, "marchproxy_log_archive_last_success_timestamp_seconds{log=%q} %d\n", name, last)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_log_archive_expired_total Archived objects deleted after the retention\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_log_archive_expired_total counter\n")
+	fmt.Fprintf(w, "marchproxy_log_archive_expired_total %d\n", a.expired)
+	fmt.Fprintf(w, "# HELP marchproxy_log_archive_expiry_failures_total Failed listings and deletions of expired objects\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_log_archive_expiry_failures_total counter\n")
+	fmt.Fprintf(w, "marchproxy_log_archive_expiry_failures_total %d\n", a.expiryFailure)
+}
@@ -0,0 +1,278 @@
+package logarchive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server-side encryption of uploaded objects
+const (
+	SSEAES256 = "AES256"  // Keys managed by the storage service
+	SSEKMS    = "aws:kms" // A KMS key, the bucket's default without KMSKeyID
+)
+
+// emptyHash is the SHA-256 of an empty payload
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Options configures an S3-compatible bucket
+type S3Options struct {
+	Endpoint     string // Such as https://s3.eu-west-1.amazonaws.com or a MinIO URL
+	Region       string
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // Temporary credentials only
+	PathStyle    bool   // endpoint/bucket/key instead of bucket.endpoint/key, for most non-AWS stores
+	SSE          string // AES256, aws:kms, or empty for the bucket's default
+	KMSKeyID     string // With aws:kms
+	Client       *http.Client
+}
+
+// S3 is an object store speaking the S3 API with Signature Version 4
+type S3 struct {
+	opts     S3Options
+	endpoint *url.URL
+}
+
+// NewS3 validates the options
+func NewS3(opts S3Options) (*S3, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid object storage endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" || opts.Region == "" {
+		return nil, fmt.Errorf("object storage bucket and region are required")
+	}
+	if opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, fmt.Errorf("object storage credentials are required")
+	}
+	switch opts.SSE {
+	case "", SSEAES256, SSEKMS:
+	default:
+		return nil, fmt.Errorf("server-side encryption must be %s or %s, not %q", SSEAES256, SSEKMS, opts.SSE)
+	}
+	if opts.KMSKeyID != "" && opts.SSE != SSEKMS {
+		return nil, fmt.Errorf("a KMS key requires %s server-side encryption", SSEKMS)
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return &S3{opts: opts, endpoint: endpoint}, nil
+}
+
+// Object is a stored object
+type Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// Put uploads an object from body, whose SHA-256 is payloadHash
+func (s *S3) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, payloadHash string) error {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/gzip")
+	if s.opts.SSE != "" {
+		headers.Set("X-Amz-Server-Side-Encryption", s.opts.SSE)
+	}
+	if s.opts.KMSKeyID != "" {
+		headers.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.opts.KMSKeyID)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, headers, body, size, payloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the objects under prefix
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, 0, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid object listing: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Delete removes an object
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil, 0, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request, returning an error for any status but 2xx
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, headers http.Header, body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	path, rawPath := "/"+key, "/"+escapePath(key)
+	if s.opts.PathStyle {
+		path, rawPath = "/"+s.opts.Bucket+path, "/"+escape(s.opts.Bucket)+rawPath
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	base := strings.TrimRight(u.Path, "/")
+	u.Path, u.RawPath = base+path, escapePath(base)+rawPath
+	u.RawQuery = canonicalQuery(query)
+
+	var reader io.Reader
+	if body != nil {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		reader = body
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var failure struct {
+			Code    string
+			Message string
+		}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure)
+		return nil, fmt.Errorf("object storage %s %s: %s %s %s", method, u.Path, resp.Status, failure.Code, failure.Message)
+	}
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 authorization of a request, signing
+// the host and every header set on it
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.opts.Region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+
+	canonical := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		canonical[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(canonical))
+	for name := range canonical {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headerLines strings.Builder
+	for _, name := range names {
+		headerLines.WriteString(name + ":" + canonical[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headerLines.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.opts.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 requires
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// escapePath escapes each segment of a path
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes a query sorted by name
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -9,9 +9,26 @@ import (
 	"math/rand"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/config"
+	"marchproxy-egress/internal/certs"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/dlp"
+	"marchproxy-egress/internal/dnsproxy"
+	"marchproxy-egress/internal/quarantine"
+	"marchproxy-egress/internal/smtprelay"
+	"marchproxy-egress/internal/sshaudit"
+	"marchproxy-egress/internal/tenant"
+	"marchproxy-egress/internal/tlsinspect"
+	"marchproxy-egress/internal/slo"
+	"marchproxy-egress/internal/tlsmode"
+	"marchproxy-egress/internal/traffic"
+	"marchproxy-egress/internal/upstreamproxy"
+	"marchproxy-shared/ebpfstats"
+	"marchproxy-shared/fault"
+	"marchproxy-shared/metering"
+	"marchproxy-shared/schedule"
 )
 
 // Client handles communication with the MarchProxy manager API
@@ -19,14 +36,23 @@ type Client struct {
 	httpClient *http.Client
 	baseURL    string
 	apiKey     string
+	proxyName  string
 	
 	// Configuration state
 	lastConfigHash string
 	lastConfigTime time.Time
+
+	// Rollout state of the last config, changes without a new version when
+	// a canary rollout is promoted or rolled back
+	rollout   *Rollout
+	rolloutMu sync.RWMutex
 	
 	// Cluster information
 	clusterID   int
 	clusterName string
+
+	// Local cluster config file used instead of the manager
+	standaloneConfig string
 }
 
 // NewClient creates a new manager API client
@@ -35,8 +61,11 @@ func NewClient(cfg *config.Config) *Client {
 		httpClient: &http.Client{
 			Timeout: time.Duration(cfg.ConnectionTimeout) * time.Second,
 		},
-		baseURL: cfg.ManagerURL,
-		apiKey:  cfg.ClusterAPIKey,
+		baseURL:   cfg.ManagerURL,
+		apiKey:    cfg.ClusterAPIKey,
+		proxyName: cfg.ProxyName,
+
+		standaloneConfig: cfg.StandaloneConfig,
 	}
 }
 
@@ -66,6 +95,13 @@ type Service struct {
 	AuthToken  string `json:"auth_token,omitempty"`
 	JWTSecret  string `json:"jwt_secret,omitempty"`
 	JWTExpiry  int    `json:"jwt_expiry,omitempty"`
+	Tenant     string `json:"tenant,omitempty"` // Owning tenant on shared clusters
+
+	// Credentials replaced by the last rotation, still valid until
+	// PreviousValidUntil so clients can roll over without a cutover
+	PreviousAuthToken  string    `json:"previous_auth_token,omitempty"`
+	PreviousJWTSecret  string    `json:"previous_jwt_secret,omitempty"`
+	PreviousValidUntil time.Time `json:"previous_valid_until,omitempty"`
 }
 
 type Mapping struct {
@@ -79,6 +115,110 @@ type Mapping struct {
 	AuthType        string   `json:"auth_type"`
 	Priority        int      `json:"priority"`
 	Timeout         int      `json:"timeout"`
+
+	// Outbound dial overrides; zero values inherit the proxy defaults
+	SourceAddresses []string `json:"source_addresses,omitempty"` // Egress IP pinning / SNAT pool
+	SourceInterface string   `json:"source_interface,omitempty"`
+	IPFamily        string   `json:"ip_family,omitempty"`    // any, ipv4, ipv6
+	DialTimeout     int      `json:"dial_timeout,omitempty"` // seconds
+	DialRetries     *int     `json:"dial_retries,omitempty"`
+	MPTCP           *bool    `json:"mptcp,omitempty"` // Multipath TCP to the destination
+	BufferSize      int      `json:"buffer_size,omitempty"` // Relay buffer bytes, larger for high-BDP links
+	PoolMaxIdle     *int     `json:"pool_max_idle,omitempty"` // Warm destination connections, 0 disables pooling
+
+	// Upstream proxies, by name from upstream_proxies, that TCP connections
+	// are tunneled through instead of dialing the destination, with the
+	// fallback when none of them connects
+	UpstreamProxy *upstreamproxy.Route `json:"upstream_proxy,omitempty"`
+
+	// Service level objectives on connect latency, errors or bandwidth,
+	// with burn rates for the dashboard's slo_burn_rate alert rules
+	SLOs []slo.Objective `json:"slos,omitempty"`
+
+	// TCP socket overrides; zero values inherit the proxy defaults
+	TCPNoDelay           *bool `json:"tcp_nodelay,omitempty"`
+	TCPKeepAlive         int   `json:"tcp_keepalive,omitempty"`          // seconds, negative disables
+	TCPKeepAliveInterval int   `json:"tcp_keepalive_interval,omitempty"` // seconds
+	TCPKeepAliveCount    int   `json:"tcp_keepalive_count,omitempty"`
+	TCPSendBuffer        int   `json:"tcp_send_buffer,omitempty"`  // bytes
+	TCPRecvBuffer        int   `json:"tcp_recv_buffer,omitempty"`  // bytes
+	TCPUserTimeout       int   `json:"tcp_user_timeout,omitempty"` // milliseconds
+
+	// TLS client fingerprints, JA3 hashes or JA4 strings; an allow list
+	// admits only the clients it lists
+	TLSFingerprintAllow []string `json:"tls_fingerprint_allow,omitempty"`
+	TLSFingerprintDeny  []string `json:"tls_fingerprint_deny,omitempty"`
+
+	// Client countries (ISO 3166-1 codes) from the GeoIP database. A mapping
+	// with source countries only matches clients from them; blocked
+	// countries are dropped once the mapping matches.
+	SourceCountries  []string `json:"source_countries,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+
+	// Copy every flow of the mapping to the proxy's mirror target, on top of
+	// the sampled share of all flows
+	Mirror bool `json:"mirror,omitempty"`
+
+	// Faults injected into the mapping's connections for resilience testing,
+	// applied only on proxies with fault injection enabled
+	FaultInjection *fault.Spec `json:"fault_injection,omitempty"`
+
+	// Domains the mapping's source services may resolve through the DNS
+	// proxy, and split-horizon rewrites
+	DNS *dnsproxy.Policy `json:"dns,omitempty"`
+
+	// Mail policy of the SMTP relay for mappings with the smtp protocol
+	SMTP *smtprelay.Policy `json:"smtp,omitempty"`
+
+	// Owning tenant on shared clusters; the mapping's connections count
+	// towards its quotas and only reach services of the same tenant
+	Tenant string `json:"tenant,omitempty"`
+
+	// Connections the mapping matches, any when empty: client addresses or
+	// CIDRs, proxy listener ports, and TLS server names, exact or
+	// *.example.com. The most specific matching mapping is selected.
+	SourceCIDRs []string `json:"source_cidrs,omitempty"`
+	ListenPorts []int    `json:"listen_ports,omitempty"`
+	Hostnames   []string `json:"hostnames,omitempty"`
+
+	// CEL expression over the connection, such as
+	// source.ip in cidr("10.0.0.0/8"); the mapping only matches
+	// connections it is true for
+	Condition string `json:"condition,omitempty"`
+
+	// Validity period and weekly windows the mapping is active in, such
+	// as business hours or a temporary grant; always active when nil
+	Schedule *schedule.Schedule `json:"schedule,omitempty"`
+
+	// Sensitive data scanning of the mapping's outbound plaintext, and
+	// whether findings are alerted on, masked or blocked
+	DLP *dlp.Policy `json:"dlp,omitempty"`
+
+	// TLS interception of the mapping's HTTPS so DLP and the domain policy
+	// apply to its plaintext, with server names excluded from it
+	TLSInspection *tlsinspect.Policy `json:"tls_inspection,omitempty"`
+
+	// TLS mode of the connection to the destination: require verified TLS
+	// and block plaintext, pass TLS through untouched, or terminate and
+	// re-originate it. Takes the place of TLS inspection when set.
+	TLSPolicy *tlsmode.Policy `json:"tls_policy,omitempty"`
+
+	// SSH awareness: handshake metadata of relayed sessions, or terminated
+	// and recorded sessions with user and forwarding allow-lists
+	SSH *sshaudit.Policy `json:"ssh,omitempty"`
+}
+
+// Listener binds an additional proxy port to a group of mappings
+type Listener struct {
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	Port          int      `json:"port"`
+	Protocols     []string `json:"protocols"`
+	Mappings      []int    `json:"mappings"`
+	EnableTLS     bool     `json:"enable_tls"`
+	RequireAuth   bool     `json:"require_auth"`
+	BindAddress   string   `json:"bind_address,omitempty"`
+	BindInterface string   `json:"bind_interface,omitempty"`
 }
 
 type Certificate struct {
@@ -97,13 +237,29 @@ type LoggingConfig struct {
 }
 
 type ClusterConfig struct {
-	Cluster      ClusterInfo     `json:"cluster"`
-	Logging      LoggingConfig   `json:"logging"`
-	Services     []Service       `json:"services"`
-	Mappings     []Mapping       `json:"mappings"`
-	Certificates []Certificate   `json:"certificates"`
-	Version      string          `json:"version"`
-	GeneratedAt  string          `json:"generated_at"`
+	Cluster      ClusterInfo       `json:"cluster"`
+	Logging      LoggingConfig     `json:"logging"`
+	Services     []Service         `json:"services"`
+	Mappings     []Mapping         `json:"mappings"`
+	Listeners    []Listener        `json:"listeners,omitempty"`
+	Certificates []Certificate     `json:"certificates"`
+	Tenants      []tenant.Quota    `json:"tenants,omitempty"`
+	Quarantine   quarantine.Config `json:"quarantine"`
+	EgressDNS    *dnsproxy.Policy  `json:"egress_dns,omitempty"` // Destination names the proxy may resolve, nil for any
+	Version      string            `json:"version"`
+	GeneratedAt  string            `json:"generated_at"`
+	Rollout      *Rollout          `json:"rollout,omitempty"`
+}
+
+// Rollout is this proxy's part in a staged config rollout. Canaries get a
+// new config version first; the manager promotes it to the other proxies
+// once the canaries stay healthy, or rolls the canaries back.
+type Rollout struct {
+	ID            int    `json:"id"`
+	State         string `json:"state"` // canary, promoted, rolled_back or superseded
+	Role          string `json:"role"`  // canary or stable
+	Version       string `json:"version"`
+	StableVersion string `json:"stable_version"`
 }
 
 type ClusterInfo struct {
@@ -129,11 +285,37 @@ type LicenseStatus struct {
 
 // Heartbeat types
 type HeartbeatRequest struct {
-	Name             string  `json:"name"`
-	CPUUsage         float64 `json:"cpu_usage"`
-	MemoryUsage      float64 `json:"memory_usage"`
-	Connections      int     `json:"connections"`
-	BytesTransferred int64   `json:"bytes_transferred"`
+	ProxyName     string           `json:"proxy_name"`
+	ClusterAPIKey string           `json:"cluster_api_key"`
+	ConfigVersion string           `json:"config_version,omitempty"`
+	Metrics       HeartbeatMetrics `json:"metrics"`
+
+	// Certificates loaded by the proxy, so the manager can warn before they expire
+	Certificates []certs.Entry `json:"certificates,omitempty"`
+}
+
+// HeartbeatMetrics are the proxy metrics sent with a heartbeat. Closed and
+// failed connections are totals since the proxy started; the manager judges
+// canaries of a config rollout by their error rate.
+type HeartbeatMetrics struct {
+	CPUUsage          float64 `json:"cpu_usage"`
+	MemoryUsage       float64 `json:"memory_usage"`
+	ConnectionsActive int     `json:"connections_active"`
+	BytesTransferred  int64   `json:"bytes_transferred"`
+	ConnectionsClosed uint64  `json:"connections_closed"`
+	ConnectionsFailed uint64  `json:"connections_failed"`
+
+	// Bytes relayed by direction since start, in total and per mapping,
+	// destination service, tenant and path, for quotas the manager
+	// enforces on the difference between heartbeats. Sent bytes go to
+	// destinations, received bytes are their replies.
+	BytesSent     uint64          `json:"bytes_sent"`
+	BytesReceived uint64          `json:"bytes_received"`
+	Traffic       []traffic.Entry `json:"traffic,omitempty"`
+
+	// eBPF counters summed across CPUs, with per-mapping and per-service
+	// breakdowns, when the program is loaded
+	EBPF *ebpfstats.Snapshot `json:"ebpf,omitempty"`
 }
 
 type HeartbeatResponse struct {
@@ -142,8 +324,62 @@ type HeartbeatResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
+// Certificate issuance types
+type CertificateRequest struct {
+	ProxyName     string `json:"proxy_name"`
+	ClusterAPIKey string `json:"cluster_api_key"`
+	CSR           string `json:"csr"`
+	TTLSeconds    int    `json:"ttl_seconds"`
+}
+
+type CertificateResponse struct {
+	Success       bool   `json:"success"`
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"ca_certificate"`
+	SerialNumber  string `json:"serial_number"`
+	ExpiresAt     string `json:"expires_at"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Usage upload types
+type UsageRequest struct {
+	ProxyName     string            `json:"proxy_name"`
+	ClusterAPIKey string            `json:"cluster_api_key"`
+	Records       []metering.Record `json:"records"`
+}
+
+type UsageResponse struct {
+	Success  bool   `json:"success"`
+	Recorded int    `json:"recorded"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Quarantine report types
+type QuarantineRequest struct {
+	ProxyName     string `json:"proxy_name"`
+	ClusterAPIKey string `json:"cluster_api_key"`
+	ServiceID     int    `json:"service_id"`
+	Reason        string `json:"reason"`
+}
+
+type QuarantineResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
 // Register registers this proxy with the manager
 func (c *Client) Register(cfg *config.Config) error {
+	if c.Standalone() {
+		config, err := LoadClusterConfig(c.standaloneConfig)
+		if err != nil {
+			return err
+		}
+		c.clusterID = config.Cluster.ID
+		c.clusterName = config.Cluster.Name
+		fmt.Printf("Standalone mode, skipping registration - Cluster: %s, Config: %s\n", c.clusterName, c.standaloneConfig)
+		return nil
+	}
+
 	fmt.Printf("Registering proxy with manager...\n")
 	
 	req := RegistrationRequest{
@@ -173,6 +409,20 @@ func (c *Client) Register(cfg *config.Config) error {
 
 // GetConfig retrieves the current configuration from the manager
 func (c *Client) GetConfig() (*ClusterConfig, error) {
+	if c.Standalone() {
+		config, err := LoadClusterConfig(c.standaloneConfig)
+		if err != nil {
+			return nil, err
+		}
+		if config.Version != c.lastConfigHash {
+			fmt.Printf("Loaded standalone config - Services: %d, Mappings: %d, Version: %s\n",
+				len(config.Services), len(config.Mappings), config.Version)
+		}
+		c.lastConfigHash = config.Version
+		c.lastConfigTime = time.Now()
+		return config, nil
+	}
+
 	if c.clusterID == 0 {
 		return nil, fmt.Errorf("proxy not registered, call Register() first")
 	}
@@ -187,6 +437,7 @@ func (c *Client) GetConfig() (*ClusterConfig, error) {
 	// Update local state
 	c.lastConfigHash = config.Version
 	c.lastConfigTime = time.Now()
+	c.setRollout(config.Rollout)
 	
 	fmt.Printf("Retrieved config - Services: %d, Mappings: %d, Version: %s\n", 
 		len(config.Services), len(config.Mappings), config.Version)
@@ -194,8 +445,32 @@ func (c *Client) GetConfig() (*ClusterConfig, error) {
 	return &config, nil
 }
 
+// Rollout returns the rollout state of the last config, nil when the
+// cluster doesn't stage config rollouts
+func (c *Client) Rollout() *Rollout {
+	c.rolloutMu.RLock()
+	defer c.rolloutMu.RUnlock()
+	return c.rollout
+}
+
+// setRollout records the rollout state of a fetched config, logging changes
+func (c *Client) setRollout(rollout *Rollout) {
+	c.rolloutMu.Lock()
+	defer c.rolloutMu.Unlock()
+
+	if rollout != nil && (c.rollout == nil || *c.rollout != *rollout) {
+		fmt.Printf("Config rollout %d of version %s: %s, this proxy is %s\n",
+			rollout.ID, rollout.Version, rollout.State, rollout.Role)
+	}
+	c.rollout = rollout
+}
+
 // GetLicenseStatus retrieves the current license status
 func (c *Client) GetLicenseStatus() (*LicenseStatus, error) {
+	if c.Standalone() {
+		return standaloneLicense(), nil
+	}
+
 	var status LicenseStatus
 	if err := c.makeRequest("GET", "/api/license-status", nil, &status); err != nil {
 		return nil, fmt.Errorf("failed to get license status: %w", err)
@@ -204,14 +479,56 @@ func (c *Client) GetLicenseStatus() (*LicenseStatus, error) {
 	return &status, nil
 }
 
+// SignCertificate has the cluster CA sign a certificate request for this
+// proxy, returning the PEM certificate and the CA that issued it
+func (c *Client) SignCertificate(csrPEM []byte, ttl time.Duration) ([]byte, []byte, error) {
+	if c.Standalone() {
+		return nil, nil, fmt.Errorf("certificate issuance needs a manager, not available in standalone mode")
+	}
+
+	req := CertificateRequest{
+		ProxyName:     c.proxyName,
+		ClusterAPIKey: c.apiKey,
+		CSR:           string(csrPEM),
+		TTLSeconds:    int(ttl / time.Second),
+	}
+
+	var resp CertificateResponse
+	if err := c.makeRequest("POST", "/api/proxy/certificate", req, &resp); err != nil {
+		return nil, nil, fmt.Errorf("certificate request failed: %w", err)
+	}
+
+	if !resp.Success {
+		return nil, nil, fmt.Errorf("certificate issuance failed: %s", resp.Error)
+	}
+
+	return []byte(resp.Certificate), []byte(resp.CACertificate), nil
+}
+
 // SendHeartbeat sends a heartbeat with current proxy status
 func (c *Client) SendHeartbeat(cfg *config.Config, stats SystemStats) error {
+	if c.Standalone() {
+		return nil
+	}
+
+	sent, received := traffic.Totals(stats.Traffic)
 	req := HeartbeatRequest{
-		Name:             cfg.ProxyName,
-		CPUUsage:         stats.CPUUsage,
-		MemoryUsage:      stats.MemoryUsage,
-		Connections:      stats.ActiveConnections,
-		BytesTransferred: stats.BytesTransferred,
+		ProxyName:     cfg.ProxyName,
+		ClusterAPIKey: c.apiKey,
+		ConfigVersion: stats.ConfigVersion,
+		Metrics: HeartbeatMetrics{
+			CPUUsage:          stats.CPUUsage,
+			MemoryUsage:       stats.MemoryUsage,
+			ConnectionsActive: stats.ActiveConnections,
+			BytesTransferred:  stats.BytesTransferred,
+			ConnectionsClosed: stats.ConnectionsClosed,
+			ConnectionsFailed: stats.ConnectionsFailed,
+			BytesSent:         sent,
+			BytesReceived:     received,
+			Traffic:           stats.Traffic,
+			EBPF:              stats.EBPF,
+		},
+		Certificates: stats.Certificates,
 	}
 	
 	var resp HeartbeatResponse
@@ -226,6 +543,56 @@ func (c *Client) SendHeartbeat(cfg *config.Config, stats SystemStats) error {
 	return nil
 }
 
+// UploadUsage sends closed usage records to the manager for chargeback
+func (c *Client) UploadUsage(records []metering.Record) error {
+	if c.Standalone() {
+		return fmt.Errorf("usage upload needs a manager, not available in standalone mode")
+	}
+
+	req := UsageRequest{
+		ProxyName:     c.proxyName,
+		ClusterAPIKey: c.apiKey,
+		Records:       records,
+	}
+
+	var resp UsageResponse
+	if err := c.makeRequest("POST", "/api/proxy/usage", req, &resp); err != nil {
+		return fmt.Errorf("usage upload failed: %w", err)
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("usage upload rejected: %s", resp.Error)
+	}
+
+	return nil
+}
+
+// ReportQuarantine tells the manager this proxy quarantined a source
+// service, so it quarantines the service on every proxy of the cluster
+func (c *Client) ReportQuarantine(serviceID int, reason string) error {
+	if c.Standalone() {
+		return fmt.Errorf("quarantine reports need a manager, not available in standalone mode")
+	}
+
+	req := QuarantineRequest{
+		ProxyName:     c.proxyName,
+		ClusterAPIKey: c.apiKey,
+		ServiceID:     serviceID,
+		Reason:        reason,
+	}
+
+	var resp QuarantineResponse
+	if err := c.makeRequest("POST", "/api/proxy/quarantine", req, &resp); err != nil {
+		return fmt.Errorf("quarantine report failed: %w", err)
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("quarantine report rejected: %s", resp.Error)
+	}
+
+	return nil
+}
+
 // StartConfigRefresh starts a goroutine that periodically refreshes configuration
 func (c *Client) StartConfigRefresh(ctx context.Context, cfg *config.Config, onConfigUpdate func(*ClusterConfig)) {
 	interval := time.Duration(cfg.ConfigUpdateInterval) * time.Second
@@ -247,15 +614,17 @@ func (c *Client) StartConfigRefresh(ctx context.Context, cfg *config.Config, onC
 			jitterDuration := time.Duration(rand.Int63n(int64(jitter)))
 			time.Sleep(jitterDuration)
 			
+			previousVersion := c.lastConfigHash
 			config, err := c.GetConfig()
 			if err != nil {
 				fmt.Printf("Failed to refresh configuration: %v\n", err)
 				continue
 			}
 			
-			// Check if configuration changed
-			if config.Version != c.lastConfigHash {
-				fmt.Printf("Configuration updated - old: %s, new: %s\n", c.lastConfigHash, config.Version)
+			// Check if configuration changed; GetConfig already recorded
+			// the new version
+			if config.Version != previousVersion {
+				fmt.Printf("Configuration updated - old: %s, new: %s\n", previousVersion, config.Version)
 				onConfigUpdate(config)
 			}
 		}
@@ -307,6 +676,7 @@ func (c *Client) makeRequest(method, endpoint string, reqBody interface{}, respB
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-API-Key", c.apiKey)
+	req.Header.Set("X-Proxy-Name", c.proxyName)
 	req.Header.Set("User-Agent", "MarchProxy-Proxy/"+getVersion())
 	
 	resp, err := c.httpClient.Do(req)
@@ -342,6 +712,19 @@ type SystemStats struct {
 	MemoryUsage       float64
 	ActiveConnections int
 	BytesTransferred  int64
+	Certificates      []certs.Entry
+
+	// Applied config version and connection outcomes since start, which
+	// the manager uses to judge canary config rollouts
+	ConfigVersion     string
+	ConnectionsClosed uint64
+	ConnectionsFailed uint64
+
+	// Snapshot of the eBPF statistics maps, nil without eBPF
+	EBPF *ebpfstats.Snapshot
+
+	// Relayed bytes by direction per mapping, service, tenant and path
+	Traffic []traffic.Entry
 }
 
 // GetSystemStats returns current system statistics
@@ -352,6 +735,7 @@ func GetSystemStats() SystemStats {
 	return SystemStats{
 		CPUUsage:    0.0, // TODO: Implement CPU usage calculation
 		MemoryUsage: float64(m.Sys) / 1024 / 1024, // MB
+		Certificates: certs.Default.Entries(),
 		// ActiveConnections and BytesTransferred would be populated by the proxy server
 	}
 }
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"marchproxy-egress/internal/config"
+)
+
+func TestRolloutProtocol(t *testing.T) {
+	var heartbeat HeartbeatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/config/3":
+			if r.Header.Get("X-Proxy-Name") != "egress-1" {
+				t.Errorf("Expected the proxy name header, got %q", r.Header.Get("X-Proxy-Name"))
+			}
+			w.Write([]byte(`{"cluster": {"id": 3}, "version": "b2", "rollout": {"id": 7, "state": "canary", "role": "canary", "version": "b2", "stable_version": "a1"}}`))
+		case "/api/proxy/heartbeat":
+			json.NewDecoder(r.Body).Decode(&heartbeat)
+			w.Write([]byte(`{"success": true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{ManagerURL: server.URL, ClusterAPIKey: "secret", ProxyName: "egress-1", ConnectionTimeout: 5}
+	client := NewClient(cfg)
+	client.clusterID = 3
+
+	if client.Rollout() != nil {
+		t.Fatal("Expected no rollout before the first config")
+	}
+	clusterConfig, err := client.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Rollout{ID: 7, State: "canary", Role: "canary", Version: "b2", StableVersion: "a1"}
+	if clusterConfig.Version != "b2" || client.Rollout() == nil || *client.Rollout() != want {
+		t.Fatalf("Unexpected rollout %+v", client.Rollout())
+	}
+
+	stats := SystemStats{ConfigVersion: "b2", ConnectionsClosed: 40, ConnectionsFailed: 2}
+	if err := client.SendHeartbeat(cfg, stats); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.ProxyName != "egress-1" || heartbeat.ClusterAPIKey != "secret" || heartbeat.ConfigVersion != "b2" {
+		t.Errorf("Unexpected heartbeat %+v", heartbeat)
+	}
+	if heartbeat.Metrics.ConnectionsClosed != 40 || heartbeat.Metrics.ConnectionsFailed != 2 {
+		t.Errorf("Expected the connection outcomes in the heartbeat, got %+v", heartbeat.Metrics)
+	}
+}
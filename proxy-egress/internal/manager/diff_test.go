@@ -0,0 +1,103 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"marchproxy-shared/schedule"
+)
+
+// TestDiffConfigs tests added, removed and changed resource detection
+func TestDiffConfigs(t *testing.T) {
+	previous := &ClusterConfig{
+		Version: "1",
+		Services: []Service{
+			{ID: 1, Name: "api", IPFQDN: "10.0.0.1", AuthToken: "old-token"},
+			{ID: 2, Name: "db", IPFQDN: "10.0.0.2"},
+		},
+		Mappings: []Mapping{
+			{ID: 10, Name: "api-to-db", Ports: "5432"},
+		},
+	}
+	current := &ClusterConfig{
+		Version: "2",
+		Services: []Service{
+			{ID: 1, Name: "api", IPFQDN: "10.0.0.1", AuthToken: "new-token"},
+			{ID: 3, Name: "cache", IPFQDN: "10.0.0.3"},
+		},
+		Mappings: []Mapping{
+			{ID: 10, Name: "api-to-db", Ports: "5432"},
+		},
+		Listeners: []Listener{
+			{ID: 5, Name: "alt", Port: 9090},
+		},
+	}
+
+	diff := DiffConfigs(previous, current)
+
+	if diff.FromVersion != "1" || diff.ToVersion != "2" {
+		t.Errorf("versions = %s -> %s, want 1 -> 2", diff.FromVersion, diff.ToVersion)
+	}
+	if !reflect.DeepEqual(diff.Services.Added, []ResourceRef{{ID: 3, Name: "cache"}}) {
+		t.Errorf("services added = %v", diff.Services.Added)
+	}
+	if !reflect.DeepEqual(diff.Services.Removed, []ResourceRef{{ID: 2, Name: "db"}}) {
+		t.Errorf("services removed = %v", diff.Services.Removed)
+	}
+	if len(diff.Services.Changed) != 1 || !reflect.DeepEqual(diff.Services.Changed[0].Fields, []string{"auth_token"}) {
+		t.Errorf("services changed = %v, want auth_token on service 1", diff.Services.Changed)
+	}
+	if len(diff.Mappings.Added)+len(diff.Mappings.Removed)+len(diff.Mappings.Changed) != 0 {
+		t.Errorf("mappings diff = %+v, want no changes", diff.Mappings)
+	}
+	if len(diff.Listeners.Added) != 1 {
+		t.Errorf("listeners added = %v, want 1", diff.Listeners.Added)
+	}
+	if got := diff.Summary(); got != "services +1 -1 ~1, mappings +0 -0 ~0, listeners +1 -0 ~0" {
+		t.Errorf("Summary() = %q", got)
+	}
+}
+
+// TestConfigHistory tests that each recorded config is diffed against the previous one
+func TestConfigHistory(t *testing.T) {
+	history := &ConfigHistory{}
+
+	first := history.Record(&ClusterConfig{Version: "1", Services: []Service{{ID: 1, Name: "api"}}})
+	if len(first.Services.Added) != 1 {
+		t.Errorf("initial record added = %v, want every service", first.Services.Added)
+	}
+
+	history.Record(&ClusterConfig{Version: "2"})
+	version, appliedAt, diff := history.Snapshot()
+	if version != "2" || appliedAt.IsZero() {
+		t.Errorf("Snapshot() version = %q applied = %v", version, appliedAt)
+	}
+	if diff.FromVersion != "1" || len(diff.Services.Removed) != 1 {
+		t.Errorf("Snapshot() diff = %+v, want service 1 removed since version 1", diff)
+	}
+}
+
+// TestScheduleStates tests the schedule state reported for scheduled mappings
+func TestScheduleStates(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	expiry := now.Add(time.Hour)
+	config := &ClusterConfig{
+		Mappings: []Mapping{
+			{ID: 1, Name: "always"},
+			{ID: 2, Name: "grant", Schedule: &schedule.Schedule{ValidUntil: &expiry}},
+			{ID: 3, Name: "broken", Schedule: &schedule.Schedule{Timezone: "Nowhere/Special"}},
+		},
+	}
+
+	states := ScheduleStates(config, now, 0)
+	if len(states) != 2 {
+		t.Fatalf("ScheduleStates() = %+v, want the 2 scheduled mappings", states)
+	}
+	if !states[0].Active || states[0].NextChange == nil || !states[0].NextChange.Equal(expiry) {
+		t.Errorf("grant state = %+v, want active until %v", states[0], expiry)
+	}
+	if states[1].Active || states[1].Error == "" {
+		t.Errorf("broken state = %+v, want inactive with an error", states[1])
+	}
+}
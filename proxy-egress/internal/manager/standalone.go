@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadClusterConfig reads a cluster configuration from a YAML or JSON file
+// for running without a manager. The file uses the same field names as the
+// manager's config API. Without a version the file's content hash is used,
+// so edits are picked up by the config refresh loop.
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read standalone config: %w", err)
+	}
+
+	// Decode through JSON so the manager's json field names apply
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse standalone config %s: %w", path, err)
+	}
+	jsonData, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse standalone config %s: %w", path, err)
+	}
+	var config ClusterConfig
+	if err := json.Unmarshal(jsonData, &config); err != nil {
+		return nil, fmt.Errorf("invalid standalone config %s: %w", path, err)
+	}
+
+	if config.Version == "" {
+		sum := sha256.Sum256(data)
+		config.Version = "file-" + hex.EncodeToString(sum[:6])
+	}
+	if config.GeneratedAt == "" {
+		if info, err := os.Stat(path); err == nil {
+			config.GeneratedAt = info.ModTime().UTC().Format(time.RFC3339)
+		}
+	}
+	if config.Cluster.Name == "" {
+		config.Cluster.Name = "standalone"
+	}
+	return &config, nil
+}
+
+// Standalone reports whether the client serves configuration from a local
+// file instead of the manager
+func (c *Client) Standalone() bool {
+	return c.standaloneConfig != ""
+}
+
+// standaloneLicense is the license status reported without a manager
+func standaloneLicense() *LicenseStatus {
+	return &LicenseStatus{
+		Edition:     "Community",
+		Valid:       true,
+		ClusterName: "standalone",
+		CanRegister: true,
+	}
+}
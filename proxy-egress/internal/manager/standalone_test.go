@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"marchproxy-egress/internal/config"
+)
+
+const standaloneYAML = `
+cluster:
+  id: 3
+  name: dev
+services:
+  - id: 1
+    name: client
+    ip_fqdn: 10.0.0.1
+    auth_type: base64
+    auth_token: secret
+  - id: 2
+    name: backend
+    ip_fqdn: 127.0.0.1
+mappings:
+  - id: 1
+    name: client-to-backend
+    source_services: [1]
+    dest_services: [2]
+    protocols: [tcp]
+    ports: "9000"
+    auth_required: true
+    fault_injection:
+      delay_ms: 20
+`
+
+func TestStandaloneConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster.yaml")
+	if err := os.WriteFile(path, []byte(standaloneYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(&config.Config{StandaloneConfig: path, ConnectionTimeout: 5})
+	if !client.Standalone() {
+		t.Fatal("Expected a standalone client")
+	}
+	if err := client.Register(&config.Config{}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if client.clusterID != 3 || client.clusterName != "dev" {
+		t.Errorf("Expected cluster 3 dev, got %d %s", client.clusterID, client.clusterName)
+	}
+	if status, err := client.GetLicenseStatus(); err != nil || !status.CanRegister {
+		t.Errorf("Expected a usable license status, got %+v, %v", status, err)
+	}
+
+	cfg, err := client.GetConfig()
+	if err != nil {
+		t.Fatalf("GetConfig failed: %v", err)
+	}
+	if len(cfg.Services) != 2 || cfg.Services[0].AuthToken != "secret" {
+		t.Errorf("Unexpected services %+v", cfg.Services)
+	}
+	if len(cfg.Mappings) != 1 || cfg.Mappings[0].Ports != "9000" || cfg.Mappings[0].FaultInjection == nil ||
+		cfg.Mappings[0].FaultInjection.DelayMs != 20 {
+		t.Errorf("Unexpected mappings %+v", cfg.Mappings)
+	}
+	firstVersion := cfg.Version
+	if firstVersion == "" {
+		t.Error("Expected a version derived from the file")
+	}
+
+	// Editing the file changes the version the refresh loop compares
+	if err := os.WriteFile(path, []byte(standaloneYAML+"\nlisteners: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = client.GetConfig(); err != nil || cfg.Version == firstVersion {
+		t.Errorf("Expected a new version after editing the file, got %q, %v", cfg.Version, err)
+	}
+
+	if _, _, err := client.SignCertificate(nil, 0); err == nil {
+		t.Error("Expected certificate issuance to need a manager")
+	}
+}
+
+func TestStandaloneConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadClusterConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+
+	path := filepath.Join(dir, "bad.yaml")
+	os.WriteFile(path, []byte("services: {id: [}"), 0o600)
+	if _, err := LoadClusterConfig(path); err == nil {
+		t.Error("Expected an error for invalid YAML")
+	}
+
+	os.WriteFile(path, []byte("services: 12"), 0o600)
+	if _, err := LoadClusterConfig(path); err == nil {
+		t.Error("Expected an error for a mistyped field")
+	}
+}
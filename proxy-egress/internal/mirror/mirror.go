@@ -0,0 +1,337 @@
+// Package mirror copies selected proxied flows to an IDS or capture target,
+// so Suricata or Zeek can inspect egress traffic without a separate tap.
+//
+// The proxy terminates both sides of a connection, so there are no original
+// packets to copy. Each mirrored flow is rebuilt as a TCP or UDP
+// conversation between the real client and destination, with a handshake,
+// sequence numbers and valid checksums, and sent to a Sink: a ring of pcap
+// files or a GRE/ERSPAN tunnel.
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueSize bounds frames waiting for the sink. Frames beyond it are
+// dropped rather than slowing the relay.
+const queueSize = 8192
+
+type packet struct {
+	ts    time.Time
+	frame []byte
+}
+
+// Mirror selects flows and feeds their frames to a sink
+type Mirror struct {
+	sink       Sink
+	sampleRate float64
+	queue      chan packet
+	done       chan struct{}
+
+	mu     sync.RWMutex // Guards closing the queue against senders
+	closed bool
+
+	flows   atomic.Int64
+	packets atomic.Int64
+	bytes   atomic.Int64
+	dropped atomic.Int64
+	errors  atomic.Int64
+}
+
+// New starts a mirror writing to sink. Flows are mirrored when their mapping
+// asks for it, and otherwise with probability sampleRate (0-1).
+func New(sink Sink, sampleRate float64) *Mirror {
+	m := &Mirror{
+		sink:       sink,
+		sampleRate: sampleRate,
+		queue:      make(chan packet, queueSize),
+		done:       make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// run writes queued frames to the sink, flushing buffered sinks when idle
+func (m *Mirror) run() {
+	defer close(m.done)
+	flusher, _ := m.sink.(interface{ Flush() error })
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p, ok := <-m.queue:
+			if !ok {
+				m.sink.Close()
+				return
+			}
+			if err := m.sink.WritePacket(p.ts, p.frame); err != nil {
+				m.errors.Add(1)
+			}
+		case <-ticker.C:
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// Close stops the mirror once queued frames are written
+func (m *Mirror) Close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+	<-m.done
+}
+
+// selected decides whether a new flow is mirrored
+func (m *Mirror) selected(mapping bool) bool {
+	if m == nil {
+		return false
+	}
+	return mapping || (m.sampleRate > 0 && rand.Float64() < m.sampleRate)
+}
+
+// enqueue hands a frame to the writer without blocking
+func (m *Mirror) enqueue(frame []byte) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.queue <- packet{ts: time.Now(), frame: frame}:
+		m.packets.Add(1)
+		m.bytes.Add(int64(len(frame)))
+	default:
+		m.dropped.Add(1)
+	}
+}
+
+// TCPFlow starts mirroring a TCP connection between client and server when
+// the mapping asks for it or the flow is sampled. It returns nil otherwise;
+// a nil Flow ignores all calls.
+func (m *Mirror) TCPFlow(mapping bool, client, server net.Addr) *Flow {
+	if !m.selected(mapping) {
+		return nil
+	}
+	f := newFlow(m, client, server, false)
+	if f == nil {
+		return nil
+	}
+	f.handshake()
+	return f
+}
+
+// UDPFlow starts mirroring datagrams between client and server, selected
+// like TCPFlow
+func (m *Mirror) UDPFlow(mapping bool, client, server net.Addr) *Flow {
+	if !m.selected(mapping) {
+		return nil
+	}
+	return newFlow(m, client, server, true)
+}
+
+// Flow rebuilds one proxied conversation as packets
+type Flow struct {
+	m      *Mirror
+	client netip.AddrPort
+	server netip.AddrPort
+	udp    bool
+
+	mu        sync.Mutex
+	clientSeq uint32
+	serverSeq uint32
+	ipID      uint16
+	closed    bool
+}
+
+func newFlow(m *Mirror, client, server net.Addr, udp bool) *Flow {
+	c, ok := addrPort(client)
+	s, ok2 := addrPort(server)
+	if !ok || !ok2 {
+		return nil
+	}
+	c = netip.AddrPortFrom(c.Addr().Unmap(), c.Port())
+	s = netip.AddrPortFrom(s.Addr().Unmap(), s.Port())
+	// A proxy can bridge IPv4 clients to IPv6 destinations; the rebuilt
+	// flow then uses IPv4-mapped addresses for both sides
+	if c.Addr().Is4() != s.Addr().Is4() {
+		c = netip.AddrPortFrom(netip.AddrFrom16(c.Addr().As16()), c.Port())
+		s = netip.AddrPortFrom(netip.AddrFrom16(s.Addr().As16()), s.Port())
+	}
+
+	m.flows.Add(1)
+	return &Flow{
+		m:         m,
+		client:    c,
+		server:    s,
+		udp:       udp,
+		clientSeq: rand.Uint32(),
+		serverSeq: rand.Uint32(),
+	}
+}
+
+// addrPort converts a TCP or UDP address
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort(), true
+	case *net.UDPAddr:
+		return a.AddrPort(), true
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		return ap, err == nil
+	}
+}
+
+// ClientData mirrors bytes sent by the client
+func (f *Flow) ClientData(b []byte) {
+	f.data(true, b)
+}
+
+// ServerData mirrors bytes sent by the server
+func (f *Flow) ServerData(b []byte) {
+	f.data(false, b)
+}
+
+// Reader returns r, copying everything read from it into the flow as sent
+// by the client or the server
+func (f *Flow) Reader(r io.Reader, fromClient bool) io.Reader {
+	if f == nil {
+		return r
+	}
+	return io.TeeReader(r, flowWriter{f: f, fromClient: fromClient})
+}
+
+type flowWriter struct {
+	f          *Flow
+	fromClient bool
+}
+
+func (w flowWriter) Write(b []byte) (int, error) {
+	w.f.data(w.fromClient, b)
+	return len(b), nil
+}
+
+// Close ends a TCP flow with a FIN exchange
+func (f *Flow) Close() {
+	if f == nil || f.udp {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.emit(true, tcpFIN|tcpACK, nil)
+	f.clientSeq++
+	f.emit(false, tcpFIN|tcpACK, nil)
+	f.serverSeq++
+	f.emit(true, tcpACK, nil)
+}
+
+// handshake emits the SYN, SYN-ACK and ACK that open a TCP flow
+func (f *Flow) handshake() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.emit(true, tcpSYN, nil)
+	f.clientSeq++
+	f.emit(false, tcpSYN|tcpACK, nil)
+	f.serverSeq++
+	f.emit(true, tcpACK, nil)
+}
+
+func (f *Flow) data(fromClient bool, b []byte) {
+	if f == nil || len(b) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxSegment {
+			n = maxSegment
+		}
+		if f.udp {
+			f.emitUDP(fromClient, b[:n])
+		} else {
+			f.emit(fromClient, tcpPSH|tcpACK, b[:n])
+			if fromClient {
+				f.clientSeq += uint32(n)
+			} else {
+				f.serverSeq += uint32(n)
+			}
+		}
+		b = b[n:]
+	}
+}
+
+// emit queues a TCP segment in one direction. The caller holds f.mu.
+func (f *Flow) emit(fromClient bool, flags byte, payload []byte) {
+	src, dst := f.client, f.server
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpSYN != 0 && flags&tcpACK == 0 {
+		ack = 0
+	}
+	f.ipID++
+	segment := tcpSegment(src, dst, seq, ack, flags, payload)
+	f.m.enqueue(frame(src.Addr(), dst.Addr(), protoTCP, segment, fromClient, f.ipID))
+}
+
+// emitUDP queues a datagram in one direction. The caller holds f.mu.
+func (f *Flow) emitUDP(fromClient bool, payload []byte) {
+	src, dst := f.client, f.server
+	if !fromClient {
+		src, dst = dst, src
+	}
+	f.ipID++
+	f.m.enqueue(frame(src.Addr(), dst.Addr(), protoUDP, udpDatagram(src, dst, payload), fromClient, f.ipID))
+}
+
+// WritePrometheus writes mirror counters in Prometheus text format
+func (m *Mirror) WritePrometheus(w io.Writer) {
+	if m == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_mirror_flows_total Total number of flows mirrored\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mirror_flows_total counter\n")
+	fmt.Fprintf(w, "marchproxy_mirror_flows_total %d\n", m.flows.Load())
+
+	fmt.Fprintf(w, "# HELP marchproxy_mirror_packets_total Total number of packets sent to the mirror target\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mirror_packets_total counter\n")
+	fmt.Fprintf(w, "marchproxy_mirror_packets_total %d\n", m.packets.Load())
+
+	fmt.Fprintf(w, "# HELP marchproxy_mirror_bytes_total Total bytes of frames sent to the mirror target\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mirror_bytes_total counter\n")
+	fmt.Fprintf(w, "marchproxy_mirror_bytes_total %d\n", m.bytes.Load())
+
+	fmt.Fprintf(w, "# HELP marchproxy_mirror_dropped_total Frames dropped because the mirror target fell behind\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mirror_dropped_total counter\n")
+	fmt.Fprintf(w, "marchproxy_mirror_dropped_total %d\n", m.dropped.Load())
+
+	fmt.Fprintf(w, "# HELP marchproxy_mirror_errors_total Frames the mirror target failed to write\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mirror_errors_total counter\n")
+	fmt.Fprintf(w, "marchproxy_mirror_errors_total %d\n", m.errors.Load())
+}
@@ -0,0 +1,193 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink collects frames for inspection
+type memorySink struct {
+	mu     sync.Mutex
+	frames [][]byte
+	closed bool
+}
+
+func (s *memorySink) WritePacket(ts time.Time, frame []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = append(s.frames, frame)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+// tcpFrame is the decoded part of a rebuilt IPv4 TCP frame
+type tcpFrame struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	payload          []byte
+}
+
+func parseTCPFrame(t *testing.T, frame []byte) tcpFrame {
+	t.Helper()
+	if binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+		t.Fatalf("Expected an IPv4 frame, got ethertype 0x%04x", binary.BigEndian.Uint16(frame[12:]))
+	}
+	ip := frame[14:34]
+	if fold(sum(0, ip)) != 0xffff {
+		t.Errorf("Invalid IPv4 header checksum")
+	}
+	segment := frame[34:]
+	if int(binary.BigEndian.Uint16(ip[2:])) != 20+len(segment) {
+		t.Errorf("IPv4 total length %d does not match segment length %d", binary.BigEndian.Uint16(ip[2:]), len(segment))
+	}
+	pseudo := append(append([]byte{}, ip[12:20]...), 0, protoTCP, byte(len(segment)>>8), byte(len(segment)))
+	if fold(sum(sum(0, pseudo), segment)) != 0xffff {
+		t.Errorf("Invalid TCP checksum")
+	}
+	return tcpFrame{
+		srcPort: binary.BigEndian.Uint16(segment[0:]),
+		dstPort: binary.BigEndian.Uint16(segment[2:]),
+		seq:     binary.BigEndian.Uint32(segment[4:]),
+		ack:     binary.BigEndian.Uint32(segment[8:]),
+		flags:   segment[13],
+		payload: segment[20:],
+	}
+}
+
+func TestTCPFlow(t *testing.T) {
+	sink := &memorySink{}
+	m := New(sink, 0)
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}
+	server := &net.TCPAddr{IP: net.ParseIP("198.51.100.20"), Port: 443}
+	flow := m.TCPFlow(true, client, server)
+	if flow == nil {
+		t.Fatal("Expected a flow for a mirrored mapping")
+	}
+
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	response := bytes.Repeat([]byte("x"), maxSegment+100)
+	flow.ClientData(request)
+	flow.ServerData(response)
+	flow.Close()
+	m.Close()
+
+	if !sink.closed {
+		t.Error("Expected the sink to be closed")
+	}
+	// Handshake, request, two response segments, FIN exchange
+	if len(sink.frames) != 3+1+2+3 {
+		t.Fatalf("Expected 9 frames, got %d", len(sink.frames))
+	}
+
+	var frames []tcpFrame
+	for _, frame := range sink.frames {
+		frames = append(frames, parseTCPFrame(t, frame))
+	}
+
+	syn, synAck := frames[0], frames[1]
+	if syn.flags != tcpSYN || synAck.flags != tcpSYN|tcpACK || synAck.ack != syn.seq+1 {
+		t.Errorf("Unexpected handshake %+v %+v", syn, synAck)
+	}
+	if syn.srcPort != 40000 || syn.dstPort != 443 || synAck.srcPort != 443 {
+		t.Errorf("Unexpected ports %d -> %d", syn.srcPort, syn.dstPort)
+	}
+
+	req := frames[3]
+	if !bytes.Equal(req.payload, request) || req.seq != syn.seq+1 || req.ack != synAck.seq+1 {
+		t.Errorf("Unexpected request segment %+v", req)
+	}
+	first, second := frames[4], frames[5]
+	if len(first.payload) != maxSegment || len(second.payload) != 100 || second.seq != first.seq+maxSegment {
+		t.Errorf("Response not segmented as expected: %d and %d bytes", len(first.payload), len(second.payload))
+	}
+	if first.ack != req.seq+uint32(len(request)) {
+		t.Errorf("Response does not acknowledge the request")
+	}
+
+	clientFin, serverFin, lastAck := frames[6], frames[7], frames[8]
+	if clientFin.flags != tcpFIN|tcpACK || serverFin.ack != clientFin.seq+1 || lastAck.ack != serverFin.seq+1 {
+		t.Errorf("Unexpected FIN exchange %+v %+v %+v", clientFin, serverFin, lastAck)
+	}
+}
+
+func TestSelection(t *testing.T) {
+	sink := &memorySink{}
+	m := New(sink, 0)
+	defer m.Close()
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}
+	server := &net.TCPAddr{IP: net.ParseIP("198.51.100.20"), Port: 443}
+	flow := m.TCPFlow(false, client, server)
+	if flow != nil {
+		t.Fatal("Expected no flow without a mirrored mapping or sampling")
+	}
+	// A nil flow ignores calls and leaves readers untouched
+	flow.ClientData([]byte("ignored"))
+	flow.Close()
+	reader := strings.NewReader("data")
+	if flow.Reader(reader, true) != reader {
+		t.Error("Expected a nil flow to return the reader")
+	}
+
+	var nilMirror *Mirror
+	if nilMirror.TCPFlow(true, client, server) != nil {
+		t.Error("Expected a nil mirror to select nothing")
+	}
+
+	sampled := New(&memorySink{}, 1)
+	defer sampled.Close()
+	if sampled.UDPFlow(false, client, server) == nil {
+		t.Error("Expected every flow to be sampled at rate 1")
+	}
+}
+
+func TestFileRing(t *testing.T) {
+	dir := t.TempDir()
+	ring, err := NewFileRing(dir, 400, 2)
+	if err != nil {
+		t.Fatalf("Failed to create ring: %v", err)
+	}
+
+	frame := make([]byte, 100)
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		if err := ring.WritePacket(ts.Add(time.Duration(i)*time.Second), frame); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	ring.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mirror-*.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files kept, got %d", len(files))
+	}
+	// Three records fit per file, so ten packets leave files of 3, 3, 3 and
+	// 1 records of which the last two are kept
+	sort.Strings(files)
+	for i, records := range []int{3, 1} {
+		data, err := os.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.LittleEndian.Uint32(data) != pcapMagic || binary.LittleEndian.Uint32(data[20:]) != linkTypeEthernet {
+			t.Errorf("%s has an invalid pcap header", files[i])
+		}
+		if len(data) != pcapHeaderLen+records*(recordLen+100) {
+			t.Errorf("%s has unexpected length %d", files[i], len(data))
+		}
+	}
+}
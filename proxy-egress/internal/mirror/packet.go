@@ -0,0 +1,128 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// The proxy terminates connections, so mirrored traffic is rebuilt as
+// Ethernet frames between the real client and destination. Fixed locally
+// administered MAC addresses mark the two sides.
+var (
+	clientMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	serverMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	// maxSegment keeps frames within a 1500 byte MTU once tunneled
+	maxSegment = 1400
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// frame wraps a transport segment in Ethernet and IP headers. fromClient
+// picks the MAC addresses.
+func frame(src, dst netip.Addr, proto byte, transport []byte, fromClient bool, ipID uint16) []byte {
+	srcMAC, dstMAC := clientMAC, serverMAC
+	if !fromClient {
+		srcMAC, dstMAC = serverMAC, clientMAC
+	}
+
+	out := make([]byte, 0, 14+40+len(transport))
+	out = append(out, dstMAC...)
+	out = append(out, srcMAC...)
+
+	if src.Is4() {
+		out = binary.BigEndian.AppendUint16(out, 0x0800)
+		start := len(out)
+		out = append(out, 0x45, 0)
+		out = binary.BigEndian.AppendUint16(out, uint16(20+len(transport)))
+		out = binary.BigEndian.AppendUint16(out, ipID)
+		out = append(out, 0x40, 0, 64, proto, 0, 0) // Don't fragment, TTL 64
+		s, d := src.As4(), dst.As4()
+		out = append(out, s[:]...)
+		out = append(out, d[:]...)
+		ip := out[start:]
+		binary.BigEndian.PutUint16(ip[10:], ^fold(sum(0, ip)))
+	} else {
+		out = binary.BigEndian.AppendUint16(out, 0x86dd)
+		out = append(out, 0x60, 0, 0, 0)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(transport)))
+		out = append(out, proto, 64)
+		s, d := src.As16(), dst.As16()
+		out = append(out, s[:]...)
+		out = append(out, d[:]...)
+	}
+	return append(out, transport...)
+}
+
+// tcpSegment builds a TCP header and payload with a valid checksum
+func tcpSegment(src, dst netip.AddrPort, seq, ack uint32, flags byte, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(b[0:], src.Port())
+	binary.BigEndian.PutUint16(b[2:], dst.Port())
+	binary.BigEndian.PutUint32(b[4:], seq)
+	binary.BigEndian.PutUint32(b[8:], ack)
+	b[12] = 5 << 4
+	b[13] = flags
+	binary.BigEndian.PutUint16(b[14:], 65535)
+	b = append(b, payload...)
+	binary.BigEndian.PutUint16(b[16:], transportChecksum(src.Addr(), dst.Addr(), protoTCP, b))
+	return b
+}
+
+// udpDatagram builds a UDP header and payload with a valid checksum
+func udpDatagram(src, dst netip.AddrPort, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:], src.Port())
+	binary.BigEndian.PutUint16(b[2:], dst.Port())
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(payload)))
+	b = append(b, payload...)
+	checksum := transportChecksum(src.Addr(), dst.Addr(), protoUDP, b)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:], checksum)
+	return b
+}
+
+// transportChecksum computes a TCP or UDP checksum including the IP
+// pseudo-header
+func transportChecksum(src, dst netip.Addr, proto byte, segment []byte) uint16 {
+	var s uint32
+	if src.Is4() {
+		a, b := src.As4(), dst.As4()
+		s = sum(s, a[:])
+		s = sum(s, b[:])
+	} else {
+		a, b := src.As16(), dst.As16()
+		s = sum(s, a[:])
+		s = sum(s, b[:])
+	}
+	s += uint32(proto) + uint32(len(segment))
+	return ^fold(sum(s, segment))
+}
+
+// sum adds b to a ones' complement running sum
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,53 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	pcapMagic        = 0xa1b23c4d // Nanosecond timestamps
+	pcapSnapLen      = 65535
+	linkTypeEthernet = 1
+
+	pcapHeaderLen = 24
+	recordLen     = 16
+)
+
+// PcapWriter writes frames in the classic pcap format read by Suricata,
+// Zeek, tcpdump and Wireshark
+type PcapWriter struct {
+	w io.Writer
+}
+
+// NewPcapWriter writes the file header for Ethernet frames and returns a
+// writer for them
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	return NewPcapWriterLinkType(w, linkTypeEthernet)
+}
+
+// NewPcapWriterLinkType writes the file header for another link-layer
+// header type, such as 113 for Linux cooked captures
+func NewPcapWriterLinkType(w io.Writer, linkType uint32) (*PcapWriter, error) {
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkType)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket writes one frame and returns the bytes written
+func (p *PcapWriter) WritePacket(ts time.Time, frame []byte) (int, error) {
+	record := make([]byte, recordLen, recordLen+len(frame))
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	return p.w.Write(append(record, frame...))
+}
@@ -0,0 +1,192 @@
+package mirror
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sink receives mirrored frames
+type Sink interface {
+	WritePacket(ts time.Time, frame []byte) error
+	Close() error
+}
+
+// FileRing writes pcap files to a directory, starting a new file once the
+// current one reaches maxBytes and deleting the oldest beyond count
+type FileRing struct {
+	dir      string
+	maxBytes int64
+	count    int
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	pcap    *PcapWriter
+	written int64
+}
+
+// NewFileRing creates the directory if needed
+func NewFileRing(dir string, maxBytes int64, count int) (*FileRing, error) {
+	if maxBytes <= pcapHeaderLen || count < 1 {
+		return nil, fmt.Errorf("invalid pcap ring size")
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create mirror directory: %w", err)
+	}
+	return &FileRing{dir: dir, maxBytes: maxBytes, count: count}, nil
+}
+
+// WritePacket appends a frame to the current file, rotating first if full
+func (r *FileRing) WritePacket(ts time.Time, frame []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil || r.written+recordLen+int64(len(frame)) > r.maxBytes {
+		if err := r.rotate(ts); err != nil {
+			return err
+		}
+	}
+	n, err := r.pcap.WritePacket(ts, frame)
+	r.written += int64(n)
+	return err
+}
+
+// rotate closes the current file, opens the next and prunes old files
+func (r *FileRing) rotate(ts time.Time) error {
+	r.closeFile()
+
+	name := filepath.Join(r.dir, fmt.Sprintf("mirror-%s.pcap", ts.UTC().Format("20060102T150405.000000000")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create pcap file: %w", err)
+	}
+	r.file = file
+	r.buf = bufio.NewWriterSize(file, 64*1024)
+	if r.pcap, err = NewPcapWriter(r.buf); err != nil {
+		r.closeFile()
+		return err
+	}
+	r.written = pcapHeaderLen
+
+	files, err := filepath.Glob(filepath.Join(r.dir, "mirror-*.pcap"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	for len(files) > r.count {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+// Flush writes buffered frames to the current file
+func (r *FileRing) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buf == nil {
+		return nil
+	}
+	return r.buf.Flush()
+}
+
+func (r *FileRing) closeFile() {
+	if r.file == nil {
+		return
+	}
+	r.buf.Flush()
+	r.file.Close()
+	r.file, r.buf, r.pcap = nil, nil, nil
+}
+
+// Close flushes and closes the current file
+func (r *FileRing) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeFile()
+	return nil
+}
+
+// GRE tunnel payload types
+const (
+	greTransparentEthernet = 0x6558
+	greERSPAN              = 0x88be
+)
+
+// Tunnel sends frames to a collector over GRE, either as plain transparent
+// Ethernet bridging or as ERSPAN type II with a session ID
+type Tunnel struct {
+	conn    net.Conn
+	erspan  bool
+	session uint16
+
+	mu  sync.Mutex
+	seq uint32
+}
+
+// NewGRETunnel sends frames to target over GRE (transparent Ethernet
+// bridging, as received by a Linux gretap interface)
+func NewGRETunnel(target string) (*Tunnel, error) {
+	return newTunnel(target, false, 0)
+}
+
+// NewERSPANTunnel sends frames to target as ERSPAN type II with the given
+// session ID (1-1023)
+func NewERSPANTunnel(target string, session int) (*Tunnel, error) {
+	if session < 1 || session > 1023 {
+		return nil, fmt.Errorf("ERSPAN session must be 1-1023")
+	}
+	return newTunnel(target, true, uint16(session))
+}
+
+func newTunnel(target string, erspan bool, session uint16) (*Tunnel, error) {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid tunnel target %q, expected an IP address", target)
+	}
+	network := "ip6:gre"
+	if ip.To4() != nil {
+		network = "ip4:gre"
+	}
+	// Raw sockets need CAP_NET_RAW
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GRE socket to %s: %w", target, err)
+	}
+	return &Tunnel{conn: conn, erspan: erspan, session: session}, nil
+}
+
+// WritePacket encapsulates and sends one frame
+func (t *Tunnel) WritePacket(ts time.Time, frame []byte) error {
+	var header []byte
+	if t.erspan {
+		t.mu.Lock()
+		t.seq++
+		seq := t.seq
+		t.mu.Unlock()
+
+		header = make([]byte, 16)
+		binary.BigEndian.PutUint16(header[0:], 0x1000) // Sequence number present
+		binary.BigEndian.PutUint16(header[2:], greERSPAN)
+		binary.BigEndian.PutUint32(header[4:], seq)
+		binary.BigEndian.PutUint32(header[8:], 1<<28|uint32(t.session)) // Version 1 (type II), no VLAN
+		// Reserved and port index stay zero
+	} else {
+		header = make([]byte, 4)
+		binary.BigEndian.PutUint16(header[2:], greTransparentEthernet)
+	}
+	_, err := t.conn.Write(append(header, frame...))
+	return err
+}
+
+// Close closes the GRE socket
+func (t *Tunnel) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,230 @@
+// Package muxconn adapts one stream of a multiplexed transport, such as an
+// HTTP/2 CONNECT stream, to a net.Conn, so it can be relayed and handed to
+// code written for TCP connections.
+//
+// HTTP/2 read deadlines reset the stream when they expire, while relays
+// set them to poll for idleness and expect the connection to survive. Conn
+// reads through a pump goroutine instead, so an expired read deadline only
+// fails the pending Read with os.ErrDeadlineExceeded.
+package muxconn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// chunkSize is the size of the pump's read buffers
+const chunkSize = 32 * 1024
+
+// Stream is the stream a Conn reads and writes
+type Stream struct {
+	Reader io.ReadCloser // Bytes from the peer, closed by Conn.Close and read until it ends
+	Writer io.Writer     // Bytes to the peer
+
+	// Flush sends buffered writes, called after each Write. Nil when writes
+	// aren't buffered.
+	Flush func() error
+
+	// SetWriteDeadline bounds writes. Nil when the stream has no write
+	// deadlines, in which case SetWriteDeadline is a no-op.
+	SetWriteDeadline func(time.Time) error
+
+	// Close ends the stream once Reader is closed, nil when closing Reader
+	// is enough
+	Close func() error
+
+	LocalAddr, RemoteAddr net.Addr
+}
+
+// Conn is a net.Conn over a Stream
+type Conn struct {
+	stream Stream
+
+	chunks  chan []byte // Filled by the pump, closed when the reader ends
+	readErr error       // Set by the pump before closing chunks
+	pending []byte      // Rest of the chunk being read
+	reading error       // Sticky error of Read
+	readDL  deadline
+
+	writeMu sync.Mutex // Held during writes, so Close can wait for them
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// New starts reading the stream and returns it as a Conn
+func New(stream Stream) *Conn {
+	c := &Conn{
+		stream: stream,
+		chunks: make(chan []byte),
+		closed: make(chan struct{}),
+	}
+	c.readDL.cancel = make(chan struct{})
+	go c.pump()
+	return c
+}
+
+// pump reads the stream into two alternating buffers: Read holds at most
+// one of them while the other is filled. After Close it discards what is
+// left until the reader ends, so a stream the peer is still finishing
+// isn't cut short.
+func (c *Conn) pump() {
+	defer close(c.chunks)
+	buffers := [2][]byte{make([]byte, chunkSize), make([]byte, chunkSize)}
+	for i := 0; ; i ^= 1 {
+		n, err := c.stream.Reader.Read(buffers[i])
+		if n > 0 {
+			select {
+			case c.chunks <- buffers[i][:n]:
+			case <-c.closed:
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+// Read reads from the stream until the read deadline
+func (c *Conn) Read(b []byte) (int, error) {
+	if isClosed(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if len(c.pending) == 0 {
+		if c.reading != nil {
+			return 0, c.reading
+		}
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				c.reading = c.readErr
+				return 0, c.reading
+			}
+			c.pending = chunk
+		case <-c.readDL.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write writes to the stream and flushes it
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	n, err := c.stream.Writer.Write(b)
+	if err == nil && c.stream.Flush != nil {
+		err = c.stream.Flush()
+	}
+	return n, err
+}
+
+// Close ends the stream. A write blocked on flow control is cut short with
+// the write deadline, so no write outlives Close.
+func (c *Conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		if !c.writeMu.TryLock() {
+			if c.stream.SetWriteDeadline != nil {
+				c.stream.SetWriteDeadline(time.Now())
+			}
+			c.writeMu.Lock()
+		}
+		c.writeMu.Unlock()
+
+		err = c.stream.Reader.Close()
+		if c.stream.Close != nil {
+			if closeErr := c.stream.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.stream.LocalAddr }
+func (c *Conn) RemoteAddr() net.Addr { return c.stream.RemoteAddr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDL.set(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDL.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.stream.SetWriteDeadline == nil {
+		return nil
+	}
+	return c.stream.SetWriteDeadline(t)
+}
+
+// deadline is a channel closed when a deadline expires, as in net.Pipe
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+// set arms the deadline at t, disarming it when t is zero
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // The timer fired, wait for it to close cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(wait, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns the channel closed when the deadline expires
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
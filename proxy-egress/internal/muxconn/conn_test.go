@@ -0,0 +1,84 @@
+package muxconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeStream returns a Conn over pipes, and the peer's ends of them
+func pipeStream(setWriteDeadline func(time.Time) error) (*Conn, io.WriteCloser, io.ReadCloser) {
+	fromPeer, peerWriter := io.Pipe()
+	peerReader, toPeer := io.Pipe()
+	conn := New(Stream{
+		Reader:           fromPeer,
+		Writer:           toPeer,
+		SetWriteDeadline: setWriteDeadline,
+		Close:            toPeer.Close,
+	})
+	return conn, peerWriter, peerReader
+}
+
+func TestReadDeadlineKeepsStream(t *testing.T) {
+	conn, peerWriter, _ := pipeStream(nil)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 16)
+	_, err := conn.Read(buf)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Read = %v, want a timeout", err)
+	}
+
+	// The stream survives the expired deadline
+	conn.SetReadDeadline(time.Time{})
+	go io.WriteString(peerWriter, "hello")
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+
+	peerWriter.Close()
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("Read = %v, want EOF", err)
+	}
+}
+
+func TestWriteAndClose(t *testing.T) {
+	var conn *Conn
+	var peerReader io.ReadCloser
+	conn, _, peerReader = pipeStream(func(time.Time) error {
+		// Cut the blocked write short, as an HTTP/2 write deadline resets
+		// the stream
+		peerReader.Close()
+		return nil
+	})
+
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(peerReader, buf)
+	}()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the next write, Close must not wait for it forever
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("blocked"))
+		written <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	if err := <-written; err == nil {
+		t.Error("Expected the blocked write to fail")
+	}
+	if _, err := conn.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected Read after Close to fail")
+	}
+}
@@ -8,9 +8,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/config"
-	"github.com/penguintech/marchproxy/internal/logging"
-	"github.com/penguintech/marchproxy/internal/monitoring"
+	"marchproxy-egress/internal/config"
+	"marchproxy-egress/internal/logging"
+	"marchproxy-egress/internal/monitoring"
+	"marchproxy-shared/netutil"
 )
 
 // Server represents the main proxy server
@@ -52,8 +53,8 @@ func (s *Server) Start(ctx context.Context) error {
 		"worker_threads", s.config.WorkerThreads,
 	)
 	
-	// Create TCP listener
-	listener, err := net.Listen("tcp", s.config.GetListenAddress())
+	// Create TCP listener, or a unix socket listener for listen_socket
+	listener, err := netutil.ListenStream(s.config.GetListenAddress(), s.config.BindInterface, s.config.GetListenSocketMode())
 	if err != nil {
 		return fmt.Errorf("failed to create listener: %w", err)
 	}
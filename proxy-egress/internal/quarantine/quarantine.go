@@ -0,0 +1,253 @@
+// Package quarantine puts source services that keep tripping the WAF or
+// the anomaly detector under a stricter policy. A proxy that flags a
+// service often enough quarantines it locally and reports it to the
+// manager, which distributes the quarantine to every proxy of the cluster
+// until an operator releases it.
+package quarantine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons a quarantined service's connection is refused
+const (
+	RefusedBlocked     = "quarantined"
+	RefusedRateLimited = "quarantine_rate_limited"
+)
+
+// Policy applies to every quarantined service of a cluster
+type Policy struct {
+	ConnectionsPerSecond float64 `json:"connections_per_second,omitempty"` // New connections or datagrams per service, 0 = unchanged
+	Block                bool    `json:"block,omitempty"`                  // Refuse the service's connections outright
+	Log                  bool    `json:"log,omitempty"`                    // Log every connection of the service
+}
+
+// Entry is one quarantined service
+type Entry struct {
+	ServiceID int       `json:"service_id"`
+	Reason    string    `json:"reason"`
+	Since     time.Time `json:"since"`
+	Local     bool      `json:"local,omitempty"` // Flagged by this proxy, not yet listed by the manager
+}
+
+// Config is the quarantine state the manager sends in the cluster config
+type Config struct {
+	Policy   Policy  `json:"policy"`
+	Services []Entry `json:"services,omitempty"`
+}
+
+// state is a quarantined service and its connection rate bucket
+type state struct {
+	Entry
+	tokens float64
+	filled time.Time
+}
+
+// Tracker counts flags per service and enforces the quarantine policy
+type Tracker struct {
+	threshold int
+	window    time.Duration
+	report    func(serviceID int, reason string)
+
+	policy   Policy
+	services map[int]*state
+	flags    map[int][]time.Time
+	refused  map[string]uint64
+	mu       sync.Mutex
+
+	now func() time.Time
+}
+
+// NewTracker creates a tracker quarantining a service once it is flagged
+// threshold times within window; 0 never quarantines automatically.
+// report is called in its own goroutine for each service quarantined here.
+func NewTracker(threshold int, window time.Duration, report func(serviceID int, reason string)) *Tracker {
+	return &Tracker{
+		threshold: threshold,
+		window:    window,
+		report:    report,
+		services:  make(map[int]*state),
+		flags:     make(map[int][]time.Time),
+		refused:   make(map[string]uint64),
+		now:       time.Now,
+	}
+}
+
+// Flag counts one WAF or anomaly flag against a source service. It returns
+// true when the flag quarantined the service.
+func (t *Tracker) Flag(serviceID int, reason string) bool {
+	if t == nil || t.threshold <= 0 || serviceID <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	if _, ok := t.services[serviceID]; ok {
+		t.mu.Unlock()
+		return false
+	}
+	now := t.now()
+	recent := t.flags[serviceID][:0]
+	for _, at := range t.flags[serviceID] {
+		if now.Sub(at) < t.window {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < t.threshold {
+		t.flags[serviceID] = recent
+		t.mu.Unlock()
+		return false
+	}
+
+	delete(t.flags, serviceID)
+	reason = fmt.Sprintf("%s, flagged %d times in %s", reason, len(recent), t.window)
+	t.services[serviceID] = t.newState(Entry{ServiceID: serviceID, Reason: reason, Since: now, Local: true})
+	t.mu.Unlock()
+
+	if t.report != nil {
+		go t.report(serviceID, reason)
+	}
+	return true
+}
+
+// Update applies the manager's quarantine config. Services it lists are
+// quarantined; services it stopped listing were released by an operator.
+// Local quarantines stay until the manager lists them.
+func (t *Tracker) Update(config Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.policy.ConnectionsPerSecond != config.Policy.ConnectionsPerSecond {
+		for _, s := range t.services {
+			s.tokens = burst(config.Policy.ConnectionsPerSecond)
+			s.filled = t.now()
+		}
+	}
+	t.policy = config.Policy
+
+	listed := make(map[int]bool, len(config.Services))
+	for _, e := range config.Services {
+		listed[e.ServiceID] = true
+		e.Local = false
+		if s, ok := t.services[e.ServiceID]; ok {
+			s.Entry = e
+			continue
+		}
+		t.services[e.ServiceID] = t.newState(e)
+	}
+	for id, s := range t.services {
+		if !listed[id] && !s.Local {
+			delete(t.services, id)
+		}
+	}
+}
+
+// Release lifts a quarantine on this proxy, returning false if the service
+// isn't quarantined. The manager's quarantines return with the next config
+// refresh unless they are released there.
+func (t *Tracker) Release(serviceID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.services[serviceID]; !ok {
+		return false
+	}
+	delete(t.services, serviceID)
+	delete(t.flags, serviceID)
+	return true
+}
+
+// Check admits a new connection or datagram of an authenticated service.
+// It returns the service's quarantine, nil when it isn't quarantined, and
+// the reason the connection is refused, empty when it is admitted.
+func (t *Tracker) Check(serviceID int) (*Entry, string) {
+	if t == nil {
+		return nil, ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.services[serviceID]
+	if !ok {
+		return nil, ""
+	}
+	entry := s.Entry
+	if t.policy.Block {
+		t.refused[RefusedBlocked]++
+		return &entry, RefusedBlocked
+	}
+	if !t.take(s) {
+		t.refused[RefusedRateLimited]++
+		return &entry, RefusedRateLimited
+	}
+	return &entry, ""
+}
+
+// Policy returns the applied quarantine policy
+func (t *Tracker) Policy() Policy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.policy
+}
+
+// List returns the quarantined services sorted by ID
+func (t *Tracker) List() []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]Entry, 0, len(t.services))
+	for _, s := range t.services {
+		entries = append(entries, s.Entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ServiceID < entries[j].ServiceID })
+	return entries
+}
+
+// WritePrometheus writes the quarantined services and refused connections
+// in Prometheus text format
+func (t *Tracker) WritePrometheus(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP marchproxy_quarantined_services Source services under the quarantine policy\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_quarantined_services gauge\n")
+	fmt.Fprintf(w, "marchproxy_quarantined_services %d\n", len(t.services))
+	fmt.Fprintf(w, "# HELP marchproxy_quarantine_refused_total Connections of quarantined services refused per reason\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_quarantine_refused_total counter\n")
+	for _, reason := range []string{RefusedBlocked, RefusedRateLimited} {
+		fmt.Fprintf(w, "marchproxy_quarantine_refused_total{reason=\"%s\"} %d\n", reason, t.refused[reason])
+	}
+}
+
+// newState starts a quarantine with a full bucket. t.mu must be held.
+func (t *Tracker) newState(e Entry) *state {
+	return &state{Entry: e, tokens: burst(t.policy.ConnectionsPerSecond), filled: t.now()}
+}
+
+// take takes a connection token from the service's bucket. t.mu must be
+// held.
+func (t *Tracker) take(s *state) bool {
+	rate := t.policy.ConnectionsPerSecond
+	if rate <= 0 {
+		return true
+	}
+
+	now := t.now()
+	s.tokens = min(s.tokens+now.Sub(s.filled).Seconds()*rate, burst(rate))
+	s.filled = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// burst is the bucket size for a connection rate, one second of connections
+func burst(rate float64) float64 {
+	return max(rate, 1)
+}
@@ -0,0 +1,121 @@
+package quarantine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTracker returns a tracker on a fake clock, reporting quarantined
+// services on the returned channel
+func newTestTracker(threshold int) (*Tracker, *time.Time, chan int) {
+	now := time.Unix(1700000000, 0)
+	reported := make(chan int, 10)
+	tr := NewTracker(threshold, time.Minute, func(serviceID int, reason string) {
+		reported <- serviceID
+	})
+	tr.now = func() time.Time { return now }
+	return tr, &now, reported
+}
+
+func TestFlagThreshold(t *testing.T) {
+	tr, now, reported := newTestTracker(3)
+
+	tr.Flag(7, "waf")
+	tr.Flag(7, "waf")
+	*now = now.Add(2 * time.Minute)
+	if tr.Flag(7, "waf") {
+		t.Fatal("Expected flags outside the window not to count")
+	}
+	tr.Flag(7, "anomaly")
+	if !tr.Flag(7, "anomaly") {
+		t.Fatal("Expected the third flag within the window to quarantine the service")
+	}
+	if tr.Flag(7, "anomaly") {
+		t.Error("Expected a quarantined service not to be quarantined again")
+	}
+
+	select {
+	case id := <-reported:
+		if id != 7 {
+			t.Errorf("Expected service 7 reported, got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the quarantine to be reported to the manager")
+	}
+
+	entries := tr.List()
+	if len(entries) != 1 || !entries[0].Local || !strings.HasPrefix(entries[0].Reason, "anomaly") {
+		t.Errorf("Unexpected quarantine %+v", entries)
+	}
+	if entry, refused := tr.Check(7); entry == nil || refused != "" {
+		t.Errorf("Expected service 7 quarantined and admitted without a policy, got %v %q", entry, refused)
+	}
+	if entry, _ := tr.Check(8); entry != nil {
+		t.Errorf("Expected service 8 not quarantined, got %+v", entry)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	tr, now, _ := newTestTracker(0)
+	tr.Update(Config{
+		Policy:   Policy{ConnectionsPerSecond: 2},
+		Services: []Entry{{ServiceID: 3, Reason: "waf"}},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, refused := tr.Check(3); refused != "" {
+			t.Fatalf("Expected connection %d admitted, got %s", i+1, refused)
+		}
+	}
+	if _, refused := tr.Check(3); refused != RefusedRateLimited {
+		t.Errorf("Expected the third connection rate limited, got %q", refused)
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if _, refused := tr.Check(3); refused != "" {
+		t.Errorf("Expected a refilled token to admit a connection, got %s", refused)
+	}
+
+	tr.Update(Config{Policy: Policy{Block: true}, Services: []Entry{{ServiceID: 3}}})
+	if _, refused := tr.Check(3); refused != RefusedBlocked {
+		t.Errorf("Expected the blocking policy to refuse, got %q", refused)
+	}
+
+	var b bytes.Buffer
+	tr.WritePrometheus(&b)
+	for _, want := range []string{
+		"marchproxy_quarantined_services 1",
+		`marchproxy_quarantine_refused_total{reason="quarantined"} 1`,
+		`marchproxy_quarantine_refused_total{reason="quarantine_rate_limited"} 1`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected %q in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestUpdateAndRelease(t *testing.T) {
+	tr, _, _ := newTestTracker(1)
+	tr.Flag(1, "waf")
+	tr.Update(Config{Services: []Entry{{ServiceID: 2, Reason: "waf"}}})
+
+	// The local quarantine waits for the manager; the manager's one applies
+	if len(tr.List()) != 2 {
+		t.Fatalf("Expected local and manager quarantines, got %+v", tr.List())
+	}
+
+	// Once the manager lists a service, dropping it from the list releases it
+	tr.Update(Config{Services: []Entry{{ServiceID: 1}, {ServiceID: 2}}})
+	tr.Update(Config{Services: []Entry{{ServiceID: 2}}})
+	if entries := tr.List(); len(entries) != 1 || entries[0].ServiceID != 2 {
+		t.Errorf("Expected only service 2 quarantined, got %+v", entries)
+	}
+
+	if !tr.Release(2) || tr.Release(2) {
+		t.Error("Expected Release to succeed once")
+	}
+	if entry, _ := tr.Check(2); entry != nil {
+		t.Errorf("Expected service 2 released, got %+v", entry)
+	}
+}
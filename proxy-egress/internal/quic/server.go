@@ -17,7 +17,8 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/certs"
+	"marchproxy-egress/internal/manager"
 )
 
 // QUICServer handles QUIC/HTTP3 connections and multiplexing
@@ -292,6 +293,7 @@ func (qs *QUICServer) initializeTLS() error {
 		if err != nil {
 			return fmt.Errorf("failed to load certificate: %w", err)
 		}
+		certs.Default.AddKeyPair("quic", certs.RoleServer, qs.config.CertFile, &cert)
 		qs.tlsConfig.Certificates = []tls.Certificate{cert}
 	} else {
 		// Generate self-signed certificate for development
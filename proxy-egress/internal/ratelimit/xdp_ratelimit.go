@@ -3,6 +3,7 @@
 package ratelimit
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -315,8 +316,9 @@ func (rl *XDPRateLimiter) GetIPState(ip net.IP) (*IPRateState, error) {
 		return nil, fmt.Errorf("only IPv4 addresses supported")
 	}
 
-	// Convert IP to uint32 (network byte order)
-	key := uint32(ipv4[0])<<24 | uint32(ipv4[1])<<16 | uint32(ipv4[2])<<8 | uint32(ipv4[3])
+	// The map is keyed by ip->saddr as read from the packet, so the key's
+	// bytes in memory are the address bytes in order
+	key := binary.NativeEndian.Uint32(ipv4)
 
 	var state IPRateState
 	ret := C.bpf_map_lookup_elem(C.int(rl.stateMapFD), unsafe.Pointer(&key), unsafe.Pointer(&state))
@@ -341,8 +343,9 @@ func (rl *XDPRateLimiter) ClearIPState(ip net.IP) error {
 		return fmt.Errorf("only IPv4 addresses supported")
 	}
 
-	// Convert IP to uint32 (network byte order)
-	key := uint32(ipv4[0])<<24 | uint32(ipv4[1])<<16 | uint32(ipv4[2])<<8 | uint32(ipv4[3])
+	// The map is keyed by ip->saddr as read from the packet, so the key's
+	// bytes in memory are the address bytes in order
+	key := binary.NativeEndian.Uint32(ipv4)
 
 	ret := C.bpf_map_delete_elem(C.int(rl.stateMapFD), unsafe.Pointer(&key))
 	if ret != 0 {
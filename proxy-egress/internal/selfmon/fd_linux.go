@@ -0,0 +1,21 @@
+package selfmon
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of open file descriptors and the soft limit
+func openFDs() (int, int) {
+	fds := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		// One of them is the directory being read
+		fds = len(entries) - 1
+	}
+	limit := -1
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil && rlimit.Cur <= 1<<31 {
+		limit = int(rlimit.Cur)
+	}
+	return fds, limit
+}
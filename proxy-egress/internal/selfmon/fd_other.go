@@ -0,0 +1,8 @@
+//go:build !linux
+
+package selfmon
+
+// openFDs is only implemented on Linux
+func openFDs() (int, int) {
+	return -1, -1
+}
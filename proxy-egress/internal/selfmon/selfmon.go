@@ -0,0 +1,225 @@
+// Package selfmon periodically samples the proxy's own goroutine count,
+// heap size and open file descriptors, and warns when they cross their
+// thresholds or when goroutines keep growing while connections do not,
+// which is how relays stuck on unresponsive backends show up in soak tests.
+package selfmon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Resources that can raise alerts
+const (
+	ResourceGoroutines    = "goroutines"
+	ResourceHeap          = "heap"
+	ResourceFDs           = "fds"
+	ResourceGoroutineLeak = "goroutine_leak"
+)
+
+// LeakSamples is the number of samples in which goroutines grew while
+// connections did not, with no drop in goroutines in between, before a
+// leak is reported
+const LeakSamples = 10
+
+// Thresholds above which a warning is logged. Zero disables a check.
+type Thresholds struct {
+	Goroutines int
+	HeapBytes  uint64
+	FDPercent  float64 // 0-100, share of the open file limit
+}
+
+// Sample is one reading of the process resources
+type Sample struct {
+	Time        time.Time `json:"time"`
+	Goroutines  int       `json:"goroutines"`
+	HeapBytes   uint64    `json:"heap_bytes"`
+	HeapObjects uint64    `json:"heap_objects"`
+	FDs         int       `json:"fds"`      // -1 when unknown
+	FDLimit     int       `json:"fd_limit"` // -1 when unknown
+	Connections int64     `json:"connections"`
+}
+
+// Monitor samples the process resources and tracks alerts
+type Monitor struct {
+	interval    time.Duration
+	thresholds  Thresholds
+	connections func() int64
+	sample      func() Sample
+
+	mu     sync.Mutex
+	last   Sample
+	over   map[string]bool
+	alerts map[string]uint64
+	growth int    // consecutive samples of goroutine growth
+	base   Sample // sample the current growth started from
+}
+
+// New creates a monitor. connections reports the active connection count
+// used for leak detection and may be nil.
+func New(interval time.Duration, thresholds Thresholds, connections func() int64) *Monitor {
+	if connections == nil {
+		connections = func() int64 { return 0 }
+	}
+	m := &Monitor{
+		interval:    interval,
+		thresholds:  thresholds,
+		connections: connections,
+		over:        make(map[string]bool),
+		alerts:      make(map[string]uint64),
+	}
+	m.sample = m.read
+	return m
+}
+
+// Run samples every interval until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	if m.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	m.Check()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// read takes a sample of the running process
+func (m *Monitor) read() Sample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fds, limit := openFDs()
+	return Sample{
+		Time:        time.Now(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapBytes:   mem.HeapAlloc,
+		HeapObjects: mem.HeapObjects,
+		FDs:         fds,
+		FDLimit:     limit,
+		Connections: m.connections(),
+	}
+}
+
+// Check takes a sample, logs threshold crossings and returns the sample
+func (m *Monitor) Check() Sample {
+	s := m.sample()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.thresholds
+	m.update(ResourceGoroutines, t.Goroutines > 0 && s.Goroutines > t.Goroutines,
+		fmt.Sprintf("%d goroutines, threshold %d", s.Goroutines, t.Goroutines))
+	m.update(ResourceHeap, t.HeapBytes > 0 && s.HeapBytes > t.HeapBytes,
+		fmt.Sprintf("heap %d MB, threshold %d MB", s.HeapBytes>>20, t.HeapBytes>>20))
+	fdPercent := 0.0
+	if s.FDs >= 0 && s.FDLimit > 0 {
+		fdPercent = float64(s.FDs) * 100 / float64(s.FDLimit)
+	}
+	m.update(ResourceFDs, t.FDPercent > 0 && fdPercent > t.FDPercent,
+		fmt.Sprintf("%d of %d file descriptors open (%.0f%%), threshold %.0f%%", s.FDs, s.FDLimit, fdPercent, t.FDPercent))
+
+	// Goroutines that keep growing while connections do not are leaking
+	if !m.last.Time.IsZero() && s.Goroutines > m.last.Goroutines && s.Connections <= m.last.Connections {
+		if m.growth == 0 {
+			m.base = m.last
+		}
+		m.growth++
+	} else if !m.last.Time.IsZero() && s.Goroutines < m.last.Goroutines {
+		m.growth = 0
+	}
+	m.update(ResourceGoroutineLeak, m.growth >= LeakSamples,
+		fmt.Sprintf("goroutines grew from %d to %d over %d samples while connections went from %d to %d, see /debug/goroutines",
+			m.base.Goroutines, s.Goroutines, m.growth, m.base.Connections, s.Connections))
+
+	m.last = s
+	return s
+}
+
+// update records whether a resource is over its threshold, logging and
+// counting an alert when it crosses it and a recovery when it drops back
+func (m *Monitor) update(resource string, over bool, detail string) {
+	switch {
+	case over && !m.over[resource]:
+		m.alerts[resource]++
+		fmt.Printf("WARNING: self-monitor: %s\n", detail)
+	case !over && m.over[resource]:
+		fmt.Printf("Self-monitor: %s recovered\n", resource)
+	}
+	m.over[resource] = over
+}
+
+// Last returns the most recent sample
+func (m *Monitor) Last() Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// Alerts returns the number of alerts raised per resource
+func (m *Monitor) Alerts() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := make(map[string]uint64, len(m.alerts))
+	for resource, n := range m.alerts {
+		alerts[resource] = n
+	}
+	return alerts
+}
+
+// WritePrometheus writes the last sample and alert counts in Prometheus
+// text format
+func (m *Monitor) WritePrometheus(w io.Writer) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.Time.IsZero() {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_process_goroutines Goroutines at the last self-monitor sample\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_process_goroutines gauge\n")
+	fmt.Fprintf(w, "marchproxy_process_goroutines %d\n", m.last.Goroutines)
+	fmt.Fprintf(w, "# HELP marchproxy_process_heap_bytes Allocated heap at the last self-monitor sample\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_process_heap_bytes gauge\n")
+	fmt.Fprintf(w, "marchproxy_process_heap_bytes %d\n", m.last.HeapBytes)
+	if m.last.FDs >= 0 {
+		fmt.Fprintf(w, "# HELP marchproxy_process_open_fds Open file descriptors at the last self-monitor sample\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_process_open_fds gauge\n")
+		fmt.Fprintf(w, "marchproxy_process_open_fds %d\n", m.last.FDs)
+	}
+	if m.last.FDLimit >= 0 {
+		fmt.Fprintf(w, "# HELP marchproxy_process_fd_limit Open file descriptor limit\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_process_fd_limit gauge\n")
+		fmt.Fprintf(w, "marchproxy_process_fd_limit %d\n", m.last.FDLimit)
+	}
+
+	resources := []string{ResourceFDs, ResourceGoroutineLeak, ResourceGoroutines, ResourceHeap}
+	fmt.Fprintf(w, "# HELP marchproxy_selfmon_alerts_total Self-monitor threshold crossings per resource\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_selfmon_alerts_total counter\n")
+	for _, resource := range resources {
+		fmt.Fprintf(w, "marchproxy_selfmon_alerts_total{resource=%q} %d\n", resource, m.alerts[resource])
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_selfmon_over_threshold Whether a resource is over its threshold\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_selfmon_over_threshold gauge\n")
+	for _, resource := range resources {
+		over := 0
+		if m.over[resource] {
+			over = 1
+		}
+		fmt.Fprintf(w, "marchproxy_selfmon_over_threshold{resource=%q} %d\n", resource, over)
+	}
+}
@@ -0,0 +1,105 @@
+package selfmon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedSamples makes m return the given samples in order
+func fixedSamples(m *Monitor, samples ...Sample) {
+	m.sample = func() Sample {
+		s := samples[0]
+		samples = samples[1:]
+		s.Time = time.Now()
+		return s
+	}
+}
+
+func TestThresholdAlerts(t *testing.T) {
+	m := New(time.Second, Thresholds{Goroutines: 100, HeapBytes: 1 << 20, FDPercent: 50}, nil)
+	fixedSamples(m,
+		Sample{Goroutines: 50, HeapBytes: 1 << 10, FDs: 10, FDLimit: 100},
+		Sample{Goroutines: 150, HeapBytes: 2 << 20, FDs: 60, FDLimit: 100},
+		Sample{Goroutines: 150, HeapBytes: 2 << 20, FDs: 60, FDLimit: 100},
+		Sample{Goroutines: 50, HeapBytes: 1 << 10, FDs: 10, FDLimit: 100},
+		Sample{Goroutines: 150, HeapBytes: 1 << 10, FDs: 10, FDLimit: 100},
+	)
+	for i := 0; i < 5; i++ {
+		m.Check()
+	}
+
+	alerts := m.Alerts()
+	// Alerts are raised when a threshold is crossed, not on every sample
+	if alerts[ResourceGoroutines] != 2 || alerts[ResourceHeap] != 1 || alerts[ResourceFDs] != 1 {
+		t.Errorf("Unexpected alert counts %v", alerts)
+	}
+}
+
+func TestFDCheckNeedsLimit(t *testing.T) {
+	m := New(time.Second, Thresholds{FDPercent: 50}, nil)
+	fixedSamples(m, Sample{FDs: 1000, FDLimit: -1})
+	m.Check()
+	if alerts := m.Alerts(); alerts[ResourceFDs] != 0 {
+		t.Errorf("Expected no FD alert without a known limit, got %v", alerts)
+	}
+}
+
+func TestGoroutineLeak(t *testing.T) {
+	m := New(time.Second, Thresholds{}, nil)
+
+	// Goroutines that follow the connection count are not a leak
+	var samples []Sample
+	for i := 0; i <= LeakSamples; i++ {
+		samples = append(samples, Sample{Goroutines: 10 + 2*i, Connections: int64(i)})
+	}
+	// Goroutines that grow while connections stay flat are
+	for i := 0; i <= LeakSamples; i++ {
+		samples = append(samples, Sample{Goroutines: 100 + i, Connections: LeakSamples})
+	}
+	samples = append(samples, Sample{Goroutines: 20, Connections: 0})
+	fixedSamples(m, samples...)
+
+	for i := 0; i <= LeakSamples; i++ {
+		m.Check()
+	}
+	if alerts := m.Alerts(); alerts[ResourceGoroutineLeak] != 0 {
+		t.Fatalf("Expected no leak while connections grow, got %v", alerts)
+	}
+	for i := 0; i <= LeakSamples; i++ {
+		m.Check()
+	}
+	if alerts := m.Alerts(); alerts[ResourceGoroutineLeak] != 1 {
+		t.Fatalf("Expected a leak alert, got %v", alerts)
+	}
+	m.Check()
+	if m.over[ResourceGoroutineLeak] {
+		t.Error("Expected the leak to recover once goroutines drop")
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	m := New(time.Second, Thresholds{Goroutines: 1}, nil)
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("Expected no metrics before the first sample, got %q", buf.String())
+	}
+
+	s := m.Check()
+	if s.Goroutines < 1 || s.HeapBytes == 0 {
+		t.Errorf("Unexpected sample %+v", s)
+	}
+	m.WritePrometheus(&buf)
+	for _, want := range []string{
+		"marchproxy_process_goroutines ",
+		"marchproxy_process_heap_bytes ",
+		`marchproxy_selfmon_alerts_total{resource="goroutines"} 1`,
+		`marchproxy_selfmon_over_threshold{resource="goroutines"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, buf.String())
+		}
+	}
+}
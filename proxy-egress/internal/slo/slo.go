@@ -0,0 +1,416 @@
+// Package slo tracks service level objectives of mappings: the fraction of
+// dials that connect within a latency threshold, of connections that
+// close without error, or of bulk transfers that reach a bandwidth. Each
+// objective has a rolling compliance window and an error budget, and
+// burn rates tell how fast the budget is being spent.
+//
+// Burn rate alerting follows the multiwindow approach of the Google SRE
+// workbook: an objective is burning fast when both its 1 hour and 5 minute
+// burn rates reach 14.4, spending 2% of a 30 day budget in an hour, and
+// slowly when both its 6 hour and 30 minute burn rates reach 6.
+package slo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics an objective can be defined on
+const (
+	MetricConnectLatency = "connect_latency" // Dials connecting within threshold milliseconds
+	MetricErrorRate      = "error_rate"      // Connections closing without error
+	MetricBandwidth      = "bandwidth"       // Bulk transfers averaging at least threshold Mbit/s
+)
+
+// Burn rate alert windows
+const (
+	BurnFast = "fast"
+	BurnSlow = "slow"
+)
+
+// BulkTransferBytes is the smallest transfer counted by bandwidth
+// objectives; shorter connections aren't limited by bandwidth
+const BulkTransferBytes = 1 << 20
+
+// DefaultWindowDays is the compliance window of objectives without one
+const DefaultWindowDays = 30
+
+// burnAlert is a pair of windows that must both burn at factor
+type burnAlert struct {
+	name   string
+	long   time.Duration
+	short  time.Duration
+	factor float64
+}
+
+var burnAlerts = []burnAlert{
+	{name: BurnFast, long: time.Hour, short: 5 * time.Minute, factor: 14.4},
+	{name: BurnSlow, long: 6 * time.Hour, short: 30 * time.Minute, factor: 6},
+}
+
+// burnWindows are the burn rates exported as metrics
+var burnWindows = []struct {
+	label string
+	span  time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// Objective is a service level objective of a mapping. A p99 connect
+// latency under 200ms is a connect_latency objective with a target of
+// 0.99 and a threshold of 200.
+type Objective struct {
+	Name      string  `json:"name,omitempty"`      // Defaults to the metric
+	Metric    string  `json:"metric"`              // connect_latency, error_rate or bandwidth
+	Target    float64 `json:"target"`              // Fraction of good events, e.g. 0.999
+	Threshold float64 `json:"threshold,omitempty"` // Milliseconds for connect_latency, Mbit/s for bandwidth
+	Window    int     `json:"window,omitempty"`    // Days of the compliance window, 30 by default
+}
+
+// Validate checks the metric, target, threshold and window
+func (o *Objective) Validate() error {
+	switch o.Metric {
+	case MetricConnectLatency, MetricBandwidth:
+		if o.Threshold <= 0 {
+			return fmt.Errorf("%s objective needs a positive threshold", o.Metric)
+		}
+	case MetricErrorRate:
+	default:
+		return fmt.Errorf("unknown SLO metric %q", o.Metric)
+	}
+	if o.Target <= 0 || o.Target >= 1 {
+		return fmt.Errorf("SLO target must be between 0 and 1, exclusive")
+	}
+	if o.Window < 0 || o.Window > 90 {
+		return fmt.Errorf("SLO window must be at most 90 days")
+	}
+	return nil
+}
+
+// ValidateAll checks objectives of one mapping, whose names must be unique
+func ValidateAll(objectives []Objective) error {
+	seen := make(map[string]bool)
+	for i := range objectives {
+		objective := &objectives[i]
+		if err := objective.Validate(); err != nil {
+			return err
+		}
+		name := objective.name()
+		if seen[name] {
+			return fmt.Errorf("duplicate SLO %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func (o *Objective) name() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return o.Metric
+}
+
+func (o *Objective) windowDays() int {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return DefaultWindowDays
+}
+
+// counts are the good and total events of a bucket or span
+type counts struct {
+	good  uint64
+	total uint64
+}
+
+// badRatio returns the fraction of bad events, 0 without events
+func (c counts) badRatio() float64 {
+	if c.total == 0 {
+		return 0
+	}
+	return float64(c.total-c.good) / float64(c.total)
+}
+
+// ring keeps event counts in fixed-width time buckets
+type ring struct {
+	width   time.Duration
+	buckets []counts
+	stamps  []int64 // Index of the period each bucket holds
+}
+
+func newRing(width time.Duration, n int) *ring {
+	return &ring{width: width, buckets: make([]counts, n), stamps: make([]int64, n)}
+}
+
+func (r *ring) add(now time.Time, good bool) {
+	index := now.UnixNano() / int64(r.width)
+	slot := int(index % int64(len(r.buckets)))
+	if r.stamps[slot] != index {
+		r.stamps[slot] = index
+		r.buckets[slot] = counts{}
+	}
+	r.buckets[slot].total++
+	if good {
+		r.buckets[slot].good++
+	}
+}
+
+// sum returns the counts of the buckets covering span up to now
+func (r *ring) sum(now time.Time, span time.Duration) counts {
+	index := now.UnixNano() / int64(r.width)
+	n := int64(span / r.width)
+	if n > int64(len(r.buckets)) {
+		n = int64(len(r.buckets))
+	}
+	var c counts
+	for i := index - n + 1; i <= index; i++ {
+		slot := int(i % int64(len(r.buckets)))
+		if r.stamps[slot] == i {
+			c.good += r.buckets[slot].good
+			c.total += r.buckets[slot].total
+		}
+	}
+	return c
+}
+
+// state is an objective and its events: minutes for the burn rates and
+// hours for the compliance window
+type state struct {
+	mapping   string
+	objective Objective
+	minutes   *ring
+	hours     *ring
+}
+
+func newState(mapping string, objective Objective) *state {
+	return &state{
+		mapping:   mapping,
+		objective: objective,
+		minutes:   newRing(time.Minute, 6*60),
+		hours:     newRing(time.Hour, objective.windowDays()*24),
+	}
+}
+
+func (s *state) add(now time.Time, good bool) {
+	s.minutes.add(now, good)
+	s.hours.add(now, good)
+}
+
+// burnRate is the rate the budget is spent at over span, 1 spending
+// exactly the budget over the window
+func (s *state) burnRate(now time.Time, span time.Duration) float64 {
+	return s.minutes.sum(now, span).badRatio() / (1 - s.objective.Target)
+}
+
+// Status is the compliance of an objective
+type Status struct {
+	Mapping         string             `json:"mapping"`
+	Objective       string             `json:"objective"`
+	Metric          string             `json:"metric"`
+	Target          float64            `json:"target"`
+	Compliance      float64            `json:"compliance"`       // Good fraction over the window, 1 without events
+	BudgetRemaining float64            `json:"budget_remaining"` // Fraction of the error budget left, negative once spent
+	Events          uint64             `json:"events"`
+	BurnRates       map[string]float64 `json:"burn_rates"` // By window: 5m, 30m, 1h and 6h
+}
+
+// Burn is an objective spending its budget too fast
+type Burn struct {
+	Mapping   string
+	Objective string
+	Window    string  // fast or slow
+	Factor    float64 // Burn rate both windows reached
+	LongRate  float64
+	ShortRate float64
+}
+
+// Tracker tracks the objectives of every mapping
+type Tracker struct {
+	mappings map[string][]*state
+	mutex    sync.Mutex
+}
+
+// Default is the tracker the proxy records events in and the dashboard
+// alert engine evaluates
+var Default = NewTracker()
+
+// NewTracker creates a tracker without objectives
+func NewTracker() *Tracker {
+	return &Tracker{mappings: make(map[string][]*state)}
+}
+
+// Update replaces the objectives, by mapping name. Objectives that didn't
+// change keep their events.
+func (t *Tracker) Update(objectives map[string][]Objective) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	mappings := make(map[string][]*state, len(objectives))
+	for mapping, list := range objectives {
+		if ValidateAll(list) != nil {
+			continue
+		}
+		for _, objective := range list {
+			var kept *state
+			for _, old := range t.mappings[mapping] {
+				if old.objective == objective {
+					kept = old
+					break
+				}
+			}
+			if kept == nil {
+				kept = newState(mapping, objective)
+			}
+			mappings[mapping] = append(mappings[mapping], kept)
+		}
+	}
+	t.mappings = mappings
+}
+
+// observe records an event for the mapping's objectives on metric
+func (t *Tracker) observe(now time.Time, mapping, metric string, good func(*Objective) bool) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, s := range t.mappings[mapping] {
+		if s.objective.Metric == metric {
+			s.add(now, good(&s.objective))
+		}
+	}
+}
+
+// ObserveDial records a dial of a mapping; failed dials are bad events
+func (t *Tracker) ObserveDial(mapping string, latency time.Duration, err error) {
+	t.observe(time.Now(), mapping, MetricConnectLatency, func(o *Objective) bool {
+		return err == nil && float64(latency)/float64(time.Millisecond) <= o.Threshold
+	})
+}
+
+// ObserveConnection records a closed connection of a mapping
+func (t *Tracker) ObserveConnection(mapping string, failed bool) {
+	t.observe(time.Now(), mapping, MetricErrorRate, func(*Objective) bool { return !failed })
+}
+
+// ObserveTransfer records the bytes a connection of a mapping moved in
+// duration, when it was a bulk transfer
+func (t *Tracker) ObserveTransfer(mapping string, bytes int64, duration time.Duration) {
+	if bytes < BulkTransferBytes || duration <= 0 {
+		return
+	}
+	mbps := float64(bytes) * 8 / duration.Seconds() / 1e6
+	t.observe(time.Now(), mapping, MetricBandwidth, func(o *Objective) bool { return mbps >= o.Threshold })
+}
+
+// sortedLocked returns every objective's state by mapping and name
+func (t *Tracker) sortedLocked() []*state {
+	var states []*state
+	for _, list := range t.mappings {
+		states = append(states, list...)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].mapping != states[j].mapping {
+			return states[i].mapping < states[j].mapping
+		}
+		return states[i].objective.name() < states[j].objective.name()
+	})
+	return states
+}
+
+// Status returns the compliance of every objective at now
+func (t *Tracker) Status(now time.Time) []Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var statuses []Status
+	for _, s := range t.sortedLocked() {
+		window := s.hours.sum(now, time.Duration(s.objective.windowDays())*24*time.Hour)
+		status := Status{
+			Mapping:         s.mapping,
+			Objective:       s.objective.name(),
+			Metric:          s.objective.Metric,
+			Target:          s.objective.Target,
+			Compliance:      1 - window.badRatio(),
+			BudgetRemaining: 1 - window.badRatio()/(1-s.objective.Target),
+			Events:          window.total,
+			BurnRates:       make(map[string]float64, len(burnWindows)),
+		}
+		for _, w := range burnWindows {
+			status.BurnRates[w.label] = s.burnRate(now, w.span)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Burning returns the objectives whose long and short windows both burn
+// at or above the factor of a burn rate alert
+func (t *Tracker) Burning(now time.Time) []Burn {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var burns []Burn
+	for _, s := range t.sortedLocked() {
+		for _, alert := range burnAlerts {
+			long, short := s.burnRate(now, alert.long), s.burnRate(now, alert.short)
+			if long >= alert.factor && short >= alert.factor {
+				burns = append(burns, Burn{
+					Mapping:   s.mapping,
+					Objective: s.objective.name(),
+					Window:    alert.name,
+					Factor:    alert.factor,
+					LongRate:  long,
+					ShortRate: short,
+				})
+			}
+		}
+	}
+	return burns
+}
+
+// WritePrometheus writes targets, compliance, budgets and burn rates in
+// Prometheus text format
+func (t *Tracker) WritePrometheus(w io.Writer) {
+	if t == nil {
+		return
+	}
+	statuses := t.Status(time.Now())
+
+	fmt.Fprintf(w, "# HELP marchproxy_slo_target Target fraction of good events per mapping objective\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_slo_target gauge\n")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "marchproxy_slo_target{mapping=%q,objective=%q,metric=%q} %g\n", s.Mapping, s.Objective, s.Metric, s.Target)
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_slo_compliance Fraction of good events over the objective's window\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_slo_compliance gauge\n")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "marchproxy_slo_compliance{mapping=%q,objective=%q} %g\n", s.Mapping, s.Objective, s.Compliance)
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_slo_error_budget_remaining Fraction of the error budget left over the objective's window, negative once spent\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_slo_error_budget_remaining gauge\n")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "marchproxy_slo_error_budget_remaining{mapping=%q,objective=%q} %g\n", s.Mapping, s.Objective, s.BudgetRemaining)
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_slo_burn_rate Rate the error budget is spent at per window, 1 spending it exactly over the objective's window\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_slo_burn_rate gauge\n")
+	for _, s := range statuses {
+		for _, window := range burnWindows {
+			fmt.Fprintf(w, "marchproxy_slo_burn_rate{mapping=%q,objective=%q,window=%q} %g\n", s.Mapping, s.Objective, window.label, s.BurnRates[window.label])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package slo
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := [][]Objective{
+		nil,
+		{{Metric: MetricConnectLatency, Target: 0.99, Threshold: 200}},
+		{{Metric: MetricErrorRate, Target: 0.999, Window: 7}, {Name: "bulk", Metric: MetricBandwidth, Target: 0.95, Threshold: 100}},
+	}
+	for _, objectives := range valid {
+		if err := ValidateAll(objectives); err != nil {
+			t.Errorf("ValidateAll(%+v) = %v", objectives, err)
+		}
+	}
+
+	invalid := [][]Objective{
+		{{Metric: "throughput", Target: 0.99}},
+		{{Metric: MetricConnectLatency, Target: 0.99}},
+		{{Metric: MetricErrorRate, Target: 1}},
+		{{Metric: MetricErrorRate, Target: 0.99, Window: 365}},
+		{{Metric: MetricErrorRate, Target: 0.99}, {Metric: MetricErrorRate, Target: 0.9}},
+	}
+	for _, objectives := range invalid {
+		if err := ValidateAll(objectives); err == nil {
+			t.Errorf("ValidateAll(%+v) succeeded", objectives)
+		}
+	}
+}
+
+// TestObserve tests which events count as good for each metric
+func TestObserve(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Update(map[string][]Objective{"api": {
+		{Metric: MetricConnectLatency, Target: 0.9, Threshold: 100},
+		{Metric: MetricErrorRate, Target: 0.9},
+		{Metric: MetricBandwidth, Target: 0.9, Threshold: 8},
+	}})
+
+	tracker.ObserveDial("api", 50*time.Millisecond, nil)
+	tracker.ObserveDial("api", 150*time.Millisecond, nil)
+	tracker.ObserveDial("api", time.Millisecond, errors.New("refused"))
+	tracker.ObserveDial("other", time.Second, nil)
+	tracker.ObserveConnection("api", false)
+	tracker.ObserveTransfer("api", 2<<20, time.Second)   // 16.8 Mbit/s
+	tracker.ObserveTransfer("api", 2<<20, 4*time.Second) // 4.2 Mbit/s
+	tracker.ObserveTransfer("api", 1024, time.Minute)    // Not a bulk transfer
+
+	want := map[string]struct {
+		events     uint64
+		compliance float64
+	}{
+		MetricConnectLatency: {3, 1.0 / 3},
+		MetricErrorRate:      {1, 1},
+		MetricBandwidth:      {2, 0.5},
+	}
+	statuses := tracker.Status(time.Now())
+	if len(statuses) != 3 {
+		t.Fatalf("Statuses = %+v", statuses)
+	}
+	for _, status := range statuses {
+		w := want[status.Metric]
+		if status.Events != w.events || math.Abs(status.Compliance-w.compliance) > 1e-9 {
+			t.Errorf("%s: events %d, compliance %g, want %d, %g", status.Metric, status.Events, status.Compliance, w.events, w.compliance)
+		}
+	}
+}
+
+// TestBurning tests burn rate alerts need both their windows burning, and
+// that unchanged objectives keep their events across updates
+func TestBurning(t *testing.T) {
+	objective := Objective{Metric: MetricErrorRate, Target: 0.99}
+	tracker := NewTracker()
+	tracker.Update(map[string][]Objective{"api": {objective}})
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+
+	// An hour at 20% errors is a burn rate of 20 on every window
+	for minute := 0; minute < 60; minute++ {
+		at := now.Add(time.Duration(minute-59) * time.Minute)
+		for i := 0; i < 10; i++ {
+			tracker.observe(at, "api", MetricErrorRate, func(*Objective) bool { return i >= 2 })
+		}
+	}
+	burns := tracker.Burning(now)
+	if len(burns) != 2 || burns[0].Window != BurnFast || burns[1].Window != BurnSlow || math.Abs(burns[0].LongRate-20) > 1e-6 {
+		t.Fatalf("Burns = %+v", burns)
+	}
+
+	// Ten good minutes clear the fast alert's 5 minute window, while the
+	// slow alert's 30 minute window still burns at 13.3
+	tracker.Update(map[string][]Objective{"api": {objective}})
+	recovered := now.Add(10 * time.Minute)
+	for minute := 1; minute <= 10; minute++ {
+		tracker.observe(now.Add(time.Duration(minute)*time.Minute), "api", MetricErrorRate, func(*Objective) bool { return true })
+	}
+	if burns := tracker.Burning(recovered); len(burns) != 1 || burns[0].Window != BurnSlow {
+		t.Errorf("Burns after recovery = %+v", burns)
+	}
+
+	var metrics strings.Builder
+	tracker.WritePrometheus(&metrics)
+	for _, want := range []string{
+		`marchproxy_slo_target{mapping="api",objective="error_rate",metric="error_rate"} 0.99`,
+		`marchproxy_slo_burn_rate{mapping="api",objective="error_rate",window="5m"}`,
+		`marchproxy_slo_error_budget_remaining{mapping="api",objective="error_rate"}`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+
+	tracker.Update(map[string][]Objective{"api": {{Metric: MetricErrorRate, Target: 0.999}}})
+	if status := tracker.Status(recovered); status[0].Events != 0 {
+		t.Errorf("Events = %d after the objective changed, want 0", status[0].Events)
+	}
+}
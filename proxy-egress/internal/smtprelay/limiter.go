@@ -0,0 +1,50 @@
+package smtprelay
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter counts the messages of each service per minute as a token bucket
+// holding a minute's worth of messages
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// allow takes a message from the service's bucket, refilled at perMinute.
+// A perMinute of 0 is unlimited.
+func (l *limiter) allow(service string, perMinute int) bool {
+	if perMinute <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[service]
+	if !ok {
+		b = &bucket{tokens: float64(perMinute), last: now}
+		l.buckets[service] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+	if b.tokens > float64(perMinute) {
+		b.tokens = float64(perMinute)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,158 @@
+// Package smtprelay relays mail from egress clients to the SMTP servers of
+// their mappings, enforcing each mapping's sender and recipient domains and
+// message rate before anything leaves the cluster.
+//
+// Clients are identified by SMTP AUTH with their service ID and token, or
+// else by the service their address belongs to. Messages are accepted in
+// full, then delivered to the mapping's relay with STARTTLS whenever it is
+// offered, or refused when the policy requires it and the relay lacks it.
+// The envelope of every message is counted and optionally logged per
+// service; bodies are never logged.
+package smtprelay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Policy is the SMTP part of a mapping
+type Policy struct {
+	// Domains mail may be sent to. "example.com" matches the domain and its
+	// subdomains, "*.example.com" only the subdomains. Empty allows any.
+	AllowedRecipientDomains []string `json:"allowed_recipient_domains,omitempty"`
+
+	// Domains the envelope sender may be from, with the same patterns
+	AllowedSenderDomains []string `json:"allowed_sender_domains,omitempty"`
+
+	MessagesPerMinute int  `json:"messages_per_minute,omitempty"` // per service, 0 is unlimited
+	MaxRecipients     int  `json:"max_recipients,omitempty"`      // per message, 0 is the SMTP limit of 100
+	MaxMessageSize    int  `json:"max_message_size,omitempty"`    // bytes, 0 is the proxy's limit
+	RequireTLS        bool `json:"require_tls,omitempty"`         // refuse relays without STARTTLS
+}
+
+// DefaultMaxRecipients is the recipient limit of messages without one
+const DefaultMaxRecipients = 100
+
+// Validate checks the domain patterns and limits
+func (p *Policy) Validate() error {
+	for _, domain := range append(append([]string{}, p.AllowedRecipientDomains...), p.AllowedSenderDomains...) {
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.ContainsAny(name, "*@ ") {
+			return fmt.Errorf("invalid domain pattern %q", domain)
+		}
+	}
+	if p.MessagesPerMinute < 0 || p.MaxRecipients < 0 || p.MaxMessageSize < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// AllowsSender reports whether mail may be sent from address. The null
+// sender of bounces is allowed only without a sender list.
+func (p *Policy) AllowsSender(address string) bool {
+	return len(p.AllowedSenderDomains) == 0 || matchAny(domainOf(address), p.AllowedSenderDomains)
+}
+
+// AllowsRecipient reports whether mail may be sent to address
+func (p *Policy) AllowsRecipient(address string) bool {
+	return len(p.AllowedRecipientDomains) == 0 || matchAny(domainOf(address), p.AllowedRecipientDomains)
+}
+
+// maxRecipients returns the recipient limit per message
+func (p *Policy) maxRecipients() int {
+	if p.MaxRecipients > 0 {
+		return p.MaxRecipients
+	}
+	return DefaultMaxRecipients
+}
+
+// domainOf returns the lower-cased domain of a mailbox, empty without one
+func domainOf(address string) string {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(address[at+1:]), ".")
+}
+
+// matchAny reports whether domain matches any of the patterns
+func matchAny(domain string, patterns []string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		} else if domain == pattern || strings.HasSuffix(domain, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route is where a service's mail goes
+type Route struct {
+	Mapping string
+	Policy  Policy
+	Relay   string // host:port of the mapping's SMTP server
+
+	// Dial connects to the relay through the mapping's outbound settings,
+	// a plain dial when nil
+	Dial func(ctx context.Context, address string) (net.Conn, error)
+}
+
+// Source is a service that may send mail
+type Source struct {
+	ServiceID int
+	Service   string
+	Networks  []netip.Prefix // Client addresses of the service
+	Route     *Route
+}
+
+// Table holds the services that may relay mail
+type Table struct {
+	Sources []Source
+}
+
+// byID returns the source of an authenticated service
+func (t *Table) byID(serviceID int) *Source {
+	if t == nil {
+		return nil
+	}
+	for i := range t.Sources {
+		if t.Sources[i].ServiceID == serviceID {
+			return &t.Sources[i]
+		}
+	}
+	return nil
+}
+
+// byAddress returns the source with the longest network containing client
+func (t *Table) byAddress(client net.IP) *Source {
+	if t == nil {
+		return nil
+	}
+	addr, ok := netip.AddrFromSlice(client)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	var best *Source
+	bestBits := -1
+	for i := range t.Sources {
+		for _, network := range t.Sources[i].Networks {
+			if network.Contains(addr) && network.Bits() > bestBits {
+				best = &t.Sources[i]
+				bestBits = network.Bits()
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,102 @@
+package smtprelay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPolicyDomains(t *testing.T) {
+	policy := Policy{
+		AllowedRecipientDomains: []string{"example.com", "*.partner.net"},
+		AllowedSenderDomains:    []string{"corp.example"},
+	}
+	recipients := []struct {
+		address string
+		allowed bool
+	}{
+		{"ops@example.com", true},
+		{"ops@mail.Example.COM", true},
+		{"ops@notexample.com", false},
+		{"ops@partner.net", false},
+		{"ops@eu.partner.net", true},
+		{"postmaster", false},
+	}
+	for _, tt := range recipients {
+		if got := policy.AllowsRecipient(tt.address); got != tt.allowed {
+			t.Errorf("AllowsRecipient(%q) = %t, expected %t", tt.address, got, tt.allowed)
+		}
+	}
+	if !policy.AllowsSender("app@corp.example") || policy.AllowsSender("app@corp.example.org") || policy.AllowsSender("") {
+		t.Error("Unexpected sender decisions")
+	}
+
+	open := Policy{}
+	if !open.AllowsSender("") || !open.AllowsRecipient("anyone@anywhere.org") {
+		t.Error("Expected an empty policy to allow everything")
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	valid := Policy{AllowedRecipientDomains: []string{"example.com", "*.internal"}, MessagesPerMinute: 10}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid policy: %v", err)
+	}
+	invalid := []Policy{
+		{AllowedRecipientDomains: []string{"*"}},
+		{AllowedSenderDomains: []string{"user@example.com"}},
+		{MessagesPerMinute: -1},
+	}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", policy)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("web", 3) {
+			t.Fatalf("Expected message %d to be allowed", i)
+		}
+	}
+	if l.allow("web", 3) {
+		t.Error("Expected the fourth message within a minute to be limited")
+	}
+	if !l.allow("batch", 3) {
+		t.Error("Expected services to be limited separately")
+	}
+
+	// One message every 20 seconds
+	now = now.Add(20 * time.Second)
+	if !l.allow("web", 3) || l.allow("web", 3) {
+		t.Error("Expected exactly one message after 20 seconds")
+	}
+	if !l.allow("web", 0) {
+		t.Error("Expected 0 to be unlimited")
+	}
+}
+
+func TestTableLookup(t *testing.T) {
+	table := &Table{Sources: []Source{
+		{ServiceID: 1, Service: "web", Networks: mustPrefixes(t, "10.0.0.0/24")},
+		{ServiceID: 2, Service: "batch", Networks: mustPrefixes(t, "10.0.0.7/32")},
+	}}
+	if s := table.byAddress(net.ParseIP("10.0.0.7")); s == nil || s.Service != "batch" {
+		t.Errorf("Expected the most specific network to win, got %+v", s)
+	}
+	if s := table.byAddress(net.ParseIP("::ffff:10.0.0.9")); s == nil || s.Service != "web" {
+		t.Errorf("Expected web for a mapped address, got %+v", s)
+	}
+	if s := table.byID(3); s != nil {
+		t.Errorf("Expected no source for service 3, got %+v", s)
+	}
+	var none *Table
+	if none.byAddress(net.ParseIP("10.0.0.1")) != nil || none.byID(1) != nil {
+		t.Error("Expected no sources without a table")
+	}
+}
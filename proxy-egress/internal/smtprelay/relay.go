@@ -0,0 +1,100 @@
+package smtprelay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+)
+
+// errRelayWithoutTLS is returned when a policy requires STARTTLS the relay
+// does not offer
+var errRelayWithoutTLS = errors.New("relay does not offer STARTTLS")
+
+// deliver relays one message, reporting whether the relay connection was
+// encrypted
+func (s *Server) deliver(ctx context.Context, route *Route, from string, rcpts []string, message []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+
+	dial := route.Dial
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = func(ctx context.Context, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", address)
+		}
+	}
+	conn, err := dial(ctx, route.Relay)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to relay %s: %w", route.Relay, err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	host, _, err := net.SplitHostPort(route.Relay)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	defer client.Close()
+
+	if err := client.Hello(s.opts.Hostname); err != nil {
+		return false, err
+	}
+	upstreamTLS := false
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return false, err
+		}
+		upstreamTLS = true
+	} else if route.Policy.RequireTLS {
+		return false, errRelayWithoutTLS
+	}
+
+	if err := client.Mail(from); err != nil {
+		return upstreamTLS, err
+	}
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil {
+			return upstreamTLS, err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return upstreamTLS, err
+	}
+	if _, err := w.Write(message); err != nil {
+		return upstreamTLS, err
+	}
+	if err := w.Close(); err != nil {
+		return upstreamTLS, err
+	}
+	// The message is accepted, a failing QUIT changes nothing
+	client.Quit()
+	return upstreamTLS, nil
+}
+
+// relayResponse turns a delivery error into the reply to the client. The
+// relay's permanent failures stay permanent, everything else is temporary
+// so the client retries.
+func relayResponse(err error) (int, string) {
+	if errors.Is(err, errRelayWithoutTLS) {
+		return 554, "5.7.10 Relay does not offer STARTTLS"
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		if protoErr.Code >= 500 {
+			return 554, fmt.Sprintf("5.0.0 Relay rejected the message: %d %s", protoErr.Code, protoErr.Msg)
+		}
+		return 451, fmt.Sprintf("4.4.0 Relay deferred the message: %d %s", protoErr.Code, protoErr.Msg)
+	}
+	return 451, "4.4.1 Relay unavailable, try again later"
+}
@@ -0,0 +1,720 @@
+package smtprelay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message results, counted per service
+const (
+	ResultDelivered   = "delivered"
+	ResultRejected    = "rejected"
+	ResultRateLimited = "rate_limited"
+	ResultTooLarge    = "too_large"
+	ResultFailed      = "failed"
+)
+
+// UnknownService is the service reported for clients of no known source
+const UnknownService = "unknown"
+
+const (
+	// DefaultMaxMessageSize is the message size limit without one configured
+	DefaultMaxMessageSize = 10 << 20
+	// DefaultTimeout bounds each command and each delivery
+	DefaultTimeout = 5 * time.Minute
+	// maxLineLength bounds command lines, well above the 512 octets of RFC 5321
+	maxLineLength = 4096
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// Options configure a server
+type Options struct {
+	Hostname       string        // Announced in the greeting and to relays
+	TLSConfig      *tls.Config   // Offers STARTTLS to clients, nil disables it
+	MaxMessageSize int           // bytes, lowered per mapping by the policy
+	Timeout        time.Duration // per command and per delivery
+	RequireAuth    bool          // identify clients only by SMTP AUTH, not by address
+	Log            io.Writer     // JSON line per message, nil disables the log
+
+	// Authenticate verifies the token of a service for SMTP AUTH, which is
+	// not offered when nil
+	Authenticate func(serviceID int, token string) error
+}
+
+// Server accepts mail from egress clients and relays it
+type Server struct {
+	opts    Options
+	table   atomic.Pointer[Table]
+	limiter *limiter
+
+	mu                 sync.Mutex
+	counts             map[string]map[string]int64 // service -> result -> messages
+	bytes              map[string]int64            // service -> delivered bytes
+	recipientsRejected map[string]int64
+	authFailures       int64
+	logMu              sync.Mutex
+}
+
+// NewServer creates a server. It refuses every message until a table is set.
+func NewServer(opts Options) *Server {
+	if opts.Hostname == "" {
+		opts.Hostname = "localhost"
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	return &Server{
+		opts:               opts,
+		limiter:            newLimiter(),
+		counts:             make(map[string]map[string]int64),
+		bytes:              make(map[string]int64),
+		recipientsRejected: make(map[string]int64),
+	}
+}
+
+// SetTable replaces the sources for the following messages
+func (s *Server) SetTable(table *Table) {
+	s.table.Store(table)
+}
+
+// Serve accepts SMTP sessions from listener until ctx is done. With
+// implicitTLS every session starts with a TLS handshake (SMTPS).
+func (s *Server) Serve(ctx context.Context, listener net.Listener, implicitTLS bool) error {
+	if implicitTLS && s.opts.TLSConfig == nil {
+		return fmt.Errorf("implicit TLS needs a TLS config")
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(ctx, conn, implicitTLS)
+		}()
+	}
+}
+
+// session is the state of one client connection
+type session struct {
+	s      *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	client net.IP
+	tls    bool
+	helo   string
+
+	authenticated bool
+	serviceID     int
+
+	// Current transaction, reset after DATA and by RSET
+	source   *Source
+	from     string
+	rcpts    []string
+	rejected []string
+}
+
+// serveConn runs the SMTP dialogue of one client
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, implicitTLS bool) {
+	sessionDone := make(chan struct{})
+	defer close(sessionDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sessionDone:
+		}
+		conn.Close()
+	}()
+
+	sess := &session{s: s, conn: conn, client: addrIP(conn.RemoteAddr())}
+	if implicitTLS {
+		tlsConn := tls.Server(conn, s.opts.TLSConfig)
+		conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return
+		}
+		sess.conn, sess.tls = tlsConn, true
+	}
+	sess.r = bufio.NewReader(sess.conn)
+	sess.w = bufio.NewWriter(sess.conn)
+
+	sess.reply(220, "%s ESMTP MarchProxy relay", s.opts.Hostname)
+	for {
+		sess.conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+		line, err := sess.readLine()
+		if errors.Is(err, errLineTooLong) {
+			sess.reply(500, "5.5.2 Line too long")
+			continue
+		}
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		if !sess.command(ctx, strings.ToUpper(verb), strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+// addrIP returns the IP of a TCP address
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+// readLine reads a command line without its line ending
+func (sess *session) readLine() (string, error) {
+	line, err := sess.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || (err == nil && len(line) > maxLineLength) {
+		// Skip the rest of the line
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = sess.r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reply writes a single line response
+func (sess *session) reply(code int, format string, args ...any) {
+	fmt.Fprintf(sess.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	sess.w.Flush()
+}
+
+// replyLines writes a multiline response
+func (sess *session) replyLines(code int, lines []string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(sess.w, "%d%s%s\r\n", code, sep, line)
+	}
+	sess.w.Flush()
+}
+
+// reset ends the current transaction
+func (sess *session) reset() {
+	sess.source = nil
+	sess.from = ""
+	sess.rcpts = nil
+	sess.rejected = nil
+}
+
+// command handles one command, false when the session is over
+func (sess *session) command(ctx context.Context, verb, arg string) bool {
+	s := sess.s
+	switch verb {
+	case "EHLO", "HELO":
+		if arg == "" {
+			sess.reply(501, "5.5.4 %s needs a domain", verb)
+			return true
+		}
+		sess.helo = arg
+		sess.reset()
+		if verb == "HELO" {
+			sess.reply(250, "%s", s.opts.Hostname)
+			return true
+		}
+		lines := []string{s.opts.Hostname, "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", fmt.Sprintf("SIZE %d", s.opts.MaxMessageSize)}
+		if s.opts.TLSConfig != nil && !sess.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		if sess.authOffered() {
+			lines = append(lines, "AUTH PLAIN LOGIN")
+		}
+		sess.replyLines(250, lines)
+
+	case "STARTTLS":
+		if s.opts.TLSConfig == nil || sess.tls {
+			sess.reply(502, "5.5.1 STARTTLS not available")
+			return true
+		}
+		sess.reply(220, "2.0.0 Ready to start TLS")
+		tlsConn := tls.Server(sess.conn, s.opts.TLSConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return false
+		}
+		// RFC 3207: the client starts over after the handshake
+		sess.conn, sess.tls = tlsConn, true
+		sess.r = bufio.NewReader(tlsConn)
+		sess.w = bufio.NewWriter(tlsConn)
+		sess.helo = ""
+		sess.authenticated = false
+		sess.reset()
+
+	case "AUTH":
+		sess.auth(arg)
+
+	case "MAIL":
+		sess.mail(arg)
+
+	case "RCPT":
+		sess.rcpt(arg)
+
+	case "DATA":
+		if arg != "" {
+			sess.reply(501, "5.5.4 DATA takes no arguments")
+			return true
+		}
+		return sess.data(ctx)
+
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "2.0.0 OK")
+
+	case "NOOP":
+		sess.reply(250, "2.0.0 OK")
+
+	case "VRFY":
+		sess.reply(252, "2.5.0 Cannot verify, send some mail")
+
+	case "QUIT":
+		sess.reply(221, "2.0.0 Bye")
+		return false
+
+	default:
+		sess.reply(502, "5.5.2 Command not recognized")
+	}
+	return true
+}
+
+// authOffered reports whether the client may authenticate now. Tokens are
+// only accepted over TLS when STARTTLS is available.
+func (sess *session) authOffered() bool {
+	return sess.s.opts.Authenticate != nil && !sess.authenticated && (sess.tls || sess.s.opts.TLSConfig == nil)
+}
+
+// auth handles AUTH PLAIN and AUTH LOGIN with the service ID as user name
+// and the service token as password
+func (sess *session) auth(arg string) {
+	s := sess.s
+	switch {
+	case sess.helo == "":
+		sess.reply(503, "5.5.1 Send EHLO first")
+		return
+	case s.opts.Authenticate == nil:
+		sess.reply(502, "5.5.1 AUTH not available")
+		return
+	case sess.authenticated:
+		sess.reply(503, "5.5.1 Already authenticated")
+		return
+	case !sess.authOffered():
+		sess.reply(538, "5.7.11 Encryption required for authentication")
+		return
+	case sess.from != "":
+		sess.reply(503, "5.5.1 AUTH not allowed during a transaction")
+		return
+	}
+
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			sess.reply(334, "")
+			line, err := sess.readLine()
+			if err != nil {
+				return
+			}
+			initial = line
+		}
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			sess.reply(501, "5.5.2 Invalid base64")
+			return
+		}
+		// authzid NUL authcid NUL password
+		parts := strings.SplitN(string(decoded), "\x00", 3)
+		if len(parts) != 3 {
+			sess.reply(501, "5.5.2 Invalid PLAIN credentials")
+			return
+		}
+		username, password = parts[1], parts[2]
+
+	case "LOGIN":
+		var ok bool
+		if username, ok = sess.prompt(initial, "Username:"); !ok {
+			return
+		}
+		if password, ok = sess.prompt("", "Password:"); !ok {
+			return
+		}
+
+	default:
+		sess.reply(504, "5.5.4 Unrecognized authentication mechanism")
+		return
+	}
+
+	serviceID, err := strconv.Atoi(username)
+	if err == nil {
+		err = s.opts.Authenticate(serviceID, password)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.authFailures++
+		s.mu.Unlock()
+		sess.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	sess.authenticated, sess.serviceID = true, serviceID
+	sess.reply(235, "2.7.0 Authentication successful")
+}
+
+// prompt asks for one base64 AUTH LOGIN value unless it was given already
+func (sess *session) prompt(given, question string) (string, bool) {
+	if given == "" {
+		sess.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte(question)))
+		line, err := sess.readLine()
+		if err != nil {
+			return "", false
+		}
+		given = line
+	}
+	decoded, err := base64.StdEncoding.DecodeString(given)
+	if err != nil {
+		sess.reply(501, "5.5.2 Invalid base64")
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// identify returns the source of the client, nil when it may not relay
+func (sess *session) identify() *Source {
+	table := sess.s.table.Load()
+	if sess.authenticated {
+		return table.byID(sess.serviceID)
+	}
+	if sess.s.opts.RequireAuth {
+		return nil
+	}
+	return table.byAddress(sess.client)
+}
+
+// mail starts a transaction with MAIL FROM:<address> [SIZE=n]
+func (sess *session) mail(arg string) {
+	s := sess.s
+	if sess.helo == "" {
+		sess.reply(503, "5.5.1 Send EHLO first")
+		return
+	}
+	if sess.source != nil {
+		sess.reply(503, "5.5.1 Nested MAIL command")
+		return
+	}
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	if s.opts.RequireAuth && !sess.authenticated {
+		sess.reply(530, "5.7.0 Authentication required")
+		return
+	}
+
+	source := sess.identify()
+	if source == nil || source.Route == nil {
+		s.finish(sess, UnknownService, nil, from, nil, 0, ResultRejected, "550 5.7.1 Relaying denied", false)
+		sess.reply(550, "5.7.1 Relaying denied")
+		return
+	}
+	policy := &source.Route.Policy
+	if !policy.AllowsSender(from) {
+		s.finish(sess, source.Service, source.Route, from, nil, 0, ResultRejected, "550 5.7.1 Sender domain not allowed", false)
+		sess.reply(550, "5.7.1 Sender domain not allowed")
+		return
+	}
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(key, "SIZE") {
+			if size, err := strconv.Atoi(value); err == nil && size > sess.maxSize(policy) {
+				s.finish(sess, source.Service, source.Route, from, nil, size, ResultTooLarge, "552 5.3.4 Message too large", false)
+				sess.reply(552, "5.3.4 Message too large")
+				return
+			}
+		}
+	}
+	if !s.limiter.allow(source.Service, policy.MessagesPerMinute) {
+		s.finish(sess, source.Service, source.Route, from, nil, 0, ResultRateLimited, "451 4.7.1 Message rate exceeded", false)
+		sess.reply(451, "4.7.1 Message rate exceeded, try again later")
+		return
+	}
+
+	sess.source, sess.from = source, from
+	sess.reply(250, "2.1.0 OK")
+}
+
+// rcpt adds a recipient with RCPT TO:<address>
+func (sess *session) rcpt(arg string) {
+	s := sess.s
+	if sess.source == nil {
+		sess.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	to, _, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	policy := &sess.source.Route.Policy
+	if len(sess.rcpts) >= policy.maxRecipients() {
+		sess.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	if !policy.AllowsRecipient(to) {
+		sess.rejected = append(sess.rejected, to)
+		s.mu.Lock()
+		s.recipientsRejected[sess.source.Service]++
+		s.mu.Unlock()
+		sess.reply(550, "5.7.1 Recipient domain not allowed")
+		return
+	}
+	sess.rcpts = append(sess.rcpts, to)
+	sess.reply(250, "2.1.5 OK")
+}
+
+// data receives the message and relays it, false when the connection broke
+func (sess *session) data(ctx context.Context) bool {
+	s := sess.s
+	switch {
+	case sess.source == nil:
+		sess.reply(503, "5.5.1 Send MAIL first")
+		return true
+	case len(sess.rcpts) == 0:
+		sess.reply(554, "5.5.1 No valid recipients")
+		return true
+	}
+	source := sess.source
+	defer sess.reset()
+
+	sess.reply(354, "End data with <CR><LF>.<CR><LF>")
+	maxSize := sess.maxSize(&source.Route.Policy)
+	var message bytes.Buffer
+	dot := textproto.NewReader(sess.r).DotReader()
+	if _, err := io.Copy(&message, io.LimitReader(dot, int64(maxSize)+1)); err != nil {
+		return false
+	}
+	if _, err := io.Copy(io.Discard, dot); err != nil {
+		return false
+	}
+	if message.Len() > maxSize {
+		s.finish(sess, source.Service, source.Route, sess.from, sess.rcpts, message.Len(), ResultTooLarge, "552 5.3.4 Message too large", false)
+		sess.reply(552, "5.3.4 Message too large")
+		return true
+	}
+
+	upstreamTLS, err := s.deliver(ctx, source.Route, sess.from, sess.rcpts, message.Bytes())
+	sess.conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	if err != nil {
+		code, text := relayResponse(err)
+		s.finish(sess, source.Service, source.Route, sess.from, sess.rcpts, message.Len(), ResultFailed, fmt.Sprintf("%d %s", code, text), upstreamTLS)
+		sess.reply(code, "%s", text)
+		return true
+	}
+	s.finish(sess, source.Service, source.Route, sess.from, sess.rcpts, message.Len(), ResultDelivered, "250 2.0.0 Message relayed", upstreamTLS)
+	sess.reply(250, "2.0.0 Message relayed")
+	return true
+}
+
+// maxSize returns the message size limit under a policy
+func (sess *session) maxSize(policy *Policy) int {
+	if policy.MaxMessageSize > 0 && policy.MaxMessageSize < sess.s.opts.MaxMessageSize {
+		return policy.MaxMessageSize
+	}
+	return sess.s.opts.MaxMessageSize
+}
+
+// parsePath parses "FROM:<address> PARAMS" or "TO:<address> PARAMS"
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	address := rest[1:end]
+	// Source routes are ignored (RFC 5321 section 4.1.2)
+	if i := strings.IndexByte(address, ':'); i >= 0 && strings.HasPrefix(address, "@") {
+		address = address[i+1:]
+	}
+	if strings.ContainsAny(address, " \r\n<>") {
+		return "", nil, false
+	}
+	return address, strings.Fields(rest[end+1:]), true
+}
+
+// finish counts and logs the outcome of a transaction
+func (s *Server) finish(sess *session, service string, route *Route, from string, rcpts []string, size int, result, response string, upstreamTLS bool) {
+	s.mu.Lock()
+	results, ok := s.counts[service]
+	if !ok {
+		results = make(map[string]int64)
+		s.counts[service] = results
+	}
+	results[result]++
+	if result == ResultDelivered {
+		s.bytes[service] += int64(size)
+	}
+	s.mu.Unlock()
+
+	if s.opts.Log == nil {
+		return
+	}
+	entry := envelopeLogEntry{
+		Time:          time.Now().UTC(),
+		Service:       service,
+		Client:        sess.client.String(),
+		Helo:          sess.helo,
+		ClientTLS:     sess.tls,
+		From:          from,
+		To:            rcpts,
+		RejectedTo:    sess.rejected,
+		Size:          size,
+		Result:        result,
+		Response:      response,
+		UpstreamTLS:   upstreamTLS,
+		Authenticated: sess.authenticated,
+	}
+	if route != nil {
+		entry.Mapping, entry.Relay = route.Mapping, route.Relay
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.opts.Log.Write(append(line, '\n'))
+}
+
+// envelopeLogEntry is one line of the envelope log
+type envelopeLogEntry struct {
+	Time          time.Time `json:"time"`
+	Service       string    `json:"service"`
+	Mapping       string    `json:"mapping,omitempty"`
+	Client        string    `json:"client"`
+	Helo          string    `json:"helo"`
+	ClientTLS     bool      `json:"client_tls"`
+	Authenticated bool      `json:"authenticated"`
+	From          string    `json:"mail_from"`
+	To            []string  `json:"rcpt_to,omitempty"`
+	RejectedTo    []string  `json:"rejected_rcpt_to,omitempty"`
+	Size          int       `json:"size"`
+	Relay         string    `json:"relay,omitempty"`
+	UpstreamTLS   bool      `json:"upstream_tls"`
+	Result        string    `json:"result"`
+	Response      string    `json:"response"`
+}
+
+// Counts returns messages by service and result
+func (s *Server) Counts() map[string]map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]map[string]int64, len(s.counts))
+	for service, results := range s.counts {
+		copied := make(map[string]int64, len(results))
+		for result, n := range results {
+			copied[result] = n
+		}
+		counts[service] = copied
+	}
+	return counts
+}
+
+// WritePrometheus writes message, byte and rejection counts in Prometheus
+// text format
+func (s *Server) WritePrometheus(w io.Writer) {
+	if s == nil {
+		return
+	}
+	counts := s.Counts()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	services := make([]string, 0, len(counts))
+	for service := range counts {
+		services = append(services, service)
+	}
+	for service := range s.recipientsRejected {
+		if _, ok := counts[service]; !ok {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+
+	fmt.Fprintf(w, "# HELP marchproxy_smtp_messages_total SMTP messages per source service and result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_smtp_messages_total counter\n")
+	for _, service := range services {
+		for _, result := range []string{ResultDelivered, ResultFailed, ResultRateLimited, ResultRejected, ResultTooLarge} {
+			if n, ok := counts[service][result]; ok {
+				fmt.Fprintf(w, "marchproxy_smtp_messages_total{service=%q,result=%q} %d\n", service, result, n)
+			}
+		}
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_smtp_bytes_total Bytes of relayed messages per source service\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_smtp_bytes_total counter\n")
+	for _, service := range services {
+		if n, ok := s.bytes[service]; ok {
+			fmt.Fprintf(w, "marchproxy_smtp_bytes_total{service=%q} %d\n", service, n)
+		}
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_smtp_recipients_rejected_total Recipients refused by the domain allow list\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_smtp_recipients_rejected_total counter\n")
+	for _, service := range services {
+		if n, ok := s.recipientsRejected[service]; ok {
+			fmt.Fprintf(w, "marchproxy_smtp_recipients_rejected_total{service=%q} %d\n", service, n)
+		}
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_smtp_auth_failures_total Failed SMTP AUTH attempts\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_smtp_auth_failures_total counter\n")
+	fmt.Fprintf(w, "marchproxy_smtp_auth_failures_total %d\n", s.authFailures)
+}
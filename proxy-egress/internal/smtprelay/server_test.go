@@ -0,0 +1,328 @@
+package smtprelay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustPrefixes(t *testing.T, cidrs ...string) []netip.Prefix {
+	t.Helper()
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefixes = append(prefixes, netip.MustParsePrefix(cidr))
+	}
+	return prefixes
+}
+
+// fakeRelay is an SMTP server that records the messages it accepts
+type fakeRelay struct {
+	addr string
+
+	mu       sync.Mutex
+	messages []relayedMessage
+}
+
+type relayedMessage struct {
+	from  string
+	rcpts []string
+	data  string
+}
+
+func newFakeRelay(t *testing.T) *fakeRelay {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	relay := &fakeRelay{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go relay.serve(conn)
+		}
+	}()
+	return relay
+}
+
+func (f *fakeRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 relay.test ESMTP")
+
+	var msg relayedMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			text.PrintfLine("250-relay.test")
+			text.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			msg = relayedMessage{from: pathOf(arg)}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt := pathOf(arg)
+			if strings.HasPrefix(rcpt, "bounce@") {
+				text.PrintfLine("550 No such user")
+				continue
+			}
+			msg.rcpts = append(msg.rcpts, rcpt)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			f.mu.Lock()
+			f.messages = append(f.messages, msg)
+			f.mu.Unlock()
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Unknown")
+		}
+	}
+}
+
+// pathOf returns the address of a MAIL or RCPT argument
+func pathOf(arg string) string {
+	start, end := strings.IndexByte(arg, '<'), strings.IndexByte(arg, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
+
+func (f *fakeRelay) received() []relayedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]relayedMessage(nil), f.messages...)
+}
+
+// startServer serves s on a loopback listener until the test ends
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, listener, false)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// send submits one message, returning the first error
+func send(addr string, auth smtp.Auth, from string, rcpts []string, body string) error {
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Hello("app.test"); err != nil {
+		return err
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	accepted := 0
+	var rcptErr error
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil {
+			rcptErr = err
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return rcptErr
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, body)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// replyCode returns the SMTP code of an error, 0 for other errors
+func replyCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func TestServerRelay(t *testing.T) {
+	relay := newFakeRelay(t)
+	var log bytes.Buffer
+	s := NewServer(Options{Hostname: "egress.test", Log: &log, Timeout: 5 * time.Second})
+	s.SetTable(&Table{Sources: []Source{{
+		ServiceID: 1,
+		Service:   "web",
+		Networks:  mustPrefixes(t, "127.0.0.0/8"),
+		Route: &Route{
+			Mapping: "web-mail",
+			Relay:   relay.addr,
+			Policy: Policy{
+				AllowedRecipientDomains: []string{"example.com"},
+				AllowedSenderDomains:    []string{"corp.example"},
+				MessagesPerMinute:       2,
+				MaxMessageSize:          1024,
+			},
+		},
+	}}})
+	addr := startServer(t, s)
+
+	// The recipient outside the allow list is dropped, the rest relayed
+	body := "Subject: hello\r\n\r\n.leading dot\r\nbye\r\n"
+	if err := send(addr, nil, "app@corp.example", []string{"ops@example.com", "ops@example.org"}, body); err != nil {
+		t.Fatalf("Expected the message to be relayed: %v", err)
+	}
+	messages := relay.received()
+	if len(messages) != 1 || messages[0].from != "app@corp.example" || len(messages[0].rcpts) != 1 || messages[0].rcpts[0] != "ops@example.com" {
+		t.Fatalf("Unexpected relayed messages %+v", messages)
+	}
+	if !strings.Contains(messages[0].data, "\n.leading dot\n") {
+		t.Errorf("Expected the body to survive dot stuffing, got %q", messages[0].data)
+	}
+
+	if err := send(addr, nil, "app@evil.example", []string{"ops@example.com"}, body); replyCode(err) != 550 {
+		t.Errorf("Expected the sender to be refused with 550, got %v", err)
+	}
+	if err := send(addr, nil, "app@corp.example", []string{"ops@example.com"}, strings.Repeat("x", 2048)); replyCode(err) != 552 {
+		t.Errorf("Expected the message to be too large, got %v", err)
+	}
+	if err := send(addr, nil, "app@corp.example", []string{"ops@example.com"}, body); replyCode(err) != 451 {
+		t.Errorf("Expected the rate limit after two messages, got %v", err)
+	}
+
+	counts := s.Counts()
+	if counts["web"][ResultDelivered] != 1 || counts["web"][ResultRejected] != 1 ||
+		counts["web"][ResultTooLarge] != 1 || counts["web"][ResultRateLimited] != 1 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], `"rejected_rcpt_to":["ops@example.org"]`) || !strings.Contains(lines[0], `"result":"delivered"`) {
+		t.Errorf("Unexpected envelope log:\n%s", log.String())
+	}
+	if strings.Contains(log.String(), "leading dot") {
+		t.Error("Expected message bodies not to be logged")
+	}
+
+	var metrics bytes.Buffer
+	s.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `marchproxy_smtp_messages_total{service="web",result="delivered"} 1`) ||
+		!strings.Contains(metrics.String(), `marchproxy_smtp_recipients_rejected_total{service="web"} 1`) {
+		t.Errorf("Unexpected metrics:\n%s", metrics.String())
+	}
+}
+
+func TestServerRelayFailures(t *testing.T) {
+	relay := newFakeRelay(t)
+	s := NewServer(Options{Timeout: 5 * time.Second})
+	table := &Table{Sources: []Source{{
+		Service:  "web",
+		Networks: mustPrefixes(t, "127.0.0.0/8"),
+		Route:    &Route{Mapping: "web-mail", Relay: relay.addr},
+	}}}
+	s.SetTable(table)
+	addr := startServer(t, s)
+
+	// A permanent relay failure stays permanent
+	if err := send(addr, nil, "app@corp.example", []string{"bounce@example.com"}, "hi\r\n"); replyCode(err) != 554 {
+		t.Errorf("Expected 554 for a relay rejection, got %v", err)
+	}
+
+	// The relay offers no STARTTLS
+	table.Sources[0].Route.Policy.RequireTLS = true
+	if err := send(addr, nil, "app@corp.example", []string{"ops@example.com"}, "hi\r\n"); replyCode(err) != 554 {
+		t.Errorf("Expected 554 without STARTTLS, got %v", err)
+	}
+
+	// Nothing listens on the relay port
+	table.Sources[0].Route.Policy.RequireTLS = false
+	table.Sources[0].Route.Relay = "127.0.0.1:1"
+	if err := send(addr, nil, "app@corp.example", []string{"ops@example.com"}, "hi\r\n"); replyCode(err) != 451 {
+		t.Errorf("Expected 451 for an unreachable relay, got %v", err)
+	}
+
+	if len(relay.received()) != 0 {
+		t.Errorf("Expected nothing relayed, got %+v", relay.received())
+	}
+	if counts := s.Counts(); counts["web"][ResultFailed] != 3 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	relay := newFakeRelay(t)
+	s := NewServer(Options{
+		Timeout:     5 * time.Second,
+		RequireAuth: true,
+		Authenticate: func(serviceID int, token string) error {
+			if serviceID != 1 || token != "secret" {
+				return errors.New("invalid token")
+			}
+			return nil
+		},
+	})
+	s.SetTable(&Table{Sources: []Source{{
+		ServiceID: 1,
+		Service:   "web",
+		Route:     &Route{Mapping: "web-mail", Relay: relay.addr},
+	}}})
+	addr := startServer(t, s)
+
+	if err := send(addr, nil, "app@corp.example", []string{"ops@example.com"}, "hi\r\n"); replyCode(err) != 530 {
+		t.Errorf("Expected 530 without authentication, got %v", err)
+	}
+	if err := send(addr, smtp.PlainAuth("", "1", "wrong", "127.0.0.1"), "app@corp.example", []string{"ops@example.com"}, "hi\r\n"); replyCode(err) != 535 {
+		t.Errorf("Expected 535 for a wrong token, got %v", err)
+	}
+	if err := send(addr, smtp.PlainAuth("", "1", "secret", "127.0.0.1"), "app@corp.example", []string{"ops@example.com"}, "hi\r\n"); err != nil {
+		t.Errorf("Expected the authenticated message to be relayed: %v", err)
+	}
+	if len(relay.received()) != 1 {
+		t.Errorf("Expected one relayed message, got %+v", relay.received())
+	}
+}
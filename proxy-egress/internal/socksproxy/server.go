@@ -0,0 +1,561 @@
+package socksproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion       = 0x05
+	userPassVersion    = 0x01
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	commandConnect      = 0x01
+	commandBind         = 0x02
+	commandUDPAssociate = 0x03
+
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+)
+
+// Reply codes
+const (
+	replySucceeded          = 0x00
+	replyGeneralFailure     = 0x01
+	replyNotAllowed         = 0x02
+	replyNetworkUnreachable = 0x03
+	replyHostUnreachable    = 0x04
+	replyConnectionRefused  = 0x05
+	replyCommandUnsupported = 0x07
+	replyAddressUnsupported = 0x08
+)
+
+// Request results, counted per service and command
+const (
+	ResultGranted     = "granted"
+	ResultDenied      = "denied"
+	ResultAuthFailed  = "auth_failed"
+	ResultDialFailed  = "dial_failed"
+	ResultUnsupported = "unsupported"
+)
+
+// UnknownService is the service reported for clients of no known source
+const UnknownService = "unknown"
+
+const (
+	// DefaultTimeout bounds the handshake and the outbound dial
+	DefaultTimeout = 10 * time.Second
+	// DefaultUDPIdleTimeout ends UDP associations without datagrams
+	DefaultUDPIdleTimeout = time.Minute
+	// relayBufferSize is the buffer of each TCP relay direction
+	relayBufferSize = 32 << 10
+)
+
+// Options configure a server
+type Options struct {
+	Timeout        time.Duration // handshake and outbound dial
+	UDPIdleTimeout time.Duration
+	RequireAuth    bool // identify clients only by username and password, not by address
+
+	// Authenticate verifies the token of a service, which is the password
+	// of its username. Username authentication isn't offered when nil.
+	Authenticate func(serviceID int, token string) error
+
+	// Resolver looks up destination names that no route lists, so they can
+	// be matched against the routes' addresses. net.DefaultResolver when nil.
+	Resolver *net.Resolver
+}
+
+// Server accepts SOCKS5 clients and relays their allowed connections and
+// datagrams
+type Server struct {
+	opts  Options
+	table atomic.Pointer[Table]
+
+	mu           sync.Mutex
+	requests     map[requestKey]int64
+	bytes        map[string]int64 // service -> relayed bytes
+	associations int64            // open UDP associations
+}
+
+// requestKey identifies one request counter
+type requestKey struct {
+	service string
+	command string
+	result  string
+}
+
+// NewServer creates a server. It refuses every request until a table is set.
+func NewServer(opts Options) *Server {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.UDPIdleTimeout <= 0 {
+		opts.UDPIdleTimeout = DefaultUDPIdleTimeout
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	return &Server{
+		opts:     opts,
+		requests: make(map[requestKey]int64),
+		bytes:    make(map[string]int64),
+	}
+}
+
+// SetTable replaces the sources for the following requests
+func (s *Server) SetTable(table *Table) {
+	s.table.Store(table)
+}
+
+// Serve accepts SOCKS5 clients from listener until ctx is done
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// client is an identified SOCKS client
+type client struct {
+	source        *Source
+	authenticated bool
+	addr          netip.Addr
+}
+
+// service returns the client's service for metrics
+func (c *client) service() string {
+	if c.source == nil {
+		return UnknownService
+	}
+	return c.source.Service
+}
+
+// serveConn runs the handshake and the request of one client
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-connDone:
+		}
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	r := bufio.NewReader(conn)
+	c, err := s.negotiate(conn, r)
+	if err != nil {
+		return
+	}
+
+	command, host, port, err := readRequest(r)
+	if err != nil {
+		if errors.Is(err, errAddressUnsupported) {
+			writeReply(conn, replyAddressUnsupported, nil)
+		}
+		return
+	}
+
+	switch command {
+	case commandConnect:
+		s.connect(ctx, conn, r, c, host, port)
+	case commandUDPAssociate:
+		s.associate(ctx, conn, r, c, port)
+	default:
+		s.count(c.service(), commandName(command), ResultUnsupported)
+		writeReply(conn, replyCommandUnsupported, nil)
+	}
+}
+
+// negotiate selects an authentication method and identifies the client
+func (s *Server) negotiate(conn net.Conn, r *bufio.Reader) (*client, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+
+	c := &client{addr: remoteAddr(conn)}
+	table := s.table.Load()
+	switch {
+	case s.opts.Authenticate != nil && bytesContain(methods, methodUserPass):
+		if _, err := conn.Write([]byte{socksVersion, methodUserPass}); err != nil {
+			return nil, err
+		}
+		username, password, err := readUserPass(r)
+		if err != nil {
+			return nil, err
+		}
+		source := table.byUsername(username)
+		if source == nil || s.opts.Authenticate(source.ServiceID, password) != nil {
+			service := UnknownService
+			if source != nil {
+				service = source.Service
+			}
+			s.count(service, "auth", ResultAuthFailed)
+			conn.Write([]byte{userPassVersion, 0x01})
+			return nil, fmt.Errorf("authentication failed for %q", username)
+		}
+		if _, err := conn.Write([]byte{userPassVersion, 0x00}); err != nil {
+			return nil, err
+		}
+		c.source, c.authenticated = source, true
+	case !s.opts.RequireAuth && bytesContain(methods, methodNoAuth):
+		if _, err := conn.Write([]byte{socksVersion, methodNoAuth}); err != nil {
+			return nil, err
+		}
+		c.source = table.byAddr(c.addr)
+	default:
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return nil, fmt.Errorf("no acceptable authentication method")
+	}
+	return c, nil
+}
+
+// readUserPass reads a username/password request (RFC 1929)
+func readUserPass(r *bufio.Reader) (string, string, error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if version != userPassVersion {
+		return "", "", fmt.Errorf("unsupported username/password version %d", version)
+	}
+	username, err := readField(r)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readField(r)
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
+
+// readField reads a string prefixed by its one byte length
+func readField(r *bufio.Reader) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return "", err
+	}
+	return string(field), nil
+}
+
+var errAddressUnsupported = errors.New("address type not supported")
+
+// readRequest reads a request's command and destination
+func readRequest(r io.Reader) (byte, string, int, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", 0, err
+	}
+	if header[0] != socksVersion {
+		return 0, "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	host, port, err := readAddr(r)
+	return header[1], host, port, err
+}
+
+// readAddr reads an ATYP, address and port. Names are lower-cased.
+func readAddr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case addrIPv4, addrIPv6:
+		size := net.IPv4len
+		if atyp[0] == addrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.Unmap().String()
+	case addrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = strings.TrimSuffix(strings.ToLower(string(name)), ".")
+	default:
+		return "", 0, errAddressUnsupported
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// appendAddr appends the ATYP, address and port of host
+func appendAddr(b []byte, host string, port int) []byte {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() {
+			b = append(b, addrIPv4)
+		} else {
+			b = append(b, addrIPv6)
+		}
+		b = append(b, addr.AsSlice()...)
+	} else {
+		b = append(b, addrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeReply writes a reply with the bound address, zeros when nil
+func writeReply(conn net.Conn, code byte, bound *net.TCPAddr) error {
+	host, port := "0.0.0.0", 0
+	if bound != nil {
+		host, port = bound.IP.String(), bound.Port
+	}
+	_, err := conn.Write(appendAddr([]byte{socksVersion, code, 0x00}, host, port))
+	return err
+}
+
+// authorize returns the route and address for a destination. Names no
+// route lists are resolved, and the first address a route allows is used.
+func (s *Server) authorize(ctx context.Context, c *client, network, host string, port int) (*Route, string) {
+	if c.source == nil {
+		return nil, ""
+	}
+	now := time.Now()
+	if route := c.source.route(network, host, port, c.authenticated, now); route != nil {
+		return route, host
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil, ""
+	}
+
+	addrs, err := s.opts.Resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, ""
+	}
+	for _, addr := range addrs {
+		resolved := addr.Unmap().String()
+		if route := c.source.route(network, resolved, port, c.authenticated, now); route != nil {
+			return route, resolved
+		}
+	}
+	return nil, ""
+}
+
+// dial connects to an allowed destination through the route
+func (s *Server) dial(ctx context.Context, route *Route, network, host string, port int) (net.Conn, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if route.Dial != nil {
+		return route.Dial(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// connect serves a CONNECT request
+func (s *Server) connect(ctx context.Context, conn net.Conn, r *bufio.Reader, c *client, host string, port int) {
+	service := c.service()
+	dialCtx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+
+	route, address := s.authorize(dialCtx, c, "tcp", host, port)
+	if route == nil {
+		s.count(service, "connect", ResultDenied)
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+	dest, err := s.dial(dialCtx, route, "tcp", address, port)
+	if err != nil {
+		s.count(service, "connect", ResultDialFailed)
+		writeReply(conn, dialReply(err), nil)
+		return
+	}
+	defer dest.Close()
+
+	bound, _ := dest.LocalAddr().(*net.TCPAddr)
+	if err := writeReply(conn, replySucceeded, bound); err != nil {
+		return
+	}
+	s.count(service, "connect", ResultGranted)
+	conn.SetDeadline(time.Time{})
+
+	// Relay both directions; bytes the client sent after its request are
+	// still buffered in r
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.CopyBuffer(dest, r, make([]byte, relayBufferSize))
+		closeWrite(dest)
+		done <- n
+	}()
+	n, _ := io.CopyBuffer(conn, dest, make([]byte, relayBufferSize))
+	closeWrite(conn)
+	n += <-done
+	s.addBytes(service, n)
+}
+
+// dialReply maps a dial error to a reply code
+func dialReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, context.DeadlineExceeded):
+		return replyHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return replyHostUnreachable
+	}
+	return replyGeneralFailure
+}
+
+// closeWrite half-closes conn when it supports it, or closes it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// remoteAddr returns the client address of conn
+func remoteAddr(conn net.Conn) netip.Addr {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(addr.IP)
+		return ip.Unmap()
+	}
+	return netip.Addr{}
+}
+
+func bytesContain(values []byte, value byte) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// commandName names a request command for metrics
+func commandName(command byte) string {
+	switch command {
+	case commandConnect:
+		return "connect"
+	case commandBind:
+		return "bind"
+	case commandUDPAssociate:
+		return "udp_associate"
+	}
+	return "unknown"
+}
+
+// count counts one request
+func (s *Server) count(service, command, result string) {
+	s.mu.Lock()
+	s.requests[requestKey{service: service, command: command, result: result}]++
+	s.mu.Unlock()
+}
+
+// addBytes counts relayed bytes of a service
+func (s *Server) addBytes(service string, n int64) {
+	s.mu.Lock()
+	s.bytes[service] += n
+	s.mu.Unlock()
+}
+
+// WritePrometheus writes the SOCKS request, byte and association metrics
+func (s *Server) WritePrometheus(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP marchproxy_socks_requests_total SOCKS5 requests by source service, command and result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_socks_requests_total counter\n")
+	keys := make([]requestKey, 0, len(s.requests))
+	for key := range s.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.command != b.command {
+			return a.command < b.command
+		}
+		return a.result < b.result
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_socks_requests_total{service=%q,command=%q,result=%q} %d\n", key.service, key.command, key.result, s.requests[key])
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_socks_bytes_total Bytes relayed for SOCKS5 clients by source service\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_socks_bytes_total counter\n")
+	services := make([]string, 0, len(s.bytes))
+	for service := range s.bytes {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		fmt.Fprintf(w, "marchproxy_socks_bytes_total{service=%q} %d\n", service, s.bytes[service])
+	}
+
+	fmt.Fprintf(w, "# HELP marchproxy_socks_udp_associations Open SOCKS5 UDP associations\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_socks_udp_associations gauge\n")
+	fmt.Fprintf(w, "marchproxy_socks_udp_associations %d\n", s.associations)
+}
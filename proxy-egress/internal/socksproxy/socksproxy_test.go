@@ -0,0 +1,242 @@
+package socksproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// echoServers starts a TCP and a UDP echo server on 127.0.0.1, returning
+// their ports
+func echoServers(t *testing.T) (int, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packetConn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, packetConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startServer serves a table where service 7 "api" may reach 127.0.0.1 on
+// tcpPort over TCP and on udpPort over UDP, and reach "echo.internal" on
+// tcpPort once authenticated
+func startServer(t *testing.T, opts Options, tcpPort, udpPort int) string {
+	t.Helper()
+	opts.Authenticate = func(serviceID int, token string) error {
+		if serviceID != 7 || token != "secret" {
+			return fmt.Errorf("invalid token")
+		}
+		return nil
+	}
+	opts.Resolver = &net.Resolver{PreferGo: true, Dial: func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("no DNS in tests")
+	}}
+	server := NewServer(opts)
+	loopback := netip.MustParsePrefix("127.0.0.1/32")
+	server.SetTable(&Table{Sources: []Source{{
+		ServiceID: 7,
+		Service:   "api",
+		Networks:  []netip.Prefix{loopback},
+		Routes: []*Route{
+			{Mapping: "tcp", Networks: []string{"tcp"}, Prefixes: []netip.Prefix{loopback}, Ports: []PortRange{{tcpPort, tcpPort}}},
+			{Mapping: "udp", Networks: []string{"udp"}, Prefixes: []netip.Prefix{loopback}, Ports: []PortRange{{udpPort, udpPort}}},
+			{
+				Mapping:      "named",
+				Networks:     []string{"tcp"},
+				Hosts:        []string{"echo.internal"},
+				AuthRequired: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, fmt.Sprintf("127.0.0.1:%d", tcpPort))
+				},
+			},
+		},
+	}}})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.Serve(ctx, listener)
+	return listener.Addr().String()
+}
+
+// echo writes a line through conn and expects it back
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping\n" {
+		t.Fatalf("Echo = %q, %v", reply, err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	tcpPort, udpPort := echoServers(t)
+	addr := startServer(t, Options{RequireAuth: true}, tcpPort, udpPort)
+	target := fmt.Sprintf("127.0.0.1:%d", tcpPort)
+
+	for _, username := range []string{"7", "api"} {
+		dialer, _ := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: username, Password: "secret"}, proxy.Direct)
+		conn, err := dialer.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("Dial as %s: %v", username, err)
+		}
+		echo(t, conn)
+	}
+
+	// Named destinations are matched by name, before resolving
+	dialer, _ := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "api", Password: "secret"}, proxy.Direct)
+	conn, err := dialer.Dial("tcp", fmt.Sprintf("echo.internal:%d", tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+
+	if _, err := dialer.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", udpPort)); err == nil {
+		t.Error("Expected a port outside the mapping to be refused")
+	}
+
+	dialer, _ = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "7", Password: "wrong"}, proxy.Direct)
+	if _, err := dialer.Dial("tcp", target); err == nil {
+		t.Error("Expected a wrong token to be refused")
+	}
+	dialer, _ = proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if _, err := dialer.Dial("tcp", target); err == nil {
+		t.Error("Expected an unauthenticated client to be refused")
+	}
+
+	var metrics strings.Builder
+	server := NewServer(Options{})
+	server.count("api", "connect", ResultGranted)
+	server.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `marchproxy_socks_requests_total{service="api",command="connect",result="granted"} 1`) {
+		t.Errorf("Metrics:\n%s", metrics.String())
+	}
+}
+
+// TestConnectByAddress tests clients known by address reach only routes
+// without required authentication
+func TestConnectByAddress(t *testing.T) {
+	tcpPort, udpPort := echoServers(t)
+	addr := startServer(t, Options{}, tcpPort, udpPort)
+
+	dialer, _ := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	conn, err := dialer.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+
+	if _, err := dialer.Dial("tcp", fmt.Sprintf("echo.internal:%d", tcpPort)); err == nil {
+		t.Error("Expected a route requiring authentication to be refused")
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	tcpPort, udpPort := echoServers(t)
+	addr := startServer(t, Options{RequireAuth: true}, tcpPort, udpPort)
+
+	control, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Username/password, then UDP ASSOCIATE from any port
+	control.Write([]byte{socksVersion, 1, methodUserPass})
+	control.Write(append(append([]byte{userPassVersion, 3}, "api"...), append([]byte{6}, "secret"...)...))
+	handshake := make([]byte, 4)
+	if _, err := io.ReadFull(control, handshake); err != nil || handshake[1] != methodUserPass || handshake[3] != 0 {
+		t.Fatalf("Handshake = %v, %v", handshake, err)
+	}
+	control.Write(appendAddr([]byte{socksVersion, commandUDPAssociate, 0}, "0.0.0.0", 0))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(control, reply); err != nil || reply[1] != replySucceeded {
+		t.Fatalf("Reply = %v, %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A denied destination is dropped, an allowed one echoed back with its
+	// address
+	conn.Write(append(appendAddr([]byte{0, 0, 0}, "127.0.0.1", tcpPort), "denied"...))
+	header := appendAddr([]byte{0, 0, 0}, "127.0.0.1", udpPort)
+	conn.Write(append(header, "hello"...))
+	datagram := make([]byte, 2048)
+	n, err := conn.Read(datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, payload, err := parseDatagram(datagram[:n])
+	if err != nil || host != "127.0.0.1" || port != udpPort || string(payload) != "hello" {
+		t.Errorf("Reply = %s:%d %q, %v", host, port, payload, err)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ranges, err := ParsePorts("80, 443,8000-8100")
+	if err != nil || len(ranges) != 3 || ranges[2] != (PortRange{8000, 8100}) {
+		t.Fatalf("ParsePorts = %v, %v", ranges, err)
+	}
+	route := &Route{Ports: ranges}
+	if !route.allowsPort(8050) || route.allowsPort(8101) {
+		t.Error("Port ranges not applied")
+	}
+	for _, spec := range []string{"0", "80-70", "http"} {
+		if _, err := ParsePorts(spec); err == nil {
+			t.Errorf("ParsePorts(%q) succeeded", spec)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package socksproxy accepts standard SOCKS5 clients (RFC 1928) on the
+// egress proxy, so applications that can't speak the MARCHPROXY_AUTH
+// handshake still leave the cluster through their mappings.
+//
+// Clients authenticate with a username and password (RFC 1929): the
+// username is their service ID or name, and the password its Base64 token
+// or JWT. Without required authentication, clients may instead be known by
+// the service their address belongs to. Each CONNECT and UDP ASSOCIATE
+// datagram is checked against the routes of the client's service, built
+// from the mappings it is a source of: the destination must be one of the
+// mapping's destination services, on one of its ports.
+package socksproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Table holds the services allowed to use the SOCKS listener
+type Table struct {
+	Sources []Source
+}
+
+// Source is a client service and the routes of its mappings
+type Source struct {
+	ServiceID int
+	Service   string
+	Networks  []netip.Prefix // Client addresses of the service
+	Routes    []*Route
+}
+
+// Route is one mapping a service may reach destinations through
+type Route struct {
+	Mapping      string
+	Networks     []string       // tcp and/or udp
+	Hosts        []string       // Destination host names, lower-case
+	Prefixes     []netip.Prefix // Destination addresses
+	Ports        []PortRange    // Destination ports, empty allows any
+	AuthRequired bool           // Only for clients that authenticated
+
+	// Active reports whether the mapping is within its schedule, nil when
+	// it is always active
+	Active func(now time.Time) bool
+
+	// Dial connects to an allowed destination with the mapping's outbound
+	// options, a net.Dialer when nil
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// PortRange is an inclusive range of destination ports
+type PortRange struct {
+	Low, High int
+}
+
+// ParsePorts parses a mapping's port spec: a port, a range (a-b) or a
+// comma-separated list of either. An empty spec allows any port.
+func ParsePorts(spec string) ([]PortRange, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var ranges []PortRange
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil || low < 1 || low > 65535 {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		high := low
+		if len(bounds) == 2 {
+			high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil || high < low || high > 65535 {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		ranges = append(ranges, PortRange{Low: low, High: high})
+	}
+	return ranges, nil
+}
+
+// byUsername returns the source with the username, a service ID or name
+func (t *Table) byUsername(username string) *Source {
+	if t == nil {
+		return nil
+	}
+	id, err := strconv.Atoi(username)
+	for i := range t.Sources {
+		source := &t.Sources[i]
+		if (err == nil && source.ServiceID == id) || (err != nil && source.Service == username) {
+			return source
+		}
+	}
+	return nil
+}
+
+// byAddr returns the source the client address belongs to
+func (t *Table) byAddr(addr netip.Addr) *Source {
+	if t == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for i := range t.Sources {
+		for _, network := range t.Sources[i].Networks {
+			if network.Contains(addr) {
+				return &t.Sources[i]
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether the route lets an authenticated or address-known
+// client reach host on port over network at now. host is a lower-case
+// name or an address.
+func (r *Route) allows(network, host string, port int, authenticated bool, now time.Time) bool {
+	if r.AuthRequired && !authenticated {
+		return false
+	}
+	if !contains(r.Networks, network) || !r.allowsPort(port) {
+		return false
+	}
+	if r.Active != nil && !r.Active(now) {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range r.Prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return contains(r.Hosts, host)
+}
+
+// allowsPort reports whether port is one of the route's ports
+func (r *Route) allowsPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, ports := range r.Ports {
+		if port >= ports.Low && port <= ports.High {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the first route allowing the destination, nil for none
+func (s *Source) route(network, host string, port int, authenticated bool, now time.Time) *Route {
+	for _, route := range s.Routes {
+		if route.allows(network, host, port, authenticated, now) {
+			return route
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package socksproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxUDPDestinations bounds the destinations of one association
+	maxUDPDestinations = 256
+	// maxDatagram is the largest UDP payload
+	maxDatagram = 65535
+)
+
+// association relays the datagrams of one UDP ASSOCIATE request
+type association struct {
+	s      *Server
+	c      *client
+	relay  *net.UDPConn
+	client netip.AddrPort // Where datagrams come from and replies go
+
+	dests      map[string]net.Conn // host:port -> outbound socket, nil when denied
+	lastActive atomic.Int64        // unix nanoseconds of the last datagram either way
+	wg         sync.WaitGroup
+}
+
+// associate serves a UDP ASSOCIATE request. The association lasts until
+// the client closes the control connection or no datagram moves for the
+// idle timeout.
+func (s *Server) associate(ctx context.Context, conn net.Conn, r *bufio.Reader, c *client, port int) {
+	service := c.service()
+	if c.source == nil {
+		s.count(service, "udp_associate", ResultDenied)
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	bound := &net.TCPAddr{IP: local.IP, Port: relay.LocalAddr().(*net.UDPAddr).Port}
+	if err := writeReply(conn, replySucceeded, bound); err != nil {
+		return
+	}
+	s.count(service, "udp_associate", ResultGranted)
+	conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	s.associations++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.associations--
+		s.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, r)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		relay.Close()
+	}()
+
+	// Datagrams are only taken from the client's address, and from the
+	// port it announced in the request or else the first one it sends
+	// from. The announced address is ignored, as NAT may change it.
+	a := &association{
+		s:      s,
+		c:      c,
+		relay:  relay,
+		client: netip.AddrPortFrom(c.addr, uint16(port)),
+		dests:  make(map[string]net.Conn),
+	}
+	a.run(ctx)
+}
+
+// run relays client datagrams until the association ends
+func (a *association) run(ctx context.Context) {
+	defer func() {
+		for _, dest := range a.dests {
+			if dest != nil {
+				dest.Close()
+			}
+		}
+		a.wg.Wait()
+	}()
+
+	idle := a.s.opts.UDPIdleTimeout
+	a.lastActive.Store(time.Now().UnixNano())
+	buf := make([]byte, maxDatagram)
+	for {
+		a.relay.SetReadDeadline(time.Now().Add(idle))
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, a.lastActive.Load())) < idle {
+				continue // Replies kept the association active
+			}
+			return
+		}
+
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != a.client.Addr() {
+			continue
+		}
+		if a.client.Port() == 0 {
+			a.client = from
+		} else if from.Port() != a.client.Port() {
+			continue
+		}
+
+		host, port, payload, err := parseDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		dest := a.destination(ctx, host, port)
+		if dest == nil {
+			continue
+		}
+		if _, err := dest.Write(payload); err == nil {
+			a.lastActive.Store(time.Now().UnixNano())
+			a.s.addBytes(a.c.service(), int64(len(payload)))
+		}
+	}
+}
+
+// destination returns the outbound socket for host and port, dialing it
+// when the client's routes allow it, nil when they don't
+func (a *association) destination(ctx context.Context, host string, port int) net.Conn {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	if dest, ok := a.dests[key]; ok {
+		return dest
+	}
+	if len(a.dests) >= maxUDPDestinations {
+		return nil
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, a.s.opts.Timeout)
+	defer cancel()
+	service := a.c.service()
+	route, address := a.s.authorize(dialCtx, a.c, "udp", host, port)
+	if route == nil {
+		a.s.count(service, "udp_datagram", ResultDenied)
+		a.dests[key] = nil
+		return nil
+	}
+	dest, err := a.s.dial(dialCtx, route, "udp", address, port)
+	if err != nil {
+		a.s.count(service, "udp_datagram", ResultDialFailed)
+		a.dests[key] = nil
+		return nil
+	}
+	a.s.count(service, "udp_datagram", ResultGranted)
+	a.dests[key] = dest
+
+	// Replies are returned with the destination as the client named it
+	header := appendAddr([]byte{0x00, 0x00, 0x00}, host, port)
+	client := a.client
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := dest.Read(buf)
+			if err != nil {
+				return
+			}
+			datagram := append(append([]byte{}, header...), buf[:n]...)
+			if _, err := a.relay.WriteToUDPAddrPort(datagram, client); err != nil {
+				return
+			}
+			a.lastActive.Store(time.Now().UnixNano())
+			a.s.addBytes(service, int64(n))
+		}
+	}()
+	return dest
+}
+
+// parseDatagram splits a client datagram into its destination and
+// payload. Fragments are not supported.
+func parseDatagram(datagram []byte) (string, int, []byte, error) {
+	if len(datagram) < 4 || datagram[0] != 0 || datagram[1] != 0 {
+		return "", 0, nil, fmt.Errorf("invalid UDP request header")
+	}
+	if datagram[2] != 0 {
+		return "", 0, nil, fmt.Errorf("fragmented datagrams are not supported")
+	}
+	r := bytes.NewReader(datagram[3:])
+	host, port, err := readAddr(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, datagram[len(datagram)-r.Len():], nil
+}
@@ -0,0 +1,389 @@
+package sshaudit
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Audit actions of full mode sessions
+const (
+	ActionAuth    = "auth"          // A login attempt
+	ActionStart   = "session_start" // The client logged in at the destination
+	ActionCommand = "command"       // A shell, command or subsystem started
+	ActionForward = "forward"       // A port forward or jump host connection
+	ActionEnd     = "session_end"   // The client disconnected
+)
+
+const (
+	serverVersion  = "SSH-2.0-MarchProxy"
+	defaultTimeout = 30 * time.Second
+)
+
+// Event is one audited step of a full mode session
+type Event struct {
+	Action   string
+	User     string
+	Allowed  bool
+	Reason   string
+	Metadata map[string]interface{}
+}
+
+// BastionOptions configures a Bastion
+type BastionOptions struct {
+	HostKey      ssh.Signer          // Shown to clients
+	UpstreamKey  ssh.Signer          // Authenticates clients with authorized keys, nil disables them
+	KnownHosts   ssh.HostKeyCallback // Verifies destinations
+	RecordingDir string              // Session recordings, one directory per day
+	Timeout      time.Duration       // Per handshake, default 30s
+}
+
+// Bastion terminates the SSH connections of mappings in full mode
+type Bastion struct {
+	opts BastionOptions
+}
+
+// NewBastion creates a bastion
+func NewBastion(opts BastionOptions) (*Bastion, error) {
+	if opts.HostKey == nil || opts.KnownHosts == nil || opts.RecordingDir == "" {
+		return nil, fmt.Errorf("full SSH recording requires a host key, known hosts and a recording directory")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	return &Bastion{opts: opts}, nil
+}
+
+// LoadBastion loads the keys and known hosts from files. The upstream key
+// is optional.
+func LoadBastion(hostKeyFile, upstreamKeyFile, knownHostsFile, recordingDir string) (*Bastion, error) {
+	hostKey, err := loadSigner(hostKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH host key: %w", err)
+	}
+	var upstreamKey ssh.Signer
+	if upstreamKeyFile != "" {
+		if upstreamKey, err = loadSigner(upstreamKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load SSH upstream key: %w", err)
+		}
+	}
+	knownHosts, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH known hosts: %w", err)
+	}
+	return NewBastion(BastionOptions{HostKey: hostKey, UpstreamKey: upstreamKey, KnownHosts: knownHosts, RecordingDir: recordingDir})
+}
+
+// loadSigner loads an unencrypted private key
+func loadSigner(path string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(pem)
+}
+
+// Request is one client connection to serve
+type Request struct {
+	Client net.Conn
+	Dial   func() (net.Conn, error) // Connects to the destination, once per login attempt
+	Addr   string                   // Destination address, for known hosts
+	Policy *Policy
+	Audit  func(Event) // Called for every audited step, may be nil
+}
+
+var errNotAllowed = errors.New("not allowed")
+
+// Serve terminates the client's SSH connection and relays its channels to
+// the destination until either side disconnects
+func (b *Bastion) Serve(req Request) error {
+	audit := req.Audit
+	if audit == nil {
+		audit = func(Event) {}
+	}
+	start := time.Now()
+
+	var upstream *ssh.Client
+	login := func(meta ssh.ConnMetadata, method string, auth ssh.AuthMethod) error {
+		event := Event{Action: ActionAuth, User: meta.User(), Metadata: map[string]interface{}{"method": method, "client_version": string(meta.ClientVersion())}}
+		if !req.Policy.allowsUser(meta.User()) {
+			event.Reason = "user not allowed"
+			audit(event)
+			return errNotAllowed
+		}
+		client, err := b.connect(req, meta.User(), auth)
+		if err != nil {
+			event.Reason = err.Error()
+			audit(event)
+			return err
+		}
+		if upstream != nil {
+			upstream.Close()
+		}
+		upstream = client
+		event.Allowed = true
+		audit(event)
+		return nil
+	}
+
+	config := &ssh.ServerConfig{
+		MaxAuthTries:  3,
+		ServerVersion: serverVersion,
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, login(meta, "password", ssh.Password(string(password)))
+		},
+		// Keys are only checked here; the destination login follows once
+		// the client proved it holds the key
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if b.opts.UpstreamKey == nil || !req.Policy.authorized(key) {
+				return nil, errNotAllowed
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)}}, nil
+		},
+	}
+	config.AddHostKey(b.opts.HostKey)
+
+	req.Client.SetDeadline(time.Now().Add(b.opts.Timeout))
+	conn, chans, globalReqs, err := ssh.NewServerConn(req.Client, config)
+	if err != nil {
+		if upstream != nil {
+			upstream.Close()
+		}
+		return fmt.Errorf("SSH handshake failed: %w", err)
+	}
+	defer conn.Close()
+	if conn.Permissions != nil && conn.Permissions.Extensions["fingerprint"] != "" {
+		if err := login(conn, "publickey "+conn.Permissions.Extensions["fingerprint"], ssh.PublicKeys(b.opts.UpstreamKey)); err != nil {
+			return err
+		}
+	}
+	if upstream == nil {
+		return fmt.Errorf("SSH login without a destination connection")
+	}
+	req.Client.SetDeadline(time.Time{})
+	defer upstream.Close()
+
+	sessionID := hex.EncodeToString(conn.SessionID()[:8])
+	title := conn.User() + "@" + req.Addr
+	audit(Event{Action: ActionStart, User: conn.User(), Allowed: true, Metadata: map[string]interface{}{
+		"session_id":     sessionID,
+		"client_version": string(conn.ClientVersion()),
+		"server_version": string(upstream.ServerVersion()),
+	}})
+
+	// Remote forwarding needs listeners at the destination; refuse it
+	go ssh.DiscardRequests(globalReqs)
+
+	// End the session when the destination disconnects
+	go func() {
+		upstream.Wait()
+		conn.Close()
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var recordings []string
+	channel := 0
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel++
+			rec := newRecording(b.opts.RecordingDir, sessionID, channel, title)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.session(newChannel, upstream, rec, conn.User(), audit)
+				if path := rec.written(); path != "" {
+					mu.Lock()
+					recordings = append(recordings, path)
+					mu.Unlock()
+				}
+			}()
+		case "direct-tcpip":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.forward(newChannel, upstream, req.Policy, conn.User(), audit)
+			}()
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+	upstream.Close()
+	wg.Wait()
+
+	audit(Event{Action: ActionEnd, User: conn.User(), Allowed: true, Metadata: map[string]interface{}{
+		"session_id":  sessionID,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"recordings":  recordings,
+	}})
+	return nil
+}
+
+// connect logs in at the destination
+func (b *Bastion) connect(req Request, user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	netConn, err := req.Dial()
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(b.opts.Timeout))
+	conn, chans, reqs, err := ssh.NewClientConn(netConn, req.Addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: b.opts.KnownHosts,
+	})
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+// session relays and records a session channel
+func (b *Bastion) session(newChannel ssh.NewChannel, upstream *ssh.Client, rec *recording, user string, audit func(Event)) {
+	defer rec.close()
+
+	upstreamCh, upstreamReqs, err := upstream.OpenChannel("session", newChannel.ExtraData())
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	clientCh, clientReqs, err := newChannel.Accept()
+	if err != nil {
+		upstreamCh.Close()
+		return
+	}
+
+	// Requests that start the session, and terminal sizes, are recorded
+	// before they are relayed
+	observe := func(r *ssh.Request) {
+		switch r.Type {
+		case "pty-req":
+			var pty struct {
+				Term          string
+				Width, Height uint32
+				PixelW        uint32
+				PixelH        uint32
+				Modes         string
+			}
+			if ssh.Unmarshal(r.Payload, &pty) == nil {
+				rec.pty(pty.Term, pty.Width, pty.Height)
+			}
+		case "window-change":
+			var size struct{ Width, Height, PixelW, PixelH uint32 }
+			if ssh.Unmarshal(r.Payload, &size) == nil {
+				rec.event("r", strconv.Itoa(int(size.Width))+"x"+strconv.Itoa(int(size.Height)))
+			}
+		case "shell", "exec", "subsystem":
+			var command struct{ Value string }
+			ssh.Unmarshal(r.Payload, &command)
+			if r.Type == "subsystem" {
+				rec.disable()
+			} else {
+				rec.begin(command.Value)
+			}
+			audit(Event{Action: ActionCommand, User: user, Allowed: true, Metadata: map[string]interface{}{
+				"type":      r.Type,
+				"command":   command.Value,
+				"recording": rec.path,
+			}})
+		}
+	}
+
+	relay(clientCh, upstreamCh, clientReqs, upstreamReqs, rec.input(clientCh), rec.output(clientCh), rec.output(clientCh.Stderr()), observe)
+}
+
+// forward relays a port forwarding channel allowed by the policy
+func (b *Bastion) forward(newChannel ssh.NewChannel, upstream *ssh.Client, policy *Policy, user string, audit func(Event)) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid forwarding request")
+		return
+	}
+	event := Event{Action: ActionForward, User: user, Metadata: map[string]interface{}{
+		"target": net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))),
+	}}
+	if !policy.allowsForward(target.Host, target.Port) {
+		event.Reason = "target not allowed"
+		audit(event)
+		newChannel.Reject(ssh.Prohibited, "forwarding target not allowed")
+		return
+	}
+
+	upstreamCh, upstreamReqs, err := upstream.OpenChannel("direct-tcpip", newChannel.ExtraData())
+	if err != nil {
+		event.Reason = err.Error()
+		audit(event)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	clientCh, clientReqs, err := newChannel.Accept()
+	if err != nil {
+		upstreamCh.Close()
+		return
+	}
+	event.Allowed = true
+	audit(event)
+
+	relay(clientCh, upstreamCh, clientReqs, upstreamReqs, clientCh, clientCh, clientCh.Stderr(), nil)
+}
+
+// relay copies a channel's data and requests both ways until the
+// destination closes it or the client does. in is read from the client,
+// out and stderr write to it.
+func relay(clientCh, upstreamCh ssh.Channel, clientReqs, upstreamReqs <-chan *ssh.Request, in io.Reader, out, stderr io.Writer, observe func(*ssh.Request)) {
+	go func() {
+		io.Copy(upstreamCh, in)
+		upstreamCh.CloseWrite()
+	}()
+	go func() {
+		for r := range clientReqs {
+			if observe != nil {
+				observe(r)
+			}
+			ok, _ := upstreamCh.SendRequest(r.Type, r.WantReply, r.Payload)
+			if r.WantReply {
+				r.Reply(ok, nil)
+			}
+		}
+		upstreamCh.Close()
+	}()
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		io.Copy(out, upstreamCh)
+	}()
+	go func() {
+		defer output.Done()
+		io.Copy(stderr, upstreamCh.Stderr())
+	}()
+
+	// Exit statuses arrive as requests; the destination closing the
+	// channel ends them
+	for r := range upstreamReqs {
+		ok, _ := clientCh.SendRequest(r.Type, r.WantReply, r.Payload)
+		if r.WantReply {
+			r.Reply(ok, nil)
+		}
+	}
+	output.Wait()
+	clientCh.CloseWrite()
+	clientCh.Close()
+}
@@ -0,0 +1,280 @@
+package sshaudit
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotSSH ends a relay whose client doesn't speak SSH
+var ErrNotSSH = errors.New("client is not speaking SSH")
+
+const (
+	// maxObserved bounds the bytes buffered per direction while waiting
+	// for the version line and KEXINIT
+	maxObserved = 64 << 10
+
+	// maxPacket is the largest binary packet RFC 4253 requires support for
+	maxPacket = 35000
+
+	msgKexInit = 20
+)
+
+// Session is the metadata of one relayed SSH connection
+type Session struct {
+	ClientVersion   string
+	ServerVersion   string
+	HASSH           string // Fingerprint of the client's key exchange offer
+	HASSHServer     string // Fingerprint of the server's key exchange offer
+	Kex             string // Negotiated algorithms, empty until both offers are seen
+	HostKey         string
+	Cipher          string // Client to server
+	MAC             string // Client to server, empty for AEAD ciphers
+	BytesFromClient int64
+	BytesFromServer int64
+	Duration        time.Duration
+}
+
+// Metadata returns the session as audit event metadata
+func (s Session) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"client_version":    s.ClientVersion,
+		"server_version":    s.ServerVersion,
+		"hassh":             s.HASSH,
+		"hassh_server":      s.HASSHServer,
+		"kex":               s.Kex,
+		"host_key":          s.HostKey,
+		"cipher":            s.Cipher,
+		"mac":               s.MAC,
+		"bytes_from_client": s.BytesFromClient,
+		"bytes_from_server": s.BytesFromServer,
+		"duration_ms":       s.Duration.Milliseconds(),
+	}
+}
+
+// Observer records the handshake metadata of a relayed SSH connection from
+// both directions of the relay
+type Observer struct {
+	start  time.Time
+	mu     sync.Mutex
+	client direction
+	server direction
+}
+
+// direction is what has been observed of one side's stream
+type direction struct {
+	buf     []byte
+	off     int // Parsed bytes of buf
+	done    bool
+	version string
+	kex     [][]string // Name-lists of the KEXINIT
+	bytes   int64
+	err     error
+}
+
+// NewObserver creates an observer for one connection
+func NewObserver() *Observer {
+	return &Observer{start: time.Now()}
+}
+
+// Reader wraps one direction of the relay. Reads of the client direction
+// fail with ErrNotSSH when the client doesn't start with an SSH version
+// line. It returns r unchanged for a nil observer.
+func (o *Observer) Reader(r io.Reader, fromClient bool) io.Reader {
+	if o == nil {
+		return r
+	}
+	return &observedReader{r: r, observer: o, fromClient: fromClient}
+}
+
+type observedReader struct {
+	r          io.Reader
+	observer   *Observer
+	fromClient bool
+}
+
+func (or *observedReader) Read(b []byte) (int, error) {
+	n, err := or.r.Read(b)
+	if n > 0 {
+		if observeErr := or.observer.observe(or.fromClient, b[:n]); observeErr != nil {
+			return 0, observeErr
+		}
+	}
+	return n, err
+}
+
+// observe adds data read from one side
+func (o *Observer) observe(fromClient bool, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	d := &o.server
+	if fromClient {
+		d = &o.client
+	}
+	d.bytes += int64(len(data))
+	if d.err != nil || d.done {
+		return d.err
+	}
+
+	d.buf = append(d.buf, data...)
+	d.parse(fromClient)
+	if len(d.buf) > maxObserved {
+		d.done = true
+	}
+	if d.done {
+		d.buf = nil
+	}
+	return d.err
+}
+
+// parse reads the version line and the KEXINIT that follows it. Servers
+// may send other lines before their version; clients must start with it.
+func (d *direction) parse(fromClient bool) {
+	for d.version == "" {
+		if fromClient && d.off == 0 && len(d.buf) >= 4 && !bytes.HasPrefix(d.buf, []byte("SSH-")) {
+			d.err = ErrNotSSH
+			return
+		}
+		i := bytes.IndexByte(d.buf[d.off:], '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimRight(string(d.buf[d.off:d.off+i]), "\r")
+		d.off += i + 1
+		if strings.HasPrefix(line, "SSH-") {
+			d.version = line
+		}
+	}
+
+	// The first binary packet is the unencrypted KEXINIT
+	rest := d.buf[d.off:]
+	if len(rest) < 4 {
+		return
+	}
+	length := binary.BigEndian.Uint32(rest)
+	if length < 2 || length > maxPacket {
+		d.done = true
+		return
+	}
+	if len(rest) < 4+int(length) {
+		return
+	}
+	d.done = true
+	packet := rest[4 : 4+length]
+	padding := int(packet[0])
+	if padding >= len(packet)-1 {
+		return
+	}
+	payload := packet[1 : len(packet)-padding]
+	if payload[0] == msgKexInit {
+		d.kex = parseKexInit(payload)
+	}
+}
+
+// parseKexInit returns the name-lists of a KEXINIT payload, nil when it is
+// truncated
+func parseKexInit(payload []byte) [][]string {
+	rest := payload[1:]
+	if len(rest) < 16 {
+		return nil
+	}
+	rest = rest[16:] // Cookie
+
+	lists := make([][]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		if len(rest) < 4 {
+			return nil
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint32(len(rest)-4) < n {
+			return nil
+		}
+		var names []string
+		if n > 0 {
+			names = strings.Split(string(rest[4:4+n]), ",")
+		}
+		lists = append(lists, names)
+		rest = rest[4+n:]
+	}
+	return lists
+}
+
+// KEXINIT name-list positions
+const (
+	listKex = iota
+	listHostKey
+	listCipherCS
+	listCipherSC
+	listMACCS
+	listMACSC
+	listCompressionCS
+	listCompressionSC
+)
+
+// Session returns what has been observed so far
+func (o *Observer) Session() Session {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s := Session{
+		ClientVersion:   o.client.version,
+		ServerVersion:   o.server.version,
+		BytesFromClient: o.client.bytes,
+		BytesFromServer: o.server.bytes,
+		Duration:        time.Since(o.start),
+	}
+	client, server := o.client.kex, o.server.kex
+	if client != nil {
+		s.HASSH = hassh(client, listCipherCS, listMACCS, listCompressionCS)
+	}
+	if server != nil {
+		s.HASSHServer = hassh(server, listCipherSC, listMACSC, listCompressionSC)
+	}
+	if client != nil && server != nil {
+		s.Kex = negotiate(client[listKex], server[listKex])
+		s.HostKey = negotiate(client[listHostKey], server[listHostKey])
+		s.Cipher = negotiate(client[listCipherCS], server[listCipherCS])
+		if !aead(s.Cipher) {
+			s.MAC = negotiate(client[listMACCS], server[listMACCS])
+		}
+	}
+	return s
+}
+
+// hassh fingerprints a key exchange offer as HASSH does: the MD5 of its
+// key exchange, cipher, MAC and compression algorithms
+func hassh(lists [][]string, cipher, mac, compression int) string {
+	offer := strings.Join([]string{
+		strings.Join(lists[listKex], ","),
+		strings.Join(lists[cipher], ","),
+		strings.Join(lists[mac], ","),
+		strings.Join(lists[compression], ","),
+	}, ";")
+	sum := md5.Sum([]byte(offer))
+	return hex.EncodeToString(sum[:])
+}
+
+// negotiate returns the first of the client's algorithms the server
+// supports, as RFC 4253 negotiates them
+func negotiate(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// aead reports whether a cipher authenticates itself, making the MAC unused
+func aead(cipher string) bool {
+	return strings.HasPrefix(cipher, "chacha20-poly1305") || strings.Contains(cipher, "-gcm")
+}
@@ -0,0 +1,147 @@
+// Package sshaudit makes the egress proxy SSH-aware for audited,
+// bastion-style egress. In metadata mode the proxy relays SSH untouched
+// and records the client and server software, their HASSH fingerprints
+// and the negotiated algorithms from the plaintext key exchange. In full
+// mode it terminates SSH, relays the client's authentication to the
+// destination, enforces user and port forwarding allow-lists, and records
+// every interactive session with its keystroke timing as an asciicast v2
+// file.
+package sshaudit
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Recording modes
+const (
+	RecordMetadata = "metadata" // Relay untouched, record the handshake metadata
+	RecordFull     = "full"     // Terminate SSH and record sessions
+)
+
+// Policy is the SSH part of a mapping
+type Policy struct {
+	Record string `json:"record,omitempty"` // metadata (default) or full
+
+	// Destination user names clients may log in as, full mode; empty
+	// allows every user
+	AllowUsers []string `json:"allow_users,omitempty"`
+
+	// Targets of port forwarding and jump hosts, full mode, as host[:port]:
+	// a domain pattern, IP address or CIDR, with * for any port and port 22
+	// when omitted. Empty refuses forwarding.
+	AllowForward []string `json:"allow_forward,omitempty"`
+
+	// Client public keys in authorized_keys format, full mode. Clients
+	// logging in with one of them are authenticated at the destination
+	// with the proxy's upstream key; other clients' passwords are relayed.
+	AuthorizedKeys []string `json:"authorized_keys,omitempty"`
+}
+
+// Mode returns the recording mode, metadata when unset
+func (p *Policy) Mode() string {
+	if p.Record == "" {
+		return RecordMetadata
+	}
+	return p.Record
+}
+
+// Validate checks the mode, forwarding targets and authorized keys
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Mode() {
+	case RecordMetadata, RecordFull:
+	default:
+		return fmt.Errorf("record must be %s or %s", RecordMetadata, RecordFull)
+	}
+	for _, target := range p.AllowForward {
+		if _, _, err := splitTarget(target); err != nil {
+			return err
+		}
+	}
+	for _, line := range p.AuthorizedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			return fmt.Errorf("invalid authorized key: %w", err)
+		}
+	}
+	return nil
+}
+
+// allowsUser reports whether clients may log in as user
+func (p *Policy) allowsUser(user string) bool {
+	if len(p.AllowUsers) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowUsers {
+		if allowed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized reports whether key is one of the policy's authorized keys
+func (p *Policy) authorized(key ssh.PublicKey) bool {
+	for _, line := range p.AuthorizedKeys {
+		authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && string(authorized.Marshal()) == string(key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsForward reports whether clients may forward to host:port
+func (p *Policy) allowsForward(host string, port uint32) bool {
+	for _, target := range p.AllowForward {
+		pattern, ports, err := splitTarget(target)
+		if err != nil || (ports != "*" && ports != strconv.FormatUint(uint64(port), 10)) {
+			continue
+		}
+		if matchHost(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTarget splits a forwarding target into its host pattern and port
+func splitTarget(target string) (host, port string, err error) {
+	host, port = target, "22"
+	if h, p, splitErr := net.SplitHostPort(target); splitErr == nil {
+		host, port = h, p
+	}
+	if port != "*" {
+		if n, convErr := strconv.Atoi(port); convErr != nil || n < 1 || n > 65535 {
+			return "", "", fmt.Errorf("invalid port in forwarding target %q", target)
+		}
+	}
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.Contains(name, "*") || strings.Contains(name, " ") {
+		return "", "", fmt.Errorf("invalid forwarding target %q", target)
+	}
+	return host, port, nil
+}
+
+// matchHost matches a host against a domain pattern, IP address or CIDR.
+// "example.com" matches the domain and its subdomains, "*.example.com"
+// only the subdomains.
+func matchHost(host, pattern string) bool {
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && prefix.Contains(addr.Unmap())
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
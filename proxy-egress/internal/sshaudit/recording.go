@@ -0,0 +1,167 @@
+package sshaudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recording writes one session channel as an asciicast v2 file: a JSON
+// header line followed by [seconds, code, data] events, "i" for what the
+// client typed, "o" for what it was shown and "r" for terminal resizes.
+// The file is created when the session starts a shell or command.
+type recording struct {
+	path  string
+	title string
+
+	mu       sync.Mutex
+	file     *os.File
+	start    time.Time
+	term     string
+	width    int
+	height   int
+	disabled bool // Subsystems such as sftp carry no terminal output
+	err      error
+}
+
+// newRecording prepares the recording of a session channel in dir
+func newRecording(dir, sessionID string, channel int, title string) *recording {
+	day := time.Now().UTC().Format("2006-01-02")
+	return &recording{
+		path:   filepath.Join(dir, day, fmt.Sprintf("%s-%d.cast", sessionID, channel)),
+		title:  title,
+		width:  80,
+		height: 24,
+	}
+}
+
+// pty sets the terminal type and size before the session starts
+func (r *recording) pty(term string, width, height uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.term = term
+	if width > 0 && height > 0 {
+		r.width, r.height = int(width), int(height)
+	}
+}
+
+// disable stops the recording of a channel that carries no terminal
+func (r *recording) disable() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled = true
+}
+
+// begin creates the file and writes the header once, for a shell or a
+// command
+func (r *recording) begin(command string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.beginLocked(command)
+}
+
+func (r *recording) beginLocked(command string) error {
+	if r.file != nil || r.disabled || r.err != nil {
+		return r.err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		r.err = err
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		r.err = err
+		return err
+	}
+	r.file, r.start = file, time.Now()
+
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     r.width,
+		"height":    r.height,
+		"timestamp": r.start.Unix(),
+		"title":     r.title,
+	}
+	if r.term != "" {
+		header["env"] = map[string]string{"TERM": r.term}
+	}
+	if command != "" {
+		header["command"] = command
+	}
+	return r.writeLocked(header)
+}
+
+// event records one event, starting the recording when needed
+func (r *recording) event(code string, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled || r.beginLocked("") != nil {
+		return
+	}
+	r.writeLocked([]interface{}{time.Since(r.start).Seconds(), code, data})
+}
+
+func (r *recording) writeLocked(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// written returns the file written, empty when nothing was recorded
+func (r *recording) written() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return ""
+	}
+	return r.path
+}
+
+// close closes the file
+func (r *recording) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+	}
+}
+
+// input records what passes through a reader as keystrokes
+func (r *recording) input(reader io.Reader) io.Reader {
+	return &recordedReader{r: reader, rec: r}
+}
+
+// output records what passes through a writer as terminal output
+func (r *recording) output(w io.Writer) io.Writer {
+	return &recordedWriter{w: w, rec: r}
+}
+
+type recordedReader struct {
+	r   io.Reader
+	rec *recording
+}
+
+func (rr *recordedReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	if n > 0 {
+		rr.rec.event("i", string(b[:n]))
+	}
+	return n, err
+}
+
+type recordedWriter struct {
+	w   io.Writer
+	rec *recording
+}
+
+func (rw *recordedWriter) Write(b []byte) (int, error) {
+	rw.rec.event("o", string(b))
+	return rw.w.Write(b)
+}
@@ -0,0 +1,288 @@
+package sshaudit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigner generates an ed25519 key
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// pipe returns both ends of a loopback TCP connection. SSH peers send
+// their version lines at once, which would deadlock on a net.Pipe.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// destination serves SSH with password "secret", answering exec requests
+// with the command and the keystrokes it reads, until the client's EOF
+func destination(t *testing.T, hostKey ssh.Signer) func() (net.Conn, error) {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	return func() (net.Conn, error) {
+		proxySide, serverSide := pipe(t)
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(serverSide, config)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				channel, requests, _ := newChannel.Accept()
+				go func() {
+					for r := range requests {
+						if r.Type != "exec" {
+							r.Reply(true, nil)
+							continue
+						}
+						r.Reply(true, nil)
+						io.WriteString(channel, "ran "+string(r.Payload[4:])+": ")
+						io.Copy(channel, channel)
+						channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+						channel.Close()
+					}
+				}()
+			}
+		}()
+		return proxySide, nil
+	}
+}
+
+// TestObserver tests the metadata recorded from a relayed SSH handshake
+func TestObserver(t *testing.T) {
+	observer := NewObserver()
+	hostKey := newSigner(t)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	clientSide, proxyClient := net.Pipe()
+	proxyServer, serverSide := net.Pipe()
+	go io.Copy(proxyServer, observer.Reader(proxyClient, true))
+	go io.Copy(proxyClient, observer.Reader(proxyServer, false))
+	go ssh.NewServerConn(serverSide, config)
+
+	conn, _, _, err := ssh.NewClientConn(clientSide, "host:22", &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   "SSH-2.0-TestClient_1.0",
+	})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	conn.Close()
+
+	session := observer.Session()
+	if session.ClientVersion != "SSH-2.0-TestClient_1.0" || !strings.HasPrefix(session.ServerVersion, "SSH-2.0-Go") {
+		t.Errorf("versions = %q, %q", session.ClientVersion, session.ServerVersion)
+	}
+	if len(session.HASSH) != 32 || len(session.HASSHServer) != 32 || session.Kex == "" || session.HostKey != "ssh-ed25519" || session.Cipher == "" {
+		t.Errorf("session = %+v", session)
+	}
+}
+
+// TestObserverNotSSH tests that a client not speaking SSH is refused
+func TestObserverNotSSH(t *testing.T) {
+	reader := NewObserver().Reader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"), true)
+	if _, err := reader.Read(make([]byte, 64)); !errors.Is(err, ErrNotSSH) {
+		t.Errorf("Read = %v, want ErrNotSSH", err)
+	}
+}
+
+// TestPolicy tests validation and the forwarding allow-list
+func TestPolicy(t *testing.T) {
+	policy := &Policy{Record: RecordFull, AllowForward: []string{"db.internal:5432", "10.1.0.0/16:*", "*.jump.example"}}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	tests := []struct {
+		host string
+		port uint32
+		want bool
+	}{
+		{"db.internal", 5432, true},
+		{"db.internal", 22, false},
+		{"10.1.2.3", 6379, true},
+		{"10.2.0.1", 6379, false},
+		{"a.jump.example", 22, true},
+		{"jump.example", 22, false},
+	}
+	for _, tt := range tests {
+		if got := policy.allowsForward(tt.host, tt.port); got != tt.want {
+			t.Errorf("allowsForward(%s, %d) = %t, want %t", tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	for _, p := range []*Policy{
+		{Record: "keystrokes"},
+		{AllowForward: []string{"db:99999"}},
+		{AuthorizedKeys: []string{"ssh-ed25519 AAAA"}},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", p)
+		}
+	}
+}
+
+// TestBastion tests a recorded session through the bastion and that
+// disallowed users and forwards are refused
+func TestBastion(t *testing.T) {
+	destKey := newSigner(t)
+	dir := t.TempDir()
+	bastion, err := NewBastion(BastionOptions{
+		HostKey:      newSigner(t),
+		KnownHosts:   ssh.FixedHostKey(destKey.PublicKey()),
+		RecordingDir: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var events []Event
+	serve := func(user string) (*ssh.Client, chan error) {
+		clientSide, proxySide := pipe(t)
+		done := make(chan error, 1)
+		go func() {
+			done <- bastion.Serve(Request{
+				Client: proxySide,
+				Dial:   destination(t, destKey),
+				Addr:   "dest:22",
+				Policy: &Policy{Record: RecordFull, AllowUsers: []string{"alice"}},
+				Audit: func(e Event) {
+					mu.Lock()
+					events = append(events, e)
+					mu.Unlock()
+				},
+			})
+		}()
+		conn, chans, reqs, err := ssh.NewClientConn(clientSide, "bastion:22", &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			clientSide.Close()
+			return nil, done
+		}
+		return ssh.NewClient(conn, chans, reqs), done
+	}
+
+	if client, _ := serve("mallory"); client != nil {
+		t.Fatal("login as a user not allowed succeeded")
+	}
+
+	client, done := serve("alice")
+	if client == nil {
+		t.Fatal("login failed")
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Start("uptime"); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stdin, "ls\n")
+	stdin.Close()
+	output, _ := io.ReadAll(stdout)
+	if err := session.Wait(); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+	if string(output) != "ran uptime: ls\n" {
+		t.Errorf("output = %q", output)
+	}
+
+	if _, err := client.Dial("tcp", "db.internal:5432"); err == nil {
+		t.Error("forward to a target not allowed succeeded")
+	}
+	client.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var actions []string
+	var recording string
+	for _, e := range events {
+		actions = append(actions, e.Action)
+		if e.Action == ActionEnd {
+			if paths := e.Metadata["recordings"].([]string); len(paths) == 1 {
+				recording = paths[0]
+			}
+		}
+	}
+	if got := strings.Join(actions, ","); got != "auth,auth,session_start,command,forward,session_end" {
+		t.Errorf("audit actions = %s", got)
+	}
+
+	// The recording holds the header, the keystrokes and the output
+	file, err := os.Open(recording)
+	if err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	var header map[string]interface{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header["command"] != "uptime" {
+		t.Errorf("header = %s", scanner.Text())
+	}
+	var codes []string
+	for scanner.Scan() {
+		var event []interface{}
+		json.Unmarshal(scanner.Bytes(), &event)
+		codes = append(codes, event[1].(string))
+	}
+	if got := strings.Join(codes, ""); !strings.Contains(got, "i") || !strings.Contains(got, "o") {
+		t.Errorf("recorded events %q, want input and output", got)
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/penguintech/marchproxy/internal/acceleration/xdp"
-	"github.com/penguintech/marchproxy/internal/manager"
+	"marchproxy-egress/internal/acceleration/xdp"
+	"marchproxy-egress/internal/manager"
 )
 
 // RuleSynchronizer handles synchronization between manager rules and XDP fast-path
@@ -231,8 +231,8 @@ func (rs *RuleSynchronizer) classifyAndAddRule(service *manager.Service, mapping
 func (rs *RuleSynchronizer) canUseFastPath(service *manager.Service, mapping *manager.Mapping) bool {
 	// Rules that MUST use slow-path (Go proxy):
 
-	// 1. Authentication required (JWT/Base64 validation)
-	if service.AuthType == "jwt" || service.AuthType == "base64" {
+	// 1. Authentication required (JWT/Base64/HMAC validation)
+	if service.AuthType == "jwt" || service.AuthType == "base64" || service.AuthType == "hmac" {
 		return false
 	}
 
@@ -357,6 +357,8 @@ func (rs *RuleSynchronizer) hasComplexPorts(service *manager.Service, mapping *m
 		   mapping.DynamicPorts
 }
 
+// ipToUint32 packs an IPv4 address in host byte order for the XDP service
+// rules, see xdp.ServiceRule
 func (rs *RuleSynchronizer) ipToUint32(ip net.IP) uint32 {
 	if ip == nil {
 		return 0
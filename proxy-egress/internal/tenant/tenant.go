@@ -0,0 +1,292 @@
+// Package tenant enforces per-tenant quotas on proxies shared by several
+// tenants. Mappings are tagged with a tenant ID by the manager; every
+// connection of a mapping counts towards its tenant's connection, request
+// rate and bandwidth quotas on this proxy instance.
+package tenant
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Quota kinds, used as the reason a tenant was rejected
+const (
+	QuotaConnections = "connections"
+	QuotaRequests    = "requests"
+)
+
+// Quota limits one tenant on each proxy instance. Zero values are unlimited.
+type Quota struct {
+	ID                string  `json:"id"`
+	MaxConnections    int     `json:"max_connections,omitempty"`     // Concurrent connections
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"` // New connections or datagrams
+	BandwidthKbps     int     `json:"bandwidth_kbps,omitempty"`      // Shared by all connections, both directions
+}
+
+// Usage is a snapshot of one tenant's quota and consumption
+type Usage struct {
+	Tenant   string            `json:"tenant"`
+	Quota    Quota             `json:"quota"`
+	Active   int64             `json:"active_connections"`
+	Bytes    uint64            `json:"bytes"`
+	Rejected map[string]uint64 `json:"rejected"`
+}
+
+// state is the live accounting of one tenant
+type state struct {
+	quota    Quota
+	active   int64
+	bytes    uint64
+	rejected map[string]uint64
+
+	// Request rate token bucket
+	tokens float64
+	filled time.Time
+
+	// Bandwidth pacing, the time the last reserved byte is sent
+	sendAt time.Time
+}
+
+// Limiter tracks and enforces the quotas of every tenant
+type Limiter struct {
+	tenants map[string]*state
+	mu      sync.Mutex
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewLimiter creates a limiter without quotas; tenants are only counted
+// until Update configures them
+func NewLimiter() *Limiter {
+	return &Limiter{
+		tenants: make(map[string]*state),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// Update replaces the configured quotas. Counters and open connections of
+// tenants are kept, tenants missing from quotas become unlimited.
+func (l *Limiter) Update(quotas []Quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	configured := make(map[string]bool, len(quotas))
+	for _, quota := range quotas {
+		if quota.ID == "" {
+			continue
+		}
+		configured[quota.ID] = true
+		s := l.state(quota.ID)
+		if s.quota.RequestsPerSecond != quota.RequestsPerSecond {
+			s.tokens = burst(quota.RequestsPerSecond)
+			s.filled = l.now()
+		}
+		s.quota = quota
+	}
+	for id, s := range l.tenants {
+		if !configured[id] {
+			s.quota = Quota{ID: id}
+		}
+	}
+}
+
+// Quota returns the configured quota of a tenant
+func (l *Limiter) Quota(tenant string) Quota {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.tenants[tenant]; ok {
+		return s.quota
+	}
+	return Quota{ID: tenant}
+}
+
+// Open admits a new connection for tenant. It returns the function that
+// closes the connection again, or the quota that rejected it.
+func (l *Limiter) Open(tenant string) (release func(), rejected string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.state(tenant)
+	if s.quota.MaxConnections > 0 && s.active >= int64(s.quota.MaxConnections) {
+		s.rejected[QuotaConnections]++
+		return nil, QuotaConnections
+	}
+	if !l.take(s) {
+		s.rejected[QuotaRequests]++
+		return nil, QuotaRequests
+	}
+
+	s.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			s.active--
+			l.mu.Unlock()
+		})
+	}, ""
+}
+
+// Request admits one request that holds no connection open, such as a
+// datagram. It returns false if the tenant's request rate is exhausted.
+func (l *Limiter) Request(tenant string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.state(tenant)
+	if !l.take(s) {
+		s.rejected[QuotaRequests]++
+		return false
+	}
+	return true
+}
+
+// Count adds n relayed bytes to tenant's usage
+func (l *Limiter) Count(tenant string, n int64) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.state(tenant).bytes += uint64(n)
+}
+
+// Wait blocks until n more bytes fit in the tenant's bandwidth quota
+func (l *Limiter) Wait(tenant string, n int) {
+	l.mu.Lock()
+	s := l.state(tenant)
+	kbps := s.quota.BandwidthKbps
+	if kbps <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := l.now()
+	if s.sendAt.Before(now) {
+		s.sendAt = now
+	}
+	s.sendAt = s.sendAt.Add(time.Duration(float64(n) * 8 / float64(kbps) * float64(time.Millisecond)))
+	delay := s.sendAt.Sub(now)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// Writer paces writes to w with tenant's bandwidth quota. It returns w
+// unchanged when the tenant has none, keeping zero-copy relays intact.
+func (l *Limiter) Writer(tenant string, w io.Writer) io.Writer {
+	if l.Quota(tenant).BandwidthKbps <= 0 {
+		return w
+	}
+	return &writer{w: w, limiter: l, tenant: tenant}
+}
+
+// Usage returns the quota and consumption of every tenant seen so far,
+// ordered by tenant
+func (l *Limiter) Usage() []Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := make([]Usage, 0, len(l.tenants))
+	for id, s := range l.tenants {
+		rejected := make(map[string]uint64, len(s.rejected))
+		for quota, n := range s.rejected {
+			rejected[quota] = n
+		}
+		usage = append(usage, Usage{Tenant: id, Quota: s.quota, Active: s.active, Bytes: s.bytes, Rejected: rejected})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
+
+// WritePrometheus writes tenant usage in Prometheus text format
+func (l *Limiter) WritePrometheus(w io.Writer, module string) {
+	usage := l.Usage()
+
+	fmt.Fprintf(w, "# HELP marchproxy_tenant_active_connections Open connections per module and tenant\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tenant_active_connections gauge\n")
+	for _, u := range usage {
+		fmt.Fprintf(w, `marchproxy_tenant_active_connections{module="%s",tenant="%s"} %d`+"\n", module, u.Tenant, u.Active)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_tenant_bytes_total Bytes relayed per module and tenant\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tenant_bytes_total counter\n")
+	for _, u := range usage {
+		fmt.Fprintf(w, `marchproxy_tenant_bytes_total{module="%s",tenant="%s"} %d`+"\n", module, u.Tenant, u.Bytes)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_tenant_rejected_total Connections and requests rejected per module, tenant and quota\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tenant_rejected_total counter\n")
+	for _, u := range usage {
+		for _, quota := range []string{QuotaConnections, QuotaRequests} {
+			fmt.Fprintf(w, `marchproxy_tenant_rejected_total{module="%s",tenant="%s",quota="%s"} %d`+"\n",
+				module, u.Tenant, quota, u.Rejected[quota])
+		}
+	}
+}
+
+// state returns the accounting of a tenant, creating it on first use.
+// l.mu must be held.
+func (l *Limiter) state(tenant string) *state {
+	s, ok := l.tenants[tenant]
+	if !ok {
+		s = &state{quota: Quota{ID: tenant}, rejected: make(map[string]uint64)}
+		l.tenants[tenant] = s
+	}
+	return s
+}
+
+// take takes a request token from the tenant's bucket. l.mu must be held.
+func (l *Limiter) take(s *state) bool {
+	rate := s.quota.RequestsPerSecond
+	if rate <= 0 {
+		return true
+	}
+
+	now := l.now()
+	s.tokens = min(s.tokens+now.Sub(s.filled).Seconds()*rate, burst(rate))
+	s.filled = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// burst is the bucket size for a request rate, one second of requests
+func burst(rate float64) float64 {
+	return max(rate, 1)
+}
+
+// writer paces writes for one tenant
+type writer struct {
+	w       io.Writer
+	limiter *Limiter
+	tenant  string
+}
+
+// chunk bounds the bytes paced at once, so tenants sharing a quota
+// interleave instead of waiting behind one large write
+const chunk = 16 * 1024
+
+func (t *writer) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), chunk)
+		t.limiter.Wait(t.tenant, n)
+		m, err := t.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,128 @@
+package tenant
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter on a fake clock that sleeps by
+// advancing the clock and records the time slept
+func newTestLimiter() (*Limiter, *time.Time, *time.Duration) {
+	now := time.Unix(1700000000, 0)
+	var slept time.Duration
+	l := NewLimiter()
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	return l, &now, &slept
+}
+
+func TestConnectionQuota(t *testing.T) {
+	l, _, _ := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", MaxConnections: 2}})
+
+	first, rejected := l.Open("acme")
+	if rejected != "" {
+		t.Fatalf("Expected the first connection to be admitted, got %s", rejected)
+	}
+	if _, rejected := l.Open("acme"); rejected != "" {
+		t.Fatalf("Expected the second connection to be admitted, got %s", rejected)
+	}
+	if _, rejected := l.Open("acme"); rejected != QuotaConnections {
+		t.Fatalf("Expected the third connection to be rejected, got %q", rejected)
+	}
+
+	// Releasing twice frees one slot only
+	first()
+	first()
+	if _, rejected := l.Open("acme"); rejected != "" {
+		t.Fatalf("Expected a connection after a release, got %s", rejected)
+	}
+	if _, rejected := l.Open("acme"); rejected != QuotaConnections {
+		t.Fatalf("Expected the quota to be full again, got %q", rejected)
+	}
+
+	// Other tenants are not limited
+	for i := 0; i < 5; i++ {
+		if _, rejected := l.Open("globex"); rejected != "" {
+			t.Fatalf("Expected unlimited tenant to be admitted, got %s", rejected)
+		}
+	}
+}
+
+func TestRequestQuota(t *testing.T) {
+	l, now, _ := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", RequestsPerSecond: 2}})
+
+	if !l.Request("acme") || !l.Request("acme") {
+		t.Fatal("Expected a burst of two requests")
+	}
+	if l.Request("acme") {
+		t.Fatal("Expected the third request to be rejected")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if !l.Request("acme") {
+		t.Fatal("Expected a request after the bucket refilled")
+	}
+	if _, rejected := l.Open("acme"); rejected != QuotaRequests {
+		t.Fatalf("Expected connections to share the request rate, got %q", rejected)
+	}
+
+	// Dropping the quota lifts the limit but keeps the counters
+	l.Update(nil)
+	if !l.Request("acme") {
+		t.Fatal("Expected no limit once the quota is removed")
+	}
+	usage := l.Usage()
+	if len(usage) != 1 || usage[0].Rejected[QuotaRequests] != 2 {
+		t.Fatalf("Expected 2 rejected requests, got %+v", usage)
+	}
+}
+
+func TestBandwidthQuota(t *testing.T) {
+	l, _, slept := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", BandwidthKbps: 800}})
+
+	// 800 kbps is 100 kB/s, shared by every writer of the tenant
+	var a, b bytes.Buffer
+	l.Writer("acme", &a).Write(make([]byte, 50000))
+	l.Writer("acme", &b).Write(make([]byte, 50000))
+	if *slept < 900*time.Millisecond || *slept > 1100*time.Millisecond {
+		t.Errorf("Expected about 1s of pacing for 100 kB, got %v", *slept)
+	}
+	if a.Len() != 50000 || b.Len() != 50000 {
+		t.Errorf("Expected every byte written, got %d and %d", a.Len(), b.Len())
+	}
+
+	*slept = 0
+	l.Writer("globex", &a).Write(make([]byte, 50000))
+	if *slept != 0 {
+		t.Errorf("Expected no pacing without a quota, got %v", *slept)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	l, _, _ := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", MaxConnections: 1}})
+	l.Open("acme")
+	l.Open("acme")
+	l.Count("acme", 1500)
+
+	var buf bytes.Buffer
+	l.WritePrometheus(&buf, "egress")
+	for _, want := range []string{
+		`marchproxy_tenant_active_connections{module="egress",tenant="acme"} 1`,
+		`marchproxy_tenant_bytes_total{module="egress",tenant="acme"} 1500`,
+		`marchproxy_tenant_rejected_total{module="egress",tenant="acme",quota="connections"} 1`,
+		`marchproxy_tenant_rejected_total{module="egress",tenant="acme",quota="requests"} 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-egress/internal/certs"
+)
+
+const (
+	defaultIssueTTL      = 24 * time.Hour
+	defaultRetryInterval = 30 * time.Second
+	maxRetryInterval     = 5 * time.Minute
+)
+
+// ErrNoCertificate is returned before the first certificate has been issued
+var ErrNoCertificate = errors.New("no mTLS certificate issued yet")
+
+// CertificateSigner signs a PEM certificate signing request and returns the
+// PEM certificate together with the issuing CA
+type CertificateSigner interface {
+	SignCertificate(csrPEM []byte, ttl time.Duration) (certPEM, caPEM []byte, err error)
+}
+
+// IssuerConfig describes the identity requested from the cluster CA
+type IssuerConfig struct {
+	CommonName    string
+	DNSNames      []string
+	IPAddresses   []net.IP
+	TTL           time.Duration // Requested certificate lifetime
+	RenewBefore   time.Duration // Renew this long before expiry, 0 = a third of the lifetime
+	RetryInterval time.Duration // First retry delay after a failed renewal, doubled up to 5m
+}
+
+// Issuer keeps a short-lived certificate from the cluster CA, renewing it
+// with a freshly generated key before it expires
+type Issuer struct {
+	signer CertificateSigner
+	config IssuerConfig
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	caPool *x509.CertPool
+
+	issued   uint64
+	failures uint64
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewIssuer creates an issuer; call Issue for the first certificate and
+// Start to keep it renewed
+func NewIssuer(signer CertificateSigner, cfg IssuerConfig) *Issuer {
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultIssueTTL
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+
+	return &Issuer{
+		signer: signer,
+		config: cfg,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Issue generates a new key, has the cluster CA sign it and swaps the result
+// in for new handshakes. Existing connections keep their certificate.
+func (i *Issuer) Issue() error {
+	if err := i.issue(); err != nil {
+		atomic.AddUint64(&i.failures, 1)
+		return err
+	}
+	atomic.AddUint64(&i.issued, 1)
+	return nil
+}
+
+func (i *Issuer) issue() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: i.config.CommonName},
+		DNSNames:    i.config.DNSNames,
+		IPAddresses: i.config.IPAddresses,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	certPEM, caPEM, err := i.signer.SignCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), i.config.TTL)
+	if err != nil {
+		return fmt.Errorf("certificate signing failed: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return fmt.Errorf("signed certificate does not match the key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse signed certificate: %w", err)
+	}
+
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("failed to parse cluster CA certificate")
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: caPool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return fmt.Errorf("signed certificate does not chain to the cluster CA: %w", err)
+	}
+
+	i.mu.Lock()
+	i.cert = &cert
+	i.leaf = leaf
+	i.caPool = caPool
+	i.mu.Unlock()
+
+	certs.Default.Add("issuer", certs.RoleServer, "manager", leaf)
+	certs.Default.AddPEM("issuer", certs.RoleCA, "manager", caPEM)
+
+	log.Printf("Issued mTLS certificate %s for %s, valid until %s", leaf.SerialNumber, leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Start renews the certificate in the background until Stop is called
+func (i *Issuer) Start() {
+	go i.renewLoop()
+}
+
+// Stop ends background renewal
+func (i *Issuer) Stop() {
+	i.stopOnce.Do(func() { close(i.stopCh) })
+}
+
+func (i *Issuer) renewLoop() {
+	retry := i.config.RetryInterval
+	next := i.renewAt()
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-i.stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := i.Issue(); err != nil {
+			log.Printf("mTLS certificate renewal failed, retrying in %s: %v", retry, err)
+			next = time.Now().Add(retry)
+			retry *= 2
+			if retry > maxRetryInterval {
+				retry = maxRetryInterval
+			}
+			continue
+		}
+
+		retry = i.config.RetryInterval
+		next = i.renewAt()
+	}
+}
+
+// renewAt returns when the current certificate should be replaced, spread
+// by up to a tenth of the renewal window so a cluster does not renew at once.
+// The manager may shorten the requested lifetime, so a window that does not
+// fit falls back to a third of the actual lifetime.
+func (i *Issuer) renewAt() time.Time {
+	leaf := i.Leaf()
+	if leaf == nil {
+		return time.Now()
+	}
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	window := i.config.RenewBefore
+	if window <= 0 || window >= lifetime {
+		window = lifetime / 3
+	}
+	jitter := time.Duration(mrand.Int63n(int64(window/10) + 1))
+	return leaf.NotAfter.Add(-window - jitter)
+}
+
+// GetCertificate serves the current certificate for tls.Config.GetCertificate
+func (i *Issuer) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return i.current()
+}
+
+// GetClientCertificate serves the current certificate for
+// tls.Config.GetClientCertificate
+func (i *Issuer) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return i.current()
+}
+
+func (i *Issuer) current() (*tls.Certificate, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return i.cert, nil
+}
+
+// Leaf returns the current certificate, nil before the first issue
+func (i *Issuer) Leaf() *x509.Certificate {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.leaf
+}
+
+// CAPool returns the cluster CA that signed the current certificate
+func (i *Issuer) CAPool() *x509.CertPool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.caPool
+}
+
+// Stats returns how many certificates were issued and how many attempts failed
+func (i *Issuer) Stats() (issued, failures uint64) {
+	return atomic.LoadUint64(&i.issued), atomic.LoadUint64(&i.failures)
+}
+
+// WritePrometheus writes the issuance counters in Prometheus text format
+func (i *Issuer) WritePrometheus(w io.Writer) {
+	issued, failures := i.Stats()
+
+	fmt.Fprintf(w, "# HELP marchproxy_mtls_certificate_issuance_total mTLS certificates requested from the cluster CA by result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_mtls_certificate_issuance_total counter\n")
+	fmt.Fprintf(w, `marchproxy_mtls_certificate_issuance_total{result="success"} %d`+"\n", issued)
+	fmt.Fprintf(w, `marchproxy_mtls_certificate_issuance_total{result="failure"} %d`+"\n", failures)
+}
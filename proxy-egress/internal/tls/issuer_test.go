@@ -0,0 +1,137 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSigner signs requests with a test CA, like the manager's cluster CA
+type fakeSigner struct {
+	ca *testCA
+
+	mu     sync.Mutex
+	serial int64
+	fail   bool
+}
+
+func (s *fakeSigner) SignCertificate(csrPEM []byte, ttl time.Duration) ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		return nil, nil, errors.New("manager unavailable")
+	}
+
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, nil, err
+	}
+
+	s.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(s.serial),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Second),
+		NotAfter:     time.Now().Add(ttl),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca.cert, csr.PublicKey, s.ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.cert.Raw}), nil
+}
+
+func TestIssuerRotatesKeys(t *testing.T) {
+	issuer := NewIssuer(&fakeSigner{ca: newTestCA(t)}, IssuerConfig{
+		CommonName: "egress-1",
+		DNSNames:   []string{"egress-1.cluster.local"},
+		TTL:        time.Hour,
+	})
+
+	if _, err := issuer.GetCertificate(nil); !errors.Is(err, ErrNoCertificate) {
+		t.Fatalf("Expected ErrNoCertificate before the first issue, got %v", err)
+	}
+
+	if err := issuer.Issue(); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	first, _ := issuer.GetCertificate(nil)
+	firstSerial := issuer.Leaf().SerialNumber.Int64()
+	if leaf := issuer.Leaf(); leaf.Subject.CommonName != "egress-1" || leaf.DNSNames[0] != "egress-1.cluster.local" {
+		t.Errorf("Unexpected certificate identity %s %v", leaf.Subject, leaf.DNSNames)
+	}
+
+	if err := issuer.Issue(); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	second, _ := issuer.GetClientCertificate(nil)
+
+	if issuer.Leaf().SerialNumber.Int64() == firstSerial {
+		t.Errorf("Expected a new certificate, got serial %s", issuer.Leaf().SerialNumber)
+	}
+	if first.PrivateKey.(*ecdsa.PrivateKey).Equal(second.PrivateKey) {
+		t.Error("Expected renewal to rotate the private key")
+	}
+	if _, err := issuer.Leaf().Verify(x509.VerifyOptions{Roots: issuer.CAPool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Expected the certificate to verify against the CA pool: %v", err)
+	}
+}
+
+func TestIssuerRenewsBeforeExpiry(t *testing.T) {
+	issuer := NewIssuer(&fakeSigner{ca: newTestCA(t)}, IssuerConfig{
+		CommonName:  "egress-1",
+		TTL:         3 * time.Second,
+		RenewBefore: time.Second,
+	})
+	if err := issuer.Issue(); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	issuer.Start()
+	defer issuer.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if issued, _ := issuer.Stats(); issued >= 2 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("Expected the certificate to be renewed before it expired")
+}
+
+func TestIssuerKeepsCertificateOnFailure(t *testing.T) {
+	signer := &fakeSigner{ca: newTestCA(t)}
+	issuer := NewIssuer(signer, IssuerConfig{CommonName: "egress-1", TTL: time.Hour})
+	if err := issuer.Issue(); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	signer.mu.Lock()
+	signer.fail = true
+	signer.mu.Unlock()
+
+	if err := issuer.Issue(); err == nil {
+		t.Fatal("Expected issue to fail while the signer is unavailable")
+	}
+	if cert, err := issuer.GetCertificate(nil); err != nil || cert == nil {
+		t.Errorf("Expected the previous certificate to stay in use, got %v", err)
+	}
+	if issued, failures := issuer.Stats(); issued != 1 || failures != 1 {
+		t.Errorf("Expected 1 issued and 1 failure, got %d and %d", issued, failures)
+	}
+}
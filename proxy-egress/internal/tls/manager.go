@@ -6,13 +6,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"math/big"
 	"net"
 	"sync"
 	"time"
+
+	"marchproxy-egress/internal/certs"
 )
 
 type TLSManager struct {
@@ -156,6 +157,7 @@ func (tm *TLSManager) initialize() error {
 			return fmt.Errorf("failed to load certificate: %w", err)
 		}
 		tm.certificates["default"] = &cert
+		certs.Default.AddKeyPair("tls", certs.RoleServer, tm.config.CertFile, &cert)
 	}
 
 	for name, certConfig := range tm.config.Certificates {
@@ -164,7 +166,8 @@ func (tm *TLSManager) initialize() error {
 			return fmt.Errorf("failed to load certificate %s: %w", name, err)
 		}
 		tm.certificates[name] = &cert
-		
+		certs.Default.AddKeyPair("tls", certs.RoleServer, certConfig.CertFile, &cert)
+
 		for _, domain := range certConfig.Domains {
 			tm.certificates[domain] = &cert
 		}
@@ -250,10 +253,8 @@ func (tm *TLSManager) GetTLSConfig() *tls.Config {
 		config.RootCAs = tm.rootCAs
 	}
 
-	if tm.sessionCache != nil {
-		config.SessionCache = tm.sessionCache
-	}
-
+	// Servers resume sessions with tickets, crypto/tls has no server-side
+	// session cache to plug sessionCache into
 	return config
 }
 
@@ -285,6 +286,7 @@ func (tm *TLSManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certifica
 			tm.mutex.Lock()
 			tm.certificates[serverName] = cert
 			tm.mutex.Unlock()
+			certs.Default.AddKeyPair("acme", certs.RoleServer, serverName, cert)
 			tm.metrics.recordACMEObtained()
 			return cert, nil
 		}
@@ -377,6 +379,7 @@ func (tm *TLSManager) rotateCertificate(serverName string) (*tls.Certificate, er
 		tm.mutex.Lock()
 		tm.certificates[serverName] = newCert
 		tm.mutex.Unlock()
+		certs.Default.AddKeyPair("acme", certs.RoleServer, serverName, newCert)
 
 		tm.metrics.recordCertRotation()
 		tm.metrics.recordACMERenewed()
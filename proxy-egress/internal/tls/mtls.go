@@ -7,24 +7,52 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
+	"marchproxy-egress/internal/certs"
 	"marchproxy-egress/internal/config"
 )
 
 // MTLSManager handles mTLS configuration and certificate management
 type MTLSManager struct {
-	config    *config.Config
-	tlsConfig *tls.Config
+	config     *config.Config
+	tlsConfig  *tls.Config
+	revocation *RevocationChecker
+	issuer     *Issuer
 }
 
 // NewMTLSManager creates a new mTLS manager with the given configuration
 func NewMTLSManager(cfg *config.Config) (*MTLSManager, error) {
+	return NewMTLSManagerWithSigner(cfg, nil)
+}
+
+// NewMTLSManagerWithSigner creates a new mTLS manager that, when
+// MTLSAutoIssue is set, gets its certificate from the cluster CA through
+// signer and keeps it renewed instead of loading files
+func NewMTLSManagerWithSigner(cfg *config.Config, signer CertificateSigner) (*MTLSManager, error) {
 	manager := &MTLSManager{
 		config: cfg,
 	}
 
+	if cfg.IsMTLSEnabled() && cfg.MTLSAutoIssue {
+		if signer == nil {
+			return nil, fmt.Errorf("mTLS auto issue requires a certificate signer")
+		}
+		manager.issuer = NewIssuer(signer, issuerConfigFrom(cfg))
+		if err := manager.issuer.Issue(); err != nil {
+			return nil, fmt.Errorf("failed to issue mTLS certificate: %w", err)
+		}
+		manager.issuer.Start()
+	}
+
 	if cfg.IsMTLSEnabled() {
+		revocationConfig := revocationConfigFrom(cfg)
+		if revocationConfig.Enabled() || revocationConfig.OCSPStapling {
+			manager.revocation = NewRevocationChecker(revocationConfig)
+		}
+
 		tlsConfig, err := manager.setupMTLSConfig()
 		if err != nil {
 			return nil, fmt.Errorf("failed to setup mTLS config: %w", err)
@@ -37,6 +65,10 @@ func NewMTLSManager(cfg *config.Config) (*MTLSManager, error) {
 
 // setupMTLSConfig creates the TLS configuration for mTLS
 func (m *MTLSManager) setupMTLSConfig() (*tls.Config, error) {
+	if m.issuer != nil {
+		return m.setupIssuedMTLSConfig(), nil
+	}
+
 	serverCert, serverKey, clientCA := m.config.GetMTLSConfig()
 
 	// Load server certificate and key
@@ -44,6 +76,7 @@ func (m *MTLSManager) setupMTLSConfig() (*tls.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load server certificate and key: %w", err)
 	}
+	certs.Default.AddKeyPair("mtls", certs.RoleServer, serverCert, &cert)
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
@@ -59,6 +92,14 @@ func (m *MTLSManager) setupMTLSConfig() (*tls.Config, error) {
 		PreferServerCipherSuites: true,
 	}
 
+	if m.config.MTLSOCSPStapling {
+		getCertificate, err := m.revocation.StapleOCSP(cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up OCSP stapling: %w", err)
+		}
+		tlsConfig.GetCertificate = getCertificate
+	}
+
 	// Configure client certificate validation if required
 	if m.config.RequiresClientCert() {
 		// Load client CA certificate
@@ -71,11 +112,15 @@ func (m *MTLSManager) setupMTLSConfig() (*tls.Config, error) {
 		if !clientCertPool.AppendCertsFromPEM(clientCAData) {
 			return nil, fmt.Errorf("failed to parse client CA certificate")
 		}
+		certs.Default.AddPEM("mtls", certs.RoleCA, clientCA, clientCAData)
 
 		tlsConfig.ClientCAs = clientCertPool
 
 		if m.config.ShouldVerifyClientCert() {
 			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if m.revocation != nil && m.revocation.config.Enabled() {
+				tlsConfig.VerifyConnection = m.revocation.VerifyConnection
+			}
 		} else {
 			tlsConfig.ClientAuth = tls.RequireAnyClientCert
 		}
@@ -84,6 +129,82 @@ func (m *MTLSManager) setupMTLSConfig() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// setupIssuedMTLSConfig creates the TLS configuration for certificates issued
+// by the cluster CA. The certificate is looked up per handshake so renewals
+// apply without a restart; peers are verified against the cluster CA.
+func (m *MTLSManager) setupIssuedMTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: m.issuer.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		PreferServerCipherSuites: true,
+	}
+
+	if m.config.RequiresClientCert() {
+		tlsConfig.ClientCAs = m.issuer.CAPool()
+		if m.config.ShouldVerifyClientCert() {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if m.revocation != nil && m.revocation.config.Enabled() {
+				tlsConfig.VerifyConnection = m.revocation.VerifyConnection
+			}
+		} else {
+			tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		}
+	}
+
+	return tlsConfig
+}
+
+// issuerConfigFrom returns the identity requested from the cluster CA
+func issuerConfigFrom(cfg *config.Config) IssuerConfig {
+	issuerConfig := IssuerConfig{
+		CommonName:  cfg.ProxyName,
+		TTL:         time.Duration(cfg.MTLSIssueTTL) * time.Second,
+		RenewBefore: time.Duration(cfg.MTLSIssueRenewBefore) * time.Second,
+	}
+
+	for _, name := range append([]string{cfg.Hostname}, cfg.MTLSIssueDNSNames...) {
+		if name == "" {
+			continue
+		}
+		if ip := net.ParseIP(name); ip != nil {
+			issuerConfig.IPAddresses = append(issuerConfig.IPAddresses, ip)
+		} else {
+			issuerConfig.DNSNames = append(issuerConfig.DNSNames, name)
+		}
+	}
+
+	return issuerConfig
+}
+
+// GetIssuer returns the cluster CA issuer, nil unless MTLSAutoIssue is set
+func (m *MTLSManager) GetIssuer() *Issuer {
+	return m.issuer
+}
+
+// revocationConfigFrom returns the client certificate revocation settings
+func revocationConfigFrom(cfg *config.Config) RevocationConfig {
+	return RevocationConfig{
+		OCSPEnabled:        cfg.MTLSOCSPEnabled,
+		OCSPStapling:       cfg.MTLSOCSPStapling,
+		OCSPTimeout:        time.Duration(cfg.MTLSOCSPTimeout) * time.Second,
+		CRLEnabled:         cfg.MTLSCRLEnabled,
+		CRLSources:         cfg.MTLSCRLSources,
+		CRLRefreshInterval: time.Duration(cfg.MTLSCRLRefreshInterval) * time.Second,
+		FailOpen:           cfg.MTLSRevocationFailOpen,
+	}
+}
+
+// GetRevocationChecker returns the client certificate revocation checker,
+// nil when revocation checking and OCSP stapling are off
+func (m *MTLSManager) GetRevocationChecker() *RevocationChecker {
+	return m.revocation
+}
+
 // GetTLSConfig returns the configured TLS config
 func (m *MTLSManager) GetTLSConfig() *tls.Config {
 	return m.tlsConfig
@@ -130,6 +251,18 @@ func (m *MTLSManager) CreateHTTPClient() (*http.Client, error) {
 		return &http.Client{}, nil
 	}
 
+	if m.issuer != nil {
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					GetClientCertificate: m.issuer.GetClientCertificate,
+					RootCAs:              m.issuer.CAPool(),
+					MinVersion:           tls.VersionTLS12,
+				},
+			},
+		}, nil
+	}
+
 	// Load client certificate if configured
 	var clientCerts []tls.Certificate
 	if m.config.MTLSClientCertPath != "" && m.config.MTLSClientKeyPath != "" {
@@ -137,6 +270,7 @@ func (m *MTLSManager) CreateHTTPClient() (*http.Client, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to load client certificate: %w", err)
 		}
+		certs.Default.AddKeyPair("mtls", certs.RoleClient, m.config.MTLSClientCertPath, &clientCert)
 		clientCerts = append(clientCerts, clientCert)
 	}
 
@@ -163,6 +297,7 @@ func (m *MTLSManager) CreateHTTPClient() (*http.Client, error) {
 		if !serverCertPool.AppendCertsFromPEM(serverCAData) {
 			return nil, fmt.Errorf("failed to parse server CA certificate")
 		}
+		certs.Default.AddPEM("mtls", certs.RoleCA, m.config.MTLSClientCAPath, serverCAData)
 		clientTLSConfig.RootCAs = serverCertPool
 	}
 
@@ -179,6 +314,14 @@ func (m *MTLSManager) ValidateConfiguration() error {
 		return nil
 	}
 
+	if m.issuer != nil {
+		if m.issuer.Leaf() == nil {
+			return ErrNoCertificate
+		}
+		log.Printf("mTLS configuration validated successfully")
+		return nil
+	}
+
 	serverCert, serverKey, clientCA := m.config.GetMTLSConfig()
 
 	// Validate server certificate and key
@@ -216,9 +359,24 @@ func (m *MTLSManager) GetCertificateInfo() map[string]interface{} {
 	info["enabled"] = true
 	info["require_client_cert"] = m.config.RequiresClientCert()
 	info["verify_client_cert"] = m.config.ShouldVerifyClientCert()
+	info["ocsp_enabled"] = m.config.MTLSOCSPEnabled
+	info["ocsp_stapling"] = m.config.MTLSOCSPStapling
+	info["crl_enabled"] = m.config.MTLSCRLEnabled
+	info["revocation_fail_open"] = m.config.MTLSRevocationFailOpen
+	info["auto_issue"] = m.issuer != nil
 
 	// Get server certificate info
-	if m.tlsConfig != nil && len(m.tlsConfig.Certificates) > 0 {
+	if m.issuer != nil {
+		if cert := m.issuer.Leaf(); cert != nil {
+			info["server_cert"] = map[string]interface{}{
+				"subject":    cert.Subject.String(),
+				"issuer":     cert.Issuer.String(),
+				"not_before": cert.NotBefore,
+				"not_after":  cert.NotAfter,
+				"serial":     cert.SerialNumber.String(),
+			}
+		}
+	} else if m.tlsConfig != nil && len(m.tlsConfig.Certificates) > 0 {
 		serverCert := m.tlsConfig.Certificates[0]
 		if len(serverCert.Certificate) > 0 {
 			cert, err := x509.ParseCertificate(serverCert.Certificate[0])
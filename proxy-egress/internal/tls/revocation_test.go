@@ -0,0 +1,205 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, ocspServer string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func (ca *testCA) writeCRL(t *testing.T, revoked ...int64) string {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create CRL: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write CRL: %v", err)
+	}
+	return path
+}
+
+// ocspResponder answers every request with status for the requested serial
+func (ca *testCA) ocspResponder(t *testing.T, status int, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, ca.key)
+		if err != nil {
+			t.Errorf("Failed to create OCSP response: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(response)
+	}))
+}
+
+func TestRevocationCRL(t *testing.T) {
+	ca := newTestCA(t)
+	checker := NewRevocationChecker(RevocationConfig{
+		CRLEnabled: true,
+		CRLSources: []string{ca.writeCRL(t, 7)},
+	})
+	defer checker.Stop()
+
+	if err := checker.Check([]*x509.Certificate{ca.issue(t, 6, ""), ca.cert}); err != nil {
+		t.Errorf("Expected certificate not on the CRL to pass, got %v", err)
+	}
+	if err := checker.Check([]*x509.Certificate{ca.issue(t, 7, ""), ca.cert}); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("Expected revoked certificate to be rejected, got %v", err)
+	}
+}
+
+func TestRevocationOCSPCachesResponses(t *testing.T) {
+	ca := newTestCA(t)
+	var requests int32
+	responder := ca.ocspResponder(t, ocsp.Good, &requests)
+	defer responder.Close()
+
+	checker := NewRevocationChecker(RevocationConfig{OCSPEnabled: true})
+	chain := []*x509.Certificate{ca.issue(t, 10, responder.URL), ca.cert}
+
+	for i := 0; i < 3; i++ {
+		if err := checker.Check(chain); err != nil {
+			t.Fatalf("Expected good certificate to pass, got %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected one OCSP request, got %d", requests)
+	}
+
+	stats, cacheHits := checker.Stats()
+	if cacheHits != 2 || len(stats) != 1 || stats[0].Result != RevocationGood || stats[0].Count != 3 {
+		t.Errorf("Unexpected stats %+v, cache hits %d", stats, cacheHits)
+	}
+}
+
+func TestRevocationOCSPRevoked(t *testing.T) {
+	ca := newTestCA(t)
+	var requests int32
+	responder := ca.ocspResponder(t, ocsp.Revoked, &requests)
+	defer responder.Close()
+
+	checker := NewRevocationChecker(RevocationConfig{OCSPEnabled: true})
+	if err := checker.Check([]*x509.Certificate{ca.issue(t, 11, responder.URL), ca.cert}); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("Expected revoked certificate to be rejected, got %v", err)
+	}
+}
+
+func TestRevocationFailOpenAndClosed(t *testing.T) {
+	ca := newTestCA(t)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer responder.Close()
+
+	chain := []*x509.Certificate{ca.issue(t, 12, responder.URL), ca.cert}
+
+	closed := NewRevocationChecker(RevocationConfig{OCSPEnabled: true})
+	if err := closed.Check(chain); err == nil || errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("Expected fail-closed checker to reject an unknown status, got %v", err)
+	}
+
+	open := NewRevocationChecker(RevocationConfig{OCSPEnabled: true, FailOpen: true})
+	if err := open.Check(chain); err != nil {
+		t.Errorf("Expected fail-open checker to accept an unknown status, got %v", err)
+	}
+
+	stats, _ := open.Stats()
+	if len(stats) != 1 || stats[0].Result != RevocationUnknown {
+		t.Errorf("Expected an unknown result to be counted, got %+v", stats)
+	}
+}
@@ -0,0 +1,157 @@
+package tlsinspect
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCertTTL is the lifetime of minted certificates
+	DefaultCertTTL = 24 * time.Hour
+
+	// backdate covers clients whose clocks run behind the proxy's
+	backdate = time.Hour
+
+	// maxCachedCerts bounds the certificate cache; it is reset once full
+	maxCachedCerts = 10000
+)
+
+// Authority mints leaf certificates for intercepted server names from the
+// internal CA. Certificates share one key and are cached per name until
+// close to their expiry.
+type Authority struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+
+	minted atomic.Uint64
+}
+
+// LoadAuthority loads the CA certificate and key from PEM files
+func LoadAuthority(certFile, keyFile string, ttl time.Duration) (*Authority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS inspection CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the TLS inspection CA: %w", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("TLS inspection CA key cannot sign")
+	}
+	return NewAuthority(ca, signer, ttl)
+}
+
+// NewAuthority creates an authority for a CA certificate and its key
+func NewAuthority(ca *x509.Certificate, caKey crypto.Signer, ttl time.Duration) (*Authority, error) {
+	if !ca.IsCA || ca.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("TLS inspection certificate %q is not a CA", ca.Subject.CommonName)
+	}
+	if time.Now().After(ca.NotAfter) {
+		return nil, fmt.Errorf("TLS inspection CA expired on %s", ca.NotAfter.Format(time.RFC3339))
+	}
+	if ttl <= 0 {
+		ttl = DefaultCertTTL
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the certificate key: %w", err)
+	}
+	return &Authority{ca: ca, caKey: caKey, key: key, ttl: ttl, certs: make(map[string]*tls.Certificate)}, nil
+}
+
+// CA returns the CA certificate clients must trust
+func (a *Authority) CA() *x509.Certificate {
+	return a.ca
+}
+
+// Certificate returns a certificate for serverName, minting one when none
+// is cached or the cached one is in its last tenth of life
+func (a *Authority) Certificate(serverName string) (*tls.Certificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if cert, ok := a.certs[serverName]; ok && now.Before(cert.Leaf.NotAfter.Add(-a.ttl/10)) {
+		return cert, nil
+	}
+
+	cert, err := a.mint(serverName, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.certs) >= maxCachedCerts {
+		a.certs = make(map[string]*tls.Certificate)
+	}
+	a.certs[serverName] = cert
+	return cert, nil
+}
+
+// mint signs a certificate for serverName, never outliving the CA
+func (a *Authority) mint(serverName string, now time.Time) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(a.ttl)
+	if notAfter.After(a.ca.NotAfter) {
+		notAfter = a.ca.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverName},
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(serverName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{serverName}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.ca, &a.key.PublicKey, a.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mint a certificate for %s: %w", serverName, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	a.minted.Add(1)
+	return &tls.Certificate{Certificate: [][]byte{der, a.ca.Raw}, PrivateKey: a.key, Leaf: leaf}, nil
+}
+
+// writePrometheus writes the minting counters in Prometheus text format
+func (a *Authority) writePrometheus(w io.Writer) {
+	a.mu.Lock()
+	cached := len(a.certs)
+	a.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP marchproxy_tls_inspection_certificates_minted_total Certificates minted for intercepted server names\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tls_inspection_certificates_minted_total counter\n")
+	fmt.Fprintf(w, "marchproxy_tls_inspection_certificates_minted_total %d\n", a.minted.Load())
+	fmt.Fprintf(w, "# HELP marchproxy_tls_inspection_certificates_cached Minted certificates currently cached\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tls_inspection_certificates_cached gauge\n")
+	fmt.Fprintf(w, "marchproxy_tls_inspection_certificates_cached %d\n", cached)
+}
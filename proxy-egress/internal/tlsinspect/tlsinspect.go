@@ -0,0 +1,377 @@
+// Package tlsinspect intercepts the TLS connections of egress mappings that
+// opt in. The proxy completes the client's handshake with a certificate it
+// mints for the requested server name from an internal CA the clients
+// trust, opens its own TLS connection to the real server after verifying
+// the server's certificate, and relays the plaintext between the two so
+// the mapping's DLP, domain and mirroring policies see it.
+//
+// Server names on the exclusion lists, such as banking, healthcare or
+// certificate-pinned services, are spliced through untouched and are never
+// issued a certificate. Every decision is written to the audit log.
+package tlsinspect
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log and metrics
+const (
+	ActionIntercepted = "intercepted" // Terminated, inspected and re-encrypted
+	ActionExcluded    = "excluded"    // Spliced through on an exclusion list
+	ActionDenied      = "denied"      // Server name refused by the domain policy
+	ActionRefused     = "refused"     // Upstream certificate failed verification
+	ActionFailed      = "failed"      // A handshake failed, such as with a pinning client
+)
+
+var (
+	// ErrDenied is returned for a server name the domain policy refuses
+	ErrDenied = errors.New("server name denied by domain policy")
+	// ErrUntrusted is returned when the upstream certificate fails
+	// verification; the client is never shown a certificate for it
+	ErrUntrusted = errors.New("upstream certificate not trusted")
+)
+
+// Policy is the TLS inspection part of a mapping
+type Policy struct {
+	Enabled bool `json:"enabled"`
+
+	// Server names spliced through without interception, in addition to
+	// the proxy's global exclusions. "example.com" matches the domain and
+	// its subdomains, "*.example.com" only the subdomains.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Validate checks the exclusion patterns
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	return validatePatterns(p.Exclude)
+}
+
+// validatePatterns checks server name patterns
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		name := strings.TrimPrefix(pattern, "*.")
+		if name == "" || strings.Contains(name, "*") || strings.Contains(name, " ") {
+			return fmt.Errorf("invalid server name pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// matchName reports whether a server name matches any of the patterns
+func matchName(name string, patterns []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+		} else if name == pattern || strings.HasSuffix(name, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configures an Inspector
+type Options struct {
+	Authority *Authority     // Mints the certificates shown to clients
+	Exclude   []string       // Global exclusions, same patterns as Policy.Exclude
+	RootCAs   *x509.CertPool // Verifies upstream servers, nil for the system roots
+	AuditLog  io.Writer      // JSON line per decision, nil disables the log
+	Timeout   time.Duration  // Per handshake, default 10s
+}
+
+// Inspector intercepts the TLS connections of opted-in mappings
+type Inspector struct {
+	opts Options
+
+	logMu sync.Mutex
+
+	mu     sync.Mutex
+	counts map[countKey]uint64
+}
+
+type countKey struct {
+	mapping string
+	action  string
+}
+
+// defaultTimeout bounds each handshake
+const defaultTimeout = 10 * time.Second
+
+// New creates an inspector
+func New(opts Options) (*Inspector, error) {
+	if opts.Authority == nil {
+		return nil, fmt.Errorf("TLS inspection requires a CA")
+	}
+	if err := validatePatterns(opts.Exclude); err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	return &Inspector{opts: opts, counts: make(map[countKey]uint64)}, nil
+}
+
+// Request is one connection to intercept
+type Request struct {
+	Mapping  string
+	Policy   *Policy
+	Client   net.Conn                     // Accepted connection, nothing read from it yet
+	Upstream net.Conn                     // Connected to the destination, nothing written yet
+	Allow    func(serverName string) bool // Domain policy, nil allows every name
+}
+
+// Session is the connection pair to relay after Intercept
+type Session struct {
+	Client      net.Conn // Plaintext when intercepted
+	Upstream    net.Conn // Plaintext when intercepted
+	ServerName  string
+	Intercepted bool
+}
+
+// Intercept reads the client's ClientHello and decides how to handle the
+// connection. Connections that aren't TLS, carry no server name or match
+// an exclusion are returned to be relayed as they are. The returned
+// connections replace the request's; on error the caller closes both.
+func (in *Inspector) Intercept(req Request) (*Session, error) {
+	hello, client, err := peekClientHello(req.Client, in.opts.Timeout)
+	if errors.Is(err, errNotTLS) {
+		return &Session{Client: client, Upstream: req.Upstream}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ClientHello: %w", err)
+	}
+
+	entry := auditEntry{
+		Time:       time.Now().UTC(),
+		Mapping:    req.Mapping,
+		Client:     req.Client.RemoteAddr().String(),
+		Upstream:   req.Upstream.RemoteAddr().String(),
+		ServerName: hello.ServerName,
+	}
+	passthrough := &Session{Client: client, Upstream: req.Upstream, ServerName: hello.ServerName}
+
+	if req.Allow != nil && hello.ServerName != "" && !req.Allow(hello.ServerName) {
+		in.record(entry, ActionDenied, "")
+		return nil, ErrDenied
+	}
+	switch {
+	case hello.ServerName == "":
+		in.record(entry, ActionExcluded, "no server name")
+		return passthrough, nil
+	case matchName(hello.ServerName, in.opts.Exclude):
+		in.record(entry, ActionExcluded, "global exclusion")
+		return passthrough, nil
+	case req.Policy != nil && matchName(hello.ServerName, req.Policy.Exclude):
+		in.record(entry, ActionExcluded, "mapping exclusion")
+		return passthrough, nil
+	}
+
+	// Verify the server before showing the client a certificate for it,
+	// offering the client's ALPN protocols so both sides agree on one
+	upstream := tls.Client(req.Upstream, &tls.Config{
+		ServerName: hello.ServerName,
+		RootCAs:    in.opts.RootCAs,
+		NextProtos: hello.SupportedProtos,
+		MinVersion: tls.VersionTLS12,
+	})
+	upstream.SetDeadline(time.Now().Add(in.opts.Timeout))
+	if err := upstream.Handshake(); err != nil {
+		var verifyErr *tls.CertificateVerificationError
+		if errors.As(err, &verifyErr) {
+			in.record(entry, ActionRefused, err.Error())
+			return nil, fmt.Errorf("%w: %v", ErrUntrusted, err)
+		}
+		in.record(entry, ActionFailed, err.Error())
+		return nil, fmt.Errorf("upstream handshake failed: %w", err)
+	}
+	upstream.SetDeadline(time.Time{})
+	state := upstream.ConnectionState()
+	entry.describeUpstream(state)
+
+	cert, err := in.opts.Authority.Certificate(hello.ServerName)
+	if err != nil {
+		in.record(entry, ActionFailed, err.Error())
+		return nil, err
+	}
+	var protos []string
+	if state.NegotiatedProtocol != "" {
+		protos = []string{state.NegotiatedProtocol}
+	}
+	server := tls.Server(client, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   protos,
+		MinVersion:   tls.VersionTLS12,
+	})
+	server.SetDeadline(time.Now().Add(in.opts.Timeout))
+	if err := server.Handshake(); err != nil {
+		in.record(entry, ActionFailed, err.Error())
+		return nil, fmt.Errorf("client handshake failed: %w", err)
+	}
+	server.SetDeadline(time.Time{})
+
+	in.record(entry, ActionIntercepted, "")
+	return &Session{Client: server, Upstream: upstream, ServerName: hello.ServerName, Intercepted: true}, nil
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Mapping    string    `json:"mapping"`
+	Client     string    `json:"client"`
+	Upstream   string    `json:"upstream"`
+	ServerName string    `json:"server_name"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason,omitempty"`
+
+	// Upstream session, once its handshake completed
+	TLSVersion   string `json:"tls_version,omitempty"`
+	CipherSuite  string `json:"cipher_suite,omitempty"`
+	ALPN         string `json:"alpn,omitempty"`
+	CertSubject  string `json:"cert_subject,omitempty"`
+	CertIssuer   string `json:"cert_issuer,omitempty"`
+	CertNotAfter string `json:"cert_not_after,omitempty"`
+	CertSerial   string `json:"cert_serial,omitempty"`
+}
+
+// describeUpstream adds the upstream session and certificate to the entry
+func (e *auditEntry) describeUpstream(state tls.ConnectionState) {
+	e.TLSVersion = tls.VersionName(state.Version)
+	e.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	e.ALPN = state.NegotiatedProtocol
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		e.CertSubject = leaf.Subject.String()
+		e.CertIssuer = leaf.Issuer.String()
+		e.CertNotAfter = leaf.NotAfter.UTC().Format(time.RFC3339)
+		e.CertSerial = leaf.SerialNumber.Text(16)
+	}
+}
+
+// record counts a decision and writes it to the audit log
+func (in *Inspector) record(entry auditEntry, action, reason string) {
+	in.mu.Lock()
+	in.counts[countKey{mapping: entry.Mapping, action: action}]++
+	in.mu.Unlock()
+
+	if in.opts.AuditLog == nil {
+		return
+	}
+	entry.Action, entry.Reason = action, reason
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	in.logMu.Lock()
+	defer in.logMu.Unlock()
+	in.opts.AuditLog.Write(append(line, '\n'))
+}
+
+// WritePrometheus writes the decisions in Prometheus text format
+func (in *Inspector) WritePrometheus(w io.Writer) {
+	if in == nil {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	keys := make([]countKey, 0, len(in.counts))
+	for key := range in.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mapping != keys[j].mapping {
+			return keys[i].mapping < keys[j].mapping
+		}
+		return keys[i].action < keys[j].action
+	})
+
+	fmt.Fprintf(w, "# HELP marchproxy_tls_inspection_total TLS connections of inspected mappings per mapping and action\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tls_inspection_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_tls_inspection_total{mapping=%q,action=%q} %d\n", key.mapping, key.action, in.counts[key])
+	}
+	in.opts.Authority.writePrometheus(w)
+}
+
+// errNotTLS is returned by peekClientHello for a connection that doesn't
+// start with a TLS handshake record
+var errNotTLS = errors.New("not a TLS connection")
+
+// errHelloRead stops the handshake once the ClientHello has been parsed
+var errHelloRead = errors.New("ClientHello read")
+
+// peekClientHello parses the client's ClientHello without answering it.
+// The returned connection replays the bytes read before continuing with
+// the client's.
+func peekClientHello(conn net.Conn, timeout time.Duration) (*tls.ClientHelloInfo, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	replay := &replayConn{Conn: conn, reader: reader}
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, replay, err
+	}
+	if first[0] != 0x16 {
+		return nil, replay, errNotTLS
+	}
+
+	var recorded bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(readOnlyConn{reader: io.TeeReader(reader, &recorded)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			copied := *info
+			hello = &copied
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, err
+	}
+	replay.reader = io.MultiReader(&recorded, reader)
+	return hello, replay, nil
+}
+
+// replayConn reads through reader, which holds bytes already read from Conn
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// readOnlyConn feeds the ClientHello parser and discards its replies
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)       { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,234 @@
+package tlsinspect
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCA creates a self-signed CA and its key
+func newCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	return ca, key
+}
+
+// upstream serves TLS for api.example.com on one end of a pipe, echoing
+// what it reads
+func upstream(t *testing.T, authority *Authority) net.Conn {
+	t.Helper()
+	cert, err := authority.Certificate("api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxySide, serverSide := net.Pipe()
+	go func() {
+		conn := tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{*cert}})
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	return proxySide
+}
+
+// setup returns an inspector with an audit log and the pool clients trust
+func setup(t *testing.T, upstreamRoots *x509.CertPool, exclude ...string) (*Inspector, *x509.CertPool, *bytes.Buffer) {
+	t.Helper()
+	ca, key := newCA(t, "MarchProxy Inspection CA")
+	authority, err := NewAuthority(ca, key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	inspector, err := New(Options{Authority: authority, Exclude: exclude, RootCAs: upstreamRoots, AuditLog: &audit, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(ca)
+	return inspector, clients, &audit
+}
+
+// lastAudit returns the last audit log entry
+func lastAudit(t *testing.T, audit *bytes.Buffer) auditEntry {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("audit log %q: %v", audit.String(), err)
+	}
+	return entry
+}
+
+// TestIntercept tests that the plaintext of an intercepted connection
+// flows through the proxy
+func TestIntercept(t *testing.T) {
+	upstreamCA, upstreamKey := newCA(t, "Public CA")
+	upstreamAuthority, _ := NewAuthority(upstreamCA, upstreamKey, time.Hour)
+	roots := x509.NewCertPool()
+	roots.AddCert(upstreamCA)
+	inspector, clientRoots, audit := setup(t, roots)
+
+	clientSide, proxySide := net.Pipe()
+	go func() {
+		client := tls.Client(clientSide, &tls.Config{ServerName: "api.example.com", RootCAs: clientRoots})
+		defer client.Close()
+		client.Write([]byte("card=4111"))
+		io.ReadFull(client, make([]byte, 9))
+	}()
+
+	session, err := inspector.Intercept(Request{Mapping: "web", Policy: &Policy{Enabled: true}, Client: proxySide, Upstream: upstream(t, upstreamAuthority)})
+	if err != nil {
+		t.Fatalf("Intercept: %v", err)
+	}
+	if !session.Intercepted || session.ServerName != "api.example.com" {
+		t.Fatalf("session = %+v", session)
+	}
+
+	plaintext := make([]byte, 9)
+	if _, err := io.ReadFull(session.Client, plaintext); err != nil || string(plaintext) != "card=4111" {
+		t.Fatalf("client plaintext = %q, %v", plaintext, err)
+	}
+	session.Upstream.Write(plaintext)
+	io.ReadFull(session.Upstream, plaintext)
+	session.Client.Write(plaintext)
+
+	entry := lastAudit(t, audit)
+	if entry.Action != ActionIntercepted || entry.CertSubject != "CN=api.example.com" || entry.TLSVersion == "" {
+		t.Errorf("audit entry = %+v", entry)
+	}
+}
+
+// TestExcluded tests that excluded and non-TLS connections pass untouched
+func TestExcluded(t *testing.T) {
+	inspector, _, audit := setup(t, nil, "bank.example")
+
+	for _, name := range []string{"www.bank.example", "health.example"} {
+		clientSide, proxySide := net.Pipe()
+		go tls.Client(clientSide, &tls.Config{ServerName: name}).Handshake()
+
+		upstreamSide, _ := net.Pipe()
+		session, err := inspector.Intercept(Request{
+			Mapping:  "web",
+			Policy:   &Policy{Enabled: true, Exclude: []string{"*.health.example", "health.example"}},
+			Client:   proxySide,
+			Upstream: upstreamSide,
+		})
+		if err != nil {
+			t.Fatalf("Intercept(%s): %v", name, err)
+		}
+		if session.Intercepted || session.Upstream != upstreamSide {
+			t.Errorf("Intercept(%s) intercepted", name)
+		}
+		if entry := lastAudit(t, audit); entry.Action != ActionExcluded {
+			t.Errorf("Intercept(%s) audit action %s", name, entry.Action)
+		}
+
+		// The ClientHello is replayed to the upstream
+		header := make([]byte, 1)
+		if _, err := session.Client.Read(header); err != nil || header[0] != 0x16 {
+			t.Errorf("Intercept(%s) replay = %x, %v", name, header, err)
+		}
+		clientSide.Close()
+	}
+
+	clientSide, proxySide := net.Pipe()
+	go clientSide.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	session, err := inspector.Intercept(Request{Mapping: "web", Client: proxySide, Upstream: proxySide})
+	if err != nil || session.Intercepted {
+		t.Fatalf("Intercept(plaintext) = %+v, %v", session, err)
+	}
+	line := make([]byte, 3)
+	if _, err := io.ReadFull(session.Client, line); err != nil || string(line) != "GET" {
+		t.Errorf("plaintext replay = %q, %v", line, err)
+	}
+}
+
+// TestRefused tests that untrusted upstreams and denied names are refused
+func TestRefused(t *testing.T) {
+	upstreamCA, upstreamKey := newCA(t, "Unknown CA")
+	upstreamAuthority, _ := NewAuthority(upstreamCA, upstreamKey, time.Hour)
+	inspector, clientRoots, audit := setup(t, x509.NewCertPool())
+
+	clientSide, proxySide := net.Pipe()
+	go tls.Client(clientSide, &tls.Config{ServerName: "api.example.com", RootCAs: clientRoots}).Handshake()
+	_, err := inspector.Intercept(Request{Mapping: "web", Policy: &Policy{Enabled: true}, Client: proxySide, Upstream: upstream(t, upstreamAuthority)})
+	if !errors.Is(err, ErrUntrusted) {
+		t.Errorf("Intercept = %v, want ErrUntrusted", err)
+	}
+	if entry := lastAudit(t, audit); entry.Action != ActionRefused {
+		t.Errorf("audit action %s, want %s", entry.Action, ActionRefused)
+	}
+	clientSide.Close()
+
+	clientSide, proxySide = net.Pipe()
+	go tls.Client(clientSide, &tls.Config{ServerName: "blocked.example"}).Handshake()
+	upstreamSide, _ := net.Pipe()
+	_, err = inspector.Intercept(Request{
+		Mapping:  "web",
+		Policy:   &Policy{Enabled: true},
+		Client:   proxySide,
+		Upstream: upstreamSide,
+		Allow:    func(name string) bool { return name != "blocked.example" },
+	})
+	if !errors.Is(err, ErrDenied) {
+		t.Errorf("Intercept = %v, want ErrDenied", err)
+	}
+	clientSide.Close()
+}
+
+// TestAuthority tests the minted certificates and the CA checks
+func TestAuthority(t *testing.T) {
+	ca, key := newCA(t, "MarchProxy Inspection CA")
+	authority, err := NewAuthority(ca, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := authority.Certificate("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Leaf.IPAddresses) != 1 || cert.Leaf.NotAfter.After(ca.NotAfter) {
+		t.Errorf("leaf = %v, not after %s", cert.Leaf.IPAddresses, cert.Leaf.NotAfter)
+	}
+	if again, _ := authority.Certificate("10.0.0.1"); again != cert {
+		t.Error("certificate not cached")
+	}
+
+	leaf := *cert.Leaf
+	leaf.IsCA = false
+	if _, err := NewAuthority(&leaf, key, 0); err == nil {
+		t.Error("NewAuthority accepted a leaf certificate")
+	}
+	if err := (&Policy{Exclude: []string{"*.*.example"}}).Validate(); err == nil {
+		t.Error("Validate accepted an invalid pattern")
+	}
+}
@@ -0,0 +1,554 @@
+// Package tlsmode enforces the TLS mode of egress mappings:
+//
+//   - require: the connection to the destination must be TLS with a
+//     certificate that verifies for the server name. Plaintext clients are
+//     refused, and the destination's certificate is verified with a probe
+//     handshake before the client's own handshake is relayed to it.
+//   - passthrough: TLS is relayed untouched, never inspected or terminated.
+//   - terminate: the proxy ends the client's TLS, or accepts its plaintext,
+//     and originates its own verified TLS connection to the destination.
+//
+// Handshake failures carry a reason, such as unknown_authority or
+// hostname_mismatch, for the logs and metrics.
+package tlsmode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of a mapping
+const (
+	ModeRequire     = "require"
+	ModePassthrough = "passthrough"
+	ModeTerminate   = "terminate"
+)
+
+// Handshake failure reasons
+const (
+	ReasonPlaintext        = "plaintext"           // The client didn't start a TLS handshake
+	ReasonNoCertificate    = "no_certificate"      // A TLS client on a terminate mapping without a certificate
+	ReasonUnknownAuthority = "unknown_authority"   // The destination's chain isn't trusted
+	ReasonHostnameMismatch = "hostname_mismatch"   // The certificate isn't valid for the server name
+	ReasonExpired          = "certificate_expired" // The certificate is expired or not yet valid
+	ReasonInvalidCert      = "certificate_invalid" // Any other certificate verification failure
+	ReasonProtocolVersion  = "protocol_version"    // No TLS version in common
+	ReasonTimeout          = "timeout"             // The handshake didn't complete in time
+	ReasonClientHandshake  = "client_handshake"    // The client's handshake with the proxy failed
+	ReasonHandshake        = "handshake_failed"    // Any other handshake failure
+)
+
+// resultOK counts connections whose policy was enforced without error
+const resultOK = "ok"
+
+// Policy is the TLS mode of a mapping
+type Policy struct {
+	Mode string `json:"mode"` // require, passthrough or terminate
+
+	// Name verified on the destination's certificate; defaults to the
+	// client's server name, then the destination host
+	ServerName string `json:"server_name,omitempty"`
+
+	// PEM bundle of CAs trusted for the destination instead of the proxy's
+	RootCAs string `json:"root_cas,omitempty"`
+
+	// Lowest TLS version accepted from the destination, "1.2" by default
+	MinVersion string `json:"min_version,omitempty"`
+
+	// PEM certificate and key shown to TLS clients of terminate mappings;
+	// without them only plaintext clients and clients whose TLS the
+	// listener ended are accepted
+	Certificate string `json:"certificate,omitempty"`
+	PrivateKey  string `json:"private_key,omitempty"`
+}
+
+// Validate checks the mode, version, CAs and certificate
+func (p *Policy) Validate() error {
+	_, err := compile(p)
+	return err
+}
+
+// compiled is a policy with its PEM parsed
+type compiled struct {
+	policy     *Policy
+	rootCAs    *x509.CertPool
+	minVersion uint16
+	cert       *tls.Certificate
+}
+
+// compile parses a policy
+func compile(p *Policy) (*compiled, error) {
+	if p == nil {
+		return nil, nil
+	}
+	switch p.Mode {
+	case ModeRequire, ModePassthrough, ModeTerminate:
+	default:
+		return nil, fmt.Errorf("invalid TLS mode %q", p.Mode)
+	}
+
+	c := &compiled{policy: p, minVersion: tls.VersionTLS12}
+	switch p.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		c.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid minimum TLS version %q", p.MinVersion)
+	}
+
+	if p.RootCAs != "" {
+		c.rootCAs = x509.NewCertPool()
+		if !c.rootCAs.AppendCertsFromPEM([]byte(p.RootCAs)) {
+			return nil, fmt.Errorf("no certificates in root_cas")
+		}
+	}
+
+	if (p.Certificate == "") != (p.PrivateKey == "") {
+		return nil, fmt.Errorf("certificate and private_key must be set together")
+	}
+	if p.Certificate != "" {
+		if p.Mode != ModeTerminate {
+			return nil, fmt.Errorf("a certificate is only used by the terminate mode")
+		}
+		cert, err := tls.X509KeyPair([]byte(p.Certificate), []byte(p.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		c.cert = &cert
+	}
+	return c, nil
+}
+
+// HandshakeError is a TLS policy failure with the reason it is counted under
+type HandshakeError struct {
+	Reason string
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns the failure reason of err, ReasonHandshake when it has none
+func Reason(err error) string {
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.Reason
+	}
+	return ReasonHandshake
+}
+
+// classify returns the reason of an upstream handshake error
+func classify(err error) string {
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &hostnameErr):
+		return ReasonHostnameMismatch
+	case errors.As(err, &authorityErr):
+		return ReasonUnknownAuthority
+	case errors.As(err, &invalidErr):
+		if invalidErr.Reason == x509.Expired {
+			return ReasonExpired
+		}
+		return ReasonInvalidCert
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	}
+
+	var alert tls.AlertError
+	if errors.As(err, &alert) && alert == 70 { // protocol_version
+		return ReasonProtocolVersion
+	}
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		return ReasonInvalidCert
+	}
+	if strings.Contains(err.Error(), "protocol version") {
+		return ReasonProtocolVersion
+	}
+	return ReasonHandshake
+}
+
+// Options configures an Enforcer
+type Options struct {
+	RootCAs   *x509.CertPool // Verifies destinations, nil for the system roots
+	Timeout   time.Duration  // Per handshake, default 10s
+	VerifyTTL time.Duration  // How long a verified destination skips the probe, default 5m
+}
+
+// Defaults of Options
+const (
+	defaultTimeout   = 10 * time.Second
+	defaultVerifyTTL = 5 * time.Minute
+)
+
+// maxCached bounds the compiled policies and verified destinations kept
+const maxCached = 1024
+
+// Enforcer applies the TLS mode of mappings to their connections
+type Enforcer struct {
+	opts Options
+
+	mu       sync.Mutex
+	policies map[string]*compiled
+	verified map[verifyKey]time.Time
+	counts   map[countKey]uint64
+}
+
+type verifyKey struct {
+	destination string
+	serverName  string
+	policy      string
+}
+
+type countKey struct {
+	mapping string
+	mode    string
+	result  string
+}
+
+// New creates an enforcer
+func New(opts Options) *Enforcer {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.VerifyTTL <= 0 {
+		opts.VerifyTTL = defaultVerifyTTL
+	}
+	return &Enforcer{
+		opts:     opts,
+		policies: make(map[string]*compiled),
+		verified: make(map[verifyKey]time.Time),
+		counts:   make(map[countKey]uint64),
+	}
+}
+
+// Request is one connection of a mapping with a TLS mode
+type Request struct {
+	Mapping     string
+	Policy      *Policy
+	Client      net.Conn                 // Accepted connection, nothing read from it yet
+	Upstream    net.Conn                 // Connected to the destination, nothing written yet
+	Destination string                   // host:port of the destination
+	Redial      func() (net.Conn, error) // Opens another connection to the destination, for probes
+}
+
+// Session is the connection pair to relay after Apply
+type Session struct {
+	Client     net.Conn
+	Upstream   net.Conn
+	ServerName string
+	Version    uint16 // TLS version verified or negotiated with the destination, 0 for passthrough
+	Terminated bool   // The proxy relays plaintext between its own TLS sessions
+}
+
+// Apply enforces the request's policy, returning the connections to relay
+// in place of the request's. A nil policy relays them as they are. Errors
+// are *HandshakeError; the caller closes both connections.
+func (e *Enforcer) Apply(req Request) (*Session, error) {
+	if req.Policy == nil {
+		return &Session{Client: req.Client, Upstream: req.Upstream}, nil
+	}
+	c, err := e.compiled(req.Policy)
+	if err != nil {
+		return nil, &HandshakeError{Reason: ReasonHandshake, Err: err}
+	}
+
+	var session *Session
+	switch c.policy.Mode {
+	case ModePassthrough:
+		session = &Session{Client: req.Client, Upstream: req.Upstream}
+	case ModeRequire:
+		session, err = e.require(c, req)
+	case ModeTerminate:
+		session, err = e.terminate(c, req)
+	}
+	e.count(req.Mapping, c.policy.Mode, err)
+	return session, err
+}
+
+// compiled returns the parsed policy, parsing it once per distinct policy
+func (e *Enforcer) compiled(p *Policy) (*compiled, error) {
+	key, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.policies[string(key)]; ok {
+		return c, nil
+	}
+	c, err := compile(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.policies) >= maxCached {
+		e.policies = make(map[string]*compiled)
+	}
+	e.policies[string(key)] = c
+	return c, nil
+}
+
+// require refuses plaintext clients and verifies the destination before
+// relaying the client's handshake to it
+func (e *Enforcer) require(c *compiled, req Request) (*Session, error) {
+	hello, client, err := peekClientHello(req.Client, e.opts.Timeout)
+	if errors.Is(err, errNotTLS) {
+		return nil, &HandshakeError{Reason: ReasonPlaintext, Err: err}
+	}
+	if err != nil {
+		return nil, &HandshakeError{Reason: ReasonClientHandshake, Err: fmt.Errorf("failed to read ClientHello: %w", err)}
+	}
+
+	serverName := e.serverName(c, hello.ServerName, req.Destination)
+	key := verifyKey{destination: req.Destination, serverName: serverName, policy: c.policy.RootCAs + c.policy.MinVersion}
+	version, err := e.verify(c, key, req.Redial)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Client: client, Upstream: req.Upstream, ServerName: serverName, Version: version}, nil
+}
+
+// verify probes the destination with a handshake of its own unless it
+// verified recently. The version of a cached verification is unknown.
+func (e *Enforcer) verify(c *compiled, key verifyKey, redial func() (net.Conn, error)) (uint16, error) {
+	e.mu.Lock()
+	verifiedAt, ok := e.verified[key]
+	e.mu.Unlock()
+	if ok && time.Since(verifiedAt) < e.opts.VerifyTTL {
+		return 0, nil
+	}
+
+	if redial == nil {
+		return 0, &HandshakeError{Reason: ReasonHandshake, Err: fmt.Errorf("no way to probe %s", key.destination)}
+	}
+	conn, err := redial()
+	if err != nil {
+		return 0, &HandshakeError{Reason: ReasonHandshake, Err: fmt.Errorf("failed to probe %s: %w", key.destination, err)}
+	}
+	probe, err := e.handshake(c, conn, key.serverName, nil)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	version := probe.ConnectionState().Version
+	probe.Close()
+
+	e.mu.Lock()
+	if len(e.verified) >= maxCached {
+		e.verified = make(map[verifyKey]time.Time)
+	}
+	e.verified[key] = time.Now()
+	e.mu.Unlock()
+	return version, nil
+}
+
+// terminate ends the client's TLS, when it still speaks TLS, and opens a
+// verified TLS connection to the destination
+func (e *Enforcer) terminate(c *compiled, req Request) (*Session, error) {
+	client := req.Client
+	clientTLS := false
+	clientName := ""
+	var clientProtos []string
+
+	if _, ok := client.(*tls.Conn); !ok {
+		hello, peeked, err := peekClientHello(client, e.opts.Timeout)
+		client = peeked
+		switch {
+		case errors.Is(err, errNotTLS):
+			// Plaintext client: originate TLS only
+		case err != nil:
+			return nil, &HandshakeError{Reason: ReasonClientHandshake, Err: fmt.Errorf("failed to read ClientHello: %w", err)}
+		case c.cert == nil:
+			return nil, &HandshakeError{Reason: ReasonNoCertificate, Err: fmt.Errorf("TLS client on a terminate mapping without a certificate")}
+		default:
+			clientTLS = true
+			clientName = hello.ServerName
+			clientProtos = hello.SupportedProtos
+		}
+	}
+
+	serverName := e.serverName(c, clientName, req.Destination)
+	upstream, err := e.handshake(c, req.Upstream, serverName, clientProtos)
+	if err != nil {
+		return nil, err
+	}
+	state := upstream.ConnectionState()
+
+	if clientTLS {
+		var protos []string
+		if state.NegotiatedProtocol != "" {
+			protos = []string{state.NegotiatedProtocol}
+		}
+		server := tls.Server(client, &tls.Config{
+			Certificates: []tls.Certificate{*c.cert},
+			NextProtos:   protos,
+			MinVersion:   tls.VersionTLS12,
+		})
+		server.SetDeadline(time.Now().Add(e.opts.Timeout))
+		if err := server.Handshake(); err != nil {
+			return nil, &HandshakeError{Reason: ReasonClientHandshake, Err: err}
+		}
+		server.SetDeadline(time.Time{})
+		client = server
+	}
+	return &Session{Client: client, Upstream: upstream, ServerName: serverName, Version: state.Version, Terminated: true}, nil
+}
+
+// handshake runs a verified client handshake with the destination
+func (e *Enforcer) handshake(c *compiled, conn net.Conn, serverName string, protos []string) (*tls.Conn, error) {
+	rootCAs := e.opts.RootCAs
+	if c.rootCAs != nil {
+		rootCAs = c.rootCAs
+	}
+	upstream := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    rootCAs,
+		NextProtos: protos,
+		MinVersion: c.minVersion,
+	})
+	upstream.SetDeadline(time.Now().Add(e.opts.Timeout))
+	if err := upstream.Handshake(); err != nil {
+		return nil, &HandshakeError{Reason: classify(err), Err: err}
+	}
+	upstream.SetDeadline(time.Time{})
+	return upstream, nil
+}
+
+// serverName returns the name verified on the destination's certificate
+func (e *Enforcer) serverName(c *compiled, clientName, destination string) string {
+	if c.policy.ServerName != "" {
+		return c.policy.ServerName
+	}
+	if clientName != "" {
+		return clientName
+	}
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		return destination
+	}
+	return host
+}
+
+// count records the outcome of a connection
+func (e *Enforcer) count(mapping, mode string, err error) {
+	result := resultOK
+	if err != nil {
+		result = Reason(err)
+	}
+	e.mu.Lock()
+	e.counts[countKey{mapping: mapping, mode: mode, result: result}]++
+	e.mu.Unlock()
+}
+
+// WritePrometheus writes the outcomes in Prometheus text format
+func (e *Enforcer) WritePrometheus(w io.Writer) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	keys := make([]countKey, 0, len(e.counts))
+	for key := range e.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mapping != keys[j].mapping {
+			return keys[i].mapping < keys[j].mapping
+		}
+		if keys[i].mode != keys[j].mode {
+			return keys[i].mode < keys[j].mode
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	fmt.Fprintf(w, "# HELP marchproxy_tls_mode_connections_total Connections of mappings with a TLS mode per mapping, mode and result, ok or the handshake failure reason\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_tls_mode_connections_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "marchproxy_tls_mode_connections_total{mapping=%q,mode=%q,result=%q} %d\n", key.mapping, key.mode, key.result, e.counts[key])
+	}
+}
+
+// errNotTLS is returned by peekClientHello for a connection that doesn't
+// start with a TLS handshake record
+var errNotTLS = errors.New("not a TLS connection")
+
+// errHelloRead stops the handshake once the ClientHello has been parsed
+var errHelloRead = errors.New("ClientHello read")
+
+// peekClientHello parses the client's ClientHello without answering it.
+// The returned connection replays the bytes read before continuing with
+// the client's.
+func peekClientHello(conn net.Conn, timeout time.Duration) (*tls.ClientHelloInfo, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	replay := &replayConn{Conn: conn, reader: reader}
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, replay, err
+	}
+	if first[0] != 0x16 {
+		return nil, replay, errNotTLS
+	}
+
+	var recorded bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(readOnlyConn{reader: io.TeeReader(reader, &recorded)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			copied := *info
+			hello = &copied
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, err
+	}
+	replay.reader = io.MultiReader(&recorded, reader)
+	return hello, replay, nil
+}
+
+// replayConn reads through reader, which holds bytes already read from Conn
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// readOnlyConn feeds the ClientHello parser and discards its replies
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)       { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,300 @@
+package tlsmode
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCA creates a self-signed CA and its key
+func newCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	return ca, key
+}
+
+// leaf issues a certificate for name, returning it with its PEM encoding
+func leaf(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) (tls.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+// caPEM encodes a CA certificate
+func caPEM(ca *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+}
+
+// upstream serves TLS with cert on a loopback connection, echoing what it
+// reads. Unlike a pipe, the socket buffers the alert of a client refusing
+// the certificate while the server is still writing.
+func upstream(t *testing.T, cert tls.Certificate) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		serverSide, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{cert}})
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// tlsClient starts a TLS handshake for serverName on one end of a pipe,
+// returning the other end
+func tlsClient(t *testing.T, serverName string, roots *x509.CertPool) net.Conn {
+	t.Helper()
+	clientSide, proxySide := net.Pipe()
+	go func() {
+		conn := tls.Client(clientSide, &tls.Config{ServerName: serverName, RootCAs: roots})
+		conn.Handshake()
+	}()
+	t.Cleanup(func() { clientSide.Close(); proxySide.Close() })
+	return proxySide
+}
+
+func TestValidate(t *testing.T) {
+	ca, caKey := newCA(t, "CA")
+	_, certPEM, keyPEM := leaf(t, ca, caKey, "proxy.example.com")
+
+	valid := []*Policy{
+		nil,
+		{Mode: ModeRequire, RootCAs: caPEM(ca)},
+		{Mode: ModePassthrough},
+		{Mode: ModeTerminate, MinVersion: "1.3", Certificate: certPEM, PrivateKey: keyPEM},
+	}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v", p, err)
+		}
+	}
+
+	invalid := []*Policy{
+		{Mode: "strict"},
+		{Mode: ModeRequire, MinVersion: "1.1"},
+		{Mode: ModeRequire, RootCAs: "not a certificate"},
+		{Mode: ModeTerminate, Certificate: certPEM},
+		{Mode: ModeRequire, Certificate: certPEM, PrivateKey: keyPEM},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", p)
+		}
+	}
+}
+
+// TestRequire tests that a verified destination is probed once and the
+// client's own handshake is relayed untouched
+func TestRequire(t *testing.T) {
+	ca, caKey := newCA(t, "CA")
+	cert, _, _ := leaf(t, ca, caKey, "api.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	enforcer := New(Options{RootCAs: roots, Timeout: 5 * time.Second})
+
+	probes := 0
+	redial := func() (net.Conn, error) {
+		probes++
+		return upstream(t, cert), nil
+	}
+	for i := 0; i < 2; i++ {
+		upstreamConn, _ := net.Pipe()
+		session, err := enforcer.Apply(Request{
+			Mapping:     "api",
+			Policy:      &Policy{Mode: ModeRequire},
+			Client:      tlsClient(t, "api.example.com", roots),
+			Upstream:    upstreamConn,
+			Destination: "10.0.0.1:443",
+			Redial:      redial,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.ServerName != "api.example.com" || session.Terminated {
+			t.Errorf("Session = %+v", session)
+		}
+		if session.Upstream != upstreamConn {
+			t.Error("Expected the upstream connection to be relayed as it is")
+		}
+
+		// The ClientHello is replayed to the destination
+		record := make([]byte, 1)
+		if _, err := session.Client.Read(record); err != nil || record[0] != 0x16 {
+			t.Errorf("First byte = %x, %v, want a handshake record", record, err)
+		}
+	}
+	if probes != 1 {
+		t.Errorf("Probes = %d, want 1", probes)
+	}
+}
+
+func TestRequireRefusals(t *testing.T) {
+	ca, caKey := newCA(t, "CA")
+	other, _ := newCA(t, "Other CA")
+	cert, _, _ := leaf(t, ca, caKey, "api.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		name   string
+		policy *Policy
+		client func() net.Conn
+		want   string
+	}{
+		{
+			name:   "plaintext",
+			policy: &Policy{Mode: ModeRequire},
+			client: func() net.Conn {
+				clientSide, proxySide := net.Pipe()
+				go clientSide.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+				return proxySide
+			},
+			want: ReasonPlaintext,
+		},
+		{
+			name:   "unknown authority",
+			policy: &Policy{Mode: ModeRequire, RootCAs: caPEM(other)},
+			client: func() net.Conn { return tlsClient(t, "api.example.com", roots) },
+			want:   ReasonUnknownAuthority,
+		},
+		{
+			name:   "hostname mismatch",
+			policy: &Policy{Mode: ModeRequire, ServerName: "db.example.com"},
+			client: func() net.Conn { return tlsClient(t, "api.example.com", roots) },
+			want:   ReasonHostnameMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enforcer := New(Options{RootCAs: roots, Timeout: 5 * time.Second})
+			_, err := enforcer.Apply(Request{
+				Mapping:     "api",
+				Policy:      tt.policy,
+				Client:      tt.client(),
+				Destination: "10.0.0.1:443",
+				Redial:      func() (net.Conn, error) { return upstream(t, cert), nil },
+			})
+			var handshakeErr *HandshakeError
+			if !errors.As(err, &handshakeErr) || handshakeErr.Reason != tt.want {
+				t.Fatalf("Apply = %v, want reason %s", err, tt.want)
+			}
+
+			var metrics strings.Builder
+			enforcer.WritePrometheus(&metrics)
+			want := `marchproxy_tls_mode_connections_total{mapping="api",mode="require",result="` + tt.want + `"} 1`
+			if !strings.Contains(metrics.String(), want) {
+				t.Errorf("Metrics missing %s:\n%s", want, metrics.String())
+			}
+		})
+	}
+}
+
+// TestTerminate tests TLS origination for a plaintext client and that TLS
+// clients are refused without a certificate to show them
+func TestTerminate(t *testing.T) {
+	ca, caKey := newCA(t, "CA")
+	cert, _, _ := leaf(t, ca, caKey, "api.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	enforcer := New(Options{RootCAs: roots, Timeout: 5 * time.Second})
+
+	clientSide, proxySide := net.Pipe()
+	defer clientSide.Close()
+	go clientSide.Write([]byte("ping"))
+	session, err := enforcer.Apply(Request{
+		Mapping:     "api",
+		Policy:      &Policy{Mode: ModeTerminate, ServerName: "api.example.com"},
+		Client:      proxySide,
+		Upstream:    upstream(t, cert),
+		Destination: "10.0.0.1:443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.Terminated || session.Version < tls.VersionTLS12 {
+		t.Errorf("Session = %+v", session)
+	}
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(session.Client, request); err != nil {
+		t.Fatal(err)
+	}
+	session.Upstream.Write(request)
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(session.Upstream, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Reply = %q, %v", reply, err)
+	}
+
+	_, err = enforcer.Apply(Request{
+		Mapping:     "api",
+		Policy:      &Policy{Mode: ModeTerminate},
+		Client:      tlsClient(t, "api.example.com", roots),
+		Upstream:    upstream(t, cert),
+		Destination: "10.0.0.1:443",
+	})
+	if Reason(err) != ReasonNoCertificate {
+		t.Errorf("Apply = %v, want reason %s", err, ReasonNoCertificate)
+	}
+}
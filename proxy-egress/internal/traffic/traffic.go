@@ -0,0 +1,140 @@
+// Package traffic counts relayed bytes per mapping, destination service and
+// tenant, split by direction. Egress bytes are sent by clients towards
+// destinations (requests); ingress bytes are the destinations' replies
+// (responses). Counts are totals since the proxy started: they are exposed
+// to Prometheus and sent with heartbeats, where the manager enforces quotas
+// on the difference between two heartbeats.
+package traffic
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Paths that relay bytes
+const (
+	PathUserspace = "userspace" // Relayed by the proxy
+	PathEBPF      = "ebpf"      // Forwarded by the eBPF program
+)
+
+// Key identifies the traffic of one mapping, destination service and
+// tenant
+type Key struct {
+	Mapping string
+	Service string
+	Tenant  string
+}
+
+// Entry is the traffic of one key on one path
+type Entry struct {
+	Mapping      string `json:"mapping"`
+	Service      string `json:"service"`
+	Tenant       string `json:"tenant"`
+	Path         string `json:"path"`
+	EgressBytes  uint64 `json:"egress_bytes"`
+	IngressBytes uint64 `json:"ingress_bytes"`
+}
+
+// bytes are the egress and ingress bytes of a key
+type bytes struct {
+	egress, ingress uint64
+}
+
+// Counter counts the bytes relayed in userspace. The zero value is ready to
+// use.
+type Counter struct {
+	keys map[Key]*bytes
+	mu   sync.Mutex
+}
+
+// Egress adds n bytes sent towards the destination
+func (c *Counter) Egress(key Key, n int64) {
+	c.add(key, n, 0)
+}
+
+// Ingress adds n bytes received from the destination
+func (c *Counter) Ingress(key Key, n int64) {
+	c.add(key, 0, n)
+}
+
+func (c *Counter) add(key Key, egress, ingress int64) {
+	if egress <= 0 && ingress <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys == nil {
+		c.keys = make(map[Key]*bytes)
+	}
+	b := c.keys[key]
+	if b == nil {
+		b = &bytes{}
+		c.keys[key] = b
+	}
+	if egress > 0 {
+		b.egress += uint64(egress)
+	}
+	if ingress > 0 {
+		b.ingress += uint64(ingress)
+	}
+}
+
+// Entries returns the userspace traffic of every key seen so far
+func (c *Counter) Entries() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]Entry, 0, len(c.keys))
+	for key, b := range c.keys {
+		entries = append(entries, Entry{
+			Mapping:      key.Mapping,
+			Service:      key.Service,
+			Tenant:       key.Tenant,
+			Path:         PathUserspace,
+			EgressBytes:  b.egress,
+			IngressBytes: b.ingress,
+		})
+	}
+	Sort(entries)
+	return entries
+}
+
+// Sort orders entries by mapping, service, tenant and path
+func Sort(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Mapping != b.Mapping {
+			return a.Mapping < b.Mapping
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.Path < b.Path
+	})
+}
+
+// Totals sums the egress and ingress bytes of entries
+func Totals(entries []Entry) (egress, ingress uint64) {
+	for _, e := range entries {
+		egress += e.EgressBytes
+		ingress += e.IngressBytes
+	}
+	return egress, ingress
+}
+
+// WritePrometheus writes entries as a counter labeled by direction
+func WritePrometheus(w io.Writer, entries []Entry) {
+	fmt.Fprintf(w, "# HELP marchproxy_traffic_bytes_total Bytes relayed per mapping, destination service, tenant and path, egress towards the destination and ingress from it\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_traffic_bytes_total counter\n")
+	for _, e := range entries {
+		labels := fmt.Sprintf("mapping=%q,service=%q,tenant=%q,path=%q", e.Mapping, e.Service, e.Tenant, e.Path)
+		fmt.Fprintf(w, "marchproxy_traffic_bytes_total{%s,direction=\"egress\"} %d\n", labels, e.EgressBytes)
+		fmt.Fprintf(w, "marchproxy_traffic_bytes_total{%s,direction=\"ingress\"} %d\n", labels, e.IngressBytes)
+	}
+}
@@ -0,0 +1,44 @@
+package traffic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	var c Counter
+	api := Key{Mapping: "api", Service: "payments", Tenant: "acme"}
+	c.Egress(api, 100)
+	c.Ingress(api, 2500)
+	c.Egress(api, 50)
+	c.Ingress(Key{Mapping: "db", Service: "postgres"}, 10)
+	c.Egress(Key{Mapping: "idle"}, 0)
+
+	entries := c.Entries()
+	want := []Entry{
+		{Mapping: "api", Service: "payments", Tenant: "acme", Path: PathUserspace, EgressBytes: 150, IngressBytes: 2500},
+		{Mapping: "db", Service: "postgres", Path: PathUserspace, IngressBytes: 10},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Entries = %+v", entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("Entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+	if egress, ingress := Totals(entries); egress != 150 || ingress != 2510 {
+		t.Errorf("Totals = %d, %d", egress, ingress)
+	}
+
+	var metrics strings.Builder
+	WritePrometheus(&metrics, entries)
+	for _, line := range []string{
+		`marchproxy_traffic_bytes_total{mapping="api",service="payments",tenant="acme",path="userspace",direction="egress"} 150`,
+		`marchproxy_traffic_bytes_total{mapping="api",service="payments",tenant="acme",path="userspace",direction="ingress"} 2500`,
+	} {
+		if !strings.Contains(metrics.String(), line) {
+			t.Errorf("Metrics missing %s:\n%s", line, metrics.String())
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package upstreamproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// httpConnect asks an HTTP upstream to open a tunnel to address, returning
+// the tunnel. Bytes the upstream sent after its reply are replayed.
+func httpConnect(conn net.Conn, upstream *Upstream, address string) (net.Conn, error) {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if upstream.Username != "" || upstream.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(upstream.Username + ":" + upstream.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	request += "\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, &Error{Upstream: upstream.Name, Reason: ReasonUnreachable, Err: err}
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("invalid CONNECT response: %w", err)
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusProxyAuthRequired:
+		return nil, &Error{Upstream: upstream.Name, Reason: ReasonAuth, Err: fmt.Errorf("CONNECT %s: %s", address, response.Status)}
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return nil, &Error{Upstream: upstream.Name, Reason: ReasonRefused, Err: fmt.Errorf("CONNECT %s: %s", address, response.Status)}
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the CONNECT reply
+// before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,160 @@
+package upstreamproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion      = 0x05
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xff
+	socksConnect      = 0x01
+	socksIPv4         = 0x01
+	socksDomain       = 0x03
+	socksIPv6         = 0x04
+)
+
+// socksReplies describes the reply codes of a CONNECT request
+var socksReplies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect asks a SOCKS5 upstream to connect to address, leaving conn
+// tunneled to it
+func socks5Connect(conn net.Conn, upstream *Upstream, address string) error {
+	methods := []byte{socksNoAuth}
+	if upstream.Username != "" || upstream.Password != "" {
+		methods = []byte{socksUserPass}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return &Error{Upstream: upstream.Name, Reason: ReasonUnreachable, Err: err}
+	}
+
+	choice := make([]byte, 2)
+	if _, err := io.ReadFull(conn, choice); err != nil {
+		return fmt.Errorf("no method selected: %w", err)
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", choice[0])
+	}
+	switch choice[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if err := socks5Authenticate(conn, upstream); err != nil {
+			return err
+		}
+	case socksNoAcceptable:
+		return &Error{Upstream: upstream.Name, Reason: ReasonAuth, Err: fmt.Errorf("no acceptable authentication method")}
+	default:
+		return fmt.Errorf("unsupported authentication method %d", choice[1])
+	}
+
+	request, err := socks5Request(address)
+	if err != nil {
+		return &Error{Upstream: upstream.Name, Reason: ReasonRefused, Err: err}
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address and port
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("no CONNECT reply: %w", err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != 0x00 {
+		message, known := socksReplies[reply[1]]
+		if !known {
+			message = fmt.Sprintf("reply code %d", reply[1])
+		}
+		return &Error{Upstream: upstream.Name, Reason: ReasonRefused, Err: fmt.Errorf("CONNECT %s: %s", address, message)}
+	}
+
+	var boundLen int
+	switch reply[3] {
+	case socksIPv4:
+		boundLen = net.IPv4len
+	case socksIPv6:
+		boundLen = net.IPv6len
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLen = int(length[0])
+	default:
+		return fmt.Errorf("unexpected bound address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, boundLen+2)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// socks5Authenticate sends the upstream's username and password
+func socks5Authenticate(conn net.Conn, upstream *Upstream) error {
+	request := []byte{0x01, byte(len(upstream.Username))}
+	request = append(request, upstream.Username...)
+	request = append(request, byte(len(upstream.Password)))
+	request = append(request, upstream.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("no authentication reply: %w", err)
+	}
+	if status[1] != 0x00 {
+		return &Error{Upstream: upstream.Name, Reason: ReasonAuth, Err: fmt.Errorf("username/password rejected")}
+	}
+	return nil
+}
+
+// socks5Request encodes a CONNECT request for address. Host names are
+// sent as they are for the upstream to resolve.
+func socks5Request(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	request := []byte{socksVersion, socksConnect, 0x00}
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		request = append(request, socksIPv4)
+		request = append(request, ip.To4()...)
+	case ip != nil:
+		request = append(request, socksIPv6)
+		request = append(request, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %s is too long", host)
+		}
+		request = append(request, socksDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
@@ -0,0 +1,201 @@
+package waf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"unicode/utf8"
+)
+
+// Bounds on payload decoding. Inputs come from untrusted clients, so nested
+// encodings are only unwrapped a few levels and the work stays linear in
+// the input size.
+const (
+	maxDecodeDepth    = 3         // Nested encodings unwrapped, e.g. URL encoded base64
+	maxDecodeInput    = 64 * 1024 // Larger inputs are only inspected as sent
+	maxDecodedVariant = 16        // Distinct decoded forms checked per input
+)
+
+var errNotText = errors.New("decoded data is not text")
+
+// Register adds a decoder. Decoders run in the order they were registered.
+func (pd *PayloadDecoder) Register(name string, decoder Decoder) {
+	if _, exists := pd.decoders[name]; !exists {
+		pd.names = append(pd.names, name)
+	}
+	pd.decoders[name] = decoder
+}
+
+// Decode returns the distinct decoded forms of data, up to maxDecodeDepth
+// encodings deep. data itself is not included. Attacks are often encoded to
+// slip past the rule patterns, so the rules are checked against these too.
+func (pd *PayloadDecoder) Decode(data []byte) [][]byte {
+	if len(data) == 0 || len(data) > maxDecodeInput {
+		return nil
+	}
+
+	seen := map[string]bool{string(data): true}
+	var variants [][]byte
+	current := [][]byte{data}
+	for depth := 0; depth < maxDecodeDepth && len(current) > 0; depth++ {
+		var next [][]byte
+		for _, input := range current {
+			for _, name := range pd.names {
+				decoder := pd.decoders[name]
+				if !decoder.CanDecode(input) {
+					continue
+				}
+				decoded, err := decoder.Decode(input)
+				if err != nil || len(decoded) == 0 || len(decoded) > maxDecodeInput || seen[string(decoded)] {
+					continue
+				}
+				seen[string(decoded)] = true
+				variants = append(variants, decoded)
+				if len(variants) == maxDecodedVariant {
+					return variants
+				}
+				next = append(next, decoded)
+			}
+		}
+		current = next
+	}
+	return variants
+}
+
+// urlDecoder decodes percent-encoding leniently, the way many servers do:
+// invalid escapes are kept as they are instead of failing the whole input.
+// IIS style %uXXXX escapes and '+' for space are decoded too.
+type urlDecoder struct{}
+
+func (urlDecoder) CanDecode(data []byte) bool {
+	return bytes.IndexByte(data, '%') >= 0 || bytes.IndexByte(data, '+') >= 0
+}
+
+func (urlDecoder) Decode(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '+':
+			out = append(out, ' ')
+		case c == '%' && i+5 < len(data) && (data[i+1] == 'u' || data[i+1] == 'U'):
+			if r, ok := parseHex(data[i+2 : i+6]); ok {
+				out = utf8.AppendRune(out, rune(r))
+				i += 5
+			} else {
+				out = append(out, c)
+			}
+		case c == '%' && i+2 < len(data):
+			if b, ok := parseHex(data[i+1 : i+3]); ok {
+				out = append(out, byte(b))
+				i += 2
+			} else {
+				out = append(out, c)
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// htmlEntityDecoder decodes named and numeric HTML character references
+type htmlEntityDecoder struct{}
+
+func (htmlEntityDecoder) CanDecode(data []byte) bool {
+	return bytes.IndexByte(data, '&') >= 0
+}
+
+func (htmlEntityDecoder) Decode(data []byte) ([]byte, error) {
+	return []byte(html.UnescapeString(string(data))), nil
+}
+
+// escapeDecoder decodes \xNN and \uNNNN escapes as used in JavaScript and
+// many string literals
+type escapeDecoder struct{}
+
+func (escapeDecoder) CanDecode(data []byte) bool {
+	return bytes.Contains(data, []byte(`\x`)) || bytes.Contains(data, []byte(`\u`))
+}
+
+func (escapeDecoder) Decode(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\\' && i+3 < len(data) && data[i+1] == 'x' {
+			if b, ok := parseHex(data[i+2 : i+4]); ok {
+				out = append(out, byte(b))
+				i += 3
+				continue
+			}
+		}
+		if data[i] == '\\' && i+5 < len(data) && data[i+1] == 'u' {
+			if r, ok := parseHex(data[i+2 : i+6]); ok {
+				out = utf8.AppendRune(out, rune(r))
+				i += 5
+				continue
+			}
+		}
+		out = append(out, data[i])
+	}
+	return out, nil
+}
+
+// base64Decoder decodes inputs that are entirely standard or URL-safe
+// base64. Decodings that are not valid UTF-8 text are dropped, so random
+// tokens do not add noise.
+type base64Decoder struct{}
+
+// minBase64Length skips short words that happen to be valid base64
+const minBase64Length = 12
+
+func (base64Decoder) CanDecode(data []byte) bool {
+	if len(data) < minBase64Length {
+		return false
+	}
+	for i, c := range data {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '+', c == '/', c == '-', c == '_':
+		case c == '=' && i >= len(data)-2:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (base64Decoder) Decode(data []byte) ([]byte, error) {
+	var err error
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		decoded := make([]byte, encoding.DecodedLen(len(data)))
+		var n int
+		n, err = encoding.Decode(decoded, data)
+		if err == nil {
+			if !utf8.Valid(decoded[:n]) {
+				return nil, errNotText
+			}
+			return decoded[:n], nil
+		}
+	}
+	return nil, err
+}
+
+// parseHex parses a short run of hex digits
+func parseHex(digits []byte) (int, bool) {
+	value := 0
+	for _, c := range digits {
+		switch {
+		case c >= '0' && c <= '9':
+			value = value<<4 | int(c-'0')
+		case c >= 'a' && c <= 'f':
+			value = value<<4 | int(c-'a'+10)
+		case c >= 'A' && c <= 'F':
+			value = value<<4 | int(c-'A'+10)
+		default:
+			return 0, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,118 @@
+package waf
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPayloadDecoder(t *testing.T) {
+	pd := NewPayloadDecoder()
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"1%27%20OR%20%271%27%3D%271", "1' OR '1'='1"},
+		{"%3Cscript%3E", "<script>"},
+		{"%u003Cscript%u003E", "<script>"},
+		{"a+b%zz%", "a b%zz%"},
+		{"&lt;script&gt;alert(1)&lt;/script&gt;", "<script>alert(1)</script>"},
+		{`\x3cscript\x3e`, "<script>"},
+		{"PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", "<script>alert(1)</script>"},
+		// Nested: URL encoded HTML entities
+		{"%26lt%3Bscript%26gt%3B", "<script>"},
+	}
+	for _, tt := range tests {
+		found := false
+		for _, decoded := range pd.Decode([]byte(tt.input)) {
+			if string(decoded) == tt.want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Decode(%q) did not produce %q", tt.input, tt.want)
+		}
+	}
+
+	if variants := pd.Decode([]byte("plain text")); len(variants) != 0 {
+		t.Errorf("Expected no decoded forms of plain text, got %q", variants)
+	}
+	if variants := pd.Decode(bytes.Repeat([]byte("%41"), maxDecodeInput)); variants != nil {
+		t.Error("Expected oversized input to be skipped")
+	}
+}
+
+func TestEncodedAttackDetected(t *testing.T) {
+	waf := NewWAF(WAFConfig{Enabled: true})
+	req := httptest.NewRequest("GET", "/search?q=%2526lt%253Biframe%2520src%253Dx%2526gt%253B", nil)
+
+	result := &InspectionResult{Passed: true, Metadata: map[string]interface{}{}}
+	waf.inspectQueryParams(req, result)
+
+	found := false
+	for _, violation := range result.Violations {
+		if violation.Category == CategoryXSS && strings.HasSuffix(violation.Location, ":decoded") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected an XSS violation in the decoded query, got %+v", result.Violations)
+	}
+}
+
+func FuzzPayloadDecoder(f *testing.F) {
+	for _, seed := range []string{
+		"%27%20OR%201%3D1", "%u0027", "%", "%%%", "&#x3c;&#60;&lt", `\x3c<\`, "PHNjcmlwdD4=",
+		"%2526lt%253B", "++++", strings.Repeat("%25", 50),
+	} {
+		f.Add([]byte(seed))
+	}
+	pd := NewPayloadDecoder()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		variants := pd.Decode(data)
+		if len(variants) > maxDecodedVariant {
+			t.Fatalf("Got %d decoded forms, limit is %d", len(variants), maxDecodedVariant)
+		}
+		seen := map[string]bool{string(data): true}
+		for _, variant := range variants {
+			if len(variant) > maxDecodeInput {
+				t.Fatalf("Decoded form of %d bytes exceeds the limit", len(variant))
+			}
+			if seen[string(variant)] {
+				t.Fatalf("Duplicate decoded form %q", variant)
+			}
+			seen[string(variant)] = true
+		}
+	})
+}
+
+func FuzzDecoders(f *testing.F) {
+	f.Add([]byte("%41%u0042+&amp;\\x43\\u0044"))
+	f.Add([]byte("QUJDREVGR0hJSktM"))
+	f.Add([]byte("%u12"))
+
+	decoders := []Decoder{urlDecoder{}, htmlEntityDecoder{}, escapeDecoder{}, base64Decoder{}}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, decoder := range decoders {
+			if !decoder.CanDecode(data) {
+				continue
+			}
+			decoded, err := decoder.Decode(data)
+			if err != nil {
+				continue
+			}
+			// None of the encodings expand, apart from %uXXXX and \uXXXX
+			// escapes of up to three bytes
+			if len(decoded) > len(data) {
+				t.Fatalf("%T expanded %d bytes to %d", decoder, len(data), len(decoded))
+			}
+			if _, ok := decoder.(base64Decoder); ok && !utf8.Valid(decoded) {
+				t.Fatalf("base64 decoded to invalid UTF-8 %q", decoded)
+			}
+		}
+	})
+}
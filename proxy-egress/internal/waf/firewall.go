@@ -2,13 +2,10 @@ package waf
 
 import (
 	"bytes"
-	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
 	"sync"
@@ -59,6 +56,17 @@ type WAFConfig struct {
 	SensitiveDataMasking   bool
 	RateLimitPerIP         int
 	BlockDuration          time.Duration
+	GeoDatabase            GeoDatabase // Country lookups, such as the proxy's geoip.Reader
+
+	// OnFlag is called for each blocked or anomalous request, in detection
+	// mode too, with the event "blocked" or "anomaly_detected". Callers
+	// attribute it to the source service and pass it to a quarantine
+	// tracker to quarantine repeat offenders.
+	OnFlag func(req *http.Request, event string)
+
+	// LogWriters receive the security log entries of EnableRequestLogging,
+	// such as SyslogWriter sinks
+	LogWriters []SecurityLogWriter
 }
 
 type WAFMode string
@@ -226,6 +234,7 @@ type SanitizationRule struct {
 
 type PayloadDecoder struct {
 	decoders map[string]Decoder
+	names    []string
 }
 
 type Decoder interface {
@@ -321,6 +330,7 @@ func NewWAF(config WAFConfig) *WAF {
 
 	if config.EnableGeoBlocking {
 		waf.geoBlocker = NewGeoBlocker(config.AllowedCountries, config.BlockedCountries)
+		waf.geoBlocker.geoDatabase = config.GeoDatabase
 	}
 
 	if config.EnableIPReputation {
@@ -332,6 +342,9 @@ func NewWAF(config WAFConfig) *WAF {
 
 	if config.EnableRequestLogging {
 		waf.logger = NewSecurityLogger()
+		for _, writer := range config.LogWriters {
+			waf.logger.AddWriter(writer)
+		}
 	}
 
 	for _, rule := range config.CustomRules {
@@ -379,6 +392,7 @@ func (waf *WAF) ProcessRequest(req *http.Request) error {
 	if result.Score >= waf.config.BlockingScore {
 		waf.recordViolations(result.Violations)
 		waf.logSecurityEvent(req, "blocked", result)
+		waf.flag(req, "blocked")
 		return waf.handleBlocking(req, waf.getBlockingError(result))
 	}
 
@@ -386,6 +400,7 @@ func (waf *WAF) ProcessRequest(req *http.Request) error {
 		if waf.anomalyDetector.IsAnomalous(req, body) {
 			waf.metrics.recordAnomalyDetected()
 			waf.logSecurityEvent(req, "anomaly_detected", nil)
+			waf.flag(req, "anomaly_detected")
 			
 			if waf.config.Mode == ModePrevention {
 				return waf.handleBlocking(req, ErrSuspiciousPayload)
@@ -482,11 +497,25 @@ func (waf *WAF) inspectCookies(req *http.Request, result *InspectionResult) {
 }
 
 func (waf *WAF) checkForViolations(input string, location string, result *InspectionResult) {
+	matched := make(map[string]bool)
 	violations := waf.rules.Check(input, location)
 	for _, violation := range violations {
+		matched[violation.Rule] = true
 		result.Violations = append(result.Violations, violation)
 		result.Score += violation.Severity.Score()
 	}
+
+	// Check decoded forms too, counting each rule once per input
+	for _, decoded := range waf.requestAnalyzer.decoder.Decode([]byte(input)) {
+		for _, violation := range waf.rules.Check(string(decoded), location+":decoded") {
+			if matched[violation.Rule] {
+				continue
+			}
+			matched[violation.Rule] = true
+			result.Violations = append(result.Violations, violation)
+			result.Score += violation.Severity.Score()
+		}
+	}
 }
 
 func (waf *WAF) readRequestBody(req *http.Request) ([]byte, error) {
@@ -581,6 +610,13 @@ func (waf *WAF) logSecurityEvent(req *http.Request, action string, data interfac
 	waf.logger.Log(entry)
 }
 
+// flag reports a blocked or anomalous request to the OnFlag hook
+func (waf *WAF) flag(req *http.Request, event string) {
+	if waf.config.OnFlag != nil {
+		waf.config.OnFlag(req, event)
+	}
+}
+
 func (waf *WAF) updateMetrics(start time.Time) {
 	duration := time.Since(start)
 	waf.metrics.mutex.Lock()
@@ -610,7 +646,7 @@ func (waf *WAF) initializeDefaultRules() {
 	}
 
 	commandInjectionPatterns := []string{
-		`(?i)(\||;|&|>|<|\$\(|\`|\\n|\\r)`,
+		`(?i)(\||;|&|>|<|\$\(|` + "`" + `|\\n|\\r)`,
 		`(?i)(wget|curl|nc|netcat|telnet|ssh|ftp|scp|rsync)`,
 		`(?i)(bash|sh|cmd|powershell|python|perl|ruby|php)`,
 	}
@@ -720,7 +756,7 @@ func (ad *AnomalyDetector) IsAnomalous(req *http.Request, body []byte) bool {
 
 	score := 0
 
-	if float64(len(body)) > ad.baseline.AverageSize*3 {
+	if int64(len(body)) > ad.baseline.AverageSize*3 {
 		score += 2
 	}
 
@@ -755,7 +791,13 @@ func NewGeoBlocker(allowed []string, blocked []string) *GeoBlocker {
 }
 
 func (gb *GeoBlocker) IsBlocked(ip string) (bool, string) {
-	country := "US"
+	// Without a database every client is treated as unknown
+	country := "unknown"
+	if gb.geoDatabase != nil {
+		if c, err := gb.geoDatabase.GetCountry(ip); err == nil {
+			country = c
+		}
+	}
 
 	if len(gb.allowedCountries) > 0 {
 		if !gb.allowedCountries[country] {
@@ -849,9 +891,14 @@ func NewPayloadSanitizer() *PayloadSanitizer {
 }
 
 func NewPayloadDecoder() *PayloadDecoder {
-	return &PayloadDecoder{
+	pd := &PayloadDecoder{
 		decoders: make(map[string]Decoder),
 	}
+	pd.Register("url", urlDecoder{})
+	pd.Register("html", htmlEntityDecoder{})
+	pd.Register("escape", escapeDecoder{})
+	pd.Register("base64", base64Decoder{})
+	return pd
 }
 
 func NewResponseFilter(enableMasking bool) *ResponseFilter {
@@ -910,6 +957,27 @@ func (sl *SecurityLogger) Log(entry *SecurityLogEntry) {
 	}
 }
 
+// AddWriter adds a destination of the logged entries
+func (sl *SecurityLogger) AddWriter(writer SecurityLogWriter) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.loggers = append(sl.loggers, writer)
+}
+
+// Flush flushes every writer, returning the first error
+func (sl *SecurityLogger) Flush() error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	var first error
+	for _, logger := range sl.loggers {
+		if err := logger.Flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 func NewLogBuffer(maxSize int) *LogBuffer {
 	return &LogBuffer{
 		entries: make([]*SecurityLogEntry, 0, maxSize),
@@ -0,0 +1,603 @@
+package waf
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Remote security log sinks: RFC 5424 syslog and ArcSight CEF over UDP,
+// TCP or TLS, so blocked requests and the proxy's other security events
+// reach an existing SIEM. Entries are queued and sent in the background;
+// a sink that is down is redialed with exponential backoff while its
+// queue fills, and entries that don't fit are dropped and counted.
+
+// Formats of remote security log sinks
+const (
+	FormatRFC5424 = "rfc5424"
+	FormatCEF     = "cef" // CEF message in an RFC 5424 envelope
+)
+
+var (
+	ErrSinkQueueFull = errors.New("security log sink queue full")
+	ErrSinkClosed    = errors.New("security log sink closed")
+)
+
+const (
+	// sdID is the RFC 5424 structured data ID of entries, under the
+	// documentation enterprise number of RFC 5612
+	sdID     = "marchproxy@32473"
+	sdMetaID = "meta@32473"
+
+	facilityLogAudit = 13
+
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+// SyslogOptions configures a remote security log sink
+type SyslogOptions struct {
+	Name       string        // Sink label in metrics, the address by default
+	Network    string        // udp, tcp or tls
+	Address    string        // host:port
+	Format     string        // rfc5424 (default) or cef
+	TLSConfig  *tls.Config   // For tls; the server name defaults to the address host
+	Facility   int           // Syslog facility, log audit (13) when 0
+	Hostname   string        // The local host name by default
+	AppName    string        // marchproxy by default
+	Version    string        // Product version in CEF headers
+	QueueSize  int           // Entries buffered while the sink is down, default 1024
+	Timeout    time.Duration // Per dial and write, default 5s
+	MinBackoff time.Duration // First reconnect delay, default 1s
+	MaxBackoff time.Duration // Longest reconnect delay, default 1m
+}
+
+// ParseSyslogURL parses a sink URL such as udp://siem:514 or
+// tls://siem.example:6514?format=cef&name=soc. The port defaults to 514,
+// or 6514 for tls; the query may set format, name and facility.
+func ParseSyslogURL(raw string) (SyslogOptions, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return SyslogOptions{}, fmt.Errorf("invalid security log sink %q: %w", raw, err)
+	}
+	opts := SyslogOptions{Network: u.Scheme, Address: u.Host}
+	port := "514"
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		port = "6514"
+	default:
+		return SyslogOptions{}, fmt.Errorf("security log sink %q must use udp, tcp or tls", raw)
+	}
+	if u.Hostname() == "" {
+		return SyslogOptions{}, fmt.Errorf("security log sink %q has no host", raw)
+	}
+	if u.Port() == "" {
+		opts.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	query := u.Query()
+	opts.Name = query.Get("name")
+	opts.Format = query.Get("format")
+	if facility := query.Get("facility"); facility != "" {
+		if opts.Facility, err = strconv.Atoi(facility); err != nil {
+			return SyslogOptions{}, fmt.Errorf("security log sink %q has an invalid facility", raw)
+		}
+	}
+	return opts, opts.validate()
+}
+
+// validate checks the options and fills in the defaults
+func (o *SyslogOptions) validate() error {
+	switch o.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("security log sink network must be udp, tcp or tls, not %q", o.Network)
+	}
+	if _, _, err := net.SplitHostPort(o.Address); err != nil {
+		return fmt.Errorf("invalid security log sink address %q: %w", o.Address, err)
+	}
+	switch o.Format {
+	case "":
+		o.Format = FormatRFC5424
+	case FormatRFC5424, FormatCEF:
+	default:
+		return fmt.Errorf("security log sink format must be %s or %s, not %q", FormatRFC5424, FormatCEF, o.Format)
+	}
+	if o.Facility < 0 || o.Facility > 23 {
+		return fmt.Errorf("syslog facility %d is not between 0 and 23", o.Facility)
+	}
+	if o.Facility == 0 {
+		o.Facility = facilityLogAudit
+	}
+	if o.Name == "" {
+		o.Name = o.Address
+	}
+	if o.Hostname == "" {
+		o.Hostname, _ = os.Hostname()
+	}
+	if o.AppName == "" {
+		o.AppName = "marchproxy"
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1024
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = time.Second
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = time.Minute
+	}
+	return nil
+}
+
+// SyslogWriter is a SecurityLogWriter sending entries to a remote syslog
+// or CEF collector
+type SyslogWriter struct {
+	opts  SyslogOptions
+	queue chan []byte
+	done  chan struct{} // Closed by Close
+	exit  chan struct{} // Closed when the sender returns
+	once  sync.Once
+
+	queued     atomic.Uint64
+	delivered  atomic.Uint64
+	dropped    atomic.Uint64 // Queue full
+	discarded  atomic.Uint64 // Left in the queue at close
+	failures   atomic.Uint64 // Failed dials and writes
+	reconnects atomic.Uint64
+	connected  atomic.Bool
+}
+
+// NewSyslogWriter starts a sink. It connects in the background, so an
+// unreachable collector delays delivery rather than startup.
+func NewSyslogWriter(opts SyslogOptions) (*SyslogWriter, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Network == "tls" {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if opts.TLSConfig != nil {
+			config = opts.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(opts.Address)
+		}
+		opts.TLSConfig = config
+	}
+
+	w := &SyslogWriter{
+		opts:  opts,
+		queue: make(chan []byte, opts.QueueSize),
+		done:  make(chan struct{}),
+		exit:  make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Name returns the sink's metrics label
+func (w *SyslogWriter) Name() string {
+	return w.opts.Name
+}
+
+// Write queues an entry, dropping it when the queue is full
+func (w *SyslogWriter) Write(entry *SecurityLogEntry) error {
+	select {
+	case <-w.done:
+		return ErrSinkClosed
+	default:
+	}
+
+	var message []byte
+	if w.opts.Format == FormatCEF {
+		message = w.opts.envelope(entry, "-", formatCEF(entry, w.opts.Version))
+	} else {
+		message = w.opts.envelope(entry, structuredData(entry), summary(entry))
+	}
+	w.queued.Add(1) // Before the send, so pending never counts it delivered first
+	select {
+	case w.queue <- message:
+		return nil
+	default:
+		w.queued.Add(^uint64(0))
+		w.dropped.Add(1)
+		return ErrSinkQueueFull
+	}
+}
+
+// Flush waits until the queued entries were sent or dropped, at most one
+// timeout
+func (w *SyslogWriter) Flush() error {
+	deadline := time.Now().Add(w.opts.Timeout)
+	for w.pending() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("security log sink %s: %d entries not delivered", w.opts.Name, w.pending())
+		}
+		select {
+		case <-w.exit:
+			return ErrSinkClosed
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// pending returns the entries queued but neither delivered nor discarded
+func (w *SyslogWriter) pending() uint64 {
+	return w.queued.Load() - w.delivered.Load() - w.discarded.Load()
+}
+
+// Close flushes the queue and stops the sink, discarding what could not
+// be delivered
+func (w *SyslogWriter) Close() error {
+	err := w.Flush()
+	w.once.Do(func() { close(w.done) })
+	<-w.exit
+	return err
+}
+
+// run sends the queued entries, redialing with exponential backoff after
+// failures. An entry whose write fails is retried on a new connection,
+// at once the first time since collectors close idle connections.
+func (w *SyslogWriter) run() {
+	defer close(w.exit)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+		w.connected.Store(false)
+	}()
+
+	backoff := w.opts.MinBackoff
+	dialed := false
+	for {
+		var message []byte
+		select {
+		case message = <-w.queue:
+		case <-w.done:
+			w.discard()
+			return
+		}
+
+		wait, writeFailed := false, false
+		for {
+			if wait {
+				select {
+				case <-time.After(backoff):
+				case <-w.done:
+					w.discarded.Add(1)
+					w.discard()
+					return
+				}
+				if backoff *= 2; backoff > w.opts.MaxBackoff {
+					backoff = w.opts.MaxBackoff
+				}
+			}
+			if conn == nil {
+				c, err := w.dial()
+				if err != nil {
+					w.failures.Add(1)
+					wait = true
+					continue
+				}
+				if dialed {
+					w.reconnects.Add(1)
+				}
+				conn, dialed = c, true
+				w.connected.Store(true)
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(w.opts.Timeout))
+			if _, err := conn.Write(w.frame(message)); err != nil {
+				w.failures.Add(1)
+				conn.Close()
+				conn = nil
+				w.connected.Store(false)
+				wait, writeFailed = writeFailed, true
+				continue
+			}
+			backoff = w.opts.MinBackoff
+			w.delivered.Add(1)
+			break
+		}
+	}
+}
+
+// discard drops the entries left in the queue
+func (w *SyslogWriter) discard() {
+	for {
+		select {
+		case <-w.queue:
+			w.discarded.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+// dial connects to the collector
+func (w *SyslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: w.opts.Timeout}
+	if w.opts.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", w.opts.Address, w.opts.TLSConfig)
+	}
+	return dialer.Dial(w.opts.Network, w.opts.Address)
+}
+
+// frame returns a message as sent: one datagram per message over UDP, and
+// octet counting framing (RFC 6587) over TCP and TLS
+func (w *SyslogWriter) frame(message []byte) []byte {
+	if w.opts.Network == "udp" {
+		return message
+	}
+	return append([]byte(strconv.Itoa(len(message))+" "), message...)
+}
+
+// SinkStats is the delivery of one sink
+type SinkStats struct {
+	Name       string
+	Delivered  uint64
+	Dropped    uint64 // Queue full, or left in the queue at close
+	Failures   uint64 // Failed dials and writes
+	Reconnects uint64
+	Connected  bool
+	Queued     int
+}
+
+// Stats returns the sink's delivery counters
+func (w *SyslogWriter) Stats() SinkStats {
+	return SinkStats{
+		Name:       w.opts.Name,
+		Delivered:  w.delivered.Load(),
+		Dropped:    w.dropped.Load() + w.discarded.Load(),
+		Failures:   w.failures.Load(),
+		Reconnects: w.reconnects.Load(),
+		Connected:  w.connected.Load(),
+		Queued:     len(w.queue),
+	}
+}
+
+// WriteSinkMetrics writes the delivery of sinks in Prometheus text format
+func WriteSinkMetrics(out io.Writer, sinks []*SyslogWriter) {
+	if len(sinks) == 0 {
+		return
+	}
+	stats := make([]SinkStats, len(sinks))
+	for i, sink := range sinks {
+		stats[i] = sink.Stats()
+	}
+
+	fmt.Fprintf(out, "# HELP marchproxy_security_log_events_total Security log entries by sink and delivery result\n")
+	fmt.Fprintf(out, "# TYPE marchproxy_security_log_events_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(out, "marchproxy_security_log_events_total{sink=%q,result=\"delivered\"} %d\n", s.Name, s.Delivered)
+		fmt.Fprintf(out, "marchproxy_security_log_events_total{sink=%q,result=\"dropped\"} %d\n", s.Name, s.Dropped)
+	}
+	fmt.Fprintf(out, "# HELP marchproxy_security_log_failures_total Failed connections and writes by sink\n")
+	fmt.Fprintf(out, "# TYPE marchproxy_security_log_failures_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(out, "marchproxy_security_log_failures_total{sink=%q} %d\n", s.Name, s.Failures)
+	}
+	fmt.Fprintf(out, "# HELP marchproxy_security_log_reconnects_total Reconnections by sink\n")
+	fmt.Fprintf(out, "# TYPE marchproxy_security_log_reconnects_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(out, "marchproxy_security_log_reconnects_total{sink=%q} %d\n", s.Name, s.Reconnects)
+	}
+	fmt.Fprintf(out, "# HELP marchproxy_security_log_connected Whether the sink is connected\n")
+	fmt.Fprintf(out, "# TYPE marchproxy_security_log_connected gauge\n")
+	for _, s := range stats {
+		connected := 0
+		if s.Connected {
+			connected = 1
+		}
+		fmt.Fprintf(out, "marchproxy_security_log_connected{sink=%q} %d\n", s.Name, connected)
+	}
+	fmt.Fprintf(out, "# HELP marchproxy_security_log_queued Entries waiting for delivery by sink\n")
+	fmt.Fprintf(out, "# TYPE marchproxy_security_log_queued gauge\n")
+	for _, s := range stats {
+		fmt.Fprintf(out, "marchproxy_security_log_queued{sink=%q} %d\n", s.Name, s.Queued)
+	}
+}
+
+// envelope returns an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (o *SyslogOptions) envelope(entry *SecurityLogEntry, sd, msg string) []byte {
+	timestamp := entry.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		o.Facility*8+severity(entry),
+		timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(o.Hostname, 255),
+		headerField(o.AppName, 48),
+		os.Getpid(),
+		headerField(entry.Action, 32),
+		sd, msg))
+}
+
+// severity returns the syslog severity of an entry: warning for blocked
+// and denied events, notice for other violations and anomalies
+func severity(entry *SecurityLogEntry) int {
+	switch {
+	case entry.Action == "blocked" || strings.HasSuffix(entry.Action, "_blocked") || entry.Metadata["allowed"] == false:
+		return severityWarning
+	case len(entry.Violations) > 0 || entry.Action == "anomaly_detected":
+		return severityNotice
+	}
+	return severityInfo
+}
+
+// headerField returns a header field as printable ASCII without spaces,
+// "-" when empty
+func headerField(value string, max int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value)
+	if len(field) > max {
+		field = field[:max]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// structuredData returns the RFC 5424 structured data of an entry: its
+// fields, then its metadata
+func structuredData(entry *SecurityLogEntry) string {
+	var b strings.Builder
+	b.WriteString("[" + sdID)
+	param := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, " %s=\"%s\"", name, sdEscaper.Replace(value))
+		}
+	}
+	param("action", entry.Action)
+	param("clientIp", entry.ClientIP)
+	param("method", entry.Method)
+	param("path", entry.Path)
+	param("userAgent", entry.UserAgent)
+	param("requestId", entry.RequestID)
+	if entry.Score > 0 {
+		param("score", strconv.Itoa(entry.Score))
+	}
+	if entry.ResponseCode > 0 {
+		param("responseCode", strconv.Itoa(entry.ResponseCode))
+	}
+	param("violations", violationRules(entry))
+	b.WriteString("]")
+
+	if len(entry.Metadata) > 0 {
+		b.WriteString("[" + sdMetaID)
+		for _, key := range sortedKeys(entry.Metadata) {
+			param(headerField(strings.NewReplacer("=", "_", "]", "_", `"`, "_").Replace(key), 32), metadataValue(entry.Metadata[key]))
+		}
+		b.WriteString("]")
+	}
+	return b.String()
+}
+
+// sdEscaper escapes RFC 5424 parameter values
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "]", `\]`)
+
+// formatCEF returns an entry as an ArcSight CEF message
+func formatCEF(entry *SecurityLogEntry, version string) string {
+	var b strings.Builder
+	cefSeverity := map[int]int{severityWarning: 7, severityNotice: 5, severityInfo: 3}[severity(entry)]
+	fmt.Fprintf(&b, "CEF:0|PenguinTech|MarchProxy|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(version), cefHeaderEscaper.Replace(entry.Action), cefHeaderEscaper.Replace(summary(entry)), cefSeverity)
+
+	var ext []string
+	field := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	timestamp := entry.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	field("rt", strconv.FormatInt(timestamp.UnixMilli(), 10))
+	field("act", entry.Action)
+	field("src", entry.ClientIP)
+	field("requestMethod", entry.Method)
+	field("request", entry.Path)
+	field("requestClientApplication", entry.UserAgent)
+	field("externalId", entry.RequestID)
+	if entry.Score > 0 {
+		field("cn1", strconv.Itoa(entry.Score))
+		field("cn1Label", "score")
+	}
+	if entry.ResponseCode > 0 {
+		field("cn2", strconv.Itoa(entry.ResponseCode))
+		field("cn2Label", "responseCode")
+	}
+	if rules := violationRules(entry); rules != "" {
+		field("cs1", rules)
+		field("cs1Label", "violations")
+	}
+	if len(entry.Metadata) > 0 {
+		if metadata, err := json.Marshal(entry.Metadata); err == nil {
+			field("cs2", string(metadata))
+			field("cs2Label", "metadata")
+		}
+	}
+	b.WriteString(strings.Join(ext, " "))
+	return b.String()
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// summary describes an entry in one line, such as
+// "blocked GET /login from 203.0.113.7, score 12 (942100, 941100)"
+func summary(entry *SecurityLogEntry) string {
+	parts := []string{entry.Action}
+	if entry.Method != "" || entry.Path != "" {
+		parts = append(parts, strings.TrimSpace(entry.Method+" "+entry.Path))
+	}
+	if entry.ClientIP != "" {
+		parts = append(parts, "from "+entry.ClientIP)
+	}
+	line := strings.Join(parts, " ")
+	if entry.Score > 0 {
+		line += fmt.Sprintf(", score %d", entry.Score)
+	}
+	if rules := violationRules(entry); rules != "" {
+		line += " (" + strings.ReplaceAll(rules, ",", ", ") + ")"
+	}
+	return line
+}
+
+// violationRules lists the rules an entry violated
+func violationRules(entry *SecurityLogEntry) string {
+	rules := make([]string, len(entry.Violations))
+	for i, v := range entry.Violations {
+		rules[i] = v.Rule
+	}
+	return strings.Join(rules, ",")
+}
+
+// metadataValue formats a metadata value, as JSON unless it is a string
+func metadataValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,166 @@
+package waf
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogURL(t *testing.T) {
+	opts, err := ParseSyslogURL("tls://siem.example?format=cef&name=soc&facility=4")
+	if err != nil {
+		t.Fatalf("ParseSyslogURL: %v", err)
+	}
+	if opts.Network != "tls" || opts.Address != "siem.example:6514" || opts.Format != FormatCEF || opts.Name != "soc" || opts.Facility != 4 {
+		t.Errorf("options = %+v", opts)
+	}
+	if opts, _ := ParseSyslogURL("udp://10.0.0.5"); opts.Address != "10.0.0.5:514" || opts.Format != FormatRFC5424 || opts.Facility != facilityLogAudit {
+		t.Errorf("defaults = %+v", opts)
+	}
+	for _, raw := range []string{"http://siem:514", "udp://", "tcp://siem:514?format=leef", "tcp://siem:514?facility=30"} {
+		if _, err := ParseSyslogURL(raw); err == nil {
+			t.Errorf("ParseSyslogURL(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestSyslogFormats(t *testing.T) {
+	opts := SyslogOptions{Network: "udp", Address: "siem:514", Hostname: "proxy-1", Version: "1.2.3"}
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+	entry := &SecurityLogEntry{
+		Timestamp:  time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		ClientIP:   "203.0.113.7",
+		Method:     "GET",
+		Path:       `/login"]`,
+		Action:     "blocked",
+		Score:      12,
+		Violations: []Violation{{Rule: "942100"}, {Rule: "941100"}},
+		Metadata:   map[string]interface{}{"mapping": "web", "port": 443},
+	}
+
+	message := string(opts.envelope(entry, structuredData(entry), summary(entry)))
+	want := `<108>1 2026-03-01T12:00:00.000000Z proxy-1 marchproxy `
+	if !strings.HasPrefix(message, want) {
+		t.Errorf("RFC 5424 header = %q, want prefix %q", message, want)
+	}
+	for _, part := range []string{
+		` blocked [marchproxy@32473 action="blocked" clientIp="203.0.113.7" method="GET" path="/login\"\]" score="12" violations="942100,941100"][meta@32473 mapping="web" port="443"] `,
+		`blocked GET /login"] from 203.0.113.7, score 12 (942100, 941100)`,
+	} {
+		if !strings.Contains(message, part) {
+			t.Errorf("RFC 5424 message %q lacks %q", message, part)
+		}
+	}
+
+	cef := formatCEF(entry, opts.Version)
+	for _, part := range []string{
+		`CEF:0|PenguinTech|MarchProxy|1.2.3|blocked|blocked GET /login"] from 203.0.113.7, score 12 (942100, 941100)|7|`,
+		"rt=1772366400000 act=blocked src=203.0.113.7",
+		`cs2={"mapping":"web","port":443}`,
+	} {
+		if !strings.Contains(cef, part) {
+			t.Errorf("CEF message %q lacks %q", cef, part)
+		}
+	}
+	if got := formatCEF(&SecurityLogEntry{Action: "a|b", Path: "x=y\n"}, "1"); !strings.Contains(got, `|a\|b|`) || !strings.Contains(got, `request=x\=y\n`) {
+		t.Errorf("CEF escaping = %q", got)
+	}
+}
+
+// readFrame reads one octet counted message
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err = r.Read(buf)
+	return string(buf), err
+}
+
+func TestSyslogWriterReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	w, err := NewSyslogWriter(SyslogOptions{
+		Network:    "tcp",
+		Address:    listener.Addr().String(),
+		MinBackoff: 10 * time.Millisecond,
+		Timeout:    2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// The collector reads one entry, then drops the connection
+	w.Write(&SecurityLogEntry{Action: "first"})
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message, err := readFrame(bufio.NewReader(conn)); err != nil || !strings.Contains(message, " first ") {
+		t.Fatalf("first entry = %q, %v", message, err)
+	}
+	conn.Close()
+
+	// Entries written while it is gone arrive on the next connection
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Stats().Reconnects == 0 && time.Now().Before(deadline) {
+		w.Write(&SecurityLogEntry{Action: "second"})
+		time.Sleep(20 * time.Millisecond)
+	}
+	conn, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if message, err := readFrame(bufio.NewReader(conn)); err != nil || !strings.Contains(message, " second ") {
+		t.Errorf("entry after reconnecting = %q, %v", message, err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	if stats := w.Stats(); stats.Reconnects != 1 || stats.Failures == 0 || !stats.Connected || stats.Delivered < 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSyslogWriterQueueFull(t *testing.T) {
+	// Nothing listens, so entries queue until the sink closes
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	w, err := NewSyslogWriter(SyslogOptions{Network: "tcp", Address: address, QueueSize: 2, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Write(&SecurityLogEntry{Action: "blocked"})
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close delivered entries to a missing collector")
+	}
+	if stats := w.Stats(); stats.Delivered != 0 || stats.Dropped != 5 || stats.Failures == 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if err := w.Write(&SecurityLogEntry{}); err != ErrSinkClosed {
+		t.Errorf("Write after Close = %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+// Package zerotrust carries the egress proxy's copy of the L3/L4 proxy's
+// immutable audit logger, so audited egress sessions such as SSH land in
+// the same SHA-256 chained log format and can be verified with the same
+// tooling. Keep audit_logger.go in sync with proxy-l3l4.
+package zerotrust
@@ -0,0 +1,345 @@
+// Package egressclient connects applications through the MarchProxy egress
+// proxy, so they don't have to implement its authentication handshake.
+//
+// A mapping that requires authentication greets each connection with a
+// MARCHPROXY_AUTH banner ending in a SERVICE_ID:TOKEN line. The client
+// answers with its service ID and token, or, in challenge mode, asks for a
+// nonce with CHALLENGE and answers with an HMAC proof so the token never
+// crosses the network. The proxy replies AUTH_OK and relays the connection
+// to the mapping's destination, or closes it. Proxies that advertise
+// version 2 of the handshake on an AUTH_VERSIONS line are asked for it, and
+// say why they refuse credentials on an AUTH_FAIL line before closing. The
+// handshake is specified in proto/marchproxy/egress_auth.proto.
+//
+// With MuxAddress set, a Dialer instead authenticates a few transport
+// connections to the proxy's multiplexed listener once and opens each
+// connection as an HTTP/2 CONNECT stream over them, so short connections
+// cost neither a TCP nor an authentication handshake.
+//
+// A Dialer has the DialContext method of net.Dialer, so it can be plugged
+// into http.Transport, database drivers and gRPC. The address dialed is
+// the egress proxy listener of the mapping; the proxy picks the
+// destination:
+//
+//	dialer, err := egressclient.New(egressclient.Config{
+//		ServiceID: 12,
+//		Token:     egressclient.StaticToken(os.Getenv("MARCHPROXY_TOKEN")),
+//	})
+//	conn, err := dialer.DialContext(ctx, "tcp", "egress.internal:8081")
+package egressclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Handshake lines of the egress proxy
+const (
+	authBanner        = "MARCHPROXY_AUTH"
+	authPrompt        = "SERVICE_ID:TOKEN"
+	authOK            = "AUTH_OK"
+	authChallenge     = "CHALLENGE"
+	authChallengeNext = "AUTH_CHALLENGE"
+	authFail          = "AUTH_FAIL"
+
+	// Version negotiation, from version 2 of the handshake
+	authVersions        = "AUTH_VERSIONS"
+	authVersionRequest  = "VERSION"
+	authVersionAccepted = "AUTH_VERSION"
+	protocolVersion     = "2"
+
+	// maxHandshakeLine bounds the lines read from the proxy
+	maxHandshakeLine = 4096
+)
+
+// ErrAuthRejected is returned when the proxy closes the connection instead
+// of accepting the credentials: a wrong or expired token, a service not
+// allowed on the mapping, or a client locked out after repeated failures
+var ErrAuthRejected = errors.New("egress proxy rejected the credentials")
+
+// ContextDialer dials the egress proxy. *net.Dialer is one.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Config configures a Dialer
+type Config struct {
+	ServiceID int         // Source service presented to the proxy
+	Token     TokenSource // Nil for mappings without authentication
+
+	// Challenge answers a nonce with an HMAC proof of the token instead of
+	// sending it. Only static service tokens can be proven, not JWTs.
+	Challenge bool
+
+	Timeout      time.Duration // Per attempt, for connecting and the handshake, 10 seconds by default
+	Retries      int           // Attempts after a failed connect or handshake
+	RetryBackoff time.Duration // Before the first retry, doubling each time, 200ms by default
+	Dialer       ContextDialer // Connects to the proxy, a net.Dialer by default
+
+	// MuxAddress is the proxy's multiplexed listener. When set, connections
+	// are streams over up to MuxConnections authenticated transport
+	// connections, 1 by default. The address dialed still names the
+	// mapping's listener.
+	MuxAddress     string
+	MuxConnections int
+}
+
+// Dialer connects to destinations through the egress proxy
+type Dialer struct {
+	config Config
+	mux    *muxPool // Multiplexed transports, nil without MuxAddress
+}
+
+// New creates a Dialer
+func New(config Config) (*Dialer, error) {
+	if config.Token != nil && config.ServiceID <= 0 {
+		return nil, fmt.Errorf("a positive service ID is required with a token")
+	}
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("retries must not be negative")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 200 * time.Millisecond
+	}
+	if config.Dialer == nil {
+		config.Dialer = &net.Dialer{}
+	}
+	d := &Dialer{config: config}
+	if config.MuxAddress != "" {
+		if config.Token == nil {
+			return nil, fmt.Errorf("multiplexed transports require a token")
+		}
+		if config.MuxConnections <= 0 {
+			d.config.MuxConnections = 1
+		}
+		d.mux = &muxPool{dialer: d, transport: &http2.Transport{AllowHTTP: true}}
+	}
+	return d, nil
+}
+
+// Close closes the multiplexed transports, ending their streams
+func (d *Dialer) Close() error {
+	if d.mux == nil {
+		return nil
+	}
+	return d.mux.close()
+}
+
+// Dial connects to the mapping listening at address
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the mapping listening at address and
+// authenticates. Failed attempts are retried with backoff. A rejected
+// token is refreshed and tried once more when its source can refresh it.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("egress proxy connections are TCP, not %s", network)
+	}
+
+	backoff := d.config.RetryBackoff
+	refreshed := false
+	var lastErr error
+	for attempt := 0; attempt <= d.config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		conn, err := d.attempt(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		if errors.Is(err, ErrAuthRejected) {
+			refresher, ok := d.config.Token.(Refresher)
+			if !ok || refreshed {
+				return nil, err
+			}
+			// A token that expired or was rotated since it was fetched
+			refresher.Invalidate()
+			refreshed = true
+			attempt--
+		}
+	}
+	return nil, lastErr
+}
+
+// attempt connects and authenticates once
+func (d *Dialer) attempt(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+
+	if d.mux != nil {
+		return d.mux.open(ctx, address)
+	}
+	conn, err := d.config.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.config.Token == nil {
+		return conn, nil
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	authenticated, err := d.authenticate(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return authenticated, nil
+}
+
+// authenticate answers the proxy's handshake, returning the connection to
+// use; bytes the destination sent right after AUTH_OK are replayed
+func (d *Dialer) authenticate(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	token, err := d.config.Token.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	reader := bufio.NewReaderSize(conn, maxHandshakeLine)
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, fmt.Errorf("no handshake from egress proxy: %w", err)
+	}
+	if line != authBanner {
+		return nil, fmt.Errorf("unexpected handshake from egress proxy: %q", line)
+	}
+	versioned := false
+	for line != authPrompt {
+		if line, err = readLine(reader); err != nil {
+			return nil, fmt.Errorf("incomplete handshake from egress proxy: %w", err)
+		}
+		if versions, found := strings.CutPrefix(line, authVersions+" "); found {
+			versioned = slices.Contains(strings.Fields(versions), protocolVersion)
+		}
+	}
+
+	if versioned {
+		if _, err := io.WriteString(conn, authVersionRequest+" "+protocolVersion+"\n"); err != nil {
+			return nil, err
+		}
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, rejected(err)
+		}
+		if line != authVersionAccepted+" "+protocolVersion {
+			return nil, unexpected(line)
+		}
+	}
+
+	answer := token
+	if d.config.Challenge {
+		if _, err := io.WriteString(conn, authChallenge+"\n"); err != nil {
+			return nil, err
+		}
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, rejected(err)
+		}
+		nonce, found := strings.CutPrefix(line, authChallengeNext+" ")
+		if !found {
+			return nil, unexpected(line)
+		}
+		timestamp := time.Now().Unix()
+		answer = nonce + ":" + strconv.FormatInt(timestamp, 10) + ":" + ChallengeProof(d.config.ServiceID, token, nonce, timestamp)
+	}
+	if _, err := fmt.Fprintf(conn, "%d:%s\n", d.config.ServiceID, answer); err != nil {
+		return nil, err
+	}
+
+	line, err = readLine(reader)
+	if err != nil {
+		return nil, rejected(err)
+	}
+	if line != authOK {
+		return nil, unexpected(line)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// rejected turns the proxy closing the connection after the credentials
+// into ErrAuthRejected
+func rejected(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return ErrAuthRejected
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && !netErr.Timeout() {
+		return ErrAuthRejected // Connection reset
+	}
+	return err
+}
+
+// unexpected turns a line the handshake didn't expect into an error,
+// ErrAuthRejected with the proxy's reason for an AUTH_FAIL line
+func unexpected(line string) error {
+	if reason, found := strings.CutPrefix(line, authFail+" "); found {
+		return fmt.Errorf("%w: %s", ErrAuthRejected, reason)
+	}
+	return fmt.Errorf("unexpected reply from egress proxy: %q", line)
+}
+
+// readLine reads one handshake line without its line ending
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("handshake line longer than %d bytes", maxHandshakeLine)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// ChallengeProof is the hex HMAC-SHA256 of "SERVICE_ID:NONCE:TIMESTAMP"
+// keyed with the service token, as the egress proxy verifies it
+func ChallengeProof(serviceID int, token, nonce string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%d:%s:%d", serviceID, nonce, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bufferedConn reads what was buffered during the handshake before the
+// rest of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
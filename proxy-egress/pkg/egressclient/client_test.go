@@ -0,0 +1,292 @@
+package egressclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/net/http2"
+
+	"marchproxy-egress/internal/muxconn"
+)
+
+// fakeProxy answers the egress handshake like the proxy, accepting service
+// 7 with token, or a challenge proof of it, and greeting with "hello"
+// after AUTH_OK. It counts the connections it rejected.
+func fakeProxy(t *testing.T, accept func(token string) bool) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var rejections atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "MARCHPROXY_AUTH\nPlease provide authentication in format:\nSERVICE_ID:TOKEN\n")
+				reader := bufio.NewReader(conn)
+				line, _ := reader.ReadString('\n')
+				if strings.TrimSpace(line) == "CHALLENGE" {
+					io.WriteString(conn, "AUTH_CHALLENGE abc123\n")
+					line, _ = reader.ReadString('\n')
+				}
+				id, credential, _ := strings.Cut(strings.TrimSpace(line), ":")
+				if id != "7" || !accept(credential) {
+					rejections.Add(1)
+					return
+				}
+				io.WriteString(conn, "AUTH_OK\nhello\n")
+				io.Copy(conn, reader)
+			}()
+		}
+	}()
+	return listener.Addr().String(), &rejections
+}
+
+// expectGreeting reads the destination's greeting through conn
+func expectGreeting(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	greeting := make([]byte, 6)
+	if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != "hello\n" {
+		t.Fatalf("Greeting = %q, %v", greeting, err)
+	}
+}
+
+func TestDialStaticToken(t *testing.T) {
+	addr, _ := fakeProxy(t, func(token string) bool { return token == "secret" })
+
+	dialer, err := New(Config{ServiceID: 7, Token: StaticToken("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGreeting(t, conn)
+
+	dialer, _ = New(Config{ServiceID: 7, Token: StaticToken("wrong"), Retries: 3})
+	if _, err := dialer.Dial("tcp", addr); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("Dial = %v, want ErrAuthRejected", err)
+	}
+	if _, err := dialer.Dial("udp", addr); err == nil {
+		t.Error("Expected UDP to be refused")
+	}
+}
+
+func TestDialChallenge(t *testing.T) {
+	addr, _ := fakeProxy(t, func(answer string) bool {
+		parts := strings.Split(answer, ":")
+		if len(parts) != 3 || parts[0] != "abc123" {
+			return false
+		}
+		timestamp, _ := strconv.ParseInt(parts[1], 10, 64)
+		return parts[2] == ChallengeProof(7, "secret", "abc123", timestamp)
+	})
+
+	dialer, _ := New(Config{ServiceID: 7, Token: StaticToken("secret"), Challenge: true})
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGreeting(t, conn)
+}
+
+// TestDialVersion2 tests version 2 is negotiated when the proxy offers it
+// and that refusals carry the proxy's reason
+func TestDialVersion2(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "MARCHPROXY_AUTH\nPlease provide authentication in format:\nAUTH_VERSIONS 1 2\nSERVICE_ID:TOKEN\n")
+				reader := bufio.NewReader(conn)
+				if line, _ := reader.ReadString('\n'); line != "VERSION 2\n" {
+					return
+				}
+				io.WriteString(conn, "AUTH_VERSION 2\n")
+				if line, _ := reader.ReadString('\n'); line != "7:secret\n" {
+					io.WriteString(conn, "AUTH_FAIL denied\n")
+					return
+				}
+				io.WriteString(conn, "AUTH_OK\nhello\n")
+			}()
+		}
+	}()
+
+	dialer, _ := New(Config{ServiceID: 7, Token: StaticToken("secret")})
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGreeting(t, conn)
+
+	dialer, _ = New(Config{ServiceID: 7, Token: StaticToken("wrong")})
+	if _, err := dialer.Dial("tcp", listener.Addr().String()); !errors.Is(err, ErrAuthRejected) || !strings.HasSuffix(err.Error(), ": denied") {
+		t.Errorf("Dial = %v, want ErrAuthRejected: denied", err)
+	}
+}
+
+// TestDialRefreshesRejectedJWT tests a rejected JWT is fetched again once
+// and that the minted JWTs verify with the service's secret
+func TestDialRefreshesRejectedJWT(t *testing.T) {
+	addr, rejections := fakeProxy(t, func(token string) bool {
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) { return []byte("jwt-secret"), nil })
+		return err == nil && claims["service_id"] == float64(7)
+	})
+
+	fetches := 0
+	source := &JWTSource{Fetch: func(ctx context.Context) (string, error) {
+		fetches++
+		if fetches == 1 {
+			// Signed before a secret rotation
+			return signJWT(7, "api", "old-secret", time.Hour, time.Now())
+		}
+		return signJWT(7, "api", "jwt-secret", time.Hour, time.Now())
+	}}
+	dialer, _ := New(Config{ServiceID: 7, Token: source})
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGreeting(t, conn)
+	if fetches != 2 || rejections.Load() != 1 {
+		t.Errorf("Fetches = %d, rejections = %d, want 2 and 1", fetches, rejections.Load())
+	}
+
+	// The cached JWT is reused until it nears expiry
+	conn, err = dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGreeting(t, conn)
+	if fetches != 2 {
+		t.Errorf("Fetches = %d, want the cached JWT reused", fetches)
+	}
+
+	minted, err := SignedJWT(7, "api", "jwt-secret", time.Minute).Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires, err := JWTExpiry(minted); err != nil || time.Until(expires) > time.Minute {
+		t.Errorf("Expiry = %v, %v", expires, err)
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dialer, _ := New(Config{Retries: 2, RetryBackoff: time.Millisecond})
+	start := time.Now()
+	if _, err := dialer.Dial("tcp", addr); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("Dial failed after %s, want the retries backed off", elapsed)
+	}
+}
+
+// TestDialMultiplexed tests connections share one authenticated transport
+// as CONNECT streams, served like the proxy's multiplexed listener does
+func TestDialMultiplexed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var transports atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "MARCHPROXY_AUTH\nPlease provide authentication in format:\nSERVICE_ID:TOKEN\n")
+				if line, _ := readLine(bufio.NewReaderSize(conn, 16)); line != "7:secret" {
+					return
+				}
+				io.WriteString(conn, "AUTH_OK\n")
+				transports.Add(1)
+				server := &http2.Server{}
+				server.ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method != http.MethodConnect || r.Host != "egress.internal:8080" {
+						http.Error(w, "no mapping", http.StatusForbidden)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+					controller := http.NewResponseController(w)
+					controller.Flush()
+					stream := muxconn.New(muxconn.Stream{Reader: r.Body, Writer: w, Flush: controller.Flush, SetWriteDeadline: controller.SetWriteDeadline})
+					defer stream.Close()
+					io.Copy(stream, stream)
+				})})
+			}()
+		}
+	}()
+
+	dialer, _ := New(Config{ServiceID: 7, Token: StaticToken("secret"), MuxAddress: listener.Addr().String()})
+	defer dialer.Close()
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			conn, err := dialer.Dial("tcp", "egress.internal:8080")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			message := fmt.Sprintf("stream %d\n", i)
+			io.WriteString(conn, message)
+			reply := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != message {
+				errs <- fmt.Errorf("echo = %q, %v", reply, err)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := transports.Load(); n != 1 {
+		t.Errorf("Transports = %d, want 1", n)
+	}
+
+	if _, err := dialer.Dial("tcp", "egress.internal:9999"); !errors.Is(err, ErrStreamRefused) {
+		t.Errorf("Dial = %v, want ErrStreamRefused", err)
+	}
+}
@@ -0,0 +1,208 @@
+package egressclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"marchproxy-egress/internal/muxconn"
+)
+
+// ErrStreamRefused is returned when the multiplexed listener refuses a
+// stream: no mapping for the address, or the service isn't allowed on it
+var ErrStreamRefused = errors.New("egress proxy refused the stream")
+
+// muxPool holds the authenticated transport connections to the proxy's
+// multiplexed listener
+type muxPool struct {
+	dialer    *Dialer
+	transport *http2.Transport
+	conns     []*muxTransport
+	mu        sync.Mutex
+}
+
+// muxTransport is one authenticated transport connection
+type muxTransport struct {
+	conn   net.Conn
+	client *http2.ClientConn
+}
+
+// open opens a stream to the mapping listening at address
+func (p *muxPool) open(ctx context.Context, address string) (net.Conn, error) {
+	transport, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request lives as long as the stream; ctx only bounds opening it
+	reqCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	body, bodyWriter := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		Host:          address,
+		URL:           &url.URL{Host: address},
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: -1,
+	}
+	resp, err := transport.client.RoundTrip(req.WithContext(reqCtx))
+	if !stop() {
+		err = errors.Join(ctx.Err(), err)
+	}
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		bodyWriter.Close()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, maxHandshakeLine))
+		resp.Body.Close()
+		bodyWriter.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: %s", ErrStreamRefused, strings.TrimSpace(string(reason)))
+	}
+
+	return muxconn.New(muxconn.Stream{
+		Reader:           &streamBody{ReadCloser: resp.Body, request: bodyWriter, cancel: cancel, grace: p.dialer.config.Timeout},
+		Writer:           bodyWriter,
+		SetWriteDeadline: pipeWriteDeadline(bodyWriter),
+		LocalAddr:        transport.conn.LocalAddr(),
+		RemoteAddr:       transport.conn.RemoteAddr(),
+	}), nil
+}
+
+// streamBody is the response body of a stream. Closing it ends the request
+// body and leaves the proxy time to end the stream in turn, so a close
+// doesn't reset the stream and count as an error at the proxy.
+type streamBody struct {
+	io.ReadCloser
+	request *io.PipeWriter
+	cancel  context.CancelFunc
+	grace   time.Duration
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.cancel() // The stream ended, release it
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	b.request.Close()
+	time.AfterFunc(b.grace, b.cancel)
+	return nil
+}
+
+// pipeWriteDeadline bounds writes to a stream's request body. An expired
+// write deadline ends the stream, as it does on the proxy's side.
+func pipeWriteDeadline(w *io.PipeWriter) func(time.Time) error {
+	var timer *time.Timer
+	var mu sync.Mutex
+	return func(t time.Time) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if t.IsZero() {
+			return nil
+		}
+		expire := func() { w.CloseWithError(os.ErrDeadlineExceeded) }
+		if wait := time.Until(t); wait > 0 {
+			timer = time.AfterFunc(wait, expire)
+		} else {
+			expire()
+		}
+		return nil
+	}
+}
+
+// get returns a transport with room for another stream, connecting a new
+// one while there are fewer than MuxConnections. When all are busy, the
+// stream waits for room on the first.
+func (p *muxPool) get(ctx context.Context) (*muxTransport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	live := p.conns[:0]
+	for _, transport := range p.conns {
+		if transport.client.State().Closed || transport.client.State().Closing {
+			transport.conn.Close()
+			continue
+		}
+		live = append(live, transport)
+	}
+	p.conns = live
+
+	for _, transport := range p.conns {
+		if transport.client.CanTakeNewRequest() {
+			return transport, nil
+		}
+	}
+	if len(p.conns) > 0 && len(p.conns) >= p.dialer.config.MuxConnections {
+		return p.conns[0], nil
+	}
+
+	transport, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.conns = append(p.conns, transport)
+	return transport, nil
+}
+
+// connect dials the multiplexed listener, authenticates and starts HTTP/2
+func (p *muxPool) connect(ctx context.Context) (*muxTransport, error) {
+	d := p.dialer
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+
+	conn, err := d.config.Dialer.DialContext(ctx, "tcp", d.config.MuxAddress)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	authenticated, err := d.authenticate(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client, err := p.transport.NewClientConn(authenticated)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start HTTP/2 on the multiplexed transport: %w", err)
+	}
+	return &muxTransport{conn: conn, client: client}, nil
+}
+
+// close closes the transport connections
+func (p *muxPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, transport := range p.conns {
+		transport.client.Close()
+		transport.conn.Close()
+	}
+	p.conns = nil
+	return nil
+}
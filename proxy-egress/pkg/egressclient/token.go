@@ -0,0 +1,136 @@
+package egressclient
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies the token presented to the egress proxy
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// Refresher is a TokenSource whose cached token can be discarded, so the
+// next Token call fetches a new one. The Dialer invalidates a token the
+// proxy rejected.
+type Refresher interface {
+	TokenSource
+	Invalidate()
+}
+
+// StaticToken is a service token that never changes
+type StaticToken string
+
+// Token returns the token
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+// JWTSource caches JWTs from Fetch, such as a call to the service's token
+// issuer, and fetches a new one RefreshBefore its exp claim
+type JWTSource struct {
+	Fetch         func(ctx context.Context) (string, error)
+	RefreshBefore time.Duration // 1 minute by default
+
+	token   string
+	expires time.Time
+	mu      sync.Mutex
+}
+
+// Token returns the cached JWT, fetching one when there is none or it
+// is about to expire
+func (s *JWTSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refreshBefore := s.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = time.Minute
+	}
+	if s.token != "" && (s.expires.IsZero() || time.Until(s.expires) > refreshBefore) {
+		return s.token, nil
+	}
+
+	token, err := s.Fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	expires, err := JWTExpiry(token)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expires = token, expires
+	return token, nil
+}
+
+// Invalidate discards the cached JWT
+func (s *JWTSource) Invalidate() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+// JWTExpiry returns the exp claim of a JWT without verifying it, zero
+// when it has none
+func JWTExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if claims.ExpiresAt == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(claims.ExpiresAt, 0), nil
+}
+
+// SignedJWT returns a source minting HS256 JWTs with the service's JWT
+// secret, in the claims the egress proxy verifies, valid for ttl
+func SignedJWT(serviceID int, serviceName, secret string, ttl time.Duration) *JWTSource {
+	return &JWTSource{
+		Fetch: func(context.Context) (string, error) {
+			return signJWT(serviceID, serviceName, secret, ttl, time.Now())
+		},
+		RefreshBefore: ttl / 10,
+	}
+}
+
+// signJWT mints an HS256 JWT
+func signJWT(serviceID int, serviceName, secret string, ttl time.Duration, now time.Time) (string, error) {
+	if secret == "" {
+		return "", fmt.Errorf("no JWT secret")
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("JWT lifetime must be positive")
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"service_id":   serviceID,
+		"service_name": serviceName,
+		"iat":          now.Unix(),
+		"exp":          now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"marchproxy-ingress/internal/bot"
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/fingerprint"
+	"marchproxy-ingress/internal/manager"
+)
+
+// newBotDetector creates the bot classifier from the configured lists
+func newBotDetector(cfg *config.Config) (*bot.Detector, error) {
+	return bot.NewDetector(bot.Config{
+		GoodBots:         cfg.Bot.GoodBots,
+		BadUserAgents:    cfg.Bot.BadUserAgents,
+		GoodFingerprints: cfg.Bot.GoodFingerprints,
+		BadFingerprints:  cfg.Bot.BadFingerprints,
+		TarpitDelay:      cfg.Bot.TarpitDelay,
+		ChallengeSecret:  cfg.Bot.ChallengeSecret,
+		ChallengeTTL:     cfg.Bot.ChallengeTTL,
+	})
+}
+
+// checkBot classifies the request on routes with bot protection and applies
+// the route's action to bad bots. It reports whether the request may
+// proceed; when it may not, the response has been written.
+func (p *IngressProxy) checkBot(w http.ResponseWriter, r *http.Request, route *manager.IngressRoute, fp *fingerprint.Fingerprint) bool {
+	if !route.BotProtectionEnabled {
+		return true
+	}
+
+	action, err := bot.ParseAction(route.BotAction)
+	if err != nil {
+		fmt.Printf("Warning: route %s%s: %v, using challenge\n", route.HostPattern, route.PathPattern, err)
+		action = bot.ActionChallenge
+	}
+
+	var fingerprints []string
+	if fp != nil {
+		fingerprints = []string{fp.JA3, fp.JA4}
+	}
+	return p.botDetector.Handle(w, r, action, fingerprints...)
+}
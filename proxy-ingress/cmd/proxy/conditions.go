@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"marchproxy-ingress/internal/fingerprint"
+	"marchproxy-shared/cel"
+)
+
+// routeConditions compiles route conditions against the variables of
+// requestActivation
+var routeConditions = cel.NewCache("source", "request", "connection")
+
+// requestActivation returns the variables route conditions see. Header
+// names are lower case and headers and query parameters hold their first
+// value.
+func requestActivation(r *http.Request) cel.Activation {
+	sourceIP, sourcePort := r.RemoteAddr, 0
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		sourceIP = host
+		sourcePort, _ = strconv.Atoi(port)
+	}
+
+	headers := make(map[string]interface{}, len(r.Header))
+	for name, values := range r.Header {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	query := make(map[string]interface{})
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+
+	scheme := "http"
+	var sni, clientCN, ja3, ja4 string
+	if r.TLS != nil {
+		scheme = "https"
+		sni = r.TLS.ServerName
+		if len(r.TLS.PeerCertificates) > 0 {
+			clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	if fp := fingerprint.FromRequest(r); fp != nil {
+		ja3, ja4 = fp.JA3, fp.JA4
+	}
+
+	return cel.Activation{
+		"source": map[string]interface{}{
+			"ip":   sourceIP,
+			"port": sourcePort,
+		},
+		"request": map[string]interface{}{
+			"method":  r.Method,
+			"host":    r.Host,
+			"path":    r.URL.Path,
+			"scheme":  scheme,
+			"query":   query,
+			"headers": headers,
+		},
+		"connection": map[string]interface{}{
+			"tls":       r.TLS != nil,
+			"sni":       sni,
+			"ja3":       ja3,
+			"ja4":       ja4,
+			"client_cn": clientCN,
+		},
+	}
+}
+
+// conditionMatches reports whether the route's condition holds for the
+// request. A condition that fails to compile or evaluate doesn't match.
+func conditionMatches(condition string, vars func() cel.Activation) bool {
+	if condition == "" {
+		return true
+	}
+	ok, err := routeConditions.Eval(condition, vars())
+	return err == nil && ok
+}
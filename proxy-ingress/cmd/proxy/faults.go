@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"marchproxy-ingress/internal/manager"
+	"marchproxy-shared/fault"
+)
+
+// checkFaults applies the route's injected faults. It reports whether the
+// request may proceed; when it may not, the aborted response has been
+// written. The returned writer is throttled when the route's bandwidth is
+// degraded.
+func (p *IngressProxy) checkFaults(w http.ResponseWriter, r *http.Request, route *manager.IngressRoute, routeLabel string) (http.ResponseWriter, bool) {
+	faults := p.faults.Decide(routeLabel, route.FaultInjection)
+	if faults.Delay > 0 {
+		select {
+		case <-time.After(faults.Delay):
+		case <-r.Context().Done():
+			return w, false
+		}
+	}
+	if faults.Abort {
+		http.Error(w, "Injected fault", faults.AbortStatus)
+		return w, false
+	}
+	if faults.BandwidthKbps <= 0 {
+		return w, true
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{fault.Reader(r.Body, faults.BandwidthKbps), r.Body}
+	return &throttledResponseWriter{ResponseWriter: w, w: fault.Writer(w, faults.BandwidthKbps)}, true
+}
+
+// throttledResponseWriter paces response bodies for degraded bandwidth
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (t *throttledResponseWriter) Write(b []byte) (int, error) {
+	return t.w.Write(b)
+}
+
+// Flush keeps streamed responses flowing through the throttle
+func (t *throttledResponseWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// faultOverride is the body of PUT /admin/faults
+type faultOverride struct {
+	Route string `json:"route"` // Host pattern and path pattern, as in the metric labels
+	TTL   int    `json:"ttl"`   // seconds
+	fault.Spec
+}
+
+// faultsHandler serves /admin/faults:
+//
+//	GET    /admin/faults               list active overrides
+//	PUT    /admin/faults               override a route's faults for ttl seconds
+//	DELETE /admin/faults?route=<route> clear one override, or all without route
+func faultsHandler(faults *fault.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !faults.Enabled() {
+			http.Error(w, "fault injection is disabled, set fault_injection.enabled", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(faults.Overrides())
+		case http.MethodPut:
+			var req faultOverride
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid fault override: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := faults.Set(req.Route, req.Spec, time.Duration(req.TTL)*time.Second); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Printf("Fault override for route %s set for %ds: %+v\n", req.Route, req.TTL, req.Spec)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(faults.Overrides())
+		case http.MethodDelete:
+			if route := r.URL.Query().Get("route"); route != "" {
+				if !faults.Clear(route) {
+					http.Error(w, "no override for route", http.StatusNotFound)
+					return
+				}
+			} else {
+				faults.ClearAll()
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/connclose"
+	"marchproxy-ingress/internal/fingerprint"
+	"marchproxy-ingress/internal/guard"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newGuard creates the request body and slow client guard for the ingress
+// listeners
+func newGuard(cfg *config.Config) *guard.Guard {
+	// net/http falls back to the read timeout when no header timeout is set
+	headerTimeout := cfg.Listener.ReadHeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = cfg.Listener.ReadTimeout
+	}
+
+	return guard.New(guard.Config{
+		MaxBodySize:       cfg.Security.MaxRequestSize,
+		MinBodyRate:       cfg.Listener.MinBodyRate,
+		BodyRateGrace:     cfg.Listener.BodyRateGrace,
+		ReadHeaderTimeout: headerTimeout,
+	})
+}
+
+// newCloseTracker creates the close reason tracker for the ingress
+// listeners, registering its counter with reg
+func newCloseTracker(cfg *config.Config, reg prometheus.Registerer) *connclose.Tracker {
+	// net/http falls back to the read timeout for both waits
+	idleTimeout := cfg.Listener.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = cfg.Listener.ReadTimeout
+	}
+	headerTimeout := cfg.Listener.ReadHeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = cfg.Listener.ReadTimeout
+	}
+
+	return connclose.New(reg, redModule, connclose.Config{
+		IdleTimeout:   idleTimeout,
+		HeaderTimeout: headerTimeout,
+	})
+}
+
+// newListenerServer creates an ingress HTTP server with the configured
+// timeouts and slow client tracking, exposing TLS fingerprints to handlers
+func (p *IngressProxy) newListenerServer(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: p.config.Listener.ReadHeaderTimeout,
+		ReadTimeout:       p.config.Listener.ReadTimeout,
+		WriteTimeout:      p.config.Listener.WriteTimeout,
+		IdleTimeout:       p.config.Listener.IdleTimeout,
+		MaxHeaderBytes:    p.config.Listener.MaxHeaderBytes,
+		ConnContext:       fingerprint.ConnContext,
+	}
+	p.guard.Protect(server)
+	p.closes.Protect(server)
+	return server
+}
+
+// clientBodyError maps a request body error raised while proxying to the
+// status and RED reason for the client. It returns 0 for upstream errors.
+func clientBodyError(err error) (int, string) {
+	switch {
+	case errors.Is(err, guard.ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge, "body_too_large"
+	case errors.Is(err, guard.ErrSlowBody):
+		return http.StatusRequestTimeout, "slow_request"
+	default:
+		return 0, ""
+	}
+}
+
+// requestCloseReason maps the RED reason of a request to the close reason
+// it leaves on the client connection, "" when it does not explain a close.
+// A backend that hung up mid-response is told apart from other upstream
+// errors.
+func requestCloseReason(reason string, upstreamErr error) string {
+	switch reason {
+	case "", "upstream_5xx":
+		return ""
+	case "mtls_rejected":
+		return connclose.AuthFailure
+	case "no_route", "fingerprint_denied", "bot_rejected", "rate_limited", "tenant_quota", "body_too_large":
+		return connclose.PolicyDenied
+	case "upstream_unreachable":
+		if errors.Is(upstreamErr, io.EOF) || errors.Is(upstreamErr, io.ErrUnexpectedEOF) {
+			return connclose.BackendEOF
+		}
+		return connclose.Error
+	default:
+		return connclose.Error
+	}
+}
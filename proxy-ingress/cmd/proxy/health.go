@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/health"
+)
+
+// newBackendHealth creates the health checker for backend services. Active
+// checks run on the configured interval and failures seen by the proxy
+// eject a backend between checks.
+func newBackendHealth(cfg *config.Config) *health.HealthChecker {
+	return health.NewHealthChecker(health.HealthConfig{
+		CheckInterval:    cfg.HealthCheck.Interval,
+		EnabledChecks:    cfg.HealthCheck.Checks,
+		PassiveThreshold: cfg.HealthCheck.PassiveThreshold,
+		PassiveWindow:    cfg.HealthCheck.PassiveWindow,
+
+		SlowStartWindow:    cfg.HealthCheck.SlowStartWindow,
+		SlowStartCurve:     cfg.HealthCheck.SlowStartCurve,
+		SlowStartMinWeight: cfg.HealthCheck.SlowStartMinWeight,
+
+		Zone:           cfg.Locality.Zone,
+		Region:         cfg.Locality.Region,
+		SpillThreshold: cfg.Locality.SpillThreshold,
+	})
+}
+
+// healthBackend describes a backend service to the health checker. The
+// address is host or host:port, with port 80 when none is given.
+func healthBackend(name, address string) *health.Backend {
+	host, port := address, 80
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		host = h
+		if n, err := strconv.Atoi(p); err == nil {
+			port = n
+		}
+	}
+	return &health.Backend{Name: name, Host: host, Port: port, Scheme: "http"}
+}
+
+// locateBackend copies the zone and region of the backend endpoint at the
+// same host and port onto backend. Callers hold p.mu.
+func (p *IngressProxy) locateBackend(backend *health.Backend) {
+	if p.clusterConfig == nil {
+		return
+	}
+	for _, group := range p.clusterConfig.Backends {
+		for _, endpoint := range group.Endpoints {
+			if endpoint.Host == backend.Host && endpoint.Port == backend.Port {
+				backend.Zone, backend.Region = endpoint.Zone, endpoint.Region
+				return
+			}
+		}
+	}
+}
+
+// syncHealthBackends registers the configured backend services with the
+// health checker and removes the ones no longer configured. Callers hold p.mu.
+func (p *IngressProxy) syncHealthBackends() {
+	wanted := make(map[string]*health.Backend)
+	if p.clusterConfig != nil {
+		for _, service := range p.clusterConfig.Services {
+			backend := healthBackend(fmt.Sprint(service.ID), service.IPFQDN)
+			p.locateBackend(backend)
+			wanted[backend.Name] = backend
+		}
+	}
+
+	for _, backendHealth := range p.health.GetAllBackendHealth() {
+		current := backendHealth.Backend
+		if backend, exists := wanted[current.Name]; !exists || backend.Host != current.Host || backend.Port != current.Port ||
+			backend.Zone != current.Zone || backend.Region != current.Region {
+			p.health.RemoveBackend(current)
+		}
+	}
+	for _, backend := range wanted {
+		p.health.AddBackend(backend)
+	}
+}
+
+// reportUpstreamError feeds a failed proxy attempt to the health checker.
+// Requests abandoned by the client say nothing about the backend.
+func (p *IngressProxy) reportUpstreamError(backend *health.Backend, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	kind := health.FailureConnectionRefused
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		kind = health.FailureTimeout
+	}
+	p.health.ReportFailure(backend, kind)
+}
+
+// weightedBackend is a backend service a request may be sent to
+type weightedBackend struct {
+	target  *health.Backend
+	address string
+	weight  float64 // Effective weight from the health checker, above 0
+}
+
+// pickWeighted picks one of candidates at random, in proportion to their
+// weight
+func pickWeighted(candidates []weightedBackend) weightedBackend {
+	total := 0.0
+	for _, c := range candidates {
+		total += c.weight
+	}
+	point := rand.Float64() * total
+	for _, c := range candidates {
+		if point < c.weight {
+			return c
+		}
+		point -= c.weight
+	}
+	return candidates[len(candidates)-1]
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/manager"
+	"marchproxy-shared/licensing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newLicenseGate creates the gate for enterprise features, fed by the
+// manager or, in standalone mode, limited to community features
+func newLicenseGate(cfg *config.Config, client *manager.Client) *licensing.Gate {
+	proxyName, _ := os.Hostname()
+	fetch := licensing.ManagerFetcher(cfg.Manager.URL, cfg.Manager.APIKey, proxyName)
+	if client.Standalone() {
+		fetch = licensing.Community()
+	}
+	return licensing.New(fetch, licensing.Options{
+		Refresh:   cfg.License.RefreshInterval,
+		Grace:     cfg.License.GracePeriod,
+		CacheFile: cfg.License.CacheFile,
+	})
+}
+
+// licenseCollector exports the enterprise features enabled by the license
+type licenseCollector struct {
+	gate *licensing.Gate
+}
+
+var (
+	licenseFeatureDesc = prometheus.NewDesc("marchproxy_license_feature_enabled",
+		"Whether an enterprise feature is enabled by the license", []string{"feature"}, nil)
+	licenseDegradedDesc = prometheus.NewDesc("marchproxy_license_degraded",
+		"Whether the last license check failed", nil, nil)
+	licenseAgeDesc = prometheus.NewDesc("marchproxy_license_entitlements_age_seconds",
+		"Seconds since the entitlements were fetched", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c licenseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- licenseFeatureDesc
+	ch <- licenseDegradedDesc
+	ch <- licenseAgeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c licenseCollector) Collect(ch chan<- prometheus.Metric) {
+	status := c.gate.Status()
+	for _, feature := range licensing.Features {
+		ch <- prometheus.MustNewConstMetric(licenseFeatureDesc, prometheus.GaugeValue, boolToFloat(c.gate.Enabled(feature)), feature)
+	}
+	ch <- prometheus.MustNewConstMetric(licenseDegradedDesc, prometheus.GaugeValue, boolToFloat(status.Degraded))
+	if !status.FetchedAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(licenseAgeDesc, prometheus.GaugeValue, time.Since(status.FetchedAt).Seconds())
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -6,8 +6,9 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -18,14 +19,37 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"marchproxy-ingress/internal/auth"
+	"marchproxy-ingress/internal/bot"
+	"marchproxy-ingress/internal/certs"
 	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/connclose"
+	"marchproxy-ingress/internal/counters"
+	"marchproxy-ingress/internal/deadline"
 	"marchproxy-ingress/internal/ebpf"
+	"marchproxy-ingress/internal/fingerprint"
+	"marchproxy-ingress/internal/guard"
+	"marchproxy-ingress/internal/health"
 	"marchproxy-ingress/internal/manager"
-	"marchproxy-ingress/internal/tls"
+	"marchproxy-ingress/internal/overload"
+	"marchproxy-ingress/internal/ratelimit"
+	"marchproxy-ingress/internal/tenant"
+	"marchproxy-ingress/internal/tickets"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/cel"
+	"marchproxy-shared/dashgen"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/fault"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/metering"
+	"marchproxy-shared/netutil"
+	"marchproxy-shared/readiness"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 )
 
@@ -55,25 +79,106 @@ Features:
 	}
 
 	// Add command line flags
-	rootCmd.Flags().StringP("config", "c", "", "Configuration file path")
-	rootCmd.Flags().StringP("manager-url", "m", "", "Manager server URL")
-	rootCmd.Flags().StringP("cluster-api-key", "k", "", "Cluster API key")
-	rootCmd.Flags().StringP("listen-port", "p", "80", "HTTP listen port")
-	rootCmd.Flags().StringP("tls-port", "t", "443", "HTTPS/TLS listen port")
-	rootCmd.Flags().StringP("admin-port", "a", "8082", "Admin/metrics port")
-	rootCmd.Flags().StringP("log-level", "l", "INFO", "Log level (DEBUG, INFO, WARN, ERROR)")
-	rootCmd.Flags().BoolP("enable-ebpf", "e", true, "Enable eBPF acceleration")
-	rootCmd.Flags().BoolP("enable-mtls", "", true, "Enable mTLS authentication")
-	rootCmd.Flags().BoolP("enable-metrics", "", true, "Enable Prometheus metrics")
+	rootCmd.PersistentFlags().StringP("config", "c", "", "Configuration file path")
+	rootCmd.PersistentFlags().StringP("manager-url", "m", "", "Manager server URL")
+	rootCmd.PersistentFlags().StringP("cluster-api-key", "k", "", "Cluster API key")
+	rootCmd.PersistentFlags().StringP("listen-port", "p", "80", "HTTP listen port")
+	rootCmd.PersistentFlags().StringP("tls-port", "t", "443", "HTTPS/TLS listen port")
+	rootCmd.PersistentFlags().StringP("admin-port", "a", "8082", "Admin/metrics port")
+	rootCmd.PersistentFlags().StringP("log-level", "l", "INFO", "Log level (DEBUG, INFO, WARN, ERROR)")
+	rootCmd.PersistentFlags().BoolP("enable-ebpf", "e", true, "Enable eBPF acceleration")
+	rootCmd.PersistentFlags().BoolP("enable-mtls", "", true, "Enable mTLS authentication")
+	rootCmd.PersistentFlags().BoolP("enable-metrics", "", true, "Enable Prometheus metrics")
+	layers.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newConfigCmd())
+	rootCmd.AddCommand(newMetricsCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newConfigCmd creates the config command. config print-effective prints
+// the configuration this binary would run with, given the same flags and
+// environment, with secrets masked.
+func newConfigCmd() *cobra.Command {
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print-effective",
+		Short: "Print the merged configuration with secrets masked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := config.Load(cmd)
+			if err == nil {
+				err = layers.PrintEffective(os.Stdout, cfg, format)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", "yaml", "output format: yaml or json")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(printCmd)
+	return configCmd
+}
+
+// newMetricsCmd creates the metrics command. metrics export-dashboards
+// generates a Grafana dashboard and Prometheus rules from the metrics a
+// running ingress exposes on its admin port, as its collectors are only
+// registered at startup.
+func newMetricsCmd() *cobra.Command {
+	var outputDir, from string
+	exportCmd := &cobra.Command{
+		Use:   "export-dashboards",
+		Short: "Generate a Grafana dashboard and Prometheus rules from the exposed metrics",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if from == "" {
+				adminPort, _ := cmd.Flags().GetString("admin-port")
+				from = "http://127.0.0.1:" + adminPort + "/metrics"
+			}
+			metrics, err := dashgen.Scrape(from)
+			if err == nil {
+				var files []string
+				files, err = dashgen.Write(outputDir, redModule, metrics)
+				for _, file := range files {
+					fmt.Printf("Wrote %s\n", file)
+				}
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", ".", "directory to write the dashboard and rules to")
+	exportCmd.Flags().StringVar(&from, "from", "", "metrics endpoint to read (default the admin port on this host)")
+
+	metricsCmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Inspect the exposed metrics",
+	}
+	metricsCmd.AddCommand(exportCmd)
+	return metricsCmd
+}
+
 func runIngressProxy(cmd *cobra.Command, args []string) {
 	// Load configuration
 	cfg, err := config.Load(cmd)
+	if validate, _ := cmd.Flags().GetBool("validate-config"); validate {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -83,56 +188,73 @@ func runIngressProxy(cmd *cobra.Command, args []string) {
 
 	fmt.Printf("Starting MarchProxy Ingress %s\n", version)
 	fmt.Printf("Proxy Type: %s\n", cfg.ProxyType)
-	fmt.Printf("Manager URL: %s\n", cfg.ManagerURL)
-	fmt.Printf("HTTP Port: %d\n", cfg.ListenPort)
+	fmt.Printf("Manager URL: %s\n", cfg.Manager.URL)
+	fmt.Printf("HTTP Port: %d\n", cfg.Port)
 	fmt.Printf("TLS Port: %d\n", cfg.TLSPort)
-	fmt.Printf("Admin Port: %d\n", cfg.AdminPort)
+	fmt.Printf("Admin Port: %d\n", cfg.MetricsPort)
 	fmt.Printf("Log Level: %s\n", cfg.LogLevel)
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Take over the listeners of the ingress this binary replaces, if one
+	// is running, before opening any
+	var handover *netutil.Handover
+	if cfg.Upgrade.Socket != "" {
+		handover, err = netutil.StartHandover(cfg.Upgrade.Socket, cfg.Upgrade.Timeout, func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		})
+		if err != nil {
+			log.Fatalf("Failed to start listener handover: %v", err)
+		}
+		defer handover.Close()
+		fmt.Printf("Listener handover enabled on %s, inherited %d sockets\n", cfg.Upgrade.Socket, handover.Inherited())
+	}
+
+	// /readyz stays unavailable until the ingress is registered, has its
+	// config and listeners, and has loaded eBPF when enabled
+	readySteps := []string{readiness.StepRegistration, readiness.StepConfig, readiness.StepListeners}
+	if cfg.EnableEBPF {
+		readySteps = append(readySteps, readiness.StepEBPF)
+	}
+	ready := readiness.New(readySteps...)
+
 	// Initialize manager client for configuration and registration
 	managerClient := manager.NewClient(cfg)
 
-	// Check license status first
-	licenseStatus, err := managerClient.GetLicenseStatus()
-	if err != nil {
-		fmt.Printf("Warning: Failed to check license status: %v\n", err)
-	} else {
-		fmt.Printf("License: %s (%s) - Proxies: %d/%d\n",
-			licenseStatus.Edition,
-			map[bool]string{true: "Valid", false: "Invalid"}[licenseStatus.Valid],
-			licenseStatus.CurrentProxies,
-			licenseStatus.MaxProxies)
-
-		if !licenseStatus.CanRegister {
-			fmt.Printf("Error: Cannot register - proxy limit reached or license invalid\n")
-			os.Exit(1)
-		}
+	// Gate enterprise features on the cluster's entitlements
+	license := newLicenseGate(cfg, managerClient)
+	if err := license.Refresh(ctx); err == nil {
+		fmt.Printf("License entitlements: %v\n", license.Status().Features)
 	}
+	go license.Run(ctx)
 
 	// Register ingress proxy with manager
 	fmt.Printf("Registering ingress proxy with manager...\n")
-	if err := managerClient.Register(cfg); err != nil {
+	hostname, _ := os.Hostname()
+	registration, err := managerClient.Register(ctx, hostname, hostname, version, cfg.GetCapabilities())
+	if err == nil && !registration.Success {
+		err = fmt.Errorf("%s", registration.Error)
+	}
+	if err != nil {
 		fmt.Printf("Failed to register with manager: %v\n", err)
 		os.Exit(1)
 	}
+	ready.Done(readiness.StepRegistration)
 
 	// Get initial configuration including ingress routes
-	initialConfig, err := managerClient.GetConfig()
+	initialConfig, err := managerClient.GetConfig(ctx)
 	if err != nil {
 		fmt.Printf("Failed to get initial configuration: %v\n", err)
 		os.Exit(1)
 	}
+	ready.Done(readiness.StepConfig)
 
 	fmt.Printf("Loaded configuration - Services: %d, Ingress Routes: %d\n",
 		len(initialConfig.Services), len(initialConfig.IngressRoutes))
 
-	// Initialize authenticator and metrics
-	authenticator := auth.NewAuthenticator(initialConfig.Services)
-	metrics := &IngressMetrics{}
+	metrics := NewIngressMetrics()
 
 	// Initialize eBPF manager with ingress-specific programs
 	ebpfManager := ebpf.NewManager(cfg.EnableEBPF)
@@ -140,90 +262,272 @@ func runIngressProxy(cmd *cobra.Command, args []string) {
 		fmt.Printf("eBPF acceleration enabled for ingress\n")
 		if err := ebpfManager.LoadProgram("ingress"); err != nil {
 			fmt.Printf("Warning: Failed to load eBPF program: %v\n", err)
-			fmt.Printf("Continuing with userspace-only mode\n")
+			fmt.Printf("Continuing with userspace-only mode, /readyz stays unavailable while eBPF is enabled\n")
+			ready.Fail(readiness.StepEBPF, err)
 		} else {
+			ready.Done(readiness.StepEBPF)
 			// Sync initial configuration
-			ebpfManager.UpdateServices(initialConfig.Services)
-			ebpfManager.UpdateIngressRoutes(initialConfig.IngressRoutes)
+			ebpfManager.UpdateServices(len(initialConfig.Services))
+			ebpfManager.UpdateIngressRoutes(len(initialConfig.IngressRoutes))
 		}
 	}
 
 	// Initialize mTLS configuration
 	var tlsConfig *tls.Config
 	if cfg.EnableMTLS {
-		tlsConfig, err = setupMTLS(cfg)
+		var revocation *auth.RevocationChecker
+		tlsConfig, revocation, err = setupMTLS(cfg)
 		if err != nil {
 			fmt.Printf("Warning: Failed to setup mTLS: %v\n", err)
 			fmt.Printf("Continuing without mTLS\n")
 		} else {
 			fmt.Printf("mTLS authentication enabled\n")
+			if revocation != nil {
+				defer revocation.Stop()
+				metrics.Registry.MustRegister(revocationCollector{checker: revocation})
+			}
 		}
 	}
 
+	// Session ticket keys for the HTTPS listener, shared through the manager
+	// when configured so resumption works across replicas
+	if tlsConfig != nil && cfg.SessionTickets.Enabled {
+		ticketManager := tickets.NewManager(tlsConfig, managerClient, tickets.Config{
+			Shared:           cfg.SessionTickets.Shared,
+			RotationInterval: cfg.SessionTickets.RotationInterval,
+			RefreshInterval:  cfg.SessionTickets.RefreshInterval,
+			KeyCount:         cfg.SessionTickets.KeyCount,
+			Timeout:          cfg.GetManagerTimeout(),
+		})
+		tlsConfig.VerifyConnection = ticketManager.VerifyConnection(tlsConfig.VerifyConnection)
+		ticketManager.Start()
+		defer ticketManager.Stop()
+		metrics.Registry.MustRegister(ticketCollector{manager: ticketManager})
+	} else if tlsConfig != nil {
+		tlsConfig.SessionTicketsDisabled = true
+	}
+
+	// Per-route and per-client rate limits, shared across replicas when the
+	// redis store is configured
+	rateLimiter, closeRateLimiter, err := newRateLimiter(cfg)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		fmt.Printf("Continuing with in-memory rate limits\n")
+		rateLimiter, closeRateLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore()), func() {}
+	}
+	defer closeRateLimiter()
+	metrics.Registry.MustRegister(rateLimitCollector{limiter: rateLimiter})
+
+	botDetector, err := newBotDetector(cfg)
+	if err != nil {
+		fmt.Printf("Failed to initialize bot detection: %v\n", err)
+		os.Exit(1)
+	}
+	metrics.Registry.MustRegister(botCollector{detector: botDetector})
+
+	fingerprints := fingerprint.NewTracker(cfg.TLSFingerprint.MaxTracked)
+	metrics.Registry.MustRegister(fingerprintCollector{tracker: fingerprints})
+
+	// Fault injection for resilience testing
+	faults := fault.NewInjector(cfg.FaultInjection.Enabled)
+	if faults.Enabled() {
+		fmt.Printf("Warning: fault injection enabled, route faults and admin overrides will be applied\n")
+	}
+	metrics.Registry.MustRegister(faultCollector{injector: faults})
+
+	// Connection and request limits, and load shedding under pressure
+	shedder, err := newShedder(cfg)
+	if err != nil {
+		fmt.Printf("Failed to initialize load shedding: %v\n", err)
+		os.Exit(1)
+	}
+	go shedder.Run(ctx)
+	metrics.Registry.MustRegister(overloadCollector{shedder: shedder})
+
+	// Per-tenant quotas on shared clusters
+	tenants := tenant.NewLimiter()
+	tenants.Update(initialConfig.Tenants)
+	metrics.Registry.MustRegister(tenantCollector{limiter: tenants})
+
+	// Backends drained for maintenance, by the manager or the admin API
+	drains := drain.NewSet("ingress")
+	drains.SetManaged(initialConfig.DrainedBackends)
+	metrics.Registry.MustRegister(drains.Collector(nil))
+
+	// Usage metering per tenant and backend for chargeback
+	meter := newMeter(cfg, managerClient)
+	if meter != nil {
+		fmt.Printf("Usage metering enabled - interval: %v\n", cfg.Metering.Interval)
+		go meter.Run(ctx, cfg.Metering.Interval)
+		metrics.Registry.MustRegister(meteringCollector{meter: meter})
+	}
+	metrics.Registry.MustRegister(licenseCollector{gate: license})
+
 	// Initialize ingress proxy server
 	fmt.Printf("Starting ingress proxy server on ports %d (HTTP) and %d (HTTPS)...\n",
-		cfg.ListenPort, cfg.TLSPort)
+		cfg.Port, cfg.TLSPort)
 	ingressServer := &IngressProxy{
 		config:        cfg,
 		clusterConfig: initialConfig,
 		managerClient: managerClient,
-		authenticator: authenticator,
 		metrics:       metrics,
 		ebpfManager:   ebpfManager,
 		tlsConfig:     tlsConfig,
+		health:        newBackendHealth(cfg),
+		rateLimiter:   rateLimiter,
+		guard:         newGuard(cfg),
+		closes:        newCloseTracker(cfg, metrics.Registry),
+		botDetector:   botDetector,
+		fingerprints:  fingerprints,
+		faults:        faults,
+		shedder:       shedder,
+		tenants:       tenants,
+		drains:        drains,
+		meter:         meter,
 	}
+	metrics.Registry.MustRegister(guardCollector{guard: ingressServer.guard})
+
+	// Backend health from active checks and live traffic failures
+	ingressServer.syncHealthBackends()
+	if err := ingressServer.health.Start(); err != nil {
+		fmt.Printf("Warning: Failed to start backend health checks: %v\n", err)
+	}
+
+	// Applied config version and diff for /admin/config
+	configHistory := &manager.ConfigHistory{}
+	configHistory.Record(initialConfig)
 
 	// Start configuration refresh loop
 	go managerClient.StartConfigRefresh(ctx, cfg, func(config *manager.ClusterConfig) {
-		fmt.Printf("Configuration updated - Version: %s\n", config.Version)
+		diff := configHistory.Record(config)
+		fmt.Printf("Configuration updated - Version: %s (%s)\n", config.Version, diff.Summary())
 		ingressServer.updateConfiguration(config)
 
 		// Update eBPF maps
 		if ebpfManager.IsEnabled() {
-			ebpfManager.UpdateServices(config.Services)
-			ebpfManager.UpdateIngressRoutes(config.IngressRoutes)
+			ebpfManager.UpdateServices(len(config.Services))
+			ebpfManager.UpdateIngressRoutes(len(config.IngressRoutes))
 		}
 	})
 
 	// Start heartbeat loop
 	go managerClient.StartHeartbeat(ctx, cfg, func() manager.SystemStats {
-		return manager.GetSystemStats()
+		stats := manager.GetSystemStats()
+		stats.Connections = int(atomic.LoadInt64(&metrics.ActiveConnections))
+		stats.RequestCount = uint64(metrics.RoutedRequests.Load())
+		stats.ErrorCount = uint64(atomic.LoadInt64(&metrics.FailedRequests))
+		return stats
 	})
 
+	// Open every listener before serving, so an ingress being replaced can
+	// stop accepting once they are all open
+	httpListener, err := netutil.Listen("tcp", cfg.GetListenAddress(), cfg.BindInterface)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.GetListenAddress(), err)
+	}
+	// Without TLS there is nothing to serve on the HTTPS port
+	var httpsListener net.Listener
+	if tlsConfig != nil {
+		httpsListener, err = netutil.Listen("tcp", cfg.GetTLSListenAddress(), cfg.BindInterface)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", cfg.GetTLSListenAddress(), err)
+		}
+	} else {
+		fmt.Printf("TLS not configured, serving HTTP only\n")
+	}
+	var adminListener net.Listener
+	var snmpConn net.PacketConn
+	if cfg.EnableMetrics {
+		adminAddr := fmt.Sprintf(":%d", cfg.MetricsPort)
+		adminListener, err = adminserver.ListenWith(cfg.Admin, adminAddr, func(network, address string) (net.Listener, error) {
+			return netutil.Listen(network, address, "")
+		})
+		if err != nil {
+			log.Fatalf("Failed to listen on admin address %s: %v", cfg.Admin.Address(adminAddr), err)
+		}
+		if warning := adminserver.Warning(cfg.Admin, cfg.Admin.Address(adminAddr)); warning != "" {
+			log.Printf("Warning: %s", warning)
+		}
+		if cfg.SNMP.Listen != "" {
+			snmpConn, err = netutil.ListenPacket("udp", cfg.SNMP.Listen, "")
+			if err != nil {
+				log.Fatalf("Failed to listen on SNMP address %s: %v", cfg.SNMP.Listen, err)
+			}
+		}
+	}
+	ready.Done(readiness.StepListeners)
+
 	// Start HTTP server in goroutine
 	go func() {
-		if err := ingressServer.StartHTTP(ctx); err != nil {
+		if err := ingressServer.StartHTTP(ctx, httpListener); err != nil {
 			fmt.Printf("HTTP ingress server failed: %v\n", err)
 			cancel()
 		}
 	}()
 
 	// Start HTTPS server in goroutine
-	go func() {
-		if err := ingressServer.StartHTTPS(ctx); err != nil {
-			fmt.Printf("HTTPS ingress server failed: %v\n", err)
-			cancel()
-		}
-	}()
+	if httpsListener != nil {
+		go func() {
+			if err := ingressServer.StartHTTPS(ctx, httpsListener); err != nil {
+				fmt.Printf("HTTPS ingress server failed: %v\n", err)
+				cancel()
+			}
+		}()
+	}
 
 	// Start admin server for health checks and metrics
-	if cfg.EnableMetrics {
+	if adminListener != nil {
 		go func() {
-			if err := startAdminServer(cfg.AdminPort, metrics, ebpfManager); err != nil {
+			if err := startAdminServer(adminListener, cfg.Admin, ready, metrics, ebpfManager, configHistory, faults, tenants, drains, ingressServer.health); err != nil {
 				fmt.Printf("Failed to start admin server: %v\n", err)
 			}
 		}()
 	}
+	if snmpConn != nil {
+		agent := newSNMPAgent(cfg.SNMP.Community, ready, metrics)
+		metrics.Registry.MustRegister(snmpCollector{agent: agent})
+		fmt.Printf("SNMP agent listening on %s\n", snmpConn.LocalAddr())
+		go func() {
+			if err := agent.Serve(snmpConn); err != nil {
+				fmt.Printf("SNMP agent failed: %v\n", err)
+			}
+		}()
+	}
+
+	var upgraded <-chan struct{}
+	if handover != nil {
+		if err := handover.Ready(); err != nil {
+			fmt.Printf("Warning: listener handover incomplete: %v\n", err)
+		}
+		upgraded = handover.Done()
+	}
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal. SIGUSR2 starts a hitless upgrade.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if handover != nil {
+		signal.Notify(sigChan, syscall.SIGUSR2)
+	}
 
-	select {
-	case sig := <-sigChan:
-		fmt.Printf("Received signal %s, shutting down\n", sig)
-	case <-ctx.Done():
-		fmt.Printf("Context cancelled, shutting down\n")
+	for running := true; running; {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGUSR2 {
+				fmt.Printf("Upgrading, starting the new binary\n")
+				go func() {
+					if err := handover.Upgrade(); err != nil {
+						fmt.Printf("Upgrade failed, still serving: %v\n", err)
+					}
+				}()
+				continue
+			}
+			fmt.Printf("Received signal %s, shutting down\n", sig)
+		case <-upgraded:
+			fmt.Printf("New process took over the listeners, draining\n")
+		case <-ctx.Done():
+			fmt.Printf("Context cancelled, shutting down\n")
+		}
+		running = false
 	}
 
 	// Graceful shutdown
@@ -232,6 +536,12 @@ func runIngressProxy(cmd *cobra.Command, args []string) {
 	// Shutdown ingress servers
 	if ingressServer != nil {
 		ingressServer.Stop()
+		ingressServer.health.Stop()
+	}
+
+	// Export usage of the last partial period
+	if meter != nil {
+		meter.Flush()
 	}
 
 	// Cleanup eBPF resources
@@ -244,8 +554,9 @@ func runIngressProxy(cmd *cobra.Command, args []string) {
 	fmt.Printf("MarchProxy Ingress shutdown complete\n")
 }
 
-// setupMTLS configures mutual TLS for the ingress proxy
-func setupMTLS(cfg *config.Config) (*tls.Config, error) {
+// setupMTLS configures mutual TLS for the ingress proxy. The revocation
+// checker is nil unless OCSP, CRL checks or OCSP stapling are enabled.
+func setupMTLS(cfg *config.Config) (*tls.Config, *auth.RevocationChecker, error) {
 	tlsConfig := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 	}
@@ -253,43 +564,103 @@ func setupMTLS(cfg *config.Config) (*tls.Config, error) {
 	// Load server certificate
 	cert, err := tls.LoadX509KeyPair(cfg.MTLSServerCertPath, cfg.MTLSServerKeyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+		return nil, nil, fmt.Errorf("failed to load server certificate: %w", err)
 	}
 	tlsConfig.Certificates = []tls.Certificate{cert}
+	certs.Default.AddKeyPair("mtls", certs.RoleServer, cfg.MTLSServerCertPath, &cert)
+
+	// Client certificate revocation and OCSP stapling
+	revocationConfig := auth.RevocationConfig{
+		OCSPEnabled:        cfg.MTLSRevocation.OCSPEnabled,
+		OCSPStapling:       cfg.MTLSRevocation.OCSPStapling,
+		OCSPTimeout:        cfg.MTLSRevocation.OCSPTimeout,
+		CRLEnabled:         cfg.MTLSRevocation.CRLEnabled,
+		CRLSources:         cfg.MTLSRevocation.CRLSources,
+		CRLRefreshInterval: cfg.MTLSRevocation.CRLRefreshInterval,
+		FailOpen:           cfg.MTLSRevocation.FailOpen,
+	}
+	var revocation *auth.RevocationChecker
+	if revocationConfig.Enabled() || revocationConfig.OCSPStapling {
+		revocation = auth.NewRevocationChecker(revocationConfig)
+	}
+	if revocationConfig.OCSPStapling {
+		getCertificate, err := revocation.StapleOCSP(cert)
+		if err != nil {
+			revocation.Stop()
+			return nil, nil, fmt.Errorf("failed to set up OCSP stapling: %w", err)
+		}
+		tlsConfig.GetCertificate = getCertificate
+	}
 
 	// Setup client certificate validation for mutual TLS
 	if cfg.MTLSRequireClientCert {
 		// Load client CA certificates
 		caCert, err := ioutil.ReadFile(cfg.MTLSClientCAPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load client CA: %w", err)
+			return nil, nil, fmt.Errorf("failed to load client CA: %w", err)
 		}
 
 		caCertPool := x509.NewCertPool()
 		if !caCertPool.AppendCertsFromPEM(caCert) {
-			return nil, fmt.Errorf("failed to parse client CA certificate")
+			return nil, nil, fmt.Errorf("failed to parse client CA certificate")
 		}
+		certs.Default.AddPEM("mtls", certs.RoleCA, cfg.MTLSClientCAPath, caCert)
 
 		tlsConfig.ClientCAs = caCertPool
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 
 		fmt.Printf("mTLS client certificate validation enabled\n")
+
+		if revocationConfig.Enabled() {
+			tlsConfig.VerifyConnection = revocation.VerifyConnection
+			fmt.Printf("mTLS client certificate revocation checks enabled (OCSP: %v, CRL: %v, fail open: %v)\n",
+				revocationConfig.OCSPEnabled, revocationConfig.CRLEnabled, revocationConfig.FailOpen)
+		}
 	}
 
-	return tlsConfig, nil
+	return tlsConfig, revocation, nil
 }
 
-// IngressMetrics holds metrics for the ingress proxy
+// IngressMetrics holds metrics for the ingress proxy. Per-request counters
+// are sharded to avoid cache-line contention; the rest use sync/atomic.
+// The RED series live in Registry, which /metrics serves.
 type IngressMetrics struct {
-	HTTPRequests      int64
-	HTTPSRequests     int64
-	RoutedRequests    int64
+	HTTPRequests      *counters.ShardedCounter
+	HTTPSRequests     *counters.ShardedCounter
+	RoutedRequests    *counters.ShardedCounter
 	FailedRequests    int64
 	AuthSuccesses     int64
 	AuthFailures      int64
 	ActiveConnections int64
-	BytesTransferred  int64
-	mu                sync.RWMutex
+	BytesTransferred  *counters.ShardedCounter
+	Registry          *prometheus.Registry
+	RED               *redMetrics
+	Localities        *prometheus.CounterVec // Requests per backend locality relative to the proxy
+	BudgetExhausted   *prometheus.CounterVec // Requests cancelled per route once their timeout budget ran out
+}
+
+// NewIngressMetrics creates zeroed ingress metrics
+func NewIngressMetrics() *IngressMetrics {
+	registry := prometheus.NewRegistry()
+	localities := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marchproxy_ingress_locality_requests_total",
+		Help: "Requests routed per backend locality relative to the proxy: zone, region or remote",
+	}, []string{"locality"})
+	budgetExhausted := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marchproxy_ingress_budget_exhausted_total",
+		Help: "Requests cancelled per route because their timeout budget ran out, before forwarding (proxy) or while waiting for the backend (upstream)",
+	}, []string{"route", "stage"})
+	registry.MustRegister(localities, budgetExhausted)
+	return &IngressMetrics{
+		HTTPRequests:     counters.NewShardedCounter(),
+		HTTPSRequests:    counters.NewShardedCounter(),
+		RoutedRequests:   counters.NewShardedCounter(),
+		BytesTransferred: counters.NewShardedCounter(),
+		Registry:         registry,
+		RED:              newREDMetrics(registry),
+		Localities:       localities,
+		BudgetExhausted:  budgetExhausted,
+	}
 }
 
 // IngressProxy implements a reverse proxy server with mTLS and routing
@@ -297,72 +668,150 @@ type IngressProxy struct {
 	config        *config.Config
 	clusterConfig *manager.ClusterConfig
 	managerClient *manager.Client
-	authenticator *auth.Authenticator
 	metrics       *IngressMetrics
 	ebpfManager   *ebpf.Manager
 	tlsConfig     *tls.Config
+	health        *health.HealthChecker
+	rateLimiter   *ratelimit.Limiter
+	guard         *guard.Guard
+	closes        *connclose.Tracker
+	botDetector   *bot.Detector
+	fingerprints  *fingerprint.Tracker
+	faults        *fault.Injector
+	shedder       *overload.Shedder
+	tenants       *tenant.Limiter
+	drains        *drain.Set
+	meter         *metering.Meter // nil when metering is disabled
 	httpServer    *http.Server
 	httpsServer   *http.Server
 	mu            sync.RWMutex
 }
 
-// StartHTTP starts the HTTP ingress server
-func (p *IngressProxy) StartHTTP(ctx context.Context) error {
+// StartHTTP starts the HTTP ingress server on listener
+func (p *IngressProxy) StartHTTP(ctx context.Context, listener net.Listener) error {
 	handler := p.createReverseProxyHandler(false)
 
-	p.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", p.config.ListenPort),
-		Handler: handler,
-	}
+	addr := p.config.GetListenAddress()
+	p.httpServer = p.newListenerServer(addr, handler)
 
-	fmt.Printf("HTTP ingress proxy listening on :%d\n", p.config.ListenPort)
-	return p.httpServer.ListenAndServe()
+	fmt.Printf("HTTP ingress proxy listening on %s\n", addr)
+	return p.httpServer.Serve(p.shedder.Listener(listener))
 }
 
-// StartHTTPS starts the HTTPS ingress server with mTLS
-func (p *IngressProxy) StartHTTPS(ctx context.Context) error {
+// StartHTTPS starts the HTTPS ingress server with mTLS on listener
+func (p *IngressProxy) StartHTTPS(ctx context.Context, listener net.Listener) error {
 	if p.tlsConfig == nil {
+		listener.Close()
 		return fmt.Errorf("TLS not configured")
 	}
 
 	handler := p.createReverseProxyHandler(true)
 
-	p.httpsServer = &http.Server{
-		Addr:      fmt.Sprintf(":%d", p.config.TLSPort),
-		Handler:   handler,
-		TLSConfig: p.tlsConfig,
+	addr := p.config.GetTLSListenAddress()
+	p.httpsServer = p.newListenerServer(addr, handler)
+	p.httpsServer.TLSConfig = p.tlsConfig
+
+	// ServeTLS would clone the config and miss session ticket key rotation,
+	// so wrap the listener with the shared config and advertise HTTP/2 here
+	if len(p.tlsConfig.NextProtos) == 0 {
+		p.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
+	fingerprint.Capture(p.tlsConfig, p.fingerprints)
 
-	fmt.Printf("HTTPS ingress proxy with mTLS listening on :%d\n", p.config.TLSPort)
-	return p.httpsServer.ListenAndServeTLS("", "")
+	fmt.Printf("HTTPS ingress proxy with mTLS listening on %s\n", addr)
+	return p.httpsServer.Serve(tls.NewListener(fingerprint.Listener(p.shedder.Listener(listener)), p.tlsConfig))
 }
 
 // createReverseProxyHandler creates the HTTP handler for reverse proxying
 func (p *IngressProxy) createReverseProxyHandler(isTLS bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Update metrics
-		p.metrics.mu.Lock()
 		if isTLS {
-			p.metrics.HTTPSRequests++
+			p.metrics.HTTPSRequests.Inc()
 		} else {
-			p.metrics.HTTPRequests++
+			p.metrics.HTTPRequests.Inc()
 		}
-		p.metrics.ActiveConnections++
-		p.metrics.mu.Unlock()
-
+		atomic.AddInt64(&p.metrics.ActiveConnections, 1)
+		defer atomic.AddInt64(&p.metrics.ActiveConnections, -1)
+
+		// RED metrics for this request and the close reason it leaves on
+		// the client connection, recorded once it completes
+		start := time.Now()
+		var routeLabel, backendLabel, reason string
+		var upstreamErr error
+		tenantID := p.routeTenant(nil)
 		defer func() {
-			p.metrics.mu.Lock()
-			p.metrics.ActiveConnections--
-			p.metrics.mu.Unlock()
+			p.metrics.RED.observe(routeLabel, backendLabel, tenantID, reason,
+				time.Since(start), traceIDFromRequest(r))
+			p.closes.Mark(r, routeLabel, requestCloseReason(reason, upstreamErr))
 		}()
 
+		// Shed requests the ingress cannot take on without slowing the rest
+		admitted, ok := p.checkOverload(w, r)
+		if !ok {
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "overloaded"
+			return
+		}
+		defer admitted()
+
 		// Find matching route
 		route := p.findMatchingRoute(r)
 		if route == nil {
 			http.Error(w, "No matching route found", http.StatusNotFound)
-			p.metrics.mu.Lock()
-			p.metrics.FailedRequests++
-			p.metrics.mu.Unlock()
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "no_route"
+			return
+		}
+		routeLabel = route.HostPattern + route.PathPattern
+		tenantID = p.routeTenant(route)
+
+		// Time budget from the route timeout, or the caller's own deadline
+		// when sooner; the request is cancelled once it runs out
+		budget, budgeted := deadline.Deadline(start, time.Duration(route.RequestTimeoutMs)*time.Millisecond, r.Header)
+		if budgeted {
+			ctx, cancel := context.WithDeadline(r.Context(), budget)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		// TLS fingerprint allow and deny lists for the route
+		fp := fingerprint.FromRequest(r)
+		if !fingerprint.Allowed(fp, route.TLSFingerprintAllow, route.TLSFingerprintDeny) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "fingerprint_denied"
+			return
+		}
+
+		// Bot classification and the route's action for bad bots
+		if !p.checkBot(w, r, route, fp) {
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "bot_rejected"
+			return
+		}
+
+		if !p.checkRateLimit(w, r, route, routeLabel) {
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "rate_limited"
+			return
+		}
+
+		// Concurrency, request rate and bandwidth quotas of the route's tenant
+		release, w, ok := p.checkTenantQuota(w, tenantID)
+		if !ok {
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "tenant_quota"
+			return
+		}
+		defer release()
+
+		// Reject bodies over the route's limit up front and enforce the
+		// limit and minimum upload rate while the body is proxied
+		if err := p.guard.LimitBody(w, r, route.MaxBodySize); err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "body_too_large"
 			return
 		}
 
@@ -370,44 +819,100 @@ func (p *IngressProxy) createReverseProxyHandler(isTLS bool) http.Handler {
 		if route.RequireMTLS && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 			if err := p.validateClientCertificate(r.TLS.PeerCertificates[0], route); err != nil {
 				http.Error(w, "Client certificate validation failed", http.StatusForbidden)
-				p.metrics.mu.Lock()
-				p.metrics.AuthFailures++
-				p.metrics.mu.Unlock()
+				atomic.AddInt64(&p.metrics.AuthFailures, 1)
+				reason = "mtls_rejected"
 				return
 			}
-			p.metrics.mu.Lock()
-			p.metrics.AuthSuccesses++
-			p.metrics.mu.Unlock()
+			atomic.AddInt64(&p.metrics.AuthSuccesses, 1)
+		}
+
+		// Injected delays, aborts and bandwidth limits for resilience testing
+		w, ok = p.checkFaults(w, r, route, routeLabel)
+		if !ok {
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "fault_abort"
+			return
 		}
 
 		// Select backend service (load balancing)
-		backend, err := p.selectBackend(route)
+		backend, target, err := p.selectBackend(route)
 		if err != nil {
 			http.Error(w, "No healthy backend available", http.StatusServiceUnavailable)
-			p.metrics.mu.Lock()
-			p.metrics.FailedRequests++
-			p.metrics.mu.Unlock()
+			atomic.AddInt64(&p.metrics.FailedRequests, 1)
+			reason = "no_backend"
 			return
 		}
+		backendLabel = backend.Host
+
+		// Forward the time left so the backend can abandon work the client
+		// will no longer wait for
+		if budgeted {
+			remaining := time.Until(budget)
+			if remaining <= 0 {
+				p.metrics.BudgetExhausted.WithLabelValues(routeLabel, "proxy").Inc()
+				http.Error(w, "Request timeout budget exhausted", http.StatusGatewayTimeout)
+				atomic.AddInt64(&p.metrics.FailedRequests, 1)
+				reason = "budget_exhausted"
+				return
+			}
+			deadline.SetHeaders(r.Header, remaining)
+		}
 
 		// Create reverse proxy
 		proxy := httputil.NewSingleHostReverseProxy(backend)
 		proxy.ModifyResponse = func(resp *http.Response) error {
 			// Update byte transfer metrics
-			p.metrics.mu.Lock()
-			p.metrics.BytesTransferred += resp.ContentLength
-			p.metrics.mu.Unlock()
+			if resp.ContentLength > 0 {
+				p.metrics.BytesTransferred.Add(resp.ContentLength)
+				p.tenants.Count(tenantID, resp.ContentLength)
+			}
 			return nil
 		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if status, clientReason := clientBodyError(err); status != 0 {
+				fmt.Printf("Aborted request from %s: %v\n", r.RemoteAddr, err)
+				reason = clientReason
+				atomic.AddInt64(&p.metrics.FailedRequests, 1)
+				w.WriteHeader(status)
+				return
+			}
+			if budgeted && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+				// The budget ran out, not the backend
+				fmt.Printf("Request to %s cancelled: timeout budget exhausted\n", backend.Host)
+				p.metrics.BudgetExhausted.WithLabelValues(routeLabel, "upstream").Inc()
+				reason = "budget_exhausted"
+				atomic.AddInt64(&p.metrics.FailedRequests, 1)
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
+			}
+			fmt.Printf("Upstream %s failed: %v\n", backend.Host, err)
+			reason = "upstream_unreachable"
+			upstreamErr = err
+			p.reportUpstreamError(target, err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
 
 		// Proxy the request
-		proxy.ServeHTTP(w, r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		untrack := p.drains.Track(target.Host, target.Port)
+		proxy.ServeHTTP(recorder, r)
+		untrack()
+		p.meter.Add(tenantID, backendLabel, metering.Usage{
+			Requests: 1,
+			Bytes:    uint64(max(r.ContentLength, 0) + recorder.bytes),
+		})
+		if reason == "" && recorder.status >= 500 {
+			reason = "upstream_5xx"
+			p.health.ReportFailure(target, health.FailureServerError)
+		}
 
-		p.metrics.mu.Lock()
-		p.metrics.RoutedRequests++
-		p.metrics.mu.Unlock()
+		p.metrics.RoutedRequests.Inc()
 
-		fmt.Printf("Proxied %s %s to %s\n", r.Method, r.URL.Path, backend.String())
+		if fp != nil {
+			fmt.Printf("Proxied %s %s to %s (ja3=%s ja4=%s)\n", r.Method, r.URL.Path, backend.String(), fp.JA3, fp.JA4)
+		} else {
+			fmt.Printf("Proxied %s %s to %s\n", r.Method, r.URL.Path, backend.String())
+		}
 	})
 }
 
@@ -422,11 +927,23 @@ func (p *IngressProxy) findMatchingRoute(r *http.Request) *manager.IngressRoute
 
 	host := r.Host
 	path := r.URL.Path
+	now := time.Now()
+
+	// Condition variables, built for the first route with a condition
+	var vars cel.Activation
+	activation := func() cel.Activation {
+		if vars == nil {
+			vars = requestActivation(r)
+		}
+		return vars
+	}
 
 	// Find matching routes based on host and path patterns
 	for _, route := range p.clusterConfig.IngressRoutes {
 		if p.matchesHostPattern(host, route.HostPattern) &&
-		   p.matchesPathPattern(path, route.PathPattern) {
+		   p.matchesPathPattern(path, route.PathPattern) &&
+		   route.Schedule.Active(now, p.config.Schedule.ClockSkew) &&
+		   conditionMatches(route.Condition, activation) {
 			return &route
 		}
 	}
@@ -484,35 +1001,63 @@ func (p *IngressProxy) validateClientCertificate(cert *x509.Certificate, route *
 	return nil
 }
 
-// selectBackend selects a backend service using load balancing
-func (p *IngressProxy) selectBackend(route *manager.IngressRoute) (*url.URL, error) {
+// selectBackend selects a backend service of the route that is not ejected
+// by health checks, along with its health checker identity. Services are
+// picked by effective weight, so backends ramping up after slow-start take a
+// smaller share of requests, and drained services take none. With a locality
+// set, services in the proxy's zone are preferred and others only take what
+// the zone can't.
+func (p *IngressProxy) selectBackend(route *manager.IngressRoute) (*url.URL, *health.Backend, error) {
 	if len(route.BackendServices) == 0 {
-		return nil, fmt.Errorf("no backend services configured")
+		return nil, nil, fmt.Errorf("no backend services configured")
 	}
 
-	// Simple round-robin for now
-	// TODO: Implement more sophisticated load balancing
-	serviceID := route.BackendServices[0]
-
 	// Find the service details
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
 	if p.clusterConfig == nil {
-		return nil, fmt.Errorf("no cluster configuration")
+		return nil, nil, fmt.Errorf("no cluster configuration")
 	}
 
-	for _, service := range p.clusterConfig.Services {
-		if service.ID == serviceID {
-			backend, err := url.Parse(fmt.Sprintf("http://%s", service.IPFQDN))
-			if err != nil {
-				return nil, fmt.Errorf("invalid backend URL: %w", err)
+	var targets []*health.Backend
+	var addresses []string
+	for _, serviceID := range route.BackendServices {
+		for _, service := range p.clusterConfig.Services {
+			if service.ID != serviceID {
+				continue
 			}
-			return backend, nil
+
+			target := healthBackend(fmt.Sprint(service.ID), service.IPFQDN)
+			if p.drains.Drained(target.Host, target.Port) {
+				break
+			}
+			p.locateBackend(target)
+			targets = append(targets, target)
+			addresses = append(addresses, service.IPFQDN)
+			break
 		}
 	}
 
-	return nil, fmt.Errorf("backend service not found")
+	var candidates []weightedBackend
+	for i, weight := range p.health.LocalityWeights(targets) {
+		if weight > 0 {
+			candidates = append(candidates, weightedBackend{target: targets[i], address: addresses[i], weight: weight})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no available backend service")
+	}
+
+	chosen := pickWeighted(candidates)
+	if locality := p.health.Locality(chosen.target); locality != "" {
+		p.metrics.Localities.WithLabelValues(locality).Inc()
+	}
+	backend, err := url.Parse(fmt.Sprintf("http://%s", chosen.address))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid backend URL: %w", err)
+	}
+	return backend, chosen.target, nil
 }
 
 // updateConfiguration updates the proxy's cluster configuration
@@ -521,7 +1066,9 @@ func (p *IngressProxy) updateConfiguration(config *manager.ClusterConfig) {
 	defer p.mu.Unlock()
 
 	p.clusterConfig = config
-	p.authenticator.UpdateServices(config.Services)
+	p.tenants.Update(config.Tenants)
+	p.drains.SetManaged(config.DrainedBackends)
+	p.syncHealthBackends()
 
 	fmt.Printf("Ingress proxy configuration updated - Services: %d, Routes: %d\n",
 		len(config.Services), len(config.IngressRoutes))
@@ -529,6 +1076,8 @@ func (p *IngressProxy) updateConfiguration(config *manager.ClusterConfig) {
 
 // Stop stops the ingress proxy servers
 func (p *IngressProxy) Stop() {
+	p.closes.Drain()
+
 	if p.httpServer != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -542,8 +1091,8 @@ func (p *IngressProxy) Stop() {
 	}
 }
 
-// startAdminServer starts the admin/metrics HTTP server
-func startAdminServer(port int, metrics *IngressMetrics, ebpfMgr *ebpf.Manager) error {
+// startAdminServer starts the admin/metrics HTTP server on listener
+func startAdminServer(listener net.Listener, admin adminserver.Config, ready *readiness.Tracker, metrics *IngressMetrics, ebpfMgr *ebpf.Manager, configHistory *manager.ConfigHistory, faults *fault.Injector, tenants *tenant.Limiter, drains *drain.Set, backends *health.HealthChecker) error {
 	mux := http.NewServeMux()
 
 	// Health check endpoint
@@ -553,86 +1102,51 @@ func startAdminServer(port int, metrics *IngressMetrics, ebpfMgr *ebpf.Manager)
 		fmt.Fprintf(w, `{"status":"healthy","type":"ingress","version":"%s"}`, version)
 	})
 
-	// Comprehensive metrics endpoint
-	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics.mu.RLock()
-		httpRequests := metrics.HTTPRequests
-		httpsRequests := metrics.HTTPSRequests
-		routedRequests := metrics.RoutedRequests
-		failedRequests := metrics.FailedRequests
-		authSuccesses := metrics.AuthSuccesses
-		authFailures := metrics.AuthFailures
-		activeConnections := metrics.ActiveConnections
-		bytesTransferred := metrics.BytesTransferred
-		metrics.mu.RUnlock()
-
-		w.Header().Set("Content-Type", "text/plain")
+	// Readiness for rollouts, once startup has finished
+	mux.Handle("/readyz", ready)
+
+	// Metrics endpoint. OpenMetrics is negotiated so scrapers that ask for
+	// it receive the trace exemplars on the latency histogram.
+	metrics.Registry.MustRegister(&ingressCollector{metrics: metrics, ebpfMgr: ebpfMgr})
+	metrics.Registry.MustRegister(certCollector{})
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
+
+	// Applied configuration version and what the last refresh changed
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		configVersion, appliedAt, diff := configHistory.Snapshot()
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":    configVersion,
+			"applied_at": appliedAt.UTC().Format(time.RFC3339),
+			"diff":       diff,
+		})
+	})
 
-		// HTTP request metrics
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_http_requests_total Total number of HTTP requests\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_http_requests_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_http_requests_total %d\n", httpRequests)
-
-		// HTTPS request metrics
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_https_requests_total Total number of HTTPS requests\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_https_requests_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_https_requests_total %d\n", httpsRequests)
-
-		// Routed request metrics
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_routed_requests_total Total number of successfully routed requests\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_routed_requests_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_routed_requests_total %d\n", routedRequests)
-
-		// Failed request metrics
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_failed_requests_total Total number of failed requests\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_failed_requests_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_failed_requests_total %d\n", failedRequests)
-
-		// Bytes transferred metrics
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_bytes_transferred_total Total bytes transferred\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_bytes_transferred_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_bytes_transferred_total %d\n", bytesTransferred)
-
-		// Authentication metrics
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_auth_successes_total Total successful mTLS authentications\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_auth_successes_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_auth_successes_total %d\n", authSuccesses)
-
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_auth_failures_total Total failed mTLS authentications\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_auth_failures_total counter\n")
-		fmt.Fprintf(w, "marchproxy_ingress_auth_failures_total %d\n", authFailures)
-
-		// Active connections gauge
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_active_connections Current number of active connections\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_active_connections gauge\n")
-		fmt.Fprintf(w, "marchproxy_ingress_active_connections %d\n", activeConnections)
-
-		// Version information
-		fmt.Fprintf(w, "# HELP marchproxy_ingress_version_info Version information\n")
-		fmt.Fprintf(w, "# TYPE marchproxy_ingress_version_info gauge\n")
-		fmt.Fprintf(w, `marchproxy_ingress_version_info{version="%s"} 1`+"\n", version)
-
-		// eBPF metrics
-		if ebpfMgr != nil && ebpfMgr.IsEnabled() {
-			ebpfProxyStats, ebpfStats := ebpfMgr.GetStats()
-
-			fmt.Fprintf(w, "# HELP marchproxy_ingress_ebpf_enabled Whether eBPF acceleration is enabled\n")
-			fmt.Fprintf(w, "# TYPE marchproxy_ingress_ebpf_enabled gauge\n")
-			fmt.Fprintf(w, "marchproxy_ingress_ebpf_enabled %d\n", map[bool]int{true: 1, false: 0}[ebpfStats.ProgramLoaded])
-
-			fmt.Fprintf(w, "# HELP marchproxy_ingress_ebpf_total_packets Total packets processed by eBPF\n")
-			fmt.Fprintf(w, "# TYPE marchproxy_ingress_ebpf_total_packets counter\n")
-			fmt.Fprintf(w, "marchproxy_ingress_ebpf_total_packets %d\n", ebpfProxyStats.TotalPackets)
-		}
+	// Fault injection overrides for resilience testing
+	mux.HandleFunc("/admin/faults", faultsHandler(faults))
+
+	// Quota and usage per tenant
+	mux.HandleFunc("/admin/tenants", tenantsHandler(tenants))
+
+	// Backends drained for maintenance and the requests still in flight
+	mux.HandleFunc("/admin/backends/drain", drains.Handler(nil))
+
+	// Backend health and the effective weight of backends ramping up
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(backends.GetSystemHealth())
 	})
 
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Handler: adminserver.Guard(admin, mux),
 	}
 
-	fmt.Printf("Ingress admin server listening on :%d\n", port)
-	fmt.Printf("Endpoints: /healthz, /metrics\n")
-	return server.ListenAndServe()
+	fmt.Printf("Ingress admin server listening on %s\n", listener.Addr())
+	fmt.Printf("Endpoints: /healthz, /readyz, /metrics, /status, /admin/config, /admin/faults, /admin/tenants, /admin/backends/drain\n")
+	return server.Serve(listener)
 }
\ No newline at end of file
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/manager"
+	"marchproxy-shared/metering"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newMeter creates the usage meter with its sinks, nil when metering is
+// disabled or has nowhere to send records
+func newMeter(cfg *config.Config, client *manager.Client) *metering.Meter {
+	if cfg.Metering.Interval <= 0 {
+		return nil
+	}
+	proxyName, _ := os.Hostname()
+
+	var sinks []metering.Sink
+	if cfg.Metering.Upload && !client.Standalone() {
+		sinks = append(sinks, managerUsageSink{client: client, proxyName: proxyName})
+	}
+	if cfg.Metering.CSVDir != "" {
+		sink, err := metering.NewCSVSink(cfg.Metering.CSVDir)
+		if err != nil {
+			fmt.Printf("Warning: usage CSV export disabled: %v\n", err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return metering.New(redModule, proxyName, sinks...)
+}
+
+// managerUsageSink uploads usage records to the manager
+type managerUsageSink struct {
+	client    *manager.Client
+	proxyName string
+}
+
+// Name implements metering.Sink
+func (s managerUsageSink) Name() string {
+	return "manager"
+}
+
+// Write implements metering.Sink
+func (s managerUsageSink) Write(records []metering.Record) error {
+	return s.client.UploadUsage(context.Background(), s.proxyName, records)
+}
+
+// meteringCollector exports the usage record exports per sink
+type meteringCollector struct {
+	meter *metering.Meter
+}
+
+var (
+	meteringRecordsDesc = prometheus.NewDesc("marchproxy_metering_records_total",
+		"Usage records delivered per sink", []string{"sink"}, nil)
+	meteringErrorsDesc = prometheus.NewDesc("marchproxy_metering_export_errors_total",
+		"Failed usage exports per sink", []string{"sink"}, nil)
+	meteringDroppedDesc = prometheus.NewDesc("marchproxy_metering_dropped_records_total",
+		"Usage records dropped after too many failed exports per sink", []string{"sink"}, nil)
+	meteringPendingDesc = prometheus.NewDesc("marchproxy_metering_pending_records",
+		"Usage records waiting for a retry per sink", []string{"sink"}, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c meteringCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- meteringRecordsDesc
+	ch <- meteringErrorsDesc
+	ch <- meteringDroppedDesc
+	ch <- meteringPendingDesc
+}
+
+// Collect implements prometheus.Collector
+func (c meteringCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.meter.Stats() {
+		ch <- prometheus.MustNewConstMetric(meteringRecordsDesc, prometheus.CounterValue, float64(s.Written), s.Sink)
+		ch <- prometheus.MustNewConstMetric(meteringErrorsDesc, prometheus.CounterValue, float64(s.Errors), s.Sink)
+		ch <- prometheus.MustNewConstMetric(meteringDroppedDesc, prometheus.CounterValue, float64(s.Dropped), s.Sink)
+		ch <- prometheus.MustNewConstMetric(meteringPendingDesc, prometheus.GaugeValue, float64(s.Pending), s.Sink)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-ingress/internal/auth"
+	"marchproxy-ingress/internal/bot"
+	"marchproxy-ingress/internal/certs"
+	"marchproxy-ingress/internal/ebpf"
+	"marchproxy-ingress/internal/fingerprint"
+	"marchproxy-ingress/internal/guard"
+	"marchproxy-ingress/internal/ratelimit"
+	"marchproxy-ingress/internal/tickets"
+	"marchproxy-shared/fault"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RED metrics shared by every MarchProxy module. The ingress reports each
+// HTTP request with the same names and labels the other modules use for
+// their unit of work, and links latency samples to the caller's trace.
+const (
+	redModule        = "ingress"
+	redDefaultTenant = "default"
+)
+
+// redDurationBuckets are the latency bounds used by every module in seconds
+var redDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// redMetrics holds the request rate, error and duration series
+type redMetrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// newREDMetrics creates the RED series and registers them with reg
+func newREDMetrics(reg prometheus.Registerer) *redMetrics {
+	m := &redMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marchproxy_requests_total",
+			Help: "Requests handled per module, route, backend and tenant",
+		}, []string{"module", "route", "backend", "tenant"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marchproxy_request_errors_total",
+			Help: "Failed requests per module, route, backend, tenant and reason",
+		}, []string{"module", "route", "backend", "tenant", "reason"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "marchproxy_request_duration_seconds",
+			Help:    "Request latency per module, route, backend and tenant",
+			Buckets: redDurationBuckets,
+		}, []string{"module", "route", "backend", "tenant"}),
+	}
+	reg.MustRegister(m.requests, m.errors, m.duration)
+	return m
+}
+
+// observe records one request. An empty reason marks success; a non-empty
+// trace ID is attached to the latency sample as an exemplar.
+func (m *redMetrics) observe(route, backend, tenant, reason string, duration time.Duration, traceID string) {
+	if route == "" {
+		route = "none"
+	}
+	if backend == "" {
+		backend = "none"
+	}
+	if tenant == "" {
+		tenant = redDefaultTenant
+	}
+
+	m.requests.WithLabelValues(redModule, route, backend, tenant).Inc()
+	if reason != "" {
+		m.errors.WithLabelValues(redModule, route, backend, tenant, reason).Inc()
+	}
+
+	observer := m.duration.WithLabelValues(redModule, route, backend, tenant)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		exemplarObserver.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(duration.Seconds())
+}
+
+// traceIDFromRequest returns the trace ID of a W3C traceparent header
+// ("00-<32 hex trace id>-<16 hex span id>-<2 hex flags>"), or "" when the
+// header is missing or malformed
+func traceIDFromRequest(r *http.Request) string {
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ""
+	}
+
+	traceID := parts[1]
+	if len(traceID) != 32 || traceID == strings.Repeat("0", 32) {
+		return ""
+	}
+	if _, err := hex.DecodeString(traceID); err != nil {
+		return ""
+	}
+	return strings.ToLower(traceID)
+}
+
+// statusRecorder captures the status code written by the reverse proxy
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64 // Response body bytes written
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streamed responses flowing through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ingressCollector exports the atomic ingress counters on each scrape so
+// they can share a registry with the RED series
+type ingressCollector struct {
+	metrics *IngressMetrics
+	ebpfMgr *ebpf.Manager
+}
+
+var (
+	ingressHTTPRequestsDesc = prometheus.NewDesc("marchproxy_ingress_http_requests_total",
+		"Total number of HTTP requests", nil, nil)
+	ingressHTTPSRequestsDesc = prometheus.NewDesc("marchproxy_ingress_https_requests_total",
+		"Total number of HTTPS requests", nil, nil)
+	ingressRoutedRequestsDesc = prometheus.NewDesc("marchproxy_ingress_routed_requests_total",
+		"Total number of successfully routed requests", nil, nil)
+	ingressFailedRequestsDesc = prometheus.NewDesc("marchproxy_ingress_failed_requests_total",
+		"Total number of failed requests", nil, nil)
+	ingressBytesDesc = prometheus.NewDesc("marchproxy_ingress_bytes_transferred_total",
+		"Total bytes transferred", nil, nil)
+	ingressAuthSuccessesDesc = prometheus.NewDesc("marchproxy_ingress_auth_successes_total",
+		"Total successful mTLS authentications", nil, nil)
+	ingressAuthFailuresDesc = prometheus.NewDesc("marchproxy_ingress_auth_failures_total",
+		"Total failed mTLS authentications", nil, nil)
+	ingressActiveConnectionsDesc = prometheus.NewDesc("marchproxy_ingress_active_connections",
+		"Current number of active connections", nil, nil)
+	ingressVersionDesc = prometheus.NewDesc("marchproxy_ingress_version_info",
+		"Version information", nil, prometheus.Labels{"version": version})
+	ingressEBPFEnabledDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_enabled",
+		"Whether eBPF acceleration is enabled", nil, nil)
+	ingressEBPFPacketsDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_total_packets",
+		"Total packets processed by eBPF", nil, nil)
+	ingressEBPFBytesDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_total_bytes",
+		"Total bytes processed by eBPF", nil, nil)
+	ingressEBPFReadErrorsDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_stats_read_errors",
+		"Failed reads of the eBPF statistics maps", nil, nil)
+	ingressEBPFFlowCacheHitsDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_flow_cache_hits_total",
+		"Packets whose policy decision came from the eBPF flow cache", nil, nil)
+	ingressEBPFFlowCacheMissesDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_flow_cache_misses_total",
+		"Packets whose policy was decided by scanning the eBPF rules", nil, nil)
+	ingressEBPFServicePacketsDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_service_packets_total",
+		"Packets matched in eBPF per service", []string{"service"}, nil)
+	ingressEBPFServiceBytesDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_service_bytes_total",
+		"Bytes matched in eBPF per service", []string{"service"}, nil)
+	ingressEBPFMappingPacketsDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_mapping_packets_total",
+		"Packets matched in eBPF per mapping", []string{"mapping"}, nil)
+	ingressEBPFMappingBytesDesc = prometheus.NewDesc("marchproxy_ingress_ebpf_mapping_bytes_total",
+		"Bytes matched in eBPF per mapping", []string{"mapping"}, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c *ingressCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ingressHTTPRequestsDesc
+	ch <- ingressHTTPSRequestsDesc
+	ch <- ingressRoutedRequestsDesc
+	ch <- ingressFailedRequestsDesc
+	ch <- ingressBytesDesc
+	ch <- ingressAuthSuccessesDesc
+	ch <- ingressAuthFailuresDesc
+	ch <- ingressActiveConnectionsDesc
+	ch <- ingressVersionDesc
+	ch <- ingressEBPFEnabledDesc
+	ch <- ingressEBPFPacketsDesc
+	ch <- ingressEBPFBytesDesc
+	ch <- ingressEBPFReadErrorsDesc
+	ch <- ingressEBPFFlowCacheHitsDesc
+	ch <- ingressEBPFFlowCacheMissesDesc
+	ch <- ingressEBPFServicePacketsDesc
+	ch <- ingressEBPFServiceBytesDesc
+	ch <- ingressEBPFMappingPacketsDesc
+	ch <- ingressEBPFMappingBytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *ingressCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.metrics
+	ch <- prometheus.MustNewConstMetric(ingressHTTPRequestsDesc, prometheus.CounterValue, float64(m.HTTPRequests.Load()))
+	ch <- prometheus.MustNewConstMetric(ingressHTTPSRequestsDesc, prometheus.CounterValue, float64(m.HTTPSRequests.Load()))
+	ch <- prometheus.MustNewConstMetric(ingressRoutedRequestsDesc, prometheus.CounterValue, float64(m.RoutedRequests.Load()))
+	ch <- prometheus.MustNewConstMetric(ingressFailedRequestsDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&m.FailedRequests)))
+	ch <- prometheus.MustNewConstMetric(ingressBytesDesc, prometheus.CounterValue, float64(m.BytesTransferred.Load()))
+	ch <- prometheus.MustNewConstMetric(ingressAuthSuccessesDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&m.AuthSuccesses)))
+	ch <- prometheus.MustNewConstMetric(ingressAuthFailuresDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&m.AuthFailures)))
+	ch <- prometheus.MustNewConstMetric(ingressActiveConnectionsDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&m.ActiveConnections)))
+	ch <- prometheus.MustNewConstMetric(ingressVersionDesc, prometheus.GaugeValue, 1)
+
+	if c.ebpfMgr != nil && c.ebpfMgr.IsEnabled() {
+		ebpfProxyStats, ebpfStats := c.ebpfMgr.GetStats()
+		loaded := 0.0
+		if ebpfStats.ProgramLoaded {
+			loaded = 1
+		}
+		ch <- prometheus.MustNewConstMetric(ingressEBPFEnabledDesc, prometheus.GaugeValue, loaded)
+		ch <- prometheus.MustNewConstMetric(ingressEBPFPacketsDesc, prometheus.CounterValue, float64(ebpfProxyStats.TotalPackets))
+		ch <- prometheus.MustNewConstMetric(ingressEBPFBytesDesc, prometheus.CounterValue, float64(ebpfProxyStats.TotalBytes))
+		ch <- prometheus.MustNewConstMetric(ingressEBPFReadErrorsDesc, prometheus.CounterValue, float64(ebpfStats.StatsReadErrors))
+
+		if snapshot, err := c.ebpfMgr.Snapshot(); err == nil {
+			ch <- prometheus.MustNewConstMetric(ingressEBPFFlowCacheHitsDesc, prometheus.CounterValue, float64(snapshot.FlowCache.Hits))
+			ch <- prometheus.MustNewConstMetric(ingressEBPFFlowCacheMissesDesc, prometheus.CounterValue, float64(snapshot.FlowCache.Misses))
+			for id, counters := range snapshot.Services {
+				label := strconv.FormatUint(uint64(id), 10)
+				ch <- prometheus.MustNewConstMetric(ingressEBPFServicePacketsDesc, prometheus.CounterValue, float64(counters.Packets), label)
+				ch <- prometheus.MustNewConstMetric(ingressEBPFServiceBytesDesc, prometheus.CounterValue, float64(counters.Bytes), label)
+			}
+			for id, counters := range snapshot.Mappings {
+				label := strconv.FormatUint(uint64(id), 10)
+				ch <- prometheus.MustNewConstMetric(ingressEBPFMappingPacketsDesc, prometheus.CounterValue, float64(counters.Packets), label)
+				ch <- prometheus.MustNewConstMetric(ingressEBPFMappingBytesDesc, prometheus.CounterValue, float64(counters.Bytes), label)
+			}
+		}
+	}
+}
+
+// certCollector exports days to expiry of every certificate the ingress
+// has loaded, under the names the other modules use
+type certCollector struct{}
+
+var (
+	certLabels           = []string{"module", "source", "role", "subject", "serial"}
+	certDaysToExpiryDesc = prometheus.NewDesc("marchproxy_certificate_days_to_expiry",
+		"Days until a loaded certificate expires", certLabels, nil)
+	certNotAfterDesc = prometheus.NewDesc("marchproxy_certificate_not_after_timestamp_seconds",
+		"Expiry time of a loaded certificate", certLabels, nil)
+)
+
+// Describe implements prometheus.Collector
+func (certCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certDaysToExpiryDesc
+	ch <- certNotAfterDesc
+}
+
+// Collect implements prometheus.Collector
+func (certCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, entry := range certs.Default.Unique() {
+		labels := []string{redModule, entry.Source, string(entry.Role), entry.Subject, entry.Serial}
+		ch <- prometheus.MustNewConstMetric(certDaysToExpiryDesc, prometheus.GaugeValue, entry.DaysToExpiry(now), labels...)
+		ch <- prometheus.MustNewConstMetric(certNotAfterDesc, prometheus.GaugeValue, float64(entry.NotAfter.Unix()), labels...)
+	}
+}
+
+// revocationCollector exports client certificate revocation check counts
+type revocationCollector struct {
+	checker *auth.RevocationChecker
+}
+
+var (
+	revocationChecksDesc = prometheus.NewDesc("marchproxy_mtls_revocation_checks_total",
+		"Client certificate revocation checks by method and result", []string{"method", "result"}, nil)
+	revocationCacheHitsDesc = prometheus.NewDesc("marchproxy_mtls_ocsp_cache_hits_total",
+		"OCSP checks answered from the response cache", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c revocationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- revocationChecksDesc
+	ch <- revocationCacheHitsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c revocationCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, cacheHits := c.checker.Stats()
+	for _, stat := range stats {
+		ch <- prometheus.MustNewConstMetric(revocationChecksDesc, prometheus.CounterValue, float64(stat.Count), stat.Method, stat.Result)
+	}
+	ch <- prometheus.MustNewConstMetric(revocationCacheHitsDesc, prometheus.CounterValue, float64(cacheHits))
+}
+
+// ticketCollector exports TLS session resumption and ticket key rotation
+type ticketCollector struct {
+	manager *tickets.Manager
+}
+
+var (
+	ticketHandshakesDesc = prometheus.NewDesc("marchproxy_tls_handshakes_total",
+		"TLS handshakes on the HTTPS listener by whether a session was resumed", []string{"resumed"}, nil)
+	ticketRotationsDesc = prometheus.NewDesc("marchproxy_tls_session_ticket_key_rotations_total",
+		"Times the session ticket encryption key changed", nil, nil)
+	ticketRefreshFailuresDesc = prometheus.NewDesc("marchproxy_tls_session_ticket_key_refresh_failures_total",
+		"Failed fetches of shared session ticket keys from the manager", nil, nil)
+	ticketKeyAgeDesc = prometheus.NewDesc("marchproxy_tls_session_ticket_key_age_seconds",
+		"Age of the current session ticket encryption key", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c ticketCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ticketHandshakesDesc
+	ch <- ticketRotationsDesc
+	ch <- ticketRefreshFailuresDesc
+	ch <- ticketKeyAgeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c ticketCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.manager.Stats()
+	ch <- prometheus.MustNewConstMetric(ticketHandshakesDesc, prometheus.CounterValue, float64(stats.Handshakes-stats.Resumed), "false")
+	ch <- prometheus.MustNewConstMetric(ticketHandshakesDesc, prometheus.CounterValue, float64(stats.Resumed), "true")
+	ch <- prometheus.MustNewConstMetric(ticketRotationsDesc, prometheus.CounterValue, float64(stats.Rotations))
+	ch <- prometheus.MustNewConstMetric(ticketRefreshFailuresDesc, prometheus.CounterValue, float64(stats.RefreshFailures))
+	ch <- prometheus.MustNewConstMetric(ticketKeyAgeDesc, prometheus.GaugeValue, stats.KeyAge.Seconds())
+}
+
+// rateLimitCollector exports requests rejected by route rate limits
+type rateLimitCollector struct {
+	limiter *ratelimit.Limiter
+}
+
+var (
+	rateLimitedDesc = prometheus.NewDesc("marchproxy_ingress_rate_limited_total",
+		"Requests rejected by rate limits by the scope that rejected them", []string{"scope"}, nil)
+	rateLimitErrorsDesc = prometheus.NewDesc("marchproxy_ingress_rate_limit_errors_total",
+		"Rate limit store errors, where the request was let through", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c rateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateLimitedDesc
+	ch <- rateLimitErrorsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c rateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	limited, errors := c.limiter.Stats()
+	for scope, count := range limited {
+		ch <- prometheus.MustNewConstMetric(rateLimitedDesc, prometheus.CounterValue, float64(count), scope)
+	}
+	ch <- prometheus.MustNewConstMetric(rateLimitErrorsDesc, prometheus.CounterValue, float64(errors))
+}
+
+// guardCollector exports oversized request bodies and slow clients aborted
+// by the listeners
+type guardCollector struct {
+	guard *guard.Guard
+}
+
+var (
+	guardBodyTooLargeDesc = prometheus.NewDesc("marchproxy_ingress_body_too_large_total",
+		"Requests rejected for a body over the route's size limit", nil, nil)
+	guardSlowClientsDesc = prometheus.NewDesc("marchproxy_ingress_slow_clients_total",
+		"Requests aborted for sending headers or body too slowly by phase", []string{"phase"}, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c guardCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- guardBodyTooLargeDesc
+	ch <- guardSlowClientsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c guardCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.guard.Stats()
+	ch <- prometheus.MustNewConstMetric(guardBodyTooLargeDesc, prometheus.CounterValue, float64(stats.BodyTooLarge))
+	ch <- prometheus.MustNewConstMetric(guardSlowClientsDesc, prometheus.CounterValue, float64(stats.SlowHeaders), "header")
+	ch <- prometheus.MustNewConstMetric(guardSlowClientsDesc, prometheus.CounterValue, float64(stats.SlowBodies), "body")
+}
+
+// botCollector exports bot classification and the actions taken
+type botCollector struct {
+	detector *bot.Detector
+}
+
+var botRequestsDesc = prometheus.NewDesc("marchproxy_ingress_bot_requests_total",
+	"Requests on bot protected routes by client class and action taken", []string{"class", "action"}, nil)
+
+// Describe implements prometheus.Collector
+func (c botCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- botRequestsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c botCollector) Collect(ch chan<- prometheus.Metric) {
+	for class, actions := range c.detector.Stats() {
+		for action, count := range actions {
+			ch <- prometheus.MustNewConstMetric(botRequestsDesc, prometheus.CounterValue, float64(count), string(class), action)
+		}
+	}
+}
+
+// faultCollector exports the faults injected per route
+type faultCollector struct {
+	injector *fault.Injector
+}
+
+var faultsInjectedDesc = prometheus.NewDesc("marchproxy_ingress_faults_injected_total",
+	"Faults injected per route and fault type", []string{"route", "fault"}, nil)
+
+// Describe implements prometheus.Collector
+func (c faultCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- faultsInjectedDesc
+}
+
+// Collect implements prometheus.Collector
+func (c faultCollector) Collect(ch chan<- prometheus.Metric) {
+	for route, faults := range c.injector.Counts() {
+		for name, count := range faults {
+			ch <- prometheus.MustNewConstMetric(faultsInjectedDesc, prometheus.CounterValue, float64(count), route, name)
+		}
+	}
+}
+
+// fingerprintCollector exports TLS handshakes per client fingerprint
+type fingerprintCollector struct {
+	tracker *fingerprint.Tracker
+}
+
+var fingerprintHandshakesDesc = prometheus.NewDesc("marchproxy_tls_fingerprint_handshakes_total",
+	"TLS handshakes by client JA3 and JA4 fingerprint", []string{"ja3", "ja4"}, nil)
+
+// Describe implements prometheus.Collector
+func (c fingerprintCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fingerprintHandshakesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c fingerprintCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, other := c.tracker.Counts()
+	for _, count := range counts {
+		ch <- prometheus.MustNewConstMetric(fingerprintHandshakesDesc, prometheus.CounterValue, float64(count.Handshakes), count.JA3, count.JA4)
+	}
+	ch <- prometheus.MustNewConstMetric(fingerprintHandshakesDesc, prometheus.CounterValue, float64(other), "other", "other")
+}
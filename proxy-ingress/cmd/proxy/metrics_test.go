@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherSeries returns the series of the named family, keyed by route
+func gatherSeries(t *testing.T, reg *prometheus.Registry, name string) map[string]*dto.Metric {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := make(map[string]*dto.Metric)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			series[labelMap(metric)["route"]] = metric
+		}
+	}
+	return series
+}
+
+func labelMap(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range metric.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestREDMetricsSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newREDMetrics(reg)
+	m.observe("api", "10.0.0.1:8080", "acme", "", 3*time.Millisecond, "")
+	m.observe("api", "10.0.0.1:8080", "acme", "upstream_5xx", 2*time.Second, "")
+	m.observe("", "", "", "no_route", time.Millisecond, "")
+
+	requests := gatherSeries(t, reg, "marchproxy_requests_total")
+	if len(requests) != 2 {
+		t.Fatalf("%d request series, want 2", len(requests))
+	}
+	// Missing labels are filled in so every series has the same label set
+	for route, want := range map[string]map[string]string{
+		"api":  {"module": "ingress", "route": "api", "backend": "10.0.0.1:8080", "tenant": "acme"},
+		"none": {"module": "ingress", "route": "none", "backend": "none", "tenant": redDefaultTenant},
+	} {
+		labels := labelMap(requests[route])
+		if len(labels) != len(want) {
+			t.Errorf("%s labels %v, want %v", route, labels, want)
+		}
+		for label, value := range want {
+			if labels[label] != value {
+				t.Errorf("%s label %s = %q, want %q", route, label, labels[label], value)
+			}
+		}
+	}
+	if got := requests["api"].GetCounter().GetValue(); got != 2 {
+		t.Errorf("api requests %v, want 2", got)
+	}
+
+	errors := gatherSeries(t, reg, "marchproxy_request_errors_total")
+	if labels := labelMap(errors["api"]); labels["reason"] != "upstream_5xx" || errors["api"].GetCounter().GetValue() != 1 {
+		t.Errorf("api errors %v = %v", labels, errors["api"].GetCounter().GetValue())
+	}
+	if labels := labelMap(errors["none"]); labels["reason"] != "no_route" {
+		t.Errorf("unrouted errors %v", labels)
+	}
+
+	histogram := gatherSeries(t, reg, "marchproxy_request_duration_seconds")["api"].GetHistogram()
+	if histogram.GetSampleCount() != 2 {
+		t.Errorf("sample count %d, want 2", histogram.GetSampleCount())
+	}
+	buckets := histogram.GetBucket()
+	if len(buckets) != len(redDurationBuckets) {
+		t.Fatalf("%d buckets, want %d", len(buckets), len(redDurationBuckets))
+	}
+	for i, bucket := range buckets {
+		var want uint64
+		switch {
+		case redDurationBuckets[i] >= 2:
+			want = 2
+		case redDurationBuckets[i] >= 0.003:
+			want = 1
+		}
+		if bucket.GetUpperBound() != redDurationBuckets[i] || bucket.GetCumulativeCount() != want {
+			t.Errorf("bucket le=%g count %d, want le=%g count %d", bucket.GetUpperBound(), bucket.GetCumulativeCount(), redDurationBuckets[i], want)
+		}
+		if bucket.GetExemplar() != nil {
+			t.Errorf("bucket le=%g has exemplar without a trace", bucket.GetUpperBound())
+		}
+	}
+}
+
+func TestREDMetricsExemplar(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newREDMetrics(reg)
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	m.observe("api", "10.0.0.1:8080", "", "", 20*time.Millisecond, traceID)
+
+	for _, bucket := range gatherSeries(t, reg, "marchproxy_request_duration_seconds")["api"].GetHistogram().GetBucket() {
+		exemplar := bucket.GetExemplar()
+		if bucket.GetUpperBound() != 0.025 {
+			if exemplar != nil {
+				t.Errorf("bucket le=%g has exemplar %v", bucket.GetUpperBound(), exemplar)
+			}
+			continue
+		}
+		// The traced sample lands in the first bucket that holds it
+		if exemplar == nil || exemplar.GetValue() != 0.02 {
+			t.Fatalf("bucket le=0.025 exemplar %v", exemplar)
+		}
+		labels := exemplar.GetLabel()
+		if len(labels) != 1 || labels[0].GetName() != "trace_id" || labels[0].GetValue() != traceID {
+			t.Errorf("exemplar labels %v", labels)
+		}
+	}
+}
+
+func TestTraceIDFromRequest(t *testing.T) {
+	for header, want := range map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		// Later versions may append fields
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"": "",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01":  "",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736":                     "",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			req.Header.Set("traceparent", header)
+		}
+		if got := traceIDFromRequest(req); got != want {
+			t.Errorf("traceIDFromRequest(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/overload"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newShedder creates the load shedder for the ingress listeners from the
+// overload settings
+func newShedder(cfg *config.Config) (*overload.Shedder, error) {
+	o := cfg.Overload
+	minPriority, err := overload.ParsePriority(o.MinPriority)
+	if err != nil {
+		return nil, err
+	}
+	defaultPriority, err := overload.ParsePriority(o.DefaultPriority)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]overload.Rule, 0, len(o.Priorities))
+	for _, p := range o.Priorities {
+		priority, err := overload.ParsePriority(p.Priority)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, overload.Rule{Host: p.Host, PathPrefix: p.PathPrefix, Priority: priority})
+	}
+
+	exempt := make([]*net.IPNet, 0, len(o.ExemptCIDRs))
+	for _, cidr := range o.ExemptCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		exempt = append(exempt, network)
+	}
+
+	return overload.New(overload.Config{
+		MaxConnections:  o.MaxConnections,
+		MaxRequests:     o.MaxRequests,
+		CPUPercent:      o.CPUPercent,
+		HeapBytes:       uint64(o.HeapMB) * 1024 * 1024,
+		AcceptQueue:     o.AcceptQueue,
+		Interval:        o.Interval,
+		MinPriority:     minPriority,
+		DefaultPriority: defaultPriority,
+		CriticalPaths:   o.CriticalPaths,
+		Rules:           rules,
+		ExemptNets:      exempt,
+	}), nil
+}
+
+// checkOverload admits the request unless the ingress is shedding load.
+// It returns the function that ends the request, or false once a 503 has
+// been written. Shed requests also close their connection.
+func (p *IngressProxy) checkOverload(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, shed := p.shedder.Admit(r)
+	if shed != "" {
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Service overloaded", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return release, true
+}
+
+// overloadCollector exports the load the shedder sees and the connections
+// and requests it shed
+type overloadCollector struct {
+	shedder *overload.Shedder
+}
+
+var (
+	overloadInFlightDesc = prometheus.NewDesc("marchproxy_ingress_overload_in_flight",
+		"Client connections and requests in flight", []string{"kind"}, nil)
+	overloadCPUDesc = prometheus.NewDesc("marchproxy_ingress_overload_cpu_percent",
+		"Process CPU use as a share of GOMAXPROCS at the last sample", nil, nil)
+	overloadHeapDesc = prometheus.NewDesc("marchproxy_ingress_overload_heap_bytes",
+		"Live heap at the last sample", nil, nil)
+	overloadAcceptQueueDesc = prometheus.NewDesc("marchproxy_ingress_overload_accept_queue",
+		"Connections waiting to be accepted on the fullest listener at the last sample", nil, nil)
+	overloadSheddingDesc = prometheus.NewDesc("marchproxy_ingress_overload_shedding",
+		"Whether a signal is over its threshold and lower priority requests are shed", []string{"signal"}, nil)
+	overloadShedConnectionsDesc = prometheus.NewDesc("marchproxy_ingress_overload_shed_connections_total",
+		"Connections reset on accept for being over max_connections", nil, nil)
+	overloadShedRequestsDesc = prometheus.NewDesc("marchproxy_ingress_overload_shed_requests_total",
+		"Requests rejected with 503 by reason and priority", []string{"reason", "priority"}, nil)
+)
+
+// overloadSignals are the pressure signals in metric order
+var overloadSignals = []string{overload.ReasonAcceptQueue, overload.ReasonCPU, overload.ReasonHeap}
+
+// Describe implements prometheus.Collector
+func (c overloadCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- overloadInFlightDesc
+	ch <- overloadCPUDesc
+	ch <- overloadHeapDesc
+	ch <- overloadAcceptQueueDesc
+	ch <- overloadSheddingDesc
+	ch <- overloadShedConnectionsDesc
+	ch <- overloadShedRequestsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c overloadCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.shedder.Stats()
+	ch <- prometheus.MustNewConstMetric(overloadInFlightDesc, prometheus.GaugeValue, float64(stats.Connections), "connections")
+	ch <- prometheus.MustNewConstMetric(overloadInFlightDesc, prometheus.GaugeValue, float64(stats.Requests), "requests")
+	if stats.CPUPercent >= 0 {
+		ch <- prometheus.MustNewConstMetric(overloadCPUDesc, prometheus.GaugeValue, stats.CPUPercent)
+	}
+	ch <- prometheus.MustNewConstMetric(overloadHeapDesc, prometheus.GaugeValue, float64(stats.HeapBytes))
+	if stats.AcceptQueue >= 0 {
+		ch <- prometheus.MustNewConstMetric(overloadAcceptQueueDesc, prometheus.GaugeValue, float64(stats.AcceptQueue))
+	}
+	for _, signal := range overloadSignals {
+		shedding := 0.0
+		if stats.Pressure == signal {
+			shedding = 1
+		}
+		ch <- prometheus.MustNewConstMetric(overloadSheddingDesc, prometheus.GaugeValue, shedding, signal)
+	}
+	ch <- prometheus.MustNewConstMetric(overloadShedConnectionsDesc, prometheus.CounterValue, float64(stats.ShedConnections))
+	for reason, priorities := range stats.ShedRequests {
+		for priority, count := range priorities {
+			ch <- prometheus.MustNewConstMetric(overloadShedRequestsDesc, prometheus.CounterValue, float64(count), reason, priority.String())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/manager"
+	"marchproxy-ingress/internal/ratelimit"
+)
+
+// newRateLimiter creates the route rate limiter. With the redis store every
+// replica draws from the same buckets; the returned func releases the store.
+func newRateLimiter(cfg *config.Config) (*ratelimit.Limiter, func(), error) {
+	if cfg.RateLimit.Store != "redis" {
+		return ratelimit.NewLimiter(ratelimit.NewMemoryStore()), func() {}, nil
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.RateLimit.RedisAddr,
+		Password: cfg.RateLimit.RedisPassword,
+		DB:       cfg.RateLimit.RedisDB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("failed to connect to rate limit redis at %s: %w", cfg.RateLimit.RedisAddr, err)
+	}
+
+	store := ratelimit.NewRedisStore(client, cfg.RateLimit.KeyPrefix)
+	return ratelimit.NewLimiter(store), func() { store.Close() }, nil
+}
+
+// routeRateLimits returns the route wide and per client IP rules configured
+// for a route in the manager
+func routeRateLimits(route *manager.IngressRoute) (routeRule, clientRule ratelimit.Rule) {
+	if !route.RateLimitEnabled {
+		return ratelimit.Rule{}, ratelimit.Rule{}
+	}
+	routeRule = ratelimit.Rule{Rate: float64(route.RateLimitRPS), Burst: route.RateLimitBurst}
+	clientRule = ratelimit.Rule{Rate: float64(route.RateLimitClientRPS), Burst: route.RateLimitClientBurst}
+	return routeRule, clientRule
+}
+
+// checkRateLimit takes a token for the request on its route and reports
+// whether it may proceed. Rejected requests get a 429 with Retry-After.
+func (p *IngressProxy) checkRateLimit(w http.ResponseWriter, r *http.Request, route *manager.IngressRoute, routeLabel string) bool {
+	routeRule, clientRule := routeRateLimits(route)
+	res, applied := p.rateLimiter.Allow(r.Context(), routeLabel, clientIP(r), routeRule, clientRule)
+	if !applied {
+		return true
+	}
+
+	if p.config.RateLimit.Headers {
+		ratelimit.WriteHeaders(w.Header(), res)
+	} else {
+		ratelimit.WriteRetryAfter(w.Header(), res)
+	}
+	if res.Allowed {
+		return true
+	}
+
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+// clientIP returns the peer address of the request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
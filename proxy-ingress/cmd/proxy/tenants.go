@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"marchproxy-ingress/internal/manager"
+	"marchproxy-ingress/internal/tenant"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeTenant returns the tenant a route belongs to, the cluster's when
+// the manager did not tag it
+func (p *IngressProxy) routeTenant(route *manager.IngressRoute) string {
+	if route != nil && route.Tenant != "" {
+		return route.Tenant
+	}
+	return p.managerClient.GetClusterName()
+}
+
+// checkTenantQuota admits the request against its tenant's quotas. It
+// returns the function that ends the request and the response writer paced
+// by the tenant's bandwidth, or false once a 429 has been written.
+func (p *IngressProxy) checkTenantQuota(w http.ResponseWriter, tenantID string) (func(), http.ResponseWriter, bool) {
+	release, quota := p.tenants.Open(tenantID)
+	if quota != "" {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Tenant quota exceeded", http.StatusTooManyRequests)
+		return nil, w, false
+	}
+
+	if p.tenants.Quota(tenantID).BandwidthKbps > 0 {
+		w = &throttledResponseWriter{ResponseWriter: w, w: p.tenants.Writer(tenantID, w)}
+	}
+	return release, w, true
+}
+
+// tenantsHandler serves GET /admin/tenants with the quota and usage of
+// every tenant, or of one tenant with ?tenant=<id>
+func tenantsHandler(tenants *tenant.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		usage := tenants.Usage()
+		if id := r.URL.Query().Get("tenant"); id != "" {
+			filtered := usage[:0]
+			for _, u := range usage {
+				if u.Tenant == id {
+					filtered = append(filtered, u)
+				}
+			}
+			usage = filtered
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(usage)
+	}
+}
+
+// tenantCollector exports requests, bytes and quota rejections per tenant
+type tenantCollector struct {
+	limiter *tenant.Limiter
+}
+
+var (
+	tenantActiveDesc = prometheus.NewDesc("marchproxy_tenant_active_connections",
+		"Open connections per module and tenant", []string{"module", "tenant"}, nil)
+	tenantBytesDesc = prometheus.NewDesc("marchproxy_tenant_bytes_total",
+		"Bytes relayed per module and tenant", []string{"module", "tenant"}, nil)
+	tenantRejectedDesc = prometheus.NewDesc("marchproxy_tenant_rejected_total",
+		"Connections and requests rejected per module, tenant and quota", []string{"module", "tenant", "quota"}, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c tenantCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantActiveDesc
+	ch <- tenantBytesDesc
+	ch <- tenantRejectedDesc
+}
+
+// Collect implements prometheus.Collector
+func (c tenantCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, u := range c.limiter.Usage() {
+		ch <- prometheus.MustNewConstMetric(tenantActiveDesc, prometheus.GaugeValue, float64(u.Active), redModule, u.Tenant)
+		ch <- prometheus.MustNewConstMetric(tenantBytesDesc, prometheus.CounterValue, float64(u.Bytes), redModule, u.Tenant)
+		for _, quota := range []string{tenant.QuotaConnections, tenant.QuotaRequests} {
+			ch <- prometheus.MustNewConstMetric(tenantRejectedDesc, prometheus.CounterValue, float64(u.Rejected[quota]), redModule, u.Tenant, quota)
+		}
+	}
+}
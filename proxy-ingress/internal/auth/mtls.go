@@ -3,6 +3,7 @@ package auth
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -10,6 +11,8 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"marchproxy-ingress/internal/certs"
 )
 
 type MTLSAuthenticator struct {
@@ -17,6 +20,7 @@ type MTLSAuthenticator struct {
 	tlsConfig   *tls.Config
 	certPool    *x509.CertPool
 	metrics     *MTLSMetrics
+	revocation  *RevocationChecker
 	mutex       sync.RWMutex
 	initialized bool
 }
@@ -33,6 +37,8 @@ type MTLSConfig struct {
 	VerifyClient       bool
 	CRLPath            string
 	OCSPEnabled        bool
+	OCSPStapling       bool
+	RevocationFailOpen bool
 	CertExpiredGrace   time.Duration
 	MaxCertChainDepth  int
 	CustomVerifyFunc   func(*x509.Certificate) error
@@ -107,6 +113,7 @@ func (m *MTLSAuthenticator) initialize() error {
 	if err != nil {
 		return fmt.Errorf("failed to load server certificate: %w", err)
 	}
+	certs.Default.AddKeyPair("mtls", certs.RoleServer, m.config.ServerCertPath, &cert)
 
 	m.tlsConfig = &tls.Config{
 		Certificates: []tls.Certificate{cert},
@@ -137,6 +144,30 @@ func (m *MTLSAuthenticator) initialize() error {
 		m.tlsConfig.VerifyPeerCertificate = m.verifyClientCertificate
 	}
 
+	if m.config.OCSPEnabled || m.config.OCSPStapling || m.config.CRLPath != "" {
+		revocationConfig := RevocationConfig{
+			OCSPEnabled:  m.config.OCSPEnabled,
+			OCSPStapling: m.config.OCSPStapling,
+			CRLEnabled:   m.config.CRLPath != "",
+			FailOpen:     m.config.RevocationFailOpen,
+		}
+		if m.config.CRLPath != "" {
+			revocationConfig.CRLSources = []string{m.config.CRLPath}
+		}
+		m.revocation = NewRevocationChecker(revocationConfig)
+
+		if m.config.OCSPStapling {
+			getCertificate, err := m.revocation.StapleOCSP(cert)
+			if err != nil {
+				return fmt.Errorf("failed to set up OCSP stapling: %w", err)
+			}
+			m.tlsConfig.GetCertificate = getCertificate
+		}
+		if m.config.RequireClientCert && revocationConfig.Enabled() {
+			m.tlsConfig.VerifyConnection = m.verifyRevocation
+		}
+	}
+
 	m.initialized = true
 	logrus.Info("mTLS authenticator initialized successfully")
 	return nil
@@ -154,6 +185,7 @@ func (m *MTLSAuthenticator) loadClientCAs() error {
 		if !m.certPool.AppendCertsFromPEM(caCert) {
 			return fmt.Errorf("failed to parse CA certificate")
 		}
+		certs.Default.AddPEM("mtls", certs.RoleCA, m.config.ClientCAPath, caCert)
 		logrus.Infof("Loaded CA certificate from %s", m.config.ClientCAPath)
 	}
 
@@ -161,6 +193,7 @@ func (m *MTLSAuthenticator) loadClientCAs() error {
 		if !m.certPool.AppendCertsFromPEM([]byte(caData)) {
 			return fmt.Errorf("failed to parse CA certificate bundle entry %d", i)
 		}
+		certs.Default.AddPEM("mtls", certs.RoleCA, fmt.Sprintf("bundle[%d]", i), []byte(caData))
 		logrus.Infof("Loaded CA certificate from bundle entry %d", i)
 	}
 
@@ -236,6 +269,25 @@ func (m *MTLSAuthenticator) verifyClientCertificate(rawCerts [][]byte, verifiedC
 	return m.validateClientCertificate(cert, nil)
 }
 
+// verifyRevocation rejects client certificates that have been revoked, or
+// whose status is unknown when revocation checks fail closed
+func (m *MTLSAuthenticator) verifyRevocation(cs tls.ConnectionState) error {
+	err := m.revocation.VerifyConnection(cs)
+	switch {
+	case errors.Is(err, ErrCertificateRevoked):
+		m.metrics.recordRevokedCert()
+	case err != nil:
+		m.metrics.recordFailure()
+	}
+	return err
+}
+
+// GetRevocationChecker returns the revocation checker, nil when revocation
+// checking and OCSP stapling are off
+func (m *MTLSAuthenticator) GetRevocationChecker() *RevocationChecker {
+	return m.revocation
+}
+
 func (m *MTLSAuthenticator) validateClientCertificate(cert *x509.Certificate, chain []*x509.Certificate) error {
 	if time.Now().After(cert.NotAfter) {
 		if m.config.CertExpiredGrace > 0 && time.Since(cert.NotAfter) <= m.config.CertExpiredGrace {
@@ -326,8 +378,16 @@ func (m *MTLSAuthenticator) Reload() error {
 	if err != nil {
 		return fmt.Errorf("failed to reload server certificate: %w", err)
 	}
+	certs.Default.AddKeyPair("mtls", certs.RoleServer, m.config.ServerCertPath, &cert)
 
 	m.tlsConfig.Certificates = []tls.Certificate{cert}
+	if m.config.OCSPStapling && m.revocation != nil {
+		getCertificate, err := m.revocation.StapleOCSP(cert)
+		if err != nil {
+			return fmt.Errorf("failed to set up OCSP stapling: %w", err)
+		}
+		m.tlsConfig.GetCertificate = getCertificate
+	}
 
 	if m.config.RequireClientCert {
 		if err := m.loadClientCAs(); err != nil {
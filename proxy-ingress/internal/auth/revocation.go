@@ -0,0 +1,500 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation check methods and results, used as metric labels
+const (
+	RevocationOCSP = "ocsp"
+	RevocationCRL  = "crl"
+
+	RevocationGood    = "good"
+	RevocationRevoked = "revoked"
+	RevocationUnknown = "unknown" // No answer: responder or CRL unavailable
+)
+
+const (
+	defaultOCSPTimeout        = 5 * time.Second
+	defaultCRLRefreshInterval = time.Hour
+	defaultOCSPCacheTTL       = time.Hour // When a response has no NextUpdate
+	maxRevocationResponseSize = 10 << 20
+)
+
+// ErrCertificateRevoked is returned for a certificate its issuer has revoked
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+// RevocationConfig controls revocation checking of client certificates
+type RevocationConfig struct {
+	OCSPEnabled        bool          // Ask the certificate's OCSP responder
+	OCSPStapling       bool          // Staple OCSP responses to the server certificate
+	OCSPTimeout        time.Duration // Per request, for OCSP and CRL fetches
+	CRLEnabled         bool          // Check the certificate's CRL distribution points
+	CRLSources         []string      // Additional CRL URLs or file paths
+	CRLRefreshInterval time.Duration
+	FailOpen           bool // Accept certificates whose status cannot be determined
+}
+
+// Enabled reports whether any revocation check is configured
+func (c RevocationConfig) Enabled() bool {
+	return c.OCSPEnabled || c.CRLEnabled
+}
+
+// RevocationChecker checks client certificates against OCSP responders and
+// CRLs. OCSP responses are cached until their NextUpdate and CRLs are
+// refreshed in the background, so handshakes only wait on the network the
+// first time a responder or CRL is used.
+type RevocationChecker struct {
+	config RevocationConfig
+	client *http.Client
+
+	ocspResponses map[string]*ocsp.Response // keyed by issuer and serial
+	crls          map[string]*revocationList
+	mutex         sync.RWMutex
+
+	stats      map[[2]string]uint64 // method and result
+	cacheHits  uint64
+	statsMutex sync.Mutex
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// revocationList is a fetched CRL and its revoked serials
+type revocationList struct {
+	list    *x509.RevocationList
+	revoked map[string]bool
+	err     error // Last fetch error, the previous list stays in use
+}
+
+// NewRevocationChecker creates a revocation checker and starts refreshing
+// the configured CRLs
+func NewRevocationChecker(config RevocationConfig) *RevocationChecker {
+	if config.OCSPTimeout <= 0 {
+		config.OCSPTimeout = defaultOCSPTimeout
+	}
+	if config.CRLRefreshInterval <= 0 {
+		config.CRLRefreshInterval = defaultCRLRefreshInterval
+	}
+
+	rc := &RevocationChecker{
+		config:        config,
+		client:        &http.Client{Timeout: config.OCSPTimeout},
+		ocspResponses: make(map[string]*ocsp.Response),
+		crls:          make(map[string]*revocationList),
+		stats:         make(map[[2]string]uint64),
+		stopChan:      make(chan struct{}),
+	}
+
+	if config.CRLEnabled {
+		for _, source := range config.CRLSources {
+			rc.refreshCRL(source)
+		}
+		go rc.refreshLoop()
+	}
+
+	return rc
+}
+
+// Stop stops the background CRL refresh
+func (rc *RevocationChecker) Stop() {
+	rc.stopOnce.Do(func() { close(rc.stopChan) })
+}
+
+// VerifyConnection checks the verified client chain of a handshake. It is
+// meant for tls.Config.VerifyConnection.
+func (rc *RevocationChecker) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	return rc.Check(cs.VerifiedChains[0])
+}
+
+// Check checks the leaf of a verified chain. A certificate revoked by any
+// method is rejected. When no method can tell, the certificate is accepted
+// only if the checker fails open.
+func (rc *RevocationChecker) Check(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	leaf := chain[0]
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+
+	known := false
+	var failures []string
+
+	if rc.config.OCSPEnabled {
+		status, err := rc.checkOCSP(leaf, issuer)
+		rc.record(RevocationOCSP, status)
+		switch {
+		case status == RevocationRevoked:
+			return fmt.Errorf("%w: OCSP reports serial %s revoked", ErrCertificateRevoked, leaf.SerialNumber)
+		case status == RevocationGood:
+			known = true
+		case err != nil:
+			failures = append(failures, "OCSP: "+err.Error())
+		}
+	}
+
+	if rc.config.CRLEnabled {
+		status, err := rc.checkCRL(leaf, issuer)
+		rc.record(RevocationCRL, status)
+		switch {
+		case status == RevocationRevoked:
+			return fmt.Errorf("%w: serial %s is on the CRL", ErrCertificateRevoked, leaf.SerialNumber)
+		case status == RevocationGood:
+			known = true
+		case err != nil:
+			failures = append(failures, "CRL: "+err.Error())
+		}
+	}
+
+	if known || rc.config.FailOpen {
+		return nil
+	}
+	return fmt.Errorf("revocation status of %s unknown: %s", leaf.Subject, strings.Join(failures, "; "))
+}
+
+// checkOCSP asks the certificate's OCSP responder, using a cached response
+// while it is current
+func (rc *RevocationChecker) checkOCSP(leaf, issuer *x509.Certificate) (string, error) {
+	if issuer == nil {
+		return RevocationUnknown, errors.New("issuer not in chain")
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return RevocationUnknown, errors.New("no OCSP responder in certificate")
+	}
+
+	response, err := rc.ocspResponse(leaf, issuer)
+	if err != nil {
+		return RevocationUnknown, err
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+		return RevocationGood, nil
+	case ocsp.Revoked:
+		return RevocationRevoked, nil
+	}
+	return RevocationUnknown, errors.New("responder does not know the certificate")
+}
+
+// ocspResponse returns a current OCSP response for leaf, fetching a new one
+// when the cached response is missing or stale
+func (rc *RevocationChecker) ocspResponse(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	key := string(issuer.RawSubjectPublicKeyInfo) + leaf.SerialNumber.String()
+	now := time.Now()
+
+	rc.mutex.RLock()
+	cached := rc.ocspResponses[key]
+	rc.mutex.RUnlock()
+
+	if cached != nil && now.Before(ocspExpiry(cached)) {
+		rc.statsMutex.Lock()
+		rc.cacheHits++
+		rc.statsMutex.Unlock()
+		return cached, nil
+	}
+
+	response, err := rc.fetchOCSP(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.mutex.Lock()
+	rc.ocspResponses[key] = response
+	for k, r := range rc.ocspResponses {
+		if now.After(ocspExpiry(r)) {
+			delete(rc.ocspResponses, k)
+		}
+	}
+	rc.mutex.Unlock()
+
+	return response, nil
+}
+
+// fetchOCSP requests the status of leaf from its first OCSP responder
+func (rc *RevocationChecker) fetchOCSP(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+
+	resp, err := rc.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	return response, nil
+}
+
+// ocspExpiry returns when a cached OCSP response goes stale
+func ocspExpiry(response *ocsp.Response) time.Time {
+	if response.NextUpdate.IsZero() {
+		return response.ThisUpdate.Add(defaultOCSPCacheTTL)
+	}
+	return response.NextUpdate
+}
+
+// checkCRL looks leaf up in the configured CRLs and its distribution points.
+// Only CRLs signed by the leaf's issuer are used.
+func (rc *RevocationChecker) checkCRL(leaf, issuer *x509.Certificate) (string, error) {
+	sources := append(append([]string{}, rc.config.CRLSources...), leaf.CRLDistributionPoints...)
+	if len(sources) == 0 {
+		return RevocationUnknown, errors.New("no CRL configured or in certificate")
+	}
+
+	serial := leaf.SerialNumber.String()
+	var lastErr error
+	known := false
+
+	for _, source := range sources {
+		crl := rc.crl(source)
+		if crl.list == nil {
+			lastErr = crl.err
+			continue
+		}
+		if !bytes.Equal(crl.list.RawIssuer, leaf.RawIssuer) {
+			continue
+		}
+		if issuer != nil {
+			if err := crl.list.CheckSignatureFrom(issuer); err != nil {
+				lastErr = fmt.Errorf("CRL %s not signed by issuer: %w", source, err)
+				continue
+			}
+		}
+		if crl.revoked[serial] {
+			return RevocationRevoked, nil
+		}
+		known = true
+	}
+
+	if known {
+		return RevocationGood, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no CRL from the certificate's issuer")
+	}
+	return RevocationUnknown, lastErr
+}
+
+// crl returns the CRL for source, fetching it the first time the source is
+// seen. Later updates come from the refresh loop.
+func (rc *RevocationChecker) crl(source string) *revocationList {
+	rc.mutex.RLock()
+	crl, exists := rc.crls[source]
+	rc.mutex.RUnlock()
+
+	if exists {
+		return crl
+	}
+	return rc.refreshCRL(source)
+}
+
+// refreshCRL fetches source and replaces the stored CRL. On failure the
+// previous CRL stays in use until it passes its NextUpdate.
+func (rc *RevocationChecker) refreshCRL(source string) *revocationList {
+	list, err := rc.fetchCRL(source)
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if err != nil {
+		logrus.Warnf("Failed to refresh CRL %s: %v", source, err)
+		previous := rc.crls[source]
+		crl := &revocationList{err: err}
+		if previous != nil && previous.list != nil && (previous.list.NextUpdate.IsZero() || time.Now().Before(previous.list.NextUpdate)) {
+			crl.list, crl.revoked = previous.list, previous.revoked
+		}
+		rc.crls[source] = crl
+		return crl
+	}
+
+	crl := &revocationList{list: list, revoked: make(map[string]bool, len(list.RevokedCertificateEntries))}
+	for _, entry := range list.RevokedCertificateEntries {
+		crl.revoked[entry.SerialNumber.String()] = true
+	}
+	rc.crls[source] = crl
+	return crl
+}
+
+// fetchCRL reads a CRL from an http(s) URL or a file, DER or PEM encoded
+func (rc *RevocationChecker) fetchCRL(source string) (*x509.RevocationList, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := rc.client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("CRL server returned %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+// refreshLoop refetches every known CRL on the refresh interval
+func (rc *RevocationChecker) refreshLoop() {
+	ticker := time.NewTicker(rc.config.CRLRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rc.stopChan:
+			return
+		case <-ticker.C:
+			rc.mutex.RLock()
+			sources := make([]string, 0, len(rc.crls))
+			for source := range rc.crls {
+				sources = append(sources, source)
+			}
+			rc.mutex.RUnlock()
+
+			for _, source := range sources {
+				rc.refreshCRL(source)
+			}
+		}
+	}
+}
+
+// StapleOCSP returns a GetCertificate callback serving cert with a current
+// OCSP response stapled. The response is refreshed in the background once
+// half of its validity has passed; without one the certificate is served
+// unstapled.
+func (rc *RevocationChecker) StapleOCSP(cert tls.Certificate) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("OCSP stapling needs the issuer in the certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("no OCSP responder in server certificate")
+	}
+
+	var (
+		current    = &cert
+		refreshAt  time.Time
+		refreshing bool
+		mutex      sync.Mutex
+	)
+
+	refresh := func() {
+		response, err := rc.fetchOCSP(leaf, issuer)
+		if err == nil && response.Status != ocsp.Good {
+			err = fmt.Errorf("responder reports status %d", response.Status)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		refreshing = false
+
+		if err != nil {
+			logrus.Warnf("Failed to refresh OCSP staple for %s: %v", leaf.Subject, err)
+			refreshAt = time.Now().Add(time.Minute)
+			return
+		}
+
+		stapled := *current
+		stapled.OCSPStaple = response.Raw
+		current = &stapled
+		refreshAt = response.ThisUpdate.Add(ocspExpiry(response).Sub(response.ThisUpdate) / 2)
+	}
+
+	refresh()
+
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if !refreshing && time.Now().After(refreshAt) {
+			refreshing = true
+			go refresh()
+		}
+		return current, nil
+	}, nil
+}
+
+// record counts a check result
+func (rc *RevocationChecker) record(method, result string) {
+	rc.statsMutex.Lock()
+	defer rc.statsMutex.Unlock()
+	rc.stats[[2]string{method, result}]++
+}
+
+// RevocationStat is the number of checks by one method with one result
+type RevocationStat struct {
+	Method string
+	Result string
+	Count  uint64
+}
+
+// Stats returns the check counts by method and result, and the number of
+// checks answered from the OCSP cache
+func (rc *RevocationChecker) Stats() ([]RevocationStat, uint64) {
+	rc.statsMutex.Lock()
+	defer rc.statsMutex.Unlock()
+
+	stats := make([]RevocationStat, 0, len(rc.stats))
+	for key, count := range rc.stats {
+		stats = append(stats, RevocationStat{Method: key[0], Result: key[1], Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Method != stats[j].Method {
+			return stats[i].Method < stats[j].Method
+		}
+		return stats[i].Result < stats[j].Result
+	})
+	return stats, rc.cacheHits
+}
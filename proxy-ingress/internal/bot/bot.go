@@ -0,0 +1,287 @@
+// Package bot classifies ingress clients as browsers, good bots or bad bots
+// from their User-Agent and TLS fingerprint, and applies the route's action
+// to bad bots: allow, tarpit, block or a JavaScript cookie challenge.
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Class of a client
+type Class string
+
+const (
+	ClassHuman   Class = "human"
+	ClassGoodBot Class = "good_bot"
+	ClassBadBot  Class = "bad_bot"
+)
+
+// Action taken on bad bots
+type Action string
+
+const (
+	ActionAllow     Action = "allow"
+	ActionTarpit    Action = "tarpit"
+	ActionBlock     Action = "block"
+	ActionChallenge Action = "challenge"
+)
+
+// ParseAction validates an action name, where empty means challenge
+func ParseAction(name string) (Action, error) {
+	switch action := Action(strings.ToLower(name)); action {
+	case "":
+		return ActionChallenge, nil
+	case ActionAllow, ActionTarpit, ActionBlock, ActionChallenge:
+		return action, nil
+	default:
+		return "", fmt.Errorf("invalid bot action: %s", name)
+	}
+}
+
+// outcomeChallengePassed is counted for bad bots let through by a token
+const outcomeChallengePassed = "challenge_passed"
+
+// ChallengeCookie holds the token a client gets by passing the challenge
+const ChallengeCookie = "marchproxy_bot_check"
+
+// Config holds the classification lists and action settings
+type Config struct {
+	GoodBots         []string // User-Agent substrings of allowed crawlers
+	BadUserAgents    []string // User-Agent substrings of bad bots and tools
+	GoodFingerprints []string // JA3 hashes or JA4 fingerprints always treated as human
+	BadFingerprints  []string // JA3 hashes or JA4 fingerprints of bad bots
+	TarpitDelay      time.Duration
+	ChallengeSecret  string        // Shared by replicas so tokens work on all of them
+	ChallengeTTL     time.Duration // How long a passed challenge lasts
+}
+
+// Detector classifies requests and applies actions
+type Detector struct {
+	config           Config
+	secret           []byte
+	goodBots         []string
+	badUserAgents    []string
+	goodFingerprints map[string]bool
+	badFingerprints  map[string]bool
+
+	mu     sync.Mutex
+	counts map[Class]map[string]uint64 // by class and action or outcome
+
+	now func() time.Time
+}
+
+// NewDetector creates a detector. Without a challenge secret a random one
+// is used, so challenge tokens only work on this replica.
+func NewDetector(config Config) (*Detector, error) {
+	secret := []byte(config.ChallengeSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate challenge secret: %w", err)
+		}
+	}
+	if config.ChallengeTTL <= 0 {
+		config.ChallengeTTL = time.Hour
+	}
+
+	return &Detector{
+		config:           config,
+		secret:           secret,
+		goodBots:         lower(config.GoodBots),
+		badUserAgents:    lower(config.BadUserAgents),
+		goodFingerprints: set(config.GoodFingerprints),
+		badFingerprints:  set(config.BadFingerprints),
+		counts:           make(map[Class]map[string]uint64),
+		now:              time.Now,
+	}, nil
+}
+
+func lower(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func set(values []string) map[string]bool {
+	out := make(map[string]bool, len(values))
+	for _, v := range lower(values) {
+		out[v] = true
+	}
+	return out
+}
+
+// Classify classifies a request from its User-Agent and the client's TLS
+// fingerprints, none for plain HTTP. Fingerprints win over the User-Agent,
+// which clients can set freely.
+func (d *Detector) Classify(r *http.Request, fingerprints ...string) Class {
+	for _, fp := range fingerprints {
+		fp = strings.ToLower(fp)
+		if d.goodFingerprints[fp] {
+			return ClassHuman
+		}
+		if d.badFingerprints[fp] {
+			return ClassBadBot
+		}
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return ClassBadBot
+	}
+	for _, pattern := range d.goodBots {
+		if strings.Contains(ua, pattern) {
+			return ClassGoodBot
+		}
+	}
+	for _, pattern := range d.badUserAgents {
+		if strings.Contains(ua, pattern) {
+			return ClassBadBot
+		}
+	}
+	return ClassHuman
+}
+
+// Handle classifies the request and applies action to bad bots. It reports
+// whether the request may proceed; when it may not, the response has been
+// written.
+func (d *Detector) Handle(w http.ResponseWriter, r *http.Request, action Action, fingerprints ...string) bool {
+	class := d.Classify(r, fingerprints...)
+	if class != ClassBadBot {
+		d.count(class, string(ActionAllow))
+		return true
+	}
+
+	switch action {
+	case ActionBlock:
+		d.count(class, string(action))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+
+	case ActionTarpit:
+		d.count(class, string(action))
+		select {
+		case <-time.After(d.config.TarpitDelay):
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+
+	case ActionChallenge:
+		if d.validToken(r) {
+			d.count(class, outcomeChallengePassed)
+			return true
+		}
+		d.count(class, string(action))
+		d.writeChallenge(w, r)
+		return false
+
+	default:
+		d.count(class, string(ActionAllow))
+		return true
+	}
+}
+
+func (d *Detector) count(class Class, outcome string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.counts[class] == nil {
+		d.counts[class] = make(map[string]uint64)
+	}
+	d.counts[class][outcome]++
+}
+
+// Stats returns requests by class and the action taken, with
+// "challenge_passed" for bad bots let through by a valid token
+func (d *Detector) Stats() map[Class]map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[Class]map[string]uint64, len(d.counts))
+	for class, outcomes := range d.counts {
+		out[class] = make(map[string]uint64, len(outcomes))
+		for outcome, count := range outcomes {
+			out[class][outcome] = count
+		}
+	}
+	return out
+}
+
+// token signs an expiry for the client's address and User-Agent
+func (d *Detector) token(r *http.Request, expires int64) string {
+	mac := hmac.New(sha256.New, d.secret)
+	fmt.Fprintf(mac, "%d|%s|%s", expires, clientIP(r), r.UserAgent())
+	return strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Detector) validToken(r *http.Request) bool {
+	cookie, err := r.Cookie(ChallengeCookie)
+	if err != nil {
+		return false
+	}
+	expiresText, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresText, 10, 64)
+	if err != nil || d.now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(d.token(r, expires)))
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body>
+<noscript>Please enable JavaScript to continue.</noscript>
+<script>
+document.cookie = {{.Cookie}} + "=" + {{.Token}} + "; path=/; max-age=" + {{.MaxAge}} + "; SameSite=Lax";
+window.location.reload();
+</script>
+</body>
+</html>
+`))
+
+// writeChallenge serves a page whose script stores a signed token in a
+// cookie and reloads, which clients without JavaScript never do
+func (d *Detector) writeChallenge(w http.ResponseWriter, r *http.Request) {
+	expires := d.now().Add(d.config.ChallengeTTL).Unix()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+
+	err := challengePage.Execute(w, map[string]interface{}{
+		"Cookie": ChallengeCookie,
+		"Token":  d.token(r, expires),
+		"MaxAge": int(d.config.ChallengeTTL.Seconds()),
+	})
+	if err != nil {
+		logrus.Debugf("Failed to write bot challenge: %v", err)
+	}
+}
+
+// clientIP returns the peer address of the request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
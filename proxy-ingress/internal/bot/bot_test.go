@@ -0,0 +1,116 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newTestDetector(t *testing.T) *Detector {
+	t.Helper()
+	d, err := NewDetector(Config{
+		GoodBots:         []string{"Googlebot"},
+		BadUserAgents:    []string{"python-requests", "sqlmap"},
+		BadFingerprints:  []string{"e7d705a3286e19ea42f587b344ee6865"},
+		GoodFingerprints: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		ChallengeSecret:  "secret",
+		ChallengeTTL:     time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create detector: %v", err)
+	}
+	return d
+}
+
+func request(ua string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.10:40000"
+	r.Header.Set("User-Agent", ua)
+	return r
+}
+
+func TestClassify(t *testing.T) {
+	d := newTestDetector(t)
+	browser := "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"
+
+	cases := []struct {
+		ua, ja3 string
+		want    Class
+	}{
+		{browser, "", ClassHuman},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1)", "", ClassGoodBot},
+		{"python-requests/2.31", "", ClassBadBot},
+		{"", "", ClassBadBot},
+		{browser, "E7D705A3286E19EA42F587B344EE6865", ClassBadBot},
+		{"python-requests/2.31", "t13d1516h2_8daaf6152771_e5627efa2ab1", ClassHuman},
+	}
+	for _, c := range cases {
+		if got := d.Classify(request(c.ua), c.ja3); got != c.want {
+			t.Errorf("Classify(%q, %q) = %s, want %s", c.ua, c.ja3, got, c.want)
+		}
+	}
+}
+
+func TestBlockAndTarpit(t *testing.T) {
+	d := newTestDetector(t)
+	d.config.TarpitDelay = 20 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	if d.Handle(w, request("sqlmap/1.7"), ActionBlock) || w.Code != http.StatusForbidden {
+		t.Errorf("Expected a blocked request, got %d", w.Code)
+	}
+
+	start := time.Now()
+	if !d.Handle(httptest.NewRecorder(), request("sqlmap/1.7"), ActionTarpit) {
+		t.Error("Expected a tarpitted request to proceed")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected the tarpit to delay the request")
+	}
+
+	if !d.Handle(httptest.NewRecorder(), request("Mozilla/5.0"), ActionBlock) {
+		t.Error("Expected a browser to pass")
+	}
+
+	stats := d.Stats()
+	if stats[ClassBadBot]["block"] != 1 || stats[ClassBadBot]["tarpit"] != 1 || stats[ClassHuman]["allow"] != 1 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestChallengeToken(t *testing.T) {
+	d := newTestDetector(t)
+	ua := "python-requests/2.31"
+
+	w := httptest.NewRecorder()
+	if d.Handle(w, request(ua), ActionChallenge) {
+		t.Fatal("Expected a challenge")
+	}
+	match := regexp.MustCompile(`"(\d+\.[0-9a-f]+)"`).FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("No token in challenge page:\n%s", w.Body.String())
+	}
+
+	r := request(ua)
+	r.AddCookie(&http.Cookie{Name: ChallengeCookie, Value: match[1]})
+	if !d.Handle(httptest.NewRecorder(), r, ActionChallenge) {
+		t.Error("Expected the token to pass the challenge")
+	}
+
+	// The token is bound to the client address
+	r = request(ua)
+	r.RemoteAddr = "192.0.2.11:40000"
+	r.AddCookie(&http.Cookie{Name: ChallengeCookie, Value: match[1]})
+	if d.Handle(httptest.NewRecorder(), r, ActionChallenge) {
+		t.Error("Expected the token to fail from another address")
+	}
+
+	d.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	r = request(ua)
+	r.AddCookie(&http.Cookie{Name: ChallengeCookie, Value: match[1]})
+	if d.Handle(httptest.NewRecorder(), r, ActionChallenge) {
+		t.Error("Expected an expired token to fail")
+	}
+}
@@ -2,29 +2,41 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
+	"marchproxy-ingress/internal/overload"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/netutil"
+	"marchproxy-shared/schedule"
+
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
 	ProxyType    string `mapstructure:"proxy_type"`
 	Host         string `mapstructure:"host"`
+	BindInterface string `mapstructure:"bind_interface"` // Interface or VRF device for listeners (Linux only)
 	Port         int    `mapstructure:"port"`
 	TLSPort      int    `mapstructure:"tls_port"`
 	MetricsPort  int    `mapstructure:"metrics_port"`
+	EnableMetrics bool  `mapstructure:"enable_metrics"` // Serve the admin port with /metrics and health endpoints
 	HealthPort   int    `mapstructure:"health_port"`
 	LogLevel     string `mapstructure:"log_level"`
 	LogPath      string `mapstructure:"log_path"`
 	ConfigPath   string `mapstructure:"config_path"`
 	CertPath     string `mapstructure:"cert_path"`
 
+	// Admin server authentication, TLS and binding
+	Admin adminserver.Config `mapstructure:"admin"`
+
 	EnableEBPF       bool   `mapstructure:"enable_ebpf"`
 	EnableXDP        bool   `mapstructure:"enable_xdp"`
 	XDPInterface     string `mapstructure:"xdp_interface"`
@@ -40,6 +52,26 @@ type Config struct {
 	MTLSServerKeyPath    string `mapstructure:"mtls_server_key_path"`
 	MTLSClientCAPath     string `mapstructure:"mtls_client_ca_path"`
 
+	// Client certificate revocation checking
+	MTLSRevocation struct {
+		OCSPEnabled        bool          `mapstructure:"ocsp_enabled"`
+		OCSPStapling       bool          `mapstructure:"ocsp_stapling"` // Staple OCSP responses to the server certificate
+		OCSPTimeout        time.Duration `mapstructure:"ocsp_timeout"`  // Per OCSP or CRL fetch
+		CRLEnabled         bool          `mapstructure:"crl_enabled"`
+		CRLSources         []string      `mapstructure:"crl_sources"` // CRL URLs or files besides distribution points
+		CRLRefreshInterval time.Duration `mapstructure:"crl_refresh_interval"`
+		FailOpen           bool          `mapstructure:"fail_open"` // Accept certificates whose status is unknown
+	} `mapstructure:"mtls_revocation"`
+
+	// TLS session ticket key rotation for the HTTPS listener
+	SessionTickets struct {
+		Enabled          bool          `mapstructure:"enabled"`
+		Shared           bool          `mapstructure:"shared"` // Fetch keys from the manager so replicas resume each other's sessions
+		RotationInterval time.Duration `mapstructure:"rotation_interval"`
+		RefreshInterval  time.Duration `mapstructure:"refresh_interval"` // How often shared keys are fetched
+		KeyCount         int           `mapstructure:"key_count"`        // Local keys kept for decryption
+	} `mapstructure:"session_tickets"`
+
 	Manager struct {
 		URL        string `mapstructure:"url"`
 		APIKey     string `mapstructure:"api_key"`
@@ -47,12 +79,25 @@ type Config struct {
 		ClusterID  string `mapstructure:"cluster_id"`
 		RetryCount int    `mapstructure:"retry_count"`
 		Timeout    int    `mapstructure:"timeout"`
+
+		RefreshInterval   time.Duration `mapstructure:"refresh_interval"`   // How often the configuration is fetched
+		HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"` // How often health is reported
+
+		// Local cluster config file (YAML or JSON) used instead of the
+		// manager, for tests and demos
+		StandaloneConfig string `mapstructure:"standalone_config"`
 	} `mapstructure:"manager"`
 
 	RateLimit struct {
-		RequestsPerSecond int `mapstructure:"requests_per_second"`
-		BurstSize         int `mapstructure:"burst_size"`
-		MaxConnections    int `mapstructure:"max_connections"`
+		RequestsPerSecond int    `mapstructure:"requests_per_second"`
+		BurstSize         int    `mapstructure:"burst_size"`
+		MaxConnections    int    `mapstructure:"max_connections"`
+		Headers           bool   `mapstructure:"headers"` // Send X-RateLimit-* headers on limited routes
+		Store             string `mapstructure:"store"`   // "memory" or "redis" to share buckets across replicas
+		RedisAddr         string `mapstructure:"redis_addr"`
+		RedisPassword     string `mapstructure:"redis_password"`
+		RedisDB           int    `mapstructure:"redis_db"`
+		KeyPrefix         string `mapstructure:"key_prefix"`
 	} `mapstructure:"rate_limit"`
 
 	LoadBalancing struct {
@@ -78,6 +123,110 @@ type Config struct {
 		MaxRequestSize       int64    `mapstructure:"max_request_size"`
 		TimeoutSeconds       int      `mapstructure:"timeout_seconds"`
 	} `mapstructure:"security"`
+
+	// Timeouts and slow client protection for the HTTP and HTTPS listeners
+	Listener struct {
+		ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+		ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+		WriteTimeout      time.Duration `mapstructure:"write_timeout"` // 0 for long-lived streaming responses
+		IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+		MaxHeaderBytes    int           `mapstructure:"max_header_bytes"`
+		MinBodyRate       int64         `mapstructure:"min_body_rate"` // Bytes per second, 0 disables
+		BodyRateGrace     time.Duration `mapstructure:"body_rate_grace"`
+	} `mapstructure:"listener"`
+
+	// Bot classification for routes with bot protection enabled
+	Bot struct {
+		GoodBots         []string      `mapstructure:"good_bots"`       // User-Agent substrings of allowed crawlers
+		BadUserAgents    []string      `mapstructure:"bad_user_agents"` // User-Agent substrings of bots and attack tools
+		GoodFingerprints []string      `mapstructure:"good_fingerprints"`
+		BadFingerprints  []string      `mapstructure:"bad_fingerprints"` // JA3 hashes
+		TarpitDelay      time.Duration `mapstructure:"tarpit_delay"`
+		ChallengeSecret  string        `mapstructure:"challenge_secret"` // Same on every replica
+		ChallengeTTL     time.Duration `mapstructure:"challenge_ttl"`
+	} `mapstructure:"bot"`
+
+	// Route fault specs and /admin/faults overrides, for resilience testing only
+	FaultInjection struct {
+		Enabled bool `mapstructure:"enabled"`
+	} `mapstructure:"fault_injection"`
+
+	// JA3/JA4 fingerprints of TLS clients
+	TLSFingerprint struct {
+		MaxTracked int `mapstructure:"max_tracked"` // Distinct fingerprints in metrics
+	} `mapstructure:"tls_fingerprint"`
+
+	// Route schedules, evaluated with this proxy's clock
+	Schedule struct {
+		ClockSkew time.Duration `mapstructure:"clock_skew"` // Tolerated at window and validity edges
+	} `mapstructure:"schedule"`
+
+	// Usage metering per tenant and backend for chargeback
+	Metering struct {
+		Interval time.Duration `mapstructure:"interval"` // Period of each usage record, 0 disables
+		Upload   bool          `mapstructure:"upload"`   // Upload records to the manager
+		CSVDir   string        `mapstructure:"csv_dir"`  // Also append records to daily CSV files here
+	} `mapstructure:"metering"`
+
+	// Enterprise feature entitlements fetched from the manager
+	License struct {
+		RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+		GracePeriod     time.Duration `mapstructure:"grace_period"` // Cached entitlements outlive an unreachable manager this long
+		CacheFile       string        `mapstructure:"cache_file"`   // Keep entitlements here across restarts
+	} `mapstructure:"license"`
+
+	// Load shedding: connection and request limits, and shedding of lower
+	// priority requests while CPU, heap or the accept queue is over its
+	// threshold
+	Overload struct {
+		MaxConnections  int                `mapstructure:"max_connections"` // 0 for no limit
+		MaxRequests     int                `mapstructure:"max_requests"`    // In flight below critical priority, 0 for no limit
+		CPUPercent      float64            `mapstructure:"cpu_percent"`     // Share of GOMAXPROCS, 0 disables
+		HeapMB          int                `mapstructure:"heap_mb"`         // 0 disables
+		AcceptQueue     int                `mapstructure:"accept_queue"`    // Connections waiting to be accepted, 0 disables
+		Interval        time.Duration      `mapstructure:"interval"`
+		MinPriority     string             `mapstructure:"min_priority"` // Lowest priority still served under pressure
+		DefaultPriority string             `mapstructure:"default_priority"`
+		CriticalPaths   []string           `mapstructure:"critical_paths"` // Never shed, for health checks
+		Priorities      []OverloadPriority `mapstructure:"priorities"`
+		ExemptCIDRs     []string           `mapstructure:"exempt_cidrs"` // Clients never refused by max_connections
+	} `mapstructure:"overload"`
+
+	// Hitless upgrades hand the listeners to a new binary over this Unix
+	// socket
+	Upgrade struct {
+		Socket  string        `mapstructure:"socket"` // Empty disables upgrades
+		Timeout time.Duration `mapstructure:"timeout"`
+	} `mapstructure:"upgrade"`
+
+	HealthCheck struct {
+		Interval         time.Duration `mapstructure:"interval"`
+		Checks           []string      `mapstructure:"checks"`
+		PassiveThreshold int           `mapstructure:"passive_threshold"` // Live traffic failures that eject a backend, 0 disables
+		PassiveWindow    time.Duration `mapstructure:"passive_window"`
+
+		// Added and recovered backends ramp up to their weight over
+		// SlowStartWindow instead of taking a full share at once
+		SlowStartWindow    time.Duration `mapstructure:"slow_start_window"` // 0 disables slow-start
+		SlowStartCurve     string        `mapstructure:"slow_start_curve"`  // linear or exponential
+		SlowStartMinWeight float64       `mapstructure:"slow_start_min_weight"`
+	} `mapstructure:"health_check"`
+
+	// Same-zone backend preference. Requests go to backends in the proxy's
+	// zone, then its region, spilling farther only while too little of the
+	// nearer locality's weight is healthy and warm.
+	Locality struct {
+		Zone           string  `mapstructure:"zone"`
+		Region         string  `mapstructure:"region"`          // Locality routing is off without a zone or region
+		SpillThreshold float64 `mapstructure:"spill_threshold"` // Available share of a locality's weight below which requests spill, above 0 and at most 1
+	} `mapstructure:"locality"`
+
+	// Read-only SNMPv2c agent serving MARCHPROXY-MIB, for monitoring
+	// without Prometheus
+	SNMP struct {
+		Listen    string `mapstructure:"listen"` // UDP host:port, empty disables
+		Community string `mapstructure:"community"`
+	} `mapstructure:"snmp"`
 }
 
 type RoutingRule struct {
@@ -87,30 +236,53 @@ type RoutingRule struct {
 	Priority int    `mapstructure:"priority"`
 }
 
-func LoadConfig() (*Config, error) {
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("/app/configs")
-	viper.AddConfigPath("./configs")
-	viper.AddConfigPath(".")
-
-	viper.SetEnvPrefix("PROXY")
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+// OverloadPriority sets the shedding priority of requests for a host and
+// path prefix
+type OverloadPriority struct {
+	Host       string `mapstructure:"host"` // Empty for every host
+	PathPrefix string `mapstructure:"path_prefix"`
+	Priority   string `mapstructure:"priority"` // low, normal, high or critical
+}
 
-	setDefaults()
+// Load loads configuration from defaults, the config file, PROXY_*
+// environment variables and command line flags, each overriding the one
+// before. Without --config, config.yaml is read from /app/configs,
+// ./configs or the working directory when there is one.
+func Load(cmd *cobra.Command) (*Config, error) {
+	l := layers.New("PROXY")
+	v := l.Viper()
+	setDefaults(v)
+
+	if err := bindFlags(l, cmd); err != nil {
+		return nil, fmt.Errorf("failed to bind flags: %w", err)
+	}
+	if err := l.ApplySet(cmd.Flags()); err != nil {
+		return nil, err
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			logrus.Warn("Config file not found, using defaults and environment variables")
-		} else {
+	configFile, _ := cmd.Flags().GetString("config")
+	if configFile != "" {
+		if err := l.ReadFile(configFile); err != nil {
 			return nil, fmt.Errorf("error reading config file: %w", err)
 		}
+	} else {
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+		v.AddConfigPath("/app/configs")
+		v.AddConfigPath("./configs")
+		v.AddConfigPath(".")
+		if err := v.ReadInConfig(); err != nil {
+			if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+				logrus.Warn("Config file not found, using defaults and environment variables")
+			} else {
+				return nil, fmt.Errorf("error reading config file: %w", err)
+			}
+		}
 	}
 
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
-		return nil, fmt.Errorf("error unmarshaling config: %w", err)
+	if err := l.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	if err := validateConfig(&config); err != nil {
@@ -120,56 +292,168 @@ func LoadConfig() (*Config, error) {
 	return &config, nil
 }
 
-func setDefaults() {
-	viper.SetDefault("proxy_type", "ingress")
-	viper.SetDefault("host", "0.0.0.0")
-	viper.SetDefault("port", 80)
-	viper.SetDefault("tls_port", 443)
-	viper.SetDefault("metrics_port", 8082)
-	viper.SetDefault("health_port", 8083)
-	viper.SetDefault("log_level", "info")
-	viper.SetDefault("log_path", "/app/logs")
-	viper.SetDefault("config_path", "/app/configs")
-	viper.SetDefault("cert_path", "/app/certs")
-
-	viper.SetDefault("enable_ebpf", true)
-	viper.SetDefault("enable_xdp", false)
-	viper.SetDefault("xdp_interface", "eth0")
-	viper.SetDefault("enable_dpdk", false)
-	viper.SetDefault("enable_af_xdp", false)
-	viper.SetDefault("enable_sriov", false)
-	viper.SetDefault("hardware_offload", false)
-
-	viper.SetDefault("mtls_enabled", getEnvBool("MTLS_ENABLED", true))
-	viper.SetDefault("mtls_require_client_cert", true)
-	viper.SetDefault("mtls_server_cert_path", getEnv("MTLS_SERVER_CERT_PATH", "/app/certs/ingress-server.crt"))
-	viper.SetDefault("mtls_server_key_path", getEnv("MTLS_SERVER_KEY_PATH", "/app/certs/ingress-server.key"))
-	viper.SetDefault("mtls_client_ca_path", getEnv("MTLS_CLIENT_CA_PATH", "/app/certs/client-ca-bundle.crt"))
-
-	viper.SetDefault("manager.url", getEnv("MANAGER_URL", "http://manager:8000"))
-	viper.SetDefault("manager.api_key", getEnv("CLUSTER_API_KEY", ""))
-	viper.SetDefault("manager.proxy_id", getEnv("PROXY_ID", ""))
-	viper.SetDefault("manager.cluster_id", getEnv("CLUSTER_ID", "default"))
-	viper.SetDefault("manager.retry_count", 3)
-	viper.SetDefault("manager.timeout", 30)
-
-	viper.SetDefault("rate_limit.requests_per_second", 1000)
-	viper.SetDefault("rate_limit.burst_size", 2000)
-	viper.SetDefault("rate_limit.max_connections", 10000)
-
-	viper.SetDefault("load_balancing.algorithm", "round_robin")
-	viper.SetDefault("load_balancing.backends", []string{})
-
-	viper.SetDefault("cache.enabled", true)
-	viper.SetDefault("cache.ttl", 300)
-	viper.SetDefault("cache.max_size", 1000)
-	viper.SetDefault("cache.max_memory", 100)
-
-	viper.SetDefault("security.enable_ddos_protection", true)
-	viper.SetDefault("security.allowed_ips", []string{})
-	viper.SetDefault("security.blocked_ips", []string{})
-	viper.SetDefault("security.max_request_size", 10*1024*1024)
-	viper.SetDefault("security.timeout_seconds", 30)
+// bindFlags lets command line flags override their config keys
+func bindFlags(l *layers.Layers, cmd *cobra.Command) error {
+	flagBindings := map[string]string{
+		"manager-url":     "manager.url",
+		"cluster-api-key": "manager.api_key",
+		"listen-port":     "port",
+		"tls-port":        "tls_port",
+		"admin-port":      "metrics_port",
+		"log-level":       "log_level",
+		"enable-ebpf":     "enable_ebpf",
+		"enable-mtls":     "mtls_enabled",
+		"enable-metrics":  "enable_metrics",
+	}
+
+	for flag, configKey := range flagBindings {
+		if err := l.BindFlag(configKey, cmd.Flags().Lookup(flag)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("proxy_type", "ingress")
+	v.SetDefault("host", "0.0.0.0")
+	v.SetDefault("bind_interface", getEnv("BIND_INTERFACE", ""))
+	v.SetDefault("port", 80)
+	v.SetDefault("tls_port", 443)
+	v.SetDefault("metrics_port", 8082)
+	v.SetDefault("enable_metrics", true)
+	v.SetDefault("health_port", 8083)
+	v.SetDefault("log_level", "info")
+	v.SetDefault("log_path", "/app/logs")
+	v.SetDefault("config_path", "/app/configs")
+	v.SetDefault("cert_path", "/app/certs")
+
+	v.SetDefault("enable_ebpf", true)
+	v.SetDefault("enable_xdp", false)
+	v.SetDefault("xdp_interface", "eth0")
+	v.SetDefault("enable_dpdk", false)
+	v.SetDefault("enable_af_xdp", false)
+	v.SetDefault("enable_sriov", false)
+	v.SetDefault("hardware_offload", false)
+
+	v.SetDefault("mtls_enabled", getEnvBool("MTLS_ENABLED", true))
+	v.SetDefault("mtls_require_client_cert", true)
+	v.SetDefault("mtls_server_cert_path", getEnv("MTLS_SERVER_CERT_PATH", "/app/certs/ingress-server.crt"))
+	v.SetDefault("mtls_server_key_path", getEnv("MTLS_SERVER_KEY_PATH", "/app/certs/ingress-server.key"))
+	v.SetDefault("mtls_client_ca_path", getEnv("MTLS_CLIENT_CA_PATH", "/app/certs/client-ca-bundle.crt"))
+	v.SetDefault("mtls_revocation.ocsp_enabled", getEnvBool("MTLS_OCSP_ENABLED", false))
+	v.SetDefault("mtls_revocation.ocsp_stapling", getEnvBool("MTLS_OCSP_STAPLING", false))
+	v.SetDefault("mtls_revocation.ocsp_timeout", 5*time.Second)
+	v.SetDefault("mtls_revocation.crl_enabled", getEnvBool("MTLS_CRL_ENABLED", false))
+	v.SetDefault("mtls_revocation.crl_sources", []string{})
+	v.SetDefault("mtls_revocation.crl_refresh_interval", time.Hour)
+	v.SetDefault("mtls_revocation.fail_open", getEnvBool("MTLS_REVOCATION_FAIL_OPEN", false))
+
+	v.SetDefault("session_tickets.enabled", getEnvBool("TLS_SESSION_TICKETS", true))
+	v.SetDefault("session_tickets.shared", getEnvBool("TLS_SESSION_TICKETS_SHARED", false))
+	v.SetDefault("session_tickets.rotation_interval", time.Hour)
+	v.SetDefault("session_tickets.refresh_interval", 5*time.Minute)
+	v.SetDefault("session_tickets.key_count", 3)
+
+	v.SetDefault("manager.url", getEnv("MANAGER_URL", "http://manager:8000"))
+	v.SetDefault("manager.api_key", getEnv("CLUSTER_API_KEY", ""))
+	v.SetDefault("manager.proxy_id", getEnv("PROXY_ID", ""))
+	v.SetDefault("manager.cluster_id", getEnv("CLUSTER_ID", "default"))
+	v.SetDefault("manager.retry_count", 3)
+	v.SetDefault("manager.timeout", 30)
+	v.SetDefault("manager.refresh_interval", time.Minute)
+	v.SetDefault("manager.heartbeat_interval", 30*time.Second)
+	v.SetDefault("manager.standalone_config", getEnv("STANDALONE_CONFIG", ""))
+
+	v.SetDefault("rate_limit.requests_per_second", 1000)
+	v.SetDefault("rate_limit.burst_size", 2000)
+	v.SetDefault("rate_limit.max_connections", 10000)
+	v.SetDefault("rate_limit.headers", getEnvBool("RATE_LIMIT_HEADERS", true))
+	v.SetDefault("rate_limit.store", getEnv("RATE_LIMIT_STORE", "memory"))
+	v.SetDefault("rate_limit.redis_addr", getEnv("RATE_LIMIT_REDIS_ADDR", ""))
+	v.SetDefault("rate_limit.redis_password", getEnv("RATE_LIMIT_REDIS_PASSWORD", ""))
+	v.SetDefault("rate_limit.redis_db", 0)
+	v.SetDefault("rate_limit.key_prefix", "marchproxy:ratelimit:")
+
+	v.SetDefault("load_balancing.algorithm", "round_robin")
+	v.SetDefault("load_balancing.backends", []string{})
+
+	v.SetDefault("cache.enabled", true)
+	v.SetDefault("cache.ttl", 300)
+	v.SetDefault("cache.max_size", 1000)
+	v.SetDefault("cache.max_memory", 100)
+
+	v.SetDefault("security.enable_ddos_protection", true)
+	v.SetDefault("security.allowed_ips", []string{})
+	v.SetDefault("security.blocked_ips", []string{})
+	v.SetDefault("security.max_request_size", 10*1024*1024)
+	v.SetDefault("security.timeout_seconds", 30)
+
+	v.SetDefault("listener.read_header_timeout", 10*time.Second)
+	v.SetDefault("listener.read_timeout", 60*time.Second)
+	v.SetDefault("listener.write_timeout", 120*time.Second)
+	v.SetDefault("listener.idle_timeout", 120*time.Second)
+	v.SetDefault("listener.max_header_bytes", 1<<20)
+	v.SetDefault("listener.min_body_rate", 1024)
+	v.SetDefault("listener.body_rate_grace", 10*time.Second)
+
+	v.SetDefault("bot.good_bots", []string{
+		"Googlebot", "bingbot", "DuckDuckBot", "Applebot", "YandexBot", "Baiduspider", "Slurp",
+	})
+	v.SetDefault("bot.bad_user_agents", []string{
+		"python-requests", "python-urllib", "Go-http-client", "curl/", "Wget/", "libwww-perl",
+		"Scrapy", "sqlmap", "nikto", "masscan", "zgrab", "Nmap",
+	})
+	v.SetDefault("bot.good_fingerprints", []string{})
+	v.SetDefault("bot.bad_fingerprints", []string{})
+	v.SetDefault("bot.tarpit_delay", 10*time.Second)
+	v.SetDefault("bot.challenge_secret", getEnv("BOT_CHALLENGE_SECRET", ""))
+	v.SetDefault("bot.challenge_ttl", time.Hour)
+
+	v.SetDefault("fault_injection.enabled", false)
+
+	v.SetDefault("tls_fingerprint.max_tracked", 1000)
+
+	v.SetDefault("schedule.clock_skew", 30*time.Second)
+
+	v.SetDefault("metering.interval", 5*time.Minute)
+	v.SetDefault("metering.upload", true)
+	v.SetDefault("metering.csv_dir", getEnv("METERING_CSV_DIR", ""))
+
+	v.SetDefault("license.refresh_interval", 5*time.Minute)
+	v.SetDefault("license.grace_period", 72*time.Hour)
+	v.SetDefault("license.cache_file", getEnv("LICENSE_CACHE_FILE", ""))
+
+	v.SetDefault("overload.max_connections", 0)
+	v.SetDefault("overload.max_requests", 0)
+	v.SetDefault("overload.cpu_percent", 0)
+	v.SetDefault("overload.heap_mb", 0)
+	v.SetDefault("overload.accept_queue", 0)
+	v.SetDefault("overload.interval", time.Second)
+	v.SetDefault("overload.min_priority", "high")
+	v.SetDefault("overload.default_priority", "normal")
+	v.SetDefault("overload.critical_paths", []string{"/healthz", "/health", "/ready", "/readyz", "/livez"})
+	v.SetDefault("overload.priorities", []OverloadPriority{})
+	v.SetDefault("overload.exempt_cidrs", []string{})
+
+	v.SetDefault("upgrade.socket", getEnv("UPGRADE_SOCKET", ""))
+	v.SetDefault("upgrade.timeout", time.Minute)
+
+	v.SetDefault("health_check.interval", 10*time.Second)
+	v.SetDefault("health_check.checks", []string{"tcp"})
+	v.SetDefault("health_check.passive_threshold", 5)
+	v.SetDefault("health_check.passive_window", 10*time.Second)
+	v.SetDefault("health_check.slow_start_window", 0)
+	v.SetDefault("health_check.slow_start_curve", "linear")
+	v.SetDefault("health_check.slow_start_min_weight", 0.1)
+
+	v.SetDefault("locality.zone", getEnv("LOCALITY_ZONE", ""))
+	v.SetDefault("locality.region", getEnv("LOCALITY_REGION", ""))
+	v.SetDefault("locality.spill_threshold", 0.7)
+
+	v.SetDefault("snmp.listen", getEnv("SNMP_LISTEN", ""))
+	v.SetDefault("snmp.community", getEnv("SNMP_COMMUNITY", ""))
 }
 
 func validateConfig(config *Config) error {
@@ -189,6 +473,10 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid health port: %d", config.HealthPort)
 	}
 
+	if err := config.Admin.Validate(); err != nil {
+		return err
+	}
+
 	if _, err := logrus.ParseLevel(config.LogLevel); err != nil {
 		return fmt.Errorf("invalid log level: %s", config.LogLevel)
 	}
@@ -197,6 +485,27 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid host: %s", config.Host)
 	}
 
+	if err := netutil.ValidateInterface(config.BindInterface); err != nil {
+		return err
+	}
+
+	if err := validateOverload(config); err != nil {
+		return err
+	}
+
+	if config.Upgrade.Socket != "" && config.Upgrade.Timeout <= 0 {
+		return fmt.Errorf("invalid upgrade timeout: %v", config.Upgrade.Timeout)
+	}
+
+	if config.SNMP.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.SNMP.Listen); err != nil {
+			return fmt.Errorf("invalid SNMP listen address: %w", err)
+		}
+		if config.SNMP.Community == "" {
+			return fmt.Errorf("SNMP community required when the SNMP agent is enabled")
+		}
+	}
+
 	if config.EnableMTLS {
 		if config.MTLSServerCertPath == "" {
 			return fmt.Errorf("mTLS server certificate path required when mTLS is enabled")
@@ -207,6 +516,43 @@ func validateConfig(config *Config) error {
 		if config.MTLSClientCAPath == "" && config.MTLSRequireClientCert {
 			return fmt.Errorf("mTLS client CA path required when client certificates are required")
 		}
+		if config.MTLSRevocation.OCSPTimeout <= 0 {
+			return fmt.Errorf("invalid mTLS revocation OCSP timeout: %v", config.MTLSRevocation.OCSPTimeout)
+		}
+		if config.MTLSRevocation.CRLEnabled && config.MTLSRevocation.CRLRefreshInterval <= 0 {
+			return fmt.Errorf("invalid mTLS revocation CRL refresh interval: %v", config.MTLSRevocation.CRLRefreshInterval)
+		}
+	}
+
+	if config.SessionTickets.Enabled {
+		if config.SessionTickets.RotationInterval <= 0 || config.SessionTickets.RefreshInterval <= 0 {
+			return fmt.Errorf("session ticket rotation and refresh intervals must be positive")
+		}
+		if config.SessionTickets.KeyCount < 1 {
+			return fmt.Errorf("invalid session ticket key count: %d", config.SessionTickets.KeyCount)
+		}
+	}
+
+	if config.Listener.ReadHeaderTimeout < 0 || config.Listener.ReadTimeout < 0 ||
+		config.Listener.WriteTimeout < 0 || config.Listener.IdleTimeout < 0 {
+		return fmt.Errorf("listener timeouts must not be negative")
+	}
+	if config.Listener.MinBodyRate < 0 || config.Security.MaxRequestSize < 0 {
+		return fmt.Errorf("listener body limits must not be negative")
+	}
+
+	if config.Bot.TarpitDelay < 0 || config.Bot.ChallengeTTL <= 0 {
+		return fmt.Errorf("invalid bot tarpit delay or challenge TTL")
+	}
+
+	switch config.RateLimit.Store {
+	case "memory":
+	case "redis":
+		if config.RateLimit.RedisAddr == "" {
+			return fmt.Errorf("rate limit redis address required when the redis store is used")
+		}
+	default:
+		return fmt.Errorf("invalid rate limit store: %s", config.RateLimit.Store)
 	}
 
 	validAlgorithms := map[string]bool{
@@ -219,9 +565,45 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid load balancing algorithm: %s", config.LoadBalancing.Algorithm)
 	}
 
-	if config.Manager.APIKey == "" {
+	if config.Manager.APIKey == "" && config.Manager.StandaloneConfig == "" {
 		return fmt.Errorf("cluster API key is required")
 	}
+	if config.Manager.RefreshInterval <= 0 || config.Manager.HeartbeatInterval <= 0 {
+		return fmt.Errorf("manager refresh and heartbeat intervals must be positive")
+	}
+
+	if config.HealthCheck.Interval < 0 || config.HealthCheck.PassiveWindow < 0 {
+		return fmt.Errorf("health check interval and passive window must not be negative")
+	}
+	if config.HealthCheck.PassiveThreshold < 0 {
+		return fmt.Errorf("invalid health check passive threshold: %d", config.HealthCheck.PassiveThreshold)
+	}
+	if config.HealthCheck.SlowStartWindow < 0 {
+		return fmt.Errorf("health check slow start window must not be negative")
+	}
+	switch config.HealthCheck.SlowStartCurve {
+	case "", "linear", "exponential":
+	default:
+		return fmt.Errorf("invalid health check slow start curve: %s", config.HealthCheck.SlowStartCurve)
+	}
+	if config.HealthCheck.SlowStartWindow > 0 && (config.HealthCheck.SlowStartMinWeight <= 0 || config.HealthCheck.SlowStartMinWeight > 1) {
+		return fmt.Errorf("health check slow start min weight must be above 0 and at most 1")
+	}
+	if config.Locality.SpillThreshold <= 0 || config.Locality.SpillThreshold > 1 {
+		return fmt.Errorf("locality spill threshold must be above 0 and at most 1")
+	}
+
+	if config.Schedule.ClockSkew < 0 || config.Schedule.ClockSkew > schedule.MaxClockSkew {
+		return fmt.Errorf("schedule clock skew must be between 0 and %s", schedule.MaxClockSkew)
+	}
+
+	if config.Metering.Interval < 0 {
+		return fmt.Errorf("metering interval must not be negative")
+	}
+
+	if config.License.RefreshInterval <= 0 || config.License.GracePeriod <= 0 {
+		return fmt.Errorf("license refresh interval and grace period must be positive")
+	}
 
 	return nil
 }
@@ -260,10 +642,67 @@ func (c *Config) GetTLSConfig() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// GetListenAddress returns the HTTP listen address on the configured host
+func (c *Config) GetListenAddress() string {
+	return netutil.JoinHostPort(c.Host, c.Port)
+}
+
+// GetTLSListenAddress returns the HTTPS listen address on the configured host
+func (c *Config) GetTLSListenAddress() string {
+	return netutil.JoinHostPort(c.Host, c.TLSPort)
+}
+
 func (c *Config) GetManagerTimeout() time.Duration {
 	return time.Duration(c.Manager.Timeout) * time.Second
 }
 
+// GetCapabilities returns the features this ingress registers with the
+// manager
+func (c *Config) GetCapabilities() []string {
+	capabilities := []string{"http", "https"}
+	if c.EnableEBPF {
+		capabilities = append(capabilities, "ebpf")
+	}
+	if c.EnableXDP {
+		capabilities = append(capabilities, "xdp")
+	}
+	if c.EnableMTLS {
+		capabilities = append(capabilities, "mtls")
+	}
+	return capabilities
+}
+
+// validateOverload checks the load shedding limits, priorities and
+// exempt networks
+func validateOverload(config *Config) error {
+	o := config.Overload
+	if o.MaxConnections < 0 || o.MaxRequests < 0 || o.CPUPercent < 0 || o.HeapMB < 0 || o.AcceptQueue < 0 {
+		return fmt.Errorf("overload limits and thresholds must not be negative")
+	}
+	if o.CPUPercent > 100 {
+		return fmt.Errorf("invalid overload CPU percent: %v", o.CPUPercent)
+	}
+	if (o.CPUPercent > 0 || o.HeapMB > 0 || o.AcceptQueue > 0) && o.Interval <= 0 {
+		return fmt.Errorf("invalid overload interval: %v", o.Interval)
+	}
+
+	priorities := []string{o.MinPriority, o.DefaultPriority}
+	for _, p := range o.Priorities {
+		priorities = append(priorities, p.Priority)
+	}
+	for _, p := range priorities {
+		if _, err := overload.ParsePriority(p); err != nil {
+			return fmt.Errorf("invalid overload priority: %w", err)
+		}
+	}
+	for _, cidr := range o.ExemptCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid overload exempt CIDR %q: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -280,13 +719,13 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
-func loadClientCAs(caPath string) (*tls.CertPool, error) {
+func loadClientCAs(caPath string) (*x509.CertPool, error) {
 	caCert, err := os.ReadFile(caPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
 	}
 
-	caCertPool := tls.NewCertPool()
+	caCertPool := x509.NewCertPool()
 	if !caCertPool.AppendCertsFromPEM(caCert) {
 		return nil, fmt.Errorf("failed to parse CA certificate")
 	}
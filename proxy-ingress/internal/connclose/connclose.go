@@ -0,0 +1,169 @@
+// Package connclose classifies why ingress client connections closed and
+// counts them per route and reason, so backend failures can be told apart
+// from client churn.
+package connclose
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Close reasons shared by every MarchProxy module
+const (
+	ClientEOF    = "client_eof"    // The client closed the connection
+	BackendEOF   = "backend_eof"   // The backend closed mid-response
+	AuthFailure  = "auth_failure"  // The last request failed authentication
+	PolicyDenied = "policy_denied" // The last request was denied by a route policy
+	IdleTimeout  = "idle_timeout"  // No request arrived within the timeout
+	Drain        = "drain"         // Closed while the server shut down
+	Error        = "error"         // The last request failed in the proxy
+)
+
+// Config holds the server timeouts used to recognise idle closes
+type Config struct {
+	IdleTimeout   time.Duration // Between requests on a kept-alive connection
+	HeaderTimeout time.Duration // For the first request on a new connection
+}
+
+// connInfo is the state of one client connection
+type connInfo struct {
+	mu     sync.Mutex
+	state  http.ConnState
+	since  time.Time // When the connection entered state
+	route  string    // Route of the last request
+	reason string    // Close reason set by the last request
+}
+
+type connKey struct{}
+
+// Tracker classifies connection closes
+type Tracker struct {
+	config   Config
+	module   string
+	closed   *prometheus.CounterVec
+	conns    sync.Map // net.Conn to *connInfo
+	draining atomic.Bool
+
+	now func() time.Time
+}
+
+// New creates a tracker whose counter is registered with reg
+func New(reg prometheus.Registerer, module string, config Config) *Tracker {
+	t := &Tracker{
+		config: config,
+		module: module,
+		closed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marchproxy_connections_closed_total",
+			Help: "Closed connections per module, route and close reason",
+		}, []string{"module", "route", "reason"}),
+		now: time.Now,
+	}
+	reg.MustRegister(t.closed)
+	return t
+}
+
+// Protect installs connection tracking on server. Hooks already set on
+// server still run. Hijacked connections, such as WebSocket upgrades, are
+// no longer tracked once the server hands them over.
+func (t *Tracker) Protect(server *http.Server) {
+	nextState := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		t.connState(conn, state)
+		if nextState != nil {
+			nextState(conn, state)
+		}
+	}
+	nextContext := server.ConnContext
+	server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if nextContext != nil {
+			ctx = nextContext(ctx, conn)
+		}
+		return context.WithValue(ctx, connKey{}, conn)
+	}
+}
+
+// Mark records the route of a request and the close reason it leaves on
+// its connection, "" when the request does not explain a close
+func (t *Tracker) Mark(r *http.Request, route, reason string) {
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	if v, ok := t.conns.Load(conn); ok {
+		info := v.(*connInfo)
+		info.mu.Lock()
+		info.route = route
+		info.reason = reason
+		info.mu.Unlock()
+	}
+}
+
+// Drain marks every connection closed from now on as closed by a shutdown
+func (t *Tracker) Drain() {
+	t.draining.Store(true)
+}
+
+func (t *Tracker) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		t.conns.Store(conn, &connInfo{state: state, since: t.now()})
+	case http.StateActive, http.StateIdle:
+		if v, ok := t.conns.Load(conn); ok {
+			info := v.(*connInfo)
+			info.mu.Lock()
+			if state == http.StateActive {
+				info.reason = ""
+			}
+			info.state = state
+			info.since = t.now()
+			info.mu.Unlock()
+		}
+	case http.StateHijacked:
+		t.conns.Delete(conn)
+	case http.StateClosed:
+		v, ok := t.conns.LoadAndDelete(conn)
+		if !ok {
+			return
+		}
+		info := v.(*connInfo)
+		info.mu.Lock()
+		route, reason := info.route, t.classify(info)
+		info.mu.Unlock()
+		if route == "" {
+			route = "none"
+		}
+		t.closed.WithLabelValues(t.module, route, reason).Inc()
+	}
+}
+
+// classify returns the close reason of a connection that just closed
+func (t *Tracker) classify(info *connInfo) string {
+	if t.draining.Load() {
+		return Drain
+	}
+
+	// The server closes connections that wait too long for a request,
+	// whatever happened to the request before
+	waited := t.now().Sub(info.since)
+	switch info.state {
+	case http.StateNew:
+		if t.config.HeaderTimeout > 0 && waited >= t.config.HeaderTimeout {
+			return IdleTimeout
+		}
+	case http.StateIdle:
+		if t.config.IdleTimeout > 0 && waited >= t.config.IdleTimeout {
+			return IdleTimeout
+		}
+	}
+
+	if info.reason != "" {
+		return info.reason
+	}
+	return ClientEOF
+}
@@ -0,0 +1,100 @@
+package connclose
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// serve runs a server that marks every request with the route and reason
+// from its query string
+func serve(t *testing.T, config Config) (*Tracker, *httptest.Server) {
+	t.Helper()
+
+	tracker := New(prometheus.NewRegistry(), "ingress", config)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.Mark(r, r.URL.Query().Get("route"), r.URL.Query().Get("reason"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.IdleTimeout = config.IdleTimeout
+	tracker.Protect(server.Config)
+	server.Start()
+	t.Cleanup(server.Close)
+	return tracker, server
+}
+
+// request sends one request on conn and reads the response
+func request(t *testing.T, conn net.Conn, path string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// waitClosed waits until the tracker has counted a close for route and reason
+func waitClosed(t *testing.T, tracker *Tracker, route, reason string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(tracker.closed.WithLabelValues("ingress", route, reason)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a %s close on route %s", reason, route)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	tracker, server := serve(t, Config{IdleTimeout: 200 * time.Millisecond})
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// The client hangs up after a successful request
+	conn := dial()
+	request(t, conn, "/?route=api")
+	conn.Close()
+	waitClosed(t, tracker, "api", ClientEOF)
+
+	// The client hangs up after a denied request
+	conn = dial()
+	request(t, conn, "/?route=admin&reason="+PolicyDenied)
+	conn.Close()
+	waitClosed(t, tracker, "admin", PolicyDenied)
+
+	// The server closes a kept-alive connection that stays idle
+	conn = dial()
+	defer conn.Close()
+	request(t, conn, "/?route=web")
+	waitClosed(t, tracker, "web", IdleTimeout)
+}
+
+func TestDrain(t *testing.T) {
+	tracker, server := serve(t, Config{})
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request(t, conn, "/?route=api")
+
+	tracker.Drain()
+	server.Config.SetKeepAlivesEnabled(false)
+	waitClosed(t, tracker, "api", Drain)
+}
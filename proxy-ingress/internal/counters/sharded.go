@@ -0,0 +1,58 @@
+// Package counters provides low-contention counters for hot-path metrics.
+package counters
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync/atomic"
+)
+
+// cacheLineSize is the padding used to keep counter shards on separate cache lines
+const cacheLineSize = 64
+
+// counterShard is a single padded shard of a ShardedCounter
+type counterShard struct {
+	value int64
+	_     [cacheLineSize - 8]byte
+}
+
+// ShardedCounter is a lock-free counter split across cache-line padded
+// shards. Writers pick a shard at random so concurrent increments from
+// different cores rarely touch the same cache line; Load sums all shards and
+// is intended for scrape-time reads. The zero value is not usable; create
+// counters with NewShardedCounter.
+type ShardedCounter struct {
+	shards []counterShard
+	mask   uint32
+}
+
+// NewShardedCounter creates a counter with one shard per GOMAXPROCS, rounded up to a power of two
+func NewShardedCounter() *ShardedCounter {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return &ShardedCounter{
+		shards: make([]counterShard, n),
+		mask:   uint32(n - 1),
+	}
+}
+
+// Add adds delta to the counter
+func (c *ShardedCounter) Add(delta int64) {
+	atomic.AddInt64(&c.shards[rand.Uint32()&c.mask].value, delta)
+}
+
+// Inc increments the counter by one
+func (c *ShardedCounter) Inc() {
+	c.Add(1)
+}
+
+// Load returns the sum of all shards
+func (c *ShardedCounter) Load() int64 {
+	var total int64
+	for i := range c.shards {
+		total += atomic.LoadInt64(&c.shards[i].value)
+	}
+	return total
+}
@@ -0,0 +1,119 @@
+// Package deadline propagates the time left for a request to the backends,
+// so they can abandon work the client will no longer wait for.
+package deadline
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying the budget to backends, and read from callers that
+// already have a deadline
+const (
+	GRPCTimeoutHeader    = "grpc-timeout"      // gRPC wire format, such as 250m
+	RequestTimeoutHeader = "X-Request-Timeout" // Whole milliseconds
+)
+
+// grpcUnits are the grpc-timeout units, largest first
+var grpcUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'H', time.Hour},
+	{'M', time.Minute},
+	{'S', time.Second},
+	{'m', time.Millisecond},
+	{'u', time.Microsecond},
+	{'n', time.Nanosecond},
+}
+
+// grpcMaxValue is the largest grpc-timeout value, 8 digits
+const grpcMaxValue = 99999999
+
+// Deadline returns when a request that arrived at start must be answered:
+// the route timeout after start, or sooner when the caller's own
+// grpc-timeout or X-Request-Timeout leaves less. ok is false when neither
+// the route nor the caller sets a timeout.
+func Deadline(start time.Time, routeTimeout time.Duration, h http.Header) (deadline time.Time, ok bool) {
+	budget := routeTimeout
+	if caller, found := CallerTimeout(h); found && (budget <= 0 || caller < budget) {
+		budget = caller
+	}
+	if budget <= 0 {
+		return time.Time{}, false
+	}
+	return start.Add(budget), true
+}
+
+// CallerTimeout returns the budget the caller sent, the smaller of its
+// grpc-timeout and X-Request-Timeout. Malformed values are ignored.
+func CallerTimeout(h http.Header) (time.Duration, bool) {
+	var budget time.Duration
+	found := false
+	if d, err := ParseGRPCTimeout(h.Get(GRPCTimeoutHeader)); err == nil {
+		budget, found = d, true
+	}
+	if ms, err := strconv.ParseInt(strings.TrimSpace(h.Get(RequestTimeoutHeader)), 10, 64); err == nil && ms >= 0 {
+		if d := time.Duration(ms) * time.Millisecond; !found || d < budget {
+			budget, found = d, true
+		}
+	}
+	return budget, found
+}
+
+// SetHeaders replaces the budget headers of a request to a backend with
+// remaining. grpc-timeout is only set on gRPC requests.
+func SetHeaders(h http.Header, remaining time.Duration) {
+	remaining = max(remaining, 0)
+	h.Set(RequestTimeoutHeader, strconv.FormatInt(remaining.Milliseconds(), 10))
+	if IsGRPC(h) {
+		h.Set(GRPCTimeoutHeader, FormatGRPCTimeout(remaining))
+	} else {
+		h.Del(GRPCTimeoutHeader)
+	}
+}
+
+// IsGRPC reports whether a request's content type is gRPC
+func IsGRPC(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// FormatGRPCTimeout formats d in the grpc-timeout format, in the finest
+// unit that fits in 8 digits, rounding up so the backend never gets more
+// time than is left
+func FormatGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for i := len(grpcUnits) - 1; i >= 0; i-- {
+		u := grpcUnits[i]
+		value := (d + u.d - 1) / u.d
+		if value <= grpcMaxValue {
+			return fmt.Sprintf("%d%c", value, u.unit)
+		}
+	}
+	return fmt.Sprintf("%dH", grpcMaxValue)
+}
+
+// ParseGRPCTimeout parses a grpc-timeout value
+func ParseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	value, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	for _, u := range grpcUnits {
+		if s[len(s)-1] == u.unit {
+			if value > int64(1<<63-1)/int64(u.d) {
+				return 1<<63 - 1, nil
+			}
+			return time.Duration(value) * u.d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid grpc-timeout unit in %q", s)
+}
@@ -0,0 +1,82 @@
+package deadline
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGRPCTimeoutFormat(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0n"},
+		{250 * time.Millisecond, "250000u"},
+		{1500 * time.Millisecond, "1500000u"},
+		{30 * time.Second, "30000000u"},
+		{2 * time.Minute, "120000m"},
+		{1001 * time.Microsecond, "1001000n"},
+	} {
+		got := FormatGRPCTimeout(tc.d)
+		if got != tc.want {
+			t.Errorf("FormatGRPCTimeout(%v) = %q, want %q", tc.d, got, tc.want)
+		}
+		if parsed, err := ParseGRPCTimeout(got); err != nil || parsed < tc.d {
+			t.Errorf("ParseGRPCTimeout(%q) = %v, %v, want at least %v", got, parsed, err, tc.d)
+		}
+	}
+
+	for _, bad := range []string{"", "5", "5x", "-5S", "123456789S"} {
+		if _, err := ParseGRPCTimeout(bad); err == nil {
+			t.Errorf("ParseGRPCTimeout(%q) accepted", bad)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	start := time.Now()
+
+	if _, ok := Deadline(start, 0, http.Header{}); ok {
+		t.Error("Deadline without a route timeout or caller budget")
+	}
+	if d, ok := Deadline(start, 5*time.Second, http.Header{}); !ok || !d.Equal(start.Add(5*time.Second)) {
+		t.Errorf("Deadline = %v, %t, want the route timeout", d, ok)
+	}
+
+	// A caller with less time left shortens the budget, never lengthens it
+	h := http.Header{}
+	h.Set(GRPCTimeoutHeader, "2S")
+	h.Set(RequestTimeoutHeader, "1500")
+	if d, _ := Deadline(start, 5*time.Second, h); !d.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("Deadline = %v, want the caller's 1.5s", d.Sub(start))
+	}
+	h.Set(RequestTimeoutHeader, "60000")
+	h.Del(GRPCTimeoutHeader)
+	if d, _ := Deadline(start, 5*time.Second, h); !d.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("Deadline = %v, want the route's 5s", d.Sub(start))
+	}
+	if d, ok := Deadline(start, 0, h); !ok || !d.Equal(start.Add(time.Minute)) {
+		t.Errorf("Deadline = %v, want the caller's minute on routes without a timeout", d.Sub(start))
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "application/grpc+proto")
+	h.Set(GRPCTimeoutHeader, "10S")
+	SetHeaders(h, 750*time.Millisecond)
+	if got := h.Get(GRPCTimeoutHeader); got != "750000u" {
+		t.Errorf("grpc-timeout = %q", got)
+	}
+	if got := h.Get(RequestTimeoutHeader); got != "750" {
+		t.Errorf("X-Request-Timeout = %q, want 750", got)
+	}
+
+	h = http.Header{}
+	h.Set(GRPCTimeoutHeader, "10S")
+	SetHeaders(h, time.Second)
+	if got := h.Get(GRPCTimeoutHeader); got != "" {
+		t.Errorf("grpc-timeout = %q on a plain HTTP request", got)
+	}
+}
@@ -0,0 +1,197 @@
+package ebpf
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"marchproxy-shared/ebpfstats"
+)
+
+/*
+#cgo LDFLAGS: -lbpf -lelf -lz
+#include <stdlib.h>
+#include <errno.h>
+#include <bpf/libbpf.h>
+#include <bpf/bpf.h>
+#include <linux/bpf.h>
+
+// Open and load an eBPF object file
+struct bpf_object *load_bpf_program(const char *filename) {
+    struct bpf_object *obj;
+
+    obj = bpf_object__open(filename);
+    if (libbpf_get_error(obj)) {
+        return NULL;
+    }
+    if (bpf_object__load(obj)) {
+        bpf_object__close(obj);
+        return NULL;
+    }
+    return obj;
+}
+
+// Lookup map element
+int lookup_map_element(int map_fd, void *key, void *value) {
+    return bpf_map_lookup_elem(map_fd, key, value);
+}
+
+// Get the key following key, or the first key when key is NULL
+int next_map_key(int map_fd, void *key, void *next_key) {
+    return bpf_map_get_next_key(map_fd, key, next_key);
+}
+
+// Describe a map for the statistics reader, returning its fd or -1 when
+// the program has no such map
+int describe_map(struct bpf_object *obj, const char *map_name, __u32 *value_size, int *per_cpu) {
+    struct bpf_map *map;
+    enum bpf_map_type type;
+
+    map = bpf_object__find_map_by_name(obj, map_name);
+    if (!map) {
+        return -1;
+    }
+
+    type = bpf_map__type(map);
+    *value_size = bpf_map__value_size(map);
+    *per_cpu = type == BPF_MAP_TYPE_PERCPU_ARRAY ||
+               type == BPF_MAP_TYPE_PERCPU_HASH ||
+               type == BPF_MAP_TYPE_LRU_PERCPU_HASH;
+    return bpf_map__fd(map);
+}
+*/
+import "C"
+
+// BPFLoader loads an eBPF object file through libbpf
+type BPFLoader struct {
+	programPath string
+	obj         *C.struct_bpf_object
+}
+
+// NewBPFLoader creates a loader of the object file at programPath
+func NewBPFLoader(programPath string) *BPFLoader {
+	return &BPFLoader{programPath: programPath}
+}
+
+// LoadProgram loads the object file into the kernel
+func (l *BPFLoader) LoadProgram() error {
+	if l.obj != nil {
+		return fmt.Errorf("program already loaded")
+	}
+	if _, err := os.Stat(l.programPath); err != nil {
+		return fmt.Errorf("eBPF program file not found: %s", l.programPath)
+	}
+
+	cPath := C.CString(l.programPath)
+	defer C.free(unsafe.Pointer(cPath))
+
+	l.obj = C.load_bpf_program(cPath)
+	if l.obj == nil {
+		return fmt.Errorf("failed to load eBPF program from %s", l.programPath)
+	}
+	return nil
+}
+
+// UnloadProgram closes the object, detaching its programs and maps
+func (l *BPFLoader) UnloadProgram() error {
+	if l.obj != nil {
+		C.bpf_object__close(l.obj)
+		l.obj = nil
+	}
+	return nil
+}
+
+// StatsReader returns a reader of the program's statistics maps. The
+// per-service and per-mapping breakdowns are read when the program has them.
+func (l *BPFLoader) StatsReader() (*ebpfstats.Reader, error) {
+	if l.obj == nil {
+		return nil, fmt.Errorf("eBPF program not loaded")
+	}
+
+	global := l.statsMap(ebpfstats.GlobalMapName)
+	if global == nil {
+		return nil, fmt.Errorf("program has no %s map", ebpfstats.GlobalMapName)
+	}
+
+	var services, mappings ebpfstats.Map
+	if m := l.statsMap(ebpfstats.ServiceMapName); m != nil {
+		services = m
+	}
+	if m := l.statsMap(ebpfstats.MappingMapName); m != nil {
+		mappings = m
+	}
+	reader, err := ebpfstats.NewReader(global, services, mappings)
+	if err != nil {
+		return nil, err
+	}
+	if m := l.statsMap(ebpfstats.FlowCacheMapName); m != nil {
+		reader.SetFlowCacheMap(m)
+	}
+	return reader, nil
+}
+
+// statsMap returns a statistics map of the program, or nil when it has none
+func (l *BPFLoader) statsMap(name string) *bpfMap {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var valueSize C.__u32
+	var perCPU C.int
+	fd := C.describe_map(l.obj, cName, &valueSize, &perCPU)
+	if fd < 0 {
+		return nil
+	}
+	return &bpfMap{fd: fd, valueSize: int(valueSize), perCPU: perCPU != 0}
+}
+
+// bpfMap is a map with __u32 keys read through libbpf
+type bpfMap struct {
+	fd        C.int
+	valueSize int
+	perCPU    bool
+}
+
+var _ ebpfstats.Map = (*bpfMap)(nil)
+
+// Lookup copies the value of key into value
+func (m *bpfMap) Lookup(key uint32, value []byte) (bool, error) {
+	cKey := C.__u32(key)
+	ret, errno := C.lookup_map_element(m.fd, unsafe.Pointer(&cKey), unsafe.Pointer(&value[0]))
+	if ret != 0 {
+		if ret == -C.ENOENT || errno == syscall.ENOENT {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to look up key %d: %d", key, ret)
+	}
+	return true, nil
+}
+
+// NextKey returns the key after key, or the first key when key is nil
+func (m *bpfMap) NextKey(key *uint32) (uint32, bool, error) {
+	var cKey, cNext C.__u32
+	var keyPtr unsafe.Pointer
+	if key != nil {
+		cKey = C.__u32(*key)
+		keyPtr = unsafe.Pointer(&cKey)
+	}
+
+	ret, errno := C.next_map_key(m.fd, keyPtr, unsafe.Pointer(&cNext))
+	if ret != 0 {
+		if ret == -C.ENOENT || errno == syscall.ENOENT {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to iterate map: %d", ret)
+	}
+	return uint32(cNext), true, nil
+}
+
+// ValueSize returns the size of one CPU's value
+func (m *bpfMap) ValueSize() int {
+	return m.valueSize
+}
+
+// PerCPU reports whether the map keeps a value per CPU
+func (m *bpfMap) PerCPU() bool {
+	return m.perCPU
+}
@@ -0,0 +1,35 @@
+//go:build !cgo
+// +build !cgo
+
+package ebpf
+
+import (
+	"fmt"
+
+	"marchproxy-shared/ebpfstats"
+)
+
+// BPFLoader stands in for the libbpf loader when built without CGO
+type BPFLoader struct {
+	programPath string
+}
+
+// NewBPFLoader creates a loader of the object file at programPath
+func NewBPFLoader(programPath string) *BPFLoader {
+	return &BPFLoader{programPath: programPath}
+}
+
+// LoadProgram fails: programs can't be loaded without CGO
+func (l *BPFLoader) LoadProgram() error {
+	return fmt.Errorf("cannot load %s: CGO not available", l.programPath)
+}
+
+// UnloadProgram does nothing
+func (l *BPFLoader) UnloadProgram() error {
+	return nil
+}
+
+// StatsReader fails: maps can't be read without CGO
+func (l *BPFLoader) StatsReader() (*ebpfstats.Reader, error) {
+	return nil, fmt.Errorf("eBPF statistics unavailable (CGO not available)")
+}
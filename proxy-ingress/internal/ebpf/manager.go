@@ -0,0 +1,174 @@
+// Package ebpf loads the ingress eBPF program and reads its statistics
+// through the reader shared with egress
+package ebpf
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"marchproxy-shared/ebpfstats"
+)
+
+// programSearchPaths are where compiled programs are looked for, by name
+var programSearchPaths = []string{
+	"ebpf/build/%s.o",
+	"/opt/marchproxy/ebpf/%s.o",
+	"./%s.o",
+}
+
+// Manager handles the ingress eBPF program lifecycle. Routing stays in
+// userspace: the program counts and filters packets, and the manager
+// exposes its counters.
+type Manager struct {
+	enabled    bool
+	loader     *BPFLoader
+	reader     *ebpfstats.Reader
+	stats      *EBPFStats
+	readErrors atomic.Uint64
+	mu         sync.RWMutex
+}
+
+// NewManager creates a new eBPF manager
+func NewManager(enabled bool) *Manager {
+	return &Manager{
+		enabled: enabled,
+		stats:   &EBPFStats{LastUpdate: time.Now()},
+	}
+}
+
+// IsEnabled returns whether eBPF is enabled
+func (m *Manager) IsEnabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.enabled
+}
+
+// LoadProgram loads the compiled program called name, e.g. "ingress" for
+// ingress.o
+func (m *Manager) LoadProgram(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.enabled {
+		return fmt.Errorf("eBPF is disabled")
+	}
+	if m.loader != nil {
+		return fmt.Errorf("eBPF program already loaded")
+	}
+
+	path, err := findProgram(name)
+	if err != nil {
+		return err
+	}
+
+	loader := NewBPFLoader(path)
+	if err := loader.LoadProgram(); err != nil {
+		m.stats.ProgramErrors++
+		return fmt.Errorf("failed to load eBPF program: %w", err)
+	}
+
+	reader, err := loader.StatsReader()
+	if err != nil {
+		fmt.Printf("eBPF: Statistics unavailable: %v\n", err)
+	}
+
+	m.loader = loader
+	m.reader = reader
+	m.stats.ProgramLoaded = true
+	m.stats.ProgramPath = path
+	m.stats.LastUpdate = time.Now()
+
+	fmt.Printf("eBPF: Program loaded successfully from %s\n", path)
+	return nil
+}
+
+// findProgram returns the path of the compiled program called name
+func findProgram(name string) (string, error) {
+	for _, pattern := range programSearchPaths {
+		path := fmt.Sprintf(pattern, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("eBPF program %s.o not found", name)
+}
+
+// UpdateServices records how many services are configured
+func (m *Manager) UpdateServices(services int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.Services = services
+	m.stats.LastUpdate = time.Now()
+	return nil
+}
+
+// UpdateIngressRoutes records how many ingress routes are configured
+func (m *Manager) UpdateIngressRoutes(routes int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.IngressRoutes = routes
+	m.stats.LastUpdate = time.Now()
+	return nil
+}
+
+// Snapshot returns the counters of the loaded program, summed across CPUs
+// and broken down per service and mapping. Callers must not modify it.
+func (m *Manager) Snapshot() (*ebpfstats.Snapshot, error) {
+	m.mu.RLock()
+	reader := m.reader
+	m.mu.RUnlock()
+
+	if reader == nil {
+		return nil, fmt.Errorf("eBPF statistics unavailable")
+	}
+	snapshot, err := reader.Snapshot()
+	if err != nil {
+		m.readErrors.Add(1)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// GetStats returns current eBPF statistics
+func (m *Manager) GetStats() (*ProxyStats, *EBPFStats) {
+	var proxyStats ProxyStats
+	if snapshot, err := m.Snapshot(); err == nil {
+		proxyStats = ProxyStats{
+			TotalPackets:        snapshot.Global.TotalPackets,
+			TotalBytes:          snapshot.Global.TotalBytes,
+			TCPPackets:          snapshot.Global.TCPPackets,
+			UDPPackets:          snapshot.Global.UDPPackets,
+			ICMPPackets:         snapshot.Global.ICMPPackets,
+			DroppedPackets:      snapshot.Global.DroppedPackets,
+			ForwardedPackets:    snapshot.Global.AllowedPackets,
+			FallbackToUserspace: snapshot.Global.UserspacePackets,
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ebpfStats := *m.stats
+	ebpfStats.StatsReadErrors = m.readErrors.Load()
+	return &proxyStats, &ebpfStats
+}
+
+// Cleanup unloads the program
+func (m *Manager) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reader = nil
+	if m.loader != nil {
+		m.loader.UnloadProgram()
+		m.loader = nil
+	}
+	m.stats.ProgramLoaded = false
+	m.stats.LastUpdate = time.Now()
+	return nil
+}
@@ -0,0 +1,26 @@
+package ebpf
+
+import "time"
+
+// ProxyStats are the program-wide eBPF counters, summed across CPUs
+type ProxyStats struct {
+	TotalPackets        uint64
+	TotalBytes          uint64
+	TCPPackets          uint64
+	UDPPackets          uint64
+	ICMPPackets         uint64
+	DroppedPackets      uint64
+	ForwardedPackets    uint64
+	FallbackToUserspace uint64
+}
+
+// EBPFStats describes the loaded program
+type EBPFStats struct {
+	ProgramLoaded   bool
+	ProgramPath     string
+	LastUpdate      time.Time
+	ProgramErrors   uint64
+	StatsReadErrors uint64 // Failed reads of the statistics maps
+	Services        int
+	IngressRoutes   int
+}
@@ -0,0 +1,318 @@
+// Package fingerprint computes JA3 and JA4 TLS client fingerprints from
+// ClientHello messages and ties them to the connections they arrived on, so
+// request handlers and policies can classify clients by their TLS stack.
+package fingerprint
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Fingerprint identifies a TLS client implementation
+type Fingerprint struct {
+	JA3       string // MD5 of JA3String
+	JA3String string
+	JA4       string
+}
+
+// Matches reports whether the JA3 hash or JA4 fingerprint is in values
+func (f *Fingerprint) Matches(values []string) bool {
+	if f == nil {
+		return false
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, f.JA3) || v == f.JA4 {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed applies allow and deny lists of JA3 hashes and JA4 fingerprints.
+// A non-empty allow list admits only clients it lists, so connections
+// without a fingerprint are refused by it.
+func Allowed(f *Fingerprint, allow, deny []string) bool {
+	if f.Matches(deny) {
+		return false
+	}
+	return len(allow) == 0 || f.Matches(allow)
+}
+
+// FromHello computes the fingerprint of a ClientHello. The legacy version
+// is not exposed by crypto/tls, so it is taken as the highest supported
+// version capped at TLS 1.2, which is what TLS 1.3 clients send.
+func FromHello(hello *tls.ClientHelloInfo) *Fingerprint {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, curve := range hello.SupportedCurves {
+		curves[i] = uint16(curve)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, point := range hello.SupportedPoints {
+		points[i] = uint16(point)
+	}
+
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinValues(hello.CipherSuites),
+		joinValues(hello.Extensions),
+		joinValues(curves),
+		joinValues(points),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+
+	return &Fingerprint{JA3: hex.EncodeToString(sum[:]), JA3String: ja3, JA4: ja4(hello)}
+}
+
+// ja4 computes the JA4 fingerprint of a ClientHello received over TCP
+func ja4(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	versions := map[uint16]string{
+		tls.VersionTLS13: "13",
+		tls.VersionTLS12: "12",
+		tls.VersionTLS11: "11",
+		tls.VersionTLS10: "10",
+		0x0300:           "s3",
+	}
+	versionText, ok := versions[version]
+	if !ok {
+		versionText = "00"
+	}
+
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+
+	ciphers := hexValues(hello.CipherSuites, nil)
+	extensions := hexValues(hello.Extensions, nil)
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		alpn = alpnChars(hello.SupportedProtos[0])
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionText, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	// SNI and ALPN are left out of the hash as they already show in part a
+	sort.Strings(ciphers)
+	hashedExtensions := hexValues(hello.Extensions, map[uint16]bool{0x0000: true, 0x0010: true})
+	sort.Strings(hashedExtensions)
+
+	extensionText := strings.Join(hashedExtensions, ",")
+	if len(hello.SignatureSchemes) > 0 {
+		schemes := make([]uint16, len(hello.SignatureSchemes))
+		for i, scheme := range hello.SignatureSchemes {
+			schemes[i] = uint16(scheme)
+		}
+		extensionText += "_" + strings.Join(hexValues(schemes, nil), ",")
+	}
+
+	b := truncatedHash(ciphers, strings.Join(ciphers, ","))
+	c := truncatedHash(hashedExtensions, extensionText)
+	return a + "_" + b + "_" + c
+}
+
+// hexValues formats values as four digit hex, leaving out GREASE values
+// and those in skip
+func hexValues(values []uint16, skip map[uint16]bool) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) && !skip[v] {
+			out = append(out, fmt.Sprintf("%04x", v))
+		}
+	}
+	return out
+}
+
+// truncatedHash returns the first 12 hex digits of the SHA-256 of text, or
+// zeros when there were no values
+func truncatedHash(values []string, text string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// alpnChars returns the first and last characters of an ALPN protocol, or
+// of its hex form when either is not alphanumeric
+func alpnChars(proto string) string {
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	encoded := hex.EncodeToString([]byte(proto))
+	return string([]byte{encoded[0], encoded[len(encoded)-1]})
+}
+
+func isAlphanumeric(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// joinValues joins values with dashes, leaving out GREASE values
+func joinValues(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports whether v is a reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// Conn is a connection accepted by a Listener. It holds the fingerprint of
+// its ClientHello once the handshake has started.
+type Conn struct {
+	net.Conn
+	fingerprint atomic.Pointer[Fingerprint]
+}
+
+// Fingerprint returns the connection's fingerprint, or nil before the
+// ClientHello
+func (c *Conn) Fingerprint() *Fingerprint {
+	return c.fingerprint.Load()
+}
+
+type listener struct {
+	net.Listener
+}
+
+// Listener wraps l so TLS handshakes on its connections are fingerprinted.
+// It goes beneath the TLS listener.
+func Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// Capture records the fingerprint of every ClientHello received with config
+// on connections from a Listener, and counts it in tracker when not nil
+func Capture(config *tls.Config, tracker *Tracker) {
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if conn, ok := hello.Conn.(*Conn); ok {
+			fp := FromHello(hello)
+			conn.fingerprint.Store(fp)
+			tracker.Observe(fp)
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+// ForConn returns the fingerprint of a connection from a Listener, directly
+// or beneath TLS, or nil
+func ForConn(conn net.Conn) *Fingerprint {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if c, ok := conn.(*Conn); ok {
+		return c.Fingerprint()
+	}
+	return nil
+}
+
+type connKey struct{}
+
+// ConnContext is an http.Server ConnContext hook that makes the connection
+// available to FromRequest
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// FromRequest returns the fingerprint of the connection r arrived on, or nil
+// for plain HTTP
+func FromRequest(r *http.Request) *Fingerprint {
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return nil
+	}
+	return ForConn(conn)
+}
+
+// Count is the number of handshakes seen with one fingerprint
+type Count struct {
+	JA3        string
+	JA4        string
+	Handshakes uint64
+}
+
+// Tracker counts handshakes per fingerprint. Past its limit of distinct
+// fingerprints new ones are counted together, so metrics stay bounded.
+type Tracker struct {
+	limit int
+
+	mu     sync.Mutex
+	counts map[[2]string]uint64
+	other  uint64
+}
+
+// NewTracker creates a tracker for up to limit fingerprints
+func NewTracker(limit int) *Tracker {
+	return &Tracker{limit: limit, counts: make(map[[2]string]uint64)}
+}
+
+// Observe counts a handshake. It does nothing on a nil tracker.
+func (t *Tracker) Observe(f *Fingerprint) {
+	if t == nil || f == nil {
+		return
+	}
+
+	key := [2]string{f.JA3, f.JA4}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[key]; ok || len(t.counts) < t.limit {
+		t.counts[key]++
+	} else {
+		t.other++
+	}
+}
+
+// Counts returns the handshakes per tracked fingerprint and those past the
+// limit
+func (t *Tracker) Counts() ([]Count, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make([]Count, 0, len(t.counts))
+	for key, handshakes := range t.counts {
+		counts = append(counts, Count{JA3: key[0], JA4: key[1], Handshakes: handshakes})
+	}
+	return counts, t.other
+}
@@ -0,0 +1,139 @@
+package fingerprint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServerConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ingress"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestHandshakeIsFingerprinted(t *testing.T) {
+	serverConfig := testServerConfig(t)
+	tracker := NewTracker(1)
+	Capture(serverConfig, tracker)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := tls.NewListener(Listener(inner), serverConfig)
+	defer listener.Close()
+
+	result := make(chan *Fingerprint, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- nil
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		result <- ForConn(conn)
+	}()
+
+	conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	conn.Close()
+
+	fp := <-result
+	if fp == nil {
+		t.Fatal("Expected a fingerprint for the connection")
+	}
+	if !strings.HasPrefix(fp.JA3String, "771,") || len(fp.JA3) != 32 {
+		t.Errorf("Unexpected JA3 %s (%s)", fp.JA3, fp.JA3String)
+	}
+	if !strings.HasPrefix(fp.JA4, "t13i") {
+		t.Errorf("Unexpected JA4 %s", fp.JA4)
+	}
+
+	tracker.Observe(&Fingerprint{JA3: "other"})
+	counts, other := tracker.Counts()
+	if len(counts) != 1 || counts[0].JA4 != fp.JA4 || counts[0].Handshakes != 1 || other != 1 {
+		t.Errorf("Unexpected tracker counts %+v, %d past the limit", counts, other)
+	}
+}
+
+func TestGREASEIsIgnored(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{0x1a1a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{0x0a0a, tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Extensions:        []uint16{0x2a2a, 0, 10, 11},
+		SupportedCurves:   []tls.CurveID{0x3a3a, tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+
+	want := "771,4865-49195,0-10-11,29-23,0"
+	if fp := FromHello(hello); fp.JA3String != want {
+		t.Errorf("Expected %s, got %s", want, fp.JA3String)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// Chrome ClientHello from the JA4 specification
+	hello := &tls.ClientHelloInfo{
+		ServerName:        "example.com",
+		SupportedVersions: []uint16{0x4a4a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites: []uint16{0x6a6a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{0x8a8a, 0x001b, 0x0000, 0x0033, 0x0010, 0x4469, 0x0017, 0x002d,
+			0x000d, 0x0005, 0x0023, 0x0012, 0x002b, 0xff01, 0x000b, 0x000a, 0x0015},
+		SignatureSchemes: []tls.SignatureScheme{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		SupportedProtos:  []string{"h2", "http/1.1"},
+	}
+
+	want := "t13d1516h2_8daaf6152771_e5627efa2ab1"
+	if fp := FromHello(hello); fp.JA4 != want {
+		t.Errorf("Expected %s, got %s", want, fp.JA4)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	fp := &Fingerprint{JA3: "e7d705a3286e19ea42f587b344ee6865", JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1"}
+
+	cases := []struct {
+		fp          *Fingerprint
+		allow, deny []string
+		want        bool
+	}{
+		{fp, nil, nil, true},
+		{fp, nil, []string{"E7D705A3286E19EA42F587B344EE6865"}, false},
+		{fp, []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"}, nil, true},
+		{fp, []string{"t13d1516h2_000000000000_000000000000"}, nil, false},
+		{nil, []string{fp.JA4}, nil, false},
+		{nil, nil, []string{fp.JA4}, true},
+	}
+	for i, c := range cases {
+		if got := Allowed(c.fp, c.allow, c.deny); got != c.want {
+			t.Errorf("Case %d: expected %v, got %v", i, c.want, got)
+		}
+	}
+}
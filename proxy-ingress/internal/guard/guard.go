@@ -0,0 +1,211 @@
+// Package guard protects the ingress listeners from oversized request
+// bodies and from slow clients holding connections open.
+package guard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrBodyTooLarge is returned once a request body exceeds its limit
+	ErrBodyTooLarge = errors.New("request body too large")
+	// ErrSlowBody is returned when a request body falls below the minimum rate
+	ErrSlowBody = errors.New("request body sent too slowly")
+)
+
+// Config holds the request limits
+type Config struct {
+	MaxBodySize       int64         // For routes without their own limit, 0 for none
+	MinBodyRate       int64         // Bytes per second a request body must keep up, 0 disables
+	BodyRateGrace     time.Duration // Before the minimum rate applies
+	ReadHeaderTimeout time.Duration // Time the server allows for request headers
+}
+
+// Stats counts rejected requests and slow clients
+type Stats struct {
+	BodyTooLarge uint64
+	SlowBodies   uint64
+	SlowHeaders  uint64
+}
+
+// Guard enforces body limits and detects slow clients
+type Guard struct {
+	config Config
+
+	conns sync.Map // net.Conn to *connInfo
+
+	bodyTooLarge uint64
+	slowBodies   uint64
+	slowHeaders  uint64
+
+	now func() time.Time
+}
+
+// New creates a guard
+func New(config Config) *Guard {
+	return &Guard{config: config, now: time.Now}
+}
+
+// Protect installs the guard's connection tracking on server, which must
+// already have its handler. Hooks already set on server still run. A
+// connection closed after the header timeout without its request reaching
+// the handler counts as a slow client.
+func (g *Guard) Protect(server *http.Server) {
+	next := server.Handler
+	nextState := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		g.connState(conn, state)
+		if nextState != nil {
+			nextState(conn, state)
+		}
+	}
+	nextContext := server.ConnContext
+	server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if nextContext != nil {
+			ctx = nextContext(ctx, conn)
+		}
+		return context.WithValue(ctx, connKey{}, conn)
+	}
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+			if v, ok := g.conns.Load(conn); ok {
+				v.(*connInfo).served.Store(true)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type connKey struct{}
+
+// connInfo tracks when a connection started waiting for a request and
+// whether its last request reached the handler
+type connInfo struct {
+	since  atomic.Int64 // Unix nanoseconds
+	served atomic.Bool
+}
+
+func (g *Guard) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		info := &connInfo{}
+		info.since.Store(g.now().UnixNano())
+		g.conns.Store(conn, info)
+	case http.StateActive:
+		// The server reports a connection active once the request is read
+		// or its header timeout fires, so the wait runs from New or Idle
+		if v, ok := g.conns.Load(conn); ok {
+			v.(*connInfo).served.Store(false)
+		}
+	case http.StateIdle:
+		if v, ok := g.conns.Load(conn); ok {
+			info := v.(*connInfo)
+			info.since.Store(g.now().UnixNano())
+			info.served.Store(true)
+		}
+	case http.StateHijacked:
+		g.conns.Delete(conn)
+	case http.StateClosed:
+		v, ok := g.conns.LoadAndDelete(conn)
+		if !ok || g.config.ReadHeaderTimeout <= 0 {
+			return
+		}
+		info := v.(*connInfo)
+		waited := g.now().Sub(time.Unix(0, info.since.Load()))
+		if !info.served.Load() && waited >= g.config.ReadHeaderTimeout {
+			atomic.AddUint64(&g.slowHeaders, 1)
+			logrus.Debugf("Closed connection from %s that did not send request headers in time", conn.RemoteAddr())
+		}
+	}
+}
+
+// LimitBody applies limit, or the default when limit is 0, to the request
+// body along with the minimum body rate. Requests whose Content-Length is
+// already over the limit get ErrBodyTooLarge; otherwise reads from r.Body
+// fail with ErrBodyTooLarge or ErrSlowBody once a limit is crossed.
+func (g *Guard) LimitBody(w http.ResponseWriter, r *http.Request, limit int64) error {
+	if limit <= 0 {
+		limit = g.config.MaxBodySize
+	}
+	if limit > 0 && r.ContentLength > limit {
+		atomic.AddUint64(&g.bodyTooLarge, 1)
+		return ErrBodyTooLarge
+	}
+	if r.Body == nil || r.Body == http.NoBody || (limit <= 0 && g.config.MinBodyRate <= 0) {
+		return nil
+	}
+
+	r.Body = &body{
+		ReadCloser: r.Body,
+		guard:      g,
+		limit:      limit,
+		controller: http.NewResponseController(w),
+		start:      g.now(),
+	}
+	return nil
+}
+
+// Stats returns the counters
+func (g *Guard) Stats() Stats {
+	return Stats{
+		BodyTooLarge: atomic.LoadUint64(&g.bodyTooLarge),
+		SlowBodies:   atomic.LoadUint64(&g.slowBodies),
+		SlowHeaders:  atomic.LoadUint64(&g.slowHeaders),
+	}
+}
+
+// body is a request body under a size limit and minimum rate. The rate is
+// enforced with connection read deadlines, so a stalled client is cut off
+// rather than detected on its next read.
+type body struct {
+	io.ReadCloser
+	guard      *Guard
+	limit      int64
+	controller *http.ResponseController
+	start      time.Time
+	read       int64
+	err        error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if rate := b.guard.config.MinBodyRate; rate > 0 {
+		due := b.start.Add(b.guard.config.BodyRateGrace + time.Duration(b.read+1)*time.Second/time.Duration(rate))
+		b.controller.SetReadDeadline(due)
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	if b.limit > 0 && b.read > b.limit {
+		n -= int(b.read - b.limit)
+		b.read = b.limit
+		b.err = ErrBodyTooLarge
+		atomic.AddUint64(&b.guard.bodyTooLarge, 1)
+		return n, b.err
+	}
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		b.err = ErrSlowBody
+		atomic.AddUint64(&b.guard.slowBodies, 1)
+		return n, b.err
+	}
+	if err == io.EOF && b.guard.config.MinBodyRate > 0 {
+		// A deadline left behind would fail the server's background read
+		// and cancel the request while the response is proxied
+		b.controller.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package guard
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs handler behind a guard and returns the server URL
+func serve(t *testing.T, g *Guard, limit int64, handler func(error, []byte, error)) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limitErr := g.LimitBody(w, r, limit)
+		var data []byte
+		var readErr error
+		if limitErr == nil {
+			data, readErr = io.ReadAll(r.Body)
+		}
+		handler(limitErr, data, readErr)
+	}))
+	server.Config.ReadHeaderTimeout = g.config.ReadHeaderTimeout
+	g.Protect(server.Config)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBodyLimits(t *testing.T) {
+	g := New(Config{MaxBodySize: 8})
+	results := make(chan error, 1)
+	server := serve(t, g, 0, func(limitErr error, _ []byte, readErr error) {
+		if limitErr != nil {
+			results <- limitErr
+		} else {
+			results <- readErr
+		}
+	})
+
+	http.Post(server.URL, "text/plain", strings.NewReader("0123456789"))
+	if err := <-results; !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("Expected Content-Length over the limit to be rejected, got %v", err)
+	}
+
+	// A chunked body has no Content-Length, so the limit applies on read
+	http.Post(server.URL, "text/plain", io.MultiReader(strings.NewReader("01234"), strings.NewReader("56789")))
+	if err := <-results; !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("Expected a chunked body over the limit to fail, got %v", err)
+	}
+
+	http.Post(server.URL, "text/plain", strings.NewReader("01234567"))
+	if err := <-results; err != nil {
+		t.Errorf("Expected a body at the limit to pass, got %v", err)
+	}
+
+	if stats := g.Stats(); stats.BodyTooLarge != 2 {
+		t.Errorf("Expected 2 oversized bodies, got %+v", stats)
+	}
+}
+
+func TestSlowBodyIsAborted(t *testing.T) {
+	g := New(Config{MinBodyRate: 100, BodyRateGrace: 50 * time.Millisecond})
+	results := make(chan error, 1)
+	server := serve(t, g, 0, func(_ error, _ []byte, readErr error) {
+		results <- readErr
+	})
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 1000\r\n\r\n0123456789")
+
+	select {
+	case err := <-results:
+		if !errors.Is(err, ErrSlowBody) {
+			t.Errorf("Expected ErrSlowBody, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stalled body was not aborted")
+	}
+
+	if stats := g.Stats(); stats.SlowBodies != 1 {
+		t.Errorf("Expected 1 slow body, got %+v", stats)
+	}
+}
+
+func TestSlowHeadersAreCounted(t *testing.T) {
+	g := New(Config{ReadHeaderTimeout: 100 * time.Millisecond})
+	server := serve(t, g, 0, func(error, []byte, error) {})
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: te")
+
+	// The server closes the connection once the header timeout passes
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(conn)
+
+	deadline := time.Now().Add(time.Second)
+	for g.Stats().SlowHeaders == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := g.Stats(); stats.SlowHeaders != 1 {
+		t.Errorf("Expected 1 slow header client, got %+v", stats)
+	}
+
+	if _, err := http.Get(server.URL); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if stats := g.Stats(); stats.SlowHeaders != 1 {
+		t.Errorf("Expected a normal request not to count, got %+v", stats)
+	}
+}
@@ -38,6 +38,18 @@ type HealthConfig struct {
 	RetryDelay         time.Duration
 	EnableMTLSChecks   bool
 	MTLSConfig         MTLSCheckConfig
+	StartupJitter      time.Duration                 // First checks are spread over this window, default CheckInterval
+	MaxBackoff         time.Duration                 // Upper bound for the backoff of failing backends
+	Backends           map[string]BackendCheckConfig // Per-backend overrides keyed by backend name
+	GRPCServices       []string                      // Services asked by gRPC checks, default the whole server
+	PassiveThreshold   int                           // Live traffic failures within PassiveWindow that eject a backend, 0 disables
+	PassiveWindow      time.Duration                 // Window for counting live traffic failures
+	SlowStartWindow    time.Duration                 // Added and recovered backends ramp up to their weight over this, 0 disables
+	SlowStartCurve     string                        // SlowStartLinear or SlowStartExponential, linear when empty
+	SlowStartMinWeight float64                       // Share of its weight a ramping backend starts at, default 0.1
+	Zone               string                        // The proxy's zone, preferring backends in it
+	Region             string                        // The proxy's region, locality routing is off without it or Zone
+	SpillThreshold     float64                       // Share of a locality's weight available before requests spill to the next, default 0.7
 }
 
 type MTLSCheckConfig struct {
@@ -62,6 +74,13 @@ type BackendHealth struct {
 	Metadata           map[string]interface{}
 	SSLCertExpiry      time.Time
 	SSLCertValid       bool
+	NextCheck          time.Time
+	GRPCServices       map[string]string // Serving status per gRPC service from the last gRPC check
+	PassiveFailures    uint64            // Failures reported from live traffic
+	LastEjection       time.Time         // When live traffic failures last ejected the backend
+	WarmingSince       time.Time         // When the backend was added or last recovered, for slow-start
+	passiveFailures    []time.Time
+	stop               chan struct{}
 }
 
 type VirtualHostHealth struct {
@@ -79,14 +98,18 @@ type VirtualHostHealth struct {
 }
 
 type Backend struct {
-	Name      string
-	Host      string
-	Port      int
-	Scheme    string
-	Path      string
-	Weight    int
-	MaxConns  int
-	Headers   map[string]string
+	Name       string
+	Host       string
+	Port       int
+	Scheme     string
+	Path       string
+	Weight     int
+	MaxConns   int
+	Headers    map[string]string
+	HealthPath   string   // Path probed by HTTP checks instead of the check default
+	GRPCServices []string // Services asked by gRPC checks instead of the check default
+	Zone         string   // Zone the backend runs in, for locality routing
+	Region       string   // Region the backend runs in
 }
 
 type VirtualHost struct {
@@ -136,6 +159,11 @@ type ProbeConfig struct {
 	Timeout  time.Duration
 	Headers  map[string]string
 	Expected ProbeExpected
+	Command  string     // Executable run by exec probes
+	Args     []string   // Arguments passed to Command
+	Env      []string   // Extra KEY=value pairs; the proxy's environment is not inherited
+	Dir      string     // Working directory of Command
+	Limits   ExecLimits // Resource limits for Command
 }
 
 type ProbeType string
@@ -148,10 +176,12 @@ const (
 )
 
 type ProbeExpected struct {
-	StatusCode int
-	Body       string
-	Headers    map[string]string
-	Timeout    time.Duration
+	StatusCode    int
+	Body          string
+	Headers       map[string]string
+	Timeout       time.Duration
+	ExitCode      int    // Exit code exec probes must return
+	OutputPattern string // Regular expression exec probe output must match
 }
 
 type ProbeResult struct {
@@ -174,6 +204,7 @@ type HealthMetrics struct {
 	StatusChanges     uint64
 	MTLSHandshakes    uint64
 	SSLCertFailures   uint64
+	PassiveEjections  uint64
 	mutex             sync.RWMutex
 }
 
@@ -228,16 +259,6 @@ type LivenessProbe struct {
 }
 
 func NewHealthChecker(config HealthConfig) *HealthChecker {
-	hc := &HealthChecker{
-		config:   config,
-		backends: make(map[string]*BackendHealth),
-		vhosts:   make(map[string]*VirtualHostHealth),
-		checks:   make(map[string]HealthCheck),
-		probes:   make(map[string]Probe),
-		metrics:  &HealthMetrics{},
-		stopChan: make(chan struct{}),
-	}
-
 	if config.CheckInterval == 0 {
 		config.CheckInterval = 30 * time.Second
 	}
@@ -250,6 +271,28 @@ func NewHealthChecker(config HealthConfig) *HealthChecker {
 	if config.UnhealthyThreshold == 0 {
 		config.UnhealthyThreshold = 3
 	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.PassiveWindow == 0 {
+		config.PassiveWindow = defaultPassiveWindow
+	}
+	if config.SlowStartMinWeight <= 0 || config.SlowStartMinWeight > 1 {
+		config.SlowStartMinWeight = defaultSlowStartMinWeight
+	}
+	if config.SpillThreshold <= 0 || config.SpillThreshold > 1 {
+		config.SpillThreshold = defaultLocalitySpillThreshold
+	}
+
+	hc := &HealthChecker{
+		config:   config,
+		backends: make(map[string]*BackendHealth),
+		vhosts:   make(map[string]*VirtualHostHealth),
+		checks:   make(map[string]HealthCheck),
+		probes:   make(map[string]Probe),
+		metrics:  &HealthMetrics{},
+		stopChan: make(chan struct{}),
+	}
 
 	hc.initializeDefaultChecks()
 	hc.initializeProbes()
@@ -270,6 +313,9 @@ func (hc *HealthChecker) initializeDefaultChecks() {
 	sslCertCheck := NewSSLCertCheck("ssl_cert")
 	hc.checks["ssl_cert"] = sslCertCheck
 
+	grpcCheck := NewGRPCHealthCheck("grpc", hc.config.GRPCServices)
+	hc.checks["grpc"] = grpcCheck
+
 	if hc.config.EnableMTLSChecks {
 		mtlsCheck := NewMTLSHealthCheck("mtls", hc.config.MTLSConfig, HTTPExpected{
 			StatusCodes: []int{200, 201, 202, 204},
@@ -292,6 +338,9 @@ func (hc *HealthChecker) initializeProbes() {
 		case ProbeTypeTCP:
 			probe := NewLivenessProbe(name, config)
 			hc.probes[name] = probe
+		case ProbeTypeExec:
+			probe := NewExecProbe(name, config)
+			hc.probes[name] = probe
 		case ProbeTypeMTLS:
 			if hc.config.EnableMTLSChecks {
 				probe := NewMTLSProbe(name, config)
@@ -305,12 +354,29 @@ func (hc *HealthChecker) AddBackend(backend *Backend) {
 	hc.mutex.Lock()
 	defer hc.mutex.Unlock()
 
+	hc.addBackendLocked(backend)
+}
+
+// addBackendLocked registers a backend and, when the checker is running,
+// starts its check schedule. Callers hold hc.mutex.
+func (hc *HealthChecker) addBackendLocked(backend *Backend) {
 	key := fmt.Sprintf("%s-%s:%d", backend.Name, backend.Host, backend.Port)
-	hc.backends[key] = &BackendHealth{
-		Backend:   backend,
-		Status:    StatusUnknown,
-		LastCheck: time.Time{},
-		Metadata:  make(map[string]interface{}),
+	if _, exists := hc.backends[key]; exists {
+		return
+	}
+
+	backendHealth := &BackendHealth{
+		Backend:      backend,
+		Status:       StatusUnknown,
+		LastCheck:    time.Time{},
+		Metadata:     make(map[string]interface{}),
+		WarmingSince: time.Now(),
+		stop:         make(chan struct{}),
+	}
+	hc.backends[key] = backendHealth
+
+	if hc.running {
+		hc.scheduleBackend(key, backendHealth)
 	}
 }
 
@@ -319,7 +385,10 @@ func (hc *HealthChecker) RemoveBackend(backend *Backend) {
 	defer hc.mutex.Unlock()
 
 	key := fmt.Sprintf("%s-%s:%d", backend.Name, backend.Host, backend.Port)
-	delete(hc.backends, key)
+	if backendHealth, exists := hc.backends[key]; exists {
+		close(backendHealth.stop)
+		delete(hc.backends, key)
+	}
 }
 
 func (hc *HealthChecker) AddVirtualHost(vhost *VirtualHost) {
@@ -335,7 +404,7 @@ func (hc *HealthChecker) AddVirtualHost(vhost *VirtualHost) {
 	}
 
 	for _, backend := range vhost.Backends {
-		hc.AddBackend(backend)
+		hc.addBackendLocked(backend)
 	}
 }
 
@@ -385,7 +454,10 @@ func (hc *HealthChecker) Start() error {
 	}
 
 	hc.running = true
-	go hc.checkLoop()
+	hc.stopChan = make(chan struct{})
+	for key, backendHealth := range hc.backends {
+		hc.scheduleBackend(key, backendHealth)
+	}
 
 	return nil
 }
@@ -404,51 +476,18 @@ func (hc *HealthChecker) Stop() error {
 	return nil
 }
 
-func (hc *HealthChecker) checkLoop() {
-	ticker := time.NewTicker(hc.config.CheckInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			hc.performHealthChecks()
-		case <-hc.stopChan:
-			return
-		}
-	}
-}
-
-func (hc *HealthChecker) performHealthChecks() {
-	var wg sync.WaitGroup
-
-	// Check backends
-	hc.mutex.RLock()
-	backends := make(map[string]*BackendHealth)
-	for k, v := range hc.backends {
-		backends[k] = v
-	}
-	hc.mutex.RUnlock()
-
-	for key, backendHealth := range backends {
-		wg.Add(1)
-		go func(k string, bh *BackendHealth) {
-			defer wg.Done()
-			hc.checkBackend(k, bh)
-		}(key, backendHealth)
+func (hc *HealthChecker) checkBackend(key string, backendHealth *BackendHealth) {
+	override := hc.config.Backends[backendHealth.Backend.Name]
+	timeout := hc.config.Timeout
+	if override.Timeout > 0 {
+		timeout = override.Timeout
 	}
 
-	wg.Wait()
-
-	// Update virtual host health based on backend health
-	hc.updateVirtualHostHealth()
-}
-
-func (hc *HealthChecker) checkBackend(key string, backendHealth *BackendHealth) {
-	ctx, cancel := context.WithTimeout(context.Background(), hc.config.Timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	start := time.Now()
-	result := hc.executeChecks(ctx, backendHealth.Backend)
+	result := hc.executeChecks(ctx, override.target(backendHealth.Backend), hc.enabledChecks(override))
 	duration := time.Since(start)
 
 	hc.mutex.Lock()
@@ -476,38 +515,53 @@ func (hc *HealthChecker) checkBackend(key string, backendHealth *BackendHealth)
 	if newStatus != oldStatus {
 		backendHealth.Status = newStatus
 		backendHealth.LastStatusChange = time.Now()
+		if oldStatus == StatusUnhealthy {
+			// Back in service, ramp up again
+			backendHealth.WarmingSince = backendHealth.LastStatusChange
+		}
 		hc.metrics.recordStatusChange()
 		hc.notifyStatusChange(backendHealth, oldStatus, newStatus)
 	}
 
 	if result.Metadata != nil {
 		backendHealth.Metadata = result.Metadata
+		if statuses, ok := result.Metadata["grpc_services"].(map[string]string); ok {
+			backendHealth.GRPCServices = statuses
+		}
 	}
 
 	hc.metrics.recordCheck(duration)
 	hc.updateBackendCounts()
 }
 
-func (hc *HealthChecker) executeChecks(ctx context.Context, backend *Backend) *CheckResult {
+func (hc *HealthChecker) executeChecks(ctx context.Context, backend *Backend, enabledChecks []string) *CheckResult {
 	var lastResult *CheckResult
+	metadata := make(map[string]interface{})
+
+	// run executes one check and reports whether the remaining checks can
+	// be skipped. Metadata from every check that ran is kept on the result.
+	run := func(check HealthCheck) bool {
+		result := check.Check(ctx, backend)
+		for key, value := range result.Metadata {
+			metadata[key] = value
+		}
+		lastResult = result
+		return result.Status == StatusUnhealthy
+	}
 
-	for _, checkName := range hc.config.EnabledChecks {
+	for _, checkName := range enabledChecks {
 		if checkName == "all" {
 			for _, check := range hc.checks {
-				if check.Enabled() {
-					result := check.Check(ctx, backend)
-					if result.Status == StatusUnhealthy {
-						return result
-					}
-					lastResult = result
+				if check.Enabled() && run(check) {
+					lastResult.Metadata = metadata
+					return lastResult
 				}
 			}
 		} else if check, exists := hc.checks[checkName]; exists && check.Enabled() {
-			result := check.Check(ctx, backend)
-			if result.Status == StatusUnhealthy {
-				return result
+			if run(check) {
+				lastResult.Metadata = metadata
+				return lastResult
 			}
-			lastResult = result
 		}
 	}
 
@@ -518,12 +572,17 @@ func (hc *HealthChecker) executeChecks(ctx context.Context, backend *Backend) *C
 		}
 	}
 
+	if len(metadata) > 0 {
+		lastResult.Metadata = metadata
+	}
 	return lastResult
 }
 
 func (hc *HealthChecker) determineHealthStatus(backendHealth *BackendHealth, result *CheckResult) HealthStatus {
 	if result.Status == StatusUnhealthy {
-		if backendHealth.ConsecutiveFailures >= hc.config.UnhealthyThreshold {
+		// A failed check never improves a backend that is already out,
+		// including one ejected by live traffic failures
+		if backendHealth.Status == StatusUnhealthy || backendHealth.ConsecutiveFailures >= hc.config.UnhealthyThreshold {
 			return StatusUnhealthy
 		}
 		return StatusDegraded
@@ -667,6 +726,13 @@ func (hc *HealthChecker) GetSystemHealth() *SystemHealth {
 			ErrorMessage:         backendHealth.ErrorMessage,
 			SSLCertExpiry:        backendHealth.SSLCertExpiry,
 			SSLCertValid:         backendHealth.SSLCertValid,
+			NextCheck:            backendHealth.NextCheck,
+			GRPCServices:         backendHealth.GRPCServices,
+			PassiveFailures:      backendHealth.PassiveFailures,
+			LastEjection:         backendHealth.LastEjection,
+			WarmingSince:         backendHealth.WarmingSince,
+			EffectiveWeight:      hc.effectiveWeight(backendHealth, systemHealth.Timestamp),
+			Locality:             hc.Locality(backendHealth.Backend),
 		}
 
 		systemHealth.Backends[key] = summary
@@ -746,6 +812,7 @@ func (hc *HealthChecker) getMetricsSummary() MetricsSummary {
 		StatusChanges:     hc.metrics.StatusChanges,
 		MTLSHandshakes:    hc.metrics.MTLSHandshakes,
 		SSLCertFailures:   hc.metrics.SSLCertFailures,
+		PassiveEjections:  hc.metrics.PassiveEjections,
 	}
 }
 
@@ -759,13 +826,20 @@ type SystemHealth struct {
 }
 
 type BackendHealthSummary struct {
-	Status              HealthStatus  `json:"status"`
-	LastCheck           time.Time     `json:"last_check"`
-	ConsecutiveFailures int           `json:"consecutive_failures"`
-	ResponseTime        time.Duration `json:"response_time"`
-	ErrorMessage        string        `json:"error_message,omitempty"`
-	SSLCertExpiry       time.Time     `json:"ssl_cert_expiry,omitempty"`
-	SSLCertValid        bool          `json:"ssl_cert_valid"`
+	Status              HealthStatus      `json:"status"`
+	LastCheck           time.Time         `json:"last_check"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	ResponseTime        time.Duration     `json:"response_time"`
+	ErrorMessage        string            `json:"error_message,omitempty"`
+	SSLCertExpiry       time.Time         `json:"ssl_cert_expiry,omitempty"`
+	SSLCertValid        bool              `json:"ssl_cert_valid"`
+	NextCheck           time.Time         `json:"next_check"`
+	GRPCServices        map[string]string `json:"grpc_services,omitempty"`
+	PassiveFailures     uint64            `json:"passive_failures"`
+	LastEjection        time.Time         `json:"last_ejection,omitempty"`
+	WarmingSince        time.Time         `json:"warming_since"`
+	EffectiveWeight     float64           `json:"effective_weight"`
+	Locality            string            `json:"locality,omitempty"`
 }
 
 type VirtualHostHealthSummary struct {
@@ -793,6 +867,7 @@ type MetricsSummary struct {
 	StatusChanges     uint64        `json:"status_changes"`
 	MTLSHandshakes    uint64        `json:"mtls_handshakes"`
 	SSLCertFailures   uint64        `json:"ssl_cert_failures"`
+	PassiveEjections  uint64        `json:"passive_ejections"`
 }
 
 // Health check implementations
@@ -823,7 +898,11 @@ func (hc *HTTPHealthCheck) Check(ctx context.Context, target interface{}) *Check
 		}
 	}
 
-	url := fmt.Sprintf("%s://%s:%d%s", backend.Scheme, backend.Host, backend.Port, hc.path)
+	path := hc.path
+	if backend.HealthPath != "" {
+		path = backend.HealthPath
+	}
+	url := fmt.Sprintf("%s://%s:%d%s", backend.Scheme, backend.Host, backend.Port, path)
 
 	req, err := http.NewRequestWithContext(ctx, hc.method, url, nil)
 	if err != nil {
@@ -908,7 +987,11 @@ func (mc *MTLSHealthCheck) Check(ctx context.Context, target interface{}) *Check
 		}
 	}
 
-	url := fmt.Sprintf("https://%s:%d%s", backend.Host, backend.Port, mc.path)
+	path := mc.path
+	if backend.HealthPath != "" {
+		path = backend.HealthPath
+	}
+	url := fmt.Sprintf("https://%s:%d%s", backend.Host, backend.Port, path)
 
 	req, err := http.NewRequestWithContext(ctx, mc.method, url, nil)
 	if err != nil {
@@ -1128,4 +1211,10 @@ func (hm *HealthMetrics) recordSSLCertFailure() {
 	hm.mutex.Lock()
 	defer hm.mutex.Unlock()
 	hm.SSLCertFailures++
-}
\ No newline at end of file
+}
+
+func (hm *HealthMetrics) recordPassiveEjection() {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	hm.PassiveEjections++
+}
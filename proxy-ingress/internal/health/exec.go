@@ -0,0 +1,209 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultExecKillAfter is how long a probe command may run after SIGTERM
+	// before its process group is killed
+	defaultExecKillAfter = 2 * time.Second
+
+	// defaultExecMaxOutput caps the combined stdout and stderr kept per run
+	defaultExecMaxOutput = 64 * 1024
+
+	// execPath is the PATH given to probe commands, which do not inherit
+	// the proxy's environment
+	execPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// ExecLimits bounds the resources an exec probe command may use. Zero
+// values leave the corresponding limit unset.
+type ExecLimits struct {
+	CPUTime        time.Duration // RLIMIT_CPU, rounded up to whole seconds
+	MemoryBytes    uint64        // RLIMIT_AS
+	MaxProcesses   uint64        // RLIMIT_NPROC, counted per user
+	MaxOpenFiles   uint64        // RLIMIT_NOFILE
+	MaxOutputBytes int           // Output kept for matching, default 64 KiB
+	KillAfter      time.Duration // Grace period after SIGTERM, default 2s
+}
+
+// ExecProbe runs a command and judges health from its exit code and output.
+// The command runs in its own process group with a minimal environment and
+// the configured resource limits, and the whole group is killed when the
+// probe finishes or times out.
+type ExecProbe struct {
+	name    string
+	config  ProbeConfig
+	pattern *regexp.Regexp
+	err     error
+}
+
+func NewExecProbe(name string, config ProbeConfig) *ExecProbe {
+	probe := &ExecProbe{name: name, config: config}
+
+	if config.Command == "" {
+		probe.err = fmt.Errorf("exec probe %s has no command", name)
+	} else if config.Expected.OutputPattern != "" {
+		probe.pattern, probe.err = regexp.Compile(config.Expected.OutputPattern)
+		if probe.err != nil {
+			probe.err = fmt.Errorf("exec probe %s has an invalid output pattern: %w", name, probe.err)
+		}
+	}
+
+	return probe
+}
+
+func (ep *ExecProbe) Name() string           { return ep.name }
+func (ep *ExecProbe) GetConfig() ProbeConfig { return ep.config }
+
+func (ep *ExecProbe) Execute(ctx context.Context) *ProbeResult {
+	if ep.err != nil {
+		return &ProbeResult{Status: StatusUnhealthy, Error: ep.err, Message: "Exec probe misconfigured"}
+	}
+
+	if ep.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ep.config.Timeout)
+		defer cancel()
+	}
+
+	limits := ep.config.Limits
+	killAfter := limits.KillAfter
+	if killAfter <= 0 {
+		killAfter = defaultExecKillAfter
+	}
+	maxOutput := limits.MaxOutputBytes
+	if maxOutput <= 0 {
+		maxOutput = defaultExecMaxOutput
+	}
+
+	output := &limitedBuffer{limit: maxOutput}
+	cmd := exec.CommandContext(ctx, ep.config.Command, ep.config.Args...)
+	cmd.Env = append([]string{execPath}, ep.config.Env...)
+	cmd.Dir = ep.config.Dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Cancel = func() error { return signalGroup(cmd, false) }
+	cmd.WaitDelay = killAfter
+	configureExecSandbox(cmd)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return &ProbeResult{Status: StatusUnhealthy, Error: err, Message: "Exec probe failed to start"}
+	}
+
+	if err := applyExecLimits(cmd.Process.Pid, limits); err != nil {
+		signalGroup(cmd, true)
+		cmd.Wait()
+		return &ProbeResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: time.Since(start),
+			Error:        err,
+			Message:      "Exec probe resource limits could not be applied",
+		}
+	}
+
+	err := cmd.Wait()
+	responseTime := time.Since(start)
+
+	// Descendants that outlived the command would otherwise leak
+	signalGroup(cmd, true)
+
+	data := map[string]interface{}{
+		"output": output.String(),
+	}
+
+	if ctx.Err() != nil {
+		return &ProbeResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: responseTime,
+			Error:        fmt.Errorf("exec probe %s timed out: %w", ep.name, ctx.Err()),
+			Message:      "Exec probe timed out",
+			Data:         data,
+		}
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return &ProbeResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: responseTime,
+			Error:        err,
+			Message:      "Exec probe failed",
+			Data:         data,
+		}
+	}
+
+	exitCode := cmd.ProcessState.ExitCode()
+	data["exit_code"] = exitCode
+
+	if exitCode != ep.config.Expected.ExitCode {
+		return &ProbeResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: responseTime,
+			Error:        fmt.Errorf("unexpected exit code: %d", exitCode),
+			Message:      "Exec probe exit code mismatch",
+			Data:         data,
+		}
+	}
+
+	if ep.pattern != nil && !ep.pattern.MatchString(output.String()) {
+		return &ProbeResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: responseTime,
+			Error:        fmt.Errorf("output does not match %q", ep.config.Expected.OutputPattern),
+			Message:      "Exec probe output mismatch",
+			Data:         data,
+		}
+	}
+
+	return &ProbeResult{
+		Status:       StatusHealthy,
+		ResponseTime: responseTime,
+		Message:      "Exec probe passed",
+		Data:         data,
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written and discards the rest
+// so a chatty command cannot exhaust the proxy's memory
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+	mutex     sync.Mutex
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	output := strings.TrimSpace(b.buf.String())
+	if b.truncated {
+		output += " [truncated]"
+	}
+	return output
+}
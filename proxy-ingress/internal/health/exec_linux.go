@@ -0,0 +1,71 @@
+package health
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// configureExecSandbox starts the command in its own process group so the
+// command and everything it spawns can be signalled together
+func configureExecSandbox(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends SIGTERM, or SIGKILL when kill is set, to the command's
+// process group
+func signalGroup(cmd *exec.Cmd, kill bool) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	err := syscall.Kill(-cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// applyExecLimits sets the resource limits of a started command with
+// prlimit(2). They take effect as soon as the command has been started.
+func applyExecLimits(pid int, limits ExecLimits) error {
+	if limits.CPUTime > 0 {
+		seconds := uint64((limits.CPUTime + 999999999) / 1000000000)
+		if err := prlimit(pid, syscall.RLIMIT_CPU, seconds); err != nil {
+			return fmt.Errorf("failed to limit CPU time: %w", err)
+		}
+	}
+	if limits.MemoryBytes > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, limits.MemoryBytes); err != nil {
+			return fmt.Errorf("failed to limit memory: %w", err)
+		}
+	}
+	if limits.MaxProcesses > 0 {
+		// RLIMIT_NPROC is not exported by the syscall package
+		const rlimitNproc = 6
+		if err := prlimit(pid, rlimitNproc, limits.MaxProcesses); err != nil {
+			return fmt.Errorf("failed to limit processes: %w", err)
+		}
+	}
+	if limits.MaxOpenFiles > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_NOFILE, limits.MaxOpenFiles); err != nil {
+			return fmt.Errorf("failed to limit open files: %w", err)
+		}
+	}
+	return nil
+}
+
+// prlimit sets both the soft and hard limit of resource for pid
+func prlimit(pid, resource int, value uint64) error {
+	limit := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package health
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// configureExecSandbox is a no-op; process groups are only used on Linux
+func configureExecSandbox(cmd *exec.Cmd) {}
+
+// signalGroup stops the command itself, as it has no process group of its own
+func signalGroup(cmd *exec.Cmd, kill bool) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+// applyExecLimits rejects resource limits, which are only supported on Linux
+func applyExecLimits(pid int, limits ExecLimits) error {
+	if limits.CPUTime > 0 || limits.MemoryBytes > 0 || limits.MaxProcesses > 0 || limits.MaxOpenFiles > 0 {
+		return fmt.Errorf("exec probe resource limits are only supported on Linux")
+	}
+	return nil
+}
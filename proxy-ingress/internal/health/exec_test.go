@@ -0,0 +1,118 @@
+//go:build linux
+
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ProbeConfig
+		want   HealthStatus
+	}{
+		{
+			name: "exit code and output match",
+			config: ProbeConfig{
+				Command:  "/bin/sh",
+				Args:     []string{"-c", "echo replication lag 0s"},
+				Expected: ProbeExpected{OutputPattern: `lag 0s`},
+			},
+			want: StatusHealthy,
+		},
+		{
+			name: "expected non-zero exit code",
+			config: ProbeConfig{
+				Command:  "/bin/sh",
+				Args:     []string{"-c", "exit 3"},
+				Expected: ProbeExpected{ExitCode: 3},
+			},
+			want: StatusHealthy,
+		},
+		{
+			name:   "unexpected exit code",
+			config: ProbeConfig{Command: "/bin/sh", Args: []string{"-c", "exit 1"}},
+			want:   StatusUnhealthy,
+		},
+		{
+			name: "output mismatch",
+			config: ProbeConfig{
+				Command:  "/bin/sh",
+				Args:     []string{"-c", "echo degraded"},
+				Expected: ProbeExpected{OutputPattern: `^ok$`},
+			},
+			want: StatusUnhealthy,
+		},
+		{
+			name:   "missing command",
+			config: ProbeConfig{Command: "/nonexistent/probe"},
+			want:   StatusUnhealthy,
+		},
+		{
+			name:   "invalid pattern",
+			config: ProbeConfig{Command: "/bin/true", Expected: ProbeExpected{OutputPattern: `(`}},
+			want:   StatusUnhealthy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := NewExecProbe("exec", tt.config).Execute(context.Background())
+			if result.Status != tt.want {
+				t.Errorf("status = %s (%v), want %s", result.Status, result.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecProbeTimeoutKillsProcessGroup(t *testing.T) {
+	probe := NewExecProbe("slow", ProbeConfig{
+		Command: "/bin/sh",
+		// The background sleep keeps the output pipe open after sh exits
+		Args:    []string{"-c", "trap '' TERM; sleep 30 & sleep 30"},
+		Timeout: 100 * time.Millisecond,
+		Limits:  ExecLimits{KillAfter: 100 * time.Millisecond},
+	})
+
+	start := time.Now()
+	result := probe.Execute(context.Background())
+	if result.Status != StatusUnhealthy {
+		t.Errorf("status = %s, want unhealthy", result.Status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("probe took %v, want it killed shortly after the timeout", elapsed)
+	}
+}
+
+func TestExecProbeAppliesLimitsAndCapsOutput(t *testing.T) {
+	probe := NewExecProbe("limits", ProbeConfig{
+		Command:  "/bin/sh",
+		Args:     []string{"-c", "sleep 0.2; ulimit -n; ulimit -t; head -c 4096 /dev/zero | tr '\\0' x"},
+		Expected: ProbeExpected{OutputPattern: `^32\n7\n`},
+		Limits:   ExecLimits{MaxOpenFiles: 32, CPUTime: 6500 * time.Millisecond, MaxOutputBytes: 64},
+	})
+
+	result := probe.Execute(context.Background())
+	if result.Status != StatusHealthy {
+		t.Fatalf("status = %s (%v), output %q", result.Status, result.Error, result.Data["output"])
+	}
+	if output := result.Data["output"].(string); len(output) > 64+len(" [truncated]") {
+		t.Errorf("output length %d exceeds the cap", len(output))
+	}
+}
+
+func TestExecProbeRegisteredFromConfig(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{
+		EnableProbes: true,
+		ProbeEndpoints: map[string]ProbeConfig{
+			"script": {Type: ProbeTypeExec, Command: "/bin/true"},
+		},
+	})
+
+	if result := hc.ExecuteProbe("script"); result.Status != StatusHealthy {
+		t.Errorf("status = %s (%v), want healthy", result.Status, result.Error)
+	}
+}
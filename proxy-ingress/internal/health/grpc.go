@@ -0,0 +1,143 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCHealthCheck probes backends with the grpc.health.v1 protocol. An
+// empty service name asks for the overall health of the server.
+type GRPCHealthCheck struct {
+	name     string
+	enabled  bool
+	timeout  time.Duration
+	services []string
+}
+
+func NewGRPCHealthCheck(name string, services []string) *GRPCHealthCheck {
+	if len(services) == 0 {
+		services = []string{""}
+	}
+
+	return &GRPCHealthCheck{
+		name:     name,
+		enabled:  true,
+		timeout:  5 * time.Second,
+		services: services,
+	}
+}
+
+func (gc *GRPCHealthCheck) Name() string                                  { return gc.name }
+func (gc *GRPCHealthCheck) Enabled() bool                                 { return gc.enabled }
+func (gc *GRPCHealthCheck) Configure(config map[string]interface{}) error { return nil }
+
+func (gc *GRPCHealthCheck) Check(ctx context.Context, target interface{}) *CheckResult {
+	backend, ok := target.(*Backend)
+	if !ok {
+		return &CheckResult{
+			Status: StatusUnhealthy,
+			Error:  fmt.Errorf("invalid target type for gRPC check"),
+		}
+	}
+
+	services := gc.services
+	if len(backend.GRPCServices) > 0 {
+		services = backend.GRPCServices
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gc.timeout)
+	defer cancel()
+
+	address := net.JoinHostPort(backend.Host, strconv.Itoa(backend.Port))
+
+	start := time.Now()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(grpcCredentials(backend)))
+	if err != nil {
+		return &CheckResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: time.Since(start),
+			Error:        err,
+		}
+	}
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	statuses := make(map[string]string, len(services))
+	var failed []string
+	var checkErr error
+
+	for _, service := range services {
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		switch {
+		case err == nil:
+			statuses[service] = resp.GetStatus().String()
+		case status.Code(err) == codes.NotFound:
+			statuses[service] = healthpb.HealthCheckResponse_SERVICE_UNKNOWN.String()
+		case status.Code(err) == codes.Unimplemented:
+			statuses[service] = "UNIMPLEMENTED"
+		default:
+			statuses[service] = healthpb.HealthCheckResponse_UNKNOWN.String()
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+
+		if statuses[service] != healthpb.HealthCheckResponse_SERVING.String() {
+			failed = append(failed, grpcServiceLabel(service)+"="+statuses[service])
+		}
+	}
+	responseTime := time.Since(start)
+
+	metadata := map[string]interface{}{"grpc_services": statuses}
+
+	if len(failed) > 0 {
+		if checkErr == nil {
+			checkErr = fmt.Errorf("gRPC services not serving: %s", strings.Join(failed, ", "))
+		}
+		return &CheckResult{
+			Status:       StatusUnhealthy,
+			ResponseTime: responseTime,
+			Error:        checkErr,
+			Metadata:     metadata,
+		}
+	}
+
+	return &CheckResult{
+		Status:       StatusHealthy,
+		ResponseTime: responseTime,
+		Message:      "gRPC health check passed",
+		Metadata:     metadata,
+	}
+}
+
+// grpcCredentials uses TLS for backends with a TLS scheme and plaintext
+// otherwise
+func grpcCredentials(backend *Backend) credentials.TransportCredentials {
+	switch backend.Scheme {
+	case "https", "grpcs":
+		return credentials.NewTLS(&tls.Config{ServerName: backend.Host})
+	default:
+		return insecure.NewCredentials()
+	}
+}
+
+// grpcServiceLabel names a service in messages, where the empty name
+// stands for the whole server
+func grpcServiceLabel(service string) string {
+	if service == "" {
+		return "<server>"
+	}
+	return service
+}
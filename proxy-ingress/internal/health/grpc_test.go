@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func startGRPCHealthServer(t *testing.T) (*grpchealth.Server, *Backend) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	healthServer := grpchealth.NewServer()
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	host, portString, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+	return healthServer, &Backend{Name: "grpc", Host: host, Port: port, Scheme: "http"}
+}
+
+func TestGRPCHealthCheckReportsPerServiceStatus(t *testing.T) {
+	healthServer, backend := startGRPCHealthServer(t)
+	healthServer.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("billing", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	check := NewGRPCHealthCheck("grpc", []string{"", "orders"})
+
+	result := check.Check(context.Background(), backend)
+	if result.Status != StatusHealthy {
+		t.Fatalf("status = %s (%v), want healthy", result.Status, result.Error)
+	}
+	statuses := result.Metadata["grpc_services"].(map[string]string)
+	if statuses[""] != "SERVING" || statuses["orders"] != "SERVING" {
+		t.Errorf("statuses = %v, want server and orders SERVING", statuses)
+	}
+
+	backend.GRPCServices = []string{"orders", "billing", "missing"}
+	result = check.Check(context.Background(), backend)
+	if result.Status != StatusUnhealthy || result.Error == nil {
+		t.Fatalf("status = %s (%v), want unhealthy with an error", result.Status, result.Error)
+	}
+	statuses = result.Metadata["grpc_services"].(map[string]string)
+	want := map[string]string{"orders": "SERVING", "billing": "NOT_SERVING", "missing": "SERVICE_UNKNOWN"}
+	for service, status := range want {
+		if statuses[service] != status {
+			t.Errorf("%s = %q, want %q", service, statuses[service], status)
+		}
+	}
+}
+
+func TestGRPCStatusInSystemHealth(t *testing.T) {
+	healthServer, backend := startGRPCHealthServer(t)
+	healthServer.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+
+	hc := NewHealthChecker(HealthConfig{
+		EnabledChecks:    []string{"tcp", "grpc"},
+		HealthyThreshold: 1,
+		Backends: map[string]BackendCheckConfig{
+			"grpc": {Services: []string{"orders"}},
+		},
+	})
+	hc.AddBackend(backend)
+
+	for key, backendHealth := range hc.GetAllBackendHealth() {
+		hc.checkBackend(key, backendHealth)
+	}
+
+	for _, summary := range hc.GetSystemHealth().Backends {
+		if summary.Status != StatusHealthy {
+			t.Errorf("status = %s, want healthy", summary.Status)
+		}
+		if summary.GRPCServices["orders"] != "SERVING" {
+			t.Errorf("grpc services = %v, want orders SERVING", summary.GRPCServices)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"fmt"
+	"time"
+)
+
+// Localities of a backend relative to the proxy, nearest first
+const (
+	LocalityZone   = "zone"   // Same zone
+	LocalityRegion = "region" // Same region, another zone
+	LocalityRemote = "remote" // Another region, or not labelled
+)
+
+var localityTiers = []string{LocalityZone, LocalityRegion, LocalityRemote}
+
+// defaultLocalitySpillThreshold is the share of a locality's weight that
+// must be available for it to take every request when none is configured
+const defaultLocalitySpillThreshold = 0.7
+
+// localityEnabled reports whether the proxy is placed in a zone or region
+func (hc *HealthChecker) localityEnabled() bool {
+	return hc.config.Zone != "" || hc.config.Region != ""
+}
+
+// localityTier returns the index in localityTiers of backend's locality
+func (hc *HealthChecker) localityTier(backend *Backend) int {
+	zone, region := hc.config.Zone, hc.config.Region
+	switch {
+	case region != "" && backend.Region != region:
+		return 2
+	case zone != "" && backend.Zone == zone:
+		return 0
+	case region != "" && backend.Region == region:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Locality returns backend's locality relative to the proxy, empty when
+// locality routing is off
+func (hc *HealthChecker) Locality(backend *Backend) string {
+	if !hc.localityEnabled() {
+		return ""
+	}
+	return localityTiers[hc.localityTier(backend)]
+}
+
+// LocalityWeights returns the share of requests each of backends should
+// receive, in their order. Without a zone or region every backend gets its
+// effective weight. Otherwise the nearest locality takes every request
+// while at least SpillThreshold of its weight is available; health
+// ejections and slow-start shrink that share, and the missing part spills
+// to the next locality, then the one after. Backends that may not receive
+// traffic get 0.
+func (hc *HealthChecker) LocalityWeights(backends []*Backend) []float64 {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	now := time.Now()
+	weights := make([]float64, len(backends))
+	var available, configured [3]float64
+	for i, backend := range backends {
+		key := fmt.Sprintf("%s-%s:%d", backend.Name, backend.Host, backend.Port)
+		full := float64(max(backend.Weight, 1))
+		weights[i] = full
+		if backendHealth, exists := hc.backends[key]; exists {
+			weights[i] = hc.effectiveWeight(backendHealth, now)
+		}
+		tier := hc.localityTier(backend)
+		available[tier] += weights[i]
+		configured[tier] += full
+	}
+	if !hc.localityEnabled() {
+		return weights
+	}
+
+	// Each locality takes the share its availability allows of what the
+	// nearer ones left over
+	var shares [3]float64
+	remaining := 1.0
+	for tier := range shares {
+		if available[tier] == 0 || remaining <= 0 {
+			continue
+		}
+		share := min(available[tier]/configured[tier]/hc.config.SpillThreshold, 1)
+		shares[tier] = remaining * share
+		remaining -= shares[tier]
+	}
+
+	for i, backend := range backends {
+		if tier := hc.localityTier(backend); weights[i] > 0 {
+			weights[i] = shares[tier] * weights[i] / available[tier]
+		}
+	}
+	return weights
+}
@@ -0,0 +1,67 @@
+package health
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLocalityWeightsPreferSameZone(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{Zone: "us-east-1a", Region: "us-east-1", PassiveThreshold: 1})
+	local := []*Backend{
+		{Name: "a1", Host: "10.0.1.1", Port: 80, Zone: "us-east-1a", Region: "us-east-1"},
+		{Name: "a2", Host: "10.0.1.2", Port: 80, Zone: "us-east-1a", Region: "us-east-1"},
+	}
+	other := &Backend{Name: "b1", Host: "10.0.2.1", Port: 80, Zone: "us-east-1b", Region: "us-east-1"}
+	remote := &Backend{Name: "w1", Host: "10.9.0.1", Port: 80, Zone: "us-west-2a", Region: "us-west-2"}
+	backends := []*Backend{local[0], local[1], other, remote}
+	for _, backend := range backends {
+		hc.AddBackend(backend)
+	}
+
+	for i, want := range []string{LocalityZone, LocalityZone, LocalityRegion, LocalityRemote} {
+		if got := hc.Locality(backends[i]); got != want {
+			t.Errorf("%s locality = %q, want %q", backends[i].Name, got, want)
+		}
+	}
+
+	// A healthy zone takes every request
+	expectWeights(t, hc.LocalityWeights(backends), []float64{0.5, 0.5, 0, 0})
+
+	// With half the zone ejected, 0.5/0.7 of the requests stay in it and the
+	// rest spill to the other zone of the region
+	hc.ReportFailure(local[0], FailureServerError)
+	expectWeights(t, hc.LocalityWeights(backends), []float64{0, 0.5 / 0.7, 1 - 0.5/0.7, 0})
+
+	// With the whole region down, requests leave it
+	hc.ReportFailure(local[1], FailureServerError)
+	hc.ReportFailure(other, FailureServerError)
+	expectWeights(t, hc.LocalityWeights(backends), []float64{0, 0, 0, 1})
+}
+
+func TestLocalityWeightsCountSlowStart(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{Zone: "a", SpillThreshold: 1, SlowStartWindow: time.Hour, SlowStartMinWeight: 0.5})
+	warming := &Backend{Name: "a1", Host: "10.0.1.1", Port: 80, Zone: "a"}
+	other := &Backend{Name: "b1", Host: "10.0.2.1", Port: 80, Zone: "b"}
+	hc.AddBackend(warming)
+
+	// Backends unknown to the checker count with their weight
+	weights := hc.LocalityWeights([]*Backend{warming, other})
+	if weights[0] < 0.5 || weights[0] > 0.51 || math.Abs(weights[0]+weights[1]-1) > 1e-9 {
+		t.Errorf("Weights = %v, want about half spilled while the zone warms", weights)
+	}
+
+	// Without a zone or region, backends keep their effective weights
+	hc = NewHealthChecker(HealthConfig{})
+	expectWeights(t, hc.LocalityWeights([]*Backend{{Name: "x", Weight: 3}, {Name: "y"}}), []float64{3, 1})
+}
+
+func expectWeights(t *testing.T, got, want []float64) {
+	t.Helper()
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("Weights = %v, want %v", got, want)
+			return
+		}
+	}
+}
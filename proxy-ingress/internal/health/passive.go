@@ -0,0 +1,80 @@
+package health
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultPassiveWindow is how far back passive failures are counted
+const defaultPassiveWindow = 10 * time.Second
+
+// FailureKind classifies a failure seen on live traffic
+type FailureKind string
+
+const (
+	FailureServerError       FailureKind = "server_error"       // 5xx response from the backend
+	FailureConnectionRefused FailureKind = "connection_refused" // Connect refused, reset or otherwise failed
+	FailureTimeout           FailureKind = "timeout"            // Connect or response timeout
+)
+
+// ReportFailure records a failure the data plane observed on a request to
+// backend. When PassiveThreshold failures land within PassiveWindow
+// the backend is ejected: it is marked unhealthy at once and returns to
+// service through the active checks, as any other unhealthy backend does.
+// Failures for unknown backends or with passive checks disabled are ignored.
+func (hc *HealthChecker) ReportFailure(backend *Backend, kind FailureKind) {
+	if hc.config.PassiveThreshold <= 0 {
+		return
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	key := fmt.Sprintf("%s-%s:%d", backend.Name, backend.Host, backend.Port)
+	backendHealth, exists := hc.backends[key]
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	backendHealth.PassiveFailures++
+
+	// Keep only the failures inside the window
+	cutoff := now.Add(-hc.config.PassiveWindow)
+	recent := backendHealth.passiveFailures[:0]
+	for _, at := range backendHealth.passiveFailures {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	backendHealth.passiveFailures = append(recent, now)
+
+	if len(backendHealth.passiveFailures) < hc.config.PassiveThreshold || backendHealth.Status == StatusUnhealthy {
+		return
+	}
+
+	oldStatus := backendHealth.Status
+	backendHealth.Status = StatusUnhealthy
+	backendHealth.LastStatusChange = now
+	backendHealth.LastEjection = now
+	backendHealth.ConsecutiveSuccesses = 0
+	backendHealth.ErrorMessage = fmt.Sprintf("ejected after %d live traffic failures within %v, last: %s",
+		len(backendHealth.passiveFailures), hc.config.PassiveWindow, kind)
+	backendHealth.passiveFailures = backendHealth.passiveFailures[:0]
+
+	hc.metrics.recordPassiveEjection()
+	hc.metrics.recordStatusChange()
+	hc.notifyStatusChange(backendHealth, oldStatus, StatusUnhealthy)
+	hc.updateBackendCounts()
+}
+
+// IsAvailable reports whether backend may receive traffic. Backends that
+// are unknown to the checker or not yet checked are available.
+func (hc *HealthChecker) IsAvailable(backend *Backend) bool {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	key := fmt.Sprintf("%s-%s:%d", backend.Name, backend.Host, backend.Port)
+	backendHealth, exists := hc.backends[key]
+	return !exists || backendHealth.Status != StatusUnhealthy
+}
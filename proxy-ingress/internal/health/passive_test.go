@@ -0,0 +1,66 @@
+package health
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportFailureEjectsWithinWindow(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{PassiveThreshold: 3, PassiveWindow: time.Minute, HealthyThreshold: 2})
+	backend := &Backend{Name: "api", Host: "10.0.0.1", Port: 8080}
+	hc.AddBackend(backend)
+
+	hc.ReportFailure(backend, FailureServerError)
+	hc.ReportFailure(backend, FailureTimeout)
+	if !hc.IsAvailable(backend) {
+		t.Fatal("backend ejected before reaching the threshold")
+	}
+
+	hc.ReportFailure(backend, FailureConnectionRefused)
+	if hc.IsAvailable(backend) {
+		t.Fatal("backend still available after reaching the threshold")
+	}
+
+	summary := hc.GetSystemHealth()
+	if summary.Metrics.PassiveEjections != 1 {
+		t.Errorf("passive ejections = %d, want 1", summary.Metrics.PassiveEjections)
+	}
+	for _, backendSummary := range summary.Backends {
+		if backendSummary.PassiveFailures != 3 || backendSummary.LastEjection.IsZero() {
+			t.Errorf("summary = %+v, want 3 passive failures and an ejection time", backendSummary)
+		}
+	}
+
+	// A failed active check keeps the backend out
+	backendHealth := hc.GetBackendHealth(backend)
+	if status := hc.determineHealthStatus(backendHealth, &CheckResult{Status: StatusUnhealthy}); status != StatusUnhealthy {
+		t.Errorf("status after failed active check = %s, want unhealthy", status)
+	}
+}
+
+func TestReportFailureIgnoresStaleFailures(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{PassiveThreshold: 2, PassiveWindow: 50 * time.Millisecond})
+	backend := &Backend{Name: "api", Host: "10.0.0.1", Port: 8080}
+	hc.AddBackend(backend)
+
+	hc.ReportFailure(backend, FailureServerError)
+	time.Sleep(100 * time.Millisecond)
+	hc.ReportFailure(backend, FailureServerError)
+
+	if !hc.IsAvailable(backend) {
+		t.Error("failures outside the window ejected the backend")
+	}
+}
+
+func TestReportFailureDisabled(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{})
+	backend := &Backend{Name: "api", Host: "10.0.0.1", Port: 8080}
+	hc.AddBackend(backend)
+
+	for i := 0; i < 100; i++ {
+		hc.ReportFailure(backend, FailureServerError)
+	}
+	if !hc.IsAvailable(backend) {
+		t.Error("backend ejected with passive checks disabled")
+	}
+}
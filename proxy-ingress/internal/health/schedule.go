@@ -0,0 +1,128 @@
+package health
+
+import (
+	"math/rand"
+	"time"
+)
+
+// defaultMaxBackoff caps how far apart checks of a failing backend can drift
+const defaultMaxBackoff = 5 * time.Minute
+
+// intervalJitter spreads repeat checks by up to ±10% of their delay so
+// backends added together do not stay in lockstep
+const intervalJitter = 0.1
+
+// BackendCheckConfig overrides the global check settings for one backend
+type BackendCheckConfig struct {
+	Interval time.Duration // Time between checks, default HealthConfig.CheckInterval
+	Timeout  time.Duration // Per-check timeout, default HealthConfig.Timeout
+	Checks   []string      // Check types to run, default HealthConfig.EnabledChecks
+	Path     string        // Path probed by HTTP and mTLS checks
+	Port     int           // Port probed instead of the backend's traffic port
+	Services []string      // Services asked by gRPC checks
+}
+
+// target returns the backend as the checks should see it, with the
+// override's port, path and gRPC services applied
+func (o BackendCheckConfig) target(backend *Backend) *Backend {
+	if o.Port == 0 && o.Path == "" && len(o.Services) == 0 {
+		return backend
+	}
+
+	probe := *backend
+	if o.Port > 0 {
+		probe.Port = o.Port
+	}
+	if o.Path != "" {
+		probe.HealthPath = o.Path
+	}
+	if len(o.Services) > 0 {
+		probe.GRPCServices = o.Services
+	}
+	return &probe
+}
+
+// enabledChecks returns the check types to run for a backend
+func (hc *HealthChecker) enabledChecks(override BackendCheckConfig) []string {
+	if len(override.Checks) > 0 {
+		return override.Checks
+	}
+	return hc.config.EnabledChecks
+}
+
+// checkInterval returns the base interval between checks of a backend
+func (hc *HealthChecker) checkInterval(backend *Backend) time.Duration {
+	if override, exists := hc.config.Backends[backend.Name]; exists && override.Interval > 0 {
+		return override.Interval
+	}
+	return hc.config.CheckInterval
+}
+
+// firstDelay picks a random start within the jitter window so checks of
+// backends registered together do not all fire at once
+func (hc *HealthChecker) firstDelay(backend *Backend) time.Duration {
+	window := hc.config.StartupJitter
+	if window <= 0 {
+		window = hc.checkInterval(backend)
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// nextDelay returns the wait before the next check. Once a backend has
+// failed UnhealthyThreshold checks in a row, each further failure doubles
+// the interval up to MaxBackoff.
+func (hc *HealthChecker) nextDelay(backendHealth *BackendHealth) time.Duration {
+	interval := hc.checkInterval(backendHealth.Backend)
+
+	delay := interval
+	for failures := backendHealth.ConsecutiveFailures; failures >= hc.config.UnhealthyThreshold; failures-- {
+		delay *= 2
+		if delay >= hc.config.MaxBackoff {
+			delay = hc.config.MaxBackoff
+			break
+		}
+	}
+	if delay < interval {
+		delay = interval
+	}
+
+	spread := int64(float64(delay) * intervalJitter)
+	if spread > 0 {
+		delay += time.Duration(rand.Int63n(2*spread+1) - spread)
+	}
+	return delay
+}
+
+// scheduleBackend starts the check loop for one backend. Callers hold
+// hc.mutex.
+func (hc *HealthChecker) scheduleBackend(key string, backendHealth *BackendHealth) {
+	delay := hc.firstDelay(backendHealth.Backend)
+	backendHealth.NextCheck = time.Now().Add(delay)
+	go hc.runBackend(key, backendHealth, delay, hc.stopChan)
+}
+
+// runBackend checks one backend on its own schedule until the backend is
+// removed or the checker stops
+func (hc *HealthChecker) runBackend(key string, backendHealth *BackendHealth, delay time.Duration, stopChan chan struct{}) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			hc.checkBackend(key, backendHealth)
+			hc.updateVirtualHostHealth()
+
+			hc.mutex.Lock()
+			delay = hc.nextDelay(backendHealth)
+			backendHealth.NextCheck = time.Now().Add(delay)
+			hc.mutex.Unlock()
+
+			timer.Reset(delay)
+		case <-backendHealth.stop:
+			return
+		case <-stopChan:
+			return
+		}
+	}
+}
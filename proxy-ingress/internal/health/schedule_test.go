@@ -0,0 +1,138 @@
+package health
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNextDelayBacksOffAfterUnhealthyThreshold(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{
+		CheckInterval:      10 * time.Second,
+		UnhealthyThreshold: 3,
+		MaxBackoff:         60 * time.Second,
+	})
+	backendHealth := &BackendHealth{Backend: &Backend{Name: "api"}}
+
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{4, 40 * time.Second},
+		{5, 60 * time.Second},
+		{10, 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		backendHealth.ConsecutiveFailures = tt.failures
+		delay := hc.nextDelay(backendHealth)
+
+		spread := time.Duration(float64(tt.base) * intervalJitter)
+		if delay < tt.base-spread || delay > tt.base+spread {
+			t.Errorf("failures=%d: delay %v outside %v ± %v", tt.failures, delay, tt.base, spread)
+		}
+	}
+}
+
+func TestBackendOverrides(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{
+		CheckInterval: 30 * time.Second,
+		EnabledChecks: []string{"http"},
+		Backends: map[string]BackendCheckConfig{
+			"db": {Interval: 5 * time.Second, Checks: []string{"tcp"}, Port: 9000, Path: "/ready"},
+		},
+	})
+
+	db := &Backend{Name: "db", Host: "10.0.0.1", Port: 5432}
+	web := &Backend{Name: "web", Host: "10.0.0.2", Port: 80}
+
+	if got := hc.checkInterval(db); got != 5*time.Second {
+		t.Errorf("db interval = %v, want 5s", got)
+	}
+	if got := hc.checkInterval(web); got != 30*time.Second {
+		t.Errorf("web interval = %v, want 30s", got)
+	}
+
+	override := hc.config.Backends["db"]
+	if checks := hc.enabledChecks(override); len(checks) != 1 || checks[0] != "tcp" {
+		t.Errorf("db checks = %v, want [tcp]", checks)
+	}
+	if checks := hc.enabledChecks(hc.config.Backends["web"]); len(checks) != 1 || checks[0] != "http" {
+		t.Errorf("web checks = %v, want [http]", checks)
+	}
+
+	target := override.target(db)
+	if target.Port != 9000 || target.HealthPath != "/ready" {
+		t.Errorf("target = %+v, want port 9000 and path /ready", target)
+	}
+	if db.Port != 5432 {
+		t.Errorf("override modified the backend port to %d", db.Port)
+	}
+}
+
+func TestFirstDelayWithinJitterWindow(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{CheckInterval: time.Second, StartupJitter: 100 * time.Millisecond})
+	backend := &Backend{Name: "api"}
+
+	for i := 0; i < 100; i++ {
+		if delay := hc.firstDelay(backend); delay < 0 || delay >= 100*time.Millisecond {
+			t.Fatalf("first delay %v outside [0, 100ms)", delay)
+		}
+	}
+}
+
+func TestScheduledChecksUseOverridePathAndPort(t *testing.T) {
+	var hits atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	host, portString, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	hc := NewHealthChecker(HealthConfig{
+		CheckInterval:    time.Hour,
+		StartupJitter:    time.Millisecond,
+		EnabledChecks:    []string{"tcp"},
+		HealthyThreshold: 1,
+		Backends: map[string]BackendCheckConfig{
+			"api": {Interval: 20 * time.Millisecond, Checks: []string{"http"}, Path: "/ready", Port: port},
+		},
+	})
+
+	// The traffic port is closed; only the override port answers
+	backend := &Backend{Name: "api", Host: host, Port: 1, Scheme: "http"}
+	hc.AddBackend(backend)
+	if err := hc.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer hc.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for hits.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hits.Load() < 2 {
+		t.Fatalf("override endpoint was checked %d times, want at least 2", hits.Load())
+	}
+
+	health := hc.GetBackendHealth(backend)
+	hc.mutex.RLock()
+	status := health.Status
+	hc.mutex.RUnlock()
+	if status != StatusHealthy {
+		t.Errorf("status = %s, want healthy", status)
+	}
+}
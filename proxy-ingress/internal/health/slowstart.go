@@ -0,0 +1,63 @@
+package health
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Slow-start curves
+const (
+	SlowStartLinear      = "linear"      // Weight grows by the same amount every second
+	SlowStartExponential = "exponential" // Weight doubles at a steady rate, staying low longer
+)
+
+// defaultSlowStartMinWeight is the share of its weight a ramping backend
+// starts at when none is configured
+const defaultSlowStartMinWeight = 0.1
+
+// slowStartFactor returns the share of its weight a backend that started
+// warming at since receives at now, 1 once warm or without slow-start
+func (hc *HealthChecker) slowStartFactor(since, now time.Time) float64 {
+	window := hc.config.SlowStartWindow
+	if window <= 0 || since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= window {
+		return 1
+	}
+	progress := math.Max(float64(elapsed)/float64(window), 0)
+	minWeight := hc.config.SlowStartMinWeight
+	if hc.config.SlowStartCurve == SlowStartExponential {
+		return math.Pow(minWeight, 1-progress)
+	}
+	return minWeight + (1-minWeight)*progress
+}
+
+// effectiveWeight returns the weight of a backend at now: 0 while it may
+// not receive traffic, its weight scaled by slow-start otherwise. Backends
+// without a weight count as weight 1. Callers hold hc.mutex.
+func (hc *HealthChecker) effectiveWeight(backendHealth *BackendHealth, now time.Time) float64 {
+	if backendHealth.Status == StatusUnhealthy {
+		return 0
+	}
+	weight := float64(max(backendHealth.Backend.Weight, 1))
+	return weight * hc.slowStartFactor(backendHealth.WarmingSince, now)
+}
+
+// EffectiveWeight returns the share of traffic backend should receive
+// relative to the other backends. Backends added or back from unhealthy
+// ramp up to their weight over SlowStartWindow, unhealthy ones have 0 and
+// backends unknown to the checker have their configured weight.
+func (hc *HealthChecker) EffectiveWeight(backend *Backend) float64 {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	key := fmt.Sprintf("%s-%s:%d", backend.Name, backend.Host, backend.Port)
+	backendHealth, exists := hc.backends[key]
+	if !exists {
+		return float64(max(backend.Weight, 1))
+	}
+	return hc.effectiveWeight(backendHealth, time.Now())
+}
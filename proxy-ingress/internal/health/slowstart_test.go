@@ -0,0 +1,61 @@
+package health
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSlowStartFactor(t *testing.T) {
+	since := time.Now()
+	for _, tc := range []struct {
+		curve   string
+		elapsed time.Duration
+		want    float64
+	}{
+		{SlowStartLinear, 0, 0.01},
+		{SlowStartLinear, 50 * time.Second, 0.505},
+		{SlowStartLinear, 100 * time.Second, 1},
+		{SlowStartExponential, 0, 0.01},
+		{SlowStartExponential, 50 * time.Second, 0.1},
+		{SlowStartExponential, time.Hour, 1},
+	} {
+		hc := NewHealthChecker(HealthConfig{SlowStartWindow: 100 * time.Second, SlowStartCurve: tc.curve, SlowStartMinWeight: 0.01})
+		if got := hc.slowStartFactor(since, since.Add(tc.elapsed)); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s factor after %s = %f, want %f", tc.curve, tc.elapsed, got, tc.want)
+		}
+	}
+}
+
+func TestEffectiveWeightRampsAfterRecovery(t *testing.T) {
+	hc := NewHealthChecker(HealthConfig{SlowStartWindow: time.Hour, PassiveThreshold: 1, HealthyThreshold: 1})
+	backend := &Backend{Name: "api", Host: "10.0.0.1", Port: 8080, Weight: 10}
+	hc.AddBackend(backend)
+
+	if weight := hc.EffectiveWeight(backend); weight < 1 || weight > 1.1 {
+		t.Errorf("new backend weight = %f, want about 1", weight)
+	}
+
+	backendHealth := hc.GetBackendHealth(backend)
+	backendHealth.WarmingSince = time.Now().Add(-2 * time.Hour)
+	if weight := hc.EffectiveWeight(backend); weight != 10 {
+		t.Errorf("warm backend weight = %f, want 10", weight)
+	}
+
+	hc.ReportFailure(backend, FailureServerError)
+	if weight := hc.EffectiveWeight(backend); weight != 0 {
+		t.Errorf("ejected backend weight = %f, want 0", weight)
+	}
+
+	// Back in service, the backend ramps up from a tenth of its weight
+	backendHealth.Status = hc.determineHealthStatus(backendHealth, &CheckResult{Status: StatusHealthy})
+	backendHealth.WarmingSince = time.Now()
+	if weight := hc.EffectiveWeight(backend); weight < 1 || weight > 1.1 {
+		t.Errorf("recovered backend weight = %f, want about 1", weight)
+	}
+	for _, summary := range hc.GetSystemHealth().Backends {
+		if summary.EffectiveWeight < 1 || summary.EffectiveWeight > 1.1 {
+			t.Errorf("summary effective weight = %f, want about 1", summary.EffectiveWeight)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package manager
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +12,11 @@ import (
 	"time"
 
 	"marchproxy-ingress/internal/config"
+	"marchproxy-ingress/internal/tenant"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/fault"
+	"marchproxy-shared/metering"
+	"marchproxy-shared/schedule"
 )
 
 type Client struct {
@@ -23,6 +29,9 @@ type Client struct {
 
 	clusterID   int
 	clusterName string
+
+	// Local cluster config file used instead of the manager
+	standaloneConfig string
 }
 
 func NewClient(cfg *config.Config) *Client {
@@ -32,6 +41,8 @@ func NewClient(cfg *config.Config) *Client {
 		},
 		baseURL: cfg.Manager.URL,
 		apiKey:  cfg.Manager.APIKey,
+
+		standaloneConfig: cfg.Manager.StandaloneConfig,
 	}
 }
 
@@ -120,6 +131,8 @@ type BackendEndpoint struct {
 	Port   int    `json:"port"`
 	Weight int    `json:"weight"`
 	Active bool   `json:"active"`
+	Zone   string `json:"zone,omitempty"`   // Zone the endpoint runs in, for same-zone routing
+	Region string `json:"region,omitempty"` // Region the endpoint runs in
 }
 
 type LoadBalancingConfig struct {
@@ -209,13 +222,74 @@ type SecurityRule struct {
 	Parameters  map[string]interface{} `json:"parameters"`
 }
 
+// Service is a backend service routes forward requests to
+type Service struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	IPFQDN string `json:"ip_fqdn"`          // host:port, or a host on port 80
+	Tenant string `json:"tenant,omitempty"` // Owning tenant on shared clusters
+}
+
+// IngressRoute routes requests by host and path to backend services
+type IngressRoute struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	HostPattern     string `json:"host_pattern"` // Exact or *.example.com, any when empty
+	PathPattern     string `json:"path_pattern"` // Exact or /api/*, any when empty
+	Priority        int    `json:"priority"`
+	BackendServices []int  `json:"backend_services"`
+
+	// Owning tenant on shared clusters; the route's requests count
+	// towards its quotas
+	Tenant string `json:"tenant,omitempty"`
+
+	// CEL expression over the request; the route only matches requests it
+	// is true for
+	Condition string `json:"condition,omitempty"`
+
+	// Validity period and weekly windows the route is active in; always
+	// active when nil
+	Schedule *schedule.Schedule `json:"schedule,omitempty"`
+
+	// Client certificates must be presented, with one of these CNs when set
+	RequireMTLS      bool     `json:"require_mtls"`
+	AllowedClientCNs []string `json:"allowed_client_cns,omitempty"`
+
+	// Route and per client IP rate limits; zero bursts default to the rate
+	RateLimitEnabled     bool `json:"rate_limit_enabled"`
+	RateLimitRPS         int  `json:"rate_limit_rps"`
+	RateLimitBurst       int  `json:"rate_limit_burst"`
+	RateLimitClientRPS   int  `json:"rate_limit_client_rps"`
+	RateLimitClientBurst int  `json:"rate_limit_client_burst"`
+
+	MaxBodySize      int64 `json:"max_body_size"`      // bytes, 0 for the proxy default
+	RequestTimeoutMs int   `json:"request_timeout_ms"` // Budget forwarded to backends, 0 for none
+
+	// Bad bots are allowed, tarpitted, blocked or challenged
+	BotProtectionEnabled bool   `json:"bot_protection_enabled"`
+	BotAction            string `json:"bot_action,omitempty"`
+
+	// TLS client fingerprints, JA3 hashes or JA4 strings; an allow list
+	// admits only the clients it lists
+	TLSFingerprintAllow []string `json:"tls_fingerprint_allow,omitempty"`
+	TLSFingerprintDeny  []string `json:"tls_fingerprint_deny,omitempty"`
+
+	// Faults injected into the route's requests for resilience testing,
+	// applied only on proxies with fault injection enabled
+	FaultInjection *fault.Spec `json:"fault_injection,omitempty"`
+}
+
 type ClusterConfig struct {
 	Cluster         ClusterInfo        `json:"cluster"`
 	VirtualHosts    []VirtualHost      `json:"virtual_hosts"`
 	Backends        []Backend          `json:"backends"`
+	Services        []Service          `json:"services"`
+	IngressRoutes   []IngressRoute     `json:"ingress_routes"`
 	Certificates    []Certificate      `json:"certificates"`
 	Logging         LoggingConfig      `json:"logging"`
 	SecurityPolicies []SecurityPolicy  `json:"security_policies"`
+	Tenants         []tenant.Quota     `json:"tenants,omitempty"`
+	DrainedBackends []drain.Backend    `json:"drained_backends,omitempty"`
 	ConfigHash      string             `json:"config_hash"`
 	Version         string             `json:"version"`
 	UpdatedAt       time.Time          `json:"updated_at"`
@@ -260,6 +334,21 @@ type HealthReportResponse struct {
 }
 
 func (c *Client) Register(ctx context.Context, proxyName, hostname, version string, capabilities []string) (*RegistrationResponse, error) {
+	if c.Standalone() {
+		config, err := LoadClusterConfig(c.standaloneConfig)
+		if err != nil {
+			return nil, err
+		}
+		c.clusterID = config.Cluster.ID
+		c.clusterName = config.Cluster.Name
+		return &RegistrationResponse{
+			Success:     true,
+			ProxyID:     config.Cluster.ID,
+			ClusterName: config.Cluster.Name,
+			Message:     "standalone mode, registration skipped",
+		}, nil
+	}
+
 	req := RegistrationRequest{
 		Name:         proxyName,
 		Hostname:     hostname,
@@ -285,6 +374,18 @@ func (c *Client) Register(ctx context.Context, proxyName, hostname, version stri
 }
 
 func (c *Client) GetConfig(ctx context.Context) (*ClusterConfig, error) {
+	if c.Standalone() {
+		config, err := LoadClusterConfig(c.standaloneConfig)
+		if err != nil {
+			return nil, err
+		}
+		if config.ConfigHash != c.lastConfigHash {
+			c.lastConfigHash = config.ConfigHash
+			c.lastConfigTime = time.Now()
+		}
+		return config, nil
+	}
+
 	var resp ConfigResponse
 	err := c.makeRequest(ctx, "GET", "/api/v1/config", nil, &resp)
 	if err != nil {
@@ -304,6 +405,10 @@ func (c *Client) GetConfig(ctx context.Context) (*ClusterConfig, error) {
 }
 
 func (c *Client) ReportHealth(ctx context.Context, report HealthReportRequest) error {
+	if c.Standalone() {
+		return nil
+	}
+
 	report.ProxyID = c.clusterID
 	report.Timestamp = time.Now()
 
@@ -320,6 +425,86 @@ func (c *Client) ReportHealth(ctx context.Context, report HealthReportRequest) e
 	return nil
 }
 
+type SessionTicketKeysRequest struct {
+	ClusterAPIKey string `json:"cluster_api_key"`
+}
+
+type SessionTicketKey struct {
+	ID        int    `json:"id"`
+	Key       string `json:"key"` // base64, 32 bytes
+	CreatedAt string `json:"created_at"`
+}
+
+type SessionTicketKeysResponse struct {
+	Success          bool               `json:"success"`
+	Keys             []SessionTicketKey `json:"keys"`
+	RotationInterval int                `json:"rotation_interval"`
+	Error            string             `json:"error,omitempty"`
+}
+
+// SessionTicketKeys fetches the TLS session ticket keys shared by the
+// cluster's ingress replicas, newest first
+func (c *Client) SessionTicketKeys(ctx context.Context) ([][32]byte, error) {
+	if c.Standalone() {
+		return nil, fmt.Errorf("shared session ticket keys need a manager, not available in standalone mode")
+	}
+
+	var resp SessionTicketKeysResponse
+	err := c.makeRequest(ctx, "POST", "/api/proxy/session-tickets", SessionTicketKeysRequest{ClusterAPIKey: c.apiKey}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session ticket keys: %w", err)
+	}
+
+	if !resp.Success {
+		return nil, fmt.Errorf("session ticket key request failed: %s", resp.Error)
+	}
+
+	keys := make([][32]byte, 0, len(resp.Keys))
+	for _, key := range resp.Keys {
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("invalid session ticket key %d", key.ID)
+		}
+		var decoded [32]byte
+		copy(decoded[:], raw)
+		keys = append(keys, decoded)
+	}
+
+	return keys, nil
+}
+
+type UsageRequest struct {
+	ProxyName     string            `json:"proxy_name"`
+	ClusterAPIKey string            `json:"cluster_api_key"`
+	Records       []metering.Record `json:"records"`
+}
+
+type UsageResponse struct {
+	Success  bool   `json:"success"`
+	Recorded int    `json:"recorded"`
+	Error    string `json:"error,omitempty"`
+}
+
+// UploadUsage sends closed usage records to the manager for chargeback
+func (c *Client) UploadUsage(ctx context.Context, proxyName string, records []metering.Record) error {
+	if c.Standalone() {
+		return fmt.Errorf("usage upload needs a manager, not available in standalone mode")
+	}
+
+	req := UsageRequest{ProxyName: proxyName, ClusterAPIKey: c.apiKey, Records: records}
+
+	var resp UsageResponse
+	if err := c.makeRequest(ctx, "POST", "/api/proxy/usage", req, &resp); err != nil {
+		return fmt.Errorf("usage upload failed: %w", err)
+	}
+
+	if !resp.Success {
+		return fmt.Errorf("usage upload rejected: %s", resp.Error)
+	}
+
+	return nil
+}
+
 func (c *Client) GetCertificate(ctx context.Context, certID int) (*Certificate, error) {
 	var cert Certificate
 	err := c.makeRequest(ctx, "GET", fmt.Sprintf("/api/v1/certificates/%d", certID), nil, &cert)
@@ -341,6 +526,10 @@ func (c *Client) ListCertificates(ctx context.Context) ([]Certificate, error) {
 }
 
 func (c *Client) NotifyConfigUpdate(ctx context.Context, updateType, message string) error {
+	if c.Standalone() {
+		return nil
+	}
+
 	notification := map[string]interface{}{
 		"proxy_id":    c.clusterID,
 		"update_type": updateType,
@@ -383,6 +572,76 @@ func (c *Client) PollConfigChanges(ctx context.Context, interval time.Duration)
 	return configChan
 }
 
+// StartConfigRefresh fetches the configuration every refresh interval
+// until ctx is done, calling onConfigUpdate when it changed
+func (c *Client) StartConfigRefresh(ctx context.Context, cfg *config.Config, onConfigUpdate func(*ClusterConfig)) {
+	ticker := time.NewTicker(cfg.Manager.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previousHash := c.lastConfigHash
+			config, err := c.GetConfig(ctx)
+			if err != nil {
+				fmt.Printf("Failed to refresh configuration: %v\n", err)
+				continue
+			}
+			if c.lastConfigHash != previousHash {
+				onConfigUpdate(config)
+			}
+		}
+	}
+}
+
+// SystemStats is the state of the proxy reported with each heartbeat
+type SystemStats struct {
+	CPUUsage     float64
+	MemoryUsage  int64 // bytes
+	Connections  int
+	RequestCount uint64
+	ErrorCount   uint64
+}
+
+// GetSystemStats returns the memory use of the process; the proxy fills in
+// its connection and request counts
+func GetSystemStats() SystemStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return SystemStats{MemoryUsage: int64(m.Sys)}
+}
+
+// StartHeartbeat reports the proxy's health every heartbeat interval until
+// ctx is done
+func (c *Client) StartHeartbeat(ctx context.Context, cfg *config.Config, getStats func() SystemStats) {
+	started := time.Now()
+	ticker := time.NewTicker(cfg.Manager.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := getStats()
+			err := c.ReportHealth(ctx, HealthReportRequest{
+				Status:       "healthy",
+				Uptime:       time.Since(started),
+				CPUUsage:     stats.CPUUsage,
+				MemoryUsage:  stats.MemoryUsage,
+				Connections:  stats.Connections,
+				RequestCount: stats.RequestCount,
+				ErrorCount:   stats.ErrorCount,
+			})
+			if err != nil {
+				fmt.Printf("Failed to send heartbeat: %v\n", err)
+			}
+		}
+	}
+}
+
 func (c *Client) GetBackend(ctx context.Context, backendName string) (*Backend, error) {
 	var backend Backend
 	err := c.makeRequest(ctx, "GET", fmt.Sprintf("/api/v1/backends/%s", backendName), nil, &backend)
@@ -424,6 +683,10 @@ func (c *Client) ListVirtualHosts(ctx context.Context) ([]VirtualHost, error) {
 }
 
 func (c *Client) Ping(ctx context.Context) error {
+	if c.Standalone() {
+		return nil
+	}
+
 	var resp map[string]interface{}
 	err := c.makeRequest(ctx, "GET", "/api/v1/ping", nil, &resp)
 	if err != nil {
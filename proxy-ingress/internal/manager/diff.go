@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigDiff describes what changed between two applied cluster configs
+type ConfigDiff struct {
+	FromVersion  string       `json:"from_version"`
+	ToVersion    string       `json:"to_version"`
+	VirtualHosts ResourceDiff `json:"virtual_hosts"`
+	Backends     ResourceDiff `json:"backends"`
+}
+
+// ResourceDiff lists the resources of one kind that were added, removed or changed
+type ResourceDiff struct {
+	Added   []ResourceRef    `json:"added"`
+	Removed []ResourceRef    `json:"removed"`
+	Changed []ResourceChange `json:"changed"`
+}
+
+// ResourceRef identifies a resource in a diff
+type ResourceRef struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ResourceChange names a changed resource and the fields that differ. Field
+// values are omitted so secrets such as TLS keys are never exposed.
+type ResourceChange struct {
+	ResourceRef
+	Fields []string `json:"fields"`
+}
+
+// Summary returns a one-line count of added, removed and changed resources
+func (d *ConfigDiff) Summary() string {
+	return fmt.Sprintf("virtual hosts %s, backends %s",
+		d.VirtualHosts.summary(), d.Backends.summary())
+}
+
+// summary formats the diff counts as +added -removed ~changed
+func (d ResourceDiff) summary() string {
+	return fmt.Sprintf("+%d -%d ~%d", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+// DiffConfigs computes the structured diff from previous to current. A nil
+// previous config treats every resource in current as added.
+func DiffConfigs(previous, current *ClusterConfig) ConfigDiff {
+	if previous == nil {
+		previous = &ClusterConfig{}
+	}
+	if current == nil {
+		current = &ClusterConfig{}
+	}
+
+	return ConfigDiff{
+		FromVersion: previous.Version,
+		ToVersion:   current.Version,
+		VirtualHosts: diffResources(previous.VirtualHosts, current.VirtualHosts, func(v VirtualHost) ResourceRef {
+			return ResourceRef{ID: v.ID, Name: v.Hostname}
+		}),
+		Backends: diffResources(previous.Backends, current.Backends, func(b Backend) ResourceRef {
+			return ResourceRef{ID: b.ID, Name: b.Name}
+		}),
+	}
+}
+
+// diffResources compares two resource lists keyed by ID
+func diffResources[T any](previous, current []T, ref func(T) ResourceRef) ResourceDiff {
+	diff := ResourceDiff{
+		Added:   []ResourceRef{},
+		Removed: []ResourceRef{},
+		Changed: []ResourceChange{},
+	}
+
+	before := make(map[int]T, len(previous))
+	for _, item := range previous {
+		before[ref(item).ID] = item
+	}
+
+	seen := make(map[int]bool, len(current))
+	for _, item := range current {
+		r := ref(item)
+		seen[r.ID] = true
+
+		old, exists := before[r.ID]
+		if !exists {
+			diff.Added = append(diff.Added, r)
+			continue
+		}
+		if fields := changedFields(old, item); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ResourceChange{ResourceRef: r, Fields: fields})
+		}
+	}
+
+	for _, item := range previous {
+		if r := ref(item); !seen[r.ID] {
+			diff.Removed = append(diff.Removed, r)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].ID < diff.Added[j].ID })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].ID < diff.Removed[j].ID })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].ID < diff.Changed[j].ID })
+	return diff
+}
+
+// changedFields returns the JSON names of the struct fields that differ
+func changedFields(previous, current interface{}) []string {
+	before := reflect.ValueOf(previous)
+	after := reflect.ValueOf(current)
+	fieldTypes := before.Type()
+
+	var fields []string
+	for i := 0; i < fieldTypes.NumField(); i++ {
+		if reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			continue
+		}
+
+		name := strings.Split(fieldTypes.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = fieldTypes.Field(i).Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// ConfigHistory records the applied cluster config and the diff from the
+// config it replaced. It is safe for concurrent use.
+type ConfigHistory struct {
+	current   *ClusterConfig
+	appliedAt time.Time
+	diff      ConfigDiff
+	mu        sync.RWMutex
+}
+
+// Record stores config as the applied version and returns its diff against
+// the previous one
+func (h *ConfigHistory) Record(config *ClusterConfig) ConfigDiff {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.diff = DiffConfigs(h.current, config)
+	h.current = config
+	h.appliedAt = time.Now()
+	return h.diff
+}
+
+// Snapshot returns the applied config version, when it was applied and the
+// diff from the previous version
+func (h *ConfigHistory) Snapshot() (version string, appliedAt time.Time, diff ConfigDiff) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.current != nil {
+		version = h.current.Version
+	}
+	return version, h.appliedAt, h.diff
+}
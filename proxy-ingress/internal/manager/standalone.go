@@ -0,0 +1,59 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadClusterConfig reads a cluster configuration from a YAML or JSON file
+// for running without a manager. The file uses the same field names as the
+// manager's config API. Without a version the file's content hash is used,
+// so edits are picked up when the config is polled.
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read standalone config: %w", err)
+	}
+
+	// Decode through JSON so the manager's json field names apply
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse standalone config %s: %w", path, err)
+	}
+	jsonData, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse standalone config %s: %w", path, err)
+	}
+	var config ClusterConfig
+	if err := json.Unmarshal(jsonData, &config); err != nil {
+		return nil, fmt.Errorf("invalid standalone config %s: %w", path, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if config.ConfigHash == "" {
+		config.ConfigHash = hex.EncodeToString(sum[:])
+	}
+	if config.Version == "" {
+		config.Version = "file-" + hex.EncodeToString(sum[:6])
+	}
+	if config.UpdatedAt.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			config.UpdatedAt = info.ModTime().UTC()
+		}
+	}
+	if config.Cluster.Name == "" {
+		config.Cluster.Name = "standalone"
+	}
+	return &config, nil
+}
+
+// Standalone reports whether the client serves configuration from a local
+// file instead of the manager
+func (c *Client) Standalone() bool {
+	return c.standaloneConfig != ""
+}
@@ -0,0 +1,386 @@
+// Package overload sheds load before the ingress degrades for everyone. It
+// caps concurrent connections and requests, and while CPU, heap or the
+// accept queue is over its threshold it rejects lower priority requests
+// with a fast 503. Critical requests, such as load balancer health checks,
+// are always served.
+package overload
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority orders requests for shedding
+type Priority int
+
+// Request priorities, lowest first
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	PriorityCritical // Never shed
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"low", "normal", "high", "critical"}
+
+func (p Priority) String() string {
+	if p < 0 || p >= numPriorities {
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority parses a priority name
+func ParsePriority(name string) (Priority, error) {
+	for p, n := range priorityNames {
+		if strings.EqualFold(name, n) {
+			return Priority(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q, want low, normal, high or critical", name)
+}
+
+// Reasons a request or connection is shed
+const (
+	ReasonConnections = "connections"  // The connection limit was reached
+	ReasonRequests    = "requests"     // The in-flight request limit was reached
+	ReasonCPU         = "cpu"          // CPU use was over its threshold
+	ReasonHeap        = "heap"         // Heap was over its threshold
+	ReasonAcceptQueue = "accept_queue" // Connections waiting to be accepted were over the threshold
+)
+
+// requestReasons are the reasons a request can be shed, in metric order
+var requestReasons = [...]string{ReasonAcceptQueue, ReasonCPU, ReasonHeap, ReasonRequests}
+
+// recoverRatio is the share of its threshold a signal must drop under
+// before shedding stops, so it does not flap around the threshold
+const recoverRatio = 0.9
+
+// Rule assigns a priority to requests for a host and path prefix
+type Rule struct {
+	Host       string // Empty matches every host
+	PathPrefix string // Empty matches every path
+	Priority   Priority
+}
+
+// Config holds the limits and thresholds. Zero disables a limit.
+type Config struct {
+	MaxConnections int     // Concurrent client connections
+	MaxRequests    int     // Concurrent requests below critical priority
+	CPUPercent     float64 // 0-100, share of GOMAXPROCS in use
+	HeapBytes      uint64
+	AcceptQueue    int           // Connections waiting on a listener to be accepted
+	Interval       time.Duration // Between pressure samples
+
+	// Under pressure, requests below this priority are shed
+	MinPriority     Priority
+	DefaultPriority Priority
+	CriticalPaths   []string     // Exact paths, such as health checks, always served
+	Rules           []Rule       // First match wins
+	ExemptNets      []*net.IPNet // Clients whose connections are never shed
+}
+
+// Stats is the current load and the counts of shed work
+type Stats struct {
+	Connections     int64
+	Requests        int64
+	CPUPercent      float64 // -1 when unknown
+	HeapBytes       uint64
+	AcceptQueue     int    // -1 when unknown
+	Pressure        string // Signal over its threshold, "" when none
+	ShedConnections uint64
+
+	// Shed requests by reason and priority
+	ShedRequests map[string]map[Priority]uint64
+}
+
+// Shedder admits connections and requests
+type Shedder struct {
+	config Config
+
+	connections atomic.Int64
+	requests    atomic.Int64
+	pressure    atomic.Value // string
+
+	shedConnections atomic.Uint64
+	shedRequests    [len(requestReasons)][numPriorities]atomic.Uint64
+
+	mu          sync.Mutex
+	listeners   []net.Listener
+	cpuPercent  float64
+	heapBytes   uint64
+	acceptQueue int
+	lastCPU     time.Duration
+	lastSample  time.Time
+}
+
+// New creates a shedder
+func New(config Config) *Shedder {
+	s := &Shedder{config: config, cpuPercent: -1, acceptQueue: -1}
+	s.pressure.Store("")
+	return s
+}
+
+// Run samples the pressure signals until ctx is done
+func (s *Shedder) Run(ctx context.Context) {
+	if s.config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	s.Sample()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Sample()
+		}
+	}
+}
+
+// heapSample reads live heap objects without stopping the world
+var heapSample = []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+
+// Sample reads CPU, heap and accept queue, and starts or stops shedding
+// when one crosses its threshold
+func (s *Shedder) Sample() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if used := cpuTime(); used >= 0 {
+		if !s.lastSample.IsZero() {
+			elapsed := now.Sub(s.lastSample) * time.Duration(runtime.GOMAXPROCS(0))
+			if elapsed > 0 {
+				s.cpuPercent = float64(used-s.lastCPU) * 100 / float64(elapsed)
+			}
+		}
+		s.lastCPU = used
+	}
+	s.lastSample = now
+
+	metrics.Read(heapSample)
+	s.heapBytes = heapSample[0].Value.Uint64()
+
+	s.acceptQueue = -1
+	for _, l := range s.listeners {
+		if queued := acceptQueue(l); queued > s.acceptQueue {
+			s.acceptQueue = queued
+		}
+	}
+
+	s.setPressure(s.overThreshold(s.pressure.Load().(string)))
+}
+
+// overThreshold returns the first signal over its threshold. The signal
+// already shedding stays on until it drops below recoverRatio of it.
+func (s *Shedder) overThreshold(current string) string {
+	over := func(signal string, value, threshold float64) bool {
+		if threshold <= 0 || value < 0 {
+			return false
+		}
+		if signal == current {
+			return value >= threshold*recoverRatio
+		}
+		return value > threshold
+	}
+
+	c := s.config
+	switch {
+	case over(ReasonCPU, s.cpuPercent, c.CPUPercent):
+		return ReasonCPU
+	case over(ReasonHeap, float64(s.heapBytes), float64(c.HeapBytes)):
+		return ReasonHeap
+	case over(ReasonAcceptQueue, float64(s.acceptQueue), float64(c.AcceptQueue)):
+		return ReasonAcceptQueue
+	}
+	return ""
+}
+
+func (s *Shedder) setPressure(signal string) {
+	previous := s.pressure.Swap(signal).(string)
+	switch {
+	case signal != "" && previous != signal:
+		fmt.Printf("WARNING: overload: %s over its threshold, shedding requests below %s priority\n", signal, s.config.MinPriority)
+	case signal == "" && previous != "":
+		fmt.Printf("Overload: %s recovered, no longer shedding requests\n", previous)
+	}
+}
+
+// Pressure returns the signal over its threshold, "" when none
+func (s *Shedder) Pressure() string {
+	return s.pressure.Load().(string)
+}
+
+// Priority returns the priority of a request
+func (s *Shedder) Priority(r *http.Request) Priority {
+	for _, path := range s.config.CriticalPaths {
+		if r.URL.Path == path {
+			return PriorityCritical
+		}
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, rule := range s.config.Rules {
+		if rule.Host != "" && !strings.EqualFold(rule.Host, host) {
+			continue
+		}
+		if strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+			return rule.Priority
+		}
+	}
+	return s.config.DefaultPriority
+}
+
+// Admit admits a request. It returns the function that ends the request,
+// or the reason it was shed.
+func (s *Shedder) Admit(r *http.Request) (release func(), shed string) {
+	priority := s.Priority(r)
+	if priority < PriorityCritical {
+		if max := s.config.MaxRequests; max > 0 && s.requests.Load() >= int64(max) {
+			shed = ReasonRequests
+		} else if pressure := s.Pressure(); pressure != "" && priority < s.config.MinPriority {
+			shed = pressure
+		}
+		if shed != "" {
+			s.shedRequests[reasonIndex(shed)][priority].Add(1)
+			return nil, shed
+		}
+	}
+
+	s.requests.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { s.requests.Add(-1) })
+	}, ""
+}
+
+func reasonIndex(reason string) int {
+	for i, r := range requestReasons {
+		if r == reason {
+			return i
+		}
+	}
+	panic("overload: unknown shed reason " + reason)
+}
+
+// Listener wraps l so that connections over the limit are reset as soon
+// as they are accepted, and samples l's accept queue. l should be the
+// bound TCP listener, before TLS or other wrapping.
+func (s *Shedder) Listener(l net.Listener) net.Listener {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+	return &listener{Listener: l, shedder: s}
+}
+
+type listener struct {
+	net.Listener
+	shedder *Shedder
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.shedder.admitConn(conn) {
+			return &trackedConn{Conn: conn, shedder: l.shedder}, nil
+		}
+		// Reset rather than close, so the client fails fast and nothing
+		// lingers in TIME_WAIT
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+func (l *listener) Close() error {
+	l.shedder.mu.Lock()
+	for i, sampled := range l.shedder.listeners {
+		if sampled == l.Listener {
+			l.shedder.listeners = append(l.shedder.listeners[:i], l.shedder.listeners[i+1:]...)
+			break
+		}
+	}
+	l.shedder.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// admitConn counts a new connection, or returns false when it is over the
+// limit and its client is not exempt
+func (s *Shedder) admitConn(conn net.Conn) bool {
+	max := s.config.MaxConnections
+	if max > 0 && s.connections.Load() >= int64(max) && !s.exempt(conn.RemoteAddr()) {
+		s.shedConnections.Add(1)
+		return false
+	}
+	s.connections.Add(1)
+	return true
+}
+
+func (s *Shedder) exempt(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.config.ExemptNets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackedConn releases its connection slot once closed
+type trackedConn struct {
+	net.Conn
+	shedder *Shedder
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.shedder.connections.Add(-1) })
+	return c.Conn.Close()
+}
+
+// Stats returns the current load and shed counts
+func (s *Shedder) Stats() Stats {
+	s.mu.Lock()
+	stats := Stats{
+		CPUPercent:  s.cpuPercent,
+		HeapBytes:   s.heapBytes,
+		AcceptQueue: s.acceptQueue,
+	}
+	s.mu.Unlock()
+
+	stats.Connections = s.connections.Load()
+	stats.Requests = s.requests.Load()
+	stats.Pressure = s.Pressure()
+	stats.ShedConnections = s.shedConnections.Load()
+	stats.ShedRequests = make(map[string]map[Priority]uint64, len(requestReasons))
+	for i, reason := range requestReasons {
+		counts := make(map[Priority]uint64, PriorityCritical)
+		for p := PriorityLow; p < PriorityCritical; p++ {
+			counts[p] = s.shedRequests[i][p].Load()
+		}
+		stats.ShedRequests[reason] = counts
+	}
+	return stats
+}
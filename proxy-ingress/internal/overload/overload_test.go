@@ -0,0 +1,203 @@
+package overload
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPriority(t *testing.T) {
+	s := New(Config{
+		DefaultPriority: PriorityNormal,
+		CriticalPaths:   []string{"/healthz"},
+		Rules: []Rule{
+			{Host: "shop.example.com", PathPrefix: "/checkout", Priority: PriorityHigh},
+			{PathPrefix: "/reports", Priority: PriorityLow},
+		},
+	})
+
+	tests := []struct {
+		url  string
+		want Priority
+	}{
+		{"http://shop.example.com/healthz", PriorityCritical},
+		{"http://shop.example.com:8080/checkout/pay", PriorityHigh},
+		{"http://other.example.com/checkout", PriorityNormal},
+		{"http://other.example.com/reports/daily", PriorityLow},
+		{"http://other.example.com/healthz/deep", PriorityNormal},
+	}
+	for _, tt := range tests {
+		if got := s.Priority(httptest.NewRequest("GET", tt.url, nil)); got != tt.want {
+			t.Errorf("%s: priority %s, want %s", tt.url, got, tt.want)
+		}
+	}
+
+	if p, err := ParsePriority("High"); err != nil || p != PriorityHigh {
+		t.Errorf("ParsePriority(High) = %v, %v", p, err)
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority accepted an unknown name")
+	}
+}
+
+func TestRequestLimit(t *testing.T) {
+	s := New(Config{MaxRequests: 1, DefaultPriority: PriorityHigh, CriticalPaths: []string{"/healthz"}})
+	request := httptest.NewRequest("GET", "/", nil)
+
+	release, shed := s.Admit(request)
+	if shed != "" {
+		t.Fatalf("first request shed for %s", shed)
+	}
+	if _, shed := s.Admit(request); shed != ReasonRequests {
+		t.Errorf("request over the limit shed for %q", shed)
+	}
+	// Health checks pass even with the limit reached
+	health, shed := s.Admit(httptest.NewRequest("GET", "/healthz", nil))
+	if shed != "" {
+		t.Errorf("health check shed for %s", shed)
+	}
+	health()
+
+	release()
+	release()
+	if _, shed := s.Admit(request); shed != "" {
+		t.Errorf("request after release shed for %s", shed)
+	}
+	if got := s.Stats().ShedRequests[ReasonRequests][PriorityHigh]; got != 1 {
+		t.Errorf("counted %d shed requests, want 1", got)
+	}
+}
+
+func TestPressureSheds(t *testing.T) {
+	s := New(Config{HeapBytes: 1, MinPriority: PriorityHigh, DefaultPriority: PriorityNormal,
+		Rules: []Rule{{PathPrefix: "/api", Priority: PriorityHigh}}})
+	s.Sample()
+	if s.Pressure() != ReasonHeap {
+		t.Fatalf("pressure %q with a 1 byte heap threshold", s.Pressure())
+	}
+
+	if _, shed := s.Admit(httptest.NewRequest("GET", "/", nil)); shed != ReasonHeap {
+		t.Errorf("normal request shed for %q under heap pressure", shed)
+	}
+	if release, shed := s.Admit(httptest.NewRequest("GET", "/api/orders", nil)); shed != "" {
+		t.Errorf("high priority request shed for %s", shed)
+	} else {
+		release()
+	}
+
+	// Shedding stops once the heap drops back under the threshold
+	s.config.HeapBytes = 1 << 62
+	s.Sample()
+	if s.Pressure() != "" {
+		t.Errorf("pressure %q after recovery", s.Pressure())
+	}
+	if _, shed := s.Admit(httptest.NewRequest("GET", "/", nil)); shed != "" {
+		t.Errorf("request shed for %s after recovery", shed)
+	}
+}
+
+func TestOverThresholdHysteresis(t *testing.T) {
+	s := New(Config{AcceptQueue: 100})
+	s.acceptQueue = 101
+	if got := s.overThreshold(""); got != ReasonAcceptQueue {
+		t.Fatalf("queue over the threshold returned %q", got)
+	}
+	s.acceptQueue = 95
+	if got := s.overThreshold(""); got != "" {
+		t.Errorf("queue under the threshold started shedding for %s", got)
+	}
+	if got := s.overThreshold(ReasonAcceptQueue); got != ReasonAcceptQueue {
+		t.Errorf("queue just under the threshold stopped shedding")
+	}
+	s.acceptQueue = 80
+	if got := s.overThreshold(ReasonAcceptQueue); got != "" {
+		t.Errorf("queue well under the threshold kept shedding for %s", got)
+	}
+}
+
+// dialAccepted dials addr and reports whether the connection stays open,
+// reading until the server side closes or resets it
+func dialAccepted(t *testing.T, addr string) (net.Conn, bool) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return conn, true
+	}
+	conn.Close()
+	return nil, false
+}
+
+// listen starts a shedding listener on loopback and accepts from it
+func listen(t *testing.T, s *Shedder) (string, <-chan net.Conn) {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := s.Listener(tcp)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return tcp.Addr().String(), accepted
+}
+
+func TestConnectionLimit(t *testing.T) {
+	s := New(Config{MaxConnections: 1})
+	addr, accepted := listen(t, s)
+
+	first, ok := dialAccepted(t, addr)
+	if !ok {
+		t.Fatal("first connection was not accepted")
+	}
+	defer first.Close()
+	server := <-accepted
+
+	if _, ok := dialAccepted(t, addr); ok {
+		t.Error("connection over the limit was accepted")
+	}
+	if got := s.Stats().ShedConnections; got != 1 {
+		t.Errorf("counted %d shed connections, want 1", got)
+	}
+
+	// Closing a connection frees its slot
+	server.Close()
+	server.Close()
+	next, ok := dialAccepted(t, addr)
+	if !ok {
+		t.Fatal("connection after a close was not accepted")
+	}
+	next.Close()
+	(<-accepted).Close()
+}
+
+func TestConnectionLimitExempt(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := New(Config{MaxConnections: 1, ExemptNets: []*net.IPNet{loopback}})
+	addr, _ := listen(t, s)
+
+	for i := 0; i < 2; i++ {
+		conn, ok := dialAccepted(t, addr)
+		if !ok {
+			t.Fatalf("exempt connection %d was not accepted", i+1)
+		}
+		defer conn.Close()
+	}
+	if got := s.Stats().ShedConnections; got != 0 {
+		t.Errorf("shed %d exempt connections", got)
+	}
+}
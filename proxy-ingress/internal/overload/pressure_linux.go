@@ -0,0 +1,39 @@
+package overload
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuTime returns the user and system CPU time used by the process
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return -1
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// acceptQueue returns the connections waiting on a TCP listener to be
+// accepted, -1 when unknown. For a listening socket the kernel reports the
+// accept queue length as unacked segments.
+func acceptQueue(l net.Listener) int {
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		return -1
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	queued := -1
+	raw.Control(func(fd uintptr) {
+		if info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO); err == nil {
+			queued = int(info.Unacked)
+		}
+	})
+	return queued
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package overload
+
+import (
+	"net"
+	"time"
+)
+
+// cpuTime is only implemented on Linux
+func cpuTime() time.Duration {
+	return -1
+}
+
+// acceptQueue is only implemented on Linux
+func acceptQueue(l net.Listener) int {
+	return -1
+}
@@ -0,0 +1,214 @@
+// Package ratelimit implements token bucket limits for ingress routes, per
+// route and per client IP. Buckets live in memory or in Redis, where every
+// replica draws from the same budget.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Limit scopes, used as metric labels
+const (
+	ScopeRoute  = "route"
+	ScopeClient = "client"
+)
+
+// Rule is a token bucket: Rate requests per second with room for Burst at once
+type Rule struct {
+	Rate  float64
+	Burst int // Defaults to Rate rounded up
+}
+
+// Enabled reports whether the rule limits anything
+func (r Rule) Enabled() bool {
+	return r.Rate > 0
+}
+
+func (r Rule) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.Rate))
+}
+
+// Result is the state of a bucket after taking a token
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Until the bucket is full again
+	RetryAfter time.Duration // Until the next token, when not allowed
+}
+
+// Store keeps token buckets
+type Store interface {
+	Take(ctx context.Context, key string, rule Rule) (Result, error)
+}
+
+// result builds the Result for a bucket left with tokens
+func result(rule Rule, allowed bool, tokens float64) Result {
+	burst := rule.burst()
+	res := Result{
+		Allowed:   allowed,
+		Limit:     int(burst),
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((burst - tokens) / rule.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+	}
+	return res
+}
+
+// Limiter applies route and client rules to requests. Store errors let the
+// request through so a Redis outage does not take the ingress down.
+type Limiter struct {
+	store Store
+
+	limited map[string]*uint64 // by scope
+	errors  uint64
+}
+
+// NewLimiter creates a limiter backed by store
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{
+		store: store,
+		limited: map[string]*uint64{
+			ScopeRoute:  new(uint64),
+			ScopeClient: new(uint64),
+		},
+	}
+}
+
+// Allow takes a token from the client's bucket for the route and then from
+// the route's bucket. It returns the result with the fewest tokens left, or
+// the one that rejected the request, and whether any rule applied.
+func (l *Limiter) Allow(ctx context.Context, route, clientIP string, routeRule, clientRule Rule) (Result, bool) {
+	var tightest *Result
+
+	checks := []struct {
+		scope string
+		key   string
+		rule  Rule
+	}{
+		{ScopeClient, "client:" + route + ":" + clientIP, clientRule},
+		{ScopeRoute, "route:" + route, routeRule},
+	}
+	for _, check := range checks {
+		if !check.rule.Enabled() {
+			continue
+		}
+
+		res, err := l.store.Take(ctx, check.key, check.rule)
+		if err != nil {
+			atomic.AddUint64(&l.errors, 1)
+			logrus.Warnf("Rate limit store error for %s, allowing request: %v", check.key, err)
+			continue
+		}
+		if !res.Allowed {
+			atomic.AddUint64(l.limited[check.scope], 1)
+			return res, true
+		}
+		if tightest == nil || res.Remaining < tightest.Remaining {
+			tightest = &res
+		}
+	}
+
+	if tightest == nil {
+		return Result{Allowed: true}, false
+	}
+	return *tightest, true
+}
+
+// Stats returns requests rejected per scope and store errors
+func (l *Limiter) Stats() (limited map[string]uint64, errors uint64) {
+	limited = make(map[string]uint64, len(l.limited))
+	for scope, count := range l.limited {
+		limited[scope] = atomic.LoadUint64(count)
+	}
+	return limited, atomic.LoadUint64(&l.errors)
+}
+
+// WriteHeaders sets the X-RateLimit-* headers for a result, and Retry-After
+// when the request was rejected
+func WriteHeaders(h http.Header, res Result) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+	WriteRetryAfter(h, res)
+}
+
+// WriteRetryAfter sets Retry-After, in whole seconds, when the request was
+// rejected
+func WriteRetryAfter(h http.Header, res Result) {
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	}
+}
+
+// MemoryStore keeps buckets in process memory. Buckets that have refilled
+// are dropped, so per-client keys do not grow without bound.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket will be full again
+}
+
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take implements Store
+func (s *MemoryStore) Take(_ context.Context, key string, rule Rule) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	burst := rule.burst()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rule.Rate)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((burst - b.tokens) / rule.Rate * float64(time.Second)))
+
+	return result(rule, allowed, b.tokens), nil
+}
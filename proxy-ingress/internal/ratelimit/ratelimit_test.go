@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestStore() (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	store := NewMemoryStore()
+	store.now = clock.Now
+	return store, clock
+}
+
+func TestMemoryStoreBurstAndRefill(t *testing.T) {
+	store, clock := newTestStore()
+	rule := Rule{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		res, _ := store.Take(context.Background(), "k", rule)
+		if !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("Request %d: expected allowed with %d remaining, got %+v", i, 2-i, res)
+		}
+	}
+
+	res, _ := store.Take(context.Background(), "k", rule)
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("Expected rejection with a 500ms retry, got %+v", res)
+	}
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	if res, _ := store.Take(context.Background(), "k", rule); !res.Allowed {
+		t.Errorf("Expected a token after refilling, got %+v", res)
+	}
+}
+
+func TestMemoryStoreSweepsFullBuckets(t *testing.T) {
+	store, clock := newTestStore()
+	store.Take(context.Background(), "idle", Rule{Rate: 10})
+
+	clock.now = clock.now.Add(2 * sweepInterval)
+	store.Take(context.Background(), "active", Rule{Rate: 10})
+
+	if _, ok := store.buckets["idle"]; ok || len(store.buckets) != 1 {
+		t.Errorf("Expected the refilled bucket to be swept, have %d buckets", len(store.buckets))
+	}
+}
+
+func TestLimiterClientAndRouteScopes(t *testing.T) {
+	store, _ := newTestStore()
+	limiter := NewLimiter(store)
+	routeRule := Rule{Rate: 1, Burst: 3}
+	clientRule := Rule{Rate: 1, Burst: 1}
+
+	if res, applied := limiter.Allow(context.Background(), "/api", "10.0.0.1", routeRule, clientRule); !applied || !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("Expected first request allowed with the client bucket empty, got %+v", res)
+	}
+	if res, _ := limiter.Allow(context.Background(), "/api", "10.0.0.1", routeRule, clientRule); res.Allowed {
+		t.Fatal("Expected the second request from the same client to be limited")
+	}
+	limiter.Allow(context.Background(), "/api", "10.0.0.2", routeRule, clientRule)
+	limiter.Allow(context.Background(), "/api", "10.0.0.3", routeRule, clientRule)
+	if res, _ := limiter.Allow(context.Background(), "/api", "10.0.0.4", routeRule, clientRule); res.Allowed {
+		t.Fatal("Expected the route budget to be exhausted")
+	}
+
+	limited, _ := limiter.Stats()
+	if limited[ScopeClient] != 1 || limited[ScopeRoute] != 1 {
+		t.Errorf("Unexpected limited counts %v", limited)
+	}
+
+	if _, applied := limiter.Allow(context.Background(), "/open", "10.0.0.1", Rule{}, Rule{}); applied {
+		t.Error("Expected no rule to apply to an unlimited route")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, Rule) (Result, error) {
+	return Result{}, errors.New("connection refused")
+}
+
+func TestLimiterFailsOpen(t *testing.T) {
+	limiter := NewLimiter(failingStore{})
+	if res, _ := limiter.Allow(context.Background(), "/api", "10.0.0.1", Rule{Rate: 1}, Rule{}); !res.Allowed {
+		t.Error("Expected requests to pass when the store is unavailable")
+	}
+	if _, errs := limiter.Stats(); errs != 1 {
+		t.Errorf("Expected one store error, got %d", errs)
+	}
+}
+
+func TestWriteHeaders(t *testing.T) {
+	h := http.Header{}
+	WriteHeaders(h, Result{Limit: 10, Remaining: 0, Reset: 1500 * time.Millisecond, RetryAfter: 100 * time.Millisecond})
+
+	for name, want := range map[string]string{
+		"X-RateLimit-Limit":     "10",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "2",
+		"Retry-After":           "1",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package tenant
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter on a fake clock that sleeps by
+// advancing the clock and records the time slept
+func newTestLimiter() (*Limiter, *time.Time, *time.Duration) {
+	now := time.Unix(1700000000, 0)
+	var slept time.Duration
+	l := NewLimiter()
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	return l, &now, &slept
+}
+
+func TestConnectionQuota(t *testing.T) {
+	l, _, _ := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", MaxConnections: 2}})
+
+	first, rejected := l.Open("acme")
+	if rejected != "" {
+		t.Fatalf("Expected the first connection to be admitted, got %s", rejected)
+	}
+	if _, rejected := l.Open("acme"); rejected != "" {
+		t.Fatalf("Expected the second connection to be admitted, got %s", rejected)
+	}
+	if _, rejected := l.Open("acme"); rejected != QuotaConnections {
+		t.Fatalf("Expected the third connection to be rejected, got %q", rejected)
+	}
+
+	// Releasing twice frees one slot only
+	first()
+	first()
+	if _, rejected := l.Open("acme"); rejected != "" {
+		t.Fatalf("Expected a connection after a release, got %s", rejected)
+	}
+	if _, rejected := l.Open("acme"); rejected != QuotaConnections {
+		t.Fatalf("Expected the quota to be full again, got %q", rejected)
+	}
+
+	// Other tenants are not limited
+	for i := 0; i < 5; i++ {
+		if _, rejected := l.Open("globex"); rejected != "" {
+			t.Fatalf("Expected unlimited tenant to be admitted, got %s", rejected)
+		}
+	}
+}
+
+func TestRequestQuota(t *testing.T) {
+	l, now, _ := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", RequestsPerSecond: 2}})
+
+	for i := 0; i < 2; i++ {
+		if _, rejected := l.Open("acme"); rejected != "" {
+			t.Fatalf("Expected a burst of two requests, got %s", rejected)
+		}
+	}
+	if _, rejected := l.Open("acme"); rejected != QuotaRequests {
+		t.Fatalf("Expected the third request to be rejected, got %q", rejected)
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if _, rejected := l.Open("acme"); rejected != "" {
+		t.Fatalf("Expected a request after the bucket refilled, got %s", rejected)
+	}
+
+	// Dropping the quota lifts the limit but keeps the counters
+	l.Update(nil)
+	if _, rejected := l.Open("acme"); rejected != "" {
+		t.Fatalf("Expected no limit once the quota is removed, got %s", rejected)
+	}
+	usage := l.Usage()
+	if len(usage) != 1 || usage[0].Rejected[QuotaRequests] != 1 || usage[0].Active != 4 {
+		t.Fatalf("Expected 1 rejected and 4 active requests, got %+v", usage)
+	}
+}
+
+func TestBandwidthQuota(t *testing.T) {
+	l, _, slept := newTestLimiter()
+	l.Update([]Quota{{ID: "acme", BandwidthKbps: 800}})
+
+	// 800 kbps is 100 kB/s, shared by every writer of the tenant
+	var a, b bytes.Buffer
+	l.Writer("acme", &a).Write(make([]byte, 50000))
+	l.Writer("acme", &b).Write(make([]byte, 50000))
+	if *slept < 900*time.Millisecond || *slept > 1100*time.Millisecond {
+		t.Errorf("Expected about 1s of pacing for 100 kB, got %v", *slept)
+	}
+	if a.Len() != 50000 || b.Len() != 50000 {
+		t.Errorf("Expected every byte written, got %d and %d", a.Len(), b.Len())
+	}
+
+	*slept = 0
+	l.Writer("globex", &a).Write(make([]byte, 50000))
+	if *slept != 0 {
+		t.Errorf("Expected no pacing without a quota, got %v", *slept)
+	}
+}
@@ -0,0 +1,218 @@
+// Package tickets rotates the TLS session ticket keys of the ingress
+// listeners. Keys are either generated locally or fetched from the manager
+// so every replica behind a load balancer can resume the others' sessions.
+package tickets
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRotationInterval = time.Hour
+	defaultRefreshInterval  = 5 * time.Minute
+	defaultKeyCount         = 3
+)
+
+// KeySource returns the cluster's session ticket keys, newest first. The
+// first key encrypts new tickets, the rest only decrypt older ones.
+type KeySource interface {
+	SessionTicketKeys(ctx context.Context) ([][32]byte, error)
+}
+
+// Config controls session ticket key rotation
+type Config struct {
+	Shared           bool          // Fetch keys from the manager instead of generating them
+	RotationInterval time.Duration // How often local keys rotate
+	RefreshInterval  time.Duration // How often shared keys are fetched
+	KeyCount         int           // Local keys kept so tickets outlive one rotation
+	Timeout          time.Duration // Per fetch from the manager
+}
+
+// Stats is a snapshot of handshake and rotation counters
+type Stats struct {
+	Handshakes      uint64 // Full and resumed handshakes
+	Resumed         uint64
+	Rotations       uint64 // Times the encryption key changed
+	RefreshFailures uint64 // Failed fetches from the manager
+	Keys            int
+	KeyAge          time.Duration // Age of the current encryption key
+}
+
+// Manager keeps a tls.Config's session ticket keys rotated and counts how
+// many handshakes resume a session
+type Manager struct {
+	tlsConfig *tls.Config
+	source    KeySource
+	config    Config
+
+	mu        sync.Mutex
+	keys      [][32]byte
+	rotatedAt time.Time
+
+	handshakes      uint64
+	resumed         uint64
+	rotations       uint64
+	refreshFailures uint64
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// NewManager creates a key manager for tlsConfig. The config must be the one
+// handed to tls.NewListener; http.Server.ServeTLS works on a clone, which
+// would not see rotated keys.
+func NewManager(tlsConfig *tls.Config, source KeySource, cfg Config) *Manager {
+	if cfg.RotationInterval <= 0 {
+		cfg.RotationInterval = defaultRotationInterval
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+	if cfg.KeyCount <= 0 {
+		cfg.KeyCount = defaultKeyCount
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	return &Manager{
+		tlsConfig: tlsConfig,
+		source:    source,
+		config:    cfg,
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// Start installs the first keys and rotates them in the background. When
+// the manager cannot be reached a local key is used until a fetch succeeds.
+func (m *Manager) Start() {
+	interval := m.config.RotationInterval
+	if m.config.Shared {
+		interval = m.config.RefreshInterval
+		if err := m.refresh(); err != nil {
+			logrus.Warnf("Failed to fetch shared session ticket keys, using a local key: %v", err)
+			m.rotate()
+		}
+	} else {
+		m.rotate()
+	}
+
+	go m.loop(interval)
+}
+
+// Stop ends background rotation
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() { close(m.stopChan) })
+}
+
+func (m *Manager) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-ticker.C:
+			if !m.config.Shared {
+				m.rotate()
+				continue
+			}
+			if err := m.refresh(); err != nil {
+				logrus.Warnf("Failed to refresh shared session ticket keys: %v", err)
+			}
+		}
+	}
+}
+
+// refresh fetches the shared keys from the manager
+func (m *Manager) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+	defer cancel()
+
+	keys, err := m.source.SessionTicketKeys(ctx)
+	if err == nil && len(keys) == 0 {
+		err = fmt.Errorf("manager returned no keys")
+	}
+	if err != nil {
+		atomic.AddUint64(&m.refreshFailures, 1)
+		return err
+	}
+
+	m.setKeys(keys)
+	return nil
+}
+
+// rotate generates a new local encryption key, keeping the previous ones
+// for decryption
+func (m *Manager) rotate() {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		logrus.Errorf("Failed to generate session ticket key: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	keys := append([][32]byte{key}, m.keys...)
+	m.mu.Unlock()
+
+	if len(keys) > m.config.KeyCount {
+		keys = keys[:m.config.KeyCount]
+	}
+	m.setKeys(keys)
+}
+
+func (m *Manager) setKeys(keys [][32]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.keys) == 0 || m.keys[0] != keys[0] {
+		m.rotatedAt = time.Now()
+		atomic.AddUint64(&m.rotations, 1)
+	}
+	m.keys = keys
+	m.tlsConfig.SetSessionTicketKeys(keys)
+}
+
+// VerifyConnection counts full and resumed handshakes before calling next,
+// which may be nil. It is meant for tls.Config.VerifyConnection, which runs
+// on resumed handshakes too.
+func (m *Manager) VerifyConnection(next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		atomic.AddUint64(&m.handshakes, 1)
+		if cs.DidResume {
+			atomic.AddUint64(&m.resumed, 1)
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+}
+
+// Stats returns the current counters
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	keys, rotatedAt := len(m.keys), m.rotatedAt
+	m.mu.Unlock()
+
+	stats := Stats{
+		Handshakes:      atomic.LoadUint64(&m.handshakes),
+		Resumed:         atomic.LoadUint64(&m.resumed),
+		Rotations:       atomic.LoadUint64(&m.rotations),
+		RefreshFailures: atomic.LoadUint64(&m.refreshFailures),
+		Keys:            keys,
+	}
+	if !rotatedAt.IsZero() {
+		stats.KeyAge = time.Since(rotatedAt)
+	}
+	return stats
+}
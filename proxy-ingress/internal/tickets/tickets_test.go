@@ -0,0 +1,145 @@
+package tickets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type staticSource struct {
+	keys [][32]byte
+	err  error
+}
+
+func (s *staticSource) SessionTicketKeys(context.Context) ([][32]byte, error) {
+	return s.keys, s.err
+}
+
+func testServerConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ingress"},
+		DNSNames:     []string{"ingress"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MaxVersion:   tls.VersionTLS12,
+	}
+}
+
+// handshake connects to a fresh server using serverConfig and reports
+// whether the client resumed its cached session
+func handshake(t *testing.T, serverConfig *tls.Config, cache tls.ClientSessionCache) bool {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: cache,
+		ServerName:         "ingress",
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().DidResume
+}
+
+func TestSharedKeysResumeAcrossReplicas(t *testing.T) {
+	var key [32]byte
+	rand.Read(key[:])
+	source := &staticSource{keys: [][32]byte{key}}
+
+	replicaA := testServerConfig(t)
+	managerA := NewManager(replicaA, source, Config{Shared: true})
+	replicaA.VerifyConnection = managerA.VerifyConnection(nil)
+	managerA.Start()
+	defer managerA.Stop()
+
+	replicaB := testServerConfig(t)
+	replicaB.Certificates = replicaA.Certificates
+	managerB := NewManager(replicaB, source, Config{Shared: true})
+	replicaB.VerifyConnection = managerB.VerifyConnection(nil)
+	managerB.Start()
+	defer managerB.Stop()
+
+	cache := tls.NewLRUClientSessionCache(1)
+	if handshake(t, replicaA, cache) {
+		t.Fatal("Expected the first handshake to be a full handshake")
+	}
+	if !handshake(t, replicaB, cache) {
+		t.Error("Expected a replica sharing the key to resume the session")
+	}
+
+	if stats := managerB.Stats(); stats.Handshakes != 1 || stats.Resumed != 1 || stats.Keys != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestLocalRotationKeepsOldKeys(t *testing.T) {
+	serverConfig := testServerConfig(t)
+	manager := NewManager(serverConfig, nil, Config{KeyCount: 2})
+	manager.Start()
+	defer manager.Stop()
+
+	cache := tls.NewLRUClientSessionCache(1)
+	handshake(t, serverConfig, cache)
+
+	manager.rotate()
+	if !handshake(t, serverConfig, cache) {
+		t.Error("Expected a ticket from the previous key to resume")
+	}
+
+	manager.rotate()
+	manager.rotate()
+	if stats := manager.Stats(); stats.Keys != 2 || stats.Rotations != 4 {
+		t.Errorf("Expected 2 keys after 4 rotations, got %+v", stats)
+	}
+}
+
+func TestSharedFallsBackToLocalKey(t *testing.T) {
+	serverConfig := testServerConfig(t)
+	manager := NewManager(serverConfig, &staticSource{err: errors.New("unreachable")}, Config{Shared: true})
+	manager.Start()
+	defer manager.Stop()
+
+	if stats := manager.Stats(); stats.Keys != 1 || stats.RefreshFailures != 1 {
+		t.Errorf("Expected a local key after a failed fetch, got %+v", stats)
+	}
+	handshake(t, serverConfig, tls.NewLRUClientSessionCache(1))
+}
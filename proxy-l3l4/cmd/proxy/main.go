@@ -7,20 +7,31 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"marchproxy-l3l4/internal/acceleration"
 	"marchproxy-l3l4/internal/config"
 	"marchproxy-l3l4/internal/multicloud"
+	"marchproxy-l3l4/internal/netutil"
 	"marchproxy-l3l4/internal/numa"
 	"marchproxy-l3l4/internal/observability"
 	"marchproxy-l3l4/internal/qos"
+	"marchproxy-l3l4/internal/sctp"
 	"marchproxy-l3l4/internal/zerotrust"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/bgp"
+	"marchproxy-shared/coordination"
+	"marchproxy-shared/dashgen"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/licensing"
+	"marchproxy-shared/readiness"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -48,18 +59,114 @@ func main() {
 - Zero-trust security features`,
 		Version: fmt.Sprintf("%s (built: %s, commit: %s)", version, buildTime, gitCommit),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runProxy(configPath, logger)
+			if validate, _ := cmd.Flags().GetBool("validate-config"); validate {
+				os.Exit(checkConfig(configPath, cmd.Flags()))
+			}
+			return runProxy(configPath, cmd.Flags(), logger)
 		},
 	}
 
 	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file path")
+	layers.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newConfigCmd(&configPath))
+	rootCmd.AddCommand(newMetricsCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		logger.WithError(err).Fatal("Failed to start proxy")
 	}
 }
 
-func runProxy(configPath string, logger *logrus.Logger) error {
+// newConfigCmd creates the config command. config print-effective prints
+// the configuration this binary would run with, given the same flags and
+// environment, with secrets masked.
+func newConfigCmd(configPath *string) *cobra.Command {
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print-effective",
+		Short: "Print the merged configuration with secrets masked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := config.Load(*configPath, cmd.Flags())
+			if err == nil {
+				err = layers.PrintEffective(os.Stdout, cfg, format)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", "yaml", "output format: yaml or json")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(printCmd)
+	return configCmd
+}
+
+// newMetricsCmd creates the metrics command. metrics export-dashboards
+// generates a Grafana dashboard and Prometheus rules from the metrics this
+// binary registers, adding those only a running L3/L4 proxy exposes when --from
+// points at its metrics endpoint.
+func newMetricsCmd() *cobra.Command {
+	var outputDir, from string
+	exportCmd := &cobra.Command{
+		Use:   "export-dashboards",
+		Short: "Generate a Grafana dashboard and Prometheus rules from the registered metrics",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := exportDashboards(outputDir, from); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", ".", "directory to write the dashboard and rules to")
+	exportCmd.Flags().StringVar(&from, "from", "", "metrics endpoint of a running L3/L4 proxy to read as well")
+
+	metricsCmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Inspect the registered metrics",
+	}
+	metricsCmd.AddCommand(exportCmd)
+	return metricsCmd
+}
+
+// exportDashboards writes the dashboard and rules generated from the
+// registered metrics, merged with those scraped from a running L3/L4 proxy
+func exportDashboards(outputDir, from string) error {
+	metrics, err := dashgen.FromDefaultRegistry()
+	if err != nil {
+		return err
+	}
+	if from != "" {
+		scraped, err := dashgen.Scrape(from)
+		if err != nil {
+			return err
+		}
+		metrics = dashgen.Merge(scraped, metrics)
+	}
+	files, err := dashgen.Write(outputDir, "l3l4", metrics)
+	for _, file := range files {
+		fmt.Printf("Wrote %s\n", file)
+	}
+	return err
+}
+
+// checkConfig loads the configuration for --validate-config and returns
+// the exit status, printing every problem found
+func checkConfig(configPath string, flags *pflag.FlagSet) int {
+	if _, err := config.Load(configPath, flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+func runProxy(configPath string, flags *pflag.FlagSet, logger *logrus.Logger) error {
 	logger.WithFields(logrus.Fields{
 		"version":    version,
 		"build_time": buildTime,
@@ -67,14 +174,28 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 	}).Info("Starting MarchProxy L3/L4 Enhanced Proxy")
 
 	// Load configuration
-	cfg, err := config.Load(configPath)
+	cfg, err := config.Load(configPath, flags)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	// /readyz stays unavailable until the config is loaded, the listeners
+	// are bound and XDP programs are loaded when enabled
+	readySteps := []string{readiness.StepConfig, readiness.StepListeners}
+	if cfg.EnableAcceleration && (cfg.AccelerationMode == "xdp" || cfg.AccelerationMode == "afxdp") {
+		readySteps = append(readySteps, readiness.StepEBPF)
+	}
+	ready := readiness.New(readySteps...)
+	ready.Done(readiness.StepConfig)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Gate enterprise features on the cluster's entitlements
+	license := cfg.NewLicenseGate(logger)
+	license.Refresh(ctx)
+	go license.Run(ctx)
+
 	// Initialize observability
 	var metrics *observability.Metrics
 	var tracer *observability.Tracer
@@ -82,6 +203,17 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 	metrics = observability.NewMetrics(cfg.MetricsNamespace)
 	logger.Info("Metrics initialized")
 
+	// Multipath TCP connections are tracked for subflow stats
+	mptcpConns := &netutil.MPTCPTracker{}
+	observability.RegisterMPTCPMetrics(cfg.MetricsNamespace, mptcpConns)
+	if cfg.EnableMPTCP {
+		if netutil.MPTCPSupported() {
+			logger.Info("Multipath TCP enabled")
+		} else {
+			logger.Warn("MPTCP enabled but not available in this kernel, connections will use plain TCP")
+		}
+	}
+
 	if cfg.EnableTracing {
 		tracer, err = observability.NewTracer("marchproxy-l3l4", cfg.JaegerEndpoint, cfg.TraceSampleRate, logger)
 		if err != nil {
@@ -131,7 +263,7 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 
 	// Initialize multi-cloud router
 	var mcRouter *multicloud.Router
-	if cfg.EnableMultiCloud && len(cfg.Backends) > 0 {
+	if cfg.EnableMultiCloud && len(cfg.Backends) > 0 && license.Require(licensing.FeatureMultiCloud, "Multi-cloud routing") {
 		backends := make([]*multicloud.Backend, len(cfg.Backends))
 		for i, b := range cfg.Backends {
 			backends[i] = &multicloud.Backend{
@@ -150,6 +282,7 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 		if err != nil {
 			logger.WithError(err).Warn("Failed to initialize multi-cloud router")
 		} else {
+			mcRouter.SetMultipathTCP(cfg.EnableMPTCP)
 			if err := mcRouter.Start(); err != nil {
 				logger.WithError(err).Warn("Failed to start multi-cloud router")
 			} else {
@@ -158,20 +291,100 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 		}
 	}
 
+	// Elect one replica through the manager for singleton tasks; without
+	// coordination the nil elector leads on every replica
+	var elector *coordination.Elector
+	coordCtx, coordCancel := context.WithCancel(ctx)
+	defer coordCancel()
+	coordDone := make(chan struct{})
+	if backend := cfg.NewCoordinationBackend(); backend != nil {
+		elector = coordination.NewElector(backend, "l3l4/leader", cfg.Coordination.LeaseTTL, logger)
+		go func() {
+			defer close(coordDone)
+			elector.Run(coordCtx)
+		}()
+		logger.WithField("lease_ttl", cfg.Coordination.LeaseTTL).Info("Replica coordination enabled")
+	} else {
+		close(coordDone)
+	}
+
+	// Announce the service VIPs over BGP while backends are healthy and the
+	// instance is not draining, so routers only send traffic to live nodes
+	var speaker *bgp.Speaker
+	var draining atomic.Bool
+	bgpCtx, bgpCancel := context.WithCancel(ctx)
+	defer bgpCancel()
+	bgpDone := make(chan struct{})
+	if cfg.BGP.Enabled {
+		speakerConfig, err := cfg.BGP.SpeakerConfig()
+		if err != nil {
+			return fmt.Errorf("invalid BGP configuration: %w", err)
+		}
+		speaker, err = bgp.NewSpeaker(speakerConfig, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create BGP speaker: %w", err)
+		}
+		go func() {
+			defer close(bgpDone)
+			speaker.Run(bgpCtx)
+		}()
+		go speaker.Follow(bgpCtx, cfg.BGP.CheckInterval, func() bool {
+			if draining.Load() {
+				return false
+			}
+			if cfg.BGP.LeaderOnly && !elector.IsLeader() {
+				return false
+			}
+			// Without multi-cloud routing there are no backend health checks
+			return mcRouter == nil || mcRouter.HasHealthyBackends()
+		})
+		logger.WithFields(logrus.Fields{
+			"local_as":    cfg.BGP.LocalAS,
+			"peers":       len(cfg.BGP.Peers),
+			"vips":        cfg.BGP.VIPs,
+			"leader_only": cfg.BGP.LeaderOnly,
+		}).Info("BGP speaker started")
+	}
+
 	// Initialize hardware acceleration
 	var accelManager *acceleration.Manager
 	if cfg.EnableAcceleration {
 		accelManager, err = acceleration.NewManager(cfg.AccelerationMode, logger)
 		if err != nil {
 			logger.WithError(err).Warn("Failed to initialize acceleration")
+			ready.Fail(readiness.StepEBPF, err)
 		} else {
 			if err := accelManager.Initialize(cfg.XDPDevice, cfg.AFXDPQueueCount); err != nil {
 				logger.WithError(err).Warn("Failed to initialize acceleration hardware")
+				ready.Fail(readiness.StepEBPF, err)
 			} else if err := accelManager.Start(); err != nil {
 				logger.WithError(err).Warn("Failed to start acceleration")
+				ready.Fail(readiness.StepEBPF, err)
 			} else {
 				logger.WithField("mode", accelManager.GetMode()).Info("Hardware acceleration started")
+				ready.Done(readiness.StepEBPF)
+			}
+		}
+	}
+
+	// Start SCTP forwarding
+	var sctpProxy *sctp.Proxy
+	if cfg.SCTP.Enabled {
+		if !sctp.Supported() {
+			logger.Warn("SCTP forwarding enabled but the kernel has no SCTP support, load the sctp module")
+		} else {
+			mappings, err := cfg.SCTP.ProxyMappings()
+			if err != nil {
+				return fmt.Errorf("invalid SCTP mappings: %w", err)
 			}
+			sctpProxy = sctp.NewProxy(mappings, cfg.SCTP.Options(), cfg.SCTP.DialTimeout, logger)
+			if err := sctpProxy.Start(); err != nil {
+				return fmt.Errorf("failed to start SCTP forwarding: %w", err)
+			}
+			logger.WithFields(logrus.Fields{
+				"mappings": len(mappings),
+				"streams":  cfg.SCTP.Streams,
+			}).Info("SCTP forwarding started")
 		}
 	}
 
@@ -198,7 +411,7 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 		if err != nil {
 			logger.WithError(err).Warn("OPA policy enforcer unavailable")
 		} else {
-			policyEnforcer.SetLicenseStatus(cfg.IsEnterpriseFeatureEnabled("zero-trust"))
+			license.Watch(licensing.FeatureZeroTrust, policyEnforcer.SetLicenseStatus)
 		}
 
 		if _, err := os.Stat(cfg.CertPath); err == nil {
@@ -212,6 +425,9 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 		}
 	}
 
+	// SCTP is listening, the metrics server binds below
+	ready.Done(readiness.StepListeners)
+
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -224,8 +440,32 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 		w.Write([]byte("OK"))
 	})
 
+	// Readiness for rollouts, unavailable while draining
+	metricsMux.Handle("/readyz", ready)
+
 	metricsMux.Handle("/metrics", promhttp.Handler())
 
+	// Drain withdraws the BGP announcement so peers move traffic to other
+	// instances, e.g. before maintenance
+	metricsMux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			draining.Store(true)
+			ready.SetUnready("draining")
+			logger.Info("Draining, BGP announcement will be withdrawn")
+		case http.MethodDelete:
+			draining.Store(false)
+			ready.SetUnready("")
+			logger.Info("Drain cleared")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"draining":%t}`, draining.Load())
+	})
+
 	metricsMux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		status := map[string]interface{}{
 			"version":     version,
@@ -234,6 +474,7 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 			"numa_enabled": cfg.EnableNUMA,
 			"multicloud_enabled": cfg.EnableMultiCloud,
 			"acceleration_mode": "standard",
+			"license":     license.Status(),
 		}
 
 		if accelManager != nil {
@@ -253,19 +494,46 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 			status["routing_stats"] = mcRouter.GetStats()
 		}
 
+		status["draining"] = draining.Load()
+		if speaker != nil {
+			status["bgp_peers"] = speaker.Status()
+		}
+		if elector != nil {
+			status["coordination"] = elector.Status()
+		}
+		if sctpProxy != nil {
+			status["sctp_associations"] = sctpProxy.Status()
+		}
+
+		mptcpConnections, mptcpSubflows := mptcpConns.Stats()
+		status["mptcp"] = map[string]interface{}{
+			"enabled":     cfg.EnableMPTCP,
+			"supported":   netutil.MPTCPSupported(),
+			"connections": mptcpConnections,
+			"subflows":    mptcpSubflows,
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, `{"status":%v}`, status)
 	})
 
 	metricsServer := &http.Server{
-		Addr:    cfg.MetricsAddr,
-		Handler: metricsMux,
+		Handler: adminserver.Guard(cfg.Admin, metricsMux),
 	}
 
+	metricsAddr := cfg.Admin.Address(cfg.MetricsAddr)
+	if warning := adminserver.Warning(cfg.Admin, metricsAddr); warning != "" {
+		logger.Warn(warning)
+	}
 	go func() {
-		logger.WithField("addr", cfg.MetricsAddr).Info("Starting metrics/health server")
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithField("addr", metricsAddr).Info("Starting metrics/health server")
+		listener, err := adminserver.Listen(cfg.Admin, cfg.MetricsAddr)
+		if err != nil {
+			logger.WithError(err).Error("Metrics server error")
+			return
+		}
+		if err := metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 			logger.WithError(err).Error("Metrics server error")
 		}
 	}()
@@ -301,6 +569,21 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 	<-sigChan
 	logger.Info("Shutting down...")
 
+	// Withdraw the VIPs and give peers time to move traffic elsewhere
+	// before closing anything
+	if speaker != nil {
+		draining.Store(true)
+		speaker.SetAnnounced(false)
+		logger.WithField("drain_time", cfg.BGP.DrainTime).Info("BGP announcement withdrawn, draining")
+		time.Sleep(cfg.BGP.DrainTime)
+		bgpCancel()
+		<-bgpDone
+	}
+
+	// Hand leadership to another replica once announcements are withdrawn
+	coordCancel()
+	<-coordDone
+
 	// Log shutdown event
 	if auditLogger != nil {
 		auditEvent := &zerotrust.AuditEvent{
@@ -324,6 +607,10 @@ func runProxy(configPath string, logger *logrus.Logger) error {
 		logger.WithError(err).Error("Metrics server shutdown error")
 	}
 
+	if sctpProxy != nil {
+		sctpProxy.Stop()
+	}
+
 	if mcRouter != nil {
 		mcRouter.Stop()
 	}
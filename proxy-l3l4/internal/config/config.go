@@ -2,10 +2,20 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"time"
 
-	"github.com/spf13/viper"
+	"marchproxy-l3l4/internal/sctp"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/bgp"
+	"marchproxy-shared/coordination"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/licensing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
 // Config holds the complete proxy configuration
@@ -18,6 +28,10 @@ type Config struct {
 	// Server settings
 	BindAddr    string `mapstructure:"bind_addr"`
 	MetricsAddr string `mapstructure:"metrics_addr"`
+	EnableMPTCP bool   `mapstructure:"enable_mptcp"` // Multipath TCP listeners and dialers (Linux 5.15+)
+
+	// Metrics server authentication, TLS and binding
+	Admin adminserver.Config `mapstructure:"admin"`
 
 	// Zero-Trust settings
 	EnableZeroTrust bool   `mapstructure:"enable_zero_trust"`
@@ -47,6 +61,15 @@ type Config struct {
 	CostOptimization   bool              `mapstructure:"cost_optimization"`
 	Backends           []BackendConfig   `mapstructure:"backends"`
 
+	// Anycast VIP announcements
+	BGP BGPConfig `mapstructure:"bgp"`
+
+	// Leader election between replicas
+	Coordination CoordinationConfig `mapstructure:"coordination"`
+
+	// SCTP forwarding for telco signalling
+	SCTP SCTPConfig `mapstructure:"sctp"`
+
 	// Observability
 	EnableTracing    bool   `mapstructure:"enable_tracing"`
 	JaegerEndpoint   string `mapstructure:"jaeger_endpoint"`
@@ -64,6 +87,11 @@ type Config struct {
 	LicenseKey      string `mapstructure:"license_key"`
 	LicenseServer   string `mapstructure:"license_server"`
 	ReleaseMode     bool   `mapstructure:"release_mode"`
+
+	// Enterprise feature entitlements fetched from the manager in release mode
+	LicenseRefreshInterval time.Duration `mapstructure:"license_refresh_interval"`
+	LicenseGracePeriod     time.Duration `mapstructure:"license_grace_period"` // cached entitlements outlive an unreachable manager this long
+	LicenseCacheFile       string        `mapstructure:"license_cache_file"`   // keep entitlements here across restarts
 }
 
 // BackendConfig represents a backend server configuration
@@ -78,60 +106,227 @@ type BackendConfig struct {
 	Timeout  time.Duration `mapstructure:"timeout"`
 }
 
-// Load loads configuration from file and environment variables
-func Load(configPath string) (*Config, error) {
+// BGPConfig announces the service VIPs to upstream routers while this
+// instance has healthy backends and is not draining
+type BGPConfig struct {
+	Enabled       bool            `mapstructure:"enabled"`
+	LocalAS       uint32          `mapstructure:"local_as"`
+	RouterID      string          `mapstructure:"router_id"`
+	Peers         []BGPPeerConfig `mapstructure:"peers"`
+	VIPs          []string        `mapstructure:"vips"`          // Addresses or prefixes, bare addresses become /32 or /128
+	NextHop       string          `mapstructure:"next_hop"`      // Defaults to the session's local address
+	NextHopIPv6   string          `mapstructure:"next_hop_ipv6"` // Required for IPv6 VIPs over IPv4 sessions
+	Communities   []string        `mapstructure:"communities"`   // ASN:value
+	HoldTime      time.Duration   `mapstructure:"hold_time"`
+	ConnectRetry  time.Duration   `mapstructure:"connect_retry"`
+	CheckInterval time.Duration   `mapstructure:"check_interval"` // How often local health gates the announcement
+	DrainTime     time.Duration   `mapstructure:"drain_time"`     // Wait after withdrawing before shutting down
+	LeaderOnly    bool            `mapstructure:"leader_only"`    // Only the elected replica announces, for active/standby instead of anycast
+}
+
+// CoordinationConfig elects a leader among replicas through manager leases
+// for singleton tasks
+type CoordinationConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	LeaseTTL time.Duration `mapstructure:"lease_ttl"` // A failed leader is replaced within this long
+}
+
+// SCTPConfig forwards SCTP associations between multihomed endpoints
+type SCTPConfig struct {
+	Enabled        bool                `mapstructure:"enabled"`
+	Streams        int                 `mapstructure:"streams"`          // Streams requested per association
+	MaxMessageSize int                 `mapstructure:"max_message_size"` // Largest user message relayed, in bytes
+	NoDelay        bool                `mapstructure:"no_delay"`
+	DialTimeout    time.Duration       `mapstructure:"dial_timeout"`
+	Mappings       []SCTPMappingConfig `mapstructure:"mappings"`
+}
+
+// SCTPMappingConfig forwards one multihomed listen endpoint to a backend
+type SCTPMappingConfig struct {
+	Name            string   `mapstructure:"name"`
+	Listen          []string `mapstructure:"listen"`           // ip:port per local address, one port for all
+	Backend         []string `mapstructure:"backend"`          // ip:port per backend address, one port for all
+	AllowedSources  []string `mapstructure:"allowed_sources"`  // CIDRs every client address must be in
+	AllowedPPIDs    []uint32 `mapstructure:"allowed_ppids"`    // Payload protocols clients may send, e.g. 18 (S1AP), 46 (Diameter), 60 (NGAP)
+	MaxAssociations int      `mapstructure:"max_associations"` // 0 for no limit
+}
+
+// Options converts the SCTP settings to association options
+func (s SCTPConfig) Options() sctp.Options {
+	return sctp.Options{
+		Streams:        s.Streams,
+		MaxMessageSize: s.MaxMessageSize,
+		NoDelay:        s.NoDelay,
+	}
+}
+
+// ProxyMappings converts the SCTP mappings to proxy mappings
+func (s SCTPConfig) ProxyMappings() ([]*sctp.Mapping, error) {
+	var mappings []*sctp.Mapping
+	names := make(map[string]bool)
+	for i, m := range s.Mappings {
+		if m.Name == "" {
+			return nil, fmt.Errorf("mapping %d: name is required", i)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("duplicate mapping %q", m.Name)
+		}
+		names[m.Name] = true
+
+		mapping := &sctp.Mapping{
+			Name:            m.Name,
+			AllowedPPIDs:    m.AllowedPPIDs,
+			MaxAssociations: m.MaxAssociations,
+		}
+		var err error
+		if mapping.Listen, err = sctp.ParseAddr(m.Listen); err != nil {
+			return nil, fmt.Errorf("mapping %s: invalid listen: %w", m.Name, err)
+		}
+		if mapping.Backend, err = sctp.ParseAddr(m.Backend); err != nil {
+			return nil, fmt.Errorf("mapping %s: invalid backend: %w", m.Name, err)
+		}
+		if mapping.Backend.Port == 0 {
+			return nil, fmt.Errorf("mapping %s: backend port is required", m.Name)
+		}
+		for _, cidr := range m.AllowedSources {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("mapping %s: invalid allowed source %q: %w", m.Name, cidr, err)
+			}
+			mapping.AllowedSources = append(mapping.AllowedSources, network)
+		}
+		if m.MaxAssociations < 0 {
+			return nil, fmt.Errorf("mapping %s: max_associations must be >= 0", m.Name)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// BGPPeerConfig is an upstream router
+type BGPPeerConfig struct {
+	Address string `mapstructure:"address"`
+	Port    int    `mapstructure:"port"`
+	AS      uint32 `mapstructure:"as"`
+}
+
+// SpeakerConfig converts the BGP settings to speaker settings
+func (b BGPConfig) SpeakerConfig() (bgp.Config, error) {
+	cfg := bgp.Config{
+		LocalAS:      b.LocalAS,
+		HoldTime:     b.HoldTime,
+		ConnectRetry: b.ConnectRetry,
+	}
+
+	var err error
+	if cfg.RouterID, err = netip.ParseAddr(b.RouterID); err != nil {
+		return cfg, fmt.Errorf("invalid router_id: %w", err)
+	}
+	for _, peer := range b.Peers {
+		addr, err := netip.ParseAddr(peer.Address)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid peer address: %w", err)
+		}
+		cfg.Peers = append(cfg.Peers, bgp.Peer{Address: addr, Port: peer.Port, AS: peer.AS})
+	}
+	for _, vip := range b.VIPs {
+		prefix, err := netip.ParsePrefix(vip)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(vip)
+			if addrErr != nil {
+				return cfg, fmt.Errorf("invalid vip %q: %w", vip, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.Prefixes = append(cfg.Prefixes, prefix)
+	}
+	if b.NextHop != "" {
+		if cfg.NextHop, err = netip.ParseAddr(b.NextHop); err != nil {
+			return cfg, fmt.Errorf("invalid next_hop: %w", err)
+		}
+	}
+	if b.NextHopIPv6 != "" {
+		if cfg.NextHopIPv6, err = netip.ParseAddr(b.NextHopIPv6); err != nil {
+			return cfg, fmt.Errorf("invalid next_hop_ipv6: %w", err)
+		}
+	}
+	for _, community := range b.Communities {
+		value, err := bgp.ParseCommunity(community)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Communities = append(cfg.Communities, value)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Load loads configuration from defaults, the config file at configPath,
+// MARCHPROXY_* environment variables and the --set flags, each overriding
+// the one before
+func Load(configPath string, flags *pflag.FlagSet) (*Config, error) {
+	l := layers.New("MARCHPROXY")
+	v := l.Viper()
+
 	// Set defaults
-	viper.SetDefault("manager_url", "http://api-server:8000")
-	viper.SetDefault("bind_addr", ":8081")
-	viper.SetDefault("metrics_addr", ":8082")
-	viper.SetDefault("enable_zero_trust", true)
-	viper.SetDefault("opa_url", "http://opa:8181")
-	viper.SetDefault("audit_log_path", "/var/log/marchproxy/audit/audit.log")
-	viper.SetDefault("enable_numa", false)
-	viper.SetDefault("worker_threads", 0) // Auto-detect
-	viper.SetDefault("enable_qos", true)
-	viper.SetDefault("default_bandwidth", 1000000000) // 1 Gbps
-	viper.SetDefault("burst_size", 100000000)         // 100 MB
-	viper.SetDefault("priority_queue_depth", 1000)
-	viper.SetDefault("enable_multicloud", false)
-	viper.SetDefault("routing_algorithm", "latency")
-	viper.SetDefault("health_check_enabled", true)
-	viper.SetDefault("health_check_interval", 30*time.Second)
-	viper.SetDefault("cost_optimization", false)
-	viper.SetDefault("enable_tracing", false)
-	viper.SetDefault("trace_sample_rate", 0.1)
-	viper.SetDefault("metrics_namespace", "marchproxy")
-	viper.SetDefault("enable_acceleration", false)
-	viper.SetDefault("acceleration_mode", "standard")
-	viper.SetDefault("afxdp_queue_count", 4)
-	viper.SetDefault("dpdk_enabled", false)
-	viper.SetDefault("license_server", "https://license.penguintech.io")
-	viper.SetDefault("release_mode", false)
+	v.SetDefault("manager_url", "http://api-server:8000")
+	v.SetDefault("bind_addr", ":8081")
+	v.SetDefault("metrics_addr", ":8082")
+	v.SetDefault("enable_mptcp", false)
+	v.SetDefault("enable_zero_trust", true)
+	v.SetDefault("opa_url", "http://opa:8181")
+	v.SetDefault("audit_log_path", "/var/log/marchproxy/audit/audit.log")
+	v.SetDefault("enable_numa", false)
+	v.SetDefault("worker_threads", 0) // Auto-detect
+	v.SetDefault("enable_qos", true)
+	v.SetDefault("default_bandwidth", 1000000000) // 1 Gbps
+	v.SetDefault("burst_size", 100000000)         // 100 MB
+	v.SetDefault("priority_queue_depth", 1000)
+	v.SetDefault("enable_multicloud", false)
+	v.SetDefault("routing_algorithm", "latency")
+	v.SetDefault("health_check_enabled", true)
+	v.SetDefault("health_check_interval", 30*time.Second)
+	v.SetDefault("cost_optimization", false)
+	v.SetDefault("bgp.hold_time", 90*time.Second)
+	v.SetDefault("bgp.connect_retry", 10*time.Second)
+	v.SetDefault("bgp.check_interval", 2*time.Second)
+	v.SetDefault("bgp.drain_time", 15*time.Second)
+	v.SetDefault("coordination.enabled", false)
+	v.SetDefault("coordination.lease_ttl", coordination.DefaultLeaseTTL)
+	v.SetDefault("sctp.enabled", false)
+	v.SetDefault("sctp.streams", sctp.DefaultStreams)
+	v.SetDefault("sctp.max_message_size", sctp.DefaultMaxMessageSize)
+	v.SetDefault("sctp.no_delay", true)
+	v.SetDefault("sctp.dial_timeout", 5*time.Second)
+	v.SetDefault("enable_tracing", false)
+	v.SetDefault("trace_sample_rate", 0.1)
+	v.SetDefault("metrics_namespace", "marchproxy")
+	v.SetDefault("enable_acceleration", false)
+	v.SetDefault("acceleration_mode", "standard")
+	v.SetDefault("afxdp_queue_count", 4)
+	v.SetDefault("dpdk_enabled", false)
+	v.SetDefault("license_server", "https://license.penguintech.io")
+	v.SetDefault("release_mode", false)
+	v.SetDefault("license_refresh_interval", licensing.DefaultRefresh)
+	v.SetDefault("license_grace_period", licensing.DefaultGrace)
 
 	// Default DSCP mappings
-	viper.SetDefault("dscp_marking", map[string]uint8{
+	v.SetDefault("dscp_marking", map[string]uint8{
 		"P0": 46, // EF (Expedited Forwarding)
 		"P1": 34, // AF41
 		"P2": 18, // AF21
 		"P3": 0,  // BE (Best Effort)
 	})
 
-	// Load config file if provided
-	if configPath != "" {
-		viper.SetConfigFile(configPath)
-		if err := viper.ReadInConfig(); err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
-		}
+	if err := l.ReadFile(configPath); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := l.ApplySet(flags); err != nil {
+		return nil, err
 	}
 
-	// Environment variables take precedence
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("MARCHPROXY")
-
-	// Unmarshal config
 	var cfg Config
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	if err := l.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	// Validate configuration
@@ -177,6 +372,42 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	if c.BGP.Enabled {
+		if _, err := c.BGP.SpeakerConfig(); err != nil {
+			return fmt.Errorf("invalid bgp: %w", err)
+		}
+		if c.BGP.CheckInterval <= 0 {
+			return fmt.Errorf("bgp.check_interval must be > 0")
+		}
+	}
+
+	if c.Coordination.Enabled {
+		if c.Coordination.LeaseTTL < 5*time.Second || c.Coordination.LeaseTTL > 5*time.Minute {
+			return fmt.Errorf("coordination.lease_ttl must be between 5s and 5m")
+		}
+	}
+	if c.BGP.LeaderOnly && !c.Coordination.Enabled {
+		return fmt.Errorf("bgp.leader_only requires coordination.enabled")
+	}
+
+	if c.SCTP.Enabled {
+		if c.SCTP.Streams < 1 || c.SCTP.Streams > 65535 {
+			return fmt.Errorf("sctp.streams must be between 1 and 65535")
+		}
+		if c.SCTP.MaxMessageSize <= 0 {
+			return fmt.Errorf("sctp.max_message_size must be > 0")
+		}
+		if c.SCTP.DialTimeout <= 0 {
+			return fmt.Errorf("sctp.dial_timeout must be > 0")
+		}
+		if len(c.SCTP.Mappings) == 0 {
+			return fmt.Errorf("sctp.mappings is required when sctp is enabled")
+		}
+		if _, err := c.SCTP.ProxyMappings(); err != nil {
+			return fmt.Errorf("invalid sctp: %w", err)
+		}
+	}
+
 	if c.EnableAcceleration {
 		validModes := map[string]bool{
 			"standard": true, "xdp": true, "afxdp": true, "dpdk": true,
@@ -186,16 +417,44 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	if err := c.Admin.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// IsEnterpriseFeatureEnabled checks if an enterprise feature is enabled
-func (c *Config) IsEnterpriseFeatureEnabled(feature string) bool {
-	// In release mode, check license
-	if c.ReleaseMode {
-		// TODO: Validate with license server
-		return c.LicenseKey != ""
+// NewLicenseGate creates the gate for enterprise features. In release mode
+// it follows the entitlements the manager reports for the cluster; in
+// development mode all features are available.
+func (c *Config) NewLicenseGate(logger logrus.FieldLogger) *licensing.Gate {
+	if !c.ReleaseMode {
+		return licensing.Unrestricted()
+	}
+	apiKey := c.ClusterAPIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("CLUSTER_API_KEY")
+	}
+	proxyName, _ := os.Hostname()
+	return licensing.New(licensing.ManagerFetcher(c.ManagerURL, apiKey, proxyName), licensing.Options{
+		Refresh:   c.LicenseRefreshInterval,
+		Grace:     c.LicenseGracePeriod,
+		CacheFile: c.LicenseCacheFile,
+		Logger:    logger,
+	})
+}
+
+// NewCoordinationBackend creates the manager backend replicas coordinate
+// through, identifying this replica by its hostname. It returns nil when
+// coordination is disabled.
+func (c *Config) NewCoordinationBackend() *coordination.ManagerBackend {
+	if !c.Coordination.Enabled {
+		return nil
+	}
+	apiKey := c.ClusterAPIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("CLUSTER_API_KEY")
 	}
-	// In development mode, all features available
-	return true
+	proxyName, _ := os.Hostname()
+	return coordination.NewManagerBackend(c.ManagerURL, apiKey, proxyName)
 }
@@ -8,6 +8,8 @@ import (
 	"sync"
 	"time"
 
+	"marchproxy-l3l4/internal/netutil"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,6 +21,7 @@ type HealthMonitor struct {
 	interval time.Duration
 	timeout  time.Duration
 	logger   *logrus.Logger
+	mptcp    bool // Probe backends over Multipath TCP
 
 	stopChan chan struct{}
 	stopped  bool
@@ -35,6 +38,13 @@ func NewHealthMonitor(backends []*Backend, logger *logrus.Logger) *HealthMonitor
 	}
 }
 
+// SetMultipathTCP enables Multipath TCP for TCP health checks
+func (hm *HealthMonitor) SetMultipathTCP(enabled bool) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	hm.mptcp = enabled
+}
+
 // Start starts health monitoring
 func (hm *HealthMonitor) Start() error {
 	hm.mu.Lock()
@@ -101,7 +111,7 @@ func (hm *HealthMonitor) checkBackend(backend *Backend) {
 	start := time.Now()
 
 	// Try TCP health check first
-	healthy, latency := hm.tcpHealthCheck(backend)
+	healthy, latency, subflows := hm.tcpHealthCheck(backend)
 
 	if !healthy {
 		// Try HTTP health check
@@ -110,6 +120,7 @@ func (hm *HealthMonitor) checkBackend(backend *Backend) {
 
 	backend.Healthy = healthy
 	backend.Latency = latency
+	backend.Subflows = subflows
 
 	hm.logger.WithFields(logrus.Fields{
 		"backend": backend.Name,
@@ -119,8 +130,9 @@ func (hm *HealthMonitor) checkBackend(backend *Backend) {
 	}).Debug("Health check completed")
 }
 
-// tcpHealthCheck performs a TCP health check
-func (hm *HealthMonitor) tcpHealthCheck(backend *Backend) (bool, int64) {
+// tcpHealthCheck performs a TCP health check, returning the MPTCP subflow
+// count when the backend path negotiated Multipath TCP
+func (hm *HealthMonitor) tcpHealthCheck(backend *Backend) (bool, int64, int) {
 	start := time.Now()
 
 	ctx, cancel := context.WithTimeout(context.Background(), hm.timeout)
@@ -130,16 +142,21 @@ func (hm *HealthMonitor) tcpHealthCheck(backend *Backend) (bool, int64) {
 	host := backend.URL
 	port := "80"
 
+	hm.mu.RLock()
+	mptcp := hm.mptcp
+	hm.mu.RUnlock()
+
 	// Simple TCP connection attempt
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("%s:%s", host, port))
+	d := netutil.NewDialer(0, mptcp)
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
 	if err != nil {
-		return false, 0
+		return false, 0, 0
 	}
 	defer conn.Close()
 
 	latency := time.Since(start).Microseconds()
-	return true, latency
+	subflows, _ := netutil.MPTCPSubflows(conn)
+	return true, latency, subflows
 }
 
 // httpHealthCheck performs an HTTP health check
@@ -51,6 +51,7 @@ type Backend struct {
 	Healthy  bool
 	Latency  int64 // microseconds
 	Connections int
+	Subflows    int // MPTCP subflows seen by the last health check, 0 = plain TCP
 }
 
 // NewRouter creates a new multi-cloud router
@@ -134,6 +135,14 @@ func (r *Router) getHealthyBackends() []*Backend {
 	return healthy
 }
 
+// HasHealthyBackends reports whether any backend is healthy, i.e. whether
+// this instance can serve traffic
+func (r *Router) HasHealthyBackends() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.getHealthyBackends()) > 0
+}
+
 // UpdateBackendHealth updates the health status of a backend
 func (r *Router) UpdateBackendHealth(name string, healthy bool) {
 	r.mu.Lock()
@@ -192,6 +201,11 @@ func (r *Router) DecrementConnections(name string) {
 	}
 }
 
+// SetMultipathTCP enables Multipath TCP for backend health checks
+func (r *Router) SetMultipathTCP(enabled bool) {
+	r.monitor.SetMultipathTCP(enabled)
+}
+
 // Start starts the router's background tasks
 func (r *Router) Start() error {
 	// Start health monitoring
@@ -237,6 +251,7 @@ func (r *Router) GetStats() map[string]interface{} {
 			"healthy":     b.Healthy,
 			"latency":     b.Latency,
 			"connections": b.Connections,
+			"mptcp_subflows": b.Subflows,
 		})
 	}
 	stats["backends"] = backends
@@ -0,0 +1,95 @@
+// Package netutil provides listener and dialer helpers for Multipath TCP
+// so traffic can be spread across several WAN links.
+package netutil
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listen opens a stream listener on address, accepting Multipath TCP
+// connections when mptcp is set. Clients that do not offer MPTCP, or kernels
+// with MPTCP disabled, fall back to plain TCP.
+func Listen(network, address string, mptcp bool) (net.Listener, error) {
+	lc := &net.ListenConfig{}
+	lc.SetMultipathTCP(mptcp)
+	return lc.Listen(context.Background(), network, address)
+}
+
+// NewDialer returns a dialer that requests Multipath TCP when mptcp is set
+func NewDialer(timeout time.Duration, mptcp bool) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	d.SetMultipathTCP(mptcp)
+	return d
+}
+
+// MPTCPSubflows returns the number of subflows carrying a Multipath TCP
+// connection, including the initial one. ok is false when the connection
+// is plain TCP, including MPTCP sockets that fell back to TCP.
+func MPTCPSubflows(conn net.Conn) (subflows int, ok bool) {
+	tcpConn, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		return 0, false
+	}
+	if multipath, err := tcpConn.MultipathTCP(); err != nil || !multipath {
+		return 0, false
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 1, true
+	}
+	extra, err := mptcpExtraSubflows(rawConn)
+	if err != nil {
+		return 1, true
+	}
+	return extra + 1, true
+}
+
+// MPTCPTracker tracks live Multipath TCP connections so their subflow counts
+// can be reported in connection stats. The zero value is ready to use.
+type MPTCPTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Track registers conn if it negotiated MPTCP and returns a function that
+// removes it again. Plain TCP connections are ignored.
+func (t *MPTCPTracker) Track(conn net.Conn) func() {
+	if _, ok := MPTCPSubflows(conn); !ok {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+	}
+}
+
+// Stats returns the number of live MPTCP connections and their total subflows
+func (t *MPTCPTracker) Stats() (connections, subflows int) {
+	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		if count, ok := MPTCPSubflows(conn); ok {
+			connections++
+			subflows += count
+		}
+	}
+	return connections, subflows
+}
@@ -0,0 +1,44 @@
+package netutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mptcpInfo is the MPTCP_INFO socket option at level SOL_MPTCP
+const mptcpInfo = 1
+
+// MPTCPSupported reports whether Multipath TCP is enabled in the running
+// kernel (Linux 5.15+ with net.mptcp.enabled=1)
+func MPTCPSupported() bool {
+	enabled, err := os.ReadFile("/proc/sys/net/mptcp/enabled")
+	return err == nil && strings.TrimSpace(string(enabled)) == "1"
+}
+
+// mptcpExtraSubflows reads the number of additional subflows from MPTCP_INFO.
+// The first byte of struct mptcp_info is mptcpi_subflows.
+func mptcpExtraSubflows(c syscall.RawConn) (int, error) {
+	var info [64]byte
+	size := uint32(len(info))
+
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_MPTCP, mptcpInfo,
+			uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, fmt.Errorf("failed to read MPTCP_INFO: %w", sockErr)
+	}
+	return int(info[0]), nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// MPTCPSupported reports whether Multipath TCP is available; it is only
+// supported on Linux
+func MPTCPSupported() bool {
+	return false
+}
+
+// mptcpExtraSubflows is only supported on Linux
+func mptcpExtraSubflows(c syscall.RawConn) (int, error) {
+	return 0, fmt.Errorf("MPTCP_INFO is only supported on Linux")
+}
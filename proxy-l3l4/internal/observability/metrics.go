@@ -1,6 +1,8 @@
 package observability
 
 import (
+	"marchproxy-l3l4/internal/netutil"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -168,3 +170,30 @@ func NewMetrics(namespace string) *Metrics {
 		),
 	}
 }
+
+// RegisterMPTCPMetrics exports live Multipath TCP connection and subflow
+// counts from tracker
+func RegisterMPTCPMetrics(namespace string, tracker *netutil.MPTCPTracker) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "mptcp_connections",
+			Help:      "Number of active connections using Multipath TCP",
+		},
+		func() float64 {
+			connections, _ := tracker.Stats()
+			return float64(connections)
+		},
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "mptcp_subflows",
+			Help:      "Number of subflows across active Multipath TCP connections",
+		},
+		func() float64 {
+			_, subflows := tracker.Stats()
+			return float64(subflows)
+		},
+	)
+}
@@ -0,0 +1,480 @@
+package sctp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Connection close reasons shared by every MarchProxy module
+const (
+	closeClientEOF    = "client_eof"
+	closeBackendEOF   = "backend_eof"
+	closePolicyDenied = "policy_denied"
+	closeDrain        = "drain"
+	closeError        = "error"
+)
+
+var (
+	associationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_sctp_associations_total",
+			Help: "SCTP associations accepted per mapping and result",
+		},
+		[]string{"mapping", "result"},
+	)
+
+	activeAssociations = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "marchproxy_sctp_active_associations",
+			Help: "SCTP associations being relayed per mapping",
+		},
+		[]string{"mapping"},
+	)
+
+	sctpMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_sctp_messages_total",
+			Help: "SCTP user messages relayed per mapping and direction",
+		},
+		[]string{"mapping", "direction"},
+	)
+
+	sctpBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_sctp_bytes_total",
+			Help: "SCTP payload bytes relayed per mapping and direction",
+		},
+		[]string{"mapping", "direction"},
+	)
+
+	sctpDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_sctp_messages_dropped_total",
+			Help: "SCTP user messages dropped by mapping policy per mapping and PPID",
+		},
+		[]string{"mapping", "ppid"},
+	)
+
+	associationDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "marchproxy_sctp_association_duration_seconds",
+			Help:    "Lifetime of relayed SCTP associations per mapping",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		},
+		[]string{"mapping"},
+	)
+
+	connectionsClosed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_connections_closed_total",
+			Help: "Closed connections per module, route and close reason",
+		},
+		[]string{"module", "route", "reason"},
+	)
+)
+
+// Mapping forwards the associations accepted on Listen to Backend
+type Mapping struct {
+	Name    string
+	Listen  *Addr
+	Backend *Addr
+
+	// Every address a client advertises must be in one of these networks,
+	// since traffic can move to any of its paths. Empty allows all.
+	AllowedSources []*net.IPNet
+
+	// Payload protocols clients may send. Empty allows all.
+	AllowedPPIDs []uint32
+
+	// Associations relayed at once, 0 for no limit
+	MaxAssociations int
+}
+
+// allowsPeers reports whether every address of a multihomed peer is allowed
+func (m *Mapping) allowsPeers(peers *Addr) bool {
+	if len(m.AllowedSources) == 0 {
+		return true
+	}
+	for _, ip := range peers.IPs {
+		allowed := false
+		for _, network := range m.AllowedSources {
+			if network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsPPID reports whether clients may send messages with ppid
+func (m *Mapping) allowsPPID(ppid uint32) bool {
+	if len(m.AllowedPPIDs) == 0 {
+		return true
+	}
+	for _, allowed := range m.AllowedPPIDs {
+		if ppid == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AssociationStatus is the state of one relayed association, for /status
+type AssociationStatus struct {
+	ID          uint64    `json:"id"`
+	Mapping     string    `json:"mapping"`
+	Client      string    `json:"client"` // Every client address
+	Backend     string    `json:"backend"`
+	Started     time.Time `json:"started"`
+	MessagesIn  uint64    `json:"messages_in"` // Client to backend
+	MessagesOut uint64    `json:"messages_out"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	Dropped     uint64    `json:"dropped"`
+	ClientPaths *Status   `json:"client_paths,omitempty"`
+	BackendPath *Status   `json:"backend_paths,omitempty"`
+}
+
+// association is one client association relayed to a backend
+type association struct {
+	id      uint64
+	mapping *Mapping
+	client  *Conn
+	backend *Conn
+	peers   *Addr
+	started time.Time
+
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	dropped     atomic.Uint64
+}
+
+// Proxy relays SCTP associations for its mappings
+type Proxy struct {
+	mappings    []*Mapping
+	opts        Options
+	dialTimeout time.Duration
+	logger      *logrus.Logger
+
+	mu           sync.Mutex
+	listeners    []*Listener
+	associations map[uint64]*association
+	perMapping   map[string]int
+	nextID       uint64
+	stopping     bool
+	wg           sync.WaitGroup
+}
+
+// NewProxy creates a proxy for mappings
+func NewProxy(mappings []*Mapping, opts Options, dialTimeout time.Duration, logger *logrus.Logger) *Proxy {
+	return &Proxy{
+		mappings:     mappings,
+		opts:         opts.withDefaults(),
+		dialTimeout:  dialTimeout,
+		logger:       logger,
+		associations: make(map[uint64]*association),
+		perMapping:   make(map[string]int),
+	}
+}
+
+// Start listens on every mapping
+func (p *Proxy) Start() error {
+	for _, mapping := range p.mappings {
+		listener, err := Listen(mapping.Listen, p.opts)
+		if err != nil {
+			p.Stop()
+			return fmt.Errorf("mapping %s: %w", mapping.Name, err)
+		}
+		p.mu.Lock()
+		p.listeners = append(p.listeners, listener)
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go p.serve(mapping, listener)
+
+		p.logger.WithFields(logrus.Fields{
+			"mapping": mapping.Name,
+			"listen":  mapping.Listen.String(),
+			"backend": mapping.Backend.String(),
+		}).Info("SCTP mapping listening")
+	}
+	return nil
+}
+
+// Stop closes the listeners and every relayed association
+func (p *Proxy) Stop() {
+	p.mu.Lock()
+	p.stopping = true
+	listeners := p.listeners
+	p.listeners = nil
+	for _, a := range p.associations {
+		a.client.Close()
+		if a.backend != nil {
+			a.backend.Close()
+		}
+	}
+	p.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	p.wg.Wait()
+}
+
+// serve accepts associations for a mapping until its listener closes
+func (p *Proxy) serve(mapping *Mapping, listener *Listener) {
+	defer p.wg.Done()
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if p.isStopping() {
+				return
+			}
+			p.logger.WithError(err).WithField("mapping", mapping.Name).Warn("Failed to accept SCTP association")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.handle(mapping, client)
+		}()
+	}
+}
+
+// handle applies the mapping policy to an association and relays it
+func (p *Proxy) handle(mapping *Mapping, client *Conn) {
+	peers, err := client.PeerAddrs()
+	if err != nil {
+		p.reject(mapping, client, "error", closeError, err)
+		return
+	}
+	logger := p.logger.WithFields(logrus.Fields{
+		"mapping": mapping.Name,
+		"client":  peers.String(),
+	})
+
+	if !mapping.allowsPeers(peers) {
+		p.reject(mapping, client, "policy_denied", closePolicyDenied, fmt.Errorf("client address not allowed"))
+		return
+	}
+
+	a := p.register(mapping, client, peers)
+	if a == nil {
+		p.reject(mapping, client, "limit", closePolicyDenied, fmt.Errorf("mapping at its association limit"))
+		return
+	}
+	defer p.unregister(a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+	backend, err := Dial(ctx, mapping.Backend, p.opts)
+	cancel()
+	if err != nil {
+		associationsTotal.WithLabelValues(mapping.Name, "dial_failed").Inc()
+		connectionsClosed.WithLabelValues("l3l4", mapping.Name, closeError).Inc()
+		logger.WithError(err).Warn("Failed to reach SCTP backend")
+		client.Close()
+		return
+	}
+	p.mu.Lock()
+	a.backend = backend
+	stopping := p.stopping
+	p.mu.Unlock()
+	if stopping {
+		client.Close()
+		backend.Close()
+		connectionsClosed.WithLabelValues("l3l4", mapping.Name, closeDrain).Inc()
+		return
+	}
+
+	associationsTotal.WithLabelValues(mapping.Name, "relayed").Inc()
+	activeAssociations.WithLabelValues(mapping.Name).Inc()
+	logger.WithField("association", a.id).Info("SCTP association relayed")
+
+	reason := p.relay(a)
+	client.Close()
+	backend.Close()
+
+	activeAssociations.WithLabelValues(mapping.Name).Dec()
+	associationDuration.WithLabelValues(mapping.Name).Observe(time.Since(a.started).Seconds())
+	connectionsClosed.WithLabelValues("l3l4", mapping.Name, reason).Inc()
+	logger.WithFields(logrus.Fields{
+		"association":  a.id,
+		"reason":       reason,
+		"messages_in":  a.messagesIn.Load(),
+		"messages_out": a.messagesOut.Load(),
+		"dropped":      a.dropped.Load(),
+	}).Info("SCTP association closed")
+}
+
+// relay copies messages both ways until either side ends, returning the
+// close reason
+func (p *Proxy) relay(a *association) string {
+	reasons := make(chan string, 2)
+	go func() {
+		err := p.pump(a, a.client, a.backend, true)
+		reasons <- closeReason(err, closeClientEOF, p.isStopping())
+	}()
+	go func() {
+		err := p.pump(a, a.backend, a.client, false)
+		reasons <- closeReason(err, closeBackendEOF, p.isStopping())
+	}()
+
+	reason := <-reasons
+	// Closing both ends stops the other direction
+	a.client.Close()
+	a.backend.Close()
+	<-reasons
+	return reason
+}
+
+// closeReason classifies how one direction of a relay ended
+func closeReason(err error, eofReason string, stopping bool) string {
+	switch {
+	case stopping:
+		return closeDrain
+	case errors.Is(err, io.EOF):
+		return eofReason
+	default:
+		return closeError
+	}
+}
+
+// pump relays messages from src to dst. Client messages are checked
+// against the mapping's payload protocols. Stream IDs beyond the streams
+// negotiated with dst are folded onto the available ones.
+func (p *Proxy) pump(a *association, src, dst *Conn, fromClient bool) error {
+	direction := "out"
+	if fromClient {
+		direction = "in"
+	}
+	messages := sctpMessages.WithLabelValues(a.mapping.Name, direction)
+	bytes := sctpBytes.WithLabelValues(a.mapping.Name, direction)
+
+	for {
+		msg, err := src.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if fromClient && !a.mapping.allowsPPID(msg.PPID) {
+			a.dropped.Add(1)
+			sctpDropped.WithLabelValues(a.mapping.Name, fmt.Sprint(msg.PPID)).Inc()
+			continue
+		}
+		if streams := dst.OutStreams(); streams > 0 {
+			msg.Stream %= uint16(streams)
+		}
+		if err := dst.WriteMessage(msg); err != nil {
+			return err
+		}
+
+		messages.Inc()
+		bytes.Add(float64(len(msg.Data)))
+		if fromClient {
+			a.messagesIn.Add(1)
+			a.bytesIn.Add(uint64(len(msg.Data)))
+		} else {
+			a.messagesOut.Add(1)
+			a.bytesOut.Add(uint64(len(msg.Data)))
+		}
+	}
+}
+
+// reject closes an association refused before it was relayed
+func (p *Proxy) reject(mapping *Mapping, client *Conn, result, reason string, err error) {
+	associationsTotal.WithLabelValues(mapping.Name, result).Inc()
+	connectionsClosed.WithLabelValues("l3l4", mapping.Name, reason).Inc()
+	p.logger.WithError(err).WithField("mapping", mapping.Name).Warn("SCTP association rejected")
+	client.Close()
+}
+
+// register tracks a new association, nil when the mapping is at its limit
+func (p *Proxy) register(mapping *Mapping, client *Conn, peers *Addr) *association {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if mapping.MaxAssociations > 0 && p.perMapping[mapping.Name] >= mapping.MaxAssociations {
+		return nil
+	}
+	p.nextID++
+	a := &association{
+		id:      p.nextID,
+		mapping: mapping,
+		client:  client,
+		peers:   peers,
+		started: time.Now(),
+	}
+	p.associations[a.id] = a
+	p.perMapping[mapping.Name]++
+	return a
+}
+
+// unregister stops tracking an association
+func (p *Proxy) unregister(a *association) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.associations, a.id)
+	p.perMapping[a.mapping.Name]--
+}
+
+// isStopping reports whether Stop was called
+func (p *Proxy) isStopping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopping
+}
+
+// Status returns every relayed association with the state of its paths
+func (p *Proxy) Status() []AssociationStatus {
+	p.mu.Lock()
+	associations := make([]*association, 0, len(p.associations))
+	for _, a := range p.associations {
+		if a.backend != nil {
+			associations = append(associations, a)
+		}
+	}
+	p.mu.Unlock()
+
+	out := make([]AssociationStatus, 0, len(associations))
+	for _, a := range associations {
+		status := AssociationStatus{
+			ID:          a.id,
+			Mapping:     a.mapping.Name,
+			Client:      a.peers.String(),
+			Backend:     a.mapping.Backend.String(),
+			Started:     a.started,
+			MessagesIn:  a.messagesIn.Load(),
+			MessagesOut: a.messagesOut.Load(),
+			BytesIn:     a.bytesIn.Load(),
+			BytesOut:    a.bytesOut.Load(),
+			Dropped:     a.dropped.Load(),
+		}
+		if paths, err := a.client.Status(); err == nil {
+			status.ClientPaths = &paths
+		}
+		if paths, err := a.backend.Status(); err == nil {
+			status.BackendPath = &paths
+		}
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
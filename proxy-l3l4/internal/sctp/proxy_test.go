@@ -0,0 +1,123 @@
+package sctp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func mustParseAddr(t *testing.T, addresses ...string) *Addr {
+	t.Helper()
+	addr, err := ParseAddr(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func TestAllowsPeers(t *testing.T) {
+	mapping := &Mapping{AllowedSources: mustParseCIDRs(t, "10.0.0.0/8", "2001:db8::/32")}
+	for _, c := range []struct {
+		peers []string
+		want  bool
+	}{
+		{[]string{"10.1.2.3:36412"}, true},
+		{[]string{"10.1.2.3:36412", "[2001:db8::3]:36412"}, true},
+		// Every path of a multihomed client must be allowed
+		{[]string{"10.1.2.3:36412", "192.0.2.3:36412"}, false},
+		{[]string{"192.0.2.3:36412"}, false},
+		{[]string{"[2001:db9::3]:36412"}, false},
+	} {
+		if got := mapping.allowsPeers(mustParseAddr(t, c.peers...)); got != c.want {
+			t.Errorf("allowsPeers(%v) = %t, want %t", c.peers, got, c.want)
+		}
+	}
+
+	open := &Mapping{}
+	if !open.allowsPeers(mustParseAddr(t, "192.0.2.3:36412")) {
+		t.Error("mapping without allowed sources refused a client")
+	}
+}
+
+func TestAllowsPPID(t *testing.T) {
+	mapping := &Mapping{AllowedPPIDs: []uint32{PPIDS1AP, PPIDNGAP}}
+	for ppid, want := range map[uint32]bool{
+		PPIDS1AP:     true,
+		PPIDNGAP:     true,
+		PPIDDiameter: false,
+		0:            false,
+	} {
+		if got := mapping.allowsPPID(ppid); got != want {
+			t.Errorf("allowsPPID(%d) = %t, want %t", ppid, got, want)
+		}
+	}
+
+	open := &Mapping{}
+	if !open.allowsPPID(PPIDDiameter) {
+		t.Error("mapping without allowed PPIDs dropped a message")
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		stopping bool
+		want     string
+	}{
+		{io.EOF, false, closeClientEOF},
+		{fmt.Errorf("read: %w", io.EOF), false, closeClientEOF},
+		{errors.New("connection reset"), false, closeError},
+		{ErrMessageTooLarge, false, closeError},
+		{io.EOF, true, closeDrain},
+		{errors.New("use of closed file"), true, closeDrain},
+	} {
+		if got := closeReason(c.err, closeClientEOF, c.stopping); got != c.want {
+			t.Errorf("closeReason(%v, stopping %t) = %s, want %s", c.err, c.stopping, got, c.want)
+		}
+	}
+}
+
+func TestRegisterLimit(t *testing.T) {
+	p := NewProxy(nil, Options{}, 0, nil)
+	limited := &Mapping{Name: "s1ap", MaxAssociations: 2}
+	unlimited := &Mapping{Name: "diameter"}
+	peers := mustParseAddr(t, "10.1.2.3:36412")
+
+	first := p.register(limited, nil, peers)
+	second := p.register(limited, nil, peers)
+	if first == nil || second == nil || first.id == second.id {
+		t.Fatalf("associations %v and %v under the limit", first, second)
+	}
+	if p.register(limited, nil, peers) != nil {
+		t.Error("association registered over the limit")
+	}
+	for n := 0; n < 5; n++ {
+		if p.register(unlimited, nil, peers) == nil {
+			t.Fatal("mapping without a limit refused an association")
+		}
+	}
+
+	// Ending an association frees its slot
+	p.unregister(first)
+	if p.register(limited, nil, peers) == nil {
+		t.Error("slot not freed")
+	}
+	if len(p.Status()) != 0 {
+		t.Error("associations without a backend reported in status")
+	}
+}
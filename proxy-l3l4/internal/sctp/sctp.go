@@ -0,0 +1,169 @@
+// Package sctp forwards SCTP associations for telco workloads such as
+// S1AP, NGAP and Diameter.
+//
+// Sockets are one-to-one style (SOCK_STREAM), one association per socket.
+// Endpoints are multihomed: listeners bind several local addresses and
+// backends are dialed on all of theirs, so the kernel fails over between
+// paths on its own. Message boundaries, stream IDs and payload protocol
+// identifiers are preserved across the proxy.
+package sctp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Well-known payload protocol identifiers
+const (
+	PPIDS1AP     = 18
+	PPIDDiameter = 46
+	PPIDNGAP     = 60
+)
+
+const (
+	// DefaultStreams is the number of streams requested per association
+	DefaultStreams = 16
+	// DefaultMaxMessageSize bounds a reassembled user message
+	DefaultMaxMessageSize = 256 * 1024
+)
+
+// ErrUnsupported is returned where the kernel has no SCTP support
+var ErrUnsupported = errors.New("SCTP is only supported on Linux")
+
+// ErrMessageTooLarge is returned for user messages over the maximum size
+var ErrMessageTooLarge = errors.New("SCTP message exceeds the maximum size")
+
+// Message is one SCTP user message
+type Message struct {
+	Data      []byte
+	Stream    uint16
+	PPID      uint32 // Payload protocol identifier
+	Unordered bool
+}
+
+// Options tune new associations
+type Options struct {
+	Streams        int  // Outbound streams requested and inbound streams accepted
+	MaxMessageSize int  // Largest user message relayed, in bytes
+	NoDelay        bool // Send messages without Nagle-style bundling delays
+}
+
+// withDefaults fills unset options
+func (o Options) withDefaults() Options {
+	if o.Streams <= 0 {
+		o.Streams = DefaultStreams
+	}
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return o
+}
+
+// Addr is a multihomed SCTP endpoint: one port on several IP addresses
+type Addr struct {
+	IPs  []net.IP
+	Port int
+}
+
+// ParseAddr parses host:port addresses of one endpoint. Every address must
+// use the same port, since an SCTP endpoint has a single port.
+func ParseAddr(addresses []string) (*Addr, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no addresses")
+	}
+
+	addr := &Addr{}
+	for _, address := range addresses {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q: not an IP address", address)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in %q", address)
+		}
+		if len(addr.IPs) > 0 && port != addr.Port {
+			return nil, fmt.Errorf("address %q uses port %d, expected %d for every address", address, port, addr.Port)
+		}
+		addr.IPs = append(addr.IPs, ip)
+		addr.Port = port
+	}
+	return addr, nil
+}
+
+// String returns the addresses as ip1,ip2:port
+func (a *Addr) String() string {
+	ips := make([]string, len(a.IPs))
+	for i, ip := range a.IPs {
+		ips[i] = ip.String()
+	}
+	return net.JoinHostPort(strings.Join(ips, ","), strconv.Itoa(a.Port))
+}
+
+// ipv6 reports whether any address needs an IPv6 socket
+func (a *Addr) ipv6() bool {
+	for _, ip := range a.IPs {
+		if ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Status is the state of an association as seen by the kernel
+type Status struct {
+	State       string `json:"state"`
+	InStreams   int    `json:"in_streams"`
+	OutStreams  int    `json:"out_streams"`
+	Rwnd        uint32 `json:"rwnd"`
+	Unacked     int    `json:"unacked"`
+	Pending     int    `json:"pending"`
+	PrimaryPath string `json:"primary_path"`
+	Paths       []Path `json:"paths"`
+}
+
+// Path is one peer address of a multihomed association
+type Path struct {
+	Address string `json:"address"`
+	State   string `json:"state"` // active, potentially_failed, inactive or unconfirmed
+	SRTT    uint32 `json:"srtt_ms"`
+	RTO     uint32 `json:"rto_ms"`
+	CWND    uint32 `json:"cwnd"`
+	MTU     uint32 `json:"mtu"`
+}
+
+// assocStates names the sstat_state values of SCTP_STATUS
+var assocStates = map[int32]string{
+	0: "empty",
+	1: "closed",
+	2: "cookie_wait",
+	3: "cookie_echoed",
+	4: "established",
+	5: "shutdown_pending",
+	6: "shutdown_sent",
+	7: "shutdown_received",
+	8: "shutdown_ack_sent",
+}
+
+// pathStates names the spinfo_state values of SCTP_GET_PEER_ADDR_INFO
+var pathStates = map[int32]string{
+	0: "inactive",
+	1: "potentially_failed",
+	2: "active",
+	3: "unconfirmed",
+}
+
+// stateName returns the name of a state value, or the number when unknown
+func stateName(names map[int32]string, state int32) string {
+	if name, ok := names[state]; ok {
+		return name
+	}
+	return strconv.Itoa(int(state))
+}
@@ -0,0 +1,521 @@
+package sctp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Socket options and ancillary data types from linux/sctp.h
+const (
+	solSCTP             = 132
+	sctpInitMsg         = 2
+	sctpNoDelay         = 3
+	sctpStatus          = 14
+	sctpGetPeerAddrInfo = 15
+	sctpRecvRcvInfo     = 32
+	sctpSockoptBindxAdd = 100
+	sctpGetPeerAddrs    = 108
+	sctpGetLocalAddrs   = 109
+	sctpSockoptConnectx = 110
+	sctpCmsgSndInfo     = 2
+	sctpCmsgRcvInfo     = 3
+	sctpUnordered       = 1
+	msgNotification     = 0x8000
+	sctpStatusSize      = 176 // struct sctp_status
+	sctpPaddrInfoSize   = 152 // struct sctp_paddrinfo, packed
+	sctpSndInfoSize     = 16  // struct sctp_sndinfo
+	sctpRcvInfoSize     = 28  // struct sctp_rcvinfo
+	sockaddrStorageSize = 128
+	maxAssociationAddrs = 64
+	listenBacklog       = 128
+)
+
+// Supported reports whether the kernel can open SCTP sockets; the sctp
+// module may need to be loaded
+func Supported() bool {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return false
+	}
+	unix.Close(fd)
+	return true
+}
+
+// Listener accepts associations on a multihomed address
+type Listener struct {
+	file *os.File
+	raw  syscall.RawConn
+	addr *Addr
+	opts Options
+}
+
+// Listen binds every address of addr and listens for associations
+func Listen(addr *Addr, opts Options) (*Listener, error) {
+	opts = opts.withDefaults()
+	fd, err := newSocket(addr.ipv6(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set SO_REUSEADDR: %w", err)
+	}
+	if err := unix.SetsockoptString(fd, solSCTP, sctpSockoptBindxAdd, string(packAddrs(addr))); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind %s: %w", addr, err)
+	}
+	if err := unix.Listen(fd, listenBacklog); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "sctp-listener")
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Listener{file: file, raw: raw, addr: addr, opts: opts}, nil
+}
+
+// Accept waits for the next association
+func (l *Listener) Accept() (*Conn, error) {
+	var nfd int
+	var opErr error
+	err := l.raw.Read(func(fd uintptr) bool {
+		nfd, _, opErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return opErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opErr != nil {
+		return nil, fmt.Errorf("accept failed: %w", opErr)
+	}
+	return newConn(nfd, l.opts)
+}
+
+// Close stops accepting associations
+func (l *Listener) Close() error {
+	return l.file.Close()
+}
+
+// Addr returns the listen address
+func (l *Listener) Addr() *Addr {
+	return l.addr
+}
+
+// Conn is one association on a one-to-one style socket
+type Conn struct {
+	file       *os.File
+	raw        syscall.RawConn
+	opts       Options
+	buf        []byte
+	oob        []byte
+	outStreams int
+}
+
+// Dial establishes an association with every address of remote, so the
+// kernel can fail over between the remote's paths
+func Dial(ctx context.Context, remote *Addr, opts Options) (*Conn, error) {
+	opts = opts.withDefaults()
+	fd, err := newSocket(remote.ipv6(), opts)
+	if err != nil {
+		return nil, err
+	}
+	connectErr := unix.SetsockoptString(fd, solSCTP, sctpSockoptConnectx, string(packAddrs(remote)))
+	if connectErr != nil && connectErr != unix.EINPROGRESS {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to connect to %s: %w", remote, connectErr)
+	}
+
+	file := os.NewFile(uintptr(fd), "sctp")
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if connectErr == unix.EINPROGRESS {
+		if deadline, ok := ctx.Deadline(); ok {
+			file.SetWriteDeadline(deadline)
+		}
+		stop := context.AfterFunc(ctx, func() {
+			file.SetWriteDeadline(time.Unix(1, 0))
+		})
+		err := waitConnected(raw)
+		stop()
+		file.SetWriteDeadline(time.Time{})
+		if err != nil {
+			file.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to connect to %s: %w", remote, err)
+		}
+	}
+
+	return wrapConn(file, raw, opts)
+}
+
+// waitConnected waits for a non-blocking connect to finish
+func waitConnected(raw syscall.RawConn) error {
+	var sockErr error
+	first := true
+	err := raw.Write(func(fd uintptr) bool {
+		if first {
+			first = false
+			return false
+		}
+		value, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			sockErr = err
+			return true
+		}
+		switch errno := unix.Errno(value); errno {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case 0:
+			// Spurious wakeups happen; only a known peer means connected
+			_, err := unix.Getpeername(int(fd))
+			return err == nil
+		default:
+			sockErr = errno
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// newConn wraps an accepted socket
+func newConn(fd int, opts Options) (*Conn, error) {
+	// Socket options are not reliably inherited from the listener
+	if err := unix.SetsockoptInt(fd, solSCTP, sctpRecvRcvInfo, 1); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to enable SCTP_RECVRCVINFO: %w", err)
+	}
+	if opts.NoDelay {
+		unix.SetsockoptInt(fd, solSCTP, sctpNoDelay, 1)
+	}
+
+	file := os.NewFile(uintptr(fd), "sctp")
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wrapConn(file, raw, opts)
+}
+
+// wrapConn creates a Conn for an established association
+func wrapConn(file *os.File, raw syscall.RawConn, opts Options) (*Conn, error) {
+	c := &Conn{
+		file: file,
+		raw:  raw,
+		opts: opts,
+		buf:  make([]byte, 64*1024),
+		oob:  make([]byte, unix.CmsgSpace(sctpRcvInfoSize)),
+	}
+	status, err := c.Status()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.outStreams = status.OutStreams
+	return c, nil
+}
+
+// newSocket creates a non-blocking one-to-one SCTP socket set up for
+// relaying messages
+func newSocket(ipv6 bool, opts Options) (int, error) {
+	family := unix.AF_INET
+	if ipv6 {
+		family = unix.AF_INET6
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create SCTP socket: %w", err)
+	}
+
+	// struct sctp_initmsg: outbound streams, max inbound streams, attempts, timeout
+	var initMsg [8]byte
+	binary.NativeEndian.PutUint16(initMsg[0:], uint16(opts.Streams))
+	binary.NativeEndian.PutUint16(initMsg[2:], uint16(opts.Streams))
+	if err := unix.SetsockoptString(fd, solSCTP, sctpInitMsg, string(initMsg[:])); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to set SCTP_INITMSG: %w", err)
+	}
+	if err := unix.SetsockoptInt(fd, solSCTP, sctpRecvRcvInfo, 1); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to enable SCTP_RECVRCVINFO: %w", err)
+	}
+	if opts.NoDelay {
+		unix.SetsockoptInt(fd, solSCTP, sctpNoDelay, 1)
+	}
+	return fd, nil
+}
+
+// ReadMessage reads the next user message, reassembling messages larger
+// than one read. Notifications are skipped. It returns io.EOF once the
+// peer shut the association down.
+func (c *Conn) ReadMessage() (Message, error) {
+	var msg Message
+	var data []byte
+	notification := false
+	first := true
+
+	for {
+		var n, oobn, flags int
+		var opErr error
+		err := c.raw.Read(func(fd uintptr) bool {
+			n, oobn, flags, _, opErr = unix.Recvmsg(int(fd), c.buf, c.oob, 0)
+			return opErr != unix.EAGAIN
+		})
+		if err != nil {
+			return msg, err
+		}
+		if opErr != nil {
+			return msg, opErr
+		}
+		if n == 0 && oobn == 0 && flags&unix.MSG_EOR == 0 {
+			return msg, io.EOF
+		}
+
+		if first {
+			notification = flags&msgNotification != 0
+			parseRcvInfo(c.oob[:oobn], &msg)
+			first = false
+		}
+		if !notification {
+			if len(data)+n > c.opts.MaxMessageSize {
+				return msg, ErrMessageTooLarge
+			}
+			data = append(data, c.buf[:n]...)
+		}
+		if flags&unix.MSG_EOR == 0 {
+			continue
+		}
+
+		if notification {
+			msg, data, notification, first = Message{}, nil, false, true
+			continue
+		}
+		msg.Data = data
+		return msg, nil
+	}
+}
+
+// parseRcvInfo fills the stream, PPID and flags of msg from SCTP_RCVINFO
+func parseRcvInfo(oob []byte, msg *Message) {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level != solSCTP || cmsg.Header.Type != sctpCmsgRcvInfo || len(cmsg.Data) < sctpRcvInfoSize {
+			continue
+		}
+		// struct sctp_rcvinfo: sid, ssn, flags, pad, ppid (wire order), ...
+		msg.Stream = binary.NativeEndian.Uint16(cmsg.Data[0:])
+		msg.Unordered = binary.NativeEndian.Uint16(cmsg.Data[4:])&sctpUnordered != 0
+		msg.PPID = binary.BigEndian.Uint32(cmsg.Data[8:])
+	}
+}
+
+// WriteMessage sends one user message on its stream with its PPID
+func (c *Conn) WriteMessage(msg Message) error {
+	oob := make([]byte, unix.CmsgSpace(sctpSndInfoSize))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = solSCTP
+	header.Type = sctpCmsgSndInfo
+	header.SetLen(unix.CmsgLen(sctpSndInfoSize))
+
+	// struct sctp_sndinfo: sid, flags, ppid (wire order), context, assoc_id
+	info := oob[unix.CmsgLen(0):]
+	binary.NativeEndian.PutUint16(info[0:], msg.Stream)
+	if msg.Unordered {
+		binary.NativeEndian.PutUint16(info[2:], sctpUnordered)
+	}
+	binary.BigEndian.PutUint32(info[4:], msg.PPID)
+
+	var opErr error
+	err := c.raw.Write(func(fd uintptr) bool {
+		_, opErr = unix.SendmsgN(int(fd), msg.Data, oob, nil, 0)
+		return opErr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// OutStreams returns the number of outbound streams negotiated for the
+// association
+func (c *Conn) OutStreams() int {
+	return c.outStreams
+}
+
+// PeerAddrs returns every address of the peer
+func (c *Conn) PeerAddrs() (*Addr, error) {
+	return c.addrs(sctpGetPeerAddrs)
+}
+
+// LocalAddrs returns every local address of the association
+func (c *Conn) LocalAddrs() (*Addr, error) {
+	return c.addrs(sctpGetLocalAddrs)
+}
+
+// addrs reads a struct sctp_getaddrs: assoc_id, addr_num, packed sockaddrs
+func (c *Conn) addrs(option int) (*Addr, error) {
+	buf := make([]byte, 8+maxAssociationAddrs*unix.SizeofSockaddrInet6)
+	if err := c.getsockopt(option, buf); err != nil {
+		return nil, fmt.Errorf("failed to read association addresses: %w", err)
+	}
+	count := int(binary.NativeEndian.Uint32(buf[4:]))
+	addr := &Addr{}
+	offset := 8
+	for i := 0; i < count && offset < len(buf); i++ {
+		ip, port, size := parseSockaddr(buf[offset:])
+		if size == 0 {
+			break
+		}
+		addr.IPs = append(addr.IPs, ip)
+		addr.Port = port
+		offset += size
+	}
+	return addr, nil
+}
+
+// Status returns the association state with the state of every path
+func (c *Conn) Status() (Status, error) {
+	buf := make([]byte, sctpStatusSize)
+	if err := c.getsockopt(sctpStatus, buf); err != nil {
+		return Status{}, fmt.Errorf("failed to read SCTP_STATUS: %w", err)
+	}
+
+	status := Status{
+		State:      stateName(assocStates, int32(binary.NativeEndian.Uint32(buf[4:]))),
+		Rwnd:       binary.NativeEndian.Uint32(buf[8:]),
+		Unacked:    int(binary.NativeEndian.Uint16(buf[12:])),
+		Pending:    int(binary.NativeEndian.Uint16(buf[14:])),
+		InStreams:  int(binary.NativeEndian.Uint16(buf[16:])),
+		OutStreams: int(binary.NativeEndian.Uint16(buf[18:])),
+	}
+	// sstat_primary is a struct sctp_paddrinfo at offset 24; its address
+	// follows the assoc_id
+	if ip, port, size := parseSockaddr(buf[28:]); size > 0 {
+		status.PrimaryPath = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	peers, err := c.PeerAddrs()
+	if err != nil {
+		return status, nil
+	}
+	for _, ip := range peers.IPs {
+		status.Paths = append(status.Paths, c.path(ip, peers.Port))
+	}
+	return status, nil
+}
+
+// path reads the state of one peer address with SCTP_GET_PEER_ADDR_INFO
+func (c *Conn) path(ip net.IP, port int) Path {
+	path := Path{Address: net.JoinHostPort(ip.String(), strconv.Itoa(port)), State: "unknown"}
+
+	buf := make([]byte, sctpPaddrInfoSize)
+	copy(buf[4:4+sockaddrStorageSize], packSockaddr(ip, port))
+	if err := c.getsockopt(sctpGetPeerAddrInfo, buf); err != nil {
+		return path
+	}
+	path.State = stateName(pathStates, int32(binary.NativeEndian.Uint32(buf[132:])))
+	path.CWND = binary.NativeEndian.Uint32(buf[136:])
+	path.SRTT = binary.NativeEndian.Uint32(buf[140:])
+	path.RTO = binary.NativeEndian.Uint32(buf[144:])
+	path.MTU = binary.NativeEndian.Uint32(buf[148:])
+	return path
+}
+
+// getsockopt reads an SCTP socket option into buf, which starts with the
+// association ID (0 on one-to-one sockets)
+func (c *Conn) getsockopt(option int, buf []byte) error {
+	size := uint32(len(buf))
+	var sockErr error
+	err := c.raw.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, solSCTP, uintptr(option),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Close aborts the association if it is still up and closes the socket
+func (c *Conn) Close() error {
+	return c.file.Close()
+}
+
+// parseSockaddr decodes a sockaddr_in or sockaddr_in6, returning its size
+func parseSockaddr(buf []byte) (net.IP, int, int) {
+	if len(buf) < 2 {
+		return nil, 0, 0
+	}
+	switch binary.NativeEndian.Uint16(buf) {
+	case unix.AF_INET:
+		if len(buf) < unix.SizeofSockaddrInet4 {
+			return nil, 0, 0
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, buf[4:8])
+		return ip, int(binary.BigEndian.Uint16(buf[2:])), unix.SizeofSockaddrInet4
+	case unix.AF_INET6:
+		if len(buf) < unix.SizeofSockaddrInet6 {
+			return nil, 0, 0
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, buf[8:24])
+		return ip, int(binary.BigEndian.Uint16(buf[2:])), unix.SizeofSockaddrInet6
+	}
+	return nil, 0, 0
+}
+
+// packSockaddr encodes ip and port as a sockaddr_in or sockaddr_in6
+func packSockaddr(ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		buf := make([]byte, unix.SizeofSockaddrInet4)
+		binary.NativeEndian.PutUint16(buf, unix.AF_INET)
+		binary.BigEndian.PutUint16(buf[2:], uint16(port))
+		copy(buf[4:], ip4)
+		return buf
+	}
+	buf := make([]byte, unix.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(buf, unix.AF_INET6)
+	binary.BigEndian.PutUint16(buf[2:], uint16(port))
+	copy(buf[8:], ip.To16())
+	return buf
+}
+
+// packAddrs encodes every address of addr back to back, as sctp_bindx and
+// sctp_connectx expect
+func packAddrs(addr *Addr) []byte {
+	var buf []byte
+	for _, ip := range addr.IPs {
+		buf = append(buf, packSockaddr(ip, addr.Port)...)
+	}
+	return buf
+}
@@ -0,0 +1,216 @@
+package sctp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func TestSockaddr(t *testing.T) {
+	for _, c := range []struct {
+		ip   string
+		size int
+	}{
+		{"10.0.0.1", unix.SizeofSockaddrInet4},
+		{"2001:db8::1", unix.SizeofSockaddrInet6},
+	} {
+		buf := packSockaddr(net.ParseIP(c.ip), 36412)
+		ip, port, size := parseSockaddr(buf)
+		if !ip.Equal(net.ParseIP(c.ip)) || port != 36412 || size != c.size {
+			t.Errorf("%s decoded as %s port %d size %d", c.ip, ip, port, size)
+		}
+		if _, _, size := parseSockaddr(buf[:c.size-1]); size != 0 {
+			t.Errorf("%s: truncated sockaddr decoded", c.ip)
+		}
+	}
+	if _, _, size := parseSockaddr([]byte{0xff, 0xff, 0, 0}); size != 0 {
+		t.Error("unknown family decoded")
+	}
+
+	// Addresses are packed back to back for bindx and connectx
+	packed := packAddrs(mustParseAddr(t, "10.0.0.1:3868", "[2001:db8::1]:3868"))
+	if len(packed) != unix.SizeofSockaddrInet4+unix.SizeofSockaddrInet6 {
+		t.Fatalf("packed %d bytes", len(packed))
+	}
+	if ip, port, _ := parseSockaddr(packed[unix.SizeofSockaddrInet4:]); !ip.Equal(net.ParseIP("2001:db8::1")) || port != 3868 {
+		t.Errorf("second address %s port %d", ip, port)
+	}
+}
+
+func TestParseRcvInfo(t *testing.T) {
+	oob := make([]byte, unix.CmsgSpace(sctpRcvInfoSize))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = solSCTP
+	header.Type = sctpCmsgRcvInfo
+	header.SetLen(unix.CmsgLen(sctpRcvInfoSize))
+	info := oob[unix.CmsgLen(0):]
+	binary.NativeEndian.PutUint16(info[0:], 7)
+	binary.NativeEndian.PutUint16(info[4:], sctpUnordered)
+	binary.BigEndian.PutUint32(info[8:], PPIDNGAP)
+
+	var msg Message
+	parseRcvInfo(oob, &msg)
+	if msg.Stream != 7 || msg.PPID != PPIDNGAP || !msg.Unordered {
+		t.Errorf("parsed %+v", msg)
+	}
+
+	// Other ancillary data is ignored
+	header.Type = sctpCmsgSndInfo
+	msg = Message{}
+	parseRcvInfo(oob, &msg)
+	if msg.Stream != 0 || msg.PPID != 0 || msg.Unordered {
+		t.Errorf("parsed %+v from SCTP_SNDINFO", msg)
+	}
+}
+
+// requireSCTP skips tests that need the kernel's SCTP support
+func requireSCTP(t *testing.T) {
+	t.Helper()
+	if !Supported() {
+		t.Skip("SCTP sockets not available; load the sctp kernel module")
+	}
+}
+
+// listenLoopback listens on an ephemeral loopback port
+func listenLoopback(t *testing.T) *Listener {
+	t.Helper()
+	listener, err := Listen(mustParseAddr(t, "127.0.0.1:0"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	setBoundPort(t, listener)
+	return listener
+}
+
+// setBoundPort replaces port 0 in the listener's address with the one the
+// kernel picked
+func setBoundPort(t *testing.T, listener *Listener) {
+	t.Helper()
+	var sa unix.Sockaddr
+	var err error
+	listener.raw.Control(func(fd uintptr) {
+		sa, err = unix.Getsockname(int(fd))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.addr = &Addr{IPs: listener.addr.IPs, Port: sa.(*unix.SockaddrInet4).Port}
+}
+
+// echo returns every message on each association accepted by listener
+func echo(listener *Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if conn.WriteMessage(msg) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func dialLoopback(t *testing.T, addr *Addr) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, addr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestLoopback(t *testing.T) {
+	requireSCTP(t)
+	backend := listenLoopback(t)
+	go echo(backend)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	allowed := &Mapping{
+		Name:           "s1ap",
+		Listen:         mustParseAddr(t, "127.0.0.1:0"),
+		Backend:        backend.Addr(),
+		AllowedSources: mustParseCIDRs(t, "127.0.0.0/8"),
+		AllowedPPIDs:   []uint32{PPIDS1AP},
+	}
+	denied := &Mapping{
+		Name:           "denied",
+		Listen:         mustParseAddr(t, "127.0.0.1:0"),
+		Backend:        backend.Addr(),
+		AllowedSources: mustParseCIDRs(t, "10.0.0.0/8"),
+	}
+	p := NewProxy([]*Mapping{allowed, denied}, Options{}, 5*time.Second, logger)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	for _, listener := range p.listeners {
+		setBoundPort(t, listener)
+	}
+
+	client := dialLoopback(t, p.listeners[0].Addr())
+	// Diameter is not allowed on this mapping and is dropped
+	if err := client.WriteMessage(Message{Data: []byte("cer"), PPID: PPIDDiameter}); err != nil {
+		t.Fatal(err)
+	}
+	sent := Message{Data: bytes.Repeat([]byte("s1-setup"), 1000), Stream: 3, PPID: PPIDS1AP}
+	if err := client.WriteMessage(sent); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, sent.Data) || got.Stream != sent.Stream || got.PPID != sent.PPID {
+		t.Errorf("echoed %d bytes on stream %d with PPID %d", len(got.Data), got.Stream, got.PPID)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := p.Status()
+		if len(status) == 1 && status[0].MessagesIn == 1 && status[0].MessagesOut == 1 && status[0].Dropped == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A client outside the allowed sources is closed before relaying
+	refused := dialLoopback(t, p.listeners[1].Addr())
+	if _, err := refused.ReadMessage(); err == nil {
+		t.Error("refused association relayed a message")
+	}
+
+	// The relay ends with the client's association
+	client.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for len(p.Status()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("association still tracked after the client closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
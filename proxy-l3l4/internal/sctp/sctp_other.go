@@ -0,0 +1,76 @@
+//go:build !linux
+
+package sctp
+
+import "context"
+
+// Supported reports whether SCTP is available; it is only supported on Linux
+func Supported() bool {
+	return false
+}
+
+// Listener accepts associations on a multihomed address
+type Listener struct{}
+
+// Listen is only supported on Linux
+func Listen(addr *Addr, opts Options) (*Listener, error) {
+	return nil, ErrUnsupported
+}
+
+// Accept is only supported on Linux
+func (l *Listener) Accept() (*Conn, error) {
+	return nil, ErrUnsupported
+}
+
+// Close is only supported on Linux
+func (l *Listener) Close() error {
+	return ErrUnsupported
+}
+
+// Addr returns nil; listeners are only supported on Linux
+func (l *Listener) Addr() *Addr {
+	return nil
+}
+
+// Conn is one association on a one-to-one style socket
+type Conn struct{}
+
+// Dial is only supported on Linux
+func Dial(ctx context.Context, remote *Addr, opts Options) (*Conn, error) {
+	return nil, ErrUnsupported
+}
+
+// ReadMessage is only supported on Linux
+func (c *Conn) ReadMessage() (Message, error) {
+	return Message{}, ErrUnsupported
+}
+
+// WriteMessage is only supported on Linux
+func (c *Conn) WriteMessage(msg Message) error {
+	return ErrUnsupported
+}
+
+// OutStreams is only supported on Linux
+func (c *Conn) OutStreams() int {
+	return 0
+}
+
+// PeerAddrs is only supported on Linux
+func (c *Conn) PeerAddrs() (*Addr, error) {
+	return nil, ErrUnsupported
+}
+
+// LocalAddrs is only supported on Linux
+func (c *Conn) LocalAddrs() (*Addr, error) {
+	return nil, ErrUnsupported
+}
+
+// Status is only supported on Linux
+func (c *Conn) Status() (Status, error) {
+	return Status{}, ErrUnsupported
+}
+
+// Close is only supported on Linux
+func (c *Conn) Close() error {
+	return ErrUnsupported
+}
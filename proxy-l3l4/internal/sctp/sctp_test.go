@@ -0,0 +1,62 @@
+package sctp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	addr, err := ParseAddr([]string{"10.0.0.1:36412", "[2001:db8::1]:36412"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Port != 36412 || len(addr.IPs) != 2 || !addr.ipv6() {
+		t.Errorf("parsed %+v", addr)
+	}
+	if got := addr.String(); got != "[10.0.0.1,2001:db8::1]:36412" {
+		t.Errorf("String() = %s", got)
+	}
+	if v4 := mustParseAddr(t, "10.0.0.1:3868", "10.0.1.1:3868"); v4.ipv6() || v4.String() != "10.0.0.1,10.0.1.1:3868" {
+		t.Errorf("IPv4 endpoint %s, ipv6 %t", v4, v4.ipv6())
+	}
+
+	for addresses, want := range map[string]string{
+		"":                              "no addresses",
+		"10.0.0.1":                      "invalid address",
+		"host.example:36412":            "not an IP address",
+		"10.0.0.1:port":                 "invalid port",
+		"10.0.0.1:65536":                "invalid port",
+		"10.0.0.1:36412,10.0.1.1:38412": "expected 36412 for every address",
+	} {
+		var list []string
+		if addresses != "" {
+			list = strings.Split(addresses, ",")
+		}
+		if _, err := ParseAddr(list); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseAddr(%q): error %v, want %q", addresses, err, want)
+		}
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	opts := Options{}.withDefaults()
+	if opts.Streams != DefaultStreams || opts.MaxMessageSize != DefaultMaxMessageSize {
+		t.Errorf("defaults %+v", opts)
+	}
+	opts = Options{Streams: 4, MaxMessageSize: 1024, NoDelay: true}.withDefaults()
+	if opts.Streams != 4 || opts.MaxMessageSize != 1024 || !opts.NoDelay {
+		t.Errorf("options overridden %+v", opts)
+	}
+}
+
+func TestStateName(t *testing.T) {
+	if got := stateName(assocStates, 4); got != "established" {
+		t.Errorf("state 4 %q", got)
+	}
+	if got := stateName(pathStates, 1); got != "potentially_failed" {
+		t.Errorf("path state 1 %q", got)
+	}
+	if got := stateName(pathStates, 42); got != "42" {
+		t.Errorf("unknown state %q", got)
+	}
+}
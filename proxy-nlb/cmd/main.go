@@ -3,18 +3,32 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"marchproxy-nlb/internal/config"
+	"marchproxy-nlb/internal/geoip"
 	"marchproxy-nlb/internal/grpc"
 	"marchproxy-nlb/internal/nlb"
-
+	"marchproxy-nlb/internal/vrrp"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/bgp"
+	"marchproxy-shared/dashgen"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/netutil"
+	"marchproxy-shared/readiness"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -23,6 +37,12 @@ var (
 )
 
 func main() {
+	layers.AddFlags(pflag.CommandLine)
+	output := pflag.StringP("output", "o", "yaml", "output format of config print-effective: yaml or json")
+	outputDir := pflag.String("output-dir", ".", "directory metrics export-dashboards writes to")
+	from := pflag.String("from", "", "metrics endpoint of a running NLB for metrics export-dashboards to read as well")
+	pflag.Parse()
+
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetLevel(logrus.InfoLevel)
@@ -38,15 +58,223 @@ func main() {
 		configPath = "config.example.yaml"
 	}
 
-	cfg, err := config.Load(configPath)
+	if validate, _ := pflag.CommandLine.GetBool("validate-config"); validate {
+		os.Exit(checkConfig(configPath))
+	}
+	if pflag.NArg() > 0 && pflag.Arg(0) == "metrics" {
+		os.Exit(metricsCommand(pflag.Args(), *outputDir, *from))
+	}
+	if pflag.NArg() > 0 {
+		os.Exit(configCommand(configPath, pflag.Args(), *output))
+	}
+
+	cfg, err := config.Load(configPath, pflag.CommandLine)
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to load config")
 	}
 
+	// /readyz stays unavailable until the config is loaded and every
+	// listener is bound
+	ready := readiness.New(readiness.StepConfig, readiness.StepListeners)
+	ready.Done(readiness.StepConfig)
+
+	// Register protocol plugins before any module or route names them
+	if err := nlb.LoadPlugins(cfg.Plugins, logger); err != nil {
+		logger.WithError(err).Fatal("Failed to load protocol plugins")
+	}
+
+	// Take over the listeners of the NLB this binary replaces, if one is
+	// running, before opening any
+	var handover *netutil.Handover
+	if cfg.UpgradeSocket != "" {
+		handover, err = netutil.StartHandover(cfg.UpgradeSocket, cfg.UpgradeTimeout, logger.Infof)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to start listener handover")
+		}
+		defer handover.Close()
+		logger.WithFields(logrus.Fields{
+			"socket":    cfg.UpgradeSocket,
+			"inherited": handover.Inherited(),
+		}).Info("Listener handover enabled")
+	}
+
 	// Initialize router
 	router := nlb.NewRouter(logger)
 	logger.Info("Traffic router initialized")
 
+	// Apply TCP socket tuning per protocol route
+	if err := router.SetDefaultSocketOptions(cfg.SocketOptions.TCPOptions()); err != nil {
+		logger.WithError(err).Warn("Failed to set default socket options")
+	}
+	for _, route := range cfg.RouteSocketOptions {
+		protocol := parseProtocol(route.Protocol)
+		if err := router.SetSocketOptions(protocol, cfg.RouteTCPOptions(route.Protocol)); err != nil {
+			logger.WithError(err).WithField("protocol", route.Protocol).Warn("Failed to set route socket options")
+		}
+	}
+
+	// Eject modules that keep failing live traffic until their ejection ends
+	if err := router.SetOutlierDetection(nlb.OutlierConfig{
+		FailureThreshold: cfg.PassiveHealth.FailureThreshold,
+		Window:           cfg.PassiveHealth.Window,
+		EjectionTime:     cfg.PassiveHealth.EjectionTime,
+	}); err != nil {
+		logger.WithError(err).Warn("Failed to set passive health checks")
+	}
+
+	// Ramp up the share of modules that were just added or recovered
+	if err := router.SetSlowStart(nlb.SlowStartConfig{
+		Window:    cfg.SlowStart.Window,
+		Curve:     cfg.SlowStart.Curve,
+		MinWeight: cfg.SlowStart.MinWeight,
+	}); err != nil {
+		logger.WithError(err).Warn("Failed to set slow-start")
+	}
+
+	// Backends drained for maintenance get no new connections while their
+	// open ones finish, drained by the manager or the admin API
+	drains := drain.NewSet("nlb")
+	router.SetDrains(drains)
+	prometheus.MustRegister(drains.Collector(router.DrainingConns))
+	drainCtx, drainCancel := context.WithCancel(context.Background())
+	defer drainCancel()
+	if fetch := cfg.NewDrainFetcher(); fetch != nil {
+		go drains.Poll(drainCtx, cfg.DrainPollInterval, fetch, func(err error) {
+			logger.WithError(err).Warn("Failed to fetch backend drains")
+		})
+	}
+
+	// Standalone mode has no manager to announce modules, so route to the
+	// ones listed in the config
+	for _, module := range cfg.StaticModules {
+		weight := module.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		maxConns := module.MaxConns
+		if maxConns == 0 {
+			maxConns = cfg.MaxConnectionsPerModule
+		}
+		if err := router.RegisterModule(&nlb.ModuleEndpoint{
+			Name:        module.Name,
+			Protocol:    parseProtocol(module.Protocol),
+			Address:     module.Address,
+			GRPCPort:    module.GRPCPort,
+			Healthy:     true,
+			MaxConns:    maxConns,
+			Version:     module.Version,
+			Weight:      weight,
+			Zone:        module.Zone,
+			Region:      module.Region,
+			LastHealthy: time.Now(),
+		}); err != nil {
+			logger.WithError(err).WithField("module", module.Name).Fatal("Failed to register static module")
+		}
+	}
+	if cfg.Standalone {
+		logger.WithField("modules", len(cfg.StaticModules)).Info("Running standalone without a manager")
+	}
+
+	// Prefer modules in the NLB's own zone, then its region
+	if err := router.SetLocality(nlb.LocalityPolicy{
+		Zone:      cfg.Locality.Zone,
+		Region:    cfg.Locality.Region,
+		Spillover: cfg.Locality.Spillover,
+	}); err != nil {
+		logger.WithError(err).Fatal("Invalid locality")
+	}
+	if cfg.Locality.Zone != "" || cfg.Locality.Region != "" {
+		logger.WithFields(logrus.Fields{
+			"zone":      cfg.Locality.Zone,
+			"region":    cfg.Locality.Region,
+			"spillover": cfg.Locality.Spillover,
+		}).Info("Locality-aware routing enabled")
+	}
+
+	// Block and route clients by the country of their address
+	if cfg.GeoIP.Database != "" {
+		geo, err := geoip.Open(cfg.GeoIP.Database)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load GeoIP database")
+		}
+		policy := nlb.GeoPolicy{BlockCountries: cfg.GeoIP.BlockCountries}
+		for _, route := range cfg.GeoIP.Routes {
+			policy.Routes = append(policy.Routes, nlb.GeoRoute{
+				Countries: route.Countries,
+				Modules:   route.Modules,
+				Strict:    route.Strict,
+			})
+		}
+		router.SetGeoIP(geo, policy)
+		logger.WithFields(logrus.Fields{
+			"database":          geo.Metadata.DatabaseType,
+			"blocked_countries": len(policy.BlockCountries),
+			"routes":            len(policy.Routes),
+		}).Info("GeoIP routing enabled")
+	}
+
+	// Announce the service VIPs over BGP while modules are healthy and the
+	// instance is not draining, so routers only send traffic to live nodes
+	var speaker *bgp.Speaker
+	var draining atomic.Bool
+	bgpCtx, bgpCancel := context.WithCancel(context.Background())
+	defer bgpCancel()
+	bgpDone := make(chan struct{})
+	if cfg.BGP.Enabled {
+		speakerConfig, err := cfg.BGP.SpeakerConfig()
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid BGP configuration")
+		}
+		speaker, err = bgp.NewSpeaker(speakerConfig, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to create BGP speaker")
+		}
+		go func() {
+			defer close(bgpDone)
+			speaker.Run(bgpCtx)
+		}()
+		go speaker.Follow(bgpCtx, cfg.BGP.CheckInterval, func() bool {
+			return !draining.Load() && router.HasHealthyModules()
+		})
+		logger.WithFields(logrus.Fields{
+			"local_as": cfg.BGP.LocalAS,
+			"peers":    len(cfg.BGP.Peers),
+			"vips":     cfg.BGP.VIPs,
+		}).Info("BGP speaker started")
+	}
+
+	// Hold the floating VIP while this instance wins the VRRP election,
+	// with module health and drains lowering its priority
+	var vrrpInstance *vrrp.Instance
+	vrrpCtx, vrrpCancel := context.WithCancel(context.Background())
+	defer vrrpCancel()
+	vrrpDone := make(chan struct{})
+	if cfg.VRRP.Enabled {
+		instanceConfig, err := cfg.VRRP.InstanceConfig()
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid VRRP configuration")
+		}
+		vrrpInstance, err = vrrp.NewInstance(instanceConfig, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to create VRRP instance")
+		}
+		go func() {
+			defer close(vrrpDone)
+			if err := vrrpInstance.Run(vrrpCtx); err != nil {
+				logger.WithError(err).Error("VRRP stopped")
+			}
+		}()
+		go vrrpInstance.Follow(vrrpCtx, cfg.VRRP.CheckInterval, func() bool {
+			return !draining.Load() && router.HasHealthyModules()
+		})
+		logger.WithFields(logrus.Fields{
+			"interface": cfg.VRRP.Interface,
+			"vrid":      cfg.VRRP.VirtualRouterID,
+			"priority":  cfg.VRRP.Priority,
+			"vips":      cfg.VRRP.VIPs,
+		}).Info("VRRP started")
+	}
+
 	// Initialize rate limiter if enabled
 	var rateLimiter *nlb.RateLimiter
 	if cfg.EnableRateLimiting {
@@ -71,6 +299,7 @@ func main() {
 			nlb.ProtocolMongoDB,
 			nlb.ProtocolRedis,
 			nlb.ProtocolRTMP,
+			nlb.ProtocolKafka,
 		}
 
 		for _, protocol := range protocols {
@@ -98,14 +327,40 @@ func main() {
 
 	// Initialize gRPC client pool if enabled
 	var clientPool *grpc.ClientPool
+	meshCtx, meshCancel := context.WithCancel(context.Background())
+	defer meshCancel()
 	if cfg.EnableConnectionPooling {
-		clientPool = grpc.NewClientPool(logger)
-		logger.Info("gRPC client pool initialized")
+		meshOptions, err := cfg.Mesh.MeshOptions()
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid mesh configuration")
+		}
+		clientPool = grpc.NewMeshPool(meshOptions, logger)
+
+		// Route detected protocols to the modules owning them, static ones
+		// and those the manager knows of
+		mesh := nlb.NewMesh(router, clientPool, cfg.MaxConnectionsPerModule, logger)
+		for _, modules := range router.GetAllModules() {
+			for _, module := range modules {
+				mesh.AddStatic(module)
+			}
+		}
+		if discovery := cfg.NewModuleDiscovery(); discovery != nil {
+			go mesh.RunDiscovery(meshCtx, cfg.Mesh.DiscoveryInterval, discovery.Discover)
+		}
+		go mesh.RunHealthChecks(meshCtx, cfg.ModuleHealthCheckInterval, cfg.ModuleHealthCheckInterval/2)
+		logger.WithFields(logrus.Fields{
+			"mtls":               meshOptions.TLS != nil,
+			"discovery_interval": cfg.Mesh.DiscoveryInterval,
+		}).Info("gRPC module mesh initialized")
 	}
 
 	// Initialize gRPC server on port 50051
 	mockService := grpc.NewMockNLBService(logger)
 	grpcServer := grpc.NewServer(cfg.GRPCAddr, cfg.GRPCPort, mockService, logger)
+	grpcServer.SetBindInterface(cfg.BindInterface)
+	if err := grpcServer.Listen(); err != nil {
+		logger.WithError(err).Fatal("Failed to start gRPC server")
+	}
 
 	// Start gRPC server in goroutine
 	go func() {
@@ -115,8 +370,9 @@ func main() {
 	}()
 
 	logger.WithFields(logrus.Fields{
-		"address": cfg.GRPCAddr,
-		"port":    cfg.GRPCPort,
+		"address":   cfg.GRPCAddr,
+		"port":      cfg.GRPCPort,
+		"interface": cfg.BindInterface,
 	}).Info("gRPC server started on port 50051")
 
 	// Setup NLB router listening on port 443 (via configuration)
@@ -125,8 +381,12 @@ func main() {
 	logger.WithField("bind_addr", cfg.BindAddr).Info("NLB router ready on port 443")
 
 	// Setup signal handling for graceful shutdown
+	// SIGUSR2 starts a hitless upgrade.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if handover != nil {
+		signal.Notify(sigChan, syscall.SIGUSR2)
+	}
 
 	// Start health check and metrics server
 	mux := http.NewServeMux()
@@ -137,8 +397,37 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	// Readiness for rollouts and load balancers, unavailable while draining
+	mux.Handle("/readyz", ready)
+
 	// Prometheus metrics endpoint
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true, // required to expose latency exemplars
+	}))
+
+	// Drain withdraws the BGP announcement and gives up the VRRP VIP so
+	// traffic moves to other instances, e.g. before maintenance
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			draining.Store(true)
+			ready.SetUnready("draining")
+			logger.Info("Draining, VIPs will be released")
+		case http.MethodDelete:
+			draining.Store(false)
+			ready.SetUnready("")
+			logger.Info("Drain cleared")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"draining":%t}`, draining.Load())
+	})
+
+	// Drain single modules' backends, leaving the instance in service
+	mux.HandleFunc("/admin/backends/drain", drains.Handler(router.DrainingConns))
 
 	// Status endpoint with detailed information
 	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
@@ -154,28 +443,98 @@ func main() {
 			status["router_stats"] = router.GetStats()
 		}
 
+		status["draining"] = draining.Load()
+		if speaker != nil {
+			status["bgp_peers"] = speaker.Status()
+		}
+		if vrrpInstance != nil {
+			status["vrrp"] = vrrpInstance.Status()
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, `{"status":%v}`, status)
 	})
 
 	metricsServer := &http.Server{
-		Addr:    cfg.MetricsAddr,
-		Handler: mux,
+		Handler: adminserver.Guard(cfg.Admin, mux),
+	}
+
+	metricsListener, err := adminserver.ListenWith(cfg.Admin, cfg.MetricsAddr, func(network, address string) (net.Listener, error) {
+		return netutil.Listen(network, address, "")
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to start health check and metrics server")
+	}
+	if warning := adminserver.Warning(cfg.Admin, cfg.Admin.Address(cfg.MetricsAddr)); warning != "" {
+		logger.Warn(warning)
 	}
 
 	go func() {
-		logger.WithField("addr", cfg.MetricsAddr).Info("Starting health check and metrics server")
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithField("addr", metricsListener.Addr().String()).Info("Starting health check and metrics server")
+		if err := metricsServer.Serve(metricsListener); err != nil && err != http.ErrServerClosed {
 			logger.WithError(err).Error("Metrics server error")
 		}
 	}()
 
+	// Every listener is open, so the NLB is ready and the one being replaced
+	// can stop accepting
+	ready.Done(readiness.StepListeners)
+	var upgraded <-chan struct{}
+	if handover != nil {
+		if err := handover.Ready(); err != nil {
+			logger.WithError(err).Warn("Listener handover incomplete")
+		}
+		upgraded = handover.Done()
+	}
+
 	logger.Info("MarchProxy NLB started successfully - ready to route traffic")
 
-	// Wait for shutdown signal
-	<-sigChan
+	// Wait for shutdown signal, or for a new binary to take over
+	tookOver := false
+	for running := true; running; {
+		select {
+		case sig := <-sigChan:
+			if sig != syscall.SIGUSR2 {
+				running = false
+				break
+			}
+			logger.Info("Upgrading, starting the new binary")
+			go func() {
+				if err := handover.Upgrade(); err != nil {
+					logger.WithError(err).Error("Upgrade failed, still serving")
+				}
+			}()
+		case <-upgraded:
+			tookOver = true
+			running = false
+		}
+	}
+	if tookOver {
+		logger.Info("New process took over the listeners, draining")
+	}
 	logger.Info("Received shutdown signal, initiating graceful shutdown...")
+	ready.SetUnready("shutting down")
+
+	// Hand the floating VIP to the backup right away
+	if vrrpInstance != nil {
+		vrrpCancel()
+		<-vrrpDone
+	}
+
+	// Withdraw the VIPs and give peers time to move traffic elsewhere
+	// before closing anything
+	if speaker != nil {
+		draining.Store(true)
+		speaker.SetAnnounced(false)
+		// After an upgrade the new process already serves the listeners
+		if !tookOver {
+			logger.WithField("drain_time", cfg.BGP.DrainTime).Info("BGP announcement withdrawn, draining")
+			time.Sleep(cfg.BGP.DrainTime)
+		}
+		bgpCancel()
+		<-bgpDone
+	}
 
 	// Graceful shutdown with 30 second timeout
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -203,7 +562,8 @@ func main() {
 		blueGreenController.Stop()
 	}
 
-	// Close client pool
+	// Stop the module mesh and close the client pool
+	meshCancel()
 	if clientPool != nil {
 		if err := clientPool.Close(); err != nil {
 			logger.WithError(err).Error("Client pool shutdown error")
@@ -213,6 +573,71 @@ func main() {
 	logger.Info("Graceful shutdown complete")
 }
 
+// configCommand runs config print-effective, which prints the merged
+// configuration with secrets masked, and returns the exit status
+func configCommand(configPath string, args []string, format string) int {
+	if len(args) != 2 || args[0] != "config" || args[1] != "print-effective" {
+		fmt.Fprintf(os.Stderr, "unknown command %q, want config print-effective\n", strings.Join(args, " "))
+		return 2
+	}
+	cfg, err := config.Load(configPath, pflag.CommandLine)
+	if err == nil {
+		err = layers.PrintEffective(os.Stdout, cfg, format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// metricsCommand runs metrics export-dashboards, which generates a Grafana
+// dashboard and Prometheus rules from the registered metrics, and returns
+// the exit status
+func metricsCommand(args []string, outputDir, from string) int {
+	if len(args) != 2 || args[1] != "export-dashboards" {
+		fmt.Fprintf(os.Stderr, "unknown command %q, want metrics export-dashboards\n", strings.Join(args, " "))
+		return 2
+	}
+	if err := exportDashboards(outputDir, from); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// exportDashboards writes the dashboard and rules generated from the
+// registered metrics, merged with those scraped from a running NLB
+func exportDashboards(outputDir, from string) error {
+	metrics, err := dashgen.FromDefaultRegistry()
+	if err != nil {
+		return err
+	}
+	if from != "" {
+		scraped, err := dashgen.Scrape(from)
+		if err != nil {
+			return err
+		}
+		metrics = dashgen.Merge(scraped, metrics)
+	}
+	files, err := dashgen.Write(outputDir, "nlb", metrics)
+	for _, file := range files {
+		fmt.Printf("Wrote %s\n", file)
+	}
+	return err
+}
+
+// checkConfig loads the configuration for --validate-config and returns
+// the exit status, printing every problem found
+func checkConfig(configPath string) int {
+	if _, err := config.Load(configPath, pflag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
 // parseProtocol converts string to Protocol enum
 func parseProtocol(protocolStr string) nlb.Protocol {
 	switch protocolStr {
@@ -228,7 +653,9 @@ func parseProtocol(protocolStr string) nlb.Protocol {
 		return nlb.ProtocolRedis
 	case "rtmp", "RTMP":
 		return nlb.ProtocolRTMP
+	case "kafka", "Kafka":
+		return nlb.ProtocolKafka
 	default:
-		return nlb.ProtocolUnknown
+		return nlb.PluginProtocol(protocolStr)
 	}
 }
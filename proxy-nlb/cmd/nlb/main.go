@@ -3,19 +3,33 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"marchproxy-nlb/internal/config"
+	"marchproxy-nlb/internal/geoip"
 	"marchproxy-nlb/internal/grpc"
 	"marchproxy-nlb/internal/nlb"
-
+	"marchproxy-nlb/internal/vrrp"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/bgp"
+	"marchproxy-shared/coordination"
+	"marchproxy-shared/dashgen"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/netutil"
+	"marchproxy-shared/readiness"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -42,18 +56,114 @@ func main() {
 - gRPC-based module communication`,
 		Version: fmt.Sprintf("%s (built: %s, commit: %s)", version, buildTime, gitCommit),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runNLB(configPath, logger)
+			if validate, _ := cmd.Flags().GetBool("validate-config"); validate {
+				os.Exit(checkConfig(configPath, cmd.Flags()))
+			}
+			return runNLB(configPath, cmd.Flags(), logger)
 		},
 	}
 
 	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file path")
+	layers.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newConfigCmd(&configPath))
+	rootCmd.AddCommand(newMetricsCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		logger.WithError(err).Fatal("Failed to start NLB")
 	}
 }
 
-func runNLB(configPath string, logger *logrus.Logger) error {
+// newConfigCmd creates the config command. config print-effective prints
+// the configuration this binary would run with, given the same flags and
+// environment, with secrets masked.
+func newConfigCmd(configPath *string) *cobra.Command {
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print-effective",
+		Short: "Print the merged configuration with secrets masked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := config.Load(*configPath, cmd.Flags())
+			if err == nil {
+				err = layers.PrintEffective(os.Stdout, cfg, format)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", "yaml", "output format: yaml or json")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(printCmd)
+	return configCmd
+}
+
+// newMetricsCmd creates the metrics command. metrics export-dashboards
+// generates a Grafana dashboard and Prometheus rules from the metrics this
+// binary registers, adding those only a running NLB exposes when --from
+// points at its metrics endpoint.
+func newMetricsCmd() *cobra.Command {
+	var outputDir, from string
+	exportCmd := &cobra.Command{
+		Use:   "export-dashboards",
+		Short: "Generate a Grafana dashboard and Prometheus rules from the registered metrics",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := exportDashboards(outputDir, from); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "o", ".", "directory to write the dashboard and rules to")
+	exportCmd.Flags().StringVar(&from, "from", "", "metrics endpoint of a running NLB to read as well")
+
+	metricsCmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Inspect the registered metrics",
+	}
+	metricsCmd.AddCommand(exportCmd)
+	return metricsCmd
+}
+
+// exportDashboards writes the dashboard and rules generated from the
+// registered metrics, merged with those scraped from a running NLB
+func exportDashboards(outputDir, from string) error {
+	metrics, err := dashgen.FromDefaultRegistry()
+	if err != nil {
+		return err
+	}
+	if from != "" {
+		scraped, err := dashgen.Scrape(from)
+		if err != nil {
+			return err
+		}
+		metrics = dashgen.Merge(scraped, metrics)
+	}
+	files, err := dashgen.Write(outputDir, "nlb", metrics)
+	for _, file := range files {
+		fmt.Printf("Wrote %s\n", file)
+	}
+	return err
+}
+
+// checkConfig loads the configuration for --validate-config and returns
+// the exit status, printing every problem found
+func checkConfig(configPath string, flags *pflag.FlagSet) int {
+	if _, err := config.Load(configPath, flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+func runNLB(configPath string, flags *pflag.FlagSet, logger *logrus.Logger) error {
 	logger.WithFields(logrus.Fields{
 		"version":    version,
 		"build_time": buildTime,
@@ -61,15 +171,270 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 	}).Info("Starting MarchProxy Network Load Balancer")
 
 	// Load configuration
-	cfg, err := config.Load(configPath)
+	cfg, err := config.Load(configPath, flags)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	// /readyz stays unavailable until the config is loaded and every
+	// listener is bound
+	ready := readiness.New(readiness.StepConfig, readiness.StepListeners)
+	ready.Done(readiness.StepConfig)
+
+	// Gate enterprise features on the cluster's entitlements
+	licenseCtx, licenseCancel := context.WithCancel(context.Background())
+	defer licenseCancel()
+	license := cfg.NewLicenseGate(logger)
+	license.Refresh(licenseCtx)
+	go license.Run(licenseCtx)
+
+	// Register protocol plugins before any module or route names them
+	if err := nlb.LoadPlugins(cfg.Plugins, logger); err != nil {
+		return fmt.Errorf("failed to load protocol plugins: %w", err)
+	}
+
+	// Take over the listeners of the NLB this binary replaces, if one is
+	// running, before opening any
+	var handover *netutil.Handover
+	if cfg.UpgradeSocket != "" {
+		handover, err = netutil.StartHandover(cfg.UpgradeSocket, cfg.UpgradeTimeout, logger.Infof)
+		if err != nil {
+			return fmt.Errorf("failed to start listener handover: %w", err)
+		}
+		defer handover.Close()
+		logger.WithFields(logrus.Fields{
+			"socket":    cfg.UpgradeSocket,
+			"inherited": handover.Inherited(),
+		}).Info("Listener handover enabled")
+	}
+
 	// Initialize router
 	router := nlb.NewRouter(logger)
 	logger.Info("Traffic router initialized")
 
+	// Apply TCP socket tuning per protocol route
+	if err := router.SetDefaultSocketOptions(cfg.SocketOptions.TCPOptions()); err != nil {
+		logger.WithError(err).Warn("Failed to set default socket options")
+	}
+	for _, route := range cfg.RouteSocketOptions {
+		protocol := parseProtocol(route.Protocol)
+		if err := router.SetSocketOptions(protocol, cfg.RouteTCPOptions(route.Protocol)); err != nil {
+			logger.WithError(err).WithField("protocol", route.Protocol).Warn("Failed to set route socket options")
+		}
+	}
+
+	// Eject modules that keep failing live traffic until their ejection ends
+	if err := router.SetOutlierDetection(nlb.OutlierConfig{
+		FailureThreshold: cfg.PassiveHealth.FailureThreshold,
+		Window:           cfg.PassiveHealth.Window,
+		EjectionTime:     cfg.PassiveHealth.EjectionTime,
+	}); err != nil {
+		logger.WithError(err).Warn("Failed to set passive health checks")
+	}
+
+	// Ramp up the share of modules that were just added or recovered
+	if err := router.SetSlowStart(nlb.SlowStartConfig{
+		Window:    cfg.SlowStart.Window,
+		Curve:     cfg.SlowStart.Curve,
+		MinWeight: cfg.SlowStart.MinWeight,
+	}); err != nil {
+		logger.WithError(err).Warn("Failed to set slow-start")
+	}
+
+	// Backends drained for maintenance get no new connections while their
+	// open ones finish, drained by the manager or the admin API
+	drains := drain.NewSet("nlb")
+	router.SetDrains(drains)
+	prometheus.MustRegister(drains.Collector(router.DrainingConns))
+	drainCtx, drainCancel := context.WithCancel(context.Background())
+	defer drainCancel()
+	if fetch := cfg.NewDrainFetcher(); fetch != nil {
+		go drains.Poll(drainCtx, cfg.DrainPollInterval, fetch, func(err error) {
+			logger.WithError(err).Warn("Failed to fetch backend drains")
+		})
+	}
+
+	// Standalone mode has no manager to announce modules, so route to the
+	// ones listed in the config
+	for _, module := range cfg.StaticModules {
+		weight := module.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		maxConns := module.MaxConns
+		if maxConns == 0 {
+			maxConns = cfg.MaxConnectionsPerModule
+		}
+		if err := router.RegisterModule(&nlb.ModuleEndpoint{
+			Name:        module.Name,
+			Protocol:    parseProtocol(module.Protocol),
+			Address:     module.Address,
+			GRPCPort:    module.GRPCPort,
+			Healthy:     true,
+			MaxConns:    maxConns,
+			Version:     module.Version,
+			Weight:      weight,
+			Zone:        module.Zone,
+			Region:      module.Region,
+			LastHealthy: time.Now(),
+		}); err != nil {
+			return fmt.Errorf("failed to register static module %s: %w", module.Name, err)
+		}
+	}
+	if cfg.Standalone {
+		logger.WithField("modules", len(cfg.StaticModules)).Info("Running standalone without a manager")
+	}
+
+	// Prefer modules in the NLB's own zone, then its region
+	if err := router.SetLocality(nlb.LocalityPolicy{
+		Zone:      cfg.Locality.Zone,
+		Region:    cfg.Locality.Region,
+		Spillover: cfg.Locality.Spillover,
+	}); err != nil {
+		return fmt.Errorf("invalid locality: %w", err)
+	}
+	if cfg.Locality.Zone != "" || cfg.Locality.Region != "" {
+		logger.WithFields(logrus.Fields{
+			"zone":      cfg.Locality.Zone,
+			"region":    cfg.Locality.Region,
+			"spillover": cfg.Locality.Spillover,
+		}).Info("Locality-aware routing enabled")
+	}
+
+	// Block and route clients by the country of their address
+	if cfg.GeoIP.Database != "" {
+		geo, err := geoip.Open(cfg.GeoIP.Database)
+		if err != nil {
+			return fmt.Errorf("failed to load GeoIP database: %w", err)
+		}
+		policy := nlb.GeoPolicy{BlockCountries: cfg.GeoIP.BlockCountries}
+		for _, route := range cfg.GeoIP.Routes {
+			policy.Routes = append(policy.Routes, nlb.GeoRoute{
+				Countries: route.Countries,
+				Modules:   route.Modules,
+				Strict:    route.Strict,
+			})
+		}
+		router.SetGeoIP(geo, policy)
+		logger.WithFields(logrus.Fields{
+			"database":          geo.Metadata.DatabaseType,
+			"blocked_countries": len(policy.BlockCountries),
+			"routes":            len(policy.Routes),
+		}).Info("GeoIP routing enabled")
+	}
+
+	// Elect a leader among the NLB replicas for singleton tasks and share
+	// rate-limit consumption between them through the manager
+	var elector *coordination.Elector
+	var counters *coordination.Counters
+	coordCtx, coordCancel := context.WithCancel(context.Background())
+	defer coordCancel()
+	coordDone := make(chan struct{})
+	if backend := cfg.NewCoordinationBackend(); backend != nil {
+		elector = coordination.NewElector(backend, "nlb/leader", cfg.Coordination.LeaseTTL, logger)
+		counters = coordination.NewCounters(backend, logger)
+		go func() {
+			defer close(coordDone)
+			elector.Run(coordCtx)
+		}()
+		logger.WithFields(logrus.Fields{
+			"lease_ttl":         cfg.Coordination.LeaseTTL,
+			"share_rate_limits": cfg.Coordination.ShareRateLimits,
+		}).Info("Replica coordination started")
+	}
+
+	// Announce the service VIPs over BGP while modules are healthy and the
+	// instance is not draining, so routers only send traffic to live nodes.
+	// With leader_only only the elected replica announces.
+	var speaker *bgp.Speaker
+	var draining atomic.Bool
+	bgpCtx, bgpCancel := context.WithCancel(context.Background())
+	defer bgpCancel()
+	bgpDone := make(chan struct{})
+	if cfg.BGP.Enabled {
+		speakerConfig, err := cfg.BGP.SpeakerConfig()
+		if err != nil {
+			return fmt.Errorf("invalid BGP configuration: %w", err)
+		}
+		speaker, err = bgp.NewSpeaker(speakerConfig, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create BGP speaker: %w", err)
+		}
+		go func() {
+			defer close(bgpDone)
+			speaker.Run(bgpCtx)
+		}()
+		go speaker.Follow(bgpCtx, cfg.BGP.CheckInterval, func() bool {
+			return !draining.Load() && router.HasHealthyModules() &&
+				(!cfg.BGP.LeaderOnly || elector.IsLeader())
+		})
+		logger.WithFields(logrus.Fields{
+			"local_as":    cfg.BGP.LocalAS,
+			"peers":       len(cfg.BGP.Peers),
+			"vips":        cfg.BGP.VIPs,
+			"leader_only": cfg.BGP.LeaderOnly,
+		}).Info("BGP speaker started")
+	}
+
+	// Hold the floating VIP while this instance wins the VRRP election,
+	// with module health and drains lowering its priority
+	var vrrpInstance *vrrp.Instance
+	vrrpCtx, vrrpCancel := context.WithCancel(context.Background())
+	defer vrrpCancel()
+	vrrpDone := make(chan struct{})
+	if cfg.VRRP.Enabled {
+		instanceConfig, err := cfg.VRRP.InstanceConfig()
+		if err != nil {
+			return fmt.Errorf("invalid VRRP configuration: %w", err)
+		}
+		vrrpInstance, err = vrrp.NewInstance(instanceConfig, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create VRRP instance: %w", err)
+		}
+		go func() {
+			defer close(vrrpDone)
+			if err := vrrpInstance.Run(vrrpCtx); err != nil {
+				logger.WithError(err).Error("VRRP stopped")
+			}
+		}()
+		go vrrpInstance.Follow(vrrpCtx, cfg.VRRP.CheckInterval, func() bool {
+			return !draining.Load() && router.HasHealthyModules()
+		})
+		logger.WithFields(logrus.Fields{
+			"interface": cfg.VRRP.Interface,
+			"vrid":      cfg.VRRP.VirtualRouterID,
+			"priority":  cfg.VRRP.Priority,
+			"vips":      cfg.VRRP.VIPs,
+		}).Info("VRRP started")
+	}
+
+	// Balance gRPC streams, rather than connections, across backends that
+	// pass their gRPC health checks
+	var grpcBalancer *nlb.GRPCBalancer
+	grpcLBCtx, grpcLBCancel := context.WithCancel(context.Background())
+	defer grpcLBCancel()
+	if cfg.GRPCBalancer.Enabled {
+		grpcBalancer, err = nlb.NewGRPCBalancer(cfg.GRPCBalancer.BalancerConfig(), logger)
+		if err != nil {
+			return fmt.Errorf("invalid gRPC balancer configuration: %w", err)
+		}
+		addr := cfg.GRPCBalancerAddress()
+		listener, err := netutil.Listen("tcp", addr, cfg.BindInterface)
+		if err != nil {
+			return fmt.Errorf("failed to listen for gRPC balancing on %s: %w", addr, err)
+		}
+		go grpcBalancer.RunHealthChecks(grpcLBCtx)
+		go func() {
+			if err := grpcBalancer.Serve(grpcLBCtx, listener); err != nil {
+				logger.WithError(err).Error("gRPC balancer error")
+			}
+		}()
+		logger.WithFields(logrus.Fields{
+			"address":  addr,
+			"backends": len(cfg.GRPCBalancer.Backends),
+		}).Info("gRPC balancer started")
+	}
+
 	// Initialize rate limiter
 	var rateLimiter *nlb.RateLimiter
 	if cfg.EnableRateLimiting {
@@ -83,6 +448,11 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 			}
 		}
 
+		// Enforce the buckets across replicas
+		if counters != nil && cfg.Coordination.ShareRateLimits {
+			go rateLimiter.Share(coordCtx, counters, cfg.Coordination.SyncInterval)
+		}
+
 		logger.Info("Rate limiter initialized")
 	}
 
@@ -99,6 +469,7 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 			nlb.ProtocolMongoDB,
 			nlb.ProtocolRedis,
 			nlb.ProtocolRTMP,
+			nlb.ProtocolKafka,
 		}
 
 		for _, protocol := range protocols {
@@ -110,6 +481,11 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 			}
 		}
 
+		// Replicas share the modules, so only the leader scales them
+		if elector != nil {
+			autoscaler.SetLeader(elector.IsLeader)
+		}
+
 		if err := autoscaler.Start(); err != nil {
 			logger.WithError(err).Warn("Failed to start autoscaler")
 		} else {
@@ -126,14 +502,40 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 
 	// Initialize gRPC client pool
 	var clientPool *grpc.ClientPool
+	meshCtx, meshCancel := context.WithCancel(context.Background())
+	defer meshCancel()
 	if cfg.EnableConnectionPooling {
-		clientPool = grpc.NewClientPool(logger)
-		logger.Info("gRPC client pool initialized")
+		meshOptions, err := cfg.Mesh.MeshOptions()
+		if err != nil {
+			return fmt.Errorf("invalid mesh configuration: %w", err)
+		}
+		clientPool = grpc.NewMeshPool(meshOptions, logger)
+
+		// Route detected protocols to the modules owning them, static ones
+		// and those the manager knows of
+		mesh := nlb.NewMesh(router, clientPool, cfg.MaxConnectionsPerModule, logger)
+		for _, modules := range router.GetAllModules() {
+			for _, module := range modules {
+				mesh.AddStatic(module)
+			}
+		}
+		if discovery := cfg.NewModuleDiscovery(); discovery != nil {
+			go mesh.RunDiscovery(meshCtx, cfg.Mesh.DiscoveryInterval, discovery.Discover)
+		}
+		go mesh.RunHealthChecks(meshCtx, cfg.ModuleHealthCheckInterval, cfg.ModuleHealthCheckInterval/2)
+		logger.WithFields(logrus.Fields{
+			"mtls":               meshOptions.TLS != nil,
+			"discovery_interval": cfg.Mesh.DiscoveryInterval,
+		}).Info("gRPC module mesh initialized")
 	}
 
 	// Initialize gRPC server
 	mockService := grpc.NewMockNLBService(logger)
 	grpcServer := grpc.NewServer(cfg.GRPCAddr, cfg.GRPCPort, mockService, logger)
+	grpcServer.SetBindInterface(cfg.BindInterface)
+	if err := grpcServer.Listen(); err != nil {
+		return err
+	}
 
 	// Start gRPC server in goroutine
 	go func() {
@@ -143,13 +545,17 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 	}()
 
 	logger.WithFields(logrus.Fields{
-		"address": cfg.GRPCAddr,
-		"port":    cfg.GRPCPort,
+		"address":   cfg.GRPCAddr,
+		"port":      cfg.GRPCPort,
+		"interface": cfg.BindInterface,
 	}).Info("gRPC server started")
 
-	// Setup signal handling
+	// Setup signal handling. SIGUSR2 starts a hitless upgrade.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if handover != nil {
+		signal.Notify(sigChan, syscall.SIGUSR2)
+	}
 
 	// Start metrics/health server
 	metricsMux := http.NewServeMux()
@@ -159,7 +565,36 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 		w.Write([]byte("OK"))
 	})
 
-	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Readiness for rollouts and load balancers, unavailable while draining
+	metricsMux.Handle("/readyz", ready)
+
+	metricsMux.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true, // required to expose latency exemplars
+	}))
+
+	// Drain withdraws the BGP announcement and gives up the VRRP VIP so
+	// traffic moves to other instances, e.g. before maintenance
+	metricsMux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			draining.Store(true)
+			ready.SetUnready("draining")
+			logger.Info("Draining, VIPs will be released")
+		case http.MethodDelete:
+			draining.Store(false)
+			ready.SetUnready("")
+			logger.Info("Drain cleared")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"draining":%t}`, draining.Load())
+	})
+
+	// Drain single modules' backends, leaving the instance in service
+	metricsMux.HandleFunc("/admin/backends/drain", drains.Handler(router.DrainingConns))
 
 	metricsMux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		status := map[string]interface{}{
@@ -169,12 +604,27 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 			"autoscaling":        cfg.EnableAutoscaling,
 			"bluegreen":          cfg.EnableBlueGreen,
 			"connection_pooling": cfg.EnableConnectionPooling,
+			"license":            license.Status(),
 		}
 
 		if router != nil {
 			status["router_stats"] = router.GetStats()
 		}
 
+		status["draining"] = draining.Load()
+		if speaker != nil {
+			status["bgp_peers"] = speaker.Status()
+		}
+		if vrrpInstance != nil {
+			status["vrrp"] = vrrpInstance.Status()
+		}
+		if elector != nil {
+			status["coordination"] = elector.Status()
+		}
+		if grpcBalancer != nil {
+			status["grpc_backends"] = grpcBalancer.Stats()
+		}
+
 		if rateLimiter != nil {
 			status["ratelimit_stats"] = rateLimiter.GetAllStats()
 		}
@@ -197,22 +647,91 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 	})
 
 	metricsServer := &http.Server{
-		Addr:    cfg.MetricsAddr,
-		Handler: metricsMux,
+		Handler: adminserver.Guard(cfg.Admin, metricsMux),
+	}
+
+	metricsAddr := cfg.Admin.Address(cfg.MetricsAddr)
+	metricsListener, err := adminserver.ListenWith(cfg.Admin, cfg.MetricsAddr, func(network, address string) (net.Listener, error) {
+		return netutil.Listen(network, address, "")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %w", metricsAddr, err)
+	}
+	if warning := adminserver.Warning(cfg.Admin, metricsAddr); warning != "" {
+		logger.Warn(warning)
 	}
 
 	go func() {
-		logger.WithField("addr", cfg.MetricsAddr).Info("Starting metrics/health server")
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithField("addr", metricsAddr).Info("Starting metrics/health server")
+		if err := metricsServer.Serve(metricsListener); err != nil && err != http.ErrServerClosed {
 			logger.WithError(err).Error("Metrics server error")
 		}
 	}()
 
+	// Every listener is open, so the NLB is ready and the one being replaced
+	// can stop accepting
+	ready.Done(readiness.StepListeners)
+	var upgraded <-chan struct{}
+	if handover != nil {
+		if err := handover.Ready(); err != nil {
+			logger.WithError(err).Warn("Listener handover incomplete")
+		}
+		upgraded = handover.Done()
+	}
+
 	logger.Info("MarchProxy NLB started successfully")
 
-	// Wait for shutdown signal
-	<-sigChan
+	// Wait for shutdown signal, or for a new binary to take over
+	tookOver := false
+	for running := true; running; {
+		select {
+		case sig := <-sigChan:
+			if sig != syscall.SIGUSR2 {
+				running = false
+				break
+			}
+			logger.Info("Upgrading, starting the new binary")
+			go func() {
+				if err := handover.Upgrade(); err != nil {
+					logger.WithError(err).Error("Upgrade failed, still serving")
+				}
+			}()
+		case <-upgraded:
+			tookOver = true
+			running = false
+		}
+	}
+	if tookOver {
+		logger.Info("New process took over the listeners, draining")
+	}
 	logger.Info("Shutting down...")
+	ready.SetUnready("shutting down")
+
+	// Hand the floating VIP to the backup right away
+	if vrrpInstance != nil {
+		vrrpCancel()
+		<-vrrpDone
+	}
+
+	// Withdraw the VIPs and give peers time to move traffic elsewhere
+	// before closing anything
+	if speaker != nil {
+		draining.Store(true)
+		speaker.SetAnnounced(false)
+		// After an upgrade the new process already serves the listeners
+		if !tookOver {
+			logger.WithField("drain_time", cfg.BGP.DrainTime).Info("BGP announcement withdrawn, draining")
+			time.Sleep(cfg.BGP.DrainTime)
+		}
+		bgpCancel()
+		<-bgpDone
+	}
+
+	// Hand leadership to another replica right away
+	if elector != nil {
+		coordCancel()
+		<-coordDone
+	}
 
 	// Graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -222,6 +741,8 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 		logger.WithError(err).Error("Metrics server shutdown error")
 	}
 
+	grpcLBCancel()
+
 	if grpcServer != nil {
 		if err := grpcServer.Stop(); err != nil {
 			logger.WithError(err).Error("gRPC server shutdown error")
@@ -236,6 +757,7 @@ func runNLB(configPath string, logger *logrus.Logger) error {
 		blueGreenController.Stop()
 	}
 
+	meshCancel()
 	if clientPool != nil {
 		if err := clientPool.Close(); err != nil {
 			logger.WithError(err).Error("Client pool shutdown error")
@@ -261,7 +783,9 @@ func parseProtocol(protocolStr string) nlb.Protocol {
 		return nlb.ProtocolRedis
 	case "rtmp", "RTMP":
 		return nlb.ProtocolRTMP
+	case "kafka", "Kafka":
+		return nlb.ProtocolKafka
 	default:
-		return nlb.ProtocolUnknown
+		return nlb.PluginProtocol(protocolStr)
 	}
 }
@@ -0,0 +1,13 @@
+// Command so exports the STOMP example as a shared-object plugin:
+//
+//	go build -buildmode=plugin -o stomp.so ./examples/plugins/stomp/so
+package main
+
+import (
+	"marchproxy-nlb/examples/plugins/stomp"
+)
+
+// MarchProxyPlugin is the symbol the NLB looks up
+var MarchProxyPlugin = stomp.Plugin
+
+func main() {}
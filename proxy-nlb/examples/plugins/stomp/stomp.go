@@ -0,0 +1,81 @@
+// Package stomp is an example NLB protocol plugin. It detects STOMP clients
+// and keeps each virtual host on its own modules: a client connecting with
+// host:orders goes to modules named orders-*, and other clients are
+// balanced across all STOMP modules.
+//
+// Compile it into a custom NLB with nlbplugin.Register(stomp.Plugin), or
+// build the so directory with -buildmode=plugin and list the result under
+// plugins.
+package stomp
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"marchproxy-nlb/pkg/nlbplugin"
+)
+
+// Plugin is the STOMP protocol plugin
+var Plugin = &nlbplugin.Plugin{
+	APIVersion: nlbplugin.APIVersion,
+	Name:       "stomp",
+	MinBytes:   6,
+	Detector:   detector{},
+	Handler:    handler{},
+}
+
+// connectCommands open every STOMP session
+var connectCommands = [][]byte{[]byte("CONNECT"), []byte("STOMP")}
+
+type detector struct{}
+
+// Detect matches a CONNECT or STOMP frame, after any heart-beat newlines
+func (detector) Detect(data []byte) bool {
+	data = bytes.TrimLeft(data, "\r\n")
+	for _, command := range connectCommands {
+		rest, ok := bytes.CutPrefix(data, command)
+		if ok && len(rest) > 0 && (rest[0] == '\n' || rest[0] == '\r') {
+			return true
+		}
+	}
+	return false
+}
+
+type handler struct{}
+
+// SelectModule picks the least loaded module of the client's virtual host
+func (handler) SelectModule(ctx context.Context, conn nlbplugin.Connection, modules []nlbplugin.Module) (string, error) {
+	host := virtualHost(conn.Data)
+	if host == "" {
+		return "", nil
+	}
+
+	selected := ""
+	fewest := 0
+	for _, m := range modules {
+		if !strings.HasPrefix(m.Name, host+"-") {
+			continue
+		}
+		if selected == "" || m.ActiveConns < fewest {
+			selected, fewest = m.Name, m.ActiveConns
+		}
+	}
+	return selected, nil
+}
+
+// virtualHost returns the host header of the CONNECT frame, as far as the
+// first bytes of the connection hold it
+func virtualHost(data []byte) string {
+	lines := strings.Split(strings.TrimLeft(string(data), "\r\n"), "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break // end of headers
+		}
+		if value, ok := strings.CutPrefix(line, "host:"); ok {
+			return value
+		}
+	}
+	return ""
+}
@@ -1,32 +1,88 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"time"
 
-	"github.com/spf13/viper"
+	modgrpc "marchproxy-nlb/internal/grpc"
+	"marchproxy-nlb/internal/nlb"
+	"marchproxy-nlb/internal/vrrp"
+	"marchproxy-shared/adminserver"
+	"marchproxy-shared/bgp"
+	"marchproxy-shared/coordination"
+	"marchproxy-shared/drain"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/licensing"
+	"marchproxy-shared/netutil"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
 // Config holds the NLB configuration
 type Config struct {
 	// Server settings
 	BindAddr        string `mapstructure:"bind_addr"`
+	BindInterface   string `mapstructure:"bind_interface"` // Interface or VRF device for listeners (Linux only)
 	GRPCAddr        string `mapstructure:"grpc_addr"`
 	GRPCPort        int    `mapstructure:"grpc_port"`
 	MetricsAddr     string `mapstructure:"metrics_addr"`
 
+	// Metrics server authentication, TLS and binding
+	Admin adminserver.Config `mapstructure:"admin"`
+
+	// Hitless upgrades hand the listeners to a new binary over this Unix
+	// socket. Empty disables them.
+	UpgradeSocket  string        `mapstructure:"upgrade_socket"`
+	UpgradeTimeout time.Duration `mapstructure:"upgrade_timeout"`
+
 	// Manager connection
 	ManagerURL      string `mapstructure:"manager_url"`
 	ClusterAPIKey   string `mapstructure:"cluster_api_key"`
 	RegistrationURL string `mapstructure:"registration_url"`
 
+	// Standalone mode runs without a manager, routing to StaticModules
+	Standalone    bool                 `mapstructure:"standalone"`
+	StaticModules []StaticModuleConfig `mapstructure:"static_modules"`
+
 	// Traffic management
 	EnableRateLimiting bool              `mapstructure:"enable_rate_limiting"`
 	DefaultRateLimit   float64           `mapstructure:"default_rate_limit"`
 	DefaultBurstSize   float64           `mapstructure:"default_burst_size"`
 	RateLimitBuckets   []RateLimitConfig `mapstructure:"rate_limit_buckets"`
 
+	// TCP socket tuning for routed connections
+	SocketOptions      SocketConfig        `mapstructure:"socket_options"`
+	RouteSocketOptions []RouteSocketConfig `mapstructure:"route_socket_options"`
+
+	// Client country blocking and routing
+	GeoIP GeoIPConfig `mapstructure:"geoip"`
+
+	// Same-zone module preference
+	Locality LocalityConfig `mapstructure:"locality"`
+
+	// Anycast VIP announcements
+	BGP BGPConfig `mapstructure:"bgp"`
+
+	// Floating VIP failover between an on-prem pair
+	VRRP VRRPConfig `mapstructure:"vrrp"`
+
+	// Leader election and shared state between NLB replicas
+	Coordination CoordinationConfig `mapstructure:"coordination"`
+
+	// Protocol plugins built with -buildmode=plugin, see pkg/nlbplugin
+	Plugins []string `mapstructure:"plugins"`
+
+	// Per-stream gRPC load balancing
+	GRPCBalancer GRPCBalancerConfig `mapstructure:"grpc_balancer"`
+
+	// gRPC mesh to the ALB, DBLB and RTMP modules owning routed protocols
+	Mesh MeshConfig `mapstructure:"mesh"`
+
 	// Autoscaling
 	EnableAutoscaling      bool          `mapstructure:"enable_autoscaling"`
 	AutoscaleInterval      time.Duration `mapstructure:"autoscale_interval"`
@@ -41,6 +97,9 @@ type Config struct {
 	// Module management
 	MaxModulesPerProtocol  int           `mapstructure:"max_modules_per_protocol"`
 	ModuleHealthCheckInterval time.Duration `mapstructure:"module_health_check_interval"`
+	PassiveHealth             PassiveHealthConfig `mapstructure:"passive_health"`
+	SlowStart                 SlowStartConfig     `mapstructure:"slow_start"`
+	DrainPollInterval         time.Duration       `mapstructure:"drain_poll_interval"` // 0 ignores backend drains from the manager
 
 	// Observability
 	EnableTracing       bool   `mapstructure:"enable_tracing"`
@@ -53,6 +112,11 @@ type Config struct {
 	LicenseServer   string `mapstructure:"license_server"`
 	ReleaseMode     bool   `mapstructure:"release_mode"`
 
+	// Enterprise feature entitlements fetched from the manager in release mode
+	LicenseRefreshInterval time.Duration `mapstructure:"license_refresh_interval"`
+	LicenseGracePeriod     time.Duration `mapstructure:"license_grace_period"` // cached entitlements outlive an unreachable manager this long
+	LicenseCacheFile       string        `mapstructure:"license_cache_file"`   // keep entitlements here across restarts
+
 	// Advanced features
 	EnableConnectionPooling bool `mapstructure:"enable_connection_pooling"`
 	MaxConnectionsPerModule int  `mapstructure:"max_connections_per_module"`
@@ -66,64 +130,452 @@ type RateLimitConfig struct {
 	RefillRate float64 `mapstructure:"refill_rate"`
 }
 
-// Load loads configuration from file and environment variables
-func Load(configPath string) (*Config, error) {
+// StaticModuleConfig is a module endpoint registered at startup instead of
+// being discovered through the manager
+type StaticModuleConfig struct {
+	Name     string `mapstructure:"name"`
+	Protocol string `mapstructure:"protocol"`
+	Address  string `mapstructure:"address"`
+	GRPCPort int    `mapstructure:"grpc_port"`
+	MaxConns int    `mapstructure:"max_conns"`
+	Weight   int    `mapstructure:"weight"`
+	Version  string `mapstructure:"version"`
+	Zone     string `mapstructure:"zone"`
+	Region   string `mapstructure:"region"`
+}
+
+// SocketConfig tunes TCP sockets for routed connections. Zero values keep
+// the kernel defaults.
+type SocketConfig struct {
+	NoDelay           *bool         `mapstructure:"tcp_nodelay"`
+	KeepAlive         time.Duration `mapstructure:"keepalive"` // Idle time before probing, negative disables
+	KeepAliveInterval time.Duration `mapstructure:"keepalive_interval"`
+	KeepAliveCount    int           `mapstructure:"keepalive_count"`
+	SendBuffer        int           `mapstructure:"send_buffer"`
+	RecvBuffer        int           `mapstructure:"recv_buffer"`
+	UserTimeout       time.Duration `mapstructure:"user_timeout"` // TCP_USER_TIMEOUT (Linux only)
+}
+
+// PassiveHealthConfig ejects modules that keep failing live traffic
+type PassiveHealthConfig struct {
+	FailureThreshold int           `mapstructure:"failure_threshold"` // Failures within Window that eject a module, 0 disables
+	Window           time.Duration `mapstructure:"window"`
+	EjectionTime     time.Duration `mapstructure:"ejection_time"`
+}
+
+// GeoIPConfig blocks and routes clients by the country of their address
+type GeoIPConfig struct {
+	Database       string           `mapstructure:"database"`        // MaxMind DB (mmdb) file, empty disables lookups
+	BlockCountries []string         `mapstructure:"block_countries"` // ISO 3166-1 codes dropped at the NLB
+	Routes         []GeoRouteConfig `mapstructure:"routes"`
+}
+
+// GeoRouteConfig sends clients from a set of countries to specific modules
+type GeoRouteConfig struct {
+	Countries []string `mapstructure:"countries"`
+	Modules   []string `mapstructure:"modules"`
+	Strict    bool     `mapstructure:"strict"` // Refuse clients instead of falling back to other modules
+}
+
+// SlowStartConfig ramps up the traffic share of new and recovered modules
+type SlowStartConfig struct {
+	Window    time.Duration `mapstructure:"window"`     // Ramp duration, 0 disables slow-start
+	Curve     string        `mapstructure:"curve"`      // linear or exponential
+	MinWeight float64       `mapstructure:"min_weight"` // Share of its weight a module starts at
+}
+
+// LocalityConfig places the NLB in a zone and region, preferring modules
+// in the same zone, then the same region, to cut cross-zone traffic
+type LocalityConfig struct {
+	Zone      string  `mapstructure:"zone"`
+	Region    string  `mapstructure:"region"`
+	Spillover float64 `mapstructure:"spillover"` // Share of connections sent on to the next locality, 0 to 1
+}
+
+// BGPConfig announces the service VIPs to upstream routers while this
+// instance has healthy modules and is not draining
+type BGPConfig struct {
+	Enabled       bool            `mapstructure:"enabled"`
+	LocalAS       uint32          `mapstructure:"local_as"`
+	RouterID      string          `mapstructure:"router_id"`
+	Peers         []BGPPeerConfig `mapstructure:"peers"`
+	VIPs          []string        `mapstructure:"vips"`          // Addresses or prefixes, bare addresses become /32 or /128
+	NextHop       string          `mapstructure:"next_hop"`      // Defaults to the session's local address
+	NextHopIPv6   string          `mapstructure:"next_hop_ipv6"` // Required for IPv6 VIPs over IPv4 sessions
+	Communities   []string        `mapstructure:"communities"`   // ASN:value
+	HoldTime      time.Duration   `mapstructure:"hold_time"`
+	ConnectRetry  time.Duration   `mapstructure:"connect_retry"`
+	CheckInterval time.Duration   `mapstructure:"check_interval"` // How often local health gates the announcement
+	DrainTime     time.Duration   `mapstructure:"drain_time"`     // Wait after withdrawing before shutting down
+	LeaderOnly    bool            `mapstructure:"leader_only"`    // Only the elected replica announces, for active/standby instead of anycast
+}
+
+// BGPPeerConfig is an upstream router
+type BGPPeerConfig struct {
+	Address string `mapstructure:"address"`
+	Port    int    `mapstructure:"port"`
+	AS      uint32 `mapstructure:"as"`
+}
+
+// SpeakerConfig converts the BGP settings to speaker settings
+func (b BGPConfig) SpeakerConfig() (bgp.Config, error) {
+	cfg := bgp.Config{
+		LocalAS:      b.LocalAS,
+		HoldTime:     b.HoldTime,
+		ConnectRetry: b.ConnectRetry,
+		MetricPrefix: "nlb",
+	}
+
+	var err error
+	if cfg.RouterID, err = netip.ParseAddr(b.RouterID); err != nil {
+		return cfg, fmt.Errorf("invalid router_id: %w", err)
+	}
+	for _, peer := range b.Peers {
+		addr, err := netip.ParseAddr(peer.Address)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid peer address: %w", err)
+		}
+		cfg.Peers = append(cfg.Peers, bgp.Peer{Address: addr, Port: peer.Port, AS: peer.AS})
+	}
+	for _, vip := range b.VIPs {
+		prefix, err := netip.ParsePrefix(vip)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(vip)
+			if addrErr != nil {
+				return cfg, fmt.Errorf("invalid vip %q: %w", vip, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.Prefixes = append(cfg.Prefixes, prefix)
+	}
+	if b.NextHop != "" {
+		if cfg.NextHop, err = netip.ParseAddr(b.NextHop); err != nil {
+			return cfg, fmt.Errorf("invalid next_hop: %w", err)
+		}
+	}
+	if b.NextHopIPv6 != "" {
+		if cfg.NextHopIPv6, err = netip.ParseAddr(b.NextHopIPv6); err != nil {
+			return cfg, fmt.Errorf("invalid next_hop_ipv6: %w", err)
+		}
+	}
+	for _, community := range b.Communities {
+		value, err := bgp.ParseCommunity(community)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Communities = append(cfg.Communities, value)
+	}
+	return cfg, cfg.Validate()
+}
+
+// CoordinationConfig elects a leader among NLB replicas through manager
+// leases for singleton tasks, and shares rate-limit consumption between them
+type CoordinationConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	LeaseTTL        time.Duration `mapstructure:"lease_ttl"`         // A failed leader is replaced within this long
+	SyncInterval    time.Duration `mapstructure:"sync_interval"`     // How often shared counters are exchanged
+	ShareRateLimits bool          `mapstructure:"share_rate_limits"` // Enforce rate-limit buckets across replicas
+}
+
+// GRPCBalancerConfig balances gRPC streams across backends on a listener
+// of its own
+type GRPCBalancerConfig struct {
+	Enabled        bool                `mapstructure:"enabled"`
+	ListenPort     int                 `mapstructure:"listen_port"` // On the bind_addr host
+	Backends       []GRPCBackendConfig `mapstructure:"backends"`
+	MaxStreams     int                 `mapstructure:"max_streams"`     // Open streams per backend, 0 for no limit
+	HealthService  string              `mapstructure:"health_service"`  // grpc.health.v1 service checked, empty for the whole server
+	HealthInterval time.Duration       `mapstructure:"health_interval"` // 0 disables health checks
+	HealthTimeout  time.Duration       `mapstructure:"health_timeout"`
+}
+
+// GRPCBackendConfig is a gRPC server streams are balanced to
+type GRPCBackendConfig struct {
+	Name    string `mapstructure:"name"`
+	Address string `mapstructure:"address"` // host:port, plaintext HTTP/2
+}
+
+// BalancerConfig converts the gRPC balancer settings
+func (g GRPCBalancerConfig) BalancerConfig() nlb.GRPCBalancerConfig {
+	cfg := nlb.GRPCBalancerConfig{
+		HealthService:  g.HealthService,
+		HealthInterval: g.HealthInterval,
+		HealthTimeout:  g.HealthTimeout,
+		MaxStreams:     g.MaxStreams,
+	}
+	for _, backend := range g.Backends {
+		cfg.Backends = append(cfg.Backends, nlb.GRPCBackend{Name: backend.Name, Address: backend.Address})
+	}
+	return cfg
+}
+
+// MeshConfig connects the NLB to the modules it routes to over the module
+// gRPC channel, discovering them through the manager
+type MeshConfig struct {
+	DiscoveryInterval time.Duration `mapstructure:"discovery_interval"` // 0 disables discovery, leaving the static modules
+	TLSCert           string        `mapstructure:"tls_cert"`           // Client certificate for mutual TLS, empty for plaintext
+	TLSKey            string        `mapstructure:"tls_key"`
+	TLSCA             string        `mapstructure:"tls_ca"`          // CA that signed the module certificates
+	TLSServerName     string        `mapstructure:"tls_server_name"` // Name verified in module certificates, defaults to the address
+	Retries           int           `mapstructure:"retries"`         // Further modules tried after a failed call
+	RetryBackoff      time.Duration `mapstructure:"retry_backoff"`
+	BreakerThreshold  int           `mapstructure:"breaker_threshold"` // Consecutive failures opening a module's breaker, 0 disables
+	BreakerCooldown   time.Duration `mapstructure:"breaker_cooldown"`
+	MaxInFlight       int           `mapstructure:"max_in_flight"` // Calls in flight per module, 0 for no limit
+	MaxQueue          int           `mapstructure:"max_queue"`     // Calls waiting for a slot once every module is full, 0 sheds at once
+	QueueTimeout      time.Duration `mapstructure:"queue_timeout"`
+	ShedQueued        int           `mapstructure:"shed_queued"` // Shed calls to modules reporting this much queued work, 0 only at their limit
+}
+
+// MeshOptions converts the mesh settings, loading the TLS credentials
+func (m MeshConfig) MeshOptions() (modgrpc.MeshOptions, error) {
+	opts := modgrpc.MeshOptions{
+		Retries:          m.Retries,
+		RetryBackoff:     m.RetryBackoff,
+		BreakerThreshold: m.BreakerThreshold,
+		BreakerCooldown:  m.BreakerCooldown,
+		MaxInFlight:      m.MaxInFlight,
+		MaxQueue:         m.MaxQueue,
+		QueueTimeout:     m.QueueTimeout,
+		ShedQueued:       m.ShedQueued,
+	}
+	if m.TLSCert != "" {
+		tlsConfig, err := modgrpc.MeshTLSConfig(m.TLSCert, m.TLSKey, m.TLSCA, m.TLSServerName)
+		if err != nil {
+			return opts, err
+		}
+		opts.TLS = tlsConfig
+	}
+	return opts, nil
+}
+
+// NewModuleDiscovery creates the client discovering the modules the NLB
+// routes to through the manager. It returns nil in standalone mode or when
+// discovery is disabled.
+func (c *Config) NewModuleDiscovery() *modgrpc.ManagerDiscovery {
+	if c.Standalone || c.Mesh.DiscoveryInterval <= 0 {
+		return nil
+	}
+	proxyName, _ := os.Hostname()
+	return modgrpc.NewManagerDiscovery(c.ManagerURL, c.ClusterAPIKey, proxyName, nlb.MeshModuleTypes())
+}
+
+// GRPCBalancerAddress returns the gRPC balancer's listen address
+func (c *Config) GRPCBalancerAddress() string {
+	host, _, _ := net.SplitHostPort(c.BindAddr)
+	return netutil.JoinHostPort(host, c.GRPCBalancer.ListenPort)
+}
+
+// VRRPConfig moves a floating VIP between NLB instances with VRRP
+type VRRPConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	Interface       string        `mapstructure:"interface"`
+	VirtualRouterID uint8         `mapstructure:"virtual_router_id"`
+	Priority        uint8         `mapstructure:"priority"`
+	VIPs            []string      `mapstructure:"vips"` // IPv4 addresses with prefix length, bare addresses become /32
+	AdvertInterval  time.Duration `mapstructure:"advert_interval"`
+	Preempt         bool          `mapstructure:"preempt"`
+	PreemptDelay    time.Duration `mapstructure:"preempt_delay"`
+	HealthPenalty   uint8         `mapstructure:"health_penalty"` // Priority lost while unhealthy, 0 releases the VIPs instead
+	UnicastPeer     string        `mapstructure:"unicast_peer"`   // Peer address where multicast is not available
+	CheckInterval   time.Duration `mapstructure:"check_interval"` // How often module health is checked
+}
+
+// InstanceConfig converts the VRRP settings to virtual router settings
+func (v VRRPConfig) InstanceConfig() (vrrp.Config, error) {
+	cfg := vrrp.Config{
+		Interface:       v.Interface,
+		VirtualRouterID: v.VirtualRouterID,
+		Priority:        v.Priority,
+		AdvertInterval:  v.AdvertInterval,
+		Preempt:         v.Preempt,
+		PreemptDelay:    v.PreemptDelay,
+		HealthPenalty:   v.HealthPenalty,
+	}
+	for _, vip := range v.VIPs {
+		prefix, err := netip.ParsePrefix(vip)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(vip)
+			if addrErr != nil {
+				return cfg, fmt.Errorf("invalid vip %q: %w", vip, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.VIPs = append(cfg.VIPs, prefix)
+	}
+	if v.UnicastPeer != "" {
+		var err error
+		if cfg.UnicastPeer, err = netip.ParseAddr(v.UnicastPeer); err != nil {
+			return cfg, fmt.Errorf("invalid unicast_peer: %w", err)
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// RouteSocketConfig overrides socket tuning for one protocol route
+type RouteSocketConfig struct {
+	Protocol     string `mapstructure:"protocol"`
+	SocketConfig `mapstructure:",squash"`
+}
+
+// TCPOptions converts the socket settings to netutil options
+func (s SocketConfig) TCPOptions() netutil.TCPOptions {
+	return netutil.TCPOptions{
+		NoDelay:           s.NoDelay,
+		KeepAlive:         s.KeepAlive,
+		KeepAliveInterval: s.KeepAliveInterval,
+		KeepAliveCount:    s.KeepAliveCount,
+		SendBuffer:        s.SendBuffer,
+		RecvBuffer:        s.RecvBuffer,
+		UserTimeout:       s.UserTimeout,
+	}
+}
+
+// merge returns the settings with any non-zero override fields applied
+func (s SocketConfig) merge(override SocketConfig) SocketConfig {
+	if override.NoDelay != nil {
+		s.NoDelay = override.NoDelay
+	}
+	if override.KeepAlive != 0 {
+		s.KeepAlive = override.KeepAlive
+	}
+	if override.KeepAliveInterval != 0 {
+		s.KeepAliveInterval = override.KeepAliveInterval
+	}
+	if override.KeepAliveCount != 0 {
+		s.KeepAliveCount = override.KeepAliveCount
+	}
+	if override.SendBuffer != 0 {
+		s.SendBuffer = override.SendBuffer
+	}
+	if override.RecvBuffer != 0 {
+		s.RecvBuffer = override.RecvBuffer
+	}
+	if override.UserTimeout != 0 {
+		s.UserTimeout = override.UserTimeout
+	}
+	return s
+}
+
+// RouteTCPOptions returns the socket options for a protocol route, layering
+// its overrides on top of the global socket_options
+func (c *Config) RouteTCPOptions(protocol string) netutil.TCPOptions {
+	settings := c.SocketOptions
+	for _, route := range c.RouteSocketOptions {
+		if route.Protocol == protocol {
+			settings = settings.merge(route.SocketConfig)
+		}
+	}
+	return settings.TCPOptions()
+}
+
+// Load loads configuration from defaults, the config file at configPath,
+// MARCHPROXY_NLB_* environment variables and the --set flags, each
+// overriding the one before
+func Load(configPath string, flags *pflag.FlagSet) (*Config, error) {
+	l := layers.New("MARCHPROXY_NLB")
+	v := l.Viper()
+
 	// Set defaults
-	viper.SetDefault("bind_addr", ":8080")
-	viper.SetDefault("grpc_addr", "0.0.0.0")
-	viper.SetDefault("grpc_port", 50051)
-	viper.SetDefault("metrics_addr", ":8082")
-	viper.SetDefault("manager_url", "http://api-server:8000")
+	v.SetDefault("bind_addr", ":8080")
+	v.SetDefault("bind_interface", "")
+	v.SetDefault("grpc_addr", "0.0.0.0")
+	v.SetDefault("grpc_port", 50051)
+	v.SetDefault("metrics_addr", ":8082")
+	v.SetDefault("manager_url", "http://api-server:8000")
+	v.SetDefault("standalone", false)
+	v.SetDefault("upgrade_socket", "")
+	v.SetDefault("upgrade_timeout", time.Minute)
 
 	// Rate limiting defaults
-	viper.SetDefault("enable_rate_limiting", true)
-	viper.SetDefault("default_rate_limit", 10000.0) // 10k requests per second
-	viper.SetDefault("default_burst_size", 20000.0)
+	v.SetDefault("enable_rate_limiting", true)
+	v.SetDefault("default_rate_limit", 10000.0) // 10k requests per second
+	v.SetDefault("default_burst_size", 20000.0)
+
+	// Socket tuning defaults
+	v.SetDefault("socket_options.tcp_nodelay", true)
+	v.SetDefault("socket_options.keepalive", 15*time.Second)
 
 	// Autoscaling defaults
-	viper.SetDefault("enable_autoscaling", true)
-	viper.SetDefault("autoscale_interval", 30*time.Second)
-	viper.SetDefault("scale_up_cooldown", 3*time.Minute)
-	viper.SetDefault("scale_down_cooldown", 5*time.Minute)
+	v.SetDefault("enable_autoscaling", true)
+	v.SetDefault("autoscale_interval", 30*time.Second)
+	v.SetDefault("scale_up_cooldown", 3*time.Minute)
+	v.SetDefault("scale_down_cooldown", 5*time.Minute)
 
 	// Blue/Green defaults
-	viper.SetDefault("enable_bluegreen", true)
-	viper.SetDefault("canary_step_size", 10) // 10% increments
-	viper.SetDefault("canary_step_duration", 2*time.Minute)
+	v.SetDefault("enable_bluegreen", true)
+	v.SetDefault("canary_step_size", 10) // 10% increments
+	v.SetDefault("canary_step_duration", 2*time.Minute)
 
 	// Module management defaults
-	viper.SetDefault("max_modules_per_protocol", 50)
-	viper.SetDefault("module_health_check_interval", 10*time.Second)
+	v.SetDefault("max_modules_per_protocol", 50)
+	v.SetDefault("module_health_check_interval", 10*time.Second)
+	v.SetDefault("passive_health.failure_threshold", 5)
+	v.SetDefault("passive_health.window", 10*time.Second)
+	v.SetDefault("passive_health.ejection_time", 30*time.Second)
+	v.SetDefault("slow_start.window", 0)
+	v.SetDefault("slow_start.curve", "linear")
+	v.SetDefault("slow_start.min_weight", 0.1)
+	v.SetDefault("drain_poll_interval", 10*time.Second)
+
+	// BGP defaults
+	v.SetDefault("bgp.hold_time", 90*time.Second)
+	v.SetDefault("bgp.connect_retry", 10*time.Second)
+	v.SetDefault("bgp.check_interval", 2*time.Second)
+	v.SetDefault("bgp.drain_time", 15*time.Second)
+
+	// Coordination defaults
+	v.SetDefault("coordination.enabled", false)
+	v.SetDefault("coordination.lease_ttl", coordination.DefaultLeaseTTL)
+	v.SetDefault("coordination.sync_interval", coordination.DefaultSyncInterval)
+	v.SetDefault("coordination.share_rate_limits", true)
+
+	// gRPC balancer defaults
+	v.SetDefault("grpc_balancer.listen_port", 50061)
+	v.SetDefault("grpc_balancer.health_interval", 5*time.Second)
+	v.SetDefault("grpc_balancer.health_timeout", 2*time.Second)
+
+	// Mesh defaults
+	v.SetDefault("mesh.discovery_interval", 30*time.Second)
+	v.SetDefault("mesh.retries", 2)
+	v.SetDefault("mesh.retry_backoff", 50*time.Millisecond)
+	v.SetDefault("mesh.breaker_threshold", 5)
+	v.SetDefault("mesh.breaker_cooldown", 30*time.Second)
+	v.SetDefault("mesh.max_in_flight", 1000)
+	v.SetDefault("mesh.max_queue", 100)
+	v.SetDefault("mesh.queue_timeout", 100*time.Millisecond)
+
+	// VRRP defaults
+	v.SetDefault("vrrp.priority", 100)
+	v.SetDefault("vrrp.advert_interval", time.Second)
+	v.SetDefault("vrrp.preempt", true)
+	v.SetDefault("vrrp.check_interval", time.Second)
 
 	// Observability defaults
-	viper.SetDefault("enable_tracing", false)
-	viper.SetDefault("trace_sample_rate", 0.1)
-	viper.SetDefault("metrics_namespace", "marchproxy_nlb")
+	v.SetDefault("enable_tracing", false)
+	v.SetDefault("trace_sample_rate", 0.1)
+	v.SetDefault("metrics_namespace", "marchproxy_nlb")
 
 	// Licensing defaults
-	viper.SetDefault("license_server", "https://license.penguintech.io")
-	viper.SetDefault("release_mode", false)
+	v.SetDefault("license_server", "https://license.penguintech.io")
+	v.SetDefault("release_mode", false)
+	v.SetDefault("license_refresh_interval", licensing.DefaultRefresh)
+	v.SetDefault("license_grace_period", licensing.DefaultGrace)
 
 	// Advanced features defaults
-	viper.SetDefault("enable_connection_pooling", true)
-	viper.SetDefault("max_connections_per_module", 10000)
+	v.SetDefault("enable_connection_pooling", true)
+	v.SetDefault("max_connections_per_module", 10000)
 
-	// Load config file if provided
-	if configPath != "" {
-		viper.SetConfigFile(configPath)
-		if err := viper.ReadInConfig(); err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
-		}
+	if err := l.ReadFile(configPath); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := l.ApplySet(flags); err != nil {
+		return nil, err
 	}
 
-	// Environment variables take precedence
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("MARCHPROXY_NLB")
-
-	// Unmarshal config
 	var cfg Config
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	if err := l.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	// Override from environment if set
@@ -141,18 +593,157 @@ func Load(configPath string) (*Config, error) {
 
 // Validate validates the configuration
 func (c *Config) Validate() error {
-	if c.ManagerURL == "" {
-		return fmt.Errorf("manager_url is required")
+	if !c.Standalone {
+		if c.ManagerURL == "" {
+			return fmt.Errorf("manager_url is required")
+		}
+
+		if c.ClusterAPIKey == "" {
+			return fmt.Errorf("cluster_api_key is required")
+		}
 	}
 
-	if c.ClusterAPIKey == "" {
-		return fmt.Errorf("cluster_api_key is required")
+	names := make(map[string]bool)
+	for i, module := range c.StaticModules {
+		if module.Name == "" || module.Protocol == "" || module.Address == "" {
+			return fmt.Errorf("static_modules[%d] requires name, protocol and address", i)
+		}
+		if names[module.Protocol+"/"+module.Name] {
+			return fmt.Errorf("static_modules[%d]: duplicate module %s for %s", i, module.Name, module.Protocol)
+		}
+		names[module.Protocol+"/"+module.Name] = true
+		if module.GRPCPort < 0 || module.GRPCPort > 65535 {
+			return fmt.Errorf("static_modules[%d]: invalid grpc_port", i)
+		}
+		if module.MaxConns < 0 || module.Weight < 0 {
+			return fmt.Errorf("static_modules[%d]: max_conns and weight must not be negative", i)
+		}
 	}
 
 	if c.GRPCPort <= 0 || c.GRPCPort > 65535 {
 		return fmt.Errorf("invalid grpc_port: must be 1-65535")
 	}
 
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return fmt.Errorf("invalid bind_addr %q: %w", c.BindAddr, err)
+	}
+	if err := netutil.ValidateBindAddress(host); err != nil {
+		return fmt.Errorf("invalid bind_addr: %w", err)
+	}
+
+	if err := netutil.ValidateBindAddress(c.GRPCAddr); err != nil {
+		return fmt.Errorf("invalid grpc_addr: %w", err)
+	}
+
+	if err := netutil.ValidateInterface(c.BindInterface); err != nil {
+		return err
+	}
+
+	if c.UpgradeSocket != "" && c.UpgradeTimeout <= 0 {
+		return fmt.Errorf("upgrade_timeout must be > 0")
+	}
+
+	if err := c.SocketOptions.TCPOptions().Validate(); err != nil {
+		return fmt.Errorf("invalid socket_options: %w", err)
+	}
+
+	for _, route := range c.RouteSocketOptions {
+		if route.Protocol == "" {
+			return fmt.Errorf("route_socket_options entry requires a protocol")
+		}
+		if err := c.RouteTCPOptions(route.Protocol).Validate(); err != nil {
+			return fmt.Errorf("invalid route_socket_options for %s: %w", route.Protocol, err)
+		}
+	}
+
+	if c.PassiveHealth.FailureThreshold < 0 {
+		return fmt.Errorf("passive_health.failure_threshold must not be negative")
+	}
+	if c.PassiveHealth.FailureThreshold > 0 && (c.PassiveHealth.Window <= 0 || c.PassiveHealth.EjectionTime <= 0) {
+		return fmt.Errorf("passive_health.window and passive_health.ejection_time must be > 0")
+	}
+
+	if c.SlowStart.Window < 0 {
+		return fmt.Errorf("slow_start.window must not be negative")
+	}
+	switch c.SlowStart.Curve {
+	case "", "linear", "exponential":
+	default:
+		return fmt.Errorf("slow_start.curve must be linear or exponential")
+	}
+	if c.SlowStart.Window > 0 && (c.SlowStart.MinWeight <= 0 || c.SlowStart.MinWeight > 1) {
+		return fmt.Errorf("slow_start.min_weight must be above 0 and at most 1")
+	}
+
+	if c.GeoIP.Database == "" && (len(c.GeoIP.BlockCountries) > 0 || len(c.GeoIP.Routes) > 0) {
+		return fmt.Errorf("geoip.database is required for geoip.block_countries and geoip.routes")
+	}
+	for i, route := range c.GeoIP.Routes {
+		if len(route.Countries) == 0 || len(route.Modules) == 0 {
+			return fmt.Errorf("geoip.routes[%d] requires countries and modules", i)
+		}
+	}
+
+	if c.Locality.Spillover < 0 || c.Locality.Spillover > 1 {
+		return fmt.Errorf("locality.spillover must be between 0 and 1")
+	}
+
+	if c.BGP.Enabled {
+		if _, err := c.BGP.SpeakerConfig(); err != nil {
+			return fmt.Errorf("invalid bgp: %w", err)
+		}
+		if c.BGP.CheckInterval <= 0 {
+			return fmt.Errorf("bgp.check_interval must be > 0")
+		}
+	}
+
+	if c.VRRP.Enabled {
+		if _, err := c.VRRP.InstanceConfig(); err != nil {
+			return fmt.Errorf("invalid vrrp: %w", err)
+		}
+		if c.VRRP.CheckInterval <= 0 {
+			return fmt.Errorf("vrrp.check_interval must be > 0")
+		}
+	}
+
+	if c.GRPCBalancer.Enabled {
+		if c.GRPCBalancer.ListenPort <= 0 || c.GRPCBalancer.ListenPort > 65535 {
+			return fmt.Errorf("invalid grpc_balancer.listen_port: must be 1-65535")
+		}
+		if err := c.GRPCBalancer.BalancerConfig().Validate(); err != nil {
+			return fmt.Errorf("invalid grpc_balancer: %w", err)
+		}
+	}
+
+	if (c.Mesh.TLSCert == "") != (c.Mesh.TLSKey == "") {
+		return fmt.Errorf("mesh.tls_cert and mesh.tls_key must be set together")
+	}
+	if c.Mesh.TLSCert != "" && c.Mesh.TLSCA == "" {
+		return fmt.Errorf("mesh.tls_ca is required for mutual TLS")
+	}
+	if c.Mesh.DiscoveryInterval < 0 {
+		return fmt.Errorf("mesh.discovery_interval must be >= 0")
+	}
+	if c.DrainPollInterval < 0 {
+		return fmt.Errorf("drain_poll_interval must be >= 0")
+	}
+	if c.Mesh.Retries < 0 || c.Mesh.RetryBackoff < 0 {
+		return fmt.Errorf("mesh.retries and mesh.retry_backoff must be >= 0")
+	}
+	if c.Mesh.BreakerThreshold < 0 {
+		return fmt.Errorf("mesh.breaker_threshold must be >= 0")
+	}
+	if c.Mesh.BreakerThreshold > 0 && c.Mesh.BreakerCooldown <= 0 {
+		return fmt.Errorf("mesh.breaker_cooldown must be > 0")
+	}
+	if c.Mesh.MaxInFlight < 0 || c.Mesh.MaxQueue < 0 || c.Mesh.ShedQueued < 0 {
+		return fmt.Errorf("mesh.max_in_flight, mesh.max_queue and mesh.shed_queued must be >= 0")
+	}
+	if c.Mesh.MaxQueue > 0 && c.Mesh.QueueTimeout <= 0 {
+		return fmt.Errorf("mesh.queue_timeout must be > 0")
+	}
+
 	if c.EnableRateLimiting {
 		if c.DefaultRateLimit <= 0 {
 			return fmt.Errorf("default_rate_limit must be > 0")
@@ -180,6 +771,25 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	if c.Coordination.Enabled {
+		if c.Standalone {
+			return fmt.Errorf("coordination needs a manager, not available in standalone mode")
+		}
+		if c.Coordination.LeaseTTL < 5*time.Second || c.Coordination.LeaseTTL > 5*time.Minute {
+			return fmt.Errorf("coordination.lease_ttl must be between 5s and 5m")
+		}
+		if c.Coordination.SyncInterval <= 0 {
+			return fmt.Errorf("coordination.sync_interval must be > 0")
+		}
+	}
+	if c.BGP.LeaderOnly && !c.Coordination.Enabled {
+		return fmt.Errorf("bgp.leader_only requires coordination.enabled")
+	}
+
+	if c.ModuleHealthCheckInterval <= 0 {
+		return fmt.Errorf("module_health_check_interval must be > 0")
+	}
+
 	if c.MaxModulesPerProtocol <= 0 {
 		return fmt.Errorf("max_modules_per_protocol must be > 0")
 	}
@@ -188,16 +798,52 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("max_connections_per_module must be > 0")
 	}
 
+	if err := c.Admin.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// IsEnterpriseFeatureEnabled checks if an enterprise feature is enabled
-func (c *Config) IsEnterpriseFeatureEnabled(feature string) bool {
-	// In release mode, check license
-	if c.ReleaseMode {
-		// TODO: Validate with license server
-		return c.LicenseKey != ""
+// NewLicenseGate creates the gate for enterprise features. In release mode
+// it follows the entitlements the manager reports for the cluster, or
+// community features when standalone; in development mode all features
+// are available.
+func (c *Config) NewLicenseGate(logger logrus.FieldLogger) *licensing.Gate {
+	if !c.ReleaseMode {
+		return licensing.Unrestricted()
+	}
+	proxyName, _ := os.Hostname()
+	fetch := licensing.ManagerFetcher(c.ManagerURL, c.ClusterAPIKey, proxyName)
+	if c.Standalone {
+		fetch = licensing.Community()
+	}
+	return licensing.New(fetch, licensing.Options{
+		Refresh:   c.LicenseRefreshInterval,
+		Grace:     c.LicenseGracePeriod,
+		CacheFile: c.LicenseCacheFile,
+		Logger:    logger,
+	})
+}
+
+// NewDrainFetcher returns a function fetching the backends the manager
+// drains across the cluster. It returns nil when standalone or when drain
+// polling is disabled.
+func (c *Config) NewDrainFetcher() func(ctx context.Context) ([]drain.Backend, error) {
+	if c.Standalone || c.DrainPollInterval <= 0 {
+		return nil
+	}
+	proxyName, _ := os.Hostname()
+	return drain.ManagerFetcher(c.ManagerURL, c.ClusterAPIKey, proxyName)
+}
+
+// NewCoordinationBackend creates the manager backend replicas coordinate
+// through, identifying this replica by its hostname. It returns nil when
+// coordination is disabled.
+func (c *Config) NewCoordinationBackend() *coordination.ManagerBackend {
+	if !c.Coordination.Enabled {
+		return nil
 	}
-	// In development mode, all features available
-	return true
+	proxyName, _ := os.Hostname()
+	return coordination.NewManagerBackend(c.ManagerURL, c.ClusterAPIKey, proxyName)
 }
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"marchproxy-shared/layers"
+
+	"github.com/spf13/pflag"
+)
+
+// writeConfig writes a config file for a standalone NLB with extra
+// settings
+func writeConfig(t *testing.T, extra string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nlb.yaml")
+	content := "standalone: true\ngrpc_port: 50060\n" + extra
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setFlags returns flags with --set given for each value
+func setFlags(t *testing.T, values ...string) *pflag.FlagSet {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	layers.AddFlags(flags)
+	for _, value := range values {
+		if err := flags.Set("set", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return flags
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "metrics_addr: :9000\nbgp:\n  hold_time: 30s\n  drain_time: 5s\n")
+	t.Setenv("MARCHPROXY_NLB_GRPC_PORT", "50070")
+	t.Setenv("MARCHPROXY_NLB_BGP_HOLD_TIME", "45s")
+	t.Setenv("MARCHPROXY_NLB_METRICS_ADDR", ":9100")
+
+	cfg, err := Load(path, setFlags(t, "metrics_addr=:9200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BindAddr != ":8080" {
+		t.Errorf("bind_addr %q, want the default", cfg.BindAddr)
+	}
+	if cfg.BGP.DrainTime != 5*time.Second {
+		t.Errorf("bgp.drain_time %s, want 5s from the file", cfg.BGP.DrainTime)
+	}
+	if cfg.GRPCPort != 50070 || cfg.BGP.HoldTime != 45*time.Second {
+		t.Errorf("grpc_port %d and bgp.hold_time %s, want the environment's", cfg.GRPCPort, cfg.BGP.HoldTime)
+	}
+	if cfg.MetricsAddr != ":9200" {
+		t.Errorf("metrics_addr %q, want --set's", cfg.MetricsAddr)
+	}
+}
+
+func TestLoadEnvironmentOnly(t *testing.T) {
+	// Keys without a default can still be set from the environment
+	t.Setenv("MARCHPROXY_NLB_STANDALONE", "true")
+	t.Setenv("MARCHPROXY_NLB_GEOIP_DATABASE", "/data/geo.mmdb")
+	t.Setenv("MARCHPROXY_NLB_GEOIP_BLOCK_COUNTRIES", "KP,IR")
+
+	cfg, err := Load("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GeoIP.Database != "/data/geo.mmdb" {
+		t.Errorf("geoip.database %q", cfg.GeoIP.Database)
+	}
+	if strings.Join(cfg.GeoIP.BlockCountries, ",") != "KP,IR" {
+		t.Errorf("geoip.block_countries %v", cfg.GeoIP.BlockCountries)
+	}
+}
+
+func TestLoadProblems(t *testing.T) {
+	path := writeConfig(t, `
+static_modules:
+  - name: web
+    protocol: http
+    adress: 10.0.0.1:80
+bgp:
+  hodl_time: 5s
+  enabled: maybe
+`)
+	t.Setenv("MARCHPROXY_NLB_VRRP_PRIORITY", "300")
+
+	_, err := Load(path, setFlags(t, "canary_step_sise=20"))
+	var problems layers.Problems
+	if !errors.As(err, &problems) {
+		t.Fatalf("error %v, want Problems", err)
+	}
+
+	want := []layers.Problem{
+		{Key: "bgp.enabled", Source: path, Reason: `want true or false, got "maybe"`},
+		{Key: "bgp.hodl_time", Source: path, Reason: `unknown setting, did you mean "bgp.hold_time"?`},
+		{Key: "canary_step_sise", Source: "--set", Reason: `unknown setting, did you mean "canary_step_size"?`},
+		{Key: "static_modules[0].adress", Source: path, Reason: `unknown setting, did you mean "static_modules[0].address"?`},
+		{Key: "vrrp.priority", Source: "MARCHPROXY_NLB_VRRP_PRIORITY", Reason: `want an integer from 0 to 255, got "300"`},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems:\n%v", problems)
+	}
+	for i := range want {
+		if problems[i] != want[i] {
+			t.Errorf("problem %d: %+v, want %+v", i, problems[i], want[i])
+		}
+	}
+}
+
+func TestLoadSetSyntax(t *testing.T) {
+	if _, err := Load("", setFlags(t, "standalone")); err == nil || !strings.Contains(err.Error(), "want key=value") {
+		t.Errorf("--set without a value: %v", err)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	if _, err := Load("../../config.example.yaml", nil); err != nil {
+		t.Errorf("config.example.yaml: %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 )
@@ -17,11 +18,15 @@ import (
 // ModuleClient represents a gRPC client connection to a module container
 type ModuleClient struct {
 	name       string
+	moduleType string // alb, dblb or rtmp for discovered modules
 	address    string
 	port       int
+	creds      credentials.TransportCredentials
 	conn       *grpc.ClientConn
 	state      connectivity.State
 	lastUsed   time.Time
+	breaker    breaker
+	window     *window
 	mu         sync.RWMutex
 	logger     *logrus.Logger
 }
@@ -36,6 +41,8 @@ func NewModuleClient(name, address string, port int, logger *logrus.Logger) (*Mo
 		name:    name,
 		address: address,
 		port:    port,
+		creds:   insecure.NewCredentials(),
+		window:  newWindow(0),
 		logger:  logger,
 	}, nil
 }
@@ -63,7 +70,7 @@ func (mc *ModuleClient) Connect(ctx context.Context) error {
 	}
 
 	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(mc.creds),
 		grpc.WithKeepaliveParams(kaParams),
 		grpc.WithBlock(),
 		grpc.WithDefaultCallOptions(
@@ -71,6 +78,7 @@ func (mc *ModuleClient) Connect(ctx context.Context) error {
 			grpc.MaxCallSendMsgSize(16 * 1024 * 1024), // 16MB
 		),
 	}
+	opts = append(opts, mc.loadInterceptors()...)
 
 	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -160,6 +168,7 @@ func (mc *ModuleClient) GetState() connectivity.State {
 // ClientPool manages a pool of gRPC client connections
 type ClientPool struct {
 	clients map[string]*ModuleClient
+	options MeshOptions
 	mu      sync.RWMutex
 	logger  *logrus.Logger
 	ctx     context.Context
@@ -167,12 +176,21 @@ type ClientPool struct {
 	wg      sync.WaitGroup
 }
 
-// NewClientPool creates a new client pool
+// NewClientPool creates a new client pool with plaintext connections and
+// no retries or circuit breaking
 func NewClientPool(logger *logrus.Logger) *ClientPool {
+	return NewMeshPool(MeshOptions{}, logger)
+}
+
+// NewMeshPool creates a client pool for the module mesh, connecting with
+// the options' TLS settings and retrying and circuit breaking calls made
+// through Invoke
+func NewMeshPool(options MeshOptions, logger *logrus.Logger) *ClientPool {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	pool := &ClientPool{
 		clients: make(map[string]*ModuleClient),
+		options: options,
 		logger:  logger,
 		ctx:     ctx,
 		cancel:  cancel,
@@ -187,10 +205,19 @@ func NewClientPool(logger *logrus.Logger) *ClientPool {
 
 // AddClient adds a client to the pool
 func (cp *ClientPool) AddClient(name, address string, port int) error {
+	return cp.addClient(name, "", address, port)
+}
+
+func (cp *ClientPool) addClient(name, moduleType, address string, port int) error {
 	client, err := NewModuleClient(name, address, port, cp.logger)
 	if err != nil {
 		return err
 	}
+	client.moduleType = moduleType
+	client.window = newWindow(cp.options.MaxInFlight)
+	if cp.options.TLS != nil {
+		client.creds = credentials.NewTLS(cp.options.TLS)
+	}
 
 	// Attempt initial connection
 	if err := client.Connect(cp.ctx); err != nil {
@@ -340,10 +367,13 @@ func (cp *ClientPool) GetStats() map[string]interface{} {
 		}
 
 		clientStats[name] = map[string]interface{}{
+			"type":      client.moduleType,
 			"address":   client.address,
 			"port":      client.port,
 			"healthy":   healthy,
 			"state":     client.GetState().String(),
+			"breaker":   client.breaker.state(time.Now()),
+			"window":    client.window.stats(cp.options.ShedQueued, time.Now()),
 			"last_used": client.lastUsed,
 		}
 	}
@@ -0,0 +1,101 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Endpoint is a module instance the NLB routes to over the mesh
+type Endpoint struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // alb, dblb or rtmp
+	Address string `json:"address"`
+	Port    int    `json:"grpc_port"`
+	Zone    string `json:"zone,omitempty"` // Where the module runs, for locality-aware routing
+	Region  string `json:"region,omitempty"`
+}
+
+// modulesRequest is the body of a module discovery request
+type modulesRequest struct {
+	ProxyName     string   `json:"proxy_name"`
+	ClusterAPIKey string   `json:"cluster_api_key"`
+	ModuleTypes   []string `json:"module_types"`
+}
+
+// modulesResponse is the manager's answer to a module discovery request
+type modulesResponse struct {
+	Success bool       `json:"success"`
+	Error   string     `json:"error,omitempty"`
+	Modules []Endpoint `json:"modules"`
+}
+
+// ManagerDiscovery finds the module instances of the cluster registered
+// with the manager
+type ManagerDiscovery struct {
+	baseURL     string
+	apiKey      string
+	proxyName   string
+	moduleTypes []string
+	client      *http.Client
+}
+
+// NewManagerDiscovery creates a discovery client using the manager's
+// /api/proxy/modules endpoint, which lists the active modules of
+// moduleTypes in the cluster of the API key
+func NewManagerDiscovery(managerURL, apiKey, proxyName string, moduleTypes []string) *ManagerDiscovery {
+	return &ManagerDiscovery{
+		baseURL:     strings.TrimRight(managerURL, "/"),
+		apiKey:      apiKey,
+		proxyName:   proxyName,
+		moduleTypes: moduleTypes,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Discover returns the active module endpoints
+func (d *ManagerDiscovery) Discover(ctx context.Context) ([]Endpoint, error) {
+	data, err := json.Marshal(modulesRequest{ProxyName: d.proxyName, ClusterAPIKey: d.apiKey, ModuleTypes: d.moduleTypes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.baseURL+"/api/proxy/modules", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("manager unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(respData))
+	}
+	var result modulesResponse
+	if err := json.Unmarshal(respData, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if !result.Success {
+		return nil, fmt.Errorf("module discovery rejected: %s", result.Error)
+	}
+
+	endpoints := result.Modules[:0]
+	for _, endpoint := range result.Modules {
+		if endpoint.Name != "" && endpoint.Address != "" && endpoint.Port > 0 && endpoint.Port <= 65535 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
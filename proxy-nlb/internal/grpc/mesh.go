@@ -0,0 +1,304 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MeshOptions configure the client pool as the module mesh: the TLS
+// settings of module connections, and the retries, circuit breaking and
+// backpressure of calls made through Invoke
+type MeshOptions struct {
+	TLS              *tls.Config   // nil for plaintext
+	Retries          int           // Further attempts, each on the next module, after a failed call
+	RetryBackoff     time.Duration // Before the first retry, doubling with each one
+	BreakerThreshold int           // Consecutive failures that open a module's breaker, 0 disables
+	BreakerCooldown  time.Duration // How long an open breaker refuses calls before a trial call
+
+	MaxInFlight  int           // Calls in flight per module, 0 for no limit
+	MaxQueue     int           // Calls waiting for a slot when every module's window is full, 0 sheds them at once
+	QueueTimeout time.Duration // How long a call waits for a slot before it is shed
+	ShedQueued   int           // Shed calls to modules reporting this many queued, 0 only sheds modules at their limit
+}
+
+// ErrBreakerOpen is returned for calls to a module whose circuit breaker
+// is open
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// MeshTLSConfig loads the client certificate presented to modules and the
+// CA that verifies them, for mutual TLS between modules. serverName
+// overrides the name verified in module certificates, which otherwise is
+// the address dialled.
+func MeshTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mesh client certificate: %w", err)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mesh CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in mesh CA %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open" // Cooldown over, one trial call allowed
+)
+
+// breaker stops calls to a module after consecutive failures, until a
+// trial call after the cooldown succeeds
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // A half-open trial call is in flight
+}
+
+// allow reports whether a call may be made at now
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the outcome of an allowed call, opening the breaker after
+// threshold consecutive failures or a failed trial call
+func (b *breaker) record(failed bool, threshold int, cooldown time.Duration, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if threshold > 0 && (b.failures >= threshold || !b.openUntil.IsZero()) {
+		b.openUntil = now.Add(cooldown)
+	}
+}
+
+// release gives up an allowed call without an outcome
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *breaker) state(now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return breakerClosed
+	case now.Before(b.openUntil) || b.trial:
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// retryable reports whether a failed call may succeed on another module:
+// the module was unreachable, overloaded or refused by its breaker
+func retryable(err error) bool {
+	if errors.Is(err, ErrBreakerOpen) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// MeshCall is a call to the module name over its connection
+type MeshCall func(ctx context.Context, name string, conn *grpc.ClientConn) error
+
+// Invoke calls the first of the named modules whose breaker and
+// concurrency window allow it, moving on to the next module for up to
+// Retries further attempts when the call fails with a retryable error.
+// Modules with an open breaker, a full window or reporting they are
+// saturated are skipped without using an attempt. When every window is
+// full the call waits up to QueueTimeout for a slot on the first module,
+// unless MaxQueue calls already wait there, and is otherwise shed with
+// ResourceExhausted. It returns the name of the module that answered.
+func (cp *ClientPool) Invoke(ctx context.Context, names []string, call MeshCall) (string, error) {
+	if len(names) == 0 {
+		return "", errors.New("no modules to call")
+	}
+	backoff := cp.options.RetryBackoff
+	attempts := 0
+	var full *ModuleClient // First module skipped for a full window
+	var lastErr error
+	for _, name := range names {
+		client, err := cp.GetClient(name)
+		if err != nil {
+			lastErr = status.Error(codes.Unavailable, err.Error())
+			continue
+		}
+		if err := client.window.tryAcquire(cp.options.ShedQueued, time.Now()); err != nil {
+			if err == errWindowFull && full == nil {
+				full = client
+			}
+			lastErr = fmt.Errorf("module %s: %w", name, err)
+			continue
+		}
+
+		done, err := cp.attempt(ctx, client, call, attempts, &backoff)
+		if err == errBreakerSkipped {
+			lastErr = fmt.Errorf("module %s: %w", name, ErrBreakerOpen)
+			continue
+		}
+		attempts++
+		lastErr = err
+		if err == nil {
+			return name, nil
+		}
+		if done || !retryable(err) || ctx.Err() != nil || attempts > cp.options.Retries {
+			return "", lastErr
+		}
+		cp.logger.WithError(err).WithField("module", name).Debug("Module call failed, retrying on the next module")
+	}
+
+	// Every module was busy: queue for the first full window
+	if attempts == 0 && full != nil && cp.options.MaxQueue > 0 {
+		if err := full.window.acquire(ctx, cp.options.ShedQueued, cp.options.MaxQueue, cp.options.QueueTimeout); err != nil {
+			return "", fmt.Errorf("module %s: %w", full.name, err)
+		}
+		_, err := cp.attempt(ctx, full, call, 0, &backoff)
+		if err == errBreakerSkipped {
+			return "", fmt.Errorf("module %s: %w", full.name, ErrBreakerOpen)
+		}
+		if err != nil {
+			return "", err
+		}
+		return full.name, nil
+	}
+	return "", lastErr
+}
+
+// errBreakerSkipped is returned by attempt for modules whose breaker
+// refused the call
+var errBreakerSkipped = errors.New("breaker skipped")
+
+// attempt makes a call to a module holding a window slot, after the
+// backoff for retries, and frees the slot. done is set when ctx ended
+// during the backoff.
+func (cp *ClientPool) attempt(ctx context.Context, client *ModuleClient, call MeshCall, attempts int, backoff *time.Duration) (done bool, err error) {
+	defer client.window.release()
+	if !client.breaker.allow(time.Now()) {
+		return false, errBreakerSkipped
+	}
+	if attempts > 0 && *backoff > 0 {
+		select {
+		case <-ctx.Done():
+			client.breaker.release()
+			return true, ctx.Err()
+		case <-time.After(*backoff):
+		}
+		*backoff *= 2
+	}
+	return false, cp.invokeOne(ctx, client, call)
+}
+
+// Probe makes a call to the module name that bypasses its concurrency
+// window, for health checks that must reach saturated modules. The
+// module's breaker still applies.
+func (cp *ClientPool) Probe(ctx context.Context, name string, call MeshCall) error {
+	client, err := cp.GetClient(name)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if !client.breaker.allow(time.Now()) {
+		return fmt.Errorf("module %s: %w", name, ErrBreakerOpen)
+	}
+	return cp.invokeOne(ctx, client, call)
+}
+
+// Window returns the concurrency window of the module name
+func (cp *ClientPool) Window(name string) (WindowStats, bool) {
+	client, err := cp.GetClient(name)
+	if err != nil {
+		return WindowStats{}, false
+	}
+	return client.window.stats(cp.options.ShedQueued, time.Now()), true
+}
+
+// invokeOne makes one call to a module its breaker allowed, and records
+// the outcome
+func (cp *ClientPool) invokeOne(ctx context.Context, client *ModuleClient, call MeshCall) error {
+	conn, err := client.GetConnection()
+	if err != nil {
+		err = status.Errorf(codes.Unavailable, "module %s: %v", client.name, err)
+	} else {
+		err = call(ctx, client.name, conn)
+	}
+	// Only failures of the module count against its breaker, not requests
+	// the module rejected
+	failed := err != nil && retryable(err)
+	now := time.Now()
+	client.breaker.record(failed, cp.options.BreakerThreshold, cp.options.BreakerCooldown, now)
+	if failed && client.breaker.state(now) == breakerOpen {
+		cp.logger.WithField("module", client.name).Warn("Module circuit breaker open")
+	}
+	return err
+}
+
+// Sync makes the pool's clients match the discovered endpoints, adding new
+// modules, replacing moved ones and removing the ones gone
+func (cp *ClientPool) Sync(endpoints []Endpoint) {
+	wanted := make(map[string]Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		wanted[endpoint.Name] = endpoint
+	}
+
+	cp.mu.RLock()
+	var stale []string
+	for name, client := range cp.clients {
+		endpoint, ok := wanted[name]
+		if !ok || endpoint.Address != client.address || endpoint.Port != client.port {
+			stale = append(stale, name)
+		}
+	}
+	cp.mu.RUnlock()
+	for _, name := range stale {
+		cp.RemoveClient(name)
+	}
+
+	for _, endpoint := range endpoints {
+		if _, err := cp.GetClient(endpoint.Name); err == nil {
+			continue
+		}
+		if err := cp.addClient(endpoint.Name, endpoint.Type, endpoint.Address, endpoint.Port); err != nil {
+			cp.logger.WithError(err).WithField("module", endpoint.Name).Warn("Failed to add discovered module")
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"marchproxy-shared/netutil"
+
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -84,6 +86,7 @@ type StatsResponse struct {
 type Server struct {
 	address     string
 	port        int
+	bindIface   string
 	grpcServer  *grpc.Server
 	healthServer *health.Server
 	service     NLBService
@@ -103,6 +106,36 @@ func NewServer(address string, port int, service NLBService, logger *logrus.Logg
 	}
 }
 
+// SetBindInterface binds the server socket to a network interface or VRF
+// device. Must be called before Start.
+func (s *Server) SetBindInterface(iface string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bindIface = iface
+}
+
+// Listen opens the server socket ahead of Start, so that it is open once
+// Listen returns. Start opens it when Listen wasn't called.
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listen()
+}
+
+// listen opens the server socket unless it is open. Must hold mu.
+func (s *Server) listen() error {
+	if s.listener != nil {
+		return nil
+	}
+	addr := netutil.JoinHostPort(s.address, s.port)
+	listener, err := netutil.Listen("tcp", addr, s.bindIface)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s.listener = listener
+	return nil
+}
+
 // Start starts the gRPC server
 func (s *Server) Start() error {
 	s.mu.Lock()
@@ -111,14 +144,12 @@ func (s *Server) Start() error {
 		return fmt.Errorf("server already running")
 	}
 
-	addr := fmt.Sprintf("%s:%d", s.address, s.port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
+	if err := s.listen(); err != nil {
 		s.mu.Unlock()
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return err
 	}
-
-	s.listener = listener
+	addr := s.listener.Addr().String()
+	listener := s.listener
 
 	// Configure keepalive parameters
 	kaParams := keepalive.ServerParameters{
@@ -208,6 +239,7 @@ func (s *Server) Stop() error {
 
 	if s.listener != nil {
 		s.listener.Close()
+		s.listener = nil
 	}
 
 	s.running = false
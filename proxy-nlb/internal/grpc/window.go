@@ -0,0 +1,218 @@
+package grpc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Load report headers modules send on their gRPC responses, health checks
+// included, so the NLB sees how busy they are across all NLB replicas
+const (
+	LoadInFlightHeader = "marchproxy-load-in-flight" // Connections or requests being served
+	LoadLimitHeader    = "marchproxy-load-limit"     // How many the module accepts, 0 for no limit
+	LoadQueuedHeader   = "marchproxy-load-queued"    // Work waiting in the module for capacity
+)
+
+// loadReportTTL is how long a module's load report is trusted without a
+// newer one; health checks refresh it well within this
+const loadReportTTL = 30 * time.Second
+
+// Window errors are ResourceExhausted, so Invoke moves on to the next
+// module without counting them against the module's breaker
+var (
+	errWindowFull = status.Error(codes.ResourceExhausted, "module concurrency window full")
+	errSaturated  = status.Error(codes.ResourceExhausted, "module reports it is saturated")
+)
+
+// LoadReport is a module's own account of its load
+type LoadReport struct {
+	InFlight int
+	Limit    int
+	Queued   int
+}
+
+// ParseLoadReport reads a load report from response headers
+func ParseLoadReport(md metadata.MD) (LoadReport, bool) {
+	values := md.Get(LoadInFlightHeader)
+	if len(values) == 0 {
+		return LoadReport{}, false
+	}
+	var report LoadReport
+	report.InFlight, _ = strconv.Atoi(values[0])
+	if values := md.Get(LoadLimitHeader); len(values) > 0 {
+		report.Limit, _ = strconv.Atoi(values[0])
+	}
+	if values := md.Get(LoadQueuedHeader); len(values) > 0 {
+		report.Queued, _ = strconv.Atoi(values[0])
+	}
+	return report, true
+}
+
+// WindowStats describe a module's concurrency window
+type WindowStats struct {
+	InFlight  int        // Calls this NLB has in flight to the module
+	Waiting   int        // Calls queued for a slot
+	Limit     int        // Window size, 0 for no limit
+	Report    LoadReport // Last load report from the module
+	Saturated bool       // New calls are shed
+}
+
+// window bounds the calls in flight to a module and tracks the load the
+// module reports, shedding calls while the module says it is saturated
+type window struct {
+	mu         sync.Mutex
+	limit      int
+	inFlight   int
+	waiting    int
+	freed      chan struct{} // Closed and replaced when a slot frees up
+	report     LoadReport
+	reportedAt time.Time
+}
+
+func newWindow(limit int) *window {
+	return &window{limit: limit, freed: make(chan struct{})}
+}
+
+// observe records a load report
+func (w *window) observe(report LoadReport, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report = report
+	w.reportedAt = now
+}
+
+// saturatedLocked reports whether the module's fresh load report says it
+// is at its limit, or has shedQueued or more calls queued
+func (w *window) saturatedLocked(shedQueued int, now time.Time) bool {
+	if w.reportedAt.IsZero() || now.Sub(w.reportedAt) > loadReportTTL {
+		return false
+	}
+	if w.report.Limit > 0 && w.report.InFlight >= w.report.Limit {
+		return true
+	}
+	return shedQueued > 0 && w.report.Queued >= shedQueued
+}
+
+// tryAcquire takes a slot without waiting
+func (w *window) tryAcquire(shedQueued int, now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.saturatedLocked(shedQueued, now) {
+		return errSaturated
+	}
+	if w.limit > 0 && w.inFlight >= w.limit {
+		return errWindowFull
+	}
+	w.inFlight++
+	return nil
+}
+
+// acquire takes a slot, waiting up to timeout behind at most maxQueue
+// other calls for one to free up
+func (w *window) acquire(ctx context.Context, shedQueued, maxQueue int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	w.mu.Lock()
+	if w.waiting >= maxQueue {
+		w.mu.Unlock()
+		return errWindowFull
+	}
+	w.waiting++
+	defer func() {
+		w.mu.Lock()
+		w.waiting--
+		w.mu.Unlock()
+	}()
+	for {
+		if w.saturatedLocked(shedQueued, time.Now()) {
+			w.mu.Unlock()
+			return errSaturated
+		}
+		if w.limit <= 0 || w.inFlight < w.limit {
+			w.inFlight++
+			w.mu.Unlock()
+			return nil
+		}
+		freed := w.freed
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return errWindowFull
+		case <-freed:
+		}
+		w.mu.Lock()
+	}
+}
+
+// release frees a slot, waking the queued calls
+func (w *window) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inFlight--
+	close(w.freed)
+	w.freed = make(chan struct{})
+}
+
+func (w *window) stats(shedQueued int, now time.Time) WindowStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WindowStats{
+		InFlight:  w.inFlight,
+		Waiting:   w.waiting,
+		Limit:     w.limit,
+		Report:    w.report,
+		Saturated: w.saturatedLocked(shedQueued, now),
+	}
+}
+
+// loadInterceptors read the load reports in the response headers of every
+// call on a module connection
+func (mc *ModuleClient) loadInterceptors() []grpc.DialOption {
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		var header metadata.MD
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header))...)
+		if report, ok := ParseLoadReport(header); ok {
+			mc.window.observe(report, time.Now())
+		}
+		return err
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		clientStream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &loadStream{ClientStream: clientStream, window: mc.window}, nil
+	}
+	return []grpc.DialOption{grpc.WithChainUnaryInterceptor(unary), grpc.WithChainStreamInterceptor(stream)}
+}
+
+// loadStream reads the load report in a stream's headers once they arrive
+// with the first message
+type loadStream struct {
+	grpc.ClientStream
+	window *window
+	once   sync.Once
+}
+
+func (s *loadStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.once.Do(func() {
+		if header, headerErr := s.ClientStream.Header(); headerErr == nil {
+			if report, ok := ParseLoadReport(header); ok {
+				s.window.observe(report, time.Now())
+			}
+		}
+	})
+	return err
+}
@@ -104,6 +104,7 @@ type Autoscaler struct {
 	ctx             context.Context
 	cancel          context.CancelFunc
 	wg              sync.WaitGroup
+	leader          func() bool // Only the replica leading scales, nil scales on every replica
 }
 
 // NewAutoscaler creates a new autoscaler
@@ -225,8 +226,23 @@ func (as *Autoscaler) evaluationLoop() {
 	}
 }
 
+// SetLeader limits scaling to the replica for which leader returns true,
+// so replicas sharing modules don't all scale them
+func (as *Autoscaler) SetLeader(leader func() bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.leader = leader
+}
+
 // evaluate evaluates scaling decisions for all protocols
 func (as *Autoscaler) evaluate() {
+	as.mu.RLock()
+	leader := as.leader
+	as.mu.RUnlock()
+	if leader != nil && !leader() {
+		return
+	}
+
 	as.mu.RLock()
 	protocols := make([]Protocol, 0, len(as.policies))
 	for protocol := range as.policies {
@@ -0,0 +1,42 @@
+package nlb
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Connection close reasons shared by every MarchProxy module, so backend
+// failures can be told apart from client churn
+const (
+	CloseClientEOF    = "client_eof"    // The client closed its side first
+	CloseBackendEOF   = "backend_eof"   // The module closed its side first
+	CloseAuthFailure  = "auth_failure"  // The client failed to authenticate
+	ClosePolicyDenied = "policy_denied" // Dropped by routing policy, such as geo blocking
+	CloseIdleTimeout  = "idle_timeout"  // No data moved for the idle timeout
+	CloseDrain        = "drain"         // Closed while the NLB was draining
+	CloseError        = "error"         // Detection, capacity or relay error
+)
+
+var connectionsClosed = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "marchproxy_connections_closed_total",
+		Help: "Closed connections per module, route and close reason",
+	},
+	[]string{"module", "route", "reason"},
+)
+
+// routingCloseReason maps a routing error to the close reason of the
+// connection that could not be routed
+func routingCloseReason(errorType string) string {
+	if errorType == "geo_blocked" || errorType == "plugin_denied" {
+		return ClosePolicyDenied
+	}
+	return CloseError
+}
+
+// CloseConnection releases a connection that RouteConnection sent to
+// module and records why it closed
+func (r *Router) CloseConnection(module *ModuleEndpoint, reason string) {
+	module.DecrementConns()
+	connectionsClosed.WithLabelValues(redModule, module.Protocol.String(), reason).Inc()
+}
@@ -0,0 +1,39 @@
+package nlb
+
+import (
+	"marchproxy-shared/drain"
+)
+
+// SetDrains sets the backends drained for maintenance. Drained modules get
+// no new connections while their open ones finish.
+func (r *Router) SetDrains(drains *drain.Set) {
+	r.drainsMu.Lock()
+	defer r.drainsMu.Unlock()
+	r.drains = drains
+}
+
+// isDrained reports whether a module's backend is drained
+func (r *Router) isDrained(module *ModuleEndpoint) bool {
+	r.drainsMu.RLock()
+	drains := r.drains
+	r.drainsMu.RUnlock()
+
+	return drains.Drained(module.Address, module.GRPCPort)
+}
+
+// DrainingConns returns the connections still open to the modules of a
+// drained backend
+func (r *Router) DrainingConns(backend drain.Backend) int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var conns int64
+	for _, modules := range r.endpoints {
+		for _, module := range modules {
+			if backend.Matches(module.Address, module.GRPCPort) {
+				conns += int64(module.GetActiveConns())
+			}
+		}
+	}
+	return conns
+}
@@ -0,0 +1,51 @@
+package nlb
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"marchproxy-shared/drain"
+)
+
+func TestDrainedModulesGetNoConnections(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	router := NewRouter(logger)
+	drains := drain.NewSet("nlb")
+	router.SetDrains(drains)
+
+	kept := &ModuleEndpoint{Name: "alb-1", Protocol: ProtocolHTTP, Address: "10.0.0.1", GRPCPort: 50051, Healthy: true, MaxConns: 100}
+	drained := &ModuleEndpoint{Name: "alb-2", Protocol: ProtocolHTTP, Address: "10.0.0.2", GRPCPort: 50051, Healthy: true, MaxConns: 100}
+	for _, module := range []*ModuleEndpoint{kept, drained} {
+		if err := router.RegisterModule(module); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := drained.IncrementConns(); err != nil {
+		t.Fatal(err)
+	}
+	drains.Add(drain.Backend{Host: "10.0.0.2"})
+
+	for i := 0; i < 5; i++ {
+		module, err := router.RouteConnection(context.Background(), httpRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if module != kept {
+			t.Fatalf("Expected connections routed to alb-1, got %s", module.Name)
+		}
+		router.CloseConnection(module, CloseClientEOF)
+	}
+	if conns := router.DrainingConns(drain.Backend{Host: "10.0.0.2"}); conns != 1 {
+		t.Errorf("Expected the open connection of the drained module, got %d", conns)
+	}
+
+	// With every module drained, nothing is routed
+	drains.Add(drain.Backend{Host: "10.0.0.1", Port: 50051})
+	if _, err := router.RouteConnection(context.Background(), httpRequest); err == nil {
+		t.Error("Expected no module available with all of them drained")
+	}
+}
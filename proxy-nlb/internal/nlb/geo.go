@@ -0,0 +1,132 @@
+package nlb
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"marchproxy-nlb/internal/geoip"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrGeoBlocked is returned when the client's country is blocked
+var ErrGeoBlocked = errors.New("client country blocked")
+
+var geoConnections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "nlb_geo_connections_total",
+		Help: "Total number of connections per client country and action",
+	},
+	[]string{"country", "action"},
+)
+
+// CountryLookup resolves client addresses to ISO 3166-1 country codes
+type CountryLookup interface {
+	Country(ip net.IP) string
+}
+
+// GeoRoute sends clients from Countries to the named modules. Unless Strict
+// is set, clients fall back to any module when none of them is available.
+type GeoRoute struct {
+	Countries []string
+	Modules   []string
+	Strict    bool
+}
+
+// GeoPolicy drops clients from blocked countries and steers the others by
+// the first route listing their country
+type GeoPolicy struct {
+	BlockCountries []string
+	Routes         []GeoRoute
+}
+
+// SetGeoIP enables country lookups of client addresses with policy applied
+// to routed connections. A nil lookup disables them.
+func (r *Router) SetGeoIP(lookup CountryLookup, policy GeoPolicy) {
+	r.geoMu.Lock()
+	defer r.geoMu.Unlock()
+	r.geoLookup = lookup
+	r.geoPolicy = policy
+}
+
+type clientAddrKey struct{}
+
+// WithClientAddr returns a context carrying the address of the client whose
+// connection is being routed, for country lookups
+func WithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// clientIP returns the client address set by WithClientAddr, if any
+func clientIP(ctx context.Context) net.IP {
+	switch addr := ctx.Value(clientAddrKey{}).(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case net.Addr:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	default:
+		return nil
+	}
+}
+
+// geoDecision looks up the client's country and applies the policy. It
+// returns the route for the country, nil when none matches, or
+// ErrGeoBlocked.
+func (r *Router) geoDecision(ctx context.Context) (*GeoRoute, error) {
+	r.geoMu.RLock()
+	lookup, policy := r.geoLookup, r.geoPolicy
+	r.geoMu.RUnlock()
+
+	if lookup == nil {
+		return nil, nil
+	}
+
+	country := geoip.Unknown
+	if ip := clientIP(ctx); ip != nil {
+		country = lookup.Country(ip)
+	}
+
+	if geoip.Match(country, policy.BlockCountries) {
+		geoConnections.WithLabelValues(country, "blocked").Inc()
+		return nil, ErrGeoBlocked
+	}
+	geoConnections.WithLabelValues(country, "routed").Inc()
+
+	for i := range policy.Routes {
+		if geoip.Match(country, policy.Routes[i].Countries) {
+			return &policy.Routes[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// geoFilter narrows modules to those of route. Without a route, or when
+// none of its modules is among them and the route is not strict, modules
+// are returned as they are.
+func geoFilter(modules []*ModuleEndpoint, route *GeoRoute) []*ModuleEndpoint {
+	if route == nil || len(route.Modules) == 0 {
+		return modules
+	}
+
+	var selected []*ModuleEndpoint
+	for _, module := range modules {
+		for _, name := range route.Modules {
+			if module.Name == name {
+				selected = append(selected, module)
+				break
+			}
+		}
+	}
+	if len(selected) == 0 && !route.Strict {
+		return modules
+	}
+	return selected
+}
@@ -0,0 +1,406 @@
+package nlb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcRoute is the RED route label of balanced gRPC streams
+const grpcRoute = "gRPC"
+
+var (
+	grpcStreams = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nlb_grpc_streams_total",
+			Help: "gRPC streams balanced per service, method, backend and status code",
+		},
+		[]string{"service", "method", "backend", "code"},
+	)
+
+	grpcStreamDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nlb_grpc_stream_duration_seconds",
+			Help:    "gRPC stream duration per service and method",
+			Buckets: redDurationBuckets,
+		},
+		[]string{"service", "method"},
+	)
+
+	grpcActiveStreams = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_grpc_active_streams",
+			Help: "Open gRPC streams per backend",
+		},
+		[]string{"backend"},
+	)
+
+	grpcBackendReady = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_grpc_backend_ready",
+			Help: "Whether a gRPC backend passes its health check (1=ready, 0=not ready)",
+		},
+		[]string{"backend"},
+	)
+)
+
+// grpcServerErrors are the status codes counted as failures in the RED
+// metrics; the rest describe the request rather than the backend
+var grpcServerErrors = map[codes.Code]bool{
+	codes.Unknown:          true,
+	codes.DeadlineExceeded: true,
+	codes.Internal:         true,
+	codes.Unavailable:      true,
+	codes.DataLoss:         true,
+}
+
+// GRPCBackend is a server the gRPC balancer sends streams to
+type GRPCBackend struct {
+	Name    string
+	Address string // host:port serving gRPC over plaintext HTTP/2
+}
+
+// GRPCBalancerConfig controls the gRPC balancer. Backends are checked with
+// the grpc.health.v1 protocol every HealthInterval and only receive streams
+// while they report SERVING.
+type GRPCBalancerConfig struct {
+	Backends       []GRPCBackend
+	HealthService  string        // Service name checked, empty for the whole server
+	HealthInterval time.Duration // 0 disables health checks, backends are always ready
+	HealthTimeout  time.Duration
+	MaxStreams     int // Open streams per backend, 0 for no limit
+}
+
+// Validate checks the balancer settings
+func (c GRPCBalancerConfig) Validate() error {
+	if len(c.Backends) == 0 {
+		return errors.New("at least one backend is required")
+	}
+	names := make(map[string]bool, len(c.Backends))
+	for _, backend := range c.Backends {
+		if backend.Name == "" {
+			return errors.New("backend name is required")
+		}
+		if names[backend.Name] {
+			return fmt.Errorf("duplicate backend %s", backend.Name)
+		}
+		names[backend.Name] = true
+		if _, _, err := net.SplitHostPort(backend.Address); err != nil {
+			return fmt.Errorf("backend %s: invalid address: %w", backend.Name, err)
+		}
+	}
+	if c.HealthInterval < 0 || c.MaxStreams < 0 {
+		return errors.New("health interval and max streams must not be negative")
+	}
+	if c.HealthInterval > 0 && c.HealthTimeout <= 0 {
+		return errors.New("health timeout must be positive")
+	}
+	return nil
+}
+
+// GRPCBalancer balances gRPC traffic per stream rather than per connection.
+// Clients speak HTTP/2 to the balancer; each stream goes to the ready
+// backend with the fewest open streams, over connections the balancer
+// multiplexes to every backend.
+type GRPCBalancer struct {
+	config   GRPCBalancerConfig
+	backends []*grpcBackend
+	logger   *logrus.Logger
+	next     atomic.Uint64 // Rotates the starting backend between ties
+}
+
+// grpcBackend is a backend and its balancing state
+type grpcBackend struct {
+	GRPCBackend
+	transport *http2.Transport
+	streams   atomic.Int64
+	ready     atomic.Bool
+}
+
+// NewGRPCBalancer creates a balancer for the configured backends
+func NewGRPCBalancer(config GRPCBalancerConfig, logger *logrus.Logger) (*GRPCBalancer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	b := &GRPCBalancer{config: config, logger: logger}
+	for _, backend := range config.Backends {
+		gb := &grpcBackend{
+			GRPCBackend: backend,
+			transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+				ReadIdleTimeout: 30 * time.Second,
+			},
+		}
+		// Without health checks backends are ready until they fail streams
+		gb.setReady(config.HealthInterval == 0)
+		b.backends = append(b.backends, gb)
+	}
+	return b, nil
+}
+
+func (gb *grpcBackend) setReady(ready bool) bool {
+	value := 0.0
+	if ready {
+		value = 1.0
+	}
+	grpcBackendReady.WithLabelValues(gb.Name).Set(value)
+	return gb.ready.Swap(ready) != ready
+}
+
+// Serve accepts HTTP/2 cleartext connections on listener until ctx ends
+func (b *GRPCBalancer) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           h2c.NewHandler(b, &http2.Server{}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// RunHealthChecks checks every backend right away and then every
+// HealthInterval until ctx ends. It returns at once without health checks.
+func (b *GRPCBalancer) RunHealthChecks(ctx context.Context) {
+	if b.config.HealthInterval == 0 {
+		return
+	}
+
+	clients := make([]healthpb.HealthClient, len(b.backends))
+	for i, backend := range b.backends {
+		conn, err := grpc.NewClient(backend.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			b.logger.WithError(err).WithField("backend", backend.Name).Error("Failed to create gRPC health client")
+			continue
+		}
+		defer conn.Close()
+		clients[i] = healthpb.NewHealthClient(conn)
+	}
+
+	ticker := time.NewTicker(b.config.HealthInterval)
+	defer ticker.Stop()
+	for {
+		for i, backend := range b.backends {
+			if clients[i] != nil {
+				b.checkBackend(ctx, backend, clients[i])
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackend updates a backend's readiness from one health check
+func (b *GRPCBalancer) checkBackend(ctx context.Context, backend *grpcBackend, client healthpb.HealthClient) {
+	checkCtx, cancel := context.WithTimeout(ctx, b.config.HealthTimeout)
+	defer cancel()
+
+	resp, err := client.Check(checkCtx, &healthpb.HealthCheckRequest{Service: b.config.HealthService})
+	ready := err == nil && resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+	if ctx.Err() != nil || !backend.setReady(ready) {
+		return
+	}
+
+	fields := logrus.Fields{"backend": backend.Name, "address": backend.Address}
+	switch {
+	case ready:
+		b.logger.WithFields(fields).Info("gRPC backend ready")
+	case err != nil:
+		b.logger.WithFields(fields).WithError(err).Warn("gRPC backend failed its health check")
+	default:
+		b.logger.WithFields(fields).WithField("status", resp.GetStatus().String()).Warn("gRPC backend not serving")
+	}
+}
+
+// pick returns the ready backend with the fewest open streams and counts
+// the new stream against it, or nil when none can take one
+func (b *GRPCBalancer) pick() *grpcBackend {
+	n := len(b.backends)
+	start := int(b.next.Add(1) % uint64(n))
+
+	var selected *grpcBackend
+	var fewest int64
+	for i := 0; i < n; i++ {
+		backend := b.backends[(start+i)%n]
+		if !backend.ready.Load() {
+			continue
+		}
+		streams := backend.streams.Load()
+		if b.config.MaxStreams > 0 && streams >= int64(b.config.MaxStreams) {
+			continue
+		}
+		if selected == nil || streams < fewest {
+			selected, fewest = backend, streams
+		}
+	}
+	if selected != nil {
+		grpcActiveStreams.WithLabelValues(selected.Name).Set(float64(selected.streams.Add(1)))
+	}
+	return selected
+}
+
+func (gb *grpcBackend) release() {
+	grpcActiveStreams.WithLabelValues(gb.Name).Set(float64(gb.streams.Add(-1)))
+}
+
+// ServeHTTP relays one gRPC stream to a backend, copying messages in both
+// directions as they arrive and the backend's status trailers at the end
+func (b *GRPCBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	service, method := splitGRPCMethod(r.URL.Path)
+
+	backend := b.pick()
+	if backend == nil {
+		writeGRPCStatus(w, codes.Unavailable, "no ready backends")
+		b.observe(r.Context(), service, method, "", codes.Unavailable, start)
+		return
+	}
+	defer backend.release()
+
+	out := r.Clone(r.Context())
+	out.URL.Scheme = "http"
+	out.URL.Host = backend.Address
+	out.RequestURI = ""
+
+	resp, err := backend.transport.RoundTrip(out)
+	if err != nil {
+		b.logger.WithError(err).WithField("backend", backend.Name).Debug("gRPC backend request failed")
+		writeGRPCStatus(w, codes.Unavailable, "backend unavailable")
+		b.observe(r.Context(), service, method, backend.Name, codes.Unavailable, start)
+		return
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for key, values := range resp.Header {
+		header[key] = values
+	}
+	// A trailers-only response carries its status in the headers; it is
+	// sent on as trailers since the headers go out before the status is known
+	status := resp.Header.Get("Grpc-Status")
+	for _, key := range []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"} {
+		if values, ok := header[key]; ok {
+			delete(header, key)
+			header[http.TrailerPrefix+key] = values
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				break
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				b.logger.WithError(err).WithField("backend", backend.Name).Debug("gRPC stream reset")
+				if status == "" {
+					status = strconv.Itoa(int(codes.Unavailable))
+				}
+			}
+			break
+		}
+	}
+
+	for key, values := range resp.Trailer {
+		header[http.TrailerPrefix+key] = values
+	}
+	if trailer := resp.Trailer.Get("Grpc-Status"); trailer != "" {
+		status = trailer
+	}
+
+	code := codes.Unknown
+	if value, err := strconv.Atoi(status); err == nil {
+		code = codes.Code(value)
+	}
+	b.observe(r.Context(), service, method, backend.Name, code, start)
+}
+
+// observe records a finished stream
+func (b *GRPCBalancer) observe(ctx context.Context, service, method, backend string, code codes.Code, start time.Time) {
+	label := backend
+	if label == "" {
+		label = "none"
+	}
+	grpcStreams.WithLabelValues(service, method, label, code.String()).Inc()
+	grpcStreamDuration.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+
+	reason := ""
+	if grpcServerErrors[code] {
+		reason = "grpc_" + strings.ToLower(code.String())
+	}
+	observeRequest(ctx, grpcRoute, backend, reason, time.Since(start))
+}
+
+// Stats returns the backends' readiness and open streams
+func (b *GRPCBalancer) Stats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(b.backends))
+	for _, backend := range b.backends {
+		stats = append(stats, map[string]interface{}{
+			"name":    backend.Name,
+			"address": backend.Address,
+			"ready":   backend.ready.Load(),
+			"streams": backend.streams.Load(),
+		})
+	}
+	return stats
+}
+
+// splitGRPCMethod splits a "/package.Service/Method" path
+func splitGRPCMethod(path string) (string, string) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || service == "" || method == "" {
+		return "unknown", "unknown"
+	}
+	return service, method
+}
+
+// writeGRPCStatus answers a stream with a status and no messages
+func writeGRPCStatus(w http.ResponseWriter, code codes.Code, message string) {
+	header := w.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(code)))
+	header.Set(http.TrailerPrefix+"Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
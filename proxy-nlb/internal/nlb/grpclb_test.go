@@ -0,0 +1,181 @@
+package nlb
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPCBackend serves the health service and answers any other method
+// with NotFound carrying the backend's name
+func startGRPCBackend(t *testing.T, name string) (string, *health.Server) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		return status.Error(codes.NotFound, name)
+	}))
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), healthServer
+}
+
+func startGRPCBalancer(t *testing.T, config GRPCBalancerConfig) (*GRPCBalancer, *grpc.ClientConn) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	balancer, err := NewGRPCBalancer(config, logger)
+	if err != nil {
+		t.Fatalf("NewGRPCBalancer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go balancer.Serve(ctx, listener)
+	go balancer.RunHealthChecks(ctx)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return balancer, conn
+}
+
+// callBackend invokes an unknown method and returns the backend that
+// answered, or the status when no backend did
+func callBackend(t *testing.T, conn *grpc.ClientConn) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := conn.Invoke(ctx, "/test.Echo/Call", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	s := status.Convert(err)
+	if s.Code() == codes.NotFound {
+		return s.Message()
+	}
+	return s.Code().String()
+}
+
+func waitReady(t *testing.T, balancer *GRPCBalancer, want map[string]bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		matched := true
+		for _, backend := range balancer.Stats() {
+			if backend["ready"] != want[backend["name"].(string)] {
+				matched = false
+			}
+		}
+		if matched {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("backends never reached readiness %v: %v", want, balancer.Stats())
+}
+
+func TestGRPCBalancerSpreadsStreams(t *testing.T) {
+	addrA, _ := startGRPCBackend(t, "backend-a")
+	addrB, healthB := startGRPCBackend(t, "backend-b")
+
+	balancer, conn := startGRPCBalancer(t, GRPCBalancerConfig{
+		Backends:       []GRPCBackend{{Name: "a", Address: addrA}, {Name: "b", Address: addrB}},
+		HealthInterval: 20 * time.Millisecond,
+		HealthTimeout:  time.Second,
+	})
+	waitReady(t, balancer, map[string]bool{"a": true, "b": true})
+
+	// Streams on one client connection reach both backends
+	seen := map[string]int{}
+	for i := 0; i < 20; i++ {
+		seen[callBackend(t, conn)]++
+	}
+	if seen["backend-a"] == 0 || seen["backend-b"] == 0 || len(seen) != 2 {
+		t.Errorf("streams per backend = %v, want both backends", seen)
+	}
+
+	// Messages are relayed both ways on a successful call
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Check through the balancer = %v, %v", resp, err)
+	}
+
+	// A backend failing its health check stops getting streams
+	healthB.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitReady(t, balancer, map[string]bool{"a": true, "b": false})
+	for i := 0; i < 10; i++ {
+		if got := callBackend(t, conn); got != "backend-a" {
+			t.Fatalf("stream went to %s while backend-b was not serving", got)
+		}
+	}
+}
+
+func TestGRPCBalancerNoReadyBackends(t *testing.T) {
+	addr, healthServer := startGRPCBackend(t, "backend-a")
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	balancer, conn := startGRPCBalancer(t, GRPCBalancerConfig{
+		Backends:       []GRPCBackend{{Name: "a", Address: addr}},
+		HealthInterval: 20 * time.Millisecond,
+		HealthTimeout:  time.Second,
+	})
+	waitReady(t, balancer, map[string]bool{"a": false})
+
+	if got := callBackend(t, conn); got != codes.Unavailable.String() {
+		t.Errorf("call with no ready backends = %s, want Unavailable", got)
+	}
+}
+
+func TestGRPCBalancerMaxStreams(t *testing.T) {
+	b, err := NewGRPCBalancer(GRPCBalancerConfig{
+		Backends:   []GRPCBackend{{Name: "a", Address: "127.0.0.1:1"}, {Name: "b", Address: "127.0.0.1:2"}},
+		MaxStreams: 1,
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("NewGRPCBalancer: %v", err)
+	}
+
+	first, second := b.pick(), b.pick()
+	if first == nil || second == nil || first == second {
+		t.Fatalf("picks = %v, %v, want one stream on each backend", first, second)
+	}
+	if third := b.pick(); third != nil {
+		t.Errorf("third pick = %s, want none with every backend full", third.Name)
+	}
+	first.release()
+	if again := b.pick(); again != first {
+		t.Errorf("pick after release = %v, want %s", again, first.Name)
+	}
+}
+
+func TestSplitGRPCMethod(t *testing.T) {
+	tests := []struct {
+		path, service, method string
+	}{
+		{"/grpc.health.v1.Health/Check", "grpc.health.v1.Health", "Check"},
+		{"/pkg.Svc/", "unknown", "unknown"},
+		{"/", "unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		if service, method := splitGRPCMethod(tt.path); service != tt.service || method != tt.method {
+			t.Errorf("splitGRPCMethod(%q) = %s, %s", tt.path, service, method)
+		}
+	}
+}
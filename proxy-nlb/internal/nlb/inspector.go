@@ -16,6 +16,7 @@ const (
 	ProtocolMongoDB
 	ProtocolRedis
 	ProtocolRTMP
+	ProtocolKafka
 )
 
 // String returns the string representation of the protocol
@@ -33,7 +34,12 @@ func (p Protocol) String() string {
 		return "Redis"
 	case ProtocolRTMP:
 		return "RTMP"
+	case ProtocolKafka:
+		return "Kafka"
 	default:
+		if plugin := pluginFor(p); plugin != nil {
+			return plugin.Name
+		}
 		return "Unknown"
 	}
 }
@@ -56,11 +62,23 @@ func (pi *ProtocolInspector) InspectProtocol(data []byte) (Protocol, error) {
 		return ProtocolUnknown, errors.New("insufficient data for protocol detection")
 	}
 
+	// Plugin protocols first, as their detectors are written for one
+	// protocol and the built-in checks are loose
+	if protocol := detectPlugin(data); protocol != ProtocolUnknown {
+		return protocol, nil
+	}
+
 	// HTTP detection - check for common HTTP methods and version
 	if pi.isHTTP(data) {
 		return ProtocolHTTP, nil
 	}
 
+	// Kafka detection - before MySQL and PostgreSQL, whose checks also
+	// accept a Kafka request header
+	if pi.isKafka(data) {
+		return ProtocolKafka, nil
+	}
+
 	// MySQL detection - check for greeting packet
 	if pi.isMySQL(data) {
 		return ProtocolMySQL, nil
@@ -113,6 +131,43 @@ func (pi *ProtocolInspector) isHTTP(data []byte) bool {
 	return false
 }
 
+// kafkaOpeningRequests are the API keys a Kafka client opens a connection
+// with, and the highest version of each that is recognised
+var kafkaOpeningRequests = map[uint16]uint16{
+	18: 4,  // ApiVersions, sent first by every current client
+	3:  12, // Metadata, sent first by clients older than 0.10
+	17: 1,  // SaslHandshake
+}
+
+// isKafka checks if data starts with a Kafka request an opening client sends
+// Format: size (4 bytes) + api_key (2) + api_version (2) + correlation_id (4)
+// + client_id length (2), all big-endian
+func (pi *ProtocolInspector) isKafka(data []byte) bool {
+	if len(data) < 14 {
+		return false
+	}
+
+	size := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	apiKey := uint16(data[4])<<8 | uint16(data[5])
+	apiVersion := uint16(data[6])<<8 | uint16(data[7])
+	maxVersion, ok := kafkaOpeningRequests[apiKey]
+	if !ok || apiVersion > maxVersion || size < 10 || size > 1<<20 {
+		return false
+	}
+
+	// The client ID is a nullable string that must fit in the request
+	clientIDLen := int(int16(uint16(data[12])<<8 | uint16(data[13])))
+	if clientIDLen < -1 || clientIDLen > int(size)-10 {
+		return false
+	}
+	for i := 14; i < 14+clientIDLen && i < len(data); i++ {
+		if data[i] < 0x20 || data[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
 // isMySQL checks if data contains MySQL protocol signatures
 // MySQL greeting packet starts with protocol version (0x0a for MySQL 5.x+)
 func (pi *ProtocolInspector) isMySQL(data []byte) bool {
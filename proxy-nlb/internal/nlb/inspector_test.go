@@ -0,0 +1,64 @@
+package nlb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzInspectProtocol(f *testing.F) {
+	for _, seed := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		{0x4a, 0x00, 0x00, 0x00, 0x0a, '8', '.', '0', 0x00},
+		{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f},
+		{0x00, 0x00, 0x00, 0x29, 0x00, 0x03, 0x00, 0x00, 'u', 's', 'e', 'r', 0x00},
+		{0x3a, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xdd, 0x07, 0x00, 0x00},
+		[]byte("*1\r\n$4\r\nPING\r\n"),
+		{0x03, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04},
+		{0x16, 0x03, 0x01},
+		{0x00, 0x00, 0x00, 0x15, 0x00, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x05, 'k', 'c', 'a', 't', '1'},
+		{},
+	} {
+		f.Add(seed)
+	}
+	inspector := NewProtocolInspector()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		protocol, err := inspector.InspectProtocol(data)
+		if len(data) < 3 {
+			if err == nil {
+				t.Fatalf("Expected an error for %d bytes", len(data))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", data, err)
+		}
+		if protocol.String() == "" {
+			t.Fatalf("Protocol %d has no name", protocol)
+		}
+		if again, _ := inspector.InspectProtocol(data); again != protocol {
+			t.Fatalf("Detection of %q is not stable: %v then %v", data, protocol, again)
+		}
+		if bytes.HasPrefix(data, []byte("GET ")) && protocol != ProtocolHTTP {
+			t.Fatalf("Expected %q to be detected as HTTP, got %v", data, protocol)
+		}
+	})
+}
+
+func TestInspectProtocolKafka(t *testing.T) {
+	inspector := NewProtocolInspector()
+	tests := []struct {
+		name     string
+		data     []byte
+		expected Protocol
+	}{
+		{"ApiVersions v3", []byte{0x00, 0x00, 0x00, 0x15, 0x00, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x05, 'k', 'c', 'a', 't', '1'}, ProtocolKafka},
+		{"Metadata v0 without client ID", []byte{0x00, 0x00, 0x00, 0x0e, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00}, ProtocolKafka},
+		{"PostgreSQL startup", []byte{0x00, 0x00, 0x00, 0x29, 0x00, 0x03, 0x00, 0x00, 'u', 's', 'e', 'r', 0x00, 'a', 'p', 'p'}, ProtocolPostgreSQL},
+	}
+	for _, tt := range tests {
+		if protocol, _ := inspector.InspectProtocol(tt.data); protocol != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, protocol)
+		}
+	}
+}
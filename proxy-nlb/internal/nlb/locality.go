@@ -0,0 +1,156 @@
+package nlb
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Localities of a module relative to the NLB, nearest first
+const (
+	LocalityZone   = "zone"   // Same zone
+	LocalityRegion = "region" // Same region, another zone
+	LocalityRemote = "remote" // Another region, or not labelled
+)
+
+var localityTiers = []string{LocalityZone, LocalityRegion, LocalityRemote}
+
+var (
+	localityConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nlb_locality_connections_total",
+			Help: "Total number of connections routed per protocol and module locality relative to the NLB",
+		},
+		[]string{"protocol", "locality"},
+	)
+
+	localitySpillover = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nlb_locality_spillover_total",
+			Help: "Total number of connections routed beyond the nearest locality with healthy modules",
+		},
+		[]string{"protocol", "reason"},
+	)
+)
+
+// LocalityPolicy prefers modules in the NLB's own zone, then in its region,
+// keeping traffic off cross-zone links. Connections spill over to the next
+// locality when the nearer one has no module with room, and Spillover of
+// them do so on purpose, keeping the farther modules warm.
+type LocalityPolicy struct {
+	Zone      string  // The NLB's zone
+	Region    string  // The NLB's region, locality routing is off without either
+	Spillover float64 // Share of connections sent to the next locality, 0 to 1
+}
+
+// Validate checks the locality settings
+func (l LocalityPolicy) Validate() error {
+	if l.Spillover < 0 || l.Spillover > 1 {
+		return errors.New("spillover must be between 0 and 1")
+	}
+	return nil
+}
+
+func (l LocalityPolicy) enabled() bool {
+	return l.Zone != "" || l.Region != ""
+}
+
+// SetLocality sets the NLB's locality, preferring modules near it
+func (r *Router) SetLocality(policy LocalityPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	r.localityMu.Lock()
+	defer r.localityMu.Unlock()
+	r.locality = policy
+	return nil
+}
+
+// localityTier returns the index in localityTiers of module's locality
+func (l LocalityPolicy) localityTier(module *ModuleEndpoint) int {
+	switch {
+	case l.Region != "" && module.Region != l.Region:
+		return 2
+	case l.Zone != "" && module.Zone == l.Zone:
+		return 0
+	case l.Region != "" && module.Region == l.Region:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Locality returns module's locality relative to the NLB, empty when
+// locality routing is disabled
+func (r *Router) Locality(module *ModuleEndpoint) string {
+	r.localityMu.RLock()
+	policy := r.locality
+	r.localityMu.RUnlock()
+
+	if !policy.enabled() {
+		return ""
+	}
+	return localityTiers[policy.localityTier(module)]
+}
+
+// selectNearest selects among modules by least connections within the
+// nearest locality that has a module with room, spilling over to the next
+// one by the policy's ratio
+func (r *Router) selectNearest(protocol Protocol, modules []*ModuleEndpoint) (*ModuleEndpoint, error) {
+	r.localityMu.RLock()
+	policy := r.locality
+	r.localityMu.RUnlock()
+
+	if !policy.enabled() {
+		return r.leastConnections(protocol, modules)
+	}
+
+	var tiers [3][]*ModuleEndpoint
+	nearest := len(tiers)
+	for _, module := range modules {
+		tier := policy.localityTier(module)
+		nearest = min(nearest, tier)
+		if module.GetActiveConns() < module.MaxConns {
+			tiers[tier] = append(tiers[tier], module)
+		}
+	}
+
+	var roomy []int
+	for tier := range tiers {
+		if len(tiers[tier]) > 0 {
+			roomy = append(roomy, tier)
+		}
+	}
+	if len(roomy) == 0 {
+		// Every module is full, let the capacity check refuse the connection
+		return r.leastConnections(protocol, modules)
+	}
+
+	chosen := roomy[0]
+	if chosen > nearest {
+		localitySpillover.WithLabelValues(protocol.String(), "capacity").Inc()
+	} else if len(roomy) > 1 && policy.Spillover > 0 && rand.Float64() < policy.Spillover {
+		chosen = roomy[1]
+		localitySpillover.WithLabelValues(protocol.String(), "ratio").Inc()
+	}
+	return r.leastConnections(protocol, tiers[chosen])
+}
+
+// byLocality orders modules nearest first, keeping their order within a
+// locality
+func (r *Router) byLocality(modules []*ModuleEndpoint) {
+	r.localityMu.RLock()
+	policy := r.locality
+	r.localityMu.RUnlock()
+
+	if !policy.enabled() {
+		return
+	}
+	sort.SliceStable(modules, func(i, j int) bool {
+		return policy.localityTier(modules[i]) < policy.localityTier(modules[j])
+	})
+}
@@ -0,0 +1,76 @@
+package nlb
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func localityRouter(t *testing.T, policy LocalityPolicy) *Router {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	router := NewRouter(logger)
+	if err := router.SetLocality(policy); err != nil {
+		t.Fatal(err)
+	}
+	for _, module := range []*ModuleEndpoint{
+		{Name: "alb-a1", Zone: "eu-west-1a", Region: "eu-west-1", MaxConns: 1},
+		{Name: "alb-b1", Zone: "eu-west-1b", Region: "eu-west-1", MaxConns: 10},
+		{Name: "alb-us", Zone: "us-east-1a", Region: "us-east-1", MaxConns: 10},
+	} {
+		module.Protocol = ProtocolHTTP
+		module.Healthy = true
+		if err := router.RegisterModule(module); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return router
+}
+
+func TestLocalityPrefersSameZone(t *testing.T) {
+	router := localityRouter(t, LocalityPolicy{Zone: "eu-west-1a", Region: "eu-west-1"})
+
+	module, err := router.RouteConnection(context.Background(), httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if module.Name != "alb-a1" || router.Locality(module) != LocalityZone {
+		t.Fatalf("Expected the same-zone module, got %s (%s)", module.Name, router.Locality(module))
+	}
+
+	// A full zone spills over to the region before leaving it
+	module, err = router.RouteConnection(context.Background(), httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if module.Name != "alb-b1" || router.Locality(module) != LocalityRegion {
+		t.Fatalf("Expected the same-region module, got %s (%s)", module.Name, router.Locality(module))
+	}
+}
+
+func TestLocalitySpillover(t *testing.T) {
+	router := localityRouter(t, LocalityPolicy{Zone: "eu-west-1a", Region: "eu-west-1", Spillover: 1})
+
+	module, err := router.RouteConnection(context.Background(), httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if module.Name != "alb-b1" {
+		t.Fatalf("Expected every connection spilled to the next zone, got %s", module.Name)
+	}
+
+	if err := router.SetLocality(LocalityPolicy{Zone: "eu-west-1a", Spillover: 1.5}); err == nil {
+		t.Error("Expected a spillover above 1 to be rejected")
+	}
+}
+
+func TestLocalityDisabled(t *testing.T) {
+	router := localityRouter(t, LocalityPolicy{})
+	module := router.GetModules(ProtocolHTTP)[2]
+	if locality := router.Locality(module); locality != "" {
+		t.Fatalf("Expected no locality without the NLB's zone, got %q", locality)
+	}
+}
@@ -0,0 +1,385 @@
+package nlb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	modgrpc "marchproxy-nlb/internal/grpc"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ModuleTypes is the inter-module topology: the module type that owns
+// each protocol the NLB detects. Protocols without an owner, such as
+// Kafka, are only routed to static modules.
+var ModuleTypes = map[Protocol]string{
+	ProtocolHTTP:       "alb",
+	ProtocolMySQL:      "dblb",
+	ProtocolPostgreSQL: "dblb",
+	ProtocolMongoDB:    "dblb",
+	ProtocolRedis:      "dblb",
+	ProtocolRTMP:       "rtmp",
+}
+
+// MeshModuleTypes returns the module types the NLB routes to, for
+// discovery
+func MeshModuleTypes() []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, moduleType := range ModuleTypes {
+		if !seen[moduleType] {
+			seen[moduleType] = true
+			types = append(types, moduleType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ownedProtocols returns the protocols a module type owns
+func ownedProtocols(moduleType string) []Protocol {
+	var protocols []Protocol
+	for protocol, owner := range ModuleTypes {
+		if owner == moduleType {
+			protocols = append(protocols, protocol)
+		}
+	}
+	sort.Slice(protocols, func(i, j int) bool { return protocols[i] < protocols[j] })
+	return protocols
+}
+
+var (
+	meshModules = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_mesh_modules",
+			Help: "Modules known to the mesh per module type and source",
+		},
+		[]string{"type", "source"},
+	)
+
+	meshForwards = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nlb_mesh_forwards_total",
+			Help: "Connections forwarded to modules over the mesh per protocol and result",
+		},
+		[]string{"protocol", "result"},
+	)
+
+	meshInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_mesh_in_flight",
+			Help: "Calls this NLB has in flight to each module, and waiting for a slot",
+		},
+		[]string{"module", "state"},
+	)
+
+	meshModuleQueued = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_mesh_module_queued",
+			Help: "Work waiting in each module for capacity, as the module last reported",
+		},
+		[]string{"module"},
+	)
+
+	meshModuleSaturated = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_mesh_module_saturated",
+			Help: "Whether new calls to each module are shed because it reports it is saturated",
+		},
+		[]string{"module"},
+	)
+)
+
+// Mesh connects the router to the modules over the gRPC client pool. It
+// keeps the router's modules and the pool's clients in line with the
+// modules discovered through the manager, marks modules healthy by their
+// gRPC health checks, and forwards routed connections to the owning module
+// with retries on the other modules of the protocol.
+type Mesh struct {
+	router   *Router
+	pool     *modgrpc.ClientPool
+	logger   *logrus.Logger
+	maxConns int
+
+	mu         sync.Mutex
+	static     []modgrpc.Endpoint
+	discovered map[string]modgrpc.Endpoint // By module name
+}
+
+// NewMesh creates a mesh registering discovered modules with router, each
+// accepting up to maxConns connections
+func NewMesh(router *Router, pool *modgrpc.ClientPool, maxConns int, logger *logrus.Logger) *Mesh {
+	return &Mesh{
+		router:     router,
+		pool:       pool,
+		logger:     logger,
+		maxConns:   maxConns,
+		discovered: make(map[string]modgrpc.Endpoint),
+	}
+}
+
+// AddStatic adds a module registered with the router from the config to
+// the pool, so connections routed to it go over the mesh too
+func (m *Mesh) AddStatic(module *ModuleEndpoint) {
+	if module.GRPCPort <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, endpoint := range m.static {
+		if endpoint.Name == module.Name {
+			return
+		}
+	}
+	m.static = append(m.static, modgrpc.Endpoint{
+		Name:    module.Name,
+		Type:    ModuleTypes[module.Protocol],
+		Address: module.Address,
+		Port:    module.GRPCPort,
+		Zone:    module.Zone,
+		Region:  module.Region,
+	})
+	m.pool.Sync(m.endpointsLocked())
+	meshModules.WithLabelValues(ModuleTypes[module.Protocol], "static").Inc()
+}
+
+// Apply makes the discovered modules those of endpoints: new modules are
+// registered with the router for every protocol their type owns, and
+// modules gone or moved are unregistered
+func (m *Mesh) Apply(endpoints []modgrpc.Endpoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[string]modgrpc.Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		if len(ownedProtocols(endpoint.Type)) == 0 {
+			m.logger.WithField("module", endpoint.Name).Warnf("Ignoring module of unknown type %q", endpoint.Type)
+			continue
+		}
+		wanted[endpoint.Name] = endpoint
+	}
+
+	for name, old := range m.discovered {
+		if endpoint, ok := wanted[name]; ok && endpoint == old {
+			continue
+		}
+		for _, protocol := range ownedProtocols(old.Type) {
+			m.router.UnregisterModule(protocol, name)
+		}
+		delete(m.discovered, name)
+		deleteModuleGauges(name)
+	}
+	for name, endpoint := range wanted {
+		if _, ok := m.discovered[name]; ok {
+			continue
+		}
+		for _, protocol := range ownedProtocols(endpoint.Type) {
+			if err := m.router.RegisterModule(&ModuleEndpoint{
+				Name:        endpoint.Name,
+				Protocol:    protocol,
+				Address:     endpoint.Address,
+				GRPCPort:    endpoint.Port,
+				Healthy:     true,
+				MaxConns:    m.maxConns,
+				Weight:      1,
+				Zone:        endpoint.Zone,
+				Region:      endpoint.Region,
+				LastHealthy: time.Now(),
+			}); err != nil {
+				m.logger.WithError(err).WithField("module", name).Warn("Failed to register discovered module")
+			}
+		}
+		m.discovered[name] = endpoint
+	}
+
+	m.pool.Sync(m.endpointsLocked())
+
+	counts := make(map[string]int)
+	for _, endpoint := range m.discovered {
+		counts[endpoint.Type]++
+	}
+	for _, moduleType := range MeshModuleTypes() {
+		meshModules.WithLabelValues(moduleType, "discovered").Set(float64(counts[moduleType]))
+	}
+}
+
+// deleteModuleGauges removes the load gauges of a module that is gone
+func deleteModuleGauges(name string) {
+	meshInFlight.DeleteLabelValues(name, "active")
+	meshInFlight.DeleteLabelValues(name, "waiting")
+	meshModuleQueued.DeleteLabelValues(name)
+	meshModuleSaturated.DeleteLabelValues(name)
+}
+
+// endpointsLocked returns the static and discovered modules
+func (m *Mesh) endpointsLocked() []modgrpc.Endpoint {
+	endpoints := append([]modgrpc.Endpoint{}, m.static...)
+	for _, endpoint := range m.discovered {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// RunDiscovery applies the modules discover returns every interval until
+// ctx is done. Failed discoveries keep the modules last discovered.
+func (m *Mesh) RunDiscovery(ctx context.Context, interval time.Duration, discover func(context.Context) ([]modgrpc.Endpoint, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		endpoints, err := discover(ctx)
+		if err != nil {
+			m.logger.WithError(err).Warn("Module discovery failed, keeping the known modules")
+		} else {
+			m.Apply(endpoints)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunHealthChecks checks every module's gRPC health through the mesh every
+// interval until ctx is done
+func (m *Mesh) RunHealthChecks(ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.CheckHealth(ctx, timeout)
+		}
+	}
+}
+
+// CheckHealth marks each module healthy in the router when it answers its
+// gRPC health check with SERVING. Modules whose circuit breaker is open
+// are unhealthy until a trial check succeeds.
+func (m *Mesh) CheckHealth(ctx context.Context, timeout time.Duration) {
+	m.mu.Lock()
+	endpoints := m.endpointsLocked()
+	m.mu.Unlock()
+
+	failures := make(map[string]error, len(endpoints))
+	for _, endpoint := range endpoints {
+		// Probes reach saturated modules too, refreshing their load reports
+		err := m.pool.Probe(ctx, endpoint.Name, func(ctx context.Context, name string, conn *grpc.ClientConn) error {
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			resp, err := healthpb.NewHealthClient(conn).Check(checkCtx, &healthpb.HealthCheckRequest{})
+			if err != nil {
+				return err
+			}
+			if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+				return fmt.Errorf("module %s is %s", name, resp.GetStatus())
+			}
+			return nil
+		})
+		failures[endpoint.Name] = err
+
+		if window, ok := m.pool.Window(endpoint.Name); ok {
+			meshInFlight.WithLabelValues(endpoint.Name, "active").Set(float64(window.InFlight))
+			meshInFlight.WithLabelValues(endpoint.Name, "waiting").Set(float64(window.Waiting))
+			meshModuleQueued.WithLabelValues(endpoint.Name).Set(float64(window.Report.Queued))
+			saturated := 0.0
+			if window.Saturated {
+				saturated = 1
+			}
+			meshModuleSaturated.WithLabelValues(endpoint.Name).Set(saturated)
+		}
+	}
+
+	for _, modules := range m.router.GetAllModules() {
+		for _, module := range modules {
+			err, checked := failures[module.Name]
+			if !checked || module.IsHealthy() == (err == nil) {
+				continue
+			}
+			module.SetHealthy(err == nil)
+			if err == nil {
+				m.logger.WithField("module", module.Name).Info("Module passed its health check")
+			} else {
+				m.logger.WithError(err).WithField("module", module.Name).Warn("Module failed its health check")
+			}
+		}
+	}
+}
+
+// Forward routes a connection by its first bytes, then makes call to the
+// owning module over the mesh, retrying on the protocol's other healthy
+// modules, nearest first, when the module is unreachable, saturated or its
+// breaker is open. The call holds a slot of the module's concurrency window
+// while it runs, so it should last as long as the connection it relays. It
+// returns the module that answered, whose connection must be released with
+// the router's CloseConnection. Connections shed because every module is
+// busy fail with ResourceExhausted.
+func (m *Mesh) Forward(ctx context.Context, data []byte, call func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error) (*ModuleEndpoint, error) {
+	chosen, err := m.router.RouteConnection(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	protocol := chosen.Protocol.String()
+
+	// The routed module first, then the others nearest first in least
+	// connections order
+	candidates := []*ModuleEndpoint{chosen}
+	others := m.router.GetModules(chosen.Protocol)
+	sort.SliceStable(others, func(i, j int) bool { return others[i].GetActiveConns() < others[j].GetActiveConns() })
+	m.router.byLocality(others)
+	for _, module := range others {
+		if module != chosen && module.IsHealthy() && !module.IsEjected() && !m.router.isDrained(module) {
+			candidates = append(candidates, module)
+		}
+	}
+	byName := make(map[string]*ModuleEndpoint, len(candidates))
+	names := make([]string, 0, len(candidates))
+	for _, module := range candidates {
+		byName[module.Name] = module
+		names = append(names, module.Name)
+	}
+
+	answered := chosen
+	_, err = m.pool.Invoke(ctx, names, func(ctx context.Context, name string, conn *grpc.ClientConn) error {
+		// Move the connection to the module tried
+		module := byName[name]
+		if module != answered {
+			if err := module.IncrementConns(); err != nil {
+				return status.Error(codes.ResourceExhausted, err.Error())
+			}
+			answered.DecrementConns()
+			answered = module
+		}
+		return call(ctx, module, conn)
+	})
+	if status.Code(err) == codes.ResourceExhausted {
+		// Busy modules are not failing, so they are not ejected
+		meshForwards.WithLabelValues(protocol, "shed").Inc()
+		m.router.CloseConnection(answered, CloseError)
+		return nil, fmt.Errorf("shedding %s connection: %w", protocol, err)
+	}
+	if err != nil {
+		meshForwards.WithLabelValues(protocol, "failed").Inc()
+		m.router.ReportFailure(answered, "mesh_unavailable")
+		m.router.CloseConnection(answered, CloseError)
+		return nil, fmt.Errorf("forwarding %s connection: %w", protocol, err)
+	}
+	if answered != chosen {
+		meshForwards.WithLabelValues(protocol, "retried").Inc()
+	} else {
+		meshForwards.WithLabelValues(protocol, "forwarded").Inc()
+	}
+	return answered, nil
+}
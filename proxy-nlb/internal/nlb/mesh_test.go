@@ -0,0 +1,286 @@
+package nlb
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	modgrpc "marchproxy-nlb/internal/grpc"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func startMesh(t *testing.T, options modgrpc.MeshOptions, names ...string) (*Mesh, *Router, *modgrpc.ClientPool, []modgrpc.Endpoint) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	var endpoints []modgrpc.Endpoint
+	for _, name := range names {
+		addr, _ := startGRPCBackend(t, name)
+		host, port, _ := net.SplitHostPort(addr)
+		portNum, _ := strconv.Atoi(port)
+		endpoints = append(endpoints, modgrpc.Endpoint{Name: name, Type: "alb", Address: host, Port: portNum})
+	}
+
+	router := NewRouter(logger)
+	pool := modgrpc.NewMeshPool(options, logger)
+	t.Cleanup(func() { pool.Close() })
+	mesh := NewMesh(router, pool, 10, logger)
+	mesh.Apply(endpoints)
+	return mesh, router, pool, endpoints
+}
+
+func breakerState(pool *modgrpc.ClientPool, name string) string {
+	clients := pool.GetStats()["clients"].(map[string]interface{})
+	return clients[name].(map[string]interface{})["breaker"].(string)
+}
+
+var httpRequest = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+func TestMeshApply(t *testing.T) {
+	mesh, router, pool, endpoints := startMesh(t, modgrpc.MeshOptions{}, "alb-a", "alb-b")
+
+	if got := len(router.GetModules(ProtocolHTTP)); got != 2 {
+		t.Fatalf("HTTP modules = %d, want 2", got)
+	}
+	if got := pool.GetStats()["total_clients"]; got != 2 {
+		t.Fatalf("pool clients = %v, want 2", got)
+	}
+
+	// A module that is gone is unregistered and its client removed; a
+	// module of an unknown type is ignored
+	mesh.Apply([]modgrpc.Endpoint{endpoints[1], {Name: "other", Type: "egress", Address: "127.0.0.1", Port: 1}})
+	modules := router.GetModules(ProtocolHTTP)
+	if len(modules) != 1 || modules[0].Name != "alb-b" {
+		t.Fatalf("HTTP modules after removal = %v", modules)
+	}
+	if got := pool.GetStats()["total_clients"]; got != 1 {
+		t.Fatalf("pool clients after removal = %v, want 1", got)
+	}
+}
+
+func TestMeshForwardRetriesAndBreaks(t *testing.T) {
+	mesh, router, pool, _ := startMesh(t, modgrpc.MeshOptions{
+		Retries:          1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	}, "alb-a", "alb-b")
+
+	// alb-a is overloaded, alb-b answers
+	tried := map[string]int{}
+	call := func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error {
+		tried[module.Name]++
+		if module.Name == "alb-a" {
+			return status.Error(codes.Unavailable, "overloaded")
+		}
+		return nil
+	}
+	for i := 0; i < 4; i++ {
+		module, err := mesh.Forward(context.Background(), httpRequest, call)
+		if err != nil {
+			t.Fatalf("Forward %d: %v", i, err)
+		}
+		if module.Name != "alb-b" {
+			t.Fatalf("Forward %d answered by %s, want alb-b", i, module.Name)
+		}
+	}
+	if tried["alb-a"] != 2 {
+		t.Errorf("alb-a tried %d times, want 2 before its breaker opened", tried["alb-a"])
+	}
+	if got := breakerState(pool, "alb-a"); got != "open" {
+		t.Errorf("alb-a breaker = %s, want open", got)
+	}
+
+	// Retried connections are counted against the module that answered
+	for _, module := range router.GetModules(ProtocolHTTP) {
+		want := 0
+		if module.Name == "alb-b" {
+			want = 4
+		}
+		if got := module.GetActiveConns(); got != want {
+			t.Errorf("%s active connections = %d, want %d", module.Name, got, want)
+		}
+	}
+
+	// A module with an open breaker fails its health check
+	mesh.CheckHealth(context.Background(), time.Second)
+	for _, module := range router.GetModules(ProtocolHTTP) {
+		if want := module.Name == "alb-b"; module.IsHealthy() != want {
+			t.Errorf("%s healthy = %v, want %v", module.Name, module.IsHealthy(), want)
+		}
+	}
+}
+
+func TestMeshForwardFails(t *testing.T) {
+	mesh, router, _, _ := startMesh(t, modgrpc.MeshOptions{Retries: 1}, "alb-a", "alb-b")
+
+	// Rejections by the module are not retried
+	tried := 0
+	_, err := mesh.Forward(context.Background(), httpRequest, func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error {
+		tried++
+		return status.Error(codes.PermissionDenied, "denied")
+	})
+	if status.Code(err) != codes.PermissionDenied || tried != 1 {
+		t.Fatalf("Forward = %v after %d calls, want PermissionDenied after 1", err, tried)
+	}
+	for _, module := range router.GetModules(ProtocolHTTP) {
+		if module.GetActiveConns() != 0 {
+			t.Errorf("%s kept a failed connection", module.Name)
+		}
+	}
+}
+
+func TestMeshCheckHealth(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	addr, healthServer := startGRPCBackend(t, "alb-a")
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	router := NewRouter(logger)
+	pool := modgrpc.NewMeshPool(modgrpc.MeshOptions{}, logger)
+	defer pool.Close()
+	mesh := NewMesh(router, pool, 10, logger)
+	mesh.Apply([]modgrpc.Endpoint{{Name: "alb-a", Type: "alb", Address: host, Port: portNum}})
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	mesh.CheckHealth(context.Background(), time.Second)
+	if router.GetModules(ProtocolHTTP)[0].IsHealthy() {
+		t.Fatal("NOT_SERVING module still healthy")
+	}
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	mesh.CheckHealth(context.Background(), time.Second)
+	if !router.GetModules(ProtocolHTTP)[0].IsHealthy() {
+		t.Fatal("SERVING module still unhealthy")
+	}
+}
+
+func TestMeshForwardWindow(t *testing.T) {
+	mesh, router, _, _ := startMesh(t, modgrpc.MeshOptions{MaxInFlight: 1}, "alb-a")
+
+	// A relayed connection holds the module's only slot until it ends
+	started, finish := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		module, err := mesh.Forward(context.Background(), httpRequest, func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error {
+			close(started)
+			<-finish
+			return nil
+		})
+		if err == nil {
+			router.CloseConnection(module, CloseClientEOF)
+		}
+		done <- err
+	}()
+	<-started
+
+	ok := func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error { return nil }
+	if _, err := mesh.Forward(context.Background(), httpRequest, ok); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Forward with a full window = %v, want ResourceExhausted", err)
+	}
+	if module := router.GetModules(ProtocolHTTP)[0]; !module.IsHealthy() || module.IsEjected() || module.GetActiveConns() != 1 {
+		t.Fatalf("shed connection changed the module: healthy %v, ejected %v, %d connections", module.IsHealthy(), module.IsEjected(), module.GetActiveConns())
+	}
+
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mesh.Forward(context.Background(), httpRequest, ok); err != nil {
+		t.Fatalf("Forward after the slot freed: %v", err)
+	}
+}
+
+func TestMeshForwardQueues(t *testing.T) {
+	mesh, _, _, _ := startMesh(t, modgrpc.MeshOptions{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 5 * time.Second}, "alb-a")
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	go mesh.Forward(context.Background(), httpRequest, func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error {
+		close(started)
+		<-finish
+		return nil
+	})
+	<-started
+
+	// The second connection waits for the slot instead of being shed
+	time.AfterFunc(50*time.Millisecond, func() { close(finish) })
+	start := time.Now()
+	if _, err := mesh.Forward(context.Background(), httpRequest, func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error {
+		return nil
+	}); err != nil {
+		t.Fatalf("queued Forward: %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("queued Forward did not wait for the slot")
+	}
+}
+
+// startLoadedBackend starts a module reporting the load in inFlight
+// against a limit of 10 on every response
+func startLoadedBackend(t *testing.T, inFlight *atomic.Int64) modgrpc.Endpoint {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		grpc.SetHeader(ctx, metadata.Pairs(
+			modgrpc.LoadInFlightHeader, strconv.FormatInt(inFlight.Load(), 10),
+			modgrpc.LoadLimitHeader, "10",
+		))
+		return handler(ctx, req)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(report))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return modgrpc.Endpoint{Name: "dblb-a", Type: "dblb", Address: host, Port: portNum}
+}
+
+func TestMeshShedsSaturatedModule(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	var inFlight atomic.Int64
+	endpoint := startLoadedBackend(t, &inFlight)
+
+	router := NewRouter(logger)
+	pool := modgrpc.NewMeshPool(modgrpc.MeshOptions{}, logger)
+	defer pool.Close()
+	mesh := NewMesh(router, pool, 10, logger)
+	mesh.Apply([]modgrpc.Endpoint{endpoint})
+
+	redis := []byte("*1\r\n$4\r\nPING\r\n")
+	ok := func(ctx context.Context, module *ModuleEndpoint, conn *grpc.ClientConn) error { return nil }
+
+	// Health checks carry the module's load report
+	inFlight.Store(10)
+	mesh.CheckHealth(context.Background(), time.Second)
+	if window, _ := pool.Window("dblb-a"); !window.Saturated {
+		t.Fatalf("module at its limit not saturated: %+v", window)
+	}
+	if _, err := mesh.Forward(context.Background(), redis, ok); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Forward to a saturated module = %v, want ResourceExhausted", err)
+	}
+	if !router.GetModules(ProtocolRedis)[0].IsHealthy() {
+		t.Fatal("saturated module marked unhealthy")
+	}
+
+	inFlight.Store(3)
+	mesh.CheckHealth(context.Background(), time.Second)
+	if _, err := mesh.Forward(context.Background(), redis, ok); err != nil {
+		t.Fatalf("Forward once the module has room: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package nlb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Failure reasons reported by the data plane for a routed connection
+const (
+	FailureServerError       = "server_error"       // Module answered with an error
+	FailureConnectionRefused = "connection_refused" // Connect refused, reset or otherwise failed
+	FailureTimeout           = "timeout"            // Connect or response timeout
+)
+
+var passiveEjections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "nlb_passive_ejections_total",
+		Help: "Total number of modules ejected after failures on live traffic",
+	},
+	[]string{"protocol", "module", "reason"},
+)
+
+// OutlierConfig controls passive ejection of modules that keep failing live
+// traffic. A module with FailureThreshold failures within Window stops
+// receiving connections for EjectionTime.
+type OutlierConfig struct {
+	FailureThreshold int // 0 disables passive ejection
+	Window           time.Duration
+	EjectionTime     time.Duration
+}
+
+// Validate checks the outlier settings
+func (o OutlierConfig) Validate() error {
+	if o.FailureThreshold < 0 {
+		return errors.New("failure threshold must not be negative")
+	}
+	if o.FailureThreshold > 0 && (o.Window <= 0 || o.EjectionTime <= 0) {
+		return errors.New("window and ejection time must be positive")
+	}
+	return nil
+}
+
+// IsEjected reports whether the module is sitting out an ejection
+func (m *ModuleEndpoint) IsEjected() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return time.Now().Before(m.ejectedUntil)
+}
+
+// recordFailure adds a failure to the module's window and reports whether
+// it crossed the threshold and has been ejected
+func (m *ModuleEndpoint) recordFailure(outlier OutlierConfig) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(m.ejectedUntil) {
+		return false
+	}
+
+	cutoff := now.Add(-outlier.Window)
+	recent := m.failures[:0]
+	for _, at := range m.failures {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	m.failures = append(recent, now)
+
+	if len(m.failures) < outlier.FailureThreshold {
+		return false
+	}
+
+	m.failures = m.failures[:0]
+	m.ejectedUntil = now.Add(outlier.EjectionTime)
+	return true
+}
+
+// SetOutlierDetection sets the passive ejection settings for all modules
+func (r *Router) SetOutlierDetection(outlier OutlierConfig) error {
+	if err := outlier.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outlier = outlier
+	return nil
+}
+
+// ReportFailure records a failure the data plane saw on a connection routed
+// to module. Ejected modules are skipped by routing until their ejection
+// time has passed, so a failing module is taken out within seconds instead
+// of waiting for its next health check.
+func (r *Router) ReportFailure(module *ModuleEndpoint, reason string) {
+	r.mu.RLock()
+	outlier := r.outlier
+	r.mu.RUnlock()
+
+	if outlier.FailureThreshold <= 0 || !module.recordFailure(outlier) {
+		return
+	}
+
+	passiveEjections.WithLabelValues(module.Protocol.String(), module.Name, reason).Inc()
+	r.logger.WithFields(logrus.Fields{
+		"module":   module.Name,
+		"protocol": module.Protocol.String(),
+		"reason":   reason,
+		"duration": outlier.EjectionTime,
+	}).Warn("Module ejected after live traffic failures")
+}
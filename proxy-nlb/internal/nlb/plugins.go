@@ -0,0 +1,169 @@
+package nlb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"marchproxy-nlb/pkg/nlbplugin"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pluginProtocolBase is the first Protocol given to plugins, clear of the
+// built-in protocols
+const pluginProtocolBase Protocol = 1000
+
+// errPluginDenied marks connections a plugin handler refused
+var errPluginDenied = errors.New("refused by protocol plugin")
+
+// Protocol plugins in detection order. Protocols are process-wide, like the
+// built-in ones, so plugins are too.
+var (
+	plugins   []*nlbplugin.Plugin
+	pluginsMu sync.RWMutex
+)
+
+// RegisterPlugin adds a protocol plugin and returns the protocol its
+// connections are routed as. Plugins detect before the built-in protocols,
+// in the order they were registered.
+func RegisterPlugin(p *nlbplugin.Plugin) (Protocol, error) {
+	if err := p.Validate(); err != nil {
+		return ProtocolUnknown, err
+	}
+	if builtin := builtinProtocol(p.Name); builtin != ProtocolUnknown {
+		return ProtocolUnknown, fmt.Errorf("plugin %s shadows the built-in %s protocol", p.Name, builtin)
+	}
+
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	for _, existing := range plugins {
+		if existing.Name == p.Name {
+			return ProtocolUnknown, fmt.Errorf("plugin %s already registered", p.Name)
+		}
+	}
+	plugins = append(plugins, p)
+	return pluginProtocolBase + Protocol(len(plugins)-1), nil
+}
+
+// LoadPlugins registers the compiled-in plugins and then the shared-object
+// plugins at paths, in order
+func LoadPlugins(paths []string, logger *logrus.Logger) error {
+	all := nlbplugin.Registered()
+	for _, path := range paths {
+		p, err := nlbplugin.Load(path)
+		if err != nil {
+			return err
+		}
+		all = append(all, p)
+	}
+
+	for _, p := range all {
+		protocol, err := RegisterPlugin(p)
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{
+			"plugin":   p.Name,
+			"protocol": int(protocol),
+			"handler":  p.Handler != nil,
+		}).Info("Protocol plugin registered")
+	}
+	return nil
+}
+
+// PluginProtocol returns the protocol of a registered plugin by name, or
+// ProtocolUnknown
+func PluginProtocol(name string) Protocol {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	for i, p := range plugins {
+		if p.Name == name {
+			return pluginProtocolBase + Protocol(i)
+		}
+	}
+	return ProtocolUnknown
+}
+
+// pluginFor returns the plugin of a protocol, nil for built-in protocols
+func pluginFor(protocol Protocol) *nlbplugin.Plugin {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	i := int(protocol - pluginProtocolBase)
+	if i < 0 || i >= len(plugins) {
+		return nil
+	}
+	return plugins[i]
+}
+
+// pluginHandler returns the handler of a plugin protocol, if it has one
+func pluginHandler(protocol Protocol) nlbplugin.Handler {
+	if p := pluginFor(protocol); p != nil {
+		return p.Handler
+	}
+	return nil
+}
+
+// detectPlugin returns the protocol of the first plugin recognising data
+func detectPlugin(data []byte) Protocol {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	for i, p := range plugins {
+		if len(data) >= p.MinBytes && p.Detector.Detect(data) {
+			return pluginProtocolBase + Protocol(i)
+		}
+	}
+	return ProtocolUnknown
+}
+
+// builtinProtocol returns the built-in protocol a plugin name would clash with
+func builtinProtocol(name string) Protocol {
+	for p := ProtocolHTTP; p.String() != "Unknown"; p++ {
+		if strings.EqualFold(p.String(), name) {
+			return p
+		}
+	}
+	return ProtocolUnknown
+}
+
+// selectPluginModule lets a plugin handler choose among the available
+// modules, falling back to least connections when it has no preference
+func (r *Router) selectPluginModule(ctx context.Context, handler nlbplugin.Handler, protocol Protocol, geoRoute *GeoRoute, data []byte) (*ModuleEndpoint, error) {
+	candidates, err := r.availableModules(protocol, geoRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := make([]nlbplugin.Module, len(candidates))
+	for i, m := range candidates {
+		m.mu.RLock()
+		modules[i] = nlbplugin.Module{
+			Name:        m.Name,
+			Address:     m.Address,
+			Version:     m.Version,
+			Weight:      m.Weight,
+			ActiveConns: m.ActiveConns,
+			MaxConns:    m.MaxConns,
+		}
+		m.mu.RUnlock()
+	}
+
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	conn := nlbplugin.Connection{ClientAddr: addr, Data: data}
+	name, err := handler.SelectModule(ctx, conn, modules)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errPluginDenied, err)
+	}
+	if name == "" {
+		return r.selectNearest(protocol, candidates)
+	}
+	for _, m := range candidates {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("plugin for protocol %s selected unavailable module %s", protocol, name)
+}
@@ -0,0 +1,128 @@
+package nlb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"marchproxy-nlb/pkg/nlbplugin"
+
+	"github.com/sirupsen/logrus"
+)
+
+type prefixDetector []byte
+
+func (p prefixDetector) Detect(data []byte) bool { return bytes.HasPrefix(data, p) }
+
+// tenantHandler routes RESP "tenant <name>" commands to the module named
+// after the tenant and refuses the "blocked" tenant
+type tenantHandler struct {
+	clientAddr net.Addr
+}
+
+func (h *tenantHandler) SelectModule(ctx context.Context, conn nlbplugin.Connection, modules []nlbplugin.Module) (string, error) {
+	h.clientAddr = conn.ClientAddr
+	tenant := string(bytes.Split(conn.Data, []byte("\r\n"))[4])
+	if tenant == "blocked" {
+		return "", errors.New("tenant blocked")
+	}
+	for _, m := range modules {
+		if m.Name == tenant {
+			return m.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// tenantCommand encodes "tenant <name>" as a RESP array
+func tenantCommand(name string) []byte {
+	return []byte("*2\r\n$6\r\ntenant\r\n$" + strconv.Itoa(len(name)) + "\r\n" + name + "\r\n")
+}
+
+func TestProtocolPlugin(t *testing.T) {
+	handler := &tenantHandler{}
+	protocol, err := RegisterPlugin(&nlbplugin.Plugin{
+		APIVersion: nlbplugin.APIVersion,
+		Name:       "tenant-resp",
+		MinBytes:   16,
+		Detector:   prefixDetector("*2\r\n$6\r\ntenant\r\n"),
+		Handler:    handler,
+	})
+	if err != nil {
+		t.Fatalf("RegisterPlugin: %v", err)
+	}
+	if protocol.String() != "tenant-resp" || PluginProtocol("tenant-resp") != protocol {
+		t.Fatalf("protocol %d is named %s", protocol, protocol)
+	}
+
+	// Plugins detect before the built-in Redis check
+	inspector := NewProtocolInspector()
+	if got, _ := inspector.InspectProtocol(tenantCommand("a")); got != protocol {
+		t.Errorf("plugin command detected as %s", got)
+	}
+	if got, _ := inspector.InspectProtocol([]byte("*1\r\n$4\r\nPING\r\n")); got != ProtocolRedis {
+		t.Errorf("other RESP command detected as %s", got)
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	router := NewRouter(logger)
+	for _, name := range []string{"a", "b"} {
+		if err := router.RegisterModule(&ModuleEndpoint{Name: name, Protocol: protocol, Healthy: true, MaxConns: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make "a" the least loaded so a handler choice of "b" is visible
+	if _, err := router.RouteConnection(context.Background(), tenantCommand("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}
+	ctx := WithClientAddr(context.Background(), client)
+	module, err := router.RouteConnection(ctx, tenantCommand("b"))
+	if err != nil || module.Name != "b" {
+		t.Errorf("handler choice routed to %v, %v", module, err)
+	}
+	if handler.clientAddr != client {
+		t.Errorf("handler saw client %v", handler.clientAddr)
+	}
+
+	// No preference falls back to least connections
+	if module, err := router.RouteConnection(ctx, tenantCommand("other")); err != nil || module.Name != "a" {
+		t.Errorf("fallback routed to %v, %v", module, err)
+	}
+
+	if _, err := router.RouteConnection(ctx, tenantCommand("blocked")); !errors.Is(err, errPluginDenied) {
+		t.Errorf("refused connection returned %v", err)
+	}
+}
+
+func TestRegisterPluginRejects(t *testing.T) {
+	valid := func() *nlbplugin.Plugin {
+		return &nlbplugin.Plugin{APIVersion: nlbplugin.APIVersion, Name: "rejects", Detector: prefixDetector("x")}
+	}
+	if _, err := RegisterPlugin(valid()); err != nil {
+		t.Fatalf("RegisterPlugin: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *nlbplugin.Plugin)
+	}{
+		{"duplicate name", func(p *nlbplugin.Plugin) {}},
+		{"built-in name", func(p *nlbplugin.Plugin) { p.Name = "mysql" }},
+		{"other API version", func(p *nlbplugin.Plugin) { p.Name = "v2"; p.APIVersion = nlbplugin.APIVersion + 1 }},
+		{"no detector", func(p *nlbplugin.Plugin) { p.Name = "nodetect"; p.Detector = nil }},
+		{"invalid name", func(p *nlbplugin.Plugin) { p.Name = "Has Space" }},
+	}
+	for _, tt := range tests {
+		p := valid()
+		tt.modify(p)
+		if _, err := RegisterPlugin(p); err == nil {
+			t.Errorf("%s: plugin was registered", tt.name)
+		}
+	}
+}
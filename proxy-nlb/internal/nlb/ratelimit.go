@@ -5,6 +5,8 @@ import (
 	"sync"
 	"time"
 
+	"marchproxy-shared/coordination"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
@@ -46,6 +48,7 @@ type TokenBucket struct {
 	name          string        // Bucket identifier
 	protocol      Protocol
 	logger        *logrus.Logger
+	consumed      float64       // Tokens taken since the last share with other replicas
 }
 
 // NewTokenBucket creates a new token bucket rate limiter
@@ -79,6 +82,7 @@ func (tb *TokenBucket) AllowN(n float64) bool {
 
 	if tb.tokens >= n {
 		tb.tokens -= n
+		tb.consumed += n
 		rateLimitTokens.WithLabelValues(tb.protocol.String(), tb.name).Set(tb.tokens)
 		rateLimitAllowed.WithLabelValues(tb.protocol.String(), tb.name).Inc()
 		return true
@@ -102,6 +106,27 @@ func (tb *TokenBucket) refill() {
 	tb.lastRefill = now
 }
 
+// Drain removes n tokens taken by other replicas sharing the bucket
+func (tb *TokenBucket) Drain(n float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	tb.tokens -= min64(tb.tokens, n)
+	rateLimitTokens.WithLabelValues(tb.protocol.String(), tb.name).Set(tb.tokens)
+}
+
+// takeConsumed returns the whole tokens taken since the last call, keeping
+// the fraction for the next one
+func (tb *TokenBucket) takeConsumed() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	whole := int64(tb.consumed)
+	tb.consumed -= float64(whole)
+	return whole
+}
+
 // GetAvailableTokens returns current available tokens
 func (tb *TokenBucket) GetAvailableTokens() float64 {
 	tb.mu.Lock()
@@ -185,6 +210,50 @@ func (rl *RateLimiter) AllowN(bucketName string, n float64) bool {
 	return bucket.AllowN(n)
 }
 
+// sharedCounterPrefix names the shared counter of a bucket
+const sharedCounterPrefix = "nlb/ratelimit/"
+
+// SyncShared shares the tokens taken from each bucket with the other
+// replicas through counters, and drains what they took from the local
+// buckets, so every replica enforces the bucket's rate cluster-wide
+func (rl *RateLimiter) SyncShared(ctx context.Context, counters *coordination.Counters) error {
+	rl.mu.RLock()
+	buckets := make(map[string]*TokenBucket, len(rl.buckets))
+	for name, bucket := range rl.buckets {
+		buckets[name] = bucket
+	}
+	rl.mu.RUnlock()
+
+	for name, bucket := range buckets {
+		counters.Add(sharedCounterPrefix+name, bucket.takeConsumed())
+	}
+	others, err := counters.Sync(ctx)
+	if err != nil {
+		return err
+	}
+	for name, bucket := range buckets {
+		if n := others[sharedCounterPrefix+name]; n > 0 {
+			bucket.Drain(float64(n))
+		}
+	}
+	return nil
+}
+
+// Share runs SyncShared every interval until ctx is done
+func (rl *RateLimiter) Share(ctx context.Context, counters *coordination.Counters, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.SyncShared(ctx, counters)
+		}
+	}
+}
+
 // AllowWithContext checks rate limit with context support
 func (rl *RateLimiter) AllowWithContext(ctx context.Context, bucketName string) bool {
 	select {
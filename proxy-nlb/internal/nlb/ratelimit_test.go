@@ -0,0 +1,67 @@
+package nlb
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"marchproxy-shared/coordination"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sharedStore holds counters for replicas in one process
+type sharedStore struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (s *sharedStore) Acquire(ctx context.Context, name string, ttl time.Duration) (coordination.Lease, error) {
+	return coordination.Lease{}, nil
+}
+
+func (s *sharedStore) Release(ctx context.Context, name string) error {
+	return nil
+}
+
+func (s *sharedStore) Add(ctx context.Context, increments map[string]int64) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make(map[string]int64)
+	for name, n := range increments {
+		s.counters[name] += n
+		totals[name] = s.counters[name]
+	}
+	return totals, nil
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store := &sharedStore{counters: make(map[string]int64)}
+
+	replicas := make([]*RateLimiter, 2)
+	counters := make([]*coordination.Counters, 2)
+	for i := range replicas {
+		replicas[i] = NewRateLimiter(logger)
+		replicas[i].AddBucket("shared-http", ProtocolHTTP, 100, 0.001)
+		counters[i] = coordination.NewCounters(store, logger)
+		replicas[i].SyncShared(context.Background(), counters[i])
+	}
+
+	// Tokens taken on one replica are drained from the other at the next sync
+	if !replicas[0].AllowN("shared-http", 60) {
+		t.Fatal("Expected 60 tokens to be allowed")
+	}
+	replicas[0].SyncShared(context.Background(), counters[0])
+	replicas[1].SyncShared(context.Background(), counters[1])
+
+	if replicas[1].AllowN("shared-http", 60) {
+		t.Error("Expected the other replica to see the shared bucket drained")
+	}
+	if !replicas[1].AllowN("shared-http", 30) {
+		t.Error("Expected the remaining tokens to be allowed")
+	}
+}
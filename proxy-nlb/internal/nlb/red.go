@@ -0,0 +1,86 @@
+package nlb
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RED metrics shared by every MarchProxy module. Each module reports its
+// unit of work (a routing decision here) with the same names and labels so
+// dashboards and alerts can be written once for the whole fleet.
+const (
+	redModule        = "nlb"
+	redDefaultTenant = "default"
+)
+
+// redLabels are the shared label conventions: module, route, backend, tenant
+var redLabels = []string{"module", "route", "backend", "tenant"}
+
+// redDurationBuckets are the latency bounds used by every module in seconds
+var redDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	redRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_requests_total",
+			Help: "Requests handled per module, route, backend and tenant",
+		},
+		redLabels,
+	)
+
+	redErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "marchproxy_request_errors_total",
+			Help: "Failed requests per module, route, backend, tenant and reason",
+		},
+		append(redLabels[:len(redLabels):len(redLabels)], "reason"),
+	)
+
+	redDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "marchproxy_request_duration_seconds",
+			Help:    "Request latency per module, route, backend and tenant",
+			Buckets: redDurationBuckets,
+		},
+		redLabels,
+	)
+)
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context carrying the trace ID of the request being
+// routed, so its latency sample can link back to the trace
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// traceIDFromContext returns the trace ID set by WithTraceID, if any
+func traceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// observeRequest records one routing decision. An empty reason marks
+// success; a trace ID carried by ctx is attached to the latency sample as
+// an exemplar.
+func observeRequest(ctx context.Context, route, backend, reason string, duration time.Duration) {
+	if backend == "" {
+		backend = "none"
+	}
+
+	redRequests.WithLabelValues(redModule, route, backend, redDefaultTenant).Inc()
+	if reason != "" {
+		redErrors.WithLabelValues(redModule, route, backend, redDefaultTenant, reason).Inc()
+	}
+
+	traceID := traceIDFromContext(ctx)
+	observer := redDuration.WithLabelValues(redModule, route, backend, redDefaultTenant)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		exemplarObserver.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(duration.Seconds())
+}
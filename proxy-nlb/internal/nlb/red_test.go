@@ -0,0 +1,138 @@
+package nlb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherSeries returns the series of the named family whose labels include
+// every label in match, from the default registry the RED metrics use
+func gatherSeries(t *testing.T, name string, match map[string]string) []*dto.Metric {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var series []*dto.Metric
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			labels := labelMap(metric)
+			for label, value := range match {
+				if labels[label] != value {
+					continue metrics
+				}
+			}
+			series = append(series, metric)
+		}
+	}
+	return series
+}
+
+func labelMap(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range metric.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestObserveRequestSeries(t *testing.T) {
+	route := "red-test-series"
+	observeRequest(context.Background(), route, "alb-1", "", 3*time.Millisecond)
+	observeRequest(context.Background(), route, "alb-1", "", 2*time.Second)
+	observeRequest(context.Background(), route, "", "no_healthy_modules", time.Millisecond)
+
+	requests := gatherSeries(t, "marchproxy_requests_total", map[string]string{"route": route})
+	if len(requests) != 2 {
+		t.Fatalf("%d request series, want 2", len(requests))
+	}
+	for _, metric := range requests {
+		labels := labelMap(metric)
+		if len(labels) != len(redLabels) || labels["module"] != "nlb" || labels["tenant"] != redDefaultTenant {
+			t.Errorf("request labels %v", labels)
+		}
+	}
+
+	errors := gatherSeries(t, "marchproxy_request_errors_total", map[string]string{"route": route})
+	if len(errors) != 1 {
+		t.Fatalf("%d error series, want 1", len(errors))
+	}
+	// A decision without a module is reported against backend "none"
+	if labels := labelMap(errors[0]); labels["backend"] != "none" || labels["reason"] != "no_healthy_modules" || errors[0].GetCounter().GetValue() != 1 {
+		t.Errorf("error series %v = %v", labels, errors[0].GetCounter().GetValue())
+	}
+
+	durations := gatherSeries(t, "marchproxy_request_duration_seconds", map[string]string{"route": route, "backend": "alb-1"})
+	if len(durations) != 1 {
+		t.Fatalf("%d duration series, want 1", len(durations))
+	}
+	histogram := durations[0].GetHistogram()
+	if histogram.GetSampleCount() != 2 {
+		t.Errorf("sample count %d, want 2", histogram.GetSampleCount())
+	}
+	buckets := histogram.GetBucket()
+	if len(buckets) != len(redDurationBuckets) {
+		t.Fatalf("%d buckets, want %d", len(buckets), len(redDurationBuckets))
+	}
+	for i, bucket := range buckets {
+		var want uint64
+		switch {
+		case redDurationBuckets[i] >= 2:
+			want = 2
+		case redDurationBuckets[i] >= 0.003:
+			want = 1
+		}
+		if bucket.GetUpperBound() != redDurationBuckets[i] || bucket.GetCumulativeCount() != want {
+			t.Errorf("bucket le=%g count %d, want le=%g count %d", bucket.GetUpperBound(), bucket.GetCumulativeCount(), redDurationBuckets[i], want)
+		}
+	}
+}
+
+func TestObserveRequestExemplar(t *testing.T) {
+	route := "red-test-exemplar"
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	observeRequest(WithTraceID(context.Background(), traceID), route, "alb-1", "", 20*time.Millisecond)
+	observeRequest(context.Background(), route, "alb-1", "", 200*time.Millisecond)
+
+	durations := gatherSeries(t, "marchproxy_request_duration_seconds", map[string]string{"route": route})
+	if len(durations) != 1 {
+		t.Fatalf("%d duration series, want 1", len(durations))
+	}
+	for _, bucket := range durations[0].GetHistogram().GetBucket() {
+		exemplar := bucket.GetExemplar()
+		switch bucket.GetUpperBound() {
+		case 0.025:
+			// The traced sample lands in the first bucket that holds it
+			if exemplar == nil || exemplar.GetValue() != 0.02 {
+				t.Fatalf("bucket le=0.025 exemplar %v", exemplar)
+			}
+			labels := exemplar.GetLabel()
+			if len(labels) != 1 || labels[0].GetName() != "trace_id" || labels[0].GetValue() != traceID {
+				t.Errorf("exemplar labels %v", labels)
+			}
+		default:
+			// Samples without a trace carry no exemplar
+			if exemplar != nil {
+				t.Errorf("bucket le=%g has exemplar %v", bucket.GetUpperBound(), exemplar)
+			}
+		}
+	}
+}
+
+func TestTraceIDFromContext(t *testing.T) {
+	if got := traceIDFromContext(context.Background()); got != "" {
+		t.Errorf("trace ID %q without WithTraceID", got)
+	}
+	if got := traceIDFromContext(WithTraceID(context.Background(), "abc")); got != "abc" {
+		t.Errorf("trace ID %q, want abc", got)
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"sync"
 	"time"
 
+	"marchproxy-shared/drain"
+	"marchproxy-shared/netutil"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
@@ -49,8 +54,17 @@ type ModuleEndpoint struct {
 	MaxConns     int
 	Version      string // For blue/green deployments
 	Weight       int    // For weighted routing
+	Zone         string // Where the module runs, for locality-aware routing
+	Region       string
 	LastHealthy  time.Time
 	mu           sync.RWMutex
+
+	// Passive ejection state, see outlier.go
+	failures     []time.Time
+	ejectedUntil time.Time
+
+	// Start of the slow-start ramp, see slowstart.go
+	warmSince time.Time
 }
 
 // IsHealthy checks if the endpoint is healthy
@@ -64,6 +78,9 @@ func (m *ModuleEndpoint) IsHealthy() bool {
 func (m *ModuleEndpoint) SetHealthy(healthy bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if healthy && !m.Healthy {
+		m.warmSince = time.Now()
+	}
 	m.Healthy = healthy
 	if healthy {
 		m.LastHealthy = time.Now()
@@ -105,15 +122,88 @@ type Router struct {
 	mu        sync.RWMutex
 	logger    *logrus.Logger
 	inspector *ProtocolInspector
+
+	// Per-protocol TCP socket tuning
+	socketDefaults netutil.TCPOptions
+	socketOptions  map[Protocol]netutil.TCPOptions
+	socketMu       sync.RWMutex
+
+	// Passive ejection of modules failing live traffic
+	outlier OutlierConfig
+
+	// Client country blocking and routing, see geo.go
+	geoLookup CountryLookup
+	geoPolicy GeoPolicy
+	geoMu     sync.RWMutex
+
+	// Same-zone preference, see locality.go
+	locality   LocalityPolicy
+	localityMu sync.RWMutex
+
+	// Traffic ramp of new and recovered modules, see slowstart.go
+	slowStart   SlowStartConfig
+	slowStartMu sync.RWMutex
+
+	// Backends drained for maintenance, see drain.go
+	drains   *drain.Set
+	drainsMu sync.RWMutex
 }
 
 // NewRouter creates a new traffic router
 func NewRouter(logger *logrus.Logger) *Router {
 	return &Router{
-		endpoints: make(map[Protocol][]*ModuleEndpoint),
-		logger:    logger,
-		inspector: NewProtocolInspector(),
+		endpoints:     make(map[Protocol][]*ModuleEndpoint),
+		logger:        logger,
+		inspector:     NewProtocolInspector(),
+		socketOptions: make(map[Protocol]netutil.TCPOptions),
+	}
+}
+
+// SetDefaultSocketOptions sets the socket tuning used for protocols without overrides
+func (r *Router) SetDefaultSocketOptions(opts netutil.TCPOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	r.socketMu.Lock()
+	defer r.socketMu.Unlock()
+	r.socketDefaults = opts
+	return nil
+}
+
+// SetSocketOptions sets the socket tuning for connections routed to a protocol
+func (r *Router) SetSocketOptions(protocol Protocol, opts netutil.TCPOptions) error {
+	if protocol == ProtocolUnknown {
+		return errors.New("invalid protocol")
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	r.socketMu.Lock()
+	defer r.socketMu.Unlock()
+	r.socketOptions[protocol] = opts
+	return nil
+}
+
+// SocketOptions returns the socket tuning for a protocol
+func (r *Router) SocketOptions(protocol Protocol) netutil.TCPOptions {
+	r.socketMu.RLock()
+	defer r.socketMu.RUnlock()
+
+	if opts, exists := r.socketOptions[protocol]; exists {
+		return opts
+	}
+	return r.socketDefaults
+}
+
+// TuneConnection applies the protocol's socket tuning to a routed connection
+func (r *Router) TuneConnection(protocol Protocol, conn net.Conn) error {
+	if err := netutil.ApplyTCPOptions(conn, r.SocketOptions(protocol)); err != nil {
+		routingErrors.WithLabelValues(protocol.String(), "socket_options").Inc()
+		return err
 	}
+	return nil
 }
 
 // RegisterModule registers a module endpoint for a specific protocol
@@ -140,6 +230,9 @@ func (r *Router) RegisterModule(module *ModuleEndpoint) error {
 		}
 	}
 
+	module.mu.Lock()
+	module.warmSince = time.Now()
+	module.mu.Unlock()
 	r.endpoints[module.Protocol] = append(r.endpoints[module.Protocol], module)
 
 	r.logger.WithFields(logrus.Fields{
@@ -177,34 +270,69 @@ func (r *Router) UnregisterModule(protocol Protocol, moduleName string) error {
 	return fmt.Errorf("module %s not found for protocol %s", moduleName, protocol)
 }
 
-// RouteConnection routes a connection to the appropriate module
+// RouteConnection routes a connection to the appropriate module. Connections
+// that cannot be routed are counted as closed; routed ones must be released
+// with CloseConnection.
 func (r *Router) RouteConnection(ctx context.Context, data []byte) (*ModuleEndpoint, error) {
+	start := time.Now()
+
 	// Detect protocol
 	protocol, err := r.inspector.InspectProtocol(data)
 	if err != nil {
 		routingErrors.WithLabelValues("unknown", "detection_error").Inc()
+		connectionsClosed.WithLabelValues(redModule, "unknown", routingCloseReason("detection_error")).Inc()
+		observeRequest(ctx, "unknown", "", "detection_error", time.Since(start))
 		return nil, fmt.Errorf("protocol detection failed: %w", err)
 	}
 
 	if protocol == ProtocolUnknown {
 		routingErrors.WithLabelValues("unknown", "unknown_protocol").Inc()
+		connectionsClosed.WithLabelValues(redModule, "unknown", routingCloseReason("unknown_protocol")).Inc()
+		observeRequest(ctx, "unknown", "", "unknown_protocol", time.Since(start))
 		return nil, errors.New("unknown protocol")
 	}
 
-	// Get available modules for protocol
-	module, err := r.selectModule(protocol)
+	// Drop blocked countries and find the client's country route
+	geoRoute, err := r.geoDecision(ctx)
+	if err != nil {
+		routingErrors.WithLabelValues(protocol.String(), "geo_blocked").Inc()
+		connectionsClosed.WithLabelValues(redModule, protocol.String(), routingCloseReason("geo_blocked")).Inc()
+		observeRequest(ctx, protocol.String(), "", "geo_blocked", time.Since(start))
+		return nil, err
+	}
+
+	// Get available modules for protocol, letting a protocol plugin choose
+	// among them
+	var module *ModuleEndpoint
+	if handler := pluginHandler(protocol); handler != nil {
+		module, err = r.selectPluginModule(ctx, handler, protocol, geoRoute, data)
+	} else {
+		module, err = r.selectModule(protocol, geoRoute)
+	}
 	if err != nil {
-		routingErrors.WithLabelValues(protocol.String(), "no_module").Inc()
+		errorType := "no_module"
+		if errors.Is(err, errPluginDenied) {
+			errorType = "plugin_denied"
+		}
+		routingErrors.WithLabelValues(protocol.String(), errorType).Inc()
+		connectionsClosed.WithLabelValues(redModule, protocol.String(), routingCloseReason(errorType)).Inc()
+		observeRequest(ctx, protocol.String(), "", errorType, time.Since(start))
 		return nil, err
 	}
 
 	// Increment connection count
 	if err := module.IncrementConns(); err != nil {
 		routingErrors.WithLabelValues(protocol.String(), "max_connections").Inc()
+		connectionsClosed.WithLabelValues(redModule, protocol.String(), routingCloseReason("max_connections")).Inc()
+		observeRequest(ctx, protocol.String(), module.Name, "max_connections", time.Since(start))
 		return nil, fmt.Errorf("module capacity exceeded: %w", err)
 	}
 
 	routedConnections.WithLabelValues(protocol.String(), module.Name).Inc()
+	if locality := r.Locality(module); locality != "" {
+		localityConnections.WithLabelValues(protocol.String(), locality).Inc()
+	}
+	observeRequest(ctx, protocol.String(), module.Name, "", time.Since(start))
 
 	r.logger.WithFields(logrus.Fields{
 		"protocol": protocol.String(),
@@ -215,8 +343,20 @@ func (r *Router) RouteConnection(ctx context.Context, data []byte) (*ModuleEndpo
 	return module, nil
 }
 
-// selectModule selects the best module for the protocol using least connections algorithm
-func (r *Router) selectModule(protocol Protocol) (*ModuleEndpoint, error) {
+// selectModule selects the best module for the protocol using least connections
+// algorithm, among the modules of the client's country route when there is one
+// and the nearest of them when the NLB's locality is set
+func (r *Router) selectModule(protocol Protocol, geoRoute *GeoRoute) (*ModuleEndpoint, error) {
+	healthyModules, err := r.availableModules(protocol, geoRoute)
+	if err != nil {
+		return nil, err
+	}
+	return r.selectNearest(protocol, healthyModules)
+}
+
+// availableModules returns the healthy, non-ejected and non-drained modules
+// of a protocol, limited to the client's country route when there is one
+func (r *Router) availableModules(protocol Protocol, geoRoute *GeoRoute) ([]*ModuleEndpoint, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -225,10 +365,10 @@ func (r *Router) selectModule(protocol Protocol) (*ModuleEndpoint, error) {
 		return nil, fmt.Errorf("no modules available for protocol %s", protocol)
 	}
 
-	// Filter healthy modules
+	// Filter healthy modules that are not ejected or drained
 	var healthyModules []*ModuleEndpoint
 	for _, module := range modules {
-		if module.IsHealthy() {
+		if module.IsHealthy() && !module.IsEjected() && !r.isDrained(module) {
 			healthyModules = append(healthyModules, module)
 		}
 	}
@@ -237,14 +377,32 @@ func (r *Router) selectModule(protocol Protocol) (*ModuleEndpoint, error) {
 		return nil, fmt.Errorf("no healthy modules available for protocol %s", protocol)
 	}
 
-	// Select module with least connections
+	healthyModules = geoFilter(healthyModules, geoRoute)
+	if len(healthyModules) == 0 {
+		return nil, fmt.Errorf("no healthy modules available for protocol %s in the client's region", protocol)
+	}
+
+	return healthyModules, nil
+}
+
+// leastConnections selects the module with the fewest active connections
+// for its effective weight, so modules ramping up after slow-start take a
+// smaller share of new connections
+func (r *Router) leastConnections(protocol Protocol, modules []*ModuleEndpoint) (*ModuleEndpoint, error) {
+	r.slowStartMu.RLock()
+	slowStart := r.slowStart
+	r.slowStartMu.RUnlock()
+
 	var selected *ModuleEndpoint
-	minConns := int(^uint(0) >> 1) // Max int
+	minLoad := math.Inf(1)
+	now := time.Now()
 
-	for _, module := range healthyModules {
-		conns := module.GetActiveConns()
-		if conns < minConns {
-			minConns = conns
+	for _, module := range modules {
+		// Count the connection being routed, so idle modules are ranked
+		// by weight too
+		load := float64(module.GetActiveConns()+1) / slowStart.effectiveWeight(module, now)
+		if load < minLoad {
+			minLoad = load
 			selected = module
 		}
 	}
@@ -280,6 +438,22 @@ func (r *Router) GetAllModules() map[Protocol][]*ModuleEndpoint {
 	return result
 }
 
+// HasHealthyModules reports whether any module is healthy and not ejected,
+// i.e. whether this instance can serve traffic
+func (r *Router) HasHealthyModules() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, modules := range r.endpoints {
+		for _, module := range modules {
+			if module.IsHealthy() && !module.IsEjected() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // GetStats returns routing statistics
 func (r *Router) GetStats() map[string]interface{} {
 	r.mu.RLock()
@@ -302,13 +476,17 @@ func (r *Router) GetStats() map[string]interface{} {
 			}
 
 			moduleStats = append(moduleStats, map[string]interface{}{
-				"name":         module.Name,
-				"address":      module.Address,
-				"healthy":      module.IsHealthy(),
-				"active_conns": conns,
-				"max_conns":    module.MaxConns,
-				"version":      module.Version,
-				"weight":       module.Weight,
+				"name":             module.Name,
+				"address":          module.Address,
+				"healthy":          module.IsHealthy(),
+				"ejected":          module.IsEjected(),
+				"active_conns":     conns,
+				"max_conns":        module.MaxConns,
+				"version":          module.Version,
+				"weight":           module.Weight,
+				"effective_weight": r.EffectiveWeight(module),
+				"zone":             module.Zone,
+				"region":           module.Region,
 			})
 		}
 
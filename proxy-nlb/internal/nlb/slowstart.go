@@ -0,0 +1,97 @@
+package nlb
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Slow-start curves
+const (
+	SlowStartLinear      = "linear"      // Weight grows by the same amount every second
+	SlowStartExponential = "exponential" // Weight doubles at a steady rate, staying low longer
+)
+
+// SlowStartConfig ramps up the traffic share of modules that were just
+// registered, turned healthy or came back from an ejection, instead of
+// handing them a full share of new connections while they warm caches and
+// pools. A ramping module's effective weight grows from MinWeight of its
+// weight to all of it over Window.
+type SlowStartConfig struct {
+	Window    time.Duration // 0 disables slow-start
+	Curve     string        // SlowStartLinear or SlowStartExponential, linear when empty
+	MinWeight float64       // Share of its weight a module starts at, above 0 and at most 1
+}
+
+// Validate checks the slow-start settings
+func (s SlowStartConfig) Validate() error {
+	if s.Window < 0 {
+		return errors.New("slow-start window must not be negative")
+	}
+	switch s.Curve {
+	case "", SlowStartLinear, SlowStartExponential:
+	default:
+		return errors.New("slow-start curve must be linear or exponential")
+	}
+	if s.Window > 0 && (s.MinWeight <= 0 || s.MinWeight > 1) {
+		return errors.New("slow-start minimum weight must be above 0 and at most 1")
+	}
+	return nil
+}
+
+// factor returns the share of its weight a module that started warming at
+// since receives at now, 1 once warm
+func (s SlowStartConfig) factor(since, now time.Time) float64 {
+	if s.Window <= 0 || since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= s.Window {
+		return 1
+	}
+	progress := math.Max(float64(elapsed)/float64(s.Window), 0)
+	if s.Curve == SlowStartExponential {
+		return math.Pow(s.MinWeight, 1-progress)
+	}
+	return s.MinWeight + (1-s.MinWeight)*progress
+}
+
+// SetSlowStart sets the slow-start settings for all modules
+func (r *Router) SetSlowStart(slowStart SlowStartConfig) error {
+	if err := slowStart.Validate(); err != nil {
+		return err
+	}
+
+	r.slowStartMu.Lock()
+	defer r.slowStartMu.Unlock()
+	r.slowStart = slowStart
+	return nil
+}
+
+// warmingSince returns when the module last started receiving traffic:
+// registration, turning healthy or the end of its last ejection
+func (m *ModuleEndpoint) warmingSince(now time.Time) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.ejectedUntil.After(m.warmSince) && !now.Before(m.ejectedUntil) {
+		return m.ejectedUntil
+	}
+	return m.warmSince
+}
+
+// effectiveWeight returns the module's weight scaled by slow-start at now.
+// Modules without a weight count as weight 1.
+func (s SlowStartConfig) effectiveWeight(module *ModuleEndpoint, now time.Time) float64 {
+	weight := float64(max(module.Weight, 1))
+	return weight * s.factor(module.warmingSince(now), now)
+}
+
+// EffectiveWeight returns the module's weight as routing currently uses it,
+// lower than its weight while it is ramping up after slow-start began
+func (r *Router) EffectiveWeight(module *ModuleEndpoint) float64 {
+	r.slowStartMu.RLock()
+	slowStart := r.slowStart
+	r.slowStartMu.RUnlock()
+
+	return slowStart.effectiveWeight(module, time.Now())
+}
@@ -0,0 +1,89 @@
+package nlb
+
+import (
+	"context"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSlowStartCurves(t *testing.T) {
+	since := time.Now()
+	linear := SlowStartConfig{Window: 100 * time.Second, Curve: SlowStartLinear, MinWeight: 0.1}
+	exponential := SlowStartConfig{Window: 100 * time.Second, Curve: SlowStartExponential, MinWeight: 0.01}
+
+	for _, tc := range []struct {
+		config  SlowStartConfig
+		elapsed time.Duration
+		want    float64
+	}{
+		{linear, 0, 0.1},
+		{linear, 50 * time.Second, 0.55},
+		{linear, 100 * time.Second, 1},
+		{exponential, 0, 0.01},
+		{exponential, 50 * time.Second, 0.1},
+		{exponential, 200 * time.Second, 1},
+		{SlowStartConfig{}, 0, 1},
+	} {
+		if got := tc.config.factor(since, since.Add(tc.elapsed)); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s factor after %s = %f, want %f", tc.config.Curve, tc.elapsed, got, tc.want)
+		}
+	}
+
+	if err := (SlowStartConfig{Window: time.Minute, Curve: "cubic", MinWeight: 0.1}).Validate(); err == nil {
+		t.Error("Expected an unknown curve to be rejected")
+	}
+	if err := (SlowStartConfig{Window: time.Minute}).Validate(); err == nil {
+		t.Error("Expected a zero minimum weight to be rejected")
+	}
+}
+
+func TestSlowStartRamp(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	router := NewRouter(logger)
+	if err := router.SetSlowStart(SlowStartConfig{Window: time.Hour, MinWeight: 0.1}); err != nil {
+		t.Fatal(err)
+	}
+
+	warm := &ModuleEndpoint{Name: "alb-1", Protocol: ProtocolHTTP, Healthy: true, MaxConns: 100}
+	fresh := &ModuleEndpoint{Name: "alb-2", Protocol: ProtocolHTTP, Healthy: true, MaxConns: 100}
+	for _, module := range []*ModuleEndpoint{warm, fresh} {
+		if err := router.RegisterModule(module); err != nil {
+			t.Fatal(err)
+		}
+	}
+	warm.warmSince = time.Now().Add(-2 * time.Hour)
+
+	// The new module takes about a tenth of the warm one's connections
+	routed := make(map[string]int)
+	for i := 0; i < 22; i++ {
+		module, err := router.RouteConnection(context.Background(), httpRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routed[module.Name]++
+	}
+	if routed["alb-1"] != 20 || routed["alb-2"] != 2 {
+		t.Fatalf("Expected 20 and 2 connections, got %v", routed)
+	}
+	if weight := router.EffectiveWeight(fresh); weight < 0.1 || weight > 0.11 {
+		t.Errorf("Expected the new module's effective weight near 0.1, got %f", weight)
+	}
+
+	// A module recovering from a failed health check ramps up again, a
+	// module that stayed healthy doesn't
+	warm.SetHealthy(false)
+	warm.SetHealthy(true)
+	fresh.warmSince = time.Now().Add(-2 * time.Hour)
+	fresh.SetHealthy(true)
+	if weight := router.EffectiveWeight(warm); weight > 0.11 {
+		t.Errorf("Expected the recovered module to ramp up, got weight %f", weight)
+	}
+	if weight := router.EffectiveWeight(fresh); weight != 1 {
+		t.Errorf("Expected the healthy module at full weight, got %f", weight)
+	}
+}
@@ -0,0 +1,95 @@
+package vrrp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	protocolNumber = 112
+	version        = 3
+	typeAdvert     = 1
+	headerLen      = 8
+)
+
+// multicastGroup is where advertisements are sent without a unicast peer
+var multicastGroup = netip.MustParseAddr("224.0.0.18")
+
+// advert is a VRRPv3 advertisement (RFC 5798)
+type advert struct {
+	Source    netip.Addr
+	VRID      uint8
+	Priority  uint8
+	Interval  time.Duration
+	Addresses []netip.Addr
+}
+
+// marshal encodes the advertisement with its checksum, which covers an IPv4
+// pseudo-header of the source and destination addresses
+func (a advert) marshal(src, dst netip.Addr) []byte {
+	b := make([]byte, headerLen, headerLen+4*len(a.Addresses))
+	b[0] = version<<4 | typeAdvert
+	b[1] = a.VRID
+	b[2] = a.Priority
+	b[3] = byte(len(a.Addresses))
+	binary.BigEndian.PutUint16(b[4:], uint16(a.Interval/(10*time.Millisecond))&0x0fff)
+	for _, addr := range a.Addresses {
+		v4 := addr.As4()
+		b = append(b, v4[:]...)
+	}
+	binary.BigEndian.PutUint16(b[6:], checksum(b, src, dst))
+	return b
+}
+
+// parseAdvert decodes an advertisement received from src on dst
+func parseAdvert(b []byte, src, dst netip.Addr) (advert, error) {
+	if len(b) < headerLen {
+		return advert{}, errors.New("advertisement too short")
+	}
+	if b[0]>>4 != version || b[0]&0x0f != typeAdvert {
+		return advert{}, fmt.Errorf("unsupported version or type 0x%02x", b[0])
+	}
+	count := int(b[3])
+	if len(b) < headerLen+4*count {
+		return advert{}, errors.New("truncated address list")
+	}
+	b = b[:headerLen+4*count]
+	if checksum(b, src, dst) != 0 {
+		return advert{}, errors.New("invalid checksum")
+	}
+
+	a := advert{
+		Source:   src,
+		VRID:     b[1],
+		Priority: b[2],
+		Interval: time.Duration(binary.BigEndian.Uint16(b[4:])&0x0fff) * 10 * time.Millisecond,
+	}
+	for i := 0; i < count; i++ {
+		a.Addresses = append(a.Addresses, netip.AddrFrom4([4]byte(b[headerLen+4*i:])))
+	}
+	return a, nil
+}
+
+// checksum computes the Internet checksum over the pseudo-header and b. A
+// packet carrying a valid checksum sums to zero.
+func checksum(b []byte, src, dst netip.Addr) uint16 {
+	s, d := src.As4(), dst.As4()
+	pseudo := append(append(s[:], d[:]...), 0, protocolNumber, byte(len(b)>>8), byte(len(b)))
+
+	var sum uint32
+	for _, data := range [][]byte{pseudo, b} {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(data[i])<<8 | uint32(data[i+1])
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,94 @@
+package vrrp
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSource = netip.MustParseAddr("10.0.0.1")
+	testVIP    = netip.MustParseAddr("192.0.2.10")
+)
+
+func TestAdvertMarshal(t *testing.T) {
+	a := advert{VRID: 51, Priority: 100, Interval: time.Second, Addresses: []netip.Addr{testVIP}}
+	want := []byte{
+		0x31,       // Version 3, advertisement
+		51,         // VRID
+		100,        // Priority
+		1,          // Address count
+		0x00, 0x64, // Interval in centiseconds
+		0xbd, 0xcc, // Checksum
+		192, 0, 2, 10,
+	}
+	if got := a.marshal(testSource, multicastGroup); !bytes.Equal(got, want) {
+		t.Errorf("marshal % x, want % x", got, want)
+	}
+
+	// Reserved bits above the 12-bit interval stay clear
+	a.Interval = 40950 * time.Millisecond
+	if b := a.marshal(testSource, multicastGroup); b[4] != 0x0f || b[5] != 0xff {
+		t.Errorf("interval bytes % x, want 0f ff", b[4:6])
+	}
+}
+
+func TestParseAdvert(t *testing.T) {
+	want := advert{
+		Source:    testSource,
+		VRID:      7,
+		Priority:  254,
+		Interval:  250 * time.Millisecond,
+		Addresses: []netip.Addr{testVIP, netip.MustParseAddr("192.0.2.11")},
+	}
+	b := want.marshal(testSource, multicastGroup)
+	got, err := parseAdvert(append(b, 0, 0, 0), testSource, multicastGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+
+	corrupt := append([]byte(nil), b...)
+	corrupt[2] = 1
+	for name, c := range map[string]struct {
+		b    []byte
+		dst  netip.Addr
+		want string
+	}{
+		"short":             {b[:7], multicastGroup, "too short"},
+		"version 2":         {append([]byte{0x21}, b[1:]...), multicastGroup, "unsupported version"},
+		"unknown type":      {append([]byte{0x32}, b[1:]...), multicastGroup, "unsupported version"},
+		"truncated":         {b[:len(b)-1], multicastGroup, "truncated"},
+		"corrupt":           {corrupt, multicastGroup, "invalid checksum"},
+		"other dst":         {b, netip.MustParseAddr("10.0.0.2"), "invalid checksum"},
+		"empty":             {nil, multicastGroup, "too short"},
+		"header only":       {b[:headerLen], multicastGroup, "truncated"},
+		"count past buffer": {append(append([]byte(nil), b[:3]...), 9, b[4], b[5], b[6], b[7]), multicastGroup, "truncated"},
+	} {
+		if _, err := parseAdvert(c.b, testSource, c.dst); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: error %v, want %q", name, err, c.want)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	b := advert{VRID: 1, Priority: 100, Interval: time.Second}.marshal(testSource, multicastGroup)
+	if sum := checksum(b, testSource, multicastGroup); sum != 0 {
+		t.Errorf("checksum over a marshaled advertisement %#04x, want 0", sum)
+	}
+
+	// An odd trailing byte is padded with zero
+	if got := checksum([]byte{1, 2, 3}, testSource, multicastGroup); got != 0x1177 {
+		t.Errorf("checksum over an odd length %#04x, want 0x1177", got)
+	}
+
+	// Carries fold back into the sum
+	if got := checksum(bytes.Repeat([]byte{0xff}, 64), netip.MustParseAddr("255.255.255.255"), netip.MustParseAddr("255.255.255.255")); got != ^uint16(0x0070+64) {
+		t.Errorf("checksum with carries %#04x", got)
+	}
+}
@@ -0,0 +1,80 @@
+package vrrp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// addVIP adds a VIP to the interface, succeeding if it is already there
+func addVIP(iface *net.Interface, vip netip.Prefix) error {
+	link, err := netlink.LinkByIndex(iface.Index)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", iface.Name, err)
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.IP(vip.Addr().AsSlice()), Mask: net.CIDRMask(vip.Bits(), 32)}}
+	if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add %s to %s: %w", vip, iface.Name, err)
+	}
+	return nil
+}
+
+// removeVIP removes a VIP from the interface, succeeding if it is not there
+func removeVIP(iface *net.Interface, vip netip.Prefix) error {
+	link, err := netlink.LinkByIndex(iface.Index)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", iface.Name, err)
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.IP(vip.Addr().AsSlice()), Mask: net.CIDRMask(vip.Bits(), 32)}}
+	if err := netlink.AddrDel(link, addr); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove %s from %s: %w", vip, iface.Name, err)
+	}
+	return nil
+}
+
+// sendGratuitousARP broadcasts an ARP request for vip from the interface's
+// MAC address so neighbors and switches learn the new owner
+func sendGratuitousARP(iface *net.Interface, vip netip.Addr) error {
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("interface %s has no Ethernet address", iface.Name)
+	}
+
+	proto := htons(unix.ETH_P_ARP)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(proto))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ip := vip.As4()
+	packet := make([]byte, 0, 28)
+	packet = binary.BigEndian.AppendUint16(packet, 1)      // Ethernet
+	packet = binary.BigEndian.AppendUint16(packet, 0x0800) // IPv4
+	packet = append(packet, 6, 4)
+	packet = binary.BigEndian.AppendUint16(packet, 1) // Request
+	packet = append(packet, iface.HardwareAddr...)
+	packet = append(packet, ip[:]...)
+	packet = append(packet, 0, 0, 0, 0, 0, 0)
+	packet = append(packet, ip[:]...)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: proto,
+		Ifindex:  iface.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	if err := unix.Sendto(fd, packet, 0, addr); err != nil {
+		return fmt.Errorf("failed to send gratuitous ARP on %s: %w", iface.Name, err)
+	}
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
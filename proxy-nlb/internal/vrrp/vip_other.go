@@ -0,0 +1,24 @@
+//go:build !linux
+
+package vrrp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// addVIP is only supported on Linux
+func addVIP(iface *net.Interface, vip netip.Prefix) error {
+	return fmt.Errorf("managing VIP %s is only supported on Linux", vip)
+}
+
+// removeVIP is only supported on Linux
+func removeVIP(iface *net.Interface, vip netip.Prefix) error {
+	return fmt.Errorf("managing VIP %s is only supported on Linux", vip)
+}
+
+// sendGratuitousARP is only supported on Linux
+func sendGratuitousARP(iface *net.Interface, vip netip.Addr) error {
+	return fmt.Errorf("gratuitous ARP is only supported on Linux")
+}
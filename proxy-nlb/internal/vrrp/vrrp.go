@@ -0,0 +1,594 @@
+// Package vrrp moves a floating VIP between NLB instances with VRRPv3
+// (RFC 5798), for on-prem pairs that cannot use BGP anycast.
+//
+// The master holds the VIPs on its interface and advertises its priority.
+// When its advertisements stop, or a higher priority instance may preempt
+// it, a backup takes the VIPs over and sends gratuitous ARP so neighbors
+// update their caches. Local health either lowers the priority or, without
+// a penalty, moves the instance to a fault state that releases the VIPs.
+package vrrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+// States of an instance
+const (
+	StateInit   = "init"
+	StateBackup = "backup"
+	StateMaster = "master"
+	StateFault  = "fault"
+)
+
+// maxEvents bounds the failover history kept for status reporting
+const maxEvents = 20
+
+var (
+	masterGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_vrrp_master",
+			Help: "Whether this instance is VRRP master for the virtual router",
+		},
+		[]string{"vrid"},
+	)
+
+	priorityGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nlb_vrrp_priority",
+			Help: "Effective VRRP priority after health checks",
+		},
+		[]string{"vrid"},
+	)
+
+	transitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nlb_vrrp_transitions_total",
+			Help: "Total number of VRRP state transitions by new state",
+		},
+		[]string{"vrid", "state"},
+	)
+)
+
+// Config holds the virtual router settings
+type Config struct {
+	Interface       string
+	VirtualRouterID uint8
+	Priority        uint8          // 1-254, higher wins
+	VIPs            []netip.Prefix // IPv4 addresses with the prefix length to add them with
+	AdvertInterval  time.Duration  // 0 means 1s
+	Preempt         bool           // Take over from a lower priority master
+	PreemptDelay    time.Duration  // Wait after startup before preempting
+	HealthPenalty   uint8          // Subtracted from the priority while unhealthy, 0 enters fault instead
+	UnicastPeer     netip.Addr     // Advertise to this address instead of multicast
+}
+
+// Validate checks the virtual router settings
+func (c Config) Validate() error {
+	if c.Interface == "" {
+		return errors.New("interface is required")
+	}
+	if c.VirtualRouterID == 0 {
+		return errors.New("virtual router ID must be 1-255")
+	}
+	if c.Priority == 0 || c.Priority == 255 {
+		return errors.New("priority must be 1-254")
+	}
+	if c.HealthPenalty >= c.Priority {
+		return errors.New("health penalty must be lower than the priority")
+	}
+	if len(c.VIPs) == 0 {
+		return errors.New("at least one VIP is required")
+	}
+	for _, vip := range c.VIPs {
+		if !vip.Addr().Is4() {
+			return fmt.Errorf("VIP %s is not an IPv4 address", vip)
+		}
+	}
+	if c.AdvertInterval != 0 && (c.AdvertInterval < 10*time.Millisecond || c.AdvertInterval > 40950*time.Millisecond) {
+		return errors.New("advert interval must be between 10ms and 40.95s")
+	}
+	if c.UnicastPeer.IsValid() && !c.UnicastPeer.Is4() {
+		return errors.New("unicast peer must be an IPv4 address")
+	}
+	return nil
+}
+
+// Event records a state transition
+type Event struct {
+	Time     time.Time `json:"time"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Reason   string    `json:"reason"`
+	Priority uint8     `json:"priority"`
+}
+
+// Status describes the virtual router
+type Status struct {
+	State    string   `json:"state"`
+	Priority uint8    `json:"priority"`
+	Master   string   `json:"master,omitempty"`
+	VIPs     []string `json:"vips"`
+	Events   []Event  `json:"events"`
+}
+
+// packetConn sends advertisements, an *ipv4.PacketConn outside tests
+type packetConn interface {
+	WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error)
+}
+
+// Instance runs one virtual router
+type Instance struct {
+	config Config
+	logger *logrus.Logger
+	vrid   string
+	health chan bool
+
+	// Owned by the Run loop
+	iface               *net.Interface
+	localAddr           netip.Addr
+	started             time.Time
+	masterAdverInterval time.Duration
+	healthy             bool
+
+	// Interface changes, replaced in tests
+	addVIP            func(*net.Interface, netip.Prefix) error
+	removeVIP         func(*net.Interface, netip.Prefix) error
+	sendGratuitousARP func(*net.Interface, netip.Addr) error
+
+	mu       sync.Mutex
+	state    string
+	priority uint8
+	master   netip.Addr
+	events   []Event
+}
+
+// NewInstance creates a virtual router in the init state
+func NewInstance(config Config, logger *logrus.Logger) (*Instance, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.AdvertInterval == 0 {
+		config.AdvertInterval = time.Second
+	}
+
+	i := &Instance{
+		config:   config,
+		logger:   logger,
+		vrid:     fmt.Sprint(config.VirtualRouterID),
+		health:   make(chan bool, 1),
+		healthy:  true,
+		state:    StateInit,
+		priority: config.Priority,
+
+		addVIP:            addVIP,
+		removeVIP:         removeVIP,
+		sendGratuitousARP: sendGratuitousARP,
+	}
+	priorityGauge.WithLabelValues(i.vrid).Set(float64(config.Priority))
+	return i, nil
+}
+
+// SetHealthy reports local health. Unhealthy instances lower their priority
+// by the health penalty, or enter the fault state without one.
+func (i *Instance) SetHealthy(healthy bool) {
+	select {
+	case <-i.health:
+	default:
+	}
+	i.health <- healthy
+}
+
+// Follow reports the result of healthy every interval until ctx is done
+func (i *Instance) Follow(ctx context.Context, interval time.Duration, healthy func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		i.SetHealthy(healthy())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the current state and recent transitions
+func (i *Instance) Status() Status {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	status := Status{
+		State:    i.state,
+		Priority: i.priority,
+		Events:   append([]Event(nil), i.events...),
+	}
+	if i.master.IsValid() {
+		status.Master = i.master.String()
+	}
+	for _, vip := range i.config.VIPs {
+		status.VIPs = append(status.VIPs, vip.String())
+	}
+	return status
+}
+
+// Run takes part in the virtual router until ctx is done. A master releases
+// the VIPs and advertises priority 0 on the way out so the backup takes
+// over at once.
+func (i *Instance) Run(ctx context.Context) error {
+	conn, err := i.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Start from a clean interface in case a previous run left the VIPs
+	i.releaseVIPs()
+
+	adverts := make(chan advert, 16)
+	go i.receive(conn, adverts)
+	return i.loop(ctx, conn, adverts)
+}
+
+// loop runs the state machine on the advertisements from adverts until ctx
+// is done, sending its own through conn
+func (i *Instance) loop(ctx context.Context, conn packetConn, adverts <-chan advert) error {
+	i.started = time.Now()
+	i.masterAdverInterval = i.config.AdvertInterval
+	i.transition(StateBackup, "startup", netip.Addr{})
+	timer := time.NewTimer(i.masterDownInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if i.currentState() == StateMaster {
+				i.advertise(conn, 0)
+				i.releaseVIPs()
+			}
+			i.transition(StateInit, "shutdown", netip.Addr{})
+			return nil
+
+		case adv, ok := <-adverts:
+			if !ok {
+				return errors.New("VRRP receive loop stopped")
+			}
+			i.handleAdvert(conn, adv, timer)
+
+		case healthy := <-i.health:
+			i.handleHealth(conn, healthy, timer)
+
+		case <-timer.C:
+			switch i.currentState() {
+			case StateBackup:
+				i.becomeMaster(conn, "master down timer expired")
+				timer.Reset(i.config.AdvertInterval)
+			case StateMaster:
+				i.advertise(conn, i.currentPriority())
+				timer.Reset(i.config.AdvertInterval)
+			}
+		}
+	}
+}
+
+// open creates the raw socket used to send and receive advertisements
+func (i *Instance) open() (*ipv4.PacketConn, error) {
+	iface, err := net.InterfaceByName(i.config.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", i.config.Interface, err)
+	}
+	i.iface = iface
+	if i.localAddr, err = i.primaryAddress(); err != nil {
+		return nil, err
+	}
+
+	c, err := net.ListenPacket(fmt.Sprintf("ip4:%d", protocolNumber), "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open VRRP socket: %w", err)
+	}
+	conn := ipv4.NewPacketConn(c)
+
+	setup := func() error {
+		if err := conn.SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+			return err
+		}
+		// Advertisements must arrive with TTL 255, proving they were not routed
+		if err := conn.SetTTL(255); err != nil {
+			return err
+		}
+		if i.config.UnicastPeer.IsValid() {
+			return nil
+		}
+		if err := conn.SetMulticastTTL(255); err != nil {
+			return err
+		}
+		if err := conn.SetMulticastInterface(iface); err != nil {
+			return err
+		}
+		if err := conn.SetMulticastLoopback(false); err != nil {
+			return err
+		}
+		return conn.JoinGroup(iface, &net.IPAddr{IP: net.IP(multicastGroup.AsSlice())})
+	}
+	if err := setup(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set up VRRP socket: %w", err)
+	}
+	return conn, nil
+}
+
+// primaryAddress returns the first IPv4 address of the interface that is
+// not a VIP, used as the advertisement source
+func (i *Instance) primaryAddress() (netip.Addr, error) {
+	addrs, err := i.iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to list addresses of %s: %w", i.iface.Name, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok || !ip.Unmap().Is4() || i.isVIP(ip.Unmap()) {
+			continue
+		}
+		return ip.Unmap(), nil
+	}
+	return netip.Addr{}, fmt.Errorf("interface %s has no IPv4 address besides the VIPs", i.iface.Name)
+}
+
+func (i *Instance) isVIP(addr netip.Addr) bool {
+	for _, vip := range i.config.VIPs {
+		if vip.Addr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// receive reads advertisements for this virtual router until the socket
+// is closed
+func (i *Instance) receive(conn *ipv4.PacketConn, out chan<- advert) {
+	defer close(out)
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if cm == nil || cm.IfIndex != i.iface.Index {
+			continue
+		}
+		srcAddr, ok := netip.AddrFromSlice(src.(*net.IPAddr).IP)
+		dstAddr, ok2 := netip.AddrFromSlice(cm.Dst)
+		if !ok || !ok2 || srcAddr.Unmap() == i.localAddr {
+			continue
+		}
+		if cm.TTL != 255 {
+			i.logger.WithField("source", srcAddr.Unmap()).Warn("Dropped VRRP advertisement with TTL below 255")
+			continue
+		}
+
+		adv, err := parseAdvert(buf[:n], srcAddr.Unmap(), dstAddr.Unmap())
+		if err != nil {
+			i.logger.WithError(err).WithField("source", srcAddr.Unmap()).Warn("Dropped invalid VRRP advertisement")
+			continue
+		}
+		if adv.VRID != i.config.VirtualRouterID {
+			continue
+		}
+		out <- adv
+	}
+}
+
+// handleAdvert applies an advertisement from another instance
+func (i *Instance) handleAdvert(conn packetConn, adv advert, timer *time.Timer) {
+	priority := i.currentPriority()
+	switch i.currentState() {
+	case StateBackup:
+		if adv.Priority == 0 {
+			// The master is leaving, take over after the skew time
+			resetTimer(timer, i.skewTime())
+			return
+		}
+		if !i.config.Preempt || adv.Priority >= priority || time.Since(i.started) < i.config.PreemptDelay {
+			i.masterAdverInterval = adv.Interval
+			i.setMaster(adv.Source)
+			resetTimer(timer, i.masterDownInterval())
+		}
+		// Otherwise let the master down timer expire to preempt the lower
+		// priority master
+
+	case StateMaster:
+		if adv.Priority == 0 {
+			i.advertise(conn, priority)
+			resetTimer(timer, i.config.AdvertInterval)
+			return
+		}
+		if adv.Priority > priority || (adv.Priority == priority && adv.Source.Compare(i.localAddr) > 0) {
+			i.releaseVIPs()
+			i.masterAdverInterval = adv.Interval
+			i.transition(StateBackup, fmt.Sprintf("preempted by %s with priority %d", adv.Source, adv.Priority), adv.Source)
+			resetTimer(timer, i.masterDownInterval())
+		}
+	}
+}
+
+// handleHealth applies a local health result
+func (i *Instance) handleHealth(conn packetConn, healthy bool, timer *time.Timer) {
+	if healthy == i.healthy {
+		return
+	}
+	i.healthy = healthy
+
+	if i.config.HealthPenalty == 0 {
+		switch {
+		case !healthy:
+			if i.currentState() == StateMaster {
+				i.advertise(conn, 0)
+				i.releaseVIPs()
+			}
+			timer.Stop()
+			i.transition(StateFault, "health check failed", netip.Addr{})
+		case i.currentState() == StateFault:
+			i.transition(StateBackup, "health check recovered", netip.Addr{})
+			resetTimer(timer, i.masterDownInterval())
+		}
+		return
+	}
+
+	priority := i.config.Priority
+	reason := "health check recovered"
+	if !healthy {
+		priority -= i.config.HealthPenalty
+		reason = "health check failed"
+	}
+	i.mu.Lock()
+	i.priority = priority
+	i.mu.Unlock()
+	priorityGauge.WithLabelValues(i.vrid).Set(float64(priority))
+	i.logger.WithFields(logrus.Fields{
+		"vrid":     i.config.VirtualRouterID,
+		"priority": priority,
+		"reason":   reason,
+	}).Warn("VRRP priority changed")
+
+	// Tell the backup right away so it can preempt
+	if i.currentState() == StateMaster {
+		i.advertise(conn, priority)
+		resetTimer(timer, i.config.AdvertInterval)
+	}
+}
+
+// becomeMaster takes the VIPs over
+func (i *Instance) becomeMaster(conn packetConn, reason string) {
+	i.advertise(conn, i.currentPriority())
+	for _, vip := range i.config.VIPs {
+		if err := i.addVIP(i.iface, vip); err != nil {
+			i.logger.WithError(err).WithField("vip", vip).Error("Failed to add VIP")
+			continue
+		}
+		if err := i.sendGratuitousARP(i.iface, vip.Addr()); err != nil {
+			i.logger.WithError(err).WithField("vip", vip).Warn("Failed to send gratuitous ARP")
+		}
+	}
+	i.transition(StateMaster, reason, i.localAddr)
+}
+
+// releaseVIPs removes the VIPs from the interface
+func (i *Instance) releaseVIPs() {
+	for _, vip := range i.config.VIPs {
+		if err := i.removeVIP(i.iface, vip); err != nil {
+			i.logger.WithError(err).WithField("vip", vip).Error("Failed to remove VIP")
+		}
+	}
+}
+
+// advertise sends an advertisement with the given priority
+func (i *Instance) advertise(conn packetConn, priority uint8) {
+	dst := multicastGroup
+	if i.config.UnicastPeer.IsValid() {
+		dst = i.config.UnicastPeer
+	}
+	adv := advert{
+		VRID:     i.config.VirtualRouterID,
+		Priority: priority,
+		Interval: i.config.AdvertInterval,
+	}
+	for _, vip := range i.config.VIPs {
+		adv.Addresses = append(adv.Addresses, vip.Addr())
+	}
+
+	cm := &ipv4.ControlMessage{Src: net.IP(i.localAddr.AsSlice()), IfIndex: i.iface.Index}
+	if _, err := conn.WriteTo(adv.marshal(i.localAddr, dst), cm, &net.IPAddr{IP: net.IP(dst.AsSlice())}); err != nil {
+		i.logger.WithError(err).Warn("Failed to send VRRP advertisement")
+	}
+}
+
+// transition changes state and logs it as a failover event
+func (i *Instance) transition(state, reason string, master netip.Addr) {
+	i.mu.Lock()
+	from := i.state
+	i.state = state
+	i.master = master
+	event := Event{Time: time.Now(), From: from, To: state, Reason: reason, Priority: i.priority}
+	i.events = append(i.events, event)
+	if len(i.events) > maxEvents {
+		i.events = i.events[len(i.events)-maxEvents:]
+	}
+	i.mu.Unlock()
+
+	if state == StateMaster {
+		masterGauge.WithLabelValues(i.vrid).Set(1)
+	} else {
+		masterGauge.WithLabelValues(i.vrid).Set(0)
+	}
+	transitions.WithLabelValues(i.vrid, state).Inc()
+
+	entry := i.logger.WithFields(logrus.Fields{
+		"vrid":     i.config.VirtualRouterID,
+		"from":     from,
+		"to":       state,
+		"reason":   reason,
+		"priority": event.Priority,
+	})
+	if master.IsValid() {
+		entry = entry.WithField("master", master.String())
+	}
+	if from == StateMaster || state == StateMaster || state == StateFault {
+		entry.Warn("VRRP failover")
+	} else {
+		entry.Info("VRRP state changed")
+	}
+}
+
+func (i *Instance) setMaster(master netip.Addr) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.master = master
+}
+
+func (i *Instance) currentState() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+func (i *Instance) currentPriority() uint8 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.priority
+}
+
+// skewTime lets higher priority backups take over first
+func (i *Instance) skewTime() time.Duration {
+	return time.Duration(256-int(i.currentPriority())) * i.masterAdverInterval / 256
+}
+
+// masterDownInterval is how long a backup waits for advertisements before
+// taking over
+func (i *Instance) masterDownInterval() time.Duration {
+	return 3*i.masterAdverInterval + i.skewTime()
+}
+
+// resetTimer restarts a timer that may have fired without being drained
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
@@ -0,0 +1,444 @@
+package vrrp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+var testPeer = netip.MustParseAddr("10.0.0.2")
+
+// fakeLink records advertisements sent and the VIPs held on the interface
+type fakeLink struct {
+	t       *testing.T
+	adverts chan advert
+
+	mu   sync.Mutex
+	vips map[netip.Prefix]bool
+	arps int
+}
+
+func (f *fakeLink) WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error) {
+	src, _ := netip.AddrFromSlice(cm.Src)
+	to, _ := netip.AddrFromSlice(dst.(*net.IPAddr).IP)
+	adv, err := parseAdvert(b, src.Unmap(), to.Unmap())
+	if err != nil {
+		f.t.Errorf("sent an invalid advertisement: %v", err)
+		return 0, err
+	}
+	select {
+	case f.adverts <- adv:
+	default:
+	}
+	return len(b), nil
+}
+
+// gratuitousARPs returns how many gratuitous ARPs were sent
+func (f *fakeLink) gratuitousARPs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.arps
+}
+
+// held returns the VIPs on the interface
+func (f *fakeLink) held() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var held []string
+	for vip, ok := range f.vips {
+		if ok {
+			held = append(held, vip.String())
+		}
+	}
+	sort.Strings(held)
+	return held
+}
+
+// nextAdvert returns the next advertisement sent within wait
+func (f *fakeLink) nextAdvert(wait time.Duration) (advert, bool) {
+	select {
+	case adv := <-f.adverts:
+		return adv, true
+	default:
+	}
+	select {
+	case adv := <-f.adverts:
+		return adv, true
+	case <-time.After(wait):
+		return advert{}, false
+	}
+}
+
+// drain discards advertisements sent so far
+func (f *fakeLink) drain() {
+	for {
+		select {
+		case <-f.adverts:
+		default:
+			return
+		}
+	}
+}
+
+// testInstance runs an instance on a fake interface, feeding it the
+// advertisements sent to the returned channel
+type testInstance struct {
+	*Instance
+	link    *fakeLink
+	adverts chan advert
+	cancel  context.CancelFunc
+	done    chan error
+
+	once sync.Once
+	err  error
+}
+
+func startInstance(t *testing.T, config Config) *testInstance {
+	t.Helper()
+	if config.Interface == "" {
+		config.Interface = "test0"
+	}
+	if config.VirtualRouterID == 0 {
+		config.VirtualRouterID = 51
+	}
+	if config.Priority == 0 {
+		config.Priority = 100
+	}
+	if config.VIPs == nil {
+		config.VIPs = []netip.Prefix{netip.MustParsePrefix("192.0.2.10/24")}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	i, err := NewInstance(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := &fakeLink{t: t, adverts: make(chan advert, 256), vips: make(map[netip.Prefix]bool)}
+	i.iface = &net.Interface{Index: 1, Name: config.Interface}
+	i.localAddr = testSource
+	i.addVIP = func(_ *net.Interface, vip netip.Prefix) error {
+		link.mu.Lock()
+		defer link.mu.Unlock()
+		link.vips[vip] = true
+		return nil
+	}
+	i.removeVIP = func(_ *net.Interface, vip netip.Prefix) error {
+		link.mu.Lock()
+		defer link.mu.Unlock()
+		link.vips[vip] = false
+		return nil
+	}
+	i.sendGratuitousARP = func(_ *net.Interface, vip netip.Addr) error {
+		link.mu.Lock()
+		defer link.mu.Unlock()
+		link.arps++
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ti := &testInstance{Instance: i, link: link, adverts: make(chan advert), cancel: cancel, done: make(chan error, 1)}
+	go func() { ti.done <- i.loop(ctx, link, ti.adverts) }()
+	t.Cleanup(func() { ti.stop() })
+	return ti
+}
+
+// stop shuts the instance down and returns the loop's error
+func (ti *testInstance) stop() error {
+	ti.once.Do(func() {
+		ti.cancel()
+		ti.err = <-ti.done
+	})
+	return ti.err
+}
+
+// receive delivers an advertisement from the test peer
+func (ti *testInstance) receive(priority uint8, interval time.Duration) {
+	ti.adverts <- advert{Source: testPeer, VRID: ti.config.VirtualRouterID, Priority: priority, Interval: interval}
+}
+
+// waitState waits for the instance to reach state
+func (ti *testInstance) waitState(t *testing.T, state string, wait time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(wait)
+	for ti.Status().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("state %s after %s, want %s", ti.Status().State, wait, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lastEvent returns the most recent transition
+func (ti *testInstance) lastEvent() Event {
+	events := ti.Status().Events
+	return events[len(events)-1]
+}
+
+func TestBecomesMasterWithoutAdverts(t *testing.T) {
+	ti := startInstance(t, Config{AdvertInterval: 10 * time.Millisecond})
+	ti.waitState(t, StateMaster, time.Second)
+
+	if got := ti.link.held(); strings.Join(got, ",") != "192.0.2.10/24" {
+		t.Errorf("VIPs held %v", got)
+	}
+	if n := ti.link.gratuitousARPs(); n != 1 {
+		t.Errorf("%d gratuitous ARPs, want 1", n)
+	}
+	adv, ok := ti.link.nextAdvert(time.Second)
+	if !ok || adv.Priority != 100 || adv.VRID != 51 || len(adv.Addresses) != 1 || adv.Addresses[0] != testVIP {
+		t.Errorf("advertisement %+v", adv)
+	}
+	status := ti.Status()
+	if status.Master != testSource.String() {
+		t.Errorf("master %q", status.Master)
+	}
+	if event := ti.lastEvent(); event.From != StateBackup || event.Reason != "master down timer expired" {
+		t.Errorf("event %+v", event)
+	}
+
+	// Shutting down hands over at once with priority 0 and frees the VIPs
+	ti.link.drain()
+	ti.stop()
+	for {
+		adv, ok := ti.link.nextAdvert(0)
+		if !ok {
+			t.Fatal("no priority 0 advertisement on shutdown")
+		}
+		if adv.Priority == 0 {
+			break
+		}
+	}
+	if got := ti.link.held(); len(got) != 0 {
+		t.Errorf("VIPs held after shutdown %v", got)
+	}
+	if status := ti.Status(); status.State != StateInit {
+		t.Errorf("state after shutdown %s", status.State)
+	}
+}
+
+func TestBackupFollowsMaster(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		config   Config
+		priority uint8
+	}{
+		{"higher priority", Config{Preempt: true}, 200},
+		{"equal priority", Config{Preempt: true}, 100},
+		{"lower priority without preemption", Config{}, 50},
+		{"lower priority within the preempt delay", Config{Preempt: true, PreemptDelay: time.Hour}, 50},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.config.AdvertInterval = 10 * time.Millisecond
+			ti := startInstance(t, c.config)
+
+			// Outlast the instance's own master down interval
+			for n := 0; n < 10; n++ {
+				ti.receive(c.priority, 100*time.Millisecond)
+				time.Sleep(10 * time.Millisecond)
+			}
+			status := ti.Status()
+			if status.State != StateBackup || status.Master != testPeer.String() {
+				t.Errorf("state %s with master %q, want backup to %s", status.State, status.Master, testPeer)
+			}
+			if got := ti.link.held(); len(got) != 0 {
+				t.Errorf("backup holds %v", got)
+			}
+		})
+	}
+}
+
+func TestBackupPreemptsLowerPriority(t *testing.T) {
+	ti := startInstance(t, Config{AdvertInterval: 10 * time.Millisecond, Preempt: true})
+	deadline := time.Now().Add(time.Second)
+	for ti.Status().State != StateMaster {
+		if time.Now().After(deadline) {
+			t.Fatal("lower priority master not preempted")
+		}
+		ti.receive(50, 10*time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ti.link.held(); len(got) != 1 {
+		t.Errorf("VIPs held %v", got)
+	}
+}
+
+func TestMasterYields(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		priority uint8
+		source   netip.Addr
+		yields   bool
+	}{
+		{"higher priority", 101, testPeer, true},
+		{"equal priority from a higher address", 100, testPeer, true},
+		{"equal priority from a lower address", 100, netip.MustParseAddr("10.0.0.0"), false},
+		{"lower priority", 99, testPeer, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ti := startInstance(t, Config{AdvertInterval: 10 * time.Millisecond})
+			ti.waitState(t, StateMaster, time.Second)
+
+			// The loop takes the second advertisement once the first is
+			// handled
+			ti.adverts <- advert{Source: c.source, VRID: 51, Priority: c.priority, Interval: time.Second}
+			ti.adverts <- advert{Source: c.source, VRID: 51, Priority: c.priority, Interval: time.Second}
+			status := ti.Status()
+			if !c.yields {
+				if status.State != StateMaster {
+					t.Errorf("state %s, want master kept", status.State)
+				}
+				return
+			}
+			if status.State != StateBackup || status.Master != c.source.String() {
+				t.Errorf("state %s with master %q, want backup to %s", status.State, status.Master, c.source)
+			}
+			if got := ti.link.held(); len(got) != 0 {
+				t.Errorf("VIPs held after yielding %v", got)
+			}
+			if event := ti.lastEvent(); !strings.HasPrefix(event.Reason, "preempted by "+c.source.String()) {
+				t.Errorf("event %+v", event)
+			}
+		})
+	}
+}
+
+func TestPriorityZero(t *testing.T) {
+	// A backup takes over after the skew time, well before the master down
+	// interval of 3.6s
+	ti := startInstance(t, Config{AdvertInterval: time.Second})
+	ti.receive(200, time.Second)
+	started := time.Now()
+	ti.receive(0, time.Second)
+	ti.waitState(t, StateMaster, 2*time.Second)
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond {
+		t.Errorf("took over after %s, want the skew time of about 609ms", elapsed)
+	}
+
+	// A master answers with an advertisement at once
+	ti.link.drain()
+	ti.receive(0, time.Second)
+	adv, ok := ti.link.nextAdvert(500 * time.Millisecond)
+	if !ok || adv.Priority != 100 {
+		t.Errorf("answer %+v, want an advertisement with priority 100", adv)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("fault without a penalty", func(t *testing.T) {
+		ti := startInstance(t, Config{AdvertInterval: 10 * time.Millisecond})
+		ti.waitState(t, StateMaster, time.Second)
+		ti.link.drain()
+
+		ti.SetHealthy(false)
+		ti.waitState(t, StateFault, time.Second)
+		if got := ti.link.held(); len(got) != 0 {
+			t.Errorf("VIPs held in fault %v", got)
+		}
+		var sawZero bool
+		for {
+			adv, ok := ti.link.nextAdvert(0)
+			if !ok {
+				break
+			}
+			sawZero = sawZero || adv.Priority == 0
+		}
+		if !sawZero {
+			t.Error("no priority 0 advertisement on fault")
+		}
+
+		// Faulted instances stay out of the election
+		time.Sleep(50 * time.Millisecond)
+		if state := ti.Status().State; state != StateFault {
+			t.Errorf("state %s, want fault", state)
+		}
+
+		ti.SetHealthy(true)
+		ti.waitState(t, StateMaster, time.Second)
+		events := ti.Status().Events
+		if reason := events[len(events)-2].Reason; reason != "health check recovered" {
+			t.Errorf("recovery event %q", reason)
+		}
+	})
+
+	t.Run("penalty", func(t *testing.T) {
+		ti := startInstance(t, Config{AdvertInterval: time.Second, HealthPenalty: 60})
+		ti.receive(0, time.Second)
+		ti.waitState(t, StateMaster, 2*time.Second)
+		ti.link.drain()
+
+		ti.SetHealthy(false)
+		adv, ok := ti.link.nextAdvert(500 * time.Millisecond)
+		if !ok || adv.Priority != 40 {
+			t.Errorf("advertisement %+v, want priority 40 at once", adv)
+		}
+		if status := ti.Status(); status.State != StateMaster || status.Priority != 40 {
+			t.Errorf("state %s with priority %d", status.State, status.Priority)
+		}
+
+		// The lowered priority loses to a peer it used to beat
+		ti.receive(50, time.Second)
+		ti.receive(50, time.Second)
+		if state := ti.Status().State; state != StateBackup {
+			t.Errorf("state %s, want backup", state)
+		}
+
+		ti.SetHealthy(true)
+		deadline := time.Now().Add(time.Second)
+		for ti.Status().Priority != 100 {
+			if time.Now().After(deadline) {
+				t.Fatal("priority not restored")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestLoopStopsWithoutAdverts(t *testing.T) {
+	ti := startInstance(t, Config{AdvertInterval: time.Second})
+	close(ti.adverts)
+	err := <-ti.done
+	if err == nil || !strings.Contains(err.Error(), "receive loop stopped") {
+		t.Errorf("error %v", err)
+	}
+	ti.done <- err // For the cleanup
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{
+		Interface:       "eth0",
+		VirtualRouterID: 51,
+		Priority:        100,
+		VIPs:            []netip.Prefix{netip.MustParsePrefix("192.0.2.10/24")},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(*Config){
+		"no interface":       func(c *Config) { c.Interface = "" },
+		"no VRID":            func(c *Config) { c.VirtualRouterID = 0 },
+		"priority 0":         func(c *Config) { c.Priority = 0 },
+		"priority 255":       func(c *Config) { c.Priority = 255 },
+		"penalty too large":  func(c *Config) { c.HealthPenalty = 100 },
+		"no VIPs":            func(c *Config) { c.VIPs = nil },
+		"IPv6 VIP":           func(c *Config) { c.VIPs = []netip.Prefix{netip.MustParsePrefix("2001:db8::10/64")} },
+		"interval too short": func(c *Config) { c.AdvertInterval = time.Millisecond },
+		"interval too long":  func(c *Config) { c.AdvertInterval = time.Minute },
+		"IPv6 unicast peer":  func(c *Config) { c.UnicastPeer = netip.MustParseAddr("2001:db8::2") },
+	} {
+		c := valid
+		change(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: valid", name)
+		}
+	}
+}
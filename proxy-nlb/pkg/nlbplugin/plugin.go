@@ -0,0 +1,154 @@
+// Package nlbplugin lets teams add protocols to the MarchProxy NLB without
+// changing it. A plugin detects its protocol from the first bytes of a
+// connection and may choose which module serves each connection; the NLB
+// does everything else (health, limits, metrics, geo policy).
+//
+// Plugins are compiled into a custom NLB binary by importing them for their
+// Register call, or built separately with -buildmode=plugin and listed under
+// plugins in the NLB config. A shared object must export a *Plugin named
+// MarchProxyPlugin and must be built with the same Go version and the same
+// versions of every shared dependency as the NLB, as the Go runtime
+// requires; loading fails otherwise.
+//
+// APIVersion changes whenever these types change incompatibly. The NLB only
+// accepts plugins declaring the version it was built with.
+package nlbplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"plugin"
+	"regexp"
+	"sync"
+)
+
+// APIVersion is the version of the plugin interface
+const APIVersion = 1
+
+// SymbolName is the symbol a shared-object plugin exports
+const SymbolName = "MarchProxyPlugin"
+
+// Detector recognises a protocol
+type Detector interface {
+	// Detect reports whether the first bytes a client sent belong to the
+	// protocol. data holds at least MinBytes bytes when the client sent
+	// that many. It is called concurrently and must not keep or modify data.
+	Detect(data []byte) bool
+}
+
+// Handler routes connections of a protocol
+type Handler interface {
+	// SelectModule picks the module a connection goes to, by name, among
+	// the healthy modules of the protocol. An empty name leaves the choice
+	// to the NLB's least-connections balancing, and an error refuses the
+	// connection. It is called concurrently.
+	SelectModule(ctx context.Context, conn Connection, modules []Module) (string, error)
+}
+
+// Connection is what the NLB knows about a connection being routed
+type Connection struct {
+	ClientAddr net.Addr // nil when the listener doesn't report it
+	Data       []byte   // The first bytes the client sent, read-only
+}
+
+// Module is a module a connection can be routed to
+type Module struct {
+	Name        string
+	Address     string
+	Version     string
+	Weight      int
+	ActiveConns int
+	MaxConns    int
+}
+
+// Plugin describes a protocol plugin
+type Plugin struct {
+	APIVersion int      // Must be APIVersion
+	Name       string   // Protocol name used in module and route configs, e.g. "stomp"
+	MinBytes   int      // Bytes Detect needs, at most 64
+	Detector   Detector // Required
+	Handler    Handler  // Optional, least connections when nil
+}
+
+// maxMinBytes bounds what the NLB reads before detecting a protocol
+const maxMinBytes = 64
+
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// Validate checks a plugin against the interface version of the NLB
+func (p *Plugin) Validate() error {
+	if p == nil {
+		return errors.New("plugin is nil")
+	}
+	if p.APIVersion != APIVersion {
+		return fmt.Errorf("plugin %q uses plugin API version %d, the NLB supports %d", p.Name, p.APIVersion, APIVersion)
+	}
+	if !namePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid plugin name %q: lowercase letters, digits, - and _, up to 32", p.Name)
+	}
+	if p.Detector == nil {
+		return fmt.Errorf("plugin %s has no detector", p.Name)
+	}
+	if p.MinBytes < 0 || p.MinBytes > maxMinBytes {
+		return fmt.Errorf("plugin %s: min bytes must be 0-%d", p.Name, maxMinBytes)
+	}
+	return nil
+}
+
+var (
+	registry   []*Plugin
+	registryMu sync.Mutex
+)
+
+// Register adds a compiled-in plugin, usually from the plugin package's
+// init function. It panics on an invalid or duplicate plugin, as a broken
+// build should fail at startup.
+func Register(p *Plugin) {
+	if err := p.Validate(); err != nil {
+		panic(err)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, existing := range registry {
+		if existing.Name == p.Name {
+			panic(fmt.Sprintf("nlbplugin: plugin %s registered twice", p.Name))
+		}
+	}
+	registry = append(registry, p)
+}
+
+// Registered returns the compiled-in plugins in registration order
+func Registered() []*Plugin {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return append([]*Plugin(nil), registry...)
+}
+
+// Load opens a shared-object plugin and returns the plugin it exports
+func Load(path string) (*Plugin, error) {
+	so, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin %s: %w", path, err)
+	}
+	symbol, err := so.Lookup(SymbolName)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+
+	var p *Plugin
+	switch s := symbol.(type) {
+	case **Plugin:
+		p = *s
+	case *Plugin:
+		p = s
+	default:
+		return nil, fmt.Errorf("plugin %s: %s is a %T, not a *nlbplugin.Plugin", path, SymbolName, symbol)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	return p, nil
+}
@@ -14,7 +14,8 @@ import (
 	"github.com/penguintech/marchproxy/proxy-rtmp/internal/transcode"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/metering"
 )
 
 var (
@@ -45,16 +46,55 @@ Outputs HLS and DASH adaptive streams.`,
 	rootCmd.PersistentFlags().Int("segment-duration", 6, "Segment duration in seconds")
 	rootCmd.PersistentFlags().String("preset", "medium", "Encoding preset (ultrafast, fast, medium, slow)")
 
-	viper.BindPFlags(rootCmd.PersistentFlags())
+	layers.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.AddCommand(newConfigCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		logrus.WithError(err).Fatal("Failed to execute command")
 	}
 }
 
+// newConfigCmd creates the config command. config print-effective prints
+// the configuration this binary would run with, given the same flags and
+// environment, with secrets masked.
+func newConfigCmd() *cobra.Command {
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print-effective",
+		Short: "Print the merged configuration with secrets masked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := config.Load(cfgFile, cmd.Flags())
+			if err == nil {
+				err = layers.PrintEffective(os.Stdout, cfg, format)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", "yaml", "output format: yaml or json")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(printCmd)
+	return configCmd
+}
+
 func run(cmd *cobra.Command, args []string) {
 	// Initialize configuration
-	cfg, err := config.Load(cfgFile)
+	cfg, err := config.Load(cfgFile, cmd.Flags())
+	if validate, _ := cmd.Flags().GetBool("validate-config"); validate {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to load configuration")
 	}
@@ -81,12 +121,18 @@ func run(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Gate enterprise transcoding tiers on the cluster's entitlements
+	license := cfg.NewLicenseGate()
+	license.Refresh(ctx)
+	go license.Run(ctx)
+
 	// Initialize GPU detector and select encoder
 	detector := transcode.NewDetector()
 	encoderConfig, err := detector.SelectEncoder(cfg.Encoder)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to select encoder")
 	}
+	encoderConfig = transcode.LicensedEncoder(encoderConfig, license)
 
 	logrus.WithFields(logrus.Fields{
 		"encoder":      encoderConfig.Name,
@@ -98,12 +144,38 @@ func run(cmd *cobra.Command, args []string) {
 	// Initialize FFmpeg manager
 	ffmpegManager := transcode.NewManager(encoderConfig, cfg)
 
+	// Meter transcode minutes for chargeback
+	meter := newMeter(cfg)
+	if meter != nil {
+		ffmpegManager.SetMeter(meter, cfg.Tenant)
+		go meter.Run(ctx, time.Duration(cfg.MeteringInterval)*time.Second)
+		logrus.WithFields(logrus.Fields{
+			"tenant":   cfg.Tenant,
+			"interval": cfg.MeteringInterval,
+		}).Info("Usage metering enabled")
+	}
+
 	// Initialize RTMP server
 	rtmpServer, err := rtmp.NewServer(cfg, ffmpegManager)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to create RTMP server")
 	}
 
+	// Let publishers of streams handed over by the previous instance resume them
+	if cfg.HandoffFile != "" {
+		streams, err := rtmp.ReadHandoff(cfg.HandoffFile)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to load stream handoff")
+		}
+		window := time.Duration(cfg.HandoffResumeWindow) * time.Second
+		if imported := rtmpServer.ImportStreams(streams, window); imported > 0 {
+			logrus.WithFields(logrus.Fields{
+				"streams":       imported,
+				"resume_window": window,
+			}).Info("Handed over streams can resume")
+		}
+	}
+
 	// Initialize gRPC server (ModuleService)
 	grpcServer := grpc.NewServer(cfg, rtmpServer, ffmpegManager)
 
@@ -147,10 +219,51 @@ func run(cmd *cobra.Command, args []string) {
 	// Stop gRPC server
 	grpcServer.Stop()
 
+	// Hand the active streams to the replacing instance
+	if cfg.HandoffFile != "" {
+		streams := rtmpServer.ExportStreams()
+		if err := rtmp.WriteHandoff(cfg.HandoffFile, streams); err != nil {
+			logrus.WithError(err).Error("Failed to write stream handoff")
+		} else {
+			logrus.WithField("streams", len(streams)).Info("Handed over active streams")
+		}
+	}
+
 	// Stop RTMP server
 	if err := rtmpServer.Stop(shutdownCtx); err != nil {
 		logrus.WithError(err).Error("Error stopping RTMP server")
 	}
 
+	// Export usage of the last partial period
+	if meter != nil {
+		meter.Flush()
+	}
+
 	logrus.Info("Shutdown complete")
 }
+
+// newMeter creates the usage meter with its sinks, nil when metering is
+// disabled or has nowhere to send records
+func newMeter(cfg *config.Config) *metering.Meter {
+	if cfg.MeteringInterval <= 0 {
+		return nil
+	}
+	proxyName, _ := os.Hostname()
+
+	var sinks []metering.Sink
+	if cfg.MeteringManagerURL != "" {
+		sinks = append(sinks, newManagerUsageSink(cfg.MeteringManagerURL, cfg.MeteringAPIKey, proxyName))
+	}
+	if cfg.MeteringCSVDir != "" {
+		sink, err := metering.NewCSVSink(cfg.MeteringCSVDir)
+		if err != nil {
+			logrus.WithError(err).Warn("Usage CSV export disabled")
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return metering.New("rtmp", proxyName, sinks...)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"marchproxy-shared/metering"
+)
+
+// managerUsageSink uploads records to the manager's /api/proxy/usage endpoint,
+// authenticated with the cluster API key
+type managerUsageSink struct {
+	url       string
+	apiKey    string
+	proxyName string
+	client    *http.Client
+}
+
+// usageRequest is the body of a usage upload
+type usageRequest struct {
+	ProxyName     string   `json:"proxy_name"`
+	ClusterAPIKey string   `json:"cluster_api_key"`
+	Records       []metering.Record `json:"records"`
+}
+
+// usageResponse is the manager's answer to a usage upload
+type usageResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// newManagerUsageSink creates a sink uploading to the manager at managerURL
+func newManagerUsageSink(managerURL, apiKey, proxyName string) *managerUsageSink {
+	return &managerUsageSink{
+		url:       strings.TrimRight(managerURL, "/") + "/api/proxy/usage",
+		apiKey:    apiKey,
+		proxyName: proxyName,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name implements metering.Sink
+func (s *managerUsageSink) Name() string {
+	return "manager"
+}
+
+// Write implements metering.Sink
+func (s *managerUsageSink) Write(records []metering.Record) error {
+	body, err := json.Marshal(usageRequest{ProxyName: s.proxyName, ClusterAPIKey: s.apiKey, Records: records})
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("usage upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read usage response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("usage upload failed with status %d: %s", resp.StatusCode, string(data))
+	}
+
+	var result usageResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("failed to parse usage response: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("usage upload rejected: %s", result.Error)
+	}
+	return nil
+}
@@ -3,8 +3,13 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"marchproxy-shared/layers"
+	"marchproxy-shared/licensing"
 )
 
 // Config holds the RTMP proxy configuration
@@ -14,6 +19,10 @@ type Config struct {
 	Port     int    `mapstructure:"port"`
 	GRPCPort int    `mapstructure:"grpc-port"`
 
+	// gRPC on a unix socket instead of grpc-port, for sidecars
+	GRPCSocket     string `mapstructure:"grpc-socket"`
+	GRPCSocketMode string `mapstructure:"grpc-socket-mode"` // Octal permissions, 0660 when empty
+
 	// Logging
 	LogLevel string `mapstructure:"log-level"`
 
@@ -39,44 +48,88 @@ type Config struct {
 
 	// Health check
 	HealthCheckInterval int `mapstructure:"health-check-interval"` // seconds
+
+	// Usage metering of transcode minutes for chargeback
+	Tenant             string `mapstructure:"tenant"`               // tenant billed for this container's transcodes
+	MeteringInterval   int    `mapstructure:"metering-interval"`    // seconds per usage record, 0 disables
+	MeteringCSVDir     string `mapstructure:"metering-csv-dir"`     // append records to daily CSV files here
+	MeteringManagerURL string `mapstructure:"metering-manager-url"` // upload records to this manager
+	MeteringAPIKey     string `mapstructure:"metering-api-key"`     // cluster API key for the upload
+
+	// Enterprise transcoding tiers, gated on the manager's entitlements in release mode
+	ReleaseMode            bool   `mapstructure:"release-mode"`
+	ManagerURL             string `mapstructure:"manager-url"`
+	ClusterAPIKey          string `mapstructure:"cluster-api-key"`
+	LicenseRefreshInterval int    `mapstructure:"license-refresh-interval"` // seconds
+	LicenseGracePeriod     int    `mapstructure:"license-grace-period"`     // seconds cached entitlements outlive an unreachable manager
+	LicenseCacheFile       string `mapstructure:"license-cache-file"`       // keep entitlements here across restarts
+
+	// Stream handoff to a replacement instance during planned maintenance
+	HandoffFile         string `mapstructure:"handoff-file"`          // write stream metadata here on shutdown and restore it from here at startup
+	HandoffResumeWindow int    `mapstructure:"handoff-resume-window"` // seconds a publisher has to reconnect and resume its stream
+}
+
+// flagKeys are the config keys command line flags of the same name set
+var flagKeys = []string{
+	"host", "port", "grpc-port", "log-level", "encoder", "preset",
+	"output-dir", "enable-hls", "enable-dash", "segment-duration",
 }
 
-// Load loads configuration from file and environment
-func Load(cfgFile string) (*Config, error) {
+// Load loads configuration from defaults, the config file, RTMP_*
+// environment variables and command line flags, each overriding the one
+// before
+func Load(cfgFile string, flags *pflag.FlagSet) (*Config, error) {
+	l := layers.New("RTMP")
+	v := l.Viper()
+
 	// Set defaults
-	viper.SetDefault("host", "0.0.0.0")
-	viper.SetDefault("port", 1935)
-	viper.SetDefault("grpc-port", 50053)
-	viper.SetDefault("log-level", "info")
-	viper.SetDefault("encoder", "auto")
-	viper.SetDefault("preset", "medium")
-	viper.SetDefault("output-dir", "/var/lib/marchproxy/streams")
-	viper.SetDefault("enable-hls", true)
-	viper.SetDefault("enable-dash", true)
-	viper.SetDefault("segment-duration", 6)
-	viper.SetDefault("ffmpeg-path", "ffmpeg")
-	viper.SetDefault("ffprobe-path", "ffprobe")
-	viper.SetDefault("max-bitrate", 10)         // 10 Mbps default
-	viper.SetDefault("max-streams", 100)        // 100 concurrent streams
-	viper.SetDefault("max-resolution", 1080)    // 1080p max
-	viper.SetDefault("health-check-interval", 30)
+	v.SetDefault("host", "0.0.0.0")
+	v.SetDefault("port", 1935)
+	v.SetDefault("grpc-port", 50053)
+	v.SetDefault("log-level", "info")
+	v.SetDefault("encoder", "auto")
+	v.SetDefault("preset", "medium")
+	v.SetDefault("output-dir", "/var/lib/marchproxy/streams")
+	v.SetDefault("enable-hls", true)
+	v.SetDefault("enable-dash", true)
+	v.SetDefault("segment-duration", 6)
+	v.SetDefault("ffmpeg-path", "ffmpeg")
+	v.SetDefault("ffprobe-path", "ffprobe")
+	v.SetDefault("max-bitrate", 10)         // 10 Mbps default
+	v.SetDefault("max-streams", 100)        // 100 concurrent streams
+	v.SetDefault("max-resolution", 1080)    // 1080p max
+	v.SetDefault("health-check-interval", 30)
+	v.SetDefault("tenant", "default")
+	v.SetDefault("metering-interval", 300)
+	v.SetDefault("release-mode", false)
+	v.SetDefault("license-refresh-interval", 300)
+	v.SetDefault("license-grace-period", 259200) // 72 hours
+	v.SetDefault("handoff-resume-window", 60)
+
+	// Flags share their names with config keys
+	if flags != nil {
+		for _, key := range flagKeys {
+			if err := l.BindFlag(key, flags.Lookup(key)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := l.ApplySet(flags); err != nil {
+		return nil, err
+	}
 
 	// Load config file if specified
 	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
+		v.SetConfigFile(cfgFile)
 	} else {
-		viper.SetConfigName("rtmp")
-		viper.SetConfigType("yaml")
-		viper.AddConfigPath("/etc/marchproxy/")
-		viper.AddConfigPath(".")
+		v.SetConfigName("rtmp")
+		v.SetConfigType("yaml")
+		v.AddConfigPath("/etc/marchproxy/")
+		v.AddConfigPath(".")
 	}
 
-	// Environment variables
-	viper.SetEnvPrefix("RTMP")
-	viper.AutomaticEnv()
-
 	// Read config file (optional)
-	if err := viper.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			return nil, fmt.Errorf("error reading config: %w", err)
 		}
@@ -84,11 +137,14 @@ func Load(cfgFile string) (*Config, error) {
 
 	// Unmarshal config
 	var cfg Config
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("error unmarshaling config: %w", err)
+	if err := l.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	// Validate and create output directory
+	// Create output directory
 	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
@@ -106,6 +162,28 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid gRPC port: %d", c.GRPCPort)
 	}
 
+	if _, err := c.SocketMode(); err != nil {
+		return err
+	}
+
+	if c.MeteringInterval < 0 {
+		return fmt.Errorf("metering interval cannot be negative")
+	}
+	if c.MeteringManagerURL != "" && c.MeteringAPIKey == "" {
+		return fmt.Errorf("metering-api-key is required to upload usage to the manager")
+	}
+
+	if c.ReleaseMode && (c.ManagerURL == "" || c.ClusterAPIKey == "") {
+		return fmt.Errorf("manager-url and cluster-api-key are required in release mode")
+	}
+	if c.LicenseRefreshInterval <= 0 || c.LicenseGracePeriod <= 0 {
+		return fmt.Errorf("license refresh interval and grace period must be positive")
+	}
+
+	if c.HandoffResumeWindow < 0 {
+		return fmt.Errorf("handoff resume window cannot be negative")
+	}
+
 	if c.SegmentDuration < 1 || c.SegmentDuration > 60 {
 		return fmt.Errorf("segment duration must be between 1 and 60 seconds")
 	}
@@ -130,3 +208,30 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// SocketMode returns the permissions of the gRPC unix socket
+func (c *Config) SocketMode() (os.FileMode, error) {
+	if c.GRPCSocketMode == "" {
+		return 0660, nil
+	}
+	mode, err := strconv.ParseUint(c.GRPCSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid grpc-socket-mode %q: must be octal permissions such as 0660", c.GRPCSocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// NewLicenseGate creates the gate for enterprise transcoding tiers. In
+// release mode it follows the entitlements the manager reports for the
+// cluster; in development mode all tiers are available.
+func (c *Config) NewLicenseGate() *licensing.Gate {
+	if !c.ReleaseMode {
+		return licensing.Unrestricted()
+	}
+	proxyName, _ := os.Hostname()
+	return licensing.New(licensing.ManagerFetcher(c.ManagerURL, c.ClusterAPIKey, proxyName), licensing.Options{
+		Refresh:   time.Duration(c.LicenseRefreshInterval) * time.Second,
+		Grace:     time.Duration(c.LicenseGracePeriod) * time.Second,
+		CacheFile: c.LicenseCacheFile,
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"time"
 
 	"github.com/penguintech/marchproxy/proxy-rtmp/internal/config"
@@ -36,7 +37,12 @@ func NewServer(cfg *config.Config, rtmpSrv *rtmp.Server, ffmpegMgr *transcode.Ma
 // Start starts the gRPC server
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.GRPCPort)
-	listener, err := net.Listen("tcp", addr)
+	listen := func() (net.Listener, error) { return net.Listen("tcp", addr) }
+	if s.config.GRPCSocket != "" {
+		addr = "unix:" + s.config.GRPCSocket
+		listen = func() (net.Listener, error) { return s.listenUnix(s.config.GRPCSocket) }
+	}
+	listener, err := listen()
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
@@ -66,6 +72,31 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// listenUnix listens on the unix socket at path with the configured
+// permissions, replacing a socket a crashed run left behind
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	mode, err := s.config.SocketMode()
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
 // Stop stops the gRPC server
 func (s *Server) Stop() {
 	if s.grpcServer != nil {
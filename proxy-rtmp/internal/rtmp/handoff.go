@@ -0,0 +1,125 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StreamState is the metadata of a stream handed over to a replacement
+// instance during planned maintenance. The RTMP connection itself can't
+// move, but a publisher that reconnects within the resume window continues
+// the same session and HLS playlist instead of starting a new one.
+type StreamState struct {
+	ID             string    `json:"id"`
+	StreamKey      string    `json:"stream_key"`
+	ClientAddr     string    `json:"client_addr"`
+	StartTime      time.Time `json:"start_time"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	Encoder        string    `json:"encoder,omitempty"`
+	BitrateProfile string    `json:"bitrate_profile,omitempty"`
+	HandedOverAt   time.Time `json:"handed_over_at"`
+}
+
+// Handoff is the set of streams written to the handoff file
+type Handoff struct {
+	Streams []StreamState `json:"streams"`
+}
+
+// ExportStreams returns the state of every active stream
+func (s *Server) ExportStreams() []StreamState {
+	s.sessionsMutex.RLock()
+	defer s.sessionsMutex.RUnlock()
+
+	now := time.Now().UTC()
+	states := make([]StreamState, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		state := session.state()
+		state.HandedOverAt = now
+		states = append(states, state)
+	}
+	return states
+}
+
+// ImportStreams makes streams handed over by another instance resumable
+// for window after their handoff
+func (s *Server) ImportStreams(states []StreamState, window time.Duration) int {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+
+	s.resumeWindow = window
+	imported := 0
+	for _, state := range states {
+		if time.Since(state.HandedOverAt) > window {
+			continue
+		}
+		s.resumable[state.StreamKey] = state
+		imported++
+	}
+	return imported
+}
+
+// takeResumable returns and forgets the handed over state of a stream if
+// its publisher reconnected within the resume window
+func (s *Server) takeResumable(streamKey string) (StreamState, bool) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+
+	state, ok := s.resumable[streamKey]
+	if !ok {
+		return StreamState{}, false
+	}
+	delete(s.resumable, streamKey)
+	return state, time.Since(state.HandedOverAt) <= s.resumeWindow
+}
+
+// WriteHandoff writes the streams to path, replacing it atomically
+func WriteHandoff(path string, streams []StreamState) error {
+	data, err := json.Marshal(Handoff{Streams: streams})
+	if err != nil {
+		return fmt.Errorf("failed to marshal handoff: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".handoff-*")
+	if err != nil {
+		return fmt.Errorf("failed to create handoff file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write handoff file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write handoff file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadHandoff reads the streams from the handoff file. A missing file is
+// no handoff.
+func ReadHandoff(path string) ([]StreamState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handoff file: %w", err)
+	}
+
+	var handoff Handoff
+	if err := json.Unmarshal(data, &handoff); err != nil {
+		return nil, fmt.Errorf("failed to parse handoff file: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":    path,
+		"streams": len(handoff.Streams),
+	}).Info("Loaded stream handoff")
+	return handoff.Streams, nil
+}
@@ -0,0 +1,121 @@
+package rtmp
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RED metrics shared by every MarchProxy module. The RTMP module reports
+// each publishing session with the same names and labels the other modules
+// use for their unit of work; they are exposed through the gRPC metrics map
+// for the NLB to export.
+const (
+	redModule        = "rtmp"
+	redRoute         = "live"
+	redDefaultTenant = "default"
+)
+
+// redDurationBuckets are the latency bounds used by every module in seconds
+var redDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// redKey identifies one series by the shared labels
+type redKey struct {
+	route   string
+	backend string
+	tenant  string
+}
+
+// redSeries is the request count, error counts and latency histogram for one key
+type redSeries struct {
+	requests uint64
+	errors   map[string]uint64
+	buckets  []uint64
+	sum      float64
+}
+
+// redMetrics holds session rate, errors and duration per route, backend and tenant
+type redMetrics struct {
+	series map[redKey]*redSeries
+	mutex  sync.Mutex
+}
+
+// observe records one session. An empty reason marks success.
+func (m *redMetrics) observe(route, backend, reason string, duration time.Duration) {
+	if backend == "" {
+		backend = "none"
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.series == nil {
+		m.series = make(map[redKey]*redSeries)
+	}
+	key := redKey{route: route, backend: backend, tenant: redDefaultTenant}
+	s, exists := m.series[key]
+	if !exists {
+		s = &redSeries{errors: make(map[string]uint64), buckets: make([]uint64, len(redDurationBuckets))}
+		m.series[key] = s
+	}
+
+	s.requests++
+	if reason != "" {
+		s.errors[reason]++
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range redDurationBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += seconds
+}
+
+// snapshot returns the series as plain values, with cumulative bucket
+// counts keyed by their upper bound
+func (m *redMetrics) snapshot() []map[string]interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]redKey, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].backend < keys[j].backend
+	})
+
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		s := m.series[key]
+
+		errors := make(map[string]uint64, len(s.errors))
+		for reason, count := range s.errors {
+			errors[reason] = count
+		}
+
+		buckets := make(map[string]uint64, len(redDurationBuckets)+1)
+		for i, bound := range redDurationBuckets {
+			buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = s.buckets[i]
+		}
+		buckets["+Inf"] = s.requests
+
+		result = append(result, map[string]interface{}{
+			"module":           redModule,
+			"route":            key.route,
+			"backend":          key.backend,
+			"tenant":           key.tenant,
+			"requests_total":   s.requests,
+			"errors_total":     errors,
+			"duration_buckets": buckets,
+			"duration_sum":     s.sum,
+		})
+	}
+	return result
+}
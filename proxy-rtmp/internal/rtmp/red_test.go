@@ -0,0 +1,83 @@
+package rtmp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestREDSnapshot(t *testing.T) {
+	var m redMetrics
+	m.observe(redRoute, "", "", 20*time.Millisecond)
+	m.observe(redRoute, "", "handshake_failed", 3*time.Second)
+	m.observe(redRoute, "", "handshake_failed", 400*time.Second)
+	m.observe("vod", "edge-1", "", time.Second)
+
+	series := m.snapshot()
+	if len(series) != 2 {
+		t.Fatalf("%d series, want 2", len(series))
+	}
+
+	// Series are sorted by route, and a session without a backend is
+	// reported against backend "none"
+	live := series[0]
+	for label, want := range map[string]string{
+		"module":  "rtmp",
+		"route":   redRoute,
+		"backend": "none",
+		"tenant":  redDefaultTenant,
+	} {
+		if live[label] != want {
+			t.Errorf("%s = %v, want %s", label, live[label], want)
+		}
+	}
+	if series[1]["route"] != "vod" || series[1]["backend"] != "edge-1" {
+		t.Errorf("second series %v/%v", series[1]["route"], series[1]["backend"])
+	}
+
+	if live["requests_total"] != uint64(3) {
+		t.Errorf("requests_total = %v, want 3", live["requests_total"])
+	}
+	errors := live["errors_total"].(map[string]uint64)
+	if len(errors) != 1 || errors["handshake_failed"] != 2 {
+		t.Errorf("errors_total = %v", errors)
+	}
+	if sum := live["duration_sum"].(float64); sum != 403.02 {
+		t.Errorf("duration_sum = %v, want 403.02", sum)
+	}
+
+	// Buckets are cumulative, and +Inf counts the session over the last bound
+	buckets := live["duration_buckets"].(map[string]uint64)
+	if len(buckets) != len(redDurationBuckets)+1 {
+		t.Fatalf("%d buckets, want %d", len(buckets), len(redDurationBuckets)+1)
+	}
+	for _, bound := range redDurationBuckets {
+		var want uint64
+		switch {
+		case bound >= 5:
+			want = 2
+		case bound >= 0.025:
+			want = 1
+		}
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		if buckets[le] != want {
+			t.Errorf("bucket le=%s count %d, want %d", le, buckets[le], want)
+		}
+	}
+	if buckets["+Inf"] != 3 {
+		t.Errorf("bucket le=+Inf count %d, want 3", buckets["+Inf"])
+	}
+}
+
+func TestREDSnapshotCopies(t *testing.T) {
+	var m redMetrics
+	m.observe(redRoute, "", "timeout", time.Second)
+	errors := m.snapshot()[0]["errors_total"].(map[string]uint64)
+	errors["timeout"] = 100
+
+	// Later observations do not change an earlier snapshot and vice versa
+	m.observe(redRoute, "", "timeout", time.Second)
+	if got := m.snapshot()[0]["errors_total"].(map[string]uint64)["timeout"]; got != 2 {
+		t.Errorf("timeout errors %d, want 2", got)
+	}
+}
@@ -22,15 +22,26 @@ type Server struct {
 	sessionsMutex sync.RWMutex
 	running       bool
 	runningMutex  sync.RWMutex
+	encoder       string // RED backend label for transcoding sessions
+	red           redMetrics
+	resumable     map[string]StreamState // Streams handed over by another instance, by stream key
+	resumeWindow  time.Duration
 }
 
 // NewServer creates a new RTMP server
 func NewServer(cfg *config.Config, ffmpegMgr *transcode.Manager) (*Server, error) {
+	var encoder string
+	if ffmpegMgr != nil {
+		encoder, _ = ffmpegMgr.GetStats()["encoder"].(string)
+	}
+
 	return &Server{
 		config:        cfg,
 		ffmpegManager: ffmpegMgr,
 		sessions:      make(map[string]*Session),
+		resumable:     make(map[string]StreamState),
 		running:       false,
+		encoder:       encoder,
 	}, nil
 }
 
@@ -116,6 +127,13 @@ func (s *Server) acceptLoop(ctx context.Context) {
 func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
+	// RED metrics for this session, recorded once it ends
+	start := time.Now()
+	var reason string
+	defer func() {
+		s.red.observe(redRoute, s.encoder, reason, time.Since(start))
+	}()
+
 	clientAddr := conn.RemoteAddr().String()
 	logrus.WithField("client", clientAddr).Debug("New RTMP connection")
 
@@ -123,11 +141,13 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	streamKey, err := s.performHandshake(conn)
 	if err != nil {
 		logrus.WithError(err).WithField("client", clientAddr).Warn("Handshake failed")
+		reason = "handshake"
 		return
 	}
 
 	if streamKey == "" {
 		logrus.WithField("client", clientAddr).Warn("No stream key provided")
+		reason = "no_stream_key"
 		return
 	}
 
@@ -138,6 +158,13 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 
 	// Create session
 	session := NewSession(streamKey, conn, s.config, s.ffmpegManager)
+	if state, ok := s.takeResumable(streamKey); ok {
+		session.Resume(state)
+		logrus.WithFields(logrus.Fields{
+			"stream_key": streamKey,
+			"session_id": state.ID,
+		}).Info("Resuming handed over stream")
+	}
 
 	// Register session
 	s.sessionsMutex.Lock()
@@ -147,6 +174,7 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	// Handle stream
 	if err := session.Start(ctx); err != nil {
 		logrus.WithError(err).WithField("stream_key", streamKey).Error("Session failed")
+		reason = "session_failed"
 	}
 
 	// Unregister session
@@ -254,8 +282,9 @@ func (s *Server) GetStats() map[string]interface{} {
 	defer s.sessionsMutex.RUnlock()
 
 	stats := map[string]interface{}{
-		"total_sessions": len(s.sessions),
-		"running":        s.running,
+		"total_sessions":    len(s.sessions),
+		"running":           s.running,
+		"resumable_streams": len(s.resumable),
 	}
 
 	var totalBytesIn, totalBytesOut int64
@@ -268,6 +297,7 @@ func (s *Server) GetStats() map[string]interface{} {
 
 	stats["total_bytes_in"] = totalBytesIn
 	stats["total_bytes_out"] = totalBytesOut
+	stats["red"] = s.red.snapshot()
 
 	return stats
 }
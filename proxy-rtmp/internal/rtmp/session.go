@@ -43,6 +43,7 @@ type Session struct {
 	mutex         sync.RWMutex
 	stopChan      chan struct{}
 	stopped       bool
+	resumed       bool // Continues a stream handed over by another instance
 }
 
 // NewSession creates a new RTMP session
@@ -79,7 +80,11 @@ func (s *Session) Start(ctx context.Context) error {
 	// Start FFmpeg transcoding
 	// Use default 1080p bitrate config
 	bitrate := transcode.DefaultBitrateLadder()[0]
-	proc, err := s.ffmpegManager.StartTranscode(ctx, s.StreamKey, inputURL, bitrate)
+	start := s.ffmpegManager.StartTranscode
+	if s.resumed {
+		start = s.ffmpegManager.ResumeTranscode
+	}
+	proc, err := start(ctx, s.StreamKey, inputURL, bitrate)
 	if err != nil {
 		s.mutex.Lock()
 		s.Status = SessionError
@@ -208,6 +213,39 @@ func (s *Session) Stop() error {
 	return nil
 }
 
+// Resume continues a stream handed over by another instance, keeping its
+// session ID, start time and byte counts
+func (s *Session) Resume(state StreamState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ID = state.ID
+	s.StartTime = state.StartTime
+	s.BytesIn = state.BytesIn
+	s.BytesOut = state.BytesOut
+	s.resumed = true
+}
+
+// state returns the session's handoff state
+func (s *Session) state() StreamState {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	state := StreamState{
+		ID:         s.ID,
+		StreamKey:  s.StreamKey,
+		ClientAddr: s.ClientAddr,
+		StartTime:  s.StartTime,
+		BytesIn:    s.BytesIn,
+		BytesOut:   s.BytesOut,
+	}
+	if s.ffmpegProc != nil {
+		state.Encoder = s.ffmpegProc.Encoder.Name
+		state.BitrateProfile = s.ffmpegProc.Bitrate.Name
+	}
+	return state
+}
+
 // GetInfo returns session information
 func (s *Session) GetInfo() map[string]interface{} {
 	s.mutex.RLock()
@@ -223,6 +261,7 @@ func (s *Session) GetInfo() map[string]interface{} {
 		"duration":    duration.String(),
 		"bytes_in":    s.BytesIn,
 		"bytes_out":   s.BytesOut,
+		"resumed":     s.resumed,
 	}
 
 	if !s.StopTime.IsZero() {
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"marchproxy-shared/licensing"
 )
 
 // GPUType represents the detected GPU type
@@ -194,3 +195,16 @@ func (d *Detector) getEncoderConfig(encoder string) (*EncoderConfig, error) {
 		return nil, fmt.Errorf("unknown encoder: %s", encoder)
 	}
 }
+
+// LicensedEncoder returns enc when the license covers its transcoding
+// tier. Hardware and H.265 encoders are enterprise tiers; without them
+// the CPU x264 encoder is used instead.
+func LicensedEncoder(enc *EncoderConfig, license *licensing.Gate) *EncoderConfig {
+	if enc.HWAccel != "" && !license.Require(licensing.FeatureTranscodeGPU, enc.Name+" hardware transcoding") {
+		return NewX264Config(enc.Preset)
+	}
+	if enc.Codec == "h265" && !license.Require(licensing.FeatureTranscodeHEVC, enc.Name+" H.265 transcoding") {
+		return NewX264Config(enc.Preset)
+	}
+	return enc
+}
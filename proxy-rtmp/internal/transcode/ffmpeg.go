@@ -9,6 +9,7 @@ import (
 
 	"github.com/penguintech/marchproxy/proxy-rtmp/internal/config"
 	"github.com/sirupsen/logrus"
+	"marchproxy-shared/metering"
 )
 
 // ProcessStatus represents FFmpeg process status
@@ -36,6 +37,7 @@ type Process struct {
 	StartTime   time.Time
 	StopTime    time.Time
 	Error       error
+	metered     time.Time // Transcode time is metered up to here
 	mutex       sync.RWMutex
 }
 
@@ -45,6 +47,10 @@ type Manager struct {
 	encoder   *EncoderConfig
 	processes map[string]*Process
 	mutex     sync.RWMutex
+
+	// Transcode minutes per tenant and encoder, nil when metering is disabled
+	meter  *metering.Meter
+	tenant string
 }
 
 // NewManager creates a new FFmpeg manager
@@ -56,8 +62,57 @@ func NewManager(encoder *EncoderConfig, cfg *config.Config) *Manager {
 	}
 }
 
+// SetMeter meters the transcode minutes of every process for tenant.
+// Running transcodes are metered up to the end of each period.
+func (m *Manager) SetMeter(meter *metering.Meter, tenant string) {
+	m.meter = meter
+	m.tenant = tenant
+	meter.OnFlush(m.meterRunning)
+}
+
+// meterRunning meters running transcodes up to now
+func (m *Manager) meterRunning() {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := time.Now()
+	for _, proc := range m.processes {
+		m.meterProcess(proc, now)
+	}
+}
+
+// meterProcess meters the transcode time of proc not yet metered, up to until
+func (m *Manager) meterProcess(proc *Process, until time.Time) {
+	proc.mutex.Lock()
+	from := proc.metered
+	if from.IsZero() {
+		from = proc.StartTime
+	}
+	if !until.After(from) {
+		proc.mutex.Unlock()
+		return
+	}
+	proc.metered = until
+	proc.mutex.Unlock()
+
+	m.meter.Add(m.tenant, proc.Encoder.Name, metering.Usage{TranscodeMinutes: until.Sub(from).Minutes()})
+}
+
 // StartTranscode starts a new transcoding process
 func (m *Manager) StartTranscode(ctx context.Context, streamKey string, inputURL string, bitrate BitrateConfig) (*Process, error) {
+	return m.startTranscode(ctx, streamKey, inputURL, bitrate, false)
+}
+
+// ResumeTranscode starts transcoding a stream handed over by another
+// instance. The HLS playlist it left in the output directory is continued
+// instead of restarted, so players keep their place.
+func (m *Manager) ResumeTranscode(ctx context.Context, streamKey string, inputURL string, bitrate BitrateConfig) (*Process, error) {
+	return m.startTranscode(ctx, streamKey, inputURL, bitrate, true)
+}
+
+// startTranscode starts a transcoding process, appending to existing
+// output when resume is set
+func (m *Manager) startTranscode(ctx context.Context, streamKey string, inputURL string, bitrate BitrateConfig, resume bool) (*Process, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
@@ -88,13 +143,14 @@ func (m *Manager) StartTranscode(ctx context.Context, streamKey string, inputURL
 	}
 
 	// Build FFmpeg command
-	args := m.buildFFmpegArgs(inputURL, outputPaths, bitrate)
+	args := m.buildFFmpegArgs(inputURL, outputPaths, bitrate, resume)
 	proc.Cmd = exec.CommandContext(ctx, m.config.FFmpegPath, args...)
 
 	logrus.WithFields(logrus.Fields{
 		"stream_key": streamKey,
 		"encoder":    m.encoder.Name,
 		"bitrate":    bitrate.Name,
+		"resume":     resume,
 		"args":       args,
 	}).Info("Starting FFmpeg process")
 
@@ -115,7 +171,7 @@ func (m *Manager) StartTranscode(ctx context.Context, streamKey string, inputURL
 }
 
 // buildFFmpegArgs builds FFmpeg command arguments
-func (m *Manager) buildFFmpegArgs(input string, outputs map[string]string, bitrate BitrateConfig) []string {
+func (m *Manager) buildFFmpegArgs(input string, outputs map[string]string, bitrate BitrateConfig, resume bool) []string {
 	var args []string
 
 	// Input
@@ -168,13 +224,17 @@ func (m *Manager) buildFFmpegArgs(input string, outputs map[string]string, bitra
 		"-ac", "2",
 	)
 
-	// HLS output
+	// HLS output, continuing the playlist's segment sequence on resume
 	if hlsPath, ok := outputs["hls"]; ok {
+		hlsFlags := "delete_segments+independent_segments"
+		if resume {
+			hlsFlags += "+append_list"
+		}
 		args = append(args,
 			"-f", "hls",
 			"-hls_time", fmt.Sprintf("%d", m.config.SegmentDuration),
 			"-hls_list_size", "10",
-			"-hls_flags", "delete_segments+independent_segments",
+			"-hls_flags", hlsFlags,
 			"-hls_segment_type", "mpegts",
 			"-hls_segment_filename", fmt.Sprintf("%s/%%03d.ts", m.config.OutputDir),
 			hlsPath,
@@ -199,6 +259,11 @@ func (m *Manager) buildFFmpegArgs(input string, outputs map[string]string, bitra
 // monitorProcess monitors FFmpeg process lifecycle
 func (m *Manager) monitorProcess(ctx context.Context, proc *Process) {
 	defer func() {
+		proc.mutex.RLock()
+		stopped := proc.StopTime
+		proc.mutex.RUnlock()
+		m.meterProcess(proc, stopped)
+
 		m.mutex.Lock()
 		delete(m.processes, proc.StreamKey)
 		m.mutex.Unlock()
@@ -0,0 +1,305 @@
+// Package adminserver guards a proxy's admin endpoints (metrics, status,
+// capture and debug handlers). It authenticates requests with bearer
+// tokens or client certificates, serves over TLS, can bind to loopback or a
+// unix socket, and decides per endpoint who may call it.
+package adminserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Access levels an endpoint can require
+const (
+	AccessPublic = "public" // Anyone, for probes
+	AccessRead   = "read"   // read_token, token or a client certificate
+	AccessAdmin  = "admin"  // token or a client certificate
+)
+
+// unixPrefix marks a listen address as a unix socket path
+const unixPrefix = "unix:"
+
+// defaultSocketMode lets the owner and group connect to the unix socket
+const defaultSocketMode os.FileMode = 0660
+
+// Default endpoints below admin access. Every other endpoint needs admin
+// access.
+var (
+	DefaultPublic = []string{"/healthz", "/readyz", "/ready", "/health"}
+	DefaultRead   = []string{"/metrics", "/stats", "/status"}
+)
+
+// Config is the admin server section of a module's configuration
+type Config struct {
+	Listen     string   `mapstructure:"listen"`      // host:port or unix:/path, empty keeps the module's address
+	SocketMode string   `mapstructure:"socket_mode"` // Octal permissions of a unix socket, 0660 when empty
+	Token      string   `mapstructure:"token"`       // Comma-separated bearer tokens with admin access
+	ReadToken  string   `mapstructure:"read_token"`  // Comma-separated bearer tokens with read access
+	TLSCert    string   `mapstructure:"tls_cert"`    // Serve HTTPS with this certificate
+	TLSKey     string   `mapstructure:"tls_key"`
+	ClientCA   string   `mapstructure:"client_ca"` // Require client certificates signed by this CA, granting admin access
+	Public     []string `mapstructure:"public"`    // Endpoints open to anyone, DefaultPublic when empty
+	Read       []string `mapstructure:"read"`      // Endpoints read tokens may call, DefaultRead when empty
+}
+
+// Enabled reports whether requests are authenticated at all
+func (c Config) Enabled() bool {
+	return c.Token != "" || c.ReadToken != "" || c.ClientCA != ""
+}
+
+// Validate checks the section is usable
+func (c Config) Validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("admin.tls_cert and admin.tls_key must be set together")
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		return fmt.Errorf("admin.client_ca needs admin.tls_cert and admin.tls_key")
+	}
+	if strings.HasPrefix(c.Listen, unixPrefix) {
+		if strings.TrimPrefix(c.Listen, unixPrefix) == "" {
+			return fmt.Errorf("admin.listen needs a socket path after %q", unixPrefix)
+		}
+	} else if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("invalid admin.listen %q: %w", c.Listen, err)
+		}
+	}
+	if _, err := c.socketMode(); err != nil {
+		return err
+	}
+	for _, path := range append(append([]string{}, c.Public...), c.Read...) {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("admin endpoint %q must start with /", path)
+		}
+	}
+	return nil
+}
+
+// socketMode parses SocketMode
+func (c Config) socketMode() (os.FileMode, error) {
+	if c.SocketMode == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid admin.socket_mode %q: must be octal permissions such as 0660", c.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Address returns where the admin server listens, defaultAddr unless
+// Listen overrides it
+func (c Config) Address(defaultAddr string) string {
+	if c.Listen != "" {
+		return c.Listen
+	}
+	return defaultAddr
+}
+
+// Listen opens the admin listener on Address(defaultAddr), a unix socket
+// for unix:/path, and wraps it with TLS when configured
+func Listen(c Config, defaultAddr string) (net.Listener, error) {
+	return ListenWith(c, defaultAddr, net.Listen)
+}
+
+// ListenWith is Listen opening the socket with listen, for modules that
+// inherit listeners across upgrades
+func ListenWith(c Config, defaultAddr string, listen func(network, address string) (net.Listener, error)) (net.Listener, error) {
+	addr := c.Address(defaultAddr)
+	path, unix := strings.CutPrefix(addr, unixPrefix)
+	if !unix {
+		listener, err := listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return WrapListener(c, listener)
+	}
+
+	// A socket left by a crashed run would make the bind fail. One that
+	// still accepts belongs to a live process and is kept.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	mode, err := c.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return WrapListener(c, listener)
+}
+
+// WrapListener serves TLS on listener when a certificate is configured,
+// for listeners opened elsewhere
+func WrapListener(c Config, listener net.Listener) (net.Listener, error) {
+	if c.TLSCert == "" {
+		return listener, nil
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in admin client CA %s", c.ClientCA)
+		}
+		// Clients without a certificate may still use a token
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// Access returns the access level path requires
+func (c Config) Access(path string) string {
+	public, read := c.Public, c.Read
+	if len(public) == 0 {
+		public = DefaultPublic
+	}
+	if len(read) == 0 {
+		read = DefaultRead
+	}
+	switch {
+	case matchesAny(path, public):
+		return AccessPublic
+	case matchesAny(path, read):
+		return AccessRead
+	default:
+		return AccessAdmin
+	}
+}
+
+// matchesAny reports whether path is one of endpoints or below one
+func matchesAny(path string, endpoints []string) bool {
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		if path == endpoint || strings.HasPrefix(path, endpoint+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Guard wraps an admin handler so each request needs the access its
+// endpoint requires. Without tokens or a client CA every request passes,
+// as before authentication existed.
+func Guard(c Config, next http.Handler) http.Handler {
+	if !c.Enabled() {
+		return next
+	}
+	admin := digests(c.Token)
+	read := digests(c.ReadToken)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := c.Access(r.URL.Path)
+		if required == AccessPublic {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Verified client certificates have admin access
+		granted := ""
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			granted = AccessAdmin
+		} else if token, ok := bearerToken(r); ok {
+			digest := sha256.Sum256([]byte(token))
+			switch {
+			case matchDigest(digest, admin):
+				granted = AccessAdmin
+			case matchDigest(digest, read):
+				granted = AccessRead
+			}
+		}
+
+		switch {
+		case granted == "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="marchproxy-admin"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		case required == AccessAdmin && granted != AccessAdmin:
+			http.Error(w, "admin access required", http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Warning describes why the admin endpoints are exposed, or "" when they
+// are protected or only reachable locally
+func Warning(c Config, addr string) string {
+	if c.Enabled() || strings.HasPrefix(addr, unixPrefix) {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && host != "" {
+		if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" {
+			return ""
+		}
+	}
+	return fmt.Sprintf("admin endpoints on %s are unauthenticated, set admin.token or admin.client_ca, or bind admin.listen to loopback", addr)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// digests hashes comma-separated tokens, so they compare in constant time
+// whatever their length
+func digests(tokens string) [][sha256.Size]byte {
+	var out [][sha256.Size]byte
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			out = append(out, sha256.Sum256([]byte(token)))
+		}
+	}
+	return out
+}
+
+// matchDigest compares against every token, so timing doesn't reveal
+// which one matched
+func matchDigest(digest [sha256.Size]byte, tokens [][sha256.Size]byte) bool {
+	match := 0
+	for i := range tokens {
+		match |= subtle.ConstantTimeCompare(digest[:], tokens[i][:])
+	}
+	return match == 1
+}
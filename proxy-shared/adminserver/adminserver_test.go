@@ -0,0 +1,127 @@
+package adminserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	cfg := Config{Token: "admin-1, admin-2", ReadToken: "reader"}
+	handler := Guard(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "wrong", http.StatusUnauthorized},
+		{"/metrics", "reader", http.StatusOK},
+		{"/metrics", "admin-2", http.StatusOK},
+		{"/admin/capture/start", "reader", http.StatusForbidden},
+		{"/admin/capture/start", "admin-1", http.StatusOK},
+		{"/debug/goroutines", "", http.StatusUnauthorized},
+		{"/metricsfoo", "reader", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s with %q = %d, want %d", tt.path, tt.token, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestGuardDisabled(t *testing.T) {
+	handler := Guard(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/faults", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unauthenticated request without tokens = %d", rec.Code)
+	}
+}
+
+func TestAccessOverrides(t *testing.T) {
+	cfg := Config{Public: []string{"/healthz", "/metrics"}, Read: []string{"/status/"}}
+	for path, want := range map[string]string{
+		"/metrics":       AccessPublic,
+		"/readyz":        AccessAdmin,
+		"/status":        AccessRead,
+		"/status/routes": AccessRead,
+		"/drain":         AccessAdmin,
+	} {
+		if got := cfg.Access(path); got != want {
+			t.Errorf("Access(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, cfg := range []Config{
+		{TLSCert: "cert.pem"},
+		{ClientCA: "ca.pem"},
+		{Listen: "unix:"},
+		{Listen: "8081"},
+		{SocketMode: "0999"},
+		{Read: []string{"metrics"}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%+v validated", cfg)
+		}
+	}
+	if err := (Config{Listen: "127.0.0.1:8081", Token: "x"}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	for i := 0; i < 2; i++ {
+		listener, err := Listen(Config{Listen: "unix:" + path, SocketMode: "0600"}, ":0")
+		if err != nil {
+			t.Fatalf("listen %d: %v", i, err)
+		}
+		if listener.Addr().Network() != "unix" {
+			t.Errorf("listening on %s", listener.Addr().Network())
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("socket permissions %v, %v", info, err)
+		}
+		// Leave the socket behind, as a crash would
+		if ul, ok := listener.(interface{ SetUnlinkOnClose(bool) }); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}
+}
+
+func TestWarning(t *testing.T) {
+	for addr, exposed := range map[string]bool{
+		":8081":                true,
+		"0.0.0.0:8081":         true,
+		"127.0.0.1:8081":       false,
+		"[::1]:8081":           false,
+		"localhost:8081":       false,
+		"unix:/run/admin.sock": false,
+	} {
+		if got := Warning(Config{}, addr) != ""; got != exposed {
+			t.Errorf("Warning(%s) exposed = %t, want %t", addr, got, exposed)
+		}
+	}
+	if Warning(Config{Token: "x"}, ":8081") != "" {
+		t.Error("warning with a token set")
+	}
+}
@@ -0,0 +1,284 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Message types (RFC 4271)
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+const (
+	headerLen  = 19
+	maxMsgLen  = 4096
+	bgpVersion = 4
+	asTrans    = 23456 // Stands in for 4-byte ASNs in 2-byte fields (RFC 6793)
+)
+
+// Path attribute flags and types
+const (
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtended   = 0x10
+
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrLocalPref   = 5
+	attrCommunities = 8
+	attrMPReach     = 14
+	attrMPUnreach   = 15
+)
+
+// Capabilities and address families
+const (
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+)
+
+// Notification codes used by the speaker
+const (
+	notifyHoldTimerExpired = 4
+	notifyCease            = 6
+	ceaseAdminShutdown     = 2
+)
+
+var marker = [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// message frames a BGP message body with the header
+func message(kind byte, body []byte) []byte {
+	out := make([]byte, headerLen, headerLen+len(body))
+	copy(out, marker[:])
+	binary.BigEndian.PutUint16(out[16:], uint16(headerLen+len(body)))
+	out[18] = kind
+	return append(out, body...)
+}
+
+// readMessage reads one message and returns its type and body
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if [16]byte(header[:16]) != marker {
+		return 0, nil, errors.New("invalid message marker")
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMsgLen {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// openMessage builds an OPEN advertising 4-byte ASNs and the address
+// families of the announced prefixes
+func openMessage(localAS uint32, holdTime uint16, routerID netip.Addr, families []uint16) []byte {
+	var caps []byte
+	for _, afi := range families {
+		caps = append(caps, capMultiprotocol, 4, byte(afi>>8), byte(afi), 0, safiUnicast)
+	}
+	caps = append(caps, capFourOctetAS, 4)
+	caps = binary.BigEndian.AppendUint32(caps, localAS)
+
+	myAS := uint16(asTrans)
+	if localAS <= 0xffff {
+		myAS = uint16(localAS)
+	}
+
+	body := []byte{bgpVersion}
+	body = binary.BigEndian.AppendUint16(body, myAS)
+	body = binary.BigEndian.AppendUint16(body, holdTime)
+	id := routerID.As4()
+	body = append(body, id[:]...)
+	body = append(body, byte(len(caps)+2), 2, byte(len(caps)))
+	body = append(body, caps...)
+	return message(msgOpen, body)
+}
+
+// peerOpen holds what the speaker needs from the peer's OPEN
+type peerOpen struct {
+	AS          uint32
+	HoldTime    uint16
+	FourOctetAS bool
+}
+
+// parseOpen decodes an OPEN body
+func parseOpen(body []byte) (peerOpen, error) {
+	if len(body) < 10 {
+		return peerOpen{}, errors.New("OPEN message too short")
+	}
+	if body[0] != bgpVersion {
+		return peerOpen{}, fmt.Errorf("unsupported BGP version %d", body[0])
+	}
+	open := peerOpen{
+		AS:       uint32(binary.BigEndian.Uint16(body[1:])),
+		HoldTime: binary.BigEndian.Uint16(body[3:]),
+	}
+
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return peerOpen{}, errors.New("invalid OPEN parameter length")
+	}
+	for len(params) >= 2 {
+		kind, length := params[0], int(params[1])
+		if len(params) < 2+length {
+			return peerOpen{}, errors.New("truncated OPEN parameter")
+		}
+		value := params[2 : 2+length]
+		params = params[2+length:]
+		if kind != 2 {
+			continue
+		}
+		for len(value) >= 2 {
+			code, capLen := value[0], int(value[1])
+			if len(value) < 2+capLen {
+				return peerOpen{}, errors.New("truncated capability")
+			}
+			if code == capFourOctetAS && capLen == 4 {
+				open.FourOctetAS = true
+				open.AS = binary.BigEndian.Uint32(value[2:])
+			}
+			value = value[2+capLen:]
+		}
+	}
+	return open, nil
+}
+
+// notificationMessage builds a NOTIFICATION
+func notificationMessage(code, subcode byte) []byte {
+	return message(msgNotification, []byte{code, subcode})
+}
+
+// route describes how prefixes are announced to one peer
+type route struct {
+	LocalAS     uint32
+	IBGP        bool
+	FourOctetAS bool
+	NextHop     netip.Addr
+	Communities []uint32
+}
+
+// appendAttr appends a path attribute, using the extended length when needed
+func appendAttr(out []byte, flags, kind byte, value []byte) []byte {
+	if len(value) > 255 {
+		out = append(out, flags|flagExtended, kind)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(value)))
+	} else {
+		out = append(out, flags, kind, byte(len(value)))
+	}
+	return append(out, value...)
+}
+
+// appendPrefix appends a prefix in NLRI encoding
+func appendPrefix(out []byte, prefix netip.Prefix) []byte {
+	bits := prefix.Bits()
+	addr := prefix.Addr().AsSlice()
+	return append(append(out, byte(bits)), addr[:(bits+7)/8]...)
+}
+
+// announceMessage builds an UPDATE announcing prefixes of one address
+// family. IPv4 uses the classic NLRI field, IPv6 MP_REACH_NLRI.
+func announceMessage(r route, prefixes []netip.Prefix) []byte {
+	var attrs []byte
+	attrs = appendAttr(attrs, flagTransitive, attrOrigin, []byte{0}) // IGP
+
+	var path []byte
+	if !r.IBGP {
+		path = []byte{2, 1} // AS_SEQUENCE of one
+		if r.FourOctetAS {
+			path = binary.BigEndian.AppendUint32(path, r.LocalAS)
+		} else {
+			path = binary.BigEndian.AppendUint16(path, uint16(r.LocalAS))
+		}
+	}
+	attrs = appendAttr(attrs, flagTransitive, attrASPath, path)
+
+	if r.IBGP {
+		attrs = appendAttr(attrs, flagTransitive, attrLocalPref, binary.BigEndian.AppendUint32(nil, 100))
+	}
+	if len(r.Communities) > 0 {
+		var communities []byte
+		for _, community := range r.Communities {
+			communities = binary.BigEndian.AppendUint32(communities, community)
+		}
+		attrs = appendAttr(attrs, flagOptional|flagTransitive, attrCommunities, communities)
+	}
+
+	var nlri []byte
+	if r.NextHop.Is4() {
+		nextHop := r.NextHop.As4()
+		attrs = appendAttr(attrs, flagTransitive, attrNextHop, nextHop[:])
+		for _, prefix := range prefixes {
+			nlri = appendPrefix(nlri, prefix)
+		}
+	} else {
+		nextHop := r.NextHop.As16()
+		reach := []byte{0, afiIPv6, safiUnicast, 16}
+		reach = append(reach, nextHop[:]...)
+		reach = append(reach, 0)
+		for _, prefix := range prefixes {
+			reach = appendPrefix(reach, prefix)
+		}
+		attrs = appendAttr(attrs, flagOptional, attrMPReach, reach)
+	}
+
+	body := []byte{0, 0} // No withdrawn routes
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	body = append(body, nlri...)
+	return message(msgUpdate, body)
+}
+
+// withdrawMessage builds an UPDATE withdrawing prefixes of one address family
+func withdrawMessage(prefixes []netip.Prefix, ipv6 bool) []byte {
+	var body []byte
+	if !ipv6 {
+		var withdrawn []byte
+		for _, prefix := range prefixes {
+			withdrawn = appendPrefix(withdrawn, prefix)
+		}
+		body = binary.BigEndian.AppendUint16(body, uint16(len(withdrawn)))
+		body = append(body, withdrawn...)
+		body = append(body, 0, 0) // No path attributes
+		return message(msgUpdate, body)
+	}
+
+	unreach := []byte{0, afiIPv6, safiUnicast}
+	for _, prefix := range prefixes {
+		unreach = appendPrefix(unreach, prefix)
+	}
+	attrs := appendAttr(nil, flagOptional, attrMPUnreach, unreach)
+	body = append(body, 0, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	return message(msgUpdate, body)
+}
+
+// ParseCommunity parses a community in "ASN:value" form
+func ParseCommunity(s string) (uint32, error) {
+	asn, value, ok := strings.Cut(s, ":")
+	high, err1 := strconv.ParseUint(asn, 10, 16)
+	low, err2 := strconv.ParseUint(value, 10, 16)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid community %q, expected ASN:value", s)
+	}
+	return uint32(high<<16 | low), nil
+}
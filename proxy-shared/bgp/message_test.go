@@ -0,0 +1,304 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// update is a decoded UPDATE message
+type update struct {
+	withdrawn []netip.Prefix
+	attrs     map[byte][]byte
+	flags     map[byte]byte
+	nlri      []netip.Prefix
+}
+
+// parsePrefixes decodes NLRI encoded prefixes of an address family
+func parsePrefixes(t *testing.T, b []byte, ipv6 bool) []netip.Prefix {
+	t.Helper()
+	var prefixes []netip.Prefix
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+		if len(b) < 1+n {
+			t.Fatalf("truncated prefix in %x", b)
+		}
+		var addr netip.Addr
+		if ipv6 {
+			var a [16]byte
+			copy(a[:], b[1:1+n])
+			addr = netip.AddrFrom16(a)
+		} else {
+			var a [4]byte
+			copy(a[:], b[1:1+n])
+			addr = netip.AddrFrom4(a)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, bits))
+		b = b[1+n:]
+	}
+	return prefixes
+}
+
+// parseUpdate decodes an UPDATE body with IPv4 withdrawn routes and NLRI
+func parseUpdate(t *testing.T, body []byte) update {
+	t.Helper()
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	u := update{
+		withdrawn: parsePrefixes(t, body[2:2+withdrawnLen], false),
+		attrs:     make(map[byte][]byte),
+		flags:     make(map[byte]byte),
+	}
+	body = body[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(body))
+	attrs := body[2 : 2+attrsLen]
+	u.nlri = parsePrefixes(t, body[2+attrsLen:], false)
+	for len(attrs) > 0 {
+		flags, kind := attrs[0], attrs[1]
+		var length int
+		if flags&flagExtended != 0 {
+			length = int(binary.BigEndian.Uint16(attrs[2:]))
+			attrs = attrs[4:]
+		} else {
+			length = int(attrs[2])
+			attrs = attrs[3:]
+		}
+		u.flags[kind] = flags
+		u.attrs[kind] = attrs[:length]
+		attrs = attrs[length:]
+	}
+	return u
+}
+
+// readFrom reads a message built by the package
+func readFrom(t *testing.T, msg []byte) (byte, []byte) {
+	t.Helper()
+	kind, body, err := readMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kind, body
+}
+
+func TestMessageFraming(t *testing.T) {
+	keepalive := message(msgKeepalive, nil)
+	if len(keepalive) != headerLen {
+		t.Errorf("KEEPALIVE is %d bytes, want %d", len(keepalive), headerLen)
+	}
+	if kind, body := readFrom(t, keepalive); kind != msgKeepalive || len(body) != 0 {
+		t.Errorf("read type %d with %d bytes, want an empty KEEPALIVE", kind, len(body))
+	}
+
+	notification := notificationMessage(notifyCease, ceaseAdminShutdown)
+	if kind, body := readFrom(t, notification); kind != msgNotification || !bytes.Equal(body, []byte{notifyCease, ceaseAdminShutdown}) {
+		t.Errorf("read type %d body %v, want NOTIFICATION 6/2", kind, body)
+	}
+
+	badMarker := append([]byte(nil), keepalive...)
+	badMarker[3] = 0
+	if _, _, err := readMessage(bytes.NewReader(badMarker)); err == nil || !strings.Contains(err.Error(), "marker") {
+		t.Errorf("bad marker: %v", err)
+	}
+	for _, length := range []uint16{headerLen - 1, maxMsgLen + 1} {
+		bad := append([]byte(nil), keepalive...)
+		binary.BigEndian.PutUint16(bad[16:], length)
+		if _, _, err := readMessage(bytes.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "length") {
+			t.Errorf("length %d: %v", length, err)
+		}
+	}
+	if _, _, err := readMessage(bytes.NewReader(message(msgUpdate, []byte{0, 0, 0})[:headerLen+1])); err == nil {
+		t.Error("truncated body read")
+	}
+}
+
+func TestOpenMessage(t *testing.T) {
+	routerID := netip.MustParseAddr("10.0.0.1")
+	for _, c := range []struct {
+		as       uint32
+		myAS     uint16
+		families []uint16
+	}{
+		{65000, 65000, []uint16{afiIPv4}},
+		{4200000000, asTrans, []uint16{afiIPv4, afiIPv6}},
+	} {
+		kind, body := readFrom(t, openMessage(c.as, 90, routerID, c.families))
+		if kind != msgOpen {
+			t.Fatalf("type %d, want OPEN", kind)
+		}
+		if body[0] != bgpVersion || binary.BigEndian.Uint16(body[1:]) != c.myAS || binary.BigEndian.Uint16(body[3:]) != 90 {
+			t.Errorf("AS %d: header %v", c.as, body[:5])
+		}
+		if netip.AddrFrom4([4]byte(body[5:9])) != routerID {
+			t.Errorf("AS %d: router ID %v", c.as, body[5:9])
+		}
+		// One capabilities parameter: multiprotocol per family, then 4-byte AS
+		params := body[10:]
+		if int(body[9]) != len(params) || params[0] != 2 || int(params[1]) != len(params)-2 {
+			t.Fatalf("AS %d: parameters %v", c.as, params)
+		}
+		caps := params[2:]
+		for _, afi := range c.families {
+			if !bytes.Equal(caps[:6], []byte{capMultiprotocol, 4, 0, byte(afi), 0, safiUnicast}) {
+				t.Errorf("AS %d: multiprotocol capability %v, want AFI %d", c.as, caps[:6], afi)
+			}
+			caps = caps[6:]
+		}
+		if caps[0] != capFourOctetAS || caps[1] != 4 || binary.BigEndian.Uint32(caps[2:]) != c.as {
+			t.Errorf("AS %d: 4-byte AS capability %v", c.as, caps)
+		}
+
+		open, err := parseOpen(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if open != (peerOpen{AS: c.as, HoldTime: 90, FourOctetAS: true}) {
+			t.Errorf("parsed %+v, want AS %d", open, c.as)
+		}
+	}
+}
+
+func TestParseOpen(t *testing.T) {
+	// A 2-byte AS speaker without capabilities
+	plain := []byte{bgpVersion, 0xfd, 0xe9, 0, 180, 10, 0, 0, 2, 0}
+	open, err := parseOpen(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open != (peerOpen{AS: 65001, HoldTime: 180}) {
+		t.Errorf("parsed %+v", open)
+	}
+
+	// Other parameters and capabilities are skipped
+	withOthers := append([]byte{bgpVersion, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 14},
+		1, 2, 0xaa, 0xbb, // Authentication, deprecated
+		2, 8, 2, 0, capFourOctetAS, 4, 0, 1, 0, 0) // Route refresh, then AS 65536
+	if open, err := parseOpen(withOthers); err != nil || open.AS != 65536 || !open.FourOctetAS {
+		t.Errorf("parsed %+v, %v", open, err)
+	}
+
+	for name, body := range map[string][]byte{
+		"short":                {bgpVersion, 0, 1},
+		"version 3":            {3, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 0},
+		"parameter length":     {bgpVersion, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 4, 2, 2},
+		"truncated parameter":  {bgpVersion, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 2, 2, 6},
+		"truncated capability": {bgpVersion, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 4, 2, 2, capFourOctetAS, 4},
+	} {
+		if _, err := parseOpen(body); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestAnnounceMessageIPv4(t *testing.T) {
+	prefixes := []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32"), netip.MustParsePrefix("198.51.100.0/24")}
+	r := route{
+		LocalAS:     65000,
+		FourOctetAS: true,
+		NextHop:     netip.MustParseAddr("10.0.0.1"),
+		Communities: []uint32{65000<<16 | 100},
+	}
+	kind, body := readFrom(t, announceMessage(r, prefixes))
+	if kind != msgUpdate {
+		t.Fatalf("type %d, want UPDATE", kind)
+	}
+	u := parseUpdate(t, body)
+	if len(u.withdrawn) != 0 || !reflect.DeepEqual(u.nlri, prefixes) {
+		t.Errorf("withdrawn %v and NLRI %v, want %v announced", u.withdrawn, u.nlri, prefixes)
+	}
+	if !bytes.Equal(u.attrs[attrOrigin], []byte{0}) {
+		t.Errorf("origin %v, want IGP", u.attrs[attrOrigin])
+	}
+	if !bytes.Equal(u.attrs[attrASPath], []byte{2, 1, 0, 0, 0xfd, 0xe8}) {
+		t.Errorf("AS path %v, want a 4-byte sequence of 65000", u.attrs[attrASPath])
+	}
+	if !bytes.Equal(u.attrs[attrNextHop], []byte{10, 0, 0, 1}) {
+		t.Errorf("next hop %v", u.attrs[attrNextHop])
+	}
+	if !bytes.Equal(u.attrs[attrCommunities], []byte{0xfd, 0xe8, 0, 100}) || u.flags[attrCommunities] != flagOptional|flagTransitive {
+		t.Errorf("communities %v with flags %#x", u.attrs[attrCommunities], u.flags[attrCommunities])
+	}
+	if _, ok := u.attrs[attrLocalPref]; ok {
+		t.Error("eBGP announcement has LOCAL_PREF")
+	}
+
+	// iBGP leaves the AS path empty and sets LOCAL_PREF; 2-byte peers get
+	// 2-byte AS numbers
+	r = route{LocalAS: 65000, IBGP: true, NextHop: netip.MustParseAddr("10.0.0.1")}
+	u = parseUpdate(t, announceMessage(r, prefixes)[headerLen:])
+	if len(u.attrs[attrASPath]) != 0 || !bytes.Equal(u.attrs[attrLocalPref], []byte{0, 0, 0, 100}) {
+		t.Errorf("iBGP AS path %v and LOCAL_PREF %v", u.attrs[attrASPath], u.attrs[attrLocalPref])
+	}
+	if _, ok := u.attrs[attrCommunities]; ok {
+		t.Error("communities sent without any configured")
+	}
+	r = route{LocalAS: 65000, NextHop: netip.MustParseAddr("10.0.0.1")}
+	u = parseUpdate(t, announceMessage(r, prefixes)[headerLen:])
+	if !bytes.Equal(u.attrs[attrASPath], []byte{2, 1, 0xfd, 0xe8}) {
+		t.Errorf("AS path %v, want a 2-byte sequence of 65000", u.attrs[attrASPath])
+	}
+}
+
+func TestAnnounceMessageIPv6(t *testing.T) {
+	prefixes := []netip.Prefix{netip.MustParsePrefix("2001:db8::10/128"), netip.MustParsePrefix("2001:db8:1::/48")}
+	nextHop := netip.MustParseAddr("2001:db8::1")
+	u := parseUpdate(t, announceMessage(route{LocalAS: 65000, FourOctetAS: true, NextHop: nextHop}, prefixes)[headerLen:])
+	if len(u.nlri) != 0 {
+		t.Errorf("IPv6 prefixes in the IPv4 NLRI: %v", u.nlri)
+	}
+	if _, ok := u.attrs[attrNextHop]; ok {
+		t.Error("IPv6 announcement has an IPv4 NEXT_HOP")
+	}
+	reach := u.attrs[attrMPReach]
+	if u.flags[attrMPReach] != flagOptional || len(reach) < 21 {
+		t.Fatalf("MP_REACH_NLRI %v with flags %#x", reach, u.flags[attrMPReach])
+	}
+	if !bytes.Equal(reach[:4], []byte{0, afiIPv6, safiUnicast, 16}) {
+		t.Errorf("MP_REACH_NLRI family %v", reach[:4])
+	}
+	if netip.AddrFrom16([16]byte(reach[4:20])) != nextHop || reach[20] != 0 {
+		t.Errorf("MP_REACH_NLRI next hop %v", reach[4:21])
+	}
+	if got := parsePrefixes(t, reach[21:], true); !reflect.DeepEqual(got, prefixes) {
+		t.Errorf("MP_REACH_NLRI prefixes %v, want %v", got, prefixes)
+	}
+}
+
+func TestWithdrawMessage(t *testing.T) {
+	ipv4 := []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32"), netip.MustParsePrefix("10.0.0.0/8")}
+	u := parseUpdate(t, withdrawMessage(ipv4, false)[headerLen:])
+	if !reflect.DeepEqual(u.withdrawn, ipv4) || len(u.attrs) != 0 || len(u.nlri) != 0 {
+		t.Errorf("withdrew %v with attributes %v and NLRI %v", u.withdrawn, u.attrs, u.nlri)
+	}
+
+	ipv6 := []netip.Prefix{netip.MustParsePrefix("2001:db8::10/128")}
+	u = parseUpdate(t, withdrawMessage(ipv6, true)[headerLen:])
+	unreach := u.attrs[attrMPUnreach]
+	if len(u.withdrawn) != 0 || u.flags[attrMPUnreach] != flagOptional || !bytes.Equal(unreach[:3], []byte{0, afiIPv6, safiUnicast}) {
+		t.Fatalf("withdrawn %v and MP_UNREACH_NLRI %v", u.withdrawn, unreach)
+	}
+	if got := parsePrefixes(t, unreach[3:], true); !reflect.DeepEqual(got, ipv6) {
+		t.Errorf("MP_UNREACH_NLRI prefixes %v, want %v", got, ipv6)
+	}
+}
+
+func TestAppendAttrExtendedLength(t *testing.T) {
+	value := make([]byte, 300)
+	attr := appendAttr(nil, flagOptional|flagTransitive, attrCommunities, value)
+	if attr[0] != flagOptional|flagTransitive|flagExtended || binary.BigEndian.Uint16(attr[2:]) != 300 || len(attr) != 304 {
+		t.Errorf("extended attribute header %v, %d bytes", attr[:4], len(attr))
+	}
+}
+
+func TestParseCommunity(t *testing.T) {
+	if c, err := ParseCommunity("65000:100"); err != nil || c != 65000<<16|100 {
+		t.Errorf("ParseCommunity(65000:100) = %d, %v", c, err)
+	}
+	for _, s := range []string{"65000", "65536:1", "1:65536", "a:1", ":1", ""} {
+		if _, err := ParseCommunity(s); err == nil {
+			t.Errorf("ParseCommunity(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+// Package bgp announces the service VIPs to upstream routers over BGP while
+// the local instance is healthy, and withdraws them on failure or drain, so
+// several instances can serve the same anycast VIP active-active.
+//
+// The speaker is announce-only: it opens a session to each configured peer,
+// advertises the VIP prefixes with itself as next hop and ignores the routes
+// peers send back.
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMetricPrefix names the speaker metrics when Config.MetricPrefix is unset
+const defaultMetricPrefix = "marchproxy"
+
+// speakerMetrics are the session and announcement gauges under one prefix
+type speakerMetrics struct {
+	sessionUp    *prometheus.GaugeVec
+	vipAnnounced prometheus.Gauge
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsByPrefix = make(map[string]*speakerMetrics)
+)
+
+// metricsFor returns the gauges named with prefix, registering them the
+// first time the prefix is used
+func metricsFor(prefix string) *speakerMetrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if m, ok := metricsByPrefix[prefix]; ok {
+		return m
+	}
+	m := &speakerMetrics{
+		sessionUp: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: prefix + "_bgp_session_up",
+				Help: "Whether the BGP session to a peer is established",
+			},
+			[]string{"peer"},
+		),
+		vipAnnounced: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: prefix + "_bgp_vip_announced",
+				Help: "Whether the service VIPs are announced to BGP peers",
+			},
+		),
+	}
+	metricsByPrefix[prefix] = m
+	return m
+}
+
+// Peer is a BGP neighbor the VIPs are announced to
+type Peer struct {
+	Address netip.Addr
+	Port    int // 0 means 179
+	AS      uint32
+}
+
+func (p Peer) String() string {
+	port := p.Port
+	if port == 0 {
+		port = 179
+	}
+	return net.JoinHostPort(p.Address.String(), strconv.Itoa(port))
+}
+
+// Config holds the speaker settings
+type Config struct {
+	LocalAS      uint32
+	RouterID     netip.Addr // IPv4 BGP identifier
+	Peers        []Peer
+	Prefixes     []netip.Prefix // VIPs, usually /32 and /128
+	NextHop      netip.Addr     // IPv4 next hop, the session's local address when unset
+	NextHopIPv6  netip.Addr     // IPv6 next hop, the session's local address when unset
+	Communities  []uint32
+	HoldTime     time.Duration // 0 means 90s
+	ConnectRetry time.Duration // 0 means 10s
+	MetricPrefix string        // Prefix of the metric names, "marchproxy" when unset
+}
+
+// Validate checks the speaker settings
+func (c Config) Validate() error {
+	if c.LocalAS == 0 {
+		return errors.New("local AS is required")
+	}
+	if !c.RouterID.Is4() {
+		return errors.New("router ID must be an IPv4 address")
+	}
+	if len(c.Peers) == 0 {
+		return errors.New("at least one peer is required")
+	}
+	for _, peer := range c.Peers {
+		if !peer.Address.IsValid() || peer.AS == 0 {
+			return fmt.Errorf("peer %s requires an address and AS", peer)
+		}
+	}
+	if len(c.Prefixes) == 0 {
+		return errors.New("at least one VIP is required")
+	}
+	if c.HoldTime != 0 && c.HoldTime < 3*time.Second {
+		return errors.New("hold time must be at least 3s")
+	}
+	if c.NextHop.IsValid() && !c.NextHop.Is4() {
+		return errors.New("next hop must be an IPv4 address")
+	}
+	if c.NextHopIPv6.IsValid() && !c.NextHopIPv6.Is6() {
+		return errors.New("IPv6 next hop must be an IPv6 address")
+	}
+	return nil
+}
+
+// PeerStatus describes the session to one peer
+type PeerStatus struct {
+	Peer        string    `json:"peer"`
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"`
+	LastError   string    `json:"last_error,omitempty"`
+	Established bool      `json:"established"`
+}
+
+// Speaker maintains sessions to the peers and announces the VIPs while
+// asked to
+type Speaker struct {
+	config  Config
+	logger  *logrus.Logger
+	metrics *speakerMetrics
+
+	mu        sync.Mutex
+	announced bool
+	status    map[string]*PeerStatus
+	notify    []chan struct{}
+}
+
+// NewSpeaker creates a speaker with the VIPs withdrawn
+func NewSpeaker(config Config, logger *logrus.Logger) (*Speaker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.HoldTime == 0 {
+		config.HoldTime = 90 * time.Second
+	}
+	if config.ConnectRetry == 0 {
+		config.ConnectRetry = 10 * time.Second
+	}
+	if config.MetricPrefix == "" {
+		config.MetricPrefix = defaultMetricPrefix
+	}
+	for i, prefix := range config.Prefixes {
+		config.Prefixes[i] = prefix.Masked()
+	}
+
+	s := &Speaker{
+		config:  config,
+		logger:  logger,
+		metrics: metricsFor(config.MetricPrefix),
+		status:  make(map[string]*PeerStatus),
+	}
+	for _, peer := range config.Peers {
+		s.status[peer.String()] = &PeerStatus{Peer: peer.String(), State: "idle", Since: time.Now()}
+		s.notify = append(s.notify, make(chan struct{}, 1))
+	}
+	return s, nil
+}
+
+// Run keeps sessions to all peers until ctx is done, then closes them,
+// which withdraws the VIPs
+func (s *Speaker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, peer := range s.config.Peers {
+		wg.Add(1)
+		go func(peer Peer, notify chan struct{}) {
+			defer wg.Done()
+			s.runPeer(ctx, peer, notify)
+		}(peer, s.notify[i])
+	}
+	wg.Wait()
+}
+
+// SetAnnounced announces or withdraws the VIPs on every established session
+func (s *Speaker) SetAnnounced(announced bool) {
+	s.mu.Lock()
+	changed := s.announced != announced
+	s.announced = announced
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if announced {
+		s.metrics.vipAnnounced.Set(1)
+	} else {
+		s.metrics.vipAnnounced.Set(0)
+	}
+	s.logger.WithField("announced", announced).Info("BGP VIP announcement changed")
+	for _, notify := range s.notify {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Announced reports whether the VIPs are meant to be announced
+func (s *Speaker) Announced() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.announced
+}
+
+// Follow announces the VIPs while healthy reports true, checking every
+// interval until ctx is done
+func (s *Speaker) Follow(ctx context.Context, interval time.Duration, healthy func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.SetAnnounced(healthy())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the state of every peer session
+func (s *Speaker) Status() []PeerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]PeerStatus, 0, len(s.config.Peers))
+	for _, peer := range s.config.Peers {
+		out = append(out, *s.status[peer.String()])
+	}
+	return out
+}
+
+func (s *Speaker) setState(peer Peer, state string, err error) {
+	s.mu.Lock()
+	status := s.status[peer.String()]
+	if status.State != state {
+		status.State = state
+		status.Since = time.Now()
+	}
+	status.Established = state == "established"
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	s.mu.Unlock()
+
+	if state == "established" {
+		s.metrics.sessionUp.WithLabelValues(peer.String()).Set(1)
+	} else {
+		s.metrics.sessionUp.WithLabelValues(peer.String()).Set(0)
+	}
+}
+
+func (s *Speaker) runPeer(ctx context.Context, peer Peer, notify chan struct{}) {
+	for {
+		err := s.session(ctx, peer, notify)
+		if ctx.Err() != nil {
+			s.setState(peer, "idle", nil)
+			return
+		}
+		s.setState(peer, "idle", err)
+		s.logger.WithError(err).WithField("peer", peer.String()).Warn("BGP session closed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.config.ConnectRetry):
+		}
+	}
+}
+
+// session runs one BGP session until it fails or ctx is done
+func (s *Speaker) session(ctx context.Context, peer Peer, notify chan struct{}) error {
+	s.setState(peer, "connect", nil)
+	dialer := net.Dialer{Timeout: s.config.ConnectRetry}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	// The handshake waits minutes for a slow peer, so shutting down has to
+	// cut its reads short
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	open, err := s.handshake(conn, peer)
+	stop()
+	if err != nil {
+		return err
+	}
+
+	holdTime := s.config.HoldTime
+	if peerHold := time.Duration(open.HoldTime) * time.Second; peerHold < holdTime {
+		holdTime = peerHold
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	localAddr, _ := netip.AddrFromSlice(local.IP)
+	r := route{
+		LocalAS:     s.config.LocalAS,
+		IBGP:        peer.AS == s.config.LocalAS,
+		FourOctetAS: open.FourOctetAS,
+		Communities: s.config.Communities,
+	}
+	ipv4, ipv6 := s.families()
+	nextHop4, nextHop6 := s.config.NextHop, s.config.NextHopIPv6
+	if !nextHop4.IsValid() && localAddr.Unmap().Is4() {
+		nextHop4 = localAddr.Unmap()
+	}
+	if !nextHop6.IsValid() && localAddr.Is6() && !localAddr.Is4In6() {
+		nextHop6 = localAddr
+	}
+	if len(ipv4) > 0 && !nextHop4.IsValid() {
+		return errors.New("IPv4 VIPs need an IPv4 next hop on an IPv6 session")
+	}
+	if len(ipv6) > 0 && !nextHop6.IsValid() {
+		return errors.New("IPv6 VIPs need an IPv6 next hop on an IPv4 session")
+	}
+
+	s.setState(peer, "established", nil)
+	s.logger.WithFields(logrus.Fields{
+		"peer":      peer.String(),
+		"peer_as":   open.AS,
+		"hold_time": holdTime,
+	}).Info("BGP session established")
+
+	// The reader only watches for errors, notifications and the hold timer;
+	// routes sent by the peer are ignored
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				conn.SetReadDeadline(time.Now().Add(holdTime))
+			}
+			kind, body, err := readMessage(conn)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					conn.Write(notificationMessage(notifyHoldTimerExpired, 0))
+					err = errors.New("hold timer expired")
+				}
+				readErr <- err
+				return
+			}
+			if kind == msgNotification && len(body) >= 2 {
+				readErr <- fmt.Errorf("peer sent notification %d/%d", body[0], body[1])
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	advertised := false
+	update := func() error {
+		want := s.Announced()
+		if want == advertised {
+			return nil
+		}
+		for _, family := range []struct {
+			prefixes []netip.Prefix
+			nextHop  netip.Addr
+			ipv6     bool
+		}{{ipv4, nextHop4, false}, {ipv6, nextHop6, true}} {
+			if len(family.prefixes) == 0 {
+				continue
+			}
+			msg := withdrawMessage(family.prefixes, family.ipv6)
+			if want {
+				r.NextHop = family.nextHop
+				msg = announceMessage(r, family.prefixes)
+			}
+			if err := s.write(conn, msg); err != nil {
+				return err
+			}
+		}
+		advertised = want
+		return nil
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.write(conn, notificationMessage(notifyCease, ceaseAdminShutdown))
+			return nil
+		case err := <-readErr:
+			return err
+		case <-keepalive:
+			if err := s.write(conn, message(msgKeepalive, nil)); err != nil {
+				return err
+			}
+		case <-notify:
+			if err := update(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake exchanges OPEN and KEEPALIVE messages with the peer
+func (s *Speaker) handshake(conn net.Conn, peer Peer) (peerOpen, error) {
+	s.setState(peer, "open_sent", nil)
+	ipv4, ipv6 := s.families()
+	var families []uint16
+	if len(ipv4) > 0 {
+		families = append(families, afiIPv4)
+	}
+	if len(ipv6) > 0 {
+		families = append(families, afiIPv6)
+	}
+	open := openMessage(s.config.LocalAS, uint16(s.config.HoldTime/time.Second), s.config.RouterID, families)
+	if err := s.write(conn, open); err != nil {
+		return peerOpen{}, err
+	}
+
+	// RFC 4271 suggests a large hold time until the session is up
+	conn.SetReadDeadline(time.Now().Add(4 * time.Minute))
+	defer conn.SetReadDeadline(time.Time{})
+
+	kind, body, err := readMessage(conn)
+	if err != nil {
+		return peerOpen{}, fmt.Errorf("failed to read OPEN: %w", err)
+	}
+	if kind != msgOpen {
+		return peerOpen{}, fmt.Errorf("expected OPEN, got message type %d", kind)
+	}
+	peerOpenMsg, err := parseOpen(body)
+	if err != nil {
+		conn.Write(notificationMessage(2, 0))
+		return peerOpen{}, err
+	}
+	if peerOpenMsg.AS != peer.AS {
+		conn.Write(notificationMessage(2, 2)) // Bad peer AS
+		return peerOpen{}, fmt.Errorf("peer AS %d does not match configured AS %d", peerOpenMsg.AS, peer.AS)
+	}
+	if peerOpenMsg.HoldTime != 0 && peerOpenMsg.HoldTime < 3 {
+		conn.Write(notificationMessage(2, 6)) // Unacceptable hold time
+		return peerOpen{}, fmt.Errorf("unacceptable hold time %ds", peerOpenMsg.HoldTime)
+	}
+	if !peerOpenMsg.FourOctetAS && s.config.LocalAS > 0xffff {
+		conn.Write(notificationMessage(2, 2))
+		return peerOpen{}, errors.New("peer does not support 4-byte AS numbers")
+	}
+
+	s.setState(peer, "open_confirm", nil)
+	if err := s.write(conn, message(msgKeepalive, nil)); err != nil {
+		return peerOpen{}, err
+	}
+	kind, body, err = readMessage(conn)
+	if err != nil {
+		return peerOpen{}, fmt.Errorf("failed to read KEEPALIVE: %w", err)
+	}
+	if kind == msgNotification && len(body) >= 2 {
+		return peerOpen{}, fmt.Errorf("peer sent notification %d/%d", body[0], body[1])
+	}
+	if kind != msgKeepalive {
+		return peerOpen{}, fmt.Errorf("expected KEEPALIVE, got message type %d", kind)
+	}
+	return peerOpenMsg, nil
+}
+
+// families splits the VIPs by address family
+func (s *Speaker) families() (ipv4, ipv6 []netip.Prefix) {
+	for _, prefix := range s.config.Prefixes {
+		if prefix.Addr().Is4() {
+			ipv4 = append(ipv4, prefix)
+		} else {
+			ipv6 = append(ipv6, prefix)
+		}
+	}
+	return ipv4, ipv6
+}
+
+func (s *Speaker) write(conn net.Conn, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write(msg)
+	return err
+}
@@ -0,0 +1,349 @@
+package bgp
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakePeer is a BGP router accepting one session from the speaker
+type fakePeer struct {
+	t        *testing.T
+	listener net.Listener
+	as       uint32
+	conn     net.Conn
+}
+
+func newFakePeer(t *testing.T, as uint32) *fakePeer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return &fakePeer{t: t, listener: listener, as: as}
+}
+
+// peer returns the speaker's view of the fake peer
+func (p *fakePeer) peer() Peer {
+	addr := p.listener.Addr().(*net.TCPAddr)
+	return Peer{Address: netip.MustParseAddr("127.0.0.1"), Port: addr.Port, AS: p.as}
+}
+
+// accept takes the speaker's connection and reads its OPEN
+func (p *fakePeer) accept() peerOpen {
+	p.t.Helper()
+	conn, err := p.listener.Accept()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.t.Cleanup(func() { conn.Close() })
+	p.conn = conn
+	kind, body := p.read()
+	if kind != msgOpen {
+		p.t.Fatalf("speaker sent type %d, want OPEN", kind)
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return open
+}
+
+// establish answers the speaker's OPEN and confirms the session
+func (p *fakePeer) establish() peerOpen {
+	p.t.Helper()
+	open := p.accept()
+	p.write(openMessage(p.as, 90, netip.MustParseAddr("10.255.0.1"), []uint16{afiIPv4, afiIPv6}))
+	p.write(message(msgKeepalive, nil))
+	if kind, _ := p.read(); kind != msgKeepalive {
+		p.t.Fatalf("speaker sent type %d, want KEEPALIVE", kind)
+	}
+	return open
+}
+
+func (p *fakePeer) write(msg []byte) {
+	p.t.Helper()
+	if _, err := p.conn.Write(msg); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// read returns the next message from the speaker
+func (p *fakePeer) read() (byte, []byte) {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kind, body, err := readMessage(p.conn)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return kind, body
+}
+
+// readUpdate returns the next UPDATE
+func (p *fakePeer) readUpdate() update {
+	p.t.Helper()
+	for {
+		kind, body := p.read()
+		switch kind {
+		case msgKeepalive:
+			continue
+		case msgUpdate:
+			return parseUpdate(p.t, body)
+		}
+		p.t.Fatalf("speaker sent type %d, want UPDATE", kind)
+	}
+}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func testSpeaker(t *testing.T, peer Peer) *Speaker {
+	t.Helper()
+	s, err := NewSpeaker(Config{
+		LocalAS:      65000,
+		RouterID:     netip.MustParseAddr("10.0.0.1"),
+		Peers:        []Peer{peer},
+		Prefixes:     []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32"), netip.MustParsePrefix("2001:db8::10/128")},
+		NextHopIPv6:  netip.MustParseAddr("2001:db8::1"),
+		Communities:  []uint32{65000<<16 | 100},
+		ConnectRetry: 50 * time.Millisecond,
+	}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// waitState waits for the session to the only peer to reach state
+func waitState(t *testing.T, s *Speaker, state string) PeerStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.Status()[0]
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %s, want %s", status.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSpeakerAnnouncesWhileHealthy(t *testing.T) {
+	fake := newFakePeer(t, 65001)
+	s := testSpeaker(t, fake.peer())
+
+	var healthy atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	go s.Follow(ctx, 5*time.Millisecond, healthy.Load)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	open := fake.establish()
+	if open.AS != 65000 || !open.FourOctetAS || open.HoldTime != 90 {
+		t.Errorf("speaker OPEN %+v", open)
+	}
+	status := waitState(t, s, "established")
+	if !status.Established || status.Peer != fake.peer().String() {
+		t.Errorf("status %+v", status)
+	}
+
+	// Nothing is announced until the instance is healthy
+	healthy.Store(true)
+	ipv4 := fake.readUpdate()
+	if want := []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")}; !reflect.DeepEqual(ipv4.nlri, want) {
+		t.Errorf("announced %v, want %v", ipv4.nlri, want)
+	}
+	if !reflect.DeepEqual(ipv4.attrs[attrNextHop], []byte{127, 0, 0, 1}) {
+		t.Errorf("next hop %v, want the session's local address", ipv4.attrs[attrNextHop])
+	}
+	if !reflect.DeepEqual(ipv4.attrs[attrASPath], []byte{2, 1, 0, 0, 0xfd, 0xe8}) {
+		t.Errorf("AS path %v", ipv4.attrs[attrASPath])
+	}
+	ipv6 := fake.readUpdate()
+	reach := ipv6.attrs[attrMPReach]
+	if len(reach) < 21 || netip.AddrFrom16([16]byte(reach[4:20])) != netip.MustParseAddr("2001:db8::1") {
+		t.Fatalf("IPv6 announcement %v", reach)
+	}
+	if got := parsePrefixes(t, reach[21:], true); !reflect.DeepEqual(got, []netip.Prefix{netip.MustParsePrefix("2001:db8::10/128")}) {
+		t.Errorf("announced %v", got)
+	}
+
+	// Draining withdraws both families
+	healthy.Store(false)
+	withdrawn := fake.readUpdate()
+	if want := []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")}; !reflect.DeepEqual(withdrawn.withdrawn, want) {
+		t.Errorf("withdrew %v, want %v", withdrawn.withdrawn, want)
+	}
+	unreach := fake.readUpdate().attrs[attrMPUnreach]
+	if got := parsePrefixes(t, unreach[3:], true); !reflect.DeepEqual(got, []netip.Prefix{netip.MustParsePrefix("2001:db8::10/128")}) {
+		t.Errorf("withdrew %v", got)
+	}
+	if s.Announced() {
+		t.Error("speaker still announcing while drained")
+	}
+
+	// Healthy again announces again
+	healthy.Store(true)
+	if again := fake.readUpdate(); len(again.nlri) != 1 {
+		t.Errorf("announced %v after recovering", again.nlri)
+	}
+	fake.readUpdate()
+
+	// Shutting down sends a cease notification
+	cancel()
+	for {
+		kind, body := fake.read()
+		if kind == msgKeepalive {
+			continue
+		}
+		if kind != msgNotification || binary.BigEndian.Uint16(body) != notifyCease<<8|ceaseAdminShutdown {
+			t.Errorf("speaker sent type %d %v on shutdown, want a cease NOTIFICATION", kind, body)
+		}
+		break
+	}
+	<-done
+	if status := s.Status()[0]; status.State != "idle" || status.Established {
+		t.Errorf("status after shutdown %+v", status)
+	}
+}
+
+func TestSpeakerAnnouncesOnEstablish(t *testing.T) {
+	fake := newFakePeer(t, 65000) // iBGP
+	s := testSpeaker(t, fake.peer())
+	s.SetAnnounced(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	fake.establish()
+	u := fake.readUpdate()
+	if len(u.nlri) != 1 || len(u.attrs[attrASPath]) != 0 || !reflect.DeepEqual(u.attrs[attrLocalPref], []byte{0, 0, 0, 100}) {
+		t.Errorf("iBGP announcement NLRI %v, AS path %v, LOCAL_PREF %v", u.nlri, u.attrs[attrASPath], u.attrs[attrLocalPref])
+	}
+}
+
+func TestSpeakerRejectsWrongPeerAS(t *testing.T) {
+	fake := newFakePeer(t, 65001)
+	peer := fake.peer()
+	s := testSpeaker(t, peer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	fake.as = 65002
+	fake.accept()
+	fake.write(openMessage(65002, 90, netip.MustParseAddr("10.255.0.1"), []uint16{afiIPv4}))
+	kind, body := fake.read()
+	if kind != msgNotification || body[0] != 2 || body[1] != 2 {
+		t.Errorf("speaker sent type %d %v, want NOTIFICATION 2/2 (bad peer AS)", kind, body)
+	}
+
+	// The session is retried after the error is recorded
+	fake.accept()
+	status := s.Status()[0]
+	if status.Established || !strings.Contains(status.LastError, "does not match configured AS 65001") {
+		t.Errorf("status %+v", status)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{
+		LocalAS:  65000,
+		RouterID: netip.MustParseAddr("10.0.0.1"),
+		Peers:    []Peer{{Address: netip.MustParseAddr("10.0.0.254"), AS: 65001}},
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(*Config){
+		"no local AS":        func(c *Config) { c.LocalAS = 0 },
+		"IPv6 router ID":     func(c *Config) { c.RouterID = netip.MustParseAddr("2001:db8::1") },
+		"no peers":           func(c *Config) { c.Peers = nil },
+		"peer without AS":    func(c *Config) { c.Peers = []Peer{{Address: netip.MustParseAddr("10.0.0.254")}} },
+		"no VIPs":            func(c *Config) { c.Prefixes = nil },
+		"short hold time":    func(c *Config) { c.HoldTime = time.Second },
+		"IPv6 next hop":      func(c *Config) { c.NextHop = netip.MustParseAddr("2001:db8::1") },
+		"IPv4 IPv6 next hop": func(c *Config) { c.NextHopIPv6 = netip.MustParseAddr("10.0.0.1") },
+	} {
+		c := valid
+		change(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: valid", name)
+		}
+	}
+
+	if got := (Peer{Address: netip.MustParseAddr("10.0.0.254")}).String(); got != "10.0.0.254:179" {
+		t.Errorf("peer %s, want port 179 by default", got)
+	}
+}
+
+func TestSpeakerMetricPrefix(t *testing.T) {
+	config := Config{
+		LocalAS:  65000,
+		RouterID: netip.MustParseAddr("10.0.0.1"),
+		Peers:    []Peer{{Address: netip.MustParseAddr("10.0.0.254"), AS: 65001}},
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")},
+	}
+	defaults, err := NewSpeaker(config, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MetricPrefix = "nlb"
+	nlb, err := NewSpeaker(config, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewSpeaker(config, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each module names the gauges after itself, registering them once
+	if defaults.metrics == nlb.metrics || nlb.metrics != again.metrics {
+		t.Error("metrics not shared per prefix")
+	}
+	for speaker, want := range map[*Speaker]string{defaults: "marchproxy_bgp_vip_announced", nlb: "nlb_bgp_vip_announced"} {
+		if desc := speaker.metrics.vipAnnounced.Desc().String(); !strings.Contains(desc, `"`+want+`"`) {
+			t.Errorf("gauge %s, want %s", desc, want)
+		}
+	}
+}
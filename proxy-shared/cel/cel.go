@@ -0,0 +1,151 @@
+// Package cel evaluates a subset of the Common Expression Language, enough
+// for mapping and route conditions such as
+//
+//	source.ip in cidr("10.0.0.0/8") && request.path.startsWith("/internal")
+//
+// without an external policy service. Expressions are compiled once and
+// evaluated per connection or request against nested maps of variables.
+//
+// The subset covers literals (bool, int, double, string, null, lists and
+// maps), field selection and indexing, the ! - * / % + - comparison in &&
+// || and ?: operators, has(), size(), int(), double(), string(), ip(),
+// cidr(), and the string methods startsWith, endsWith, contains, matches,
+// lowerAscii and upperAscii. Like CEL, && and || absorb an error on one
+// side when the other decides the result.
+package cel
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// Limits keeping evaluation cheap on the connection path
+const (
+	MaxLength = 4096 // Characters in an expression
+	MaxDepth  = 64   // Nesting of an expression
+)
+
+// Activation holds the variables an expression is evaluated against. Values
+// are bool, ints, float64, string, netip.Addr, netip.Prefix, slices and maps
+// with string keys, nested as deep as needed.
+type Activation map[string]interface{}
+
+// Program is a compiled expression
+type Program struct {
+	source string
+	root   node
+}
+
+// Compile parses expr. When variables are given, any other top-level
+// identifier is an error, so typos surface when a config is loaded rather
+// than as non-matching conditions.
+func Compile(expr string, variables ...string) (*Program, error) {
+	if len(expr) > MaxLength {
+		return nil, fmt.Errorf("expression longer than %d characters", MaxLength)
+	}
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if len(variables) > 0 {
+		p.variables = make(map[string]bool, len(variables))
+		for _, v := range variables {
+			p.variables[v] = true
+		}
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: expr, root: root}, nil
+}
+
+// String returns the source of the expression
+func (p *Program) String() string {
+	return p.source
+}
+
+// Eval evaluates the expression, which must produce a bool
+func (p *Program) Eval(vars Activation) (bool, error) {
+	v, err := p.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression produced %s, not bool", typeName(v))
+	}
+	return b, nil
+}
+
+// Cache compiles each expression once. Compile errors are cached too, so a
+// broken condition costs a map lookup per evaluation.
+type Cache struct {
+	variables []string
+	programs  map[string]cached
+	mu        sync.Mutex
+}
+
+type cached struct {
+	program *Program
+	err     error
+}
+
+// maxCached bounds the cache across config changes; it starts over when full
+const maxCached = 4096
+
+// NewCache creates a cache compiling expressions against variables
+func NewCache(variables ...string) *Cache {
+	return &Cache{variables: variables, programs: make(map[string]cached)}
+}
+
+// Program returns the compiled expr
+func (c *Cache) Program(expr string) (*Program, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.programs[expr]; ok {
+		return entry.program, entry.err
+	}
+	if len(c.programs) >= maxCached {
+		c.programs = make(map[string]cached)
+	}
+	program, err := Compile(expr, c.variables...)
+	c.programs[expr] = cached{program: program, err: err}
+	return program, err
+}
+
+// Eval compiles expr if needed and evaluates it
+func (c *Cache) Eval(expr string, vars Activation) (bool, error) {
+	program, err := c.Program(expr)
+	if err != nil {
+		return false, err
+	}
+	return program.Eval(vars)
+}
+
+// regexpCache holds patterns of matches() calls that aren't literals
+var regexpCache = struct {
+	patterns map[string]*regexp.Regexp
+	mu       sync.Mutex
+}{patterns: make(map[string]*regexp.Regexp)}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.mu.Lock()
+	defer regexpCache.mu.Unlock()
+
+	if re, ok := regexpCache.patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if len(regexpCache.patterns) >= maxCached {
+		regexpCache.patterns = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.patterns[pattern] = re
+	return re, nil
+}
@@ -0,0 +1,153 @@
+package cel
+
+import (
+	"strings"
+	"testing"
+)
+
+func testVars() Activation {
+	return Activation{
+		"source": map[string]interface{}{
+			"ip":      "10.1.2.3",
+			"port":    51000,
+			"country": "DE",
+		},
+		"request": map[string]interface{}{
+			"method":  "GET",
+			"path":    "/internal/metrics",
+			"headers": map[string]string{"x-team": "payments"},
+		},
+		"connection": map[string]interface{}{
+			"tls": true,
+			"sni": "api.example.com",
+		},
+	}
+}
+
+// TestEval tests expressions against connection and request variables
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`source.ip in cidr("10.0.0.0/8") && request.path.startsWith("/internal")`, true},
+		{`source.ip in cidr("192.168.0.0/16")`, false},
+		{`ip(source.ip) in cidr("10.1.2.3")`, true},
+		{`cidr("10.0.0.0/8").containsIP(source.ip)`, true},
+		{`source.country in ["DE", "FR"]`, true},
+		{`!(source.country in ["US"])`, true},
+		{`source.port >= 50000 && source.port < 60000`, true},
+		{`source.port % 2 == 0`, true},
+		{`request.headers["x-team"] == "payments"`, true},
+		{`has(request.headers.x_missing)`, false},
+		{`has(request.headers.x_missing) && request.headers.x_missing == "a"`, false},
+		{`request.method == "POST" || connection.sni.endsWith(".example.com")`, true},
+		{`request.path.matches("^/internal/[a-z]+$")`, true},
+		{`request.path.matches(r"\d")`, false},
+		{`size(request.path) == 17 && request.path.size() == 17`, true},
+		{`connection.tls ? source.port > 0 : false`, true},
+		{`"Payments".lowerAscii() == request.headers["x-team"]`, true},
+		{`int("42") + 1 == 43 && double(1) == 1.0 && string(7) == "7"`, true},
+		{`{"a": 1}["a"] == 1 && [1, 2] + [3] == [1, 2, 3]`, true},
+		{`-source.port < 0 && 1.5 * 2.0 == 3.0`, true},
+		{`ip("::ffff:10.1.2.3") == ip(source.ip)`, true},
+	}
+
+	for _, tt := range tests {
+		got, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Compile(%s): %v", tt.expr, err)
+			continue
+		}
+		result, err := got.Eval(testVars())
+		if err != nil {
+			t.Errorf("Eval(%s): %v", tt.expr, err)
+			continue
+		}
+		if result != tt.want {
+			t.Errorf("Eval(%s) = %t, want %t", tt.expr, result, tt.want)
+		}
+	}
+}
+
+// TestErrorAbsorption tests that && and || ignore an error the other side
+// makes irrelevant, in either order
+func TestErrorAbsorption(t *testing.T) {
+	vars := testVars()
+	for expr, want := range map[string]bool{
+		`request.missing == "x" || source.country == "DE"`: true,
+		`source.country == "DE" || request.missing == "x"`: true,
+		`request.missing == "x" && source.country == "US"`: false,
+		`source.country == "US" && request.missing == "x"`: false,
+	} {
+		got, err := mustCompile(t, expr).Eval(vars)
+		if err != nil || got != want {
+			t.Errorf("Eval(%s) = %t, %v, want %t", expr, got, err, want)
+		}
+	}
+
+	for _, expr := range []string{
+		`request.missing == "x"`,
+		`request.missing == "x" || source.country == "US"`,
+		`source.port + "1" == "x"`,
+		`source.port / 0 == 1`,
+		`source.port`,
+	} {
+		if _, err := mustCompile(t, expr).Eval(vars); err == nil {
+			t.Errorf("Eval(%s) succeeded", expr)
+		}
+	}
+}
+
+// TestCompileErrors tests that malformed expressions are rejected up front
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`source.ip in`,
+		`source.ip in cidr("10.0.0.0/33")`,
+		`ip("not-an-ip")`,
+		`request.path.matches("[")`,
+		`request.path.startsWith()`,
+		`unknown(1)`,
+		`request.path.frobnicate()`,
+		`has(source)`,
+		`"unterminated`,
+		`a ? b`,
+		`source.ip @ 1`,
+		`destination.port == 80`,
+		strings.Repeat("(", MaxDepth+1) + "true" + strings.Repeat(")", MaxDepth+1),
+		strings.Repeat("a", MaxLength+1),
+	} {
+		if _, err := Compile(expr, "source", "request", "connection"); err == nil {
+			t.Errorf("Compile(%.40s) succeeded", expr)
+		}
+	}
+}
+
+// TestCache tests that expressions compile once
+func TestCache(t *testing.T) {
+	c := NewCache("source")
+	first, err := c.Program(`source.country == "DE"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := c.Program(`source.country == "DE"`)
+	if first != second {
+		t.Error("expression compiled twice")
+	}
+	if _, err := c.Eval(`request.path == "/"`, testVars()); err == nil {
+		t.Error("undeclared variable accepted")
+	}
+	if ok, err := c.Eval(`source.country == "DE"`, testVars()); !ok || err != nil {
+		t.Errorf("Eval = %t, %v", ok, err)
+	}
+}
+
+func mustCompile(t *testing.T, expr string) *Program {
+	t.Helper()
+	p, err := Compile(expr)
+	if err != nil {
+		t.Fatalf("Compile(%s): %v", expr, err)
+	}
+	return p
+}
@@ -0,0 +1,645 @@
+package cel
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type node interface {
+	eval(vars Activation) (interface{}, error)
+}
+
+type literal struct{ val interface{} }
+
+type ident struct{ name string }
+
+type selection struct {
+	operand node
+	field   string
+}
+
+type indexing struct{ operand, index node }
+
+type hasField struct{ selection *selection }
+
+type unaryOp struct {
+	op string
+	x  node
+}
+
+type binary struct {
+	op   string
+	x, y node
+}
+
+type logical struct {
+	and  bool
+	x, y node
+}
+
+type conditional struct{ cond, then, otherwise node }
+
+type list struct{ elems []node }
+
+type mapNode struct{ keys, values []node }
+
+type call struct {
+	name   string
+	target node // Receiver of a method call, nil for functions
+	args   []node
+	re     *regexp.Regexp // Precompiled literal pattern of matches()
+}
+
+func (n *literal) eval(Activation) (interface{}, error) {
+	return n.val, nil
+}
+
+func (n *ident) eval(vars Activation) (interface{}, error) {
+	v, ok := vars[n.name]
+	if !ok {
+		return nil, fmt.Errorf("undeclared variable %s", n.name)
+	}
+	return normalize(v), nil
+}
+
+func (n *selection) eval(vars Activation) (interface{}, error) {
+	operand, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	v, ok, err := lookup(operand, n.field)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", n.field)
+	}
+	return v, nil
+}
+
+func (n *indexing) eval(vars Activation) (interface{}, error) {
+	operand, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := operand.([]interface{}); ok {
+		i, ok := index.(int64)
+		if !ok {
+			return nil, fmt.Errorf("list index must be int, not %s", typeName(index))
+		}
+		if i < 0 || i >= int64(len(l)) {
+			return nil, fmt.Errorf("index %d out of range", i)
+		}
+		return l[i], nil
+	}
+	key, ok := index.(string)
+	if !ok {
+		return nil, fmt.Errorf("map key must be string, not %s", typeName(index))
+	}
+	v, ok, err := lookup(operand, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", key)
+	}
+	return v, nil
+}
+
+func (n *hasField) eval(vars Activation) (interface{}, error) {
+	operand, err := n.selection.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	_, ok, err := lookup(operand, n.selection.field)
+	return ok, err
+}
+
+func (n *unaryOp) eval(vars Activation) (interface{}, error) {
+	x, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := x.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s%s", n.op, typeName(x))
+}
+
+func (n *logical) eval(vars Activation) (interface{}, error) {
+	// An error on one side is absorbed when the other side decides the
+	// result, whichever order they are written in
+	x, errX := evalBool(n.x, vars)
+	if errX == nil && x != n.and {
+		return x, nil
+	}
+	y, errY := evalBool(n.y, vars)
+	if errY == nil && y != n.and {
+		return y, nil
+	}
+	if errX != nil {
+		return nil, errX
+	}
+	if errY != nil {
+		return nil, errY
+	}
+	return n.and, nil
+}
+
+func evalBool(n node, vars Activation) (bool, error) {
+	v, err := n.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("no such overload: %s used as bool", typeName(v))
+	}
+	return b, nil
+}
+
+func (n *conditional) eval(vars Activation) (interface{}, error) {
+	c, err := evalBool(n.cond, vars)
+	if err != nil {
+		return nil, err
+	}
+	if c {
+		return n.then.eval(vars)
+	}
+	return n.otherwise.eval(vars)
+}
+
+func (n *list) eval(vars Activation) (interface{}, error) {
+	out := make([]interface{}, len(n.elems))
+	for i, elem := range n.elems {
+		v, err := elem.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (n *mapNode) eval(vars Activation) (interface{}, error) {
+	out := make(map[string]interface{}, len(n.keys))
+	for i := range n.keys {
+		k, err := n.keys[i].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be string, not %s", typeName(k))
+		}
+		v, err := n.values[i].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+func (n *binary) eval(vars Activation) (interface{}, error) {
+	x, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(x, y), nil
+	case "!=":
+		return !equal(x, y), nil
+	case "in":
+		return contains(y, x)
+	case "<", "<=", ">", ">=":
+		c, err := compare(x, y)
+		if err != nil {
+			return nil, fmt.Errorf("no such overload: %s %s %s", typeName(x), n.op, typeName(y))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	return arithmetic(n.op, x, y)
+}
+
+func arithmetic(op string, x, y interface{}) (interface{}, error) {
+	switch a := x.(type) {
+	case int64:
+		b, ok := y.(int64)
+		if !ok {
+			break
+		}
+		switch op {
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		case "/", "%":
+			if b == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return a / b, nil
+			}
+			return a % b, nil
+		}
+	case float64:
+		b, ok := y.(float64)
+		if !ok {
+			break
+		}
+		switch op {
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		case "/":
+			return a / b, nil
+		}
+	case string:
+		if b, ok := y.(string); ok && op == "+" {
+			return a + b, nil
+		}
+	case []interface{}:
+		if b, ok := y.([]interface{}); ok && op == "+" {
+			return append(append([]interface{}{}, a...), b...), nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", typeName(x), op, typeName(y))
+}
+
+func (n *call) eval(vars Activation) (interface{}, error) {
+	var target interface{}
+	if n.target != nil {
+		var err error
+		if target, err = n.target.eval(vars); err != nil {
+			return nil, err
+		}
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	if n.target == nil {
+		return callFunction(n.name, args[0])
+	}
+	return n.callMethod(target, args)
+}
+
+func callFunction(name string, arg interface{}) (interface{}, error) {
+	switch name {
+	case "size":
+		return size(arg)
+	case "int":
+		switch v := arg.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if math.IsNaN(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+				return nil, fmt.Errorf("int() out of range: %v", v)
+			}
+			return int64(v), nil
+		case string:
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("int() cannot convert %q", v)
+			}
+			return i, nil
+		}
+	case "double":
+		switch v := arg.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("double() cannot convert %q", v)
+			}
+			return f, nil
+		}
+	case "string":
+		switch v := arg.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		case netip.Addr:
+			return v.String(), nil
+		case netip.Prefix:
+			return v.String(), nil
+		}
+	case "ip":
+		switch v := arg.(type) {
+		case netip.Addr:
+			return v, nil
+		case string:
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			return addr.Unmap(), nil
+		}
+	case "cidr":
+		if s, ok := arg.(string); ok {
+			return parsePrefix(s)
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s(%s)", name, typeName(arg))
+}
+
+func (n *call) callMethod(target interface{}, args []interface{}) (interface{}, error) {
+	if n.name == "size" {
+		return size(target)
+	}
+	if n.name == "containsIP" {
+		prefix, ok := target.(netip.Prefix)
+		if !ok {
+			return nil, fmt.Errorf("no such overload: %s.containsIP()", typeName(target))
+		}
+		return contains(prefix, args[0])
+	}
+
+	s, ok := target.(string)
+	if !ok {
+		return nil, fmt.Errorf("no such overload: %s.%s()", typeName(target), n.name)
+	}
+	switch n.name {
+	case "lowerAscii":
+		return strings.ToLower(s), nil
+	case "upperAscii":
+		return strings.ToUpper(s), nil
+	}
+
+	arg, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("no such overload: string.%s(%s)", n.name, typeName(args[0]))
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "matches":
+		re := n.re
+		if re == nil {
+			var err error
+			if re, err = compileRegexp(arg); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("unknown method %s", n.name)
+}
+
+func size(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return int64(utf8.RuneCountInString(v)), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case map[string]interface{}:
+		return int64(len(v)), nil
+	}
+	return nil, fmt.Errorf("no such overload: size(%s)", typeName(v))
+}
+
+// contains implements x in container for lists, map keys and CIDRs
+func contains(container, x interface{}) (interface{}, error) {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, elem := range c {
+			if equal(elem, x) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		key, ok := x.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c[key]
+		return found, nil
+	case netip.Prefix:
+		var addr netip.Addr
+		switch v := x.(type) {
+		case netip.Addr:
+			addr = v
+		case string:
+			parsed, err := netip.ParseAddr(v)
+			if err != nil {
+				// Clients without an IP, such as unix sockets, are in no CIDR
+				return false, nil
+			}
+			addr = parsed
+		default:
+			return nil, fmt.Errorf("no such overload: %s in cidr", typeName(x))
+		}
+		return c.Contains(addr.Unmap()), nil
+	}
+	return nil, fmt.Errorf("no such overload: %s in %s", typeName(x), typeName(container))
+}
+
+// lookup returns the field of a map, reporting whether it is present
+func lookup(operand interface{}, field string) (interface{}, bool, error) {
+	m, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("no such overload: %s.%s", typeName(operand), field)
+	}
+	v, ok := m[field]
+	if !ok {
+		return nil, false, nil
+	}
+	return normalize(v), true, nil
+}
+
+// normalize converts variables to the types expressions work with
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case Activation:
+		return map[string]interface{}(v)
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, s := range v {
+			m[k] = s
+		}
+		return m
+	case []string:
+		l := make([]interface{}, len(v))
+		for i, s := range v {
+			l[i] = s
+		}
+		return l
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, elem := range v {
+			l[i] = normalize(elem)
+		}
+		return l
+	}
+	return v
+}
+
+func equal(x, y interface{}) bool {
+	switch a := x.(type) {
+	case int64:
+		if b, ok := y.(float64); ok {
+			return float64(a) == b
+		}
+	case float64:
+		if b, ok := y.(int64); ok {
+			return a == float64(b)
+		}
+	case netip.Addr:
+		if b, ok := y.(string); ok {
+			parsed, err := netip.ParseAddr(b)
+			return err == nil && parsed.Unmap() == a.Unmap()
+		}
+	case string:
+		if b, ok := y.(netip.Addr); ok {
+			return equal(b, a)
+		}
+	case []interface{}, map[string]interface{}:
+		return reflect.DeepEqual(x, y)
+	}
+	return x == y
+}
+
+func compare(x, y interface{}) (int, error) {
+	switch a := x.(type) {
+	case int64:
+		switch b := y.(type) {
+		case int64:
+			return cmp(a < b, a > b), nil
+		case float64:
+			return cmp(float64(a) < b, float64(a) > b), nil
+		}
+	case float64:
+		switch b := y.(type) {
+		case float64:
+			return cmp(a < b, a > b), nil
+		case int64:
+			return cmp(a < float64(b), a > float64(b)), nil
+		}
+	case string:
+		if b, ok := y.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("not comparable")
+}
+
+func cmp(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		// A bare address is a single-host CIDR
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	case netip.Addr:
+		return "ip"
+	case netip.Prefix:
+		return "cidr"
+	}
+	return fmt.Sprintf("%T", v)
+}
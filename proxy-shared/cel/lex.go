@@ -0,0 +1,181 @@
+package cel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokOp // Operators and punctuation
+)
+
+type token struct {
+	kind tokenKind
+	text string      // Identifier or operator
+	val  interface{} // Literal value
+	pos  int
+}
+
+// operators longest first, so "<=" lexes before "<"
+var operators = []string{
+	"==", "!=", "<=", ">=", "&&", "||",
+	"<", ">", "!", "+", "-", "*", "/", "%", "?", ":",
+	"(", ")", "[", "]", "{", "}", ".", ",",
+}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(src) {
+				r, size := utf8.DecodeRuneInString(src[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			word := src[start:i]
+			// Raw strings: r"..." or r'...'
+			if (word == "r" || word == "R") && i < len(src) && (src[i] == '"' || src[i] == '\'') {
+				s, n, err := lexString(src[i:], true)
+				if err != nil {
+					return nil, fmt.Errorf("at %d: %w", start, err)
+				}
+				tokens = append(tokens, token{kind: tokString, val: s, pos: start})
+				i += n
+				continue
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: word, pos: start})
+
+		case r >= '0' && r <= '9':
+			t, n, err := lexNumber(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %w", i, err)
+			}
+			t.pos = i
+			tokens = append(tokens, t)
+			i += n
+
+		case r == '"' || r == '\'':
+			s, n, err := lexString(src[i:], false)
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokString, val: s, pos: i})
+			i += n
+
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("at %d: unexpected %q", i, r)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// lexNumber reads an int, hex int or double literal
+func lexNumber(src string) (token, int, error) {
+	if strings.HasPrefix(src, "0x") || strings.HasPrefix(src, "0X") {
+		n := 2
+		for n < len(src) && strings.ContainsRune("0123456789abcdefABCDEF", rune(src[n])) {
+			n++
+		}
+		v, err := strconv.ParseInt(src[2:n], 16, 64)
+		if err != nil {
+			return token{}, 0, fmt.Errorf("invalid number %q", src[:n])
+		}
+		return token{kind: tokInt, val: v}, n, nil
+	}
+
+	n := 0
+	float := false
+scan:
+	for n < len(src) {
+		c := src[n]
+		switch {
+		case c >= '0' && c <= '9':
+		case c == '.' && !float && n+1 < len(src) && src[n+1] >= '0' && src[n+1] <= '9':
+			float = true
+		case (c == 'e' || c == 'E') && n > 0:
+			float = true
+			if n+1 < len(src) && (src[n+1] == '+' || src[n+1] == '-') {
+				n++
+			}
+		default:
+			break scan
+		}
+		n++
+	}
+	if float {
+		v, err := strconv.ParseFloat(src[:n], 64)
+		if err != nil {
+			return token{}, 0, fmt.Errorf("invalid number %q", src[:n])
+		}
+		return token{kind: tokFloat, val: v}, n, nil
+	}
+	v, err := strconv.ParseInt(src[:n], 10, 64)
+	if err != nil {
+		return token{}, 0, fmt.Errorf("invalid number %q", src[:n])
+	}
+	return token{kind: tokInt, val: v}, n, nil
+}
+
+// lexString reads a quoted string, returning it and the bytes consumed
+func lexString(src string, raw bool) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, fmt.Errorf("newline in string")
+		case c == '\\' && !raw:
+			i++
+			if i >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(src[i])
+			default:
+				return "", 0, fmt.Errorf("unknown escape \\%c", src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
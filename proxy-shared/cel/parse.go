@@ -0,0 +1,456 @@
+package cel
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+)
+
+// functions are the global functions and their argument counts
+var functions = map[string]int{
+	"size":   1,
+	"int":    1,
+	"double": 1,
+	"string": 1,
+	"ip":     1,
+	"cidr":   1,
+}
+
+// methods are the receiver functions and their argument counts
+var methods = map[string]int{
+	"startsWith": 1,
+	"endsWith":   1,
+	"contains":   1,
+	"matches":    1,
+	"lowerAscii": 0,
+	"upperAscii": 0,
+	"size":       0,
+	"containsIP": 1,
+}
+
+type parser struct {
+	tokens    []token
+	pos       int
+	depth     int
+	variables map[string]bool // Allowed top-level identifiers, any when nil
+}
+
+func (p *parser) parse() (node, error) {
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", describe(t))
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the operator op if it is next
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return p.errorf(t, "expected %q, found %s", op, describe(t))
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("string %q", t.val)
+	case tokInt, tokFloat:
+		return fmt.Sprintf("number %v", t.val)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// expr parses a conditional, the lowest precedence
+func (p *parser) expr() (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > MaxDepth {
+		return nil, p.errorf(p.peek(), "expression nested deeper than %d", MaxDepth)
+	}
+
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return c, nil
+	}
+	t, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	f, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{cond: c, then: t, otherwise: f}, nil
+}
+
+func (p *parser) or() (node, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = &logical{and: false, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) and() (node, error) {
+	x, err := p.relation()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		y, err := p.relation()
+		if err != nil {
+			return nil, err
+		}
+		x = &logical{and: true, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) relation() (node, error) {
+	x, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op := ""
+		switch {
+		case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+			op = t.text
+		case t.kind == tokIdent && t.text == "in":
+			op = "in"
+		default:
+			return x, nil
+		}
+		p.next()
+		y, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) additive() (node, error) {
+	x, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) multiplicative() (node, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if t := p.peek(); t.kind == tokOp && (t.text == "!" || t.text == "-") {
+		p.next()
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > MaxDepth {
+			return nil, p.errorf(t, "expression nested deeper than %d", MaxDepth)
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		// Fold negative number literals
+		if lit, ok := x.(*literal); ok && t.text == "-" {
+			switch v := lit.val.(type) {
+			case int64:
+				return &literal{val: -v}, nil
+			case float64:
+				return &literal{val: -v}, nil
+			}
+		}
+		return &unaryOp{op: t.text, x: x}, nil
+	}
+	return p.member()
+}
+
+// member parses a primary followed by selections, indexes and method calls
+func (p *parser) member() (node, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, p.errorf(t, "expected a field or method name, found %s", describe(t))
+			}
+			if !p.accept("(") {
+				x = &selection{operand: x, field: t.text}
+				continue
+			}
+			args, err := p.args(")")
+			if err != nil {
+				return nil, err
+			}
+			want, ok := methods[t.text]
+			if !ok {
+				return nil, p.errorf(t, "unknown method %s", t.text)
+			}
+			if len(args) != want {
+				return nil, p.errorf(t, "%s takes %d arguments, got %d", t.text, want, len(args))
+			}
+			x, err = newCall(t, x, args)
+			if err != nil {
+				return nil, p.errorf(t, "%v", err)
+			}
+		case p.accept("["):
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &indexing{operand: x, index: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt, tokFloat, tokString:
+		return &literal{val: t.val}, nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literal{val: true}, nil
+		case "false":
+			return &literal{val: false}, nil
+		case "null":
+			return &literal{val: nil}, nil
+		case "in":
+			return nil, p.errorf(t, "unexpected %s", describe(t))
+		}
+		if !p.accept("(") {
+			if p.variables != nil && !p.variables[t.text] {
+				return nil, p.errorf(t, "undeclared variable %s", t.text)
+			}
+			return &ident{name: t.text}, nil
+		}
+		if t.text == "has" {
+			return p.has(t)
+		}
+		args, err := p.args(")")
+		if err != nil {
+			return nil, err
+		}
+		want, ok := functions[t.text]
+		if !ok {
+			return nil, p.errorf(t, "unknown function %s", t.text)
+		}
+		if len(args) != want {
+			return nil, p.errorf(t, "%s takes %d arguments, got %d", t.text, want, len(args))
+		}
+		n, err := newCall(t, nil, args)
+		if err != nil {
+			return nil, p.errorf(t, "%v", err)
+		}
+		return n, nil
+
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		case "[":
+			elems, err := p.args("]")
+			if err != nil {
+				return nil, err
+			}
+			return &list{elems: elems}, nil
+		case "{":
+			return p.mapLiteral()
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", describe(t))
+}
+
+// args parses comma-separated expressions up to end
+func (p *parser) args(end string) ([]node, error) {
+	var args []node
+	if p.accept(end) {
+		return args, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(end) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) mapLiteral() (node, error) {
+	m := &mapNode{}
+	if p.accept("}") {
+		return m, nil
+	}
+	for {
+		key, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		m.keys = append(m.keys, key)
+		m.values = append(m.values, value)
+		if p.accept("}") {
+			return m, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// has parses the has(a.b) macro, which tests for a field without failing
+// when it is missing
+func (p *parser) has(t token) (node, error) {
+	arg, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	sel, ok := arg.(*selection)
+	if !ok {
+		return nil, p.errorf(t, "has() needs a field selection such as has(request.headers.x)")
+	}
+	return &hasField{selection: sel}, nil
+}
+
+// newCall builds a call, checking and precomputing literal arguments
+func newCall(t token, target node, args []node) (node, error) {
+	c := &call{name: t.text, target: target, args: args}
+	if len(args) != 1 {
+		return c, nil
+	}
+	lit, ok := args[0].(*literal)
+	if !ok {
+		return c, nil
+	}
+	s, isString := lit.val.(string)
+
+	switch {
+	case target == nil && t.text == "ip" && isString:
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		return &literal{val: addr.Unmap()}, nil
+	case target == nil && t.text == "cidr" && isString:
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		return &literal{val: prefix}, nil
+	case target != nil && t.text == "matches" && isString:
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", s, err)
+		}
+		c.re = re
+	}
+	return c, nil
+}
@@ -0,0 +1,315 @@
+// Package coordination lets replicas of a proxy role coordinate through
+// the manager. An Elector holds a manager lease so exactly one replica runs
+// a singleton task such as BGP announcements or autoscaling, and Counters
+// share small counts such as rate-limit consumption across replicas.
+//
+// Leases expire unless renewed, so a failed leader is replaced within one
+// lease TTL. A leader that can't reach the manager steps down before its
+// lease can expire, so two replicas never both believe they lead.
+package coordination
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLeaseTTL is how long a lease outlives its last renewal
+	DefaultLeaseTTL = 15 * time.Second
+	// DefaultSyncInterval is how often shared counters are exchanged
+	DefaultSyncInterval = 5 * time.Second
+)
+
+// Lease is the state of a manager lease as seen by one replica
+type Lease struct {
+	Name      string    `json:"name"`
+	Holder    string    `json:"holder"`
+	Held      bool      `json:"held"` // Held by the requesting replica
+	Term      int64     `json:"term"` // Increases every time the holder changes
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Backend stores leases and counters shared by the replicas
+type Backend interface {
+	Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error)
+	Release(ctx context.Context, name string) error
+	Add(ctx context.Context, increments map[string]int64) (map[string]int64, error)
+}
+
+// Status is the state of an elector, for /status
+type Status struct {
+	Name   string `json:"name"`
+	Leader bool   `json:"leader"`
+	Holder string `json:"holder"`
+	Term   int64  `json:"term"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Elector campaigns for one lease and reports whether this replica leads
+type Elector struct {
+	backend Backend
+	name    string
+	ttl     time.Duration
+	logger  logrus.FieldLogger
+
+	mu       sync.RWMutex
+	leader   bool
+	holder   string
+	term     int64
+	deadline time.Time // Leadership ends here unless the lease is renewed
+	lastErr  error
+	watchers []func(bool)
+
+	now func() time.Time
+}
+
+// NewElector creates an elector for the lease name. A zero ttl selects
+// DefaultLeaseTTL.
+func NewElector(backend Backend, name string, ttl time.Duration, logger logrus.FieldLogger) *Elector {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Elector{
+		backend: backend,
+		name:    name,
+		ttl:     ttl,
+		logger:  logger.WithField("lease", name),
+		now:     time.Now,
+	}
+}
+
+// IsLeader reports whether this replica leads. A nil elector always leads,
+// so singleton tasks run on every replica when coordination is disabled.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader && e.now().Before(e.deadline)
+}
+
+// Watch calls fn with the leadership now and whenever it changes
+func (e *Elector) Watch(fn func(leader bool)) {
+	if e == nil {
+		fn(true)
+		return
+	}
+	e.mu.Lock()
+	e.watchers = append(e.watchers, fn)
+	e.mu.Unlock()
+	fn(e.IsLeader())
+}
+
+// Campaign acquires or renews the lease once. While the manager is
+// unreachable a leader keeps leading until its lease could have expired.
+func (e *Elector) Campaign(ctx context.Context) error {
+	start := e.now()
+	lease, err := e.backend.Acquire(ctx, e.name, e.ttl)
+
+	e.mu.Lock()
+	was := e.leader
+	if err != nil {
+		if e.leader && !e.now().Before(e.deadline) {
+			e.leader = false
+		}
+	} else {
+		e.leader = lease.Held
+		e.holder = lease.Holder
+		e.term = lease.Term
+		if lease.Held {
+			// Step down well before the manager could hand the lease to
+			// another replica
+			e.deadline = start.Add(e.ttl * 2 / 3)
+		}
+	}
+	if err != nil && e.lastErr == nil {
+		e.logger.WithError(err).Warn("Failed to renew coordination lease")
+	}
+	e.lastErr = err
+	leader := e.leader
+	var notify []func(bool)
+	if leader != was {
+		notify = append(notify, e.watchers...)
+		if leader {
+			e.logger.WithField("term", e.term).Info("Elected leader")
+		} else {
+			e.logger.WithField("holder", e.holder).Warn("Lost leadership")
+		}
+	}
+	e.mu.Unlock()
+
+	for _, fn := range notify {
+		fn(leader)
+	}
+	return err
+}
+
+// Run campaigns every third of the lease TTL until ctx is done, then
+// releases the lease so another replica takes over at once
+func (e *Elector) Run(ctx context.Context) {
+	e.Campaign(ctx)
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.Resign()
+			return
+		case <-ticker.C:
+			e.Campaign(ctx)
+		}
+	}
+}
+
+// Resign gives up leadership and releases the lease
+func (e *Elector) Resign() {
+	e.mu.Lock()
+	was := e.leader
+	e.leader = false
+	notify := e.watchers
+	e.mu.Unlock()
+
+	if !was {
+		return
+	}
+	for _, fn := range notify {
+		fn(false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.backend.Release(ctx, e.name); err != nil {
+		e.logger.WithError(err).Warn("Failed to release coordination lease")
+	} else {
+		e.logger.Info("Released leadership")
+	}
+}
+
+// Status returns the state of the elector
+func (e *Elector) Status() Status {
+	leader := e.IsLeader()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	status := Status{Name: e.name, Leader: leader, Holder: e.holder, Term: e.term}
+	if e.lastErr != nil {
+		status.Error = e.lastErr.Error()
+	}
+	return status
+}
+
+// Counters shares counts between replicas. Each replica adds what it
+// counted locally; a sync sends the additions and reports how much the
+// other replicas added since the previous sync.
+type Counters struct {
+	backend Backend
+	logger  logrus.FieldLogger
+
+	mu      sync.Mutex
+	pending map[string]int64 // Added locally since the last sync
+	totals  map[string]int64 // Cluster-wide totals at the last sync
+	lastErr error
+}
+
+// NewCounters creates shared counters stored in backend
+func NewCounters(backend Backend, logger logrus.FieldLogger) *Counters {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Counters{
+		backend: backend,
+		logger:  logger,
+		pending: make(map[string]int64),
+		totals:  make(map[string]int64),
+	}
+}
+
+// Add counts n locally for the counter name
+func (c *Counters) Add(name string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[name] += n
+}
+
+// Sync sends the local additions and returns, per counter, how much the
+// other replicas added since the previous sync. The first sync of a
+// counter only establishes its total. Additions are kept for the next
+// sync when this one fails.
+func (c *Counters) Sync(ctx context.Context) (map[string]int64, error) {
+	c.mu.Lock()
+	sent := c.pending
+	c.pending = make(map[string]int64)
+	increments := make(map[string]int64, len(sent)+len(c.totals))
+	for name := range c.totals {
+		increments[name] = 0
+	}
+	for name, n := range sent {
+		increments[name] = n
+	}
+	c.mu.Unlock()
+
+	if len(increments) == 0 {
+		return map[string]int64{}, nil
+	}
+	totals, err := c.backend.Add(ctx, increments)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		for name, n := range sent {
+			c.pending[name] += n
+		}
+		if c.lastErr == nil {
+			c.logger.WithError(err).Warn("Failed to sync shared counters")
+		}
+		c.lastErr = err
+		return nil, err
+	}
+	if c.lastErr != nil {
+		c.logger.Info("Shared counters sync recovered")
+	}
+	c.lastErr = nil
+
+	others := make(map[string]int64, len(totals))
+	for name, total := range totals {
+		if previous, ok := c.totals[name]; ok {
+			if delta := total - previous - sent[name]; delta > 0 {
+				others[name] = delta
+			}
+		}
+		c.totals[name] = total
+	}
+	return others, nil
+}
+
+// Run syncs every interval until ctx is done, passing what the other
+// replicas added to fn
+func (c *Counters) Run(ctx context.Context, interval time.Duration, fn func(others map[string]int64)) {
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if others, err := c.Sync(ctx); err == nil {
+				fn(others)
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package coordination
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeStore is the manager's lease and counter store on a fake clock
+type fakeStore struct {
+	mu       sync.Mutex
+	now      time.Time
+	leases   map[string]Lease
+	counters map[string]int64
+	err      error
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		now:      time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC),
+		leases:   make(map[string]Lease),
+		counters: make(map[string]int64),
+	}
+}
+
+// replica is one proxy replica's view of the store
+type replica struct {
+	store *fakeStore
+	name  string
+}
+
+func (r replica) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return Lease{}, s.err
+	}
+	lease := s.leases[name]
+	if lease.Holder != r.name && lease.Holder != "" && s.now.Before(lease.ExpiresAt) {
+		lease.Held = false
+		return lease, nil
+	}
+	if lease.Holder != r.name || !s.now.Before(lease.ExpiresAt) {
+		lease.Term++
+	}
+	lease = Lease{Name: name, Holder: r.name, Held: true, Term: lease.Term, ExpiresAt: s.now.Add(ttl)}
+	s.leases[name] = lease
+	return lease, nil
+}
+
+func (r replica) Release(ctx context.Context, name string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lease := s.leases[name]; lease.Holder == r.name {
+		lease.Holder = ""
+		s.leases[name] = lease
+	}
+	return nil
+}
+
+func (r replica) Add(ctx context.Context, increments map[string]int64) (map[string]int64, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	totals := make(map[string]int64)
+	for name, n := range increments {
+		s.counters[name] += n
+		totals[name] = s.counters[name]
+	}
+	return totals, nil
+}
+
+// quietLogger discards log output
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// newTestElector returns an elector for replica name on the store's clock
+func newTestElector(store *fakeStore, name string) *Elector {
+	e := NewElector(replica{store: store, name: name}, "nlb/bgp", 15*time.Second, quietLogger())
+	e.now = func() time.Time {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.now
+	}
+	return e
+}
+
+func (s *fakeStore) advance(d time.Duration) {
+	s.mu.Lock()
+	s.now = s.now.Add(d)
+	s.mu.Unlock()
+}
+
+func TestElectionAndFailover(t *testing.T) {
+	store := newFakeStore()
+	a := newTestElector(store, "nlb-a")
+	b := newTestElector(store, "nlb-b")
+
+	var changes []bool
+	b.Watch(func(leader bool) { changes = append(changes, leader) })
+
+	a.Campaign(context.Background())
+	b.Campaign(context.Background())
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("Expected a to lead, got a=%+v b=%+v", a.Status(), b.Status())
+	}
+	if b.Status().Holder != "nlb-a" {
+		t.Errorf("Expected b to see a as holder, got %+v", b.Status())
+	}
+
+	// a stops renewing; b takes over once the lease expires
+	store.advance(10 * time.Second)
+	b.Campaign(context.Background())
+	if b.IsLeader() {
+		t.Fatal("Expected b to wait for the lease to expire")
+	}
+	if a.IsLeader() {
+		t.Fatal("Expected a to step down before its lease could expire")
+	}
+	store.advance(6 * time.Second)
+	b.Campaign(context.Background())
+	if !b.IsLeader() || b.Status().Term != 2 {
+		t.Fatalf("Expected b to lead term 2, got %+v", b.Status())
+	}
+
+	// Resigning hands the lease over at once
+	b.Resign()
+	a.Campaign(context.Background())
+	if !a.IsLeader() || a.Status().Term != 3 {
+		t.Fatalf("Expected a to lead term 3 after b resigned, got %+v", a.Status())
+	}
+
+	if len(changes) != 3 || changes[0] || !changes[1] || changes[2] {
+		t.Errorf("Expected b's leadership to go false, true, false, got %v", changes)
+	}
+}
+
+func TestLeaderStepsDownWhenManagerUnreachable(t *testing.T) {
+	store := newFakeStore()
+	a := newTestElector(store, "nlb-a")
+	a.Campaign(context.Background())
+
+	// One failed renewal is tolerated
+	store.err = errors.New("connection refused")
+	store.advance(5 * time.Second)
+	if err := a.Campaign(context.Background()); err == nil {
+		t.Fatal("Expected the campaign error to be returned")
+	}
+	if !a.IsLeader() {
+		t.Fatal("Expected a to keep leading within its lease")
+	}
+
+	store.advance(5 * time.Second)
+	a.Campaign(context.Background())
+	if a.IsLeader() {
+		t.Fatal("Expected a to step down before the lease expires")
+	}
+	if a.Status().Error == "" {
+		t.Error("Expected the error in the status")
+	}
+}
+
+func TestNilElectorLeads(t *testing.T) {
+	var e *Elector
+	if !e.IsLeader() {
+		t.Error("Expected a nil elector to lead")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	store := newFakeStore()
+	a := NewCounters(replica{store: store, name: "nlb-a"}, quietLogger())
+	b := NewCounters(replica{store: store, name: "nlb-b"}, quietLogger())
+
+	a.Add("nlb/ratelimit/http", 10)
+	if others, _ := a.Sync(context.Background()); len(others) != 0 {
+		t.Errorf("Expected the first sync to only establish totals, got %v", others)
+	}
+	b.Add("nlb/ratelimit/http", 5)
+	b.Sync(context.Background())
+
+	a.Add("nlb/ratelimit/http", 1)
+	b.Add("nlb/ratelimit/http", 7)
+	b.Sync(context.Background())
+	others, err := a.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if others["nlb/ratelimit/http"] != 12 {
+		t.Errorf("Expected 12 added by b since a's last sync, got %v", others)
+	}
+
+	// Additions survive a failed sync
+	a.Add("nlb/ratelimit/http", 3)
+	store.err = errors.New("timeout")
+	if _, err := a.Sync(context.Background()); err == nil {
+		t.Fatal("Expected the sync error to be returned")
+	}
+	store.err = nil
+	a.Sync(context.Background())
+	if store.counters["nlb/ratelimit/http"] != 26 {
+		t.Errorf("Expected 26 in total, got %d", store.counters["nlb/ratelimit/http"])
+	}
+}
+
+func TestManagerBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/proxy/lease":
+			var req leaseRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.ClusterAPIKey != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "Invalid cluster API key"}`))
+				return
+			}
+			if req.Release {
+				w.Write([]byte(`{"success": true, "released": true}`))
+				return
+			}
+			w.Write([]byte(`{"success": true, "name": "` + req.Name + `", "holder": "` + req.ProxyName +
+				`", "held": true, "term": 4, "expires_at": "2026-10-17T10:00:15.250000Z"}`))
+		case "/api/proxy/counters":
+			w.Write([]byte(`{"success": true, "counters": {"nlb/ratelimit/http": 42}}`))
+		}
+	}))
+	defer server.Close()
+
+	backend := NewManagerBackend(server.URL+"/", "secret", "nlb-a")
+	lease, err := backend.Acquire(context.Background(), "nlb/bgp", 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.Held || lease.Holder != "nlb-a" || lease.Term != 4 || lease.ExpiresAt.IsZero() {
+		t.Errorf("Unexpected lease %+v", lease)
+	}
+	if err := backend.Release(context.Background(), "nlb/bgp"); err != nil {
+		t.Error(err)
+	}
+
+	totals, err := backend.Add(context.Background(), map[string]int64{"nlb/ratelimit/http": 2})
+	if err != nil || totals["nlb/ratelimit/http"] != 42 {
+		t.Errorf("Unexpected totals %v: %v", totals, err)
+	}
+
+	if _, err := NewManagerBackend(server.URL, "wrong", "nlb-a").Acquire(context.Background(), "nlb/bgp", time.Minute); err == nil {
+		t.Error("Expected a rejected API key to fail")
+	}
+}
@@ -0,0 +1,133 @@
+package coordination
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// leaseRequest is the body of a lease request
+type leaseRequest struct {
+	ProxyName     string `json:"proxy_name"`
+	ClusterAPIKey string `json:"cluster_api_key"`
+	Name          string `json:"name"`
+	TTLSeconds    int    `json:"ttl_seconds"`
+	Release       bool   `json:"release,omitempty"`
+}
+
+// leaseResponse is the manager's answer to a lease request
+type leaseResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Lease
+}
+
+// countersRequest is the body of a shared counters request
+type countersRequest struct {
+	ProxyName     string           `json:"proxy_name"`
+	ClusterAPIKey string           `json:"cluster_api_key"`
+	Increments    map[string]int64 `json:"increments"`
+}
+
+// countersResponse is the manager's answer to a shared counters request
+type countersResponse struct {
+	Success  bool             `json:"success"`
+	Error    string           `json:"error,omitempty"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+// ManagerBackend keeps leases and counters in the manager, scoped to the
+// cluster of the API key
+type ManagerBackend struct {
+	baseURL   string
+	apiKey    string
+	proxyName string
+	client    *http.Client
+}
+
+// NewManagerBackend creates a backend using the manager's /api/proxy/lease
+// and /api/proxy/counters endpoints. proxyName identifies this replica as
+// a lease holder.
+func NewManagerBackend(managerURL, apiKey, proxyName string) *ManagerBackend {
+	return &ManagerBackend{
+		baseURL:   strings.TrimRight(managerURL, "/"),
+		apiKey:    apiKey,
+		proxyName: proxyName,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Acquire acquires or renews the lease name for ttl
+func (m *ManagerBackend) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	var resp leaseResponse
+	req := leaseRequest{ProxyName: m.proxyName, ClusterAPIKey: m.apiKey, Name: name, TTLSeconds: int(ttl / time.Second)}
+	if err := m.post(ctx, "/api/proxy/lease", req, &resp); err != nil {
+		return Lease{}, err
+	}
+	if !resp.Success {
+		return Lease{}, fmt.Errorf("lease request rejected: %s", resp.Error)
+	}
+	return resp.Lease, nil
+}
+
+// Release releases the lease name if this replica holds it
+func (m *ManagerBackend) Release(ctx context.Context, name string) error {
+	var resp leaseResponse
+	req := leaseRequest{ProxyName: m.proxyName, ClusterAPIKey: m.apiKey, Name: name, TTLSeconds: int(DefaultLeaseTTL / time.Second), Release: true}
+	if err := m.post(ctx, "/api/proxy/lease", req, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("lease release rejected: %s", resp.Error)
+	}
+	return nil
+}
+
+// Add adds increments to the shared counters, returning their totals
+func (m *ManagerBackend) Add(ctx context.Context, increments map[string]int64) (map[string]int64, error) {
+	var resp countersResponse
+	req := countersRequest{ProxyName: m.proxyName, ClusterAPIKey: m.apiKey, Increments: increments}
+	if err := m.post(ctx, "/api/proxy/counters", req, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("counters request rejected: %s", resp.Error)
+	}
+	return resp.Counters, nil
+}
+
+// post sends body to the manager endpoint and decodes the answer into result
+func (m *ManagerBackend) post(ctx context.Context, endpoint string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.baseURL+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("manager unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(respData))
+	}
+	if err := json.Unmarshal(respData, result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
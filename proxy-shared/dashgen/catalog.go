@@ -0,0 +1,304 @@
+// Package dashgen generates Grafana dashboards and Prometheus recording
+// and alerting rules from the metrics a module actually exposes, so the
+// observability setup is regenerated from the code rather than maintained
+// by hand. The metrics are read from a running module's /metrics endpoint
+// or from a Prometheus registry in process.
+package dashgen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric types
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+	Summary   = "summary"
+)
+
+// Metric describes one exposed metric family
+type Metric struct {
+	Name   string
+	Type   string
+	Help   string
+	Labels []string // Variable labels, without le and quantile
+}
+
+// Registry is a Prometheus registry, such as prometheus.DefaultRegisterer
+type Registry interface {
+	prometheus.Collector
+	prometheus.Gatherer
+}
+
+// runtimePrefixes are the families of the Go and process collectors,
+// which have dashboards of their own
+var runtimePrefixes = []string{"go_", "process_", "promhttp_"}
+
+// Scrape reads the metrics of a running module from its metrics endpoint,
+// such as http://127.0.0.1:8081/metrics
+func Scrape(url string) ([]Metric, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scraping %s: %s", url, resp.Status)
+	}
+	return Parse(resp.Body)
+}
+
+// Parse reads the metrics of a Prometheus text exposition, such as a
+// /metrics response. Label names are taken from the samples, so families
+// without samples have none.
+func Parse(r io.Reader) ([]Metric, error) {
+	families := make(map[string]*Metric)
+	family := func(name string) *Metric {
+		m, ok := families[name]
+		if !ok {
+			m = &Metric{Name: name}
+			families[name] = m
+		}
+		return m
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "HELP":
+				if len(fields) == 4 {
+					family(fields[2]).Help = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(fields[3])
+				}
+			case "TYPE":
+				if len(fields) == 4 {
+					family(fields[2]).Type = fields[3]
+				}
+			}
+			continue
+		}
+
+		name, labels, err := parseSample(line)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := families[name]
+		if !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				base := strings.TrimSuffix(name, suffix)
+				if f, found := families[base]; base != name && found && (f.Type == Histogram || f.Type == Summary) {
+					m, ok = f, true
+					break
+				}
+			}
+		}
+		if !ok {
+			m = family(name)
+		}
+		for _, label := range labels {
+			if label != "le" && label != "quantile" && !contains(m.Labels, label) {
+				m.Labels = append(m.Labels, label)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	metrics := make([]Metric, 0, len(families))
+	for _, m := range families {
+		if m.Type == "" || m.Type == "untyped" {
+			m.Type = guessType(m.Name)
+		}
+		metrics = append(metrics, *m)
+	}
+	return filter(metrics), nil
+}
+
+// parseSample returns the name and label names of a sample line
+func parseSample(line string) (string, []string, error) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return "", nil, fmt.Errorf("invalid sample %q", line)
+	}
+	name := line[:end]
+	if line[end] != '{' {
+		return name, nil, nil
+	}
+
+	var labels []string
+	rest := line[end+1:]
+	for {
+		rest = strings.TrimLeft(rest, ", ")
+		if strings.HasPrefix(rest, "}") {
+			return name, labels, nil
+		}
+		eq := strings.Index(rest, "=")
+		if eq < 0 || len(rest) < eq+2 || rest[eq+1] != '"' {
+			return "", nil, fmt.Errorf("invalid labels in sample %q", line)
+		}
+		labels = append(labels, strings.TrimSpace(rest[:eq]))
+		// Skip the quoted value, honouring escapes
+		i := eq + 2
+		for i < len(rest) && rest[i] != '"' {
+			if rest[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(rest) {
+			return "", nil, fmt.Errorf("unterminated label value in sample %q", line)
+		}
+		rest = rest[i+1:]
+	}
+}
+
+// descPattern matches the string form of a *prometheus.Desc
+var descPattern = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*"), constLabels: \{.*\}, variableLabels: \{(.*)\}\}$`)
+
+// FromRegistry reads the metrics registered with a registry. Names, help
+// and labels come from the collectors' descriptors, so vectors without
+// any series yet are included. Types come from the gathered families, and
+// are guessed from the name for families without series.
+func FromRegistry(registry Registry) ([]Metric, error) {
+	types := make(map[string]string)
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		types[family.GetName()] = strings.ToLower(family.GetType().String())
+	}
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		registry.Describe(descs)
+		close(descs)
+	}()
+	seen := make(map[string]bool)
+	var metrics []Metric
+	for desc := range descs {
+		match := descPattern.FindStringSubmatch(desc.String())
+		if match == nil {
+			continue
+		}
+		name, err := strconv.Unquote(match[1])
+		if err != nil || seen[name] {
+			continue
+		}
+		help, _ := strconv.Unquote(match[2])
+		seen[name] = true
+
+		m := Metric{Name: name, Type: types[name], Help: help}
+		if m.Type == "" || m.Type == "untyped" {
+			m.Type = guessType(name)
+		}
+		for _, label := range strings.Split(match[3], ",") {
+			label = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(label), "c("), ")")
+			if label != "" {
+				m.Labels = append(m.Labels, label)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return filter(metrics), nil
+}
+
+// FromDefaultRegistry reads the metrics registered with the default
+// Prometheus registry, which promauto registers with
+func FromDefaultRegistry() ([]Metric, error) {
+	registry, ok := prometheus.DefaultRegisterer.(Registry)
+	if !ok {
+		return nil, fmt.Errorf("the default Prometheus registerer is not a registry")
+	}
+	return FromRegistry(registry)
+}
+
+// Merge combines metric catalogs, keeping the first description of a
+// family and the labels found in any
+func Merge(catalogs ...[]Metric) []Metric {
+	byName := make(map[string]*Metric)
+	var names []string
+	for _, catalog := range catalogs {
+		for _, m := range catalog {
+			existing, ok := byName[m.Name]
+			if !ok {
+				m := m
+				m.Labels = append([]string(nil), m.Labels...)
+				byName[m.Name] = &m
+				names = append(names, m.Name)
+				continue
+			}
+			for _, label := range m.Labels {
+				if !contains(existing.Labels, label) {
+					existing.Labels = append(existing.Labels, label)
+				}
+			}
+		}
+	}
+	metrics := make([]Metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, *byName[name])
+	}
+	return filter(metrics)
+}
+
+// guessType returns the type of a family known only by name, following
+// the Prometheus naming conventions
+func guessType(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_total"):
+		return Counter
+	case strings.HasSuffix(name, "_duration_seconds"), strings.HasSuffix(name, "_latency_seconds"):
+		return Histogram
+	}
+	return Gauge
+}
+
+// filter drops the runtime families and sorts the rest by name
+func filter(metrics []Metric) []Metric {
+	kept := metrics[:0]
+	for _, m := range metrics {
+		runtime := false
+		for _, prefix := range runtimePrefixes {
+			if strings.HasPrefix(m.Name, prefix) {
+				runtime = true
+			}
+		}
+		if !runtime {
+			kept = append(kept, m)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Name < kept[j].Name })
+	return kept
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package dashgen
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const exposition = `# HELP marchproxy_requests_total Requests handled per module, route, backend and tenant
+# TYPE marchproxy_requests_total counter
+marchproxy_requests_total{module="egress",route="web",backend="api",tenant="default"} 3
+# HELP marchproxy_request_errors_total Failed requests per module, route, backend, tenant and reason
+# TYPE marchproxy_request_errors_total counter
+# HELP marchproxy_request_duration_seconds Request latency per module, route, backend and tenant
+# TYPE marchproxy_request_duration_seconds histogram
+marchproxy_request_duration_seconds_bucket{module="egress",route="a{b}",backend="x\"y",tenant="default",le="0.1"} 1
+marchproxy_request_duration_seconds_sum{module="egress",route="a{b}",backend="x\"y",tenant="default"} 0.05
+marchproxy_request_duration_seconds_count{module="egress",route="a{b}",backend="x\"y",tenant="default"} 1
+# HELP marchproxy_active_connections Current number of active connections
+# TYPE marchproxy_active_connections gauge
+marchproxy_active_connections 2
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 12
+`
+
+func TestParse(t *testing.T) {
+	metrics, err := Parse(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Metric{
+		{Name: "marchproxy_active_connections", Type: Gauge, Help: "Current number of active connections"},
+		{Name: "marchproxy_request_duration_seconds", Type: Histogram, Help: "Request latency per module, route, backend and tenant", Labels: []string{"module", "route", "backend", "tenant"}},
+		{Name: "marchproxy_request_errors_total", Type: Counter, Help: "Failed requests per module, route, backend, tenant and reason"},
+		{Name: "marchproxy_requests_total", Type: Counter, Help: "Requests handled per module, route, backend and tenant", Labels: []string{"module", "route", "backend", "tenant"}},
+	}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Errorf("metrics = %+v\nwant %+v", metrics, want)
+	}
+
+	if _, err := Parse(strings.NewReader(`marchproxy_broken{route="a} 1`)); err == nil {
+		t.Error("Parse accepted an unterminated label value")
+	}
+}
+
+// TestFromRegistry tests that vectors without series are read with their
+// labels and a type guessed from the name
+func TestFromRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "marchproxy_nlb_routes_failed_total", Help: "Failed routings"}, []string{"protocol"}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "marchproxy_nlb_route_latency_seconds", Help: "Routing latency"}, []string{"protocol"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "marchproxy_nlb_backends", Help: "Healthy backends"}),
+		prometheus.NewGoCollector(),
+	)
+
+	metrics, err := FromRegistry(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Metric{
+		{Name: "marchproxy_nlb_backends", Type: Gauge, Help: "Healthy backends"},
+		{Name: "marchproxy_nlb_route_latency_seconds", Type: Histogram, Help: "Routing latency", Labels: []string{"protocol"}},
+		{Name: "marchproxy_nlb_routes_failed_total", Type: Counter, Help: "Failed routings", Labels: []string{"protocol"}},
+	}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Errorf("metrics = %+v\nwant %+v", metrics, want)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	metrics, _ := Parse(strings.NewReader(exposition))
+
+	data, err := Dashboard("egress", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dashboard struct {
+		UID    string
+		Panels []struct {
+			Type    string
+			Title   string
+			Targets []struct{ Expr string }
+		}
+	}
+	if err := json.Unmarshal(data, &dashboard); err != nil {
+		t.Fatalf("invalid dashboard: %v", err)
+	}
+	exprs := make(map[string]string)
+	rows := 0
+	for _, panel := range dashboard.Panels {
+		if panel.Type == "row" {
+			rows++
+			continue
+		}
+		exprs[panel.Title] = panel.Targets[len(panel.Targets)-1].Expr
+	}
+	if dashboard.UID != "marchproxy-egress-generated" || rows != 3 || len(exprs) != 4 {
+		t.Errorf("dashboard %s has %d rows and panels %v", dashboard.UID, rows, exprs)
+	}
+	for name, want := range map[string]string{
+		"marchproxy_requests_total":           `sum by (module, route) (rate(marchproxy_requests_total{instance=~"$instance"}[$__rate_interval]))`,
+		"marchproxy_request_duration_seconds": `histogram_quantile(0.99, sum by (le) (rate(marchproxy_request_duration_seconds_bucket{instance=~"$instance"}[$__rate_interval])))`,
+		"marchproxy_active_connections":       `sum (marchproxy_active_connections{instance=~"$instance"})`,
+	} {
+		if exprs[name] != want {
+			t.Errorf("%s panel = %s, want %s", name, exprs[name], want)
+		}
+	}
+
+	rules := string(Rules("egress", metrics))
+	for _, line := range []string{
+		`      - record: egress:marchproxy_requests:rate5m`,
+		`        expr: "sum by (instance, module, route, backend, tenant) (rate(marchproxy_requests_total[5m]))"`,
+		`      - record: egress:marchproxy_request_duration_seconds:p95_5m`,
+		`      - alert: MarchProxyEgressHighErrorRatio`,
+	} {
+		if !strings.Contains(rules, line+"\n") {
+			t.Errorf("rules lack %s:\n%s", line, rules)
+		}
+	}
+	// The RED error counter is alerted on through the error ratio only
+	if strings.Contains(rules, "MarchProxyEgressRequestErrors") {
+		t.Errorf("rules alert on the RED error counter itself:\n%s", rules)
+	}
+}
@@ -0,0 +1,314 @@
+package dashgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Thresholds of the generated rules
+const (
+	failureFor      = "15m"  // Failure counters increasing for this long fire
+	errorRatio      = 0.05   // RED error ratio that fires
+	errorRatioFor   = "10m"  // How long the error ratio must hold
+	latencyQuantile = "0.95" // Quantile of the recorded histograms
+)
+
+// Write generates the dashboard and rules of a module into dir as
+// marchproxy-<module>.json and marchproxy-<module>-rules.yml, returning
+// the files written
+func Write(dir, module string, metrics []Metric) ([]string, error) {
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("no metrics to generate dashboards from")
+	}
+	dashboard, err := Dashboard(module, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files := []string{
+		filepath.Join(dir, "marchproxy-"+module+".json"),
+		filepath.Join(dir, "marchproxy-"+module+"-rules.yml"),
+	}
+	for i, data := range [][]byte{dashboard, Rules(module, metrics)} {
+		if err := os.WriteFile(files[i], data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Dashboard returns a Grafana dashboard with a panel per metric, in a row
+// per subsystem, filtered by datasource and instance variables
+func Dashboard(module string, metrics []Metric) ([]byte, error) {
+	var panels []map[string]interface{}
+	id, y := 1, 0
+	group := ""
+	column := 0
+	for _, m := range metrics {
+		if g := subsystem(module, m.Name); g != group {
+			group = g
+			if column != 0 {
+				y += 8
+			}
+			panels = append(panels, map[string]interface{}{
+				"id":        id,
+				"type":      "row",
+				"title":     title(group),
+				"collapsed": false,
+				"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+				"panels":    []interface{}{},
+			})
+			id++
+			y++
+			column = 0
+		}
+
+		panels = append(panels, map[string]interface{}{
+			"id":          id,
+			"type":        "timeseries",
+			"title":       m.Name,
+			"description": m.Help,
+			"datasource":  map[string]string{"type": "prometheus", "uid": "${datasource}"},
+			"gridPos":     map[string]int{"h": 8, "w": 12, "x": column * 12, "y": y},
+			"fieldConfig": map[string]interface{}{"defaults": map[string]string{"unit": unit(m)}, "overrides": []interface{}{}},
+			"options": map[string]interface{}{
+				"legend":  map[string]string{"displayMode": "list", "placement": "bottom"},
+				"tooltip": map[string]string{"mode": "multi"},
+			},
+			"targets": targets(m),
+		})
+		id++
+		if column == 1 {
+			y += 8
+		}
+		column = 1 - column
+	}
+
+	dashboard := map[string]interface{}{
+		"uid":           "marchproxy-" + module + "-generated",
+		"title":         "MarchProxy " + title(module) + " (generated)",
+		"description":   "Generated by marchproxy-" + module + " metrics export-dashboards from the module's registered metrics; regenerate instead of editing",
+		"tags":          []string{"marchproxy", module, "generated"},
+		"editable":      true,
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-1h", "to": "now"},
+		"templating": map[string]interface{}{"list": []interface{}{
+			map[string]interface{}{
+				"name":  "datasource",
+				"label": "Datasource",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			map[string]interface{}{
+				"name":       "instance",
+				"label":      "Instance",
+				"type":       "query",
+				"datasource": map[string]string{"type": "prometheus", "uid": "${datasource}"},
+				"query":      "label_values(" + metrics[0].Name + ", instance)",
+				"refresh":    2,
+				"includeAll": true,
+				"multi":      true,
+				"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+			},
+		}},
+		"panels": panels,
+	}
+	data, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// targets returns the queries of a metric's panel
+func targets(m Metric) []map[string]string {
+	selector := `{instance=~"$instance"}`
+	by, legend := grouping(m.Labels, 2)
+	switch m.Type {
+	case Counter:
+		return []map[string]string{{
+			"refId":        "A",
+			"expr":         fmt.Sprintf("sum%s (rate(%s%s[$__rate_interval]))", by, m.Name, selector),
+			"legendFormat": legend,
+		}}
+	case Histogram:
+		var queries []map[string]string
+		for i, q := range [][2]string{{"0.5", "p50"}, {"0.95", "p95"}, {"0.99", "p99"}} {
+			queries = append(queries, map[string]string{
+				"refId":        string(rune('A' + i)),
+				"expr":         fmt.Sprintf("histogram_quantile(%s, sum by (le) (rate(%s_bucket%s[$__rate_interval])))", q[0], m.Name, selector),
+				"legendFormat": q[1],
+			})
+		}
+		return queries
+	case Summary:
+		return []map[string]string{{
+			"refId": "A",
+			"expr": fmt.Sprintf("sum%s (rate(%s_sum%s[$__rate_interval])) / sum%s (rate(%s_count%s[$__rate_interval]))",
+				by, m.Name, selector, by, m.Name, selector),
+			"legendFormat": legend,
+		}}
+	}
+	return []map[string]string{{
+		"refId":        "A",
+		"expr":         fmt.Sprintf("sum%s (%s%s)", by, m.Name, selector),
+		"legendFormat": legend,
+	}}
+}
+
+// grouping returns the by clause over the first n labels and the legend
+// naming them
+func grouping(labels []string, n int) (by, legend string) {
+	if len(labels) > n {
+		labels = labels[:n]
+	}
+	if len(labels) == 0 {
+		return "", "total"
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = "{{" + label + "}}"
+	}
+	return " by (" + strings.Join(labels, ", ") + ")", strings.Join(parts, " ")
+}
+
+// unit returns the Grafana unit of a metric's panel
+func unit(m Metric) string {
+	name := strings.TrimSuffix(m.Name, "_total")
+	switch {
+	case m.Type == Counter && strings.HasSuffix(name, "_bytes"):
+		return "Bps"
+	case m.Type == Counter:
+		return "ops"
+	case strings.HasSuffix(name, "_timestamp_seconds"):
+		return "dateTimeAsIso"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "bytes"
+	case strings.HasSuffix(name, "_ratio"):
+		return "percentunit"
+	case strings.HasSuffix(name, "_days"):
+		return "d"
+	}
+	return "short"
+}
+
+// Rules returns Prometheus recording rules for the rate of every counter
+// and the latency quantile of every histogram, and alerting rules for
+// failure counters and the RED error ratio
+func Rules(module string, metrics []Metric) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by marchproxy-%s metrics export-dashboards from the module's\n", module)
+	fmt.Fprintf(&b, "# registered metrics; regenerate instead of editing.\n")
+	fmt.Fprintf(&b, "groups:\n")
+
+	var recording bytes.Buffer
+	for _, m := range metrics {
+		by := strings.Join(append([]string{"instance"}, m.Labels...), ", ")
+		switch m.Type {
+		case Counter:
+			fmt.Fprintf(&recording, "      - record: %s:%s:rate5m\n", module, strings.TrimSuffix(m.Name, "_total"))
+			fmt.Fprintf(&recording, "        expr: %s\n", strconv.Quote(fmt.Sprintf("sum by (%s) (rate(%s[5m]))", by, m.Name)))
+		case Histogram:
+			fmt.Fprintf(&recording, "      - record: %s:%s:p%s_5m\n", module, m.Name, strings.TrimPrefix(latencyQuantile, "0."))
+			fmt.Fprintf(&recording, "        expr: %s\n", strconv.Quote(fmt.Sprintf("histogram_quantile(%s, sum by (instance, le) (rate(%s_bucket[5m])))", latencyQuantile, m.Name)))
+		}
+	}
+	writeGroup(&b, "marchproxy_"+module+"_recording", recording.Bytes())
+
+	names := make(map[string]bool)
+	for _, m := range metrics {
+		names[m.Name] = true
+	}
+	red := names["marchproxy_requests_total"] && names["marchproxy_request_errors_total"]
+
+	var alerts bytes.Buffer
+	if red {
+		fmt.Fprintf(&alerts, "      - alert: MarchProxy%sHighErrorRatio\n", title(module))
+		fmt.Fprintf(&alerts, "        expr: %s\n", strconv.Quote(fmt.Sprintf(
+			`sum by (instance, route) (rate(marchproxy_request_errors_total{module="%s"}[5m])) / sum by (instance, route) (rate(marchproxy_requests_total{module="%s"}[5m])) > %g`,
+			module, module, errorRatio)))
+		fmt.Fprintf(&alerts, "        for: %s\n", errorRatioFor)
+		fmt.Fprintf(&alerts, "        labels:\n          severity: warning\n          module: %s\n", module)
+		fmt.Fprintf(&alerts, "        annotations:\n")
+		fmt.Fprintf(&alerts, "          summary: %s\n", strconv.Quote("High error ratio on route {{ $labels.route }} of {{ $labels.instance }}"))
+		fmt.Fprintf(&alerts, "          description: %s\n", strconv.Quote(fmt.Sprintf("More than %g%% of requests failed for %s.", errorRatio*100, errorRatioFor)))
+	}
+	for _, m := range metrics {
+		if m.Type != Counter || !failureCounter(m.Name) || (red && m.Name == "marchproxy_request_errors_total") {
+			continue
+		}
+		fmt.Fprintf(&alerts, "      - alert: MarchProxy%s%s\n", title(module), camel(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(m.Name, "marchproxy_"), module+"_"), "_total")))
+		fmt.Fprintf(&alerts, "        expr: %s\n", strconv.Quote(fmt.Sprintf("sum by (instance) (rate(%s[5m])) > 0", m.Name)))
+		fmt.Fprintf(&alerts, "        for: %s\n", failureFor)
+		fmt.Fprintf(&alerts, "        labels:\n          severity: warning\n          module: %s\n", module)
+		fmt.Fprintf(&alerts, "        annotations:\n")
+		summary := m.Help
+		if summary == "" {
+			summary = m.Name
+		}
+		fmt.Fprintf(&alerts, "          summary: %s\n", strconv.Quote(summary+" on {{ $labels.instance }}"))
+		fmt.Fprintf(&alerts, "          description: %s\n", strconv.Quote(fmt.Sprintf("%s has been increasing for %s.", m.Name, failureFor)))
+	}
+	writeGroup(&b, "marchproxy_"+module+"_alerts", alerts.Bytes())
+	return b.Bytes()
+}
+
+// writeGroup writes a rule group, with an empty rule list when it has no
+// rules
+func writeGroup(b *bytes.Buffer, name string, rules []byte) {
+	fmt.Fprintf(b, "  - name: %s\n", name)
+	if len(rules) == 0 {
+		fmt.Fprintf(b, "    rules: []\n")
+		return
+	}
+	fmt.Fprintf(b, "    rules:\n")
+	b.Write(rules)
+}
+
+// failureCounter tells whether a counter counts failures
+func failureCounter(name string) bool {
+	for _, suffix := range []string{"_errors_total", "_failures_total", "_failed_total"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// subsystem returns the row of a metric: the first word of its name after
+// the marchproxy and module prefixes
+func subsystem(module, name string) string {
+	name = strings.TrimPrefix(name, "marchproxy_")
+	name = strings.TrimPrefix(name, module+"_")
+	if i := strings.Index(name, "_"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func title(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// camel converts a snake_case name to CamelCase
+func camel(s string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(s, "_") {
+		b.WriteString(title(part))
+	}
+	return b.String()
+}
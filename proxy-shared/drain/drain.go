@@ -0,0 +1,400 @@
+// Package drain takes single backends out of rotation for maintenance.
+// A drained backend gets no new requests or connections, while the work
+// already sent to it finishes. Drains come from the manager, for every
+// proxy of the cluster at once, and from the admin API of one proxy.
+package drain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Where a drain was requested
+const (
+	SourceManager = "manager"
+	SourceAdmin   = "admin"
+)
+
+// Backend is a backend to drain: a host, and one of its ports or all of
+// them when Port is 0
+type Backend struct {
+	Host string `json:"host"`
+	Port int    `json:"port,omitempty"`
+}
+
+// Parse parses host or host:port
+func Parse(s string) (Backend, error) {
+	s = strings.TrimSpace(s)
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return Backend{}, fmt.Errorf("invalid port in backend %q", s)
+		}
+		b := Backend{Host: host, Port: n}
+		return b, b.Validate()
+	}
+	b := Backend{Host: strings.Trim(s, "[]")}
+	return b, b.Validate()
+}
+
+// Validate checks the backend names a host and a valid port
+func (b Backend) Validate() error {
+	if b.Host == "" {
+		return fmt.Errorf("backend host is required")
+	}
+	if b.Port < 0 || b.Port > 65535 {
+		return fmt.Errorf("invalid backend port %d", b.Port)
+	}
+	return nil
+}
+
+// Matches reports whether the backend at host:port is this one
+func (b Backend) Matches(host string, port int) bool {
+	return strings.EqualFold(b.Host, host) && (b.Port == 0 || b.Port == port)
+}
+
+// String returns host:port, or the host alone for every port
+func (b Backend) String() string {
+	if b.Port == 0 {
+		return b.Host
+	}
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+// endpoint is a host:port work is in flight to
+type endpoint struct {
+	host string
+	port int
+}
+
+// Set holds the drained backends of a proxy and counts the work in flight
+// to every backend, so operators see when a drain has finished
+type Set struct {
+	module string
+
+	mu       sync.RWMutex
+	managed  map[Backend]time.Time // Drains from the manager, since when
+	local    map[Backend]time.Time // Drains from the admin API
+	inflight map[endpoint]int64
+}
+
+// NewSet creates an empty set for a module, which labels its metrics
+func NewSet(module string) *Set {
+	return &Set{
+		module:   module,
+		managed:  make(map[Backend]time.Time),
+		local:    make(map[Backend]time.Time),
+		inflight: make(map[endpoint]int64),
+	}
+}
+
+// SetManaged replaces the drains from the manager
+func (s *Set) SetManaged(backends []Backend) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	managed := make(map[Backend]time.Time, len(backends))
+	for _, b := range backends {
+		if b.Validate() != nil {
+			continue
+		}
+		b.Host = strings.ToLower(b.Host)
+		since, ok := s.managed[b]
+		if !ok {
+			since = time.Now()
+		}
+		managed[b] = since
+	}
+	s.managed = managed
+}
+
+// Add drains a backend until Remove, reporting whether it wasn't already
+func (s *Set) Add(b Backend) bool {
+	b.Host = strings.ToLower(b.Host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.local[b]; ok {
+		return false
+	}
+	s.local[b] = time.Now()
+	return true
+}
+
+// Remove ends a drain started with Add. Drains from the manager end when
+// the manager lifts them.
+func (s *Set) Remove(b Backend) bool {
+	b.Host = strings.ToLower(b.Host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.local[b]; !ok {
+		return false
+	}
+	delete(s.local, b)
+	return true
+}
+
+// Drained reports whether the backend at host:port takes no new work
+func (s *Set) Drained(host string, port int) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, drains := range []map[Backend]time.Time{s.managed, s.local} {
+		for b := range drains {
+			if b.Matches(host, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Track counts work sent to host:port until the returned release is called
+func (s *Set) Track(host string, port int) (release func()) {
+	if s == nil {
+		return func() {}
+	}
+	key := endpoint{host: strings.ToLower(host), port: port}
+	s.mu.Lock()
+	s.inflight[key]++
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.inflight[key]--; s.inflight[key] <= 0 {
+				delete(s.inflight, key)
+			}
+		})
+	}
+}
+
+// Active returns the tracked work in flight to a backend
+func (s *Set) Active(b Backend) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeLocked(b)
+}
+
+func (s *Set) activeLocked(b Backend) int64 {
+	var n int64
+	for key, count := range s.inflight {
+		if b.Matches(key.host, key.port) {
+			n += count
+		}
+	}
+	return n
+}
+
+// Status is a drain and the work still in flight to its backend
+type Status struct {
+	Backend
+	Source string    `json:"source"`
+	Since  time.Time `json:"since"`
+	Active int64     `json:"active"`  // Requests or connections still in flight
+	Done   bool      `json:"drained"` // Nothing is in flight any more
+}
+
+// Status lists the drains, the manager's first. active counts the work in
+// flight to a backend; nil uses the work tracked with Track.
+func (s *Set) Status(active func(Backend) int64) []Status {
+	s.mu.RLock()
+	var list []Status
+	for _, source := range []string{SourceManager, SourceAdmin} {
+		drains := s.managed
+		if source == SourceAdmin {
+			drains = s.local
+		}
+		start := len(list)
+		for b, since := range drains {
+			status := Status{Backend: b, Source: source, Since: since}
+			if active == nil {
+				status.Active = s.activeLocked(b)
+			}
+			list = append(list, status)
+		}
+		sort.Slice(list[start:], func(i, j int) bool {
+			return list[start+i].String() < list[start+j].String()
+		})
+	}
+	s.mu.RUnlock()
+
+	for i := range list {
+		if active != nil {
+			list[i].Active = active(list[i].Backend)
+		}
+		list[i].Done = list[i].Active == 0
+	}
+	return list
+}
+
+// Handler serves the admin API of the drains:
+//
+//	GET    /admin/backends/drain                       list drains and the work in flight
+//	PUT    /admin/backends/drain                       drain {"host": ..., "port": ...}
+//	DELETE /admin/backends/drain?backend=<host[:port]> end a drain started here
+//
+// active counts the work in flight to a backend; nil uses Track.
+func (s *Set) Handler(active func(Backend) int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var b Backend
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&b); err != nil {
+				http.Error(w, fmt.Sprintf("invalid backend: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := b.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.Add(b)
+		case http.MethodDelete:
+			b, err := Parse(r.URL.Query().Get("backend"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !s.Remove(b) {
+				http.Error(w, "no drain from the admin API for backend", http.StatusNotFound)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"drains": s.Status(active)})
+	}
+}
+
+// Collector exports the drains and the work in flight to drained backends.
+// active counts the work in flight to a backend; nil uses Track.
+func (s *Set) Collector(active func(Backend) int64) prometheus.Collector {
+	return &collector{
+		set:    s,
+		active: active,
+		drained: prometheus.NewDesc("marchproxy_backend_drained",
+			"Backends drained per module and source of the drain", []string{"module", "backend", "source"}, nil),
+		inflight: prometheus.NewDesc("marchproxy_backend_drain_inflight",
+			"Requests or connections still in flight to drained backends", []string{"module", "backend", "source"}, nil),
+	}
+}
+
+type collector struct {
+	set      *Set
+	active   func(Backend) int64
+	drained  *prometheus.Desc
+	inflight *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.drained
+	ch <- c.inflight
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.set.Status(c.active) {
+		ch <- prometheus.MustNewConstMetric(c.drained, prometheus.GaugeValue, 1, c.set.module, status.String(), status.Source)
+		ch <- prometheus.MustNewConstMetric(c.inflight, prometheus.GaugeValue, float64(status.Active), c.set.module, status.String(), status.Source)
+	}
+}
+
+// drainsRequest is the body of a drains request to the manager
+type drainsRequest struct {
+	ProxyName     string `json:"proxy_name"`
+	ClusterAPIKey string `json:"cluster_api_key"`
+}
+
+// drainsResponse is the manager's answer to a drains request
+type drainsResponse struct {
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	Drains  []Backend `json:"drained_backends"`
+}
+
+// ManagerFetcher returns a function fetching the cluster's drains from the
+// manager's /api/proxy/drains endpoint
+func ManagerFetcher(managerURL, apiKey, proxyName string) func(ctx context.Context) ([]Backend, error) {
+	baseURL := strings.TrimRight(managerURL, "/")
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context) ([]Backend, error) {
+		data, err := json.Marshal(drainsRequest{ProxyName: proxyName, ClusterAPIKey: apiKey})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/api/proxy/drains", bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("manager unreachable: %w", err)
+		}
+		defer resp.Body.Close()
+
+		respData, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		if resp.StatusCode >= 400 {
+			return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(respData))
+		}
+		var result drainsResponse
+		if err := json.Unmarshal(respData, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		if !result.Success {
+			return nil, fmt.Errorf("drains request rejected: %s", result.Error)
+		}
+		return result.Drains, nil
+	}
+}
+
+// Poll applies the drains fetch returns every interval until ctx is done.
+// Failed fetches keep the known drains and are passed to onError.
+func (s *Set) Poll(ctx context.Context, interval time.Duration, fetch func(context.Context) ([]Backend, error), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if backends, err := fetch(ctx); err != nil {
+			if onError != nil {
+				onError(err)
+			}
+		} else {
+			s.SetManaged(backends)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package drain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Backend
+	}{
+		{"10.0.0.5", Backend{Host: "10.0.0.5"}},
+		{"db-1.internal:5432", Backend{Host: "db-1.internal", Port: 5432}},
+		{"[fd00::1]:8080", Backend{Host: "fd00::1", Port: 8080}},
+	} {
+		got, err := Parse(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", tc.in, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "host:0", "host:http", ":80"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSetDrains(t *testing.T) {
+	var nilSet *Set
+	if nilSet.Drained("10.0.0.5", 80) {
+		t.Error("A nil set drains backends")
+	}
+
+	s := NewSet("ingress")
+	s.SetManaged([]Backend{{Host: "10.0.0.5"}})
+	s.Add(Backend{Host: "Web-2.internal", Port: 8080})
+
+	for _, tc := range []struct {
+		host string
+		port int
+		want bool
+	}{
+		{"10.0.0.5", 80, true},
+		{"10.0.0.5", 443, true},
+		{"web-2.internal", 8080, true},
+		{"web-2.internal", 8443, false},
+		{"10.0.0.6", 80, false},
+	} {
+		if got := s.Drained(tc.host, tc.port); got != tc.want {
+			t.Errorf("Drained(%s, %d) = %t, want %t", tc.host, tc.port, got, tc.want)
+		}
+	}
+
+	// The admin API only ends its own drains
+	if s.Remove(Backend{Host: "10.0.0.5"}) {
+		t.Error("Removed a drain from the manager")
+	}
+	if !s.Remove(Backend{Host: "web-2.internal", Port: 8080}) || s.Drained("web-2.internal", 8080) {
+		t.Error("Drain from the admin API not removed")
+	}
+	s.SetManaged(nil)
+	if s.Drained("10.0.0.5", 80) {
+		t.Error("Drain lifted by the manager still applies")
+	}
+}
+
+func TestSetTracksInflight(t *testing.T) {
+	s := NewSet("ingress")
+	s.Add(Backend{Host: "10.0.0.5"})
+	first := s.Track("10.0.0.5", 80)
+	second := s.Track("10.0.0.5", 443)
+	s.Track("10.0.0.6", 80)
+
+	status := s.Status(nil)
+	if len(status) != 1 || status[0].Active != 2 || status[0].Done {
+		t.Fatalf("Status = %+v, want 2 in flight to 10.0.0.5", status)
+	}
+	first()
+	first()
+	second()
+	if status := s.Status(nil); status[0].Active != 0 || !status[0].Done {
+		t.Errorf("Status = %+v, want the drain done", status)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := NewSet("nlb")
+	s.SetManaged([]Backend{{Host: "10.0.0.5"}})
+	handler := s.Handler(func(b Backend) int64 { return 3 })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("PUT", "/admin/backends/drain", strings.NewReader(`{"host":"10.0.0.7","port":50051}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Drains []Status `json:"drains"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Drains) != 2 || body.Drains[0].Source != SourceManager || body.Drains[1].String() != "10.0.0.7:50051" || body.Drains[1].Active != 3 {
+		t.Errorf("Drains = %+v", body.Drains)
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"PUT", "/admin/backends/drain", `{"port":80}`, http.StatusBadRequest},
+		{"DELETE", "/admin/backends/drain?backend=10.0.0.5", "", http.StatusNotFound},
+		{"DELETE", "/admin/backends/drain?backend=10.0.0.7:50051", "", http.StatusOK},
+		{"POST", "/admin/backends/drain", "", http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.target, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	s := NewSet("dblb")
+	s.Add(Backend{Host: "pg-1", Port: 5432})
+	defer s.Track("pg-1", 5432)()
+
+	want := `
+# HELP marchproxy_backend_drain_inflight Requests or connections still in flight to drained backends
+# TYPE marchproxy_backend_drain_inflight gauge
+marchproxy_backend_drain_inflight{backend="pg-1:5432",module="dblb",source="admin"} 1
+`
+	if err := testutil.CollectAndCompare(s.Collector(nil), strings.NewReader(want), "marchproxy_backend_drain_inflight"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManagerFetcher(t *testing.T) {
+	manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req drainsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/api/proxy/drains" || req.ClusterAPIKey != "key" {
+			http.Error(w, `{"success": false, "error": "Invalid cluster API key"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"success": true, "drained_backends": [{"host": "10.0.0.5", "port": 8080}]}`))
+	}))
+	defer manager.Close()
+
+	backends, err := ManagerFetcher(manager.URL+"/", "key", "proxy-1")(context.Background())
+	if err != nil || len(backends) != 1 || backends[0] != (Backend{Host: "10.0.0.5", Port: 8080}) {
+		t.Errorf("Fetched %+v, %v", backends, err)
+	}
+	if _, err := ManagerFetcher(manager.URL, "wrong", "proxy-1")(context.Background()); err == nil {
+		t.Error("Rejected request returned no error")
+	}
+}
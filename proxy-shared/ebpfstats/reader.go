@@ -0,0 +1,327 @@
+// Package ebpfstats reads the counters that MarchProxy eBPF programs keep in
+// maps. Counters live in per-CPU maps so the programs never contend on an
+// atomic; the reader sums every CPU's copy and breaks the totals down per
+// mapping and per service.
+package ebpfstats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the statistics maps shared by the MarchProxy eBPF programs
+const (
+	GlobalMapName    = "statistics"       // PERCPU_ARRAY, key 0: struct ebpf_stats
+	ServiceMapName   = "service_stats"    // PERCPU_HASH, service ID: struct scope_stats
+	MappingMapName   = "mapping_stats"    // PERCPU_HASH, mapping ID: struct scope_stats
+	FlowCacheMapName = "flow_cache_stats" // PERCPU_ARRAY, key 0: struct flow_cache_stats
+)
+
+// Field counts of the map values, which are sequences of __u64 counters
+const (
+	globalFields    = 8
+	scopeFields     = 5
+	flowCacheFields = 2
+
+	// Programs that count bytes by direction append two counters to
+	// struct scope_stats
+	directionalScopeFields = 7
+)
+
+// DefaultMaxAge is how long a snapshot is reused before the maps are read
+// again, so /metrics scrapes and heartbeats landing together walk the maps
+// once
+const DefaultMaxAge = time.Second
+
+// Map is an eBPF map with __u32 keys. Lookups on per-CPU maps fill value with
+// one copy per possible CPU, each padded to 8 bytes.
+type Map interface {
+	// Lookup copies the value of key into value, reporting whether the key
+	// exists
+	Lookup(key uint32, value []byte) (bool, error)
+	// NextKey returns the key after key, or the first key when key is nil,
+	// reporting false past the last key
+	NextKey(key *uint32) (uint32, bool, error)
+	// ValueSize is the size of one CPU's value
+	ValueSize() int
+	// PerCPU reports whether the map keeps a value per CPU
+	PerCPU() bool
+}
+
+// Global are the program-wide counters. The field order is that of
+// struct ebpf_stats.
+type Global struct {
+	TotalPackets     uint64 `json:"total_packets"`
+	TCPPackets       uint64 `json:"tcp_packets"`
+	UDPPackets       uint64 `json:"udp_packets"`
+	DroppedPackets   uint64 `json:"dropped_packets"`
+	AllowedPackets   uint64 `json:"allowed_packets"`
+	UserspacePackets uint64 `json:"userspace_packets"`
+	TotalBytes       uint64 `json:"total_bytes"`
+	ICMPPackets      uint64 `json:"icmp_packets"`
+}
+
+// Counters are the counters of one mapping or service. The field order is
+// that of struct scope_stats.
+type Counters struct {
+	Packets   uint64 `json:"packets"`
+	Bytes     uint64 `json:"bytes"`
+	Allowed   uint64 `json:"allowed"`
+	Dropped   uint64 `json:"dropped"`
+	Userspace uint64 `json:"userspace"`
+
+	// Bytes forwarded in the program by direction, zero for programs that
+	// don't count them: allowed bytes to the destination, and the bytes of
+	// its replies
+	BytesOut uint64 `json:"bytes_out"`
+	BytesIn  uint64 `json:"bytes_in"`
+}
+
+// FlowCache are the counters of the flow cache, which holds the policy
+// decision of each flow so the rules are scanned once per flow. The field
+// order is that of struct flow_cache_stats.
+type FlowCache struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// HitRatio returns the share of lookups answered from the cache, 0 before
+// any lookup
+func (f FlowCache) HitRatio() float64 {
+	total := f.Hits + f.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(f.Hits) / float64(total)
+}
+
+// Snapshot is one read of every statistics map, summed across CPUs
+type Snapshot struct {
+	Taken     time.Time           `json:"taken"`
+	CPUs      int                 `json:"cpus"`
+	Global    Global              `json:"global"`
+	Services  map[uint32]Counters `json:"services"`
+	Mappings  map[uint32]Counters `json:"mappings"`
+	FlowCache FlowCache           `json:"flow_cache"`
+}
+
+// Reader reads snapshots of a program's statistics maps
+type Reader struct {
+	global   Map
+	services Map
+	mappings Map
+	flows    Map
+	cpus     int
+	maxAge   time.Duration
+
+	mu   sync.Mutex
+	last *Snapshot
+}
+
+// NewReader creates a reader of the global map and, when the program has
+// them, the per-service and per-mapping maps, which may be nil
+func NewReader(global, services, mappings Map) (*Reader, error) {
+	if global == nil {
+		return nil, fmt.Errorf("no %s map", GlobalMapName)
+	}
+	return &Reader{
+		global:   global,
+		services: services,
+		mappings: mappings,
+		cpus:     PossibleCPUs(),
+		maxAge:   DefaultMaxAge,
+	}, nil
+}
+
+// SetFlowCacheMap sets the flow cache counters map, for programs that cache
+// flow decisions
+func (r *Reader) SetFlowCacheMap(flows Map) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flows = flows
+	r.last = nil
+}
+
+// SetMaxAge sets how long a snapshot is reused; 0 reads the maps every time
+func (r *Reader) SetMaxAge(maxAge time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxAge = maxAge
+}
+
+// Snapshot returns the current counters. The snapshot is shared: callers
+// must not modify it.
+func (r *Reader) Snapshot() (*Snapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last != nil && time.Since(r.last.Taken) < r.maxAge {
+		return r.last, nil
+	}
+
+	snapshot := &Snapshot{
+		Taken:    time.Now(),
+		CPUs:     r.cpus,
+		Services: map[uint32]Counters{},
+		Mappings: map[uint32]Counters{},
+	}
+
+	values, found, err := r.read(r.global, 0, globalFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", GlobalMapName, err)
+	}
+	if found {
+		snapshot.Global = Global{
+			TotalPackets:     values[0],
+			TCPPackets:       values[1],
+			UDPPackets:       values[2],
+			DroppedPackets:   values[3],
+			AllowedPackets:   values[4],
+			UserspacePackets: values[5],
+			TotalBytes:       values[6],
+			ICMPPackets:      values[7],
+		}
+	}
+
+	if r.flows != nil {
+		values, found, err := r.read(r.flows, 0, flowCacheFields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", FlowCacheMapName, err)
+		}
+		if found {
+			snapshot.FlowCache = FlowCache{Hits: values[0], Misses: values[1]}
+		}
+	}
+
+	if snapshot.Services, err = r.readScopes(r.services); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ServiceMapName, err)
+	}
+	if snapshot.Mappings, err = r.readScopes(r.mappings); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", MappingMapName, err)
+	}
+
+	r.last = snapshot
+	return snapshot, nil
+}
+
+// readScopes reads every entry of a per-service or per-mapping map
+func (r *Reader) readScopes(m Map) (map[uint32]Counters, error) {
+	scopes := map[uint32]Counters{}
+	if m == nil {
+		return scopes, nil
+	}
+	fields := scopeFields
+	if m.ValueSize() >= directionalScopeFields*8 {
+		fields = directionalScopeFields
+	}
+
+	var key *uint32
+	for {
+		next, ok, err := m.NextKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return scopes, nil
+		}
+		key = &next
+
+		values, found, err := r.read(m, next, fields)
+		if err != nil {
+			return nil, err
+		}
+		// Entries deleted between NextKey and Lookup are skipped
+		if !found {
+			continue
+		}
+		counters := Counters{
+			Packets:   values[0],
+			Bytes:     values[1],
+			Allowed:   values[2],
+			Dropped:   values[3],
+			Userspace: values[4],
+		}
+		if fields == directionalScopeFields {
+			counters.BytesOut, counters.BytesIn = values[5], values[6]
+		}
+		scopes[next] = counters
+	}
+}
+
+// read looks up key and sums its counters across CPUs
+func (r *Reader) read(m Map, key uint32, fields int) ([]uint64, bool, error) {
+	cpus := 1
+	if m.PerCPU() {
+		cpus = r.cpus
+	}
+	stride := roundUp8(m.ValueSize())
+	value := make([]byte, stride*cpus)
+
+	found, err := m.Lookup(key, value)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	values, err := Aggregate(value, m.ValueSize(), cpus, fields)
+	return values, err == nil, err
+}
+
+// Aggregate sums the first fields __u64 counters of each CPU's copy of a
+// value. Per-CPU values of valueSize bytes are laid out back to back, each
+// padded to 8 bytes, as the kernel returns them from lookups.
+func Aggregate(raw []byte, valueSize, cpus, fields int) ([]uint64, error) {
+	if fields*8 > valueSize {
+		return nil, fmt.Errorf("value of %d bytes holds fewer than %d counters", valueSize, fields)
+	}
+	stride := roundUp8(valueSize)
+	if len(raw) < stride*cpus {
+		return nil, fmt.Errorf("value of %d bytes is short of %d CPUs of %d bytes", len(raw), cpus, stride)
+	}
+
+	sums := make([]uint64, fields)
+	for cpu := 0; cpu < cpus; cpu++ {
+		value := raw[cpu*stride:]
+		for field := range sums {
+			sums[field] += binary.NativeEndian.Uint64(value[field*8:])
+		}
+	}
+	return sums, nil
+}
+
+// PossibleCPUs returns the number of possible CPUs, the number of copies in
+// a per-CPU map value, which can exceed the CPUs online
+func PossibleCPUs() int {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err == nil {
+		if cpus, err := ParseCPUList(strings.TrimSpace(string(data))); err == nil {
+			return cpus
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// ParseCPUList returns the number of CPUs that a kernel CPU list such as
+// "0-3,8-11" spans, counting from CPU 0 to the highest listed
+func ParseCPUList(list string) (int, error) {
+	highest := -1
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		last, err := strconv.Atoi(bounds[len(bounds)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU list %q", list)
+		}
+		if last > highest {
+			highest = last
+		}
+	}
+	return highest + 1, nil
+}
+
+func roundUp8(n int) int {
+	return (n + 7) &^ 7
+}
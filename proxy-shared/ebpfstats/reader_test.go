@@ -0,0 +1,190 @@
+package ebpfstats
+
+import (
+	"encoding/binary"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeMap is an in-memory Map holding each key's per-CPU values
+type fakeMap struct {
+	valueSize int
+	perCPU    bool
+	values    map[uint32][][]uint64 // key -> CPU -> counters
+}
+
+func (f *fakeMap) Lookup(key uint32, value []byte) (bool, error) {
+	cpus, ok := f.values[key]
+	if !ok {
+		return false, nil
+	}
+	stride := roundUp8(f.valueSize)
+	for cpu, counters := range cpus {
+		for i, counter := range counters {
+			binary.NativeEndian.PutUint64(value[cpu*stride+i*8:], counter)
+		}
+	}
+	return true, nil
+}
+
+func (f *fakeMap) NextKey(key *uint32) (uint32, bool, error) {
+	keys := make([]uint32, 0, len(f.values))
+	for k := range f.values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		if key == nil || k > *key {
+			return k, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (f *fakeMap) ValueSize() int { return f.valueSize }
+func (f *fakeMap) PerCPU() bool   { return f.perCPU }
+
+func perCPU(cpus int, counters ...uint64) [][]uint64 {
+	values := make([][]uint64, cpus)
+	for cpu := range values {
+		values[cpu] = counters
+	}
+	return values
+}
+
+func TestSnapshotSumsCPUs(t *testing.T) {
+	reader, err := NewReader(
+		&fakeMap{valueSize: 64, perCPU: true, values: map[uint32][][]uint64{0: {}}},
+		&fakeMap{valueSize: 40, perCPU: true, values: map[uint32][][]uint64{}},
+		&fakeMap{valueSize: 40, perCPU: true, values: map[uint32][][]uint64{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.cpus = 4
+	reader.global.(*fakeMap).values[0] = perCPU(4, 10, 6, 3, 1, 5, 4, 1500, 1)
+	reader.services.(*fakeMap).values[7] = perCPU(4, 2, 200, 2, 0, 0)
+	reader.mappings.(*fakeMap).values[3] = [][]uint64{{1, 60, 0, 1, 0}, {0, 0, 0, 0, 0}, {2, 120, 2, 0, 0}, {0, 0, 0, 0, 0}}
+
+	snapshot, err := reader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Global{TotalPackets: 40, TCPPackets: 24, UDPPackets: 12, DroppedPackets: 4,
+		AllowedPackets: 20, UserspacePackets: 16, TotalBytes: 6000, ICMPPackets: 4}
+	if snapshot.Global != want {
+		t.Errorf("Global = %+v, want %+v", snapshot.Global, want)
+	}
+	if got := snapshot.Services[7]; got != (Counters{Packets: 8, Bytes: 800, Allowed: 8}) {
+		t.Errorf("Service 7 = %+v", got)
+	}
+	if got := snapshot.Mappings[3]; got != (Counters{Packets: 3, Bytes: 180, Allowed: 2, Dropped: 1}) {
+		t.Errorf("Mapping 3 = %+v", got)
+	}
+}
+
+func TestSnapshotDirectionalBytes(t *testing.T) {
+	mappings := &fakeMap{valueSize: 56, perCPU: true, values: map[uint32][][]uint64{
+		3: perCPU(2, 4, 400, 4, 0, 0, 400, 9000),
+	}}
+	reader, err := NewReader(&fakeMap{valueSize: 64, perCPU: true, values: map[uint32][][]uint64{}}, nil, mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.cpus = 2
+
+	snapshot, err := reader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Counters{Packets: 8, Bytes: 800, Allowed: 8, BytesOut: 800, BytesIn: 18000}
+	if got := snapshot.Mappings[3]; got != want {
+		t.Errorf("Mapping 3 = %+v, want %+v", got, want)
+	}
+}
+
+func TestSnapshotReuse(t *testing.T) {
+	global := &fakeMap{valueSize: 64, perCPU: true, values: map[uint32][][]uint64{0: perCPU(2, 1, 0, 0, 0, 0, 0, 0, 0)}}
+	reader, err := NewReader(global, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.cpus = 2
+
+	first, err := reader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.values[0] = perCPU(2, 5, 0, 0, 0, 0, 0, 0, 0)
+	if second, _ := reader.Snapshot(); second != first {
+		t.Error("Expected the snapshot to be reused within its max age")
+	}
+
+	reader.SetMaxAge(0)
+	time.Sleep(time.Millisecond)
+	third, err := reader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Global.TotalPackets != 10 {
+		t.Errorf("TotalPackets = %d, want 10", third.Global.TotalPackets)
+	}
+	if len(third.Services) != 0 || len(third.Mappings) != 0 {
+		t.Error("Expected empty breakdowns without breakdown maps")
+	}
+}
+
+func TestSnapshotFlowCache(t *testing.T) {
+	global := &fakeMap{valueSize: 64, perCPU: true, values: map[uint32][][]uint64{0: perCPU(2, 0, 0, 0, 0, 0, 0, 0, 0)}}
+	reader, err := NewReader(global, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.cpus = 2
+	reader.SetFlowCacheMap(&fakeMap{valueSize: 16, perCPU: true, values: map[uint32][][]uint64{0: perCPU(2, 9, 1)}})
+
+	snapshot, err := reader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.FlowCache != (FlowCache{Hits: 18, Misses: 2}) {
+		t.Errorf("FlowCache = %+v", snapshot.FlowCache)
+	}
+	if ratio := snapshot.FlowCache.HitRatio(); ratio != 0.9 {
+		t.Errorf("HitRatio = %v, want 0.9", ratio)
+	}
+	if ratio := (FlowCache{}).HitRatio(); ratio != 0 {
+		t.Errorf("Empty HitRatio = %v, want 0", ratio)
+	}
+}
+
+func TestAggregatePadding(t *testing.T) {
+	// A 12-byte value is padded to 16 bytes per CPU
+	raw := make([]byte, 32)
+	binary.NativeEndian.PutUint64(raw[0:], 3)
+	binary.NativeEndian.PutUint64(raw[16:], 4)
+	sums, err := Aggregate(raw, 12, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums[0] != 7 {
+		t.Errorf("Sum = %d, want 7", sums[0])
+	}
+
+	if _, err := Aggregate(raw, 12, 3, 1); err == nil {
+		t.Error("Expected an error for a value short of its CPUs")
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for list, want := range map[string]int{"0": 1, "0-7": 8, "0-3,8-11": 12, "0,2": 3} {
+		got, err := ParseCPUList(list)
+		if err != nil || got != want {
+			t.Errorf("ParseCPUList(%q) = %d, %v, want %d", list, got, err, want)
+		}
+	}
+	if _, err := ParseCPUList("a-b"); err == nil {
+		t.Error("Expected an error for an invalid list")
+	}
+}
@@ -0,0 +1,252 @@
+// Package fault injects latency, aborts and bandwidth limits into proxied
+// traffic, so resilience testing can be done through the proxy layer.
+//
+// Faults come from the manager, on a mapping or route, or from admin API
+// overrides, which replace the configured faults of a target until they
+// expire or are cleared. Nothing is injected unless fault injection is
+// enabled on the proxy instance.
+package fault
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errnos that aborted connections can simulate
+var Errnos = []string{"ECONNRESET", "ECONNREFUSED", "ETIMEDOUT"}
+
+// Spec describes the faults injected into one route or mapping
+type Spec struct {
+	DelayMs       int     `json:"delay_ms,omitempty"`
+	DelayPercent  float64 `json:"delay_percent,omitempty"`  // 0-100, 0 = every request when delay_ms is set
+	AbortPercent  float64 `json:"abort_percent,omitempty"`  // 0-100
+	AbortStatus   int     `json:"abort_status,omitempty"`   // HTTP status for aborted requests, default 503
+	AbortErrno    string  `json:"abort_errno,omitempty"`    // Error simulated on aborted connections, default ECONNRESET
+	BandwidthKbps int     `json:"bandwidth_kbps,omitempty"` // 0 = unlimited
+}
+
+// Validate checks the spec's ranges
+func (s *Spec) Validate() error {
+	if s.DelayMs < 0 {
+		return fmt.Errorf("delay_ms cannot be negative")
+	}
+	if s.DelayPercent < 0 || s.DelayPercent > 100 || s.AbortPercent < 0 || s.AbortPercent > 100 {
+		return fmt.Errorf("delay_percent and abort_percent must be between 0 and 100")
+	}
+	if s.AbortStatus != 0 && (s.AbortStatus < 400 || s.AbortStatus > 599) {
+		return fmt.Errorf("abort_status must be between 400 and 599")
+	}
+	if s.AbortErrno != "" && !validErrno(s.AbortErrno) {
+		return fmt.Errorf("abort_errno must be one of %v", Errnos)
+	}
+	if s.BandwidthKbps < 0 {
+		return fmt.Errorf("bandwidth_kbps cannot be negative")
+	}
+	return nil
+}
+
+func validErrno(errno string) bool {
+	for _, e := range Errnos {
+		if e == errno {
+			return true
+		}
+	}
+	return false
+}
+
+// Decision is the faults to apply to one request or connection
+type Decision struct {
+	Delay         time.Duration
+	Abort         bool
+	AbortStatus   int
+	AbortErrno    string
+	BandwidthKbps int
+}
+
+// Override is an admin API fault spec for a target
+type Override struct {
+	Target    string    `json:"target"`
+	Spec      Spec      `json:"spec"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Injector decides which faults apply to each request and counts them
+type Injector struct {
+	enabled bool
+
+	mu        sync.Mutex
+	overrides map[string]Override
+	counts    map[string]map[string]int64 // target -> fault -> injected
+	rand      func() float64
+}
+
+// NewInjector creates an injector. A disabled injector never injects
+// faults and refuses overrides.
+func NewInjector(enabled bool) *Injector {
+	return &Injector{
+		enabled:   enabled,
+		overrides: make(map[string]Override),
+		counts:    make(map[string]map[string]int64),
+		rand:      rand.Float64,
+	}
+}
+
+// Enabled reports whether faults are injected at all
+func (i *Injector) Enabled() bool {
+	return i != nil && i.enabled
+}
+
+// Set overrides the faults of a target for ttl
+func (i *Injector) Set(target string, spec Spec, ttl time.Duration) error {
+	if !i.Enabled() {
+		return fmt.Errorf("fault injection is disabled")
+	}
+	if target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.overrides[target] = Override{Target: target, Spec: spec, ExpiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+// Clear removes the override of a target, reporting whether there was one
+func (i *Injector) Clear(target string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, ok := i.overrides[target]
+	delete(i.overrides, target)
+	return ok
+}
+
+// ClearAll removes every override
+func (i *Injector) ClearAll() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.overrides = make(map[string]Override)
+}
+
+// Overrides returns the unexpired overrides sorted by target
+func (i *Injector) Overrides() []Override {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	list := make([]Override, 0, len(i.overrides))
+	for target, o := range i.overrides {
+		if now.After(o.ExpiresAt) {
+			delete(i.overrides, target)
+			continue
+		}
+		list = append(list, o)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Target < list[b].Target })
+	return list
+}
+
+// Decide picks the faults for one request to target. An unexpired override
+// replaces the configured spec, which may be nil.
+func (i *Injector) Decide(target string, configured *Spec) Decision {
+	var d Decision
+	if !i.Enabled() {
+		return d
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	spec := configured
+	if o, ok := i.overrides[target]; ok {
+		if time.Now().After(o.ExpiresAt) {
+			delete(i.overrides, target)
+		} else {
+			spec = &o.Spec
+		}
+	}
+	if spec == nil {
+		return d
+	}
+
+	if spec.AbortPercent > 0 && i.rand()*100 < spec.AbortPercent {
+		d.Abort = true
+		d.AbortStatus = spec.AbortStatus
+		if d.AbortStatus == 0 {
+			d.AbortStatus = 503
+		}
+		d.AbortErrno = spec.AbortErrno
+		if d.AbortErrno == "" {
+			d.AbortErrno = "ECONNRESET"
+		}
+		i.count(target, "abort")
+		return d
+	}
+	if spec.DelayMs > 0 && (spec.DelayPercent == 0 || i.rand()*100 < spec.DelayPercent) {
+		d.Delay = time.Duration(spec.DelayMs) * time.Millisecond
+		i.count(target, "delay")
+	}
+	if spec.BandwidthKbps > 0 {
+		d.BandwidthKbps = spec.BandwidthKbps
+		i.count(target, "bandwidth")
+	}
+	return d
+}
+
+// count records an injected fault. The caller holds i.mu.
+func (i *Injector) count(target, fault string) {
+	faults, ok := i.counts[target]
+	if !ok {
+		faults = make(map[string]int64)
+		i.counts[target] = faults
+	}
+	faults[fault]++
+}
+
+// Counts returns injected faults by target and fault type
+func (i *Injector) Counts() map[string]map[string]int64 {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	counts := make(map[string]map[string]int64, len(i.counts))
+	for target, faults := range i.counts {
+		copied := make(map[string]int64, len(faults))
+		for fault, n := range faults {
+			copied[fault] = n
+		}
+		counts[target] = copied
+	}
+	return counts
+}
+
+// WritePrometheus writes injected fault counts in Prometheus text format
+func (i *Injector) WritePrometheus(w io.Writer) {
+	if !i.Enabled() {
+		return
+	}
+	counts := i.Counts()
+	targets := make([]string, 0, len(counts))
+	for target := range counts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	fmt.Fprintf(w, "# HELP marchproxy_faults_injected_total Faults injected per mapping and fault type\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_faults_injected_total counter\n")
+	for _, target := range targets {
+		for _, fault := range []string{"abort", "bandwidth", "delay"} {
+			if n, ok := counts[target][fault]; ok {
+				fmt.Fprintf(w, "marchproxy_faults_injected_total{mapping=%q,fault=%q} %d\n", target, fault, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package fault
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSpecValidate(t *testing.T) {
+	valid := []Spec{
+		{},
+		{DelayMs: 100, DelayPercent: 50},
+		{AbortPercent: 100, AbortStatus: 502, AbortErrno: "ETIMEDOUT"},
+		{BandwidthKbps: 64},
+	}
+	for _, spec := range valid {
+		if err := spec.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid: %v", spec, err)
+		}
+	}
+
+	invalid := []Spec{
+		{DelayMs: -1},
+		{DelayPercent: 101},
+		{AbortPercent: -5},
+		{AbortStatus: 200},
+		{AbortErrno: "EPERM"},
+		{BandwidthKbps: -1},
+	}
+	for _, spec := range invalid {
+		if err := spec.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", spec)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	i := NewInjector(true)
+	roll := 0.0
+	i.rand = func() float64 { return roll }
+
+	configured := &Spec{DelayMs: 200, DelayPercent: 50, AbortPercent: 10, BandwidthKbps: 128}
+
+	// A roll of 5% aborts with the defaults
+	roll = 0.05
+	d := i.Decide("api", configured)
+	if !d.Abort || d.AbortStatus != 503 || d.AbortErrno != "ECONNRESET" || d.Delay != 0 {
+		t.Errorf("Expected an abort, got %+v", d)
+	}
+
+	// A roll of 30% is delayed and throttled but not aborted
+	roll = 0.3
+	d = i.Decide("api", configured)
+	if d.Abort || d.Delay != 200*time.Millisecond || d.BandwidthKbps != 128 {
+		t.Errorf("Expected a delay and throttle, got %+v", d)
+	}
+
+	// A roll of 70% is only throttled
+	roll = 0.7
+	if d = i.Decide("api", configured); d.Delay != 0 || d.BandwidthKbps != 128 {
+		t.Errorf("Expected only a throttle, got %+v", d)
+	}
+
+	if d = i.Decide("other", nil); d != (Decision{}) {
+		t.Errorf("Expected no faults without a spec, got %+v", d)
+	}
+
+	counts := i.Counts()["api"]
+	if counts["abort"] != 1 || counts["delay"] != 1 || counts["bandwidth"] != 2 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	i := NewInjector(true)
+	i.rand = func() float64 { return 0.5 }
+
+	if err := i.Set("api", Spec{AbortPercent: 100, AbortStatus: 500}, time.Minute); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := i.Set("api", Spec{AbortStatus: 200}, time.Minute); err == nil {
+		t.Error("Expected an invalid override to be refused")
+	}
+
+	// The override replaces the configured delay
+	d := i.Decide("api", &Spec{DelayMs: 100})
+	if !d.Abort || d.AbortStatus != 500 || d.Delay != 0 {
+		t.Errorf("Expected the override to apply, got %+v", d)
+	}
+	if len(i.Overrides()) != 1 {
+		t.Errorf("Expected one override, got %v", i.Overrides())
+	}
+
+	if !i.Clear("api") || i.Clear("api") {
+		t.Error("Expected Clear to remove the override once")
+	}
+	if d = i.Decide("api", &Spec{DelayMs: 100}); d.Delay != 100*time.Millisecond {
+		t.Errorf("Expected the configured spec after clearing, got %+v", d)
+	}
+
+	// Expired overrides no longer apply
+	i.Set("api", Spec{AbortPercent: 100}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if d = i.Decide("api", nil); d.Abort {
+		t.Error("Expected an expired override to be ignored")
+	}
+	if len(i.Overrides()) != 0 {
+		t.Error("Expected expired overrides to be dropped")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	i := NewInjector(false)
+	if d := i.Decide("api", &Spec{AbortPercent: 100}); d.Abort {
+		t.Error("Expected a disabled injector to inject nothing")
+	}
+	if err := i.Set("api", Spec{}, time.Minute); err == nil {
+		t.Error("Expected a disabled injector to refuse overrides")
+	}
+
+	var nilInjector *Injector
+	if d := nilInjector.Decide("api", &Spec{AbortPercent: 100}); d.Abort {
+		t.Error("Expected a nil injector to inject nothing")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	// 80 kbps is 10000 bytes per second, so 3000 bytes take about 0.3s
+	var out bytes.Buffer
+	start := time.Now()
+	n, err := Writer(&out, 80).Write(make([]byte, 3000))
+	elapsed := time.Since(start)
+	if err != nil || n != 3000 || out.Len() != 3000 {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Throttled write took %v, expected about 300ms", elapsed)
+	}
+
+	start = time.Now()
+	data, err := io.ReadAll(Reader(bytes.NewReader(make([]byte, 2000)), 80))
+	elapsed = time.Since(start)
+	if err != nil || len(data) != 2000 {
+		t.Fatalf("ReadAll returned %d bytes, %v", len(data), err)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Throttled read took %v, expected about 200ms", elapsed)
+	}
+
+	var plain bytes.Buffer
+	if Writer(&plain, 0) != &plain {
+		t.Error("Expected an unlimited writer to be returned unchanged")
+	}
+}
@@ -0,0 +1,86 @@
+package fault
+
+import (
+	"io"
+	"time"
+)
+
+// pacer spreads bytes over time at a fixed rate
+type pacer struct {
+	bytesPerSec float64
+	start       time.Time
+	sent        int64
+}
+
+func newPacer(kbps int) *pacer {
+	return &pacer{bytesPerSec: float64(kbps) * 1000 / 8}
+}
+
+// chunk is the most bytes moved before pacing, a tenth of a second's worth
+func (p *pacer) chunk() int {
+	return max(int(p.bytesPerSec/10), 1)
+}
+
+// wait sleeps until n more bytes are within the rate
+func (p *pacer) wait(n int) {
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	p.sent += int64(n)
+	due := p.start.Add(time.Duration(float64(p.sent) / p.bytesPerSec * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledWriter struct {
+	w io.Writer
+	p *pacer
+}
+
+// Writer limits writes to w to kbps kilobits per second. It returns w
+// unchanged when kbps is not positive.
+func Writer(w io.Writer, kbps int) io.Writer {
+	if kbps <= 0 {
+		return w
+	}
+	return &throttledWriter{w: w, p: newPacer(kbps)}
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), t.p.chunk())
+		t.p.wait(n)
+		m, err := t.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+type throttledReader struct {
+	r io.Reader
+	p *pacer
+}
+
+// Reader limits reads from r to kbps kilobits per second. It returns r
+// unchanged when kbps is not positive.
+func Reader(r io.Reader, kbps int) io.Reader {
+	if kbps <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, p: newPacer(kbps)}
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > t.p.chunk() {
+		b = b[:t.p.chunk()]
+	}
+	n, err := t.r.Read(b)
+	t.p.wait(n)
+	return n, err
+}
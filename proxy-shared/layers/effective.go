@@ -0,0 +1,154 @@
+package layers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mask replaces secret values in the effective configuration
+const mask = "********"
+
+// secretNames are the key names, or the ends of key names after an
+// underscore, whose values are masked
+var secretNames = []string{"api_key", "community", "license_key", "password", "passphrase", "private_key", "secret", "token"}
+
+// PrintEffective writes cfg, a pointer to a loaded config struct, to w as
+// yaml or json under the keys it is read from. Secrets are masked, as are
+// passwords in URLs; empty secrets are left empty so it is clear they are
+// unset.
+func PrintEffective(w io.Writer, cfg interface{}, format string) error {
+	values := effective(reflect.ValueOf(cfg))
+	switch format {
+	case "", "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(values); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(values)
+	}
+	return fmt.Errorf("unknown output format %q, want yaml or json", format)
+}
+
+// effective converts v to maps, lists and plain values keyed like the
+// config file
+func effective(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	// Durations, addresses and times print as they are written
+	if stringer, ok := v.Interface().(fmt.Stringer); ok && (v.Kind() != reflect.Struct || v.Type() == reflect.TypeOf(time.Time{})) {
+		return stringer.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		values := make(map[string]interface{})
+		effectiveFields(v, values)
+		return values
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return []interface{}{}
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = effective(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		values := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			values[key] = maskSecret(key, effective(iter.Value()))
+		}
+		return values
+	case reflect.String:
+		return maskURL(v.String())
+	}
+	return v.Interface()
+}
+
+// effectiveFields adds the fields of struct v to values under their keys
+func effectiveFields(v reflect.Value, values map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "squash") {
+			fv := reflect.Indirect(v.Field(i))
+			if fv.Kind() == reflect.Struct {
+				effectiveFields(fv, values)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		values[name] = maskSecret(name, effective(v.Field(i)))
+	}
+}
+
+// maskSecret masks value if key names a secret
+func maskSecret(key string, value interface{}) interface{} {
+	if !isSecret(key) {
+		return value
+	}
+	switch value := value.(type) {
+	case string:
+		if value != "" {
+			return mask
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = maskSecret(key, value[i])
+		}
+	}
+	return value
+}
+
+// isSecret reports whether key names a secret, such as cluster_api_key
+func isSecret(key string) bool {
+	key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	for _, name := range secretNames {
+		if key == name || strings.HasSuffix(key, "_"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskURL masks the password in s if it is a URL with one
+func maskURL(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	return u.Redacted()
+}
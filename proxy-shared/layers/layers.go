@@ -0,0 +1,381 @@
+// Package layers loads a module's settings in layers, lowest precedence
+// first: defaults, the config file, environment variables and command-line
+// flags. Every setting can be given in the environment as PREFIX_KEY, with
+// the dots of nested keys replaced by underscores, and on the command line
+// as --set key=value. Keys in the config file or --set that no setting
+// reads are errors, so a typo does not silently leave the default in place.
+package layers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Problem is a setting that could not be loaded
+type Problem struct {
+	Key    string // Such as bgp.hold_time or static_modules[0].name
+	Source string // Where the value came from
+	Reason string
+}
+
+func (p Problem) String() string {
+	if p.Source == "" {
+		return fmt.Sprintf("%s: %s", p.Key, p.Reason)
+	}
+	return fmt.Sprintf("%s: %s (from %s)", p.Key, p.Reason, p.Source)
+}
+
+// Problems are every problem found loading the configuration
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+	if len(lines) == 1 {
+		return lines[0]
+	}
+	return fmt.Sprintf("%d problems:\n  %s", len(lines), strings.Join(lines, "\n  "))
+}
+
+// AddFlags adds the --set and --validate-config flags
+func AddFlags(flags *pflag.FlagSet) {
+	flags.StringArray("set", nil, "set a config key, overriding the file and environment (key=value, repeatable)")
+	flags.Bool("validate-config", false, "check the configuration and exit, non-zero if it has problems")
+}
+
+// Layers loads settings from defaults, a config file, the environment and
+// flags
+type Layers struct {
+	v      *viper.Viper
+	prefix string
+	flags  map[string]*pflag.Flag // Flags bound to keys
+	set    map[string]bool        // Keys given with --set
+}
+
+// New returns layers reading the environment variables under envPrefix
+func New(envPrefix string) *Layers {
+	v := viper.New()
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	v.AutomaticEnv()
+	return &Layers{
+		v:      v,
+		prefix: envPrefix,
+		flags:  make(map[string]*pflag.Flag),
+		set:    make(map[string]bool),
+	}
+}
+
+// Viper returns the settings, for setting defaults
+func (l *Layers) Viper() *viper.Viper {
+	return l.v
+}
+
+// ReadFile reads the config file at path, if any
+func (l *Layers) ReadFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	l.v.SetConfigFile(path)
+	return l.v.ReadInConfig()
+}
+
+// BindFlag sets key from flag when flag is given on the command line
+func (l *Layers) BindFlag(key string, flag *pflag.Flag) error {
+	if flag == nil {
+		return nil
+	}
+	l.flags[key] = flag
+	return l.v.BindPFlag(key, flag)
+}
+
+// ApplySet applies the --set flags, if flags has them
+func (l *Layers) ApplySet(flags *pflag.FlagSet) error {
+	if flags == nil || flags.Lookup("set") == nil {
+		return nil
+	}
+	values, err := flags.GetStringArray("set")
+	if err != nil {
+		return err
+	}
+	for _, arg := range values {
+		key, value, ok := strings.Cut(arg, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			return fmt.Errorf("--set %q: want key=value", arg)
+		}
+		l.v.Set(key, value)
+		l.set[key] = true
+	}
+	return nil
+}
+
+// Decode reads every layer into cfg, a pointer to a struct. Unknown keys
+// and values of the wrong type are returned together as Problems.
+func (l *Layers) Decode(cfg interface{}) error {
+	settings := make(map[string]setting)
+	collectSettings(reflect.TypeOf(cfg).Elem(), "", false, settings)
+	for key, s := range settings {
+		if s.env {
+			l.v.BindEnv(key)
+		}
+	}
+
+	var problems Problems
+	if err := l.v.Unmarshal(cfg); err != nil {
+		var decodeErr *mapstructure.Error
+		if !errors.As(err, &decodeErr) {
+			return err
+		}
+		for _, msg := range decodeErr.Errors {
+			problems = append(problems, l.typeProblem(msg, settings))
+		}
+	}
+	for _, key := range unknownKeys(l.v.AllSettings(), "", settings) {
+		reason := "unknown setting"
+		if match := suggest(key, settings); match != "" {
+			reason += fmt.Sprintf(", did you mean %q?", match)
+		}
+		problems = append(problems, Problem{Key: key, Source: l.source(key), Reason: reason})
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Key < problems[j].Key })
+	return problems
+}
+
+// quotedKey finds the key in a mapstructure error, such as
+// "cannot parse 'grpc_port' as int"
+var quotedKey = regexp.MustCompile(`'([^']*)'`)
+
+// listIndex matches list indexes in keys, such as [0] in routes[0].name
+var listIndex = regexp.MustCompile(`\[\d+\]`)
+
+// typeProblem describes a value that could not be decoded into its setting
+func (l *Layers) typeProblem(msg string, settings map[string]setting) Problem {
+	match := quotedKey.FindStringSubmatch(msg)
+	if match == nil || match[1] == "" {
+		return Problem{Key: "(top level)", Source: l.v.ConfigFileUsed(), Reason: msg}
+	}
+	key := match[1]
+	problem := Problem{Key: key, Source: l.source(key), Reason: msg}
+	s, ok := settings[listIndex.ReplaceAllString(key, "")]
+	if !ok {
+		return problem
+	}
+	typ := s.typ
+	if strings.HasSuffix(key, "]") {
+		typ = elem(typ)
+	}
+	if value := l.v.Get(key); value != nil && !strings.Contains(key, "[") {
+		problem.Reason = fmt.Sprintf("want %s, got %q", describeType(typ), fmt.Sprint(value))
+	} else {
+		problem.Reason = fmt.Sprintf("want %s", describeType(typ))
+	}
+	return problem
+}
+
+// source names where the value of key came from, in order of precedence
+func (l *Layers) source(key string) string {
+	key = strings.SplitN(key, "[", 2)[0]
+	for set := range l.set {
+		if set == key || strings.HasPrefix(set, key+".") {
+			return "--set"
+		}
+	}
+	if flag, ok := l.flags[key]; ok && flag.Changed {
+		return "--" + flag.Name
+	}
+	if env := l.envName(key); os.Getenv(env) != "" {
+		return env
+	}
+	if l.v.InConfig(key) {
+		return l.v.ConfigFileUsed()
+	}
+	return "defaults"
+}
+
+// envName returns the environment variable that sets key
+func (l *Layers) envName(key string) string {
+	key = strings.NewReplacer(".", "_", "-", "_").Replace(key)
+	if l.prefix == "" {
+		return strings.ToUpper(key)
+	}
+	return strings.ToUpper(l.prefix + "_" + key)
+}
+
+// unknownKeys returns the keys in values, the settings under prefix, that
+// no config struct field reads
+func unknownKeys(values map[string]interface{}, prefix string, settings map[string]setting) []string {
+	var unknown []string
+	for name, value := range values {
+		key := prefix + name
+		s, ok := settings[listIndex.ReplaceAllString(key, "")]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		switch {
+		case s.typ.Kind() == reflect.Struct:
+			if nested, ok := value.(map[string]interface{}); ok {
+				unknown = append(unknown, unknownKeys(nested, key+".", settings)...)
+			}
+		case s.typ.Kind() == reflect.Slice && elem(s.typ).Kind() == reflect.Struct:
+			items, _ := value.([]interface{})
+			for i, item := range items {
+				if nested, ok := item.(map[string]interface{}); ok {
+					unknown = append(unknown, unknownKeys(nested, fmt.Sprintf("%s[%d].", key, i), settings)...)
+				}
+			}
+		}
+	}
+	return unknown
+}
+
+// setting is a key a config struct field is read from
+type setting struct {
+	typ reflect.Type
+	env bool // Can be set from the environment, false within lists
+}
+
+// collectSettings adds the keys of t's fields under prefix. Fields of
+// structs in lists are keyed as list.field.
+func collectSettings(t reflect.Type, prefix string, inList bool, settings map[string]setting) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		typ := field.Type
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if strings.Contains(opts, "squash") {
+			collectSettings(typ, prefix, inList, settings)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		key := prefix + name
+
+		switch {
+		case typ.Kind() == reflect.Struct && typ != reflect.TypeOf(time.Time{}):
+			settings[key] = setting{typ: typ}
+			collectSettings(typ, key+".", inList, settings)
+		case typ.Kind() == reflect.Slice && elem(typ).Kind() == reflect.Struct:
+			settings[key] = setting{typ: typ}
+			collectSettings(elem(typ), key+".", true, settings)
+		default:
+			settings[key] = setting{typ: typ, env: !inList}
+		}
+	}
+}
+
+func elem(t reflect.Type) reflect.Type {
+	t = t.Elem()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// describeType names the values a setting of type t accepts
+func describeType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return "a duration such as 30s or 5m"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf("an integer from 0 to %d", uint64(math.MaxUint64)>>(64-t.Bits()))
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		if elem(t).Kind() == reflect.Struct {
+			return "a list of maps"
+		}
+		return "a list of " + strings.TrimPrefix(describeType(elem(t)), "a ")
+	case reflect.Map, reflect.Struct:
+		return "a map of settings"
+	}
+	return t.String()
+}
+
+// suggest returns the known key closest to an unknown one, or "" when none
+// is close. Only keys beside the unknown one are considered.
+func suggest(key string, settings map[string]setting) string {
+	parent, name := "", key
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		parent, name = key[:i+1], key[i+1:]
+	}
+	listParent := listIndex.ReplaceAllString(parent, "")
+
+	best, bestDistance := "", len(name)/2+1
+	for known := range settings {
+		if !strings.HasPrefix(known, listParent) || strings.Contains(known[len(listParent):], ".") {
+			continue
+		}
+		candidate := known[len(listParent):]
+		if d := editDistance(name, candidate); d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return parent + best
+}
+
+// editDistance counts the characters inserted, deleted, changed or
+// swapped with their neighbour to turn a into b
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
@@ -0,0 +1,243 @@
+package layers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+type testBackend struct {
+	Address string `mapstructure:"address"`
+	Weight  int    `mapstructure:"weight"`
+}
+
+type Common struct {
+	LogLevel string `mapstructure:"log_level"`
+}
+
+type testConfig struct {
+	Common `mapstructure:",squash"`
+
+	Name     string        `mapstructure:"name"`
+	Port     int           `mapstructure:"port"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Debug    bool          `mapstructure:"debug"`
+	Server   testServer    `mapstructure:"server"`
+	Backends []testBackend `mapstructure:"backends"`
+	Tags     []string      `mapstructure:"tags"`
+	internal string
+}
+
+type testServer struct {
+	Addr     string `mapstructure:"addr"`
+	Priority uint8  `mapstructure:"priority"`
+}
+
+// writeFile writes a config file with content
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testFlags returns flags with AddFlags, a --port flag and --set given for
+// each value
+func testFlags(t *testing.T, values ...string) *pflag.FlagSet {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddFlags(flags)
+	flags.Int("port", 0, "port")
+	for _, value := range values {
+		if err := flags.Set("set", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return flags
+}
+
+// load reads path and flags into a testConfig through every layer
+func load(t *testing.T, path string, flags *pflag.FlagSet) (*testConfig, error) {
+	t.Helper()
+	l := New("TEST")
+	v := l.Viper()
+	v.SetDefault("name", "default")
+	v.SetDefault("port", 80)
+	v.SetDefault("timeout", "10s")
+	v.SetDefault("server.addr", ":8080")
+	v.SetDefault("log_level", "info")
+	if err := l.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		if err := l.BindFlag("port", flags.Lookup("port")); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.ApplySet(flags); err != nil {
+		return nil, err
+	}
+	var cfg testConfig
+	if err := l.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "name: file\nport: 81\ntimeout: 20s\nlog_level: debug\nserver:\n  addr: :9000\n  priority: 10\n")
+	t.Setenv("TEST_PORT", "82")
+	t.Setenv("TEST_SERVER_PRIORITY", "20")
+	t.Setenv("TEST_TIMEOUT", "30s")
+	flags := testFlags(t, "timeout=40s")
+	if err := flags.Set("port", "83"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := load(t, path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "file" || cfg.Server.Addr != ":9000" || cfg.LogLevel != "debug" {
+		t.Errorf("name %q, server.addr %q and log_level %q, want the file's", cfg.Name, cfg.Server.Addr, cfg.LogLevel)
+	}
+	if cfg.Server.Priority != 20 {
+		t.Errorf("server.priority %d, want the environment's", cfg.Server.Priority)
+	}
+	if cfg.Port != 83 {
+		t.Errorf("port %d, want the flag's", cfg.Port)
+	}
+	if cfg.Timeout != 40*time.Second {
+		t.Errorf("timeout %s, want --set's", cfg.Timeout)
+	}
+
+	cfg, err = load(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "default" || cfg.Port != 82 || cfg.Timeout != 30*time.Second {
+		t.Errorf("without a file: name %q, port %d and timeout %s", cfg.Name, cfg.Port, cfg.Timeout)
+	}
+}
+
+func TestEnvironmentOnly(t *testing.T) {
+	// Keys without a default can still be set from the environment, but
+	// not the fields of list items
+	t.Setenv("TEST_DEBUG", "true")
+	t.Setenv("TEST_TAGS", "a,b")
+	t.Setenv("TEST_BACKENDS_ADDRESS", "10.0.0.1:80")
+
+	cfg, err := load(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Debug || strings.Join(cfg.Tags, ",") != "a,b" {
+		t.Errorf("debug %t and tags %v, want the environment's", cfg.Debug, cfg.Tags)
+	}
+	if len(cfg.Backends) != 0 {
+		t.Errorf("backends %v, want none", cfg.Backends)
+	}
+}
+
+func TestProblems(t *testing.T) {
+	path := writeFile(t, `
+nmae: typo
+server:
+  adr: :9000
+backends:
+  - address: 10.0.0.1:80
+    wieght: 2
+  - address: 10.0.0.2:80
+    weight: heavy
+debug: maybe
+`)
+	t.Setenv("TEST_SERVER_PRIORITY", "300")
+
+	_, err := load(t, path, testFlags(t, "timeuot=5s", "server.zone=a"))
+	var problems Problems
+	if !errors.As(err, &problems) {
+		t.Fatalf("error %v, want Problems", err)
+	}
+
+	want := []Problem{
+		{Key: "backends[0].wieght", Source: path, Reason: `unknown setting, did you mean "backends[0].weight"?`},
+		{Key: "backends[1].weight", Source: path, Reason: "want an integer"},
+		{Key: "debug", Source: path, Reason: `want true or false, got "maybe"`},
+		{Key: "nmae", Source: path, Reason: `unknown setting, did you mean "name"?`},
+		{Key: "server.adr", Source: path, Reason: `unknown setting, did you mean "server.addr"?`},
+		{Key: "server.priority", Source: "TEST_SERVER_PRIORITY", Reason: `want an integer from 0 to 255, got "300"`},
+		{Key: "server.zone", Source: "--set", Reason: "unknown setting"},
+		{Key: "timeuot", Source: "--set", Reason: `unknown setting, did you mean "timeout"?`},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems:\n%v", problems)
+	}
+	for i := range want {
+		if problems[i] != want[i] {
+			t.Errorf("problem %d: %+v, want %+v", i, problems[i], want[i])
+		}
+	}
+	if !strings.HasPrefix(problems.Error(), "8 problems:\n  backends[0].wieght: ") {
+		t.Errorf("error %q", problems.Error())
+	}
+	if got := problems[:1].Error(); got != want[0].String() {
+		t.Errorf("single problem %q, want %q", got, want[0].String())
+	}
+}
+
+func TestApplySet(t *testing.T) {
+	if _, err := load(t, "", testFlags(t, "name")); err == nil || !strings.Contains(err.Error(), "want key=value") {
+		t.Errorf("--set without a value: %v", err)
+	}
+
+	// Keys are case insensitive and values may contain =
+	cfg, err := load(t, "", testFlags(t, " Name =a=b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "a=b" {
+		t.Errorf("name %q", cfg.Name)
+	}
+
+	// Flags without --set are left alone
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	if err := New("TEST").ApplySet(flags); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := New("TEST").envName("server.addr"); got != "TEST_SERVER_ADDR" {
+		t.Errorf("envName %q", got)
+	}
+	if got := New("").envName("log-level"); got != "LOG_LEVEL" {
+		t.Errorf("envName without a prefix %q", got)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"port", "port", 0},
+		{"port", "prot", 1},
+		{"name", "nmae", 1},
+		{"timeout", "timeuot", 1},
+		{"addr", "adr", 1},
+		{"port", "host", 2},
+		{"", "abc", 3},
+	} {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
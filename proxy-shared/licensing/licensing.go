@@ -0,0 +1,373 @@
+// Package licensing gates enterprise features on the entitlements the
+// manager reports for the cluster's license. Entitlements are cached and
+// refreshed periodically; while the manager is unreachable the last known
+// entitlements stay in effect for a grace period, after which the proxy
+// falls back to community features. Every module gates its features with
+// this package so they are gated the same way everywhere.
+package licensing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Enterprise features gated by the license, named as the license server
+// reports them
+const (
+	FeatureZeroTrust     = "zero_trust"     // OPA policy enforcement and audit logging
+	FeatureMultiCloud    = "multi_cloud"    // routing across cloud backends
+	FeatureWAF           = "waf"            // web application firewall
+	FeatureGalera        = "galera"         // Galera cluster aware load balancing
+	FeatureTranscodeGPU  = "transcode_gpu"  // hardware transcoding with NVENC and AMF
+	FeatureTranscodeHEVC = "transcode_hevc" // H.265 transcoding
+	FeatureTLSInspection = "tls_inspection" // egress TLS interception with the internal CA
+)
+
+// Features lists every feature gated by the license
+var Features = []string{
+	FeatureZeroTrust, FeatureMultiCloud, FeatureWAF,
+	FeatureGalera, FeatureTranscodeGPU, FeatureTranscodeHEVC,
+	FeatureTLSInspection,
+}
+
+const (
+	// DefaultRefresh is how often entitlements are refreshed
+	DefaultRefresh = 5 * time.Minute
+	// DefaultGrace is how long cached entitlements stay in effect while
+	// the manager is unreachable
+	DefaultGrace = 72 * time.Hour
+)
+
+// Entitlements is what the license of the cluster allows
+type Entitlements struct {
+	Edition   string    `json:"edition"`
+	Valid     bool      `json:"valid"`
+	Features  []string  `json:"features"`
+	ExpiresAt string    `json:"expires_at,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Has reports whether the entitlements include feature
+func (e *Entitlements) Has(feature string) bool {
+	if !e.Valid {
+		return false
+	}
+	for _, f := range e.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchFunc fetches the current entitlements
+type FetchFunc func(ctx context.Context) (Entitlements, error)
+
+// Options tunes a gate. Zero values select the defaults.
+type Options struct {
+	Refresh   time.Duration // refresh interval
+	Grace     time.Duration // how long cached entitlements outlive a failing manager
+	CacheFile string        // keep entitlements here across restarts, empty to disable
+	Logger    logrus.FieldLogger
+	Now       func() time.Time // clock, time.Now when nil
+}
+
+// Status is the state of a gate, for /stats and the admin API
+type Status struct {
+	Edition      string    `json:"edition"`
+	Valid        bool      `json:"valid"`
+	Unrestricted bool      `json:"unrestricted,omitempty"`
+	Features     []string  `json:"features"`
+	ExpiresAt    string    `json:"expires_at,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at,omitempty"`
+	Degraded     bool      `json:"degraded"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Gate answers whether enterprise features are enabled
+type Gate struct {
+	fetch        FetchFunc
+	opts         Options
+	unrestricted bool
+
+	mu       sync.RWMutex
+	cached   *Entitlements
+	lastErr  error
+	enabled  map[string]bool
+	watchers map[string][]func(bool)
+
+	now func() time.Time
+}
+
+// New creates a gate fetching entitlements with fetch. Entitlements kept
+// in the cache file are in effect until the first refresh.
+func New(fetch FetchFunc, opts Options) *Gate {
+	if opts.Refresh <= 0 {
+		opts.Refresh = DefaultRefresh
+	}
+	if opts.Grace <= 0 {
+		opts.Grace = DefaultGrace
+	}
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	g := &Gate{
+		fetch:    fetch,
+		opts:     opts,
+		enabled:  make(map[string]bool),
+		watchers: make(map[string][]func(bool)),
+		now:      opts.Now,
+	}
+	if opts.CacheFile != "" {
+		if ent, err := loadCache(opts.CacheFile); err != nil {
+			if !os.IsNotExist(err) {
+				opts.Logger.WithError(err).Warn("Failed to load cached license entitlements")
+			}
+		} else {
+			g.cached = ent
+			g.apply()
+		}
+	}
+	return g
+}
+
+// Unrestricted creates a gate enabling every feature, for development
+// builds
+func Unrestricted() *Gate {
+	return &Gate{unrestricted: true}
+}
+
+// Enabled reports whether feature is enabled. A nil gate enables nothing.
+func (g *Gate) Enabled(feature string) bool {
+	if g == nil {
+		return false
+	}
+	if g.unrestricted {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.enabled[feature]
+}
+
+// Require reports whether feature is enabled, logging that what is
+// disabled when it is not
+func (g *Gate) Require(feature, what string) bool {
+	if g.Enabled(feature) {
+		return true
+	}
+	if g != nil && g.opts.Logger != nil {
+		g.opts.Logger.WithField("feature", feature).Warnf("%s requires an enterprise entitlement, disabled", what)
+	}
+	return false
+}
+
+// Watch calls fn with the state of feature now and whenever it changes
+func (g *Gate) Watch(feature string, fn func(enabled bool)) {
+	if g == nil {
+		fn(false)
+		return
+	}
+	if !g.unrestricted {
+		g.mu.Lock()
+		g.watchers[feature] = append(g.watchers[feature], fn)
+		g.mu.Unlock()
+	}
+	fn(g.Enabled(feature))
+}
+
+// Refresh fetches the entitlements. When that fails the cached
+// entitlements stay in effect within the grace period; beyond it only
+// community features remain.
+func (g *Gate) Refresh(ctx context.Context) error {
+	if g == nil || g.unrestricted {
+		return nil
+	}
+	ent, err := g.fetch(ctx)
+	now := g.now()
+
+	g.mu.Lock()
+	if err != nil {
+		if g.cached != nil && now.Sub(g.cached.FetchedAt) <= g.opts.Grace {
+			left := g.opts.Grace - now.Sub(g.cached.FetchedAt)
+			g.opts.Logger.WithError(err).WithFields(logrus.Fields{
+				"edition":    g.cached.Edition,
+				"grace_left": left.Round(time.Minute).String(),
+			}).Warn("License check failed, keeping cached entitlements")
+		} else {
+			g.opts.Logger.WithError(err).WithField("grace_period", g.opts.Grace.String()).
+				Warn("License check failed with no entitlements within the grace period, enterprise features disabled")
+		}
+	} else {
+		if g.lastErr != nil {
+			g.opts.Logger.WithField("edition", ent.Edition).Info("License check recovered")
+		}
+		ent.FetchedAt = now
+		g.cached = &ent
+		if g.opts.CacheFile != "" {
+			if err := saveCache(g.opts.CacheFile, &ent); err != nil {
+				g.opts.Logger.WithError(err).Warn("Failed to cache license entitlements")
+			}
+		}
+	}
+	g.lastErr = err
+	changed := g.apply()
+
+	var notify []func()
+	for feature, enabled := range changed {
+		g.opts.Logger.WithFields(logrus.Fields{
+			"feature": feature,
+			"enabled": enabled,
+		}).Info("Enterprise feature entitlement changed")
+		for _, fn := range g.watchers[feature] {
+			fn, enabled := fn, enabled
+			notify = append(notify, func() { fn(enabled) })
+		}
+	}
+	g.mu.Unlock()
+
+	for _, fn := range notify {
+		fn()
+	}
+	return err
+}
+
+// apply recomputes the enabled features from the cached entitlements,
+// returning the features that changed. Callers hold g.mu.
+func (g *Gate) apply() map[string]bool {
+	enabled := make(map[string]bool)
+	if g.cached != nil && g.now().Sub(g.cached.FetchedAt) <= g.opts.Grace {
+		for _, feature := range g.cached.Features {
+			if g.cached.Has(feature) {
+				enabled[feature] = true
+			}
+		}
+	}
+
+	changed := make(map[string]bool)
+	for feature := range enabled {
+		if !g.enabled[feature] {
+			changed[feature] = true
+		}
+	}
+	for feature := range g.enabled {
+		if !enabled[feature] {
+			changed[feature] = false
+		}
+	}
+	g.enabled = enabled
+	return changed
+}
+
+// Run refreshes the entitlements every refresh interval until ctx is done
+func (g *Gate) Run(ctx context.Context) {
+	if g == nil || g.unrestricted {
+		return
+	}
+	ticker := time.NewTicker(g.opts.Refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.Refresh(ctx)
+		}
+	}
+}
+
+// Status returns the state of the gate
+func (g *Gate) Status() Status {
+	if g == nil {
+		return Status{Features: []string{}}
+	}
+	if g.unrestricted {
+		return Status{Edition: "Development", Valid: true, Unrestricted: true, Features: append([]string(nil), Features...)}
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	status := Status{Features: []string{}, Degraded: g.lastErr != nil}
+	if g.cached != nil {
+		status.Edition = g.cached.Edition
+		status.Valid = g.cached.Valid
+		status.ExpiresAt = g.cached.ExpiresAt
+		status.FetchedAt = g.cached.FetchedAt
+	}
+	for feature := range g.enabled {
+		status.Features = append(status.Features, feature)
+	}
+	sort.Strings(status.Features)
+	if g.lastErr != nil {
+		status.Error = g.lastErr.Error()
+	}
+	return status
+}
+
+// WritePrometheus writes the state of every gated feature in Prometheus
+// text format
+func (g *Gate) WritePrometheus(w io.Writer) {
+	if g == nil {
+		return
+	}
+	status := g.Status()
+
+	fmt.Fprintf(w, "# HELP marchproxy_license_feature_enabled Whether an enterprise feature is enabled by the license\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_license_feature_enabled gauge\n")
+	for _, feature := range Features {
+		fmt.Fprintf(w, "marchproxy_license_feature_enabled{feature=\"%s\"} %d\n", feature, boolToInt(g.Enabled(feature)))
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_license_degraded Whether the last license check failed\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_license_degraded gauge\n")
+	fmt.Fprintf(w, "marchproxy_license_degraded %d\n", boolToInt(status.Degraded))
+	if !status.FetchedAt.IsZero() {
+		fmt.Fprintf(w, "# HELP marchproxy_license_entitlements_age_seconds Seconds since the entitlements were fetched\n")
+		fmt.Fprintf(w, "# TYPE marchproxy_license_entitlements_age_seconds gauge\n")
+		fmt.Fprintf(w, "marchproxy_license_entitlements_age_seconds %.0f\n", g.now().Sub(status.FetchedAt).Seconds())
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// loadCache reads entitlements kept by saveCache
+func loadCache(path string) (*Entitlements, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ent Entitlements
+	if err := json.Unmarshal(data, &ent); err != nil {
+		return nil, fmt.Errorf("invalid cache file %s: %w", path, err)
+	}
+	return &ent, nil
+}
+
+// saveCache keeps entitlements in path, replacing it atomically
+func saveCache(path string, ent *Entitlements) error {
+	data, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,198 @@
+package licensing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeManager serves entitlements and fails while err is set
+type fakeManager struct {
+	ent Entitlements
+	err error
+}
+
+func (m *fakeManager) fetch(ctx context.Context) (Entitlements, error) {
+	if m.err != nil {
+		return Entitlements{}, m.err
+	}
+	return m.ent, nil
+}
+
+// quietLogger discards log output
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// testOptions returns options for a gate on the fake clock now
+func testOptions(cacheFile string, now *time.Time) Options {
+	return Options{
+		Grace:     time.Hour,
+		CacheFile: cacheFile,
+		Logger:    quietLogger(),
+		Now:       func() time.Time { return *now },
+	}
+}
+
+// newTestGate returns a gate on a fake clock, logging to the test
+func newTestGate(t *testing.T, m *fakeManager, cacheFile string) (*Gate, *time.Time) {
+	now := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	g := New(m.fetch, testOptions(cacheFile, &now))
+	return g, &now
+}
+
+func TestGraceWhenManagerUnreachable(t *testing.T) {
+	m := &fakeManager{ent: Entitlements{Edition: "Enterprise", Valid: true, Features: []string{FeatureWAF}}}
+	g, now := newTestGate(t, m, "")
+
+	if g.Enabled(FeatureWAF) {
+		t.Fatal("Expected nothing enabled before the first refresh")
+	}
+	if err := g.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Enabled(FeatureWAF) || g.Enabled(FeatureGalera) {
+		t.Fatalf("Expected only waf enabled, got %+v", g.Status())
+	}
+
+	// Within the grace period the cached entitlements stay in effect
+	m.err = errors.New("connection refused")
+	*now = now.Add(30 * time.Minute)
+	if err := g.Refresh(context.Background()); err == nil {
+		t.Fatal("Expected the refresh error to be returned")
+	}
+	if !g.Enabled(FeatureWAF) || !g.Status().Degraded {
+		t.Fatalf("Expected waf to stay enabled while degraded, got %+v", g.Status())
+	}
+
+	// Beyond it only community features remain
+	*now = now.Add(time.Hour)
+	g.Refresh(context.Background())
+	if g.Enabled(FeatureWAF) {
+		t.Fatal("Expected waf disabled after the grace period")
+	}
+
+	m.err = nil
+	g.Refresh(context.Background())
+	if !g.Enabled(FeatureWAF) || g.Status().Degraded {
+		t.Fatalf("Expected waf enabled after recovering, got %+v", g.Status())
+	}
+}
+
+func TestInvalidLicense(t *testing.T) {
+	m := &fakeManager{ent: Entitlements{Edition: "Enterprise", Valid: false, Features: []string{FeatureWAF}}}
+	g, _ := newTestGate(t, m, "")
+	g.Refresh(context.Background())
+	if g.Enabled(FeatureWAF) {
+		t.Fatal("Expected an invalid license to enable nothing")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	m := &fakeManager{ent: Entitlements{Edition: "Community", Valid: true}}
+	g, _ := newTestGate(t, m, "")
+
+	var states []bool
+	g.Watch(FeatureZeroTrust, func(enabled bool) { states = append(states, enabled) })
+	g.Refresh(context.Background())
+
+	m.ent = Entitlements{Edition: "Enterprise", Valid: true, Features: []string{FeatureZeroTrust}}
+	g.Refresh(context.Background())
+	g.Refresh(context.Background())
+
+	if len(states) != 2 || states[0] || !states[1] {
+		t.Fatalf("Expected the initial state and one change, got %v", states)
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "license.json")
+	m := &fakeManager{ent: Entitlements{Edition: "Enterprise", Valid: true, Features: []string{FeatureGalera}}}
+	g, now := newTestGate(t, m, cacheFile)
+	g.Refresh(context.Background())
+
+	// A restart while the manager is down starts from the cache
+	*now = now.Add(30 * time.Minute)
+	restarted := New((&fakeManager{err: errors.New("timeout")}).fetch, testOptions(cacheFile, now))
+	if !restarted.Enabled(FeatureGalera) {
+		t.Fatalf("Expected galera enabled from the cache, got %+v", restarted.Status())
+	}
+
+	// Unless the cache is older than the grace period
+	*now = now.Add(time.Hour)
+	restarted = New((&fakeManager{err: errors.New("timeout")}).fetch, testOptions(cacheFile, now))
+	if restarted.Enabled(FeatureGalera) {
+		t.Fatal("Expected a cache older than the grace period to enable nothing")
+	}
+}
+
+func TestUnrestricted(t *testing.T) {
+	g := Unrestricted()
+	for _, feature := range Features {
+		if !g.Enabled(feature) {
+			t.Errorf("Expected %s enabled", feature)
+		}
+	}
+
+	var nilGate *Gate
+	if nilGate.Enabled(FeatureWAF) || nilGate.Require(FeatureWAF, "WAF") {
+		t.Error("Expected a nil gate to enable nothing")
+	}
+}
+
+func TestManagerFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req entitlementsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/api/proxy/entitlements" || req.ClusterAPIKey != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "Invalid cluster API key"}`))
+			return
+		}
+		w.Write([]byte(`{"success": true, "edition": "Enterprise", "valid": true, "features": ["waf"]}`))
+	}))
+	defer server.Close()
+
+	ent, err := ManagerFetcher(server.URL+"/", "secret", "proxy-1")(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Edition != "Enterprise" || !ent.Has(FeatureWAF) {
+		t.Errorf("Unexpected entitlements %+v", ent)
+	}
+
+	if _, err := ManagerFetcher(server.URL, "wrong", "proxy-1")(context.Background()); err == nil {
+		t.Error("Expected a rejected API key to fail")
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	m := &fakeManager{ent: Entitlements{Edition: "Enterprise", Valid: true, Features: []string{FeatureWAF}}}
+	g, _ := newTestGate(t, m, "")
+	g.Refresh(context.Background())
+
+	var buf bytes.Buffer
+	g.WritePrometheus(&buf)
+	for _, want := range []string{
+		`marchproxy_license_feature_enabled{feature="waf"} 1`,
+		`marchproxy_license_feature_enabled{feature="galera"} 0`,
+		`marchproxy_license_degraded 0`,
+		`marchproxy_license_entitlements_age_seconds 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, buf.String())
+		}
+	}
+}
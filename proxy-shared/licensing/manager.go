@@ -0,0 +1,75 @@
+package licensing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// entitlementsRequest is the body of an entitlements request
+type entitlementsRequest struct {
+	ProxyName     string `json:"proxy_name"`
+	ClusterAPIKey string `json:"cluster_api_key"`
+}
+
+// entitlementsResponse is the manager's answer to an entitlements request
+type entitlementsResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Entitlements
+}
+
+// ManagerFetcher fetches entitlements from the manager's
+// /api/proxy/entitlements endpoint, authenticated with the cluster API key
+func ManagerFetcher(managerURL, apiKey, proxyName string) FetchFunc {
+	url := strings.TrimRight(managerURL, "/") + "/api/proxy/entitlements"
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return func(ctx context.Context) (Entitlements, error) {
+		body, err := json.Marshal(entitlementsRequest{ProxyName: proxyName, ClusterAPIKey: apiKey})
+		if err != nil {
+			return Entitlements{}, fmt.Errorf("failed to marshal entitlements request: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return Entitlements{}, fmt.Errorf("failed to create entitlements request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return Entitlements{}, fmt.Errorf("manager unreachable: %w", err)
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return Entitlements{}, fmt.Errorf("failed to read entitlements: %w", err)
+		}
+		if resp.StatusCode >= 400 {
+			return Entitlements{}, fmt.Errorf("entitlements request failed with status %d: %s", resp.StatusCode, string(data))
+		}
+
+		var result entitlementsResponse
+		if err := json.Unmarshal(data, &result); err != nil {
+			return Entitlements{}, fmt.Errorf("failed to parse entitlements: %w", err)
+		}
+		if !result.Success {
+			return Entitlements{}, fmt.Errorf("entitlements request rejected: %s", result.Error)
+		}
+		return result.Entitlements, nil
+	}
+}
+
+// Community returns a fetcher reporting a valid community license, for
+// proxies running without a manager
+func Community() FetchFunc {
+	return func(ctx context.Context) (Entitlements, error) {
+		return Entitlements{Edition: "Community", Valid: true, Features: []string{}}, nil
+	}
+}
@@ -0,0 +1,98 @@
+package metering
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// CSVHeader is the header row of usage CSV files
+var CSVHeader = []string{
+	"period_start", "period_end", "module", "proxy", "tenant", "service",
+	"bytes", "connections", "requests", "transcode_minutes",
+}
+
+// CSVSink appends records to one CSV file per module and UTC day, named
+// usage-<module>-<YYYY-MM-DD>.csv after the day the period started
+type CSVSink struct {
+	dir string
+}
+
+// NewCSVSink creates a sink writing to dir, creating it if needed
+func NewCSVSink(dir string) (*CSVSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create metering directory: %w", err)
+	}
+	return &CSVSink{dir: dir}, nil
+}
+
+// Name implements Sink
+func (s *CSVSink) Name() string {
+	return "csv"
+}
+
+// Write implements Sink
+func (s *CSVSink) Write(records []Record) error {
+	byFile := make(map[string][]Record)
+	var order []string
+	for _, r := range records {
+		name := fmt.Sprintf("usage-%s-%s.csv", r.Module, r.PeriodStart.UTC().Format("2006-01-02"))
+		if _, ok := byFile[name]; !ok {
+			order = append(order, name)
+		}
+		byFile[name] = append(byFile[name], r)
+	}
+
+	for _, name := range order {
+		if err := s.append(filepath.Join(s.dir, name), byFile[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes records to path, with a header when the file is new
+func (s *CSVSink) append(path string, records []Record) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write(CSVHeader)
+	}
+	for _, r := range records {
+		w.Write(CSVRow(r))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// CSVRow formats a record as a row matching CSVHeader
+func CSVRow(r Record) []string {
+	return []string{
+		r.PeriodStart.UTC().Format(time.RFC3339),
+		r.PeriodEnd.UTC().Format(time.RFC3339),
+		r.Module,
+		r.Proxy,
+		r.Tenant,
+		r.Service,
+		strconv.FormatUint(r.Bytes, 10),
+		strconv.FormatUint(r.Connections, 10),
+		strconv.FormatUint(r.Requests, 10),
+		strconv.FormatFloat(r.TranscodeMinutes, 'f', 3, 64),
+	}
+}
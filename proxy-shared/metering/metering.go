@@ -0,0 +1,265 @@
+// Package metering aggregates billable usage per tenant and service into
+// periodic usage records for chargeback: bytes, connections and requests
+// of the proxies, transcode minutes of the RTMP module. Every interval the current period
+// is closed and its records are handed to the sinks, the manager upload or
+// CSV files; records a sink fails to take are retried with the next period.
+package metering
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxPending bounds the records kept for a failing sink; the oldest are
+// dropped beyond it
+const MaxPending = 100000
+
+// Usage is the billable usage of one tenant and service
+type Usage struct {
+	Bytes            uint64  `json:"bytes"`
+	Connections      uint64  `json:"connections"`
+	Requests         uint64  `json:"requests"`
+	TranscodeMinutes float64 `json:"transcode_minutes"`
+}
+
+// add adds u to the usage
+func (u *Usage) add(o Usage) {
+	u.Bytes += o.Bytes
+	u.Connections += o.Connections
+	u.Requests += o.Requests
+	u.TranscodeMinutes += o.TranscodeMinutes
+}
+
+// Record is the usage of one tenant and service on one proxy over one period
+type Record struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Module      string    `json:"module"`
+	Proxy       string    `json:"proxy"`
+	Tenant      string    `json:"tenant"`
+	Service     string    `json:"service"`
+	Usage
+}
+
+// Sink takes closed usage records
+type Sink interface {
+	Name() string
+	Write(records []Record) error
+}
+
+// key identifies the usage of one tenant and service
+type key struct {
+	tenant  string
+	service string
+}
+
+// sinkState is the delivery state of one sink
+type sinkState struct {
+	sink    Sink
+	pending []Record
+	written uint64
+	errors  uint64
+	dropped uint64
+}
+
+// Meter aggregates usage for the current period and exports closed periods
+type Meter struct {
+	module string
+	proxy  string
+
+	mu    sync.Mutex
+	start time.Time
+	usage map[key]*Usage
+
+	sinksMu sync.Mutex
+	sinks   []*sinkState
+	onFlush []func()
+
+	now func() time.Time
+}
+
+// New creates a meter for the given module and proxy name
+func New(module, proxy string, sinks ...Sink) *Meter {
+	m := &Meter{
+		module: module,
+		proxy:  proxy,
+		usage:  make(map[key]*Usage),
+		now:    time.Now,
+	}
+	for _, sink := range sinks {
+		m.sinks = append(m.sinks, &sinkState{sink: sink})
+	}
+	m.start = m.now().UTC()
+	return m
+}
+
+// Add adds usage for tenant and service to the current period. A nil
+// meter ignores it.
+func (m *Meter) Add(tenant, service string, u Usage) {
+	if m == nil || u == (Usage{}) {
+		return
+	}
+	k := key{tenant: tenant, service: service}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total, ok := m.usage[k]
+	if !ok {
+		total = &Usage{}
+		m.usage[k] = total
+	}
+	total.add(u)
+}
+
+// OnFlush registers fn to run before each period closes, so long-running
+// work such as a transcode can add its usage so far
+func (m *Meter) OnFlush(fn func()) {
+	m.sinksMu.Lock()
+	defer m.sinksMu.Unlock()
+	m.onFlush = append(m.onFlush, fn)
+}
+
+// Close ends the current period and returns its records, ordered by
+// tenant and service. A period without usage has no records.
+func (m *Meter) Close() []Record {
+	m.mu.Lock()
+	start, end := m.start, m.now().UTC()
+	usage := m.usage
+	m.start = end
+	m.usage = make(map[key]*Usage)
+	m.mu.Unlock()
+
+	records := make([]Record, 0, len(usage))
+	for k, u := range usage {
+		records = append(records, Record{
+			PeriodStart: start,
+			PeriodEnd:   end,
+			Module:      m.module,
+			Proxy:       m.proxy,
+			Tenant:      k.tenant,
+			Service:     k.service,
+			Usage:       *u,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Tenant != records[j].Tenant {
+			return records[i].Tenant < records[j].Tenant
+		}
+		return records[i].Service < records[j].Service
+	})
+	return records
+}
+
+// Flush closes the current period and delivers its records, with any left
+// over from failed deliveries, to every sink
+func (m *Meter) Flush() {
+	m.sinksMu.Lock()
+	defer m.sinksMu.Unlock()
+
+	for _, fn := range m.onFlush {
+		fn()
+	}
+	records := m.Close()
+
+	for _, s := range m.sinks {
+		s.pending = append(s.pending, records...)
+		if len(s.pending) == 0 {
+			continue
+		}
+		if err := s.sink.Write(s.pending); err != nil {
+			s.errors++
+			if over := len(s.pending) - MaxPending; over > 0 {
+				s.dropped += uint64(over)
+				s.pending = append([]Record(nil), s.pending[over:]...)
+			}
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"sink":    s.sink.Name(),
+				"pending": len(s.pending),
+			}).Warn("Usage export failed")
+			continue
+		}
+		s.written += uint64(len(s.pending))
+		s.pending = nil
+	}
+}
+
+// Run flushes every interval until ctx is done. Flush once more after
+// the last connection closed or transcode stopped to export the partial
+// period.
+func (m *Meter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Flush()
+		}
+	}
+}
+
+// SinkStats is the export state of one sink
+type SinkStats struct {
+	Sink    string
+	Written uint64 // Records delivered
+	Errors  uint64 // Failed exports
+	Dropped uint64 // Records dropped after too many failed exports
+	Pending int    // Records waiting for a retry
+}
+
+// Stats returns the export state of every sink
+func (m *Meter) Stats() []SinkStats {
+	if m == nil {
+		return nil
+	}
+	m.sinksMu.Lock()
+	defer m.sinksMu.Unlock()
+
+	stats := make([]SinkStats, 0, len(m.sinks))
+	for _, s := range m.sinks {
+		stats = append(stats, SinkStats{
+			Sink:    s.sink.Name(),
+			Written: s.written,
+			Errors:  s.errors,
+			Dropped: s.dropped,
+			Pending: len(s.pending),
+		})
+	}
+	return stats
+}
+
+// WritePrometheus writes the export state of every sink in Prometheus
+// text format
+func (m *Meter) WritePrometheus(w io.Writer) {
+	stats := m.Stats()
+
+	fmt.Fprintf(w, "# HELP marchproxy_metering_records_total Usage records delivered per sink\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_metering_records_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "marchproxy_metering_records_total{sink=\"%s\"} %d\n", s.Sink, s.Written)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_metering_export_errors_total Failed usage exports per sink\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_metering_export_errors_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "marchproxy_metering_export_errors_total{sink=\"%s\"} %d\n", s.Sink, s.Errors)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_metering_dropped_records_total Usage records dropped after too many failed exports per sink\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_metering_dropped_records_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "marchproxy_metering_dropped_records_total{sink=\"%s\"} %d\n", s.Sink, s.Dropped)
+	}
+	fmt.Fprintf(w, "# HELP marchproxy_metering_pending_records Usage records waiting for a retry per sink\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_metering_pending_records gauge\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "marchproxy_metering_pending_records{sink=\"%s\"} %d\n", s.Sink, s.Pending)
+	}
+}
@@ -0,0 +1,150 @@
+package metering
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memorySink records what it was given and fails while err is set
+type memorySink struct {
+	records []Record
+	err     error
+}
+
+func (s *memorySink) Name() string { return "memory" }
+
+func (s *memorySink) Write(records []Record) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.records = append(s.records, records...)
+	return nil
+}
+
+// newTestMeter returns a meter on a fake clock
+func newTestMeter(sinks ...Sink) (*Meter, *time.Time) {
+	now := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	m := New("egress", "proxy-1", sinks...)
+	m.now = func() time.Time { return now }
+	m.start = now
+	return m, &now
+}
+
+func TestClose(t *testing.T) {
+	m, now := newTestMeter()
+	m.Add("globex", "db", Usage{Connections: 1, Bytes: 100})
+	m.Add("acme", "web", Usage{Requests: 2, Bytes: 300})
+	m.Add("acme", "web", Usage{Requests: 1, Bytes: 200})
+	m.Add("acme", "web", Usage{})
+
+	*now = now.Add(5 * time.Minute)
+	records := m.Close()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %+v", records)
+	}
+	acme := records[0]
+	if acme.Tenant != "acme" || acme.Service != "web" || acme.Requests != 3 || acme.Bytes != 500 {
+		t.Errorf("Expected acme/web with 3 requests and 500 bytes, got %+v", acme)
+	}
+	if acme.Module != "egress" || acme.Proxy != "proxy-1" {
+		t.Errorf("Expected module and proxy on the record, got %+v", acme)
+	}
+	if acme.PeriodEnd.Sub(acme.PeriodStart) != 5*time.Minute {
+		t.Errorf("Expected a 5 minute period, got %v to %v", acme.PeriodStart, acme.PeriodEnd)
+	}
+
+	// The next period starts where the last ended and starts empty
+	*now = now.Add(5 * time.Minute)
+	m.Add("acme", "web", Usage{TranscodeMinutes: 1.5})
+	records = m.Close()
+	if len(records) != 1 || records[0].Requests != 0 || records[0].TranscodeMinutes != 1.5 {
+		t.Fatalf("Expected only the new usage, got %+v", records)
+	}
+	if !records[0].PeriodStart.Equal(acme.PeriodEnd) {
+		t.Errorf("Expected periods to be contiguous, got %v after %v", records[0].PeriodStart, acme.PeriodEnd)
+	}
+}
+
+func TestFlushRetries(t *testing.T) {
+	sink := &memorySink{err: errors.New("manager unavailable")}
+	m, now := newTestMeter(sink)
+
+	m.Add("acme", "web", Usage{Connections: 1})
+	*now = now.Add(time.Minute)
+	m.Flush()
+	if len(sink.records) != 0 {
+		t.Fatalf("Expected nothing delivered while the sink fails, got %+v", sink.records)
+	}
+
+	sink.err = nil
+	m.Add("acme", "web", Usage{Connections: 2})
+	*now = now.Add(time.Minute)
+	m.Flush()
+	if len(sink.records) != 2 || sink.records[0].Connections != 1 || sink.records[1].Connections != 2 {
+		t.Fatalf("Expected the failed period to be retried in order, got %+v", sink.records)
+	}
+
+	stats := m.Stats()
+	if len(stats) != 1 || stats[0].Written != 2 || stats[0].Errors != 1 || stats[0].Pending != 0 {
+		t.Errorf("Expected 2 records written after 1 error, got %+v", stats)
+	}
+
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf)
+	for _, want := range []string{
+		`marchproxy_metering_records_total{sink="memory"} 2`,
+		`marchproxy_metering_export_errors_total{sink="memory"} 1`,
+		`marchproxy_metering_pending_records{sink="memory"} 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	sink := &memorySink{}
+	m, now := newTestMeter(sink)
+
+	// Usage added on flush lands in the period being closed
+	m.OnFlush(func() { m.Add("acme", "encoder-1", Usage{TranscodeMinutes: 2}) })
+	*now = now.Add(time.Minute)
+	m.Flush()
+	if len(sink.records) != 1 || sink.records[0].TranscodeMinutes != 2 {
+		t.Errorf("Expected the flush hook's usage delivered, got %+v", sink.records)
+	}
+}
+
+func TestCSVSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewCSVSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, now := newTestMeter(sink)
+
+	m.Add("acme", "web", Usage{Connections: 1, Bytes: 1500})
+	*now = now.Add(time.Minute)
+	m.Flush()
+	m.Add("acme", "web", Usage{Requests: 4})
+	*now = now.Add(time.Minute)
+	m.Flush()
+
+	data, err := os.ReadFile(filepath.Join(dir, "usage-egress-2026-10-17.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"period_start,period_end,module,proxy,tenant,service,bytes,connections,requests,transcode_minutes",
+		"2026-10-17T10:00:00Z,2026-10-17T10:01:00Z,egress,proxy-1,acme,web,1500,1,0,0.000",
+		"2026-10-17T10:01:00Z,2026-10-17T10:02:00Z,egress,proxy-1,acme,web,0,0,4,0.000",
+	}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("Unexpected CSV:\n%s\nwant:\n%s", data, want)
+	}
+}
@@ -0,0 +1,132 @@
+// Package netutil provides listener helpers for binding to specific
+// addresses and network interfaces.
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// JoinHostPort builds a listen address from an optional bind address and a port.
+// An empty host binds to all interfaces.
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ValidateBindAddress checks that a bind address is empty or a literal IP address
+func ValidateBindAddress(address string) error {
+	if address == "" {
+		return nil
+	}
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid bind address %q: must be an IP address", address)
+	}
+	return nil
+}
+
+// ValidateInterface checks that a bind interface is empty or exists on this host
+func ValidateInterface(iface string) error {
+	if iface == "" {
+		return nil
+	}
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return fmt.Errorf("invalid bind interface %q: %w", iface, err)
+	}
+	return nil
+}
+
+// Listen opens a stream listener on address. If iface is set the socket is
+// bound to that device (or VRF master device) with SO_BINDTODEVICE. With
+// handover enabled, a listener inherited for the same address is reused.
+func Listen(network, address, iface string) (net.Listener, error) {
+	return inheritListener(socketName(network, address, iface), func() (net.Listener, error) {
+		listener, err := listenConfig(iface, false).Listen(context.Background(), network, address)
+		if err != nil {
+			return nil, err
+		}
+		keepSocketFile(listener)
+		return listener, nil
+	})
+}
+
+// ListenReusePort opens count stream listeners sharing address via
+// SO_REUSEPORT so the kernel load balances new connections across them.
+// If any socket fails to open, those already opened are closed.
+func ListenReusePort(network, address, iface string, count int) ([]net.Listener, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("listener count must be at least 1")
+	}
+	return listenGroup(listenConfig(iface, true), network, address, iface, count)
+}
+
+// ListenMPTCP opens count Multipath TCP listeners on address, sharing it via
+// SO_REUSEPORT when count is greater than one. Clients that do not offer
+// MPTCP, or kernels with MPTCP disabled, fall back to plain TCP.
+func ListenMPTCP(network, address, iface string, count int) ([]net.Listener, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("listener count must be at least 1")
+	}
+	lc := listenConfig(iface, count > 1)
+	lc.SetMultipathTCP(true)
+	return listenGroup(lc, network, address, iface, count)
+}
+
+// listenGroup opens count listeners on address from lc, closing any already
+// opened if one fails
+func listenGroup(lc *net.ListenConfig, network, address, iface string, count int) ([]net.Listener, error) {
+	name := socketName(network, address, iface)
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		// Resolve an ephemeral port once so every socket shares it
+		if i == 1 {
+			address = listeners[0].Addr().String()
+		}
+		listener, err := inheritListener(fmt.Sprintf("%s#%d", name, i), func() (net.Listener, error) {
+			return lc.Listen(context.Background(), network, address)
+		})
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// ListenPacket opens a packet listener on address, optionally bound to iface
+func ListenPacket(network, address, iface string) (net.PacketConn, error) {
+	return inheritPacketConn(socketName(network, address, iface), func() (net.PacketConn, error) {
+		return listenConfig(iface, false).ListenPacket(context.Background(), network, address)
+	})
+}
+
+// listenConfig returns a ListenConfig that binds new sockets to iface when set
+// and enables SO_REUSEPORT when requested
+func listenConfig(iface string, reusePort bool) *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if iface != "" || reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if reusePort {
+				if err := setReusePort(c); err != nil {
+					return err
+				}
+			}
+			if iface != "" {
+				return bindToDevice(c, iface)
+			}
+			return nil
+		}
+	}
+	return lc
+}
+
+// DefaultAcceptors returns the default number of accept loops, one per CPU
+func DefaultAcceptors() int {
+	return runtime.NumCPU()
+}
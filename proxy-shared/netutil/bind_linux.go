@@ -0,0 +1,151 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice restricts a socket to a single interface. Binding to a VRF
+// master device scopes the socket to that VRF's routing table.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to bind socket to interface %s: %w", iface, sockErr)
+	}
+	return nil
+}
+
+// setReusePort enables SO_REUSEPORT so several sockets can bind the same address
+func setReusePort(c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to enable SO_REUSEPORT: %w", sockErr)
+	}
+	return nil
+}
+
+// setUserTimeout sets TCP_USER_TIMEOUT so connections with unacknowledged
+// data are dropped after timeout instead of the kernel retransmit default
+func setUserTimeout(c syscall.RawConn, timeout time.Duration) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds()))
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to set TCP_USER_TIMEOUT: %w", sockErr)
+	}
+	return nil
+}
+
+// mptcpInfo is the MPTCP_INFO socket option at level SOL_MPTCP
+const mptcpInfo = 1
+
+// MPTCPSupported reports whether Multipath TCP is enabled in the running
+// kernel (Linux 5.15+ with net.mptcp.enabled=1)
+func MPTCPSupported() bool {
+	enabled, err := os.ReadFile("/proc/sys/net/mptcp/enabled")
+	return err == nil && strings.TrimSpace(string(enabled)) == "1"
+}
+
+// mptcpExtraSubflows reads the number of additional subflows from MPTCP_INFO.
+// The first byte of struct mptcp_info is mptcpi_subflows.
+func mptcpExtraSubflows(c syscall.RawConn) (int, error) {
+	var info [64]byte
+	size := uint32(len(info))
+
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_MPTCP, mptcpInfo,
+			uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, fmt.Errorf("failed to read MPTCP_INFO: %w", sockErr)
+	}
+	return int(info[0]), nil
+}
+
+// peerUID returns the user the process at the other end of conn runs as
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, fmt.Errorf("failed to read SO_PEERCRED: %w", sockErr)
+	}
+	return int(cred.Uid), nil
+}
+
+// rightsSpace returns the control buffer size for n descriptors
+func rightsSpace(n int) int {
+	return syscall.CmsgSpace(n * 4)
+}
+
+// unixRights encodes files as an SCM_RIGHTS control message
+func unixRights(files []*os.File) ([]byte, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	return syscall.UnixRights(fds...), nil
+}
+
+// parseUnixRights returns the files passed in SCM_RIGHTS control messages
+func parseUnixRights(oob []byte) ([]*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "inherited"))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,57 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// bindToDevice is only supported on Linux
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return fmt.Errorf("binding to interface %s is only supported on Linux", iface)
+}
+
+// setReusePort is only supported on Linux
+func setReusePort(c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT listeners are only supported on Linux")
+}
+
+// setUserTimeout is only supported on Linux
+func setUserTimeout(c syscall.RawConn, timeout time.Duration) error {
+	return fmt.Errorf("TCP_USER_TIMEOUT is only supported on Linux")
+}
+
+// MPTCPSupported reports whether Multipath TCP is available; it is only
+// supported on Linux
+func MPTCPSupported() bool {
+	return false
+}
+
+// mptcpExtraSubflows is only supported on Linux
+func mptcpExtraSubflows(c syscall.RawConn) (int, error) {
+	return 0, fmt.Errorf("MPTCP_INFO is only supported on Linux")
+}
+
+// peerUID is only supported on Linux
+func peerUID(conn *net.UnixConn) (int, error) {
+	return 0, fmt.Errorf("SO_PEERCRED is only supported on Linux")
+}
+
+// rightsSpace is only meaningful on Linux
+func rightsSpace(n int) int {
+	return 0
+}
+
+// unixRights is only supported on Linux
+func unixRights(files []*os.File) ([]byte, error) {
+	return nil, fmt.Errorf("listener handover is only supported on Linux")
+}
+
+// parseUnixRights is only supported on Linux
+func parseUnixRights(oob []byte) ([]*os.File, error) {
+	return nil, fmt.Errorf("listener handover is only supported on Linux")
+}
@@ -0,0 +1,170 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestJoinHostPort tests listen address construction
+func TestJoinHostPort(t *testing.T) {
+	tests := []struct {
+		host     string
+		port     int
+		expected string
+	}{
+		{"", 8080, ":8080"},
+		{"10.0.0.5", 8080, "10.0.0.5:8080"},
+		{"::1", 9090, "[::1]:9090"},
+	}
+
+	for _, tt := range tests {
+		if got := JoinHostPort(tt.host, tt.port); got != tt.expected {
+			t.Errorf("JoinHostPort(%q, %d) = %s, want %s", tt.host, tt.port, got, tt.expected)
+		}
+	}
+}
+
+// TestValidateBindAddress tests bind address validation
+func TestValidateBindAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{"", true},
+		{"0.0.0.0", true},
+		{"192.168.1.10", true},
+		{"fe80::1", true},
+		{"eth0", false},
+		{"10.0.0.256", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateBindAddress(tt.address)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateBindAddress(%q) error = %v, want valid %t", tt.address, err, tt.valid)
+		}
+	}
+}
+
+// TestListenLoopback tests listening on an explicit bind address
+func TestListenLoopback(t *testing.T) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := ListenPacket("udp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+}
+
+// TestNewDialerValidation tests dialer option validation
+func TestNewDialerValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  DialOptions
+		valid bool
+	}{
+		{"defaults", DialOptions{}, true},
+		{"ipv4 pool", DialOptions{Family: FamilyIPv4, SourceAddrs: []string{"10.0.0.1", "10.0.0.2"}}, true},
+		{"family mismatch", DialOptions{Family: FamilyIPv6, SourceAddrs: []string{"10.0.0.1"}}, false},
+		{"bad source", DialOptions{SourceAddrs: []string{"not-an-ip"}}, false},
+		{"bad family", DialOptions{Family: "ipx"}, false},
+		{"negative retries", DialOptions{Retries: -1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDialer(tt.opts)
+			if (err == nil) != tt.valid {
+				t.Errorf("NewDialer() error = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+// TestDialerSourceAddress tests dialing from a pinned source address with retries
+func TestDialerSourceAddress(t *testing.T) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	dialer, err := NewDialer(DialOptions{
+		Timeout:      time.Second,
+		Retries:      2,
+		RetryBackoff: 10 * time.Millisecond,
+		SourceAddrs:  []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if !local.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("local address = %s, want 127.0.0.1", local.IP)
+	}
+}
+
+// fakeResolver answers every host name with fixed addresses
+type fakeResolver []netip.Addr
+
+func (f fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return f, nil
+}
+
+// TestDialerResolver tests dialing a host name through a resolver, racing
+// an unreachable IPv6 address against IPv4
+func TestDialerResolver(t *testing.T) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	dialer, err := NewDialer(DialOptions{
+		Timeout:       2 * time.Second,
+		FallbackDelay: 50 * time.Millisecond,
+		Resolver:      fakeResolver{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("127.0.0.1")},
+	})
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("api.example.com", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+
+	if remote := conn.RemoteAddr().(*net.TCPAddr); !remote.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("remote address = %s, want 127.0.0.1", remote.IP)
+	}
+}
@@ -0,0 +1,307 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// IP families accepted by DialOptions.Family
+const (
+	FamilyAny  = "any"
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// DialOptions configures outbound connections
+type DialOptions struct {
+	Timeout       time.Duration // Per-attempt connect timeout, 0 = no timeout
+	FallbackDelay time.Duration // Happy Eyeballs delay before racing the other family, negative disables
+	Retries       int           // Additional attempts after the first failure
+	RetryBackoff  time.Duration // Delay between attempts, doubled after each retry
+	Family        string        // any, ipv4 or ipv6
+	SourceAddrs   []string      // Source IPs to round-robin over (egress IP pinning / SNAT pool)
+	Interface     string        // Interface or VRF device to bind outbound sockets to (Linux only)
+	MPTCP         bool          // Request Multipath TCP for stream connections, falls back to TCP
+	Resolver      HostResolver  // Looks up destination host names, the system resolver when nil
+}
+
+// HostResolver looks up the addresses of a host name on network ("ip",
+// "ip4" or "ip6"), like net.Resolver
+type HostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// defaultFallbackDelay is how long net.Dialer waits before racing the other
+// family when FallbackDelay is 0
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// Dialer dials outbound connections according to DialOptions. It is safe for
+// concurrent use.
+type Dialer struct {
+	opts    DialOptions
+	sources []net.IP
+	next    uint32
+}
+
+// NewDialer validates options and creates a Dialer
+func NewDialer(opts DialOptions) (*Dialer, error) {
+	switch opts.Family {
+	case "", FamilyAny, FamilyIPv4, FamilyIPv6:
+	default:
+		return nil, fmt.Errorf("invalid IP family %q: must be any, ipv4 or ipv6", opts.Family)
+	}
+
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("dial retries cannot be negative")
+	}
+
+	d := &Dialer{opts: opts}
+	for _, addr := range opts.SourceAddrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", addr)
+		}
+		if opts.Family == FamilyIPv4 && ip.To4() == nil {
+			return nil, fmt.Errorf("source address %s is not IPv4", addr)
+		}
+		if opts.Family == FamilyIPv6 && ip.To4() != nil {
+			return nil, fmt.Errorf("source address %s is not IPv6", addr)
+		}
+		d.sources = append(d.sources, ip)
+	}
+
+	return d, nil
+}
+
+// Options returns the options the dialer was created with
+func (d *Dialer) Options() DialOptions {
+	return d.opts
+}
+
+// DialContext connects to address on network ("tcp" or "udp"), retrying on
+// failure. For dual-stack destinations the families are raced using Happy
+// Eyeballs (RFC 8305) unless a family or IPv4/IPv6 source address pins one.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	network = d.network(network)
+	backoff := d.opts.RetryBackoff
+
+	var lastErr error
+	for attempt := 0; attempt <= d.opts.Retries; attempt++ {
+		if attempt > 0 && backoff > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		conn, err := d.dialOnce(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if d.opts.Retries > 0 {
+		return nil, fmt.Errorf("dial %s failed after %d attempts: %w", address, d.opts.Retries+1, lastErr)
+	}
+	return nil, lastErr
+}
+
+// dialOnce makes one connection attempt. Host names are looked up with the
+// configured resolver, when there is one.
+func (d *Dialer) dialOnce(ctx context.Context, network, address string) (net.Conn, error) {
+	nd := d.dialer(network)
+	if d.opts.Resolver == nil {
+		return nd.DialContext(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nd.DialContext(ctx, network, address)
+	}
+
+	lookupNetwork := "ip"
+	switch {
+	case len(network) > 3 && network[3] == '4':
+		lookupNetwork = "ip4"
+	case len(network) > 3 && network[3] == '6':
+		lookupNetwork = "ip6"
+	}
+	addrs, err := d.opts.Resolver.LookupNetIP(ctx, lookupNetwork, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	// A source address pins the family, like it does for net.Dialer
+	if local := localIP(nd.LocalAddr); local != nil {
+		var matching []netip.Addr
+		for _, addr := range addrs {
+			if addr.Unmap().Is4() == (local.To4() != nil) {
+				matching = append(matching, addr)
+			}
+		}
+		addrs = matching
+	}
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+	return d.dialAddrs(ctx, nd, network, addrs, port)
+}
+
+// dialAddrs connects to the first reachable address. As with net.Dialer,
+// the addresses of the first one's family are tried in turn, and those of
+// the other family join the race after the fallback delay or once the
+// first family fails (Happy Eyeballs, RFC 8305).
+func (d *Dialer) dialAddrs(ctx context.Context, nd *net.Dialer, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	var primaries, fallbacks []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() == addrs[0].Unmap().Is4() {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(fallbacks) == 0 || d.opts.FallbackDelay < 0 {
+		return dialSerial(ctx, nd, network, addrs, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	race := func(addrs []netip.Addr) {
+		go func() {
+			conn, err := dialSerial(ctx, nd, network, addrs, port)
+			results <- result{conn, err}
+		}()
+	}
+
+	delay := d.opts.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+
+	race(primaries)
+	pending, raced := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-fallback.C:
+			if !raced {
+				race(fallbacks)
+				pending, raced = pending+1, true
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// The losing family's connection is closed if it still lands
+					go func() {
+						if lost := <-results; lost.conn != nil {
+							lost.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !raced {
+				race(fallbacks)
+				pending, raced = pending+1, true
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial tries addresses in turn, returning the first error when all fail
+func dialSerial(ctx context.Context, nd *net.Dialer, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := nd.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// localIP returns the IP of a dialer's local address, nil when unset
+func localIP(addr net.Addr) net.IP {
+	switch local := addr.(type) {
+	case *net.TCPAddr:
+		return local.IP
+	case *net.UDPAddr:
+		return local.IP
+	}
+	return nil
+}
+
+// network narrows a generic network to the configured IP family
+func (d *Dialer) network(network string) string {
+	switch d.opts.Family {
+	case FamilyIPv4:
+		return network + "4"
+	case FamilyIPv6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// dialer builds the net.Dialer for a single attempt
+func (d *Dialer) dialer(network string) *net.Dialer {
+	nd := &net.Dialer{
+		Timeout:       d.opts.Timeout,
+		FallbackDelay: d.opts.FallbackDelay,
+	}
+	nd.SetMultipathTCP(d.opts.MPTCP)
+
+	if len(d.sources) > 0 {
+		ip := d.sources[int(atomic.AddUint32(&d.next, 1)-1)%len(d.sources)]
+		switch network {
+		case "udp", "udp4", "udp6":
+			nd.LocalAddr = &net.UDPAddr{IP: ip}
+		default:
+			nd.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+
+	if d.opts.Interface != "" {
+		iface := d.opts.Interface
+		nd.Control = func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, iface)
+		}
+	}
+
+	return nd
+}
@@ -0,0 +1,524 @@
+package netutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Listener handover lets a new binary take over the listening sockets of a
+// running process without closing them. The running process accepts on a
+// Unix socket at a fixed path. A new process started with the same
+// configuration connects to it, receives every open listener with
+// SCM_RIGHTS and reuses those its own Listen calls ask for. Once it is
+// serving it reports ready, the old process stops accepting and drains, and
+// the new process takes over the handover socket for the next upgrade.
+// Only the owner can connect to the socket, and a peer running as another
+// user is refused, since it would receive every listening socket.
+
+const (
+	handoverVersion = 1
+
+	// maxHandoverFiles keeps each message below the kernel's SCM_MAX_FD
+	maxHandoverFiles = 200
+
+	// handoverControl names the handover socket itself among the sockets
+	handoverControl = "handover"
+)
+
+// Steps of the handover conversation
+const (
+	stepSockets = "sockets" // old to new, with descriptors attached
+	stepSent    = "sent"    // old to new, every socket was sent
+	stepReady   = "ready"   // new to old, the new process is serving
+	stepDone    = "done"    // old to new, the old process stopped accepting
+)
+
+// handoverMessage is one message on the handover socket
+type handoverMessage struct {
+	Step    string   `json:"step"`
+	Version int      `json:"version,omitempty"`
+	PID     int      `json:"pid,omitempty"`
+	Sockets []string `json:"sockets,omitempty"` // names of the attached descriptors, in order
+}
+
+// fileSocket is a listener or packet socket whose descriptor can be shared
+type fileSocket interface {
+	File() (*os.File, error)
+}
+
+// Handover hands this process's listeners to its replacement and takes
+// over those of its predecessor
+type Handover struct {
+	path    string
+	timeout time.Duration
+	uid     int // the only user a successor may run as
+	logf    func(format string, args ...interface{})
+
+	mu         sync.Mutex
+	control    *net.UnixListener
+	sockets    map[string]fileSocket // open sockets by name, offered to a successor
+	inherited  map[string]*os.File   // sockets from the predecessor not reopened yet
+	received   int
+	parent     *net.UnixConn // predecessor, until Ready
+	upgrading  bool
+	handedOver bool
+	done       chan struct{}
+}
+
+var (
+	activeHandover *Handover
+	handoverMu     sync.Mutex
+)
+
+// StartHandover enables listener handover on the Unix socket at path. If a
+// process is already listening there its sockets are inherited, otherwise
+// this process creates the socket. Call it before opening any listener, and
+// call Ready once they are all open. timeout bounds each handover.
+func StartHandover(path string, timeout time.Duration, logf func(format string, args ...interface{})) (*Handover, error) {
+	h := &Handover{
+		path:      path,
+		timeout:   timeout,
+		uid:       os.Getuid(),
+		logf:      logf,
+		sockets:   make(map[string]fileSocket),
+		inherited: make(map[string]*os.File),
+		done:      make(chan struct{}),
+	}
+
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err == nil {
+		if err := h.receive(conn); err != nil {
+			conn.Close()
+			h.closeInherited()
+			return nil, fmt.Errorf("failed to inherit listeners from %s: %w", path, err)
+		}
+		h.parent = conn
+	} else {
+		// Nothing is serving the path, so any socket file there is stale
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		control, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for handover on %s: %w", path, err)
+		}
+		control.SetUnlinkOnClose(false)
+		if err := os.Chmod(path, 0600); err != nil {
+			control.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("failed to restrict handover socket %s: %w", path, err)
+		}
+		h.control = control
+	}
+
+	handoverMu.Lock()
+	activeHandover = h
+	handoverMu.Unlock()
+	return h, nil
+}
+
+// Inherited returns how many sockets were received from the predecessor
+func (h *Handover) Inherited() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.received
+}
+
+// Done is closed once a successor has taken over the listeners. The
+// process should then shut down, draining its connections.
+func (h *Handover) Done() <-chan struct{} {
+	return h.done
+}
+
+// Ready closes inherited sockets that weren't reopened, tells the
+// predecessor to stop accepting and starts accepting successors
+func (h *Handover) Ready() error {
+	h.closeInherited()
+
+	h.mu.Lock()
+	parent := h.parent
+	h.parent = nil
+	h.mu.Unlock()
+
+	var err error
+	if parent != nil {
+		err = h.confirm(parent)
+		parent.Close()
+	}
+	go h.serve()
+	return err
+}
+
+// confirm reports ready to the predecessor and waits for it to stop
+func (h *Handover) confirm(parent *net.UnixConn) error {
+	parent.SetDeadline(time.Now().Add(h.timeout))
+	if err := writeHandoverMessage(parent, handoverMessage{Step: stepReady, PID: os.Getpid()}, nil); err != nil {
+		return fmt.Errorf("failed to report ready to the previous process: %w", err)
+	}
+	msg, files, err := readHandoverMessage(parent)
+	closeFiles(files)
+	if err != nil {
+		return fmt.Errorf("previous process did not confirm the handover: %w", err)
+	}
+	if msg.Step != stepDone {
+		return fmt.Errorf("unexpected handover step %q", msg.Step)
+	}
+	return nil
+}
+
+// Upgrade starts the current executable, which may have been replaced on
+// disk since, with the same arguments and waits for it to take over
+func (h *Handover) Upgrade() error {
+	h.mu.Lock()
+	if h.upgrading {
+		h.mu.Unlock()
+		return errors.New("an upgrade is already in progress")
+	}
+	h.upgrading = true
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.upgrading = false
+		h.mu.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", exe, err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case <-h.done:
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("new process exited before taking over: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		return fmt.Errorf("new process did not take over within %s", h.timeout)
+	}
+}
+
+// Close stops accepting successors and removes the handover socket, unless
+// a successor has taken it over
+func (h *Handover) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handedOver || h.control == nil {
+		return nil
+	}
+	h.control.Close()
+	if err := os.Remove(h.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// serve hands the listeners to the first successor that completes a handover
+func (h *Handover) serve() {
+	h.mu.Lock()
+	control := h.control
+	h.mu.Unlock()
+	if control == nil {
+		return
+	}
+
+	for {
+		conn, err := control.AcceptUnix()
+		if err != nil {
+			return // closed
+		}
+		if uid, err := peerUID(conn); err != nil || uid != h.uid {
+			conn.Close()
+			if err != nil {
+				h.logf("Listener handover refused: %v", err)
+			} else {
+				h.logf("Listener handover refused: peer runs as uid %d, not %d", uid, h.uid)
+			}
+			continue
+		}
+		pid, err := h.handOver(conn)
+		conn.Close()
+		if err != nil {
+			h.logf("Listener handover failed: %v", err)
+			continue
+		}
+		h.logf("Listeners handed over to process %d", pid)
+		return
+	}
+}
+
+// handOver sends every open socket to a successor and, once it is ready,
+// stops accepting successors and closes Done
+func (h *Handover) handOver(conn *net.UnixConn) (int, error) {
+	names, files := h.files()
+	defer closeFiles(files)
+
+	conn.SetDeadline(time.Now().Add(h.timeout))
+	for start := 0; start < len(files); start += maxHandoverFiles {
+		end := start + maxHandoverFiles
+		if end > len(files) {
+			end = len(files)
+		}
+		msg := handoverMessage{Step: stepSockets, Version: handoverVersion, Sockets: names[start:end]}
+		if err := writeHandoverMessage(conn, msg, files[start:end]); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeHandoverMessage(conn, handoverMessage{Step: stepSent, Version: handoverVersion}, nil); err != nil {
+		return 0, err
+	}
+
+	msg, extra, err := readHandoverMessage(conn)
+	closeFiles(extra)
+	if err != nil {
+		return 0, fmt.Errorf("new process did not become ready: %w", err)
+	}
+	if msg.Step != stepReady {
+		return 0, fmt.Errorf("unexpected handover step %q", msg.Step)
+	}
+
+	h.mu.Lock()
+	h.handedOver = true
+	h.control.Close()
+	h.mu.Unlock()
+	close(h.done)
+
+	// The successor serves either way, so a lost reply only delays it
+	writeHandoverMessage(conn, handoverMessage{Step: stepDone}, nil)
+	return msg.PID, nil
+}
+
+// files duplicates the descriptors of every open socket and the handover
+// socket, forgetting sockets that have been closed
+func (h *Handover) files() ([]string, []*os.File) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	names := make([]string, 0, len(h.sockets)+1)
+	for name := range h.sockets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sent := make([]string, 0, len(names)+1)
+	files := make([]*os.File, 0, len(names)+1)
+	for _, name := range names {
+		f, err := h.sockets[name].File()
+		if err != nil {
+			delete(h.sockets, name)
+			continue
+		}
+		sent = append(sent, name)
+		files = append(files, f)
+	}
+	if f, err := h.control.File(); err == nil {
+		sent = append(sent, handoverControl)
+		files = append(files, f)
+	}
+	return sent, files
+}
+
+// receive reads the sockets a predecessor sends
+func (h *Handover) receive(conn *net.UnixConn) error {
+	conn.SetDeadline(time.Now().Add(h.timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	for {
+		msg, files, err := readHandoverMessage(conn)
+		if err != nil {
+			return err
+		}
+		if msg.Version != handoverVersion {
+			closeFiles(files)
+			return fmt.Errorf("handover version %d is not supported", msg.Version)
+		}
+		switch msg.Step {
+		case stepSockets:
+			if len(files) != len(msg.Sockets) {
+				closeFiles(files)
+				return fmt.Errorf("received %d descriptors for %d sockets", len(files), len(msg.Sockets))
+			}
+			for i, name := range msg.Sockets {
+				h.inherited[name] = files[i]
+				h.received++
+			}
+		case stepSent:
+			closeFiles(files)
+			f := h.inherited[handoverControl]
+			if f == nil {
+				return errors.New("handover socket was not sent")
+			}
+			delete(h.inherited, handoverControl)
+			h.received--
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			control, ok := l.(*net.UnixListener)
+			if !ok {
+				l.Close()
+				return errors.New("handover socket is not a Unix socket")
+			}
+			control.SetUnlinkOnClose(false)
+			h.control = control
+			return nil
+		default:
+			closeFiles(files)
+			return fmt.Errorf("unexpected handover step %q", msg.Step)
+		}
+	}
+}
+
+// take returns the inherited socket of name, if any
+func (h *Handover) take(name string) *os.File {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f := h.inherited[name]
+	delete(h.inherited, name)
+	return f
+}
+
+// track offers an open socket to successors
+func (h *Handover) track(name string, socket interface{}) {
+	s, ok := socket.(fileSocket)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sockets[name] = s
+}
+
+// closeInherited closes the inherited sockets nothing reopened
+func (h *Handover) closeInherited() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, f := range h.inherited {
+		f.Close()
+		delete(h.inherited, name)
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// currentHandover returns the handover Listen should use, if enabled
+func currentHandover() *Handover {
+	handoverMu.Lock()
+	defer handoverMu.Unlock()
+	return activeHandover
+}
+
+// socketName names a socket by what it was opened for, so a successor with
+// the same configuration asks for it by the same name
+func socketName(network, address, iface string) string {
+	return network + "/" + address + "/" + iface
+}
+
+// inheritListener returns the inherited listener of name, or opens a new one
+func inheritListener(name string, open func() (net.Listener, error)) (net.Listener, error) {
+	h := currentHandover()
+	if h == nil {
+		return open()
+	}
+	if f := h.take(name); f != nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			h.track(name, l)
+			return l, nil
+		}
+		h.logf("Failed to reuse inherited listener %s, opening a new one: %v", name, err)
+	}
+	l, err := open()
+	if err != nil {
+		return nil, err
+	}
+	h.track(name, l)
+	return l, nil
+}
+
+// inheritPacketConn returns the inherited packet socket of name, or opens a
+// new one
+func inheritPacketConn(name string, open func() (net.PacketConn, error)) (net.PacketConn, error) {
+	h := currentHandover()
+	if h == nil {
+		return open()
+	}
+	if f := h.take(name); f != nil {
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			h.track(name, conn)
+			return conn, nil
+		}
+		h.logf("Failed to reuse inherited socket %s, opening a new one: %v", name, err)
+	}
+	conn, err := open()
+	if err != nil {
+		return nil, err
+	}
+	h.track(name, conn)
+	return conn, nil
+}
+
+// writeHandoverMessage sends msg with files attached
+func writeHandoverMessage(conn *net.UnixConn, msg handoverMessage, files []*os.File) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	oob, err := unixRights(files)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// readHandoverMessage receives a message and the files attached to it
+func readHandoverMessage(conn *net.UnixConn) (handoverMessage, []*os.File, error) {
+	var msg handoverMessage
+	b := make([]byte, 64*1024)
+	oob := make([]byte, rightsSpace(maxHandoverFiles))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return msg, nil, err
+	}
+	files, err := parseUnixRights(oob[:oobn])
+	if err != nil {
+		return msg, nil, err
+	}
+	if n == 0 {
+		closeFiles(files)
+		return msg, nil, io.EOF
+	}
+	if err := json.Unmarshal(b[:n], &msg); err != nil {
+		closeFiles(files)
+		return msg, nil, err
+	}
+	return msg, files, nil
+}
@@ -0,0 +1,217 @@
+//go:build linux
+
+package netutil
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetHandover stands in for a process exiting, clearing the active handover
+func resetHandover() {
+	handoverMu.Lock()
+	activeHandover = nil
+	handoverMu.Unlock()
+}
+
+// discardf drops handover logs, which can come after the test ends
+func discardf(format string, args ...interface{}) {}
+
+func TestHandover(t *testing.T) {
+	t.Cleanup(resetHandover)
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	old, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldListener, err := Listen("tcp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPacket, err := ListenPacket("udp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closed listeners aren't handed over
+	closed, err := Listen("tcp", "127.0.0.2:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if err := old.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if old.Inherited() != 0 {
+		t.Errorf("first process inherited %d sockets", old.Inherited())
+	}
+
+	// The replacement asks for the same addresses and gets the same sockets
+	resetHandover()
+	next, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Inherited() != 2 {
+		t.Errorf("inherited %d sockets, want the 2 still open", next.Inherited())
+	}
+	listener, err := Listen("tcp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if listener.Addr().String() != oldListener.Addr().String() {
+		t.Errorf("inherited listener on %s, want %s", listener.Addr(), oldListener.Addr())
+	}
+	packet, err := ListenPacket("udp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	if packet.LocalAddr().String() != oldPacket.LocalAddr().String() {
+		t.Errorf("inherited packet socket on %s, want %s", packet.LocalAddr(), oldPacket.LocalAddr())
+	}
+
+	select {
+	case <-old.Done():
+		t.Fatal("old process stopped before the new one was ready")
+	default:
+	}
+	if err := next.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-old.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("old process was not told to stop")
+	}
+
+	// Connections made while the old process drains reach the new one
+	oldListener.Close()
+	oldPacket.Close()
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// The new process now serves the handover socket for the next upgrade
+	resetHandover()
+	third, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Inherited() != 2 {
+		t.Errorf("next upgrade inherited %d sockets, want 2", third.Inherited())
+	}
+	if err := third.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	<-next.Done()
+	third.Close()
+}
+
+func TestHandoverReusePortGroup(t *testing.T) {
+	t.Cleanup(resetHandover)
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	old, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldListeners, err := ListenReusePort("tcp", "127.0.0.1:0", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each acceptor socket of the group is inherited by its position
+	resetHandover()
+	next, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := ListenReusePort("tcp", "127.0.0.1:0", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Inherited() != 3 {
+		t.Errorf("inherited %d sockets, want 3", next.Inherited())
+	}
+	for i, l := range listeners {
+		if l.Addr().String() != oldListeners[0].Addr().String() {
+			t.Errorf("acceptor %d on %s, want %s", i, l.Addr(), oldListeners[0].Addr())
+		}
+	}
+	if err := next.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	<-old.Done()
+	for _, l := range append(oldListeners, listeners...) {
+		l.Close()
+	}
+	next.Close()
+}
+
+func TestHandoverSocketMode(t *testing.T) {
+	t.Cleanup(resetHandover)
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	h, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("handover socket mode %o, want 600", mode)
+	}
+}
+
+func TestHandoverRefusesOtherUser(t *testing.T) {
+	t.Cleanup(resetHandover)
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	old, err := StartHandover(path, 5*time.Second, discardf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	listener, err := Listen("tcp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Pretend the process runs as someone else, so this one is a stranger
+	old.uid = os.Getuid() + 1
+	if err := old.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	resetHandover()
+	if next, err := StartHandover(path, time.Second, discardf); err == nil {
+		next.Close()
+		t.Fatal("expected a peer running as another user to be refused")
+	}
+	select {
+	case <-old.Done():
+		t.Fatal("old process handed over to a refused peer")
+	default:
+	}
+}
@@ -0,0 +1,34 @@
+package netutil
+
+import "net"
+
+// MPTCPSubflows returns the number of subflows carrying a Multipath TCP
+// connection, including the initial one. ok is false when the connection
+// is plain TCP, including MPTCP sockets that fell back to TCP.
+func MPTCPSubflows(conn net.Conn) (subflows int, ok bool) {
+	for {
+		wrapped, isWrapped := conn.(interface{ NetConn() net.Conn })
+		if !isWrapped {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+
+	tcpConn, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		return 0, false
+	}
+	if multipath, err := tcpConn.MultipathTCP(); err != nil || !multipath {
+		return 0, false
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 1, true
+	}
+	extra, err := mptcpExtraSubflows(rawConn)
+	if err != nil {
+		return 1, true
+	}
+	return extra + 1, true
+}
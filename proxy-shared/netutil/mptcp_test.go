@@ -0,0 +1,82 @@
+package netutil
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestMPTCPLoopback tests an MPTCP listener and dialer over loopback
+func TestMPTCPLoopback(t *testing.T) {
+	if !MPTCPSupported() {
+		t.Skip("MPTCP is not enabled in this kernel")
+	}
+
+	listeners, err := ListenMPTCP("tcp", JoinHostPort("127.0.0.1", 0), "", 1)
+	if err != nil {
+		t.Fatalf("ListenMPTCP failed: %v", err)
+	}
+	defer listeners[0].Close()
+
+	accepted := make(chan int, 1)
+	go func() {
+		conn, err := listeners[0].Accept()
+		if err != nil {
+			accepted <- 0
+			return
+		}
+		defer conn.Close()
+		subflows, _ := MPTCPSubflows(conn)
+		accepted <- subflows
+	}()
+
+	dialer, err := NewDialer(DialOptions{Timeout: time.Second, MPTCP: true})
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+
+	subflows, ok := MPTCPSubflows(conn)
+	if !ok {
+		t.Skip("MPTCP handshake fell back to TCP")
+	}
+	if subflows < 1 {
+		t.Errorf("client subflows = %d, want at least 1", subflows)
+	}
+	if server := <-accepted; server < 1 {
+		t.Errorf("server subflows = %d, want at least 1", server)
+	}
+}
+
+// TestMPTCPSubflowsPlainTCP tests that plain TCP connections report no subflows
+func TestMPTCPSubflowsPlainTCP(t *testing.T) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	dialer, err := NewDialer(DialOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+
+	if _, ok := MPTCPSubflows(conn); ok {
+		t.Error("MPTCPSubflows reported MPTCP on a plain TCP connection")
+	}
+}
@@ -0,0 +1,86 @@
+package netutil
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// TestListenReusePort tests opening several listeners on one address
+func TestListenReusePort(t *testing.T) {
+	listeners, err := ListenReusePort("tcp", JoinHostPort("127.0.0.1", 0), "", 4)
+	if err != nil {
+		t.Skipf("SO_REUSEPORT not available: %v", err)
+	}
+	defer closeAll(listeners)
+
+	if len(listeners) != 4 {
+		t.Fatalf("got %d listeners, want 4", len(listeners))
+	}
+	addr := listeners[0].Addr().String()
+	for _, l := range listeners[1:] {
+		if l.Addr().String() != addr {
+			t.Errorf("listener address = %s, want %s", l.Addr(), addr)
+		}
+	}
+}
+
+// BenchmarkAcceptSingle measures connection rate with one accept loop
+func BenchmarkAcceptSingle(b *testing.B) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		b.Fatalf("Listen failed: %v", err)
+	}
+	benchmarkAccept(b, []net.Listener{listener})
+}
+
+// BenchmarkAcceptReusePort measures connection rate with one SO_REUSEPORT accept loop per CPU
+func BenchmarkAcceptReusePort(b *testing.B) {
+	listeners, err := ListenReusePort("tcp", JoinHostPort("127.0.0.1", 0), "", DefaultAcceptors())
+	if err != nil {
+		b.Skipf("SO_REUSEPORT not available: %v", err)
+	}
+	benchmarkAccept(b, listeners)
+}
+
+// benchmarkAccept dials b.N connections in parallel and accepts them on the listeners
+func benchmarkAccept(b *testing.B, listeners []net.Listener) {
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}(l)
+	}
+
+	addr := listeners[0].Addr().String()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Errorf("Dial failed: %v", err)
+				return
+			}
+			conn.Close()
+		}
+	})
+	b.StopTimer()
+
+	closeAll(listeners)
+	wg.Wait()
+}
+
+// closeAll closes every listener
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
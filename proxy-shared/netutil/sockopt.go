@@ -0,0 +1,101 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPOptions tunes an established TCP connection. Zero values keep the
+// kernel or Go runtime defaults.
+type TCPOptions struct {
+	NoDelay           *bool         // TCP_NODELAY, nil keeps the Go default (enabled)
+	KeepAlive         time.Duration // Idle time before the first keepalive probe, negative disables keepalive
+	KeepAliveInterval time.Duration // Time between unanswered keepalive probes
+	KeepAliveCount    int           // Unanswered probes before the connection is dropped
+	SendBuffer        int           // SO_SNDBUF in bytes
+	RecvBuffer        int           // SO_RCVBUF in bytes
+	UserTimeout       time.Duration // TCP_USER_TIMEOUT, max time sent data may stay unacknowledged (Linux only)
+}
+
+// Validate checks that the options are in range
+func (o TCPOptions) Validate() error {
+	if o.KeepAliveInterval < 0 {
+		return fmt.Errorf("keepalive interval cannot be negative")
+	}
+	if o.KeepAliveCount < 0 {
+		return fmt.Errorf("keepalive count cannot be negative")
+	}
+	if o.SendBuffer < 0 || o.RecvBuffer < 0 {
+		return fmt.Errorf("socket buffer sizes cannot be negative")
+	}
+	if o.UserTimeout < 0 {
+		return fmt.Errorf("user timeout cannot be negative")
+	}
+	if o.UserTimeout > 0 && o.UserTimeout < time.Millisecond {
+		return fmt.Errorf("user timeout must be at least 1ms")
+	}
+	return nil
+}
+
+// ApplyTCPOptions sets opts on conn. TLS connections are unwrapped to the
+// underlying socket; connections that are not TCP are left untouched.
+func ApplyTCPOptions(conn net.Conn, opts TCPOptions) error {
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if opts.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*opts.NoDelay); err != nil {
+			return fmt.Errorf("failed to set TCP_NODELAY: %w", err)
+		}
+	}
+
+	if opts.KeepAlive < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return fmt.Errorf("failed to disable keepalive: %w", err)
+		}
+	} else if opts.KeepAlive > 0 || opts.KeepAliveInterval > 0 || opts.KeepAliveCount > 0 {
+		err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     opts.KeepAlive,
+			Interval: opts.KeepAliveInterval,
+			Count:    opts.KeepAliveCount,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to configure keepalive: %w", err)
+		}
+	}
+
+	if opts.SendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set send buffer: %w", err)
+		}
+	}
+	if opts.RecvBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(opts.RecvBuffer); err != nil {
+			return fmt.Errorf("failed to set receive buffer: %w", err)
+		}
+	}
+
+	if opts.UserTimeout > 0 {
+		rawConn, err := tcpConn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := setUserTimeout(rawConn, opts.UserTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
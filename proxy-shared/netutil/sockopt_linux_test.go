@@ -0,0 +1,53 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestApplyTCPOptionsLinux tests that Linux-only options reach the socket
+func TestApplyTCPOptionsLinux(t *testing.T) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	noDelay := false
+	opts := TCPOptions{NoDelay: &noDelay, UserTimeout: 2500 * time.Millisecond}
+	if err := ApplyTCPOptions(conn, opts); err != nil {
+		t.Fatalf("ApplyTCPOptions failed: %v", err)
+	}
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+
+	var userTimeout, nodelay int
+	rawConn.Control(func(fd uintptr) {
+		userTimeout, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+		nodelay, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+	})
+	if userTimeout != 2500 {
+		t.Errorf("TCP_USER_TIMEOUT = %d, want 2500", userTimeout)
+	}
+	if nodelay != 0 {
+		t.Errorf("TCP_NODELAY = %d, want 0", nodelay)
+	}
+}
@@ -0,0 +1,67 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestTCPOptionsValidate tests socket option validation
+func TestTCPOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  TCPOptions
+		valid bool
+	}{
+		{"defaults", TCPOptions{}, true},
+		{"keepalive disabled", TCPOptions{KeepAlive: -1}, true},
+		{"tuned", TCPOptions{KeepAlive: 30 * time.Second, KeepAliveInterval: 5 * time.Second, KeepAliveCount: 3, SendBuffer: 1 << 20, UserTimeout: 10 * time.Second}, true},
+		{"negative interval", TCPOptions{KeepAliveInterval: -time.Second}, false},
+		{"negative count", TCPOptions{KeepAliveCount: -1}, false},
+		{"negative buffer", TCPOptions{RecvBuffer: -1}, false},
+		{"sub-millisecond user timeout", TCPOptions{UserTimeout: time.Microsecond}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("Validate() error = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+// TestApplyTCPOptions tests applying socket options to a live connection
+func TestApplyTCPOptions(t *testing.T) {
+	listener, err := Listen("tcp", JoinHostPort("127.0.0.1", 0), "")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	noDelay := false
+	opts := TCPOptions{
+		NoDelay:           &noDelay,
+		KeepAlive:         30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		KeepAliveCount:    3,
+		SendBuffer:        64 * 1024,
+		RecvBuffer:        64 * 1024,
+	}
+	if err := ApplyTCPOptions(conn, opts); err != nil {
+		t.Fatalf("ApplyTCPOptions failed: %v", err)
+	}
+}
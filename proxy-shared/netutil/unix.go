@@ -0,0 +1,77 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UnixPrefix marks a listen address as a unix socket path
+const UnixPrefix = "unix:"
+
+// DefaultSocketMode lets the owner and group connect to a unix socket
+const DefaultSocketMode os.FileMode = 0660
+
+// ParseSocketMode parses octal unix socket permissions such as "0660",
+// DefaultSocketMode when empty
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return DefaultSocketMode, nil
+	}
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q: must be octal permissions such as 0660", mode)
+	}
+	return os.FileMode(bits), nil
+}
+
+// ListenUnix opens a stream listener on the unix socket at path with file
+// permissions mode. A socket left behind by a crashed process is replaced,
+// one a live process still accepts on is not. With handover enabled, a
+// listener inherited for the same path is reused.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	removeStaleSocket(path)
+	listener, err := Listen("unix", path, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// ListenStream opens a stream listener on address, the unix socket at
+// unix:/path with file permissions mode or a TCP address bound to iface
+func ListenStream(address, iface string, mode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, UnixPrefix); ok {
+		return ListenUnix(path, mode)
+	}
+	return Listen("tcp", address, iface)
+}
+
+// removeStaleSocket removes the socket file at path unless a process
+// accepts on it
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// keepSocketFile stops a unix listener removing its socket file on Close
+// while handover is enabled, as the successor it was handed to serves on
+// the same file
+func keepSocketFile(listener net.Listener) {
+	if ul, ok := listener.(*net.UnixListener); ok && currentHandover() != nil {
+		ul.SetUnlinkOnClose(false)
+	}
+}
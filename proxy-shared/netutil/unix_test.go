@@ -0,0 +1,84 @@
+package netutil
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestParseSocketMode tests octal socket permission parsing
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		mode  string
+		want  os.FileMode
+		valid bool
+	}{
+		{"", DefaultSocketMode, true},
+		{"0600", 0600, true},
+		{"660", 0660, true},
+		{"0777", 0777, true},
+		{"1777", 0, false},
+		{"0686", 0, false},
+		{"rw-rw----", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSocketMode(tt.mode)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseSocketMode(%q) error = %v, valid %t", tt.mode, err, tt.valid)
+			continue
+		}
+		if tt.valid && got != tt.want {
+			t.Errorf("ParseSocketMode(%q) = %o, want %o", tt.mode, got, tt.want)
+		}
+	}
+}
+
+// TestListenUnix tests socket permissions and stale socket replacement
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	listener, err := ListenStream(UnixPrefix+path, "", 0600)
+	if err != nil {
+		t.Fatalf("ListenStream: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %o, want 600", info.Mode().Perm())
+	}
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	conn.Close()
+
+	// A socket a live listener accepts on is kept
+	if _, err := ListenUnix(path, 0600); err == nil {
+		t.Error("second listener replaced a live socket")
+	}
+
+	// Leave the socket file behind, as a crash would
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, err = ListenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	listener.Close()
+}
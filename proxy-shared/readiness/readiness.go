@@ -0,0 +1,115 @@
+// Package readiness tracks the startup steps a proxy must finish before it
+// takes traffic. /healthz only says the process is alive; /readyz stays
+// unavailable until every step has succeeded, so rollouts wait for
+// replicas that can actually serve.
+package readiness
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Startup steps
+const (
+	StepRegistration = "registration" // Registered with the manager
+	StepConfig       = "config"       // Configuration loaded or fetched
+	StepListeners    = "listeners"    // Every listener bound
+	StepEBPF         = "ebpf"         // eBPF programs loaded
+)
+
+// Status is the readiness reported on /readyz
+type Status struct {
+	Ready   bool              `json:"ready"`
+	Pending []string          `json:"pending,omitempty"` // Steps not done yet, in startup order
+	Failed  map[string]string `json:"failed,omitempty"`  // Last error of pending steps
+	Unready string            `json:"unready,omitempty"` // Why a ready process stopped taking traffic
+}
+
+// Tracker records which startup steps are done
+type Tracker struct {
+	mu      sync.Mutex
+	steps   []string
+	done    map[string]bool
+	failed  map[string]string
+	unready string
+}
+
+// New creates a tracker waiting for steps
+func New(steps ...string) *Tracker {
+	return &Tracker{
+		steps:  steps,
+		done:   make(map[string]bool, len(steps)),
+		failed: make(map[string]string),
+	}
+}
+
+// Done marks a step as succeeded. Steps the tracker doesn't wait for are
+// ignored.
+func (t *Tracker) Done(step string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[step] = true
+	delete(t.failed, step)
+}
+
+// Fail records why a step has not succeeded. The step stays pending.
+func (t *Tracker) Fail(step string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[step] = false
+	t.failed[step] = err.Error()
+}
+
+// SetUnready takes a ready process out of rotation with a reason, such as
+// a drain, or puts it back with "".
+func (t *Tracker) SetUnready(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unready = reason
+}
+
+// Status returns the pending steps and whether the process is ready
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := Status{Unready: t.unready}
+	for _, step := range t.steps {
+		if t.done[step] {
+			continue
+		}
+		status.Pending = append(status.Pending, step)
+		if err, ok := t.failed[step]; ok {
+			if status.Failed == nil {
+				status.Failed = make(map[string]string)
+			}
+			status.Failed[step] = err
+		}
+	}
+	status.Ready = len(status.Pending) == 0 && t.unready == ""
+	return status
+}
+
+// Ready reports whether every step is done
+func (t *Tracker) Ready() bool {
+	return t.Status().Ready
+}
+
+// ServeHTTP serves /readyz: 200 once ready, otherwise 503 with the
+// pending steps
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := t.Status()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,69 @@
+package readiness
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// get requests /readyz and decodes the status
+func get(t *testing.T, tracker *Tracker) (int, Status) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	tracker.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var status Status
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, status
+}
+
+func TestTracker(t *testing.T) {
+	tracker := New(StepRegistration, StepConfig, StepListeners)
+
+	code, status := get(t, tracker)
+	if code != http.StatusServiceUnavailable || status.Ready {
+		t.Fatalf("fresh tracker answered %d %+v", code, status)
+	}
+	if want := []string{StepRegistration, StepConfig, StepListeners}; !reflect.DeepEqual(status.Pending, want) {
+		t.Errorf("pending %v, want %v", status.Pending, want)
+	}
+
+	tracker.Done(StepRegistration)
+	tracker.Fail(StepConfig, errors.New("manager unreachable"))
+	tracker.Done(StepEBPF) // not waited for
+	_, status = get(t, tracker)
+	if want := []string{StepConfig, StepListeners}; !reflect.DeepEqual(status.Pending, want) {
+		t.Errorf("pending %v, want %v", status.Pending, want)
+	}
+	if status.Failed[StepConfig] != "manager unreachable" {
+		t.Errorf("failures %v", status.Failed)
+	}
+
+	tracker.Done(StepConfig)
+	tracker.Done(StepListeners)
+	code, status = get(t, tracker)
+	if code != http.StatusOK || !status.Ready || len(status.Failed) != 0 {
+		t.Errorf("finished tracker answered %d %+v", code, status)
+	}
+
+	tracker.SetUnready("draining")
+	if code, status = get(t, tracker); code != http.StatusServiceUnavailable || status.Unready != "draining" {
+		t.Errorf("draining tracker answered %d %+v", code, status)
+	}
+	tracker.SetUnready("")
+	if !tracker.Ready() {
+		t.Error("tracker not ready after the drain was cleared")
+	}
+}
+
+func TestTrackerMethods(t *testing.T) {
+	w := httptest.NewRecorder()
+	New().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d", w.Code)
+	}
+}
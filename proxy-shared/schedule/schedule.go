@@ -0,0 +1,225 @@
+// Package schedule decides when time-limited mappings and routes are
+// active. A schedule combines an optional validity period, for temporary
+// grants that expire on their own, with recurring weekly windows such as
+// business hours or a maintenance window. Proxies evaluate schedules with
+// their own clock, tolerating a configurable skew against the manager's.
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxClockSkew bounds the tolerance, which must stay well below the
+// shortest window
+const MaxClockSkew = 5 * time.Minute
+
+// Schedule limits when a mapping or route is active. The zero value and a
+// nil schedule are always active.
+type Schedule struct {
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`  // Inactive before, RFC 3339
+	ValidUntil *time.Time `json:"valid_until,omitempty"` // Inactive from, RFC 3339
+	Timezone   string     `json:"timezone,omitempty"`    // IANA zone of the windows, UTC when empty
+	Windows    []Window   `json:"windows,omitempty"`     // Active only within one of these, always when empty
+}
+
+// Window is a recurring daily period. End before Start wraps past midnight,
+// so 22:00-06:00 on fri runs into Saturday morning.
+type Window struct {
+	Days  []string `json:"days,omitempty"` // mon, tue, ... sun; every day when empty
+	Start string   `json:"start"`          // HH:MM
+	End   string   `json:"end"`            // HH:MM, exclusive; 24:00 is midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Validate checks the timezone, window times and days
+func (s *Schedule) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if _, err := s.location(); err != nil {
+		return err
+	}
+	if s.ValidFrom != nil && s.ValidUntil != nil && !s.ValidUntil.After(*s.ValidFrom) {
+		return fmt.Errorf("valid_until must be after valid_from")
+	}
+	for i, w := range s.Windows {
+		if _, _, err := w.minutes(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+		if _, err := w.days(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Active reports whether the schedule is active at now. A schedule active
+// anywhere within skew of now counts as active, so proxies whose clocks
+// drift from the manager's by up to skew still agree with it at the edges.
+// Invalid schedules are never active.
+func (s *Schedule) Active(now time.Time, skew time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	if s.Validate() != nil {
+		return false
+	}
+	return s.activeAt(now) || (skew > 0 && (s.activeAt(now.Add(-skew)) || s.activeAt(now.Add(skew))))
+}
+
+// activeAt evaluates the schedule at exactly t
+func (s *Schedule) activeAt(t time.Time) bool {
+	if s.ValidFrom != nil && t.Before(*s.ValidFrom) {
+		return false
+	}
+	if s.ValidUntil != nil && !t.Before(*s.ValidUntil) {
+		return false
+	}
+	if len(s.Windows) == 0 {
+		return true
+	}
+
+	loc, _ := s.location()
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range s.Windows {
+		start, end, _ := w.minutes()
+		days, _ := w.days()
+		if start < end {
+			if days[local.Weekday()] && minute >= start && minute < end {
+				return true
+			}
+			continue
+		}
+		// Wrapping windows belong to the day they start on
+		yesterday := (local.Weekday() + 6) % 7
+		if (days[local.Weekday()] && minute >= start) || (days[yesterday] && minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns when the schedule next turns on or off after now,
+// ignoring skew. It is zero when the schedule doesn't change again, such as
+// an open-ended grant without windows.
+func (s *Schedule) NextChange(now time.Time) time.Time {
+	if s == nil || s.Validate() != nil {
+		return time.Time{}
+	}
+
+	var candidates []time.Time
+	if s.ValidFrom != nil && s.ValidFrom.After(now) {
+		candidates = append(candidates, *s.ValidFrom)
+	}
+	if s.ValidUntil != nil && s.ValidUntil.After(now) {
+		candidates = append(candidates, *s.ValidUntil)
+	}
+
+	// Window edges over the next eight days, from the later of now and
+	// valid_from
+	loc, _ := s.location()
+	from := now
+	if s.ValidFrom != nil && s.ValidFrom.After(from) {
+		from = *s.ValidFrom
+	}
+	day := from.In(loc)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	for d := 0; d <= 8; d++ {
+		midnight := day.AddDate(0, 0, d)
+		for _, w := range s.Windows {
+			start, end, _ := w.minutes()
+			for _, m := range []int{start, end} {
+				edge := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), m/60, m%60, 0, 0, loc)
+				if edge.After(now) {
+					candidates = append(candidates, edge)
+				}
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	active := s.activeAt(now)
+	for _, c := range candidates {
+		if s.activeAt(c) != active {
+			return c
+		}
+	}
+	return time.Time{}
+}
+
+// locations caches loaded timezones, which are read from disk otherwise
+var locations sync.Map
+
+func (s *Schedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := locations.Load(s.Timezone); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+	locations.Store(s.Timezone, loc)
+	return loc, nil
+}
+
+// minutes returns the start and end as minutes after midnight
+func (w Window) minutes() (start, end int, err error) {
+	if start, err = parseClock(w.Start); err != nil {
+		return 0, 0, fmt.Errorf("start: %w", err)
+	}
+	if end, err = parseClock(w.End); err != nil {
+		return 0, 0, fmt.Errorf("end: %w", err)
+	}
+	if start == end || start == 24*60 {
+		return 0, 0, fmt.Errorf("window is empty")
+	}
+	return start, end, nil
+}
+
+// days returns the weekdays a window starts on
+func (w Window) days() ([7]bool, error) {
+	var days [7]bool
+	if len(w.Days) == 0 {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, name := range w.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", name)
+		}
+		days[day] = true
+	}
+	return days, nil
+}
+
+// parseClock parses HH:MM into minutes after midnight, allowing 24:00
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
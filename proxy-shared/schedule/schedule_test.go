@@ -0,0 +1,122 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func at(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
+
+// TestActive tests validity periods, weekly windows and wrapping windows
+func TestActive(t *testing.T) {
+	businessHours := &Schedule{
+		Timezone: "Europe/Berlin",
+		Windows:  []Window{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"}},
+	}
+	maintenance := &Schedule{
+		Windows: []Window{{Days: []string{"fri"}, Start: "22:00", End: "02:00"}},
+	}
+	grant := &Schedule{
+		ValidFrom:  ptr(at("2026-03-01T00:00:00Z")),
+		ValidUntil: ptr(at("2026-03-08T00:00:00Z")),
+	}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		now      string
+		want     bool
+	}{
+		{"nil schedule", nil, "2026-03-02T12:00:00Z", true},
+		{"business hours", businessHours, "2026-03-02T10:00:00Z", true}, // Monday 11:00 in Berlin
+		{"before business hours", businessHours, "2026-03-02T07:30:00Z", false},
+		{"weekend", businessHours, "2026-03-07T10:00:00Z", false},
+		{"maintenance friday", maintenance, "2026-03-06T23:00:00Z", true},
+		{"maintenance saturday morning", maintenance, "2026-03-07T01:59:00Z", true},
+		{"after maintenance", maintenance, "2026-03-07T02:00:00Z", false},
+		{"sunday morning", maintenance, "2026-03-08T01:00:00Z", false},
+		{"grant", grant, "2026-03-05T00:00:00Z", true},
+		{"grant expired", grant, "2026-03-08T00:00:00Z", false},
+		{"grant not started", grant, "2026-02-28T23:59:59Z", false},
+		{"invalid", &Schedule{Timezone: "Mars/Olympus"}, "2026-03-05T00:00:00Z", false},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.Active(at(tt.now), 0); got != tt.want {
+			t.Errorf("%s: Active(%s) = %t, want %t", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+// TestClockSkew tests that edges are tolerated by the skew either side
+func TestClockSkew(t *testing.T) {
+	grant := &Schedule{
+		ValidFrom:  ptr(at("2026-03-01T00:00:00Z")),
+		ValidUntil: ptr(at("2026-03-08T00:00:00Z")),
+	}
+	skew := 30 * time.Second
+
+	if !grant.Active(at("2026-02-28T23:59:45Z"), skew) {
+		t.Error("grant starting within the skew not active")
+	}
+	if !grant.Active(at("2026-03-08T00:00:20Z"), skew) {
+		t.Error("grant expired within the skew not active")
+	}
+	if grant.Active(at("2026-03-08T00:01:00Z"), skew) {
+		t.Error("grant expired beyond the skew still active")
+	}
+}
+
+// TestNextChange tests the next transition of windows and validity periods
+func TestNextChange(t *testing.T) {
+	maintenance := &Schedule{
+		Windows: []Window{{Days: []string{"fri"}, Start: "22:00", End: "02:00"}},
+	}
+	if got, want := maintenance.NextChange(at("2026-03-02T12:00:00Z")), at("2026-03-06T22:00:00Z"); !got.Equal(want) {
+		t.Errorf("NextChange = %v, want %v", got, want)
+	}
+	if got, want := maintenance.NextChange(at("2026-03-06T23:00:00Z")), at("2026-03-07T02:00:00Z"); !got.Equal(want) {
+		t.Errorf("NextChange = %v, want %v", got, want)
+	}
+
+	grant := &Schedule{ValidUntil: ptr(at("2026-06-01T00:00:00Z"))}
+	if got, want := grant.NextChange(at("2026-03-02T12:00:00Z")), at("2026-06-01T00:00:00Z"); !got.Equal(want) {
+		t.Errorf("NextChange = %v, want %v", got, want)
+	}
+	if got := (&Schedule{}).NextChange(at("2026-03-02T12:00:00Z")); !got.IsZero() {
+		t.Errorf("NextChange of an open schedule = %v", got)
+	}
+}
+
+// TestValidate tests that malformed schedules are rejected
+func TestValidate(t *testing.T) {
+	for _, s := range []*Schedule{
+		{Timezone: "Nowhere/Special"},
+		{ValidFrom: ptr(at("2026-03-02T00:00:00Z")), ValidUntil: ptr(at("2026-03-01T00:00:00Z"))},
+		{Windows: []Window{{Start: "9:00", End: "17:00"}}},
+		{Windows: []Window{{Start: "09:00", End: "24:01"}}},
+		{Windows: []Window{{Start: "09:00", End: "09:00"}}},
+		{Windows: []Window{{Days: []string{"someday"}, Start: "09:00", End: "17:00"}}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", s)
+		}
+	}
+
+	allDay := &Schedule{Windows: []Window{{Days: []string{"Sat", "sun"}, Start: "00:00", End: "24:00"}}}
+	if err := allDay.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if !allDay.Active(at("2026-03-07T23:59:00Z"), 0) {
+		t.Error("all-day window not active at 23:59")
+	}
+}
@@ -0,0 +1,293 @@
+// Package snmp is a read-only SNMPv2c agent, for network operations
+// centres that monitor through SNMP rather than Prometheus. It answers
+// Get, GetNext and GetBulk requests from a snapshot of variables taken per
+// request; the objects exposed are described by MARCHPROXY-MIB.
+package snmp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// Application types of variable values. Plain int and int64 values are
+// encoded as INTEGER and strings as OCTET STRING.
+type (
+	Counter32 uint32
+	Gauge32   uint32
+	TimeTicks uint32 // Hundredths of a second
+	Counter64 uint64
+)
+
+// exception is the value of a variable the agent does not have
+type exception byte
+
+// Var is one variable of the MIB view
+type Var struct {
+	OID   OID
+	Value interface{}
+}
+
+// SNMP error statuses
+const (
+	errorTooBig      = 1
+	errorNotWritable = 17
+)
+
+// versionV2c is the version field of SNMPv2c messages
+const versionV2c = 1
+
+// Limits of a response
+const (
+	maxMessageSize = 1472 // Fits an Ethernet frame without fragmenting
+	maxRepetitions = 64
+)
+
+// Agent answers SNMP requests for the variables returned by walk
+type Agent struct {
+	community []byte
+	walk      func() []Var
+
+	responses    atomic.Uint64
+	badCommunity atomic.Uint64
+	dropped      atomic.Uint64
+}
+
+// NewAgent creates an agent answering requests with community from the
+// variables walk returns
+func NewAgent(community string, walk func() []Var) *Agent {
+	return &Agent{community: []byte(community), walk: walk}
+}
+
+// Serve answers the requests received on conn until it is closed
+func (a *Agent) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if response := a.Handle(buf[:n]); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// request is a decoded SNMPv2c request
+type request struct {
+	pdu        byte
+	requestID  int64
+	nonRepeat  int64 // error-status, the non-repeaters of GetBulk
+	maxRepeat  int64 // error-index, the max-repetitions of GetBulk
+	oids       []OID
+	rawBinding []byte // The variable bindings as received
+}
+
+// Handle answers one request, returning nil for messages that get no
+// response: other SNMP versions, wrong communities and malformed messages
+func (a *Agent) Handle(packet []byte) []byte {
+	req, community, err := decodeRequest(packet)
+	if err != nil {
+		a.dropped.Add(1)
+		return nil
+	}
+	if subtle.ConstantTimeCompare(community, a.community) != 1 {
+		a.badCommunity.Add(1)
+		return nil
+	}
+
+	var bindings []Var
+	errStatus, errIndex := 0, 0
+	switch req.pdu {
+	case pduGet, pduGetNext, pduGetBulk:
+		bindings = a.answer(req)
+	case pduSet:
+		errStatus, errIndex = errorNotWritable, 1
+	default:
+		a.dropped.Add(1)
+		return nil
+	}
+
+	response := encodeResponse(community, req, errStatus, errIndex, bindings)
+	for len(response) > maxMessageSize {
+		if req.pdu != pduGetBulk || len(bindings) <= len(req.oids) {
+			response = encodeResponse(community, req, errorTooBig, 0, []Var{})
+			break
+		}
+		// GetBulk responses are cut short instead
+		bindings = bindings[:len(bindings)-1]
+		response = encodeResponse(community, req, errStatus, errIndex, bindings)
+	}
+	a.responses.Add(1)
+	return response
+}
+
+// answer returns the variable bindings of a Get, GetNext or GetBulk
+func (a *Agent) answer(req *request) []Var {
+	view := a.walk()
+	sort.Slice(view, func(i, j int) bool { return view[i].OID.Compare(view[j].OID) < 0 })
+
+	get := func(oid OID) Var {
+		i := sort.Search(len(view), func(i int) bool { return view[i].OID.Compare(oid) >= 0 })
+		if i < len(view) && view[i].OID.Compare(oid) == 0 {
+			return view[i]
+		}
+		return Var{OID: oid, Value: exception(tagNoSuchObject)}
+	}
+	next := func(oid OID) Var {
+		i := sort.Search(len(view), func(i int) bool { return view[i].OID.Compare(oid) > 0 })
+		if i < len(view) {
+			return view[i]
+		}
+		return Var{OID: oid, Value: exception(tagEndOfMibView)}
+	}
+
+	var bindings []Var
+	switch req.pdu {
+	case pduGet:
+		for _, oid := range req.oids {
+			bindings = append(bindings, get(oid))
+		}
+	case pduGetNext:
+		for _, oid := range req.oids {
+			bindings = append(bindings, next(oid))
+		}
+	case pduGetBulk:
+		nonRepeat := int(min(max(req.nonRepeat, 0), int64(len(req.oids))))
+		repeat := int(min(max(req.maxRepeat, 0), maxRepetitions))
+		for _, oid := range req.oids[:nonRepeat] {
+			bindings = append(bindings, next(oid))
+		}
+		cursors := append([]OID{}, req.oids[nonRepeat:]...)
+		for r := 0; r < repeat && len(cursors) > 0; r++ {
+			done := true
+			for i, oid := range cursors {
+				v := next(oid)
+				bindings = append(bindings, v)
+				cursors[i] = v.OID
+				if _, end := v.Value.(exception); !end {
+					done = false
+				}
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return bindings
+}
+
+// decodeRequest decodes an SNMPv2c message
+func decodeRequest(packet []byte) (*request, []byte, error) {
+	message, _, err := expect(packet, tagSequence)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, rest, err := expect(message, tagInteger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version, err := decodeInt(value); err != nil || version != versionV2c {
+		return nil, nil, errMalformed
+	}
+	community, rest, err := expect(rest, tagOctetString)
+	if err != nil {
+		return nil, nil, err
+	}
+	pdu, body, _, err := readTLV(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &request{pdu: pdu}
+	for _, field := range []*int64{&req.requestID, &req.nonRepeat, &req.maxRepeat} {
+		if value, body, err = expect(body, tagInteger); err != nil {
+			return nil, nil, err
+		}
+		if *field, err = decodeInt(value); err != nil {
+			return nil, nil, err
+		}
+	}
+	bindings, _, err := expect(body, tagSequence)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.rawBinding = bindings
+	for len(bindings) > 0 {
+		var binding, name []byte
+		if binding, bindings, err = expect(bindings, tagSequence); err != nil {
+			return nil, nil, err
+		}
+		if name, _, err = expect(binding, tagOID); err != nil {
+			return nil, nil, err
+		}
+		oid, err := decodeOID(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.oids = append(req.oids, oid)
+	}
+	return req, community, nil
+}
+
+// encodeResponse encodes the Response-PDU of a request. A nil bindings
+// echoes the request's, as error responses to Set do.
+func encodeResponse(community []byte, req *request, errStatus, errIndex int, bindings []Var) []byte {
+	var list []byte
+	if bindings == nil {
+		list = req.rawBinding
+	}
+	for _, v := range bindings {
+		tag, value := encodeValue(v.Value)
+		binding := appendTLV(nil, tagOID, encodeOID(v.OID))
+		binding = appendTLV(binding, tag, value)
+		list = appendTLV(list, tagSequence, binding)
+	}
+
+	pdu := appendTLV(nil, tagInteger, encodeInt(req.requestID))
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(errStatus)))
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(errIndex)))
+	pdu = appendTLV(pdu, tagSequence, list)
+
+	message := appendTLV(nil, tagInteger, encodeInt(versionV2c))
+	message = appendTLV(message, tagOctetString, community)
+	message = appendTLV(message, pduResponse, pdu)
+	return appendTLV(nil, tagSequence, message)
+}
+
+// Stats counts the requests an agent received
+type Stats struct {
+	Answered     uint64
+	BadCommunity uint64
+	Dropped      uint64 // Malformed, other SNMP versions and unsupported PDUs
+}
+
+// Stats returns the requests answered and refused so far
+func (a *Agent) Stats() Stats {
+	return Stats{
+		Answered:     a.responses.Load(),
+		BadCommunity: a.badCommunity.Load(),
+		Dropped:      a.dropped.Load(),
+	}
+}
+
+// WritePrometheus writes the requests answered and refused in Prometheus
+// text format; a nil agent writes nothing
+func (a *Agent) WritePrometheus(w io.Writer) {
+	if a == nil {
+		return
+	}
+	stats := a.Stats()
+	fmt.Fprintf(w, "# HELP marchproxy_snmp_requests_total SNMP requests by result\n")
+	fmt.Fprintf(w, "# TYPE marchproxy_snmp_requests_total counter\n")
+	fmt.Fprintf(w, "marchproxy_snmp_requests_total{result=\"answered\"} %d\n", stats.Answered)
+	fmt.Fprintf(w, "marchproxy_snmp_requests_total{result=\"bad_community\"} %d\n", stats.BadCommunity)
+	fmt.Fprintf(w, "marchproxy_snmp_requests_total{result=\"dropped\"} %d\n", stats.Dropped)
+}
@@ -0,0 +1,243 @@
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BER tags of the types SNMPv2c uses
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagCounter32   = 0x41
+	tagGauge32     = 0x42
+	tagTimeTicks   = 0x43
+	tagCounter64   = 0x46
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	pduGet      = 0xa0
+	pduGetNext  = 0xa1
+	pduResponse = 0xa2
+	pduSet      = 0xa3
+	pduGetBulk  = 0xa5
+)
+
+var errMalformed = errors.New("malformed SNMP message")
+
+// OID is an object identifier
+type OID []uint32
+
+// ParseOID parses a dotted object identifier such as 1.3.6.1.2.1.1.1.0
+func ParseOID(s string) (OID, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make(OID, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = uint32(n)
+	}
+	return oid, nil
+}
+
+// MustParseOID is ParseOID for constant OIDs
+func MustParseOID(s string) OID {
+	oid, err := ParseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return oid
+}
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Append returns the OID with arcs added, such as an instance
+func (o OID) Append(arcs ...uint32) OID {
+	return append(append(OID{}, o...), arcs...)
+}
+
+// Compare orders OIDs lexicographically, as GetNext walks them
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		switch {
+		case o[i] < other[i]:
+			return -1
+		case o[i] > other[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// readTLV splits the first BER element off b
+func readTLV(b []byte) (tag byte, value, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errMalformed
+	}
+	tag = b[0]
+	length := int(b[1])
+	b = b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(b) < n {
+			return 0, nil, nil, errMalformed
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if length > len(b) {
+		return 0, nil, nil, errMalformed
+	}
+	return tag, b[:length], b[length:], nil
+}
+
+// expect splits off the first element, which must have tag
+func expect(b []byte, tag byte) (value, rest []byte, err error) {
+	got, value, rest, err := readTLV(b)
+	if err == nil && got != tag {
+		err = errMalformed
+	}
+	return value, rest, err
+}
+
+func decodeInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errMalformed
+	}
+	n := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+func decodeOID(b []byte) (OID, error) {
+	var arcs OID
+	var n uint64
+	for i, c := range b {
+		n = n<<7 | uint64(c&0x7f)
+		if n > 0xffffffff {
+			return nil, errMalformed
+		}
+		if c&0x80 == 0 {
+			arcs = append(arcs, uint32(n))
+			n = 0
+		} else if i == len(b)-1 {
+			return nil, errMalformed
+		}
+	}
+	if len(arcs) == 0 {
+		return nil, errMalformed
+	}
+	// The first subidentifier holds the first two arcs
+	first := min(arcs[0]/40, 2)
+	return append(OID{first, arcs[0] - first*40}, arcs[1:]...), nil
+}
+
+// appendTLV appends a BER element
+func appendTLV(dst []byte, tag byte, value []byte) []byte {
+	dst = append(dst, tag)
+	switch n := len(value); {
+	case n < 0x80:
+		dst = append(dst, byte(n))
+	case n <= 0xff:
+		dst = append(dst, 0x81, byte(n))
+	case n <= 0xffff:
+		dst = append(dst, 0x82, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, value...)
+}
+
+// encodeInt returns the shortest two's complement encoding of n
+func encodeInt(n int64) []byte {
+	b := []byte{byte(n)}
+	for n > 127 || n < -128 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+// encodeUint encodes an unsigned application type, with a leading zero
+// byte when the high bit is set
+func encodeUint(n uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+func encodeOID(oid OID) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+	var b []byte
+	for _, arc := range append(OID{oid[0]*40 + oid[1]}, oid[2:]...) {
+		chunk := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			chunk = append([]byte{byte(arc&0x7f) | 0x80}, chunk...)
+		}
+		b = append(b, chunk...)
+	}
+	return b
+}
+
+// encodeValue returns the tag and encoding of a variable's value
+func encodeValue(value interface{}) (byte, []byte) {
+	switch v := value.(type) {
+	case int:
+		return tagInteger, encodeInt(int64(v))
+	case int64:
+		return tagInteger, encodeInt(v)
+	case string:
+		return tagOctetString, []byte(v)
+	case Counter32:
+		return tagCounter32, encodeUint(uint64(v))
+	case Gauge32:
+		return tagGauge32, encodeUint(uint64(v))
+	case TimeTicks:
+		return tagTimeTicks, encodeUint(uint64(v))
+	case Counter64:
+		return tagCounter64, encodeUint(uint64(v))
+	case exception:
+		return byte(v), nil
+	}
+	return tagNull, nil
+}
@@ -0,0 +1,82 @@
+package snmp
+
+import "time"
+
+// MIB is the root of MARCHPROXY-MIB, marchProxyMIB under the enterprise
+// number 32473. That number is reserved for documentation (RFC 5612);
+// deployments with a registered enterprise number can re-root the MIB.
+var MIB = MustParseOID("1.3.6.1.4.1.32473.1")
+
+// Health states of mpHealthState
+const (
+	HealthReady    = 1
+	HealthStarting = 2 // Startup steps pending
+	HealthUnready  = 3 // Taken out of rotation, such as during a drain
+)
+
+// Certificate is a row of mpCertTable
+type Certificate struct {
+	Source   string
+	Role     string
+	Subject  string
+	NotAfter time.Time
+}
+
+// Status is what a module exposes through MARCHPROXY-MIB
+type Status struct {
+	Version      string
+	Module       string
+	Uptime       time.Duration
+	Health       int
+	HealthReason string // Pending steps or the unready reason
+
+	ActiveConnections uint64
+	Connections       uint64 // Accepted, or requests served by HTTP modules
+	BytesTransferred  uint64
+	AuthFailures      uint64
+
+	Certificates []Certificate // Soonest expiry first
+}
+
+// Vars returns the MIB variables of the status at now
+func (s Status) Vars(now time.Time) []Var {
+	objects := MIB.Append(1)
+	system, health, traffic, certificates := objects.Append(1), objects.Append(2), objects.Append(3), objects.Append(4)
+
+	vars := []Var{
+		{OID: system.Append(1, 0), Value: s.Version},
+		{OID: system.Append(2, 0), Value: s.Module},
+		{OID: system.Append(3, 0), Value: TimeTicks(uint32(s.Uptime / (10 * time.Millisecond)))},
+		{OID: health.Append(1, 0), Value: s.Health},
+		{OID: health.Append(2, 0), Value: s.HealthReason},
+		{OID: traffic.Append(1, 0), Value: Gauge32(min(s.ActiveConnections, 1<<32-1))},
+		{OID: traffic.Append(2, 0), Value: Counter64(s.Connections)},
+		{OID: traffic.Append(3, 0), Value: Counter64(s.BytesTransferred)},
+		{OID: traffic.Append(4, 0), Value: Counter64(s.AuthFailures)},
+		{OID: certificates.Append(1, 0), Value: Gauge32(len(s.Certificates))},
+	}
+
+	// mpCertEntry columns, indexed from 1 in expiry order
+	entry := certificates.Append(2, 1)
+	minDays := int64(0)
+	for i, cert := range s.Certificates {
+		index := uint32(i + 1)
+		days := int64(cert.NotAfter.Sub(now).Hours() / 24)
+		if i == 0 || days < minDays {
+			minDays = days
+		}
+		vars = append(vars,
+			Var{OID: entry.Append(1, index), Value: int(index)},
+			Var{OID: entry.Append(2, index), Value: cert.Source},
+			Var{OID: entry.Append(3, index), Value: cert.Role},
+			Var{OID: entry.Append(4, index), Value: cert.Subject},
+			Var{OID: entry.Append(5, index), Value: cert.NotAfter.UTC().Format(time.RFC3339)},
+			Var{OID: entry.Append(6, index), Value: days},
+		)
+	}
+	// Without certificates there is no soonest expiry to report
+	if len(s.Certificates) > 0 {
+		vars = append(vars, Var{OID: certificates.Append(3, 0), Value: minDays})
+	}
+	return vars
+}
@@ -0,0 +1,204 @@
+package snmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// encodeRequest encodes an SNMPv2c request for oids
+func encodeRequest(pdu byte, community string, errStatus, errIndex int64, oids ...string) []byte {
+	var list []byte
+	for _, oid := range oids {
+		binding := appendTLV(nil, tagOID, encodeOID(MustParseOID(oid)))
+		binding = appendTLV(binding, tagNull, nil)
+		list = appendTLV(list, tagSequence, binding)
+	}
+	body := appendTLV(nil, tagInteger, encodeInt(42))
+	body = appendTLV(body, tagInteger, encodeInt(errStatus))
+	body = appendTLV(body, tagInteger, encodeInt(errIndex))
+	body = appendTLV(body, tagSequence, list)
+	message := appendTLV(nil, tagInteger, encodeInt(versionV2c))
+	message = appendTLV(message, tagOctetString, []byte(community))
+	message = appendTLV(message, pdu, body)
+	return appendTLV(nil, tagSequence, message)
+}
+
+// binding is a decoded variable binding of a response
+type binding struct {
+	oid   string
+	tag   byte
+	value []byte
+}
+
+// decodeResponse returns the error status and bindings of a response
+func decodeResponse(t *testing.T, packet []byte) (int64, []binding) {
+	t.Helper()
+	message, _, err := expect(packet, tagSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rest, _ := expect(message, tagInteger)
+	_, rest, _ = expect(rest, tagOctetString)
+	body, _, err := expect(rest, pduResponse)
+	if err != nil {
+		t.Fatalf("not a response: %v", err)
+	}
+	value, body, _ := expect(body, tagInteger)
+	if id, _ := decodeInt(value); id != 42 {
+		t.Errorf("request-id = %d", id)
+	}
+	value, body, _ = expect(body, tagInteger)
+	status, _ := decodeInt(value)
+	_, body, _ = expect(body, tagInteger)
+	list, _, _ := expect(body, tagSequence)
+
+	var bindings []binding
+	for len(list) > 0 {
+		var raw []byte
+		raw, list, _ = expect(list, tagSequence)
+		name, raw, _ := expect(raw, tagOID)
+		oid, _ := decodeOID(name)
+		tag, value, _, _ := readTLV(raw)
+		bindings = append(bindings, binding{oid: oid.String(), tag: tag, value: value})
+	}
+	return status, bindings
+}
+
+func testAgent() *Agent {
+	base := MustParseOID("1.3.6.1.4.1.32473.1.1")
+	return NewAgent("noc", func() []Var {
+		return []Var{
+			{OID: base.Append(3, 2, 0), Value: Counter64(1 << 40)},
+			{OID: base.Append(1, 1, 0), Value: "v1.2.3"},
+			{OID: base.Append(3, 1, 0), Value: Gauge32(7)},
+			{OID: base.Append(2, 1, 0), Value: 1},
+		}
+	})
+}
+
+func TestAgent(t *testing.T) {
+	agent := testAgent()
+	const base = "1.3.6.1.4.1.32473.1.1"
+
+	status, bindings := decodeResponse(t, agent.Handle(encodeRequest(pduGet, "noc", 0, 0, base+".1.1.0", base+".9.0")))
+	if status != 0 || len(bindings) != 2 || string(bindings[0].value) != "v1.2.3" || bindings[1].tag != tagNoSuchObject {
+		t.Errorf("Get = %d %+v", status, bindings)
+	}
+
+	// GetNext walks in OID order, whatever order walk returned
+	_, bindings = decodeResponse(t, agent.Handle(encodeRequest(pduGetNext, "noc", 0, 0, base+".1.1.0", base+".3.2.0")))
+	if len(bindings) != 2 || bindings[0].oid != base+".2.1.0" || bindings[0].tag != tagInteger || bindings[1].tag != tagEndOfMibView {
+		t.Errorf("GetNext = %+v", bindings)
+	}
+
+	// One non-repeater, then repetitions until the end of the view
+	_, bindings = decodeResponse(t, agent.Handle(encodeRequest(pduGetBulk, "noc", 1, 10, base, base+".2")))
+	var walked []string
+	for _, b := range bindings {
+		walked = append(walked, b.oid)
+	}
+	want := []string{base + ".1.1.0", base + ".2.1.0", base + ".3.1.0", base + ".3.2.0", base + ".3.2.0"}
+	if len(walked) != len(want) || bindings[len(bindings)-1].tag != tagEndOfMibView {
+		t.Fatalf("GetBulk walked %v, want %v", walked, want)
+	}
+	for i := range want {
+		if walked[i] != want[i] {
+			t.Errorf("GetBulk walked %v, want %v", walked, want)
+			break
+		}
+	}
+	if bindings[3].tag != tagCounter64 || !bytes.Equal(bindings[3].value, []byte{1, 0, 0, 0, 0, 0}) {
+		t.Errorf("Counter64 = %x %x", bindings[3].tag, bindings[3].value)
+	}
+
+	if status, _ := decodeResponse(t, agent.Handle(encodeRequest(pduSet, "noc", 0, 0, base+".1.1.0"))); status != errorNotWritable {
+		t.Errorf("Set status = %d, want notWritable", status)
+	}
+	if response := agent.Handle(encodeRequest(pduGet, "public", 0, 0, base+".1.1.0")); response != nil {
+		t.Error("answered a request with the wrong community")
+	}
+	if response := agent.Handle([]byte{0x30, 0x05, 0x02}); response != nil {
+		t.Error("answered a malformed message")
+	}
+	if stats := agent.Stats(); stats != (Stats{Answered: 4, BadCommunity: 1, Dropped: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestServe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- testAgent().Serve(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(encodeRequest(pduGet, "noc", 0, 0, "1.3.6.1.4.1.32473.1.1.3.1.0"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxMessageSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, bindings := decodeResponse(t, buf[:n]); len(bindings) != 1 || bindings[0].tag != tagGauge32 || !bytes.Equal(bindings[0].value, []byte{7}) {
+		t.Errorf("bindings = %+v", bindings)
+	}
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve = %v after close", err)
+	}
+}
+
+func TestOID(t *testing.T) {
+	for _, s := range []string{"1.3.6.1.4.1.32473.1", "1.3.6.1.2.1.1.1.0", "2.999.4294967295"} {
+		oid := MustParseOID(s)
+		decoded, err := decodeOID(encodeOID(oid))
+		if err != nil || decoded.String() != s {
+			t.Errorf("OID %s round-tripped to %v (%v)", s, decoded, err)
+		}
+	}
+	for _, n := range []int64{0, 127, 128, -1, -129, 1 << 40} {
+		if got, _ := decodeInt(encodeInt(n)); got != n {
+			t.Errorf("INTEGER %d decoded as %d", n, got)
+		}
+	}
+}
+
+func TestStatusVars(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := Status{
+		Module: "egress",
+		Uptime: 90 * time.Second,
+		Health: HealthReady,
+		Certificates: []Certificate{
+			{Source: "mtls", Role: "ca", NotAfter: now.Add(-48 * time.Hour)},
+			{Source: "mtls", Role: "server", NotAfter: now.Add(30 * 24 * time.Hour)},
+		},
+	}
+	values := make(map[string]interface{})
+	for _, v := range status.Vars(now) {
+		values[v.OID.String()] = v.Value
+	}
+	const objects = "1.3.6.1.4.1.32473.1.1"
+	for oid, want := range map[string]interface{}{
+		objects + ".1.2.0":     "egress",
+		objects + ".1.3.0":     TimeTicks(9000),
+		objects + ".2.1.0":     HealthReady,
+		objects + ".4.1.0":     Gauge32(2),
+		objects + ".4.2.1.3.2": "server",
+		objects + ".4.2.1.6.2": int64(30),
+		objects + ".4.3.0":     int64(-2),
+	} {
+		if values[oid] != want {
+			t.Errorf("%s = %v, want %v", oid, values[oid], want)
+		}
+	}
+}
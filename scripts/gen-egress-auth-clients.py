@@ -0,0 +1,117 @@
+#!/usr/bin/env python3
+"""
+gen-egress-auth-clients.py - Generate the egress auth protocol constants of
+the Python and Java client helpers from proto/marchproxy/egress_auth.proto
+
+The handshake is a text protocol, so protoc output doesn't help clients
+speak it. This script reads the versions, wire keywords and failure reasons
+of the spec and writes them as constants for the hand-written helpers in
+proxy-egress/clients. Run it after changing the spec; --check fails when
+the generated files are out of date, for CI.
+"""
+
+import argparse
+import re
+import sys
+from pathlib import Path
+
+PROJECT_ROOT = Path(__file__).resolve().parent.parent
+SPEC = PROJECT_ROOT / "proto" / "marchproxy" / "egress_auth.proto"
+PYTHON_OUT = PROJECT_ROOT / "proxy-egress" / "clients" / "python" / "marchproxy_egress" / "protocol.py"
+JAVA_OUT = (
+    PROJECT_ROOT / "proxy-egress" / "clients" / "java" / "src" / "main" / "java"
+    / "com" / "penguintech" / "marchproxy" / "egress" / "EgressAuthProtocol.java"
+)
+
+ENUM_RE = re.compile(r"^enum (\w+) \{(.*?)^\}", re.MULTILINE | re.DOTALL)
+VALUE_RE = re.compile(r"^\s*(\w+) = (\d+)(?: \[\(egress_auth_wire\) = \"([^\"]*)\"\])?;", re.MULTILINE)
+
+HEADER = "Code generated by scripts/gen-egress-auth-clients.py from proto/marchproxy/egress_auth.proto. DO NOT EDIT."
+
+
+def parse_enums(spec):
+    """Return each enum of the spec as a list of (name, number, wire) without
+    its UNSPECIFIED value and with the enum's prefix removed from names"""
+    enums = {}
+    for name, body in ENUM_RE.findall(spec):
+        prefix = re.sub(r"(?<!^)(?=[A-Z])", "_", name).upper() + "_"
+        values = []
+        for value, number, wire in VALUE_RE.findall(body):
+            if int(number) == 0:
+                continue
+            values.append((value.removeprefix(prefix), int(number), wire))
+        enums[name] = values
+    return enums
+
+
+def python_source(enums):
+    lines = [f"# {HEADER}", '"""Egress auth handshake constants"""', ""]
+    lines.append("# Handshake protocol versions")
+    for name, number, _ in enums["EgressAuthVersion"]:
+        lines.append(f"VERSION_{name} = {number}")
+    latest = max(number for _, number, _ in enums["EgressAuthVersion"])
+    lines.append(f"LATEST_VERSION = {latest}")
+    lines += ["", "# Keywords that start a handshake line"]
+    for name, _, wire in enums["EgressAuthKeyword"]:
+        lines.append(f'{name} = "{wire}"')
+    lines += ["", "# Reasons of an AUTH_FAIL line"]
+    for name, _, wire in enums["EgressAuthFailureReason"]:
+        lines.append(f'FAIL_{name} = "{wire}"')
+    return "\n".join(lines) + "\n"
+
+
+def java_source(enums):
+    lines = [
+        f"// {HEADER}",
+        "",
+        "package com.penguintech.marchproxy.egress;",
+        "",
+        "/** Egress auth handshake constants */",
+        "public final class EgressAuthProtocol {",
+        "    private EgressAuthProtocol() {}",
+        "",
+        "    // Handshake protocol versions",
+    ]
+    for name, number, _ in enums["EgressAuthVersion"]:
+        lines.append(f"    public static final int VERSION_{name} = {number};")
+    latest = max(number for _, number, _ in enums["EgressAuthVersion"])
+    lines.append(f"    public static final int LATEST_VERSION = {latest};")
+    lines += ["", "    // Keywords that start a handshake line"]
+    for name, _, wire in enums["EgressAuthKeyword"]:
+        lines.append(f'    public static final String {name} = "{wire}";')
+    lines += ["", "    // Reasons of an AUTH_FAIL line"]
+    for name, _, wire in enums["EgressAuthFailureReason"]:
+        lines.append(f'    public static final String FAIL_{name} = "{wire}";')
+    lines.append("}")
+    return "\n".join(lines) + "\n"
+
+
+def main():
+    parser = argparse.ArgumentParser(description="Generate the egress auth client constants")
+    parser.add_argument("--check", action="store_true", help="fail when the generated files are out of date")
+    args = parser.parse_args()
+
+    enums = parse_enums(SPEC.read_text())
+    for required in ("EgressAuthVersion", "EgressAuthKeyword", "EgressAuthFailureReason"):
+        if not enums.get(required):
+            sys.exit(f"Error: enum {required} not found in {SPEC}")
+
+    stale = []
+    for path, source in ((PYTHON_OUT, python_source(enums)), (JAVA_OUT, java_source(enums))):
+        if path.exists() and path.read_text() == source:
+            continue
+        if args.check:
+            stale.append(path)
+            continue
+        path.parent.mkdir(parents=True, exist_ok=True)
+        path.write_text(source)
+        print(f"Generated {path.relative_to(PROJECT_ROOT)}")
+
+    if stale:
+        for path in stale:
+            print(f"Out of date: {path.relative_to(PROJECT_ROOT)}", file=sys.stderr)
+        sys.exit("Run scripts/gen-egress-auth-clients.py to regenerate")
+
+
+if __name__ == "__main__":
+    main()
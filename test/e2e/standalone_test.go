@@ -0,0 +1,365 @@
+// End-to-end tests that boot the proxies in standalone mode, without a
+// manager, against local upstreams
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const standaloneStartTimeout = 20 * time.Second
+
+// standaloneProxy describes how to build one proxy binary. The binary can
+// also be supplied prebuilt through BinaryEnv, e.g. from a release build.
+type standaloneProxy struct {
+	Name      string
+	Dir       string
+	Package   string
+	BinaryEnv string
+}
+
+var (
+	egressProxy  = standaloneProxy{"egress", "../../proxy-egress", "./cmd/proxy", "MARCHPROXY_EGRESS_BIN"}
+	ingressProxy = standaloneProxy{"ingress", "../../proxy-ingress", "./cmd/proxy", "MARCHPROXY_INGRESS_BIN"}
+	nlbProxy     = standaloneProxy{"nlb", "../../proxy-nlb", "./cmd/nlb", "MARCHPROXY_NLB_BIN"}
+)
+
+// binary returns the path to the proxy binary, building it when needed.
+// The test is skipped when the proxy cannot be built in this environment.
+func (p standaloneProxy) binary(t *testing.T) string {
+	t.Helper()
+	if path := os.Getenv(p.BinaryEnv); path != "" {
+		return path
+	}
+
+	path := filepath.Join(t.TempDir(), "marchproxy-"+p.Name)
+	cmd := exec.Command("go", "build", "-o", path, p.Package)
+	cmd.Dir = p.Dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Cannot build the %s proxy (set %s to use a prebuilt binary): %v\n%s",
+			p.Name, p.BinaryEnv, err, output)
+	}
+	return path
+}
+
+// lockedBuffer collects process output written from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startProcess runs a proxy until the test ends. Its output is logged when
+// the test fails.
+func startProcess(t *testing.T, name, binary string, env []string, args ...string) {
+	t.Helper()
+	output := &lockedBuffer{}
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	require.NoError(t, cmd.Start(), "failed to start %s", name)
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("%s output:\n%s", name, output.String())
+		}
+	})
+}
+
+// freePort returns a TCP port that is free at the time of the call
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitForHTTP polls url until it answers 200 or the start timeout passes
+func waitForHTTP(t *testing.T, url string) {
+	t.Helper()
+	deadline := time.Now().Add(standaloneStartTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s did not become ready within %v", url, standaloneStartTimeout)
+}
+
+// getBody fetches url and returns the status code and body
+func getBody(t *testing.T, url, host string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if host != "" {
+		req.Host = host
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// writeFile writes a config file into the test's temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+// startTCPEcho runs a TCP echo upstream until the test ends
+func startTCPEcho(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startHTTPBackend runs an HTTP upstream that names itself and the request
+func startHTTPBackend(t *testing.T, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", name, r.Host, r.URL.Path)
+	})}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+// egressHandshake authenticates to the egress proxy and reports whether
+// the proxy accepted the credentials
+func egressHandshake(t *testing.T, conn net.Conn, reader *bufio.Reader, credentials string) bool {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err, "reading the auth challenge")
+		if strings.Contains(line, "SERVICE_ID:TOKEN") {
+			break
+		}
+	}
+	_, err := io.WriteString(conn, credentials+"\n")
+	require.NoError(t, err)
+	result, err := reader.ReadString('\n')
+	return err == nil && strings.TrimSpace(result) == "AUTH_OK"
+}
+
+// TestStandaloneEndToEnd boots egress, ingress and the NLB from local
+// cluster config files and checks routing, authentication and metrics
+func TestStandaloneEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping end-to-end test in short mode")
+	}
+
+	egressListen, egressAdmin := freePort(t), freePort(t)
+	ingressListen, ingressAdmin := freePort(t), freePort(t)
+
+	t.Run("Egress", func(t *testing.T) {
+		binary := egressProxy.binary(t)
+		echoPort := startTCPEcho(t)
+		clusterConfig := writeFile(t, "egress.yaml", fmt.Sprintf(`
+cluster:
+  id: 1
+  name: e2e
+services:
+  - id: 1
+    name: client
+    ip_fqdn: 127.0.0.1
+    auth_type: base64
+    auth_token: e2e-secret
+  - id: 2
+    name: echo
+    ip_fqdn: 127.0.0.1
+mappings:
+  - id: 1
+    name: client-to-echo
+    source_services: [1]
+    dest_services: [2]
+    protocols: [tcp]
+    ports: "%d"
+    auth_required: true
+`, echoPort))
+
+		startProcess(t, "egress", binary, nil,
+			"--standalone-config", clusterConfig,
+			"--listen-port", fmt.Sprint(egressListen),
+			"--admin-port", fmt.Sprint(egressAdmin),
+			"--enable-ebpf=false")
+		admin := fmt.Sprintf("http://127.0.0.1:%d", egressAdmin)
+		waitForHTTP(t, admin+"/healthz")
+
+		proxyAddr := fmt.Sprintf("127.0.0.1:%d", egressListen)
+
+		// Authenticated clients reach the upstream through the mapping
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		require.True(t, egressHandshake(t, conn, reader, "1:e2e-secret"), "valid credentials should be accepted")
+		_, err = io.WriteString(conn, "ping through egress\n")
+		require.NoError(t, err)
+		echoed, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "ping through egress\n", echoed)
+
+		// A wrong token never reaches the upstream
+		badConn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		defer badConn.Close()
+		assert.False(t, egressHandshake(t, badConn, bufio.NewReader(badConn), "1:wrong"),
+			"invalid credentials should be rejected")
+
+		status, metrics := getBody(t, admin+"/metrics", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Contains(t, metrics, "marchproxy_auth_successes_total 1")
+		assert.Contains(t, metrics, "marchproxy_auth_failures_total 1")
+
+		status, body := getBody(t, admin+"/admin/config", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "client-to-echo")
+	})
+
+	t.Run("Ingress", func(t *testing.T) {
+		binary := ingressProxy.binary(t)
+		backend := startHTTPBackend(t, "web")
+		clusterConfig := writeFile(t, "ingress.yaml", fmt.Sprintf(`
+cluster:
+  id: 1
+  name: e2e
+services:
+  - id: 1
+    name: web
+    ip_fqdn: %s
+ingress_routes:
+  - id: 1
+    name: web
+    host_pattern: app.e2e.test
+    path_pattern: /
+    backend_services: [1]
+`, backend))
+
+		startProcess(t, "ingress", binary, []string{"STANDALONE_CONFIG=" + clusterConfig},
+			"--listen-port", fmt.Sprint(ingressListen),
+			"--admin-port", fmt.Sprint(ingressAdmin),
+			"--enable-ebpf=false",
+			"--enable-mtls=false")
+		admin := fmt.Sprintf("http://127.0.0.1:%d", ingressAdmin)
+		waitForHTTP(t, admin+"/healthz")
+
+		proxyURL := fmt.Sprintf("http://127.0.0.1:%d/hello", ingressListen)
+
+		// Requests are routed by Host header
+		status, body := getBody(t, proxyURL, "app.e2e.test")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "web app.e2e.test /hello")
+
+		status, _ = getBody(t, proxyURL, "unknown.e2e.test")
+		assert.Equal(t, http.StatusNotFound, status)
+
+		status, metrics := getBody(t, admin+"/metrics", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Contains(t, metrics, "marchproxy_ingress_")
+	})
+
+	t.Run("NLB", func(t *testing.T) {
+		binary := nlbProxy.binary(t)
+		metricsPort := freePort(t)
+		// The NLB has no manager to discover modules, so list the proxies
+		// started above as static modules
+		config := writeFile(t, "nlb.yaml", fmt.Sprintf(`
+standalone: true
+bind_addr: 127.0.0.1:%d
+grpc_addr: 127.0.0.1
+grpc_port: %d
+metrics_addr: 127.0.0.1:%d
+enable_autoscaling: false
+enable_bluegreen: false
+static_modules:
+  - name: ingress-e2e
+    protocol: http
+    address: 127.0.0.1:%d
+  - name: egress-e2e
+    protocol: http
+    address: 127.0.0.1:%d
+    weight: 2
+`, freePort(t), freePort(t), metricsPort, ingressListen, egressListen))
+
+		startProcess(t, "nlb", binary, nil, "--config", config)
+		admin := fmt.Sprintf("http://127.0.0.1:%d", metricsPort)
+		waitForHTTP(t, admin+"/healthz")
+
+		status, body := getBody(t, admin+"/status", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "ingress-e2e")
+		assert.Contains(t, body, "egress-e2e")
+
+		status, metrics := getBody(t, admin+"/metrics", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Contains(t, metrics, "nlb_")
+	})
+}